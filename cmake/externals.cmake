@@ -15,7 +15,7 @@ set_property(DIRECTORY PROPERTY EP_BASE "${CMAKE_BINARY_DIR}/ep_base")
 if(INCLUDE_SANDBOX)
     set(PLUGIN_LOADER ${PLUGIN_LOADER} "github.com/mozilla-services/heka/sandbox/plugins")
     set(SANDBOX_PACKAGE "lua_sandbox")
-    set(SANDBOX_ARGS -DCMAKE_BUILD_TYPE=${CMAKE_BUILD_TYPE} -DCMAKE_INSTALL_PREFIX=${PROJECT_PATH} -DADDRESS_MODEL=${ADDRESS_MODEL} -DLUA_JIT=off --no-warn-unused-cli)
+    set(SANDBOX_ARGS -DCMAKE_BUILD_TYPE=${CMAKE_BUILD_TYPE} -DCMAKE_INSTALL_PREFIX=${PROJECT_PATH} -DADDRESS_MODEL=${ADDRESS_MODEL} -DLUA_JIT=${LUA_JIT} --no-warn-unused-cli)
     externalproject_add(
         ${SANDBOX_PACKAGE}
         GIT_REPOSITORY https://github.com/mozilla-services/lua_sandbox.git
@@ -60,6 +60,23 @@ function(git_clone url tag)
     add_dependencies(GoPackages ${name})
 endfunction(git_clone)
 
+# Like git_clone, for packages whose import path differs from the repository
+# URL, e.g. golang.org/x/net.
+function(git_clone_path url tag import_path)
+    parse_url(${url})
+    externalproject_add(
+        ${name}
+        GIT_REPOSITORY ${url}
+        GIT_TAG ${tag}
+        SOURCE_DIR "${PROJECT_PATH}/src/${import_path}"
+        BUILD_COMMAND ""
+        CONFIGURE_COMMAND ""
+        INSTALL_COMMAND ""
+        UPDATE_COMMAND "" # comment out to enable updates
+    )
+    add_dependencies(GoPackages ${name})
+endfunction(git_clone_path)
+
 function(hg_clone url tag)
     parse_url(${url})
     externalproject_add(
@@ -138,11 +155,17 @@ endfunction(add_external_plugin)
 git_clone(https://github.com/rafrombrc/gomock c922279faf77f29ce5781e96eb0711837fcb477c)
 add_custom_command(TARGET gomock POST_BUILD
 COMMAND ${GO_EXECUTABLE} install github.com/rafrombrc/gomock/mockgen)
+# `go tool yacc` was removed in Go 1.8.
+git_clone_path(https://go.googlesource.com/tools v0.1.12 golang.org/x/tools)
+add_custom_command(TARGET tools POST_BUILD
+COMMAND ${GO_EXECUTABLE} install golang.org/x/tools/cmd/goyacc)
 git_clone(https://github.com/bitly/go-simplejson ec501b3f691bcc79d97caf8fdf28bcf136efdab8)
 git_clone(https://github.com/rafrombrc/whisper-go 89e9ba3b5c6a10d8ac43bd1a25371f3e6118c37f)
 git_clone(https://github.com/rafrombrc/go-notify e3ddb616eea90d4e87dff8513c251ff514678406)
 git_clone(https://github.com/bbangert/toml a2063ce2e5cf10e54ab24075840593d60f59b611)
+git_clone(https://gopkg.in/yaml.v2 bef53efd0c76)
 git_clone(https://github.com/streadway/amqp 7d6d1802c7710be39564a287f860360c6328f956)
+git_clone(https://github.com/Azure/go-amqp v1.0.5)
 git_clone(https://github.com/feyeleanor/raw 724aedf6e1a5d8971aafec384b6bde3d5608fba4)
 git_clone(https://github.com/feyeleanor/slices bb44bb2e4817fe71ba7082d351fd582e7d40e3ea)
 add_dependencies(slices raw)
@@ -153,15 +176,53 @@ git_clone(https://github.com/rafrombrc/gospec 2e46585948f47047b0c217d00fa24bbc4e
 git_clone(https://github.com/crankycoder/g2s 2594f7a035ed881bb10618bc5dc4440ef35c6a29)
 git_clone(https://github.com/crankycoder/xmlpath 670b185b686fd11aa115291fb2f6dc3ed7ebb488)
 git_clone(https://github.com/thoj/go-ircevent 90dc7f966b95d133f1c65531c6959b52effd5e40)
-
-hg_clone(https://code.google.com/p/snappy-go default)
-git_clone(https://github.com/Shopify/sarama ab8518c05fd3775bdbf06c97d97389fe8af2dfef)
-add_dependencies(sarama snappy-go)
+git_clone(https://github.com/robertkrimen/otto v0.2.1)
+git_clone(https://github.com/lib/pq v1.10.9)
+git_clone(https://github.com/ClickHouse/clickhouse-go v1.5.4)
+git_clone_path(https://github.com/go-sourcemap/sourcemap v1.0.5 gopkg.in/sourcemap.v1)
+add_dependencies(otto sourcemap text)
+
+git_clone(https://github.com/golang/snappy v0.0.1)
+git_clone(https://github.com/eapache/go-xerial-snappy 776d5712da21)
+add_dependencies(go-xerial-snappy snappy)
+git_clone(https://github.com/eapache/go-resiliency v1.1.0)
+git_clone(https://github.com/eapache/queue v1.1.0)
+git_clone(https://github.com/pierrec/lz4 v2.0.5)
+git_clone(https://github.com/rcrowley/go-metrics 3113b8401b8a)
+git_clone(https://github.com/davecgh/go-spew v1.1.1)
+git_clone(https://github.com/Shopify/sarama v1.19.0)
+add_dependencies(sarama go-xerial-snappy go-resiliency queue lz4 go-metrics go-spew)
+git_clone(https://github.com/samuel/go-zookeeper c4fab1ac1bec)
+
+# The versions grpc-go v1.56.3 requires.
+git_clone_path(https://github.com/protocolbuffers/protobuf-go v1.30.0 google.golang.org/protobuf)
+git_clone(https://github.com/golang/protobuf v1.5.3)
+add_dependencies(protobuf protobuf-go)
+git_clone_path(https://go.googlesource.com/text v0.9.0 golang.org/x/text)
+git_clone_path(https://go.googlesource.com/net v0.9.0 golang.org/x/net)
+add_dependencies(net text)
+git_clone_path(https://go.googlesource.com/sys v0.7.0 golang.org/x/sys)
+git_clone_path(https://github.com/google/go-genproto daa745c078e1 google.golang.org/genproto)
+add_dependencies(go-genproto protobuf protobuf-go)
+git_clone_path(https://github.com/grpc/grpc-go v1.56.3 google.golang.org/grpc)
+add_dependencies(grpc-go protobuf protobuf-go net sys go-genproto)
+git_clone(https://github.com/fsnotify/fsnotify v1.4.2)
+add_dependencies(fsnotify sys)
+
+if (INCLUDE_WASM)
+    git_clone(https://github.com/bytecodealliance/wasmtime-go v1.0.0)
+endif()
 
 if (INCLUDE_GEOIP)
     add_external_plugin(git https://github.com/abh/geoip da130741c8ed2052f5f455d56e552f2e997e1ce9)
 endif()
 
+if (INCLUDE_JOURNALD)
+    git_clone(https://github.com/coreos/pkg v4)
+    git_clone(https://github.com/coreos/go-systemd v17)
+    add_dependencies(go-systemd pkg)
+endif()
+
 if (INCLUDE_DOCKER_PLUGINS)
     git_clone(https://github.com/rafrombrc/go-dockerclient 253de7054ca5defe718269e17732e24cdadc3d21)
 endif()
@@ -173,6 +234,7 @@ if (INCLUDE_MOZSVC)
 endif()
 
 hg_clone(https://code.google.com/p/go-uuid default)
+hg_clone(https://code.google.com/p/go.text default)
 git_clone(https://code.google.com/p/gogoprotobuf 7008a93e68bf)
 add_custom_command(TARGET gogoprotobuf POST_BUILD
 COMMAND ${GO_EXECUTABLE} install code.google.com/p/gogoprotobuf/protoc-gen-gogo)
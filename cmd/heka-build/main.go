@@ -0,0 +1,76 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+/*
+Heka build manifest tool.
+
+Reads a manifest of external plugin repositories, each pinned to a version,
+and generates the files needed to build them into a custom hekad binary: the
+hekad `plugin_loader.go` that imports the plugin packages, the
+`plugin_loader.cmake` file that makes the cmake build check out each
+repository at its pinned version, and optionally a `require` block for Go
+modules builds.
+*/
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+)
+
+func main() {
+	manifestPath := flag.String("manifest", "plugin_loader.toml",
+		"External plugin manifest file.")
+	loaderPath := flag.String("loader", filepath.FromSlash("cmd/hekad/plugin_loader.go"),
+		"Generated hekad plugin loader source file, not written if empty.")
+	cmakePath := flag.String("cmake", filepath.FromSlash("cmake/plugin_loader.cmake"),
+		"Generated cmake plugin loader file, not written if empty.")
+	goModPath := flag.String("gomod", "",
+		"Generated file containing a go.mod `require` block, not written if empty.")
+	flag.Parse()
+
+	data, err := ioutil.ReadFile(*manifestPath)
+	if err != nil {
+		log.Fatalf("Error reading manifest: %s", err)
+	}
+	manifest, err := ParseManifest(data)
+	if err != nil {
+		log.Fatalf("Error in manifest %s: %s", *manifestPath, err)
+	}
+	name := filepath.Base(*manifestPath)
+
+	if *loaderPath != "" {
+		src, err := manifest.LoaderSource(name)
+		if err != nil {
+			log.Fatalf("Error generating plugin loader: %s", err)
+		}
+		write(*loaderPath, src)
+	}
+	if *cmakePath != "" {
+		write(*cmakePath, manifest.CmakeSource(name))
+	}
+	if *goModPath != "" {
+		src, err := manifest.GoModSource()
+		if err != nil {
+			log.Fatalf("Error generating go.mod requirements: %s", err)
+		}
+		write(*goModPath, src)
+	}
+}
+
+func write(path string, data []byte) {
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		log.Fatalf("Error writing %s: %s", path, err)
+	}
+	log.Printf("Wrote %s", path)
+}
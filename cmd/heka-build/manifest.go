@@ -0,0 +1,170 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/bbangert/toml"
+	"go/format"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// An external plugin repository to build into hekad.
+type ExternalPlugin struct {
+	// Repository URL, e.g. "https://github.com/example/heka-plugins".
+	Url string
+	// Tag, branch, or commit to check out, or ":local" to copy the
+	// repository from {heka root}/externals.
+	Version string
+	// Version control system, "git", "hg", or "svn". Defaults to "git".
+	Vcs string
+	// Go import path of the repository root. Defaults to the URL without its
+	// scheme, user info, and port.
+	Import string
+	// Sub-packages of the repository that register plugins.
+	Packages []string
+	// Whether to skip importing the repository root, for repositories whose
+	// plugins all live in sub-packages.
+	IgnoreRoot bool `toml:"ignore_root"`
+}
+
+type Manifest struct {
+	Plugin []ExternalPlugin
+}
+
+var (
+	urlSchemeRe   = regexp.MustCompile(`^[a-zA-Z][-+.a-zA-Z0-9]+://`)
+	urlUserInfoRe = regexp.MustCompile(`^[A-Za-z0-9$\-._~!:;=]+@`)
+	urlPortRe     = regexp.MustCompile(`^([^:/]+):[0-9]+/`)
+	urlColonRe    = regexp.MustCompile(`^([^:/]+):/?`)
+)
+
+// Derives a Go import path from a repository URL, the same way the cmake
+// build's `parse_url` function does.
+func importPath(url string) string {
+	path := urlSchemeRe.ReplaceAllString(url, "")
+	path = urlUserInfoRe.ReplaceAllString(path, "")
+	path = urlPortRe.ReplaceAllString(path, "$1/")
+	path = urlColonRe.ReplaceAllString(path, "$1/")
+	if i := strings.Index(path, "#"); i != -1 {
+		path = path[:i]
+	}
+	return strings.TrimSuffix(path, ".git")
+}
+
+// Parses and validates a manifest, filling in the defaults.
+func ParseManifest(data []byte) (*Manifest, error) {
+	manifest := new(Manifest)
+	if _, err := toml.Decode(string(data), manifest); err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	for i := range manifest.Plugin {
+		plugin := &manifest.Plugin[i]
+		if plugin.Url == "" {
+			return nil, fmt.Errorf("plugin %d: missing url", i+1)
+		}
+		if plugin.Version == "" {
+			return nil, fmt.Errorf("plugin '%s': missing version", plugin.Url)
+		}
+		switch plugin.Vcs {
+		case "":
+			plugin.Vcs = "git"
+		case "git", "hg", "svn":
+		default:
+			return nil, fmt.Errorf("plugin '%s': unknown vcs: %s", plugin.Url,
+				plugin.Vcs)
+		}
+		if plugin.Import == "" {
+			plugin.Import = importPath(plugin.Url)
+		}
+		if plugin.IgnoreRoot && len(plugin.Packages) == 0 {
+			return nil, fmt.Errorf("plugin '%s': ignore_root requires packages",
+				plugin.Url)
+		}
+		if seen[plugin.Import] {
+			return nil, fmt.Errorf("plugin '%s' is listed more than once",
+				plugin.Import)
+		}
+		seen[plugin.Import] = true
+	}
+	return manifest, nil
+}
+
+// Returns the sorted import paths of the packages to build into hekad.
+func (m *Manifest) Imports() []string {
+	imports := make([]string, 0, len(m.Plugin))
+	for _, plugin := range m.Plugin {
+		if !plugin.IgnoreRoot {
+			imports = append(imports, plugin.Import)
+		}
+		for _, pkg := range plugin.Packages {
+			imports = append(imports, plugin.Import+"/"+strings.Trim(pkg, "/"))
+		}
+	}
+	sort.Strings(imports)
+	return imports
+}
+
+// Generates the hekad `plugin_loader.go` source, importing each of the
+// plugin packages so their `init()` functions register their plugins.
+func (m *Manifest) LoaderSource(manifestPath string) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "// Generated by heka-build from %s, DO NOT EDIT.\n\n",
+		manifestPath)
+	buf.WriteString("package main\n\n")
+	if imports := m.Imports(); len(imports) > 0 {
+		buf.WriteString("import (\n")
+		for _, path := range imports {
+			fmt.Fprintf(buf, "\t_ %q\n", path)
+		}
+		buf.WriteString(")\n")
+	}
+	return format.Source(buf.Bytes())
+}
+
+// Generates a `plugin_loader.cmake` file, so the cmake build checks out each
+// repository at its pinned version.
+func (m *Manifest) CmakeSource(manifestPath string) []byte {
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "# Generated by heka-build from %s, DO NOT EDIT.\n",
+		manifestPath)
+	for _, plugin := range m.Plugin {
+		args := []string{plugin.Vcs, plugin.Url, plugin.Version}
+		args = append(args, plugin.Packages...)
+		if plugin.IgnoreRoot {
+			args = append(args, "__ignore_root")
+		}
+		fmt.Fprintf(buf, "add_external_plugin(%s)\n", strings.Join(args, " "))
+	}
+	return buf.Bytes()
+}
+
+// Generates a `require` block pinning each repository for a Go modules build.
+// Versions must be module versions, e.g. tags such as "v1.2.0" or
+// pseudo-versions.
+func (m *Manifest) GoModSource() ([]byte, error) {
+	buf := new(bytes.Buffer)
+	buf.WriteString("require (\n")
+	for _, plugin := range m.Plugin {
+		if plugin.Version == ":local" {
+			return nil, fmt.Errorf("plugin '%s': can't require a :local version",
+				plugin.Import)
+		}
+		fmt.Fprintf(buf, "\t%s %s\n", plugin.Import, plugin.Version)
+	}
+	buf.WriteString(")\n")
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,112 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+const testManifest = `
+[[plugin]]
+url = "https://github.com/example/heka-plugins"
+version = "v1.2.0"
+packages = ["outputs", "filters"]
+ignore_root = true
+
+[[plugin]]
+url = "git@github.com:example/heka-sns-input.git"
+version = "0123456789abcdef"
+
+[[plugin]]
+url = "https://code.example.com/hg/heka-extra"
+version = "default"
+vcs = "hg"
+import = "example.com/heka-extra"
+`
+
+func TestParseManifest(t *testing.T) {
+	manifest, err := ParseManifest([]byte(testManifest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Plugin) != 3 {
+		t.Fatalf("Expected 3 plugins, got %d", len(manifest.Plugin))
+	}
+	expected := []string{
+		"example.com/heka-extra",
+		"github.com/example/heka-plugins/filters",
+		"github.com/example/heka-plugins/outputs",
+		"github.com/example/heka-sns-input",
+	}
+	imports := manifest.Imports()
+	if strings.Join(imports, " ") != strings.Join(expected, " ") {
+		t.Fatalf("Expected imports %v, got %v", expected, imports)
+	}
+	if manifest.Plugin[1].Vcs != "git" {
+		t.Errorf("Expected default vcs 'git', got '%s'", manifest.Plugin[1].Vcs)
+	}
+}
+
+func TestManifestErrors(t *testing.T) {
+	bad := map[string]string{
+		"missing version": `[[plugin]]
+url = "https://github.com/example/heka-plugins"`,
+		"unknown vcs": `[[plugin]]
+url = "https://github.com/example/heka-plugins"
+version = "v1"
+vcs = "cvs"`,
+		"listed more than once": `[[plugin]]
+url = "https://github.com/example/heka-plugins"
+version = "v1"
+[[plugin]]
+url = "https://github.com/example/heka-plugins.git"
+version = "v2"`,
+	}
+	for msg, data := range bad {
+		_, err := ParseManifest([]byte(data))
+		if err == nil || !strings.Contains(err.Error(), msg) {
+			t.Errorf("Expected '%s' error, got %v", msg, err)
+		}
+	}
+}
+
+func TestGeneratedSources(t *testing.T) {
+	manifest, err := ParseManifest([]byte(testManifest))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loader, err := manifest.LoaderSource("plugin_loader.toml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(loader),
+		"\t_ \"github.com/example/heka-plugins/outputs\"\n") {
+		t.Errorf("Plugin package not imported:\n%s", loader)
+	}
+
+	cmake := string(manifest.CmakeSource("plugin_loader.toml"))
+	line := "add_external_plugin(git https://github.com/example/heka-plugins v1.2.0 " +
+		"outputs filters __ignore_root)\n"
+	if !strings.Contains(cmake, line) {
+		t.Errorf("Expected cmake line %q:\n%s", line, cmake)
+	}
+
+	gomod, err := manifest.GoModSource()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(gomod), "\tgithub.com/example/heka-plugins v1.2.0\n") {
+		t.Errorf("Expected module requirement:\n%s", gomod)
+	}
+}
@@ -41,6 +41,16 @@ type LogstreamerConfig struct {
 	Differentiator []string
 	OldestDuration string `toml:"oldest_duration"`
 	Translation    logstreamer.SubmatchTranslationMap
+	// Only used in simulation mode.
+	JournalDirectory   string `toml:"journal_directory"`
+	PositionLostPolicy string `toml:"position_lost_policy"`
+}
+
+// Simulation mode settings
+type simulation struct {
+	logDirectory     string
+	journalDirectory string
+	at               time.Time
 }
 
 type Basic struct {
@@ -52,6 +62,14 @@ type FileConfig map[string]toml.Primitive
 
 func main() {
 	configFile := flag.String("config", "logstreamer.toml", "Heka Logstreamer configuration file")
+	simulate := flag.Bool("simulate", false,
+		"Show the read order, expired files, and start position for each logstream")
+	logDir := flag.String("logdir", "",
+		"Simulate against this directory (e.g. a snapshot) instead of log_directory")
+	journalDir := flag.String("journal", "",
+		"Journal directory to simulate with, overrides journal_directory")
+	at := flag.String("at", "",
+		"Simulate as of this RFC3339 time instead of now, for oldest_duration expiration")
 
 	flag.Parse()
 
@@ -103,13 +121,27 @@ func main() {
 		}
 	}
 
+	var sim *simulation
+	if *simulate {
+		sim = &simulation{
+			logDirectory:     *logDir,
+			journalDirectory: *journalDir,
+			at:               time.Now(),
+		}
+		if *at != "" {
+			if sim.at, err = time.Parse(time.RFC3339, *at); err != nil {
+				log.Fatalf("Error parsing simulation time: %s", err)
+			}
+		}
+	}
+
 	// Go through the logstreams and parse their configs
 	for name, prim := range inputs {
-		parseConfig(name, prim)
+		parseConfig(name, prim, sim)
 	}
 }
 
-func parseConfig(name string, prim toml.Primitive) {
+func parseConfig(name string, prim toml.Primitive, sim *simulation) {
 	config := LogstreamerConfig{
 		OldestDuration: "720h",
 		Differentiator: []string{name},
@@ -131,6 +163,10 @@ func parseConfig(name string, prim toml.Primitive) {
 		Differentiator: config.Differentiator,
 	}
 	oldest, _ := time.ParseDuration(config.OldestDuration)
+	if sim != nil {
+		simulateConfig(name, config, sp, oldest, sim)
+		return
+	}
 	ls, err := logstreamer.NewLogstreamSet(sp, oldest, config.LogDirectory, "")
 	if err != nil {
 		log.Fatalf("Error initializing LogstreamSet: %s\n", err.Error())
@@ -150,3 +186,86 @@ func parseConfig(name string, prim toml.Primitive) {
 		}
 	}
 }
+
+func simulateConfig(name string, config LogstreamerConfig, sp *logstreamer.SortPattern,
+	oldest time.Duration, sim *simulation) {
+
+	if sim.logDirectory != "" {
+		config.LogDirectory = sim.logDirectory
+	}
+	if sim.journalDirectory != "" {
+		config.JournalDirectory = sim.journalDirectory
+	}
+	ls, err := logstreamer.NewLogstreamSet(sp, oldest, config.LogDirectory,
+		config.JournalDirectory)
+	if err != nil {
+		log.Fatalf("Error initializing LogstreamSet: %s\n", err.Error())
+	}
+	if err = ls.SetPositionLostPolicy(config.PositionLostPolicy); err != nil {
+		log.Fatalf("Error in section [%s]: %s\n", name, err)
+	}
+	plans, errs := ls.Plan(sim.at)
+	if errs.IsError() {
+		log.Printf("Error loading journals: %s\n", errs)
+	}
+
+	fmt.Printf("Simulating %d Logstream(s) for section [%s] in %s as of %s.\n",
+		len(plans), name, config.LogDirectory, sim.at.Format(time.RFC3339))
+	if oldest != 0 {
+		fmt.Printf("Files last modified before %s are expired.\n",
+			sim.at.Add(-oldest).Format(time.RFC3339))
+	}
+	if config.JournalDirectory == "" {
+		fmt.Println("No journal directory specified, assuming no journals.")
+	}
+
+	for _, plan := range plans {
+		fmt.Printf("\nLogstream name: [%s]\n", plan.Name)
+		if plan.Err != nil {
+			fmt.Printf("Unusable, will not be read: %s\n", plan.Err)
+		} else {
+			fmt.Printf("Files: %d (in ingestion order)\n", len(plan.Logfiles))
+			for i, logfile := range plan.Logfiles {
+				fmt.Printf("\t%d. %s %s\n", i+1, logfile.FileName,
+					sortKeys(logfile, config.Priority))
+			}
+		}
+		if len(plan.Expired) > 0 {
+			fmt.Printf("Expired: %d (older than oldest_duration, skipped)\n",
+				len(plan.Expired))
+			for _, logfile := range plan.Expired {
+				modTime := "unknown modification time"
+				if info, err := os.Stat(logfile.FileName); err == nil {
+					modTime = "modified " + info.ModTime().Format(time.RFC3339)
+				}
+				fmt.Printf("\t%s (%s)\n", logfile.FileName, modTime)
+			}
+		}
+		if plan.Err != nil {
+			continue
+		}
+		if plan.Journal != nil {
+			fmt.Printf("Journal: %s:%d\n", plan.Journal.Filename,
+				plan.Journal.SeekPosition)
+		}
+		if plan.StartFile == "" {
+			fmt.Printf("Start: none, %s\n", plan.StartReason)
+		} else {
+			fmt.Printf("Start: %s:%d, %s\n", plan.StartFile, plan.StartPosition,
+				plan.StartReason)
+		}
+	}
+}
+
+// Returns the sort values of a logfile's priority parts, e.g.
+// "[Year=2013 ^Seq=1]".
+func sortKeys(logfile *logstreamer.Logfile, priority []string) string {
+	if len(priority) == 0 {
+		return ""
+	}
+	keys := make([]string, len(priority))
+	for i, part := range priority {
+		keys[i] = fmt.Sprintf("%s=%d", part, logfile.MatchParts[strings.TrimPrefix(part, "^")])
+	}
+	return "[" + strings.Join(keys, " ") + "]"
+}
@@ -21,16 +21,20 @@ import (
 	"fmt"
 	"github.com/bbangert/toml"
 	"github.com/mozilla-services/heka/pipeline"
-	"io/ioutil"
 	"os"
 	"path/filepath"
-	"strings"
 	"time"
 )
 
 type HekadConfig struct {
 	Maxprocs              int           `toml:"maxprocs"`
 	PoolSize              int           `toml:"poolsize"`
+	MaxPoolSize           int           `toml:"max_poolsize"`
+	MetricsAddress        string        `toml:"metrics_address"`
+	AdminAddress          string        `toml:"admin_address"`
+	AdminToken            string        `toml:"admin_token"`
+	DeadLetter            bool          `toml:"dead_letter"`
+	PluginLogMessages     bool          `toml:"plugin_log_messages"`
 	ChanSize              int           `toml:"plugin_chansize"`
 	CpuProfName           string        `toml:"cpuprof"`
 	MemProfName           string        `toml:"memprof"`
@@ -44,9 +48,28 @@ type HekadConfig struct {
 	SampleDenominator     int           `toml:"sample_denominator"`
 	PidFile               string        `toml:"pid_file"`
 	Hostname              string
+	// Config fragments to load along with this file, see
+	// pipeline.DecodeConfigFileWithIncludes.
+	Include []string `toml:"include"`
+	// Directories of Go plugin packages to load at startup, see
+	// pipeline.LoadPluginDirs.
+	PluginDirs []string `toml:"plugin_dirs"`
+	// Sample rates by plugin name, by profile name, see
+	// pipeline.PipelineConfig.SetSamplingProfile.
+	SamplingProfiles map[string]map[string]float64 `toml:"sampling_profiles"`
+	// Profile active at startup.
+	SamplingProfile        string   `toml:"sampling_profile"`
+	SamplingControlSigners []string `toml:"sampling_control_signers"`
+	// Severities dropped under sustained overload, tier by tier, see
+	// pipeline.LoadSheddingConfig.
+	LoadSheddingTiers         []int32 `toml:"load_shedding_tiers"`
+	LoadSheddingEscalateAfter uint    `toml:"load_shedding_escalate_after"`
+	LoadSheddingRecoverAfter  uint    `toml:"load_shedding_recover_after"`
 }
 
-func LoadHekadConfig(configPath string) (config *HekadConfig, err error) {
+func LoadHekadConfig(configPath string, recursive bool, format string) (config *HekadConfig,
+	err error) {
+
 	idle, _ := time.ParseDuration("2m")
 	hostname, err := os.Hostname()
 	if err != nil {
@@ -68,9 +91,12 @@ func LoadHekadConfig(configPath string) (config *HekadConfig, err error) {
 		SampleDenominator:     1000,
 		PidFile:               "",
 		Hostname:              hostname,
+
+		LoadSheddingEscalateAfter: 5,
+		LoadSheddingRecoverAfter:  30,
 	}
 
-	var configFile map[string]toml.Primitive
+	configFile := make(pipeline.ConfigFile)
 	p, err := os.Open(configPath)
 	if err != nil {
 		return nil, fmt.Errorf("Error opening config file: %s", err)
@@ -81,30 +107,24 @@ func LoadHekadConfig(configPath string) (config *HekadConfig, err error) {
 	}
 
 	if fi.IsDir() {
-		files, _ := ioutil.ReadDir(configPath)
-		for _, f := range files {
-			fName := f.Name()
-			if !strings.HasSuffix(fName, ".toml") {
-				// Skip non *.toml files in a config dir.
-				continue
-			}
-			fPath := filepath.Join(configPath, fName)
-			contents, err := pipeline.ReplaceEnvsFile(fPath)
+		fPaths, err := pipeline.ConfigDirFiles(configPath, recursive)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading config directory: %s", err)
+		}
+		for _, fPath := range fPaths {
+			fileConfig, err := pipeline.DecodeConfigFileWithIncludes(fPath, format)
 			if err != nil {
 				return nil, err
 			}
-			if _, err = toml.Decode(contents, &configFile); err != nil {
-				return nil, fmt.Errorf("Error decoding config file: %s", err)
+			for name, section := range fileConfig {
+				configFile[name] = section
 			}
 		}
 	} else {
-		contents, err := pipeline.ReplaceEnvsFile(configPath)
+		configFile, err = pipeline.DecodeConfigFileWithIncludes(configPath, format)
 		if err != nil {
 			return nil, err
 		}
-		if _, err = toml.Decode(contents, &configFile); err != nil {
-			return nil, fmt.Errorf("Error decoding config file: %s", err)
-		}
 	}
 
 	empty_ignore := map[string]interface{}{}
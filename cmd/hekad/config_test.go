@@ -22,7 +22,7 @@ import (
 )
 
 func TestDecode(t *testing.T) {
-	_, err := LoadHekadConfig("../../pipeline/testsupport/sample-config.toml")
+	_, err := LoadHekadConfig("../../pipeline/testsupport/sample-config.toml", false, "")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -31,7 +31,7 @@ func TestDecode(t *testing.T) {
 func TestCustomHostname(t *testing.T) {
 	expected := "my.example.com"
 	configPath := "../../pipeline/testsupport/sample-hostname.toml"
-	config, err := LoadHekadConfig(configPath)
+	config, err := LoadHekadConfig(configPath, false, "")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -52,6 +52,50 @@ func TestCustomHostname(t *testing.T) {
 	}
 }
 
+func TestConfigFormats(t *testing.T) {
+	expected := "my.example.com"
+	for _, configPath := range []string{
+		"../../pipeline/testsupport/sample-hostname.json",
+		"../../pipeline/testsupport/sample-hostname.yaml",
+	} {
+		config, err := LoadHekadConfig(configPath, false, "")
+		if err != nil {
+			t.Fatalf("%s: %s", configPath, err)
+		}
+		if config.Hostname != expected {
+			t.Fatalf("%s: HekadConfig.Hostname expected: '%s', Got: %s", configPath,
+				expected, config.Hostname)
+		}
+		if config.Maxprocs != 10 {
+			t.Fatalf("%s: HekadConfig.Maxprocs expected: 10, Got: %d", configPath,
+				config.Maxprocs)
+		}
+		globals, _, _ := setGlobalConfigs(config)
+		pConfig := pipeline.NewPipelineConfig(globals)
+		if err = loadFullConfig(pConfig, &configPath); err != nil {
+			t.Fatalf("%s: Error loading full config: %s", configPath, err)
+		}
+		if tcp, ok := pConfig.InputRunners["TcpInput"]; ok {
+			tcp.Input().Stop()
+		} else {
+			t.Fatalf("%s: No TcpInput configured.", configPath)
+		}
+		if _, ok := pConfig.OutputRunners["LogOutput"]; !ok {
+			t.Fatalf("%s: No LogOutput configured.", configPath)
+		}
+	}
+
+	// An explicit format overrides the extension.
+	configPath := "../../pipeline/testsupport/sample-hostname.json"
+	if _, err := LoadHekadConfig(configPath, false, "yaml"); err != nil {
+		// JSON is a subset of YAML, so this should still work.
+		t.Fatal(err)
+	}
+	if _, err := LoadHekadConfig(configPath, false, "toml"); err == nil {
+		t.Fatal("Decoding JSON as TOML should have failed.")
+	}
+}
+
 func TestLoadDir(t *testing.T) {
 	origAvailablePlugins := make(map[string]func() interface{})
 	for k, v := range pipeline.AvailablePlugins {
@@ -109,4 +153,38 @@ func TestLoadDir(t *testing.T) {
 	if ok {
 		t.Fatal("`not_loaded` filter *was* loaded, shouldn't have been!")
 	}
+
+	// and neither did the nested directory
+	_, ok = pipeConfig.FilterRunners["nested"]
+	if ok {
+		t.Fatal("`nested` filter *was* loaded, shouldn't have been!")
+	}
+}
+
+func TestLoadDirRecursive(t *testing.T) {
+	origAvailablePlugins := make(map[string]func() interface{})
+	for k, v := range pipeline.AvailablePlugins {
+		origAvailablePlugins[k] = v
+	}
+
+	defer func() {
+		pipeline.AvailablePlugins = origAvailablePlugins
+	}()
+
+	globals := pipeline.DefaultGlobals()
+	globals.RecursiveConfigDir = true
+	pipeConfig := pipeline.NewPipelineConfig(globals)
+	confDirPath := "../../plugins/testsupport/config_dir"
+	err := loadFullConfig(pipeConfig, &confDirPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if udp, ok := pipeConfig.InputRunners["UdpInput"]; ok {
+		defer udp.Input().Stop()
+	}
+
+	_, ok := pipeConfig.FilterRunners["nested"]
+	if !ok {
+		t.Fatal("No `nested` filter configured.")
+	}
 }
@@ -26,19 +26,36 @@ import (
 	"github.com/mozilla-services/heka/pipeline"
 	_ "github.com/mozilla-services/heka/plugins"
 	_ "github.com/mozilla-services/heka/plugins/amqp"
+	_ "github.com/mozilla-services/heka/plugins/avro"
+	_ "github.com/mozilla-services/heka/plugins/clickhouse"
+	_ "github.com/mozilla-services/heka/plugins/cloudfile"
+	_ "github.com/mozilla-services/heka/plugins/cloudwatch"
 	_ "github.com/mozilla-services/heka/plugins/dasher"
+	_ "github.com/mozilla-services/heka/plugins/datadog"
+	_ "github.com/mozilla-services/heka/plugins/dns"
 	_ "github.com/mozilla-services/heka/plugins/elasticsearch"
+	_ "github.com/mozilla-services/heka/plugins/external"
 	_ "github.com/mozilla-services/heka/plugins/file"
 	_ "github.com/mozilla-services/heka/plugins/graphite"
+	_ "github.com/mozilla-services/heka/plugins/grpc"
 	_ "github.com/mozilla-services/heka/plugins/http"
+	_ "github.com/mozilla-services/heka/plugins/influxdb"
 	_ "github.com/mozilla-services/heka/plugins/irc"
 	_ "github.com/mozilla-services/heka/plugins/kafka"
+	_ "github.com/mozilla-services/heka/plugins/kinesis"
+	_ "github.com/mozilla-services/heka/plugins/kubernetes"
 	_ "github.com/mozilla-services/heka/plugins/logstreamer"
 	_ "github.com/mozilla-services/heka/plugins/nagios"
+	_ "github.com/mozilla-services/heka/plugins/otlp"
 	_ "github.com/mozilla-services/heka/plugins/payload"
+	_ "github.com/mozilla-services/heka/plugins/postgres"
 	_ "github.com/mozilla-services/heka/plugins/process"
+	_ "github.com/mozilla-services/heka/plugins/siem"
 	_ "github.com/mozilla-services/heka/plugins/smtp"
+	_ "github.com/mozilla-services/heka/plugins/snmp"
+	_ "github.com/mozilla-services/heka/plugins/sqs"
 	_ "github.com/mozilla-services/heka/plugins/statsd"
+	_ "github.com/mozilla-services/heka/plugins/syslog"
 	_ "github.com/mozilla-services/heka/plugins/tcp"
 	_ "github.com/mozilla-services/heka/plugins/udp"
 	"io/ioutil"
@@ -47,13 +64,14 @@ import (
 	"path/filepath"
 	"runtime"
 	"runtime/pprof"
+	"sort"
 	"strconv"
 	"strings"
 	"syscall"
 )
 
 const (
-	VERSION = "0.9.0"
+	VERSION = pipeline.VERSION
 )
 
 func setGlobalConfigs(config *HekadConfig) (*pipeline.GlobalConfigStruct, string, string) {
@@ -71,6 +89,12 @@ func setGlobalConfigs(config *HekadConfig) (*pipeline.GlobalConfigStruct, string
 
 	globals := pipeline.DefaultGlobals()
 	globals.PoolSize = poolSize
+	globals.MaxPoolSize = config.MaxPoolSize
+	globals.MetricsAddress = config.MetricsAddress
+	globals.AdminAddress = config.AdminAddress
+	globals.AdminToken = config.AdminToken
+	globals.DeadLetter = config.DeadLetter
+	globals.PluginLogMessages = config.PluginLogMessages
 	globals.PluginChanSize = chanSize
 	globals.MaxMsgLoops = maxMsgLoops
 	if globals.MaxMsgLoops == 0 {
@@ -83,15 +107,67 @@ func setGlobalConfigs(config *HekadConfig) (*pipeline.GlobalConfigStruct, string
 	globals.ShareDir = config.ShareDir
 	globals.SampleDenominator = config.SampleDenominator
 	globals.Hostname = config.Hostname
+	globals.SamplingProfiles = config.SamplingProfiles
+	globals.SamplingProfile = config.SamplingProfile
+	globals.SamplingControlSigners = config.SamplingControlSigners
+	globals.LoadShedding = pipeline.LoadSheddingConfig{
+		Tiers:         config.LoadSheddingTiers,
+		EscalateAfter: config.LoadSheddingEscalateAfter,
+		RecoverAfter:  config.LoadSheddingRecoverAfter,
+	}
 
 	return globals, cpuProfName, memProfName
 }
 
+// Prints the registered plugin types, one per line, with the plugin file each
+// was loaded from.
+func printPlugins() {
+	names := make([]string, 0, len(pipeline.AvailablePlugins))
+	for name := range pipeline.AvailablePlugins {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		source := pipeline.PluginSource(name)
+		if source == "" {
+			source = "(built in)"
+		}
+		fmt.Printf("%s\t%s\n", name, source)
+	}
+}
+
 func main() {
 	configPath := flag.String("config", filepath.FromSlash("/etc/hekad.toml"),
 		"Config file or directory. If directory is specified then all files "+
 			"in the directory will be loaded.")
+	recursive := flag.Bool("recursive", false,
+		"Also load the files in nested directories when a config directory is "+
+			"specified.")
+	configFormat := flag.String("config-format", "",
+		"Format of the config files (toml, json, or yaml). Defaults to choosing "+
+			"the format based on each file's extension.")
+	validate := flag.Bool("validate", false,
+		"Check the config for errors and exit without starting any plugins. "+
+			"Exits with a non-zero status if any errors are found.")
+	checkConfig := flag.Bool("check-config", false,
+		"Check the config for errors like -validate, then run the samples in its "+
+			"[Assert.<name>] sections through its decoders and matchers and exit. "+
+			"Exits with a non-zero status if any errors are found or any "+
+			"assertion fails.")
 	version := flag.Bool("version", false, "Output version and exit")
+	listPlugins := flag.Bool("plugins", false,
+		"List the available plugin types, and the plugin file each was loaded "+
+			"from if not compiled into hekad, and exit")
+	recordDir := flag.String("record", "",
+		"Record the messages handed on by the inputs and the output produced by "+
+			"the outputs into a fixture bundle in this directory")
+	replayDir := flag.String("replay", "",
+		"Replay the inputs recorded in this fixture bundle directory through the "+
+			"config instead of running the inputs, compare the outputs produced "+
+			"with the recorded ones, and exit. Exits with a non-zero status if "+
+			"any output differs.")
+	replayUnordered := flag.Bool("replay-unordered", false,
+		"Ignore the order of each output's messages when comparing a replay")
 	flag.Parse()
 
 	config := &HekadConfig{}
@@ -109,14 +185,62 @@ func main() {
 		os.Exit(0)
 	}
 
-	config, err = LoadHekadConfig(*configPath)
+	config, err = LoadHekadConfig(*configPath, *recursive, *configFormat)
 	if err != nil {
 		log.Fatal("Error reading config: ", err)
 	}
 	if config.SampleDenominator <= 0 {
 		log.Fatalln("'sample_denominator' value must be greater than 0.")
 	}
+	err = pipeline.ValidateSamplingProfiles(config.SamplingProfiles, config.SamplingProfile)
+	if err != nil {
+		log.Fatal("Error reading config: ", err)
+	}
+	err = pipeline.ValidateLoadShedding(pipeline.LoadSheddingConfig{
+		Tiers:         config.LoadSheddingTiers,
+		EscalateAfter: config.LoadSheddingEscalateAfter,
+		RecoverAfter:  config.LoadSheddingRecoverAfter,
+	})
+	if err != nil {
+		log.Fatal("Error reading config: ", err)
+	}
+	loaded, err := pipeline.LoadPluginDirs(config.PluginDirs)
+	for _, name := range loaded {
+		log.Printf("Loaded plugin '%s' from %s", name, pipeline.PluginSource(name))
+	}
+	if err != nil {
+		log.Fatal("Error loading plugins: ", err)
+	}
+	if *listPlugins {
+		printPlugins()
+		os.Exit(0)
+	}
 	globals, cpuProfName, memProfName := setGlobalConfigs(config)
+	globals.RecursiveConfigDir = *recursive
+	globals.ConfigFormat = *configFormat
+
+	if *validate {
+		os.Exit(validateConfig(globals, *configPath))
+	}
+	if *checkConfig {
+		os.Exit(checkConfigAssertions(globals, *configPath))
+	}
+
+	if *recordDir != "" && *replayDir != "" {
+		log.Fatalln("-record and -replay can't be used together.")
+	}
+	var replayer *pipeline.Replayer
+	if *replayDir != "" {
+		if replayer, err = pipeline.NewReplayer(*replayDir); err != nil {
+			log.Fatal("Error reading recording: ", err)
+		}
+		// A replay mustn't touch the state of a running hekad.
+		if globals.BaseDir, err = ioutil.TempDir("", "hekad-replay"); err != nil {
+			log.Fatal("Error creating replay 'base_dir': ", err)
+		}
+		defer os.RemoveAll(globals.BaseDir)
+		config.PidFile = ""
+	}
 
 	if err = os.MkdirAll(globals.BaseDir, 0755); err != nil {
 		log.Fatalf("Error creating 'base_dir' %s: %s", config.BaseDir, err)
@@ -184,10 +308,37 @@ func main() {
 
 	// Set up and load the pipeline configuration and start the daemon.
 	pipeconf := pipeline.NewPipelineConfig(globals)
+	pipeconf.SetDaemonConfig(config)
+	if replayer != nil {
+		pipeconf.SetReplayer(replayer)
+	}
+	if *recordDir != "" {
+		recorder, err := pipeline.NewRecorder(*recordDir)
+		if err != nil {
+			log.Fatal("Error creating recording: ", err)
+		}
+		pipeconf.SetRecorder(recorder)
+		defer func() {
+			if err := recorder.Close(); err != nil {
+				log.Printf("Error writing recording: %s", err)
+			}
+		}()
+	}
 	if err = loadFullConfig(pipeconf, configPath); err != nil {
 		log.Fatal("Error reading config: ", err)
 	}
 	pipeline.Run(pipeconf)
+
+	if replayer != nil {
+		differing, err := replayer.Compare(os.Stdout, *replayUnordered)
+		if err != nil {
+			log.Fatal("Error comparing replay: ", err)
+		}
+		if differing > 0 {
+			os.RemoveAll(globals.BaseDir)
+			os.Exit(1)
+		}
+	}
 }
 
 func loadFullConfig(pipeconf *pipeline.PipelineConfig, configPath *string) (err error) {
@@ -201,20 +352,65 @@ func loadFullConfig(pipeconf *pipeline.PipelineConfig, configPath *string) (err
 	}
 
 	if fi.IsDir() {
-		files, _ := ioutil.ReadDir(*configPath)
-		for _, f := range files {
-			fName := f.Name()
-			if !strings.HasSuffix(fName, ".toml") {
-				// Skip non *.toml files in a config dir.
-				continue
-			}
-			err = pipeconf.LoadFromConfigFile(filepath.Join(*configPath, fName))
-			if err != nil {
-				break
-			}
-		}
+		err = pipeconf.LoadFromConfigDir(*configPath)
 	} else {
 		err = pipeconf.LoadFromConfigFile(*configPath)
 	}
 	return
 }
+
+// Checks the plugin config without starting hekad, printing any errors to
+// stderr. Returns the process exit status.
+func validateConfig(globals *pipeline.GlobalConfigStruct, configPath string) int {
+	fi, err := os.Stat(configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading config: %s\n", err)
+		return 1
+	}
+
+	pipeconf := pipeline.NewPipelineConfig(globals)
+	var errs []error
+	if fi.IsDir() {
+		errs = pipeconf.ValidateConfigDir(configPath)
+	} else {
+		errs = pipeconf.ValidateConfigFile(configPath)
+	}
+	for _, err = range errs {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	if len(errs) > 0 {
+		fmt.Fprintf(os.Stderr, "%d config errors found\n", len(errs))
+		return 1
+	}
+	fmt.Printf("Config OK: %s\n", configPath)
+	return 0
+}
+
+// Checks the config like validateConfig, then runs its assertions.
+func checkConfigAssertions(globals *pipeline.GlobalConfigStruct, configPath string) int {
+	fi, err := os.Stat(configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading config: %s\n", err)
+		return 1
+	}
+
+	pipeconf := pipeline.NewPipelineConfig(globals)
+	var (
+		run  int
+		errs []error
+	)
+	if fi.IsDir() {
+		run, errs = pipeconf.CheckConfigDir(configPath)
+	} else {
+		run, errs = pipeconf.CheckConfigFile(configPath)
+	}
+	for _, err = range errs {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	if len(errs) > 0 {
+		fmt.Fprintf(os.Stderr, "%d problems found, %d assertions run\n", len(errs), run)
+		return 1
+	}
+	fmt.Printf("Config OK: %s, %d assertions passed\n", configPath, run)
+	return 0
+}
@@ -103,6 +103,8 @@ exclude_patterns = [
 'config/inputs/statsd.rst',
 'config/inputs/tcp.rst',
 'config/inputs/udp.rst',
+'config/processors/fields.rst',
+'config/processors/index_noref.rst',
 'config/outputs/amqp.rst',
 'config/outputs/carbon.rst',
 'config/outputs/dashboard.rst',
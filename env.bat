@@ -1,6 +1,7 @@
 @echo off
 set BUILD_DIR=%CD%\build
 set CTEST_OUTPUT_ON_FAILURE=1
+set GO111MODULE=off
 
 setlocal ENABLEDELAYEDEXPANSION
 set NEWGOPATH=%BUILD_DIR%\heka
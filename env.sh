@@ -8,6 +8,8 @@ fi
 BUILD_DIR=$PWD/build
 export CTEST_OUTPUT_ON_FAILURE=1
 export GOPATH=$BUILD_DIR/heka
+# The dependencies are cloned into the GOPATH, see cmake/externals.cmake.
+export GO111MODULE=off
 export GOBIN=$GOPATH/bin
 export PATH=$GOBIN:$PATH
 
@@ -25,6 +25,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -308,6 +309,14 @@ type Logstream struct {
 	saveBuffer []byte
 	// Records whether the prior read hit an EOF
 	priorEOF bool
+	// Where reading resumes when the position can't be located, see
+	// SetPositionLostPolicy.
+	positionLostPolicy string
+	// Whether the last check for a newer file found that the file being read
+	// changed underneath us, so the position couldn't be located.
+	positionLost bool
+	// Number of times the position couldn't be located.
+	lostCount int64
 }
 
 func NewLogstream(logfiles Logfiles, position *LogstreamLocation) *Logstream {
@@ -335,6 +344,13 @@ func (l *Logstream) ReportPosition() (string, int64) {
 	return l.position.Filename, l.position.SeekPosition
 }
 
+// Returns the number of times the journaled position couldn't be located,
+// i.e. the content before it no longer matched its hash, so reading resumed
+// according to the position lost policy.
+func (l *Logstream) PositionsLost() int64 {
+	return atomic.LoadInt64(&l.lostCount)
+}
+
 // Updates the logfiles safely
 func (l *Logstream) UpdateLogfiles(logfiles Logfiles) {
 	l.lfMutex.Lock()
@@ -347,6 +363,25 @@ func (l *Logstream) SavePosition() error {
 	return l.position.Save()
 }
 
+// Reloads our position from the journal, e.g. after another process has been
+// reading the logstream, closing any file we had open. The position is reset
+// if the journal can't be parsed.
+func (l *Logstream) ReloadPosition() error {
+	position, err := LogstreamLocationFromFile(l.position.JournalPath)
+	if err != nil {
+		position.Reset()
+	}
+	if l.fd != nil {
+		l.fd.Close()
+		l.fd = nil
+		l.reader = nil
+	}
+	l.position = position
+	l.saveBuffer = l.saveBuffer[:0]
+	l.priorEOF = false
+	return err
+}
+
 // Get a copy of the logfiles
 func (l *Logstream) GetLogfiles() (logfiles Logfiles) {
 	l.lfMutex.RLock()
@@ -364,7 +399,8 @@ type LogfilesMap map[string]Logfiles
 // A set of logstreams along with utility functions for rescanning and reparsing
 // logfiles into each logstream
 type LogstreamSet struct {
-	logstreams     map[string]*Logstream
+	logstreams         map[string]*Logstream
+	positionLostPolicy string
 	rescanInterval time.Duration // Frequency of full rescan
 	oldestDuration time.Duration // Filter logfiles older than this duration ago
 	sortPattern    *SortPattern  // Used for creating logstreams and updating logfiles
@@ -412,6 +448,26 @@ func NewLogstreamSet(sortPattern *SortPattern, oldest time.Duration,
 	return ls, nil
 }
 
+// Sets where the logstreams resume reading when their position can't be
+// located, e.g. because a file was truncated and rewritten underneath them:
+// "start" (the default) rereads the logstream from its oldest logfile, and
+// "end" skips to the end of its newest logfile, so no line is read twice at
+// the risk of missing some.
+func (ls *LogstreamSet) SetPositionLostPolicy(policy string) error {
+	switch policy {
+	case "", PositionLostStart, PositionLostEnd:
+	default:
+		return fmt.Errorf("invalid position lost policy: %s", policy)
+	}
+	ls.logstreamMutex.Lock()
+	defer ls.logstreamMutex.Unlock()
+	ls.positionLostPolicy = policy
+	for _, logstream := range ls.logstreams {
+		logstream.positionLostPolicy = policy
+	}
+	return nil
+}
+
 // Access a logstream by name if it exists
 func (ls *LogstreamSet) GetLogstream(name string) (l *Logstream, ok bool) {
 	ls.logstreamMutex.RLock()
@@ -442,16 +498,7 @@ func (ls *LogstreamSet) ScanForLogstreams() (result []string, errors *MultipleEr
 	result = make([]string, 0, 0)
 	errors = NewMultipleError()
 
-	// Scan for all our logfiles
-	logfiles := ScanDirectoryForLogfiles(ls.logRoot, ls.fileMatch)
-
-	// Filter out old logfiles
-	if ls.oldestDuration != time.Duration(0) {
-		logfiles.FilterOld(time.Now().Add(-ls.oldestDuration))
-	}
-
-	// Setup all the sorting ints in every logfile
-	logfiles.PopulateMatchParts(ls.fileMatch, ls.sortPattern.Translation)
+	logfiles, _ := ls.scanLogfiles(time.Now())
 
 	// Split up the logfiles into a map
 	mfs := FilterMultipleStreamFiles(logfiles, ls.sortPattern.Differentiator)
@@ -466,32 +513,17 @@ func (ls *LogstreamSet) ScanForLogstreams() (result []string, errors *MultipleEr
 		// New logstream files found, attempt journal path load and setup
 		// the new logstream in the map, recording its newness in result
 		if !ok {
-			journalPath := filepath.Join(ls.journalRoot, name)
-			position, err := LogstreamLocationFromFile(journalPath)
-			if err != nil {
-				errors.AddMessage(err.Error())
-				position.Reset()
-			}
-			logstream = NewLogstream(nil, position)
+			logstream = NewLogstream(nil, ls.loadPosition(name, errors))
+			logstream.positionLostPolicy = ls.positionLostPolicy
 		}
 
-		// Add an error if there's multiple logfiles but no priority for sorting
-		// Continue the loop, to avoid adding this logstream as its not usable
-		if len(ls.sortPattern.Priority) == 0 && len(newLogfiles) > 1 {
-			errors.AddMessage(fmt.Sprintf("Found multiple logfiles without Priority to sort "+
-				"on for name: %s, filematch: %s, files: %s",
-				name, ls.sortPattern.FileMatch, newLogfiles.FileNames()))
+		// Continue the loop if the logfiles can't be sorted, to avoid adding
+		// this logstream as its not usable
+		if err := ls.sortLogfiles(name, newLogfiles); err != nil {
+			errors.AddMessage(err.Error())
 			continue
 		}
 
-		// Sort the new logfiles if there is a priority, single logfile streams
-		// only have a single file to read so no sorting need occur
-		// Also don't bother sorting if there's only a single logfile
-		if len(ls.sortPattern.Priority) > 0 && len(newLogfiles) > 1 {
-			byp := ByPriority{Logfiles: newLogfiles, Priority: ls.sortPattern.Priority}
-			sort.Sort(byp)
-		}
-
 		// If this is a new logstream, its now safe to add it
 		if !ok {
 			result = append(result, name)
@@ -504,6 +536,58 @@ func (ls *LogstreamSet) ScanForLogstreams() (result []string, errors *MultipleEr
 	return
 }
 
+// Scans for all our logfiles, separating out those that were last modified
+// longer than the oldest duration before `now`. Sorting ints are populated
+// for the returned logfiles.
+func (ls *LogstreamSet) scanLogfiles(now time.Time) (logfiles, expired Logfiles) {
+	logfiles = ScanDirectoryForLogfiles(ls.logRoot, ls.fileMatch)
+
+	// Filter out old logfiles
+	if ls.oldestDuration != time.Duration(0) {
+		current := logfiles.FilterOld(now.Add(-ls.oldestDuration))
+		for _, logfile := range logfiles {
+			if current.IndexOf(logfile.FileName) == -1 {
+				expired = append(expired, logfile)
+			}
+		}
+		logfiles = current
+	}
+
+	// Setup all the sorting ints in every logfile
+	logfiles.PopulateMatchParts(ls.fileMatch, ls.sortPattern.Translation)
+	return
+}
+
+// Loads the journaled position for the named logstream, recording an error
+// and starting from scratch if the journal can't be parsed.
+func (ls *LogstreamSet) loadPosition(name string, errors *MultipleError) *LogstreamLocation {
+	journalPath := filepath.Join(ls.journalRoot, name)
+	position, err := LogstreamLocationFromFile(journalPath)
+	if err != nil {
+		errors.AddMessage(err.Error())
+		position.Reset()
+	}
+	return position
+}
+
+// Sorts a logstream's logfiles oldest first. Returns an error if there are
+// multiple logfiles but no priority to sort them on.
+func (ls *LogstreamSet) sortLogfiles(name string, logfiles Logfiles) error {
+	if len(ls.sortPattern.Priority) == 0 && len(logfiles) > 1 {
+		return fmt.Errorf("Found multiple logfiles without Priority to sort "+
+			"on for name: %s, filematch: %s, files: %s",
+			name, ls.sortPattern.FileMatch, logfiles.FileNames())
+	}
+
+	// Sort the logfiles if there is a priority, single logfile streams only
+	// have a single file to read so no sorting need occur
+	if len(ls.sortPattern.Priority) > 0 && len(logfiles) > 1 {
+		byp := ByPriority{Logfiles: logfiles, Priority: ls.sortPattern.Priority}
+		sort.Sort(byp)
+	}
+	return nil
+}
+
 // Filter a single Logfiles into a Logstreams keyed by the
 // differentiator.
 func FilterMultipleStreamFiles(files Logfiles, differentiator []string) LogfilesMap {
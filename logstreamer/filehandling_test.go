@@ -17,10 +17,13 @@ package logstreamer
 
 import (
 	gs "github.com/rafrombrc/gospec/src/gospec"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"runtime"
 	"sort"
+	"strings"
+	"time"
 )
 
 func FilehandlingSpec(c gs.Context) {
@@ -214,4 +217,70 @@ func FilehandlingSpec(c gs.Context) {
 			c.Expect(len(error), gs.Equals, 26)
 		})
 	})
+
+	c.Specify("Planning a directory of access/error logs", func() {
+		regex := `/(?P<Year>\d+)/(?P<Month>\d+)/(?P<Type>\w+)\.log(\.(?P<Seq>\d+))?`
+		if runtime.GOOS == "windows" {
+			regex = `\\(?P<Year>\d+)\\(?P<Month>\d+)\\(?P<Type>\w+)\.log(\.(?P<Seq>\d+))?`
+		}
+		sp := &SortPattern{
+			FileMatch:      regex,
+			Translation:    make(SubmatchTranslationMap),
+			Priority:       []string{"Year", "Month", "^Seq"},
+			Differentiator: []string{"Type", "-log"},
+		}
+		oldest := 720 * time.Hour
+		firstError := filepath.Join(dirPath, "2010", "07", "error.log.2")
+
+		c.Specify("without a journal starts at the oldest file", func() {
+			ls, err := NewLogstreamSet(sp, oldest, dirPath, "")
+			c.Assume(err, gs.IsNil)
+			plans, errs := ls.Plan(time.Now())
+			c.Expect(errs.IsError(), gs.IsFalse)
+			c.Assume(len(plans), gs.Equals, 2)
+			c.Expect(plans[0].Name, gs.Equals, "access-log")
+			c.Expect(plans[1].Name, gs.Equals, "error-log")
+			c.Expect(len(plans[1].Logfiles), gs.Equals, 26)
+			c.Expect(len(plans[1].Expired), gs.Equals, 0)
+			c.Expect(plans[1].Journal, gs.IsNil)
+			c.Expect(plans[1].StartFile, gs.Equals, firstError)
+			c.Expect(plans[1].StartPosition, gs.Equals, int64(0))
+
+			// Nothing should have been added to the set.
+			_, ok := ls.GetLogstream("error-log")
+			c.Expect(ok, gs.IsFalse)
+		})
+
+		c.Specify("reports expired files", func() {
+			ls, err := NewLogstreamSet(sp, oldest, dirPath, "")
+			c.Assume(err, gs.IsNil)
+			plans, _ := ls.Plan(time.Now().Add(2 * oldest))
+			c.Assume(len(plans), gs.Equals, 2)
+			c.Expect(len(plans[1].Logfiles), gs.Equals, 0)
+			c.Expect(len(plans[1].Expired), gs.Equals, 26)
+			c.Expect(plans[1].StartFile, gs.Equals, "")
+		})
+
+		c.Specify("resumes from the journaled position", func() {
+			journalDir, err := ioutil.TempDir("", "logstreamer-plan")
+			c.Assume(err, gs.IsNil)
+			defer os.RemoveAll(journalDir)
+			journal := `{"seek":500,"file_name":"` +
+				strings.Replace(firstError, `\`, `\\`, -1) +
+				`","last_hash":"dc6d00ed4a287968635b8b5b96a505547e9161d3"}`
+			err = ioutil.WriteFile(filepath.Join(journalDir, "error-log"), []byte(journal),
+				0644)
+			c.Assume(err, gs.IsNil)
+
+			ls, err := NewLogstreamSet(sp, oldest, dirPath, journalDir)
+			c.Assume(err, gs.IsNil)
+			plans, errs := ls.Plan(time.Now())
+			c.Expect(errs.IsError(), gs.IsFalse)
+			c.Assume(len(plans), gs.Equals, 2)
+			c.Assume(plans[1].Journal, gs.Not(gs.IsNil))
+			c.Expect(plans[1].Journal.Filename, gs.Equals, firstError)
+			c.Expect(plans[1].StartFile, gs.Equals, firstError)
+			c.Expect(plans[1].StartPosition, gs.Equals, int64(500))
+		})
+	})
 }
@@ -26,6 +26,7 @@ import (
 	"io"
 	"os"
 	"strings"
+	"sync/atomic"
 )
 
 // A location in a logstream indicating the farthest that has been read
@@ -39,6 +40,12 @@ type LogstreamLocation struct {
 
 var LINEBUFFERLEN = 500
 
+// Policies for resuming a logstream whose position can't be located.
+const (
+	PositionLostStart = "start"
+	PositionLostEnd   = "end"
+)
+
 // Returns whether an error is a OS file related error
 func IsFileError(err error) (fileError bool) {
 	switch err.(type) {
@@ -169,6 +176,7 @@ func (l *Logstream) NewerFileAvailable() (file string, ok bool) {
 		       NO - No newer file available.
 		       YES - return ok and the new filename.
 	*/
+	l.positionLost = false
 	currentInfo, err := l.fd.Stat()
 	if err != nil {
 		return "", false
@@ -205,7 +213,13 @@ func (l *Logstream) NewerFileAvailable() (file string, ok bool) {
 			l.lfMutex.RLock()
 			defer l.lfMutex.RUnlock()
 			if len(l.logfiles) > 0 {
+				// If we're still reading the file at our filename, it
+				// changed underneath us rather than being rotated away.
+				l.positionLost = os.SameFile(currentInfo, fInfo)
 				file = l.logfiles[0].FileName
+				if l.positionLost && l.positionLostPolicy == PositionLostEnd {
+					file = l.logfiles[len(l.logfiles)-1].FileName
+				}
 				return
 			} else {
 				// Apparently no logfiles at all, retain this fd
@@ -474,6 +488,7 @@ func (l *Logstream) Read(p []byte) (n int, err error) {
 	// If we have a position, attempt to restore it
 	var fd *os.File
 	var reader io.Reader
+	lost := false
 	if l.position.Filename != "" {
 		if fd, reader, err = l.LocatePriorLocation(true); err == nil {
 			l.fd = fd
@@ -486,6 +501,7 @@ func (l *Logstream) Read(p []byte) (n int, err error) {
 		if IsFileError(err) {
 			return 0, err
 		}
+		lost = true
 	}
 
 	// No position to recover from, use oldest file if there is one
@@ -494,12 +510,55 @@ func (l *Logstream) Read(p []byte) (n int, err error) {
 		return 0, io.EOF
 	}
 
+	if lost {
+		atomic.AddInt64(&l.lostCount, 1)
+		if l.positionLostPolicy == PositionLostEnd {
+			if err = l.positionAtEnd(l.logfiles[len(l.logfiles)-1].FileName); err != nil {
+				return 0, err
+			}
+			return l.Read(p)
+		}
+	}
+
 	// Reset the position, attempt to start in the oldest file
 	l.position.Reset()
 	l.position.Filename = l.logfiles[0].FileName
 	return l.Read(p)
 }
 
+// Moves the position to the end of a logfile, as if it had been read up to
+// there, so the position's hash is that of the file's last bytes. Gzipped
+// files are read from the start, their size not being known without reading
+// them.
+func (l *Logstream) positionAtEnd(filename string) error {
+	l.position.Reset()
+	l.position.Filename = filename
+	if isGzipFile(filename) {
+		return nil
+	}
+	fd, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	info, err := fd.Stat()
+	if err != nil {
+		return err
+	}
+	tailLen := info.Size()
+	if tailLen > int64(LINEBUFFERLEN) {
+		tailLen = int64(LINEBUFFERLEN)
+	}
+	tail := make([]byte, tailLen)
+	if _, err = fd.ReadAt(tail, info.Size()-tailLen); err != nil {
+		return err
+	}
+	l.position.SeekPosition = info.Size()
+	l.position.lastLine.Write(tail)
+	l.position.GenerateHash()
+	return nil
+}
+
 // Called to actually read from the file descriptor if possible
 func (l *Logstream) readBytes(p []byte) (n int, err error) {
 	// Before we read, we check to see if there's a newer file
@@ -521,7 +580,13 @@ func (l *Logstream) readBytes(p []byte) (n int, err error) {
 
 	// We're ready to read, commit the read and update our position
 	// TODO: should anything be done with the fd?
-	n, err = l.reader.Read(p)
+	if l.positionLost {
+		// The file changed underneath us, e.g. it was truncated and written
+		// to again, so what's at our offset isn't the rest of what we read.
+		err = io.EOF
+	} else {
+		n, err = l.reader.Read(p)
+	}
 
 	// If we read any bytes, write them to our saveBuffer.
 	// If our saveBuffer is smaller than the buffer we were just passed,
@@ -614,11 +679,26 @@ func (l *Logstream) readBytes(p []byte) (n int, err error) {
 	l.FlushBuffer(0)
 	l.fd.Close()
 	l.position.Reset()
+	l.priorEOF = false
+
+	if l.positionLost {
+		// The file changed underneath us rather than being rotated.
+		l.positionLost = false
+		atomic.AddInt64(&l.lostCount, 1)
+		if l.positionLostPolicy == PositionLostEnd {
+			fd.Close()
+			l.fd = nil
+			l.reader = nil
+			if err = l.positionAtEnd(newerFilename); err != nil {
+				return
+			}
+			return l.Read(p)
+		}
+	}
 
 	l.position.Filename = newerFilename
 	l.fd = fd
 	l.reader = reader
-	l.priorEOF = false
 
 	// Now attempt to read
 	return l.Read(p)
@@ -18,6 +18,8 @@ package logstreamer
 import (
 	"github.com/mozilla-services/heka/ringbuf"
 	gs "github.com/rafrombrc/gospec/src/gospec"
+	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"runtime"
@@ -192,4 +194,78 @@ func ReaderSpec(c gs.Context) {
 		// prepended by 0 bytes to fill out a length of 500.
 		c.Expect(l.Hash, gs.Equals, "4a9ab34da77c10e87cb6566bbf061d9715985551")
 	})
+
+	c.Specify("A logstream whose file changed underneath it", func() {
+		tmpDir, err := ioutil.TempDir("", "logstreamer-tests")
+		c.Assume(err, gs.IsNil)
+		defer os.RemoveAll(tmpDir)
+		logPath := filepath.Join(tmpDir, "app.log")
+		err = ioutil.WriteFile(logPath, []byte("rewritten first line\nsecond\n"), 0644)
+		c.Assume(err, gs.IsNil)
+
+		sp := &SortPattern{
+			FileMatch:   `app\.log`,
+			Translation: make(SubmatchTranslationMap),
+		}
+		ls, err := NewLogstreamSet(sp, 0, tmpDir, "")
+		c.Assume(err, gs.IsNil)
+		names, _ := ls.ScanForLogstreams()
+		c.Assume(len(names), gs.Equals, 1)
+		stream, _ := ls.GetLogstream(names[0])
+		// Journaled before the file was truncated and rewritten.
+		stream.position.Filename = logPath
+		stream.position.SeekPosition = 10
+		stream.position.Hash = "dc6d00ed4a287968635b8b5b96a505547e9161d3"
+		b := make([]byte, 100)
+
+		c.Specify("is reread from the start by default", func() {
+			n, err := stream.Read(b)
+			c.Expect(err, gs.IsNil)
+			c.Expect(string(b[:n]), gs.Equals, "rewritten first line\nsecond\n")
+			c.Expect(stream.PositionsLost(), gs.Equals, int64(1))
+		})
+
+		c.Specify("skips to the end with the end policy", func() {
+			c.Expect(ls.SetPositionLostPolicy(PositionLostEnd), gs.IsNil)
+			n, err := stream.Read(b)
+			c.Expect(n, gs.Equals, 0)
+			c.Expect(err, gs.Equals, io.EOF)
+			c.Expect(stream.PositionsLost(), gs.Equals, int64(1))
+			c.Expect(stream.position.SeekPosition, gs.Equals, int64(28))
+
+			// The new position is journaled with a valid hash.
+			f, err := os.OpenFile(logPath, os.O_APPEND|os.O_WRONLY, 0644)
+			c.Assume(err, gs.IsNil)
+			f.WriteString("third\n")
+			f.Close()
+			n, err = stream.Read(b)
+			c.Expect(string(b[:n]), gs.Equals, "third\n")
+			c.Expect(stream.PositionsLost(), gs.Equals, int64(1))
+		})
+
+		c.Specify("is reread when truncated and rewritten while being read", func() {
+			stream.position.Reset()
+			stream.position.Filename = logPath
+			n, err := stream.Read(b)
+			stream.FlushBuffer(n)
+			for err == nil {
+				n, err = stream.Read(b)
+			}
+			err = ioutil.WriteFile(logPath, []byte("longer than what was there before\n"),
+				0644)
+			c.Assume(err, gs.IsNil)
+			var read string
+			for i := 0; i < 3; i++ {
+				n, _ = stream.Read(b)
+				read += string(b[:n])
+			}
+			// Not the end of the new content from the old offset on.
+			c.Expect(read, gs.Equals, "longer than what was there before\n")
+			c.Expect(stream.PositionsLost(), gs.Equals, int64(1))
+		})
+
+		c.Specify("rejects unknown policies", func() {
+			c.Expect(ls.SetPositionLostPolicy("middle"), gs.Not(gs.IsNil))
+		})
+	})
 }
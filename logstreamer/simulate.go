@@ -0,0 +1,132 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package logstreamer
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Describes what a LogstreamSet would do with a single logstream, without
+// opening any readers or touching the journal.
+type LogstreamPlan struct {
+	Name string
+	// Logfiles in the order they'll be read, oldest first.
+	Logfiles Logfiles
+	// Matching logfiles that were skipped because they were last modified
+	// before the oldest duration cutoff.
+	Expired Logfiles
+	// Set if the logstream isn't usable, in which case it won't be read.
+	Err error
+	// Position loaded from the journal, nil if there was no journal entry.
+	Journal *LogstreamLocation
+	// File and offset where reading would start. StartFile is empty if there
+	// are no logfiles to read.
+	StartFile     string
+	StartPosition int64
+	// Explanation of how the start position was chosen.
+	StartReason string
+}
+
+// Simulates a scan of the log directory as of the specified time, returning
+// the plans for every logstream that would be found, sorted by name. The
+// returned logstreams aren't added to the set.
+func (ls *LogstreamSet) Plan(now time.Time) (plans []*LogstreamPlan, errors *MultipleError) {
+	errors = NewMultipleError()
+	logfiles, expired := ls.scanLogfiles(now)
+	mfs := FilterMultipleStreamFiles(logfiles, ls.sortPattern.Differentiator)
+
+	// Expired files need match parts to be assigned to a logstream.
+	expired.PopulateMatchParts(ls.fileMatch, ls.sortPattern.Translation)
+	expiredMap := FilterMultipleStreamFiles(expired, ls.sortPattern.Differentiator)
+	for name := range expiredMap {
+		if _, ok := mfs[name]; !ok {
+			mfs[name] = Logfiles{}
+		}
+	}
+
+	names := make([]string, 0, len(mfs))
+	for name := range mfs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		plan := &LogstreamPlan{
+			Name:     name,
+			Logfiles: mfs[name],
+			Expired:  expiredMap[name],
+		}
+		plans = append(plans, plan)
+		if plan.Err = ls.sortLogfiles(name, plan.Logfiles); plan.Err != nil {
+			continue
+		}
+		var position *LogstreamLocation
+		if ls.journalRoot != "" {
+			position = ls.loadPosition(name, errors)
+		} else {
+			position = new(LogstreamLocation)
+			position.Reset()
+		}
+		if position.Filename != "" {
+			journal := *position
+			plan.Journal = &journal
+		}
+		logstream := NewLogstream(plan.Logfiles, position)
+		logstream.positionLostPolicy = ls.positionLostPolicy
+		plan.StartFile, plan.StartPosition, plan.StartReason = logstream.startPosition()
+	}
+	return
+}
+
+// Determines where the first Read would start, mirroring the decisions made
+// by Read but without keeping any files open.
+func (l *Logstream) startPosition() (filename string, seek int64, reason string) {
+	if journaled := l.position.Filename; journaled != "" {
+		fd, _, err := l.LocatePriorLocation(true)
+		if err == nil {
+			fd.Close()
+			if l.position.Filename == journaled {
+				reason = "resuming from the journaled position"
+			} else {
+				reason = fmt.Sprintf("journaled file %s was rotated, resuming from "+
+					"the matching position in its new location", journaled)
+			}
+			return l.position.Filename, l.position.SeekPosition, reason
+		}
+		if IsFileError(err) {
+			return "", 0, fmt.Sprintf("can't read logfiles, will retry: %s", err)
+		}
+		resume := "starting at the oldest file"
+		if l.positionLostPolicy == PositionLostEnd {
+			resume = "skipping to the end of the newest file"
+		}
+		reason = fmt.Sprintf("journaled position %s:%d wasn't found in any "+
+			"current logfile (the file may have expired, been truncated, or been "+
+			"rewritten), %s", journaled, l.position.SeekPosition, resume)
+		if len(l.logfiles) > 0 && l.positionLostPolicy == PositionLostEnd {
+			newest := l.logfiles[len(l.logfiles)-1].FileName
+			if err = l.positionAtEnd(newest); err != nil {
+				return "", 0, fmt.Sprintf("can't read logfiles, will retry: %s", err)
+			}
+			return newest, l.position.SeekPosition, reason
+		}
+	} else {
+		reason = "no journaled position, starting at the oldest file"
+	}
+
+	if len(l.logfiles) < 1 {
+		return "", 0, "no logfiles found, waiting for one to appear"
+	}
+	return l.logfiles[0].FileName, 0, reason
+}
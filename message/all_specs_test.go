@@ -29,6 +29,7 @@ func TestAllSpecs(t *testing.T) {
 	r.AddSpec(MessageFieldsSpec)
 	r.AddSpec(MessageEqualsSpec)
 	r.AddSpec(MatcherSpecificationSpec)
+	r.AddSpec(MatchCacheSpec)
 	gospec.MainGoTest(r, t)
 }
 
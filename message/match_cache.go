@@ -0,0 +1,161 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package message
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+)
+
+// Values of a MatchCache result.
+const (
+	cachedUnknown uint32 = iota
+	cachedFalse
+	cachedTrue
+)
+
+// Assigns MatchCache slots to the sub-expressions shared by several matcher
+// specifications, e.g. the `Type == 'nginx'` of `Type == 'nginx' && Severity
+// < 4` and `Type == 'nginx' && Fields[status] >= 500`, so their result is
+// only evaluated once per message. Not safe for concurrent use, but the
+// specifications may be matched while sub-expressions are being shared.
+type MatchCacheIndex struct {
+	exprs map[string]*sharedExpr
+	slots int
+}
+
+// Sub-expression seen in one or more specifications.
+type sharedExpr struct {
+	slot int32
+	// Nodes of the expression seen before it was shared.
+	nodes []*tree
+}
+
+func NewMatchCacheIndex() *MatchCacheIndex {
+	return &MatchCacheIndex{exprs: make(map[string]*sharedExpr)}
+}
+
+// Registers the sub-expressions of a specification, assigning a slot to
+// those also found in previously registered specifications. Slots are never
+// reused, so a removed specification still being matched can't store a
+// result in another expression's slot.
+func (idx *MatchCacheIndex) Share(m *MatcherSpecification) {
+	idx.share(m.vm)
+}
+
+// Returns the number of slots a MatchCache needs.
+func (idx *MatchCacheIndex) Len() int {
+	return idx.slots
+}
+
+// Registers a node and its children, returning the node's expression key.
+func (idx *MatchCacheIndex) share(t *tree) string {
+	if t == nil {
+		return ""
+	}
+	var key string
+	if t.left == nil {
+		switch t.stmt.op.tokenId {
+		case TRUE, FALSE:
+			return statementKey(t.stmt) // Nothing to save.
+		}
+		key = "(" + statementKey(t.stmt) + ")"
+	} else {
+		key = fmt.Sprintf("(%s %d %s)", idx.share(t.left), t.stmt.op.tokenId,
+			idx.share(t.right))
+	}
+	expr, ok := idx.exprs[key]
+	switch {
+	case !ok:
+		idx.exprs[key] = &sharedExpr{nodes: []*tree{t}}
+	case expr.slot != 0:
+		atomic.StoreInt32(&t.slot, expr.slot)
+	default:
+		idx.slots++
+		expr.slot = int32(idx.slots)
+		for _, node := range append(expr.nodes, t) {
+			atomic.StoreInt32(&node.slot, expr.slot)
+		}
+		expr.nodes = nil
+	}
+	return key
+}
+
+// Returns a key identifying what a statement tests.
+func statementKey(stmt *Statement) string {
+	return fmt.Sprintf("%s %d %s", symbolKey(stmt.field), stmt.op.tokenId,
+		symbolKey(stmt.value))
+}
+
+func symbolKey(sym yySymType) string {
+	key := fmt.Sprintf("%d:%q:%g:%d:%d", sym.tokenId, sym.token, sym.double,
+		sym.fieldIndex, sym.arrayIndex)
+	if len(sym.values) > 0 {
+		values := make([]string, len(sym.values))
+		for i, v := range sym.values {
+			values[i] = symbolKey(v)
+		}
+		key += "[" + strings.Join(values, ",") + "]"
+	}
+	return key
+}
+
+// Results of the shared sub-expressions evaluated for a message, filled in
+// by the specifications matched against it, concurrently if need be.
+type MatchCache struct {
+	results []uint32
+}
+
+// Forgets the cached results, making room for `size` of them, see
+// MatchCacheIndex.Len. Must not be called while the cache is in use.
+func (c *MatchCache) Reset(size int) {
+	if cap(c.results) < size {
+		c.results = make([]uint32, size)
+		return
+	}
+	c.results = c.results[:size]
+	for i := range c.results {
+		c.results[i] = cachedUnknown
+	}
+}
+
+// MatchCached is like Match, using and filling in the results of the shared
+// sub-expressions cached for the message. The cache may be nil.
+func (m *MatcherSpecification) MatchCached(message *Message, cache *MatchCache) bool {
+	return evalMatcherSpecification(m.vm, message, nil, cache)
+}
+
+// Returns the cached result of a node, if any, and where to store it
+// otherwise.
+func (c *MatchCache) lookup(t *tree) (b, ok bool, result *uint32) {
+	slot := int(atomic.LoadInt32(&t.slot))
+	if slot == 0 || slot > len(c.results) {
+		return
+	}
+	result = &c.results[slot-1]
+	switch atomic.LoadUint32(result) {
+	case cachedFalse:
+		return false, true, nil
+	case cachedTrue:
+		return true, true, nil
+	}
+	return
+}
+
+func storeResult(result *uint32, b bool) {
+	if b {
+		atomic.StoreUint32(result, cachedTrue)
+	} else {
+		atomic.StoreUint32(result, cachedFalse)
+	}
+}
@@ -0,0 +1,88 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package message
+
+import (
+	"github.com/rafrombrc/gospec/src/gospec"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+)
+
+func MatchCacheSpec(c gospec.Context) {
+	msg := getTestMessage()
+	idx := NewMatchCacheIndex()
+	newSpec := func(spec string) *MatcherSpecification {
+		ms, err := CreateMatcherSpecification(spec)
+		c.Assume(err, gs.IsNil)
+		idx.Share(ms)
+		return ms
+	}
+
+	c.Specify("A match cache index", func() {
+		c.Specify("only shares sub-expressions found in several specs", func() {
+			ms1 := newSpec("Type == 'TEST' && Severity < 4")
+			c.Expect(idx.Len(), gs.Equals, 0)
+			ms2 := newSpec("Type == 'TEST' && Fields[foo] =~ /^b/")
+			c.Expect(idx.Len(), gs.Equals, 1)
+			c.Expect(ms1.vm.left.slot, gs.Equals, int32(1))
+			c.Expect(ms2.vm.left.slot, gs.Equals, int32(1))
+			c.Expect(ms1.vm.slot, gs.Equals, int32(0))
+
+			newSpec("Type == 'TEST' && Severity < 4 || Logger == 'x'")
+			c.Expect(idx.Len(), gs.Equals, 3)
+			c.Expect(ms1.vm.right.slot, gs.Equals, int32(2))
+			c.Expect(ms1.vm.slot, gs.Equals, int32(3))
+		})
+
+		c.Specify("tells apart statements testing different things", func() {
+			newSpec("Fields[foo] =~ /^b/")
+			newSpec("Fields[foo] =~ /b$/")
+			newSpec("Fields[foo][1] =~ /^b/")
+			newSpec("Fields[foo] IN ('a', 'b')")
+			newSpec("Fields[foo] IN ('a', 'c')")
+			newSpec("TRUE")
+			newSpec("TRUE")
+			c.Expect(idx.Len(), gs.Equals, 0)
+		})
+	})
+
+	c.Specify("A match cache", func() {
+		ms1 := newSpec("Type == 'TEST' && Fields[number] == 64")
+		ms2 := newSpec("Type == 'TEST' && Fields[number] == 64 && Severity == 6")
+		cache := new(MatchCache)
+		cache.Reset(idx.Len())
+
+		c.Specify("stores the shared results", func() {
+			c.Expect(ms1.MatchCached(msg, cache), gs.IsTrue)
+			c.Expect(len(cache.results), gs.Equals, 3)
+			for _, result := range cache.results {
+				c.Expect(result, gs.Equals, cachedTrue)
+			}
+			c.Expect(ms2.MatchCached(msg, cache), gs.IsTrue)
+		})
+
+		c.Specify("is used instead of evaluating again", func() {
+			cache.results[2] = cachedFalse
+			c.Expect(ms1.MatchCached(msg, cache), gs.IsFalse)
+			c.Expect(ms2.MatchCached(msg, cache), gs.IsFalse)
+			c.Expect(ms1.Match(msg), gs.IsTrue)
+
+			cache.Reset(idx.Len())
+			c.Expect(ms2.MatchCached(msg, cache), gs.IsTrue)
+		})
+
+		c.Specify("is ignored for slots added after it was reset", func() {
+			cache.Reset(0)
+			c.Expect(ms1.MatchCached(msg, cache), gs.IsTrue)
+			c.Expect(ms1.MatchCached(msg, nil), gs.IsTrue)
+		})
+	})
+}
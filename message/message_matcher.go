@@ -14,7 +14,10 @@
 
 package message
 
-import "strings"
+import (
+	"net"
+	"strings"
+)
 
 // MatcherSpecification used by the message router to distribute messages
 type MatcherSpecification struct {
@@ -37,7 +40,24 @@ func CreateMatcherSpecification(spec string) (*MatcherSpecification, error) {
 // Match compares the message against the matcher spec and return the match
 // result
 func (m *MatcherSpecification) Match(message *Message) bool {
-	return evalMatcherSpecification(m.vm, message)
+	return evalMatcherSpecification(m.vm, message, nil, nil)
+}
+
+// MatchCaptures is like Match, also returning the values of the named capture
+// groups, e.g. `(?P<status>\d+)`, of the regular expressions that matched
+// while evaluating the spec, or nil if the message doesn't match. Groups that
+// didn't participate in their regular expression's match are omitted. The
+// router doesn't keep the captures of its own evaluation, so a plugin calling
+// this for the packs it receives evaluates its matcher a second time, without
+// the router's shared sub-expression cache.
+func (m *MatcherSpecification) MatchCaptures(message *Message) (match bool,
+	captures map[string]string) {
+
+	captures = make(map[string]string)
+	if match = evalMatcherSpecification(m.vm, message, captures, nil); !match {
+		captures = nil
+	}
+	return
 }
 
 // String outputs the spec as text
@@ -45,16 +65,57 @@ func (m *MatcherSpecification) String() string {
 	return m.spec
 }
 
-func evalMatcherSpecification(t *tree, msg *Message) (b bool) {
+func evalMatcherSpecification(t *tree, msg *Message,
+	captures map[string]string, cache *MatchCache) (b bool) {
+
 	if t == nil {
 		return false
 	}
 
-	if t.left != nil {
-		b = evalMatcherSpecification(t.left, msg)
-	} else {
-		return testExpr(msg, t.stmt)
+	if cache != nil {
+		var cached bool
+		var result *uint32
+		if b, cached, result = cache.lookup(t); cached {
+			return
+		}
+		if result != nil {
+			b = evalNode(t, msg, captures, cache)
+			storeResult(result, b)
+			return
+		}
+	}
+	return evalNode(t, msg, captures, cache)
+}
+
+func evalNode(t *tree, msg *Message, captures map[string]string,
+	cache *MatchCache) (b bool) {
+
+	if t.left == nil {
+		b = testExpr(msg, t.stmt)
+		if b && captures != nil && t.stmt.op.tokenId == OP_RE &&
+			t.stmt.value.regexp != nil {
+			addCaptures(msg, t.stmt, captures)
+		}
+		return
+	}
+	if captures == nil {
+		return evalBranches(t, msg, nil, cache)
+	}
+	// The captures of a branch are only kept if it matches, so that those of
+	// e.g. an AND failing part-way don't leak into a matching OR alternative.
+	branch := make(map[string]string)
+	if b = evalBranches(t, msg, branch, cache); b {
+		for name, value := range branch {
+			captures[name] = value
+		}
 	}
+	return
+}
+
+func evalBranches(t *tree, msg *Message, captures map[string]string,
+	cache *MatchCache) (b bool) {
+
+	b = evalMatcherSpecification(t.left, msg, captures, cache)
 	if b == true && t.stmt.op.tokenId == OP_OR {
 		return // short circuit
 	}
@@ -63,7 +124,7 @@ func evalMatcherSpecification(t *tree, msg *Message) (b bool) {
 	}
 
 	if t.right != nil {
-		b = evalMatcherSpecification(t.right, msg)
+		b = evalMatcherSpecification(t.right, msg, captures, cache)
 	}
 	return
 }
@@ -98,7 +159,102 @@ func getNumericValue(msg *Message, stmt *Statement) float64 {
 	return 0
 }
 
+// Adds the named capture groups of a statement's regular expression, which
+// is known to match.
+func addCaptures(msg *Message, stmt *Statement, captures map[string]string) {
+	var s string
+	switch stmt.field.tokenId {
+	case VAR_FIELDS:
+		var ok bool
+		if s, ok = getFieldString(msg, stmt); !ok {
+			return
+		}
+	default:
+		s = getStringValue(msg, stmt)
+	}
+	re := stmt.value.regexp
+	loc := re.FindStringSubmatchIndex(s)
+	if loc == nil {
+		return
+	}
+	for i, name := range re.SubexpNames() {
+		if name != "" && loc[2*i] != -1 {
+			captures[name] = s[loc[2*i]:loc[2*i+1]]
+		}
+	}
+}
+
+// Returns the value of a string or bytes field referenced by a statement.
+func getFieldString(msg *Message, stmt *Statement) (string, bool) {
+	fi := stmt.field.fieldIndex
+	ai := stmt.field.arrayIndex
+	var field *Field
+	if fi != 0 {
+		fields := msg.FindAllFields(stmt.field.token)
+		if fi >= len(fields) {
+			return "", false
+		}
+		field = fields[fi]
+	} else if field = msg.FindFirstField(stmt.field.token); field == nil {
+		return "", false
+	}
+	switch field.GetValueType() {
+	case Field_STRING:
+		if ai < len(field.ValueString) {
+			return field.ValueString[ai], true
+		}
+	case Field_BYTES:
+		if ai < len(field.ValueBytes) {
+			return string(field.ValueBytes[ai]), true
+		}
+	}
+	return "", false
+}
+
+// Tests membership of a string in the strings of an IN set.
+func stringSetTest(s string, stmt *Statement) bool {
+	for _, v := range stmt.value.values {
+		if v.tokenId == STRING_VALUE && s == v.token {
+			return true
+		}
+	}
+	return false
+}
+
+// Tests membership of a number in the numbers of an IN set.
+func numericSetTest(f float64, stmt *Statement) bool {
+	for _, v := range stmt.value.values {
+		if v.tokenId == NUMERIC_VALUE && f == v.double {
+			return true
+		}
+	}
+	return false
+}
+
+// Tests whether a string is an IP address in one of the networks of a CIDR
+// statement.
+func cidrTest(s string, stmt *Statement) bool {
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return false
+	}
+	for _, network := range stmt.value.nets {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
 func stringTest(s string, stmt *Statement) bool {
+	switch stmt.op.tokenId {
+	case OP_IN:
+		return stringSetTest(s, stmt)
+	case OP_CIDR:
+		return cidrTest(s, stmt)
+	case OP_BETWEEN:
+		return false
+	}
 	if stmt.value.tokenId == NUMERIC_VALUE {
 		return false
 	}
@@ -142,6 +298,14 @@ func stringTest(s string, stmt *Statement) bool {
 }
 
 func numericTest(f float64, stmt *Statement) bool {
+	switch stmt.op.tokenId {
+	case OP_IN:
+		return numericSetTest(f, stmt)
+	case OP_BETWEEN:
+		return f >= stmt.value.values[0].double && f <= stmt.value.values[1].double
+	case OP_CIDR:
+		return false
+	}
 	if !(stmt.value.tokenId == NUMERIC_VALUE || stmt.value.tokenId == NIL_VALUE) {
 		return false
 	}
@@ -226,6 +390,10 @@ func testExpr(msg *Message, stmt *Statement) bool {
 				if ai >= len(field.ValueBool) {
 					return testNonExistence(stmt)
 				}
+				switch stmt.op.tokenId {
+				case OP_IN, OP_BETWEEN, OP_CIDR:
+					return false
+				}
 				if stmt.value.tokenId == NIL_VALUE {
 					if stmt.op.tokenId == OP_EQ {
 						return false
@@ -4,6 +4,7 @@ package message
 import (
 	"fmt"
 	"log"
+	"net"
 	"regexp"
 	"strconv"
 	"sync"
@@ -28,7 +29,12 @@ var variables = map[string]int{
 	"Fields":     VAR_FIELDS,
 	"TRUE":       TRUE,
 	"FALSE":      FALSE,
-	"NIL":        NIL_VALUE}
+	"NIL":        NIL_VALUE,
+	"EXISTS":     OP_EXISTS,
+	"IN":         OP_IN,
+	"BETWEEN":    OP_BETWEEN,
+	"AND":        BETWEEN_AND,
+	"CIDR":       OP_CIDR}
 
 var parseLock sync.Mutex
 
@@ -40,6 +46,9 @@ type tree struct {
 	left  *tree
 	stmt  *Statement
 	right *tree
+	// 1-based slot of the sub-expression's result in a MatchCache, 0 if
+	// it isn't cached. Accessed atomically, see MatchCacheIndex.
+	slot int32
 }
 
 type stack struct {
@@ -77,9 +86,12 @@ var nodes []*tree
    fieldIndex  int
    arrayIndex  int
    regexp      *regexp.Regexp
+   values      []yySymType
+   nets        []*net.IPNet
 }
 
 %token OP_EQ OP_NE OP_GT OP_GTE OP_LT OP_LTE OP_RE OP_NRE
+%token OP_EXISTS OP_IN OP_BETWEEN BETWEEN_AND OP_CIDR
 %token OP_OR OP_AND
 %token VAR_UUID VAR_TYPE VAR_LOGGER VAR_PAYLOAD VAR_ENVVERSION VAR_HOSTNAME
 %token VAR_TIMESTAMP VAR_SEVERITY VAR_PID
@@ -120,6 +132,34 @@ numeric_vars : VAR_TIMESTAMP
    | VAR_SEVERITY
    | VAR_PID
 ;
+set_value : STRING_VALUE
+   | NUMERIC_VALUE
+;
+set_values : set_value
+      {
+      $$.values = []yySymType{$1}
+      }
+   | set_values ',' set_value
+      {
+      $$.values = append($1.values, $3)
+      }
+;
+set : '(' set_values ')'
+      {
+      $$ = yySymType{values: $2.values}
+      }
+;
+range : NUMERIC_VALUE BETWEEN_AND NUMERIC_VALUE
+      {
+      $$ = yySymType{values: []yySymType{$1, $3}}
+      }
+;
+cidrs : STRING_VALUE
+      {
+      $$ = yySymType{values: []yySymType{$1}}
+      }
+   | set
+;
 string_test : string_vars relational STRING_VALUE
        {
        //fmt.Println("string_test", $1, $2, $3)
@@ -130,12 +170,32 @@ string_test : string_vars relational STRING_VALUE
        //fmt.Println("string_test regexp", $1, $2, $3)
        nodes = append(nodes, &tree{stmt:&Statement{$1, $2, $3}})
        }
+   |   string_vars OP_IN set
+       {
+       //fmt.Println("string_test set", $1, $2, $3)
+       nodes = append(nodes, &tree{stmt:&Statement{$1, $2, $3}})
+       }
+   |   string_vars OP_IN OP_CIDR cidrs
+       {
+       //fmt.Println("string_test cidr", $1, $3, $4)
+       nodes = append(nodes, &tree{stmt:&Statement{$1, $3, $4}})
+       }
 ;
 numeric_test : numeric_vars relational NUMERIC_VALUE
    {
    //fmt.Println("numeric_test", $1, $2, $3)
    nodes = append(nodes, &tree{stmt:&Statement{$1, $2, $3}})
    }
+   | numeric_vars OP_IN set
+   {
+   //fmt.Println("numeric_test set", $1, $2, $3)
+   nodes = append(nodes, &tree{stmt:&Statement{$1, $2, $3}})
+   }
+   | numeric_vars OP_BETWEEN range
+   {
+   //fmt.Println("numeric_test range", $1, $2, $3)
+   nodes = append(nodes, &tree{stmt:&Statement{$1, $2, $3}})
+   }
 ;
 field_test : VAR_FIELDS relational NUMERIC_VALUE
       {
@@ -162,6 +222,29 @@ field_test : VAR_FIELDS relational NUMERIC_VALUE
       //fmt.Println("field_test existence", $1, $2, $3)
       nodes = append(nodes, &tree{stmt:&Statement{$1, $2, $3}})
       }
+   | OP_EXISTS VAR_FIELDS
+      {
+      //fmt.Println("field_test exists", $1, $2)
+      // Same as `Fields[x] != NIL`.
+      nodes = append(nodes, &tree{stmt:&Statement{$2,
+         yySymType{tokenId:OP_NE, token:"!="},
+         yySymType{tokenId:NIL_VALUE, token:"NIL"}}})
+      }
+   | VAR_FIELDS OP_IN set
+      {
+      //fmt.Println("field_test set", $1, $2, $3)
+      nodes = append(nodes, &tree{stmt:&Statement{$1, $2, $3}})
+      }
+   | VAR_FIELDS OP_BETWEEN range
+      {
+      //fmt.Println("field_test range", $1, $2, $3)
+      nodes = append(nodes, &tree{stmt:&Statement{$1, $2, $3}})
+      }
+   | VAR_FIELDS OP_IN OP_CIDR cidrs
+      {
+      //fmt.Println("field_test cidr", $1, $3, $4)
+      nodes = append(nodes, &tree{stmt:&Statement{$1, $3, $4}})
+      }
 ;
 boolean : TRUE | FALSE
 expr : '(' expr ')'
@@ -209,6 +292,11 @@ func parseMatcherSpecification(ms *MatcherSpecification) error {
 	if yyParse(&msp) == 0 {
 		s := new(stack)
 		for _, node := range nodes {
+			if node.stmt.op.tokenId == OP_CIDR {
+				if err := parseCIDRs(node.stmt); err != nil {
+					return err
+				}
+			}
 			if node.stmt.op.tokenId != OP_OR &&
 				node.stmt.op.tokenId != OP_AND {
 				s.push(node)
@@ -224,6 +312,21 @@ func parseMatcherSpecification(ms *MatcherSpecification) error {
 	return fmt.Errorf("syntax error: last token: %s pos: %d", msp.sym, msp.lexPos)
 }
 
+// Parses the networks of a CIDR statement.
+func parseCIDRs(stmt *Statement) error {
+	for _, v := range stmt.value.values {
+		if v.tokenId != STRING_VALUE {
+			return fmt.Errorf("CIDR networks must be quoted strings: %s", v.token)
+		}
+		_, network, err := net.ParseCIDR(v.token)
+		if err != nil {
+			return err
+		}
+		stmt.value.nets = append(stmt.value.nets, network)
+	}
+	return nil
+}
+
 func (m *MatcherSpecificationParser) Error(s string) {
 	fmt.Errorf("syntax error: %s last token: %s pos: %d", m.sym, m.lexPos)
 }
@@ -455,7 +558,7 @@ regexpstring:
 	}
 	rlen := len(m.sym)
 	if rlen > 0 && m.sym[0] == '^' {
-		if re, err := regexp.Compile(m.sym[1:]); err == nil {
+		if re, err := regexp.Compile(m.sym[1:]); err == nil && re.NumSubexp() == 0 {
 			if s, b := re.LiteralPrefix(); b {
 				yylval.token = s
 				yylval.fieldIndex = STARTS_WITH
@@ -465,7 +568,7 @@ regexpstring:
 		}
 	}
 	if rlen > 0 && m.sym[rlen-1] == '$' {
-		if re, err := regexp.Compile(m.sym[:rlen-1]); err == nil {
+		if re, err := regexp.Compile(m.sym[:rlen-1]); err == nil && re.NumSubexp() == 0 {
 			if s, b := re.LiteralPrefix(); b {
 				yylval.token = s
 				yylval.fieldIndex = ENDS_WITH
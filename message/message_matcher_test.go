@@ -43,6 +43,7 @@ func MatcherSpecificationSpec(c gospec.Context) {
 	field7, _ := NewField("Timestamp", date, "date-time")
 	field8, _ := NewField("zero", int64(0), "")
 	field9, _ := NewField("string", "43", "")
+	field10, _ := NewField("ip", "192.168.1.10", "ipv4")
 	msg.AddField(field1)
 	msg.AddField(field2)
 	msg.AddField(field3)
@@ -52,6 +53,7 @@ func MatcherSpecificationSpec(c gospec.Context) {
 	msg.AddField(field7)
 	msg.AddField(field8)
 	msg.AddField(field9)
+	msg.AddField(field10)
 
 	c.Specify("A MatcherSpecification", func() {
 		malformed := []string{
@@ -79,6 +81,17 @@ func MatcherSpecificationSpec(c gospec.Context) {
 			"NIL",                                                         // invalid use of constant
 			"Type == NIL",                                                 // existence check only works on fields
 			"Fields[test] > NIL",                                          // existence check only works with equals and not equals
+			"Fields[int] IN ()",                                           // empty set
+			"Fields[int] IN 999",                                          // set without parentheses
+			"Fields[int] IN (999,)",                                       // trailing comma
+			"Type IN (/TEST/)",                                            // regexp in set
+			"EXISTS Type",                                                 // existence check only works on fields
+			"EXISTS",                                                      // missing field
+			"Fields[int] BETWEEN 1",                                       // missing upper bound
+			"Fields[int] BETWEEN 'a' AND 'b'",                             // non numeric bounds
+			"Fields[ip] IN CIDR 'bogus'",                                  // invalid network
+			"Fields[ip] IN CIDR (10)",                                     // unquoted network
+			"Type == 'TEST' AND Severity == 6",                            // AND is only used by BETWEEN
 		}
 
 		negative := []string{
@@ -115,6 +128,18 @@ func MatcherSpecificationSpec(c gospec.Context) {
 			"Type =~ /st$/",
 			"Type !~ /^TE/",
 			"Type !~ /ST$/",
+			"Fields[int] IN (1, 2)",
+			"Fields[string] IN (43)",
+			"Fields[bool] IN (1)",
+			"Type IN ('test', 'foo')",
+			"Severity IN (5, 7)",
+			"EXISTS Fields[missing]",
+			"Fields[int] BETWEEN 1000 AND 2000",
+			"Fields[foo] BETWEEN 0 AND 1",
+			"Severity BETWEEN 0 AND 5",
+			"Fields[ip] IN CIDR '10.0.0.0/8'",
+			"Fields[int] IN CIDR '0.0.0.0/0'",
+			"Fields[missing] IN CIDR '0.0.0.0/0'",
 		}
 
 		positive := []string{
@@ -168,6 +193,18 @@ func MatcherSpecificationSpec(c gospec.Context) {
 			"Type =~ /ST$/",
 			"Type !~ /^te/",
 			"Type !~ /st$/",
+			"Fields[int] IN (1, 999)",
+			"Fields[foo] IN ('baz', \"bar\")",
+			"Type IN ('foo', 'TEST')",
+			"Severity IN (5, 6)",
+			"EXISTS Fields[int]",
+			"EXISTS Fields[bool] && Type == 'TEST'",
+			"Fields[int] BETWEEN 900 AND 999",
+			"Fields[double] BETWEEN 99.5 AND 100",
+			"Severity BETWEEN 6 AND 7",
+			"Fields[ip] IN CIDR '192.168.0.0/16'",
+			"Fields[ip] IN CIDR ('10.0.0.0/8', \"192.168.1.0/24\")",
+			"Fields[ip] IN CIDR '192.168.1.10/32' && Fields[int] BETWEEN 1 AND 1000",
 		}
 
 		c.Specify("malformed matcher tests", func() {
@@ -194,6 +231,35 @@ func MatcherSpecificationSpec(c gospec.Context) {
 				c.Expect(match, gs.IsTrue)
 			}
 		})
+
+		c.Specify("returns named regexp captures", func() {
+			ms, err := CreateMatcherSpecification(
+				"Fields[Payload] =~ /name=(?P<name>\\w+);type=(?P<type>\\w+)(?P<none>x)?/ && Type =~ /^(?P<prefix>TE)/")
+			c.Assume(err, gs.IsNil)
+			match, captures := ms.MatchCaptures(msg)
+			c.Expect(match, gs.IsTrue)
+			c.Expect(len(captures), gs.Equals, 3)
+			compareCaptures(c, captures, map[string]string{
+				"name":   "test",
+				"type":   "web",
+				"prefix": "TE",
+			})
+
+			ms, err = CreateMatcherSpecification("Type =~ /(?P<type>TEST)/ && Severity == 7")
+			c.Assume(err, gs.IsNil)
+			match, captures = ms.MatchCaptures(msg)
+			c.Expect(match, gs.IsFalse)
+			c.Expect(captures, gs.IsNil)
+
+			// Captures of a branch failing part-way are dropped.
+			ms, err = CreateMatcherSpecification(
+				"(Type =~ /(?P<type>TEST)/ && Severity == 7) || Logger =~ /^(?P<logger>Go)/")
+			c.Assume(err, gs.IsNil)
+			match, captures = ms.MatchCaptures(msg)
+			c.Expect(match, gs.IsTrue)
+			c.Expect(len(captures), gs.Equals, 1)
+			compareCaptures(c, captures, map[string]string{"logger": "Go"})
+		})
 	})
 }
 
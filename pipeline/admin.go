@@ -0,0 +1,343 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"reflect"
+	"strings"
+)
+
+const GLOBALS_CHANGED_TYPE = "heka.globals-changed"
+
+// The global settings that can be changed while hekad is running, through
+// the admin API's `/globals` endpoint, named as in the hekad config.
+type TunableGlobals struct {
+	PoolSize              int    `json:"poolsize"`
+	PluginChanSize        int    `json:"plugin_chansize"`
+	MaxMsgLoops           uint   `json:"max_message_loops"`
+	MaxMsgProcessInject   uint   `json:"max_process_inject"`
+	MaxMsgProcessDuration uint64 `json:"max_process_duration"`
+	MaxMsgTimerInject     uint   `json:"max_timer_inject"`
+	SampleDenominator     int    `json:"sample_denominator"`
+	// Active sampling profile, empty for none, see SetSamplingProfile.
+	SamplingProfile string `json:"sampling_profile"`
+}
+
+// Returns the current values of the settings that can be changed at runtime.
+// Code running after startup must read them through this method rather than
+// the GlobalConfigStruct fields.
+func (g *GlobalConfigStruct) Tunables() (t TunableGlobals) {
+	g.tuningMutex.RLock()
+	t = g.tunables()
+	g.tuningMutex.RUnlock()
+	return
+}
+
+// Called with the tuningMutex held.
+func (g *GlobalConfigStruct) tunables() TunableGlobals {
+	return TunableGlobals{
+		PoolSize:              g.PoolSize,
+		PluginChanSize:        g.PluginChanSize,
+		MaxMsgLoops:           g.MaxMsgLoops,
+		MaxMsgProcessInject:   g.MaxMsgProcessInject,
+		MaxMsgProcessDuration: g.MaxMsgProcessDuration,
+		MaxMsgTimerInject:     g.MaxMsgTimerInject,
+		SampleDenominator:     g.SampleDenominator,
+		SamplingProfile:       g.SamplingProfile,
+	}
+}
+
+func (t TunableGlobals) validate(maxPoolSize int) error {
+	switch {
+	case t.PoolSize < 1 || t.PoolSize > maxPoolSize:
+		return fmt.Errorf("poolsize must be between 1 and %d (the max_poolsize)",
+			maxPoolSize)
+	case t.PluginChanSize < 1:
+		return fmt.Errorf("plugin_chansize must be at least 1")
+	case t.MaxMsgLoops < 1:
+		return fmt.Errorf("max_message_loops must be at least 1")
+	case t.MaxMsgProcessDuration < 1:
+		return fmt.Errorf("max_process_duration must be at least 1")
+	case t.SampleDenominator < 1:
+		return fmt.Errorf("sample_denominator must be at least 1")
+	}
+	return nil
+}
+
+// Applies new values of the runtime settings after validating them, logging
+// each change and injecting a `heka.globals-changed` message for it, with
+// the `source` of the change. The messages are injected in the background,
+// in order, so a backed up pipeline doesn't hold up the caller. A new pool
+// size resizes the pack pools; the channel size and sample denominator apply
+// to plugins started afterwards. A new sampling profile applies to the
+// running filters and outputs at once.
+func (pc *PipelineConfig) TuneGlobals(t TunableGlobals, source string) error {
+	if err := t.validate(cap(pc.inputRecycleChan)); err != nil {
+		return err
+	}
+	g := pc.Globals
+	if _, ok := g.SamplingProfiles[t.SamplingProfile]; !ok && t.SamplingProfile != "" {
+		return fmt.Errorf("unknown sampling_profile '%s'", t.SamplingProfile)
+	}
+	g.tuningMutex.Lock()
+	old := g.tunables()
+	g.PoolSize = t.PoolSize
+	g.PluginChanSize = t.PluginChanSize
+	g.MaxMsgLoops = t.MaxMsgLoops
+	g.MaxMsgProcessInject = t.MaxMsgProcessInject
+	g.MaxMsgProcessDuration = t.MaxMsgProcessDuration
+	g.MaxMsgTimerInject = t.MaxMsgTimerInject
+	g.SampleDenominator = t.SampleDenominator
+	if t.SamplingProfile != old.SamplingProfile {
+		g.SamplingProfile = t.SamplingProfile
+		// Applied with the lock held so concurrent changes can't interleave.
+		pc.applySamplingProfile()
+	}
+	g.tuningMutex.Unlock()
+
+	if t.PoolSize != old.PoolSize {
+		pc.inputPool.SetMinSize(t.PoolSize)
+		pc.injectPool.SetMinSize(t.PoolSize)
+	}
+
+	var changes []globalsChange
+	oldValue, newValue := reflect.ValueOf(old), reflect.ValueOf(t)
+	for i := 0; i < oldValue.NumField(); i++ {
+		before, after := oldValue.Field(i).Interface(), newValue.Field(i).Interface()
+		if before == after {
+			continue
+		}
+		setting := oldValue.Type().Field(i).Tag.Get("json")
+		log.Printf("Globals: %s changed from %v to %v by %s", setting, before, after,
+			source)
+		changes = append(changes, globalsChange{setting, before, after})
+	}
+	if len(changes) > 0 {
+		pc.announceLock.Lock()
+		previous := pc.globalsAnnounced
+		announced := make(chan struct{})
+		pc.globalsAnnounced = announced
+		pc.announceLock.Unlock()
+		go func() {
+			if previous != nil {
+				<-previous
+			}
+			for _, change := range changes {
+				pc.globalsChanged(change, source)
+			}
+			close(announced)
+		}()
+	}
+	return nil
+}
+
+type globalsChange struct {
+	setting       string
+	before, after interface{}
+}
+
+// Injects the audit message for a changed setting, waiting for a pack and
+// for the router to accept it.
+func (pc *PipelineConfig) globalsChanged(change globalsChange, source string) {
+	pack := pc.PipelinePack(0)
+	if pack == nil {
+		return
+	}
+	pack.Message.SetType(GLOBALS_CHANGED_TYPE)
+	pack.Message.SetLogger(HEKA_DAEMON)
+	pack.Message.SetPayload(fmt.Sprintf("%s changed from %v to %v by %s",
+		change.setting, change.before, change.after, source))
+	message.NewStringField(pack.Message, "setting", change.setting)
+	message.NewStringField(pack.Message, "old", fmt.Sprint(change.before))
+	message.NewStringField(pack.Message, "new", fmt.Sprint(change.after))
+	message.NewStringField(pack.Message, "source", source)
+	pc.router.inChan <- pack
+}
+
+// Starts the admin HTTP server, which runs until the returned listener is
+// closed. It serves:
+//
+//	GET /globals	The settings that can be changed at runtime, as JSON.
+//	PUT /globals	Changes some of them, given as a JSON object, returning the
+//			new values with a 202 status, as the audit messages are
+//			injected afterwards, or a 400 error if any of them is
+//			invalid.
+//	GET /config	The ResolvedConfig, as JSON.
+//	GET /plugins/<name>	The named plugin's PluginState, as JSON.
+//	GET /plugins/<name>/goroutines
+//			The stack traces of the plugin's goroutines, see
+//			PluginGoroutines.
+//
+// An address without a host listens on the loopback interface only. If a
+// token is given, requests must carry it in an `Authorization: Bearer`
+// header, and it is required to listen on any other interface.
+func (pc *PipelineConfig) startAdminServer(address, token string) (net.Listener, error) {
+	address, err := adminListenAddress(address, token)
+	if err != nil {
+		return nil, err
+	}
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/globals", pc.globalsHandler)
+	mux.HandleFunc("/config", pc.configHandler)
+	mux.HandleFunc("/plugins/", pc.pluginHandler)
+	go func() {
+		err := http.Serve(listener, adminAuth(token, mux))
+		if err != nil && !pc.Globals.IsShuttingDown() {
+			log.Printf("Admin API error: %s", err)
+		}
+	}()
+	return listener, nil
+}
+
+// Returns the address the admin API listens on, defaulting the host to the
+// loopback interface, or an error if it isn't a loopback address and there
+// is no token.
+func adminListenAddress(address, token string) (string, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", err
+	}
+	if host == "" {
+		host = "127.0.0.1"
+	}
+	if token == "" && !isLoopback(host) {
+		return "", fmt.Errorf("admin_token is required to listen on '%s'", address)
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// Wraps the handler so that requests without the token get a 401 error. An
+// empty token lets every request through.
+func adminAuth(token string, h http.Handler) http.Handler {
+	if token == "" {
+		return h
+	}
+	expected := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		given := []byte(req.Header.Get("Authorization"))
+		if subtle.ConstantTimeCompare(given, expected) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="hekad"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, req)
+	})
+}
+
+func (pc *PipelineConfig) globalsHandler(w http.ResponseWriter, req *http.Request) {
+	status := http.StatusOK
+	switch req.Method {
+	case "GET":
+	case "PUT", "POST":
+		// Settings missing from the request keep their current values.
+		t := pc.Globals.Tunables()
+		if err := decodeTunables(req.Body, &t); err != nil {
+			http.Error(w, fmt.Sprintf("invalid settings: %s", err), http.StatusBadRequest)
+			return
+		}
+		if err := pc.TuneGlobals(t, req.RemoteAddr); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		status = http.StatusAccepted
+	default:
+		w.Header().Set("Allow", "GET, PUT, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(pc.Globals.Tunables())
+}
+
+// Decodes the settings in the JSON object over those already in t, failing
+// on settings that can't be changed at runtime.
+func decodeTunables(r io.Reader, t *TunableGlobals) error {
+	body, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	var settings map[string]json.RawMessage
+	if err = json.Unmarshal(body, &settings); err != nil {
+		return err
+	}
+	known := reflect.TypeOf(*t)
+	for setting := range settings {
+		found := false
+		for i := 0; i < known.NumField() && !found; i++ {
+			found = known.Field(i).Tag.Get("json") == setting
+		}
+		if !found {
+			return fmt.Errorf("unknown setting \"%s\"", setting)
+		}
+	}
+	return json.Unmarshal(body, t)
+}
+
+func (pc *PipelineConfig) configHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(pc.ResolvedConfig())
+}
+
+func (pc *PipelineConfig) pluginHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name := strings.TrimPrefix(req.URL.Path, "/plugins/")
+	goroutines := strings.HasSuffix(name, "/goroutines")
+	name = strings.TrimSuffix(name, "/goroutines")
+	if _, ok := pc.pluginRunner(name); !ok {
+		http.Error(w, fmt.Sprintf("no plugin named '%s'", name), http.StatusNotFound)
+		return
+	}
+	if goroutines {
+		stacks, _ := PluginGoroutines(name)
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprintln(w, stacks)
+		return
+	}
+	state, ok := pc.InspectPlugin(name)
+	if !ok {
+		http.Error(w, fmt.Sprintf("no plugin named '%s'", name), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(state)
+}
@@ -0,0 +1,221 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"encoding/json"
+	"errors"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+)
+
+func AdminSpec(c gs.Context) {
+	c.Specify("The globals endpoint", func() {
+		pc := NewPipelineConfig(nil)
+		pc.injectPool.fill(nil)
+
+		request := func(method, body string) *httptest.ResponseRecorder {
+			req, err := http.NewRequest(method, "/globals", strings.NewReader(body))
+			c.Assume(err, gs.IsNil)
+			req.RemoteAddr = "127.0.0.1:5000"
+			resp := httptest.NewRecorder()
+			pc.globalsHandler(resp, req)
+			return resp
+		}
+		decode := func(resp *httptest.ResponseRecorder) (t TunableGlobals) {
+			err := json.Unmarshal(resp.Body.Bytes(), &t)
+			c.Assume(err, gs.IsNil)
+			return
+		}
+
+		c.Specify("returns the current settings", func() {
+			resp := request("GET", "")
+			c.Expect(resp.Code, gs.Equals, http.StatusOK)
+			t := decode(resp)
+			c.Expect(t.MaxMsgLoops, gs.Equals, uint(4))
+			c.Expect(t.PoolSize, gs.Equals, 100)
+		})
+
+		c.Specify("changes settings", func() {
+			resp := request("PUT", `{"max_message_loops": 6, "poolsize": 50}`)
+			c.Expect(resp.Code, gs.Equals, http.StatusAccepted)
+			t := decode(resp)
+			c.Expect(t.MaxMsgLoops, gs.Equals, uint(6))
+			c.Expect(t.PoolSize, gs.Equals, 50)
+			c.Expect(t.PluginChanSize, gs.Equals, 50)
+			c.Expect(pc.Globals.Tunables().MaxMsgLoops, gs.Equals, uint(6))
+			c.Expect(pc.inputPool.MinSize(), gs.Equals, 50)
+			c.Expect(pc.injectPool.MinSize(), gs.Equals, 50)
+
+			c.Specify("and injects an audit message for each", func() {
+				pack := <-pc.router.inChan
+				msg := pack.Message
+				c.Expect(msg.GetType(), gs.Equals, GLOBALS_CHANGED_TYPE)
+				setting, _ := msg.GetFieldValue("setting")
+				c.Expect(setting, gs.Equals, "poolsize")
+				old, _ := msg.GetFieldValue("old")
+				c.Expect(old, gs.Equals, "100")
+				source, _ := msg.GetFieldValue("source")
+				c.Expect(source, gs.Equals, "127.0.0.1:5000")
+				pack = <-pc.router.inChan
+				setting, _ = pack.Message.GetFieldValue("setting")
+				c.Expect(setting, gs.Equals, "max_message_loops")
+			})
+		})
+
+		c.Specify("rejects invalid settings", func() {
+			for _, body := range []string{
+				`{"max_message_loops": 0}`,
+				`{"poolsize": 101}`,
+				`{"plugin_chansize": -1}`,
+				`{"max_poolsize": 200}`,
+				`not json`,
+			} {
+				resp := request("PUT", body)
+				c.Expect(resp.Code, gs.Equals, http.StatusBadRequest)
+			}
+			c.Expect(pc.Globals.Tunables(), gs.Equals, DefaultGlobals().Tunables())
+			c.Expect(len(pc.router.inChan), gs.Equals, 0)
+		})
+
+		c.Specify("rejects other methods", func() {
+			resp := request("DELETE", "")
+			c.Expect(resp.Code, gs.Equals, http.StatusMethodNotAllowed)
+		})
+	})
+
+	c.Specify("The plugins endpoint", func() {
+		pc := NewPipelineConfig(nil)
+		iRunner := NewInputRunner("stat_accum", new(StatAccumInput), CommonInputConfig{})
+		pc.InputRunners["stat_accum"] = iRunner
+		oRunner, err := NewFORunner("counter", new(reportTestFilter),
+			CommonFOConfig{Matcher: "TRUE"}, "CounterFilter", 10)
+		c.Assume(err, gs.IsNil)
+		pc.OutputRunners["counter"] = oRunner
+
+		request := func(path string) *httptest.ResponseRecorder {
+			req, err := http.NewRequest("GET", path, nil)
+			c.Assume(err, gs.IsNil)
+			resp := httptest.NewRecorder()
+			pc.pluginHandler(resp, req)
+			return resp
+		}
+		decode := func(resp *httptest.ResponseRecorder) (state PluginState) {
+			err := json.Unmarshal(resp.Body.Bytes(), &state)
+			c.Assume(err, gs.IsNil)
+			return
+		}
+
+		c.Specify("returns a plugin's report and last error", func() {
+			iRunner.LogError(errors.New("connection refused"))
+			resp := request("/plugins/stat_accum")
+			c.Expect(resp.Code, gs.Equals, http.StatusOK)
+			state := decode(resp)
+			c.Expect(state.Name, gs.Equals, "stat_accum")
+			c.Expect(state.Report["test1"], gs.Equals, "one")
+			c.Expect(state.LastError, gs.Equals, "connection refused")
+			c.Expect(state.LastErrorTime != nil, gs.IsTrue)
+			c.Expect(state.LastFailure == nil, gs.IsTrue)
+		})
+
+		c.Specify("returns the message whose delivery last failed", func() {
+			pack := NewPipelinePack(nil)
+			pack.Message.SetType("stuck")
+			oRunner.debug.deliveryFailed(pack, errors.New("timeout"))
+			oRunner.debug.deliveryFailed(pack, errors.New("timeout again"))
+			pack.Message.SetType("recycled")
+			state := decode(request("/plugins/counter"))
+			c.Expect(state.Report["InChanCapacity"], gs.Equals, float64(10))
+			c.Expect(state.LastFailure.Message.GetType(), gs.Equals, "stuck")
+			c.Expect(state.LastFailure.Attempts, gs.Equals, 2)
+			c.Expect(state.LastFailure.Error, gs.Equals, "timeout again")
+		})
+
+		c.Specify("returns the stack traces of a plugin's goroutines", func() {
+			started, done := make(chan bool), make(chan bool)
+			go func() {
+				labelPluginGoroutine("stat_accum")
+				started <- true
+				<-done
+			}()
+			<-started
+			resp := request("/plugins/stat_accum/goroutines")
+			close(done)
+			c.Expect(resp.Code, gs.Equals, http.StatusOK)
+			c.Expect(strings.Contains(resp.Body.String(), "AdminSpec"), gs.IsTrue)
+			stacks, count := PluginGoroutines("counter")
+			c.Expect(stacks, gs.Equals, "")
+			c.Expect(count, gs.Equals, 0)
+		})
+
+		c.Specify("rejects unknown plugins", func() {
+			c.Expect(request("/plugins/missing").Code, gs.Equals, http.StatusNotFound)
+			c.Expect(request("/plugins/missing/goroutines").Code, gs.Equals,
+				http.StatusNotFound)
+		})
+	})
+
+	c.Specify("The admin address", func() {
+		c.Specify("defaults to the loopback interface", func() {
+			address, err := adminListenAddress(":4354", "")
+			c.Expect(err, gs.IsNil)
+			c.Expect(address, gs.Equals, "127.0.0.1:4354")
+			address, err = adminListenAddress("localhost:4354", "")
+			c.Expect(err, gs.IsNil)
+			c.Expect(address, gs.Equals, "localhost:4354")
+		})
+
+		c.Specify("requires a token on other interfaces", func() {
+			_, err := adminListenAddress("0.0.0.0:4354", "")
+			c.Expect(err, gs.Not(gs.IsNil))
+			address, err := adminListenAddress("0.0.0.0:4354", "secret")
+			c.Expect(err, gs.IsNil)
+			c.Expect(address, gs.Equals, "0.0.0.0:4354")
+		})
+	})
+
+	c.Specify("The admin token", func() {
+		ok := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {})
+		request := func(token, header string) *httptest.ResponseRecorder {
+			req, err := http.NewRequest("GET", "/globals", nil)
+			c.Assume(err, gs.IsNil)
+			if header != "" {
+				req.Header.Set("Authorization", header)
+			}
+			resp := httptest.NewRecorder()
+			adminAuth(token, ok).ServeHTTP(resp, req)
+			return resp
+		}
+
+		c.Specify("is required if set", func() {
+			c.Expect(request("secret", "").Code, gs.Equals, http.StatusUnauthorized)
+			c.Expect(request("secret", "Bearer wrong").Code, gs.Equals,
+				http.StatusUnauthorized)
+			c.Expect(request("secret", "Bearer secret").Code, gs.Equals, http.StatusOK)
+		})
+
+		c.Specify("isn't required if empty", func() {
+			c.Expect(request("", "").Code, gs.Equals, http.StatusOK)
+		})
+	})
+
+	c.Specify("A pack pool's minimum size", func() {
+		pool := NewPackPool("test", 4, 10)
+		pool.fill(nil)
+		c.Expect(pool.SetMinSize(11), gs.Not(gs.IsNil))
+		c.Expect(pool.SetMinSize(8), gs.IsNil)
+		pool.check()
+		c.Expect(pool.Size(), gs.Equals, 8)
+	})
+}
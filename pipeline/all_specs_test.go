@@ -44,6 +44,32 @@ func TestAllSpecs(t *testing.T) {
 	r.AddSpec(ReportSpec)
 	r.AddSpec(StatAccumInputSpec)
 	r.AddSpec(StreamParserSpec)
+	r.AddSpec(WatermarkSpec)
+	r.AddSpec(DestinationTemplateSpec)
+	r.AddSpec(CharsetSpec)
+	r.AddSpec(StartupProbeSpec)
+	r.AddSpec(InputStamperSpec)
+	r.AddSpec(DeliveryReportSpec)
+	r.AddSpec(DiskBufferSpec)
+	r.AddSpec(PackPoolSpec)
+	r.AddSpec(PackHooksSpec)
+	r.AddSpec(PrometheusSpec)
+	r.AddSpec(DeadLetterSpec)
+	r.AddSpec(BoundedRegexpSpec)
+	r.AddSpec(RateLimiterSpec)
+	r.AddSpec(TeeOutputSpec)
+	r.AddSpec(PluginLoaderSpec)
+	r.AddSpec(AdminSpec)
+	r.AddSpec(CounterFilterSpec)
+	r.AddSpec(SamplingProfileSpec)
+	r.AddSpec(RecordReplaySpec)
+	r.AddSpec(LoadSheddingSpec)
+	r.AddSpec(PluginRequestSpec)
+	r.AddSpec(RecordSizeSpec)
+	r.AddSpec(TimestampRewriteSpec)
+	r.AddSpec(MessageTTLSpec)
+	r.AddSpec(OrderedDeliverySpec)
+	r.AddSpec(PluginLogSpec)
 
 	gospec.MainGoTest(r, t)
 }
@@ -0,0 +1,101 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"regexp/syntax"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrRegexpInputTooLong = errors.New("input exceeds the regex's max_match_length")
+	ErrRegexpOverBudget   = errors.New("match exceeded the regex's match_time_budget")
+)
+
+// Limits on a regular expression used for decoding. Go's regexps are RE2
+// based, so a match always runs in time linear in the input length and
+// memory proportional to the compiled program, never backtracking. These
+// limits bound both of those per pattern. Zero values mean no limit.
+type RegexpLimits struct {
+	// Maximum length in bytes of the input to match. Longer inputs aren't
+	// matched at all.
+	MaxMatchLength int
+	// Matches taking longer than this are treated as failures. Matches can't
+	// be interrupted, so this is checked once the match completes.
+	MatchTimeBudget time.Duration
+	// Maximum number of instructions in the compiled program, which bounds
+	// the memory used by each match.
+	MaxProgramSize int
+}
+
+// A regular expression enforcing RegexpLimits, for use by decoders.
+type BoundedRegexp struct {
+	*regexp.Regexp
+	limits RegexpLimits
+	// Inputs rejected for exceeding the max match length.
+	tooLongCount int64
+	// Matches that exceeded the time budget.
+	overBudgetCount int64
+}
+
+// Compiles a regular expression, returning an error if its compiled program
+// exceeds the specified limits.
+func CompileBoundedRegexp(expr string, limits RegexpLimits) (*BoundedRegexp, error) {
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, err
+	}
+	if limits.MaxProgramSize > 0 {
+		parsed, err := syntax.Parse(expr, syntax.Perl)
+		if err != nil {
+			return nil, err
+		}
+		prog, err := syntax.Compile(parsed.Simplify())
+		if err != nil {
+			return nil, err
+		}
+		if len(prog.Inst) > limits.MaxProgramSize {
+			return nil, fmt.Errorf("regex compiles to %d instructions, more than the limit of %d",
+				len(prog.Inst), limits.MaxProgramSize)
+		}
+	}
+	return &BoundedRegexp{Regexp: re, limits: limits}, nil
+}
+
+// Like regexp.Regexp's FindStringSubmatch, returning ErrRegexpInputTooLong or
+// ErrRegexpOverBudget instead of a result when the limits are exceeded.
+func (b *BoundedRegexp) BoundedFindStringSubmatch(s string) ([]string, error) {
+	if b.limits.MaxMatchLength > 0 && len(s) > b.limits.MaxMatchLength {
+		atomic.AddInt64(&b.tooLongCount, 1)
+		return nil, ErrRegexpInputTooLong
+	}
+	if b.limits.MatchTimeBudget <= 0 {
+		return b.FindStringSubmatch(s), nil
+	}
+	start := time.Now()
+	result := b.FindStringSubmatch(s)
+	if time.Since(start) > b.limits.MatchTimeBudget {
+		atomic.AddInt64(&b.overBudgetCount, 1)
+		return nil, ErrRegexpOverBudget
+	}
+	return result, nil
+}
+
+// Returns the number of inputs rejected for exceeding the max match length
+// and of matches that exceeded the time budget.
+func (b *BoundedRegexp) LimitCounts() (tooLong, overBudget int64) {
+	return atomic.LoadInt64(&b.tooLongCount), atomic.LoadInt64(&b.overBudgetCount)
+}
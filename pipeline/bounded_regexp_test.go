@@ -0,0 +1,61 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"strings"
+	"time"
+)
+
+func BoundedRegexpSpec(c gs.Context) {
+	c.Specify("A bounded regexp", func() {
+		c.Specify("matches like a regexp without limits", func() {
+			re, err := CompileBoundedRegexp(`(\w+)=(\w+)`, RegexpLimits{})
+			c.Assume(err, gs.IsNil)
+			result, err := re.BoundedFindStringSubmatch("key=value")
+			c.Expect(err, gs.IsNil)
+			c.Expect(len(result), gs.Equals, 3)
+			c.Expect(result[2], gs.Equals, "value")
+		})
+
+		c.Specify("rejects inputs over the max match length", func() {
+			re, err := CompileBoundedRegexp(`(\w+)`, RegexpLimits{MaxMatchLength: 8})
+			c.Assume(err, gs.IsNil)
+			_, err = re.BoundedFindStringSubmatch("12345678")
+			c.Expect(err, gs.IsNil)
+			result, err := re.BoundedFindStringSubmatch("123456789")
+			c.Expect(err, gs.Equals, ErrRegexpInputTooLong)
+			c.Expect(result == nil, gs.IsTrue)
+			tooLong, overBudget := re.LimitCounts()
+			c.Expect(tooLong, gs.Equals, int64(1))
+			c.Expect(overBudget, gs.Equals, int64(0))
+		})
+
+		c.Specify("fails matches over the time budget", func() {
+			re, err := CompileBoundedRegexp(`(a+b)+c`,
+				RegexpLimits{MatchTimeBudget: time.Nanosecond})
+			c.Assume(err, gs.IsNil)
+			_, err = re.BoundedFindStringSubmatch(strings.Repeat("ab", 10000))
+			c.Expect(err, gs.Equals, ErrRegexpOverBudget)
+			_, overBudget := re.LimitCounts()
+			c.Expect(overBudget, gs.Equals, int64(1))
+		})
+
+		c.Specify("rejects patterns over the max program size", func() {
+			_, err := CompileBoundedRegexp(`\w{1000}`, RegexpLimits{MaxProgramSize: 100})
+			c.Expect(err, gs.Not(gs.IsNil))
+			_, err = CompileBoundedRegexp(`\w{10}`, RegexpLimits{MaxProgramSize: 100})
+			c.Expect(err, gs.IsNil)
+		})
+	})
+}
@@ -0,0 +1,185 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"bytes"
+	"code.google.com/p/go.text/encoding"
+	"code.google.com/p/go.text/encoding/charmap"
+	"code.google.com/p/go.text/encoding/japanese"
+	"code.google.com/p/go.text/encoding/unicode"
+	"code.google.com/p/go.text/transform"
+	"errors"
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+	"io/ioutil"
+	"strings"
+	"unicode/utf8"
+)
+
+// What to do with byte sequences that aren't valid in the input's charset.
+type charsetPolicy int
+
+const (
+	charsetReplace charsetPolicy = iota // Replace with U+FFFD.
+	charsetDrop                         // Remove from the payload.
+	charsetFail                         // Treat the message as a decode failure.
+)
+
+var errInvalidCharset = errors.New("payload contains invalid byte sequences")
+
+// Converts message payloads from an input's charset to UTF-8, so invalid
+// bytes are dealt with before they make it to the decoders and encoders.
+type charsetTranscoder struct {
+	// Nil for UTF-8 and latin-1, which are handled natively.
+	enc    encoding.Encoding
+	latin1 bool
+	detect bool
+	policy charsetPolicy
+}
+
+// Creates a transcoder for the specified charset and invalid sequence
+// policy. An empty policy defaults to "replace".
+func newCharsetTranscoder(charset, policy string) (*charsetTranscoder, error) {
+	ct := new(charsetTranscoder)
+	switch strings.ToLower(charset) {
+	case "auto":
+		ct.detect = true
+	case "utf-8", "utf8":
+	case "latin-1", "latin1", "iso-8859-1":
+		ct.latin1 = true
+	case "windows-1252", "cp1252":
+		ct.enc = charmap.Windows1252
+	case "shift-jis", "shift_jis", "sjis":
+		ct.enc = japanese.ShiftJIS
+	case "utf-16", "utf16":
+		// Big endian unless there's a BOM saying otherwise, per RFC 2781.
+		ct.enc = unicode.UTF16(unicode.BigEndian, unicode.ExpectBOM)
+	case "utf-16le":
+		ct.enc = unicode.UTF16(unicode.LittleEndian, unicode.IgnoreBOM)
+	case "utf-16be":
+		ct.enc = unicode.UTF16(unicode.BigEndian, unicode.IgnoreBOM)
+	default:
+		return nil, fmt.Errorf("unsupported charset: %s", charset)
+	}
+
+	switch strings.ToLower(policy) {
+	case "", "replace":
+		ct.policy = charsetReplace
+	case "drop":
+		ct.policy = charsetDrop
+	case "fail":
+		ct.policy = charsetFail
+	default:
+		return nil, fmt.Errorf("invalid charset_policy: %s", policy)
+	}
+	return ct, nil
+}
+
+// Guesses the encoding of the provided data. BOMs are trusted, data that's
+// valid UTF-8 is left alone, data with lots of NUL bytes in alternating
+// positions is assumed to be UTF-16, and anything else is treated as
+// windows-1252, which is a superset of latin-1.
+func detectCharset(data []byte) (enc encoding.Encoding, isUTF8 bool) {
+	switch {
+	case bytes.HasPrefix(data, []byte{0xEF, 0xBB, 0xBF}):
+		return nil, true
+	case bytes.HasPrefix(data, []byte{0xFE, 0xFF}), bytes.HasPrefix(data, []byte{0xFF, 0xFE}):
+		return unicode.UTF16(unicode.BigEndian, unicode.ExpectBOM), false
+	case utf8.Valid(data):
+		return nil, true
+	}
+
+	var evenNuls, oddNuls int
+	for i, b := range data {
+		if b != 0 {
+			continue
+		}
+		if i%2 == 0 {
+			evenNuls++
+		} else {
+			oddNuls++
+		}
+	}
+	// ASCII text in UTF-16 has a NUL in every other byte.
+	threshold := len(data) / 4
+	switch {
+	case oddNuls > threshold && evenNuls < oddNuls/4:
+		return unicode.UTF16(unicode.LittleEndian, unicode.IgnoreBOM), false
+	case evenNuls > threshold && oddNuls < evenNuls/4:
+		return unicode.UTF16(unicode.BigEndian, unicode.IgnoreBOM), false
+	}
+	return charmap.Windows1252, false
+}
+
+// Converts the provided data to UTF-8, applying the invalid sequence policy.
+func (ct *charsetTranscoder) transcode(data []byte) (string, error) {
+	var (
+		decoded string
+		enc     = ct.enc
+		isUTF8  = enc == nil && !ct.latin1
+	)
+	if ct.detect {
+		enc, isUTF8 = detectCharset(data)
+		if isUTF8 {
+			data = bytes.TrimPrefix(data, []byte{0xEF, 0xBB, 0xBF})
+		}
+	}
+
+	switch {
+	case ct.latin1 && !ct.detect:
+		// Every byte maps directly to the code point of the same value.
+		runes := make([]rune, len(data))
+		for i, b := range data {
+			runes[i] = rune(b)
+		}
+		return string(runes), nil
+	case isUTF8:
+		if utf8.Valid(data) {
+			return string(data), nil
+		}
+		decoded = string(bytes.Runes(data))
+	default:
+		reader := transform.NewReader(bytes.NewReader(data), enc.NewDecoder())
+		out, err := ioutil.ReadAll(reader)
+		if err != nil {
+			return "", err
+		}
+		decoded = string(out)
+	}
+
+	// At this point invalid sequences have been replaced with U+FFFD.
+	if !strings.ContainsRune(decoded, utf8.RuneError) {
+		return decoded, nil
+	}
+	switch ct.policy {
+	case charsetDrop:
+		decoded = strings.Replace(decoded, string(utf8.RuneError), "", -1)
+	case charsetFail:
+		return "", errInvalidCharset
+	}
+	return decoded, nil
+}
+
+// Transcodes the payload of the provided message in place.
+func (ct *charsetTranscoder) transcodePayload(msg *message.Message) error {
+	payload := msg.GetPayload()
+	if payload == "" {
+		return nil
+	}
+	decoded, err := ct.transcode([]byte(payload))
+	if err != nil {
+		return err
+	}
+	msg.SetPayload(decoded)
+	return nil
+}
@@ -0,0 +1,89 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	gs "github.com/rafrombrc/gospec/src/gospec"
+)
+
+func CharsetSpec(c gs.Context) {
+	c.Specify("A charset transcoder", func() {
+		c.Specify("rejects unknown charsets and policies", func() {
+			_, err := newCharsetTranscoder("ebcdic", "")
+			c.Expect(err, gs.Not(gs.IsNil))
+			_, err = newCharsetTranscoder("utf-8", "ignore")
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+
+		c.Specify("converts latin-1", func() {
+			ct, err := newCharsetTranscoder("latin-1", "")
+			c.Assume(err, gs.IsNil)
+			out, err := ct.transcode([]byte("caf\xe9"))
+			c.Expect(err, gs.IsNil)
+			c.Expect(out, gs.Equals, "café")
+		})
+
+		c.Specify("converts shift-jis", func() {
+			ct, err := newCharsetTranscoder("shift-jis", "")
+			c.Assume(err, gs.IsNil)
+			out, err := ct.transcode([]byte("\x93\xfa\x96\x7b"))
+			c.Expect(err, gs.IsNil)
+			c.Expect(out, gs.Equals, "日本")
+		})
+
+		c.Specify("converts utf-16", func() {
+			ct, err := newCharsetTranscoder("utf-16", "")
+			c.Assume(err, gs.IsNil)
+			out, err := ct.transcode([]byte("\xff\xfeh\x00i\x00"))
+			c.Expect(err, gs.IsNil)
+			c.Expect(out, gs.Equals, "hi")
+		})
+
+		c.Specify("handles invalid utf-8", func() {
+			invalid := []byte("a\xffb")
+
+			c.Specify("by replacing it", func() {
+				ct, _ := newCharsetTranscoder("utf-8", "replace")
+				out, err := ct.transcode(invalid)
+				c.Expect(err, gs.IsNil)
+				c.Expect(out, gs.Equals, "a�b")
+			})
+
+			c.Specify("by dropping it", func() {
+				ct, _ := newCharsetTranscoder("utf-8", "drop")
+				out, err := ct.transcode(invalid)
+				c.Expect(err, gs.IsNil)
+				c.Expect(out, gs.Equals, "ab")
+			})
+
+			c.Specify("by failing", func() {
+				ct, _ := newCharsetTranscoder("utf-8", "fail")
+				_, err := ct.transcode(invalid)
+				c.Expect(err, gs.Equals, errInvalidCharset)
+			})
+		})
+
+		c.Specify("detects the charset", func() {
+			ct, err := newCharsetTranscoder("auto", "")
+			c.Assume(err, gs.IsNil)
+
+			out, _ := ct.transcode([]byte("\xef\xbb\xbfcafé"))
+			c.Expect(out, gs.Equals, "café")
+			out, _ = ct.transcode([]byte("c\x00a\x00f\x00\xe9\x00"))
+			c.Expect(out, gs.Equals, "café")
+			out, _ = ct.transcode([]byte("\x00c\x00a\x00f\x00\xe9"))
+			c.Expect(out, gs.Equals, "café")
+			out, _ = ct.transcode([]byte("caf\xe9 \x80"))
+			c.Expect(out, gs.Equals, "café €")
+		})
+	})
+}
@@ -27,8 +27,10 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
 	"reflect"
 	"regexp"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -49,6 +51,14 @@ var (
 // Adds a plugin to the set of usable Heka plugins that can be referenced from
 // a Heka config file.
 func RegisterPlugin(name string, factory func() interface{}) {
+	if loadingPluginFile != "" {
+		// Plugin files can't replace existing plugins.
+		if _, ok := AvailablePlugins[name]; ok {
+			pluginConflicts = append(pluginConflicts, name)
+			return
+		}
+		pluginSources[name] = loadingPluginFile
+	}
 	AvailablePlugins[name] = factory
 }
 
@@ -128,9 +138,11 @@ type PipelineConfig struct {
 	// Heka message router instance.
 	router *messageRouter
 	// PipelinePack supply for Input plugins.
+	inputPool        *PackPool
 	inputRecycleChan chan *PipelinePack
 	// PipelinePack supply for Filter plugins (separate pool prevents
 	// deadlocks).
+	injectPool        *PackPool
 	injectRecycleChan chan *PipelinePack
 	// Stores log messages generated by plugin config errors.
 	LogMsgs []string
@@ -151,6 +163,22 @@ type PipelineConfig struct {
 	allEncodersLock sync.RWMutex
 	// Name of host on which Heka is running.
 	hostname string
+	// Records the pipeline's inputs and outputs, if set.
+	recorder *Recorder
+	// Replaces the pipeline's inputs and outputs when replaying a recording,
+	// if set.
+	replayer *Replayer
+	// Drops low severity messages under overload, if load shedding is
+	// configured.
+	shedder *loadShedder
+	// Request channels of the plugins serving requests, by name, see
+	// ServeRequests.
+	responders     map[string]chan *PluginRequest
+	respondersLock sync.RWMutex
+	// Closed once the latest globals changes have been announced, so the
+	// next ones wait their turn, see TuneGlobals.
+	globalsAnnounced chan struct{}
+	announceLock     sync.Mutex
 	// Heka process id.
 	pid int32
 	// Lock protecting access to the set of running inputs so they
@@ -163,6 +191,20 @@ type PipelineConfig struct {
 	outputsLock sync.RWMutex
 	// Internal reporting channel.
 	reportRecycleChan chan *PipelinePack
+	// Tracks the event time progress of the inputs and notifies windowed
+	// filters when their windows are complete.
+	watermarks *WatermarkTracker
+	// Number of dead letters sent, see DeadLetter.
+	deadLetterCount int64
+	// Plugin log messages routed and dropped, see logPluginMessage.
+	pluginLogLimiter *rateLimiter
+	pluginLogCount   int64
+	pluginLogDropped int64
+	// Where the loaded config sections and settings came from, and the
+	// [hekad] section and its decoded struct, see ResolvedConfig.
+	configLocs    *configLocations
+	daemonSection toml.Primitive
+	daemonConfig  interface{}
 }
 
 // Creates and initializes a PipelineConfig object. `nil` value for `globals`
@@ -179,6 +221,7 @@ func NewPipelineConfig(globals *GlobalConfigStruct) (config *PipelineConfig) {
 	config.makers["Filter"] = make(map[string]PluginMaker)
 	config.makers["Encoder"] = make(map[string]PluginMaker)
 	config.makers["Output"] = make(map[string]PluginMaker)
+	config.makers["Processor"] = make(map[string]PluginMaker)
 	config.DecoderMakers = config.makers["Decoder"]
 
 	config.InputRunners = make(map[string]InputRunner)
@@ -186,14 +229,32 @@ func NewPipelineConfig(globals *GlobalConfigStruct) (config *PipelineConfig) {
 	config.OutputRunners = make(map[string]OutputRunner)
 
 	config.allEncoders = make(map[string]Encoder)
+	config.responders = make(map[string]chan *PluginRequest)
 	config.router = NewMessageRouter(globals.PluginChanSize)
-	config.inputRecycleChan = make(chan *PipelinePack, globals.PoolSize)
-	config.injectRecycleChan = make(chan *PipelinePack, globals.PoolSize)
+	config.router.samplingControl = config.samplingControl
+	routerBackedUp := func() bool {
+		return len(config.router.inChan) == cap(config.router.inChan)
+	}
+	config.inputPool = NewPackPool("input", globals.PoolSize, globals.MaxPoolSize)
+	config.inputPool.backedUp = routerBackedUp
+	config.inputRecycleChan = config.inputPool.Chan()
+	config.injectPool = NewPackPool("inject", globals.PoolSize, globals.MaxPoolSize)
+	config.injectPool.backedUp = routerBackedUp
+	config.injectRecycleChan = config.injectPool.Chan()
 	config.LogMsgs = make([]string, 0, 4)
 	config.allDecoders = make([]DecoderRunner, 0, 10)
 	config.hostname = globals.Hostname
 	config.pid = int32(os.Getpid())
 	config.reportRecycleChan = make(chan *PipelinePack, 1)
+	config.watermarks = NewWatermarkTracker()
+	config.pluginLogLimiter = newRateLimiter(PLUGIN_LOG_MAX_RATE, 0)
+	if len(globals.LoadShedding.Tiers) > 0 {
+		config.shedder = newLoadShedder(globals.LoadShedding, config.underPressure)
+		config.shedder.changed = func(old, new int) {
+			go config.announceShedding(old, new)
+		}
+		config.router.shedder = config.shedder
+	}
 
 	return config
 }
@@ -202,7 +263,7 @@ func NewPipelineConfig(globals *GlobalConfigStruct) (config *PipelineConfig) {
 // objects they are holding. Returns a PipelinePack for injection into Heka
 // pipeline, or nil if the msgLoopCount is above the configured maximum.
 func (self *PipelineConfig) PipelinePack(msgLoopCount uint) *PipelinePack {
-	if msgLoopCount++; msgLoopCount > self.Globals.MaxMsgLoops {
+	if msgLoopCount++; msgLoopCount > self.Globals.Tunables().MaxMsgLoops {
 		return nil
 	}
 	pack := <-self.injectRecycleChan
@@ -235,6 +296,11 @@ func (self *PipelineConfig) Hostname() string {
 	return self.hostname
 }
 
+// Returns the pipeline's event time watermark tracker.
+func (self *PipelineConfig) Watermarks() *WatermarkTracker {
+	return self.watermarks
+}
+
 // Returns OutputRunner registered under the specified name, or nil (and ok ==
 // false) if no such name is registered.
 func (self *PipelineConfig) Output(name string) (oRunner OutputRunner, ok bool) {
@@ -334,6 +400,30 @@ func (self *PipelineConfig) Encoder(baseName, fullName string) (Encoder, bool) {
 	return encoder, true
 }
 
+// Instantiates and returns a Processor of the specified name, or nil and
+// ok == false if no such processor is registered or it can't be created.
+func (self *PipelineConfig) Processor(baseName, fullName string) (Processor, bool) {
+	self.makersLock.RLock()
+	maker, ok := self.makers["Processor"][baseName]
+	if !ok {
+		self.makersLock.RUnlock()
+		return nil, false
+	}
+
+	plugin, err := maker.Make()
+	self.makersLock.RUnlock()
+	if err != nil {
+		msg := fmt.Sprintf("Error creating processor '%s': %s", fullName, err.Error())
+		self.log(msg)
+		return nil, false
+	}
+	processor := plugin.(Processor)
+	if wantsName, ok := processor.(WantsName); ok {
+		wantsName.SetName(fullName)
+	}
+	return processor, true
+}
+
 // Returns a FilterRunner with the given name, or nil and ok == false if no
 // such name is registered.
 func (self *PipelineConfig) Filter(name string) (fRunner FilterRunner, ok bool) {
@@ -390,6 +480,7 @@ func (self *PipelineConfig) RemoveFilterRunner(name string) bool {
 	defer self.filtersLock.Unlock()
 	if fRunner, ok := self.FilterRunners[name]; ok {
 		self.router.RemoveFilterMatcher() <- fRunner.MatchRunner()
+		self.watermarks.Unsubscribe(name)
 		delete(self.FilterRunners, name)
 		return true
 	}
@@ -423,6 +514,7 @@ func (self *PipelineConfig) RemoveInputRunner(iRunner InputRunner) {
 	self.inputsLock.Lock()
 	delete(self.InputRunners, name)
 	self.inputsLock.Unlock()
+	self.watermarks.unregisterInput(name)
 
 	iRunner.Input().Stop()
 }
@@ -486,9 +578,10 @@ func getAttr(ob interface{}, attr string, default_ interface{}) (ret interface{}
 func (self *PipelineConfig) log(msg string) {
 	self.LogMsgs = append(self.LogMsgs, msg)
 	log.Println(msg)
+	self.logPluginMessage(HEKA_DAEMON, "", pluginLogError, msg)
 }
 
-var PluginTypeRegex = regexp.MustCompile("(Decoder|Encoder|Filter|Input|Output)$")
+var PluginTypeRegex = regexp.MustCompile("(Decoder|Encoder|Filter|Input|Output|Processor)$")
 
 func getPluginCategory(pluginType string) string {
 	pluginCats := PluginTypeRegex.FindStringSubmatch(pluginType)
@@ -508,6 +601,18 @@ type CommonInputConfig struct {
 	SyncDecode         *bool `toml:"synchronous_decode"`
 	SendDecodeFailures *bool `toml:"send_decode_failures"`
 	Retries            RetryOptions
+	WatermarkDelay     uint              `toml:"watermark_delay"`
+	Charset            string            `toml:"charset"`
+	CharsetPolicy      string            `toml:"charset_policy"`
+	IdGenerator        string            `toml:"id_generator"`
+	SequenceField      string            `toml:"sequence_field"`
+	Schema             string            `toml:"schema"`
+	SignerSchemas      map[string]string `toml:"signer_schemas"`
+	Processors         []string          `toml:"processors"`
+	MaxMsgsPerSec      uint              `toml:"max_msgs_per_sec"`
+	Burst              uint              `toml:"burst"`
+	// Seconds to wait after startup before the input starts consuming.
+	WarmUpDelay uint `toml:"warm_up_delay"`
 }
 
 type CommonFOConfig struct {
@@ -517,7 +622,44 @@ type CommonFOConfig struct {
 	CanExit    *bool  `toml:"can_exit"`
 	Retries    RetryOptions
 	Encoder    string // Output only.
-	UseFraming *bool  `toml:"use_framing"` // Output only.
+	UseFraming *bool  `toml:"use_framing"`     // Output only.
+	Window     uint   `toml:"window_interval"` // Filter only.
+	// Output only.
+	StartupProbe StartupProbeConfig `toml:"startup_probe"`
+	// Only used by plugins that implement BatchProcessor.
+	MaxBatchSize   uint `toml:"max_batch_size"`
+	BatchThreshold uint `toml:"batch_threshold"`
+	// "memory" (the default) or "disk".
+	Buffering string           `toml:"buffering"`
+	Buffer    DiskBufferConfig `toml:"buffer"`
+	// Token bucket rate limit on the messages delivered to the plugin.
+	MaxMsgsPerSec uint `toml:"max_msgs_per_sec"`
+	Burst         uint `toml:"burst"`
+	// Percentage of the matching messages delivered to the plugin, 0 (the
+	// default) and 100 meaning all of them.
+	SampleRate float64 `toml:"sample_rate"`
+	// Output only. Defers initializing the plugin, which usually connects to
+	// the destination, until the first message arrives.
+	LazyConnect bool `toml:"lazy_connect"`
+	// Output only. Messages whose timestamps are older than this duration
+	// when they're about to be delivered to the plugin, e.g. after sitting
+	// in a disk buffer, are dropped. Empty (the default) means no limit.
+	MaxBufferAge string `toml:"max_buffer_age"`
+	// Output only. Whether messages dropped for being older than the
+	// max_buffer_age are sent as dead letters, if dead letters are enabled.
+	DeadLetterExpired bool `toml:"dead_letter_expired"`
+	// Output only. Maximum size in bytes of an encoded record, 0 (the
+	// default) meaning no limit, and what to do with larger ones: "drop"
+	// (the default), "truncate" the `truncate_field`, or "split" them off
+	// into a batch of their own.
+	MaxRecordSize  uint   `toml:"max_record_size"`
+	OversizePolicy string `toml:"oversize_policy"`
+	TruncateField  string `toml:"truncate_field"`
+	// Output only. Rewrites the timestamps of the encoded messages.
+	TimestampRewrite TimestampRewriteConfig `toml:"timestamp_rewrite"`
+	// Output only. Header or field whose value identifies a stream of
+	// messages to deliver in arrival order, see orderingGate.
+	OrderingKey string `toml:"ordering_key"`
 }
 
 func getDefaultRetryOptions() RetryOptions {
@@ -610,7 +752,11 @@ func NewPluginMaker(name string, pConfig *PipelineConfig, tomlSection toml.Primi
 		maker.commonTypedConfig = commonInput
 	case "Filter", "Output":
 		commonFO := CommonFOConfig{
-			Retries: getDefaultRetryOptions(),
+			Retries:        getDefaultRetryOptions(),
+			StartupProbe:   getDefaultStartupProbeConfig(),
+			MaxBatchSize:   100,
+			BatchThreshold: 10,
+			Buffer:         getDefaultDiskBufferConfig(),
 		}
 		err = toml.PrimitiveDecode(tomlSection, &commonFO)
 		maker.commonTypedConfig = commonFO
@@ -752,7 +898,8 @@ func (m *pluginMaker) PrepConfig() error {
 		matches := unknownOptionRegex.FindStringSubmatch(err.Error())
 		if len(matches) == 2 {
 			// We've got an unrecognized config option.
-			return fmt.Errorf("unknown config setting for '%s': %s", m.name, matches[1])
+			return settingErrorf(matches[1], "unknown config setting for '%s': %s",
+				m.name, matches[1])
 		}
 		return err
 	}
@@ -767,6 +914,18 @@ func (m *pluginMaker) PrepConfig() error {
 // plugin may be used, but Make will always return a "fresh" instance, i.e. it
 // will never return the same plugin instance twice.
 func (m *pluginMaker) Make() (Plugin, error) {
+	plugin, err := m.makeUninitialized()
+	if err != nil {
+		return nil, err
+	}
+	if err = m.initPlugin(plugin); err != nil {
+		return nil, err
+	}
+	return plugin, nil
+}
+
+// Like Make, without calling the plugin's Init method.
+func (m *pluginMaker) makeUninitialized() (Plugin, error) {
 	if !m.configPrepped {
 		// Our config struct hasn't been prepped.
 		if err := m.PrepConfig(); err != nil {
@@ -781,12 +940,14 @@ func (m *pluginMaker) Make() (Plugin, error) {
 		plugin = m.plugin
 		m.plugin = nil
 	}
+	return plugin, nil
+}
 
+func (m *pluginMaker) initPlugin(plugin Plugin) error {
 	if err := plugin.Init(m.configStruct); err != nil {
-		return nil, fmt.Errorf("Initialization failed for '%s': %s", m.name, err)
+		return fmt.Errorf("Initialization failed for '%s': %s", m.name, err)
 	}
-
-	return plugin, nil
+	return nil
 }
 
 // MakeRunner returns a new, unstarted PluginRunner wrapped around a new,
@@ -794,23 +955,42 @@ func (m *pluginMaker) Make() (Plugin, error) {
 // given the specified name; if name is an empty string, the plugin name will
 // be used.
 func (m *pluginMaker) MakeRunner(name string) (PluginRunner, error) {
-	if m.category == "Encoder" {
-		return nil, errors.New("Encoder plugins don't support PluginRunners")
-	}
-
-	plugin, err := m.Make()
-	if err != nil {
-		return nil, err
+	if m.category == "Encoder" || m.category == "Processor" {
+		return nil, fmt.Errorf("%s plugins don't support PluginRunners", m.category)
 	}
 
 	if name == "" {
 		name = m.name
 	}
 
+	var plugin Plugin
+	replayer := m.pConfig.replayer
+	if replayer != nil && (m.category == "Input" || m.category == "Output") {
+		// Replaying a recording, the stand-ins don't need initializing.
+		plugin = replayer.standIn(m.category, name)
+	} else {
+		var err error
+		if plugin, err = m.makeUninitialized(); err != nil {
+			return nil, err
+		}
+		// Outputs with `lazy_connect` set are initialized by their runner once
+		// the first message arrives.
+		lazy := false
+		if m.category == "Output" {
+			lazy = m.commonTypedConfig.(CommonFOConfig).LazyConnect
+		}
+		if !lazy {
+			if err = m.initPlugin(plugin); err != nil {
+				return nil, err
+			}
+		}
+	}
+
 	var runner PluginRunner
 
 	if m.category == "Decoder" {
-		runner = NewDecoderRunner(name, plugin.(Decoder), m.pConfig.Globals.PluginChanSize)
+		runner = NewDecoderRunner(name, plugin.(Decoder),
+			m.pConfig.Globals.Tunables().PluginChanSize)
 		return runner, nil
 	}
 
@@ -920,7 +1100,7 @@ func (m *pluginMaker) MakeRunner(name string) (PluginRunner, error) {
 	}
 
 	return NewFORunner(name, plugin, commonFO, m.commonConfig.Typ,
-		m.pConfig.Globals.PluginChanSize)
+		m.pConfig.Globals.Tunables().PluginChanSize)
 }
 
 // Default protobuf configurations.
@@ -932,41 +1112,131 @@ const protobufEncoderToml = `
 [ProtobufEncoder]
 `
 
-// Loads all plugin configuration from a TOML configuration file. The
-// PipelineConfig should be already initialized via the Init function before
-// this method is called.
+// Loads all plugin configuration from a TOML configuration file, along with
+// any config fragments pulled in by the `include` setting in its [hekad]
+// section (see DecodeConfigFileWithIncludes). The PipelineConfig should be
+// already initialized via the Init function before this method is called.
 func (self *PipelineConfig) LoadFromConfigFile(filename string) error {
-	var (
-		configFile ConfigFile
-		err        error
-	)
+	ir := newIncludeResolver(self.Globals.ConfigFormat)
+	if err := ir.include(filename, true); err != nil {
+		return err
+	}
+	configFile, err := ir.result()
+	if err != nil {
+		return err
+	}
+	return self.loadConfig(configFile, ir.locs)
+}
 
-	contents, err := ReplaceEnvsFile(filename)
+// Loads all plugin configuration from the TOML configuration files in a
+// directory, and any fragments they include, merged into a single
+// configuration. Nested directories are included if
+// Globals.RecursiveConfigDir is set. A section may only be
+// defined in one file, duplicates are reported as an error naming the files
+// involved.
+func (self *PipelineConfig) LoadFromConfigDir(path string) error {
+	filenames, err := ConfigDirFiles(path, self.Globals.RecursiveConfigDir)
 	if err != nil {
 		return err
 	}
 
-	if _, err = toml.Decode(contents, &configFile); err != nil {
-		return fmt.Errorf("Error decoding config file: %s", err)
+	ir := newIncludeResolver(self.Globals.ConfigFormat)
+	for _, filename := range filenames {
+		if err = ir.include(filename, true); err != nil {
+			return err
+		}
 	}
+	merged, err := ir.result()
+	if err != nil {
+		return err
+	}
+	return self.loadConfig(merged, ir.locs)
+}
+
+// Returns the sorted paths of all the config files (i.e. those with an
+// extension associated with a config format, such as `.toml` or `.json`) in a
+// config directory, optionally including nested directories. Hidden files and directories are
+// skipped.
+func ConfigDirFiles(path string, recursive bool) (filenames []string, err error) {
+	err = filepath.Walk(path, func(fPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fPath == path {
+			return nil
+		}
+		if strings.HasPrefix(info.Name(), ".") {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() {
+			if !recursive {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if ConfigFormatForFile(fPath) != "" {
+			filenames = append(filenames, fPath)
+		}
+		return nil
+	})
+	sort.Strings(filenames)
+	return
+}
+
+// Creates and registers the plugins specified in the provided configuration.
+// Every section is loaded even after errors, so all of the problems are
+// reported at once, as a ConfigErrors value. `locs` records where the
+// sections came from.
+func (self *PipelineConfig) loadConfig(configFile ConfigFile,
+	locs *configLocations) (err error) {
 
 	var (
-		errcnt              uint
+		errs                ConfigErrors
 		protobufDRegistered bool
 		protobufERegistered bool
 	)
 	makersByCategory := make(map[string][]PluginMaker)
+	self.configLocs = locs
+	self.daemonSection = configFile[HEKA_DAEMON]
+	addErr := func(section string, err error) {
+		configErr := locs.configError(section, err)
+		self.log(configErr.Error())
+		errs = append(errs, configErr)
+	}
+
+	generated, pipeErrs := expandPipelines(configFile)
+	for name, from := range generated {
+		locs.copySection(name, from)
+	}
+	for _, err := range pipeErrs {
+		if configErr, ok := err.(*ConfigError); ok {
+			addErr(configErr.Section, configErr.Err)
+		} else {
+			self.log(err.Error())
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		// Sections using a broken pipeline can't be loaded.
+		return errs
+	}
 
 	// Load all the plugin makers and file them by category.
 	for name, conf := range configFile {
-		if name == HEKA_DAEMON {
+		if name == HEKA_DAEMON || name == ASSERT_SECTION {
 			continue
 		}
 		log.Printf("Pre-loading: [%s]\n", name)
-		maker, err := NewPluginMaker(name, self, conf)
+		var maker PluginMaker
+		err := safeConfigStep(func() (err error) {
+			maker, err = NewPluginMaker(name, self, conf)
+			return
+		})
 		if err != nil {
-			self.log(err.Error())
-			errcnt++
+			addErr(name, err)
 			continue
 		}
 
@@ -996,8 +1266,7 @@ func (self *PipelineConfig) LoadFromConfigFile(filename string) error {
 			configDefault["ProtobufDecoder"])
 		if err != nil {
 			// This really shouldn't happen.
-			self.log(err.Error())
-			errcnt++
+			addErr("ProtobufDecoder", err)
 		} else {
 			makersByCategory["Decoder"] = append(makersByCategory["Decoder"],
 				maker)
@@ -1013,8 +1282,7 @@ func (self *PipelineConfig) LoadFromConfigFile(filename string) error {
 			configDefault["ProtobufEncoder"])
 		if err != nil {
 			// This really shouldn't happen.
-			self.log(err.Error())
-			errcnt++
+			addErr("ProtobufEncoder", err)
 		} else {
 			makersByCategory["Encoder"] = append(makersByCategory["Encoder"],
 				maker)
@@ -1030,7 +1298,9 @@ func (self *PipelineConfig) LoadFromConfigFile(filename string) error {
 	}
 	multiDecoders, err = orderDependencies(multiDecoders)
 	if err != nil {
-		return err
+		self.log(err.Error())
+		sortConfigErrors(errs)
+		return append(errs, err)
 	}
 	for i, d := range multiDecoders {
 		makersByCategory["MultiDecoder"][i] = multiMakers[d.name]
@@ -1043,34 +1313,25 @@ func (self *PipelineConfig) LoadFromConfigFile(filename string) error {
 	// Force decoders and encoders to be loaded before the other plugin
 	// types are initialized so we know they'll be there for inputs and
 	// outputs to use during initialization.
-	order := []string{"Decoder", "Encoder", "Input", "Filter", "Output"}
+	order := []string{"Decoder", "Encoder", "Processor", "Input", "Filter", "Output"}
 	for _, category := range order {
 		for _, maker := range makersByCategory[category] {
 			log.Printf("Loading: [%s]\n", maker.Name())
-			if err = maker.PrepConfig(); err != nil {
-				self.log(err.Error())
-				errcnt++
+			if err = safeConfigStep(maker.PrepConfig); err != nil {
+				addErr(maker.Name(), err)
+				continue
 			}
 			self.makers[category][maker.Name()] = maker
-			if category == "Encoder" {
+			if category == "Encoder" || category == "Processor" {
 				continue
 			}
-			runner, err := maker.MakeRunner("")
+			var runner PluginRunner
+			err = safeConfigStep(func() (err error) {
+				runner, err = maker.MakeRunner("")
+				return
+			})
 			if err != nil {
-				// Might be a duplicate error.
-				seen := false
-				for _, prevErr := range self.LogMsgs {
-					if err.Error() == prevErr {
-						seen = true
-						break
-					}
-				}
-				if !seen {
-					msg := fmt.Sprintf("Error making runner for %s: %s", maker.Name(),
-						err.Error())
-					self.log(msg)
-					errcnt++
-				}
+				addErr(maker.Name(), fmt.Errorf("Error making runner: %s", err))
 				continue
 			}
 			switch category {
@@ -1084,15 +1345,19 @@ func (self *PipelineConfig) LoadFromConfigFile(filename string) error {
 		}
 	}
 
-	if errcnt != 0 {
-		return fmt.Errorf("%d errors loading plugins", errcnt)
+	if len(errs) != 0 {
+		sortConfigErrors(errs)
+		return errs
 	}
 
 	return nil
 }
 
 func subsFromSection(section toml.Primitive) []string {
-	secMap := section.(map[string]interface{})
+	secMap, ok := section.(map[string]interface{})
+	if !ok {
+		return nil
+	}
 	var subs []string
 	if _, ok := secMap["subs"]; ok {
 		subsUntyped, _ := secMap["subs"].([]interface{})
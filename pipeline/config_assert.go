@@ -0,0 +1,318 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"errors"
+	"fmt"
+	"github.com/bbangert/toml"
+	"github.com/mozilla-services/heka/message"
+	"sort"
+	"strings"
+)
+
+// Name of the config section holding the config assertions, i.e.
+// `[Assert.<name>]` tables, see CheckConfigFile.
+const ASSERT_SECTION = "Assert"
+
+// A config assertion: a sample message, optionally run through a decoder,
+// along with the values the resulting message is expected to have and the
+// filters and outputs expected to match it.
+type configAssertion struct {
+	// Decoder the sample is run through, none if empty.
+	Decoder string
+	// Payload of the sample.
+	Payload string
+	// Other values set on the sample, by header or field name.
+	Message map[string]interface{}
+	// Whether the decoder is expected to fail.
+	ExpectError bool `toml:"expect_error"`
+	// Values expected on the decoded message, by header or field name.
+	Expect map[string]interface{}
+	// Names of the filters and outputs expected to match, and not to match,
+	// the decoded message.
+	Matches    []string
+	NotMatches []string `toml:"not_matches"`
+}
+
+// Checks a config file like ValidateConfigFile and, if no problems are found,
+// runs the assertions defined in its `[Assert.<name>]` sections against it,
+// so config changes can be tested with representative samples before
+// rollout. Returns the number of assertions run and every problem found,
+// failed assertions are returned as *ConfigError values.
+func (self *PipelineConfig) CheckConfigFile(filename string) (int, []error) {
+	ir := newIncludeResolver(self.Globals.ConfigFormat)
+	if err := ir.include(filename, true); err != nil {
+		return 0, []error{err}
+	}
+	return self.checkIncludes(ir)
+}
+
+// Checks the config files in a directory and runs their assertions, see
+// CheckConfigFile.
+func (self *PipelineConfig) CheckConfigDir(path string) (int, []error) {
+	filenames, err := ConfigDirFiles(path, self.Globals.RecursiveConfigDir)
+	if err != nil {
+		return 0, []error{err}
+	}
+	ir := newIncludeResolver(self.Globals.ConfigFormat)
+	for _, filename := range filenames {
+		if err = ir.include(filename, true); err != nil {
+			return 0, []error{err}
+		}
+	}
+	return self.checkIncludes(ir)
+}
+
+func (self *PipelineConfig) checkIncludes(ir *includeResolver) (int, []error) {
+	configFile, err := ir.result()
+	if err != nil {
+		return 0, []error{err}
+	}
+	// Validation expands the named pipelines, so the assertions see the
+	// generated sections.
+	if errs := self.validateConfig(configFile, ir.locs); len(errs) > 0 {
+		return 0, errs
+	}
+	return self.runAssertions(configFile, ir.locs)
+}
+
+// Runs the config's assertions, in name order. The decoders used are
+// initialized, but no plugins are started.
+func (self *PipelineConfig) runAssertions(configFile ConfigFile,
+	locs *configLocations) (run int, errs []error) {
+
+	section, ok := configFile[ASSERT_SECTION]
+	if !ok {
+		return 0, nil
+	}
+	defs, ok := toStringMap(section)
+	if !ok {
+		return 0, []error{errors.New("invalid Assert section")}
+	}
+	names := make([]string, 0, len(defs))
+	for name := range defs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// Every decoder is registered, MultiDecoders look up their subdecoders.
+	self.makersLock.Lock()
+	for name, conf := range configFile {
+		if name == HEKA_DAEMON || name == ASSERT_SECTION {
+			continue
+		}
+		maker, err := NewPluginMaker(name, self, conf)
+		if err != nil || maker.Category() != "Decoder" {
+			continue
+		}
+		if err = safeConfigStep(maker.PrepConfig); err == nil {
+			self.DecoderMakers[name] = maker
+		}
+	}
+	self.makersLock.Unlock()
+
+	matchers := make(map[string]*message.MatcherSpecification)
+	for _, name := range names {
+		key := ASSERT_SECTION + "." + name
+		a := new(configAssertion)
+		if err := toml.PrimitiveDecodeStrict(defs[name], a, nil); err != nil {
+			errs = append(errs, locs.configError(key, err))
+			continue
+		}
+		run++
+		err := safeConfigStep(func() error {
+			return self.runAssertion(a, configFile, matchers)
+		})
+		if err != nil {
+			errs = append(errs, locs.configError(key, err))
+		}
+	}
+	return run, errs
+}
+
+func (self *PipelineConfig) runAssertion(a *configAssertion, configFile ConfigFile,
+	matchers map[string]*message.MatcherSpecification) error {
+
+	pack := self.PipelinePack(0)
+	defer pack.Recycle()
+	pack.Message.SetPayload(a.Payload)
+	for name, value := range a.Message {
+		if err := setMessageValue(pack.Message, name, value); err != nil {
+			return settingErrorf("message", "can't set %s: %s", name, err)
+		}
+	}
+
+	msg := pack.Message
+	if a.Decoder != "" {
+		packs, err := self.assertDecode(a.Decoder, pack)
+		for _, p := range packs {
+			if p != pack {
+				defer p.Recycle()
+			}
+		}
+		if err != nil {
+			if a.ExpectError {
+				return nil
+			}
+			return fmt.Errorf("decoding failed: %s", err)
+		}
+		if a.ExpectError {
+			return errors.New("decoding succeeded, expected a failure")
+		}
+		if len(packs) == 0 {
+			return errors.New("the decoder produced no message")
+		}
+		msg = packs[0].Message
+	}
+
+	var failures []string
+	names := make([]string, 0, len(a.Expect))
+	for name := range a.Expect {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		expected := fmt.Sprint(a.Expect[name])
+		actual, ok := destinationValue(msg, valueName(name))
+		if !ok {
+			failures = append(failures, fmt.Sprintf("%s missing, expected %q", name,
+				expected))
+		} else if actual != expected {
+			failures = append(failures, fmt.Sprintf("%s is %q, expected %q", name,
+				actual, expected))
+		}
+	}
+	for _, expected := range []bool{true, false} {
+		plugins := a.Matches
+		if !expected {
+			plugins = a.NotMatches
+		}
+		for _, plugin := range plugins {
+			spec, err := self.assertMatcher(plugin, configFile, matchers)
+			if err != nil {
+				return err
+			}
+			if spec.Match(msg) != expected {
+				if expected {
+					failures = append(failures, fmt.Sprintf("not matched by %s", plugin))
+				} else {
+					failures = append(failures, fmt.Sprintf("matched by %s", plugin))
+				}
+			}
+		}
+	}
+	if len(failures) > 0 {
+		return errors.New(strings.Join(failures, "; "))
+	}
+	return nil
+}
+
+// Runs a sample through a new instance of a decoder, as its DecoderRunner
+// would but without starting the runner.
+func (self *PipelineConfig) assertDecode(name string, pack *PipelinePack) (
+	[]*PipelinePack, error) {
+
+	decoder, ok := self.Decoder(name)
+	if !ok {
+		return nil, settingErrorf("decoder", "unknown decoder: %s", name)
+	}
+	dr := NewDecoderRunner(name, decoder, 1).(*dRunner)
+	dr.h = self
+	dr.pConfig = self
+	dr.router = self.router
+	if wanter, ok := decoder.(WantsDecoderRunner); ok {
+		wanter.SetDecoderRunner(dr)
+	}
+	if wanter, ok := decoder.(WantsDecoderRunnerShutdown); ok {
+		defer wanter.Shutdown()
+	}
+	return decoder.Decode(pack)
+}
+
+// Returns the message matcher of a filter or output section, caching it in
+// `matchers`.
+func (self *PipelineConfig) assertMatcher(name string, configFile ConfigFile,
+	matchers map[string]*message.MatcherSpecification) (
+	*message.MatcherSpecification, error) {
+
+	if spec, ok := matchers[name]; ok {
+		return spec, nil
+	}
+	conf, ok := configFile[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown filter or output: %s", name)
+	}
+	maker, err := NewPluginMaker(name, self, conf)
+	if err == nil {
+		err = maker.PrepConfig()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("can't load %s: %s", name, err)
+	}
+	m := maker.(*pluginMaker)
+	if m.category != "Filter" && m.category != "Output" {
+		return nil, fmt.Errorf("%s isn't a filter or output", name)
+	}
+	matcher := m.commonTypedConfig.(CommonFOConfig).Matcher
+	if matcher == "" {
+		matcher = getAttr(m.configStruct, "MessageMatcher", "").(string)
+	}
+	spec, err := message.CreateMatcherSpecification(matcher)
+	if err != nil {
+		return nil, fmt.Errorf("%s: invalid message matcher: %s", name, err)
+	}
+	matchers[name] = spec
+	return spec, nil
+}
+
+// Sets a header, or if the name isn't that of a header a field, of a message.
+// Names may also be written as `Fields[name]`.
+func setMessageValue(msg *message.Message, name string, value interface{}) error {
+	str, isStr := value.(string)
+	num, isNum := value.(int64)
+	switch name {
+	case "Type", "Logger", "Hostname", "Payload", "EnvVersion":
+		if !isStr {
+			return errors.New("expected a string")
+		}
+		switch name {
+		case "Type":
+			msg.SetType(str)
+		case "Logger":
+			msg.SetLogger(str)
+		case "Hostname":
+			msg.SetHostname(str)
+		case "Payload":
+			msg.SetPayload(str)
+		case "EnvVersion":
+			msg.SetEnvVersion(str)
+		}
+		return nil
+	case "Severity", "Pid":
+		if !isNum {
+			return errors.New("expected an integer")
+		}
+		if name == "Severity" {
+			msg.SetSeverity(int32(num))
+		} else {
+			msg.SetPid(int32(num))
+		}
+		return nil
+	}
+	field, err := message.NewField(valueName(name), value, "")
+	if err != nil {
+		return err
+	}
+	msg.AddField(field)
+	return nil
+}
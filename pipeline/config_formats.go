@@ -0,0 +1,328 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/bbangert/toml"
+	"gopkg.in/yaml.v2"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Parses the (already environment variable substituted) contents of a config
+// file into its top level sections.
+type ConfigParser func(contents string) (ConfigFile, error)
+
+var (
+	configParsers = map[string]ConfigParser{
+		"toml": parseTOMLConfig,
+		"json": parseJSONConfig,
+		"yaml": parseYAMLConfig,
+	}
+	configExtensions = map[string]string{
+		".toml": "toml",
+		".json": "json",
+		".yaml": "yaml",
+		".yml":  "yaml",
+	}
+	configParsersLock sync.RWMutex
+)
+
+// Registers a parser for a config file format, which will be used for config
+// files with any of the specified extensions (e.g. ".ini"), or for every
+// config file if hekad's `-config-format` flag names the format.
+func RegisterConfigParser(format string, parser ConfigParser, extensions ...string) {
+	configParsersLock.Lock()
+	defer configParsersLock.Unlock()
+	configParsers[format] = parser
+	for _, ext := range extensions {
+		configExtensions[ext] = format
+	}
+}
+
+// Returns the config format for the specified file, or an empty string if the
+// file's extension isn't associated with a format.
+func ConfigFormatForFile(filename string) string {
+	configParsersLock.RLock()
+	defer configParsersLock.RUnlock()
+	return configExtensions[strings.ToLower(filepath.Ext(filename))]
+}
+
+// Reads and parses a config file. If `format` is empty the format is chosen
+// based on the file's extension, defaulting to TOML.
+func DecodeConfigFile(filename, format string) (ConfigFile, error) {
+	configFile, _, _, err := decodeConfigFile(filename, format)
+	return configFile, err
+}
+
+// Like DecodeConfigFile, also returning the file's contents and the format
+// used to parse them.
+func decodeConfigFile(filename, format string) (configFile ConfigFile,
+	contents string, usedFormat string, err error) {
+
+	if format == "" {
+		if format = ConfigFormatForFile(filename); format == "" {
+			format = "toml"
+		}
+	}
+	configParsersLock.RLock()
+	parser, ok := configParsers[format]
+	configParsersLock.RUnlock()
+	if !ok {
+		return nil, "", "", fmt.Errorf("Unknown config format: %s", format)
+	}
+
+	if contents, err = ReplaceEnvsFile(filename); err != nil {
+		return nil, "", "", err
+	}
+	if configFile, err = parser(contents); err != nil {
+		return nil, "", "", fmt.Errorf("Error decoding %s config file: %s", format, err)
+	}
+	return configFile, contents, format, nil
+}
+
+func parseTOMLConfig(contents string) (configFile ConfigFile, err error) {
+	_, err = toml.Decode(contents, &configFile)
+	return
+}
+
+func parseJSONConfig(contents string) (ConfigFile, error) {
+	var sections map[string]interface{}
+	decoder := json.NewDecoder(strings.NewReader(contents))
+	// Keep integers as integers rather than float64.
+	decoder.UseNumber()
+	if err := decoder.Decode(&sections); err != nil {
+		return nil, err
+	}
+	return parseGenericConfig(sections)
+}
+
+func parseYAMLConfig(contents string) (ConfigFile, error) {
+	var sections map[string]interface{}
+	if err := yaml.Unmarshal([]byte(contents), &sections); err != nil {
+		return nil, err
+	}
+	return parseGenericConfig(sections)
+}
+
+// Converts generically decoded config data to the TOML representation used
+// by the rest of the config system. Every top level value must be a section,
+// i.e. a map.
+func parseGenericConfig(sections map[string]interface{}) (ConfigFile, error) {
+	buffer := new(bytes.Buffer)
+	names := make([]string, 0, len(sections))
+	for name := range sections {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		section, ok := toStringMap(sections[name])
+		if !ok {
+			return nil, fmt.Errorf("top level value '%s' must be a section", name)
+		}
+		if err := writeTOMLTable(buffer, []string{name}, section, false); err != nil {
+			return nil, err
+		}
+	}
+	return parseTOMLConfig(buffer.String())
+}
+
+// JSON objects decode as map[string]interface{}, YAML mappings as
+// map[interface{}]interface{}.
+func toStringMap(value interface{}) (map[string]interface{}, bool) {
+	switch m := value.(type) {
+	case map[string]interface{}:
+		return m, true
+	case map[interface{}]interface{}:
+		converted := make(map[string]interface{}, len(m))
+		for k, v := range m {
+			converted[fmt.Sprintf("%v", k)] = v
+		}
+		return converted, true
+	}
+	return nil, false
+}
+
+// Writes the table, and any nested tables, to the buffer. If `arrayEntry` is
+// true the table is written as an entry in an array of tables.
+func writeTOMLTable(buffer *bytes.Buffer, path []string, table map[string]interface{},
+	arrayEntry bool) error {
+
+	for _, part := range path {
+		if !validTOMLKey(part) {
+			return fmt.Errorf("invalid section name: %s", strings.Join(path, "."))
+		}
+	}
+	keys := make([]string, 0, len(table))
+	for key := range table {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	if arrayEntry {
+		fmt.Fprintf(buffer, "[[%s]]\n", strings.Join(path, "."))
+	} else {
+		fmt.Fprintf(buffer, "[%s]\n", strings.Join(path, "."))
+	}
+	// TOML requires all of a table's values to come before its subtables.
+	var subtables, tableArrays []string
+	for _, key := range keys {
+		value := table[key]
+		if _, ok := toStringMap(value); ok {
+			subtables = append(subtables, key)
+			continue
+		}
+		if isTableArray(value) {
+			tableArrays = append(tableArrays, key)
+			continue
+		}
+		if !validTOMLKey(key) {
+			return fmt.Errorf("invalid key in [%s]: %s", strings.Join(path, "."), key)
+		}
+		s, err := tomlValue(value)
+		if err != nil {
+			return fmt.Errorf("[%s] %s: %s", strings.Join(path, "."), key, err)
+		}
+		fmt.Fprintf(buffer, "%s = %s\n", key, s)
+	}
+	buffer.WriteString("\n")
+
+	for _, key := range subtables {
+		subtable, _ := toStringMap(table[key])
+		if err := writeTOMLTable(buffer, subPath(path, key), subtable, false); err != nil {
+			return err
+		}
+	}
+	for _, key := range tableArrays {
+		for _, item := range table[key].([]interface{}) {
+			entry, _ := toStringMap(item)
+			if err := writeTOMLTable(buffer, subPath(path, key), entry, true); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func subPath(path []string, key string) []string {
+	sub := make([]string, len(path), len(path)+1)
+	copy(sub, path)
+	return append(sub, key)
+}
+
+func validTOMLKey(key string) bool {
+	return key != "" && !strings.ContainsAny(key, " \t\r\n.[]#=\"")
+}
+
+// Returns whether the value is a non-empty array made up entirely of maps.
+func isTableArray(value interface{}) bool {
+	items, ok := value.([]interface{})
+	if !ok || len(items) == 0 {
+		return false
+	}
+	for _, item := range items {
+		if _, ok := toStringMap(item); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func tomlValue(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case string:
+		return tomlString(v), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case int:
+		return strconv.Itoa(v), nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case uint64:
+		return strconv.FormatUint(v, 10), nil
+	case json.Number:
+		if _, err := v.Int64(); err == nil {
+			return v.String(), nil
+		}
+		f, err := v.Float64()
+		if err != nil {
+			return "", err
+		}
+		return tomlFloat(f), nil
+	case float64:
+		return tomlFloat(v), nil
+	case []interface{}:
+		items := make([]string, len(v))
+		for i, item := range v {
+			if _, ok := item.([]interface{}); !ok && i > 0 {
+				// TOML arrays can't mix types.
+				if fmt.Sprintf("%T", item) != fmt.Sprintf("%T", v[0]) {
+					return "", fmt.Errorf("array values must all be of the same type")
+				}
+			}
+			s, err := tomlValue(item)
+			if err != nil {
+				return "", err
+			}
+			items[i] = s
+		}
+		return "[" + strings.Join(items, ", ") + "]", nil
+	case nil:
+		return "", fmt.Errorf("null values aren't supported")
+	}
+	return "", fmt.Errorf("unsupported value type %T", value)
+}
+
+func tomlFloat(f float64) string {
+	s := strconv.FormatFloat(f, 'f', -1, 64)
+	if !strings.Contains(s, ".") {
+		s += ".0"
+	}
+	return s
+}
+
+func tomlString(s string) string {
+	buffer := new(bytes.Buffer)
+	buffer.WriteByte('"')
+	for _, r := range s {
+		switch r {
+		case '"':
+			buffer.WriteString(`\"`)
+		case '\\':
+			buffer.WriteString(`\\`)
+		case '\n':
+			buffer.WriteString(`\n`)
+		case '\t':
+			buffer.WriteString(`\t`)
+		case '\r':
+			buffer.WriteString(`\r`)
+		case '\b':
+			buffer.WriteString(`\b`)
+		case '\f':
+			buffer.WriteString(`\f`)
+		default:
+			if r < 0x20 || r == 0x7f {
+				fmt.Fprintf(buffer, `\u%04x`, r)
+			} else {
+				buffer.WriteRune(r)
+			}
+		}
+	}
+	buffer.WriteByte('"')
+	return buffer.String()
+}
@@ -0,0 +1,200 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"fmt"
+	"github.com/bbangert/toml"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// The part of the [hekad] section that's needed to resolve includes.
+type includeConfig struct {
+	Include []string `toml:"include"`
+}
+
+// Tracks the files visited while resolving the includes for a config file.
+type includeResolver struct {
+	format  string
+	loaded  map[string]bool // Absolute paths of the files already merged.
+	chain   []string        // Files currently being included, outermost first.
+	merged  ConfigFile
+	sources map[string]string // Maps section names to the defining file.
+	locs    *configLocations
+	dupes   []string
+}
+
+func newIncludeResolver(format string) *includeResolver {
+	locs := newConfigLocations()
+	return &includeResolver{
+		format:  format,
+		loaded:  make(map[string]bool),
+		merged:  make(ConfigFile),
+		sources: locs.files,
+		locs:    locs,
+	}
+}
+
+// Reads a config file along with all of the config fragments pulled in by the
+// `include` setting in its [hekad] section, recursively, and returns the
+// merged sections. Include paths may contain glob patterns, relative paths
+// are resolved relative to the directory of the file containing the include.
+// Files included more than once are only loaded the first time, a file that
+// (directly or indirectly) includes itself is an error, as is a section
+// defined in more than one file. Only the outermost file's [hekad] section is
+// returned.
+func DecodeConfigFileWithIncludes(filename, format string) (ConfigFile, error) {
+	ir := newIncludeResolver(format)
+	if err := ir.include(filename, true); err != nil {
+		return nil, err
+	}
+	return ir.result()
+}
+
+// Returns the merged config, or an error listing every section that was
+// defined more than once.
+func (ir *includeResolver) result() (ConfigFile, error) {
+	if len(ir.dupes) > 0 {
+		return nil, fmt.Errorf("Duplicate config sections: %s",
+			strings.Join(ir.dupes, ", "))
+	}
+	return ir.merged, nil
+}
+
+// Merges the specified file, and everything it includes, into the results.
+// Each outermost file's [hekad] section is kept, those of included files are
+// only used to find further includes.
+func (ir *includeResolver) include(filename string, outermost bool) error {
+	absPath, err := filepath.Abs(filename)
+	if err != nil {
+		return err
+	}
+	for i, path := range ir.chain {
+		if path == absPath {
+			cycle := append(append([]string{}, ir.chain[i:]...), absPath)
+			return fmt.Errorf("Config include cycle: %s", strings.Join(cycle, " -> "))
+		}
+	}
+	if ir.loaded[absPath] {
+		return nil
+	}
+	ir.loaded[absPath] = true
+
+	configFile, contents, format, err := decodeConfigFile(filename, ir.format)
+	if err != nil {
+		return fmt.Errorf("%s: %s", filename, err)
+	}
+	// Line numbers and environment variables are only tracked for TOML files.
+	fileLocs := newConfigLocations()
+	if format == "toml" {
+		fileLocs.scanTOML(contents)
+		if raw, err := ioutil.ReadFile(filename); err == nil {
+			fileLocs.scanEnvs(string(raw))
+		}
+	}
+
+	var includes []string
+	if section, ok := configFile[HEKA_DAEMON]; ok {
+		var ic includeConfig
+		if err = toml.PrimitiveDecode(section, &ic); err != nil {
+			return fmt.Errorf("%s: can't decode include setting: %s", filename, err)
+		}
+		for _, pattern := range ic.Include {
+			matches, err := resolveInclude(filepath.Dir(absPath), pattern)
+			if err != nil {
+				return fmt.Errorf("%s: %s", filename, err)
+			}
+			includes = append(includes, matches...)
+		}
+		if !outermost {
+			delete(configFile, HEKA_DAEMON)
+		}
+	}
+
+	for name, section := range configFile {
+		if name == PIPELINES_SECTION || name == ASSERT_SECTION {
+			if err = ir.mergeTables(name, section, filename, fileLocs); err != nil {
+				return err
+			}
+			continue
+		}
+		if source, ok := ir.sources[name]; ok {
+			ir.dupes = append(ir.dupes, fmt.Sprintf("[%s] in %s and %s", name, source,
+				filename))
+			continue
+		}
+		ir.sources[name] = filename
+		ir.locs.lines[name] = fileLocs.lines[name]
+		ir.locs.settingLines[name] = fileLocs.settingLines[name]
+		ir.locs.settingEnvs[name] = fileLocs.settingEnvs[name]
+		ir.merged[name] = section
+	}
+
+	ir.chain = append(ir.chain, absPath)
+	for _, path := range includes {
+		if err = ir.include(path, false); err != nil {
+			return err
+		}
+	}
+	ir.chain = ir.chain[:len(ir.chain)-1]
+	return nil
+}
+
+// Named pipelines and assertions may be defined in any of the files, so the
+// [pipelines] and [Assert] sections are merged by table rather than treated as
+// duplicates.
+func (ir *includeResolver) mergeTables(name string, section toml.Primitive,
+	filename string, fileLocs *configLocations) error {
+
+	defs, ok := toStringMap(section)
+	if !ok {
+		return fmt.Errorf("%s: invalid %s section", filename, name)
+	}
+	merged, ok := toStringMap(ir.merged[name])
+	if !ok {
+		merged = make(map[string]interface{})
+		ir.merged[name] = merged
+		ir.sources[name] = filename
+	}
+	for table, def := range defs {
+		key := name + "." + table
+		if source, ok := ir.sources[key]; ok {
+			ir.dupes = append(ir.dupes, fmt.Sprintf("[%s] in %s and %s", key, source,
+				filename))
+			continue
+		}
+		ir.sources[key] = filename
+		ir.locs.lines[key] = fileLocs.settingLines[name][table]
+		merged[table] = def
+	}
+	return nil
+}
+
+// Returns the sorted list of files matching an include pattern. Patterns
+// without any glob characters must match an existing file.
+func resolveInclude(dir, pattern string) ([]string, error) {
+	if !filepath.IsAbs(pattern) {
+		pattern = filepath.Join(dir, pattern)
+	}
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid include pattern '%s': %s", pattern, err)
+	}
+	if len(matches) == 0 && !strings.ContainsAny(pattern, "*?[") {
+		return nil, fmt.Errorf("included file not found: %s", pattern)
+	}
+	sort.Strings(matches)
+	return matches, nil
+}
@@ -0,0 +1,231 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Where each config section, and each of its settings, is defined, so config
+// errors can be reported with the file name and line number.
+type configLocations struct {
+	files map[string]string // Section name -> file.
+	lines map[string]int    // Section name -> line of the section header.
+	// Section name -> setting name -> line. Subsections, e.g.
+	// `[LogOutput.retries]`, are listed as settings of their section.
+	settingLines map[string]map[string]int
+	// Section name -> setting name -> names of the environment variables
+	// substituted into the setting's value.
+	settingEnvs map[string]map[string][]string
+}
+
+func newConfigLocations() *configLocations {
+	return &configLocations{
+		files:        make(map[string]string),
+		lines:        make(map[string]int),
+		settingLines: make(map[string]map[string]int),
+		settingEnvs:  make(map[string]map[string][]string),
+	}
+}
+
+// Records the locations of sections generated from another section, e.g. by
+// named pipeline expansion.
+func (l *configLocations) copySection(name, from string) {
+	l.files[name] = l.files[from]
+	l.lines[name] = l.lines[from]
+	l.settingLines[name] = l.settingLines[from]
+	l.settingEnvs[name] = l.settingEnvs[from]
+}
+
+// Wraps an error with a section in a *ConfigError, locating the setting the
+// error is about if known, otherwise the section header.
+func (l *configLocations) configError(section string, err error) *ConfigError {
+	if configErr, ok := err.(*ConfigError); ok {
+		return configErr
+	}
+	configErr := &ConfigError{File: l.files[section], Section: section, Err: err,
+		Line: l.lines[section]}
+	if settingErr, ok := err.(*settingError); ok {
+		if line, ok := l.settingLines[section][settingErr.setting]; ok {
+			configErr.Line = line
+		}
+	}
+	return configErr
+}
+
+// An error with a specific setting of a config section.
+type settingError struct {
+	setting string
+	msg     string
+}
+
+func (e *settingError) Error() string {
+	return e.msg
+}
+
+func settingErrorf(setting, format string, args ...interface{}) error {
+	return &settingError{setting, fmt.Sprintf(format, args...)}
+}
+
+// Every problem found loading a config, as returned by LoadFromConfigFile and
+// LoadFromConfigDir. Problems with plugin sections are *ConfigError values.
+type ConfigErrors []error
+
+func (e ConfigErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return fmt.Sprintf("%d errors loading plugins:\n%s", len(e), strings.Join(msgs, "\n"))
+}
+
+// Sorts *ConfigError values by section name, ahead of any other errors.
+func sortConfigErrors(errs []error) {
+	sort.Stable(configErrorsBySection(errs))
+}
+
+type configErrorsBySection []error
+
+func (s configErrorsBySection) Len() int      { return len(s) }
+func (s configErrorsBySection) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s configErrorsBySection) Less(i, j int) bool {
+	a, aOk := s[i].(*ConfigError)
+	b, bOk := s[j].(*ConfigError)
+	if !aOk || !bOk {
+		return aOk && !bOk
+	}
+	return a.Section < b.Section
+}
+
+// Runs a step of loading a config section, turning a panic, e.g. in a
+// plugin's ConfigStruct or Init method, into an error.
+func safeConfigStep(step func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return step()
+}
+
+var (
+	tomlTableRe   = regexp.MustCompile(`^\s*\[\[?\s*([^\[\]]+?)\s*\]\]?\s*(#.*)?$`)
+	tomlSettingRe = regexp.MustCompile(`^\s*([A-Za-z0-9_-]+|"[^"]*")\s*=`)
+)
+
+// Records the line of each section header and setting in a TOML config file.
+// This is a line based scan rather than a full parse, the file has already
+// been parsed successfully.
+func (l *configLocations) scanTOML(contents string) {
+	walkTOML(contents, func(section, setting string, lineNum int, line string) {
+		if setting != "" {
+			l.addSetting(section, setting, lineNum)
+		} else if _, ok := l.lines[section]; !ok {
+			l.lines[section] = lineNum
+		}
+	})
+}
+
+var envRefRe = regexp.MustCompile(`%ENV\[([^\]]*)\]`)
+
+// Records the environment variables referenced by each setting in the
+// contents of a TOML config file before they were substituted.
+func (l *configLocations) scanEnvs(raw string) {
+	walkTOML(raw, func(section, setting string, lineNum int, line string) {
+		if setting == "" {
+			return
+		}
+		for _, m := range envRefRe.FindAllStringSubmatch(line, -1) {
+			envs, ok := l.settingEnvs[section]
+			if !ok {
+				envs = make(map[string][]string)
+				l.settingEnvs[section] = envs
+			}
+			envs[setting] = append(envs[setting], m[1])
+		}
+	})
+}
+
+// Calls fn for each line of a TOML config file belonging to a section, with
+// the name of the section and of the setting the line is part of. Nested
+// tables, e.g. `[LogOutput.retries]`, count as settings of their section, and
+// lines that don't start a setting, e.g. those of a multiline string, as part
+// of the preceding setting. The setting is empty for section headers.
+func walkTOML(contents string, fn func(section, setting string, lineNum int,
+	line string)) {
+
+	var section, subsection, setting string
+	inMultiline := false
+	for i, line := range strings.Split(contents, "\n") {
+		lineNum := i + 1
+		if inMultiline {
+			if section != "" && setting != "" {
+				fn(section, setting, lineNum, line)
+			}
+			if strings.Count(line, `"""`)%2 == 1 || strings.Count(line, "'''")%2 == 1 {
+				inMultiline = false
+			}
+			continue
+		}
+		if m := tomlTableRe.FindStringSubmatch(line); m != nil {
+			section, subsection = splitTableName(m[1])
+			setting = subsection
+			fn(section, setting, lineNum, line)
+			continue
+		}
+		if m := tomlSettingRe.FindStringSubmatch(line); m != nil && subsection == "" {
+			setting = strings.Trim(m[1], `"`)
+		}
+		if section != "" && setting != "" {
+			fn(section, setting, lineNum, line)
+		}
+		if strings.Count(line, `"""`)%2 == 1 || strings.Count(line, "'''")%2 == 1 {
+			inMultiline = true
+		}
+	}
+}
+
+func (l *configLocations) addSetting(section, setting string, line int) {
+	settings, ok := l.settingLines[section]
+	if !ok {
+		settings = make(map[string]int)
+		l.settingLines[section] = settings
+	}
+	if _, ok := settings[setting]; !ok {
+		settings[setting] = line
+	}
+}
+
+// Splits a TOML table name into the top level section name and the first
+// nested table name, if any.
+func splitTableName(name string) (section, subsection string) {
+	rest := name
+	if strings.HasPrefix(name, `"`) {
+		end := strings.Index(name[1:], `"`)
+		if end == -1 {
+			return name, ""
+		}
+		section, rest = name[1:end+1], name[end+2:]
+	} else if dot := strings.Index(name, "."); dot != -1 {
+		section, rest = name[:dot], name[dot:]
+	} else {
+		return name, ""
+	}
+	rest = strings.TrimLeft(strings.TrimSpace(rest), ".")
+	if dot := strings.Index(rest, "."); dot != -1 {
+		rest = rest[:dot]
+	}
+	return section, strings.Trim(strings.TrimSpace(rest), `"`)
+}
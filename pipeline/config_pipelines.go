@@ -0,0 +1,230 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"errors"
+	"fmt"
+	"github.com/bbangert/toml"
+	"sort"
+)
+
+// Name of the config section holding the named pipeline definitions, i.e.
+// `[pipelines.<name>]` tables.
+const PIPELINES_SECTION = "pipelines"
+
+// A named processing pipeline, which can be attached to inputs, filters, and
+// outputs with their `pipeline` setting.
+type namedPipeline struct {
+	// Decoders applied, in order, to the messages of the attached inputs.
+	Decoders []string
+	// Matcher ANDed with those of the attached filters and outputs.
+	Matcher string `toml:"message_matcher"`
+	// Filter sections used as templates, each is instantiated once per
+	// pipeline that lists it.
+	Filters []string
+	// Encoder used by the attached outputs.
+	Encoder string
+}
+
+// Compiles the named pipelines in the config down to ordinary plugin
+// sections, modifying the config in place. A pipeline with more than one
+// decoder gets a generated "<name>-decoder" MultiDecoder section that applies
+// all of them. Each filter section listed in a pipeline's `filters` is copied
+// to a "<name>-<filter>" section attached to the pipeline, and the original
+// section is removed. Inputs with a `pipeline` setting then get the
+// pipeline's decoder, filters and outputs get its matcher, and outputs get its
+// encoder. Returns a map of each generated section's name to the name of the
+// section it was generated from, and any problems found as *ConfigError
+// values.
+func expandPipelines(configFile ConfigFile) (generated map[string]string, errs []error) {
+	generated = make(map[string]string)
+	addErr := func(section string, err error) {
+		errs = append(errs, &ConfigError{Section: section, Err: err})
+	}
+
+	pipelines := make(map[string]*namedPipeline)
+	var pipeNames []string
+	if section, ok := configFile[PIPELINES_SECTION]; ok {
+		delete(configFile, PIPELINES_SECTION)
+		defs, ok := toStringMap(section)
+		if !ok {
+			return nil, []error{errors.New("invalid pipelines section")}
+		}
+		for name := range defs {
+			pipeNames = append(pipeNames, name)
+		}
+		sort.Strings(pipeNames)
+		for _, name := range pipeNames {
+			pipe := new(namedPipeline)
+			err := toml.PrimitiveDecodeStrict(defs[name], pipe, nil)
+			if err != nil {
+				addErr(PIPELINES_SECTION, fmt.Errorf("pipeline '%s': %s", name, err))
+				continue
+			}
+			pipelines[name] = pipe
+		}
+	}
+
+	// Decoder chains.
+	decoders := make(map[string]string)
+	for _, name := range pipeNames {
+		pipe, ok := pipelines[name]
+		if !ok {
+			continue
+		}
+		switch len(pipe.Decoders) {
+		case 0:
+		case 1:
+			decoders[name] = pipe.Decoders[0]
+		default:
+			decoderName := name + "-decoder"
+			if _, ok := configFile[decoderName]; ok {
+				addErr(decoderName, fmt.Errorf("conflicts with pipeline '%s'", name))
+				continue
+			}
+			subs := make([]interface{}, len(pipe.Decoders))
+			for i, sub := range pipe.Decoders {
+				subs[i] = sub
+			}
+			configFile[decoderName] = map[string]interface{}{
+				"type":             "MultiDecoder",
+				"subs":             subs,
+				"cascade_strategy": "all",
+			}
+			generated[decoderName] = PIPELINES_SECTION
+			decoders[name] = decoderName
+		}
+	}
+
+	// Filter templates. Templates are only removed once every pipeline has
+	// been expanded, since they may be shared.
+	templates := make(map[string]bool)
+	for _, name := range pipeNames {
+		pipe, ok := pipelines[name]
+		if !ok {
+			continue
+		}
+		for _, filter := range pipe.Filters {
+			section, ok := sectionMap(configFile, filter)
+			if !ok {
+				addErr(PIPELINES_SECTION, fmt.Errorf("pipeline '%s': unknown filter: %s",
+					name, filter))
+				continue
+			}
+			if _, ok = section["pipeline"]; ok {
+				addErr(filter, errors.New("filters listed by a pipeline can't set pipeline"))
+				continue
+			}
+			instance := name + "-" + filter
+			if _, ok = configFile[instance]; ok {
+				addErr(instance, fmt.Errorf("conflicts with pipeline '%s'", name))
+				continue
+			}
+			if _, ok = section["type"]; !ok {
+				section["type"] = filter
+			}
+			section["pipeline"] = name
+			configFile[instance] = section
+			generated[instance] = filter
+			templates[filter] = true
+		}
+	}
+	for filter := range templates {
+		delete(configFile, filter)
+	}
+
+	names := make([]string, 0, len(configFile))
+	for name := range configFile {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		section, ok := sectionMap(configFile, name)
+		if !ok {
+			continue
+		}
+		value, ok := section["pipeline"]
+		if !ok {
+			continue
+		}
+		delete(section, "pipeline")
+		configFile[name] = section
+		pipeName, _ := value.(string)
+		pipe, ok := pipelines[pipeName]
+		if !ok {
+			addErr(name, fmt.Errorf("unknown pipeline: %v", value))
+			continue
+		}
+		if err := pipe.attach(section, name, decoders[pipeName]); err != nil {
+			addErr(name, fmt.Errorf("pipeline '%s': %s", pipeName, err))
+		}
+	}
+	return
+}
+
+// Applies the pipeline's settings to a plugin section.
+func (pipe *namedPipeline) attach(section map[string]interface{}, name,
+	decoder string) error {
+
+	typ, _ := section["type"].(string)
+	if typ == "" {
+		typ = name
+	}
+	switch category := getPluginCategory(typ); category {
+	case "Input":
+		if decoder == "" {
+			return nil
+		}
+		if _, ok := section["decoder"]; ok {
+			return errors.New("decoder can't be set when using a pipeline")
+		}
+		section["decoder"] = decoder
+	case "Filter", "Output":
+		if pipe.Matcher != "" {
+			if matcher, _ := section["message_matcher"].(string); matcher != "" {
+				section["message_matcher"] = fmt.Sprintf("(%s) && (%s)", pipe.Matcher,
+					matcher)
+			} else {
+				section["message_matcher"] = pipe.Matcher
+			}
+		}
+		if category == "Filter" || pipe.Encoder == "" {
+			return nil
+		}
+		if _, ok := section["encoder"]; ok {
+			return errors.New("encoder can't be set when using a pipeline")
+		}
+		section["encoder"] = pipe.Encoder
+	default:
+		return errors.New("only inputs, filters, and outputs can use a pipeline")
+	}
+	return nil
+}
+
+// Returns a shallow copy of a section's settings, so it can be modified
+// without affecting the original.
+func sectionMap(configFile ConfigFile, name string) (map[string]interface{}, bool) {
+	section, ok := configFile[name]
+	if !ok {
+		return nil, false
+	}
+	settings, ok := toStringMap(section)
+	if !ok {
+		return nil, false
+	}
+	copied := make(map[string]interface{}, len(settings))
+	for k, v := range settings {
+		copied[k] = v
+	}
+	return copied, true
+}
@@ -0,0 +1,297 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"fmt"
+	"github.com/bbangert/toml"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Sources of config setting values.
+const (
+	SETTING_FROM_FILE    = "file"
+	SETTING_FROM_ENV     = "env"
+	SETTING_FROM_DEFAULT = "default"
+	SETTING_FROM_ADMIN   = "admin"
+)
+
+// Replaces the values of settings that look like secrets.
+const MASKED_VALUE = "********"
+
+var (
+	secretSettingRe = regexp.MustCompile(
+		`(?i)(passw(or)?d|passphrase|secret|token|credential|api_?key|private_?key|authorization)`)
+	urlPasswordRe = regexp.MustCompile(`(://[^:/@\s]*:)[^@/\s]*@`)
+)
+
+// The value of a config setting as the running hekad sees it, and where it
+// came from.
+type SettingProvenance struct {
+	Value interface{} `json:"value"`
+	// SETTING_FROM_FILE, SETTING_FROM_ENV for file settings with environment
+	// variables substituted into them, SETTING_FROM_DEFAULT, or
+	// SETTING_FROM_ADMIN for global settings changed through the admin API.
+	Source  string   `json:"source"`
+	File    string   `json:"file,omitempty"`
+	Line    int      `json:"line,omitempty"`
+	EnvVars []string `json:"env_vars,omitempty"`
+	// Whether (part of) the value was replaced by MASKED_VALUE.
+	Masked bool `json:"masked,omitempty"`
+}
+
+// The resolved settings of a config section, by setting name.
+type SectionProvenance struct {
+	Type     string                        `json:"type,omitempty"`
+	File     string                        `json:"file,omitempty"`
+	Line     int                           `json:"line,omitempty"`
+	Settings map[string]*SettingProvenance `json:"settings"`
+}
+
+// The fully resolved configuration of the running hekad, i.e. the [hekad]
+// section and every loaded plugin section, including the settings left at
+// their defaults, as served by the admin API's `/config` endpoint.
+type ResolvedConfig struct {
+	Sections map[string]*SectionProvenance `json:"sections"`
+	// Number of settings from each source.
+	Sources map[string]int `json:"sources"`
+}
+
+func (rc *ResolvedConfig) add(name string, section *SectionProvenance) {
+	rc.Sections[name] = section
+	for _, setting := range section.Settings {
+		rc.Sources[setting.Source]++
+	}
+}
+
+// Records the struct the [hekad] section was decoded into, so its settings,
+// including the defaults, are part of the ResolvedConfig.
+func (self *PipelineConfig) SetDaemonConfig(config interface{}) {
+	self.daemonConfig = config
+}
+
+// Returns the resolved configuration, with the provenance of every setting.
+// Settings that look like secrets, based on their names or those of the
+// environment variables substituted into them, are masked, as are passwords
+// in URLs. Line numbers and environment variables are only known for TOML
+// config files.
+func (self *PipelineConfig) ResolvedConfig() *ResolvedConfig {
+	rc := &ResolvedConfig{
+		Sections: make(map[string]*SectionProvenance),
+		Sources:  make(map[string]int),
+	}
+	locs := self.configLocs
+	if locs == nil {
+		locs = newConfigLocations()
+	}
+	if self.daemonConfig != nil {
+		section := resolveSection(HEKA_DAEMON, self.daemonSection, locs,
+			self.daemonConfig)
+		self.overlayTunables(section)
+		rc.add(HEKA_DAEMON, section)
+	}
+
+	self.makersLock.RLock()
+	defer self.makersLock.RUnlock()
+	for _, makers := range self.makers {
+		for name, maker := range makers {
+			m, ok := maker.(*pluginMaker)
+			if !ok || !m.configPrepped {
+				continue
+			}
+			section := resolveSection(name, m.tomlSection, locs, m.commonConfig,
+				m.commonTypedConfig, m.configStruct)
+			section.Type = m.Type()
+			rc.add(name, section)
+		}
+	}
+	return rc
+}
+
+// Shows the global settings changed through the admin API with their current
+// values.
+func (self *PipelineConfig) overlayTunables(section *SectionProvenance) {
+	tunables := reflect.ValueOf(self.Globals.Tunables())
+	for i := 0; i < tunables.NumField(); i++ {
+		name := tunables.Type().Field(i).Tag.Get("json")
+		value := tunables.Field(i).Interface()
+		setting, ok := section.Settings[name]
+		if !ok || fmt.Sprint(setting.Value) == fmt.Sprint(value) {
+			continue
+		}
+		section.Settings[name] = &SettingProvenance{Value: value,
+			Source: SETTING_FROM_ADMIN}
+	}
+}
+
+// Resolves the settings of a config section from the structs it was decoded
+// into, with later structs taking precedence, noting for each setting whether
+// it's specified in the section or left at its default.
+func resolveSection(name string, tomlSection toml.Primitive, locs *configLocations,
+	configs ...interface{}) *SectionProvenance {
+
+	section := &SectionProvenance{
+		File:     locs.files[name],
+		Line:     locs.lines[name],
+		Settings: make(map[string]*SettingProvenance),
+	}
+	given, _ := tomlSection.(map[string]interface{})
+	for _, config := range configs {
+		values, _ := normalizeConfigValue(reflect.ValueOf(config)).(map[string]interface{})
+		for key, value := range values {
+			setting := &SettingProvenance{Source: SETTING_FROM_DEFAULT}
+			if givenKey, ok := findSetting(given, key); ok {
+				setting.Source = SETTING_FROM_FILE
+				setting.File = section.File
+				setting.Line = locs.settingLines[name][givenKey]
+				if envs := locs.settingEnvs[name][givenKey]; len(envs) > 0 {
+					setting.Source = SETTING_FROM_ENV
+					setting.EnvVars = envs
+				}
+			}
+			setting.Value, setting.Masked = maskSecrets(key, value, setting.EnvVars)
+			section.Settings[key] = setting
+		}
+	}
+	return section
+}
+
+// Finds a setting in a config section, matching the name case insensitively
+// like the TOML decoder does, and returns the name as written in the config.
+func findSetting(given map[string]interface{}, key string) (string, bool) {
+	if _, ok := given[key]; ok {
+		return key, true
+	}
+	for givenKey := range given {
+		if strings.EqualFold(givenKey, key) {
+			return givenKey, true
+		}
+	}
+	return "", false
+}
+
+// Converts a decoded config value to plain maps, slices, and scalars, naming
+// struct fields as in the config, so it can be served as JSON.
+func normalizeConfigValue(v reflect.Value) interface{} {
+	if !v.IsValid() {
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+		return normalizeConfigValue(v.Elem())
+	case reflect.Struct:
+		if t, ok := v.Interface().(time.Time); ok {
+			return t
+		}
+		m := make(map[string]interface{})
+		addConfigFields(m, v)
+		return m
+	case reflect.Map:
+		m := make(map[string]interface{}, v.Len())
+		for _, key := range v.MapKeys() {
+			m[fmt.Sprint(key.Interface())] = normalizeConfigValue(v.MapIndex(key))
+		}
+		return m
+	case reflect.Slice, reflect.Array:
+		s := make([]interface{}, v.Len())
+		for i := range s {
+			s[i] = normalizeConfigValue(v.Index(i))
+		}
+		return s
+	case reflect.Func, reflect.Chan, reflect.UnsafePointer:
+		return nil
+	}
+	if d, ok := v.Interface().(time.Duration); ok {
+		return d.String()
+	}
+	return v.Interface()
+}
+
+// Adds the exported fields of a config struct to a map, by their TOML names.
+// The fields of embedded structs are added as if they were the struct's own.
+func addConfigFields(m map[string]interface{}, v reflect.Value) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		fv := v.Field(i)
+		if field.Anonymous {
+			if fv.Kind() == reflect.Ptr {
+				if fv.IsNil() {
+					continue
+				}
+				fv = fv.Elem()
+			}
+			if fv.Kind() == reflect.Struct {
+				addConfigFields(m, fv)
+				continue
+			}
+		}
+		name := strings.Split(field.Tag.Get("toml"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = strings.ToLower(field.Name)
+		}
+		m[name] = normalizeConfigValue(fv)
+	}
+}
+
+// Masks a setting value if the setting's name, or the name of an environment
+// variable substituted into it, looks like that of a secret, and any
+// passwords in URLs. Nested settings are masked by their own names. Returns
+// whether anything was masked.
+func maskSecrets(name string, value interface{}, envVars []string) (interface{}, bool) {
+	if value != nil && value != "" {
+		if secretSettingRe.MatchString(name) {
+			return MASKED_VALUE, true
+		}
+		for _, env := range envVars {
+			if secretSettingRe.MatchString(env) {
+				return MASKED_VALUE, true
+			}
+		}
+	}
+
+	masked := false
+	switch v := value.(type) {
+	case string:
+		s := urlPasswordRe.ReplaceAllString(v, "${1}"+MASKED_VALUE+"@")
+		return s, s != v
+	case map[string]interface{}:
+		result := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			var itemMasked bool
+			result[key], itemMasked = maskSecrets(key, item, nil)
+			masked = masked || itemMasked
+		}
+		return result, masked
+	case []interface{}:
+		result := make([]interface{}, len(v))
+		for i, item := range v {
+			var itemMasked bool
+			result[i], itemMasked = maskSecrets(name, item, nil)
+			masked = masked || itemMasked
+		}
+		return result, masked
+	}
+	return value, false
+}
@@ -0,0 +1,264 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"errors"
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+	"sort"
+	"time"
+)
+
+// A problem with a single section of a config file.
+type ConfigError struct {
+	// File containing the section, empty if it isn't known.
+	File string
+	// Line of the setting the problem is with, or of the section header,
+	// zero if it isn't known.
+	Line    int
+	Section string
+	Err     error
+}
+
+func (e *ConfigError) Error() string {
+	if e.File == "" {
+		return fmt.Sprintf("[%s]: %s", e.Section, e.Err)
+	}
+	if e.Line == 0 {
+		return fmt.Sprintf("%s: [%s]: %s", e.File, e.Section, e.Err)
+	}
+	return fmt.Sprintf("%s:%d: [%s]: %s", e.File, e.Line, e.Section, e.Err)
+}
+
+// Checks a config file, and any fragments it includes, in the same way as
+// LoadFromConfigFile but without initializing, registering, or starting any
+// plugins. Returns every problem found rather than stopping at the first
+// one, problems with plugin sections are returned as *ConfigError values.
+func (self *PipelineConfig) ValidateConfigFile(filename string) []error {
+	ir := newIncludeResolver(self.Globals.ConfigFormat)
+	if err := ir.include(filename, true); err != nil {
+		return []error{err}
+	}
+	return self.validateIncludes(ir)
+}
+
+// Checks the config files in a directory in the same way as LoadFromConfigDir,
+// see ValidateConfigFile.
+func (self *PipelineConfig) ValidateConfigDir(path string) []error {
+	filenames, err := ConfigDirFiles(path, self.Globals.RecursiveConfigDir)
+	if err != nil {
+		return []error{err}
+	}
+	ir := newIncludeResolver(self.Globals.ConfigFormat)
+	for _, filename := range filenames {
+		if err = ir.include(filename, true); err != nil {
+			return []error{err}
+		}
+	}
+	return self.validateIncludes(ir)
+}
+
+func (self *PipelineConfig) validateIncludes(ir *includeResolver) []error {
+	configFile, err := ir.result()
+	if err != nil {
+		return []error{err}
+	}
+	return self.validateConfig(configFile, ir.locs)
+}
+
+// Runs the NewPluginMaker and PrepConfig pass over every plugin section, then
+// checks the settings that would otherwise only be verified when the runners
+// are made, i.e. message matchers, references to decoders and encoders, and
+// MultiDecoder dependencies. Named pipelines are expanded first. `locs`
+// records where the sections came from.
+func (self *PipelineConfig) validateConfig(configFile ConfigFile,
+	locs *configLocations) (errs []error) {
+
+	// Errors are reported in section name order.
+	sectionErrs := make(map[string][]error)
+	addErr := func(section string, err error) {
+		sectionErrs[section] = append(sectionErrs[section],
+			locs.configError(section, err))
+	}
+
+	generated, pipeErrs := expandPipelines(configFile)
+	for name, from := range generated {
+		locs.copySection(name, from)
+	}
+	for _, err := range pipeErrs {
+		if configErr, ok := err.(*ConfigError); ok {
+			addErr(configErr.Section, configErr.Err)
+		} else {
+			errs = append(errs, err)
+		}
+	}
+
+	names := make([]string, 0, len(configFile))
+	for name := range configFile {
+		if name != HEKA_DAEMON && name != ASSERT_SECTION {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	// ProtobufDecoder and ProtobufEncoder are always available.
+	decoders := map[string]bool{"ProtobufDecoder": true}
+	encoders := map[string]bool{"ProtobufEncoder": true}
+	processors := make(map[string]bool)
+	makers := make(map[string]*pluginMaker, len(names))
+	for _, name := range names {
+		var maker PluginMaker
+		err := safeConfigStep(func() (err error) {
+			if maker, err = NewPluginMaker(name, self, configFile[name]); err != nil {
+				return err
+			}
+			return maker.PrepConfig()
+		})
+		if err != nil {
+			addErr(name, err)
+			continue
+		}
+		m := maker.(*pluginMaker)
+		makers[name] = m
+		switch m.category {
+		case "Decoder":
+			decoders[name] = true
+		case "Encoder":
+			encoders[name] = true
+		case "Processor":
+			processors[name] = true
+		}
+	}
+
+	var multiDecoders []multiDecoderNode
+	for _, name := range names {
+		m, ok := makers[name]
+		if !ok {
+			continue
+		}
+		if err := safeConfigStep(func() error {
+			return m.validate(decoders, encoders, processors)
+		}); err != nil {
+			addErr(name, err)
+		}
+		if m.Type() != "MultiDecoder" {
+			continue
+		}
+		subs := subsFromSection(m.tomlSection)
+		for _, sub := range subs {
+			if !decoders[sub] {
+				addErr(name, fmt.Errorf("unknown subdecoder: %s", sub))
+			}
+		}
+		multiDecoders = append(multiDecoders, newMultiDecoderNode(name, subs))
+	}
+	errNames := make([]string, 0, len(sectionErrs))
+	for name := range sectionErrs {
+		errNames = append(errNames, name)
+	}
+	sort.Strings(errNames)
+	for _, name := range errNames {
+		errs = append(errs, sectionErrs[name]...)
+	}
+	if _, err := orderDependencies(multiDecoders); err != nil {
+		errs = append(errs, err)
+	}
+	return
+}
+
+// Checks the common config settings that MakeRunner uses, without
+// initializing the plugin.
+func (m *pluginMaker) validate(decoders, encoders, processors map[string]bool) error {
+	switch m.category {
+	case "Input":
+		commonInput := m.commonTypedConfig.(CommonInputConfig)
+		decoder := commonInput.Decoder
+		if decoder == "" {
+			decoder = getAttr(m.configStruct, "Decoder", "").(string)
+		}
+		if decoder != "" && !decoders[decoder] {
+			return settingErrorf("decoder", "unknown decoder: %s", decoder)
+		}
+		if commonInput.IdGenerator != "" {
+			idGeneratorsLock.RLock()
+			_, ok := idGenerators[commonInput.IdGenerator]
+			idGeneratorsLock.RUnlock()
+			if !ok {
+				return settingErrorf("id_generator", "unknown id_generator: %s",
+					commonInput.IdGenerator)
+			}
+		}
+		for _, processor := range commonInput.Processors {
+			if !processors[processor] {
+				return settingErrorf("processors", "unknown processor: %s", processor)
+			}
+		}
+	case "Filter", "Output":
+		commonFO := m.commonTypedConfig.(CommonFOConfig)
+		matcher := commonFO.Matcher
+		if matcher == "" {
+			matcher = getAttr(m.configStruct, "MessageMatcher", "").(string)
+		}
+		if matcher == "" {
+			return errors.New("missing message matcher")
+		}
+		if _, err := message.CreateMatcherSpecification(matcher); err != nil {
+			return settingErrorf("message_matcher", "invalid message matcher: %s", err)
+		}
+		if err := validateBuffering(commonFO.Buffering, commonFO.Buffer); err != nil {
+			return err
+		}
+		if m.category == "Filter" {
+			if commonFO.StartupProbe.Type != "" {
+				return settingErrorf("startup_probe", "startup_probe is only supported by outputs")
+			}
+			if commonFO.LazyConnect {
+				return settingErrorf("lazy_connect", "lazy_connect is only supported by outputs")
+			}
+			if commonFO.MaxBufferAge != "" {
+				return settingErrorf("max_buffer_age", "max_buffer_age is only supported by outputs")
+			}
+			if commonFO.MaxRecordSize != 0 {
+				return settingErrorf("max_record_size", "max_record_size is only supported by outputs")
+			}
+			if commonFO.TimestampRewrite != (TimestampRewriteConfig{}) {
+				return settingErrorf("timestamp_rewrite", "timestamp_rewrite is only supported by outputs")
+			}
+			return nil
+		}
+		if err := validateOversizePolicy(commonFO.OversizePolicy); err != nil {
+			return settingErrorf("oversize_policy", "%s", err)
+		}
+		if commonFO.MaxBufferAge != "" {
+			if _, err := time.ParseDuration(commonFO.MaxBufferAge); err != nil {
+				return settingErrorf("max_buffer_age", "invalid max_buffer_age: %s", err)
+			}
+		}
+		if _, err := newTimestampRewriter(commonFO.TimestampRewrite); err != nil {
+			return settingErrorf("timestamp_rewrite", "invalid timestamp_rewrite: %s", err)
+		}
+		encoder := commonFO.Encoder
+		if encoder == "" {
+			encoder = getAttr(m.configStruct, "Encoder", "").(string)
+		}
+		if encoder != "" && !encoders[encoder] {
+			return settingErrorf("encoder", "unknown encoder: %s", encoder)
+		}
+		if commonFO.StartupProbe.Type != "" {
+			if _, err := newStartupProbe(commonFO.StartupProbe, m.plugin); err != nil {
+				return settingErrorf("startup_probe", "invalid startup_probe: %s", err)
+			}
+		}
+	}
+	return nil
+}
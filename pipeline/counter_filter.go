@@ -17,18 +17,50 @@ package pipeline
 
 import (
 	"fmt"
+	"github.com/mozilla-services/heka/message"
+	"math"
 	"sort"
+	"strings"
+	"sync"
 	"time"
 )
 
-// Filter that counts the number of messages flowing through and provides
-// primitive aggregation counts.
+// Windows of the rolling rates, as in Unix load averages.
+var counterRateWindows = [3]time.Duration{time.Minute, 5 * time.Minute, 15 * time.Minute}
+
+// Names of the rolling rate fields, matching counterRateWindows.
+var counterRateNames = [3]string{"Rate1m", "Rate5m", "Rate15m"}
+
+// Groups idle for longer than the longest window are forgotten.
+const counterGroupIdle = 15 * time.Minute
+
+// Key of the group counting messages over the `max_groups` limit.
+const counterOtherGroup = "_other"
+
+// Filter that counts the messages flowing through, in total and optionally
+// broken down by the values of some headers or fields, and tracks their
+// rates over the last ticker interval and rolling 1, 5, and 15 minute
+// windows. The counts are injected as `heka.counter-output` messages once
+// per ticker interval and included in the filter's report.
 type CounterFilter struct {
-	lastTime  time.Time
-	lastCount uint
-	count     uint
-	rate      float64
-	rates     []float64
+	conf   *CounterFilterConfig
+	total  *counterGroup
+	groups map[string]*counterGroup
+	// Time of the last tally.
+	lastTime time.Time
+	lock     sync.Mutex
+}
+
+// Message count and rates of a group of messages.
+type counterGroup struct {
+	key       string
+	values    []string // Values of the `group_by` names.
+	count     int64
+	lastCount int64
+	rate      float64    // Over the last interval.
+	rates     [3]float64 // Rolling rates.
+	primed    bool       // Whether the rolling rates have a value.
+	lastSeen  time.Time
 }
 
 // CounterFilter config struct, used only for specifying default ticker
@@ -39,23 +71,40 @@ type CounterFilterConfig struct {
 	MessageMatcher string `toml:"message_matcher"`
 	// Defaults to 5 second intervals.
 	TickerInterval uint `toml:"ticker_interval"`
+	// Headers (e.g. "Type" or "Hostname") or fields to break the counts down
+	// by. Messages missing one of them are counted with an empty value.
+	GroupBy []string `toml:"group_by"`
+	// Maximum number of groups tracked, further groups are counted together
+	// as "_other". Defaults to 1000.
+	MaxGroups uint `toml:"max_groups"`
 }
 
 func (this *CounterFilter) ConfigStruct() interface{} {
 	return &CounterFilterConfig{
 		MessageMatcher: "Type != 'heka.counter-output'",
 		TickerInterval: uint(5),
+		MaxGroups:      1000,
 	}
 }
 
 func (this *CounterFilter) Init(config interface{}) error {
+	this.conf = config.(*CounterFilterConfig)
+	this.reset()
 	return nil
 }
 
+func (this *CounterFilter) reset() {
+	this.total = new(counterGroup)
+	this.groups = make(map[string]*counterGroup)
+	this.lastTime = time.Now()
+}
+
 func (this *CounterFilter) Run(fr FilterRunner, h PluginHelper) (err error) {
 	inChan := fr.InChan()
 	ticker := fr.Ticker()
+	this.lock.Lock()
 	this.lastTime = time.Now()
+	this.lock.Unlock()
 
 	var (
 		ok           = true
@@ -69,71 +118,163 @@ func (this *CounterFilter) Run(fr FilterRunner, h PluginHelper) (err error) {
 				break
 			}
 			msgLoopCount = pack.MsgLoopCount
-			this.count++
+			this.count(pack.Message)
 			pack.Recycle()
-		case <-ticker:
-			this.tally(fr, h, msgLoopCount)
+		case now := <-ticker:
+			for _, group := range this.tally(now) {
+				pack := h.PipelinePack(msgLoopCount)
+				if pack == nil {
+					fr.LogError(fmt.Errorf("exceeded MaxMsgLoops = %d",
+						h.PipelineConfig().Globals.Tunables().MaxMsgLoops))
+					break
+				}
+				this.fillMessage(pack.Message, fr.Name(), group)
+				fr.Inject(pack)
+			}
 		}
 	}
 	return
 }
 
 func (this *CounterFilter) CleanupForRestart() {
-	this.lastCount = 0
-	this.count = 0
-	this.rate = 0
-	this.rates = nil
+	this.lock.Lock()
+	this.reset()
+	this.lock.Unlock()
 }
 
-func (this *CounterFilter) tally(fr FilterRunner, h PluginHelper,
-	msgLoopCount uint) {
-	msgsSent := this.count - this.lastCount
-	if msgsSent == 0 {
+// Counts a message, in total and in its group.
+func (this *CounterFilter) count(msg *message.Message) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.total.count++
+	if len(this.conf.GroupBy) == 0 {
 		return
 	}
+	values := make([]string, len(this.conf.GroupBy))
+	for i, name := range this.conf.GroupBy {
+		values[i], _ = destinationValue(msg, name)
+	}
+	key := strings.Join(values, "|")
+	group, ok := this.groups[key]
+	if !ok {
+		if uint(len(this.groups)) >= this.conf.MaxGroups {
+			key, values = counterOtherGroup, nil
+			group, ok = this.groups[key]
+		}
+		if !ok {
+			group = &counterGroup{key: key, values: values}
+			this.groups[key] = group
+		}
+	}
+	group.count++
+}
 
-	now := time.Now()
-	elapsedTime := now.Sub(this.lastTime)
-	this.lastCount = this.count
+// Updates the rates at the end of an interval, forgets idle groups, and
+// returns the groups that received messages during the interval, the total
+// first and then the other groups sorted by key. Returns nothing if no
+// messages were received.
+func (this *CounterFilter) tally(now time.Time) (active []*counterGroup) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	elapsed := now.Sub(this.lastTime)
 	this.lastTime = now
-	this.rate = float64(msgsSent) / elapsedTime.Seconds()
-	this.rates = append(this.rates, this.rate)
+	if elapsed <= 0 {
+		return nil
+	}
+	if this.total.update(now, elapsed) {
+		active = append(active, this.total)
+	}
+	keys := make([]string, 0, len(this.groups))
+	for key, group := range this.groups {
+		if group.update(now, elapsed) {
+			keys = append(keys, key)
+		} else if now.Sub(group.lastSeen) > counterGroupIdle {
+			delete(this.groups, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		active = append(active, this.groups[key])
+	}
+	return active
+}
 
-	pack := h.PipelinePack(msgLoopCount)
-	if pack == nil {
-		fr.LogError(fmt.Errorf("exceeded MaxMsgLoops = %d",
-			h.PipelineConfig().Globals.MaxMsgLoops))
-		return
+// Updates a group's rates at the end of an interval of the given length,
+// returning whether it received any messages during the interval.
+func (g *counterGroup) update(now time.Time, elapsed time.Duration) bool {
+	sent := g.count - g.lastCount
+	g.lastCount = g.count
+	g.rate = float64(sent) / elapsed.Seconds()
+	for i, window := range counterRateWindows {
+		if !g.primed {
+			g.rates[i] = g.rate
+			continue
+		}
+		alpha := 1 - math.Exp(-elapsed.Seconds()/window.Seconds())
+		g.rates[i] += alpha * (g.rate - g.rates[i])
+	}
+	g.primed = true
+	if sent == 0 {
+		return false
 	}
-	pack.Message.SetType("heka.counter-output")
-	pack.Message.SetPayload(fmt.Sprintf("Got %d messages. %0.2f msg/sec",
-		this.count, this.rate))
-	fr.Inject(pack)
-
-	samples := len(this.rates)
-	if samples == 10 { // generate a summary every 10 samples
-		sort.Float64s(this.rates)
-		min := this.rates[0]
-		max := this.rates[samples-1]
-		sum := float64(0)
-		for _, val := range this.rates {
-			sum += val
+	g.lastSeen = now
+	return true
+}
+
+// Fills in the output message of a group.
+func (this *CounterFilter) fillMessage(msg *message.Message, logger string,
+	g *counterGroup) {
+
+	msg.SetLogger(logger)
+	msg.SetType("heka.counter-output")
+	if g == this.total {
+		msg.SetPayload(fmt.Sprintf("Got %d messages. %0.2f msg/sec", g.count, g.rate))
+	} else {
+		msg.SetPayload(fmt.Sprintf("Got %d messages for %s. %0.2f msg/sec", g.count,
+			g.key, g.rate))
+		if g.key == counterOtherGroup {
+			message.NewStringField(msg, "group", counterOtherGroup)
 		}
-		mean := sum / float64(samples)
-		pack := h.PipelinePack(msgLoopCount)
-		if pack == nil {
-			fr.LogError(fmt.Errorf("exceeded MaxMsgLoops = %d",
-				h.PipelineConfig().Globals.MaxMsgLoops))
-			return
+		for i, value := range g.values {
+			message.NewStringField(msg, this.conf.GroupBy[i], value)
 		}
-		pack.Message.SetLogger(fr.Name())
-		pack.Message.SetType("heka.counter-output")
-		pack.Message.SetPayload(
-			fmt.Sprintf("AGG Sum. Min: %0.2f    Max: %0.2f    Mean: %0.2f",
-				min, max, mean))
-		fr.Inject(pack)
-		this.rates = this.rates[:0]
 	}
+	g.addFields(msg, "")
+}
+
+// Adds a group's count and rates to a message, prefixing the field names.
+func (g *counterGroup) addFields(msg *message.Message, prefix string) {
+	message.NewInt64Field(msg, prefix+"Count", g.count, "count")
+	if f, err := message.NewField(prefix+"Rate", g.rate, "count/s"); err == nil {
+		msg.AddField(f)
+	}
+	for i, name := range counterRateNames {
+		if f, err := message.NewField(prefix+name, g.rates[i], "count/s"); err == nil {
+			msg.AddField(f)
+		}
+	}
+}
+
+// Satisfies the `ReportingPlugin` interface, adding the total count and
+// rates, and those of each group prefixed with its key, e.g.
+// "nginx|web1.Rate5m".
+func (this *CounterFilter) ReportMsg(msg *message.Message) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if this.total == nil {
+		return nil // Not initialized yet.
+	}
+	this.total.addFields(msg, "")
+	message.NewIntField(msg, "Groups", len(this.groups), "count")
+	keys := make([]string, 0, len(this.groups))
+	for key := range this.groups {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		this.groups[key].addFields(msg, key+".")
+	}
+	return nil
 }
 
 func init() {
@@ -0,0 +1,120 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"github.com/mozilla-services/heka/message"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"math"
+	"time"
+)
+
+func CounterFilterSpec(c gs.Context) {
+	c.Specify("A CounterFilter", func() {
+		filter := new(CounterFilter)
+		conf := filter.ConfigStruct().(*CounterFilterConfig)
+		conf.GroupBy = []string{"Type", "host"}
+		err := filter.Init(conf)
+		c.Assume(err, gs.IsNil)
+		start := time.Unix(1000, 0)
+		filter.lastTime = start
+
+		newMsg := func(typ, host string) *message.Message {
+			msg := new(message.Message)
+			msg.SetType(typ)
+			if host != "" {
+				message.NewStringField(msg, "host", host)
+			}
+			return msg
+		}
+
+		c.Specify("counts messages in total and by group", func() {
+			for i := 0; i < 6; i++ {
+				filter.count(newMsg("nginx", "web1"))
+			}
+			for i := 0; i < 4; i++ {
+				filter.count(newMsg("syslog", ""))
+			}
+			active := filter.tally(start.Add(5 * time.Second))
+			c.Expect(len(active), gs.Equals, 3)
+			c.Expect(active[0], gs.Equals, filter.total)
+			c.Expect(active[0].count, gs.Equals, int64(10))
+			c.Expect(active[0].rate, gs.Equals, 2.0)
+			c.Expect(active[1].key, gs.Equals, "nginx|web1")
+			c.Expect(active[1].count, gs.Equals, int64(6))
+			c.Expect(active[2].key, gs.Equals, "syslog|")
+			c.Expect(active[2].count, gs.Equals, int64(4))
+
+			c.Specify("and emits a message per group", func() {
+				msg := new(message.Message)
+				filter.fillMessage(msg, "counter", active[1])
+				c.Expect(msg.GetType(), gs.Equals, "heka.counter-output")
+				c.Expect(msg.GetPayload(), gs.Equals,
+					"Got 6 messages for nginx|web1. 1.20 msg/sec")
+				host, _ := msg.GetFieldValue("host")
+				c.Expect(host, gs.Equals, "web1")
+				count, _ := msg.GetFieldValue("Count")
+				c.Expect(count, gs.Equals, int64(6))
+				rate, _ := msg.GetFieldValue("Rate15m")
+				c.Expect(rate, gs.Equals, 1.2)
+
+				msg = new(message.Message)
+				filter.fillMessage(msg, "counter", active[0])
+				c.Expect(msg.GetPayload(), gs.Equals, "Got 10 messages. 2.00 msg/sec")
+			})
+
+			c.Specify("and decays the rolling rates while idle", func() {
+				active = filter.tally(start.Add(10 * time.Second))
+				c.Expect(len(active), gs.Equals, 0)
+				c.Expect(filter.total.rate, gs.Equals, 0.0)
+				expected := 2.0 * math.Exp(-5.0/60)
+				c.Expect(math.Abs(filter.total.rates[0]-expected) < 1e-9, gs.IsTrue)
+				c.Expect(filter.total.rates[2] > filter.total.rates[0], gs.IsTrue)
+			})
+
+			c.Specify("and forgets idle groups", func() {
+				filter.tally(start.Add(time.Hour))
+				c.Expect(len(filter.groups), gs.Equals, 0)
+			})
+
+			c.Specify("and reports them", func() {
+				msg := new(message.Message)
+				err := filter.ReportMsg(msg)
+				c.Expect(err, gs.IsNil)
+				count, _ := msg.GetFieldValue("Count")
+				c.Expect(count, gs.Equals, int64(10))
+				groups, _ := msg.GetFieldValue("Groups")
+				c.Expect(groups, gs.Equals, int64(2))
+				count, _ = msg.GetFieldValue("syslog|.Count")
+				c.Expect(count, gs.Equals, int64(4))
+			})
+		})
+
+		c.Specify("counts groups over the limit together", func() {
+			conf.MaxGroups = 1
+			filter.count(newMsg("nginx", "web1"))
+			filter.count(newMsg("nginx", "web2"))
+			filter.count(newMsg("nginx", "web3"))
+			c.Expect(len(filter.groups), gs.Equals, 2)
+			c.Expect(filter.groups[counterOtherGroup].count, gs.Equals, int64(2))
+
+			msg := new(message.Message)
+			filter.fillMessage(msg, "counter", filter.groups[counterOtherGroup])
+			group, _ := msg.GetFieldValue("group")
+			c.Expect(group, gs.Equals, counterOtherGroup)
+		})
+
+		c.Specify("doesn't emit anything without messages", func() {
+			c.Expect(len(filter.tally(start.Add(5*time.Second))), gs.Equals, 0)
+		})
+	})
+}
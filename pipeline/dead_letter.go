@@ -0,0 +1,88 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"github.com/mozilla-services/heka/message"
+	"sync/atomic"
+)
+
+// Message type of dead letters, i.e. copies of messages that failed
+// processing, see PipelineConfig.DeadLetter.
+const DEAD_LETTER_TYPE = "heka.dead-letter"
+
+// Processing stages at which a message can fail, recorded in the
+// `DeadLetterStage` field of dead letters.
+const (
+	DeadLetterDecode    = "decode"
+	DeadLetterProcessor = "processor"
+	DeadLetterFilter    = "filter"
+	DeadLetterOutput    = "output"
+)
+
+// If dead letters are enabled with the `dead_letter` global setting, routes a
+// copy of the pack's message with the type DEAD_LETTER_TYPE and fields
+// describing the failure, so it can be stored for auditing and reprocessing
+// by a plugin matching on that type. The caller keeps ownership of the pack,
+// and is expected to recycle it as it would have without dead letters.
+// Returns whether a dead letter was sent. Dead letters themselves never
+// generate dead letters, to prevent loops.
+func (pc *PipelineConfig) DeadLetter(pack *PipelinePack, stage, pluginName string,
+	err error) bool {
+
+	return pc.deadLetter(pack, stage, pluginName, err, nil)
+}
+
+// Like DeadLetter, also storing the original undecoded data, if any, in the
+// `DeadLetterRaw` field.
+func (pc *PipelineConfig) deadLetter(pack *PipelinePack, stage, pluginName string,
+	err error, raw []byte) bool {
+
+	// Runners created outside of a running pipeline, e.g. in tests, have no
+	// config.
+	if pc == nil || !pc.Globals.DeadLetter ||
+		pack.Message.GetType() == DEAD_LETTER_TYPE {
+		return false
+	}
+	letter := pc.PipelinePack(pack.MsgLoopCount)
+	if letter == nil {
+		return false
+	}
+	pack.Message.Copy(letter.Message)
+	msg := letter.Message
+	message.NewStringField(msg, "DeadLetterType", pack.Message.GetType())
+	msg.SetType(DEAD_LETTER_TYPE)
+	message.NewStringField(msg, "DeadLetterStage", stage)
+	message.NewStringField(msg, "DeadLetterPlugin", pluginName)
+	if err != nil {
+		errMsg := err.Error()
+		if len(errMsg) > 500 {
+			errMsg = errMsg[:500]
+		}
+		message.NewStringField(msg, "DeadLetterError", errMsg)
+	}
+	if len(raw) > 0 {
+		data := make([]byte, len(raw))
+		copy(data, raw)
+		if field, e := message.NewField("DeadLetterRaw", data, ""); e == nil {
+			msg.AddField(field)
+		}
+	}
+	atomic.AddInt64(&pc.deadLetterCount, 1)
+	// Filters and outputs fail on the goroutine that reads their InChan, so
+	// like their injected messages the dead letter is routed in a separate
+	// goroutine, so a router blocked on that InChan can't deadlock us.
+	go func() {
+		pc.router.InChan() <- letter
+	}()
+	return true
+}
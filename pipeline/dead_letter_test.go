@@ -0,0 +1,86 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"errors"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"strings"
+)
+
+func DeadLetterSpec(c gs.Context) {
+	pc := NewPipelineConfig(nil)
+	pc.injectRecycleChan <- NewPipelinePack(pc.injectRecycleChan)
+	recycleChan := make(chan *PipelinePack, 1)
+	pack := NewPipelinePack(recycleChan)
+	pack.Message.SetType("nginx.access")
+	pack.Message.SetPayload("GET / HTTP/1.1")
+	failure := errors.New("failed")
+
+	c.Specify("Dead letters", func() {
+		c.Specify("aren't sent unless enabled", func() {
+			c.Expect(pc.DeadLetter(pack, DeadLetterOutput, "TestOutput", failure),
+				gs.IsFalse)
+			c.Expect(len(pc.injectRecycleChan), gs.Equals, 1)
+		})
+
+		pc.Globals.DeadLetter = true
+
+		c.Specify("copy the failed message with failure details", func() {
+			c.Expect(pc.deadLetter(pack, DeadLetterDecode, "TestInput", failure,
+				[]byte("raw")), gs.IsTrue)
+			letter := <-pc.router.InChan()
+			msg := letter.Message
+			c.Expect(msg.GetType(), gs.Equals, DEAD_LETTER_TYPE)
+			c.Expect(msg.GetPayload(), gs.Equals, "GET / HTTP/1.1")
+			c.Expect(letter.MsgLoopCount, gs.Equals, uint(1))
+			fields := map[string]string{
+				"DeadLetterType":   "nginx.access",
+				"DeadLetterStage":  "decode",
+				"DeadLetterPlugin": "TestInput",
+				"DeadLetterError":  "failed",
+			}
+			for name, expected := range fields {
+				value, ok := msg.GetFieldValue(name)
+				c.Expect(ok, gs.IsTrue)
+				c.Expect(value, gs.Equals, expected)
+			}
+			raw, _ := msg.GetFieldValue("DeadLetterRaw")
+			c.Expect(string(raw.([]byte)), gs.Equals, "raw")
+			c.Expect(pc.deadLetterCount, gs.Equals, int64(1))
+			// The caller still owns the original pack.
+			c.Expect(pack.Message.GetType(), gs.Equals, "nginx.access")
+			c.Expect(len(recycleChan), gs.Equals, 0)
+		})
+
+		c.Specify("truncate long errors", func() {
+			pc.DeadLetter(pack, DeadLetterFilter, "TestFilter",
+				errors.New(strings.Repeat("x", 600)))
+			letter := <-pc.router.InChan()
+			errMsg, _ := letter.Message.GetFieldValue("DeadLetterError")
+			c.Expect(len(errMsg.(string)), gs.Equals, 500)
+		})
+
+		c.Specify("aren't sent for dead letters", func() {
+			pack.Message.SetType(DEAD_LETTER_TYPE)
+			c.Expect(pc.DeadLetter(pack, DeadLetterOutput, "TestOutput", failure),
+				gs.IsFalse)
+			c.Expect(len(pc.injectRecycleChan), gs.Equals, 1)
+		})
+
+		c.Specify("aren't sent past the message loop limit", func() {
+			pack.MsgLoopCount = pc.Globals.MaxMsgLoops
+			c.Expect(pc.DeadLetter(pack, DeadLetterOutput, "TestOutput", failure),
+				gs.IsFalse)
+		})
+	})
+}
@@ -0,0 +1,164 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// Point in the pipeline at which a message counts as delivered for the
+// purposes of a DeliveryReport.
+type DeliveryPoint int
+
+const (
+	// The message has been accepted by the router.
+	DeliveryRouter DeliveryPoint = iota + 1
+	// Every output whose message matcher matched the message has finished
+	// with it, i.e. written it to its queue buffer or sent it on, without
+	// reporting a delivery failure.
+	DeliveryOutput
+)
+
+var (
+	ErrDroppedBeforeRouter = errors.New("message dropped before reaching the router")
+	ErrNoMatchingOutput    = errors.New("no output matched the message")
+)
+
+// Parses a delivery point config value, "router" or "output".
+func ParseDeliveryPoint(s string) (DeliveryPoint, error) {
+	switch s {
+	case "router":
+		return DeliveryRouter, nil
+	case "output":
+		return DeliveryOutput, nil
+	}
+	return 0, fmt.Errorf("invalid delivery point: %s", s)
+}
+
+// Outcome of the delivery of a message, as requested with
+// PipelinePack.TrackDelivery. A decoder may turn a message into several, in
+// which case the report covers all of them.
+type DeliveryReport struct {
+	// Nil if every message reached the delivery point, or was deliberately
+	// dropped by a decoder or processor along the way. Otherwise the first
+	// failure encountered.
+	Err error
+}
+
+// Tracks the outstanding messages of a single tracked delivery. Each pack
+// carrying the tracker holds one unit of `pending`, which is released when
+// the pack reaches the delivery point or is dropped.
+type deliveryTracker struct {
+	point   DeliveryPoint
+	pending int32
+	errLock sync.Mutex
+	err     error
+	report  chan DeliveryReport
+}
+
+// Records a failure, only the first one is reported.
+func (d *deliveryTracker) fail(err error) {
+	d.errLock.Lock()
+	if d.err == nil {
+		d.err = err
+	}
+	d.errLock.Unlock()
+}
+
+// Releases one unit, sending the report once none are outstanding.
+func (d *deliveryTracker) done(err error) {
+	if d == nil {
+		return
+	}
+	if err != nil {
+		d.fail(err)
+	}
+	if atomic.AddInt32(&d.pending, -1) == 0 {
+		d.errLock.Lock()
+		err = d.err
+		d.errLock.Unlock()
+		d.report <- DeliveryReport{Err: err}
+	}
+}
+
+// Adds a unit to the tracker for each of the packs that isn't already
+// tracked, and attaches the tracker to them.
+func (d *deliveryTracker) attach(packs ...*PipelinePack) {
+	if d == nil {
+		return
+	}
+	for _, pack := range packs {
+		if pack.delivery == nil {
+			atomic.AddInt32(&d.pending, 1)
+			pack.delivery = d
+		}
+	}
+}
+
+// Starts tracking the delivery of the pack's message to the specified point.
+// Exactly one DeliveryReport will be sent on the returned channel, which is
+// buffered so the caller may stop waiting for it at any time. Must be called
+// before the pack is handed to the InputRunner's Deliver or Inject method.
+func (p *PipelinePack) TrackDelivery(point DeliveryPoint) <-chan DeliveryReport {
+	d := &deliveryTracker{
+		point:  point,
+		report: make(chan DeliveryReport, 1),
+	}
+	d.attach(p)
+	return d.report
+}
+
+// Detaches the pack's delivery tracker, if any, so the caller holds its unit
+// and must release it with `done`.
+func (p *PipelinePack) takeDelivery() *deliveryTracker {
+	d := p.delivery
+	p.delivery = nil
+	return d
+}
+
+// Releases the pack's unit of its delivery tracker, if any.
+func (p *PipelinePack) resolveDelivery(err error) {
+	p.takeDelivery().done(err)
+}
+
+// Called by the router for each pack it accepts, before the pack is shared
+// with the matchers.
+func (p *PipelinePack) routeDelivery() {
+	if p.delivery == nil {
+		return
+	}
+	if p.delivery.point == DeliveryRouter {
+		p.resolveDelivery(nil)
+		return
+	}
+	p.deliveryRouted = true
+}
+
+// Called when the pack is zeroed, releasing any unit still held with the
+// outcome implied by how far the pack got.
+func (p *PipelinePack) finishDelivery() {
+	var err error
+	switch {
+	case p.delivery == nil:
+		return
+	case !p.deliveryRouted:
+		err = ErrDroppedBeforeRouter
+	case p.deliveryOutputs == 0:
+		err = ErrNoMatchingOutput
+	}
+	p.resolveDelivery(err)
+	p.deliveryRouted = false
+	p.deliveryOutputs = 0
+}
@@ -0,0 +1,104 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"errors"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+)
+
+func DeliveryReportSpec(c gs.Context) {
+	recycleChan := make(chan *PipelinePack, 2)
+	pack := NewPipelinePack(recycleChan)
+
+	// Returns the report if one has been sent.
+	report := func(reports <-chan DeliveryReport) (DeliveryReport, bool) {
+		select {
+		case r := <-reports:
+			return r, true
+		default:
+			return DeliveryReport{}, false
+		}
+	}
+
+	c.Specify("A delivery report", func() {
+		c.Specify("to the router", func() {
+			reports := pack.TrackDelivery(DeliveryRouter)
+
+			c.Specify("is sent when the router accepts the message", func() {
+				pack.routeDelivery()
+				r, ok := report(reports)
+				c.Expect(ok, gs.IsTrue)
+				c.Expect(r.Err, gs.IsNil)
+				// Recycling the pack later doesn't change anything.
+				pack.Recycle()
+				_, ok = report(reports)
+				c.Expect(ok, gs.IsFalse)
+			})
+
+			c.Specify("fails if the message is dropped", func() {
+				pack.Recycle()
+				r, ok := report(reports)
+				c.Expect(ok, gs.IsTrue)
+				c.Expect(r.Err, gs.Equals, ErrDroppedBeforeRouter)
+			})
+
+			c.Specify("covers every message a decoder generates", func() {
+				extra := NewPipelinePack(recycleChan)
+				delivery := pack.takeDelivery()
+				delivery.attach(pack, extra)
+				delivery.done(nil)
+				pack.routeDelivery()
+				_, ok := report(reports)
+				c.Expect(ok, gs.IsFalse)
+				extra.routeDelivery()
+				_, ok = report(reports)
+				c.Expect(ok, gs.IsTrue)
+			})
+		})
+
+		c.Specify("to the outputs", func() {
+			reports := pack.TrackDelivery(DeliveryOutput)
+			pack.routeDelivery()
+			_, ok := report(reports)
+			c.Expect(ok, gs.IsFalse)
+
+			c.Specify("is sent once the outputs are done with the message", func() {
+				pack.deliveryOutputs = 2
+				pack.Recycle()
+				r, ok := report(reports)
+				c.Expect(ok, gs.IsTrue)
+				c.Expect(r.Err, gs.IsNil)
+			})
+
+			c.Specify("fails if an output fails", func() {
+				pack.deliveryOutputs = 1
+				err := errors.New("boom")
+				pack.delivery.fail(err)
+				pack.Recycle()
+				r, _ := report(reports)
+				c.Expect(r.Err, gs.Equals, err)
+			})
+
+			c.Specify("fails if no output matches", func() {
+				pack.Recycle()
+				r, _ := report(reports)
+				c.Expect(r.Err, gs.Equals, ErrNoMatchingOutput)
+			})
+		})
+
+		c.Specify("rejects unknown delivery points", func() {
+			_, err := ParseDeliveryPoint("disk")
+			c.Expect(err.Error(), gs.Equals, "invalid delivery point: disk")
+		})
+	})
+}
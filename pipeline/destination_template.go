@@ -0,0 +1,219 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Settings for a DestinationTemplate.
+type DestinationTemplateConfig struct {
+	// Template from which the destination is rendered. `%{Name}` references
+	// are replaced with the message header of that name (Type, Logger,
+	// Hostname, Payload, Pid, UUID, EnvVersion, Severity), with the value of
+	// the message field of that name, or, if there is no such field, with the
+	// current time rendered using Name as a Go time format.
+	Template string
+	// Maximum number of distinct header and field value combinations that
+	// will be used to build destinations. Messages that would create a new
+	// destination after the limit is reached are sent to the fallback
+	// destination instead. Zero means unlimited.
+	MaxCardinality uint
+	// Destination used for messages that would exceed the cardinality limit
+	// or that are missing a referenced value. If empty, Destination returns
+	// an error for those messages.
+	Fallback string
+	// Use the message timestamp instead of the current time when rendering
+	// time formats.
+	UseMessageTimestamp bool
+	// Optional function that is applied to every interpolated header and
+	// field value, e.g. to strip path separators.
+	Sanitize func(string) string
+}
+
+// A literal chunk of a destination template, followed by an optional
+// reference to a message value.
+type destinationPart struct {
+	literal string
+	name    string
+}
+
+// DestinationTemplate resolves the destination for a message (e.g. an index,
+// topic, or file path) from the message's headers and fields. Since field
+// values aren't under the control of the operator, the number of distinct
+// destinations can be capped, after which messages go to a fallback
+// destination rather than creating ever more indexes, topics, or files. Safe
+// for concurrent use.
+type DestinationTemplate struct {
+	config    DestinationTemplateConfig
+	parts     []destinationPart
+	seen      map[string]struct{}
+	lock      sync.Mutex
+	overflows int64
+	missing   int64
+}
+
+// Parses the provided template and returns a DestinationTemplate, or an
+// error if the template is malformed.
+func NewDestinationTemplate(config DestinationTemplateConfig) (*DestinationTemplate, error) {
+	dt := &DestinationTemplate{
+		config: config,
+		seen:   make(map[string]struct{}),
+	}
+	tmpl := config.Template
+	for len(tmpl) > 0 {
+		start := strings.Index(tmpl, "%{")
+		if start == -1 {
+			dt.parts = append(dt.parts, destinationPart{literal: tmpl})
+			break
+		}
+		end := strings.Index(tmpl[start:], "}")
+		if end == -1 {
+			return nil, fmt.Errorf("unterminated reference in destination template: %s",
+				config.Template)
+		}
+		end += start
+		name := tmpl[start+2 : end]
+		if name == "" {
+			return nil, fmt.Errorf("empty reference in destination template: %s",
+				config.Template)
+		}
+		dt.parts = append(dt.parts, destinationPart{literal: tmpl[:start], name: name})
+		tmpl = tmpl[end+1:]
+	}
+	return dt, nil
+}
+
+// Returns true if the template references any message values or time
+// formats, i.e. if it can render more than one destination.
+func (dt *DestinationTemplate) IsDynamic() bool {
+	for _, part := range dt.parts {
+		if part.name != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// Looks up a header or field value by name.
+func destinationValue(m *message.Message, name string) (string, bool) {
+	switch name {
+	case "Type":
+		return m.GetType(), true
+	case "Logger":
+		return m.GetLogger(), true
+	case "Hostname":
+		return m.GetHostname(), true
+	case "Payload":
+		return m.GetPayload(), true
+	case "Pid":
+		return strconv.Itoa(int(m.GetPid())), true
+	case "UUID":
+		return m.GetUuidString(), true
+	case "EnvVersion":
+		return m.GetEnvVersion(), true
+	case "Severity":
+		return strconv.Itoa(int(m.GetSeverity())), true
+	}
+	val, ok := m.GetFieldValue(name)
+	if !ok {
+		return "", false
+	}
+	switch v := val.(type) {
+	case string:
+		return v, true
+	case []byte:
+		return string(v), true
+	}
+	return fmt.Sprint(val), true
+}
+
+// Returns the destination for the provided message. Returns the fallback
+// destination if the message is missing a referenced value or if rendering
+// the message would exceed the cardinality limit. An error is returned only
+// if the fallback would be used but none is configured.
+func (dt *DestinationTemplate) Destination(m *message.Message) (string, error) {
+	var (
+		dest bytes.Buffer
+		key  bytes.Buffer
+		t    time.Time
+	)
+	for _, part := range dt.parts {
+		dest.WriteString(part.literal)
+		if part.name == "" {
+			continue
+		}
+		if val, ok := destinationValue(m, part.name); ok {
+			if dt.config.Sanitize != nil {
+				val = dt.config.Sanitize(val)
+			}
+			dest.WriteString(val)
+			// Only the message values count towards the cardinality, time
+			// based rotation shouldn't eat into the limit.
+			key.WriteString(val)
+			key.WriteByte(0)
+			continue
+		}
+		if t.IsZero() {
+			if dt.config.UseMessageTimestamp && m.Timestamp != nil {
+				t = time.Unix(0, m.GetTimestamp()).UTC()
+			} else {
+				t = time.Now().UTC()
+			}
+		}
+		formatted := t.Format(part.name)
+		if formatted == part.name {
+			// Not a field and not a time format.
+			atomic.AddInt64(&dt.missing, 1)
+			return dt.fallback(fmt.Errorf("message has no value for '%s'", part.name))
+		}
+		dest.WriteString(formatted)
+	}
+
+	if dt.config.MaxCardinality > 0 {
+		k := key.String()
+		dt.lock.Lock()
+		if _, ok := dt.seen[k]; !ok {
+			if uint(len(dt.seen)) >= dt.config.MaxCardinality {
+				dt.lock.Unlock()
+				atomic.AddInt64(&dt.overflows, 1)
+				return dt.fallback(fmt.Errorf("destination cardinality limit (%d) reached",
+					dt.config.MaxCardinality))
+			}
+			dt.seen[k] = struct{}{}
+		}
+		dt.lock.Unlock()
+	}
+	return dest.String(), nil
+}
+
+func (dt *DestinationTemplate) fallback(err error) (string, error) {
+	if dt.config.Fallback == "" {
+		return "", err
+	}
+	return dt.config.Fallback, nil
+}
+
+// Adds the template's fallback counters to the provided report message.
+func (dt *DestinationTemplate) ReportMsg(msg *message.Message, prefix string) {
+	message.NewInt64Field(msg, prefix+"CardinalityOverflows",
+		atomic.LoadInt64(&dt.overflows), "count")
+	message.NewInt64Field(msg, prefix+"MissingValues",
+		atomic.LoadInt64(&dt.missing), "count")
+}
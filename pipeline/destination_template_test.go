@@ -0,0 +1,115 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"github.com/mozilla-services/heka/message"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"strings"
+	"time"
+)
+
+func DestinationTemplateSpec(c gs.Context) {
+	msg := new(message.Message)
+	msg.SetType("mytype")
+	msg.SetLogger("mylogger")
+	msg.SetTimestamp(time.Date(2014, 10, 20, 8, 0, 0, 0, time.UTC).UnixNano())
+	f, _ := message.NewField("service", "web", "")
+	msg.AddField(f)
+
+	c.Specify("A DestinationTemplate", func() {
+		c.Specify("rejects malformed templates", func() {
+			_, err := NewDestinationTemplate(DestinationTemplateConfig{Template: "heka-%{Type"})
+			c.Expect(err, gs.Not(gs.IsNil))
+			_, err = NewDestinationTemplate(DestinationTemplateConfig{Template: "heka-%{}"})
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+
+		c.Specify("renders static templates", func() {
+			dt, err := NewDestinationTemplate(DestinationTemplateConfig{Template: "heka"})
+			c.Assume(err, gs.IsNil)
+			c.Expect(dt.IsDynamic(), gs.IsFalse)
+			dest, err := dt.Destination(msg)
+			c.Expect(err, gs.IsNil)
+			c.Expect(dest, gs.Equals, "heka")
+		})
+
+		c.Specify("renders headers, fields, and time formats", func() {
+			dt, err := NewDestinationTemplate(DestinationTemplateConfig{
+				Template:            "%{Type}-%{service}-%{2006.01.02}",
+				UseMessageTimestamp: true,
+			})
+			c.Assume(err, gs.IsNil)
+			c.Expect(dt.IsDynamic(), gs.IsTrue)
+			dest, err := dt.Destination(msg)
+			c.Expect(err, gs.IsNil)
+			c.Expect(dest, gs.Equals, "mytype-web-2014.10.20")
+		})
+
+		c.Specify("sanitizes interpolated values", func() {
+			dt, err := NewDestinationTemplate(DestinationTemplateConfig{
+				Template: "/var/log/%{Logger}.log",
+				Sanitize: func(s string) string {
+					return strings.Replace(s, "logger", "", -1)
+				},
+			})
+			c.Assume(err, gs.IsNil)
+			dest, _ := dt.Destination(msg)
+			c.Expect(dest, gs.Equals, "/var/log/my.log")
+		})
+
+		c.Specify("handles missing values", func() {
+			config := DestinationTemplateConfig{Template: "heka-%{missing}"}
+			dt, err := NewDestinationTemplate(config)
+			c.Assume(err, gs.IsNil)
+			_, err = dt.Destination(msg)
+			c.Expect(err, gs.Not(gs.IsNil))
+
+			config.Fallback = "heka-unknown"
+			dt, err = NewDestinationTemplate(config)
+			c.Assume(err, gs.IsNil)
+			dest, err := dt.Destination(msg)
+			c.Expect(err, gs.IsNil)
+			c.Expect(dest, gs.Equals, "heka-unknown")
+			c.Expect(dt.missing, gs.Equals, int64(1))
+		})
+
+		c.Specify("enforces the cardinality limit", func() {
+			dt, err := NewDestinationTemplate(DestinationTemplateConfig{
+				Template:            "%{service}-%{2006.01.02}",
+				MaxCardinality:      1,
+				Fallback:            "overflow",
+				UseMessageTimestamp: true,
+			})
+			c.Assume(err, gs.IsNil)
+			dest, _ := dt.Destination(msg)
+			c.Expect(dest, gs.Equals, "web-2014.10.20")
+
+			// Time based rotation doesn't count towards the limit.
+			msg.SetTimestamp(time.Date(2014, 10, 21, 8, 0, 0, 0, time.UTC).UnixNano())
+			dest, _ = dt.Destination(msg)
+			c.Expect(dest, gs.Equals, "web-2014.10.21")
+
+			other := message.CopyMessage(msg)
+			other.Fields = nil
+			f, _ := message.NewField("service", "db", "")
+			other.AddField(f)
+			dest, _ = dt.Destination(other)
+			c.Expect(dest, gs.Equals, "overflow")
+			c.Expect(dt.overflows, gs.Equals, int64(1))
+
+			// Previously seen values are still accepted.
+			dest, _ = dt.Destination(msg)
+			c.Expect(dest, gs.Equals, "web-2014.10.21")
+		})
+	})
+}
@@ -0,0 +1,622 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"bufio"
+	"code.google.com/p/gogoprotobuf/proto"
+	"fmt"
+	"github.com/mozilla-services/heka/client"
+	"github.com/mozilla-services/heka/message"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// Configures the on-disk queue used by filters and outputs with `buffering`
+// set to "disk".
+type DiskBufferConfig struct {
+	// Size in bytes at which a queue file is closed and a new one started.
+	// Defaults to 128MiB.
+	MaxFileSize uint64 `toml:"max_file_size"`
+	// Maximum total size in bytes of the queue files, 0 (the default) means
+	// no limit.
+	MaxBufferSize uint64 `toml:"max_buffer_size"`
+	// What to do with new messages when the queue is full: "block" (the
+	// default) waits for space, "drop" discards them, and "shutdown" shuts
+	// hekad down.
+	FullAction string `toml:"full_action"`
+	// Order in which a backlog is delivered: "oldest_first" (the default),
+	// "newest_first", or "priority".
+	DrainOrder string `toml:"drain_order"`
+	// With "priority" draining, messages matching this are delivered ahead
+	// of the others.
+	PriorityMatcher string `toml:"priority_matcher"`
+}
+
+func getDefaultDiskBufferConfig() DiskBufferConfig {
+	return DiskBufferConfig{
+		MaxFileSize: 128 * 1024 * 1024,
+		FullAction:  "block",
+		DrainOrder:  "oldest_first",
+	}
+}
+
+// Checks the `buffering` settings of a filter or output.
+func validateBuffering(buffering string, config DiskBufferConfig) error {
+	switch buffering {
+	case "", "memory":
+		return nil
+	case "disk":
+	default:
+		return fmt.Errorf("invalid buffering: %s", buffering)
+	}
+	switch config.FullAction {
+	case "block", "drop", "shutdown":
+	default:
+		return fmt.Errorf("invalid buffer full_action: %s", config.FullAction)
+	}
+	if config.MaxFileSize == 0 {
+		return fmt.Errorf("buffer max_file_size must be greater than 0")
+	}
+	switch config.DrainOrder {
+	case "", "oldest_first", "newest_first":
+	case "priority":
+		if config.PriorityMatcher == "" {
+			return fmt.Errorf("buffer priority_matcher is required for priority draining")
+		}
+		if _, err := message.CreateMatcherSpecification(config.PriorityMatcher); err != nil {
+			return fmt.Errorf("invalid buffer priority_matcher: %s", err)
+		}
+	default:
+		return fmt.Errorf("invalid buffer drain_order: %s", config.DrainOrder)
+	}
+	return nil
+}
+
+// A message read from the queue that the plugin hasn't finished with yet.
+type bufferedRecord struct {
+	file *bufferFile
+	// Position of the record in its file.
+	start int64
+	done  bool
+}
+
+// Read state of a queue file.
+type bufferFile struct {
+	id     uint
+	lane   *bufferLane
+	file   *os.File // Opened when first read.
+	parser *MessageProtoParser
+	// Read position.
+	offset int64
+	// The writer has moved on to a newer file, so the file is complete once
+	// the reader reaches its end.
+	final    bool
+	complete bool
+	// Records read and not yet finished, in file order.
+	records []*bufferedRecord
+}
+
+// Returns the position before which every record of the file is finished.
+func (f *bufferFile) finishedOffset() int64 {
+	if len(f.records) > 0 {
+		return f.records[0].start
+	}
+	return f.offset
+}
+
+// A series of queue files in a directory. The buffer has a single lane, plus
+// a second one for the priority messages with "priority" draining.
+type bufferLane struct {
+	dir string
+	// Whether files are read newest first rather than oldest first.
+	newestFirst bool
+	// Writer state.
+	writeFile *os.File
+	writeId   uint
+	writeSize uint64
+	// Reader state. Files with unread or unfinished records, in id order.
+	files              []*bufferFile
+	lastId             uint
+	checkpointFilename string
+	checkpointFile     *os.File
+}
+
+// Durable queue sitting between a filter or output's message matcher and the
+// plugin. Matching messages are appended to protobuf framed queue files in
+// the `buffers/<name>` directory of the base_dir, and read back into a
+// private pack pool that feeds the plugin. The finished position of each
+// file is checkpointed as the plugin recycles the messages read from it, so
+// messages the plugin hasn't finished with when hekad stops or crashes are
+// delivered again when it restarts.
+//
+// A backlog is normally delivered oldest first. With "newest_first" draining
+// the newest file is read first, so new messages are delivered as they
+// arrive, and the backlog is worked through, newest file first, whenever the
+// plugin has caught up. With "priority" draining the messages matching the
+// priority matcher are queued separately, in `buffers/<name>/priority`, and
+// delivered ahead of the others.
+type diskBuffer struct {
+	name     string
+	config   DiskBufferConfig
+	dir      string
+	globals  *GlobalConfigStruct
+	logError func(error)
+	// Matching messages from the router.
+	inChan chan *PipelinePack
+	// Delivers the messages read from the queue to the plugin.
+	replay      *MatchRunner
+	recycleChan chan *PipelinePack
+	poolSize    int
+	// In reading preference order, i.e. the priority lane first.
+	lanes    []*bufferLane
+	priority *message.MatcherSpecification
+	// Writer state.
+	outBytes  []byte
+	written   chan struct{}
+	writeDone chan struct{}
+	// Records the plugin hasn't finished with, by pack.
+	inFlight  map[*PipelinePack]*bufferedRecord
+	readOrder []*bufferFile
+	// How long to wait for the plugin to finish with its messages when
+	// stopping.
+	drainTimeout time.Duration
+	readDone     chan struct{}
+	// Total size of the queue files, and messages dropped because the queue
+	// was full or couldn't be written.
+	queueSize uint64
+	dropCount int64
+}
+
+func newDiskBuffer(name string, config DiskBufferConfig, chanSize int,
+	runner PluginRunner, globals *GlobalConfigStruct, logError func(error)) (
+	*diskBuffer, error) {
+
+	b := &diskBuffer{
+		name:         name,
+		config:       config,
+		dir:          globals.PrependBaseDir(filepath.Join("buffers", name)),
+		globals:      globals,
+		logError:     logError,
+		inChan:       make(chan *PipelinePack, chanSize),
+		recycleChan:  make(chan *PipelinePack, chanSize+1),
+		poolSize:     chanSize + 1,
+		written:      make(chan struct{}, 1),
+		writeDone:    make(chan struct{}),
+		inFlight:     make(map[*PipelinePack]*bufferedRecord),
+		drainTimeout: 5 * time.Second,
+		readDone:     make(chan struct{}),
+	}
+	var err error
+	if b.replay, err = NewMatchRunner("TRUE", "", runner, chanSize); err != nil {
+		return nil, err
+	}
+	if config.DrainOrder == "priority" {
+		if b.priority, err = message.CreateMatcherSpecification(
+			config.PriorityMatcher); err != nil {
+			return nil, err
+		}
+		lane, err := b.openLane(filepath.Join(b.dir, "priority"), false)
+		if err != nil {
+			return nil, err
+		}
+		b.lanes = append(b.lanes, lane)
+	}
+	lane, err := b.openLane(b.dir, config.DrainOrder == "newest_first")
+	if err != nil {
+		return nil, err
+	}
+	b.lanes = append(b.lanes, lane)
+	return b, nil
+}
+
+// Sets up a lane, picking up any files and checkpoint left by a previous run.
+func (b *diskBuffer) openLane(dir string, newestFirst bool) (*bufferLane, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("can't create buffer directory: %s", err)
+	}
+	lane := &bufferLane{
+		dir:                dir,
+		newestFirst:        newestFirst,
+		checkpointFilename: filepath.Join(dir, "checkpoint.txt"),
+	}
+	atomic.AddUint64(&b.queueSize, getQueueBufferSize(dir))
+
+	offsets := make(map[uint]int64)
+	if fileExists(lane.checkpointFilename) {
+		var err error
+		if offsets, err = readBufferCheckpoint(lane.checkpointFilename); err != nil {
+			return nil, fmt.Errorf("can't read buffer checkpoint: %s", err)
+		}
+	}
+	filenames, _ := filepath.Glob(filepath.Join(dir, "*.log"))
+	for _, filename := range filenames {
+		id, err := extractBufferId(filename)
+		if err != nil {
+			continue
+		}
+		lane.files = append(lane.files, &bufferFile{id: id, lane: lane,
+			offset: offsets[id]})
+	}
+	sort.Sort(bufferFilesById(lane.files))
+
+	// Always start writing to a new file, so a record torn by a crash is
+	// left at the end of a file where the reader will skip it.
+	lane.writeId = findBufferId(dir, true) + 1
+	if err := lane.openWriteFile(); err != nil {
+		return nil, err
+	}
+	lane.lastId = lane.writeId
+	lane.files = append(lane.files, &bufferFile{id: lane.writeId, lane: lane})
+	return lane, nil
+}
+
+type bufferFilesById []*bufferFile
+
+func (s bufferFilesById) Len() int           { return len(s) }
+func (s bufferFilesById) Less(i, j int) bool { return s[i].id < s[j].id }
+func (s bufferFilesById) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// Reads a checkpoint file, one "<file id> <offset>" line per partially
+// finished file.
+func readBufferCheckpoint(filename string) (offsets map[uint]int64, err error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	offsets = make(map[uint]int64)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var (
+			id     uint
+			offset int64
+		)
+		if _, err = fmt.Sscanf(scanner.Text(), "%d %d", &id, &offset); err != nil {
+			return nil, err
+		}
+		offsets[id] = offset
+	}
+	return offsets, scanner.Err()
+}
+
+// Starts the goroutines that write to and read from the queue. Reading stops
+// once the input channel has been closed and everything received has been
+// written, at which point the replay matcher's input channel is closed. Any
+// unread messages are left on disk.
+func (b *diskBuffer) start() {
+	go b.writeLoop()
+	go b.readLoop()
+}
+
+func (lane *bufferLane) openWriteFile() (err error) {
+	if lane.writeFile != nil {
+		lane.writeFile.Close()
+	}
+	lane.writeFile, err = os.OpenFile(getQueueFilename(lane.dir, lane.writeId),
+		os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	lane.writeSize = 0
+	return
+}
+
+// Moves the writer on to a new file.
+func (lane *bufferLane) rollWriteFile() error {
+	lane.writeId++
+	return lane.openWriteFile()
+}
+
+func (b *diskBuffer) writeLoop() {
+	for pack := range b.inChan {
+		if err := b.write(pack); err != nil {
+			atomic.AddInt64(&b.dropCount, 1)
+			b.logError(fmt.Errorf("buffer dropped message: %s", err))
+		}
+		pack.Recycle()
+	}
+	for _, lane := range b.lanes {
+		lane.writeFile.Close()
+	}
+	close(b.writeDone)
+}
+
+// Returns the lane a message is written to.
+func (b *diskBuffer) laneFor(msg *message.Message) *bufferLane {
+	if b.priority != nil && b.priority.Match(msg) {
+		return b.lanes[0]
+	}
+	return b.lanes[len(b.lanes)-1]
+}
+
+func (b *diskBuffer) write(pack *PipelinePack) error {
+	msgBytes, err := proto.Marshal(pack.Message)
+	if err != nil {
+		return err
+	}
+	if err = client.CreateHekaStream(msgBytes, &b.outBytes, nil); err != nil {
+		return err
+	}
+	size := uint64(len(b.outBytes))
+	if b.config.MaxBufferSize > 0 && size > b.config.MaxBufferSize {
+		return QueueIsFull
+	}
+	for b.config.MaxBufferSize > 0 &&
+		atomic.LoadUint64(&b.queueSize)+size > b.config.MaxBufferSize {
+
+		switch b.config.FullAction {
+		case "drop":
+			return QueueIsFull
+		case "shutdown":
+			b.logError(fmt.Errorf("buffer is full, shutting down"))
+			b.globals.ShutDown()
+			return QueueIsFull
+		}
+		if b.globals.IsShuttingDown() {
+			return QueueIsFull
+		}
+		// Space is only reclaimed a file at a time, so move on from the
+		// current files to let them be removed once they have been read.
+		rolled := false
+		for _, lane := range b.lanes {
+			if lane.writeSize > 0 {
+				if err = lane.rollWriteFile(); err != nil {
+					return err
+				}
+				rolled = true
+			}
+		}
+		if rolled {
+			b.notifyReader()
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	lane := b.laneFor(pack.Message)
+	if lane.writeSize > 0 && lane.writeSize+size > b.config.MaxFileSize {
+		if err = lane.rollWriteFile(); err != nil {
+			return err
+		}
+	}
+	n, err := lane.writeFile.Write(b.outBytes)
+	lane.writeSize += uint64(n)
+	atomic.AddUint64(&b.queueSize, uint64(n))
+	if err != nil {
+		return err
+	}
+	b.notifyReader()
+	return nil
+}
+
+// Wakes the reader if it's waiting for more data.
+func (b *diskBuffer) notifyReader() {
+	select {
+	case b.written <- struct{}{}:
+	default:
+	}
+}
+
+func (b *diskBuffer) readLoop() {
+	var (
+		free      = make([]*PipelinePack, 0, b.poolSize)
+		writeDone = b.writeDone
+	)
+	for i := 0; i < b.poolSize; i++ {
+		free = append(free, NewPipelinePack(b.recycleChan))
+	}
+
+	for writeDone != nil {
+		if len(free) == 0 {
+			select {
+			case pack := <-b.recycleChan:
+				free = append(free, b.ack(pack))
+			case <-writeDone:
+				writeDone = nil
+			}
+			continue
+		}
+
+		pack := free[len(free)-1]
+		ok, err := b.readNext(pack)
+		if err != nil {
+			b.logError(fmt.Errorf("reading buffer: %s", err))
+			time.Sleep(time.Second)
+			continue
+		}
+		if ok {
+			free = free[:len(free)-1]
+			b.replay.inChan <- pack
+			continue
+		}
+		select {
+		case <-b.written:
+		case pack := <-b.recycleChan:
+			free = append(free, b.ack(pack))
+		case <-writeDone:
+			writeDone = nil
+		}
+	}
+
+	close(b.replay.inChan)
+	// Give the plugin a chance to finish with the messages it has, so they
+	// aren't delivered again on the next run.
+	timeout := time.After(b.drainTimeout)
+	for waiting := true; waiting && len(b.inFlight) > 0; {
+		select {
+		case pack := <-b.recycleChan:
+			b.ack(pack)
+		default:
+			select {
+			case pack := <-b.recycleChan:
+				b.ack(pack)
+			case <-timeout:
+				waiting = false
+			}
+		}
+	}
+	for _, lane := range b.lanes {
+		for _, f := range lane.files {
+			if f.file != nil {
+				f.file.Close()
+			}
+		}
+		if lane.checkpointFile != nil {
+			lane.checkpointFile.Close()
+		}
+	}
+	close(b.readDone)
+}
+
+// Reads the next record to deliver into the pack, trying the lanes in order
+// of preference, returning false if there's nothing to read.
+func (b *diskBuffer) readNext(pack *PipelinePack) (bool, error) {
+	for _, lane := range b.lanes {
+		// Pick up any files the writer has moved on to.
+		for fileExists(getQueueFilename(lane.dir, lane.lastId+1)) {
+			lane.lastId++
+			lane.files = append(lane.files, &bufferFile{id: lane.lastId, lane: lane})
+		}
+		// Reading may complete and remove files, so iterate over a copy.
+		b.readOrder = append(b.readOrder[:0], lane.files...)
+		if lane.newestFirst {
+			sort.Sort(sort.Reverse(bufferFilesById(b.readOrder)))
+		}
+		for _, f := range b.readOrder {
+			ok, err := b.readFile(f, pack)
+			if ok || err != nil {
+				return ok, err
+			}
+		}
+	}
+	return false, nil
+}
+
+// Reads the next record of a file into the pack, returning false if the
+// reader has reached the end of the file.
+func (b *diskBuffer) readFile(f *bufferFile, pack *PipelinePack) (bool, error) {
+	if f.complete {
+		return false, nil
+	}
+	if f.file == nil {
+		file, err := os.Open(getQueueFilename(f.lane.dir, f.id))
+		if err != nil {
+			return false, err
+		}
+		if _, err = file.Seek(f.offset, 0); err != nil {
+			file.Close()
+			return false, err
+		}
+		f.file, f.parser = file, NewMessageProtoParser()
+	}
+	for {
+		start := f.offset
+		n, record, err := f.parser.Parse(f.file)
+		if err == io.EOF {
+			if f.final {
+				f.complete = true
+				f.file.Close()
+				f.file = nil
+				b.finish(f)
+				return false, nil
+			}
+			if f.id < f.lane.lastId {
+				// Read whatever was written before the writer moved on.
+				f.final = true
+				continue
+			}
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+		f.offset += int64(n)
+		if len(record) == 0 {
+			continue
+		}
+		headerLen := int(record[1]) + message.HEADER_FRAMING_SIZE
+		if err = proto.Unmarshal(record[headerLen:], pack.Message); err != nil {
+			b.logError(fmt.Errorf("skipping corrupt buffer record: %s", err))
+			continue
+		}
+		rec := &bufferedRecord{file: f, start: start}
+		f.records = append(f.records, rec)
+		b.inFlight[pack] = rec
+		return true, nil
+	}
+}
+
+// Marks a recycled pack's record as done, checkpointing the file's finished
+// position. Returns the pack.
+func (b *diskBuffer) ack(pack *PipelinePack) *PipelinePack {
+	rec, ok := b.inFlight[pack]
+	if !ok {
+		return pack
+	}
+	delete(b.inFlight, pack)
+	rec.done = true
+	f := rec.file
+	i := 0
+	for i < len(f.records) && f.records[i].done {
+		i++
+	}
+	if i > 0 {
+		f.records = append(f.records[:0], f.records[i:]...)
+		b.finish(f)
+	}
+	return pack
+}
+
+// Checkpoints a file's lane after progress was made on the file, removing
+// the file once it's complete and every record read from it is finished.
+func (b *diskBuffer) finish(f *bufferFile) {
+	lane := f.lane
+	if f.complete && len(f.records) == 0 {
+		filename := getQueueFilename(lane.dir, f.id)
+		if info, err := os.Stat(filename); err == nil {
+			if err = os.Remove(filename); err != nil {
+				b.logError(fmt.Errorf("can't remove buffer file: %s", err))
+			} else {
+				atomic.AddUint64(&b.queueSize, ^uint64(info.Size()-1))
+			}
+		}
+		for i, other := range lane.files {
+			if other == f {
+				lane.files = append(lane.files[:i], lane.files[i+1:]...)
+				break
+			}
+		}
+	}
+	if err := lane.checkpoint(); err != nil {
+		b.logError(fmt.Errorf("can't write buffer checkpoint: %s", err))
+	}
+}
+
+// Records the finished position of each of the lane's partially finished
+// files.
+func (lane *bufferLane) checkpoint() (err error) {
+	if lane.checkpointFile == nil {
+		if lane.checkpointFile, err = os.OpenFile(lane.checkpointFilename,
+			os.O_WRONLY|os.O_CREATE, 0644); err != nil {
+			return
+		}
+	}
+	var data []byte
+	for _, f := range lane.files {
+		if offset := f.finishedOffset(); offset > 0 {
+			data = append(data, fmt.Sprintf("%d %d\n", f.id, offset)...)
+		}
+	}
+	if _, err = lane.checkpointFile.WriteAt(data, 0); err != nil {
+		return
+	}
+	return lane.checkpointFile.Truncate(int64(len(data)))
+}
@@ -0,0 +1,236 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"fmt"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+func DiskBufferSpec(c gs.Context) {
+	tmpDir, tmpErr := ioutil.TempDir("", "diskbuffer-tests")
+	c.Assume(tmpErr, gs.IsNil)
+	defer func() {
+		tmpErr = os.RemoveAll(tmpDir)
+		c.Expect(tmpErr, gs.IsNil)
+	}()
+
+	globals := DefaultGlobals()
+	globals.BaseDir = tmpDir
+	config := getDefaultDiskBufferConfig()
+	var errs []error
+	logError := func(err error) {
+		errs = append(errs, err)
+	}
+	supply := make(chan *PipelinePack, 10)
+
+	newBuffer := func() *diskBuffer {
+		b, err := newDiskBuffer("out", config, 5, nil, globals, logError)
+		c.Assume(err, gs.IsNil)
+		b.drainTimeout = 0
+		b.start()
+		return b
+	}
+
+	send := func(b *diskBuffer, payloads ...string) {
+		for _, payload := range payloads {
+			pack := NewPipelinePack(supply)
+			pack.Message.SetPayload(payload)
+			b.inChan <- pack
+		}
+	}
+
+	sendTyped := func(b *diskBuffer, typ string, payloads ...string) {
+		for _, payload := range payloads {
+			pack := NewPipelinePack(supply)
+			pack.Message.SetType(typ)
+			pack.Message.SetPayload(payload)
+			b.inChan <- pack
+		}
+	}
+
+	receive := func(b *diskBuffer) *PipelinePack {
+		select {
+		case pack := <-b.replay.inChan:
+			return pack
+		case <-time.After(5 * time.Second):
+			return nil
+		}
+	}
+
+	stop := func(b *diskBuffer) {
+		close(b.inChan)
+		<-b.readDone
+	}
+
+	c.Specify("A disk buffer", func() {
+		c.Specify("delivers messages in order", func() {
+			b := newBuffer()
+			send(b, "one", "two", "three")
+			for _, payload := range []string{"one", "two", "three"} {
+				pack := receive(b)
+				c.Assume(pack, gs.Not(gs.IsNil))
+				c.Expect(pack.Message.GetPayload(), gs.Equals, payload)
+				pack.Recycle()
+			}
+			stop(b)
+			c.Expect(len(errs), gs.Equals, 0)
+		})
+
+		c.Specify("replays unfinished messages after a restart", func() {
+			b := newBuffer()
+			send(b, "one", "two", "three")
+			pack := receive(b)
+			c.Assume(pack, gs.Not(gs.IsNil))
+			pack.Recycle()
+			c.Assume(receive(b), gs.Not(gs.IsNil))
+			stop(b)
+
+			b = newBuffer()
+			for _, payload := range []string{"two", "three"} {
+				pack = receive(b)
+				c.Assume(pack, gs.Not(gs.IsNil))
+				c.Expect(pack.Message.GetPayload(), gs.Equals, payload)
+				pack.Recycle()
+			}
+			stop(b)
+		})
+
+		c.Specify("moves on to new files and removes finished ones", func() {
+			config.MaxFileSize = 1
+			b := newBuffer()
+			payloads := make([]string, 4)
+			for i := range payloads {
+				payloads[i] = fmt.Sprintf("message %d", i)
+			}
+			send(b, payloads...)
+			for _, payload := range payloads {
+				pack := receive(b)
+				c.Assume(pack, gs.Not(gs.IsNil))
+				c.Expect(pack.Message.GetPayload(), gs.Equals, payload)
+				pack.Recycle()
+			}
+			stop(b)
+			files, _ := filepath.Glob(filepath.Join(tmpDir, "buffers", "out", "*.log"))
+			c.Expect(len(files), gs.Equals, 1)
+		})
+
+		c.Specify("delivers a backlog newest first if asked", func() {
+			config.MaxFileSize = 1
+			config.DrainOrder = "newest_first"
+			b := newBuffer()
+			send(b, "one", "two", "three")
+			stop(b)
+
+			b = newBuffer()
+			for _, payload := range []string{"three", "two", "one"} {
+				pack := receive(b)
+				c.Assume(pack, gs.Not(gs.IsNil))
+				c.Expect(pack.Message.GetPayload(), gs.Equals, payload)
+				pack.Recycle()
+			}
+			// New messages still come first.
+			send(b, "four")
+			pack := receive(b)
+			c.Assume(pack, gs.Not(gs.IsNil))
+			c.Expect(pack.Message.GetPayload(), gs.Equals, "four")
+			pack.Recycle()
+			stop(b)
+			c.Expect(len(errs), gs.Equals, 0)
+		})
+
+		c.Specify("delivers priority messages first if asked", func() {
+			config.DrainOrder = "priority"
+			config.PriorityMatcher = "Type == 'alert'"
+			b := newBuffer()
+			sendTyped(b, "log", "debug one", "debug two")
+			sendTyped(b, "alert", "alert")
+			stop(b)
+			files, _ := filepath.Glob(filepath.Join(tmpDir, "buffers", "out",
+				"priority", "*.log"))
+			c.Expect(len(files), gs.Equals, 1)
+
+			b = newBuffer()
+			for _, payload := range []string{"alert", "debug one", "debug two"} {
+				pack := receive(b)
+				c.Assume(pack, gs.Not(gs.IsNil))
+				c.Expect(pack.Message.GetPayload(), gs.Equals, payload)
+				pack.Recycle()
+			}
+			stop(b)
+			c.Expect(len(errs), gs.Equals, 0)
+		})
+
+		c.Specify("checkpoints each partially finished file", func() {
+			b := newBuffer()
+			send(b, "one", "two")
+			stop(b)
+
+			// Leave "two" and "four" unfinished, in different files.
+			config.DrainOrder = "newest_first"
+			b = newBuffer()
+			var packs []*PipelinePack
+			receiveAll := func(payloads ...string) {
+				for _, payload := range payloads {
+					pack := receive(b)
+					c.Assume(pack, gs.Not(gs.IsNil))
+					c.Expect(pack.Message.GetPayload(), gs.Equals, payload)
+					packs = append(packs, pack)
+				}
+			}
+			receiveAll("one", "two")
+			send(b, "three", "four")
+			receiveAll("three", "four")
+			packs[0].Recycle()
+			packs[2].Recycle()
+			stop(b)
+
+			config.DrainOrder = "oldest_first"
+			b = newBuffer()
+			for _, payload := range []string{"two", "four"} {
+				pack := receive(b)
+				c.Assume(pack, gs.Not(gs.IsNil))
+				c.Expect(pack.Message.GetPayload(), gs.Equals, payload)
+				pack.Recycle()
+			}
+			stop(b)
+		})
+
+		c.Specify("drops messages when full if asked", func() {
+			config.MaxBufferSize = 1
+			config.FullAction = "drop"
+			b := newBuffer()
+			send(b, "one")
+			stop(b)
+			c.Expect(b.dropCount, gs.Equals, int64(1))
+		})
+
+		c.Specify("rejects invalid settings", func() {
+			err := validateBuffering("disk", DiskBufferConfig{FullAction: "spill",
+				MaxFileSize: 1})
+			c.Expect(err.Error(), gs.Equals, "invalid buffer full_action: spill")
+			err = validateBuffering("ram", config)
+			c.Expect(err.Error(), gs.Equals, "invalid buffering: ram")
+			config.DrainOrder = "random"
+			err = validateBuffering("disk", config)
+			c.Expect(err.Error(), gs.Equals, "invalid buffer drain_order: random")
+			config.DrainOrder = "priority"
+			err = validateBuffering("disk", config)
+			c.Expect(err.Error(), gs.Equals,
+				"buffer priority_matcher is required for priority draining")
+		})
+	})
+}
@@ -2,6 +2,7 @@ package pipeline
 
 import (
 	"fmt"
+	"time"
 )
 
 type TerminatedError string
@@ -9,3 +10,81 @@ type TerminatedError string
 func (e TerminatedError) Error() string {
 	return fmt.Sprintf("Terminated. Reason: %v", string(e))
 }
+
+// Classification of an output failure, which determines how the OutputRunner
+// handles it.
+type OutputErrorKind int
+
+const (
+	// Transient failure, e.g. a network error or an unavailable server. The
+	// message is retried using the output's `retries` backoff settings.
+	// Unclassified errors are treated as retryable.
+	ErrKindRetryable OutputErrorKind = iota
+	// The destination has asked for delivery to slow down. Delivery pauses
+	// for the requested period and is then retried, without using up any
+	// retry attempts.
+	ErrKindThrottled
+	// The message itself can't be delivered, e.g. it can't be encoded or the
+	// destination rejected it. Retrying won't help, so the message is dropped
+	// and counted.
+	ErrKindMalformed
+	// Unrecoverable failure, e.g. invalid credentials. The output is stopped
+	// and won't be restarted, even if it implements the Restarting interface.
+	ErrKindFatal
+)
+
+func (kind OutputErrorKind) String() string {
+	switch kind {
+	case ErrKindRetryable:
+		return "retryable"
+	case ErrKindThrottled:
+		return "throttled"
+	case ErrKindMalformed:
+		return "malformed"
+	case ErrKindFatal:
+		return "fatal"
+	}
+	return "unknown"
+}
+
+// Error type outputs can use to tell the OutputRunner what kind of failure
+// occurred, see OutputRunner.HandleFailure.
+type OutputError struct {
+	Kind OutputErrorKind
+	Err  error
+	// How long to pause before retrying, only used for throttled errors.
+	RetryAfter time.Duration
+}
+
+func (e *OutputError) Error() string {
+	return e.Err.Error()
+}
+
+// Wraps an error to mark it as retryable.
+func NewRetryableError(err error) error {
+	return &OutputError{Kind: ErrKindRetryable, Err: err}
+}
+
+// Wraps an error to mark it as throttled, with delivery to be retried after
+// the specified period.
+func NewThrottledError(err error, retryAfter time.Duration) error {
+	return &OutputError{Kind: ErrKindThrottled, Err: err, RetryAfter: retryAfter}
+}
+
+// Wraps an error to mark the message that caused it as undeliverable.
+func NewMalformedMessageError(err error) error {
+	return &OutputError{Kind: ErrKindMalformed, Err: err}
+}
+
+// Wraps an error to mark it as unrecoverable.
+func NewFatalError(err error) error {
+	return &OutputError{Kind: ErrKindFatal, Err: err}
+}
+
+// Returns the classification of the provided error.
+func ClassifyError(err error) OutputErrorKind {
+	if oErr, ok := err.(*OutputError); ok {
+		return oErr.Kind
+	}
+	return ErrKindRetryable
+}
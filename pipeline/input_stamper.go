@@ -0,0 +1,191 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"code.google.com/p/go-uuid/uuid"
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Generates the Uuid values for the messages of inputs that specify an
+// `id_generator`.
+type IdGenerator interface {
+	NewId() []byte
+}
+
+var (
+	idGenerators = map[string]func() IdGenerator{
+		"uuid4": func() IdGenerator { return idGeneratorFunc(uuid.NewRandom) },
+		"uuid1": func() IdGenerator { return idGeneratorFunc(uuid.NewUUID) },
+	}
+	idGeneratorsLock sync.RWMutex
+)
+
+type idGeneratorFunc func() uuid.UUID
+
+func (f idGeneratorFunc) NewId() []byte {
+	return f()
+}
+
+// Registers a factory for an IdGenerator which can then be selected with an
+// input's `id_generator` setting. Each input gets its own IdGenerator.
+// Generated ids should be 16 bytes long.
+func RegisterIdGenerator(name string, factory func() IdGenerator) {
+	idGeneratorsLock.Lock()
+	idGenerators[name] = factory
+	idGeneratorsLock.Unlock()
+}
+
+// Number of sequence numbers reserved by each write to the sequence file, so
+// that numbers are never reused even if hekad isn't shut down cleanly.
+const sequenceBlockSize = 1000
+
+// Stamps the messages of a single input with a generated id, a sequence
+// number, and / or a schema identifier as they enter the router. Only ever
+// used from the router's goroutine, apart from close.
+type inputStamper struct {
+	idGenerator   IdGenerator
+	sequenceField string
+	sequencePath  string
+	next          int64 // Next sequence number to stamp.
+	reserved      int64 // Sequence numbers below this have been persisted.
+	lock          sync.Mutex
+	schema        string
+	signerSchemas map[string]string
+}
+
+// Creates a stamper for the specified input's config, or returns nil if the
+// input doesn't need one. Sequence numbers are persisted in the
+// `input_sequences` directory of the base_dir.
+func newInputStamper(name string, config CommonInputConfig,
+	globals *GlobalConfigStruct) (*inputStamper, error) {
+
+	if config.IdGenerator == "" && config.SequenceField == "" && config.Schema == "" &&
+		len(config.SignerSchemas) == 0 {
+		return nil, nil
+	}
+	stamper := &inputStamper{
+		sequenceField: config.SequenceField,
+		schema:        config.Schema,
+		signerSchemas: config.SignerSchemas,
+	}
+	if config.IdGenerator != "" {
+		idGeneratorsLock.RLock()
+		factory, ok := idGenerators[config.IdGenerator]
+		idGeneratorsLock.RUnlock()
+		if !ok {
+			return nil, fmt.Errorf("unknown id_generator: %s", config.IdGenerator)
+		}
+		stamper.idGenerator = factory()
+	}
+	if config.SequenceField != "" {
+		dir := globals.PrependBaseDir("input_sequences")
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, fmt.Errorf("can't create sequence directory: %s", err)
+		}
+		stamper.sequencePath = filepath.Join(dir, name)
+		contents, err := ioutil.ReadFile(stamper.sequencePath)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("can't read sequence file: %s", err)
+		}
+		if len(contents) > 0 {
+			if stamper.next, err = strconv.ParseInt(strings.TrimSpace(string(contents)),
+				10, 64); err != nil {
+				return nil, fmt.Errorf("invalid sequence file %s: %s",
+					stamper.sequencePath, err)
+			}
+		}
+		stamper.reserved = stamper.next
+	}
+	return stamper, nil
+}
+
+func (s *inputStamper) stamp(msg *message.Message) {
+	if s.idGenerator != nil {
+		msg.SetUuid(s.idGenerator.NewId())
+	}
+	if s.sequenceField == "" {
+		return
+	}
+	s.lock.Lock()
+	if s.next >= s.reserved {
+		// Persist the end of the next block before using any of it.
+		if err := s.save(s.next + sequenceBlockSize); err == nil {
+			s.reserved = s.next + sequenceBlockSize
+		} else {
+			log.Printf("Can't save input sequence to %s: %s", s.sequencePath, err)
+		}
+	}
+	seq := s.next
+	s.next++
+	s.lock.Unlock()
+	message.NewInt64Field(msg, s.sequenceField, seq, "")
+}
+
+// Returns the schema identifier for a message from the specified signer,
+// given the one reported by its producer, if any. The input's
+// `signer_schemas` take precedence over the reported schema, which takes
+// precedence over the input's `schema`.
+func (s *inputStamper) schemaFor(signer, reported string) string {
+	if schema, ok := s.signerSchemas[signer]; ok && signer != "" {
+		return schema
+	}
+	if reported != "" {
+		return reported
+	}
+	return s.schema
+}
+
+// Stamps the pack's message with its schema identifier, if known, in the
+// EnvVersion header, so decoders, encoders, and message matchers can select
+// their behavior per schema version.
+func (p *PipelinePack) stampSchema() {
+	schema := p.Schema
+	if p.stamper != nil {
+		schema = p.stamper.schemaFor(p.Signer, schema)
+	}
+	if schema != "" {
+		p.Message.SetEnvVersion(schema)
+	}
+}
+
+func (s *inputStamper) save(next int64) error {
+	tmpPath := s.sequencePath + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, []byte(strconv.FormatInt(next, 10)),
+		0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, s.sequencePath)
+}
+
+// Persists the exact next sequence number, so the sequence resumes without a
+// gap after a clean shutdown.
+func (s *inputStamper) close() error {
+	if s.sequenceField == "" {
+		return nil
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if err := s.save(s.next); err != nil {
+		return err
+	}
+	s.reserved = s.next
+	return nil
+}
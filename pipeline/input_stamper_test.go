@@ -0,0 +1,133 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"github.com/mozilla-services/heka/message"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+func InputStamperSpec(c gs.Context) {
+	tmpDir, tmpErr := ioutil.TempDir("", "stamper-tests")
+	c.Assume(tmpErr, gs.IsNil)
+	defer func() {
+		tmpErr = os.RemoveAll(tmpDir)
+		c.Expect(tmpErr, gs.IsNil)
+	}()
+
+	globals := DefaultGlobals()
+	globals.BaseDir = tmpDir
+	config := CommonInputConfig{}
+
+	c.Specify("An input stamper", func() {
+		c.Specify("isn't needed by default", func() {
+			stamper, err := newInputStamper("input", config, globals)
+			c.Expect(err, gs.IsNil)
+			c.Expect(stamper, gs.IsNil)
+		})
+
+		c.Specify("rejects unknown id generators", func() {
+			config.IdGenerator = "serial"
+			_, err := newInputStamper("input", config, globals)
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+
+		c.Specify("generates ids", func() {
+			config.IdGenerator = "uuid1"
+			stamper, err := newInputStamper("input", config, globals)
+			c.Assume(err, gs.IsNil)
+			msg := new(message.Message)
+			stamper.stamp(msg)
+			c.Expect(len(msg.GetUuid()), gs.Equals, 16)
+			_, ok := msg.GetFieldValue("seq")
+			c.Expect(ok, gs.IsFalse)
+		})
+
+		c.Specify("stamps persistent sequence numbers", func() {
+			config.SequenceField = "seq"
+			stamper, err := newInputStamper("input", config, globals)
+			c.Assume(err, gs.IsNil)
+			seqPath := filepath.Join(tmpDir, "input_sequences", "input")
+
+			for i := 0; i < 3; i++ {
+				msg := new(message.Message)
+				stamper.stamp(msg)
+				seq, ok := msg.GetFieldValue("seq")
+				c.Expect(ok, gs.IsTrue)
+				c.Expect(seq, gs.Equals, int64(i))
+			}
+			// A block of numbers is reserved up front.
+			contents, err := ioutil.ReadFile(seqPath)
+			c.Expect(err, gs.IsNil)
+			c.Expect(string(contents), gs.Equals, "1000")
+
+			c.Specify("resuming exactly after a clean shutdown", func() {
+				c.Expect(stamper.close(), gs.IsNil)
+				stamper, err = newInputStamper("input", config, globals)
+				c.Assume(err, gs.IsNil)
+				msg := new(message.Message)
+				stamper.stamp(msg)
+				seq, _ := msg.GetFieldValue("seq")
+				c.Expect(seq, gs.Equals, int64(3))
+			})
+
+			c.Specify("without reusing numbers after a crash", func() {
+				stamper, err = newInputStamper("input", config, globals)
+				c.Assume(err, gs.IsNil)
+				msg := new(message.Message)
+				stamper.stamp(msg)
+				seq, _ := msg.GetFieldValue("seq")
+				c.Expect(seq, gs.Equals, int64(1000))
+			})
+		})
+
+		c.Specify("stamps schema identifiers", func() {
+			config.Schema = "v1"
+			config.SignerSchemas = map[string]string{"ops": "v3"}
+			stamper, err := newInputStamper("input", config, globals)
+			c.Assume(err, gs.IsNil)
+			pack := NewPipelinePack(nil)
+			pack.stamper = stamper
+
+			c.Specify("from the input's config by default", func() {
+				pack.stampSchema()
+				c.Expect(pack.Message.GetEnvVersion(), gs.Equals, "v1")
+			})
+
+			c.Specify("preferring the one reported by the producer", func() {
+				pack.Schema = "v2"
+				pack.stampSchema()
+				c.Expect(pack.Message.GetEnvVersion(), gs.Equals, "v2")
+			})
+
+			c.Specify("preferring the signer's above all", func() {
+				pack.Schema = "v2"
+				pack.Signer = "ops"
+				pack.stampSchema()
+				c.Expect(pack.Message.GetEnvVersion(), gs.Equals, "v3")
+			})
+		})
+
+		c.Specify("isn't needed for a reported schema", func() {
+			pack := NewPipelinePack(nil)
+			pack.Message.SetEnvVersion("0.8")
+			pack.stampSchema()
+			c.Expect(pack.Message.GetEnvVersion(), gs.Equals, "0.8")
+			pack.Schema = "v2"
+			pack.stampSchema()
+			c.Expect(pack.Message.GetEnvVersion(), gs.Equals, "v2")
+		})
+	})
+}
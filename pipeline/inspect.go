@@ -0,0 +1,152 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"bytes"
+	"context"
+	"github.com/mozilla-services/heka/message"
+	"runtime/pprof"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Internal state of a plugin, for debugging, see PipelineConfig.InspectPlugin.
+type PluginState struct {
+	Name string `json:"name"`
+	// The plugin's report fields, see PopulateReportMsg, e.g. its channel
+	// lengths or, for sandboxes, their memory and instruction usage.
+	Report map[string]interface{} `json:"report"`
+	// The latest error the plugin logged.
+	LastError     string     `json:"last_error,omitempty"`
+	LastErrorTime *time.Time `json:"last_error_time,omitempty"`
+	// Output only, the latest message whose delivery failed, still being
+	// retried unless another message failed since or the output has moved
+	// on.
+	LastFailure *DeliveryFailure `json:"last_failure,omitempty"`
+	// Number of goroutines running on behalf of the plugin, see
+	// PluginGoroutines.
+	Goroutines int `json:"goroutines"`
+}
+
+// A message an output failed to deliver.
+type DeliveryFailure struct {
+	Message  *message.Message `json:"message"`
+	Error    string           `json:"error"`
+	Attempts int              `json:"attempts"`
+	First    time.Time        `json:"first"`
+	Last     time.Time        `json:"last"`
+}
+
+// Bookkeeping of the errors a runner logs and the deliveries that fail.
+type runnerDebugState struct {
+	lock          sync.Mutex
+	lastError     string
+	lastErrorTime time.Time
+	failedPack    *PipelinePack
+	failure       *DeliveryFailure
+}
+
+func (d *runnerDebugState) errorLogged(err error) {
+	d.lock.Lock()
+	d.lastError = err.Error()
+	d.lastErrorTime = time.Now()
+	d.lock.Unlock()
+}
+
+// Records a failed delivery attempt of a pack.
+func (d *runnerDebugState) deliveryFailed(pack *PipelinePack, err error) {
+	now := time.Now()
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if pack != d.failedPack || d.failure == nil {
+		d.failedPack = pack
+		d.failure = &DeliveryFailure{
+			// Copied, as the pack is recycled once the output is done with it.
+			Message: message.CopyMessage(pack.Message),
+			First:   now,
+		}
+	}
+	d.failure.Error = err.Error()
+	d.failure.Attempts++
+	d.failure.Last = now
+}
+
+func (d *runnerDebugState) populate(state *PluginState) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.lastError != "" {
+		state.LastError = d.lastError
+		lastErrorTime := d.lastErrorTime
+		state.LastErrorTime = &lastErrorTime
+	}
+	if d.failure != nil {
+		failure := *d.failure
+		state.LastFailure = &failure
+	}
+}
+
+// Labels the calling goroutine, and those it starts, with the name of the
+// plugin it runs on behalf of, see PluginGoroutines.
+func labelPluginGoroutine(name string) {
+	pprof.SetGoroutineLabels(pprof.WithLabels(context.Background(),
+		pprof.Labels("plugin", name)))
+}
+
+// Returns the stack traces of the goroutines running on behalf of the named
+// plugin: its runner's, the plugin's own, and those they started. Goroutines
+// with the same stack are grouped, prefixed by their count.
+func PluginGoroutines(name string) (stacks string, count int) {
+	var buf bytes.Buffer
+	pprof.Lookup("goroutine").WriteTo(&buf, 1)
+	label := `"plugin":` + strconv.Quote(name)
+	var matches []string
+	// The first record is the profile's header.
+	for _, record := range strings.Split(buf.String(), "\n\n")[1:] {
+		lines := strings.SplitN(record, "\n", 3)
+		if len(lines) < 2 || !strings.HasPrefix(lines[1], "# labels: ") ||
+			!strings.Contains(lines[1], label) {
+			continue
+		}
+		if n, err := strconv.Atoi(strings.SplitN(lines[0], " ", 2)[0]); err == nil {
+			count += n
+		}
+		matches = append(matches, record)
+	}
+	return strings.Join(matches, "\n\n"), count
+}
+
+// Returns the internal state of the named input, decoder, filter, or output,
+// or false if there's no such plugin.
+func (pc *PipelineConfig) InspectPlugin(name string) (state *PluginState, ok bool) {
+	runner, ok := pc.pluginRunner(name)
+	if !ok {
+		return nil, false
+	}
+	state = &PluginState{Name: name, Report: make(map[string]interface{})}
+	msg := new(message.Message)
+	if err := PopulateReportMsg(runner, msg); err != nil {
+		state.Report["Error"] = err.Error()
+	}
+	for _, f := range msg.Fields {
+		state.Report[f.GetName()] = f.GetValue()
+	}
+	if d, ok := runner.(interface {
+		debugState() *runnerDebugState
+	}); ok {
+		d.debugState().populate(state)
+	}
+	_, state.Goroutines = PluginGoroutines(name)
+	return state, true
+}
@@ -0,0 +1,226 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"errors"
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+	"log"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Type of the messages announcing load shedding tier changes.
+const LOAD_SHEDDING_TYPE = "heka.load-shedding"
+
+// Least severe severity that is never shed, i.e. errors and anything more
+// severe always get through.
+const shedFloorSeverity = 3
+
+// Share of the router's channel that must be full for the router to count as
+// backed up.
+const shedRouterBacklog = 0.9
+
+// Delivery outcome of shed messages.
+var ErrShed = errors.New("message shed under load")
+
+// Load shedding settings.
+type LoadSheddingConfig struct {
+	// Severity from which each tier drops messages, tiers being activated in
+	// order, e.g. [7, 6] first drops debug messages, then info messages too.
+	// Load shedding is disabled if empty.
+	Tiers []int32
+	// Seconds of sustained pressure after which the next tier is activated.
+	EscalateAfter uint
+	// Seconds without pressure after which the last active tier is
+	// deactivated.
+	RecoverAfter uint
+}
+
+// Checks that the tiers shed progressively more severe messages, and never
+// errors or anything more severe.
+func ValidateLoadShedding(config LoadSheddingConfig) error {
+	for i, severity := range config.Tiers {
+		if severity <= shedFloorSeverity || severity > 7 {
+			return fmt.Errorf("load shedding tier %d: severity must be between %d and 7",
+				i+1, shedFloorSeverity+1)
+		}
+		if i > 0 && severity >= config.Tiers[i-1] {
+			return fmt.Errorf("load shedding tier %d: severity must be lower than the "+
+				"previous tier's", i+1)
+		}
+	}
+	if len(config.Tiers) > 0 && (config.EscalateAfter == 0 || config.RecoverAfter == 0) {
+		return errors.New("load shedding escalate and recover delays must be non-zero")
+	}
+	return nil
+}
+
+// Drops messages by severity tiers when the pipeline is overloaded, so the
+// most important messages survive overload deterministically. The pipeline is
+// under pressure while a pack pool is exhausted or the router is backed up.
+// After `EscalateAfter` seconds of sustained pressure the next tier is
+// activated, and after `RecoverAfter` seconds without pressure the last active
+// tier is deactivated. Messages are shed by the router, before they're
+// matched. Messages without a severity have Heka's default severity of 7,
+// i.e. debug.
+type loadShedder struct {
+	config LoadSheddingConfig
+	// Number of active tiers, read by the router.
+	level int32
+	// Reports whether the pipeline is under pressure.
+	pressured func() bool
+	// Called with the old and new levels when the level changes.
+	changed func(old, new int)
+	// Start of the current period with or without pressure. Only used by
+	// check, so not guarded.
+	pressureSince time.Time
+	calmSince     time.Time
+	// Messages shed, by severity.
+	shed [8]int64
+	// Swapped out in tests.
+	now func() time.Time
+}
+
+func newLoadShedder(config LoadSheddingConfig, pressured func() bool) *loadShedder {
+	return &loadShedder{
+		config:    config,
+		pressured: pressured,
+		now:       time.Now,
+	}
+}
+
+// Returns whether the router should drop the message, counting it if so.
+func (s *loadShedder) shouldShed(msg *message.Message) bool {
+	level := atomic.LoadInt32(&s.level)
+	if level == 0 {
+		return false
+	}
+	severity := msg.GetSeverity()
+	if severity <= shedFloorSeverity || severity < s.config.Tiers[level-1] {
+		return false
+	}
+	msgType := msg.GetType()
+	if msgType == LOAD_SHEDDING_TYPE || strings.HasPrefix(msgType, "heka.control.") {
+		return false
+	}
+	if severity > 7 {
+		severity = 7
+	}
+	atomic.AddInt64(&s.shed[severity], 1)
+	return true
+}
+
+// Makes a single escalation or recovery decision.
+func (s *loadShedder) check() {
+	now := s.now()
+	level := int(atomic.LoadInt32(&s.level))
+	if s.pressured() {
+		s.calmSince = time.Time{}
+		if s.pressureSince.IsZero() {
+			s.pressureSince = now
+		} else if level < len(s.config.Tiers) &&
+			now.Sub(s.pressureSince) >= time.Duration(s.config.EscalateAfter)*time.Second {
+
+			s.pressureSince = now
+			s.setLevel(level, level+1)
+		}
+		return
+	}
+	s.pressureSince = time.Time{}
+	if level == 0 {
+		return
+	}
+	if s.calmSince.IsZero() {
+		s.calmSince = now
+	} else if now.Sub(s.calmSince) >= time.Duration(s.config.RecoverAfter)*time.Second {
+		s.calmSince = now
+		s.setLevel(level, level-1)
+	}
+}
+
+func (s *loadShedder) setLevel(old, new int) {
+	atomic.StoreInt32(&s.level, int32(new))
+	if new > old {
+		log.Printf("Load shedding tier %d activated, dropping messages of severity %d "+
+			"and above", new, s.config.Tiers[new-1])
+	} else if new > 0 {
+		log.Printf("Load shedding tier %d deactivated, dropping messages of severity "+
+			"%d and above", old, s.config.Tiers[new-1])
+	} else {
+		log.Println("Load shedding deactivated")
+	}
+	if s.changed != nil {
+		s.changed(old, new)
+	}
+}
+
+// Checks the pressure until hekad shuts down.
+func (s *loadShedder) run(globals *GlobalConfigStruct) {
+	ticker := time.NewTicker(packPoolCheckInterval)
+	defer ticker.Stop()
+	for !globals.IsShuttingDown() {
+		<-ticker.C
+		s.check()
+	}
+}
+
+// Names of the report fields counting shed messages, by severity.
+var shedFieldNames = [8]string{4: "ShedWarning", 5: "ShedNotice", 6: "ShedInfo",
+	7: "ShedDebug"}
+
+// Adds the shedding level and counts to a report message.
+func (s *loadShedder) ReportMsg(msg *message.Message) {
+	message.NewIntField(msg, "ShedLevel", int(atomic.LoadInt32(&s.level)), "count")
+	var total int64
+	for severity := shedFloorSeverity + 1; severity < len(s.shed); severity++ {
+		n := atomic.LoadInt64(&s.shed[severity])
+		total += n
+		message.NewInt64Field(msg, shedFieldNames[severity], n, "count")
+	}
+	message.NewInt64Field(msg, "ShedMessages", total, "count")
+}
+
+// Whether a pack pool is exhausted or the router is backed up.
+func (pc *PipelineConfig) underPressure() bool {
+	return len(pc.inputPool.Chan()) == 0 || len(pc.injectPool.Chan()) == 0 ||
+		float64(len(pc.router.inChan)) >= shedRouterBacklog*float64(cap(pc.router.inChan))
+}
+
+// Announces a load shedding level change with a `heka.load-shedding`
+// message, unless no pack is available.
+func (pc *PipelineConfig) announceShedding(old, new int) {
+	var pack *PipelinePack
+	select {
+	case pack = <-pc.injectRecycleChan:
+	default:
+		log.Println("Can't announce the load shedding change, the inject pool is empty")
+		return
+	}
+	msg := pack.Message
+	msg.SetType(LOAD_SHEDDING_TYPE)
+	msg.SetLogger(HEKA_DAEMON)
+	msg.SetHostname(pc.hostname)
+	msg.SetTimestamp(time.Now().UnixNano())
+	msg.SetSeverity(4)
+	msg.SetPayload(fmt.Sprintf("load shedding level changed from %d to %d", old, new))
+	message.NewIntField(msg, "level", new, "count")
+	message.NewIntField(msg, "old_level", old, "count")
+	if new > 0 {
+		message.NewIntField(msg, "min_severity",
+			int(pc.shedder.config.Tiers[new-1]), "")
+	}
+	pc.shedder.ReportMsg(msg)
+	pc.router.InChan() <- pack
+}
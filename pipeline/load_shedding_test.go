@@ -0,0 +1,138 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"github.com/mozilla-services/heka/message"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"time"
+)
+
+func LoadSheddingSpec(c gs.Context) {
+	c.Specify("A load shedder", func() {
+		now := time.Unix(1000, 0)
+		pressured := false
+		var changes [][2]int
+		shedder := newLoadShedder(LoadSheddingConfig{
+			Tiers:         []int32{7, 6},
+			EscalateAfter: 5,
+			RecoverAfter:  30,
+		}, func() bool { return pressured })
+		shedder.now = func() time.Time { return now }
+		shedder.changed = func(old, new int) {
+			changes = append(changes, [2]int{old, new})
+		}
+		tick := func(d time.Duration) {
+			now = now.Add(d)
+			shedder.check()
+		}
+		msg := func(severity int32, msgType string) *message.Message {
+			m := new(message.Message)
+			m.SetSeverity(severity)
+			m.SetType(msgType)
+			return m
+		}
+
+		c.Specify("sheds nothing without pressure", func() {
+			tick(time.Minute)
+			tick(time.Minute)
+			c.Expect(shedder.shouldShed(msg(7, "")), gs.IsFalse)
+			c.Expect(len(changes), gs.Equals, 0)
+		})
+
+		c.Specify("escalates one tier at a time under sustained pressure", func() {
+			pressured = true
+			tick(0)
+			tick(4 * time.Second)
+			c.Expect(len(changes), gs.Equals, 0)
+			tick(time.Second)
+			c.Expect(len(changes), gs.Equals, 1)
+			c.Expect(changes[0], gs.Equals, [2]int{0, 1})
+			c.Expect(shedder.shouldShed(msg(7, "")), gs.IsTrue)
+			c.Expect(shedder.shouldShed(msg(6, "")), gs.IsFalse)
+
+			tick(5 * time.Second)
+			c.Expect(changes[1], gs.Equals, [2]int{1, 2})
+			c.Expect(shedder.shouldShed(msg(6, "")), gs.IsTrue)
+			c.Expect(shedder.shouldShed(msg(5, "")), gs.IsFalse)
+
+			c.Specify("and no further than the last tier", func() {
+				tick(time.Minute)
+				c.Expect(len(changes), gs.Equals, 2)
+			})
+
+			c.Specify("never sheds errors or control messages", func() {
+				for severity := int32(0); severity <= 3; severity++ {
+					c.Expect(shedder.shouldShed(msg(severity, "")), gs.IsFalse)
+				}
+				c.Expect(shedder.shouldShed(msg(7, "heka.control.sampling")), gs.IsFalse)
+				c.Expect(shedder.shouldShed(msg(7, LOAD_SHEDDING_TYPE)), gs.IsFalse)
+			})
+
+			c.Specify("counts what was shed by severity", func() {
+				report := new(message.Message)
+				shedder.ReportMsg(report)
+				level, _ := report.GetFieldValue("ShedLevel")
+				c.Expect(level, gs.Equals, int64(2))
+				debug, _ := report.GetFieldValue("ShedDebug")
+				c.Expect(debug, gs.Equals, int64(1))
+				info, _ := report.GetFieldValue("ShedInfo")
+				c.Expect(info, gs.Equals, int64(1))
+				total, _ := report.GetFieldValue("ShedMessages")
+				c.Expect(total, gs.Equals, int64(2))
+			})
+
+			c.Specify("recovers one tier at a time once the pressure is gone", func() {
+				pressured = false
+				tick(0)
+				tick(29 * time.Second)
+				c.Expect(len(changes), gs.Equals, 2)
+				tick(time.Second)
+				c.Expect(changes[2], gs.Equals, [2]int{2, 1})
+				c.Expect(shedder.shouldShed(msg(6, "")), gs.IsFalse)
+				c.Expect(shedder.shouldShed(msg(7, "")), gs.IsTrue)
+				tick(30 * time.Second)
+				c.Expect(changes[3], gs.Equals, [2]int{1, 0})
+				c.Expect(shedder.shouldShed(msg(7, "")), gs.IsFalse)
+			})
+
+			c.Specify("restarts the recovery delay if the pressure returns", func() {
+				pressured = false
+				tick(0)
+				tick(20 * time.Second)
+				pressured = true
+				tick(time.Second)
+				pressured = false
+				tick(0)
+				tick(20 * time.Second)
+				c.Expect(len(changes), gs.Equals, 2)
+			})
+		})
+
+		c.Specify("validates its tiers", func() {
+			valid := LoadSheddingConfig{Tiers: []int32{7, 6, 5}, EscalateAfter: 1,
+				RecoverAfter: 1}
+			c.Expect(ValidateLoadShedding(valid), gs.IsNil)
+			c.Expect(ValidateLoadShedding(LoadSheddingConfig{}), gs.IsNil)
+			invalid := valid
+			invalid.Tiers = []int32{7, 3}
+			c.Expect(ValidateLoadShedding(invalid), gs.Not(gs.IsNil))
+			invalid.Tiers = []int32{6, 7}
+			c.Expect(ValidateLoadShedding(invalid), gs.Not(gs.IsNil))
+			invalid.Tiers = []int32{8}
+			c.Expect(ValidateLoadShedding(invalid), gs.Not(gs.IsNil))
+			invalid = valid
+			invalid.EscalateAfter = 0
+			c.Expect(ValidateLoadShedding(invalid), gs.Not(gs.IsNil))
+		})
+	})
+}
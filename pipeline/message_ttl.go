@@ -0,0 +1,67 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"errors"
+	"github.com/mozilla-services/heka/message"
+	"time"
+)
+
+// Name of the dynamic field holding a message's time to live, counted from
+// its timestamp: a number of seconds, or a duration string such as "90s".
+// The router and outputs drop messages whose TTL has elapsed.
+const TTL_FIELD = "TTL"
+
+var ErrExpired = errors.New("message TTL elapsed")
+
+// Sets a message's time to live, replacing any previous one.
+func SetMessageTTL(msg *message.Message, ttl time.Duration) {
+	kept := msg.Fields[:0]
+	for _, f := range msg.Fields {
+		if f.GetName() != TTL_FIELD {
+			kept = append(kept, f)
+		}
+	}
+	msg.Fields = kept
+	f, _ := message.NewField(TTL_FIELD, ttl.Seconds(), "s")
+	msg.AddField(f)
+}
+
+// Returns a message's time to live, or false if it doesn't have a valid one.
+func MessageTTL(msg *message.Message) (ttl time.Duration, ok bool) {
+	field := msg.FindFirstField(TTL_FIELD)
+	if field == nil {
+		return 0, false
+	}
+	switch value := field.GetValue().(type) {
+	case int64:
+		return time.Duration(value) * time.Second, true
+	case float64:
+		return time.Duration(value * float64(time.Second)), true
+	case string:
+		var err error
+		ttl, err = time.ParseDuration(value)
+		return ttl, err == nil
+	}
+	return 0, false
+}
+
+// Whether a message's TTL has elapsed. Messages without a timestamp never
+// expire.
+func ttlElapsed(msg *message.Message) bool {
+	ttl, ok := MessageTTL(msg)
+	if !ok || msg.Timestamp == nil {
+		return false
+	}
+	return time.Since(time.Unix(0, msg.GetTimestamp())) > ttl
+}
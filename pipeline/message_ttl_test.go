@@ -0,0 +1,74 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"github.com/mozilla-services/heka/message"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"time"
+)
+
+func MessageTTLSpec(c gs.Context) {
+	c.Specify("A message TTL", func() {
+		pack := NewPipelinePack(nil)
+		msg := pack.Message
+		msg.SetTimestamp(time.Now().Add(-time.Minute).UnixNano())
+
+		c.Specify("is absent by default", func() {
+			_, ok := MessageTTL(msg)
+			c.Expect(ok, gs.IsFalse)
+			c.Expect(ttlElapsed(msg), gs.IsFalse)
+		})
+
+		c.Specify("is set in seconds, replacing the previous one", func() {
+			SetMessageTTL(msg, time.Hour)
+			SetMessageTTL(msg, 30*time.Second)
+			c.Expect(len(msg.FindAllFields(TTL_FIELD)), gs.Equals, 1)
+			ttl, ok := MessageTTL(msg)
+			c.Expect(ok, gs.IsTrue)
+			c.Expect(ttl, gs.Equals, 30*time.Second)
+			c.Expect(ttlElapsed(msg), gs.IsTrue)
+		})
+
+		c.Specify("accepts integers and duration strings", func() {
+			message.NewInt64Field(msg, TTL_FIELD, 120, "s")
+			ttl, _ := MessageTTL(msg)
+			c.Expect(ttl, gs.Equals, 2*time.Minute)
+			c.Expect(ttlElapsed(msg), gs.IsFalse)
+
+			msg.Fields = nil
+			message.NewStringField(msg, TTL_FIELD, "1m30s")
+			ttl, _ = MessageTTL(msg)
+			c.Expect(ttl, gs.Equals, 90*time.Second)
+
+			msg.Fields = nil
+			message.NewStringField(msg, TTL_FIELD, "soon")
+			_, ok := MessageTTL(msg)
+			c.Expect(ok, gs.IsFalse)
+		})
+
+		c.Specify("never elapses without a timestamp", func() {
+			SetMessageTTL(msg, time.Second)
+			msg.Timestamp = nil
+			c.Expect(ttlElapsed(msg), gs.IsFalse)
+		})
+
+		c.Specify("expires matches of an output's matcher", func() {
+			mr := &MatchRunner{checkTTL: true}
+			c.Expect(mr.expired(pack), gs.IsFalse)
+			SetMessageTTL(msg, time.Second)
+			c.Expect(mr.expired(pack), gs.IsTrue)
+			mr.checkTTL = false
+			c.Expect(mr.expired(pack), gs.IsFalse)
+		})
+	})
+}
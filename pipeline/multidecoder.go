@@ -144,10 +144,12 @@ func (mdr *mDRunner) Decoder() Decoder {
 
 func (mdr *mDRunner) LogError(err error) {
 	log.Printf("SubDecoder '%s' error: %s", mdr.name, err)
+	mdr.pConfig.logPluginMessage(mdr.name, "Decoder", pluginLogError, err.Error())
 }
 
 func (mdr *mDRunner) LogMessage(msg string) {
 	log.Printf("SubDecoder '%s': %s", mdr.name, msg)
+	mdr.pConfig.logPluginMessage(mdr.name, "Decoder", pluginLogInfo, msg)
 }
 
 type MultiDecoder struct {
@@ -230,7 +232,7 @@ func (md *MultiDecoder) Init(config interface{}) (err error) {
 	md.processMessageFailures = make([]int64, numSubs)
 	md.processMessageSamples = make([]int64, numSubs)
 	md.processMessageDuration = make([]int64, numSubs)
-	md.sampleDenominator = md.pConfig.Globals.SampleDenominator
+	md.sampleDenominator = md.pConfig.Globals.Tunables().SampleDenominator
 	return nil
 }
 
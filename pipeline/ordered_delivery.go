@@ -0,0 +1,243 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"github.com/mozilla-services/heka/message"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Gate sitting between an output's message matcher (or disk buffer) and the
+// plugin, see the `ordering_key` setting. The plugin is handed a message only
+// once it has finished with every earlier message sharing the message's key,
+// so the messages of a key are delivered in the order they arrived even if
+// the plugin sends, batches, or retries them concurrently. Messages of other
+// keys aren't held up.
+//
+// Like the disk buffer's, the gate's packs come from a private pool: each
+// message is passed on in a private pack sharing the original's message,
+// and the original is held until the plugin recycles the private pack, which
+// is how the gate knows the plugin has finished with the message.
+type orderingGate struct {
+	// Name of the header or field holding the key.
+	key string
+	// Matching messages, in arrival order.
+	inChan chan *PipelinePack
+	// Delivers the messages let through to the plugin.
+	replay      *MatchRunner
+	recycleChan chan *PipelinePack
+	poolSize    int
+	// Originals of the private packs held by the plugin.
+	lock     sync.Mutex
+	inFlight map[*PipelinePack]*orderedPack
+	// Messages waiting for an earlier message of their key, by key. A key
+	// is present while one of its messages is held by the plugin.
+	waiting   map[string][]*PipelinePack
+	heldCount int64
+	// How long to wait for the plugin to finish with its messages when
+	// stopping.
+	drainTimeout time.Duration
+}
+
+type orderedPack struct {
+	original *PipelinePack
+	key      string
+	keyed    bool
+}
+
+// Returns the name of the header or field a setting such as `ordering_key`
+// refers to. Field names may also be written as `Fields[name]`.
+func valueName(setting string) string {
+	if strings.HasPrefix(setting, "Fields[") && strings.HasSuffix(setting, "]") {
+		return setting[len("Fields[") : len(setting)-1]
+	}
+	return setting
+}
+
+func newOrderingGate(key string, runner PluginRunner, chanSize int) (*orderingGate, error) {
+	g := &orderingGate{
+		key:          valueName(key),
+		inChan:       make(chan *PipelinePack, chanSize),
+		recycleChan:  make(chan *PipelinePack, chanSize+1),
+		poolSize:     chanSize + 1,
+		inFlight:     make(map[*PipelinePack]*orderedPack),
+		waiting:      make(map[string][]*PipelinePack),
+		drainTimeout: 5 * time.Second,
+	}
+	var err error
+	if g.replay, err = NewMatchRunner("TRUE", "", runner, chanSize); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// Starts passing messages on. The gate stops once its input channel has been
+// closed and every message received has been passed on, at which point the
+// replay matcher's input channel is closed.
+func (g *orderingGate) start() {
+	go g.run()
+}
+
+func (g *orderingGate) run() {
+	var (
+		free    = make([]*PipelinePack, 0, g.poolSize)
+		ready   []*PipelinePack
+		inChan  = g.inChan
+		timeout <-chan time.Time
+	)
+	for i := 0; i < g.poolSize; i++ {
+		pack := NewPipelinePack(g.recycleChan)
+		pack.MsgBytes = nil // The originals' are used.
+		free = append(free, pack)
+	}
+
+	for inChan != nil || len(ready) > 0 || atomic.LoadInt64(&g.heldCount) > 0 {
+		if len(ready) > 0 && len(free) > 0 {
+			g.replay.inChan <- g.pass(free[len(free)-1], ready[0])
+			free, ready = free[:len(free)-1], ready[1:]
+			continue
+		}
+		// Only read more messages once those ready have been passed on.
+		var in chan *PipelinePack
+		if len(ready) == 0 {
+			in = inChan
+		}
+		select {
+		case pack, ok := <-in:
+			if !ok {
+				inChan = nil
+				timeout = time.After(g.drainTimeout)
+				continue
+			}
+			if g.admit(pack) {
+				ready = append(ready, pack)
+			}
+		case pack := <-g.recycleChan:
+			pack, next := g.finish(pack)
+			free = append(free, pack)
+			if next != nil {
+				ready = append(ready, next)
+			}
+		case <-timeout:
+			// The plugin is holding on to messages, give up on those still
+			// waiting for them.
+			g.lock.Lock()
+			for key, packs := range g.waiting {
+				for _, pack := range packs {
+					pack.Recycle()
+				}
+				delete(g.waiting, key)
+			}
+			g.lock.Unlock()
+			atomic.StoreInt64(&g.heldCount, 0)
+		}
+	}
+
+	close(g.replay.inChan)
+	timeout = time.After(g.drainTimeout)
+	for waiting := true; waiting && g.inFlightLen() > 0; {
+		select {
+		case pack := <-g.recycleChan:
+			g.finish(pack)
+		case <-timeout:
+			waiting = false
+		}
+	}
+}
+
+// Records the arrival of a message, returning true if it can be passed on
+// right away, false if it must wait for an earlier message of its key.
+func (g *orderingGate) admit(pack *PipelinePack) bool {
+	key, ok := destinationValue(pack.Message, g.key)
+	if !ok {
+		// Messages without a key aren't ordered.
+		return true
+	}
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if packs, busy := g.waiting[key]; busy {
+		g.waiting[key] = append(packs, pack)
+		atomic.AddInt64(&g.heldCount, 1)
+		return false
+	}
+	g.waiting[key] = nil
+	return true
+}
+
+// Fills in a private pack to pass a message on.
+func (g *orderingGate) pass(pack, original *PipelinePack) *PipelinePack {
+	pack.Message = original.Message
+	pack.MsgBytes = original.MsgBytes
+	pack.Decoded = original.Decoded
+	pack.Signer = original.Signer
+	pack.Schema = original.Schema
+	pack.MsgLoopCount = original.MsgLoopCount
+	key, keyed := destinationValue(original.Message, g.key)
+	g.lock.Lock()
+	g.inFlight[pack] = &orderedPack{original: original, key: key, keyed: keyed}
+	g.lock.Unlock()
+	return pack
+}
+
+// Releases the original of a recycled private pack. Returns the pack and the
+// next message of the same key, if one is waiting.
+func (g *orderingGate) finish(pack *PipelinePack) (*PipelinePack, *PipelinePack) {
+	g.lock.Lock()
+	op, ok := g.inFlight[pack]
+	if !ok {
+		g.lock.Unlock()
+		return pack, nil
+	}
+	delete(g.inFlight, pack)
+	var next *PipelinePack
+	if op.keyed {
+		if packs := g.waiting[op.key]; len(packs) > 0 {
+			next = packs[0]
+			g.waiting[op.key] = packs[1:]
+			atomic.AddInt64(&g.heldCount, -1)
+		} else {
+			delete(g.waiting, op.key)
+		}
+	}
+	g.lock.Unlock()
+	op.original.Recycle()
+	return pack, next
+}
+
+func (g *orderingGate) inFlightLen() int {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	return len(g.inFlight)
+}
+
+// Returns the delivery tracker of the original of a private pack held by the
+// plugin, if any.
+func (g *orderingGate) delivery(pack *PipelinePack) *deliveryTracker {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if op, ok := g.inFlight[pack]; ok {
+		return op.original.delivery
+	}
+	return nil
+}
+
+func (g *orderingGate) ReportMsg(msg *message.Message) {
+	g.lock.Lock()
+	keys := len(g.waiting)
+	g.lock.Unlock()
+	message.NewInt64Field(msg, "OrderingKeysInFlight", int64(keys), "count")
+	message.NewInt64Field(msg, "OrderingHeldMessages",
+		atomic.LoadInt64(&g.heldCount), "count")
+}
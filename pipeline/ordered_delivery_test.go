@@ -0,0 +1,123 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"github.com/mozilla-services/heka/message"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"time"
+)
+
+func OrderedDeliverySpec(c gs.Context) {
+	supply := make(chan *PipelinePack, 10)
+
+	newGate := func() *orderingGate {
+		g, err := newOrderingGate("Fields[table]", nil, 5)
+		c.Assume(err, gs.IsNil)
+		g.drainTimeout = 0
+		g.start()
+		return g
+	}
+
+	send := func(g *orderingGate, table string, payloads ...string) {
+		for _, payload := range payloads {
+			pack := NewPipelinePack(supply)
+			if table != "" {
+				message.NewStringField(pack.Message, "table", table)
+			}
+			pack.Message.SetPayload(payload)
+			g.inChan <- pack
+		}
+	}
+
+	receive := func(g *orderingGate) *PipelinePack {
+		select {
+		case pack := <-g.replay.inChan:
+			return pack
+		case <-time.After(time.Second):
+			return nil
+		}
+	}
+
+	nothingReceived := func(g *orderingGate) bool {
+		select {
+		case <-g.replay.inChan:
+			return false
+		case <-time.After(50 * time.Millisecond):
+			return true
+		}
+	}
+
+	c.Specify("An ordering gate", func() {
+		g := newGate()
+
+		c.Specify("holds messages until the previous one of their key is done", func() {
+			send(g, "orders", "o1", "o2")
+			send(g, "users", "u1")
+			first := receive(g)
+			c.Assume(first, gs.Not(gs.IsNil))
+			c.Expect(first.Message.GetPayload(), gs.Equals, "o1")
+			// Other keys aren't held up.
+			other := receive(g)
+			c.Assume(other, gs.Not(gs.IsNil))
+			c.Expect(other.Message.GetPayload(), gs.Equals, "u1")
+			c.Expect(nothingReceived(g), gs.IsTrue)
+			c.Expect(g.heldCount, gs.Equals, int64(1))
+
+			first.Recycle()
+			second := receive(g)
+			c.Assume(second, gs.Not(gs.IsNil))
+			c.Expect(second.Message.GetPayload(), gs.Equals, "o2")
+			// The original is recycled once the plugin is done with it.
+			c.Expect((<-supply).Message.GetPayload(), gs.Equals, "")
+			second.Recycle()
+			other.Recycle()
+			close(g.inChan)
+		})
+
+		c.Specify("doesn't hold messages without a key", func() {
+			send(g, "orders", "o1")
+			send(g, "", "a", "b")
+			payloads := make([]string, 0, 3)
+			for i := 0; i < 3; i++ {
+				pack := receive(g)
+				c.Assume(pack, gs.Not(gs.IsNil))
+				payloads = append(payloads, pack.Message.GetPayload())
+			}
+			c.Expect(payloads[1], gs.Equals, "a")
+			c.Expect(payloads[2], gs.Equals, "b")
+			close(g.inChan)
+		})
+
+		c.Specify("gives up on held messages when stopping", func() {
+			send(g, "orders", "o1", "o2")
+			first := receive(g)
+			c.Assume(first, gs.Not(gs.IsNil))
+			close(g.inChan)
+			_, ok := <-g.replay.inChan
+			c.Expect(ok, gs.IsFalse)
+			c.Expect(len(supply), gs.Equals, 1)
+		})
+	})
+
+	c.Specify("An output with an ordering key", func() {
+		config := CommonFOConfig{
+			Matcher:     "TRUE",
+			OrderingKey: "Type",
+			Buffering:   "disk",
+			Buffer:      getDefaultDiskBufferConfig(),
+		}
+		config.Buffer.DrainOrder = "newest_first"
+		_, err := NewFORunner("out", &StoppingOutput{}, config, "DummyOutput", 5)
+		c.Expect(err, gs.Not(gs.IsNil))
+	})
+}
@@ -0,0 +1,95 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+// Callbacks for PipelinePack lifecycle events, for extensions such as
+// tracing or accounting that need to observe every message passing through
+// Heka. Any of the callbacks may be nil. They're called synchronously on
+// Heka's hot paths, from many goroutines at once, so they must be fast and
+// safe for concurrent use, and must not recycle or otherwise hold on to the
+// pack.
+type PackHooks struct {
+	// Called when a pack is created, when a pack pool is filled or grows.
+	OnCreate func(pack *PipelinePack)
+	// Called when the router accepts a pack, after any input stamping and
+	// before it's handed to the matching filters and outputs.
+	OnDeliver func(pack *PipelinePack)
+	// Called when the last reference to a pack is released, before the pack
+	// is zeroed and returned to its pool.
+	OnRecycle func(pack *PipelinePack)
+}
+
+// Identifies a set of registered PackHooks, used to access the per-pack data
+// of the extension that registered them.
+type PackHookId int
+
+var registeredPackHooks []PackHooks
+
+// Registers lifecycle hooks for all PipelinePacks. Like RegisterPlugin, this
+// must be called from an `init()` function, before any packs are created.
+// The returned id can be used with the packs' HookData and SetHookData
+// methods.
+func RegisterPackHooks(hooks PackHooks) PackHookId {
+	registeredPackHooks = append(registeredPackHooks, hooks)
+	return PackHookId(len(registeredPackHooks) - 1)
+}
+
+// Returns the data stored on the pack by the extension with the specified
+// hook id, nil if none has been stored since the pack was last recycled.
+func (p *PipelinePack) HookData(id PackHookId) interface{} {
+	if int(id) >= len(p.hookData) {
+		return nil
+	}
+	return p.hookData[id]
+}
+
+// Stores extension data on the pack, e.g. a tracing span, which is cleared
+// once the OnRecycle hooks have been called.
+func (p *PipelinePack) SetHookData(id PackHookId, data interface{}) {
+	if int(id) >= len(p.hookData) {
+		hookData := make([]interface{}, len(registeredPackHooks))
+		copy(hookData, p.hookData)
+		p.hookData = hookData
+	}
+	p.hookData[id] = data
+}
+
+func (p *PipelinePack) hookCreate() {
+	if len(registeredPackHooks) == 0 {
+		return
+	}
+	p.hookData = make([]interface{}, len(registeredPackHooks))
+	for _, hooks := range registeredPackHooks {
+		if hooks.OnCreate != nil {
+			hooks.OnCreate(p)
+		}
+	}
+}
+
+func (p *PipelinePack) hookDeliver() {
+	for _, hooks := range registeredPackHooks {
+		if hooks.OnDeliver != nil {
+			hooks.OnDeliver(p)
+		}
+	}
+}
+
+func (p *PipelinePack) hookRecycle() {
+	for _, hooks := range registeredPackHooks {
+		if hooks.OnRecycle != nil {
+			hooks.OnRecycle(p)
+		}
+	}
+	for i := range p.hookData {
+		p.hookData[i] = nil
+	}
+}
@@ -0,0 +1,82 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	gs "github.com/rafrombrc/gospec/src/gospec"
+)
+
+func PackHooksSpec(c gs.Context) {
+	origHooks := registeredPackHooks
+	defer func() {
+		registeredPackHooks = origHooks
+	}()
+	registeredPackHooks = nil
+
+	var events []string
+	var recycledData interface{}
+	var id PackHookId
+	id = RegisterPackHooks(PackHooks{
+		OnCreate: func(pack *PipelinePack) {
+			events = append(events, "create")
+		},
+		OnDeliver: func(pack *PipelinePack) {
+			events = append(events, "deliver")
+			pack.SetHookData(id, pack.Message.GetType())
+		},
+		OnRecycle: func(pack *PipelinePack) {
+			events = append(events, "recycle")
+			recycledData = pack.HookData(id)
+		},
+	})
+	// Hooks may leave any of the callbacks unset.
+	RegisterPackHooks(PackHooks{})
+
+	recycleChan := make(chan *PipelinePack, 1)
+	pack := NewPipelinePack(recycleChan)
+
+	c.Specify("Pack lifecycle hooks", func() {
+		c.Specify("are called when a pack is created", func() {
+			c.Expect(len(events), gs.Equals, 1)
+			c.Expect(events[0], gs.Equals, "create")
+		})
+
+		c.Specify("are called when the router delivers and recycles a pack", func() {
+			router := NewMessageRouter(1)
+			router.initMatchSlices()
+			router.Start()
+			defer close(router.InChan())
+
+			pack.Message.SetType("hooked")
+			router.InChan() <- pack
+			recycled := <-recycleChan
+			c.Expect(recycled, gs.Equals, pack)
+			c.Expect(len(events), gs.Equals, 3)
+			c.Expect(events[1], gs.Equals, "deliver")
+			c.Expect(events[2], gs.Equals, "recycle")
+
+			c.Specify("with access to the pack's hook data", func() {
+				c.Expect(recycledData, gs.Equals, "hooked")
+				c.Expect(pack.HookData(id), gs.IsNil)
+			})
+		})
+
+		c.Specify("aren't called until the last reference is released", func() {
+			pack.RefCount = 2
+			pack.Recycle()
+			c.Expect(len(events), gs.Equals, 1)
+			pack.Recycle()
+			c.Expect(len(events), gs.Equals, 2)
+			c.Expect(events[1], gs.Equals, "recycle")
+		})
+	})
+}
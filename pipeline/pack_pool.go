@@ -0,0 +1,197 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// How often a pack pool checks whether it needs resizing.
+	packPoolCheckInterval = 100 * time.Millisecond
+	// Number of consecutive checks for which more than half of a pool's
+	// packs must be unused before it shrinks.
+	packPoolShrinkChecks = 300
+)
+
+// A supply of PipelinePacks, i.e. the input or inject pool. The pool starts
+// with its minimum number of packs. When it runs dry it grows in steps up to
+// its maximum size, unless the router is backed up, in which case more packs
+// would only queue up behind the slowest plugins. When more than half of its
+// packs have been unused for a while it shrinks back towards its minimum
+// size. Packs are taken from the pool by receiving from its channel, and
+// return to it when they're recycled.
+type PackPool struct {
+	name    string
+	packs   chan *PipelinePack
+	minSize int64 // Changed at runtime by TuneGlobals, so accessed atomically.
+	maxSize int
+	tracker *DiagnosticTracker
+	// Reports whether the pipeline is backed up, blocking growth.
+	backedUp func() bool
+	// Consecutive checks with more than half of the packs unused.
+	idleChecks int
+	// Current number of packs, and the number of checks that found the pool
+	// empty, growths, and shrinks.
+	size      int64
+	exhausted int64
+	growths   int64
+	shrinks   int64
+}
+
+// Creates a pool that holds between `minSize` and `maxSize` packs. A
+// `maxSize` smaller than `minSize` gives a fixed size pool.
+func NewPackPool(name string, minSize, maxSize int) *PackPool {
+	if maxSize < minSize {
+		maxSize = minSize
+	}
+	return &PackPool{
+		name:    name,
+		packs:   make(chan *PipelinePack, maxSize),
+		minSize: int64(minSize),
+		maxSize: maxSize,
+	}
+}
+
+// Returns the channel from which packs are taken, and to which they're
+// recycled.
+func (p *PackPool) Chan() chan *PipelinePack {
+	return p.packs
+}
+
+// Returns the current number of packs in the pool, including those in use.
+func (p *PackPool) Size() int {
+	return int(atomic.LoadInt64(&p.size))
+}
+
+// Adds the pool's initial packs, registering them and any packs added later
+// with the diagnostic tracker.
+func (p *PackPool) fill(tracker *DiagnosticTracker) {
+	p.tracker = tracker
+	p.grow(p.MinSize())
+}
+
+// Returns the number of packs the pool holds at least.
+func (p *PackPool) MinSize() int {
+	return int(atomic.LoadInt64(&p.minSize))
+}
+
+// Changes the pool's minimum size, which can't exceed the maximum size. A
+// larger minimum size is reached at the next check, a smaller one as the
+// pool shrinks.
+func (p *PackPool) SetMinSize(n int) error {
+	if n < 1 || n > p.maxSize {
+		return fmt.Errorf("size must be between 1 and %d", p.maxSize)
+	}
+	atomic.StoreInt64(&p.minSize, int64(n))
+	return nil
+}
+
+func (p *PackPool) grow(n int) {
+	for i := 0; i < n; i++ {
+		pack := NewPipelinePack(p.packs)
+		if p.tracker != nil {
+			p.tracker.AddPack(pack)
+		}
+		atomic.AddInt64(&p.size, 1)
+		p.packs <- pack
+	}
+}
+
+// Frees up to `n` unused packs.
+func (p *PackPool) shrink(n int) {
+	for i := 0; i < n; i++ {
+		select {
+		case pack := <-p.packs:
+			if p.tracker != nil {
+				p.tracker.RemovePack(pack)
+			}
+			atomic.AddInt64(&p.size, -1)
+		default:
+			return
+		}
+	}
+}
+
+// Makes a single resizing decision.
+func (p *PackPool) check() {
+	size := p.Size()
+	free := len(p.packs)
+	minSize := p.MinSize()
+	if size < minSize {
+		p.grow(minSize - size)
+		atomic.AddInt64(&p.growths, 1)
+		return
+	}
+	if free == 0 {
+		atomic.AddInt64(&p.exhausted, 1)
+		p.idleChecks = 0
+		if size < p.maxSize && (p.backedUp == nil || !p.backedUp()) {
+			// Grow by a quarter of the current size at a time.
+			n := size/4 + 1
+			if size+n > p.maxSize {
+				n = p.maxSize - size
+			}
+			p.grow(n)
+			atomic.AddInt64(&p.growths, 1)
+		}
+		return
+	}
+	if size <= minSize || free <= size/2 {
+		p.idleChecks = 0
+		return
+	}
+	if p.idleChecks++; p.idleChecks < packPoolShrinkChecks {
+		return
+	}
+	p.idleChecks = 0
+	n := free / 2
+	if size-n < minSize {
+		n = size - minSize
+	}
+	p.shrink(n)
+	atomic.AddInt64(&p.shrinks, 1)
+}
+
+// Resizes the pool as needed until hekad shuts down. Fixed size pools are
+// still checked, so their exhaustion is reported.
+func (p *PackPool) run(globals *GlobalConfigStruct) {
+	ticker := time.NewTicker(packPoolCheckInterval)
+	defer ticker.Stop()
+	for !globals.IsShuttingDown() {
+		<-ticker.C
+		p.check()
+	}
+}
+
+// Adds the pool's size and utilization to a report message.
+func (p *PackPool) ReportMsg(msg *message.Message) {
+	size := p.Size()
+	free := len(p.packs)
+	message.NewIntField(msg, "InChanCapacity", cap(p.packs), "count")
+	message.NewIntField(msg, "InChanLength", free, "count")
+	message.NewIntField(msg, "PoolSize", size, "count")
+	message.NewIntField(msg, "PoolMinSize", p.MinSize(), "count")
+	utilization := 0.0
+	if size > 0 {
+		utilization = float64(size-free) / float64(size) * 100
+	}
+	if field, err := message.NewField("PoolUtilization", utilization, "%"); err == nil {
+		msg.AddField(field)
+	}
+	message.NewInt64Field(msg, "PoolExhausted", atomic.LoadInt64(&p.exhausted), "count")
+	message.NewInt64Field(msg, "PoolGrowths", atomic.LoadInt64(&p.growths), "count")
+	message.NewInt64Field(msg, "PoolShrinks", atomic.LoadInt64(&p.shrinks), "count")
+}
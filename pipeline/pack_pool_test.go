@@ -0,0 +1,108 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"github.com/mozilla-services/heka/message"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+)
+
+func PackPoolSpec(c gs.Context) {
+	globals := DefaultGlobals()
+	tracker := NewDiagnosticTracker("test", globals)
+
+	// Takes `n` packs out of the pool.
+	take := func(pool *PackPool, n int) []*PipelinePack {
+		packs := make([]*PipelinePack, n)
+		for i := range packs {
+			packs[i] = <-pool.Chan()
+		}
+		return packs
+	}
+
+	c.Specify("A dynamically sized pack pool", func() {
+		pool := NewPackPool("test", 4, 10)
+		pool.fill(tracker)
+		c.Expect(pool.Size(), gs.Equals, 4)
+		c.Expect(len(tracker.packs), gs.Equals, 4)
+
+		c.Specify("grows when it's empty", func() {
+			take(pool, 4)
+			pool.check()
+			c.Expect(pool.Size(), gs.Equals, 6)
+			c.Expect(len(pool.Chan()), gs.Equals, 2)
+			c.Expect(len(tracker.packs), gs.Equals, 6)
+
+			c.Specify("up to its maximum size", func() {
+				for i := 0; i < 5; i++ {
+					take(pool, len(pool.Chan()))
+					pool.check()
+				}
+				c.Expect(pool.Size(), gs.Equals, 10)
+				c.Expect(pool.exhausted, gs.Equals, int64(6))
+				c.Expect(pool.growths, gs.Equals, int64(3))
+			})
+		})
+
+		c.Specify("doesn't grow when the pipeline is backed up", func() {
+			pool.backedUp = func() bool { return true }
+			take(pool, 4)
+			pool.check()
+			c.Expect(pool.Size(), gs.Equals, 4)
+			c.Expect(pool.exhausted, gs.Equals, int64(1))
+		})
+
+		c.Specify("shrinks back to its minimum size when idle", func() {
+			packs := take(pool, 4)
+			pool.check()
+			c.Expect(pool.Size(), gs.Equals, 6)
+			for _, pack := range packs {
+				pack.Recycle()
+			}
+			for i := 0; i < packPoolShrinkChecks-1; i++ {
+				pool.check()
+			}
+			c.Expect(pool.Size(), gs.Equals, 6)
+			pool.check()
+			c.Expect(pool.Size(), gs.Equals, 4)
+			c.Expect(len(tracker.packs), gs.Equals, 4)
+			c.Expect(pool.shrinks, gs.Equals, int64(1))
+		})
+
+		c.Specify("reports its utilization", func() {
+			take(pool, 1)
+			msg := new(message.Message)
+			pool.ReportMsg(msg)
+			value, _ := msg.GetFieldValue("InChanCapacity")
+			c.Expect(value, gs.Equals, int64(10))
+			value, _ = msg.GetFieldValue("InChanLength")
+			c.Expect(value, gs.Equals, int64(3))
+			value, _ = msg.GetFieldValue("PoolSize")
+			c.Expect(value, gs.Equals, int64(4))
+			value, _ = msg.GetFieldValue("PoolUtilization")
+			c.Expect(value, gs.Equals, float64(25))
+		})
+	})
+
+	c.Specify("A fixed size pack pool", func() {
+		pool := NewPackPool("test", 4, 0)
+		pool.fill(tracker)
+
+		c.Specify("never grows", func() {
+			take(pool, 4)
+			pool.check()
+			c.Expect(pool.Size(), gs.Equals, 4)
+			c.Expect(cap(pool.Chan()), gs.Equals, 4)
+			c.Expect(pool.exhausted, gs.Equals, int64(1))
+		})
+	})
+}
@@ -96,7 +96,8 @@ func (p *PacketTracking) Runners() (runners []PluginRunner) {
 // to determine possible leaks
 type DiagnosticTracker struct {
 	// Track all the packs that have been created.
-	packs []*PipelinePack
+	packs     []*PipelinePack
+	packsLock sync.Mutex
 
 	// Identify the name of the recycle channel it monitors packs for.
 	ChannelName string
@@ -116,7 +117,24 @@ func NewDiagnosticTracker(channelName string, globals *GlobalConfigStruct) *Diag
 
 // Add a pipeline pack for monitoring
 func (d *DiagnosticTracker) AddPack(pack *PipelinePack) {
+	d.packsLock.Lock()
 	d.packs = append(d.packs, pack)
+	d.packsLock.Unlock()
+}
+
+// Stop monitoring a pipeline pack, e.g. because it has been freed.
+func (d *DiagnosticTracker) RemovePack(pack *PipelinePack) {
+	d.packsLock.Lock()
+	for i, p := range d.packs {
+		if p == pack {
+			last := len(d.packs) - 1
+			d.packs[i] = d.packs[last]
+			d.packs[last] = nil
+			d.packs = d.packs[:last]
+			break
+		}
+	}
+	d.packsLock.Unlock()
 }
 
 // Run the monitoring routine, this should be spun up in a new goroutine
@@ -141,7 +159,11 @@ func (d *DiagnosticTracker) Run() {
 		// Locate all the packs that have not been touched in idleMax duration
 		// that are not recycled.
 		earliestAccess = time.Now().Add(-idleMax)
-		for _, pack = range d.packs {
+		d.packsLock.Lock()
+		packs := make([]*PipelinePack, len(d.packs))
+		copy(packs, d.packs)
+		d.packsLock.Unlock()
+		for _, pack = range packs {
 			if len(pack.diagnostics.lastPlugins) == 0 {
 				continue
 			}
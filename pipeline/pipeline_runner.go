@@ -20,6 +20,7 @@ import (
 	"github.com/mozilla-services/heka/message"
 	"github.com/rafrombrc/go-notify"
 	"log"
+	"net"
 	"os"
 	"os/signal"
 	"path/filepath"
@@ -31,6 +32,8 @@ import (
 )
 
 const (
+	// Heka release version.
+	VERSION = "0.9.0"
 	// Control channel event types used by go-notify
 	RELOAD = "reload"
 	STOP   = "stop"
@@ -40,18 +43,51 @@ const (
 type GlobalConfigStruct struct {
 	MaxMsgProcessDuration uint64
 	PoolSize              int
-	PluginChanSize        int
-	MaxMsgLoops           uint
-	MaxMsgProcessInject   uint
-	MaxMsgTimerInject     uint
-	MaxPackIdle           time.Duration
-	stopping              bool
-	stoppingMutex         sync.RWMutex
-	BaseDir               string
-	ShareDir              string
-	SampleDenominator     int
-	sigChan               chan os.Signal
-	Hostname              string
+	// Size up to which the pack pools may grow under load, see PackPool.
+	// Values smaller than PoolSize give fixed size pools.
+	MaxPoolSize int
+	// Address of the Prometheus `/metrics` endpoint, disabled if empty.
+	MetricsAddress string
+	// Address of the admin API, see startAdminServer. Disabled if empty.
+	AdminAddress string
+	// Token the admin API's clients must send, none required if empty.
+	AdminToken string
+	// Whether messages that fail processing are routed as dead letters, see
+	// PipelineConfig.DeadLetter.
+	DeadLetter bool
+	// Whether plugin log output and Heka's own errors are routed as
+	// messages, see PipelineConfig.logPluginMessage.
+	PluginLogMessages   bool
+	PluginChanSize      int
+	MaxMsgLoops         uint
+	MaxMsgProcessInject uint
+	MaxMsgTimerInject   uint
+	MaxPackIdle         time.Duration
+	stopping            bool
+	stoppingMutex       sync.RWMutex
+	// Guards the settings that can be changed at runtime, see Tunables.
+	tuningMutex       sync.RWMutex
+	BaseDir           string
+	ShareDir          string
+	SampleDenominator int
+	sigChan           chan os.Signal
+	Hostname          string
+	// Whether LoadFromConfigDir includes nested directories.
+	RecursiveConfigDir bool
+	// Format used to parse every config file (e.g. "json"), overriding the
+	// format implied by each file's extension.
+	ConfigFormat string
+	// Sample rates of filters and outputs by plugin name, by sampling
+	// profile name, see PipelineConfig.SetSamplingProfile.
+	SamplingProfiles map[string]map[string]float64
+	// Name of the active sampling profile, empty for none. Guarded by the
+	// tuningMutex.
+	SamplingProfile string
+	// Signers whose `heka.control.sampling` messages are honored. Messages
+	// from any source are honored if empty.
+	SamplingControlSigners []string
+	// Severity tiers dropped under sustained overload, see loadShedder.
+	LoadShedding LoadSheddingConfig
 }
 
 // Creates a GlobalConfigStruct object populated w/ default values.
@@ -149,11 +185,32 @@ type PipelinePack struct {
 	// String id of the verified signer of the accompanying Message object, if
 	// any.
 	Signer string
+	// Schema identifier reported by the producer of the accompanying Message
+	// object, if any, e.g. in a TcpInput handshake. See the inputs' `schema`
+	// setting.
+	Schema string
 	// Number of times the current message chain has generated new messages
 	// and inserted them into the pipeline.
 	MsgLoopCount uint
 	// Used internally to stamp diagnostic information onto a packet
 	diagnostics *PacketTracking
+	// Event time bookkeeping for the input that delivered the pack, if any.
+	watermark *inputWatermark
+	// Id / sequence number stamping for the input that delivered the pack,
+	// if any.
+	stamper *inputStamper
+	// Processors of the input that delivered the pack, if any, used when the
+	// pack is decoded by a DecoderRunner.
+	processors *processorChain
+	// Delivery report bookkeeping, see TrackDelivery.
+	delivery        *deliveryTracker
+	deliveryRouted  bool
+	deliveryOutputs int32
+	// Per-extension data, see RegisterPackHooks.
+	hookData []interface{}
+	// Results of the matcher sub-expressions shared by several plugins,
+	// reset by the router.
+	matchCache message.MatchCache
 }
 
 // Returns a new PipelinePack pointer that will recycle itself onto the
@@ -163,7 +220,7 @@ func NewPipelinePack(recycleChan chan *PipelinePack) (pack *PipelinePack) {
 	message := &message.Message{}
 	message.SetSeverity(7)
 
-	return &PipelinePack{
+	pack = &PipelinePack{
 		MsgBytes:     msgBytes,
 		Message:      message,
 		RecycleChan:  recycleChan,
@@ -172,16 +229,23 @@ func NewPipelinePack(recycleChan chan *PipelinePack) (pack *PipelinePack) {
 		MsgLoopCount: uint(0),
 		diagnostics:  NewPacketTracking(),
 	}
+	pack.hookCreate()
+	return pack
 }
 
 // Reset a pack to its zero state.
 func (p *PipelinePack) Zero() {
+	p.finishDelivery()
 	p.MsgBytes = p.MsgBytes[:cap(p.MsgBytes)]
 	p.Decoded = false
 	p.RefCount = 1
 	p.MsgLoopCount = 0
 	p.Signer = ""
+	p.Schema = ""
 	p.diagnostics.Reset()
+	p.watermark = nil
+	p.stamper = nil
+	p.processors = nil
 
 	// TODO: Possibly zero the message instead depending on benchmark
 	// results of re-allocating a new message
@@ -193,6 +257,7 @@ func (p *PipelinePack) Zero() {
 func (p *PipelinePack) Recycle() {
 	cnt := atomic.AddInt32(&p.RefCount, -1)
 	if cnt == 0 {
+		p.hookRecycle()
 		p.Zero()
 		p.RecycleChan <- p
 	}
@@ -206,6 +271,7 @@ func Run(config *PipelineConfig) {
 
 	var outputsWg sync.WaitGroup
 	var err error
+	var inputsStarted bool
 
 	globals := config.Globals
 
@@ -240,28 +306,68 @@ func Run(config *PipelineConfig) {
 	config.reportRecycleChan <- NewPipelinePack(config.reportRecycleChan)
 
 	// Initialize all of the PipelinePacks that we'll need
-	for i := 0; i < globals.PoolSize; i++ {
-		inputPack := NewPipelinePack(config.inputRecycleChan)
-		inputTracker.AddPack(inputPack)
-		config.inputRecycleChan <- inputPack
-
-		injectPack := NewPipelinePack(config.injectRecycleChan)
-		injectTracker.AddPack(injectPack)
-		config.injectRecycleChan <- injectPack
-	}
+	config.inputPool.fill(inputTracker)
+	config.injectPool.fill(injectTracker)
 
 	go inputTracker.Run()
 	go injectTracker.Run()
+	go config.inputPool.run(globals)
+	go config.injectPool.run(globals)
+	if config.shedder != nil {
+		go config.shedder.run(globals)
+	}
 	config.router.Start()
+	config.watermarks.Start()
 
-	for name, input := range config.InputRunners {
-		config.inputsWg.Add(1)
-		if err = input.Start(config, &config.inputsWg); err != nil {
-			log.Printf("Input '%s' failed to start: %s", name, err)
-			config.inputsWg.Done()
-			continue
+	// Replaying a recording doesn't serve anything or wait for outputs.
+	replaying := config.replayer != nil
+
+	var metricsListener net.Listener
+	if globals.MetricsAddress != "" && !replaying {
+		if metricsListener, err = config.startMetricsServer(globals.MetricsAddress); err != nil {
+			log.Printf("Metrics endpoint failed to start: %s", err)
+		} else {
+			log.Printf("Metrics endpoint listening on %s", globals.MetricsAddress)
+		}
+	}
+
+	var adminListener net.Listener
+	if globals.AdminAddress != "" && !replaying {
+		adminListener, err = config.startAdminServer(globals.AdminAddress,
+			globals.AdminToken)
+		if err != nil {
+			log.Printf("Admin API failed to start: %s", err)
+		} else {
+			log.Printf("Admin API listening on %s", adminListener.Addr())
+		}
+	}
+
+	// Hold off on the inputs until any outputs with startup probes are ready
+	// for data.
+	if err = nil; !replaying {
+		err = config.waitForStartupProbes()
+	}
+	if err != nil {
+		log.Printf("Startup aborted: %s", err)
+		globals.stop()
+	} else {
+		inputsStarted = true
+		for name, input := range config.InputRunners {
+			config.inputsWg.Add(1)
+			if err = input.Start(config, &config.inputsWg); err != nil {
+				log.Printf("Input '%s' failed to start: %s", name, err)
+				config.inputsWg.Done()
+				if replaying {
+					// Nothing will be replayed for it.
+					config.replayer.replaying.Done()
+				}
+				continue
+			}
+			log.Printf("Input started: %s\n", name)
+		}
+		if replaying {
+			go config.replayer.finish(config)
 		}
-		log.Printf("Input started: %s\n", name)
 	}
 
 	// wait for sigint
@@ -286,12 +392,15 @@ func Run(config *PipelineConfig) {
 		}
 	}
 
-	config.inputsLock.Lock()
-	for _, input := range config.InputRunners {
-		input.Input().Stop()
-		log.Printf("Stop message sent to input '%s'", input.Name())
+	// Inputs that were never started don't need stopping.
+	if inputsStarted {
+		config.inputsLock.Lock()
+		for _, input := range config.InputRunners {
+			input.Input().Stop()
+			log.Printf("Stop message sent to input '%s'", input.Name())
+		}
+		config.inputsLock.Unlock()
 	}
-	config.inputsLock.Unlock()
 	config.inputsWg.Wait()
 
 	log.Println("Waiting for decoders shutdown")
@@ -321,6 +430,24 @@ func Run(config *PipelineConfig) {
 	}
 	outputsWg.Wait()
 
+	// Every message has been processed, record where the sequences stopped.
+	for _, input := range config.InputRunners {
+		if ir, ok := input.(*iRunner); ok && ir.stamper != nil {
+			if err = ir.stamper.close(); err != nil {
+				log.Printf("Input '%s' can't save sequence: %s", ir.name, err)
+			}
+		}
+	}
+
+	config.watermarks.Stop()
+
+	if metricsListener != nil {
+		metricsListener.Close()
+	}
+	if adminListener != nil {
+		adminListener.Close()
+	}
+
 	for name, encoder := range config.allEncoders {
 		if stopper, ok := encoder.(NeedsStopping); ok {
 			log.Printf("Stopping encoder '%s'", name)
@@ -57,6 +57,26 @@ type Filter interface {
 	Run(r FilterRunner, h PluginHelper) (err error)
 }
 
+// Can be implemented by Filters and Outputs that can process many messages at
+// once more efficiently than one at a time, e.g. with bulk lookups. Such
+// plugins should hand themselves to their runner's ProcessBatches method (see
+// BatchRunner) from their Run method, instead of reading from the runner's
+// InChan.
+type BatchProcessor interface {
+	// Processes a batch of one or more messages, recycling each pack when
+	// done with it. Packs are delivered individually while the plugin keeps
+	// up, and in batches of up to `max_batch_size` when a backlog of at least
+	// `batch_threshold` messages builds up. A non-nil error is logged, unless
+	// it's a fatal error (see NewFatalError), which stops the plugin.
+	ProcessMessages(packs []*PipelinePack) error
+}
+
+// Can be implemented by BatchProcessors with a `ticker_interval` to be
+// notified of each tick.
+type BatchTicker interface {
+	TimerEvent() error
+}
+
 // Heka Encoder plugin interface.
 type Encoder interface {
 	// Extract data from the provided pack / message and use it to generate a
@@ -70,6 +90,13 @@ type NeedsStopping interface {
 	Stop()
 }
 
+// Can be implemented by Encoders whose output format starts with a header,
+// e.g. the column names of CSV, so that outputs writing to files can start
+// each new file with it. Returns nil if there's no header to write.
+type HeaderEncoder interface {
+	Header() []byte
+}
+
 // Heka Output plugin type.
 type Output interface {
 	Run(or OutputRunner, h PluginHelper) (err error)
@@ -0,0 +1,91 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"fmt"
+	"path/filepath"
+	"plugin"
+	"sort"
+	"strings"
+)
+
+var (
+	// Shared object each plugin loaded with LoadPluginDirs came from, by
+	// plugin name. Plugins compiled into hekad aren't listed.
+	pluginSources = make(map[string]string)
+	// The shared object being loaded, while its init functions run.
+	loadingPluginFile string
+	// Names registered by the shared object being loaded that were already
+	// registered.
+	pluginConflicts []string
+)
+
+// Returns the shared object file the named plugin was loaded from, or an
+// empty string if the plugin is compiled into hekad.
+func PluginSource(name string) string {
+	return pluginSources[name]
+}
+
+// Loads the Go plugin packages (`.so` files) in each of the specified
+// directories, so plugins can be added without recompiling hekad. Each
+// package registers its plugins with RegisterPlugin from its init functions,
+// exactly like the packages compiled into hekad, and must be built against
+// the same version of Heka (and Go) as hekad. Returns the names of the
+// plugins loaded.
+func LoadPluginDirs(dirs []string) (loaded []string, err error) {
+	for _, dir := range dirs {
+		files, err := filepath.Glob(filepath.Join(dir, "*.so"))
+		if err != nil {
+			return loaded, err
+		}
+		// Glob returns the files sorted, so the load order is stable.
+		for _, file := range files {
+			names, err := LoadPluginFile(file)
+			loaded = append(loaded, names...)
+			if err != nil {
+				return loaded, err
+			}
+		}
+	}
+	return loaded, nil
+}
+
+// Loads a single Go plugin package, returning the names of the plugins it
+// registered. Plugins whose names are already registered are ignored and
+// reported in the error. Fails on platforms without plugin support, e.g. if
+// hekad was built without cgo.
+func LoadPluginFile(file string) (names []string, err error) {
+	before := make(map[string]bool, len(AvailablePlugins))
+	for name := range AvailablePlugins {
+		before[name] = true
+	}
+	loadingPluginFile, pluginConflicts = file, nil
+	_, err = plugin.Open(file)
+	conflicts := pluginConflicts
+	loadingPluginFile, pluginConflicts = "", nil
+	if err != nil {
+		return nil, fmt.Errorf("Error loading plugin file '%s': %s", file, err)
+	}
+
+	for name := range AvailablePlugins {
+		if !before[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	if len(conflicts) > 0 {
+		err = fmt.Errorf("Plugin file '%s' registers plugins that already exist: %s",
+			file, strings.Join(conflicts, ", "))
+	}
+	return names, err
+}
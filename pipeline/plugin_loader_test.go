@@ -0,0 +1,71 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+func PluginLoaderSpec(c gs.Context) {
+	c.Specify("The plugin loader", func() {
+		factory := func() interface{} { return new(TeeOutput) }
+
+		c.Specify("records where loaded plugins come from", func() {
+			loadingPluginFile = "/usr/lib/heka/test.so"
+			RegisterPlugin("LoadedTestOutput", factory)
+			loadingPluginFile = ""
+			defer func() {
+				delete(AvailablePlugins, "LoadedTestOutput")
+				delete(pluginSources, "LoadedTestOutput")
+			}()
+			_, ok := AvailablePlugins["LoadedTestOutput"]
+			c.Expect(ok, gs.IsTrue)
+			c.Expect(PluginSource("LoadedTestOutput"), gs.Equals, "/usr/lib/heka/test.so")
+			c.Expect(PluginSource("TeeOutput"), gs.Equals, "")
+		})
+
+		c.Specify("won't let plugin files replace existing plugins", func() {
+			RegisterPlugin("ExistingTestOutput", factory)
+			defer delete(AvailablePlugins, "ExistingTestOutput")
+			loadingPluginFile = "/usr/lib/heka/test.so"
+			RegisterPlugin("ExistingTestOutput", func() interface{} { return nil })
+			conflicts := pluginConflicts
+			loadingPluginFile, pluginConflicts = "", nil
+			c.Expect(len(conflicts), gs.Equals, 1)
+			c.Expect(conflicts[0], gs.Equals, "ExistingTestOutput")
+			c.Expect(AvailablePlugins["ExistingTestOutput"]() != nil, gs.IsTrue)
+			c.Expect(PluginSource("ExistingTestOutput"), gs.Equals, "")
+		})
+
+		dir, err := ioutil.TempDir("", "plugin_loader")
+		c.Assume(err, gs.IsNil)
+		defer os.RemoveAll(dir)
+
+		c.Specify("loads nothing from a directory without plugin files", func() {
+			err = ioutil.WriteFile(filepath.Join(dir, "README"), []byte("hi"), 0644)
+			c.Assume(err, gs.IsNil)
+			loaded, err := LoadPluginDirs([]string{dir})
+			c.Expect(err, gs.IsNil)
+			c.Expect(len(loaded), gs.Equals, 0)
+		})
+
+		c.Specify("reports invalid plugin files", func() {
+			err = ioutil.WriteFile(filepath.Join(dir, "bad.so"), []byte("not ELF"), 0644)
+			c.Assume(err, gs.IsNil)
+			_, err := LoadPluginDirs([]string{dir})
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+	})
+}
@@ -0,0 +1,83 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"code.google.com/p/go-uuid/uuid"
+	"github.com/mozilla-services/heka/message"
+	"sync/atomic"
+	"time"
+)
+
+// Message type of the messages carrying Heka's own errors and plugin log
+// output, see PipelineConfig.logPluginMessage.
+const PLUGIN_LOG_TYPE = "heka.plugin-log"
+
+// Maximum number of plugin log messages routed per second. Log lines over
+// the rate are still written to stderr.
+const PLUGIN_LOG_MAX_RATE = 100
+
+// Severities of plugin log messages, using the syslog levels.
+const (
+	pluginLogError = int32(3)
+	pluginLogInfo  = int32(6)
+)
+
+// If enabled with the `plugin_log_messages` global setting, routes a log line
+// written by a plugin, or by Heka itself, as a message with the type
+// PLUGIN_LOG_TYPE, so Heka's own errors can be filtered, alerted on and
+// shipped like any other log. The log line is the payload, the plugin's name
+// the logger, and the plugin's category is stored in the `PluginCategory`
+// field.
+//
+// Plugins log from the goroutines delivering messages to them, so logging
+// must never block: log lines are dropped when no inject pack is free or the
+// rate limit has been exceeded.
+func (pc *PipelineConfig) logPluginMessage(plugin, category string, severity int32,
+	text string) {
+
+	// Runners created outside of a running pipeline, e.g. in tests, have no
+	// config.
+	if pc == nil || !pc.Globals.PluginLogMessages || pc.Globals.IsShuttingDown() {
+		return
+	}
+	if !pc.pluginLogLimiter.allow() {
+		atomic.AddInt64(&pc.pluginLogDropped, 1)
+		return
+	}
+	var pack *PipelinePack
+	select {
+	case pack = <-pc.injectRecycleChan:
+	default:
+		atomic.AddInt64(&pc.pluginLogDropped, 1)
+		return
+	}
+	msg := pack.Message
+	msg.SetType(PLUGIN_LOG_TYPE)
+	msg.SetTimestamp(time.Now().UnixNano())
+	msg.SetUuid(uuid.NewRandom())
+	msg.SetHostname(pc.hostname)
+	msg.SetPid(pc.pid)
+	msg.SetLogger(plugin)
+	msg.SetSeverity(severity)
+	msg.SetPayload(text)
+	if category != "" {
+		message.NewStringField(msg, "PluginCategory", category)
+	}
+	pack.RefCount = 1
+	pack.MsgLoopCount = 1
+	atomic.AddInt64(&pc.pluginLogCount, 1)
+	// The router may be blocked delivering to the plugin that's logging.
+	go func() {
+		pc.router.InChan() <- pack
+	}()
+}
@@ -0,0 +1,84 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"errors"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"time"
+)
+
+func PluginLogSpec(c gs.Context) {
+	pc := NewPipelineConfig(nil)
+	pc.injectRecycleChan <- NewPipelinePack(pc.injectRecycleChan)
+
+	c.Specify("Plugin log messages", func() {
+		runner := &foRunner{kind: foOutput, pConfig: pc}
+		runner.name = "TestOutput"
+
+		c.Specify("aren't routed unless enabled", func() {
+			runner.LogError(errors.New("failed"))
+			c.Expect(len(pc.injectRecycleChan), gs.Equals, 1)
+			c.Expect(pc.pluginLogCount, gs.Equals, int64(0))
+		})
+
+		pc.Globals.PluginLogMessages = true
+
+		c.Specify("carry the plugin's errors", func() {
+			runner.LogError(errors.New("connection refused"))
+			msg := (<-pc.router.InChan()).Message
+			c.Expect(msg.GetType(), gs.Equals, PLUGIN_LOG_TYPE)
+			c.Expect(msg.GetLogger(), gs.Equals, "TestOutput")
+			c.Expect(msg.GetPayload(), gs.Equals, "connection refused")
+			c.Expect(msg.GetSeverity(), gs.Equals, int32(3))
+			category, _ := msg.GetFieldValue("PluginCategory")
+			c.Expect(category, gs.Equals, "Output")
+			c.Expect(pc.pluginLogCount, gs.Equals, int64(1))
+		})
+
+		c.Specify("carry informational log lines", func() {
+			ir := &iRunner{pConfig: pc}
+			ir.name = "TestInput"
+			ir.LogMessage("listening")
+			msg := (<-pc.router.InChan()).Message
+			c.Expect(msg.GetLogger(), gs.Equals, "TestInput")
+			c.Expect(msg.GetSeverity(), gs.Equals, int32(6))
+			category, _ := msg.GetFieldValue("PluginCategory")
+			c.Expect(category, gs.Equals, "Input")
+		})
+
+		c.Specify("carry config errors", func() {
+			pc.log("bad config")
+			msg := (<-pc.router.InChan()).Message
+			c.Expect(msg.GetLogger(), gs.Equals, HEKA_DAEMON)
+			c.Expect(msg.GetPayload(), gs.Equals, "bad config")
+			c.Expect(len(pc.LogMsgs), gs.Equals, 1)
+		})
+
+		c.Specify("are dropped rather than waiting for a pack", func() {
+			<-pc.injectRecycleChan
+			runner.LogMessage("hi")
+			c.Expect(pc.pluginLogDropped, gs.Equals, int64(1))
+			c.Expect(len(pc.router.InChan()), gs.Equals, 0)
+		})
+
+		c.Specify("are dropped over the rate limit", func() {
+			pc.pluginLogLimiter = newRateLimiter(1, 1)
+			pc.pluginLogLimiter.now = func() time.Time { return time.Unix(0, 0) }
+			pc.pluginLogLimiter.last = time.Unix(0, 0)
+			runner.LogMessage("one")
+			<-pc.router.InChan()
+			runner.LogMessage("two")
+			c.Expect(pc.pluginLogDropped, gs.Equals, int64(1))
+		})
+	})
+}
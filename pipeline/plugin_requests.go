@@ -0,0 +1,114 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Timeout of plugin requests made without one.
+const DefaultRequestTimeout = time.Second
+
+var (
+	ErrNoResponder     = errors.New("no plugin serving requests by that name")
+	ErrRequestTimedOut = errors.New("timed out waiting for a response")
+)
+
+// A request made by one plugin to another, e.g. to look up a value in a
+// cache maintained by a filter, see PipelineConfig.Request.
+type PluginRequest struct {
+	// Name of the requesting plugin, if provided.
+	From string
+	// The request itself, whose type the plugins agree on.
+	Body     interface{}
+	response chan pluginResponse
+}
+
+type pluginResponse struct {
+	value interface{}
+	err   error
+}
+
+// Sends the response to the request. Only the first response counts, and the
+// requester may have given up waiting already, so Respond never blocks.
+func (r *PluginRequest) Respond(value interface{}, err error) {
+	select {
+	case r.response <- pluginResponse{value, err}:
+	default:
+	}
+}
+
+// Starts serving requests under the specified name, usually the serving
+// plugin's own. Returns the channel on which requests are received, which the
+// plugin must read from its own goroutine, e.g. alongside its InChan, so no
+// locking is needed to serve them from the plugin's state. Every request
+// received must be answered with Respond. Fails if another plugin is already
+// serving requests by that name.
+func (self *PipelineConfig) ServeRequests(name string) (<-chan *PluginRequest, error) {
+	self.respondersLock.Lock()
+	defer self.respondersLock.Unlock()
+	if _, ok := self.responders[name]; ok {
+		return nil, fmt.Errorf("requests to '%s' are already being served", name)
+	}
+	requests := make(chan *PluginRequest, self.Globals.Tunables().PluginChanSize)
+	self.responders[name] = requests
+	return requests, nil
+}
+
+// Stops serving requests under the specified name, e.g. when the serving
+// plugin exits. Requests already queued are left unanswered, so they time
+// out.
+func (self *PipelineConfig) StopServingRequests(name string) {
+	self.respondersLock.Lock()
+	delete(self.responders, name)
+	self.respondersLock.Unlock()
+}
+
+// Sends a request to the plugin serving requests under the specified name and
+// waits for its response, at most `timeout` in all, or DefaultRequestTimeout
+// if zero. The error is ErrNoResponder if no plugin serves requests by that
+// name, ErrRequestTimedOut if the timeout runs out, and otherwise the error
+// the serving plugin responded with. `from` identifies the requesting plugin
+// to the serving one, and may be empty.
+func (self *PipelineConfig) Request(name, from string, body interface{},
+	timeout time.Duration) (interface{}, error) {
+
+	self.respondersLock.RLock()
+	requests, ok := self.responders[name]
+	self.respondersLock.RUnlock()
+	if !ok {
+		return nil, ErrNoResponder
+	}
+	if timeout == 0 {
+		timeout = DefaultRequestTimeout
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	req := &PluginRequest{
+		From:     from,
+		Body:     body,
+		response: make(chan pluginResponse, 1),
+	}
+	select {
+	case requests <- req:
+	case <-timer.C:
+		return nil, ErrRequestTimedOut
+	}
+	select {
+	case resp := <-req.response:
+		return resp.value, resp.err
+	case <-timer.C:
+		return nil, ErrRequestTimedOut
+	}
+}
@@ -0,0 +1,72 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"errors"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"time"
+)
+
+func PluginRequestSpec(c gs.Context) {
+	c.Specify("Plugin requests", func() {
+		pConfig := NewPipelineConfig(nil)
+		requests, err := pConfig.ServeRequests("cache")
+		c.Assume(err, gs.IsNil)
+		cache := map[string]string{"host1": "web"}
+		done := make(chan bool)
+		serve := func() {
+			for req := range requests {
+				value, ok := cache[req.Body.(string)]
+				if ok {
+					req.Respond(value, nil)
+				} else {
+					req.Respond(nil, errors.New("not found: "+req.From))
+				}
+			}
+			close(done)
+		}
+
+		c.Specify("are answered by the serving plugin", func() {
+			go serve()
+			value, err := pConfig.Request("cache", "lookup", "host1", 0)
+			c.Expect(err, gs.IsNil)
+			c.Expect(value, gs.Equals, "web")
+
+			_, err = pConfig.Request("cache", "lookup", "host2", 0)
+			c.Expect(err.Error(), gs.Equals, "not found: lookup")
+			close(pConfig.responders["cache"])
+			<-done
+		})
+
+		c.Specify("fail without a serving plugin", func() {
+			_, err := pConfig.Request("other", "", "host1", 0)
+			c.Expect(err, gs.Equals, ErrNoResponder)
+			pConfig.StopServingRequests("cache")
+			_, err = pConfig.Request("cache", "", "host1", 0)
+			c.Expect(err, gs.Equals, ErrNoResponder)
+		})
+
+		c.Specify("time out if unanswered", func() {
+			_, err := pConfig.Request("cache", "", "host1", 10*time.Millisecond)
+			c.Expect(err, gs.Equals, ErrRequestTimedOut)
+			// A late response is discarded.
+			req := <-requests
+			req.Respond("web", nil)
+		})
+
+		c.Specify("are only served by one plugin per name", func() {
+			_, err := pConfig.ServeRequests("cache")
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+	})
+}
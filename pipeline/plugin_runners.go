@@ -22,7 +22,9 @@ import (
 	"github.com/mozilla-services/heka/client"
 	"github.com/mozilla-services/heka/message"
 	"log"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -66,6 +68,7 @@ type pRunnerBase struct {
 	h         PluginHelper
 	leakCount int
 	maker     PluginMaker
+	debug     runnerDebugState
 }
 
 func (pr *pRunnerBase) Name() string {
@@ -88,6 +91,10 @@ func (pr *pRunnerBase) LeakCount() int {
 	return pr.leakCount
 }
 
+func (pr *pRunnerBase) debugState() *runnerDebugState {
+	return &pr.debug
+}
+
 // AddDecodeFailureFields adds two fields to the provided message object. The
 // first field is a boolean field called `decode_failure`, set to true. The
 // second is a string field called `decode_error` which will contain the
@@ -163,6 +170,16 @@ type iRunner struct {
 	useMsgBytes        bool
 	dRunner            DecoderRunner
 	decoder            Decoder
+	watermark          *inputWatermark
+	charset            *charsetTranscoder
+	stamper            *inputStamper
+	processors         *processorChain
+	limiter            *rateLimiter
+	// Messages delivered by the input, and those of them that failed decoding
+	// or were dropped before reaching a decoder or the router.
+	deliverCount    int64
+	decodeFailCount int64
+	dropCount       int64
 }
 
 func (ir *iRunner) Ticker() (ticker <-chan time.Time) {
@@ -187,8 +204,9 @@ func NewInputRunner(name string, input Input, config CommonInputConfig) (ir Inpu
 			name:   name,
 			plugin: input.(Plugin),
 		},
-		input:  input,
-		config: config,
+		input:   input,
+		config:  config,
+		limiter: newRateLimiter(config.MaxMsgsPerSec, config.Burst),
 	}
 	if config.SyncDecode != nil {
 		runner.syncDecode = *config.SyncDecode
@@ -217,6 +235,33 @@ func (ir *iRunner) Start(h PluginHelper, wg *sync.WaitGroup) (err error) {
 		ir.ticker = time.Tick(tickLength)
 	}
 
+	if !ir.transient {
+		delay := time.Duration(ir.config.WatermarkDelay) * time.Second
+		ir.watermark = ir.pConfig.watermarks.registerInput(ir.name, delay)
+	}
+
+	if ir.stamper == nil {
+		// Only created once, the sequence must survive plugin restarts.
+		if ir.stamper, err = newInputStamper(ir.name, ir.config,
+			ir.pConfig.Globals); err != nil {
+			return fmt.Errorf("%s: %s", ir.name, err)
+		}
+	}
+
+	if ir.config.Charset != "" {
+		if ir.charset, err = newCharsetTranscoder(ir.config.Charset,
+			ir.config.CharsetPolicy); err != nil {
+			return fmt.Errorf("%s: %s", ir.name, err)
+		}
+	}
+
+	if ir.processors == nil {
+		if ir.processors, err = newProcessorChain(ir.pConfig, ir.name,
+			ir.config.Processors); err != nil {
+			return fmt.Errorf("%s: %s", ir.name, err)
+		}
+	}
+
 	if ownDecoding, ok := ir.input.(DoesOwnDecoding); ok {
 		ownDecoding.SetCommonInputConfig(ir.config)
 	} else if ir.decoder == nil && ir.dRunner == nil && ir.config.Decoder != "" {
@@ -254,8 +299,12 @@ func (ir *iRunner) Start(h PluginHelper, wg *sync.WaitGroup) (err error) {
 	return
 }
 
+// How often an input checks for shutdown during its warm up delay.
+var warmUpInterval = 100 * time.Millisecond
+
 func (ir *iRunner) Starter(h PluginHelper, wg *sync.WaitGroup) {
 	defer wg.Done()
+	labelPluginGoroutine(ir.name)
 
 	globals := ir.pConfig.Globals
 	rh, err := NewRetryHelper(ir.config.Retries)
@@ -265,6 +314,13 @@ func (ir *iRunner) Starter(h PluginHelper, wg *sync.WaitGroup) {
 		return
 	}
 
+	// Give the rest of the pipeline, or whatever the input consumes from,
+	// time to get going before consuming.
+	warmUpEnd := time.Now().Add(time.Duration(ir.config.WarmUpDelay) * time.Second)
+	for !globals.IsShuttingDown() && time.Now().Before(warmUpEnd) {
+		time.Sleep(warmUpInterval)
+	}
+
 	for !globals.IsShuttingDown() {
 		// ir.Input().Run() shouldn't return unless error or shutdown.
 		if err := ir.input.Run(ir, h); err != nil {
@@ -312,15 +368,38 @@ func (ir *iRunner) Starter(h PluginHelper, wg *sync.WaitGroup) {
 }
 
 func (ir *iRunner) Inject(pack *PipelinePack) {
+	if ir.limiter != nil {
+		ir.limiter.wait()
+	}
+	if ir.pConfig.recorder != nil {
+		ir.pConfig.recorder.recordInput(ir.name, recordedInject, pack, false)
+	}
+	ir.inject(pack)
+}
+
+func (ir *iRunner) inject(pack *PipelinePack) {
+	if pack.watermark == nil {
+		pack.watermark = ir.watermark
+	}
+	if pack.stamper == nil {
+		pack.stamper = ir.stamper
+	}
+	if ir.processors != nil && !ir.processors.process(pack, ir.sendDecodeFailures,
+		ir.LogError) {
+		return
+	}
 	ir.pConfig.router.InChan() <- pack
 }
 
 func (ir *iRunner) LogError(err error) {
+	ir.debug.errorLogged(err)
 	log.Printf("Input '%s' error: %s", ir.name, err)
+	ir.pConfig.logPluginMessage(ir.name, "Input", pluginLogError, err.Error())
 }
 
 func (ir *iRunner) LogMessage(msg string) {
 	log.Printf("Input '%s': %s", ir.name, msg)
+	ir.pConfig.logPluginMessage(ir.name, "Input", pluginLogInfo, msg)
 }
 
 func (ir *iRunner) UseMsgBytes() bool {
@@ -328,34 +407,82 @@ func (ir *iRunner) UseMsgBytes() bool {
 }
 
 func (ir *iRunner) Deliver(pack *PipelinePack) {
+	if ir.limiter != nil {
+		ir.limiter.wait()
+	}
+	atomic.AddInt64(&ir.deliverCount, 1)
+	if ir.pConfig.recorder != nil {
+		ir.pConfig.recorder.recordInput(ir.name, recordedDeliver, pack, ir.useMsgBytes)
+	}
+	pack.watermark = ir.watermark
+	pack.stamper = ir.stamper
+	if ir.charset != nil && !ir.useMsgBytes {
+		if err := ir.charset.transcodePayload(pack.Message); err != nil {
+			errMsg := fmt.Sprintf("charset error: %s", err)
+			ir.LogError(errors.New(errMsg))
+			atomic.AddInt64(&ir.decodeFailCount, 1)
+			if !ir.sendDecodeFailures {
+				atomic.AddInt64(&ir.dropCount, 1)
+				ir.pConfig.deadLetter(pack, DeadLetterDecode, ir.name, errors.New(errMsg),
+					nil)
+				pack.resolveDelivery(errors.New(errMsg))
+				pack.Recycle()
+				return
+			}
+			if err = AddDecodeFailureFields(pack.Message, errMsg); err != nil {
+				ir.LogError(err)
+			}
+			ir.inject(pack)
+			return
+		}
+	}
 	if ir.decoder == nil {
 		// No decoder, hand it right to the router.
-		ir.Inject(pack)
+		ir.inject(pack)
 		return
 	}
 	// If we get this far we have a decoder.
 	if ir.syncDecode {
+		// The decoder may replace the pack, so its delivery tracker is held
+		// here and handed on to the resulting packs.
+		delivery := pack.takeDelivery()
 		packs, err := ir.decoder.Decode(pack)
 		if err != nil {
 			errMsg := err.Error()
 			ir.LogError(fmt.Errorf("decode error: %s", errMsg))
+			atomic.AddInt64(&ir.decodeFailCount, 1)
 			if !ir.sendDecodeFailures {
+				atomic.AddInt64(&ir.dropCount, 1)
+				var raw []byte
+				if ir.useMsgBytes {
+					raw = pack.MsgBytes
+				}
+				ir.pConfig.deadLetter(pack, DeadLetterDecode, ir.name, err, raw)
+				delivery.done(fmt.Errorf("decode error: %s", errMsg))
 				pack.Recycle()
 				return
 			}
 			if err = AddDecodeFailureFields(pack.Message, errMsg); err != nil {
 				ir.LogError(err)
 			}
-			ir.Inject(pack)
+			delivery.attach(pack)
+			delivery.done(nil)
+			ir.inject(pack)
 			return
 		}
+		delivery.attach(packs...)
+		delivery.done(nil)
 		for _, p := range packs {
-			ir.Inject(p)
+			if p.Schema == "" {
+				p.Signer, p.Schema = pack.Signer, pack.Schema
+			}
+			ir.inject(p)
 		}
 		return
 	}
 	// If we get this far we're not synchronously decoding, just drop the pack
 	// on the DecoderRunner input channel.
+	pack.processors = ir.processors
 	ir.dRunner.InChan() <- pack
 }
 
@@ -386,9 +513,13 @@ type DecoderRunner interface {
 type dRunner struct {
 	pRunnerBase
 	inChan      chan *PipelinePack
+	pConfig     *PipelineConfig
 	router      *messageRouter
 	h           PluginHelper
 	sendFailure bool
+	// Messages that failed decoding, and those of them that were dropped.
+	decodeFailCount int64
+	dropCount       int64
 }
 
 // Creates and returns a new (but not yet started) DecoderRunner for the
@@ -409,7 +540,8 @@ func (dr *dRunner) Decoder() Decoder {
 
 func (dr *dRunner) Start(h PluginHelper, wg *sync.WaitGroup) {
 	dr.h = h
-	dr.router = h.PipelineConfig().router
+	dr.pConfig = h.PipelineConfig()
+	dr.router = dr.pConfig.router
 	go dr.start(h, wg)
 }
 
@@ -419,25 +551,53 @@ func (dr *dRunner) start(h PluginHelper, wg *sync.WaitGroup) {
 		packs []*PipelinePack
 		err   error
 	)
+	labelPluginGoroutine(dr.name)
 	if wanter, ok := dr.Decoder().(WantsDecoderRunner); ok {
 		wanter.SetDecoderRunner(dr)
 	}
 	for pack = range dr.inChan {
+		// The decoder may replace the pack, so its delivery tracker is held
+		// here and handed on to the resulting packs.
+		delivery := pack.takeDelivery()
 		if packs, err = dr.Decoder().Decode(pack); packs != nil {
+			delivery.attach(packs...)
+			delivery.done(nil)
 			for _, p := range packs {
+				// Extra packs from the decoder belong to the same input.
+				if p.stamper == nil {
+					p.stamper = pack.stamper
+				}
+				if p.Schema == "" {
+					p.Signer, p.Schema = pack.Signer, pack.Schema
+				}
+				if p.processors == nil {
+					p.processors = pack.processors
+				}
+				if p.processors != nil && !p.processors.process(p, dr.sendFailure,
+					dr.LogError) {
+					continue
+				}
 				dr.router.InChan() <- p
 			}
 		} else {
 			if err != nil {
 				dr.LogError(err)
+				atomic.AddInt64(&dr.decodeFailCount, 1)
 				if dr.sendFailure {
 					if err = AddDecodeFailureFields(pack.Message, err.Error()); err != nil {
 						dr.LogError(err)
 					}
+					delivery.attach(pack)
+					delivery.done(nil)
 					dr.router.InChan() <- pack
 					continue
 				}
 			}
+			if err != nil {
+				atomic.AddInt64(&dr.dropCount, 1)
+				dr.pConfig.DeadLetter(pack, DeadLetterDecode, dr.name, err)
+			}
+			delivery.done(err)
 			pack.Recycle()
 			continue
 		}
@@ -462,11 +622,14 @@ func (dr *dRunner) NewPack() *PipelinePack {
 }
 
 func (dr *dRunner) LogError(err error) {
+	dr.debug.errorLogged(err)
 	log.Printf("Decoder '%s' error: %s", dr.name, err)
+	dr.pConfig.logPluginMessage(dr.name, "Decoder", pluginLogError, err.Error())
 }
 
 func (dr *dRunner) LogMessage(msg string) {
 	log.Printf("Decoder '%s': %s", dr.name, msg)
+	dr.pConfig.logPluginMessage(dr.name, "Decoder", pluginLogInfo, msg)
 }
 
 func (dr *dRunner) SetSendFailure(sendFailure bool) {
@@ -514,6 +677,30 @@ type FilterRunner interface {
 	RetainPack(pack *PipelinePack)
 }
 
+// Implemented by FilterRunners and OutputRunners that can deliver messages in
+// batches. BatchProcessors check for it with a type assertion.
+type BatchRunner interface {
+	// Delivers incoming messages to the provided BatchProcessor (normally the
+	// plugin itself) until the input channel is closed. Meant to be called
+	// from the plugin's Run method in place of reading from InChan.
+	ProcessBatches(bp BatchProcessor) (err error)
+}
+
+// Implemented by FilterRunners that track event time, for filters that
+// aggregate over event time windows. Filters check for it with a type
+// assertion.
+type WindowRunner interface {
+	// Returns a channel on which each completed event time window will be
+	// delivered exactly once, if the filter's window_interval config value
+	// was provided, or nil otherwise. Windows the filter doesn't read in time
+	// are dropped.
+	Windows() <-chan Window
+	// Returns the pipeline-wide low watermark, i.e. the event time (in
+	// nanoseconds since the UNIX epoch) before which any incoming message
+	// should be considered late.
+	Watermark() int64
+}
+
 // Heka PluginRunner for Output plugins.
 type OutputRunner interface {
 	PluginRunner
@@ -548,6 +735,14 @@ type OutputRunner interface {
 	UsesFraming() bool
 	// Allows an output to specify whether or not it's using framing.
 	SetUseFraming(useFraming bool)
+	// Handles a failure to deliver the provided pack according to the
+	// error's OutputErrorKind. Returns true if delivery of the pack should be
+	// retried, after blocking for any required backoff. Retryable and
+	// throttled failures share the pack's retries, and aren't retried once
+	// Heka is shutting down. If false is returned the pack has already been
+	// recycled; for fatal errors the output should then return the error from
+	// its Run method.
+	HandleFailure(pack *PipelinePack, err error) (retry bool)
 }
 
 type foRunnerKind int
@@ -568,6 +763,11 @@ func (kind foRunnerKind) String() string {
 	return "unknown"
 }
 
+// Delivery attempts per pack when the output's `retries` settings allow
+// unlimited retries, so a destination that keeps failing or throttling
+// can't wedge the output.
+const defaultDeliveryRetries = 10
+
 // This one struct provides the implementation of both FilterRunner and
 // OutputRunner interfaces.
 type foRunner struct {
@@ -576,6 +776,7 @@ type foRunner struct {
 	config     CommonFOConfig
 	matcher    *MatchRunner
 	ticker     <-chan time.Time
+	windows    <-chan Window // filter only
 	inChan     chan *PipelinePack
 	h          PluginHelper
 	retainPack *PipelinePack
@@ -586,6 +787,25 @@ type foRunner struct {
 	kind       foRunnerKind
 	pConfig    *PipelineConfig
 	lastErr    error
+	// Output failure handling, see HandleFailure.
+	failureRetry  *RetryHelper
+	failedPack    *PipelinePack
+	retryCount    int64
+	throttleCount int64
+	dropCount     int64
+	startupProbe  *startupProbe // output only
+	batchChan     chan []*PipelinePack
+	buffer        *diskBuffer
+	limiter       *rateLimiter
+	// Output only, see the `max_buffer_age` setting.
+	maxAge       time.Duration
+	expiredCount int64
+	// Output only, see the `max_record_size` setting.
+	sizeLimit *recordSizeLimit
+	// Output only, see the `timestamp_rewrite` setting.
+	tsRewriter *timestampRewriter
+	// Output only, see the `ordering_key` setting.
+	ordering *orderingGate
 }
 
 // Creates and returns foRunner pointer for use as either a FilterRunner or an
@@ -600,6 +820,7 @@ func NewFORunner(name string, plugin Plugin, config CommonFOConfig,
 		},
 		pluginType: pluginType,
 		config:     config,
+		limiter:    newRateLimiter(config.MaxMsgsPerSec, config.Burst),
 	}
 	runner.inChan = make(chan *PipelinePack, chanSize)
 
@@ -613,6 +834,12 @@ func NewFORunner(name string, plugin Plugin, config CommonFOConfig,
 	}
 	runner.matcher = matcher
 
+	if config.SampleRate < 0 || config.SampleRate > 100 {
+		return nil, fmt.Errorf("'%s' sample_rate must be between 0 and 100", name)
+	}
+	matcher.configuredRate = config.SampleRate
+	matcher.setSampleRate(config.SampleRate)
+
 	if config.UseFraming != nil && *config.UseFraming {
 		runner.useFraming = true
 	}
@@ -627,6 +854,69 @@ func NewFORunner(name string, plugin Plugin, config CommonFOConfig,
 		return nil, err
 	}
 
+	if _, ok := plugin.(BatchProcessor); ok {
+		runner.batchChan = make(chan []*PipelinePack, 1)
+	}
+
+	if err = validateBuffering(config.Buffering, config.Buffer); err != nil {
+		return nil, fmt.Errorf("'%s' %s", name, err)
+	}
+
+	if config.LazyConnect && runner.kind != foOutput {
+		return nil, fmt.Errorf("'%s' lazy_connect is only supported by outputs", name)
+	}
+
+	if config.StartupProbe.Type != "" {
+		if runner.kind != foOutput {
+			return nil, fmt.Errorf("'%s' startup_probe is only supported by outputs", name)
+		}
+		if runner.startupProbe, err = newStartupProbe(config.StartupProbe, plugin); err != nil {
+			return nil, fmt.Errorf("'%s' invalid startup_probe: %s", name, err)
+		}
+	}
+
+	if config.MaxBufferAge != "" {
+		if runner.kind != foOutput {
+			return nil, fmt.Errorf("'%s' max_buffer_age is only supported by outputs", name)
+		}
+		if runner.maxAge, err = time.ParseDuration(config.MaxBufferAge); err != nil {
+			return nil, fmt.Errorf("'%s' invalid max_buffer_age: %s", name, err)
+		}
+	}
+
+	if config.MaxRecordSize != 0 {
+		if runner.kind != foOutput {
+			return nil, fmt.Errorf("'%s' max_record_size is only supported by outputs", name)
+		}
+		if err = validateOversizePolicy(config.OversizePolicy); err != nil {
+			return nil, fmt.Errorf("'%s' %s", name, err)
+		}
+		runner.sizeLimit = newRecordSizeLimit(config.MaxRecordSize,
+			config.OversizePolicy, config.TruncateField)
+	}
+
+	if runner.tsRewriter, err = newTimestampRewriter(config.TimestampRewrite); err != nil {
+		return nil, fmt.Errorf("'%s' invalid timestamp_rewrite: %s", name, err)
+	}
+	if runner.tsRewriter != nil && runner.kind != foOutput {
+		return nil, fmt.Errorf("'%s' timestamp_rewrite is only supported by outputs", name)
+	}
+
+	if config.OrderingKey != "" {
+		if runner.kind != foOutput {
+			return nil, fmt.Errorf("'%s' ordering_key is only supported by outputs", name)
+		}
+		if config.Buffering == "disk" && config.Buffer.DrainOrder != "" &&
+			config.Buffer.DrainOrder != "oldest_first" {
+			return nil, fmt.Errorf("'%s' ordering_key requires the oldest_first buffer drain_order",
+				name)
+		}
+		if runner.ordering, err = newOrderingGate(config.OrderingKey, runner,
+			chanSize); err != nil {
+			return nil, fmt.Errorf("'%s' can't create ordering gate: %s", name, err)
+		}
+	}
+
 	return runner, nil
 }
 
@@ -647,6 +937,12 @@ func (foRunner *foRunner) Start(h PluginHelper, wg *sync.WaitGroup) (err error)
 		foRunner.ticker = time.Tick(tickLength)
 	}
 
+	if foRunner.config.Window != 0 && foRunner.kind == foFilter {
+		interval := time.Duration(foRunner.config.Window) * time.Second
+		foRunner.windows = foRunner.pConfig.watermarks.Subscribe(foRunner.name,
+			interval)
+	}
+
 	if foRunner.config.Encoder != "" {
 		fullName := fmt.Sprintf("%s-%s", foRunner.name, foRunner.config.Encoder)
 		encoder, ok := foRunner.pConfig.Encoder(foRunner.config.Encoder, fullName)
@@ -657,6 +953,14 @@ func (foRunner *foRunner) Start(h PluginHelper, wg *sync.WaitGroup) (err error)
 		foRunner.encoder = encoder
 	}
 
+	if foRunner.config.Buffering == "disk" && foRunner.buffer == nil {
+		foRunner.buffer, err = newDiskBuffer(foRunner.name, foRunner.config.Buffer,
+			cap(foRunner.inChan), foRunner, foRunner.pConfig.Globals, foRunner.LogError)
+		if err != nil {
+			return fmt.Errorf("%s can't create disk buffer: %s", foRunner.name, err)
+		}
+	}
+
 	if foRunner.matcher != nil {
 		switch foRunner.kind {
 		case foFilter:
@@ -677,10 +981,19 @@ func (foRunner *foRunner) IsStoppable() bool {
 func (foRunner *foRunner) Unregister(pConfig *PipelineConfig) error {
 	switch foRunner.kind {
 	case foFilter:
+		pConfig.watermarks.Unsubscribe(foRunner.Name())
 		go pConfig.RemoveFilterRunner(foRunner.Name())
 	case foOutput:
 		go pConfig.RemoveOutputRunner(foRunner)
 	}
+	if foRunner.batchChan != nil {
+		for batch := range foRunner.batchChan {
+			for _, pack := range batch {
+				pack.Recycle()
+			}
+		}
+		return nil
+	}
 	for pack := range foRunner.inChan {
 		pack.Recycle()
 	}
@@ -737,8 +1050,50 @@ func (foRunner *foRunner) exit() {
 	foRunner.pConfig.router.inChan <- pack
 }
 
+// Counts a message dropped for being older than the max_buffer_age or its
+// TTL, sending it as a dead letter if configured to. The matcher recycles the
+// pack.
+func (foRunner *foRunner) expire(pack *PipelinePack) {
+	atomic.AddInt64(&foRunner.expiredCount, 1)
+	if foRunner.config.DeadLetterExpired {
+		err := ErrExpired
+		if !ttlElapsed(pack.Message) {
+			err = fmt.Errorf("message older than max_buffer_age of %s", foRunner.maxAge)
+		}
+		foRunner.pConfig.DeadLetter(pack, DeadLetterOutput, foRunner.name, err)
+	}
+}
+
+// Starts an additional matcher feeding the runner's plugin, e.g. for a
+// TeeOutput. Matches are delivered the way the runner's own matcher delivers
+// them, but the plugin's input isn't closed when the additional matcher's
+// input is.
+func (foRunner *foRunner) startFeed(mr *MatchRunner, sampleDenom int) {
+	var deliver func(pack *PipelinePack)
+	switch {
+	case foRunner.buffer != nil:
+		deliver = func(pack *PipelinePack) {
+			foRunner.buffer.inChan <- pack
+		}
+	case foRunner.ordering != nil:
+		deliver = func(pack *PipelinePack) {
+			foRunner.ordering.inChan <- pack
+		}
+	case foRunner.batchChan != nil:
+		deliver = func(pack *PipelinePack) {
+			foRunner.batchChan <- []*PipelinePack{pack}
+		}
+	default:
+		deliver = func(pack *PipelinePack) {
+			foRunner.inChan <- pack
+		}
+	}
+	go mr.run(sampleDenom, deliver, nil, func() {})
+}
+
 func (foRunner *foRunner) Starter(helper PluginHelper, wg *sync.WaitGroup) {
 	defer wg.Done()
+	labelPluginGoroutine(foRunner.name)
 
 	var err error
 	globals := foRunner.pConfig.Globals
@@ -751,13 +1106,53 @@ func (foRunner *foRunner) Starter(helper PluginHelper, wg *sync.WaitGroup) {
 	}
 
 	if foRunner.matcher != nil {
-		sampleDenom := globals.SampleDenominator
-		foRunner.matcher.Start(foRunner.inChan, sampleDenom)
+		foRunner.pConfig.applySamplingProfileTo(foRunner.name, foRunner.matcher)
+		sampleDenom := globals.Tunables().SampleDenominator
+		// Messages over the rate limit are dropped where the router delivers
+		// them, but those already in a disk buffer are paced on their way
+		// out of it instead.
+		if foRunner.buffer != nil {
+			foRunner.buffer.replay.limiter = foRunner.limiter
+			foRunner.buffer.replay.pace = true
+		} else {
+			foRunner.matcher.limiter = foRunner.limiter
+		}
+		// With a disk buffer the router's matches go to the buffer, and the
+		// buffer's replay matcher feeds the plugin.
+		matcher := foRunner.matcher
+		if foRunner.buffer != nil {
+			foRunner.matcher.Start(foRunner.buffer.inChan, sampleDenom)
+			foRunner.buffer.start()
+			matcher = foRunner.buffer.replay
+		}
+		// Likewise with an ordering gate, which comes after any buffer.
+		if foRunner.ordering != nil {
+			matcher.Start(foRunner.ordering.inChan, sampleDenom)
+			foRunner.ordering.start()
+			matcher = foRunner.ordering.replay
+		}
+		// The max age and message TTLs apply to what the plugin receives,
+		// after any buffer or ordering gate.
+		if foRunner.kind == foOutput {
+			matcher.maxAge = foRunner.maxAge
+			matcher.checkTTL = true
+			matcher.expire = foRunner.expire
+		}
+		if foRunner.batchChan != nil {
+			matcher.StartBatches(foRunner.batchChan, sampleDenom,
+				int(foRunner.config.BatchThreshold), int(foRunner.config.MaxBatchSize))
+		} else {
+			matcher.Start(foRunner.inChan, sampleDenom)
+		}
 	}
 
 	// Handle the cleanup
 	defer foRunner.exit()
 
+	if foRunner.config.LazyConnect && !foRunner.lazyInit(rh) {
+		return
+	}
+
 	for !globals.IsShuttingDown() {
 		// `Run` method only returns if there's an error or we're shutting
 		// down.
@@ -785,6 +1180,11 @@ func (foRunner *foRunner) Starter(helper PluginHelper, wg *sync.WaitGroup) {
 			break
 		}
 
+		// Restarting won't fix a fatal error.
+		if err != nil && ClassifyError(err) == ErrKindFatal {
+			break
+		}
+
 		// We stop and let this quit if its not a restarting plugin.
 		recon, ok := foRunner.plugin.(Restarting)
 		if !ok {
@@ -817,6 +1217,109 @@ func (foRunner *foRunner) Starter(helper PluginHelper, wg *sync.WaitGroup) {
 	}
 }
 
+// How often an output with `lazy_connect` set checks for its first message.
+var lazyInitInterval = 100 * time.Millisecond
+
+// Initializes an output with `lazy_connect` set once its first message is
+// waiting, retrying failures according to the retry options. Returns false
+// if the plugin wasn't initialized, because of shutdown or because the
+// retries were used up.
+func (foRunner *foRunner) lazyInit(rh *RetryHelper) bool {
+	globals := foRunner.pConfig.Globals
+	for len(foRunner.inChan) == 0 &&
+		(foRunner.batchChan == nil || len(foRunner.batchChan) == 0) {
+
+		if globals.IsShuttingDown() {
+			return false
+		}
+		time.Sleep(lazyInitInterval)
+	}
+	if foRunner.maker == nil {
+		foRunner.maker = foRunner.pConfig.makers["Output"][foRunner.name]
+	}
+	for {
+		err := foRunner.plugin.Init(foRunner.maker.Config())
+		if err == nil {
+			rh.Reset()
+			return true
+		}
+		foRunner.LogError(fmt.Errorf("initialization failed: %s", err))
+		if globals.IsShuttingDown() {
+			return false
+		}
+		if err = rh.Wait(); err != nil {
+			foRunner.lastErr = err
+			foRunner.LogError(err)
+			return false
+		}
+	}
+}
+
+func (foRunner *foRunner) HandleFailure(pack *PipelinePack, err error) bool {
+	kind := ClassifyError(err)
+	foRunner.LogError(fmt.Errorf("%s delivery failure: %s", kind, err))
+	foRunner.debug.deliveryFailed(pack, err)
+
+	switch kind {
+	case ErrKindRetryable, ErrKindThrottled:
+		if foRunner.pConfig != nil && foRunner.pConfig.Globals.IsShuttingDown() {
+			foRunner.LogError(fmt.Errorf("shutting down, dropping message"))
+			break
+		}
+		var retryAfter time.Duration
+		if kind == ErrKindThrottled {
+			retryAfter = time.Second
+			if oErr, ok := err.(*OutputError); ok && oErr.RetryAfter > 0 {
+				retryAfter = oErr.RetryAfter
+			}
+		}
+		if foRunner.retryDelivery(pack, retryAfter) {
+			if kind == ErrKindThrottled {
+				atomic.AddInt64(&foRunner.throttleCount, 1)
+			} else {
+				atomic.AddInt64(&foRunner.retryCount, 1)
+			}
+			return true
+		}
+		foRunner.LogError(fmt.Errorf("retries exhausted, dropping message"))
+	case ErrKindFatal:
+		foRunner.lastErr = err
+	}
+
+	foRunner.failedPack = nil
+	atomic.AddInt64(&foRunner.dropCount, 1)
+	foRunner.pConfig.DeadLetter(pack, DeadLetterOutput, foRunner.name, err)
+	delivery := pack.delivery
+	if delivery == nil && foRunner.ordering != nil {
+		delivery = foRunner.ordering.delivery(pack)
+	}
+	if delivery != nil {
+		delivery.fail(err)
+	}
+	pack.Recycle()
+	return false
+}
+
+// Waits before the next delivery attempt of the pack, for at least
+// `retryAfter`, returning false if its retries are used up. Attempts are
+// counted per pack, and limited to defaultDeliveryRetries if the output's
+// `retries` settings don't limit them.
+func (foRunner *foRunner) retryDelivery(pack *PipelinePack, retryAfter time.Duration) bool {
+	if foRunner.failureRetry == nil {
+		opts := foRunner.config.Retries
+		if opts.MaxRetries < 0 {
+			opts.MaxRetries = defaultDeliveryRetries
+		}
+		// Config was already validated when the runner started.
+		foRunner.failureRetry, _ = NewRetryHelper(opts)
+	}
+	if pack != foRunner.failedPack {
+		foRunner.failureRetry.Reset()
+		foRunner.failedPack = pack
+	}
+	return foRunner.failureRetry.WaitAtLeast(retryAfter) == nil
+}
+
 func (foRunner *foRunner) Inject(pack *PipelinePack) bool {
 	spec := foRunner.MatchRunner().MatcherSpecification()
 	match := spec.Match(pack.Message)
@@ -835,17 +1338,30 @@ func (foRunner *foRunner) Inject(pack *PipelinePack) bool {
 }
 
 func (foRunner *foRunner) LogError(err error) {
+	foRunner.debug.errorLogged(err)
 	log.Printf("Plugin '%s' error: %s", foRunner.name, err)
+	foRunner.pConfig.logPluginMessage(foRunner.name, strings.Title(foRunner.kind.String()),
+		pluginLogError, err.Error())
 }
 
 func (foRunner *foRunner) LogMessage(msg string) {
 	log.Printf("Plugin '%s': %s", foRunner.name, msg)
+	foRunner.pConfig.logPluginMessage(foRunner.name, strings.Title(foRunner.kind.String()),
+		pluginLogInfo, msg)
 }
 
 func (foRunner *foRunner) Ticker() (ticker <-chan time.Time) {
 	return foRunner.ticker
 }
 
+func (foRunner *foRunner) Windows() <-chan Window {
+	return foRunner.windows
+}
+
+func (foRunner *foRunner) Watermark() int64 {
+	return foRunner.pConfig.watermarks.Watermark()
+}
+
 func (foRunner *foRunner) RetainPack(pack *PipelinePack) {
 	foRunner.retainPack = pack
 }
@@ -865,6 +1381,49 @@ func (foRunner *foRunner) InChan() (inChan chan *PipelinePack) {
 	return foRunner.inChan
 }
 
+func (foRunner *foRunner) ProcessBatches(bp BatchProcessor) (err error) {
+	if foRunner.batchChan == nil {
+		return fmt.Errorf("%s doesn't implement BatchProcessor", foRunner.name)
+	}
+	process := func(batch []*PipelinePack) error {
+		if err := bp.ProcessMessages(batch); err != nil {
+			if ClassifyError(err) == ErrKindFatal {
+				return err
+			}
+			foRunner.LogError(err)
+		}
+		return nil
+	}
+
+	if foRunner.retainPack != nil {
+		pack := foRunner.retainPack
+		foRunner.retainPack = nil
+		if err = process([]*PipelinePack{pack}); err != nil {
+			return
+		}
+	}
+
+	ticker, _ := bp.(BatchTicker)
+	for {
+		select {
+		case batch, ok := <-foRunner.batchChan:
+			if !ok {
+				return nil
+			}
+			if err = process(batch); err != nil {
+				return
+			}
+		case <-foRunner.ticker:
+			if ticker == nil {
+				continue
+			}
+			if err = ticker.TimerEvent(); err != nil {
+				foRunner.LogError(err)
+			}
+		}
+	}
+}
+
 func (foRunner *foRunner) MatchRunner() *MatchRunner {
 	return foRunner.matcher
 }
@@ -887,14 +1446,29 @@ func (foRunner *foRunner) Encoder() Encoder {
 
 func (foRunner *foRunner) Encode(pack *PipelinePack) (output []byte, err error) {
 	var encoded []byte
+	if foRunner.tsRewriter != nil {
+		pack = foRunner.tsRewriter.rewrite(pack)
+	}
 	if encoded, err = foRunner.encoder.Encode(pack); err != nil {
 		return
 	}
+	if foRunner.sizeLimit != nil && encoded != nil {
+		if encoded, err = foRunner.sizeLimit.enforce(encoded, pack,
+			foRunner.encoder); err != nil {
+
+			return
+		}
+	}
 	if foRunner.useFraming {
 		client.CreateHekaStream(encoded, &output, nil)
 	} else {
 		output = encoded
 	}
+	if output != nil && foRunner.kind == foOutput && foRunner.pConfig != nil &&
+		foRunner.pConfig.recorder != nil {
+
+		foRunner.pConfig.recorder.recordOutput(foRunner.name, output)
+	}
 	return
 }
 
@@ -18,12 +18,14 @@ package pipeline
 
 import (
 	"bytes"
+	"code.google.com/p/go-uuid/uuid"
 	"errors"
 	"github.com/mozilla-services/heka/message"
 	ts "github.com/mozilla-services/heka/pipeline/testsupport"
 	"github.com/rafrombrc/gomock/gomock"
 	gs "github.com/rafrombrc/gospec/src/gospec"
 	"sync"
+	"time"
 )
 
 var stopinputTimes int
@@ -274,6 +276,48 @@ func (s *StopResumeOutput) Stop() {
 	return
 }
 
+type BatchOutput struct {
+	batchSizes []int
+}
+
+func (b *BatchOutput) Init(config interface{}) error {
+	return nil
+}
+
+func (b *BatchOutput) Run(or OutputRunner, h PluginHelper) error {
+	br, ok := or.(BatchRunner)
+	if !ok {
+		return errors.New("batches aren't supported")
+	}
+	return br.ProcessBatches(b)
+}
+
+func (b *BatchOutput) ProcessMessages(packs []*PipelinePack) error {
+	b.batchSizes = append(b.batchSizes, len(packs))
+	for _, pack := range packs {
+		pack.Recycle()
+	}
+	return nil
+}
+
+// Output whose Init fails the specified number of times.
+type LazyOutput struct {
+	failures int
+	inits    int
+}
+
+func (l *LazyOutput) Init(config interface{}) error {
+	l.inits++
+	if l.inits <= l.failures {
+		return errors.New("destination unavailable")
+	}
+	return nil
+}
+
+func (l *LazyOutput) Run(or OutputRunner, h PluginHelper) error {
+	return nil
+}
+
 func OutputRunnerSpec(c gs.Context) {
 	t := new(ts.SimpleT)
 	ctrl := gomock.NewController(t)
@@ -379,6 +423,243 @@ func OutputRunnerSpec(c gs.Context) {
 			c.Expect(len(pConfig.inputRecycleChan), gs.Equals, 1)
 		})
 
+		c.Specify("handles delivery failures by kind", func() {
+			commonFO.Retries = RetryOptions{
+				MaxDelay:   "1us",
+				Delay:      "1us",
+				MaxJitter:  "1us",
+				MaxRetries: 2,
+			}
+			oRunner, err := NewFORunner("stoppingOutput", output, commonFO, "StoppingOutput",
+				chanSize)
+			c.Assume(err, gs.IsNil)
+			recycleChan := make(chan *PipelinePack, 1)
+			pack := NewPipelinePack(recycleChan)
+			failure := errors.New("failed")
+
+			c.Specify("retries retryable errors until exhausted", func() {
+				c.Expect(oRunner.HandleFailure(pack, failure), gs.IsTrue)
+				c.Expect(oRunner.HandleFailure(pack, NewRetryableError(failure)), gs.IsTrue)
+				c.Expect(oRunner.HandleFailure(pack, failure), gs.IsFalse)
+				c.Expect(len(recycleChan), gs.Equals, 1)
+				c.Expect(oRunner.retryCount, gs.Equals, int64(2))
+				c.Expect(oRunner.dropCount, gs.Equals, int64(1))
+			})
+
+			c.Specify("counts retry attempts per pack", func() {
+				c.Expect(oRunner.HandleFailure(pack, failure), gs.IsTrue)
+				c.Expect(oRunner.HandleFailure(pack, failure), gs.IsTrue)
+				other := NewPipelinePack(recycleChan)
+				c.Expect(oRunner.HandleFailure(other, failure), gs.IsTrue)
+			})
+
+			c.Specify("retries throttled errors until exhausted", func() {
+				throttled := NewThrottledError(failure, time.Microsecond)
+				c.Expect(oRunner.HandleFailure(pack, throttled), gs.IsTrue)
+				c.Expect(oRunner.HandleFailure(pack, failure), gs.IsTrue)
+				c.Expect(oRunner.HandleFailure(pack, throttled), gs.IsFalse)
+				c.Expect(oRunner.throttleCount, gs.Equals, int64(1))
+				c.Expect(oRunner.retryCount, gs.Equals, int64(1))
+				c.Expect(len(recycleChan), gs.Equals, 1)
+			})
+
+			c.Specify("limits unlimited retries", func() {
+				commonFO.Retries.MaxRetries = -1
+				oRunner, err = NewFORunner("stoppingOutput", output, commonFO,
+					"StoppingOutput", chanSize)
+				c.Assume(err, gs.IsNil)
+				for i := 0; i < defaultDeliveryRetries; i++ {
+					c.Expect(oRunner.HandleFailure(pack, failure), gs.IsTrue)
+				}
+				c.Expect(oRunner.HandleFailure(pack, failure), gs.IsFalse)
+			})
+
+			c.Specify("doesn't retry once shutting down", func() {
+				oRunner.pConfig = pConfig
+				pConfig.Globals.stop()
+				c.Expect(oRunner.HandleFailure(pack, failure), gs.IsFalse)
+				c.Expect(len(recycleChan), gs.Equals, 1)
+				c.Expect(oRunner.retryCount, gs.Equals, int64(0))
+			})
+
+			c.Specify("drops malformed messages", func() {
+				malformed := NewMalformedMessageError(failure)
+				c.Expect(oRunner.HandleFailure(pack, malformed), gs.IsFalse)
+				c.Expect(len(recycleChan), gs.Equals, 1)
+				c.Expect(oRunner.dropCount, gs.Equals, int64(1))
+			})
+
+			c.Specify("doesn't retry fatal errors", func() {
+				fatal := NewFatalError(failure)
+				c.Expect(oRunner.HandleFailure(pack, fatal), gs.IsFalse)
+				c.Expect(len(recycleChan), gs.Equals, 1)
+				c.Expect(oRunner.lastErr, gs.Equals, fatal)
+			})
+		})
+
+		c.Specify("delivers batches to a BatchProcessor", func() {
+			output := &BatchOutput{}
+			commonFO.MaxBatchSize = 3
+			commonFO.BatchThreshold = 2
+			oRunner, err := NewFORunner("batchOutput", output, commonFO, "BatchOutput",
+				chanSize)
+			c.Assume(err, gs.IsNil)
+			c.Expect(oRunner.batchChan, gs.Not(gs.IsNil))
+
+			// Queue up a backlog before the matcher starts.
+			recycleChan := make(chan *PipelinePack, 5)
+			for i := 0; i < 5; i++ {
+				oRunner.matcher.inChan <- NewPipelinePack(recycleChan)
+			}
+			close(oRunner.matcher.inChan)
+			oRunner.matcher.StartBatches(oRunner.batchChan, 1000,
+				int(commonFO.BatchThreshold), int(commonFO.MaxBatchSize))
+
+			err = output.Run(oRunner, mockHelper)
+			c.Expect(err, gs.IsNil)
+			c.Expect(len(output.batchSizes), gs.Equals, 3)
+			c.Expect(output.batchSizes[0], gs.Equals, 3)
+			c.Expect(output.batchSizes[1], gs.Equals, 1)
+			c.Expect(output.batchSizes[2], gs.Equals, 1)
+			c.Expect(len(recycleChan), gs.Equals, 5)
+		})
+
+		c.Specify("samples matched messages by UUID", func() {
+			commonFO.SampleRate = 25
+			oRunner, err := NewFORunner("stoppingOutput", output, commonFO, "StoppingOutput",
+				chanSize)
+			c.Assume(err, gs.IsNil)
+
+			uuids := make([][]byte, 1000)
+			for i := range uuids {
+				uuids[i] = uuid.NewRandom()
+			}
+			deliver := func(matcher *MatchRunner) map[string]bool {
+				recycleChan := make(chan *PipelinePack, len(uuids))
+				matchChan := make(chan *PipelinePack, len(uuids))
+				go func() {
+					for _, id := range uuids {
+						pack := NewPipelinePack(recycleChan)
+						pack.Message.SetUuid(id)
+						matcher.inChan <- pack
+					}
+					close(matcher.inChan)
+				}()
+				matcher.Start(matchChan, 1000)
+				delivered := make(map[string]bool)
+				for pack := range matchChan {
+					delivered[pack.Message.GetUuidString()] = true
+				}
+				return delivered
+			}
+
+			delivered := deliver(oRunner.matcher)
+			c.Expect(len(delivered) > 150 && len(delivered) < 350, gs.IsTrue)
+			c.Expect(oRunner.matcher.sampledOutCount, gs.Equals,
+				int64(len(uuids)-len(delivered)))
+
+			// Another matcher with the same rate picks the same messages.
+			other, err := NewMatchRunner("TRUE", "", oRunner, chanSize)
+			c.Assume(err, gs.IsNil)
+			other.setSampleRate(25)
+			otherDelivered := deliver(other)
+			c.Expect(len(otherDelivered), gs.Equals, len(delivered))
+			for id := range otherDelivered {
+				c.Expect(delivered[id], gs.IsTrue)
+			}
+		})
+
+		c.Specify("drops messages older than the max_buffer_age", func() {
+			commonFO.MaxBufferAge = "1h"
+			oRunner, err := NewFORunner("stoppingOutput", output, commonFO, "StoppingOutput",
+				chanSize)
+			c.Assume(err, gs.IsNil)
+			c.Expect(oRunner.maxAge, gs.Equals, time.Hour)
+			oRunner.matcher.maxAge = oRunner.maxAge
+			oRunner.matcher.expire = oRunner.expire
+
+			recycleChan := make(chan *PipelinePack, 2)
+			matchChan := make(chan *PipelinePack, 2)
+			stale := NewPipelinePack(recycleChan)
+			stale.Message.SetTimestamp(time.Now().Add(-2 * time.Hour).UnixNano())
+			fresh := NewPipelinePack(recycleChan)
+			fresh.Message.SetTimestamp(time.Now().UnixNano())
+			oRunner.matcher.inChan <- stale
+			oRunner.matcher.inChan <- fresh
+			close(oRunner.matcher.inChan)
+			oRunner.matcher.Start(matchChan, 1000)
+
+			var delivered []*PipelinePack
+			for pack := range matchChan {
+				delivered = append(delivered, pack)
+			}
+			c.Expect(len(delivered), gs.Equals, 1)
+			c.Expect(delivered[0], gs.Equals, fresh)
+			c.Expect(<-recycleChan, gs.Equals, stale)
+			c.Expect(oRunner.expiredCount, gs.Equals, int64(1))
+		})
+
+		c.Specify("rejects max_buffer_age for filters", func() {
+			commonFO.MaxBufferAge = "1h"
+			_, err := NewFORunner("filter", &CounterFilter{}, commonFO, "CounterFilter",
+				chanSize)
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+
+		c.Specify("initializes a lazy_connect output", func() {
+			lazyInitInterval = time.Millisecond
+			commonFO.LazyConnect = true
+			commonFO.Retries = RetryOptions{
+				MaxDelay:   "1us",
+				Delay:      "1us",
+				MaxJitter:  "1us",
+				MaxRetries: 2,
+			}
+			lazy := &LazyOutput{}
+			oRunner, err := NewFORunner("stoppingOutput", lazy, commonFO, "LazyOutput",
+				chanSize)
+			c.Assume(err, gs.IsNil)
+			oRunner.pConfig = pConfig
+			rh, err := NewRetryHelper(commonFO.Retries)
+			c.Assume(err, gs.IsNil)
+
+			c.Specify("once the first message arrives", func() {
+				lazy.failures = 2
+				done := make(chan bool)
+				go func() {
+					done <- oRunner.lazyInit(rh)
+				}()
+				time.Sleep(10 * time.Millisecond)
+				c.Expect(lazy.inits, gs.Equals, 0)
+				oRunner.inChan <- NewPipelinePack(pConfig.inputRecycleChan)
+				c.Expect(<-done, gs.IsTrue)
+				c.Expect(lazy.inits, gs.Equals, 3)
+			})
+
+			c.Specify("giving up when the retries are used up", func() {
+				lazy.failures = 5
+				oRunner.inChan <- NewPipelinePack(pConfig.inputRecycleChan)
+				c.Expect(oRunner.lazyInit(rh), gs.IsFalse)
+				c.Expect(lazy.inits, gs.Equals, 3)
+				c.Expect(oRunner.lastErr, gs.Not(gs.IsNil))
+			})
+		})
+
+		c.Specify("rejects an invalid sample rate", func() {
+			commonFO.SampleRate = 150
+			_, err := NewFORunner("stoppingOutput", output, commonFO, "StoppingOutput",
+				chanSize)
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+
+		c.Specify("won't process batches for other plugins", func() {
+			oRunner, err := NewFORunner("stoppingOutput", output, commonFO, "StoppingOutput",
+				chanSize)
+			c.Assume(err, gs.IsNil)
+			err = oRunner.ProcessBatches(&BatchOutput{})
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+
 		c.Specify("encodes a message", func() {
 			oRunner, err := NewFORunner("stoppingOutput", output, commonFO, "StoppingOutput",
 				chanSize)
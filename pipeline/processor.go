@@ -0,0 +1,95 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+)
+
+// Heka Processor plugin type. Processors make small, synchronous changes to
+// the messages of the inputs that list them in their `processors` setting,
+// after the messages have been decoded and before they're handed to the
+// router. Each input gets its own Processor instances, but an input may
+// deliver messages from more than one goroutine so Process must be safe for
+// concurrent use.
+type Processor interface {
+	// Modifies the pack's message in place. Returning false for `keep` drops
+	// the message. If an error is returned the message is dropped, or passed
+	// on tagged as a decode failure if the input is configured to send decode
+	// failures.
+	Process(pack *PipelinePack) (keep bool, err error)
+}
+
+// The ordered list of processors used by an input.
+type processorChain struct {
+	pConfig    *PipelineConfig
+	names      []string
+	processors []Processor
+	dropCount  int64
+}
+
+// Instantiates the named processors for an input, in order.
+func newProcessorChain(pConfig *PipelineConfig, inputName string,
+	names []string) (*processorChain, error) {
+
+	if len(names) == 0 {
+		return nil, nil
+	}
+	chain := &processorChain{
+		pConfig:    pConfig,
+		names:      names,
+		processors: make([]Processor, len(names)),
+	}
+	for i, name := range names {
+		processor, ok := pConfig.Processor(name, fmt.Sprintf("%s-%s", inputName, name))
+		if !ok {
+			return nil, fmt.Errorf("can't create processor %s", name)
+		}
+		chain.processors[i] = processor
+	}
+	return chain, nil
+}
+
+// Runs the pack through each of the processors in turn. Returns false if the
+// pack was dropped, in which case it has already been recycled.
+func (pc *processorChain) process(pack *PipelinePack, sendFailures bool,
+	logError func(error)) bool {
+
+	for i, processor := range pc.processors {
+		keep, err := processor.Process(pack)
+		if err != nil {
+			errMsg := fmt.Sprintf("processor '%s' error: %s", pc.names[i], err)
+			logError(errors.New(errMsg))
+			if !sendFailures {
+				atomic.AddInt64(&pc.dropCount, 1)
+				pc.pConfig.DeadLetter(pack, DeadLetterProcessor, pc.names[i],
+					errors.New(errMsg))
+				pack.resolveDelivery(errors.New(errMsg))
+				pack.Recycle()
+				return false
+			}
+			if err = AddDecodeFailureFields(pack.Message, errMsg); err != nil {
+				logError(err)
+			}
+			return true
+		}
+		if !keep {
+			atomic.AddInt64(&pc.dropCount, 1)
+			pack.resolveDelivery(nil)
+			pack.Recycle()
+			return false
+		}
+	}
+	return true
+}
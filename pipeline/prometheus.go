@@ -0,0 +1,190 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Report fields that only ever increase, exposed as Prometheus counters. All
+// other numeric report fields are exposed as gauges.
+var prometheusCounters = map[string]bool{
+	"ProcessMessageCount":   true,
+	"InjectMessageCount":    true,
+	"MatchedMessages":       true,
+	"DeliveredMessages":     true,
+	"DecodeFailures":        true,
+	"DroppedMessages":       true,
+	"RetriedMessages":       true,
+	"ThrottledMessages":     true,
+	"BufferDroppedMessages": true,
+	"PoolExhausted":         true,
+	"PoolGrowths":           true,
+	"PoolShrinks":           true,
+	"DeadLetterCount":       true,
+	"MatchTooLong":          true,
+	"MatchOverBudget":       true,
+	"RateLimitedMessages":   true,
+	"SampledOutMessages":    true,
+	"ExpiredMessages":       true,
+	"ShedMessages":          true,
+	"ShedWarning":           true,
+	"ShedNotice":            true,
+	"ShedInfo":              true,
+	"ShedDebug":             true,
+	"OversizedDropped":      true,
+	"OversizedTruncated":    true,
+	"OversizedSplit":        true,
+}
+
+// A single Prometheus sample, i.e. one report field of one plugin.
+type prometheusSample struct {
+	key   string
+	name  string
+	value float64
+}
+
+// Starts an HTTP server exposing the report data at `/metrics` in the
+// Prometheus text format. The server runs until the returned listener is
+// closed.
+func (pc *PipelineConfig) startMetricsServer(address string) (net.Listener, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", pc.metricsHandler)
+	go func() {
+		// Serve returns an error once the listener is closed on shutdown.
+		if err := http.Serve(listener, mux); err != nil && !pc.Globals.IsShuttingDown() {
+			log.Printf("Metrics endpoint error: %s", err)
+		}
+	}()
+	return listener, nil
+}
+
+func (pc *PipelineConfig) metricsHandler(w http.ResponseWriter, req *http.Request) {
+	buf := new(bytes.Buffer)
+	pc.writePrometheusMetrics(buf)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(buf.Bytes())
+}
+
+// Writes the numeric fields of every report message as Prometheus metrics,
+// named after the field and labeled with the report's `key` and `name`, e.g.
+// `heka_in_chan_length{key="outputs",name="ElasticSearchOutput"} 3`.
+func (pc *PipelineConfig) writePrometheusMetrics(w io.Writer) {
+	reports := make(chan *PipelinePack)
+	go pc.reports(reports)
+
+	samples := make(map[string][]prometheusSample)
+	for pack := range reports {
+		key := reportFieldString(pack.Message, "key")
+		name := reportFieldString(pack.Message, "name")
+		for _, field := range pack.Message.Fields {
+			value, ok := prometheusValue(field)
+			if !ok {
+				continue
+			}
+			metric := "heka_" + prometheusName(field.GetName())
+			if prometheusCounters[field.GetName()] {
+				metric += "_total"
+			}
+			samples[metric] = append(samples[metric], prometheusSample{key, name, value})
+		}
+		pack.Recycle()
+	}
+
+	metrics := make([]string, 0, len(samples))
+	for metric := range samples {
+		metrics = append(metrics, metric)
+	}
+	sort.Strings(metrics)
+	for _, metric := range metrics {
+		typ := "gauge"
+		if strings.HasSuffix(metric, "_total") {
+			typ = "counter"
+		}
+		fmt.Fprintf(w, "# TYPE %s %s\n", metric, typ)
+		for _, s := range samples[metric] {
+			fmt.Fprintf(w, "%s{key=\"%s\",name=\"%s\"} %s\n", metric,
+				prometheusEscape(s.key), prometheusEscape(s.name),
+				strconv.FormatFloat(s.value, 'g', -1, 64))
+		}
+	}
+}
+
+// Returns the value of a string report field, "MISSING" if there is none.
+func reportFieldString(msg *message.Message, name string) string {
+	if value, ok := msg.GetFieldValue(name); ok {
+		if s, ok := value.(string); ok {
+			return s
+		}
+	}
+	return "MISSING"
+}
+
+// Returns the first value of a numeric field as a float.
+func prometheusValue(field *message.Field) (float64, bool) {
+	switch field.GetValueType() {
+	case message.Field_INTEGER:
+		if len(field.ValueInteger) > 0 {
+			return float64(field.ValueInteger[0]), true
+		}
+	case message.Field_DOUBLE:
+		if len(field.ValueDouble) > 0 {
+			return field.ValueDouble[0], true
+		}
+	}
+	return 0, false
+}
+
+// Converts a CamelCase report field name to a snake_case metric name, e.g.
+// "InChanCapacity" to "in_chan_capacity". Characters not allowed in metric
+// names are replaced with underscores.
+func prometheusName(fieldName string) string {
+	runes := []rune(fieldName)
+	name := make([]rune, 0, len(runes)+4)
+	for i, r := range runes {
+		switch {
+		case r < unicode.MaxASCII && unicode.IsUpper(r):
+			// Start a new word, unless inside an acronym like "ID".
+			if i > 0 && (!unicode.IsUpper(runes[i-1]) ||
+				(i+1 < len(runes) && unicode.IsLower(runes[i+1]))) &&
+				name[len(name)-1] != '_' {
+				name = append(name, '_')
+			}
+			name = append(name, unicode.ToLower(r))
+		case r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r)):
+			name = append(name, r)
+		default:
+			name = append(name, '_')
+		}
+	}
+	return string(name)
+}
+
+var prometheusEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func prometheusEscape(s string) string {
+	return prometheusEscaper.Replace(s)
+}
@@ -0,0 +1,74 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+)
+
+func PrometheusSpec(c gs.Context) {
+	c.Specify("Prometheus metric names", func() {
+		c.Expect(prometheusName("InChanCapacity"), gs.Equals, "in_chan_capacity")
+		c.Expect(prometheusName("ProcessMessageAvgDuration"), gs.Equals,
+			"process_message_avg_duration")
+		c.Expect(prometheusName("LastMessageID"), gs.Equals, "last_message_id")
+		c.Expect(prometheusName("HTTPStatus"), gs.Equals, "http_status")
+		c.Expect(prometheusName("Bytes.Sent"), gs.Equals, "bytes_sent")
+	})
+
+	c.Specify("The metrics endpoint", func() {
+		pc := NewPipelineConfig(nil)
+		pc.reportRecycleChan <- NewPipelinePack(pc.reportRecycleChan)
+
+		req, err := http.NewRequest("GET", "/metrics", nil)
+		c.Assume(err, gs.IsNil)
+		resp := httptest.NewRecorder()
+		pc.metricsHandler(resp, req)
+		c.Expect(resp.Code, gs.Equals, http.StatusOK)
+		body := resp.Body.String()
+		lines := strings.Split(body, "\n")
+
+		contains := func(line string) bool {
+			for _, l := range lines {
+				if l == line {
+					return true
+				}
+			}
+			return false
+		}
+
+		c.Specify("exposes report fields as gauges", func() {
+			c.Expect(contains("# TYPE heka_in_chan_capacity gauge"), gs.IsTrue)
+			c.Expect(contains(`heka_in_chan_capacity{key="globals",name="inputRecycleChan"} 100`),
+				gs.IsTrue)
+			c.Expect(contains(`heka_in_chan_capacity{key="globals",name="Router"} 50`),
+				gs.IsTrue)
+		})
+
+		c.Specify("exposes counts as counters", func() {
+			c.Expect(contains("# TYPE heka_process_message_count_total counter"), gs.IsTrue)
+			c.Expect(contains(`heka_process_message_count_total{key="globals",name="Router"} 0`),
+				gs.IsTrue)
+		})
+
+		c.Specify("declares each metric once", func() {
+			c.Expect(strings.Count(body, "# TYPE heka_in_chan_length "), gs.Equals, 1)
+		})
+
+		c.Specify("returns the report pack", func() {
+			c.Expect(len(pc.reportRecycleChan), gs.Equals, 1)
+		})
+	})
+}
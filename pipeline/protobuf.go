@@ -45,7 +45,7 @@ func (p *ProtobufDecoder) SetPipelineConfig(pConfig *PipelineConfig) {
 
 func (p *ProtobufDecoder) Init(config interface{}) error {
 	p.sample = true
-	p.sampleDenominator = p.pConfig.Globals.SampleDenominator
+	p.sampleDenominator = p.pConfig.Globals.Tunables().SampleDenominator
 	return nil
 }
 
@@ -118,7 +118,7 @@ func (p *ProtobufEncoder) SetPipelineConfig(pConfig *PipelineConfig) {
 func (p *ProtobufEncoder) Init(config interface{}) error {
 	p.cEncoder = client.NewProtobufEncoder(nil)
 	p.sample = true
-	p.sampleDenominator = p.pConfig.Globals.SampleDenominator
+	p.sampleDenominator = p.pConfig.Globals.Tunables().SampleDenominator
 	return nil
 }
 
@@ -0,0 +1,117 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Token bucket limiting the message rate of a single plugin, configured with
+// the common `max_msgs_per_sec` and `burst` settings. Inputs over the limit
+// are delayed, so a chatty input is slowed down instead of starving the
+// router. Messages over a filter's or output's limit are dropped, so that
+// the router's deliveries to the other plugins aren't stalled.
+type rateLimiter struct {
+	rate   float64 // Tokens added per second.
+	burst  float64 // Bucket size.
+	tokens float64
+	last   time.Time
+	lock   sync.Mutex
+	// Messages that had to wait for a token, or were dropped without one.
+	limitedCount int64
+	// Swapped out in tests.
+	now   func() time.Time
+	sleep func(time.Duration)
+}
+
+// Returns a limiter for the specified rate, or nil if the rate is zero, i.e.
+// unlimited. The burst defaults to one second's worth of messages.
+func newRateLimiter(perSec, burst uint) *rateLimiter {
+	if perSec == 0 {
+		return nil
+	}
+	if burst == 0 {
+		burst = perSec
+	}
+	l := &rateLimiter{
+		rate:  float64(perSec),
+		burst: float64(burst),
+		now:   time.Now,
+		sleep: time.Sleep,
+	}
+	l.tokens = l.burst
+	l.last = l.now()
+	return l
+}
+
+// Adds the tokens accumulated since the last call. Called with the lock held.
+func (l *rateLimiter) refill() {
+	now := l.now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+}
+
+// Takes a token, returning how long the caller must wait before it's
+// available. Tokens are reserved even when not yet available, so concurrent
+// callers are delayed in turn.
+func (l *rateLimiter) reserve() time.Duration {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.refill()
+	l.tokens--
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// Takes a token if one is available, returning whether it was. Used to
+// enforce quotas, where messages over the rate are dropped rather than
+// delayed.
+func (l *rateLimiter) allow() bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.refill()
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+// Blocks until the next message may be passed on.
+func (l *rateLimiter) wait() {
+	if delay := l.reserve(); delay > 0 {
+		atomic.AddInt64(&l.limitedCount, 1)
+		l.sleep(delay)
+	}
+}
+
+// Takes a token if one is available, counting the message as limited if
+// not, in which case it's to be dropped.
+func (l *rateLimiter) admit() bool {
+	if l.allow() {
+		return true
+	}
+	atomic.AddInt64(&l.limitedCount, 1)
+	return false
+}
+
+// Returns the number of messages delayed or dropped by the limiter.
+func (l *rateLimiter) limited() int64 {
+	return atomic.LoadInt64(&l.limitedCount)
+}
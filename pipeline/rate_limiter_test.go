@@ -0,0 +1,106 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"time"
+)
+
+func RateLimiterSpec(c gs.Context) {
+	c.Specify("A rate limiter", func() {
+		c.Specify("isn't created without a rate", func() {
+			c.Expect(newRateLimiter(0, 10) == nil, gs.IsTrue)
+		})
+
+		now := time.Unix(1000, 0)
+		var slept []time.Duration
+		limiter := newRateLimiter(10, 5)
+		limiter.now = func() time.Time { return now }
+		limiter.last = now
+		limiter.sleep = func(d time.Duration) {
+			slept = append(slept, d)
+			now = now.Add(d)
+		}
+
+		c.Specify("passes a burst without delay", func() {
+			for i := 0; i < 5; i++ {
+				limiter.wait()
+			}
+			c.Expect(len(slept), gs.Equals, 0)
+			c.Expect(limiter.limited(), gs.Equals, int64(0))
+		})
+
+		c.Specify("then delays messages to the rate", func() {
+			for i := 0; i < 7; i++ {
+				limiter.wait()
+			}
+			c.Expect(len(slept), gs.Equals, 2)
+			c.Expect(slept[0], gs.Equals, 100*time.Millisecond)
+			c.Expect(slept[1], gs.Equals, 100*time.Millisecond)
+			c.Expect(limiter.limited(), gs.Equals, int64(2))
+		})
+
+		c.Specify("refills the bucket over time, up to the burst", func() {
+			for i := 0; i < 5; i++ {
+				limiter.wait()
+			}
+			now = now.Add(time.Hour)
+			for i := 0; i < 5; i++ {
+				limiter.wait()
+			}
+			c.Expect(len(slept), gs.Equals, 0)
+			limiter.wait()
+			c.Expect(len(slept), gs.Equals, 1)
+		})
+
+		c.Specify("admits a burst, then drops messages over the rate", func() {
+			admitted := 0
+			for i := 0; i < 7; i++ {
+				if limiter.admit() {
+					admitted++
+				}
+			}
+			c.Expect(admitted, gs.Equals, 5)
+			c.Expect(len(slept), gs.Equals, 0)
+			c.Expect(limiter.limited(), gs.Equals, int64(2))
+			now = now.Add(100 * time.Millisecond)
+			c.Expect(limiter.admit(), gs.IsTrue)
+		})
+
+		c.Specify("delays a pacing matcher's matches rather than dropping them", func() {
+			runner, err := NewFORunner("paced", &StoppingOutput{},
+				CommonFOConfig{Matcher: "TRUE"}, "StoppingOutput", 10)
+			c.Assume(err, gs.IsNil)
+			matcher := runner.matcher
+			matcher.limiter = limiter
+			matcher.pace = true
+			matchChan := make(chan *PipelinePack, 10)
+			matcher.Start(matchChan, 1)
+			for i := 0; i < 7; i++ {
+				matcher.inChan <- NewPipelinePack(nil)
+			}
+			close(matcher.inChan)
+			delivered := 0
+			for _ = range matchChan {
+				delivered++
+			}
+			c.Expect(delivered, gs.Equals, 7)
+			c.Expect(len(slept), gs.Equals, 2)
+			c.Expect(limiter.limited(), gs.Equals, int64(2))
+		})
+
+		c.Specify("defaults the burst to the rate", func() {
+			c.Expect(newRateLimiter(20, 0).burst, gs.Equals, float64(20))
+		})
+	})
+}
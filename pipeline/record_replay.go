@@ -0,0 +1,586 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"bufio"
+	"code.google.com/p/gogoprotobuf/proto"
+	"fmt"
+	"github.com/mozilla-services/heka/client"
+	"github.com/mozilla-services/heka/message"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Types of the messages stored in a fixture bundle.
+const (
+	RECORDED_INPUT_TYPE  = "heka.recorded.input"
+	RECORDED_OUTPUT_TYPE = "heka.recorded.output"
+)
+
+// How an input handed a recorded message on.
+const (
+	recordedDeliver = "deliver"
+	recordedInject  = "inject"
+)
+
+// How long the pipeline must be idle after the recorded inputs have been
+// replayed before the replay is considered finished.
+var replaySettleTime = time.Second
+
+// Writes the fixture bundle of a recording hekad: every message handed on by
+// an input, before decoding if the input has a decoder, and every message
+// encoded by an output.
+//
+// A bundle is a directory holding `inputs.hpb` and, for each output,
+// `outputs/<name>.hpb`, all Heka protobuf streams readable by heka-cat.
+type Recorder struct {
+	lock    sync.Mutex
+	dir     string
+	inputs  *bufio.Writer
+	outputs map[string]*bufio.Writer
+	files   []*os.File
+	// The first write error, returned by Close.
+	err error
+}
+
+// Creates the bundle directory, replacing any earlier recording in it.
+func NewRecorder(dir string) (*Recorder, error) {
+	outputDir := filepath.Join(dir, "outputs")
+	if err := os.RemoveAll(outputDir); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(outputDir, 0755); err != nil {
+		return nil, err
+	}
+	r := &Recorder{dir: dir, outputs: make(map[string]*bufio.Writer)}
+	var err error
+	if r.inputs, err = r.create(filepath.Join(dir, "inputs.hpb")); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *Recorder) create(path string) (*bufio.Writer, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	r.files = append(r.files, f)
+	return bufio.NewWriter(f), nil
+}
+
+// Records a message handed on by an input. Raw message bytes are recorded
+// too if the input's decoder uses them.
+func (r *Recorder) recordInput(input, mode string, pack *PipelinePack, useMsgBytes bool) {
+	msgBytes, err := proto.Marshal(pack.Message)
+	if err != nil {
+		r.fail(err)
+		return
+	}
+	msg := new(message.Message)
+	msg.SetType(RECORDED_INPUT_TYPE)
+	msg.SetLogger(input)
+	message.NewStringField(msg, "mode", mode)
+	r.addBytesField(msg, "message", msgBytes)
+	if useMsgBytes {
+		r.addBytesField(msg, "raw", pack.MsgBytes)
+	}
+	r.lock.Lock()
+	r.write(r.inputs, msg)
+	r.lock.Unlock()
+}
+
+// Records the encoded form of a message sent by an output.
+func (r *Recorder) recordOutput(output string, data []byte) {
+	msg := new(message.Message)
+	msg.SetType(RECORDED_OUTPUT_TYPE)
+	msg.SetLogger(output)
+	r.addBytesField(msg, "data", data)
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	w, ok := r.outputs[output]
+	if !ok {
+		var err error
+		if w, err = r.create(outputPath(r.dir, "outputs", output)); err != nil {
+			r.setErr(err)
+			return
+		}
+		r.outputs[output] = w
+	}
+	r.write(w, msg)
+}
+
+func (r *Recorder) addBytesField(msg *message.Message, name string, value []byte) {
+	// Copied, since the value may be reused once the record is written.
+	field, _ := message.NewField(name, append([]byte(nil), value...), "")
+	msg.AddField(field)
+}
+
+// Writes a record, called with the lock held.
+func (r *Recorder) write(w *bufio.Writer, msg *message.Message) {
+	msgBytes, err := proto.Marshal(msg)
+	if err == nil {
+		var record []byte
+		if err = client.CreateHekaStream(msgBytes, &record, nil); err == nil {
+			_, err = w.Write(record)
+		}
+	}
+	if err != nil {
+		r.setErr(err)
+	}
+}
+
+func (r *Recorder) fail(err error) {
+	r.lock.Lock()
+	r.setErr(err)
+	r.lock.Unlock()
+}
+
+// Called with the lock held.
+func (r *Recorder) setErr(err error) {
+	if r.err == nil {
+		r.err = err
+	}
+}
+
+// Flushes and closes the bundle's files, returning the first error that
+// occurred while recording, if any.
+func (r *Recorder) Close() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	writers := []*bufio.Writer{r.inputs}
+	for _, w := range r.outputs {
+		writers = append(writers, w)
+	}
+	for _, w := range writers {
+		if err := w.Flush(); err != nil {
+			r.setErr(err)
+		}
+	}
+	for _, f := range r.files {
+		if err := f.Close(); err != nil {
+			r.setErr(err)
+		}
+	}
+	return r.err
+}
+
+// Path of an output's file in a bundle subdirectory.
+func outputPath(dir, subdir, output string) string {
+	return filepath.Join(dir, subdir, url.QueryEscape(output)+".hpb")
+}
+
+// Replays the inputs recorded in a fixture bundle against a possibly changed
+// config, capturing what the outputs encode so it can be compared with the
+// recorded outputs. While replaying, every input is replaced by a stand-in
+// handing on the messages recorded for it, and every output by a stand-in
+// capturing the messages encoded by its encoder rather than sending them.
+type Replayer struct {
+	dir string
+	// Recorded messages by input name.
+	inputs   map[string][]*message.Message
+	lock     sync.Mutex
+	captured map[string][][]byte
+	// Tracks the stand-in inputs still replaying.
+	replaying sync.WaitGroup
+}
+
+// Loads the recorded inputs of a bundle.
+func NewReplayer(dir string) (*Replayer, error) {
+	records, err := readRecords(filepath.Join(dir, "inputs.hpb"))
+	if err != nil {
+		return nil, err
+	}
+	r := &Replayer{
+		dir:      dir,
+		inputs:   make(map[string][]*message.Message),
+		captured: make(map[string][][]byte),
+	}
+	for _, record := range records {
+		name := record.GetLogger()
+		r.inputs[name] = append(r.inputs[name], record)
+	}
+	return r, nil
+}
+
+// Reads the records of a bundle file.
+func readRecords(path string) (records []*message.Message, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	parser := NewMessageProtoParser()
+	for {
+		_, record, err := parser.Parse(f)
+		if err == io.EOF {
+			return records, nil
+		} else if err != nil {
+			return nil, err
+		}
+		if len(record) == 0 {
+			continue
+		}
+		headerLen := int(record[1]) + message.HEADER_FRAMING_SIZE
+		msg := new(message.Message)
+		if err = proto.Unmarshal(record[headerLen:], msg); err != nil {
+			return nil, fmt.Errorf("%s: corrupt record: %s", path, err)
+		}
+		records = append(records, msg)
+	}
+}
+
+// Returns the stand-in replacing an input or output plugin.
+func (r *Replayer) standIn(category, name string) Plugin {
+	if category == "Input" {
+		r.replaying.Add(1)
+		return &replayInput{
+			replayer: r,
+			records:  r.inputs[name],
+			stopChan: make(chan struct{}),
+		}
+	}
+	return &replayOutput{replayer: r}
+}
+
+// Waits for the stand-in inputs to finish replaying and the pipeline to go
+// idle, then shuts hekad down.
+func (r *Replayer) finish(pc *PipelineConfig) {
+	r.replaying.Wait()
+	var idleSince time.Time
+	for !pc.Globals.IsShuttingDown() {
+		if !pc.idle() {
+			idleSince = time.Time{}
+		} else if idleSince.IsZero() {
+			idleSince = time.Now()
+		} else if time.Since(idleSince) >= replaySettleTime {
+			log.Println("Replay complete.")
+			pc.Globals.ShutDown()
+			return
+		}
+		time.Sleep(replaySettleTime / 20)
+	}
+}
+
+// Whether no messages are waiting to be routed, decoded, or processed.
+func (pc *PipelineConfig) idle() bool {
+	if len(pc.router.inChan) > 0 {
+		return false
+	}
+	pc.allDecodersLock.RLock()
+	for _, dRunner := range pc.allDecoders {
+		if len(dRunner.InChan()) > 0 {
+			pc.allDecodersLock.RUnlock()
+			return false
+		}
+	}
+	pc.allDecodersLock.RUnlock()
+	pc.filtersLock.RLock()
+	defer pc.filtersLock.RUnlock()
+	for _, fRunner := range pc.FilterRunners {
+		if len(fRunner.InChan()) > 0 || fRunner.MatchRunner().InChanLen() > 0 {
+			return false
+		}
+	}
+	for _, oRunner := range pc.OutputRunners {
+		if len(oRunner.InChan()) > 0 || oRunner.MatchRunner().InChanLen() > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *Replayer) capture(output string, data []byte) {
+	r.lock.Lock()
+	r.captured[output] = append(r.captured[output], append([]byte(nil), data...))
+	r.lock.Unlock()
+}
+
+// Compares the outputs captured by the replay with the recorded ones,
+// writing a report of the differences to w, and writes the captured outputs
+// to the bundle's `replayed` directory. Heka protobuf messages in the
+// outputs are compared without their UUIDs and timestamps, which differ
+// between runs for messages injected by filters. With `unordered`, the
+// order of each output's messages is ignored. Returns the number of outputs
+// that differ.
+func (r *Replayer) Compare(w io.Writer, unordered bool) (differing int, err error) {
+	recorded := make(map[string][][]byte)
+	paths, _ := filepath.Glob(filepath.Join(r.dir, "outputs", "*.hpb"))
+	for _, path := range paths {
+		name, err := url.QueryUnescape(strings.TrimSuffix(filepath.Base(path), ".hpb"))
+		if err != nil {
+			continue
+		}
+		records, err := readRecords(path)
+		if err != nil {
+			return 0, err
+		}
+		for _, record := range records {
+			data, _ := record.GetFieldValue("data")
+			value, _ := data.([]byte)
+			recorded[name] = append(recorded[name], value)
+		}
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if err = r.saveCaptured(); err != nil {
+		return 0, err
+	}
+	names := make([]string, 0, len(recorded))
+	for name := range recorded {
+		names = append(names, name)
+	}
+	for name := range r.captured {
+		if _, ok := recorded[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if diffOutput(w, name, recorded[name], r.captured[name], unordered) {
+			differing++
+		}
+	}
+	if differing == 0 {
+		fmt.Fprintf(w, "Replay matches the recording (%d outputs).\n", len(names))
+	} else {
+		fmt.Fprintf(w, "%d of %d outputs differ from the recording.\n", differing,
+			len(names))
+	}
+	return
+}
+
+// Called with the lock held.
+func (r *Replayer) saveCaptured() error {
+	dir := filepath.Join(r.dir, "replayed")
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for name, captured := range r.captured {
+		rec := &Recorder{dir: r.dir}
+		w, err := rec.create(outputPath(r.dir, "replayed", name))
+		if err != nil {
+			return err
+		}
+		for _, data := range captured {
+			msg := new(message.Message)
+			msg.SetType(RECORDED_OUTPUT_TYPE)
+			msg.SetLogger(name)
+			rec.addBytesField(msg, "data", data)
+			rec.write(w, msg)
+		}
+		w.Flush()
+		rec.files[0].Close()
+		if rec.err != nil {
+			return rec.err
+		}
+	}
+	return nil
+}
+
+// Maximum number of differing messages reported per output.
+const maxReportedDiffs = 5
+
+// Reports the differences between an output's recorded and replayed
+// messages, returning whether there are any.
+func diffOutput(w io.Writer, name string, recorded, replayed [][]byte,
+	unordered bool) bool {
+
+	before := make([]string, len(recorded))
+	for i, data := range recorded {
+		before[i] = normalizeOutput(data)
+	}
+	after := make([]string, len(replayed))
+	for i, data := range replayed {
+		after[i] = normalizeOutput(data)
+	}
+
+	var diffs []string
+	if unordered {
+		counts := make(map[string]int)
+		for _, s := range before {
+			counts[s]++
+		}
+		for _, s := range after {
+			counts[s]--
+		}
+		for _, s := range before {
+			if counts[s] > 0 {
+				diffs = append(diffs, "  missing: "+describeOutput(s))
+				counts[s]--
+			}
+		}
+		for _, s := range after {
+			if counts[s] < 0 {
+				diffs = append(diffs, "  extra:   "+describeOutput(s))
+				counts[s]++
+			}
+		}
+	} else {
+		for i := 0; i < len(before) || i < len(after); i++ {
+			switch {
+			case i >= len(after):
+				diffs = append(diffs, fmt.Sprintf("  message %d missing: %s", i+1,
+					describeOutput(before[i])))
+			case i >= len(before):
+				diffs = append(diffs, fmt.Sprintf("  message %d extra:   %s", i+1,
+					describeOutput(after[i])))
+			case before[i] != after[i]:
+				diffs = append(diffs, fmt.Sprintf("  message %d\n    - %s\n    + %s",
+					i+1, describeOutput(before[i]), describeOutput(after[i])))
+			}
+		}
+	}
+	if len(diffs) == 0 {
+		return false
+	}
+	fmt.Fprintf(w, "Output '%s': %d recorded, %d replayed, %d differences\n", name,
+		len(recorded), len(replayed), len(diffs))
+	for i, diff := range diffs {
+		if i == maxReportedDiffs {
+			fmt.Fprintf(w, "  ... %d more\n", len(diffs)-i)
+			break
+		}
+		fmt.Fprintln(w, diff)
+	}
+	return true
+}
+
+// Prefix of normalized outputs that are Heka messages.
+const normalizedMessage = "\x00heka:"
+
+// Returns the comparable form of an encoded message. Framed Heka protobuf
+// messages are compared without their UUIDs and timestamps.
+func normalizeOutput(data []byte) string {
+	if len(data) > 1 && data[0] == message.RECORD_SEPARATOR {
+		headerLen := int(data[1]) + message.HEADER_FRAMING_SIZE
+		msg := new(message.Message)
+		if headerLen <= len(data) && proto.Unmarshal(data[headerLen:], msg) == nil {
+			msg.Uuid, msg.Timestamp = nil, nil
+			if normalized, err := proto.Marshal(msg); err == nil {
+				return normalizedMessage + string(normalized)
+			}
+		}
+	}
+	return string(data)
+}
+
+// Returns a short printable form of a normalized output.
+func describeOutput(s string) string {
+	if strings.HasPrefix(s, normalizedMessage) {
+		msg := new(message.Message)
+		if proto.Unmarshal([]byte(s[len(normalizedMessage):]), msg) == nil {
+			s = msg.String()
+		}
+	}
+	if len(s) > 200 {
+		return fmt.Sprintf("%q...", s[:200])
+	}
+	return fmt.Sprintf("%q", s)
+}
+
+// Input stand-in handing on the messages recorded for the input it replaces.
+type replayInput struct {
+	replayer *Replayer
+	records  []*message.Message
+	stopChan chan struct{}
+}
+
+func (ri *replayInput) Init(config interface{}) error {
+	return nil
+}
+
+func (ri *replayInput) Run(ir InputRunner, h PluginHelper) error {
+	ri.replay(ir)
+	ri.replayer.replaying.Done()
+	<-ri.stopChan
+	return nil
+}
+
+func (ri *replayInput) replay(ir InputRunner) {
+	for _, record := range ri.records {
+		var pack *PipelinePack
+		select {
+		case pack = <-ir.InChan():
+		case <-ri.stopChan:
+			return
+		}
+		msgBytes, _ := record.GetFieldValue("message")
+		if b, ok := msgBytes.([]byte); !ok || proto.Unmarshal(b, pack.Message) != nil {
+			ir.LogError(fmt.Errorf("skipping corrupt recorded message"))
+			pack.Recycle()
+			continue
+		}
+		if raw, ok := record.GetFieldValue("raw"); ok {
+			b, _ := raw.([]byte)
+			pack.MsgBytes = append(pack.MsgBytes[:0], b...)
+		}
+		if mode, _ := record.GetFieldValue("mode"); mode == recordedInject {
+			ir.Inject(pack)
+		} else {
+			ir.Deliver(pack)
+		}
+	}
+}
+
+func (ri *replayInput) Stop() {
+	close(ri.stopChan)
+}
+
+// Output stand-in capturing what the output's encoder produces.
+type replayOutput struct {
+	replayer *Replayer
+}
+
+func (ro *replayOutput) Init(config interface{}) error {
+	return nil
+}
+
+func (ro *replayOutput) Run(or OutputRunner, h PluginHelper) error {
+	for pack := range or.InChan() {
+		// Outputs without an encoder don't have any output recorded either.
+		if or.Encoder() != nil {
+			data, err := or.Encode(pack)
+			if err != nil {
+				or.LogError(fmt.Errorf("Error encoding message: %s", err))
+			} else if data != nil {
+				ro.replayer.capture(or.Name(), data)
+			}
+		}
+		pack.Recycle()
+	}
+	return nil
+}
+
+// Sets the recorder recording the inputs and outputs of the pipeline.
+func (pc *PipelineConfig) SetRecorder(r *Recorder) {
+	pc.recorder = r
+}
+
+// Sets the replayer replacing the inputs and outputs of the pipeline. Must
+// be called before the config is loaded.
+func (pc *PipelineConfig) SetReplayer(r *Replayer) {
+	pc.replayer = r
+}
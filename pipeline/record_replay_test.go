@@ -0,0 +1,130 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"bytes"
+	"code.google.com/p/gogoprotobuf/proto"
+	"github.com/mozilla-services/heka/client"
+	"github.com/mozilla-services/heka/message"
+	ts "github.com/mozilla-services/heka/pipeline/testsupport"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+func RecordReplaySpec(c gs.Context) {
+	dir, err := ioutil.TempDir("", "record-replay")
+	c.Assume(err, gs.IsNil)
+	defer os.RemoveAll(dir)
+
+	c.Specify("A recording", func() {
+		recorder, err := NewRecorder(dir)
+		c.Assume(err, gs.IsNil)
+		pack := NewPipelinePack(nil)
+		pack.Message = ts.GetTestMessage()
+		pack.MsgBytes = []byte("raw bytes")
+		recorder.recordInput("TcpInput", recordedDeliver, pack, true)
+		recorder.recordInput("StatAccumInput", recordedInject, pack, false)
+		recorder.recordOutput("LogOutput", []byte("line 1\n"))
+		recorder.recordOutput("LogOutput", []byte("line 2\n"))
+		recorder.recordOutput("Tcp/Output", []byte("other\n"))
+		c.Assume(recorder.Close(), gs.IsNil)
+
+		replayer, err := NewReplayer(dir)
+		c.Assume(err, gs.IsNil)
+
+		c.Specify("holds each input's messages", func() {
+			records := replayer.inputs["TcpInput"]
+			c.Expect(len(records), gs.Equals, 1)
+			mode, _ := records[0].GetFieldValue("mode")
+			c.Expect(mode, gs.Equals, recordedDeliver)
+			raw, _ := records[0].GetFieldValue("raw")
+			c.Expect(string(raw.([]byte)), gs.Equals, "raw bytes")
+			msgBytes, _ := records[0].GetFieldValue("message")
+			msg := new(message.Message)
+			c.Expect(proto.Unmarshal(msgBytes.([]byte), msg), gs.IsNil)
+			c.Expect(msg.GetUuidString(), gs.Equals, pack.Message.GetUuidString())
+
+			records = replayer.inputs["StatAccumInput"]
+			c.Expect(len(records), gs.Equals, 1)
+			_, ok := records[0].GetFieldValue("raw")
+			c.Expect(ok, gs.IsFalse)
+		})
+
+		c.Specify("matches an identical replay", func() {
+			replayer.capture("LogOutput", []byte("line 1\n"))
+			replayer.capture("LogOutput", []byte("line 2\n"))
+			replayer.capture("Tcp/Output", []byte("other\n"))
+			var report bytes.Buffer
+			differing, err := replayer.Compare(&report, false)
+			c.Expect(err, gs.IsNil)
+			c.Expect(differing, gs.Equals, 0)
+			_, err = os.Stat(outputPath(dir, "replayed", "Tcp/Output"))
+			c.Expect(err, gs.IsNil)
+		})
+
+		c.Specify("reports differing outputs", func() {
+			replayer.capture("LogOutput", []byte("line 1\n"))
+			replayer.capture("LogOutput", []byte("line 3\n"))
+			var report bytes.Buffer
+			differing, err := replayer.Compare(&report, false)
+			c.Expect(err, gs.IsNil)
+			c.Expect(differing, gs.Equals, 2)
+			c.Expect(strings.Contains(report.String(), "line 3"), gs.IsTrue)
+			c.Expect(strings.Contains(report.String(), "'Tcp/Output'"), gs.IsTrue)
+		})
+
+		c.Specify("ignores the order of messages if asked to", func() {
+			replayer.capture("LogOutput", []byte("line 2\n"))
+			replayer.capture("LogOutput", []byte("line 1\n"))
+			replayer.capture("Tcp/Output", []byte("other\n"))
+			var report bytes.Buffer
+			differing, _ := replayer.Compare(&report, false)
+			c.Expect(differing, gs.Equals, 1)
+			differing, _ = replayer.Compare(&report, true)
+			c.Expect(differing, gs.Equals, 0)
+		})
+	})
+
+	c.Specify("Comparing outputs ignores the UUIDs and timestamps of messages", func() {
+		frame := func(uuid []byte, timestamp int64) []byte {
+			msg := ts.GetTestMessage()
+			msg.SetUuid(uuid)
+			msg.SetTimestamp(timestamp)
+			msgBytes, err := proto.Marshal(msg)
+			c.Assume(err, gs.IsNil)
+			var framed []byte
+			client.CreateHekaStream(msgBytes, &framed, nil)
+			return framed
+		}
+		a := frame([]byte("0123456789abcdef"), 1)
+		b := frame([]byte("fedcba9876543210"), 2)
+		c.Expect(normalizeOutput(a), gs.Equals, normalizeOutput(b))
+
+		msg := ts.GetTestMessage()
+		msg.SetPayload("changed")
+		msgBytes, _ := proto.Marshal(msg)
+		var changed []byte
+		client.CreateHekaStream(msgBytes, &changed, nil)
+		c.Expect(normalizeOutput(changed) == normalizeOutput(a), gs.IsFalse)
+		c.Expect(strings.Contains(describeOutput(normalizeOutput(changed)), "changed"),
+			gs.IsTrue)
+	})
+
+	c.Specify("Bundle files are named after the escaped output names", func() {
+		c.Expect(filepath.Base(outputPath(dir, "outputs", "Tcp/Output")), gs.Equals,
+			"Tcp%2FOutput.hpb")
+	})
+}
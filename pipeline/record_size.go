@@ -0,0 +1,165 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+	"sync/atomic"
+	"unicode/utf8"
+)
+
+// How many times a record is truncated further when escaping makes the
+// truncated field grow in the encoded record.
+const maxTruncateAttempts = 3
+
+// Returned by OutputRunner.Encode for records larger than the output's
+// `max_record_size`, which are not to be sent as part of a batch.
+type OversizedRecordError struct {
+	Size int
+	Max  int
+	// With the "split" policy, the record, which outputs that support it
+	// send in a batch of its own, so its rejection doesn't fail the records
+	// around it. Outputs that don't support it drop the record.
+	Record []byte
+}
+
+func (e *OversizedRecordError) Error() string {
+	return fmt.Sprintf("encoded record of %d bytes exceeds max_record_size of %d",
+		e.Size, e.Max)
+}
+
+// Checks the `oversize_policy` setting.
+func validateOversizePolicy(policy string) error {
+	switch policy {
+	case "", "drop", "truncate", "split":
+		return nil
+	}
+	return fmt.Errorf("invalid oversize_policy: %s", policy)
+}
+
+// Enforces an output's `max_record_size`.
+type recordSizeLimit struct {
+	max int
+	// "drop" (the default), "truncate", or "split".
+	policy string
+	// Field shortened by the "truncate" policy, "Payload" or a string field
+	// name.
+	field string
+	// Oversized records dropped, truncated, and sent on their own.
+	dropped   int64
+	truncated int64
+	split     int64
+}
+
+// Returns a limit for the specified settings, or nil if there's no maximum.
+func newRecordSizeLimit(max uint, policy, field string) *recordSizeLimit {
+	if max == 0 {
+		return nil
+	}
+	if policy == "" {
+		policy = "drop"
+	}
+	if field == "" {
+		field = "Payload"
+	}
+	return &recordSizeLimit{max: int(max), policy: policy, field: field}
+}
+
+// Applies the policy to a record produced by encoding the pack. The pack may
+// be shared with other plugins, so truncation is done on a copy of the
+// message.
+func (l *recordSizeLimit) enforce(record []byte, pack *PipelinePack,
+	encoder Encoder) ([]byte, error) {
+
+	if len(record) <= l.max {
+		return record, nil
+	}
+	switch l.policy {
+	case "split":
+		atomic.AddInt64(&l.split, 1)
+		return nil, &OversizedRecordError{Size: len(record), Max: l.max, Record: record}
+	case "truncate":
+		if truncated, ok := l.truncate(record, pack, encoder); ok {
+			atomic.AddInt64(&l.truncated, 1)
+			return truncated, nil
+		}
+	}
+	atomic.AddInt64(&l.dropped, 1)
+	return nil, &OversizedRecordError{Size: len(record), Max: l.max}
+}
+
+// Shortens the truncated field by the excess and encodes the message again,
+// until the record fits or the field can't be shortened any further.
+func (l *recordSizeLimit) truncate(record []byte, pack *PipelinePack,
+	encoder Encoder) ([]byte, bool) {
+
+	msg := new(message.Message)
+	pack.Message.Copy(msg)
+	tmpPack := &PipelinePack{
+		Message:      msg,
+		MsgBytes:     pack.MsgBytes,
+		Decoded:      pack.Decoded,
+		MsgLoopCount: pack.MsgLoopCount,
+		RefCount:     1,
+	}
+	for i := 0; i < maxTruncateAttempts && len(record) > l.max; i++ {
+		value, ok := l.fieldValue(msg)
+		if !ok || value == "" {
+			return nil, false
+		}
+		keep := len(value) - (len(record) - l.max)
+		if keep < 0 {
+			keep = 0
+		}
+		// Don't split a multi-byte character.
+		for keep > 0 && !utf8.RuneStart(value[keep]) {
+			keep--
+		}
+		l.setFieldValue(msg, value[:keep])
+		var err error
+		if record, err = encoder.Encode(tmpPack); err != nil || record == nil {
+			return nil, false
+		}
+	}
+	return record, len(record) <= l.max
+}
+
+func (l *recordSizeLimit) fieldValue(msg *message.Message) (string, bool) {
+	if l.field == "Payload" {
+		return msg.GetPayload(), true
+	}
+	field := msg.FindFirstField(l.field)
+	if field == nil || field.GetValueType() != message.Field_STRING ||
+		len(field.ValueString) == 0 {
+
+		return "", false
+	}
+	return field.ValueString[0], true
+}
+
+func (l *recordSizeLimit) setFieldValue(msg *message.Message, value string) {
+	if l.field == "Payload" {
+		msg.SetPayload(value)
+		return
+	}
+	msg.FindFirstField(l.field).ValueString[0] = value
+}
+
+// Adds the limit's counts to an output's report.
+func (l *recordSizeLimit) ReportMsg(msg *message.Message) {
+	message.NewInt64Field(msg, "OversizedDropped", atomic.LoadInt64(&l.dropped),
+		"count")
+	message.NewInt64Field(msg, "OversizedTruncated", atomic.LoadInt64(&l.truncated),
+		"count")
+	message.NewInt64Field(msg, "OversizedSplit", atomic.LoadInt64(&l.split), "count")
+}
@@ -0,0 +1,107 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"github.com/mozilla-services/heka/message"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"strings"
+)
+
+func RecordSizeSpec(c gs.Context) {
+	c.Specify("A record size limit", func() {
+		pack := NewPipelinePack(nil)
+		pack.Message.SetPayload(strings.Repeat("a", 20))
+		runner := &foRunner{encoder: &_payloadEncoder{}}
+
+		c.Specify("isn't created without a maximum", func() {
+			c.Expect(newRecordSizeLimit(0, "drop", "") == nil, gs.IsTrue)
+		})
+
+		c.Specify("passes records within the limit", func() {
+			runner.sizeLimit = newRecordSizeLimit(20, "", "")
+			output, err := runner.Encode(pack)
+			c.Expect(err, gs.IsNil)
+			c.Expect(len(output), gs.Equals, 20)
+		})
+
+		c.Specify("drops oversized records by default", func() {
+			runner.sizeLimit = newRecordSizeLimit(10, "", "")
+			output, err := runner.Encode(pack)
+			c.Expect(output == nil, gs.IsTrue)
+			oversized, ok := err.(*OversizedRecordError)
+			c.Expect(ok, gs.IsTrue)
+			c.Expect(oversized.Size, gs.Equals, 20)
+			c.Expect(oversized.Record == nil, gs.IsTrue)
+			c.Expect(runner.sizeLimit.dropped, gs.Equals, int64(1))
+		})
+
+		c.Specify("truncates the payload of a copy of the message", func() {
+			runner.sizeLimit = newRecordSizeLimit(10, "truncate", "")
+			output, err := runner.Encode(pack)
+			c.Expect(err, gs.IsNil)
+			c.Expect(string(output), gs.Equals, strings.Repeat("a", 10))
+			c.Expect(pack.Message.GetPayload(), gs.Equals, strings.Repeat("a", 20))
+			c.Expect(runner.sizeLimit.truncated, gs.Equals, int64(1))
+		})
+
+		c.Specify("doesn't truncate in the middle of a character", func() {
+			pack.Message.SetPayload("aaaaaaaaaé")
+			runner.sizeLimit = newRecordSizeLimit(10, "truncate", "")
+			output, err := runner.Encode(pack)
+			c.Expect(err, gs.IsNil)
+			c.Expect(string(output), gs.Equals, "aaaaaaaaa")
+		})
+
+		c.Specify("truncates a string field", func() {
+			field, _ := message.NewField("body", strings.Repeat("b", 20), "")
+			pack.Message.AddField(field)
+			limit := newRecordSizeLimit(30, "truncate", "body")
+			encoder := &_fieldsEncoder{}
+			record, _ := encoder.Encode(pack)
+			output, err := limit.enforce(record, pack, encoder)
+			c.Expect(err, gs.IsNil)
+			c.Expect(len(output), gs.Equals, 30)
+			value, _ := pack.Message.GetFieldValue("body")
+			c.Expect(value.(string), gs.Equals, strings.Repeat("b", 20))
+		})
+
+		c.Specify("drops records it can't truncate", func() {
+			runner.sizeLimit = newRecordSizeLimit(10, "truncate", "missing")
+			_, err := runner.Encode(pack)
+			c.Expect(err, gs.Not(gs.IsNil))
+			c.Expect(runner.sizeLimit.dropped, gs.Equals, int64(1))
+		})
+
+		c.Specify("hands split records back to the output", func() {
+			runner.sizeLimit = newRecordSizeLimit(10, "split", "")
+			_, err := runner.Encode(pack)
+			oversized, ok := err.(*OversizedRecordError)
+			c.Expect(ok, gs.IsTrue)
+			c.Expect(len(oversized.Record), gs.Equals, 20)
+			c.Expect(runner.sizeLimit.split, gs.Equals, int64(1))
+		})
+
+		c.Specify("rejects unknown policies", func() {
+			c.Expect(validateOversizePolicy("split"), gs.IsNil)
+			c.Expect(validateOversizePolicy("squeeze"), gs.Not(gs.IsNil))
+		})
+	})
+}
+
+// Encodes the payload followed by the `body` field.
+type _fieldsEncoder struct{}
+
+func (enc *_fieldsEncoder) Encode(pack *PipelinePack) (output []byte, err error) {
+	value, _ := pack.Message.GetFieldValue("body")
+	return []byte(pack.Message.GetPayload() + value.(string)), nil
+}
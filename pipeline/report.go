@@ -60,14 +60,124 @@ func PopulateReportMsg(pr PluginRunner, msg *message.Message) (err error) {
 		}
 		fRunner.MatchRunner().reportLock.Unlock()
 		message.NewInt64Field(msg, "MatchAvgDuration", tmp, "ns")
-	} else if dRunner, ok := pr.(DecoderRunner); ok {
-		message.NewIntField(msg, "InChanCapacity", cap(dRunner.InChan()), "count")
-		message.NewIntField(msg, "InChanLength", len(dRunner.InChan()), "count")
+		message.NewInt64Field(msg, "MatchedMessages",
+			atomic.LoadInt64(&fRunner.MatchRunner().matchCount), "count")
+		if fRunner.MatchRunner().sampling() ||
+			atomic.LoadInt64(&fRunner.MatchRunner().sampledOutCount) > 0 {
+			message.NewInt64Field(msg, "SampledOutMessages",
+				atomic.LoadInt64(&fRunner.MatchRunner().sampledOutCount), "count")
+		}
+		if lRunner, ok := pr.(*foRunner); ok && lRunner.limiter != nil {
+			message.NewInt64Field(msg, "RateLimitedMessages", lRunner.limiter.limited(),
+				"count")
+		}
+		if wRunner, ok := pr.(*foRunner); ok && wRunner.windows != nil {
+			message.NewInt64Field(msg, "DroppedWindows",
+				wRunner.pConfig.watermarks.droppedWindows(wRunner.name), "count")
+		}
+		if oRunner, ok := pr.(*foRunner); ok && oRunner.kind == foOutput {
+			message.NewInt64Field(msg, "RetriedMessages",
+				atomic.LoadInt64(&oRunner.retryCount), "count")
+			message.NewInt64Field(msg, "ThrottledMessages",
+				atomic.LoadInt64(&oRunner.throttleCount), "count")
+			message.NewInt64Field(msg, "DroppedMessages",
+				atomic.LoadInt64(&oRunner.dropCount), "count")
+			if expired := atomic.LoadInt64(&oRunner.expiredCount); expired > 0 ||
+				oRunner.maxAge > 0 {
+				message.NewInt64Field(msg, "ExpiredMessages", expired, "count")
+			}
+			if oRunner.sizeLimit != nil {
+				oRunner.sizeLimit.ReportMsg(msg)
+			}
+			if oRunner.tsRewriter != nil {
+				oRunner.tsRewriter.ReportMsg(msg)
+			}
+			if oRunner.ordering != nil {
+				oRunner.ordering.ReportMsg(msg)
+			}
+		}
+		if bRunner, ok := pr.(*foRunner); ok && bRunner.buffer != nil {
+			message.NewInt64Field(msg, "BufferSize",
+				int64(atomic.LoadUint64(&bRunner.buffer.queueSize)), "B")
+			message.NewInt64Field(msg, "BufferDroppedMessages",
+				atomic.LoadInt64(&bRunner.buffer.dropCount), "count")
+		}
+	} else if decRunner, ok := pr.(DecoderRunner); ok {
+		message.NewIntField(msg, "InChanCapacity", cap(decRunner.InChan()), "count")
+		message.NewIntField(msg, "InChanLength", len(decRunner.InChan()), "count")
+		if dr, ok := decRunner.(*dRunner); ok {
+			message.NewInt64Field(msg, "DecodeFailures",
+				atomic.LoadInt64(&dr.decodeFailCount), "count")
+			message.NewInt64Field(msg, "DroppedMessages",
+				atomic.LoadInt64(&dr.dropCount), "count")
+		}
+	} else if ir, ok := pr.(*iRunner); ok {
+		dropped := atomic.LoadInt64(&ir.dropCount)
+		if ir.processors != nil {
+			dropped += atomic.LoadInt64(&ir.processors.dropCount)
+		}
+		message.NewInt64Field(msg, "DeliveredMessages",
+			atomic.LoadInt64(&ir.deliverCount), "count")
+		message.NewInt64Field(msg, "DecodeFailures",
+			atomic.LoadInt64(&ir.decodeFailCount), "count")
+		message.NewInt64Field(msg, "DroppedMessages", dropped, "count")
+		if ir.limiter != nil {
+			message.NewInt64Field(msg, "RateLimitedMessages", ir.limiter.limited(), "count")
+		}
 	}
 	msg.SetType("heka.plugin-report")
 	return
 }
 
+// Returns the report message of the named input, decoder, filter, output, or
+// encoder, the same as its entry in the `heka.all-report`, or false if there's
+// no such plugin.
+func (pc *PipelineConfig) PluginReport(name string) (msg *message.Message, ok bool) {
+	runner, ok := pc.pluginRunner(name)
+	msg = new(message.Message)
+	if ok {
+		if err := PopulateReportMsg(runner, msg); err != nil {
+			message.NewStringField(msg, "Error", err.Error())
+		}
+		return msg, true
+	}
+	encoder, ok := pc.allEncoders[name]
+	if !ok {
+		return nil, false
+	}
+	msg.SetType("heka.plugin-report")
+	if reporter, isReporter := encoder.(ReportingPlugin); isReporter {
+		if err := reporter.ReportMsg(msg); err != nil {
+			message.NewStringField(msg, "Error", err.Error())
+		}
+	}
+	return msg, true
+}
+
+// Returns the runner of the named input, decoder, filter, or output.
+func (pc *PipelineConfig) pluginRunner(name string) (runner PluginRunner, ok bool) {
+	pc.inputsLock.RLock()
+	runner, ok = pc.InputRunners[name]
+	pc.inputsLock.RUnlock()
+	if !ok {
+		pc.allDecodersLock.RLock()
+		for _, decoder := range pc.allDecoders {
+			if decoder.Name() == name {
+				runner, ok = decoder, true
+				break
+			}
+		}
+		pc.allDecodersLock.RUnlock()
+	}
+	if !ok {
+		runner, ok = pc.Filter(name)
+	}
+	if !ok {
+		runner, ok = pc.OutputRunners[name]
+	}
+	return
+}
+
 // Generate recycle channel and plugin report messages and put them on the
 // provided channel as they're ready.
 func (pc *PipelineConfig) reports(reportChan chan *PipelinePack) {
@@ -80,8 +190,7 @@ func (pc *PipelineConfig) reports(reportChan chan *PipelinePack) {
 
 	pack = <-pc.reportRecycleChan
 	msg = pack.Message
-	message.NewIntField(msg, "InChanCapacity", cap(pc.inputRecycleChan), "count")
-	message.NewIntField(msg, "InChanLength", len(pc.inputRecycleChan), "count")
+	pc.inputPool.ReportMsg(msg)
 	msg.SetLogger(HEKA_DAEMON)
 	msg.SetType("heka.input-report")
 	message.NewStringField(msg, "name", "inputRecycleChan")
@@ -90,8 +199,7 @@ func (pc *PipelineConfig) reports(reportChan chan *PipelinePack) {
 
 	pack = <-pc.reportRecycleChan
 	msg = pack.Message
-	message.NewIntField(msg, "InChanCapacity", cap(pc.injectRecycleChan), "count")
-	message.NewIntField(msg, "InChanLength", len(pc.injectRecycleChan), "count")
+	pc.injectPool.ReportMsg(msg)
 	msg.SetLogger(HEKA_DAEMON)
 	msg.SetType("heka.inject-report")
 	message.NewStringField(msg, "name", "injectRecycleChan")
@@ -104,12 +212,36 @@ func (pc *PipelineConfig) reports(reportChan chan *PipelinePack) {
 	message.NewIntField(msg, "InChanLength", len(pc.router.InChan()), "count")
 	message.NewInt64Field(msg, "ProcessMessageCount",
 		atomic.LoadInt64(&pc.router.processMessageCount), "count")
+	message.NewInt64Field(msg, "DeadLetterCount",
+		atomic.LoadInt64(&pc.deadLetterCount), "count")
+	message.NewInt64Field(msg, "PluginLogMessages",
+		atomic.LoadInt64(&pc.pluginLogCount), "count")
+	message.NewInt64Field(msg, "PluginLogDropped",
+		atomic.LoadInt64(&pc.pluginLogDropped), "count")
+	message.NewInt64Field(msg, "ExpiredMessages",
+		atomic.LoadInt64(&pc.router.expiredCount), "count")
+	if pc.shedder != nil {
+		pc.shedder.ReportMsg(msg)
+	}
 	msg.SetLogger(HEKA_DAEMON)
 	msg.SetType("heka.router-report")
 	message.NewStringField(msg, "name", "Router")
 	message.NewStringField(msg, "key", "globals")
 	reportChan <- pack
 
+	pack = <-pc.reportRecycleChan
+	msg = pack.Message
+	sources := pc.ResolvedConfig().Sources
+	message.NewIntField(msg, "FileSettings", sources[SETTING_FROM_FILE], "count")
+	message.NewIntField(msg, "EnvSettings", sources[SETTING_FROM_ENV], "count")
+	message.NewIntField(msg, "DefaultSettings", sources[SETTING_FROM_DEFAULT], "count")
+	message.NewIntField(msg, "AdminSettings", sources[SETTING_FROM_ADMIN], "count")
+	msg.SetLogger(HEKA_DAEMON)
+	msg.SetType("heka.config-report")
+	message.NewStringField(msg, "name", "Config")
+	message.NewStringField(msg, "key", "globals")
+	reportChan <- pack
+
 	getReport := func(runner PluginRunner) (pack *PipelinePack) {
 		pack = <-pc.reportRecycleChan
 		if err = PopulateReportMsg(runner, pack.Message); err != nil {
@@ -269,7 +401,8 @@ func (pc *PipelineConfig) FormatTextReport(report_type, payload string) string {
 		"InChanCapacity", "InChanLength", "MatchChanCapacity", "MatchChanLength",
 		"MatchAvgDuration", "ProcessMessageCount", "InjectMessageCount", "Memory",
 		"MaxMemory", "MaxInstructions", "MaxOutput", "ProcessMessageAvgDuration",
-		"TimerEventAvgDuration",
+		"TimerEventAvgDuration", "PoolSize", "PoolMinSize", "PoolUtilization",
+		"PoolExhausted", "PoolGrowths", "PoolShrinks", "DeadLetterCount",
 	}
 
 	///////////
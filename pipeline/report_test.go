@@ -26,7 +26,12 @@ var (
 	f1, _ = message.NewField("test1", "one", "")
 )
 
-func (f *CounterFilter) ReportMsg(msg *message.Message) (err error) {
+// CounterFilter reporting the test fields rather than its counts.
+type reportTestFilter struct {
+	CounterFilter
+}
+
+func (f *reportTestFilter) ReportMsg(msg *message.Message) (err error) {
 	msg.AddField(f0)
 	msg.AddField(f1)
 	return
@@ -73,7 +78,7 @@ func ReportSpec(c gs.Context) {
 	}
 
 	fName := "counter"
-	filter := new(CounterFilter)
+	filter := new(reportTestFilter)
 	foConfig := CommonFOConfig{
 		Matcher: "TRUE",
 	}
@@ -178,6 +183,27 @@ func ReportSpec(c gs.Context) {
 			routerReport := reports["Router"]
 			c.Expect(routerReport, gs.Not(gs.IsNil))
 			c.Expect(hasChannelData(routerReport.Message), gs.IsTrue)
+
+			configReport := reports["Config"]
+			c.Expect(configReport, gs.Not(gs.IsNil))
+			count, ok := configReport.Message.GetFieldValue("DefaultSettings")
+			c.Expect(ok, gs.IsTrue)
+			c.Expect(count.(int64), gs.Equals, int64(0))
+		})
+
+		c.Specify("returns the report of a single plugin", func() {
+			msg, ok := pc.PluginReport(fName)
+			c.Expect(ok, gs.IsTrue)
+			checkForFields(c, msg)
+			c.Expect(hasChannelData(msg), gs.IsTrue)
+
+			msg, ok = pc.PluginReport(iName)
+			c.Expect(ok, gs.IsTrue)
+			checkForFields(c, msg)
+
+			msg, ok = pc.PluginReport("missing")
+			c.Expect(ok, gs.IsFalse)
+			c.Expect(msg, gs.IsNil)
 		})
 	})
 }
@@ -76,12 +76,22 @@ func NewRetryHelper(opts RetryOptions) (helper *RetryHelper, err error) {
 //
 // If the max retries has been exceeded, an error will be returned
 func (r *RetryHelper) Wait() error {
+	return r.WaitAtLeast(0)
+}
+
+// Like Wait, but waits for at least the specified duration, e.g. a delay
+// requested by a throttling server.
+func (r *RetryHelper) WaitAtLeast(min time.Duration) error {
 	if r.retries != -1 && r.times >= r.retries {
 		return ErrMaxRetriesExceeded
 	}
 	jitter, _ := rand.Int(rand.Reader, big.NewInt(r.maxJitter.Nanoseconds()))
 	jitterWait := time.Duration(jitter.Int64()) * time.Nanosecond
-	timer := time.NewTimer(r.curDelay + jitterWait)
+	wait := r.curDelay + jitterWait
+	if wait < min {
+		wait = min
+	}
+	timer := time.NewTimer(wait)
 	select {
 	case <-timer.C:
 		break
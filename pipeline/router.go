@@ -17,6 +17,7 @@ package pipeline
 
 import (
 	"github.com/mozilla-services/heka/message"
+	"hash/fnv"
 	"log"
 	"math/rand"
 	"runtime"
@@ -29,8 +30,10 @@ import (
 // Public interface exposed by the Heka message router. The message router
 // accepts packs on its input channel and then runs them through the
 // message_matcher for every running Filter and Output plugin. For plugins
-// with a positive match, the pack (and any relevant match group captures)
-// will be placed on the plugin's input channel.
+// with a positive match, the pack will be placed on the plugin's input
+// channel. The values of the matcher's named capture groups aren't delivered
+// with the pack, plugins needing them call MatchCaptures, which evaluates the
+// matcher again.
 type MessageRouter interface {
 	// Input channel from which the router gets messages to test against the
 	// registered plugin message_matchers.
@@ -50,6 +53,7 @@ type MessageRouter interface {
 
 type messageRouter struct {
 	processMessageCount int64
+	expiredCount        int64
 	inChan              chan *PipelinePack
 	addFilterMatcher    chan *MatchRunner
 	removeFilterMatcher chan *MatchRunner
@@ -62,6 +66,14 @@ type messageRouter struct {
 	// the definitive list of active matchers.
 	fMatcherMap map[string]*MatchRunner
 	oMatcherMap map[string]*MatchRunner
+	// Called with every `heka.control.sampling` message, if set.
+	samplingControl func(pack *PipelinePack)
+	// Drops low severity messages under overload, if load shedding is
+	// configured.
+	shedder *loadShedder
+	// Slots of the matcher sub-expressions whose results are cached in each
+	// pack, so those shared by several matchers are only evaluated once.
+	matchIndex *message.MatchCacheIndex
 }
 
 // Creates and returns a (not yet started) Heka message router.
@@ -73,6 +85,7 @@ func NewMessageRouter(chanSize int) (router *messageRouter) {
 	router.removeOutputMatcher = make(chan *MatchRunner, 0)
 	router.fMatcherMap = make(map[string]*MatchRunner)
 	router.oMatcherMap = make(map[string]*MatchRunner)
+	router.matchIndex = message.NewMatchCacheIndex()
 	return router
 }
 
@@ -101,9 +114,11 @@ func (self *messageRouter) initMatchSlices() {
 	self.oMatchers = make([]*MatchRunner, 0, len(self.oMatcherMap))
 	for _, matcher := range self.fMatcherMap {
 		self.fMatchers = append(self.fMatchers, matcher)
+		self.matchIndex.Share(matcher.spec)
 	}
 	for _, matcher := range self.oMatcherMap {
 		self.oMatchers = append(self.oMatchers, matcher)
+		self.matchIndex.Share(matcher.spec)
 	}
 }
 
@@ -133,6 +148,7 @@ func (self *messageRouter) Start() {
 						}
 					}
 					if !exists {
+						self.matchIndex.Share(matcher.spec)
 						if available != -1 {
 							self.fMatchers[available] = matcher
 						} else {
@@ -165,7 +181,32 @@ func (self *messageRouter) Start() {
 					break
 				}
 				pack.diagnostics.Reset()
+				if self.shedder != nil && self.shedder.shouldShed(pack.Message) {
+					pack.resolveDelivery(ErrShed)
+					pack.Recycle()
+					continue
+				}
+				if ttlElapsed(pack.Message) {
+					atomic.AddInt64(&self.expiredCount, 1)
+					pack.resolveDelivery(ErrExpired)
+					pack.Recycle()
+					continue
+				}
+				pack.routeDelivery()
+				if pack.watermark != nil {
+					pack.watermark.observe(pack.Message.GetTimestamp())
+				}
+				if pack.stamper != nil {
+					pack.stamper.stamp(pack.Message)
+				}
+				pack.stampSchema()
+				pack.hookDeliver()
+				if self.samplingControl != nil &&
+					pack.Message.GetType() == SAMPLING_CONTROL_TYPE {
+					self.samplingControl(pack)
+				}
 				atomic.AddInt64(&self.processMessageCount, 1)
+				pack.matchCache.Reset(self.matchIndex.Len())
 				for _, matcher = range self.fMatchers {
 					if matcher != nil {
 						atomic.AddInt32(&pack.RefCount, 1)
@@ -199,11 +240,31 @@ func (self *messageRouter) Start() {
 type MatchRunner struct {
 	matchSamples  int64
 	matchDuration int64
+	matchCount    int64
 	spec          *message.MatcherSpecification
 	signer        string
 	inChan        chan *PipelinePack
 	pluginRunner  PluginRunner
 	reportLock    sync.Mutex
+	limiter       *rateLimiter
+	// Whether matches over the limiter's rate are delayed rather than
+	// dropped, for matchers that don't read from the router, e.g. a disk
+	// buffer's replay.
+	pace bool
+	// Matches are only delivered if the hash of their UUID is below the
+	// cutoff, see setSampleRate. Accessed atomically, since sampling
+	// profiles change it while the matcher runs.
+	sampleCutoff    uint64
+	sampledOutCount int64
+	// The plugin's own `sample_rate`, used when the sampling profile doesn't
+	// set one.
+	configuredRate float64
+	// Matches whose timestamps are older than maxAge, or whose TTL has
+	// elapsed if checkTTL is set, are passed to `expire` and recycled rather
+	// than delivered.
+	maxAge   time.Duration
+	checkTTL bool
+	expire   func(pack *PipelinePack)
 }
 
 // Creates and returns a new MatchRunner if possible, or a relevant error if
@@ -220,10 +281,62 @@ func NewMatchRunner(filter, signer string, runner PluginRunner, chanSize int) (
 		signer:       signer,
 		inChan:       make(chan *PipelinePack, chanSize),
 		pluginRunner: runner,
+		sampleCutoff: noSampleCutoff,
 	}
 	return
 }
 
+// Restricts delivery to the specified percentage of matching messages. The
+// messages are selected by a hash of their UUID, so the selection is the same
+// for every plugin sampling at the same rate, and a larger rate selects a
+// superset of a smaller one. A rate of 0, or 100 or more, disables sampling.
+func (mr *MatchRunner) setSampleRate(percent float64) {
+	cutoff := uint64(noSampleCutoff)
+	if percent > 0 && percent < 100 {
+		cutoff = sampleCutoff(percent)
+	}
+	atomic.StoreUint64(&mr.sampleCutoff, cutoff)
+}
+
+// Whether the matcher is currently sampling.
+func (mr *MatchRunner) sampling() bool {
+	return atomic.LoadUint64(&mr.sampleCutoff) < noSampleCutoff
+}
+
+// Whether a matching message is selected by the sample rate.
+func (mr *MatchRunner) sampled(pack *PipelinePack) bool {
+	cutoff := atomic.LoadUint64(&mr.sampleCutoff)
+	return cutoff >= noSampleCutoff || uuidSampled(pack, cutoff)
+}
+
+// Whether a matching message is older than the max age or, if checkTTL is
+// set, its TTL has elapsed. Messages without a timestamp never expire.
+func (mr *MatchRunner) expired(pack *PipelinePack) bool {
+	if mr.checkTTL && ttlElapsed(pack.Message) {
+		return true
+	}
+	if mr.maxAge <= 0 || pack.Message.Timestamp == nil {
+		return false
+	}
+	return time.Since(time.Unix(0, pack.Message.GetTimestamp())) > mr.maxAge
+}
+
+// UUID hash cutoff selecting every message.
+const noSampleCutoff = 1 << 32
+
+// Returns the UUID hash cutoff selecting the specified percentage of
+// messages.
+func sampleCutoff(percent float64) uint64 {
+	return uint64(percent / 100 * (1 << 32))
+}
+
+// Whether the hash of a pack's UUID is below a sampleCutoff.
+func uuidSampled(pack *PipelinePack, cutoff uint64) bool {
+	h := fnv.New32a()
+	h.Write(pack.Message.GetUuid())
+	return uint64(h.Sum32()) < cutoff
+}
+
 // Returns the runner's MatcherSpecification object.
 func (mr *MatchRunner) MatcherSpecification() *message.MatcherSpecification {
 	return mr.spec
@@ -249,69 +362,146 @@ func (mr *MatchRunner) GetAvgDuration() (duration int64) {
 // channel for a specific Filter or Output plugin). Any messages that are not a
 // match will be immediately recycled.
 func (mr *MatchRunner) Start(matchChan chan *PipelinePack, sampleDenom int) {
-	go func() {
-		defer func() {
-			if r := recover(); r != nil {
-				var err error
-				var ok bool
-				if err, ok = r.(error); !ok {
-					panic(r)
-				}
-				if !strings.Contains(err.Error(), "send on closed channel") {
-					panic(r)
-				}
+	go mr.run(sampleDenom, func(pack *PipelinePack) {
+		matchChan <- pack
+	}, nil, func() {
+		close(matchChan)
+	})
+}
+
+// Like Start, but matching messages are delivered on the provided batchChan
+// as slices. Whenever at least `threshold` messages are waiting on the input
+// channel, up to `maxSize` matches are collected into a single batch;
+// otherwise each match is delivered as soon as it's found.
+func (mr *MatchRunner) StartBatches(batchChan chan []*PipelinePack, sampleDenom,
+	threshold, maxSize int) {
+
+	if maxSize < 1 {
+		maxSize = 1
+	}
+	if threshold < 1 {
+		threshold = 1
+	}
+	batch := make([]*PipelinePack, 0, maxSize)
+	flush := func() {
+		batchChan <- batch
+		batch = make([]*PipelinePack, 0, maxSize)
+	}
+	go mr.run(sampleDenom, func(pack *PipelinePack) {
+		batch = append(batch, pack)
+	}, func() {
+		// Checked after every message, matching or not, so a partial batch
+		// is never held once the backlog clears.
+		if len(batch) > 0 && (len(batch) >= maxSize || len(mr.inChan) < threshold) {
+			flush()
+		}
+	}, func() {
+		if len(batch) > 0 {
+			flush()
+		}
+		close(batchChan)
+	})
+}
+
+// Matches every message received on the input channel, passing matches to
+// `deliver` and recycling the rest. If provided, `after` is called after each
+// message has been handled. `done` is called once the input channel has been
+// closed.
+func (mr *MatchRunner) run(sampleDenom int, deliver func(pack *PipelinePack),
+	after func(), done func()) {
+
+	defer func() {
+		if r := recover(); r != nil {
+			var err error
+			var ok bool
+			if err, ok = r.(error); !ok {
+				panic(r)
 			}
-		}()
-
-		var (
-			startTime time.Time
-			random    int = rand.Intn(1000) + sampleDenom
-			// Don't have everyone sample at the same time. We always start with
-			// a sample so there will be a ballpark figure immediately. We could
-			// use a ticker to sample at a regular interval but that seems like
-			// overkill at this  point.
-			counter  int = random
-			match    bool
-			duration int64
-		)
-
-		var capacity int64 = int64(cap(mr.inChan))
-		for pack := range mr.inChan {
-			if len(mr.signer) != 0 && mr.signer != pack.Signer {
-				pack.Recycle()
-				continue
+			if !strings.Contains(err.Error(), "send on closed channel") {
+				panic(r)
 			}
-			// We may want to keep separate samples for match/nomatch conditions.
-			// In most cases the random sampling will capture the most common
-			// condition which is usesful for the overall system health but not
-			// matcher tuning.  Capturing the duration adds ~40ns
-			if counter == random {
-				startTime = time.Now()
-
-				match = mr.spec.Match(pack.Message)
-
-				duration = time.Since(startTime).Nanoseconds()
-				mr.reportLock.Lock()
-				mr.matchDuration += duration
-				mr.matchSamples++
-				mr.reportLock.Unlock()
-				if mr.matchSamples > capacity {
-					// the timings can vary greatly, so we need to establish a
-					// decent baseline before we start sampling
-					counter = 0
-				}
-			} else {
-				match = mr.spec.Match(pack.Message)
-				counter++
+		}
+	}()
+
+	var (
+		startTime time.Time
+		random    int = rand.Intn(1000) + sampleDenom
+		// Don't have everyone sample at the same time. We always start with
+		// a sample so there will be a ballpark figure immediately. We could
+		// use a ticker to sample at a regular interval but that seems like
+		// overkill at this  point.
+		counter  int = random
+		match    bool
+		duration int64
+	)
+
+	labelPluginGoroutine(mr.pluginRunner.Name())
+	var capacity int64 = int64(cap(mr.inChan))
+	_, isOutput := mr.pluginRunner.(OutputRunner)
+	for pack := range mr.inChan {
+		if len(mr.signer) != 0 && mr.signer != pack.Signer {
+			pack.Recycle()
+			continue
+		}
+		// We may want to keep separate samples for match/nomatch conditions.
+		// In most cases the random sampling will capture the most common
+		// condition which is usesful for the overall system health but not
+		// matcher tuning.  Capturing the duration adds ~40ns
+		if counter == random {
+			startTime = time.Now()
+
+			match = mr.spec.MatchCached(pack.Message, &pack.matchCache)
+
+			duration = time.Since(startTime).Nanoseconds()
+			mr.reportLock.Lock()
+			mr.matchDuration += duration
+			mr.matchSamples++
+			mr.reportLock.Unlock()
+			if mr.matchSamples > capacity {
+				// the timings can vary greatly, so we need to establish a
+				// decent baseline before we start sampling
+				counter = 0
 			}
+		} else {
+			match = mr.spec.MatchCached(pack.Message, &pack.matchCache)
+			counter++
+		}
 
-			if match {
-				pack.diagnostics.AddStamp(mr.pluginRunner)
-				matchChan <- pack
-			} else {
-				pack.Recycle()
+		if match && !mr.sampled(pack) {
+			atomic.AddInt64(&mr.sampledOutCount, 1)
+			match = false
+		}
+
+		if match && mr.expired(pack) {
+			if mr.expire != nil {
+				mr.expire(pack)
 			}
+			match = false
 		}
-		close(matchChan)
-	}()
+
+		if match && mr.limiter != nil {
+			if mr.pace {
+				mr.limiter.wait()
+			} else if !mr.limiter.admit() {
+				// Messages over the plugin's rate limit are dropped, waiting
+				// for a token would stall the router's other deliveries.
+				match = false
+			}
+		}
+
+		if match {
+			atomic.AddInt64(&mr.matchCount, 1)
+			pack.diagnostics.AddStamp(mr.pluginRunner)
+			if isOutput && pack.delivery != nil {
+				atomic.AddInt32(&pack.deliveryOutputs, 1)
+			}
+			deliver(pack)
+		} else {
+			pack.Recycle()
+		}
+		if after != nil {
+			after()
+		}
+	}
+	done()
 }
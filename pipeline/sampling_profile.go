@@ -0,0 +1,122 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// Type of the control messages switching the active sampling profile. The
+// payload is the name of the profile, or empty to switch back to the
+// plugins' own sample rates.
+const SAMPLING_CONTROL_TYPE = "heka.control.sampling"
+
+// Checks the sampling profiles defined in the hekad config and the name of
+// the profile initially active.
+func ValidateSamplingProfiles(profiles map[string]map[string]float64, active string) error {
+	for name, rates := range profiles {
+		for plugin, rate := range rates {
+			if rate <= 0 || rate > 100 {
+				return fmt.Errorf("sampling profile '%s': '%s' sample rate must be "+
+					"greater than 0 and at most 100", name, plugin)
+			}
+		}
+	}
+	if _, ok := profiles[active]; !ok && active != "" {
+		return fmt.Errorf("unknown sampling_profile '%s'", active)
+	}
+	return nil
+}
+
+// Switches the sampling profile, which sets the sample rates of the filters
+// and outputs it names and restores the `sample_rate` of every other one.
+// Plugins started later use the active profile's rates too. An empty name
+// leaves every plugin at its own sample rate.
+func (pc *PipelineConfig) SetSamplingProfile(name, source string) error {
+	t := pc.Globals.Tunables()
+	t.SamplingProfile = name
+	return pc.TuneGlobals(t, source)
+}
+
+// Returns a plugin's sample rate under the active profile. Called with the
+// tuningMutex held.
+func (g *GlobalConfigStruct) profileSampleRate(plugin string, mr *MatchRunner) float64 {
+	if rate, ok := g.SamplingProfiles[g.SamplingProfile][plugin]; ok {
+		return rate
+	}
+	return mr.configuredRate
+}
+
+// Applies the active profile to the running filters and outputs. Called with
+// the tuningMutex held.
+func (pc *PipelineConfig) applySamplingProfile() {
+	g := pc.Globals
+	pc.filtersLock.RLock()
+	for name, runner := range pc.FilterRunners {
+		if mr := runner.MatchRunner(); mr != nil {
+			mr.setSampleRate(g.profileSampleRate(name, mr))
+		}
+	}
+	pc.filtersLock.RUnlock()
+	pc.outputsLock.RLock()
+	for name, runner := range pc.OutputRunners {
+		if mr := runner.MatchRunner(); mr != nil {
+			mr.setSampleRate(g.profileSampleRate(name, mr))
+		}
+	}
+	pc.outputsLock.RUnlock()
+}
+
+// Applies the active profile to a plugin that's starting.
+func (pc *PipelineConfig) applySamplingProfileTo(name string, mr *MatchRunner) {
+	g := pc.Globals
+	g.tuningMutex.RLock()
+	mr.setSampleRate(g.profileSampleRate(name, mr))
+	g.tuningMutex.RUnlock()
+}
+
+// Handles a `heka.control.sampling` message seen by the router. Ignored
+// unless sampling profiles are defined, or if not from one of the
+// SamplingControlSigners when those are set.
+func (pc *PipelineConfig) samplingControl(pack *PipelinePack) {
+	g := pc.Globals
+	if len(g.SamplingProfiles) == 0 {
+		return
+	}
+	if len(g.SamplingControlSigners) > 0 {
+		allowed := false
+		for _, signer := range g.SamplingControlSigners {
+			if signer == pack.Signer {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			log.Printf("Ignored sampling control message from signer '%s'", pack.Signer)
+			return
+		}
+	}
+	name := strings.TrimSpace(pack.Message.GetPayload())
+	source := "control message"
+	if pack.Signer != "" {
+		source = fmt.Sprintf("control message signed by %s", pack.Signer)
+	}
+	// The change is announced through the router, so it can't be made on
+	// the router's goroutine.
+	go func() {
+		if err := pc.SetSamplingProfile(name, source); err != nil {
+			log.Printf("Sampling profile not changed: %s", err)
+		}
+	}()
+}
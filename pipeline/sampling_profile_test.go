@@ -0,0 +1,115 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"time"
+)
+
+func SamplingProfileSpec(c gs.Context) {
+	c.Specify("Sampling profiles", func() {
+		pc := NewPipelineConfig(nil)
+		pc.injectPool.fill(nil)
+		pc.Globals.SamplingProfiles = map[string]map[string]float64{
+			"normal":         {"debug": 1},
+			"incident-debug": {"debug": 100, "archive": 50},
+		}
+		addOutput := func(name string, rate float64) *foRunner {
+			runner, err := NewFORunner(name, &StoppingOutput{},
+				CommonFOConfig{Matcher: "TRUE", SampleRate: rate}, "StoppingOutput", 10)
+			c.Assume(err, gs.IsNil)
+			pc.OutputRunners[name] = runner
+			return runner
+		}
+		debug := addOutput("debug", 0)
+		archive := addOutput("archive", 10)
+		other := addOutput("other", 0)
+
+		c.Specify("are validated", func() {
+			err := ValidateSamplingProfiles(pc.Globals.SamplingProfiles, "normal")
+			c.Expect(err, gs.IsNil)
+			err = ValidateSamplingProfiles(pc.Globals.SamplingProfiles, "verbose")
+			c.Expect(err, gs.Not(gs.IsNil))
+			err = ValidateSamplingProfiles(map[string]map[string]float64{
+				"broken": {"debug": 0}}, "")
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+
+		c.Specify("set the sample rates of the plugins they name", func() {
+			err := pc.SetSamplingProfile("normal", "test")
+			c.Assume(err, gs.IsNil)
+			c.Expect(debug.matcher.sampleCutoff, gs.Equals, sampleCutoff(1))
+			c.Expect(archive.matcher.sampleCutoff, gs.Equals, sampleCutoff(10))
+			c.Expect(other.matcher.sampling(), gs.IsFalse)
+
+			err = pc.SetSamplingProfile("incident-debug", "test")
+			c.Assume(err, gs.IsNil)
+			c.Expect(debug.matcher.sampling(), gs.IsFalse)
+			c.Expect(archive.matcher.sampleCutoff, gs.Equals, sampleCutoff(50))
+			c.Expect(pc.Globals.Tunables().SamplingProfile, gs.Equals, "incident-debug")
+
+			c.Specify("and restore the configured rates when cleared", func() {
+				err = pc.SetSamplingProfile("", "test")
+				c.Assume(err, gs.IsNil)
+				c.Expect(debug.matcher.sampling(), gs.IsFalse)
+				c.Expect(archive.matcher.sampleCutoff, gs.Equals, sampleCutoff(10))
+			})
+
+			c.Specify("and announce each switch", func() {
+				<-pc.router.inChan
+				pack := <-pc.router.inChan
+				c.Expect(pack.Message.GetType(), gs.Equals, GLOBALS_CHANGED_TYPE)
+				setting, _ := pack.Message.GetFieldValue("setting")
+				c.Expect(setting, gs.Equals, "sampling_profile")
+				old, _ := pack.Message.GetFieldValue("old")
+				c.Expect(old, gs.Equals, "normal")
+			})
+		})
+
+		c.Specify("reject unknown profiles", func() {
+			err := pc.SetSamplingProfile("verbose", "test")
+			c.Expect(err, gs.Not(gs.IsNil))
+			c.Expect(pc.Globals.Tunables().SamplingProfile, gs.Equals, "")
+		})
+
+		c.Specify("are switched by control messages", func() {
+			pack := NewPipelinePack(pc.injectRecycleChan)
+			pack.Message.SetType(SAMPLING_CONTROL_TYPE)
+			pack.Message.SetPayload("incident-debug\n")
+
+			c.Specify("from any signer by default", func() {
+				pc.samplingControl(pack)
+				waitForProfile := func() string {
+					deadline := time.Now().Add(time.Second)
+					for time.Now().Before(deadline) {
+						if profile := pc.Globals.Tunables().SamplingProfile; profile != "" {
+							return profile
+						}
+						time.Sleep(time.Millisecond)
+					}
+					return ""
+				}
+				c.Expect(waitForProfile(), gs.Equals, "incident-debug")
+				c.Expect(archive.matcher.sampleCutoff, gs.Equals, sampleCutoff(50))
+			})
+
+			c.Specify("only from the allowed signers if set", func() {
+				pc.Globals.SamplingControlSigners = []string{"ops"}
+				pack.Signer = "intruder"
+				pc.samplingControl(pack)
+				time.Sleep(10 * time.Millisecond)
+				c.Expect(pc.Globals.Tunables().SamplingProfile, gs.Equals, "")
+			})
+		})
+	})
+}
@@ -0,0 +1,185 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Specifies how to check whether an output is ready to accept data before
+// hekad starts its inputs.
+type StartupProbeConfig struct {
+	// "tcp", "http", or "custom". Empty (the default) disables the probe.
+	Type string `toml:"type"`
+	// host:port to connect to for "tcp" probes, URL to GET for "http" probes.
+	Address string `toml:"address"`
+	// HTTP status code an "http" probe expects. Defaults to 0, i.e. any 2xx
+	// status.
+	ExpectStatus int `toml:"expect_status"`
+	// How long to wait between attempts, also used as the timeout for each
+	// attempt. Defaults to "1s".
+	Interval string `toml:"interval"`
+	// How long to wait for the output to become ready. Defaults to "5m".
+	Timeout string `toml:"timeout"`
+	// If true, hekad shuts down rather than starting the inputs when the
+	// output doesn't become ready in time.
+	Required bool `toml:"required"`
+}
+
+func getDefaultStartupProbeConfig() StartupProbeConfig {
+	return StartupProbeConfig{
+		Interval: "1s",
+		Timeout:  "5m",
+	}
+}
+
+// Implemented by outputs that can report whether they're ready to accept
+// data, e.g. whether a buffer has drained below some threshold. Used by
+// "custom" startup probes. Note that this will be called while the output is
+// running.
+type StartupProber interface {
+	// Returns nil if the output is ready, or an error describing why not.
+	StartupReady() error
+}
+
+type startupProbe struct {
+	config   StartupProbeConfig
+	interval time.Duration
+	timeout  time.Duration
+	check    func() error
+}
+
+func newStartupProbe(config StartupProbeConfig, plugin Plugin) (*startupProbe, error) {
+	var err error
+	probe := &startupProbe{config: config}
+	if probe.interval, err = time.ParseDuration(config.Interval); err != nil {
+		return nil, fmt.Errorf("invalid interval: %s", err)
+	}
+	if probe.timeout, err = time.ParseDuration(config.Timeout); err != nil {
+		return nil, fmt.Errorf("invalid timeout: %s", err)
+	}
+
+	switch strings.ToLower(config.Type) {
+	case "tcp":
+		if config.Address == "" {
+			return nil, errors.New("tcp probe requires an address")
+		}
+		probe.check = probe.checkTCP
+	case "http":
+		if config.Address == "" {
+			return nil, errors.New("http probe requires an address")
+		}
+		probe.check = probe.checkHTTP
+	case "custom":
+		prober, ok := plugin.(StartupProber)
+		if !ok {
+			return nil, errors.New("plugin doesn't support custom probes")
+		}
+		probe.check = prober.StartupReady
+	default:
+		return nil, fmt.Errorf("unknown type: %s", config.Type)
+	}
+	return probe, nil
+}
+
+func (p *startupProbe) checkTCP() error {
+	conn, err := net.DialTimeout("tcp", p.config.Address, p.interval)
+	if err != nil {
+		return err
+	}
+	conn.Close()
+	return nil
+}
+
+func (p *startupProbe) checkHTTP() error {
+	client := &http.Client{Timeout: p.interval}
+	resp, err := client.Get(p.config.Address)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if p.config.ExpectStatus != 0 {
+		if resp.StatusCode != p.config.ExpectStatus {
+			return fmt.Errorf("expected status %d, got %s", p.config.ExpectStatus,
+				resp.Status)
+		}
+	} else if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("got status %s", resp.Status)
+	}
+	return nil
+}
+
+// Polls until the probe succeeds or times out. Returns an error only if the
+// probe timed out and is required.
+func (p *startupProbe) wait(name string) error {
+	deadline := time.Now().Add(p.timeout)
+	var err error
+	for attempt := 0; ; attempt++ {
+		if err = p.check(); err == nil {
+			if attempt > 0 {
+				log.Printf("Output '%s' is ready", name)
+			}
+			return nil
+		}
+		if attempt == 0 {
+			log.Printf("Output '%s' isn't ready, delaying inputs: %s", name, err)
+		}
+		if time.Now().Add(p.interval).After(deadline) {
+			break
+		}
+		time.Sleep(p.interval)
+	}
+	if p.config.Required {
+		return fmt.Errorf("output '%s' not ready after %s: %s", name, p.timeout, err)
+	}
+	log.Printf("Output '%s' still isn't ready after %s, starting inputs anyway: %s",
+		name, p.timeout, err)
+	return nil
+}
+
+// Waits for all of the outputs with startup probes to be ready. Returns an
+// error if any required probes failed.
+func (self *PipelineConfig) waitForStartupProbes() error {
+	var wg sync.WaitGroup
+	errChan := make(chan error, len(self.OutputRunners))
+	for name, output := range self.OutputRunners {
+		runner, ok := output.(*foRunner)
+		if !ok || runner.startupProbe == nil {
+			continue
+		}
+		wg.Add(1)
+		go func(name string, probe *startupProbe) {
+			if err := probe.wait(name); err != nil {
+				errChan <- err
+			}
+			wg.Done()
+		}(name, runner.startupProbe)
+	}
+	wg.Wait()
+	close(errChan)
+
+	var errs []string
+	for err := range errChan {
+		errs = append(errs, err.Error())
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, ", "))
+	}
+	return nil
+}
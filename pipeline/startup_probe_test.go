@@ -0,0 +1,105 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"errors"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"net"
+	"net/http"
+	"net/http/httptest"
+)
+
+type probedOutput struct {
+	ready int
+}
+
+func (o *probedOutput) Init(config interface{}) error {
+	return nil
+}
+
+func (o *probedOutput) Run(or OutputRunner, h PluginHelper) error {
+	return nil
+}
+
+func (o *probedOutput) StartupReady() error {
+	if o.ready > 0 {
+		o.ready--
+		return errors.New("buffer too large")
+	}
+	return nil
+}
+
+func StartupProbeSpec(c gs.Context) {
+	c.Specify("A startup probe", func() {
+		config := getDefaultStartupProbeConfig()
+		config.Interval = "10ms"
+		config.Timeout = "50ms"
+
+		c.Specify("rejects bad config", func() {
+			config.Type = "carrier-pigeon"
+			_, err := newStartupProbe(config, &probedOutput{})
+			c.Expect(err, gs.Not(gs.IsNil))
+
+			config.Type = "tcp"
+			_, err = newStartupProbe(config, &probedOutput{})
+			c.Expect(err.Error(), gs.Equals, "tcp probe requires an address")
+
+			config.Type = "custom"
+			_, err = newStartupProbe(config, &StoppingOutput{})
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+
+		c.Specify("connects via tcp", func() {
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			c.Assume(err, gs.IsNil)
+			config.Type = "tcp"
+			config.Address = listener.Addr().String()
+			probe, err := newStartupProbe(config, &probedOutput{})
+			c.Assume(err, gs.IsNil)
+			c.Expect(probe.wait("test"), gs.IsNil)
+
+			// Closed ports only fail required probes.
+			listener.Close()
+			c.Expect(probe.wait("test"), gs.IsNil)
+			probe.config.Required = true
+			c.Expect(probe.wait("test"), gs.Not(gs.IsNil))
+		})
+
+		c.Specify("checks the http status", func() {
+			server := httptest.NewServer(http.HandlerFunc(
+				func(w http.ResponseWriter, r *http.Request) {
+					w.WriteHeader(http.StatusAccepted)
+				}))
+			defer server.Close()
+			config.Type = "http"
+			config.Address = server.URL
+			config.Required = true
+			probe, err := newStartupProbe(config, &probedOutput{})
+			c.Assume(err, gs.IsNil)
+			c.Expect(probe.wait("test"), gs.IsNil)
+
+			probe.config.ExpectStatus = http.StatusOK
+			c.Expect(probe.wait("test"), gs.Not(gs.IsNil))
+		})
+
+		c.Specify("waits for a custom prober", func() {
+			output := &probedOutput{ready: 2}
+			config.Type = "custom"
+			config.Required = true
+			probe, err := newStartupProbe(config, output)
+			c.Assume(err, gs.IsNil)
+			c.Expect(probe.wait("test"), gs.IsNil)
+			c.Expect(output.ready, gs.Equals, 0)
+		})
+	})
+}
@@ -16,10 +16,13 @@ package pipeline
 
 import (
 	"bytes"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"github.com/mozilla-services/heka/message"
 	"io"
 	"regexp"
+	"time"
 )
 
 // StreamParser interface to read a spilt a stream into records
@@ -323,3 +326,374 @@ func (m *MessageProtoParser) findRecord(buf []byte) (bytesRead int, record []byt
 	}
 	return
 }
+
+// Length prefixed record parser, each record following its length as a 4
+// byte big endian integer, or as a protobuf varint. The length isn't part of
+// the record. As the records can't be told apart from the stream, a record
+// longer than MAX_RECORD_SIZE is skipped rather than truncated.
+type LengthPrefixParser struct {
+	*streamParserBuffer
+	varint bool
+	// Bytes left to skip of a record that was too long.
+	skip uint64
+}
+
+func NewLengthPrefixParser() (l *LengthPrefixParser) {
+	l = new(LengthPrefixParser)
+	l.streamParserBuffer = newStreamParserBuffer()
+	return
+}
+
+// Sets whether the lengths are protobuf varints, as written by
+// protobuf's writeDelimitedTo, rather than 4 byte big endian integers.
+func (l *LengthPrefixParser) SetVarint(varint bool) {
+	l.varint = varint
+}
+
+func (l *LengthPrefixParser) Parse(reader io.Reader) (bytesRead int, record []byte, err error) {
+	if l.needData {
+		if bytesRead, err = l.read(reader); err != nil {
+			return
+		}
+	}
+	l.readPos += bytesRead
+
+	bytesRead, record, err = l.findRecord(l.buf[l.scanPos:l.readPos])
+	l.scanPos += bytesRead
+	if l.readPos == l.scanPos {
+		l.readPos = 0
+		l.scanPos = 0
+		l.needData = true
+	} else {
+		// Empty records and skipped bytes don't need more data.
+		l.needData = bytesRead == 0 && err == nil
+	}
+	return
+}
+
+func (l *LengthPrefixParser) GetRemainingData() []byte {
+	l.skip = 0
+	return l.streamParserBuffer.GetRemainingData()
+}
+
+func (l *LengthPrefixParser) findRecord(buf []byte) (bytesRead int, record []byte, err error) {
+	if l.skip > 0 {
+		bytesRead = len(buf)
+		if uint64(bytesRead) > l.skip {
+			bytesRead = int(l.skip)
+		}
+		l.skip -= uint64(bytesRead)
+		return
+	}
+
+	var (
+		length    uint64
+		prefixLen int
+	)
+	if l.varint {
+		if length, prefixLen = binary.Uvarint(buf); prefixLen < 0 {
+			return -prefixLen, nil, errors.New("invalid varint record length")
+		}
+	} else if len(buf) >= 4 {
+		length, prefixLen = uint64(binary.BigEndian.Uint32(buf)), 4
+	}
+	if prefixLen == 0 {
+		return // read more data to get the length
+	}
+	if length > uint64(message.MAX_RECORD_SIZE-prefixLen) {
+		l.skip = length + uint64(prefixLen)
+		return 0, nil, fmt.Errorf("record of %d bytes exceeded MAX_RECORD_SIZE %d "+
+			"and was skipped", length, message.MAX_RECORD_SIZE)
+	}
+	recordEnd := prefixLen + int(length)
+	if len(buf) < recordEnd {
+		return // read more data to get the remainder of the record
+	}
+	return recordEnd, buf[prefixLen:recordEnd], nil
+}
+
+// JSON value parser, splitting a stream of concatenated JSON values, e.g.
+// pretty printed objects, into one record per top level value, whatever
+// whitespace separates them. Braces and brackets in strings are ignored, so
+// values are split correctly whatever they contain, but the values aren't
+// otherwise validated. Bytes that can't start a value are skipped.
+type JsonParser struct {
+	*streamParserBuffer
+	// Where the current value starts, -1 if none was found yet, and how far
+	// it was scanned, relative to the start of the unparsed data.
+	start    int
+	scanned  int
+	depth    int
+	inString bool
+	escaped  bool
+}
+
+func NewJsonParser() (j *JsonParser) {
+	j = new(JsonParser)
+	j.streamParserBuffer = newStreamParserBuffer()
+	j.start = -1
+	return
+}
+
+func (j *JsonParser) Parse(reader io.Reader) (bytesRead int, record []byte, err error) {
+	if j.needData {
+		if bytesRead, err = j.read(reader); err != nil {
+			if err == io.ErrShortBuffer {
+				record = j.buf
+				j.reset()
+				// return truncated message and allow input plugin to decide what to do with it
+			}
+			return
+		}
+	}
+	j.readPos += bytesRead
+
+	bytesRead, record = j.findRecord(j.buf[j.scanPos:j.readPos])
+	j.scanPos += bytesRead
+	if len(record) == 0 {
+		j.needData = true
+	} else {
+		if j.readPos == j.scanPos {
+			j.readPos = 0
+			j.scanPos = 0
+			j.needData = true
+		} else {
+			j.needData = false
+		}
+	}
+	return
+}
+
+func (j *JsonParser) GetRemainingData() []byte {
+	j.reset()
+	return j.streamParserBuffer.GetRemainingData()
+}
+
+func (j *JsonParser) reset() {
+	j.start, j.scanned, j.depth = -1, 0, 0
+	j.inString, j.escaped = false, false
+}
+
+func (j *JsonParser) findRecord(buf []byte) (bytesRead int, record []byte) {
+	for i := j.scanned; i < len(buf); i++ {
+		c := buf[i]
+		switch {
+		case j.inString:
+			if j.escaped {
+				j.escaped = false
+			} else if c == '\\' {
+				j.escaped = true
+			} else if c == '"' {
+				j.inString = false
+				if j.depth == 0 {
+					return j.value(buf, i+1)
+				}
+			}
+		case j.start < 0:
+			switch c {
+			case '{', '[':
+				j.start, j.depth = i, 1
+			case '"':
+				j.start, j.inString = i, true
+			case '-', '0', '1', '2', '3', '4', '5', '6', '7', '8', '9', 't', 'f', 'n':
+				j.start = i
+			}
+		case j.depth == 0:
+			// A number, true, false, or null, ending where the next value or
+			// whitespace starts.
+			switch c {
+			case ' ', '\t', '\r', '\n', '{', '[', '"', '}', ']', ',', message.RECORD_SEPARATOR:
+				return j.value(buf, i)
+			}
+		case c == '"':
+			j.inString = true
+		case c == '{' || c == '[':
+			j.depth++
+		case c == '}' || c == ']':
+			if j.depth--; j.depth == 0 {
+				return j.value(buf, i+1)
+			}
+		}
+	}
+	if j.start < 0 {
+		// Nothing but whitespace or corruption, which isn't kept.
+		bytesRead = len(buf)
+		return
+	}
+	j.scanned = len(buf)
+	return
+}
+
+// Returns the value ending at end, and the bytes read up to its end.
+func (j *JsonParser) value(buf []byte, end int) (bytesRead int, record []byte) {
+	record = buf[j.start:end]
+	j.reset()
+	return end, record
+}
+
+// Settings of a MultilineParser, e.g. the `multiline` section of the inputs
+// reading log files.
+type MultilineOptions struct {
+	// Regexp matching the first line of a record, e.g. the timestamp a log
+	// line starts with.
+	Start string
+	// Regexp matching the lines continuing a record, e.g. "^\s" for the
+	// indented lines of a stack trace. A line matching neither regexp starts
+	// a record of its own.
+	Continuation string
+	// Maximum number of lines in a record, 0 for no limit. Defaults to 500.
+	MaxLines int `toml:"max_lines"`
+	// Maximum size of a record in bytes. Defaults to MAX_RECORD_SIZE.
+	MaxBytes int `toml:"max_bytes"`
+	// How long a record waits for more lines before it's returned, as a
+	// duration, e.g. "500ms". Defaults to 5s.
+	Timeout string
+}
+
+// Whether a start or continuation regexp is set.
+func (o *MultilineOptions) Enabled() bool {
+	return o.Start != "" || o.Continuation != ""
+}
+
+// Multiline record parser, joining the records of another parser, e.g. the
+// lines of a log file, into records, e.g. an exception and its stack trace.
+// A record only ends when its next one starts, so it's also returned once no
+// lines were added to it for the timeout, rather than waiting for a record
+// that may not be written for a while.
+type MultilineParser struct {
+	parser       StreamParser
+	start        *regexp.Regexp
+	continuation *regexp.Regexp
+	maxLines     int
+	maxBytes     int
+	timeout      time.Duration
+	record       []byte
+	lines        int
+	// Bytes of the stream read into the record. They're returned as read
+	// with the record, so the position saved by an input doesn't move past
+	// the lines of a record it hasn't delivered.
+	recordBytes int
+	appended    time.Time
+	// The last record returned, its buffer reused for the next one.
+	returned []byte
+	// A truncated record returned by the parser, kept until the record it
+	// ended has been returned.
+	truncated      []byte
+	truncatedBytes int
+	// Swapped out in tests.
+	now func() time.Time
+}
+
+func NewMultilineParser(parser StreamParser, opts MultilineOptions) (m *MultilineParser,
+	err error) {
+
+	if !opts.Enabled() {
+		return nil, errors.New("a multiline start or continuation regexp is required")
+	}
+	m = &MultilineParser{
+		parser:   parser,
+		maxLines: opts.MaxLines,
+		maxBytes: opts.MaxBytes,
+		timeout:  5 * time.Second,
+		now:      time.Now,
+	}
+	if opts.Start != "" {
+		if m.start, err = regexp.Compile(opts.Start); err != nil {
+			return nil, fmt.Errorf("invalid multiline start regexp: %s", err)
+		}
+	}
+	if opts.Continuation != "" {
+		if m.continuation, err = regexp.Compile(opts.Continuation); err != nil {
+			return nil, fmt.Errorf("invalid multiline continuation regexp: %s", err)
+		}
+	}
+	if m.maxLines < 0 || m.maxBytes < 0 {
+		return nil, errors.New("multiline max_lines and max_bytes can't be negative")
+	}
+	if m.maxBytes == 0 || m.maxBytes > message.MAX_RECORD_SIZE {
+		m.maxBytes = message.MAX_RECORD_SIZE
+	}
+	if opts.Timeout != "" {
+		if m.timeout, err = time.ParseDuration(opts.Timeout); err != nil {
+			return nil, fmt.Errorf("invalid multiline timeout: %s", err)
+		}
+	}
+	return
+}
+
+func (m *MultilineParser) Parse(reader io.Reader) (bytesRead int, record []byte, err error) {
+	if m.truncated != nil {
+		bytesRead, record, err = m.truncatedBytes, m.truncated, io.ErrShortBuffer
+		m.truncated = nil
+		return
+	}
+	for {
+		var (
+			n    int
+			line []byte
+		)
+		n, line, err = m.parser.Parse(reader)
+		if err == io.ErrShortBuffer {
+			if len(m.record) == 0 {
+				bytesRead, m.recordBytes = m.recordBytes+n, 0
+				return bytesRead, line, err
+			}
+			m.truncated, m.truncatedBytes = line, n
+			bytesRead, record = m.flush()
+			return bytesRead, record, nil
+		}
+		if len(line) == 0 {
+			m.recordBytes += n
+			if len(m.record) > 0 && m.now().Sub(m.appended) >= m.timeout {
+				bytesRead, record = m.flush()
+			}
+			return
+		}
+
+		if len(m.record) > 0 && (m.starts(line) || m.full() ||
+			len(m.record)+len(line) > m.maxBytes) {
+
+			bytesRead, record = m.flush()
+		}
+		m.record = append(m.record, line...)
+		m.recordBytes += n
+		m.lines++
+		m.appended = m.now()
+		if record == nil && m.full() {
+			bytesRead, record = m.flush()
+		}
+		if record != nil || err != nil {
+			return
+		}
+	}
+}
+
+// Whether a line starts a record rather than continuing the current one.
+func (m *MultilineParser) starts(line []byte) bool {
+	if m.start != nil && m.start.Match(line) {
+		return true
+	}
+	return m.continuation != nil && !m.continuation.Match(line)
+}
+
+// Whether the current record can't have more lines added to it.
+func (m *MultilineParser) full() bool {
+	return (m.maxLines > 0 && m.lines >= m.maxLines) || len(m.record) >= m.maxBytes
+}
+
+// Returns the current record and the number of bytes read into it.
+func (m *MultilineParser) flush() (bytesRead int, record []byte) {
+	m.returned, m.record = m.record, m.returned[:0]
+	bytesRead, m.recordBytes, m.lines = m.recordBytes, 0, 0
+	return bytesRead, m.returned
+}
+
+func (m *MultilineParser) GetRemainingData() (record []byte) {
+	record = append(m.record, m.parser.GetRemainingData()...)
+	m.record, m.recordBytes, m.lines = nil, 0, 0
+	return
+}
+
+func (m *MultilineParser) SetMinimumBufferSize(size int) {
+	m.parser.SetMinimumBufferSize(size)
+}
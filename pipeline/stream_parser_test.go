@@ -19,6 +19,7 @@ import (
 	"github.com/mozilla-services/heka/message"
 	gs "github.com/rafrombrc/gospec/src/gospec"
 	"io"
+	"time"
 )
 
 func StreamParserSpec(c gs.Context) {
@@ -241,4 +242,193 @@ func StreamParserSpec(c gs.Context) {
 		c.Expect(len(record), gs.Equals, message.MAX_RECORD_SIZE)
 		c.Expect(err, gs.Equals, io.ErrShortBuffer)
 	})
+
+	c.Specify("length prefix parser", func() {
+		c.Specify("4 byte big endian lengths", func() {
+			reader := bytes.NewReader([]byte("\x00\x00\x00\x05test1\x00\x00\x00\x00" +
+				"\x00\x00\x00\x06test12\x00\x00\x00\x07part"))
+			p := NewLengthPrefixParser()
+			n, record, err := p.Parse(reader)
+			c.Expect(n, gs.Equals, 9)
+			c.Expect(err, gs.IsNil)
+			c.Expect(string(record), gs.Equals, "test1")
+			n, record, err = p.Parse(reader)
+			c.Expect(n, gs.Equals, 4)
+			c.Expect(len(record), gs.Equals, 0)
+			n, record, err = p.Parse(reader)
+			c.Expect(n, gs.Equals, 10)
+			c.Expect(string(record), gs.Equals, "test12")
+			n, record, err = p.Parse(reader)
+			c.Expect(n, gs.Equals, 0)
+			c.Expect(err, gs.IsNil)
+			c.Expect(string(p.GetRemainingData()), gs.Equals, "\x00\x00\x00\x07part")
+		})
+
+		c.Specify("varint lengths", func() {
+			long := bytes.Repeat([]byte("x"), 300)
+			b := append([]byte("\x05test1\xac\x02"), long...)
+			reader := bytes.NewReader(b)
+			p := NewLengthPrefixParser()
+			p.SetVarint(true)
+			n, record, err := p.Parse(reader)
+			c.Expect(n, gs.Equals, 6)
+			c.Expect(string(record), gs.Equals, "test1")
+			n, record, err = p.Parse(reader)
+			c.Expect(n, gs.Equals, 302)
+			c.Expect(err, gs.IsNil)
+			c.Expect(string(record), gs.Equals, string(long))
+		})
+
+		c.Specify("skips records exceeding max record size", func() {
+			b := []byte("\x00\x02\x00\x00")
+			b = append(b, make([]byte, 0x20000)...)
+			b = append(b, "\x00\x00\x00\x04test"...)
+			reader := bytes.NewReader(b)
+			p := NewLengthPrefixParser()
+			var (
+				n, skipped int
+				record     []byte
+				err        error
+			)
+			for err == nil && len(record) == 0 {
+				n, record, err = p.Parse(reader)
+				skipped += n
+			}
+			c.Expect(len(record), gs.Equals, 0)
+			c.Expect(err, gs.Not(gs.IsNil))
+			for len(record) == 0 {
+				n, record, err = p.Parse(reader)
+				skipped += n
+			}
+			c.Expect(string(record), gs.Equals, "test")
+			c.Expect(skipped, gs.Equals, len(b))
+		})
+	})
+
+	c.Specify("json parser", func() {
+		c.Specify("splits concatenated values", func() {
+			reader := bytes.NewReader([]byte("{\n  \"a\": {\"b\": \"}\\\"{\"},\n  \"c\": [1, {}]\n}\n" +
+				"{\"d\":1}[2]  \"s{\" -1.5e3 true\x1e{\"partial\":"))
+			p := NewJsonParser()
+			expected := []string{"{\n  \"a\": {\"b\": \"}\\\"{\"},\n  \"c\": [1, {}]\n}",
+				"{\"d\":1}", "[2]", "\"s{\"", "-1.5e3", "true"}
+			for _, e := range expected {
+				_, record, err := p.Parse(reader)
+				c.Expect(string(record), gs.Equals, e)
+				c.Expect(err, gs.IsNil)
+			}
+			n, record, err := p.Parse(reader)
+			c.Expect(n, gs.Equals, 0)
+			c.Expect(len(record), gs.Equals, 0)
+			c.Expect(err, gs.IsNil)
+			c.Expect(string(p.GetRemainingData()), gs.Equals, "\x1e{\"partial\":")
+		})
+
+		c.Specify("finds values split across reads", func() {
+			reader := &chunkedReader{[]string{" {\"a\": \"x", "}\"", "}\n{}"}}
+			p := NewJsonParser()
+			var (
+				n, total int
+				record   []byte
+				err      error
+			)
+			for len(record) == 0 && err == nil {
+				n, record, err = p.Parse(reader)
+				total += n
+			}
+			c.Expect(string(record), gs.Equals, "{\"a\": \"x}\"}")
+			c.Expect(total, gs.Equals, 12)
+			_, record, err = p.Parse(reader)
+			c.Expect(string(record), gs.Equals, "{}")
+		})
+
+		c.Specify("skips bytes that can't start a value", func() {
+			reader := bytes.NewReader([]byte("}], \n{}"))
+			p := NewJsonParser()
+			var (
+				record []byte
+				err    error
+			)
+			for len(record) == 0 && err == nil {
+				_, record, err = p.Parse(reader)
+			}
+			c.Expect(string(record), gs.Equals, "{}")
+		})
+	})
+
+	c.Specify("multiline parser", func() {
+		now := time.Unix(1420070400, 0)
+		newParser := func(opts MultilineOptions) *MultilineParser {
+			p, err := NewMultilineParser(NewTokenParser(), opts)
+			c.Assume(err, gs.IsNil)
+			p.now = func() time.Time { return now }
+			return p
+		}
+
+		c.Specify("start regexp", func() {
+			reader := bytes.NewReader([]byte("1 a\n\tat x\n\tat y\n2 b\n3 c\n  more\n"))
+			p := newParser(MultilineOptions{Start: `^\d`, Timeout: "1s"})
+			n, record, err := p.Parse(reader)
+			c.Expect(n, gs.Equals, 16)
+			c.Expect(err, gs.IsNil)
+			c.Expect(string(record), gs.Equals, "1 a\n\tat x\n\tat y\n")
+			n, record, err = p.Parse(reader)
+			c.Expect(n, gs.Equals, 4)
+			c.Expect(string(record), gs.Equals, "2 b\n")
+			// The last record waits for more lines until the timeout.
+			n, record, err = p.Parse(reader)
+			c.Expect(n, gs.Equals, 0)
+			c.Expect(len(record), gs.Equals, 0)
+			c.Expect(err, gs.Equals, io.EOF)
+			now = now.Add(time.Second)
+			n, record, err = p.Parse(reader)
+			c.Expect(n, gs.Equals, 11)
+			c.Expect(string(record), gs.Equals, "3 c\n  more\n")
+			c.Expect(err, gs.Equals, io.EOF)
+		})
+
+		c.Specify("continuation regexp and max lines", func() {
+			reader := bytes.NewReader([]byte("a\n b\n c\n d\ne\nf\n g\npartial"))
+			p := newParser(MultilineOptions{Continuation: `^\s`, MaxLines: 2})
+			expected := []string{"a\n b\n", " c\n d\n", "e\n", "f\n g\n"}
+			for _, e := range expected {
+				n, record, err := p.Parse(reader)
+				c.Expect(n, gs.Equals, len(e))
+				c.Expect(string(record), gs.Equals, e)
+				c.Expect(err, gs.IsNil)
+			}
+			c.Expect(string(p.GetRemainingData()), gs.Equals, "partial")
+		})
+
+		c.Specify("max bytes", func() {
+			reader := bytes.NewReader([]byte("abcd\n e\n fghijk\n x\ny\n"))
+			p := newParser(MultilineOptions{Continuation: `^\s`, MaxBytes: 6})
+			expected := []string{"abcd\n", " e\n", " fghijk\n", " x\n"}
+			for _, e := range expected {
+				_, record, _ := p.Parse(reader)
+				c.Expect(string(record), gs.Equals, e)
+			}
+		})
+
+		c.Specify("requires a regexp", func() {
+			_, err := NewMultilineParser(NewTokenParser(), MultilineOptions{})
+			c.Expect(err, gs.Not(gs.IsNil))
+			_, err = NewMultilineParser(NewTokenParser(), MultilineOptions{Start: "("})
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+	})
+}
+
+// Reader returning its chunks one read at a time.
+type chunkedReader struct {
+	chunks []string
+}
+
+func (r *chunkedReader) Read(p []byte) (n int, err error) {
+	if len(r.chunks) == 0 {
+		return 0, io.EOF
+	}
+	n = copy(p, r.chunks[0])
+	r.chunks = r.chunks[1:]
+	return
 }
@@ -0,0 +1,196 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"errors"
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// Output duplicating the messages matched by its single message matcher to
+// several other outputs, each with its own sample rate and quota. Every
+// destination has its own queue, and messages are dropped for a destination
+// whose queue is full, so a failing or slow destination never blocks the
+// others.
+type TeeOutput struct {
+	conf       *TeeOutputConfig
+	dests      []*teeDestination
+	reportLock sync.RWMutex
+}
+
+type TeeOutputConfig struct {
+	// Destination settings, by the name of the destination output.
+	Outputs map[string]TeeDestinationConfig `toml:"outputs"`
+}
+
+type TeeDestinationConfig struct {
+	// Percentage of the messages passed to the destination, selected by a
+	// hash of their UUID. Defaults to 0, i.e. all messages.
+	SampleRate float64 `toml:"sample_rate"`
+	// Maximum rate of messages passed to the destination, messages over the
+	// quota are dropped. Defaults to 0, i.e. no limit.
+	MaxMsgsPerSec uint `toml:"max_msgs_per_sec"`
+	Burst         uint `toml:"burst"`
+	// Number of messages queued for the destination. Defaults to the
+	// `plugin_chansize` global setting.
+	QueueSize uint `toml:"queue_size"`
+}
+
+type teeDestination struct {
+	name         string
+	runner       *foRunner
+	matcher      *MatchRunner
+	sampling     bool
+	sampleCutoff uint64
+	quota        *rateLimiter
+	// Messages passed on, sampled out, over the quota, and dropped because
+	// the queue was full.
+	deliveredCount  int64
+	sampledOutCount int64
+	overQuotaCount  int64
+	droppedCount    int64
+}
+
+func (t *TeeOutput) ConfigStruct() interface{} {
+	return new(TeeOutputConfig)
+}
+
+func (t *TeeOutput) Init(config interface{}) error {
+	t.conf = config.(*TeeOutputConfig)
+	if len(t.conf.Outputs) == 0 {
+		return errors.New("no outputs specified")
+	}
+	for name, dest := range t.conf.Outputs {
+		if dest.SampleRate < 0 || dest.SampleRate > 100 {
+			return fmt.Errorf("output '%s' sample_rate must be between 0 and 100", name)
+		}
+	}
+	return nil
+}
+
+// Looks up the destination outputs and starts feeding them.
+func (t *TeeOutput) start(or OutputRunner, h PluginHelper) error {
+	globals := h.PipelineConfig().Globals
+	names := make([]string, 0, len(t.conf.Outputs))
+	for name := range t.conf.Outputs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	dests := make([]*teeDestination, 0, len(names))
+	for _, name := range names {
+		conf := t.conf.Outputs[name]
+		if name == or.Name() {
+			return fmt.Errorf("can't output to itself")
+		}
+		runner, ok := h.Output(name)
+		if !ok {
+			return fmt.Errorf("unknown output '%s'", name)
+		}
+		foRunner, ok := runner.(*foRunner)
+		if !ok {
+			return fmt.Errorf("output '%s' can't be fed by a TeeOutput", name)
+		}
+		queueSize := int(conf.QueueSize)
+		if queueSize == 0 {
+			queueSize = globals.Tunables().PluginChanSize
+		}
+		matcher, err := NewMatchRunner("TRUE", "", foRunner, queueSize)
+		if err != nil {
+			return err
+		}
+		dest := &teeDestination{
+			name:    name,
+			runner:  foRunner,
+			matcher: matcher,
+			quota:   newRateLimiter(conf.MaxMsgsPerSec, conf.Burst),
+		}
+		if conf.SampleRate > 0 && conf.SampleRate < 100 {
+			dest.sampling = true
+			dest.sampleCutoff = sampleCutoff(conf.SampleRate)
+		}
+		dests = append(dests, dest)
+	}
+	for _, dest := range dests {
+		dest.runner.startFeed(dest.matcher, globals.Tunables().SampleDenominator)
+	}
+	t.reportLock.Lock()
+	t.dests = dests
+	t.reportLock.Unlock()
+	return nil
+}
+
+func (t *TeeOutput) Run(or OutputRunner, h PluginHelper) (err error) {
+	if err = t.start(or, h); err != nil {
+		return
+	}
+	for pack := range or.InChan() {
+		t.deliver(pack)
+		pack.Recycle()
+	}
+	for _, dest := range t.dests {
+		close(dest.matcher.inChan)
+	}
+	return
+}
+
+// Passes a pack on to each destination that samples it in, has quota left,
+// and has room in its queue.
+func (t *TeeOutput) deliver(pack *PipelinePack) {
+	for _, dest := range t.dests {
+		if dest.sampling && !uuidSampled(pack, dest.sampleCutoff) {
+			atomic.AddInt64(&dest.sampledOutCount, 1)
+			continue
+		}
+		if dest.quota != nil && !dest.quota.allow() {
+			atomic.AddInt64(&dest.overQuotaCount, 1)
+			continue
+		}
+		atomic.AddInt32(&pack.RefCount, 1)
+		select {
+		case dest.matcher.inChan <- pack:
+			atomic.AddInt64(&dest.deliveredCount, 1)
+		default:
+			atomic.AddInt64(&dest.droppedCount, 1)
+			pack.Recycle()
+		}
+	}
+}
+
+func (t *TeeOutput) ReportMsg(msg *message.Message) error {
+	t.reportLock.RLock()
+	defer t.reportLock.RUnlock()
+
+	for _, dest := range t.dests {
+		message.NewInt64Field(msg, fmt.Sprintf("DeliveredMessages-%s", dest.name),
+			atomic.LoadInt64(&dest.deliveredCount), "count")
+		message.NewInt64Field(msg, fmt.Sprintf("SampledOutMessages-%s", dest.name),
+			atomic.LoadInt64(&dest.sampledOutCount), "count")
+		message.NewInt64Field(msg, fmt.Sprintf("OverQuotaMessages-%s", dest.name),
+			atomic.LoadInt64(&dest.overQuotaCount), "count")
+		message.NewInt64Field(msg, fmt.Sprintf("DroppedMessages-%s", dest.name),
+			atomic.LoadInt64(&dest.droppedCount), "count")
+		message.NewIntField(msg, fmt.Sprintf("QueueLength-%s", dest.name),
+			len(dest.matcher.inChan), "count")
+	}
+	return nil
+}
+
+func init() {
+	RegisterPlugin("TeeOutput", func() interface{} {
+		return new(TeeOutput)
+	})
+}
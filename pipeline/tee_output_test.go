@@ -0,0 +1,127 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"code.google.com/p/go-uuid/uuid"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"time"
+)
+
+func TeeOutputSpec(c gs.Context) {
+	c.Specify("A TeeOutput", func() {
+		pConfig := NewPipelineConfig(nil)
+		tee := new(TeeOutput)
+		config := tee.ConfigStruct().(*TeeOutputConfig)
+		teeRunner, err := NewFORunner("tee", tee, CommonFOConfig{Matcher: "TRUE"},
+			"TeeOutput", 10)
+		c.Assume(err, gs.IsNil)
+
+		addOutput := func(name string, chanSize int) *foRunner {
+			runner, err := NewFORunner(name, &StoppingOutput{},
+				CommonFOConfig{Matcher: "FALSE"}, "StoppingOutput", chanSize)
+			c.Assume(err, gs.IsNil)
+			pConfig.OutputRunners[name] = runner
+			return runner
+		}
+
+		recycleChan := make(chan *PipelinePack, 500)
+		send := func(count int) {
+			for i := 0; i < count; i++ {
+				pack := NewPipelinePack(recycleChan)
+				pack.Message.SetUuid(uuid.NewRandom())
+				tee.deliver(pack)
+				pack.Recycle()
+			}
+		}
+
+		// Waits for the destination's queue to be fed to its output.
+		drained := func(dest *teeDestination) bool {
+			for i := 0; i < 100 && len(dest.matcher.inChan) > 0; i++ {
+				time.Sleep(time.Millisecond)
+			}
+			return len(dest.matcher.inChan) == 0
+		}
+
+		c.Specify("duplicates messages to every output", func() {
+			a, b := addOutput("a", 20), addOutput("b", 20)
+			config.Outputs = map[string]TeeDestinationConfig{"a": {}, "b": {}}
+			c.Assume(tee.Init(config), gs.IsNil)
+			c.Assume(tee.start(teeRunner, pConfig), gs.IsNil)
+			send(10)
+			c.Expect(drained(tee.dests[0]) && drained(tee.dests[1]), gs.IsTrue)
+			c.Expect(len(a.inChan), gs.Equals, 10)
+			c.Expect(len(b.inChan), gs.Equals, 10)
+			pack := <-a.inChan
+			c.Expect(pack.RefCount, gs.Equals, int32(2))
+			c.Expect(len(recycleChan), gs.Equals, 0)
+		})
+
+		c.Specify("samples messages per output", func() {
+			all, some := addOutput("all", 300), addOutput("some", 300)
+			config.Outputs = map[string]TeeDestinationConfig{
+				"all":  {QueueSize: 300},
+				"some": {QueueSize: 300, SampleRate: 50},
+			}
+			c.Assume(tee.Init(config), gs.IsNil)
+			c.Assume(tee.start(teeRunner, pConfig), gs.IsNil)
+			send(200)
+			dest := tee.dests[1]
+			c.Expect(drained(tee.dests[0]) && drained(dest), gs.IsTrue)
+			c.Expect(len(all.inChan), gs.Equals, 200)
+			c.Expect(len(some.inChan) > 50 && len(some.inChan) < 150, gs.IsTrue)
+			c.Expect(dest.sampledOutCount, gs.Equals, int64(200-len(some.inChan)))
+		})
+
+		c.Specify("enforces quotas per output", func() {
+			limited := addOutput("limited", 20)
+			config.Outputs = map[string]TeeDestinationConfig{
+				"limited": {MaxMsgsPerSec: 1, Burst: 3},
+			}
+			c.Assume(tee.Init(config), gs.IsNil)
+			c.Assume(tee.start(teeRunner, pConfig), gs.IsNil)
+			send(5)
+			dest := tee.dests[0]
+			c.Expect(drained(dest), gs.IsTrue)
+			c.Expect(len(limited.inChan), gs.Equals, 3)
+			c.Expect(dest.overQuotaCount, gs.Equals, int64(2))
+		})
+
+		c.Specify("drops messages for a blocked output only", func() {
+			blocked, ok := addOutput("blocked", 1), addOutput("ok", 20)
+			config.Outputs = map[string]TeeDestinationConfig{
+				"blocked": {QueueSize: 1},
+				"ok":      {},
+			}
+			c.Assume(tee.Init(config), gs.IsNil)
+			c.Assume(tee.start(teeRunner, pConfig), gs.IsNil)
+			send(10)
+			dest := tee.dests[0]
+			c.Expect(drained(tee.dests[1]), gs.IsTrue)
+			c.Expect(len(ok.inChan), gs.Equals, 10)
+			c.Expect(len(blocked.inChan), gs.Equals, 1)
+			c.Expect(dest.deliveredCount+dest.droppedCount, gs.Equals, int64(10))
+			c.Expect(dest.droppedCount >= 7, gs.IsTrue)
+		})
+
+		c.Specify("rejects unknown outputs", func() {
+			config.Outputs = map[string]TeeDestinationConfig{"missing": {}}
+			c.Assume(tee.Init(config), gs.IsNil)
+			c.Expect(tee.start(teeRunner, pConfig), gs.Not(gs.IsNil))
+		})
+
+		c.Specify("rejects an invalid sample rate", func() {
+			config.Outputs = map[string]TeeDestinationConfig{"a": {SampleRate: 101}}
+			c.Expect(tee.Init(config), gs.Not(gs.IsNil))
+		})
+	})
+}
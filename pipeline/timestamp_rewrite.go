@@ -0,0 +1,145 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+	"sync/atomic"
+	"time"
+)
+
+// Output only, rewrites the timestamps of the messages an output encodes to
+// suit its destination, see the `timestamp_rewrite` setting.
+type TimestampRewriteConfig struct {
+	// Timestamps further than this in the future are replaced with the
+	// current time, e.g. "0s" or "5m". Empty (the default) means no cap.
+	MaxFuture string `toml:"max_future"`
+	// Timestamps further than this in the past are moved forward to that
+	// limit, e.g. "336h" for a destination that rejects older data. Empty
+	// (the default) means no limit.
+	MaxPast string `toml:"max_past"`
+	// Time zone, e.g. "Europe/Paris", whose wall clock time the timestamps
+	// are shifted to, for destinations that take timestamps as local time.
+	Timezone string
+	// Timestamps are rounded down to a multiple of this duration, e.g. "1m".
+	Floor string
+}
+
+// Applies an output's `timestamp_rewrite` settings.
+type timestampRewriter struct {
+	maxFuture    time.Duration
+	hasMaxFuture bool
+	maxPast      time.Duration
+	hasMaxPast   bool
+	location     *time.Location
+	floor        time.Duration
+	// Timestamps moved by max_future or max_past, and all changed ones.
+	cappedCount    int64
+	rewrittenCount int64
+	// Swapped out in tests.
+	now func() time.Time
+}
+
+// Returns a rewriter for the specified settings, or nil if they don't
+// rewrite anything.
+func newTimestampRewriter(config TimestampRewriteConfig) (r *timestampRewriter,
+	err error) {
+
+	if config == (TimestampRewriteConfig{}) {
+		return nil, nil
+	}
+	r = &timestampRewriter{now: time.Now}
+	if config.MaxFuture != "" {
+		if r.maxFuture, err = time.ParseDuration(config.MaxFuture); err != nil {
+			return nil, fmt.Errorf("invalid max_future: %s", err)
+		}
+		r.hasMaxFuture = true
+	}
+	if config.MaxPast != "" {
+		if r.maxPast, err = time.ParseDuration(config.MaxPast); err != nil {
+			return nil, fmt.Errorf("invalid max_past: %s", err)
+		}
+		r.hasMaxPast = true
+	}
+	if r.maxFuture < 0 || r.maxPast < 0 {
+		return nil, fmt.Errorf("max_future and max_past can't be negative")
+	}
+	if config.Timezone != "" {
+		if r.location, err = time.LoadLocation(config.Timezone); err != nil {
+			return nil, fmt.Errorf("invalid timezone: %s", err)
+		}
+	}
+	if config.Floor != "" {
+		if r.floor, err = time.ParseDuration(config.Floor); err != nil {
+			return nil, fmt.Errorf("invalid floor: %s", err)
+		}
+		if r.floor <= 0 {
+			return nil, fmt.Errorf("floor must be positive")
+		}
+	}
+	return
+}
+
+// Returns the rewritten timestamp: capped to the allowed skew first, then
+// shifted to the time zone, then floored.
+func (r *timestampRewriter) timestamp(ts int64) int64 {
+	now := r.now().UnixNano()
+	if r.hasMaxFuture && ts > now+int64(r.maxFuture) {
+		ts = now
+		atomic.AddInt64(&r.cappedCount, 1)
+	} else if r.hasMaxPast && ts < now-int64(r.maxPast) {
+		ts = now - int64(r.maxPast)
+		atomic.AddInt64(&r.cappedCount, 1)
+	}
+	if r.location != nil {
+		_, offset := time.Unix(0, ts).In(r.location).Zone()
+		ts += int64(offset) * int64(time.Second)
+	}
+	if r.floor > 0 {
+		rem := ts % int64(r.floor)
+		if rem < 0 {
+			rem += int64(r.floor)
+		}
+		ts -= rem
+	}
+	return ts
+}
+
+// Returns the pack to encode: the original if its timestamp needn't change,
+// or a pack holding a rewritten copy of the message, as the original may be
+// shared with other plugins.
+func (r *timestampRewriter) rewrite(pack *PipelinePack) *PipelinePack {
+	ts := pack.Message.GetTimestamp()
+	newTs := r.timestamp(ts)
+	if newTs == ts {
+		return pack
+	}
+	atomic.AddInt64(&r.rewrittenCount, 1)
+	msg := new(message.Message)
+	pack.Message.Copy(msg)
+	msg.SetTimestamp(newTs)
+	return &PipelinePack{
+		Message:      msg,
+		Decoded:      true,
+		MsgLoopCount: pack.MsgLoopCount,
+		RefCount:     1,
+	}
+}
+
+// Adds the rewriter's counts to an output's report.
+func (r *timestampRewriter) ReportMsg(msg *message.Message) {
+	message.NewInt64Field(msg, "CappedTimestamps", atomic.LoadInt64(&r.cappedCount),
+		"count")
+	message.NewInt64Field(msg, "RewrittenTimestamps",
+		atomic.LoadInt64(&r.rewrittenCount), "count")
+}
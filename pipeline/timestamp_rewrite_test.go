@@ -0,0 +1,103 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"strconv"
+	"time"
+)
+
+type _timestampEncoder struct{}
+
+func (enc *_timestampEncoder) Encode(pack *PipelinePack) (output []byte, err error) {
+	return []byte(strconv.FormatInt(pack.Message.GetTimestamp(), 10)), nil
+}
+
+func TimestampRewriteSpec(c gs.Context) {
+	c.Specify("A timestamp rewriter", func() {
+		now := time.Date(2015, 6, 1, 12, 0, 0, 0, time.UTC)
+		pack := NewPipelinePack(nil)
+		runner := &foRunner{encoder: &_timestampEncoder{}}
+		newRewriter := func(config TimestampRewriteConfig) *timestampRewriter {
+			r, err := newTimestampRewriter(config)
+			c.Assume(err, gs.IsNil)
+			r.now = func() time.Time { return now }
+			return r
+		}
+		encoded := func() int64 {
+			output, err := runner.Encode(pack)
+			c.Assume(err, gs.IsNil)
+			ts, err := strconv.ParseInt(string(output), 10, 64)
+			c.Assume(err, gs.IsNil)
+			return ts
+		}
+
+		c.Specify("isn't created without settings", func() {
+			r, err := newTimestampRewriter(TimestampRewriteConfig{})
+			c.Expect(err, gs.IsNil)
+			c.Expect(r == nil, gs.IsTrue)
+		})
+
+		c.Specify("rejects invalid settings", func() {
+			_, err := newTimestampRewriter(TimestampRewriteConfig{MaxFuture: "soon"})
+			c.Expect(err, gs.Not(gs.IsNil))
+			_, err = newTimestampRewriter(TimestampRewriteConfig{MaxPast: "-1h"})
+			c.Expect(err, gs.Not(gs.IsNil))
+			_, err = newTimestampRewriter(TimestampRewriteConfig{Timezone: "Nowhere/Special"})
+			c.Expect(err, gs.Not(gs.IsNil))
+			_, err = newTimestampRewriter(TimestampRewriteConfig{Floor: "0s"})
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+
+		c.Specify("caps future timestamps to now", func() {
+			runner.tsRewriter = newRewriter(TimestampRewriteConfig{MaxFuture: "1m"})
+			pack.Message.SetTimestamp(now.Add(time.Hour).UnixNano())
+			c.Expect(encoded(), gs.Equals, now.UnixNano())
+			c.Expect(pack.Message.GetTimestamp(), gs.Equals, now.Add(time.Hour).UnixNano())
+			c.Expect(runner.tsRewriter.cappedCount, gs.Equals, int64(1))
+
+			pack.Message.SetTimestamp(now.Add(30 * time.Second).UnixNano())
+			c.Expect(encoded(), gs.Equals, now.Add(30*time.Second).UnixNano())
+			c.Expect(runner.tsRewriter.rewrittenCount, gs.Equals, int64(1))
+		})
+
+		c.Specify("moves old timestamps forward to the limit", func() {
+			runner.tsRewriter = newRewriter(TimestampRewriteConfig{MaxPast: "24h"})
+			pack.Message.SetTimestamp(now.Add(-48 * time.Hour).UnixNano())
+			c.Expect(encoded(), gs.Equals, now.Add(-24*time.Hour).UnixNano())
+			c.Expect(runner.tsRewriter.cappedCount, gs.Equals, int64(1))
+		})
+
+		c.Specify("shifts timestamps to the time zone's wall clock", func() {
+			runner.tsRewriter = newRewriter(TimestampRewriteConfig{Timezone: "Etc/GMT-2"})
+			pack.Message.SetTimestamp(now.UnixNano())
+			c.Expect(encoded(), gs.Equals, now.Add(2*time.Hour).UnixNano())
+		})
+
+		c.Specify("floors timestamps", func() {
+			runner.tsRewriter = newRewriter(TimestampRewriteConfig{Floor: "1m"})
+			pack.Message.SetTimestamp(now.Add(90 * time.Second).UnixNano())
+			c.Expect(encoded(), gs.Equals, now.Add(time.Minute).UnixNano())
+
+			pack.Message.SetTimestamp(-int64(90 * time.Second))
+			c.Expect(encoded(), gs.Equals, -int64(2*time.Minute))
+		})
+
+		c.Specify("passes unchanged timestamps through", func() {
+			runner.tsRewriter = newRewriter(TimestampRewriteConfig{Floor: "1m"})
+			pack.Message.SetTimestamp(now.UnixNano())
+			c.Expect(encoded(), gs.Equals, now.UnixNano())
+			c.Expect(runner.tsRewriter.rewrittenCount, gs.Equals, int64(0))
+		})
+	})
+}
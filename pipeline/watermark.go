@@ -0,0 +1,268 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// How often the tracker recalculates the low watermark and checks for
+	// completed windows.
+	watermarkTickInterval = time.Second
+	// Inputs that haven't delivered a message in this long are ignored when
+	// calculating the low watermark, so a quiet input doesn't stall every
+	// window in the pipeline.
+	watermarkIdleTimeout = time.Minute
+	// Maximum number of completed windows that will be emitted to a filter
+	// after a single watermark advance, and the size of its window channel.
+	// If the watermark jumps further than this, e.g. when the slowest input
+	// goes idle, the oldest windows are skipped, even if messages fell into
+	// them.
+	maxWindowBacklog = 100
+)
+
+// An event time window, expressed in nanoseconds since the UNIX epoch. Start
+// is inclusive, End is exclusive.
+type Window struct {
+	Start int64
+	End   int64
+}
+
+// Contains returns true if the provided event timestamp falls within the
+// window.
+func (w Window) Contains(ts int64) bool {
+	return ts >= w.Start && ts < w.End
+}
+
+// Event time bookkeeping for a single input.
+type inputWatermark struct {
+	// Largest message timestamp seen from the input.
+	maxEventTime int64
+	// Wall clock time at which the input last delivered a message.
+	lastSeen int64
+	// How far the input's watermark trails its largest seen event time, i.e.
+	// how late data from this input is allowed to be.
+	delay int64
+}
+
+// Records a message timestamp delivered by the input. Only ever called from
+// the router goroutine, but read concurrently by the tracker, hence the
+// atomics.
+func (iw *inputWatermark) observe(ts int64) {
+	if ts > atomic.LoadInt64(&iw.maxEventTime) {
+		atomic.StoreInt64(&iw.maxEventTime, ts)
+	}
+	atomic.StoreInt64(&iw.lastSeen, time.Now().UnixNano())
+}
+
+// A filter that has asked to be told about completed windows.
+type windowSubscriber struct {
+	interval int64
+	// End of the next window to be emitted, zero until the watermark has
+	// advanced for the first time.
+	next    int64
+	windows chan Window
+	// Windows that didn't fit in the channel, accessed atomically.
+	dropped int64
+}
+
+// WatermarkTracker keeps track of the event time progress of every input in
+// the pipeline. The pipeline-wide low watermark is the smallest watermark of
+// all of the non-idle inputs, and it never moves backwards. Filters that
+// specify a `window_interval` are notified exactly once for every window that
+// ends at or before the low watermark, regardless of late or replayed data.
+type WatermarkTracker struct {
+	inputs      map[string]*inputWatermark
+	subscribers map[string]*windowSubscriber
+	lock        sync.RWMutex
+	watermark   int64
+	idleTimeout time.Duration
+	stopChan    chan struct{}
+	stopOnce    sync.Once
+}
+
+// Creates and returns a new (not yet started) WatermarkTracker.
+func NewWatermarkTracker() *WatermarkTracker {
+	return &WatermarkTracker{
+		inputs:      make(map[string]*inputWatermark),
+		subscribers: make(map[string]*windowSubscriber),
+		idleTimeout: watermarkIdleTimeout,
+		stopChan:    make(chan struct{}),
+	}
+}
+
+// Registers an input with the tracker, returning the bookkeeping object that
+// should be attached to the input's packs. `delay` specifies how far the
+// input's watermark should trail the latest event time it has seen.
+func (wt *WatermarkTracker) registerInput(name string, delay time.Duration) *inputWatermark {
+	wt.lock.Lock()
+	defer wt.lock.Unlock()
+	iw, ok := wt.inputs[name]
+	if !ok {
+		iw = new(inputWatermark)
+		wt.inputs[name] = iw
+	}
+	iw.delay = delay.Nanoseconds()
+	return iw
+}
+
+// Removes an input from the low watermark calculation.
+func (wt *WatermarkTracker) unregisterInput(name string) {
+	wt.lock.Lock()
+	delete(wt.inputs, name)
+	wt.lock.Unlock()
+}
+
+// Subscribes the named filter to completed windows of the specified length.
+// Returns the channel on which the windows will be delivered.
+func (wt *WatermarkTracker) Subscribe(name string, interval time.Duration) <-chan Window {
+	wt.lock.Lock()
+	defer wt.lock.Unlock()
+	sub := &windowSubscriber{
+		interval: interval.Nanoseconds(),
+		windows:  make(chan Window, maxWindowBacklog),
+	}
+	wt.subscribers[name] = sub
+	return sub.windows
+}
+
+// Returns the number of windows dropped because the named filter didn't
+// read them in time.
+func (wt *WatermarkTracker) droppedWindows(name string) int64 {
+	wt.lock.RLock()
+	defer wt.lock.RUnlock()
+	if sub, ok := wt.subscribers[name]; ok {
+		return atomic.LoadInt64(&sub.dropped)
+	}
+	return 0
+}
+
+// Stops delivering windows to the named filter.
+func (wt *WatermarkTracker) Unsubscribe(name string) {
+	wt.lock.Lock()
+	delete(wt.subscribers, name)
+	wt.lock.Unlock()
+}
+
+// Returns the current pipeline-wide low watermark, in nanoseconds since the
+// UNIX epoch. Any message with a timestamp before this value should be
+// considered late. Returns zero if no input has delivered any data yet.
+func (wt *WatermarkTracker) Watermark() int64 {
+	return atomic.LoadInt64(&wt.watermark)
+}
+
+// Recalculates the low watermark from the input bookkeeping. The watermark
+// is only ever moved forward; if no input is active it stays where it is.
+func (wt *WatermarkTracker) advance(now int64) int64 {
+	var (
+		low    int64
+		active bool
+	)
+	idle := wt.idleTimeout.Nanoseconds()
+	wt.lock.RLock()
+	for _, iw := range wt.inputs {
+		maxEventTime := atomic.LoadInt64(&iw.maxEventTime)
+		if maxEventTime == 0 {
+			// Nothing seen yet, we can't say anything about this input.
+			continue
+		}
+		if idle > 0 && now-atomic.LoadInt64(&iw.lastSeen) > idle {
+			continue
+		}
+		wm := maxEventTime - iw.delay
+		if !active || wm < low {
+			low = wm
+			active = true
+		}
+	}
+	wt.lock.RUnlock()
+
+	current := atomic.LoadInt64(&wt.watermark)
+	if active && low > current {
+		atomic.StoreInt64(&wt.watermark, low)
+		current = low
+	}
+	return current
+}
+
+// Returns the windows that have been completed for the provided subscriber
+// by the provided watermark, updating the subscriber's position.
+func (sub *windowSubscriber) completed(watermark int64) (windows []Window) {
+	if watermark <= 0 {
+		return
+	}
+	if sub.next == 0 {
+		// First advance, start with the window that contains the watermark.
+		sub.next = watermark - watermark%sub.interval + sub.interval
+		return
+	}
+	if backlog := (watermark - sub.next) / sub.interval; backlog >= maxWindowBacklog {
+		sub.next += (backlog - maxWindowBacklog + 1) * sub.interval
+	}
+	for sub.next <= watermark {
+		windows = append(windows, Window{Start: sub.next - sub.interval, End: sub.next})
+		sub.next += sub.interval
+	}
+	return
+}
+
+// Recalculates the watermark and hands any newly completed windows to their
+// subscribers. Never blocks: windows that don't fit in a subscriber's
+// channel, because the filter doesn't read them fast enough (or at all), are
+// dropped and counted, so one filter can't hold up the others' windows.
+func (wt *WatermarkTracker) dispatch(now int64) {
+	watermark := wt.advance(now)
+	wt.lock.Lock()
+	pending := make(map[*windowSubscriber][]Window)
+	for _, sub := range wt.subscribers {
+		if windows := sub.completed(watermark); len(windows) > 0 {
+			pending[sub] = windows
+		}
+	}
+	wt.lock.Unlock()
+
+	for sub, windows := range pending {
+		for _, w := range windows {
+			select {
+			case sub.windows <- w:
+			default:
+				atomic.AddInt64(&sub.dropped, 1)
+			}
+		}
+	}
+}
+
+// Starts the tracker's dispatch loop in a separate goroutine.
+func (wt *WatermarkTracker) Start() {
+	go func() {
+		ticker := time.NewTicker(watermarkTickInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case t := <-ticker.C:
+				wt.dispatch(t.UnixNano())
+			case <-wt.stopChan:
+				return
+			}
+		}
+	}()
+}
+
+// Stops the tracker's dispatch loop.
+func (wt *WatermarkTracker) Stop() {
+	wt.stopOnce.Do(func() {
+		close(wt.stopChan)
+	})
+}
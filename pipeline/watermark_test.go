@@ -0,0 +1,133 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"time"
+)
+
+func WatermarkSpec(c gs.Context) {
+	c.Specify("A WatermarkTracker", func() {
+		wt := NewWatermarkTracker()
+		now := time.Now().UnixNano()
+		sec := int64(time.Second)
+
+		c.Specify("starts with a zero watermark", func() {
+			c.Expect(wt.advance(now), gs.Equals, int64(0))
+		})
+
+		c.Specify("uses the slowest active input", func() {
+			a := wt.registerInput("a", 0)
+			b := wt.registerInput("b", 2*time.Second)
+			a.observe(100 * sec)
+			b.observe(101 * sec)
+			c.Expect(wt.advance(now), gs.Equals, 99*sec)
+			a.observe(110 * sec)
+			c.Expect(wt.advance(now), gs.Equals, 99*sec)
+			b.observe(120 * sec)
+			c.Expect(wt.advance(now), gs.Equals, 110*sec)
+		})
+
+		c.Specify("ignores inputs that haven't delivered anything", func() {
+			a := wt.registerInput("a", 0)
+			wt.registerInput("b", 0)
+			a.observe(100 * sec)
+			c.Expect(wt.advance(now), gs.Equals, 100*sec)
+		})
+
+		c.Specify("ignores idle inputs", func() {
+			a := wt.registerInput("a", 0)
+			b := wt.registerInput("b", 0)
+			a.observe(100 * sec)
+			b.observe(50 * sec)
+			b.lastSeen = now - 2*wt.idleTimeout.Nanoseconds()
+			c.Expect(wt.advance(now), gs.Equals, 100*sec)
+		})
+
+		c.Specify("never moves backwards", func() {
+			a := wt.registerInput("a", 0)
+			a.observe(100 * sec)
+			c.Expect(wt.advance(now), gs.Equals, 100*sec)
+			// A new input replaying old data.
+			b := wt.registerInput("b", 0)
+			b.observe(10 * sec)
+			c.Expect(wt.advance(now), gs.Equals, 100*sec)
+			c.Expect(wt.Watermark(), gs.Equals, 100*sec)
+		})
+
+		c.Specify("emits each window exactly once", func() {
+			a := wt.registerInput("a", 0)
+			windows := wt.Subscribe("filter", 10*time.Second)
+
+			a.observe(105 * sec)
+			wt.dispatch(now)
+			c.Expect(len(windows), gs.Equals, 0)
+
+			a.observe(131 * sec)
+			wt.dispatch(now)
+			c.Expect(len(windows), gs.Equals, 3)
+			w := <-windows
+			c.Expect(w.Start, gs.Equals, 100*sec)
+			c.Expect(w.End, gs.Equals, 110*sec)
+			c.Expect(w.Contains(105*sec), gs.IsTrue)
+			c.Expect(w.Contains(110*sec), gs.IsFalse)
+			w = <-windows
+			c.Expect(w.Start, gs.Equals, 110*sec)
+			w = <-windows
+			c.Expect(w.Start, gs.Equals, 120*sec)
+
+			// Late and replayed data doesn't cause windows to be re-emitted.
+			a.observe(101 * sec)
+			wt.dispatch(now)
+			c.Expect(len(windows), gs.Equals, 0)
+		})
+
+		c.Specify("skips excess windows after a big jump", func() {
+			a := wt.registerInput("a", 0)
+			windows := wt.Subscribe("filter", time.Second)
+			a.observe(1 * sec)
+			wt.dispatch(now)
+			a.observe(1000 * sec)
+			wt.dispatch(now)
+			c.Expect(len(windows), gs.Equals, maxWindowBacklog)
+			w := <-windows
+			c.Expect(w.End, gs.Equals, (1000-maxWindowBacklog+1)*sec)
+		})
+
+		c.Specify("drops windows the filter doesn't read", func() {
+			a := wt.registerInput("a", 0)
+			windows := wt.Subscribe("filter", time.Second)
+			a.observe(1 * sec)
+			wt.dispatch(now)
+			a.observe(maxWindowBacklog * sec)
+			wt.dispatch(now)
+			c.Expect(len(windows), gs.Equals, maxWindowBacklog-1)
+			c.Expect(wt.droppedWindows("filter"), gs.Equals, int64(0))
+			a.observe((maxWindowBacklog + 2) * sec)
+			wt.dispatch(now)
+			c.Expect(len(windows), gs.Equals, maxWindowBacklog)
+			c.Expect(wt.droppedWindows("filter"), gs.Equals, int64(1))
+		})
+
+		c.Specify("stops emitting after unsubscribe", func() {
+			a := wt.registerInput("a", 0)
+			windows := wt.Subscribe("filter", time.Second)
+			a.observe(1 * sec)
+			wt.dispatch(now)
+			wt.Unsubscribe("filter")
+			a.observe(10 * sec)
+			wt.dispatch(now)
+			c.Expect(len(windows), gs.Equals, 0)
+		})
+	})
+}
@@ -27,6 +27,12 @@ func TestAllSpecs(t *testing.T) {
 	r.AddSpec(ScribbleDecoderSpec)
 	r.AddSpec(PayloadEncoderSpec)
 	r.AddSpec(RstEncoderSpec)
+	r.AddSpec(NullOutputSpec)
+	r.AddSpec(NdjsonEncoderSpec)
+	r.AddSpec(CsvEncoderSpec)
+	r.AddSpec(FieldsProcessorSpec)
+	r.AddSpec(DerivedFieldsFilterSpec)
+	r.AddSpec(ColumnMappingSpec)
 
 	gospec.MainGoTest(r, t)
 }
@@ -0,0 +1,179 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package amqp
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	amqp10 "github.com/Azure/go-amqp"
+	"net/url"
+	"strings"
+)
+
+// AMQP protocol versions accepted by the `protocol` setting.
+const (
+	protocolAMQP091 = "0-9-1"
+	protocolAMQP10  = "1.0"
+)
+
+// Checks the `protocol` setting, returning whether it selects AMQP 1.0.
+func isAMQP10(protocol string) (bool, error) {
+	switch protocol {
+	case "", protocolAMQP091:
+		return false, nil
+	case protocolAMQP10:
+		return true, nil
+	}
+	return false, fmt.Errorf("unknown AMQP protocol '%s', must be '%s' or '%s'",
+		protocol, protocolAMQP091, protocolAMQP10)
+}
+
+// An AMQP 1.0 session on its own connection. Unlike 0.9.1 channels, these
+// aren't shared between plugins, so each plugin recovers from broker
+// failures independently.
+type AMQP10Session interface {
+	NewReceiver(source string, credit int) (AMQP10Receiver, error)
+	NewSender(target string) (AMQP10Sender, error)
+	// Closes the session's connection.
+	Close() error
+}
+
+// Receiving link of an AMQP 1.0 session.
+type AMQP10Receiver interface {
+	Receive() (*amqp10.Message, error)
+	AcceptMessage(msg *amqp10.Message) error
+}
+
+// Sending link of an AMQP 1.0 session.
+type AMQP10Sender interface {
+	Send(msg *amqp10.Message) error
+}
+
+// AMQP 1.0 connection dialer.
+type AMQP10Dialer struct {
+	tlsConfig *tls.Config
+	// SASL mechanism, see saslType.
+	mechanism string
+}
+
+// Returns the SASL settings for the mechanism and URL. Without a mechanism,
+// PLAIN is used if the URL contains credentials and ANONYMOUS otherwise.
+func saslType(mechanism string, u *url.URL) (amqp10.SASLType, error) {
+	var user, password string
+	if u.User != nil {
+		user = u.User.Username()
+		password, _ = u.User.Password()
+	}
+	switch strings.ToUpper(mechanism) {
+	case "":
+		if user == "" {
+			return amqp10.SASLTypeAnonymous(), nil
+		}
+		return amqp10.SASLTypePlain(user, password), nil
+	case "PLAIN":
+		if user == "" {
+			return nil, errors.New("SASL PLAIN requires credentials in the URL")
+		}
+		return amqp10.SASLTypePlain(user, password), nil
+	case "ANONYMOUS":
+		return amqp10.SASLTypeAnonymous(), nil
+	case "EXTERNAL":
+		// The identity is taken from the TLS client certificate.
+		return amqp10.SASLTypeExternal(""), nil
+	}
+	return nil, fmt.Errorf("unsupported SASL mechanism '%s'", mechanism)
+}
+
+// Connects to the broker at the URL and begins a session.
+func (dialer AMQP10Dialer) Dial(rawurl string) (AMQP10Session, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, fmt.Errorf("invalid URL: %s", err)
+	}
+	opts := &amqp10.ConnOptions{TLSConfig: dialer.tlsConfig}
+	if opts.SASLType, err = saslType(dialer.mechanism, u); err != nil {
+		return nil, err
+	}
+	// Credentials are passed through the SASL settings only.
+	u.User = nil
+	ctx := context.Background()
+	conn, err := amqp10.Dial(ctx, u.String(), opts)
+	if err != nil {
+		return nil, err
+	}
+	session, err := conn.NewSession(ctx, nil)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &amqp10Session{conn, session}, nil
+}
+
+type amqp10Session struct {
+	conn    *amqp10.Conn
+	session *amqp10.Session
+}
+
+func (s *amqp10Session) NewReceiver(source string, credit int) (AMQP10Receiver, error) {
+	receiver, err := s.session.NewReceiver(context.Background(), source,
+		&amqp10.ReceiverOptions{Credit: int32(credit)})
+	if err != nil {
+		return nil, err
+	}
+	return &amqp10Receiver{receiver}, nil
+}
+
+func (s *amqp10Session) NewSender(target string) (AMQP10Sender, error) {
+	sender, err := s.session.NewSender(context.Background(), target, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &amqp10Sender{sender}, nil
+}
+
+func (s *amqp10Session) Close() error {
+	return s.conn.Close()
+}
+
+type amqp10Receiver struct {
+	receiver *amqp10.Receiver
+}
+
+// Blocks until a message arrives or the link, session, or connection fails
+// or is closed.
+func (r *amqp10Receiver) Receive() (*amqp10.Message, error) {
+	return r.receiver.Receive(context.Background(), nil)
+}
+
+func (r *amqp10Receiver) AcceptMessage(msg *amqp10.Message) error {
+	return r.receiver.AcceptMessage(context.Background(), msg)
+}
+
+type amqp10Sender struct {
+	sender *amqp10.Sender
+}
+
+// Blocks until the broker settles the message. Returns an *amqp10.Error if
+// the broker rejected it.
+func (s *amqp10Sender) Send(msg *amqp10.Message) error {
+	return s.sender.Send(context.Background(), msg, nil)
+}
+
+// Whether a send error means the message itself was refused, as opposed to
+// the link or connection failing, in which case it's worth sending again
+// once reconnected.
+func isAMQP10Rejection(err error) bool {
+	_, ok := err.(*amqp10.Error)
+	return ok
+}
@@ -25,6 +25,7 @@ import (
 	"github.com/streadway/amqp"
 	"strings"
 	"sync"
+	"time"
 )
 
 // AMQP Input config struct
@@ -72,6 +73,15 @@ type AMQPInputConfig struct {
 	// Optional subsection for TLS configuration of AMQPS connections. If
 	// unspecified, the default AMQPS settings will be used.
 	Tls tcp.TlsConfig
+	// AMQP protocol version, either "0-9-1" or "1.0". Defaults to "0-9-1".
+	Protocol string
+	// Address of the AMQP 1.0 node to consume from, e.g. a queue or a topic
+	// subscription. The exchange and queue settings only apply to 0.9.1.
+	Address string
+	// SASL mechanism of AMQP 1.0 connections: PLAIN, ANONYMOUS, or
+	// EXTERNAL. Defaults to PLAIN if the URL contains credentials, ANONYMOUS
+	// otherwise.
+	SASLMechanism string `toml:"sasl_mechanism"`
 }
 
 type AMQPInput struct {
@@ -80,6 +90,16 @@ type AMQPInput struct {
 	usageWg *sync.WaitGroup
 	connWg  *sync.WaitGroup
 	amqpHub AMQPConnectionHub
+	// AMQP 1.0 state, used instead of the connection hub and channel.
+	amqp10   bool
+	session  AMQP10Session
+	receiver AMQP10Receiver
+	dial10   func(AMQP10Dialer, string) (AMQP10Session, error)
+	stopChan chan struct{}
+	// Decoding state of the running input.
+	dRunner DecoderRunner
+	decoder Decoder
+	header  *message.Header
 }
 
 func (ai *AMQPInput) ConfigStruct() interface{} {
@@ -93,18 +113,25 @@ func (ai *AMQPInput) ConfigStruct() interface{} {
 		QueueExclusive:     false,
 		QueueAutoDelete:    true,
 		QueueTTL:           -1,
+		Protocol:           protocolAMQP091,
 	}
 }
 
 func (ai *AMQPInput) Init(config interface{}) (err error) {
 	conf := config.(*AMQPInputConfig)
 	ai.config = conf
+	if ai.amqp10, err = isAMQP10(conf.Protocol); err != nil {
+		return
+	}
 	var tlsConf *tls.Config = nil
 	if strings.HasPrefix(conf.URL, "amqps://") && &ai.config.Tls != nil {
 		if tlsConf, err = tcp.CreateGoTlsConfig(&ai.config.Tls); err != nil {
 			return fmt.Errorf("TLS init error: %s", err)
 		}
 	}
+	if ai.amqp10 {
+		return ai.initAMQP10(tlsConf)
+	}
 
 	if ai.amqpHub == nil {
 		ai.amqpHub = getAmqpHub()
@@ -153,15 +180,38 @@ func (ai *AMQPInput) Init(config interface{}) (err error) {
 	return
 }
 
+// Connects to the broker and opens the receiving link. Connection failures
+// are recovered from by the input runner restarting the plugin according to
+// its `retries` settings.
+func (ai *AMQPInput) initAMQP10(tlsConf *tls.Config) (err error) {
+	conf := ai.config
+	if conf.Address == "" {
+		return errors.New("`address` is required with AMQP 1.0")
+	}
+	if ai.dial10 == nil {
+		ai.dial10 = AMQP10Dialer.Dial
+	}
+	ai.session, err = ai.dial10(AMQP10Dialer{tlsConf, conf.SASLMechanism}, conf.URL)
+	if err != nil {
+		return
+	}
+	if ai.receiver, err = ai.session.NewReceiver(conf.Address, conf.PrefetchCount); err != nil {
+		ai.session.Close()
+		ai.session = nil
+		return
+	}
+	ai.stopChan = make(chan struct{})
+	return
+}
+
 func (ai *AMQPInput) Run(ir InputRunner, h PluginHelper) (err error) {
 	var (
-		dRunner DecoderRunner
-		decoder Decoder
-		pack    *PipelinePack
-		e       error
-		ok      bool
+		pack *PipelinePack
+		ok   bool
 	)
-	defer ai.usageWg.Done()
+	if !ai.amqp10 {
+		defer ai.usageWg.Done()
+	}
 	packSupply := ir.InChan()
 
 	conf := ai.config
@@ -173,13 +223,18 @@ func (ai *AMQPInput) Run(ir InputRunner, h PluginHelper) (err error) {
 	// the incoming data. This can (and will) be greatly improved once we
 	// abstract out the stream parsing code so it can used here w/o having to
 	// reimplement the entire stream_type -> stream parser mapping.
+	ai.dRunner, ai.decoder = nil, nil
 	if conf.Decoder != "" {
-		if dRunner, ok = h.DecoderRunner(conf.Decoder, fmt.Sprintf("%s-%s", ir.Name(), conf.Decoder)); !ok {
+		if ai.dRunner, ok = h.DecoderRunner(conf.Decoder, fmt.Sprintf("%s-%s", ir.Name(), conf.Decoder)); !ok {
 			return fmt.Errorf("Decoder not found: %s", conf.Decoder)
 		}
-		decoder = dRunner.Decoder()
+		ai.decoder = ai.dRunner.Decoder()
+	}
+	ai.header = &message.Header{}
+
+	if ai.amqp10 {
+		return ai.runAMQP10(ir, packSupply)
 	}
-	header := &message.Header{}
 
 	stream, err := ai.ch.Consume(conf.Queue, "", false, conf.QueueExclusive,
 		false, false, nil)
@@ -188,59 +243,119 @@ func (ai *AMQPInput) Run(ir InputRunner, h PluginHelper) (err error) {
 	}
 readLoop:
 	for {
-		e = nil
 		pack = <-packSupply
 		msg, ok := <-stream
 		if !ok {
 			break readLoop
 		}
+		ai.deliver(ir, pack, msg.ContentType, msg.Body, msg.Timestamp)
+		msg.Ack(false)
+	}
+	return
+}
 
-		if msg.ContentType == "application/hekad" {
-			if dRunner == nil {
-				pack.Recycle()
-				ir.LogError(errors.New("`application/hekad` messages require a decoder."))
-			} else {
-				_, msgOk := findMessage(msg.Body, header, &(pack.MsgBytes))
-				if msgOk {
-					dRunner.InChan() <- pack
-				} else {
-					pack.Recycle()
-					ir.LogError(errors.New("Can't find Heka message."))
-				}
-				header.Reset()
+func (ai *AMQPInput) runAMQP10(ir InputRunner, packSupply chan *PipelinePack) error {
+	for {
+		pack := <-packSupply
+		msg, err := ai.receiver.Receive()
+		if err != nil {
+			pack.Recycle()
+			select {
+			case <-ai.stopChan:
+				return nil
+			default:
 			}
-		} else {
-			pack.Message.SetType("amqp")
-			pack.Message.SetPayload(string(msg.Body))
-			pack.Message.SetTimestamp(msg.Timestamp.UnixNano())
-			var packs []*PipelinePack
-			if decoder == nil {
-				packs = []*PipelinePack{pack}
-			} else {
-				packs, e = decoder.Decode(pack)
+			return fmt.Errorf("AMQP 1.0 receive error: %s", err)
+		}
+		var contentType string
+		timestamp := time.Now()
+		if props := msg.Properties; props != nil {
+			if props.ContentType != nil {
+				contentType = *props.ContentType
+			}
+			if props.CreationTime != nil {
+				timestamp = *props.CreationTime
+			}
+		}
+		body := msg.GetData()
+		if body == nil {
+			// Some clients send text as an AMQP value rather than data.
+			if s, ok := msg.Value.(string); ok {
+				body = []byte(s)
 			}
-			if packs != nil {
-				for _, p := range packs {
-					ir.Inject(p)
-				}
+		}
+		ai.deliver(ir, pack, contentType, body, timestamp)
+		if err = ai.receiver.AcceptMessage(msg); err != nil {
+			return fmt.Errorf("AMQP 1.0 accept error: %s", err)
+		}
+	}
+}
+
+// Decodes a received message body into the pack and passes it on.
+func (ai *AMQPInput) deliver(ir InputRunner, pack *PipelinePack, contentType string,
+	body []byte, timestamp time.Time) {
+
+	if contentType == "application/hekad" {
+		if ai.dRunner == nil {
+			pack.Recycle()
+			ir.LogError(errors.New("`application/hekad` messages require a decoder."))
+		} else {
+			_, msgOk := findMessage(body, ai.header, &(pack.MsgBytes))
+			if msgOk {
+				ai.dRunner.InChan() <- pack
 			} else {
-				if e != nil {
-					ir.LogError(fmt.Errorf("Couldn't parse AMQP message: %s", msg.Body))
-				}
 				pack.Recycle()
+				ir.LogError(errors.New("Can't find Heka message."))
 			}
+			ai.header.Reset()
 		}
-		msg.Ack(false)
+		return
+	}
+
+	pack.Message.SetType("amqp")
+	pack.Message.SetPayload(string(body))
+	pack.Message.SetTimestamp(timestamp.UnixNano())
+	var (
+		packs []*PipelinePack
+		e     error
+	)
+	if ai.decoder == nil {
+		packs = []*PipelinePack{pack}
+	} else {
+		packs, e = ai.decoder.Decode(pack)
+	}
+	if packs != nil {
+		for _, p := range packs {
+			ir.Inject(p)
+		}
+	} else {
+		if e != nil {
+			ir.LogError(fmt.Errorf("Couldn't parse AMQP message: %s", body))
+		}
+		pack.Recycle()
 	}
-	return
 }
 
 func (ai *AMQPInput) CleanupForRestart() {
+	if ai.amqp10 {
+		if ai.session != nil {
+			ai.session.Close()
+		}
+		return
+	}
 	ai.amqpHub.Close(ai.config.URL, ai.connWg)
 	ai.connWg.Wait()
 }
 
 func (ai *AMQPInput) Stop() {
+	if ai.amqp10 {
+		// Init may have failed during a restart.
+		if ai.session != nil {
+			close(ai.stopChan)
+			ai.session.Close()
+		}
+		return
+	}
 	ai.ch.Close()
 	ai.amqpHub.Close(ai.config.URL, ai.connWg)
 	ai.connWg.Wait()
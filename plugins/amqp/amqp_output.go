@@ -19,6 +19,7 @@ import (
 	"crypto/tls"
 	"errors"
 	"fmt"
+	amqp10 "github.com/Azure/go-amqp"
 	. "github.com/mozilla-services/heka/pipeline"
 	"github.com/mozilla-services/heka/plugins/tcp"
 	"github.com/streadway/amqp"
@@ -62,6 +63,15 @@ type AMQPOutputConfig struct {
 	Encoder string
 	// Allows us to use framing by default.
 	UseFraming bool `toml:"use_framing"`
+	// AMQP protocol version, either "0-9-1" or "1.0". Defaults to "0-9-1".
+	Protocol string
+	// Address of the AMQP 1.0 node to send to, e.g. a queue or a topic. The
+	// exchange and routing key settings only apply to 0.9.1.
+	Address string
+	// SASL mechanism of AMQP 1.0 connections: PLAIN, ANONYMOUS, or
+	// EXTERNAL. Defaults to PLAIN if the URL contains credentials, ANONYMOUS
+	// otherwise.
+	SASLMechanism string `toml:"sasl_mechanism"`
 }
 
 type AMQPOutput struct {
@@ -79,6 +89,14 @@ type AMQPOutput struct {
 	connWg *sync.WaitGroup
 	// Hold a reference to the connection hub.
 	amqpHub AMQPConnectionHub
+	// AMQP 1.0 state, used instead of the connection hub and channel.
+	amqp10  bool
+	session AMQP10Session
+	sender  AMQP10Sender
+	dial10  func(AMQP10Dialer, string) (AMQP10Session, error)
+	// Encoded message whose send failed because the connection went down,
+	// sent first once the output has been restarted.
+	pending []byte
 }
 
 func (ao *AMQPOutput) ConfigStruct() interface{} {
@@ -90,18 +108,25 @@ func (ao *AMQPOutput) ConfigStruct() interface{} {
 		Encoder:            "ProtobufEncoder",
 		UseFraming:         true,
 		ContentType:        "application/hekad",
+		Protocol:           protocolAMQP091,
 	}
 }
 
 func (ao *AMQPOutput) Init(config interface{}) (err error) {
 	conf := config.(*AMQPOutputConfig)
 	ao.config = conf
+	if ao.amqp10, err = isAMQP10(conf.Protocol); err != nil {
+		return
+	}
 	var tlsConf *tls.Config = nil
 	if strings.HasPrefix(conf.URL, "amqps://") && &ao.config.Tls != nil {
 		if tlsConf, err = tcp.CreateGoTlsConfig(&ao.config.Tls); err != nil {
 			return fmt.Errorf("TLS init error: %s", err)
 		}
 	}
+	if ao.amqp10 {
+		return ao.initAMQP10(tlsConf)
+	}
 
 	var dialer = AMQPDialer{tlsConf}
 	if ao.amqpHub == nil {
@@ -126,10 +151,35 @@ func (ao *AMQPOutput) Init(config interface{}) (err error) {
 	return
 }
 
+// Connects to the broker and opens the sending link. Connection failures are
+// recovered from by the output runner restarting the plugin according to its
+// `retries` settings.
+func (ao *AMQPOutput) initAMQP10(tlsConf *tls.Config) (err error) {
+	conf := ao.config
+	if conf.Address == "" {
+		return errors.New("`address` is required with AMQP 1.0")
+	}
+	if ao.dial10 == nil {
+		ao.dial10 = AMQP10Dialer.Dial
+	}
+	ao.session, err = ao.dial10(AMQP10Dialer{tlsConf, conf.SASLMechanism}, conf.URL)
+	if err != nil {
+		return
+	}
+	if ao.sender, err = ao.session.NewSender(conf.Address); err != nil {
+		ao.session.Close()
+		ao.session = nil
+	}
+	return
+}
+
 func (ao *AMQPOutput) Run(or OutputRunner, h PluginHelper) (err error) {
 	if or.Encoder() == nil {
 		return errors.New("Encoder required.")
 	}
+	if ao.amqp10 {
+		return ao.runAMQP10(or)
+	}
 
 	inChan := or.InChan()
 	conf := ao.config
@@ -192,7 +242,62 @@ func (ao *AMQPOutput) Run(or OutputRunner, h PluginHelper) (err error) {
 	return
 }
 
+func (ao *AMQPOutput) runAMQP10(or OutputRunner) (err error) {
+	if ao.pending != nil {
+		if err = ao.send(ao.pending); err != nil {
+			if !isAMQP10Rejection(err) {
+				return fmt.Errorf("AMQP 1.0 send error: %s", err)
+			}
+			or.LogError(fmt.Errorf("Message rejected: %s", err))
+		}
+		ao.pending = nil
+	}
+
+	var outBytes []byte
+	for pack := range or.InChan() {
+		if outBytes, err = or.Encode(pack); err != nil {
+			or.LogError(fmt.Errorf("Error encoding message: %s", err))
+			pack.Recycle()
+			continue
+		} else if outBytes == nil {
+			pack.Recycle()
+			continue
+		}
+		if err = ao.send(outBytes); err == nil {
+			pack.Recycle()
+			continue
+		}
+		if isAMQP10Rejection(err) {
+			or.HandleFailure(pack, NewMalformedMessageError(err))
+			continue
+		}
+		ao.pending = append([]byte(nil), outBytes...)
+		pack.Recycle()
+		return fmt.Errorf("AMQP 1.0 send error: %s", err)
+	}
+	ao.session.Close()
+	return nil
+}
+
+// Sends an encoded message, returning once the broker has settled it.
+func (ao *AMQPOutput) send(body []byte) error {
+	conf := ao.config
+	now := time.Now()
+	msg := amqp10.NewMessage(body)
+	msg.Properties = &amqp10.MessageProperties{
+		ContentType:  &conf.ContentType,
+		CreationTime: &now,
+	}
+	if conf.Persistent {
+		msg.Header = &amqp10.MessageHeader{Durable: true}
+	}
+	return ao.sender.Send(msg)
+}
+
 func (ao *AMQPOutput) CleanupForRestart() {
+	if ao.amqp10 && ao.session != nil {
+		ao.session.Close()
+	}
 	return
 }
 
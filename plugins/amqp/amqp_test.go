@@ -37,6 +37,7 @@ func TestAllSpecs(t *testing.T) {
 	r.Parallel = false
 
 	r.AddSpec(AMQPPluginSpec)
+	r.AddSpec(AMQP10Spec)
 
 	gs.MainGoTest(r, t)
 }
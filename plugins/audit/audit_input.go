@@ -0,0 +1,152 @@
+// +build linux
+
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package audit
+
+import (
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+	"github.com/mozilla-services/heka/pipeline"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+type AuditInputConfig struct {
+	// "unicast" to receive the records as the audit daemon, replacing
+	// auditd, or "multicast" to receive a copy of them alongside auditd.
+	SocketMode string `toml:"socket_mode"`
+	// Milliseconds after which an event missing its EOE record is delivered
+	// with the records received.
+	EventTimeout uint32 `toml:"event_timeout"`
+}
+
+// Input reading the Linux audit netlink socket, delivering each audit event,
+// reassembled from its records, as a `heka.audit` message.
+type AuditInput struct {
+	recordsReceived int64
+	eventsDelivered int64
+	invalidRecords  int64
+
+	conf     *AuditInputConfig
+	pConfig  *pipeline.PipelineConfig
+	name     string
+	socket   *auditSocket
+	stopChan chan bool
+}
+
+func (a *AuditInput) ConfigStruct() interface{} {
+	return &AuditInputConfig{
+		SocketMode:   "unicast",
+		EventTimeout: 2000,
+	}
+}
+
+func (a *AuditInput) SetPipelineConfig(pConfig *pipeline.PipelineConfig) {
+	a.pConfig = pConfig
+}
+
+func (a *AuditInput) SetName(name string) {
+	a.name = name
+}
+
+func (a *AuditInput) Init(config interface{}) (err error) {
+	a.conf = config.(*AuditInputConfig)
+	if a.conf.SocketMode != "unicast" && a.conf.SocketMode != "multicast" {
+		return fmt.Errorf("socket_mode must be 'unicast' or 'multicast'")
+	}
+	if a.conf.EventTimeout == 0 {
+		return fmt.Errorf("event_timeout must be greater than 0")
+	}
+	// Reads time out regularly, so pending events expire and stop requests
+	// aren't held up.
+	a.socket, err = openAuditSocket(a.conf.SocketMode == "unicast", 250*time.Millisecond)
+	a.stopChan = make(chan bool)
+	return
+}
+
+func (a *AuditInput) Run(ir pipeline.InputRunner, h pipeline.PluginHelper) error {
+	defer a.socket.close()
+	var (
+		timeout    = time.Duration(a.conf.EventTimeout) * time.Millisecond
+		assembler  = newAssembler(timeout)
+		hostname   = a.pConfig.Hostname()
+		packSupply = ir.InChan()
+		buf        = make([]byte, 1<<16)
+	)
+	deliver := func(e *event) {
+		pack := <-packSupply
+		populatePack(pack, e, a.name, hostname)
+		ir.Deliver(pack)
+		atomic.AddInt64(&a.eventsDelivered, 1)
+	}
+
+	for {
+		select {
+		case <-a.stopChan:
+			for _, e := range assembler.expire(time.Now(), true) {
+				deliver(e)
+			}
+			return nil
+		default:
+		}
+
+		typ, data, err := a.socket.receive(buf)
+		now := time.Now()
+		if err == nil {
+			// Replies to requests and other control messages have types
+			// below the records'.
+			if typ < 1100 {
+				continue
+			}
+			atomic.AddInt64(&a.recordsReceived, 1)
+			var r *record
+			if r, err = parseRecord(typ, data); err != nil {
+				atomic.AddInt64(&a.invalidRecords, 1)
+				ir.LogError(fmt.Errorf("invalid %s record: %s", typeName(typ), err))
+			} else if e := assembler.add(r, now); e != nil {
+				deliver(e)
+			}
+		} else if err != syscall.EAGAIN && err != syscall.EINTR {
+			if err == syscall.ENOBUFS {
+				// The socket's buffer overflowed, records were lost.
+				ir.LogError(fmt.Errorf("audit records lost, Heka isn't keeping up"))
+			} else {
+				return fmt.Errorf("reading the audit socket: %s", err)
+			}
+		}
+		for _, e := range assembler.expire(now, false) {
+			deliver(e)
+		}
+	}
+}
+
+func (a *AuditInput) Stop() {
+	close(a.stopChan)
+}
+
+func (a *AuditInput) ReportMsg(msg *message.Message) error {
+	message.NewInt64Field(msg, "RecordsReceived",
+		atomic.LoadInt64(&a.recordsReceived), "count")
+	message.NewInt64Field(msg, "EventsDelivered",
+		atomic.LoadInt64(&a.eventsDelivered), "count")
+	message.NewInt64Field(msg, "InvalidRecords",
+		atomic.LoadInt64(&a.invalidRecords), "count")
+	return nil
+}
+
+func init() {
+	pipeline.RegisterPlugin("AuditInput", func() interface{} {
+		return new(AuditInput)
+	})
+}
@@ -0,0 +1,346 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package audit
+
+import (
+	"code.google.com/p/go-uuid/uuid"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+	"github.com/mozilla-services/heka/pipeline"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Audit record types, see linux/audit.h.
+const (
+	typeEOE = 1320
+	// Records of the kernel's syscall events, which end with an EOE record.
+	// Other records are events of their own.
+	firstMultiPart = 1300
+	lastMultiPart  = 1499
+)
+
+var typeNames = map[uint16]string{
+	1100: "USER_AUTH",
+	1101: "USER_ACCT",
+	1102: "USER_MGMT",
+	1103: "CRED_ACQ",
+	1104: "CRED_DISP",
+	1105: "USER_START",
+	1106: "USER_END",
+	1108: "USER_CHAUTHTOK",
+	1109: "USER_ERR",
+	1110: "CRED_REFR",
+	1112: "USER_LOGIN",
+	1113: "USER_LOGOUT",
+	1114: "ADD_USER",
+	1115: "DEL_USER",
+	1116: "ADD_GROUP",
+	1117: "DEL_GROUP",
+	1123: "USER_CMD",
+	1124: "USER_TTY",
+	1130: "SERVICE_START",
+	1131: "SERVICE_STOP",
+	1300: "SYSCALL",
+	1302: "PATH",
+	1303: "IPC",
+	1304: "SOCKETCALL",
+	1305: "CONFIG_CHANGE",
+	1306: "SOCKADDR",
+	1307: "CWD",
+	1309: "EXECVE",
+	1311: "IPC_SET_PERM",
+	1312: "MQ_OPEN",
+	1313: "MQ_SENDRECV",
+	1314: "MQ_NOTIFY",
+	1315: "MQ_GETSETATTR",
+	1316: "KERNEL_OTHER",
+	1317: "FD_PAIR",
+	1318: "OBJ_PID",
+	1319: "TTY",
+	1320: "EOE",
+	1321: "BPRM_FCAPS",
+	1322: "CAPSET",
+	1323: "MMAP",
+	1324: "NETFILTER_PKT",
+	1325: "NETFILTER_CFG",
+	1326: "SECCOMP",
+	1327: "PROCTITLE",
+	1328: "FEATURE_CHANGE",
+	1329: "REPLACE",
+	1330: "KERN_MODULE",
+	1331: "FANOTIFY",
+	1334: "BPF",
+	1400: "AVC",
+	1401: "SELINUX_ERR",
+	1402: "AVC_PATH",
+	1403: "MAC_POLICY_LOAD",
+	1404: "MAC_STATUS",
+	1405: "MAC_CONFIG_CHANGE",
+	1500: "AA",
+	1700: "ANOM_PROMISCUOUS",
+	1701: "ANOM_ABEND",
+	1702: "ANOM_LINK",
+	1703: "ANOM_CREAT",
+	2000: "KERNEL",
+}
+
+// Returns the name of a record type, e.g. "SYSCALL".
+func typeName(typ uint16) string {
+	if name, ok := typeNames[typ]; ok {
+		return name
+	}
+	return fmt.Sprintf("UNKNOWN_%d", typ)
+}
+
+// Keys whose unquoted values are hex encoded, because they contain spaces,
+// quotes, or control characters.
+var hexKeys = map[string]bool{
+	"acct":      true,
+	"cmd":       true,
+	"comm":      true,
+	"cwd":       true,
+	"data":      true,
+	"exe":       true,
+	"name":      true,
+	"new-disk":  true,
+	"old-disk":  true,
+	"path":      true,
+	"proctitle": true,
+}
+
+type field struct {
+	key, value string
+}
+
+// An audit record, e.g. `audit(1420070400.123:42): arch=c000003e syscall=59`.
+type record struct {
+	typ    uint16
+	serial uint64
+	// Nanoseconds since the epoch.
+	timestamp int64
+	// The record's text, after its header.
+	text   string
+	fields []field
+}
+
+var errNoHeader = errors.New("missing audit(timestamp:serial) header")
+
+// Parses the text of an audit netlink message.
+func parseRecord(typ uint16, data []byte) (*record, error) {
+	text := strings.TrimRight(string(data), "\x00\n")
+	if !strings.HasPrefix(text, "audit(") {
+		return nil, errNoHeader
+	}
+	end := strings.Index(text, "):")
+	if end < 0 {
+		return nil, errNoHeader
+	}
+	header := text[len("audit("):end]
+	colon := strings.IndexByte(header, ':')
+	if colon < 0 {
+		return nil, errNoHeader
+	}
+	r := &record{typ: typ, text: strings.TrimSpace(text[end+2:])}
+	var err error
+	if r.serial, err = strconv.ParseUint(header[colon+1:], 10, 64); err != nil {
+		return nil, fmt.Errorf("invalid serial: %s", header[colon+1:])
+	}
+	stamp := header[:colon]
+	sec, frac := stamp, "0"
+	if dot := strings.IndexByte(stamp, '.'); dot >= 0 {
+		sec, frac = stamp[:dot], stamp[dot+1:]
+	}
+	s, err := strconv.ParseInt(sec, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid timestamp: %s", stamp)
+	}
+	ms, err := strconv.ParseInt(frac, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid timestamp: %s", stamp)
+	}
+	r.timestamp = s*int64(time.Second) + ms*int64(time.Millisecond)
+	r.fields = parseFields(r.text, typ == 1309)
+	return r, nil
+}
+
+// Parses the key=value pairs of a record, skipping words without a value.
+// The quoted `msg` of user space records is parsed as pairs of its own.
+func parseFields(text string, execve bool) (fields []field) {
+	for len(text) > 0 {
+		text = strings.TrimLeft(text, " ")
+		end := strings.IndexAny(text, " =")
+		if end < 0 {
+			break
+		}
+		if text[end] == ' ' {
+			text = text[end:]
+			continue
+		}
+		key := text[:end]
+		text = text[end+1:]
+
+		var value string
+		quoted := len(text) > 0 && (text[0] == '"' || text[0] == '\'')
+		if quoted {
+			if q := strings.IndexByte(text[1:], text[0]); q >= 0 {
+				value, text = text[1:q+1], text[q+2:]
+			} else {
+				value, text = text[1:], ""
+			}
+		} else {
+			end = strings.IndexByte(text, ' ')
+			if end < 0 {
+				end = len(text)
+			}
+			value, text = text[:end], text[end:]
+		}
+
+		switch {
+		case key == "msg" && quoted && strings.Contains(value, "="):
+			fields = append(fields, parseFields(value, false)...)
+			continue
+		case !quoted && (hexKeys[key] || execve && isArgKey(key)):
+			value = decodeHex(value)
+		}
+		if key != "" {
+			fields = append(fields, field{key, value})
+		}
+	}
+	return
+}
+
+// Reports whether a key is an EXECVE argument, e.g. "a1" or "a1[0]".
+func isArgKey(key string) bool {
+	if len(key) < 2 || key[0] != 'a' {
+		return false
+	}
+	for _, c := range key[1:] {
+		if (c < '0' || c > '9') && c != '[' && c != ']' {
+			return false
+		}
+	}
+	return true
+}
+
+// Decodes a hex encoded value, keeping values that aren't, e.g. "(null)".
+// NUL separators, e.g. between the arguments of a proctitle, become spaces.
+func decodeHex(value string) string {
+	decoded, err := hex.DecodeString(value)
+	if err != nil || len(decoded) == 0 {
+		return value
+	}
+	return strings.Replace(strings.TrimRight(string(decoded), "\x00"), "\x00", " ", -1)
+}
+
+// The records of an audit event, sharing a serial number.
+type event struct {
+	serial   uint64
+	records  []*record
+	received time.Time
+}
+
+// Groups records into events. Multi-part events are complete once their EOE
+// record is received or, as the kernel can drop records, once they've been
+// pending for the timeout.
+type assembler struct {
+	timeout time.Duration
+	pending map[uint64]*event
+}
+
+func newAssembler(timeout time.Duration) *assembler {
+	return &assembler{
+		timeout: timeout,
+		pending: make(map[uint64]*event),
+	}
+}
+
+// Adds a record, returning the event it completes, if any.
+func (a *assembler) add(r *record, now time.Time) *event {
+	e, ok := a.pending[r.serial]
+	if r.typ == typeEOE {
+		if ok {
+			delete(a.pending, r.serial)
+		}
+		return e
+	}
+	if ok {
+		e.records = append(e.records, r)
+		return nil
+	}
+	e = &event{serial: r.serial, records: []*record{r}, received: now}
+	if r.typ < firstMultiPart || r.typ > lastMultiPart {
+		return e
+	}
+	a.pending[r.serial] = e
+	return nil
+}
+
+type bySerial []*event
+
+func (s bySerial) Len() int           { return len(s) }
+func (s bySerial) Less(i, j int) bool { return s[i].serial < s[j].serial }
+func (s bySerial) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// Returns the pending events received before the timeout, in serial order,
+// or all of them if `all` is true.
+func (a *assembler) expire(now time.Time, all bool) []*event {
+	var expired []*event
+	for serial, e := range a.pending {
+		if all || now.Sub(e.received) >= a.timeout {
+			expired = append(expired, e)
+			delete(a.pending, serial)
+		}
+	}
+	sort.Sort(bySerial(expired))
+	return expired
+}
+
+// Fills a pack with an event. The payload holds the records in the format of
+// the auditd log, and each record field is stored as a "TYPE.key" message
+// field, e.g. "SYSCALL.exe".
+func populatePack(pack *pipeline.PipelinePack, e *event, logger, hostname string) {
+	msg := pack.Message
+	first := e.records[0]
+	msg.SetUuid(uuid.NewRandom())
+	msg.SetTimestamp(first.timestamp)
+	msg.SetType("heka.audit")
+	msg.SetLogger(logger)
+	msg.SetHostname(hostname)
+	msg.SetSeverity(6)
+
+	lines := make([]string, len(e.records))
+	for i, r := range e.records {
+		name := typeName(r.typ)
+		lines[i] = fmt.Sprintf("type=%s msg=audit(%d.%03d:%d): %s", name,
+			r.timestamp/int64(time.Second), r.timestamp%int64(time.Second)/int64(time.Millisecond),
+			r.serial, r.text)
+	}
+	msg.SetPayload(strings.Join(lines, "\n"))
+	message.NewInt64Field(msg, "Serial", int64(e.serial), "")
+	message.NewStringField(msg, "EventType", typeName(first.typ))
+	for _, r := range e.records {
+		name := typeName(r.typ)
+		for _, f := range r.fields {
+			if f.key == "pid" && r == first {
+				if pid, err := strconv.Atoi(f.value); err == nil {
+					msg.SetPid(int32(pid))
+				}
+			}
+			message.NewStringField(msg, name+"."+f.key, f.value)
+		}
+	}
+}
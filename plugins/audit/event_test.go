@@ -0,0 +1,143 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package audit
+
+import (
+	"github.com/mozilla-services/heka/pipeline"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func mustParse(t *testing.T, typ uint16, text string) *record {
+	r, err := parseRecord(typ, []byte(text))
+	if err != nil {
+		t.Fatalf("%s: %s", text, err)
+	}
+	return r
+}
+
+func TestParseRecord(t *testing.T) {
+	r := mustParse(t, 1300, `audit(1420070400.123:42): arch=c000003e syscall=59 `+
+		`success=yes exit=0 pid=1234 comm="ls" exe="/bin/ls" key=(null)`+"\x00")
+	if r.serial != 42 || r.timestamp != 1420070400123000000 {
+		t.Errorf("Unexpected header: %d, %d", r.serial, r.timestamp)
+	}
+	expected := []field{{"arch", "c000003e"}, {"syscall", "59"}, {"success", "yes"},
+		{"exit", "0"}, {"pid", "1234"}, {"comm", "ls"}, {"exe", "/bin/ls"},
+		{"key", "(null)"}}
+	if !reflect.DeepEqual(r.fields, expected) {
+		t.Errorf("Unexpected fields: %v", r.fields)
+	}
+
+	// Hex encoded values, and the nested fields of user space records.
+	r = mustParse(t, 1309, `audit(1420070400.123:42): argc=3 a0="ls" a1=2D6C61 a2="my file"`)
+	expected = []field{{"argc", "3"}, {"a0", "ls"}, {"a1", "-la"}, {"a2", "my file"}}
+	if !reflect.DeepEqual(r.fields, expected) {
+		t.Errorf("Unexpected fields: %v", r.fields)
+	}
+	r = mustParse(t, 1327, `audit(1420070400.123:42): proctitle=6C73002D6C61`)
+	if len(r.fields) != 1 || r.fields[0].value != "ls -la" {
+		t.Errorf("Unexpected fields: %v", r.fields)
+	}
+	r = mustParse(t, 1105, `audit(1420070400.500:7): pid=99 uid=0 auid=1000 `+
+		`msg='op=PAM:session_open acct="root" exe="/usr/bin/sudo" hostname=? res=success'`)
+	expected = []field{{"pid", "99"}, {"uid", "0"}, {"auid", "1000"},
+		{"op", "PAM:session_open"}, {"acct", "root"}, {"exe", "/usr/bin/sudo"},
+		{"hostname", "?"}, {"res", "success"}}
+	if !reflect.DeepEqual(r.fields, expected) || r.timestamp != 1420070400500000000 {
+		t.Errorf("Unexpected record: %v", r)
+	}
+	// Words without a value are skipped.
+	r = mustParse(t, 1400, `audit(1420070400.123:43): avc:  denied  { read } for  pid=5 name="x"`)
+	if !reflect.DeepEqual(r.fields, []field{{"pid", "5"}, {"name", "x"}}) {
+		t.Errorf("Unexpected fields: %v", r.fields)
+	}
+
+	for _, text := range []string{"arch=c000003e", "audit(1420070400.123): a=b",
+		"audit(x.1:2): a=b", "audit(1.1:x): a=b"} {
+		if _, err := parseRecord(1300, []byte(text)); err == nil {
+			t.Errorf("Invalid record accepted: %s", text)
+		}
+	}
+}
+
+func TestAssembler(t *testing.T) {
+	a := newAssembler(time.Second)
+	now := time.Unix(1000, 0)
+	records := []*record{
+		mustParse(t, 1300, "audit(1.0:10): syscall=59"),
+		mustParse(t, 1300, "audit(1.0:11): syscall=2"),
+		mustParse(t, 1112, "audit(1.0:12): res=success"),
+		mustParse(t, 1302, "audit(1.0:10): item=0"),
+		mustParse(t, 1320, "audit(1.0:10): "),
+	}
+	var complete []uint64
+	for _, r := range records {
+		if e := a.add(r, now); e != nil {
+			complete = append(complete, e.serial)
+			if e.serial == 10 && len(e.records) != 2 {
+				t.Errorf("Unexpected records: %v", e.records)
+			}
+		}
+	}
+	if !reflect.DeepEqual(complete, []uint64{12, 10}) {
+		t.Errorf("Unexpected events: %v", complete)
+	}
+
+	// Events missing their EOE record expire.
+	a.add(mustParse(t, 1300, "audit(1.0:9): syscall=1"), now.Add(time.Second/2))
+	if expired := a.expire(now.Add(time.Second/2), false); len(expired) != 0 {
+		t.Errorf("Unexpected expired events: %v", expired)
+	}
+	expired := a.expire(now.Add(time.Second), false)
+	if len(expired) != 1 || expired[0].serial != 11 {
+		t.Errorf("Unexpected expired events: %v", expired)
+	}
+	expired = a.expire(now.Add(time.Second), true)
+	if len(expired) != 1 || expired[0].serial != 9 || len(a.pending) != 0 {
+		t.Errorf("Unexpected expired events: %v", expired)
+	}
+}
+
+func TestPopulatePack(t *testing.T) {
+	e := &event{serial: 42, records: []*record{
+		mustParse(t, 1300, `audit(1420070400.123:42): syscall=59 pid=1234 exe="/bin/ls"`),
+		mustParse(t, 1302, `audit(1420070400.123:42): item=0 name="/bin/ls"`),
+		mustParse(t, 1302, `audit(1420070400.123:42): item=1 name="/lib/ld.so"`),
+	}}
+	pack := pipeline.NewPipelinePack(nil)
+	populatePack(pack, e, "audit", "web1")
+	msg := pack.Message
+
+	if msg.GetType() != "heka.audit" || msg.GetTimestamp() != 1420070400123000000 ||
+		msg.GetPid() != 1234 || msg.GetHostname() != "web1" {
+
+		t.Errorf("Unexpected message: %s", msg)
+	}
+	expected := `type=SYSCALL msg=audit(1420070400.123:42): syscall=59 pid=1234 exe="/bin/ls"
+type=PATH msg=audit(1420070400.123:42): item=0 name="/bin/ls"
+type=PATH msg=audit(1420070400.123:42): item=1 name="/lib/ld.so"`
+	if msg.GetPayload() != expected {
+		t.Errorf("Unexpected payload: %s", msg.GetPayload())
+	}
+	if v, _ := msg.GetFieldValue("EventType"); v != "SYSCALL" {
+		t.Errorf("Unexpected event type: %v", v)
+	}
+	if v, _ := msg.GetFieldValue("SYSCALL.exe"); v != "/bin/ls" {
+		t.Errorf("Unexpected exe: %v", v)
+	}
+	names := msg.FindAllFields("PATH.name")
+	if len(names) != 2 || names[1].GetValueString()[0] != "/lib/ld.so" {
+		t.Errorf("Unexpected names: %v", names)
+	}
+}
@@ -0,0 +1,146 @@
+// +build linux
+
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package audit
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+)
+
+const (
+	netlinkAudit = 9
+	// Multicast group of the audit log, kernels 3.16 and later.
+	auditGroupReadLog = 1
+
+	auditSet        = 1001
+	auditStatusPid  = 0x0004
+	nlmsgHeaderSize = 16
+)
+
+// A netlink socket receiving audit records.
+type auditSocket struct {
+	fd      int
+	unicast bool
+	seq     uint32
+}
+
+// Opens an audit socket. A unicast socket registers Heka as the audit daemon,
+// replacing auditd, a multicast socket receives a copy of the records sent
+// to the audit daemon. Reads time out after `readTimeout`.
+func openAuditSocket(unicast bool, readTimeout time.Duration) (*auditSocket, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC,
+		netlinkAudit)
+	if err != nil {
+		return nil, fmt.Errorf("can't open the audit socket: %s", err)
+	}
+	s := &auditSocket{fd: fd, unicast: unicast}
+	addr := &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}
+	if !unicast {
+		addr.Groups = auditGroupReadLog
+	}
+	if err = syscall.Bind(fd, addr); err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("can't bind the audit socket: %s", err)
+	}
+	tv := syscall.NsecToTimeval(readTimeout.Nanoseconds())
+	if err = syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	if unicast {
+		if err = s.setPid(os.Getpid()); err != nil {
+			syscall.Close(fd)
+			return nil, fmt.Errorf("can't register as the audit daemon: %s", err)
+		}
+	}
+	return s, nil
+}
+
+// Sets the PID of the audit daemon, the kernel sends the records to.
+func (s *auditSocket) setPid(pid int) error {
+	// struct audit_status: mask, enabled, failure, pid, rate_limit,
+	// backlog_limit, lost, and backlog.
+	status := make([]byte, 32)
+	binary.LittleEndian.PutUint32(status[0:], auditStatusPid)
+	binary.LittleEndian.PutUint32(status[12:], uint32(pid))
+	return s.request(auditSet, status)
+}
+
+// Sends a request, waiting for its acknowledgement.
+func (s *auditSocket) request(typ uint16, data []byte) error {
+	s.seq++
+	msg := make([]byte, nlmsgHeaderSize+len(data))
+	// Netlink headers are in host byte order, little endian on the
+	// architectures Heka supports.
+	binary.LittleEndian.PutUint32(msg[0:], uint32(len(msg)))
+	binary.LittleEndian.PutUint16(msg[4:], typ)
+	binary.LittleEndian.PutUint16(msg[6:], syscall.NLM_F_REQUEST|syscall.NLM_F_ACK)
+	binary.LittleEndian.PutUint32(msg[8:], s.seq)
+	copy(msg[nlmsgHeaderSize:], data)
+	if err := syscall.Sendto(s.fd, msg, 0, &syscall.SockaddrNetlink{
+		Family: syscall.AF_NETLINK}); err != nil {
+		return err
+	}
+
+	buf := make([]byte, syscall.Getpagesize())
+	for {
+		n, _, err := syscall.Recvfrom(s.fd, buf, 0)
+		if err != nil {
+			return err
+		}
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return err
+		}
+		for _, m := range msgs {
+			if m.Header.Seq != s.seq || m.Header.Type != syscall.NLMSG_ERROR {
+				continue
+			}
+			if len(m.Data) < 4 {
+				return fmt.Errorf("truncated netlink acknowledgement")
+			}
+			if errno := int32(binary.LittleEndian.Uint32(m.Data)); errno != 0 {
+				return syscall.Errno(-errno)
+			}
+			return nil
+		}
+	}
+}
+
+// Receives an audit record's message into buf, returning its type and text.
+// Timeouts return an EAGAIN error.
+func (s *auditSocket) receive(buf []byte) (uint16, []byte, error) {
+	n, _, err := syscall.Recvfrom(s.fd, buf, 0)
+	if err != nil {
+		return 0, nil, err
+	}
+	if n < nlmsgHeaderSize {
+		return 0, nil, fmt.Errorf("truncated netlink message")
+	}
+	typ := binary.LittleEndian.Uint16(buf[4:])
+	// The kernel doesn't always set the message length correctly, so the
+	// datagram's length is used instead, each holding a single record.
+	return typ, buf[nlmsgHeaderSize:n], nil
+}
+
+func (s *auditSocket) close() error {
+	if s.unicast {
+		// Deregisters, so the kernel logs records itself again.
+		s.setPid(0)
+	}
+	return syscall.Close(s.fd)
+}
@@ -0,0 +1,328 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package avro
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+	"github.com/mozilla-services/heka/pipeline"
+	"io/ioutil"
+	"strconv"
+	"time"
+)
+
+type AvroDecoderConfig struct {
+	// File holding the schema the payloads are written with. Relative paths
+	// are relative to Heka's `share_dir`.
+	SchemaFile string `toml:"schema_file"`
+
+	// URL of a schema registry. Payloads are then expected in the
+	// registry's wire format, naming the id of the schema they're written
+	// with, which is fetched from the registry.
+	SchemaRegistry string `toml:"schema_registry"`
+
+	// Milliseconds schema registry requests may take. Defaults to 5000.
+	RegistryTimeout uint32 `toml:"registry_timeout"`
+
+	// Names of the record's fields setting the message's headers, keyed by
+	// header: Timestamp, Severity, Hostname, Logger, Type, Payload, Pid, or
+	// Uuid. Nested fields are named after their path. Headers not in the map
+	// are set by the field named after them, if the record has one.
+	HeaderFields map[string]string `toml:"header_fields"`
+
+	// Separator of the names of the fields of nested records and maps.
+	// Defaults to ".".
+	FlattenSeparator string `toml:"flatten_separator"`
+
+	// Layout the Timestamp is parsed with if it's a string. Defaults to
+	// RFC3339.
+	TimestampLayout string `toml:"timestamp_layout"`
+
+	// Maps severity strings to their int version
+	SeverityMap map[string]int32 `toml:"severity_map"`
+}
+
+// Message headers the record's fields can set.
+var decodedHeaders = map[string]bool{
+	"Timestamp": true,
+	"Severity":  true,
+	"Hostname":  true,
+	"Logger":    true,
+	"Type":      true,
+	"Payload":   true,
+	"Pid":       true,
+	"Uuid":      true,
+}
+
+// Decodes Avro records, e.g. consumed from Kafka topics, setting a message
+// field for each of their values.
+type AvroDecoder struct {
+	conf     *AvroDecoderConfig
+	schema   *avroSchema
+	registry *schemaRegistry
+	headers  map[string]string // Header set by each record field.
+	pConfig  *pipeline.PipelineConfig
+}
+
+// Heka will call this before calling any other methods to give us access to
+// the pipeline configuration.
+func (ad *AvroDecoder) SetPipelineConfig(pConfig *pipeline.PipelineConfig) {
+	ad.pConfig = pConfig
+}
+
+func (ad *AvroDecoder) ConfigStruct() interface{} {
+	return &AvroDecoderConfig{
+		RegistryTimeout:  5000,
+		FlattenSeparator: ".",
+		TimestampLayout:  time.RFC3339Nano,
+	}
+}
+
+func (ad *AvroDecoder) Init(config interface{}) (err error) {
+	conf := config.(*AvroDecoderConfig)
+	switch {
+	case conf.SchemaFile != "" && conf.SchemaRegistry != "":
+		return fmt.Errorf("AvroDecoder can't use both `schema_file` and `schema_registry`")
+	case conf.SchemaFile != "":
+		if ad.schema, err = loadSchema(ad.pConfig.Globals.PrependShareDir(conf.SchemaFile)); err != nil {
+			return fmt.Errorf("AvroDecoder: %s", err)
+		}
+		if ad.schema.typ != "record" {
+			return fmt.Errorf("AvroDecoder schema isn't a record")
+		}
+	case conf.SchemaRegistry != "":
+		timeout := time.Duration(conf.RegistryTimeout) * time.Millisecond
+		if ad.registry, err = newSchemaRegistry(conf.SchemaRegistry, timeout); err != nil {
+			return fmt.Errorf("AvroDecoder: %s", err)
+		}
+	default:
+		return fmt.Errorf("AvroDecoder requires `schema_file` or `schema_registry`")
+	}
+
+	ad.headers = make(map[string]string, len(decodedHeaders))
+	for header := range decodedHeaders {
+		if _, ok := conf.HeaderFields[header]; !ok {
+			ad.headers[header] = header
+		}
+	}
+	for header, field := range conf.HeaderFields {
+		if !decodedHeaders[header] {
+			return fmt.Errorf("AvroDecoder can't set unknown header '%s'", header)
+		}
+		ad.headers[field] = header
+	}
+	ad.conf = conf
+	return
+}
+
+func loadSchema(path string) (*avroSchema, error) {
+	text, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("can't read schema: %s", err)
+	}
+	return parseSchema(string(text))
+}
+
+func (ad *AvroDecoder) Decode(pack *pipeline.PipelinePack) (
+	packs []*pipeline.PipelinePack, err error) {
+
+	data := []byte(pack.Message.GetPayload())
+	schema := ad.schema
+	if ad.registry != nil {
+		var id int32
+		if id, data, err = splitWireFormat(data); err != nil {
+			return
+		}
+		if schema, err = ad.registry.schema(id); err != nil {
+			return
+		}
+	}
+	value, n, err := decodeValue(schema, data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Avro payload: %s", err)
+	}
+	if n != len(data) {
+		return nil, fmt.Errorf("invalid Avro payload: %d trailing bytes", len(data)-n)
+	}
+	record, ok := value.(*avroRecord)
+	if !ok {
+		return nil, fmt.Errorf("Avro payload isn't a record")
+	}
+	if err = ad.addRecord(pack.Message, "", record); err != nil {
+		return
+	}
+	return []*pipeline.PipelinePack{pack}, nil
+}
+
+// Adds the values of a record as fields, or sets the headers they're mapped
+// to, those of nested records and maps being named after their path.
+func (ad *AvroDecoder) addRecord(msg *message.Message, prefix string,
+	record *avroRecord) (err error) {
+
+	for i, name := range record.names {
+		if err = ad.addValue(msg, prefix+name, record.values[i]); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (ad *AvroDecoder) addValue(msg *message.Message, name string,
+	value interface{}) (err error) {
+
+	if header, ok := ad.headers[name]; ok {
+		return ad.setHeader(msg, header, value)
+	}
+	switch v := value.(type) {
+	case nil:
+		return
+	case *avroRecord:
+		return ad.addRecord(msg, name+ad.conf.FlattenSeparator, v)
+	case map[string]interface{}:
+		for _, key := range sortedKeys(v) {
+			if err = ad.addValue(msg, name+ad.conf.FlattenSeparator+key, v[key]); err != nil {
+				return
+			}
+		}
+		return
+	case []interface{}:
+		if len(v) == 0 {
+			return
+		}
+		// Arrays of strings, numbers, booleans, or bytes are fields with
+		// several values, other arrays are JSON text.
+		values := make([]interface{}, len(v))
+		for i, item := range v {
+			values[i] = fieldValue(item)
+			if values[i] == nil || fmt.Sprintf("%T", values[i]) != fmt.Sprintf("%T", values[0]) {
+				return addField(msg, name, jsonText(v))
+			}
+		}
+		return addField(msg, name, values...)
+	}
+	return addField(msg, name, fieldValue(value))
+}
+
+// Returns the field value of a scalar, nil for records, maps, and arrays.
+func fieldValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case string, bool, int64, float64, []byte:
+		return v
+	case time.Time:
+		return v.UnixNano()
+	}
+	return nil
+}
+
+func addField(msg *message.Message, name string, values ...interface{}) error {
+	field, err := message.NewField(name, values[0], "")
+	if err != nil {
+		return fmt.Errorf("field '%s': %s", name, err)
+	}
+	for _, value := range values[1:] {
+		if err = field.AddValue(value); err != nil {
+			return fmt.Errorf("field '%s': %s", name, err)
+		}
+	}
+	msg.AddField(field)
+	return nil
+}
+
+func (ad *AvroDecoder) setHeader(msg *message.Message, header string,
+	value interface{}) error {
+
+	if value == nil {
+		return nil
+	}
+	switch header {
+	case "Timestamp":
+		switch v := value.(type) {
+		case time.Time:
+			msg.SetTimestamp(v.UnixNano())
+		case int64:
+			// Seconds since the epoch, unless the schema's logical type says
+			// otherwise.
+			msg.SetTimestamp(v * int64(time.Second))
+		case float64:
+			msg.SetTimestamp(int64(v * float64(time.Second)))
+		case string:
+			t, err := message.ForgivingTimeParse(ad.conf.TimestampLayout, v, time.UTC)
+			if err != nil {
+				return fmt.Errorf("Don't recognize Timestamp: '%s'", v)
+			}
+			msg.SetTimestamp(t.UnixNano())
+		default:
+			return fmt.Errorf("invalid Timestamp: %v", value)
+		}
+		return nil
+	case "Severity":
+		s := fmt.Sprint(value)
+		if severity, ok := ad.conf.SeverityMap[s]; ok {
+			msg.SetSeverity(severity)
+		} else if severity, err := strconv.ParseInt(s, 10, 32); err == nil {
+			msg.SetSeverity(int32(severity))
+		} else {
+			return fmt.Errorf("Don't recognize severity: '%s'", s)
+		}
+		return nil
+	}
+	var s string
+	switch v := value.(type) {
+	case []byte:
+		s = string(v)
+	case string:
+		s = v
+	case *avroRecord, map[string]interface{}, []interface{}:
+		s = jsonText(v)
+	default:
+		s = fmt.Sprint(v)
+	}
+	template := pipeline.MessageTemplate{header: s}
+	return template.PopulateMessage(msg, nil)
+}
+
+// Returns a decoded value as JSON text, records being objects.
+func jsonText(value interface{}) string {
+	text, _ := json.Marshal(plainValue(value))
+	return string(text)
+}
+
+func plainValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case *avroRecord:
+		obj := make(map[string]interface{}, len(v.names))
+		for i, name := range v.names {
+			obj[name] = plainValue(v.values[i])
+		}
+		return obj
+	case map[string]interface{}:
+		obj := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			obj[key] = plainValue(item)
+		}
+		return obj
+	case []interface{}:
+		items := make([]interface{}, len(v))
+		for i, item := range v {
+			items[i] = plainValue(item)
+		}
+		return items
+	}
+	return value
+}
+
+func init() {
+	pipeline.RegisterPlugin("AvroDecoder", func() interface{} {
+		return new(AvroDecoder)
+	})
+}
@@ -0,0 +1,344 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package avro
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+	"github.com/mozilla-services/heka/pipeline"
+	"io/ioutil"
+	"strings"
+	"time"
+)
+
+type AvroEncoderConfig struct {
+	// File holding the schema of the records written. Relative paths are
+	// relative to Heka's `share_dir`.
+	SchemaFile string `toml:"schema_file"`
+
+	// URL of a schema registry. Records are then written in the registry's
+	// wire format, naming the id of their schema: the one in `schema_file`,
+	// registered under `subject`, or else the latest one registered under
+	// `subject`.
+	SchemaRegistry string `toml:"schema_registry"`
+
+	// Registry subject of the schema, usually "<topic>-value".
+	Subject string
+
+	// Milliseconds schema registry requests may take. Defaults to 5000.
+	RegistryTimeout uint32 `toml:"registry_timeout"`
+
+	// Message data written to the record's fields, keyed by field: either a
+	// message header name ("Uuid", "Timestamp", "Type", "Logger",
+	// "Severity", "Payload", "EnvVersion", "Pid", or "Hostname") or
+	// "Fields[name]" for a dynamic field. Nested fields are named after their
+	// path. Fields not in the map are written from the header they're named
+	// after, or else from the dynamic field of the same name.
+	FieldMap map[string]string `toml:"field_map"`
+
+	// Separator of the names of the fields of nested records and maps.
+	// Defaults to ".".
+	FlattenSeparator string `toml:"flatten_separator"`
+}
+
+// Serializes messages to Avro records, e.g. produced to Kafka topics.
+type AvroEncoder struct {
+	conf     *AvroEncoderConfig
+	text     string // The schema file's contents.
+	schema   *avroSchema
+	registry *schemaRegistry
+	id       int32 // The registry's id of the schema, once known.
+	pConfig  *pipeline.PipelineConfig
+}
+
+var messageHeaders = map[string]bool{
+	"Uuid":       true,
+	"Timestamp":  true,
+	"Type":       true,
+	"Logger":     true,
+	"Severity":   true,
+	"Payload":    true,
+	"EnvVersion": true,
+	"Pid":        true,
+	"Hostname":   true,
+}
+
+// Heka will call this before calling any other methods to give us access to
+// the pipeline configuration.
+func (ae *AvroEncoder) SetPipelineConfig(pConfig *pipeline.PipelineConfig) {
+	ae.pConfig = pConfig
+}
+
+func (ae *AvroEncoder) ConfigStruct() interface{} {
+	return &AvroEncoderConfig{
+		RegistryTimeout:  5000,
+		FlattenSeparator: ".",
+	}
+}
+
+func (ae *AvroEncoder) Init(config interface{}) (err error) {
+	conf := config.(*AvroEncoderConfig)
+	if conf.SchemaFile == "" && conf.SchemaRegistry == "" {
+		return fmt.Errorf("AvroEncoder requires `schema_file` or `schema_registry`")
+	}
+	for field, source := range conf.FieldMap {
+		if !messageHeaders[source] && !(strings.HasPrefix(source, "Fields[") &&
+			strings.HasSuffix(source, "]") && len(source) > len("Fields[]")) {
+			return fmt.Errorf("AvroEncoder invalid source '%s' of field '%s'", source, field)
+		}
+	}
+	if conf.SchemaFile != "" {
+		text, err := ioutil.ReadFile(ae.pConfig.Globals.PrependShareDir(conf.SchemaFile))
+		if err != nil {
+			return fmt.Errorf("AvroEncoder can't read schema: %s", err)
+		}
+		ae.text = string(text)
+		if err = ae.setSchema(ae.text); err != nil {
+			return err
+		}
+	}
+	if conf.SchemaRegistry != "" {
+		if conf.Subject == "" {
+			return fmt.Errorf("AvroEncoder requires a `subject` to use a schema registry")
+		}
+		timeout := time.Duration(conf.RegistryTimeout) * time.Millisecond
+		if ae.registry, err = newSchemaRegistry(conf.SchemaRegistry, timeout); err != nil {
+			return fmt.Errorf("AvroEncoder: %s", err)
+		}
+	}
+	ae.conf = conf
+	ae.id = -1
+	return
+}
+
+func (ae *AvroEncoder) setSchema(text string) (err error) {
+	if ae.schema, err = parseSchema(text); err != nil {
+		return fmt.Errorf("AvroEncoder: %s", err)
+	}
+	if ae.schema.typ != "record" {
+		return fmt.Errorf("AvroEncoder schema isn't a record")
+	}
+	return
+}
+
+// Looks up the registry's id of the schema the first time it's needed, and
+// after failures, so that the registry being down doesn't stop Heka from
+// starting.
+func (ae *AvroEncoder) schemaId() (id int32, err error) {
+	if ae.id != -1 {
+		return ae.id, nil
+	}
+	if ae.text != "" {
+		id, err = ae.registry.register(ae.conf.Subject, ae.text)
+	} else {
+		var text string
+		if id, text, err = ae.registry.latest(ae.conf.Subject); err == nil {
+			err = ae.setSchema(text)
+		}
+	}
+	if err != nil {
+		return
+	}
+	ae.id = id
+	return
+}
+
+func (ae *AvroEncoder) Encode(pack *pipeline.PipelinePack) (output []byte, err error) {
+	buf := new(bytes.Buffer)
+	if ae.registry != nil {
+		var id int32
+		if id, err = ae.schemaId(); err != nil {
+			return
+		}
+		writeWireHeader(buf, id)
+	}
+	record := ae.recordValues(pack.Message, ae.schema, "")
+	if err = encodeValue(buf, ae.schema, record); err != nil {
+		return nil, fmt.Errorf("can't encode message: %s", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// Returns the values of a record's fields, those without a value being
+// left out, so that they're written with their default.
+func (ae *AvroEncoder) recordValues(m *message.Message, schema *avroSchema,
+	prefix string) map[string]interface{} {
+
+	values := make(map[string]interface{}, len(schema.fields))
+	for _, field := range schema.fields {
+		path := prefix + field.name
+		value, ok := ae.value(m, field.schema, path)
+		if !ok {
+			if field.hasDefault || !nullable(field.schema) {
+				continue
+			}
+			// Optional fields without a default are null.
+			value = nil
+		}
+		values[field.name] = value
+	}
+	return values
+}
+
+// Returns the message data written to a field.
+func (ae *AvroEncoder) value(m *message.Message, schema *avroSchema,
+	path string) (value interface{}, ok bool) {
+
+	source, mapped := ae.conf.FieldMap[path]
+	if !mapped {
+		// Nested records and maps are written from the fields named after
+		// their path.
+		if nested := nonNull(schema); nested.typ == "record" {
+			prefix := path + ae.conf.FlattenSeparator
+			if !ae.hasPrefix(m, prefix) {
+				// Recursive records end where the data does.
+				return nil, false
+			}
+			return ae.recordValues(m, nested, prefix), true
+		} else if nested.typ == "map" {
+			return ae.mapValues(m, path+ae.conf.FlattenSeparator)
+		}
+		source = "Fields[" + path + "]"
+		if messageHeaders[path] {
+			source = path
+		}
+	}
+	if strings.HasPrefix(source, "Fields[") {
+		field := m.FindFirstField(source[len("Fields[") : len(source)-1])
+		if field == nil {
+			return nil, false
+		}
+		return fieldValues(field)
+	}
+	switch source {
+	case "Uuid":
+		return m.GetUuidString(), true
+	case "Timestamp":
+		return time.Unix(0, m.GetTimestamp()).UTC(), true
+	case "Type":
+		return m.GetType(), true
+	case "Logger":
+		return m.GetLogger(), true
+	case "Severity":
+		return int64(m.GetSeverity()), true
+	case "Payload":
+		return m.GetPayload(), true
+	case "EnvVersion":
+		return m.GetEnvVersion(), true
+	case "Pid":
+		return int64(m.GetPid()), true
+	case "Hostname":
+		return m.GetHostname(), true
+	}
+	return nil, false
+}
+
+// Whether a dynamic field, or a mapped record field, is named with the
+// prefix.
+func (ae *AvroEncoder) hasPrefix(m *message.Message, prefix string) bool {
+	for _, field := range m.Fields {
+		if strings.HasPrefix(field.GetName(), prefix) {
+			return true
+		}
+	}
+	for path := range ae.conf.FieldMap {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the values of the dynamic fields named with the prefix, keyed by
+// the rest of their name.
+func (ae *AvroEncoder) mapValues(m *message.Message, prefix string) (
+	values map[string]interface{}, ok bool) {
+
+	values = make(map[string]interface{})
+	for _, field := range m.Fields {
+		name := field.GetName()
+		if !strings.HasPrefix(name, prefix) || len(name) == len(prefix) {
+			continue
+		}
+		if _, seen := values[name[len(prefix):]]; seen {
+			continue
+		}
+		if value, ok := fieldValues(field); ok {
+			values[name[len(prefix):]] = value
+		}
+	}
+	return values, len(values) > 0
+}
+
+// Returns a field's value, or its values if it has several.
+func fieldValues(field *message.Field) (interface{}, bool) {
+	var values []interface{}
+	switch field.GetValueType() {
+	case message.Field_STRING:
+		for _, v := range field.ValueString {
+			values = append(values, v)
+		}
+	case message.Field_BYTES:
+		for _, v := range field.ValueBytes {
+			values = append(values, v)
+		}
+	case message.Field_INTEGER:
+		for _, v := range field.ValueInteger {
+			values = append(values, v)
+		}
+	case message.Field_DOUBLE:
+		for _, v := range field.ValueDouble {
+			values = append(values, v)
+		}
+	case message.Field_BOOL:
+		for _, v := range field.ValueBool {
+			values = append(values, v)
+		}
+	}
+	switch len(values) {
+	case 0:
+		return nil, false
+	case 1:
+		return values[0], true
+	}
+	return values, true
+}
+
+func nullable(schema *avroSchema) bool {
+	if schema.typ == "null" {
+		return true
+	}
+	for _, branch := range schema.branches {
+		if branch.typ == "null" {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the first branch of a union that isn't null, or the schema
+// itself if it isn't a union.
+func nonNull(schema *avroSchema) *avroSchema {
+	for _, branch := range schema.branches {
+		if branch.typ != "null" {
+			return branch
+		}
+	}
+	return schema
+}
+
+func init() {
+	pipeline.RegisterPlugin("AvroEncoder", func() interface{} {
+		return new(AvroEncoder)
+	})
+}
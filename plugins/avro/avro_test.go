@@ -0,0 +1,305 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package avro
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/mozilla-services/heka/message"
+	"github.com/mozilla-services/heka/pipeline"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+const testSchema = `{
+	"type": "record",
+	"name": "Request",
+	"namespace": "com.example",
+	"fields": [
+		{"name": "Timestamp", "type": {"type": "long", "logicalType": "timestamp-millis"}},
+		{"name": "Hostname", "type": "string"},
+		{"name": "level", "type": {"type": "enum", "name": "Level", "symbols": ["DEBUG", "INFO", "WARN"]}},
+		{"name": "status", "type": "int"},
+		{"name": "duration", "type": ["null", "double"], "default": null},
+		{"name": "tags", "type": {"type": "array", "items": "string"}, "default": []},
+		{"name": "http", "type": {"type": "record", "name": "Http", "fields": [
+			{"name": "method", "type": "string", "default": "GET"},
+			{"name": "path", "type": "string"}
+		]}},
+		{"name": "labels", "type": {"type": "map", "values": "string"}, "default": {}},
+		{"name": "id", "type": {"type": "fixed", "name": "Id", "size": 2}},
+		{"name": "parent", "type": ["null", "Request"]}
+	]
+}`
+
+func writeSchema(t *testing.T, dir, text string) string {
+	path := filepath.Join(dir, "schema.avsc")
+	if err := ioutil.WriteFile(path, []byte(text), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func newMessage() *message.Message {
+	pack := pipeline.NewPipelinePack(nil)
+	msg := pack.Message
+	msg.SetTimestamp(1420070400123000000)
+	msg.SetHostname("web1")
+	message.NewStringField(msg, "level", "WARN")
+	message.NewInt64Field(msg, "status", 504, "")
+	f, _ := message.NewField("tags", "a", "")
+	f.AddValue("b")
+	msg.AddField(f)
+	message.NewStringField(msg, "http.path", "/index.html")
+	message.NewStringField(msg, "labels.env", "prod")
+	f, _ = message.NewField("id", []byte("ab"), "")
+	msg.AddField(f)
+	return msg
+}
+
+func TestPrimitiveEncoding(t *testing.T) {
+	// The example of the Avro specification.
+	schema, err := parseSchema(`{"type": "record", "name": "test", "fields": [
+		{"name": "a", "type": "long"}, {"name": "b", "type": "string"}]}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := new(bytes.Buffer)
+	err = encodeValue(buf, schema, map[string]interface{}{"a": int64(27), "b": "foo"})
+	if err != nil || !bytes.Equal(buf.Bytes(), []byte{0x36, 0x06, 0x66, 0x6f, 0x6f}) {
+		t.Errorf("Unexpected encoding: %v, %x", err, buf.Bytes())
+	}
+	value, n, err := decodeValue(schema, buf.Bytes())
+	expected := &avroRecord{[]string{"a", "b"}, []interface{}{int64(27), "foo"}}
+	if err != nil || n != 5 || !reflect.DeepEqual(value, expected) {
+		t.Errorf("Unexpected value: %v, %#v", err, value)
+	}
+	if _, _, err = decodeValue(schema, buf.Bytes()[:4]); err == nil {
+		t.Error("Expected an error decoding truncated data")
+	}
+
+	for _, text := range []string{`"nope"`, `{"type": "record", "name": "r"}`,
+		`["int", "int"]`, `{"type": "enum", "name": "e", "symbols": []}`,
+		`{"type": "record", "name": "r", "fields": [{"name": "a", "type": "r2"}]}`} {
+
+		if _, err = parseSchema(text); err == nil {
+			t.Errorf("Expected an error parsing %s", text)
+		}
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "avro")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	pConfig := pipeline.NewPipelineConfig(nil)
+	path := writeSchema(t, dir, testSchema)
+
+	encoder := new(AvroEncoder)
+	encoder.SetPipelineConfig(pConfig)
+	econf := encoder.ConfigStruct().(*AvroEncoderConfig)
+	econf.SchemaFile = path
+	if err = encoder.Init(econf); err != nil {
+		t.Fatal(err)
+	}
+	pack := pipeline.NewPipelinePack(nil)
+	pack.Message = newMessage()
+	output, err := encoder.Encode(pack)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoder := new(AvroDecoder)
+	decoder.SetPipelineConfig(pConfig)
+	dconf := decoder.ConfigStruct().(*AvroDecoderConfig)
+	dconf.SchemaFile = path
+	dconf.HeaderFields = map[string]string{"Severity": "level", "Type": "http.method"}
+	dconf.SeverityMap = map[string]int32{"WARN": 4}
+	if err = decoder.Init(dconf); err != nil {
+		t.Fatal(err)
+	}
+	pack = pipeline.NewPipelinePack(nil)
+	pack.Message.SetPayload(string(output))
+	if _, err = decoder.Decode(pack); err != nil {
+		t.Fatal(err)
+	}
+	msg := pack.Message
+	if msg.GetTimestamp() != 1420070400123000000 || msg.GetHostname() != "web1" ||
+		msg.GetSeverity() != 4 || msg.GetType() != "GET" {
+
+		t.Errorf("Unexpected headers: %s", msg)
+	}
+	status, _ := msg.GetFieldValue("status")
+	path_, _ := msg.GetFieldValue("http.path")
+	env, _ := msg.GetFieldValue("labels.env")
+	id, _ := msg.GetFieldValue("id")
+	tags := msg.FindFirstField("tags")
+	if status != int64(504) || path_ != "/index.html" || env != "prod" ||
+		!bytes.Equal(id.([]byte), []byte("ab")) || tags == nil ||
+		!reflect.DeepEqual(tags.ValueString, []string{"a", "b"}) {
+
+		t.Errorf("Unexpected fields: %s", msg)
+	}
+	if msg.FindFirstField("duration") != nil || msg.FindFirstField("parent") != nil {
+		t.Errorf("Unexpected null fields: %s", msg)
+	}
+
+	// Trailing data isn't a valid record.
+	pack.Message.SetPayload(string(output) + "x")
+	if _, err = decoder.Decode(pack); err == nil {
+		t.Error("Expected an error decoding trailing data")
+	}
+	// Required fields need a value.
+	pack.Message = newMessage()
+	for i, field := range pack.Message.Fields {
+		if field.GetName() == "status" {
+			pack.Message.Fields = append(pack.Message.Fields[:i], pack.Message.Fields[i+1:]...)
+			break
+		}
+	}
+	if _, err = encoder.Encode(pack); err == nil ||
+		!strings.Contains(err.Error(), "field 'status'") {
+
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestSchemaRegistry(t *testing.T) {
+	var registrations int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter,
+		r *http.Request) {
+
+		switch {
+		case r.Method == "POST" && r.URL.Path == "/subjects/requests-value/versions":
+			var request map[string]string
+			if err := json.NewDecoder(r.Body).Decode(&request); err != nil ||
+				request["schema"] != testSchema {
+
+				t.Errorf("Unexpected registration: %v, %v", err, request)
+			}
+			atomic.AddInt32(&registrations, 1)
+			w.Write([]byte(`{"id": 7}`))
+		case r.Method == "GET" && r.URL.Path == "/schemas/ids/7":
+			response, _ := json.Marshal(map[string]string{"schema": testSchema})
+			w.Write(response)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error_code": 40403, "message": "Schema not found"}`))
+		}
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "avro")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	pConfig := pipeline.NewPipelineConfig(nil)
+
+	encoder := new(AvroEncoder)
+	encoder.SetPipelineConfig(pConfig)
+	econf := encoder.ConfigStruct().(*AvroEncoderConfig)
+	econf.SchemaFile = writeSchema(t, dir, testSchema)
+	econf.SchemaRegistry = server.URL
+	econf.Subject = "requests-value"
+	econf.FieldMap = map[string]string{"http.path": "Payload"}
+	if err = encoder.Init(econf); err != nil {
+		t.Fatal(err)
+	}
+	pack := pipeline.NewPipelinePack(nil)
+	pack.Message = newMessage()
+	pack.Message.SetPayload("/from/payload")
+	var output []byte
+	for i := 0; i < 2; i++ {
+		if output, err = encoder.Encode(pack); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if registrations != 1 || !bytes.Equal(output[:5], []byte{0, 0, 0, 0, 7}) {
+		t.Errorf("Unexpected output: %d registrations, %x", registrations, output[:5])
+	}
+
+	decoder := new(AvroDecoder)
+	decoder.SetPipelineConfig(pConfig)
+	dconf := decoder.ConfigStruct().(*AvroDecoderConfig)
+	dconf.SchemaRegistry = server.URL
+	if err = decoder.Init(dconf); err != nil {
+		t.Fatal(err)
+	}
+	pack = pipeline.NewPipelinePack(nil)
+	pack.Message.SetPayload(string(output))
+	if _, err = decoder.Decode(pack); err != nil {
+		t.Fatal(err)
+	}
+	path, _ := pack.Message.GetFieldValue("http.path")
+	if path != "/from/payload" || pack.Message.GetTimestamp() != 1420070400123000000 {
+		t.Errorf("Unexpected fields: %s", pack.Message)
+	}
+
+	// Unknown schema ids fail to decode.
+	output[4] = 8
+	pack.Message.SetPayload(string(output))
+	if _, err = decoder.Decode(pack); err == nil ||
+		!strings.Contains(err.Error(), "Schema not found") {
+
+		t.Errorf("Unexpected error: %v", err)
+	}
+	pack.Message.SetPayload("not wire format")
+	if _, err = decoder.Decode(pack); err == nil {
+		t.Error("Expected an error decoding a payload without the wire header")
+	}
+}
+
+func TestInvalidSettings(t *testing.T) {
+	pConfig := pipeline.NewPipelineConfig(nil)
+	decoder := new(AvroDecoder)
+	decoder.SetPipelineConfig(pConfig)
+	dconf := decoder.ConfigStruct().(*AvroDecoderConfig)
+	if err := decoder.Init(dconf); err == nil {
+		t.Error("Expected an error without a schema")
+	}
+	dconf.SchemaRegistry = "localhost:8081"
+	if err := decoder.Init(dconf); err == nil {
+		t.Error("Expected an error with an invalid registry URL")
+	}
+	dconf.SchemaRegistry = "http://localhost:8081"
+	dconf.HeaderFields = map[string]string{"Fields": "x"}
+	if err := decoder.Init(dconf); err == nil {
+		t.Error("Expected an error with an unknown header")
+	}
+
+	encoder := new(AvroEncoder)
+	encoder.SetPipelineConfig(pConfig)
+	econf := encoder.ConfigStruct().(*AvroEncoderConfig)
+	econf.SchemaRegistry = "http://localhost:8081"
+	if err := encoder.Init(econf); err == nil {
+		t.Error("Expected an error without a subject")
+	}
+	econf.Subject = "requests-value"
+	econf.FieldMap = map[string]string{"a": "Fields[]"}
+	if err := encoder.Init(econf); err == nil {
+		t.Error("Expected an error with an invalid field source")
+	}
+	econf.FieldMap = nil
+	if err := encoder.Init(econf); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,502 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package avro
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Values are decoded to, and encoded from, nil, bool, int64, float64,
+// string, []byte, time.Time (for the timestamp logical types),
+// []interface{} (for arrays), map[string]interface{} (for maps and
+// records), and *avroRecord (for decoded records, keeping their field
+// order).
+type avroRecord struct {
+	names  []string
+	values []interface{}
+}
+
+// Bounds the items of arrays and maps, so that a corrupt count doesn't
+// allocate unbounded memory.
+const maxBlockItems = 1 << 20
+
+var errTruncated = errors.New("truncated Avro data")
+
+type avroReader struct {
+	data []byte
+	pos  int
+}
+
+// Decodes a value of the schema from the start of data, returning the
+// number of bytes read.
+func decodeValue(schema *avroSchema, data []byte) (value interface{}, n int, err error) {
+	r := &avroReader{data: data}
+	value, err = r.read(schema)
+	return value, r.pos, err
+}
+
+func (r *avroReader) long() (int64, error) {
+	v, n := binary.Varint(r.data[r.pos:])
+	if n <= 0 {
+		return 0, errTruncated
+	}
+	r.pos += n
+	return v, nil
+}
+
+func (r *avroReader) next(n int64) ([]byte, error) {
+	if n < 0 || n > int64(len(r.data)-r.pos) {
+		return nil, errTruncated
+	}
+	b := r.data[r.pos : r.pos+int(n)]
+	r.pos += int(n)
+	return b, nil
+}
+
+// Reads the item count of the next array or map block, and skips the
+// block's size in bytes if it's given.
+func (r *avroReader) blockCount() (int64, error) {
+	count, err := r.long()
+	if err != nil {
+		return 0, err
+	}
+	if count < 0 {
+		count = -count
+		if _, err = r.long(); err != nil {
+			return 0, err
+		}
+	}
+	if count > maxBlockItems {
+		return 0, fmt.Errorf("Avro block of %d items is too large", count)
+	}
+	return count, nil
+}
+
+func (r *avroReader) read(schema *avroSchema) (value interface{}, err error) {
+	switch schema.typ {
+	case "null":
+		return nil, nil
+	case "boolean":
+		var b []byte
+		if b, err = r.next(1); err != nil {
+			return
+		}
+		return b[0] != 0, nil
+	case "int", "long":
+		var v int64
+		if v, err = r.long(); err != nil {
+			return
+		}
+		switch schema.logicalType {
+		case "timestamp-millis":
+			return time.Unix(0, v*int64(time.Millisecond)).UTC(), nil
+		case "timestamp-micros":
+			return time.Unix(0, v*int64(time.Microsecond)).UTC(), nil
+		}
+		return v, nil
+	case "float":
+		var b []byte
+		if b, err = r.next(4); err != nil {
+			return
+		}
+		return float64(math.Float32frombits(binary.LittleEndian.Uint32(b))), nil
+	case "double":
+		var b []byte
+		if b, err = r.next(8); err != nil {
+			return
+		}
+		return math.Float64frombits(binary.LittleEndian.Uint64(b)), nil
+	case "bytes", "string":
+		var n int64
+		if n, err = r.long(); err != nil {
+			return
+		}
+		var b []byte
+		if b, err = r.next(n); err != nil {
+			return
+		}
+		if schema.typ == "string" {
+			return string(b), nil
+		}
+		return append([]byte(nil), b...), nil
+	case "fixed":
+		var b []byte
+		if b, err = r.next(int64(schema.size)); err != nil {
+			return
+		}
+		return append([]byte(nil), b...), nil
+	case "enum":
+		var i int64
+		if i, err = r.long(); err != nil {
+			return
+		}
+		if i < 0 || i >= int64(len(schema.symbols)) {
+			return nil, fmt.Errorf("invalid index %d of enum '%s'", i, schema.name)
+		}
+		return schema.symbols[i], nil
+	case "union":
+		var i int64
+		if i, err = r.long(); err != nil {
+			return
+		}
+		if i < 0 || i >= int64(len(schema.branches)) {
+			return nil, fmt.Errorf("invalid union branch %d", i)
+		}
+		return r.read(schema.branches[i])
+	case "record":
+		record := &avroRecord{
+			names:  make([]string, len(schema.fields)),
+			values: make([]interface{}, len(schema.fields)),
+		}
+		for i, field := range schema.fields {
+			record.names[i] = field.name
+			if record.values[i], err = r.read(field.schema); err != nil {
+				return
+			}
+		}
+		return record, nil
+	case "array":
+		items := []interface{}{}
+		for {
+			var count int64
+			if count, err = r.blockCount(); err != nil || count == 0 {
+				return items, err
+			}
+			for ; count > 0; count-- {
+				var item interface{}
+				if item, err = r.read(schema.items); err != nil {
+					return
+				}
+				items = append(items, item)
+			}
+			if len(items) > maxBlockItems {
+				return nil, fmt.Errorf("Avro array of %d items is too large", len(items))
+			}
+		}
+	case "map":
+		values := make(map[string]interface{})
+		for {
+			var count int64
+			if count, err = r.blockCount(); err != nil || count == 0 {
+				return values, err
+			}
+			for ; count > 0; count-- {
+				var key, item interface{}
+				if key, err = r.read(&avroSchema{typ: "string"}); err != nil {
+					return
+				}
+				if item, err = r.read(schema.items); err != nil {
+					return
+				}
+				values[key.(string)] = item
+			}
+			if len(values) > maxBlockItems {
+				return nil, fmt.Errorf("Avro map of %d items is too large", len(values))
+			}
+		}
+	}
+	return nil, fmt.Errorf("unknown type '%s'", schema.typ)
+}
+
+// Appends the encoding of a value of the schema to buf. Integers and floats
+// are converted to each other, and scalars to strings, if the schema
+// requires it.
+func encodeValue(buf *bytes.Buffer, schema *avroSchema, value interface{}) error {
+	if schema.typ == "union" {
+		i := unionBranch(schema, value)
+		if i == -1 {
+			return fmt.Errorf("no union branch for %v", value)
+		}
+		writeLong(buf, int64(i))
+		return encodeValue(buf, schema.branches[i], value)
+	}
+
+	v, ok := coerce(schema, value, false)
+	if !ok {
+		return fmt.Errorf("can't encode %v as %s", value, schemaName(schema))
+	}
+	switch schema.typ {
+	case "null":
+	case "boolean":
+		if v.(bool) {
+			buf.WriteByte(1)
+		} else {
+			buf.WriteByte(0)
+		}
+	case "int", "long":
+		writeLong(buf, v.(int64))
+	case "float":
+		var b [4]byte
+		binary.LittleEndian.PutUint32(b[:], math.Float32bits(float32(v.(float64))))
+		buf.Write(b[:])
+	case "double":
+		var b [8]byte
+		binary.LittleEndian.PutUint64(b[:], math.Float64bits(v.(float64)))
+		buf.Write(b[:])
+	case "string":
+		writeLong(buf, int64(len(v.(string))))
+		buf.WriteString(v.(string))
+	case "bytes":
+		writeLong(buf, int64(len(v.([]byte))))
+		buf.Write(v.([]byte))
+	case "fixed":
+		buf.Write(v.([]byte))
+	case "enum":
+		writeLong(buf, v.(int64))
+	case "array":
+		items := v.([]interface{})
+		if len(items) > 0 {
+			writeLong(buf, int64(len(items)))
+			for _, item := range items {
+				if err := encodeValue(buf, schema.items, item); err != nil {
+					return err
+				}
+			}
+		}
+		writeLong(buf, 0)
+	case "map":
+		values := v.(map[string]interface{})
+		if len(values) > 0 {
+			writeLong(buf, int64(len(values)))
+			for _, key := range sortedKeys(values) {
+				writeLong(buf, int64(len(key)))
+				buf.WriteString(key)
+				if err := encodeValue(buf, schema.items, values[key]); err != nil {
+					return fmt.Errorf("map key '%s': %s", key, err)
+				}
+			}
+		}
+		writeLong(buf, 0)
+	case "record":
+		values := v.(map[string]interface{})
+		for _, field := range schema.fields {
+			value, ok := values[field.name]
+			if !ok {
+				if !field.hasDefault {
+					return fmt.Errorf("missing value of field '%s'", field.name)
+				}
+				var err error
+				if value, err = defaultValue(field.schema, field.def); err != nil {
+					return fmt.Errorf("default of field '%s': %s", field.name, err)
+				}
+			}
+			if err := encodeValue(buf, field.schema, value); err != nil {
+				return fmt.Errorf("field '%s': %s", field.name, err)
+			}
+		}
+	}
+	return nil
+}
+
+func writeLong(buf *bytes.Buffer, v int64) {
+	var b [binary.MaxVarintLen64]byte
+	buf.Write(b[:binary.PutVarint(b[:], v)])
+}
+
+// Returns the index of the union branch a value is encoded with: the first
+// branch of the value's own type, or else the first it can be converted to.
+func unionBranch(schema *avroSchema, value interface{}) int {
+	for _, lenient := range []bool{false, true} {
+		for i, branch := range schema.branches {
+			if _, ok := coerce(branch, value, !lenient); ok {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// Converts a value to the Go type a schema is encoded from: int64 for ints,
+// longs, and enum indexes, float64 for floats and doubles, and
+// map[string]interface{} for records. If strict is true only values of the
+// schema's own type are accepted.
+func coerce(schema *avroSchema, value interface{}, strict bool) (interface{}, bool) {
+	switch schema.typ {
+	case "null":
+		return nil, value == nil
+	case "boolean":
+		if b, ok := value.(bool); ok {
+			return b, true
+		}
+		if s, ok := value.(string); ok && !strict {
+			b, err := strconv.ParseBool(s)
+			return b, err == nil
+		}
+	case "int", "long":
+		switch v := value.(type) {
+		case int64:
+			return v, true
+		case int:
+			return int64(v), true
+		case int32:
+			return int64(v), true
+		case time.Time:
+			switch schema.logicalType {
+			case "timestamp-millis":
+				return v.UnixNano() / int64(time.Millisecond), true
+			case "timestamp-micros":
+				return v.UnixNano() / int64(time.Microsecond), true
+			}
+			return v.UnixNano(), !strict
+		case float64:
+			if !strict && v == math.Trunc(v) {
+				return int64(v), true
+			}
+		case string:
+			if !strict {
+				i, err := strconv.ParseInt(v, 10, 64)
+				return i, err == nil
+			}
+		}
+	case "float", "double":
+		switch v := value.(type) {
+		case float64:
+			return v, true
+		case float32:
+			return float64(v), true
+		case int64:
+			return float64(v), !strict
+		case int:
+			return float64(v), !strict
+		case string:
+			if !strict {
+				f, err := strconv.ParseFloat(v, 64)
+				return f, err == nil
+			}
+		}
+	case "string":
+		switch v := value.(type) {
+		case string:
+			return v, true
+		case time.Time:
+			return v.Format(time.RFC3339Nano), !strict
+		case []byte:
+			return string(v), !strict
+		case bool, int64, int, float64:
+			return fmt.Sprint(v), !strict
+		}
+	case "bytes":
+		switch v := value.(type) {
+		case []byte:
+			return v, true
+		case string:
+			return []byte(v), !strict
+		}
+	case "fixed":
+		if b, ok := value.([]byte); ok && len(b) == schema.size {
+			return b, true
+		}
+	case "enum":
+		if s, ok := value.(string); ok {
+			for i, symbol := range schema.symbols {
+				if s == symbol {
+					return int64(i), true
+				}
+			}
+		}
+	case "array":
+		if items, ok := value.([]interface{}); ok {
+			return items, true
+		}
+		if !strict && value != nil {
+			// A single value is an array of one item.
+			return []interface{}{value}, true
+		}
+	case "map", "record":
+		if values, ok := value.(map[string]interface{}); ok {
+			return values, true
+		}
+	}
+	return nil, false
+}
+
+// Converts a field's default value, decoded from JSON, to the value it's
+// encoded from. Defaults of unions are of their first branch.
+func defaultValue(schema *avroSchema, def interface{}) (interface{}, error) {
+	if schema.typ == "union" {
+		return defaultValue(schema.branches[0], def)
+	}
+	switch d := def.(type) {
+	case json.Number:
+		if schema.typ == "int" || schema.typ == "long" {
+			return d.Int64()
+		}
+		return d.Float64()
+	case string:
+		if schema.typ == "bytes" || schema.typ == "fixed" {
+			// JSON strings hold bytes as the code points 0-255.
+			b := make([]byte, 0, len(d))
+			for _, r := range d {
+				if r > 255 {
+					return nil, fmt.Errorf("invalid bytes default '%s'", d)
+				}
+				b = append(b, byte(r))
+			}
+			return b, nil
+		}
+	case []interface{}:
+		if schema.typ == "array" {
+			items := make([]interface{}, len(d))
+			for i, item := range d {
+				var err error
+				if items[i], err = defaultValue(schema.items, item); err != nil {
+					return nil, err
+				}
+			}
+			return items, nil
+		}
+	case map[string]interface{}:
+		values := make(map[string]interface{}, len(d))
+		for key, value := range d {
+			var err error
+			switch schema.typ {
+			case "map":
+				values[key], err = defaultValue(schema.items, value)
+			case "record":
+				for _, field := range schema.fields {
+					if field.name == key {
+						values[key], err = defaultValue(field.schema, value)
+					}
+				}
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+		return values, nil
+	}
+	return def, nil
+}
+
+func schemaName(schema *avroSchema) string {
+	if schema.name != "" {
+		return schema.name
+	}
+	return schema.typ
+}
+
+func sortedKeys(values map[string]interface{}) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
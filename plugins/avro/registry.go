@@ -0,0 +1,157 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package avro
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Payloads in the schema registry wire format start with a zero magic byte
+// and the big endian id of the schema they're written with.
+const (
+	wireMagic      = 0
+	wireHeaderSize = 5
+)
+
+const registryContentType = "application/vnd.schemaregistry.v1+json"
+
+// Client of a Confluent style schema registry, caching the schemas it
+// fetches, which the registry never changes once assigned an id.
+type schemaRegistry struct {
+	url     string
+	client  *http.Client
+	lock    sync.Mutex
+	schemas map[int32]*avroSchema
+}
+
+func newSchemaRegistry(address string, timeout time.Duration) (*schemaRegistry, error) {
+	u, err := url.Parse(address)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid schema registry URL: '%s'", address)
+	}
+	return &schemaRegistry{
+		url:     strings.TrimRight(address, "/"),
+		client:  &http.Client{Timeout: timeout},
+		schemas: make(map[int32]*avroSchema),
+	}, nil
+}
+
+// Returns the schema with the given id.
+func (sr *schemaRegistry) schema(id int32) (*avroSchema, error) {
+	sr.lock.Lock()
+	defer sr.lock.Unlock()
+	if schema, ok := sr.schemas[id]; ok {
+		return schema, nil
+	}
+	var response struct {
+		Schema string `json:"schema"`
+	}
+	if err := sr.request("GET", fmt.Sprintf("/schemas/ids/%d", id), nil, &response); err != nil {
+		return nil, fmt.Errorf("can't fetch schema %d: %s", id, err)
+	}
+	schema, err := parseSchema(response.Schema)
+	if err != nil {
+		return nil, fmt.Errorf("schema %d: %s", id, err)
+	}
+	sr.schemas[id] = schema
+	return schema, nil
+}
+
+// Registers a schema under a subject, or looks up its id if it's already
+// registered, and returns its id.
+func (sr *schemaRegistry) register(subject, text string) (id int32, err error) {
+	request, _ := json.Marshal(map[string]string{"schema": text})
+	var response struct {
+		Id int32 `json:"id"`
+	}
+	path := fmt.Sprintf("/subjects/%s/versions", url.PathEscape(subject))
+	if err = sr.request("POST", path, request, &response); err != nil {
+		return 0, fmt.Errorf("can't register schema under '%s': %s", subject, err)
+	}
+	return response.Id, nil
+}
+
+// Returns the id and text of the latest schema registered under a subject.
+func (sr *schemaRegistry) latest(subject string) (id int32, text string, err error) {
+	var response struct {
+		Id     int32  `json:"id"`
+		Schema string `json:"schema"`
+	}
+	path := fmt.Sprintf("/subjects/%s/versions/latest", url.PathEscape(subject))
+	if err = sr.request("GET", path, nil, &response); err != nil {
+		return 0, "", fmt.Errorf("can't fetch the latest schema of '%s': %s", subject, err)
+	}
+	return response.Id, response.Schema, nil
+}
+
+func (sr *schemaRegistry) request(method, path string, body []byte,
+	response interface{}) error {
+
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, sr.url+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", registryContentType)
+	if body != nil {
+		req.Header.Set("Content-Type", registryContentType)
+	}
+	resp, err := sr.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		// Errors are {"error_code": 40403, "message": "Schema not found"}.
+		var registryErr struct {
+			Message string `json:"message"`
+		}
+		if json.Unmarshal(data, &registryErr) == nil && registryErr.Message != "" {
+			return fmt.Errorf("%s: %s", resp.Status, registryErr.Message)
+		}
+		return fmt.Errorf("%s", resp.Status)
+	}
+	return json.Unmarshal(data, response)
+}
+
+// Splits a payload in the wire format into its schema id and Avro data.
+func splitWireFormat(data []byte) (id int32, body []byte, err error) {
+	if len(data) < wireHeaderSize || data[0] != wireMagic {
+		return 0, nil, fmt.Errorf("payload isn't in the schema registry wire format")
+	}
+	return int32(binary.BigEndian.Uint32(data[1:wireHeaderSize])), data[wireHeaderSize:], nil
+}
+
+// Appends the wire format header of a schema id to buf.
+func writeWireHeader(buf *bytes.Buffer, id int32) {
+	var header [wireHeaderSize]byte
+	header[0] = wireMagic
+	binary.BigEndian.PutUint32(header[1:], uint32(id))
+	buf.Write(header[:])
+}
@@ -0,0 +1,219 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package avro
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// A parsed Avro schema, as specified by
+// https://avro.apache.org/docs/1.8.2/spec.html. Named types referenced
+// after their definition share the same *avroSchema, so recursive records
+// are cycles.
+type avroSchema struct {
+	typ         string // Primitive type name, or "record", "enum", etc.
+	name        string // Full name of records, enums, and fixed.
+	logicalType string
+	fields      []avroField   // Of records.
+	symbols     []string      // Of enums.
+	items       *avroSchema   // Of arrays, and values of maps.
+	branches    []*avroSchema // Of unions.
+	size        int           // Of fixed.
+}
+
+type avroField struct {
+	name       string
+	schema     *avroSchema
+	def        interface{} // Default value, decoded from JSON.
+	hasDefault bool
+}
+
+var avroPrimitives = map[string]bool{
+	"null":    true,
+	"boolean": true,
+	"int":     true,
+	"long":    true,
+	"float":   true,
+	"double":  true,
+	"bytes":   true,
+	"string":  true,
+}
+
+// Parses a schema's JSON text.
+func parseSchema(text string) (*avroSchema, error) {
+	var doc interface{}
+	decoder := json.NewDecoder(strings.NewReader(text))
+	decoder.UseNumber()
+	if err := decoder.Decode(&doc); err != nil {
+		return nil, fmt.Errorf("invalid Avro schema: %s", err)
+	}
+	p := &schemaParser{named: make(map[string]*avroSchema)}
+	schema, err := p.parse(doc, "")
+	if err != nil {
+		return nil, fmt.Errorf("invalid Avro schema: %s", err)
+	}
+	return schema, nil
+}
+
+type schemaParser struct {
+	named map[string]*avroSchema
+}
+
+// Parses a schema, names without a namespace being in the enclosing one.
+func (p *schemaParser) parse(doc interface{}, namespace string) (*avroSchema, error) {
+	switch d := doc.(type) {
+	case string:
+		if avroPrimitives[d] {
+			return &avroSchema{typ: d}, nil
+		}
+		if schema, ok := p.named[fullName(d, namespace)]; ok {
+			return schema, nil
+		}
+		if schema, ok := p.named[d]; ok {
+			return schema, nil
+		}
+		return nil, fmt.Errorf("unknown type '%s'", d)
+	case []interface{}:
+		schema := &avroSchema{typ: "union"}
+		seen := make(map[string]bool)
+		for _, b := range d {
+			branch, err := p.parse(b, namespace)
+			if err != nil {
+				return nil, err
+			}
+			key := branch.typ
+			if branch.name != "" {
+				key = branch.name
+			}
+			if branch.typ == "union" || seen[key] {
+				return nil, fmt.Errorf("invalid union branch '%s'", key)
+			}
+			seen[key] = true
+			schema.branches = append(schema.branches, branch)
+		}
+		return schema, nil
+	case map[string]interface{}:
+		return p.parseComplex(d, namespace)
+	}
+	return nil, fmt.Errorf("invalid schema: %v", doc)
+}
+
+func (p *schemaParser) parseComplex(doc map[string]interface{},
+	namespace string) (schema *avroSchema, err error) {
+
+	typ, _ := doc["type"].(string)
+	if typ == "" {
+		// A type nested in an object, i.e. {"type": {"type": "array", ...}}.
+		if _, ok := doc["type"]; ok {
+			return p.parse(doc["type"], namespace)
+		}
+		return nil, fmt.Errorf("missing type")
+	}
+	logicalType, _ := doc["logicalType"].(string)
+	if avroPrimitives[typ] {
+		return &avroSchema{typ: typ, logicalType: logicalType}, nil
+	}
+
+	schema = &avroSchema{typ: typ, logicalType: logicalType}
+	switch typ {
+	case "record", "error", "enum", "fixed":
+		if err = p.define(schema, doc, namespace); err != nil {
+			return
+		}
+	}
+	switch typ {
+	case "record", "error":
+		schema.typ = "record"
+		fields, _ := doc["fields"].([]interface{})
+		if fields == nil {
+			return nil, fmt.Errorf("record '%s' has no fields", schema.name)
+		}
+		// Types named in the fields are in the record's namespace.
+		ns := namespace
+		if i := strings.LastIndex(schema.name, "."); i != -1 {
+			ns = schema.name[:i]
+		}
+		for _, f := range fields {
+			fdoc, ok := f.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("invalid field in record '%s'", schema.name)
+			}
+			field := avroField{}
+			if field.name, _ = fdoc["name"].(string); field.name == "" {
+				return nil, fmt.Errorf("unnamed field in record '%s'", schema.name)
+			}
+			if field.schema, err = p.parse(fdoc["type"], ns); err != nil {
+				return nil, fmt.Errorf("field '%s': %s", field.name, err)
+			}
+			field.def, field.hasDefault = fdoc["default"]
+			schema.fields = append(schema.fields, field)
+		}
+	case "enum":
+		symbols, _ := doc["symbols"].([]interface{})
+		for _, s := range symbols {
+			symbol, ok := s.(string)
+			if !ok {
+				return nil, fmt.Errorf("invalid symbol in enum '%s'", schema.name)
+			}
+			schema.symbols = append(schema.symbols, symbol)
+		}
+		if len(schema.symbols) == 0 {
+			return nil, fmt.Errorf("enum '%s' has no symbols", schema.name)
+		}
+	case "fixed":
+		size, _ := doc["size"].(json.Number)
+		n, e := size.Int64()
+		if e != nil || n < 0 {
+			return nil, fmt.Errorf("invalid size of fixed '%s'", schema.name)
+		}
+		schema.size = int(n)
+	case "array", "map":
+		key := "items"
+		if typ == "map" {
+			key = "values"
+		}
+		if schema.items, err = p.parse(doc[key], namespace); err != nil {
+			return nil, fmt.Errorf("%s %s: %s", typ, key, err)
+		}
+	default:
+		return nil, fmt.Errorf("unknown type '%s'", typ)
+	}
+	return
+}
+
+// Registers a named type, so later references resolve to it.
+func (p *schemaParser) define(schema *avroSchema, doc map[string]interface{},
+	namespace string) error {
+
+	name, _ := doc["name"].(string)
+	if name == "" {
+		return fmt.Errorf("%s without a name", schema.typ)
+	}
+	if ns, ok := doc["namespace"].(string); ok && !strings.Contains(name, ".") {
+		namespace = ns
+	}
+	schema.name = fullName(name, namespace)
+	if _, ok := p.named[schema.name]; ok || avroPrimitives[name] {
+		return fmt.Errorf("type '%s' is defined twice", schema.name)
+	}
+	p.named[schema.name] = schema
+	return nil
+}
+
+func fullName(name, namespace string) string {
+	if namespace == "" || strings.Contains(name, ".") {
+		return name
+	}
+	return namespace + "." + name
+}
@@ -0,0 +1,238 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package aws
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignatureV4(t *testing.T) {
+	// The example from the AWS General Reference.
+	req, _ := http.NewRequest("GET",
+		"https://iam.amazonaws.com/?Action=ListUsers&Version=2010-05-08", nil)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	signer := &Signer{
+		Service: "iam",
+		Region:  "us-east-1",
+		Creds: NewCredentialsProvider("AKIDEXAMPLE",
+			"wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY", ""),
+	}
+	ts := time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC)
+	if err := signer.Sign(req, nil, ts); err != nil {
+		t.Fatal(err)
+	}
+	expected := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/iam/" +
+		"aws4_request, SignedHeaders=content-type;host;x-amz-date, " +
+		"Signature=5d672d79c15b13162d9279b0855cfba6789a8edb4c82c400e06b5924a6f2b5d7"
+	if auth := req.Header.Get("Authorization"); auth != expected {
+		t.Errorf("Expected: %s, received: %s", expected, auth)
+	}
+	if date := req.Header.Get("X-Amz-Date"); date != "20150830T123600Z" {
+		t.Errorf("Unexpected X-Amz-Date: %s", date)
+	}
+}
+
+func TestURIEncode(t *testing.T) {
+	if s := uriEncode("/a b/c~d", false); s != "/a%20b/c~d" {
+		t.Errorf("Unexpected encoding: %s", s)
+	}
+	if s := uriEncode("a/b+c=", true); s != "a%2Fb%2Bc%3D" {
+		t.Errorf("Unexpected encoding: %s", s)
+	}
+}
+
+func TestCall(t *testing.T) {
+	var target, auth string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter,
+		r *http.Request) {
+
+		target = r.Header.Get("X-Amz-Target")
+		auth = r.Header.Get("Authorization")
+		if strings.HasSuffix(target, ".Fail") {
+			w.WriteHeader(400)
+			fmt.Fprint(w, `{"__type":"com.amazonaws.dynamodb.v20120810#`+
+				`ProvisionedThroughputExceededException","message":"slow down"}`)
+			return
+		}
+		fmt.Fprint(w, `{"Value":"ok"}`)
+	}))
+	defer server.Close()
+
+	client, err := NewClient("dynamodb", "us-west-2", server.URL, "DynamoDB_20120810",
+		"application/x-amz-json-1.0", NewCredentialsProvider("id", "secret", "token"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out struct{ Value string }
+	if err = client.Call("Succeed", map[string]string{"a": "b"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if out.Value != "ok" || target != "DynamoDB_20120810.Succeed" {
+		t.Errorf("Unexpected response %q to target %s", out.Value, target)
+	}
+	if !strings.Contains(auth, "/us-west-2/dynamodb/aws4_request") ||
+		!strings.Contains(auth, "x-amz-security-token") {
+
+		t.Errorf("Unexpected Authorization header: %s", auth)
+	}
+
+	err = client.Call("Fail", nil, nil)
+	awsErr, ok := err.(*Error)
+	if !ok {
+		t.Fatalf("Expected an *Error, received: %v", err)
+	}
+	if awsErr.Code != "ProvisionedThroughputExceededException" ||
+		awsErr.Message != "slow down" || !awsErr.Throttled() || !awsErr.Retryable() {
+
+		t.Errorf("Unexpected error: %#v", awsErr)
+	}
+}
+
+func TestS3Client(t *testing.T) {
+	var uri, sha string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter,
+		r *http.Request) {
+
+		uri = r.RequestURI
+		sha = r.Header.Get("X-Amz-Content-Sha256")
+		if r.Method == "DELETE" {
+			w.WriteHeader(404)
+			fmt.Fprint(w, `<?xml version="1.0" encoding="UTF-8"?>
+<Error><Code>NoSuchKey</Code><Message>The specified key does not exist.</Message></Error>`)
+			return
+		}
+		fmt.Fprint(w, "contents")
+	}))
+	defer server.Close()
+
+	client, err := NewS3Client("us-west-2", server.URL,
+		NewCredentialsProvider("id", "secret", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := client.GetObject("bucket", "logs/a b+c.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "contents" {
+		t.Errorf("Unexpected contents: %s", body)
+	}
+	if !strings.HasSuffix(uri, "/bucket/logs/a%20b%2Bc.json") {
+		t.Errorf("Unexpected request URI: %s", uri)
+	}
+	if sha != hexHash(nil) {
+		t.Errorf("Unexpected X-Amz-Content-Sha256: %s", sha)
+	}
+
+	err = client.DeleteObject("bucket", "missing")
+	if awsErr, ok := err.(*Error); !ok || awsErr.Code != "NoSuchKey" ||
+		awsErr.StatusCode != 404 {
+
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestS3ListObjects(t *testing.T) {
+	var queries []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter,
+		r *http.Request) {
+
+		queries = append(queries, r.URL.RawQuery)
+		if r.URL.Query().Get("continuation-token") == "" {
+			fmt.Fprint(w, `<?xml version="1.0" encoding="UTF-8"?>
+<ListBucketResult><IsTruncated>true</IsTruncated>
+<Contents><Key>logs/a.gz</Key><ETag>"e1"</ETag><Size>10</Size>
+<LastModified>2015-03-01T10:00:00.000Z</LastModified></Contents>
+<NextContinuationToken>page 2</NextContinuationToken></ListBucketResult>`)
+			return
+		}
+		fmt.Fprint(w, `<?xml version="1.0" encoding="UTF-8"?>
+<ListBucketResult><IsTruncated>false</IsTruncated>
+<Contents><Key>logs/b.gz</Key><ETag>"e2"</ETag><Size>20</Size></Contents>
+</ListBucketResult>`)
+	}))
+	defer server.Close()
+
+	client, err := NewS3Client("us-west-2", server.URL,
+		NewCredentialsProvider("id", "secret", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	objects, next, err := client.ListObjects("bucket", "logs/", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != 1 || objects[0].Key != "logs/a.gz" || objects[0].Size != 10 ||
+		objects[0].LastModified.Hour() != 10 || next != "page 2" {
+
+		t.Fatalf("Unexpected first page: %+v, %q", objects, next)
+	}
+	objects, next, err = client.ListObjects("bucket", "logs/", next)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != 1 || objects[0].ETag != `"e2"` || next != "" {
+		t.Fatalf("Unexpected second page: %+v, %q", objects, next)
+	}
+	if queries[1] != "continuation-token=page%202&list-type=2&prefix=logs%2F" {
+		t.Errorf("Unexpected query: %s", queries[1])
+	}
+}
+
+func TestInstanceCredentials(t *testing.T) {
+	fetches := 0
+	expiration := time.Date(2015, 1, 1, 12, 0, 0, 0, time.UTC)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter,
+		r *http.Request) {
+
+		switch r.URL.Path {
+		case "/creds/":
+			fmt.Fprint(w, "heka-role")
+		case "/creds/heka-role":
+			fetches++
+			fmt.Fprintf(w, `{"Code":"Success","AccessKeyId":"AKID%d",`+
+				`"SecretAccessKey":"secret","Token":"token","Expiration":"%s"}`,
+				fetches, expiration.Format(time.RFC3339))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	now := expiration.Add(-time.Hour)
+	provider := &instanceCredentials{
+		metadataURL: server.URL + "/creds/",
+		client:      http.DefaultClient,
+		now:         func() time.Time { return now },
+	}
+	creds, err := provider.Credentials()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if creds.AccessKeyID != "AKID1" || creds.SessionToken != "token" {
+		t.Errorf("Unexpected credentials: %#v", creds)
+	}
+	provider.Credentials()
+	if fetches != 1 {
+		t.Errorf("Credentials fetched %d times, expected once", fetches)
+	}
+	// Refreshed shortly before they expire.
+	now = expiration.Add(-time.Minute)
+	if creds, _ = provider.Credentials(); creds.AccessKeyID != "AKID2" {
+		t.Errorf("Credentials weren't refreshed: %#v", creds)
+	}
+}
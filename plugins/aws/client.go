@@ -0,0 +1,157 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+// Package aws holds what the AWS plugins share: credentials, request signing,
+// a client for the JSON APIs of services such as Kinesis and DynamoDB, and an
+// S3 client. Only the few API calls the plugins need are implemented, rather
+// than pulling in a full SDK.
+package aws
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Largest response body read, error responses and the results of the calls
+// the plugins make being much smaller.
+const maxResponseSize = 64 << 20
+
+// Client of a service's JSON API, e.g. Kinesis or DynamoDB.
+type Client struct {
+	// Base URL of the API, defaulting to the service's regional endpoint.
+	Endpoint string
+	// Prefix of the X-Amz-Target header, e.g. "Kinesis_20131202".
+	TargetPrefix string
+	// Content type of the API, e.g. "application/x-amz-json-1.1".
+	ContentType string
+	Signer      *Signer
+	HTTP        *http.Client
+}
+
+// Creates a client of the specified service in the specified region. The
+// endpoint may be overridden, e.g. to use a local test server.
+func NewClient(service, region, endpoint, targetPrefix, contentType string,
+	creds CredentialsProvider) (*Client, error) {
+
+	if region == "" {
+		return nil, fmt.Errorf("no region specified for %s", service)
+	}
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://%s.%s.amazonaws.com", service, region)
+	}
+	return &Client{
+		Endpoint:     strings.TrimRight(endpoint, "/"),
+		TargetPrefix: targetPrefix,
+		ContentType:  contentType,
+		Signer:       &Signer{Service: service, Region: region, Creds: creds},
+		HTTP:         &http.Client{Timeout: time.Minute},
+	}, nil
+}
+
+// An error response from an AWS API.
+type Error struct {
+	StatusCode int
+	// The error code, e.g. "ProvisionedThroughputExceededException".
+	Code    string
+	Message string
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("%s (HTTP %d)", e.Code, e.StatusCode)
+	}
+	return fmt.Sprintf("%s: %s (HTTP %d)", e.Code, e.Message, e.StatusCode)
+}
+
+// Whether the request was rejected for exceeding a rate or throughput limit.
+func (e *Error) Throttled() bool {
+	switch e.Code {
+	case "ProvisionedThroughputExceededException", "ThrottlingException",
+		"Throttling", "RequestLimitExceeded", "SlowDown", "LimitExceededException":
+		return true
+	}
+	return e.StatusCode == 429
+}
+
+// Whether the request may succeed if retried.
+func (e *Error) Retryable() bool {
+	return e.Throttled() || e.StatusCode >= 500
+}
+
+// Calls an API action, encoding `in` as the JSON request body and decoding
+// the response into `out`, which may be nil. API errors are returned as
+// *Error.
+func (c *Client) Call(action string, in, out interface{}) error {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", c.Endpoint+"/", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", c.ContentType)
+	req.Header.Set("X-Amz-Target", c.TargetPrefix+"."+action)
+	if err = c.Signer.Sign(req, body, time.Now()); err != nil {
+		return err
+	}
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respBody, err := readBody(resp)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return parseError(resp.StatusCode, respBody)
+	}
+	if out == nil {
+		return nil
+	}
+	if err = json.Unmarshal(respBody, out); err != nil {
+		return fmt.Errorf("can't parse %s response: %s", action, err)
+	}
+	return nil
+}
+
+func readBody(resp *http.Response) ([]byte, error) {
+	return ioutil.ReadAll(&io.LimitedReader{R: resp.Body, N: maxResponseSize})
+}
+
+// Parses a JSON API error response, the code being in the `__type` field,
+// possibly prefixed with a namespace, e.g.
+// "com.amazonaws.dynamodb.v20120810#ResourceNotFoundException".
+func parseError(status int, body []byte) *Error {
+	var resp struct {
+		Type         string `json:"__type"`
+		Message      string `json:"message"`
+		MessageUpper string `json:"Message"`
+	}
+	e := &Error{StatusCode: status}
+	if json.Unmarshal(body, &resp) != nil {
+		e.Code = http.StatusText(status)
+		e.Message = strings.TrimSpace(string(body))
+		return e
+	}
+	e.Code = resp.Type[strings.LastIndex(resp.Type, "#")+1:]
+	if e.Message = resp.Message; e.Message == "" {
+		e.Message = resp.MessageUpper
+	}
+	return e
+}
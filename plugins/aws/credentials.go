@@ -0,0 +1,166 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package aws
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// AWS credentials, temporary ones having a session token and expiration.
+type Credentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	Expiration      time.Time
+}
+
+// Supplies the credentials requests are signed with.
+type CredentialsProvider interface {
+	Credentials() (*Credentials, error)
+}
+
+// Credentials configured explicitly.
+type staticCredentials struct {
+	creds *Credentials
+}
+
+func (s *staticCredentials) Credentials() (*Credentials, error) {
+	return s.creds, nil
+}
+
+// Returns a provider of the specified credentials. If the access key isn't
+// specified, the credentials are taken from the AWS_ACCESS_KEY_ID,
+// AWS_SECRET_ACCESS_KEY, and AWS_SESSION_TOKEN environment variables, or
+// failing that from the IAM role of the EC2 instance hekad runs on.
+func NewCredentialsProvider(accessKeyID, secretAccessKey,
+	sessionToken string) CredentialsProvider {
+
+	if accessKeyID == "" {
+		accessKeyID = os.Getenv("AWS_ACCESS_KEY_ID")
+		secretAccessKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+		sessionToken = os.Getenv("AWS_SESSION_TOKEN")
+	}
+	if accessKeyID == "" {
+		return &instanceCredentials{
+			metadataURL: instanceMetadataURL,
+			client:      &http.Client{Timeout: 5 * time.Second},
+		}
+	}
+	return &staticCredentials{&Credentials{
+		AccessKeyID:     accessKeyID,
+		SecretAccessKey: secretAccessKey,
+		SessionToken:    sessionToken,
+	}}
+}
+
+// Where EC2 instances find their IAM role's credentials.
+const instanceMetadataURL = "http://169.254.169.254/latest/meta-data/iam/security-credentials/"
+
+// How long before they expire instance credentials are refreshed.
+const refreshMargin = 5 * time.Minute
+
+// Temporary credentials of the EC2 instance's IAM role, fetched from the
+// instance metadata service and refreshed before they expire.
+type instanceCredentials struct {
+	metadataURL string
+	client      *http.Client
+	lock        sync.Mutex
+	creds       *Credentials
+	// Swapped out in tests.
+	now func() time.Time
+}
+
+func (i *instanceCredentials) Credentials() (*Credentials, error) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	now := time.Now()
+	if i.now != nil {
+		now = i.now()
+	}
+	if i.creds != nil && now.Add(refreshMargin).Before(i.creds.Expiration) {
+		return i.creds, nil
+	}
+	creds, err := i.fetch()
+	if err != nil {
+		if i.creds != nil && now.Before(i.creds.Expiration) {
+			// Still valid for a while, try again on the next request.
+			return i.creds, nil
+		}
+		return nil, fmt.Errorf("no AWS credentials configured and none available "+
+			"from the instance metadata: %s", err)
+	}
+	i.creds = creds
+	return creds, nil
+}
+
+func (i *instanceCredentials) get(url string) (body []byte, err error) {
+	resp, err := i.client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err = readBody(resp)
+	if err == nil && resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+	return
+}
+
+func (i *instanceCredentials) fetch() (*Credentials, error) {
+	role, err := i.get(i.metadataURL)
+	if err != nil {
+		return nil, err
+	}
+	if len(role) == 0 {
+		return nil, errors.New("the instance has no IAM role")
+	}
+	body, err := i.get(i.metadataURL + string(firstLine(role)))
+	if err != nil {
+		return nil, err
+	}
+	var resp struct {
+		Code            string
+		AccessKeyId     string
+		SecretAccessKey string
+		Token           string
+		Expiration      time.Time
+	}
+	if err = json.Unmarshal(body, &resp); err != nil {
+		return nil, fmt.Errorf("can't parse the role's credentials: %s", err)
+	}
+	if resp.Code != "" && resp.Code != "Success" {
+		return nil, fmt.Errorf("fetching the role's credentials failed: %s", resp.Code)
+	}
+	return &Credentials{
+		AccessKeyID:     resp.AccessKeyId,
+		SecretAccessKey: resp.SecretAccessKey,
+		SessionToken:    resp.Token,
+		Expiration:      resp.Expiration,
+	}, nil
+}
+
+// Returns the first line of a metadata listing, the instance having at most
+// one role.
+func firstLine(b []byte) []byte {
+	for i, c := range b {
+		if c == '\n' || c == '\r' {
+			return b[:i]
+		}
+	}
+	return b
+}
@@ -0,0 +1,184 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package aws
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Client of the S3 REST API, for the few object operations the plugins need.
+type S3Client struct {
+	// Base URL of the API. If set, e.g. for an S3 compatible store, buckets
+	// are addressed by path rather than by host name.
+	Endpoint string
+	Region   string
+	Signer   *Signer
+	HTTP     *http.Client
+}
+
+func NewS3Client(region, endpoint string, creds CredentialsProvider) (*S3Client, error) {
+	if region == "" {
+		return nil, fmt.Errorf("no region specified for s3")
+	}
+	return &S3Client{
+		Endpoint: strings.TrimRight(endpoint, "/"),
+		Region:   region,
+		Signer:   &Signer{Service: "s3", Region: region, Creds: creds},
+		HTTP:     &http.Client{Timeout: 5 * time.Minute},
+	}, nil
+}
+
+// Returns the URL of an object.
+func (s *S3Client) objectURL(bucket, key string) string {
+	path := "/" + uriEncode(key, false)
+	if s.Endpoint != "" {
+		return s.Endpoint + "/" + bucket + path
+	}
+	return fmt.Sprintf("https://%s.s3.%s.amazonaws.com%s", bucket, s.Region, path)
+}
+
+// Returns the URL of a bucket.
+func (s *S3Client) bucketURL(bucket string) string {
+	if s.Endpoint != "" {
+		return s.Endpoint + "/" + bucket + "/"
+	}
+	return fmt.Sprintf("https://%s.s3.%s.amazonaws.com/", bucket, s.Region)
+}
+
+// Sends a signed request without a body, returning the response if its
+// status is 2xx and an *Error otherwise.
+func (s *S3Client) do(method, rawURL string) (*http.Response, error) {
+	req, err := http.NewRequest(method, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	// Send the key encoded as it's signed, rather than as Go would encode it.
+	opaque := rawURL[len(req.URL.Scheme)+1:]
+	if i := strings.Index(opaque, "?"); i >= 0 {
+		opaque = opaque[:i]
+	}
+	req.URL.Opaque = opaque
+	req.Header.Set("X-Amz-Content-Sha256", hexHash(nil))
+	if err = s.Signer.Sign(req, nil, time.Now()); err != nil {
+		return nil, err
+	}
+	resp, err := s.HTTP.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 == 2 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	body, err := readBody(resp)
+	if err != nil {
+		return nil, err
+	}
+	return nil, parseS3Error(resp.StatusCode, body)
+}
+
+// Fetches the contents of an object.
+func (s *S3Client) GetObject(bucket, key string) ([]byte, error) {
+	resp, err := s.do("GET", s.objectURL(bucket, key))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return readBody(resp)
+}
+
+// Opens an object for streaming its contents, which unlike GetObject aren't
+// limited in size. The caller must close the returned reader.
+func (s *S3Client) OpenObject(bucket, key string) (io.ReadCloser, error) {
+	resp, err := s.do("GET", s.objectURL(bucket, key))
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// An object listed by ListObjects.
+type S3Object struct {
+	Key          string
+	ETag         string
+	Size         int64
+	LastModified time.Time
+}
+
+// Lists a page of the objects whose keys start with the prefix, in key
+// order, returning the token to pass to get the next page, or "" if it was
+// the last one.
+func (s *S3Client) ListObjects(bucket, prefix, token string) (objects []S3Object,
+	next string, err error) {
+
+	query := url.Values{"list-type": {"2"}}
+	if prefix != "" {
+		query.Set("prefix", prefix)
+	}
+	if token != "" {
+		query.Set("continuation-token", token)
+	}
+	// Encoded as it's signed, S3 not taking "+" for a space.
+	rawQuery := canonicalQuery(&url.URL{RawQuery: query.Encode()})
+	resp, err := s.do("GET", s.bucketURL(bucket)+"?"+rawQuery)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	body, err := readBody(resp)
+	if err != nil {
+		return nil, "", err
+	}
+	var result struct {
+		Contents              []S3Object
+		IsTruncated           bool
+		NextContinuationToken string
+	}
+	if err = xml.Unmarshal(body, &result); err != nil {
+		return nil, "", fmt.Errorf("can't parse object listing: %s", err)
+	}
+	if result.IsTruncated {
+		next = result.NextContinuationToken
+	}
+	return result.Contents, next, nil
+}
+
+func (s *S3Client) DeleteObject(bucket, key string) error {
+	resp, err := s.do("DELETE", s.objectURL(bucket, key))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Parses an S3 XML error response.
+func parseS3Error(status int, body []byte) *Error {
+	var resp struct {
+		Code    string
+		Message string
+	}
+	e := &Error{StatusCode: status}
+	if xml.Unmarshal(body, &resp) != nil || resp.Code == "" {
+		e.Code = http.StatusText(status)
+		e.Message = strings.TrimSpace(string(body))
+		return e
+	}
+	e.Code, e.Message = resp.Code, resp.Message
+	return e
+}
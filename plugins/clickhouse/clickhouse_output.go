@@ -0,0 +1,271 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package clickhouse
+
+import (
+	"errors"
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+	"github.com/mozilla-services/heka/pipeline"
+	"github.com/mozilla-services/heka/plugins"
+	"net/url"
+	"sync/atomic"
+	"time"
+)
+
+type ClickHouseOutputConfig struct {
+	// Address of the server's native protocol port.
+	Address string
+	// Database of the table. Defaults to the user's default database.
+	Database string
+	// Table written to.
+	Table    string
+	Username string
+	Password string
+	// Whether blocks are compressed with LZ4 on the wire.
+	Compress bool
+	// Message values written to each column, by column name, see
+	// plugins.NewColumnMapping. Values are converted to the columns' types.
+	Columns map[string]string
+	// Milliseconds after which accumulated rows are written even if the
+	// batch isn't full.
+	FlushInterval uint32 `toml:"flush_interval"`
+	// Number of rows that triggers a write. ClickHouse favors few large
+	// inserts over many small ones.
+	FlushCount int `toml:"flush_count"`
+	// The output's retry settings, also used to back off from failed writes.
+	Retries pipeline.RetryOptions
+}
+
+// Writes messages to a ClickHouse table over the native TCP protocol,
+// mapping message values to columns and inserting the rows in batches, which
+// the driver sends as blocks of columns.
+type ClickHouseOutput struct {
+	rowsWritten int64
+	rowsDropped int64
+	retries     int64
+
+	conf        *ClickHouseOutputConfig
+	columns     *plugins.ColumnMapping
+	converters  []converter // Looked up from the table on the first write.
+	conn        chConn
+	retryHelper *pipeline.RetryHelper
+	pConfig     *pipeline.PipelineConfig
+	batch       [][]interface{}
+}
+
+func (c *ClickHouseOutput) ConfigStruct() interface{} {
+	return &ClickHouseOutputConfig{
+		Address:       "localhost:9000",
+		Compress:      true,
+		FlushInterval: 1000,
+		FlushCount:    10000,
+		Retries: pipeline.RetryOptions{
+			MaxDelay:   "30s",
+			Delay:      "250ms",
+			MaxRetries: -1,
+		},
+	}
+}
+
+func (c *ClickHouseOutput) SetPipelineConfig(pConfig *pipeline.PipelineConfig) {
+	c.pConfig = pConfig
+}
+
+// Returns the driver's connection string.
+func (c *ClickHouseOutput) dsn() string {
+	params := url.Values{}
+	if c.conf.Username != "" {
+		params.Set("username", c.conf.Username)
+	}
+	if c.conf.Password != "" {
+		params.Set("password", c.conf.Password)
+	}
+	if c.conf.Database != "" {
+		params.Set("database", c.conf.Database)
+	}
+	params.Set("compress", fmt.Sprint(c.conf.Compress))
+	return fmt.Sprintf("tcp://%s?%s", c.conf.Address, params.Encode())
+}
+
+func (c *ClickHouseOutput) Init(config interface{}) (err error) {
+	c.conf = config.(*ClickHouseOutputConfig)
+	if c.conf.Address == "" {
+		return errors.New("address must be specified")
+	}
+	if c.conf.Table == "" {
+		return errors.New("table must be specified")
+	}
+	if len(c.conf.Columns) == 0 {
+		return errors.New("columns must be specified")
+	}
+	if c.conf.FlushCount < 1 {
+		return errors.New("flush_count must be greater than 0")
+	}
+	if c.columns, err = plugins.NewColumnMapping(c.conf.Columns); err != nil {
+		return
+	}
+	if c.retryHelper, err = pipeline.NewRetryHelper(c.conf.Retries); err != nil {
+		return fmt.Errorf("invalid retries: %s", err)
+	}
+	if c.conn == nil {
+		c.conn, err = newSQLConn(c.dsn())
+	}
+	return
+}
+
+func (c *ClickHouseOutput) Run(or pipeline.OutputRunner, h pipeline.PluginHelper) (err error) {
+	defer c.conn.Close()
+	ticker := time.NewTicker(time.Duration(c.conf.FlushInterval) * time.Millisecond)
+	defer ticker.Stop()
+	inChan := or.InChan()
+	for {
+		select {
+		case pack, ok := <-inChan:
+			if !ok {
+				return c.flush(or)
+			}
+			c.batch = append(c.batch, c.columns.Values(pack.Message))
+			pack.Recycle()
+			if len(c.batch) >= c.conf.FlushCount {
+				if err = c.flush(or); err != nil {
+					return
+				}
+			}
+		case <-ticker.C:
+			if err = c.flush(or); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// Looks up the types of the mapped columns, so values can be converted to
+// what the driver expects for each.
+func (c *ClickHouseOutput) loadConverters() error {
+	types, err := c.conn.ColumnTypes(c.conf.Database, c.conf.Table)
+	if err != nil {
+		return err
+	}
+	if len(types) == 0 {
+		return pipeline.NewFatalError(fmt.Errorf("table '%s' doesn't exist",
+			c.conf.Table))
+	}
+	converters := make([]converter, len(c.columns.Names))
+	for i, name := range c.columns.Names {
+		chType, ok := types[name]
+		if !ok {
+			return pipeline.NewFatalError(fmt.Errorf("table '%s' has no column '%s'",
+				c.conf.Table, name))
+		}
+		converters[i] = newConverter(chType)
+	}
+	c.converters = converters
+	return nil
+}
+
+// Converts the values of rows to their columns' types, dropping the rows
+// holding values that can't be converted.
+func (c *ClickHouseOutput) convert(or pipeline.OutputRunner,
+	rows [][]interface{}) [][]interface{} {
+
+	converted := rows[:0]
+	for _, row := range rows {
+		var err error
+		for i, value := range row {
+			if row[i], err = c.converters[i](value); err != nil {
+				err = fmt.Errorf("column '%s': %s", c.columns.Names[i], err)
+				break
+			}
+		}
+		if err != nil {
+			or.LogError(fmt.Errorf("dropping row: %s", err))
+			atomic.AddInt64(&c.rowsDropped, 1)
+			continue
+		}
+		converted = append(converted, row)
+	}
+	return converted
+}
+
+// Writes the accumulated rows. Returns an error if the output must stop.
+func (c *ClickHouseOutput) flush(or pipeline.OutputRunner) error {
+	rows := c.batch
+	c.batch = nil
+	if len(rows) == 0 {
+		return nil
+	}
+	return c.write(or, rows)
+}
+
+// Writes rows, backing off and retrying while the failures are worth
+// retrying. Rows ClickHouse rejects are dropped with their whole batch, as
+// inserting them one by one to isolate the bad ones would create a part per
+// row.
+func (c *ClickHouseOutput) write(or pipeline.OutputRunner, rows [][]interface{}) error {
+	c.retryHelper.Reset()
+	converted := false
+	for {
+		var err error
+		if c.converters == nil {
+			err = c.loadConverters()
+		}
+		if err == nil && !converted {
+			converted = true
+			if rows = c.convert(or, rows); len(rows) == 0 {
+				return nil
+			}
+		}
+		if err == nil {
+			err = c.conn.Insert(c.conf.Database, c.conf.Table, c.columns.Names, rows)
+		}
+		if err == nil {
+			atomic.AddInt64(&c.rowsWritten, int64(len(rows)))
+			return nil
+		}
+		err = classifyError(err)
+		switch pipeline.ClassifyError(err) {
+		case pipeline.ErrKindMalformed:
+			or.LogError(fmt.Errorf("dropping %d rows: %s", len(rows), err))
+			atomic.AddInt64(&c.rowsDropped, int64(len(rows)))
+			return nil
+		case pipeline.ErrKindFatal:
+			atomic.AddInt64(&c.rowsDropped, int64(len(rows)))
+			return err
+		}
+		or.LogError(err)
+		if c.pConfig != nil && c.pConfig.Globals.IsShuttingDown() {
+			break
+		}
+		if c.retryHelper.Wait() != nil {
+			or.LogError(errors.New("retries exhausted"))
+			break
+		}
+		atomic.AddInt64(&c.retries, 1)
+	}
+	atomic.AddInt64(&c.rowsDropped, int64(len(rows)))
+	or.LogError(fmt.Errorf("dropping %d rows", len(rows)))
+	return nil
+}
+
+func (c *ClickHouseOutput) ReportMsg(msg *message.Message) error {
+	message.NewInt64Field(msg, "RowsWritten", atomic.LoadInt64(&c.rowsWritten), "count")
+	message.NewInt64Field(msg, "RowsDropped", atomic.LoadInt64(&c.rowsDropped), "count")
+	message.NewInt64Field(msg, "WriteRetries", atomic.LoadInt64(&c.retries), "count")
+	return nil
+}
+
+func init() {
+	pipeline.RegisterPlugin("ClickHouseOutput", func() interface{} {
+		return new(ClickHouseOutput)
+	})
+}
@@ -0,0 +1,200 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package clickhouse
+
+import (
+	clickhouse "github.com/ClickHouse/clickhouse-go"
+	"github.com/mozilla-services/heka/message"
+	"github.com/mozilla-services/heka/pipeline"
+	"github.com/mozilla-services/heka/pipelinemock"
+	"github.com/rafrombrc/gomock/gomock"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Connection fake holding a table of the listed columns, failing the calls
+// listed in errs.
+type fakeConn struct {
+	types   map[string]string
+	rows    [][]interface{}
+	inserts int
+	errs    []error
+}
+
+func (f *fakeConn) ColumnTypes(database, table string) (map[string]string, error) {
+	return f.types, nil
+}
+
+func (f *fakeConn) Insert(database, table string, columns []string,
+	rows [][]interface{}) error {
+
+	f.inserts++
+	if len(f.errs) > 0 {
+		err := f.errs[0]
+		f.errs = f.errs[1:]
+		return err
+	}
+	f.rows = append(f.rows, rows...)
+	return nil
+}
+
+func (f *fakeConn) Close() error {
+	return nil
+}
+
+func newTestOutput(t *testing.T, conn *fakeConn) *ClickHouseOutput {
+	c := &ClickHouseOutput{conn: conn}
+	config := c.ConfigStruct().(*ClickHouseOutputConfig)
+	config.Table = "requests"
+	config.Columns = map[string]string{
+		"ts":     "Timestamp",
+		"host":   "Hostname",
+		"status": "Fields[status]",
+	}
+	config.Retries.Delay = "1ms"
+	if err := c.Init(config); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func newMessage(status string) *message.Message {
+	msg := new(message.Message)
+	msg.SetTimestamp(1420070400 * int64(time.Second))
+	msg.SetHostname("web1")
+	message.NewStringField(msg, "status", status)
+	return msg
+}
+
+func TestConverters(t *testing.T) {
+	ts := time.Unix(1420070400, 0).UTC()
+	tests := []struct {
+		chType string
+		value  interface{}
+		want   interface{}
+		err    bool
+	}{
+		{"String", int64(42), "42", false},
+		{"LowCardinality(String)", "GET", "GET", false},
+		{"Nullable(String)", nil, nil, false},
+		{"String", nil, "", false},
+		{"UInt16", "404", uint16(404), false},
+		{"UInt16", int64(-1), nil, true},
+		{"UInt8", int64(256), nil, true},
+		{"Int32", float64(-12), int32(-12), false},
+		{"Int64", "twelve", nil, true},
+		{"Float32", int64(2), float32(2), false},
+		{"Bool", "true", true, false},
+		{"DateTime", ts.UnixNano(), ts, false},
+		{"DateTime64(3, 'UTC')", "2015-01-01T00:00:00Z", ts, false},
+		{"Nullable(DateTime)", nil, nil, false},
+	}
+	for _, test := range tests {
+		got, err := newConverter(test.chType)(test.value)
+		if (err != nil) != test.err {
+			t.Errorf("%s(%v): unexpected error: %v", test.chType, test.value, err)
+			continue
+		}
+		if !test.err && got != test.want {
+			t.Errorf("%s(%v): expected %#v, got %#v", test.chType, test.value,
+				test.want, got)
+		}
+	}
+}
+
+func TestOutputConfig(t *testing.T) {
+	c := &ClickHouseOutput{conn: new(fakeConn)}
+	config := c.ConfigStruct().(*ClickHouseOutputConfig)
+	config.Table = "requests"
+	if err := c.Init(config); err == nil || err.Error() != "columns must be specified" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	config.Address = "db1:9000"
+	config.Database = "web"
+	config.Username = "heka"
+	if dsn := c.dsn(); dsn != "tcp://db1:9000?compress=true&database=web&username=heka" {
+		t.Errorf("Unexpected DSN: %s", dsn)
+	}
+}
+
+func TestWriteConvertsAndRetries(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	or := pipelinemock.NewMockOutputRunner(ctrl)
+	or.EXPECT().LogError(gomock.Any()).AnyTimes()
+
+	conn := &fakeConn{
+		types: map[string]string{
+			"ts":     "DateTime",
+			"host":   "LowCardinality(String)",
+			"status": "UInt16",
+			"bytes":  "UInt64",
+		},
+		errs: []error{&clickhouse.Exception{Code: 252, Message: "Too many parts"}},
+	}
+	c := newTestOutput(t, conn)
+	c.batch = [][]interface{}{
+		c.columns.Values(newMessage("200")),
+		c.columns.Values(newMessage("oops")),
+		c.columns.Values(newMessage("404")),
+	}
+	if err := c.flush(or); err != nil {
+		t.Fatal(err)
+	}
+	// The throttled insert is retried, without the unconvertible row.
+	if conn.inserts != 2 || len(conn.rows) != 2 {
+		t.Fatalf("Unexpected writes: %d inserts, %v", conn.inserts, conn.rows)
+	}
+	status := 0
+	for i, name := range c.columns.Names {
+		if name == "status" {
+			status = i
+		}
+	}
+	if conn.rows[1][status] != uint16(404) {
+		t.Errorf("Unexpected row: %v", conn.rows[1])
+	}
+	if c.rowsWritten != 2 || c.rowsDropped != 1 || c.retries != 1 {
+		t.Errorf("Unexpected counts: %d written, %d dropped, %d retries",
+			c.rowsWritten, c.rowsDropped, c.retries)
+	}
+
+	// Rejected data drops the batch, a missing table stops the output.
+	conn.errs = []error{&clickhouse.Exception{Code: 53, Message: "Type mismatch"}}
+	c.batch = [][]interface{}{c.columns.Values(newMessage("500"))}
+	if err := c.flush(or); err != nil || c.rowsDropped != 2 {
+		t.Errorf("Unexpected result: %v, %d dropped", err, c.rowsDropped)
+	}
+	conn.errs = []error{&clickhouse.Exception{Code: 60, Message: "Unknown table"}}
+	c.batch = [][]interface{}{c.columns.Values(newMessage("500"))}
+	if err := c.flush(or); pipeline.ClassifyError(err) != pipeline.ErrKindFatal {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestMissingColumnIsFatal(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	or := pipelinemock.NewMockOutputRunner(ctrl)
+
+	conn := &fakeConn{types: map[string]string{"ts": "DateTime", "host": "String"}}
+	c := newTestOutput(t, conn)
+	c.batch = [][]interface{}{c.columns.Values(newMessage("200"))}
+	err := c.flush(or)
+	if err == nil || !strings.Contains(err.Error(), "no column 'status'") {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if conn.inserts != 0 {
+		t.Errorf("Unexpected inserts: %d", conn.inserts)
+	}
+}
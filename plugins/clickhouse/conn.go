@@ -0,0 +1,150 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package clickhouse
+
+import (
+	"database/sql"
+	"fmt"
+	clickhouse "github.com/ClickHouse/clickhouse-go"
+	"github.com/mozilla-services/heka/pipeline"
+	"strings"
+)
+
+// The ClickHouse operations the output uses.
+type chConn interface {
+	// Returns the types of a table's columns, by column name. An empty
+	// database is the connection's default database.
+	ColumnTypes(database, table string) (map[string]string, error)
+	Insert(database, table string, columns []string, rows [][]interface{}) error
+	Close() error
+}
+
+// Talks to ClickHouse with its native TCP protocol, which sends the rows of
+// an insert as compressed blocks of columns.
+type sqlConn struct {
+	db *sql.DB
+}
+
+func newSQLConn(dsn string) (*sqlConn, error) {
+	db, err := sql.Open("clickhouse", dsn)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+	return &sqlConn{db}, nil
+}
+
+func (c *sqlConn) ColumnTypes(database, table string) (types map[string]string,
+	err error) {
+
+	query := "SELECT name, type FROM system.columns WHERE database = "
+	args := []interface{}{table}
+	if database == "" {
+		query += "currentDatabase() AND table = ?"
+	} else {
+		query += "? AND table = ?"
+		args = []interface{}{database, table}
+	}
+	rows, err := c.db.Query(query, args...)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	types = make(map[string]string)
+	for rows.Next() {
+		var name, chType string
+		if err = rows.Scan(&name, &chType); err != nil {
+			return nil, err
+		}
+		types[name] = chType
+	}
+	return types, rows.Err()
+}
+
+func quoteIdentifier(name string) string {
+	return "`" + strings.Replace(name, "`", "\\`", -1) + "`"
+}
+
+// Inserts rows in a single batch. The driver buffers the rows and sends them
+// when the transaction is committed.
+func (c *sqlConn) Insert(database, table string, columns []string,
+	rows [][]interface{}) (err error) {
+
+	target := quoteIdentifier(table)
+	if database != "" {
+		target = quoteIdentifier(database) + "." + target
+	}
+	quoted := make([]string, len(columns))
+	for i, name := range columns {
+		quoted[i] = quoteIdentifier(name)
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(columns)), ", ")
+	query := fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", target,
+		strings.Join(quoted, ", "), placeholders)
+
+	tx, err := c.db.Begin()
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+	stmt, err := tx.Prepare(query)
+	if err != nil {
+		return
+	}
+	defer stmt.Close()
+	for _, row := range rows {
+		if _, err = stmt.Exec(row...); err != nil {
+			return
+		}
+	}
+	return tx.Commit()
+}
+
+func (c *sqlConn) Close() error {
+	return c.db.Close()
+}
+
+// Wraps an error with its kind for pipeline.ClassifyError, from ClickHouse's
+// error code.
+func classifyError(err error) error {
+	if _, ok := err.(*pipeline.OutputError); ok {
+		return err
+	}
+	exception, ok := err.(*clickhouse.Exception)
+	if !ok {
+		// Network errors and lost connections.
+		return pipeline.NewRetryableError(err)
+	}
+	switch exception.Code {
+	case 202, // TOO_MANY_SIMULTANEOUS_QUERIES
+		252: // TOO_MANY_PARTS, inserts are faster than merges.
+		return pipeline.NewThrottledError(err, 0)
+	case 159, // TIMEOUT_EXCEEDED
+		209, // SOCKET_TIMEOUT
+		210, // NETWORK_ERROR
+		241, // MEMORY_LIMIT_EXCEEDED
+		242: // TABLE_IS_READ_ONLY, e.g. lost its ZooKeeper session.
+		return pipeline.NewRetryableError(err)
+	case 6, // CANNOT_PARSE_TEXT
+		27,  // CANNOT_PARSE_INPUT_ASSERTION_FAILED
+		53,  // TYPE_MISMATCH
+		70,  // CANNOT_CONVERT_TYPE
+		117: // INCORRECT_DATA
+		return pipeline.NewMalformedMessageError(err)
+	}
+	// e.g. a missing table or column, or invalid credentials.
+	return pipeline.NewFatalError(err)
+}
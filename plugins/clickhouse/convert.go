@@ -0,0 +1,258 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package clickhouse
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Converts a message value to the Go type the driver writes to a column.
+// Missing values, i.e. nil, are converted to NULL for Nullable columns and
+// to the type's zero value otherwise.
+type converter func(value interface{}) (interface{}, error)
+
+// Returns the converter for a ClickHouse column type.
+func newConverter(chType string) converter {
+	t, nullable := chType, false
+	for {
+		if inner, ok := unwrapType(t, "LowCardinality"); ok {
+			t = inner
+		} else if inner, ok = unwrapType(t, "Nullable"); ok {
+			t, nullable = inner, true
+		} else {
+			break
+		}
+	}
+	conv := baseConverter(t)
+	if !nullable {
+		return conv
+	}
+	return func(value interface{}) (interface{}, error) {
+		if value == nil {
+			return nil, nil
+		}
+		return conv(value)
+	}
+}
+
+// Returns the type wrapped in e.g. "Nullable(String)".
+func unwrapType(t, wrapper string) (string, bool) {
+	if strings.HasPrefix(t, wrapper+"(") && strings.HasSuffix(t, ")") {
+		return t[len(wrapper)+1 : len(t)-1], true
+	}
+	return t, false
+}
+
+func baseConverter(t string) converter {
+	switch {
+	case t == "String", t == "UUID", t == "IPv4", t == "IPv6",
+		strings.HasPrefix(t, "FixedString("), strings.HasPrefix(t, "Enum8("),
+		strings.HasPrefix(t, "Enum16("):
+		return toString
+	case t == "Int8":
+		return intConverter(t, math.MinInt8, math.MaxInt8, func(n int64) interface{} {
+			return int8(n)
+		})
+	case t == "Int16":
+		return intConverter(t, math.MinInt16, math.MaxInt16, func(n int64) interface{} {
+			return int16(n)
+		})
+	case t == "Int32":
+		return intConverter(t, math.MinInt32, math.MaxInt32, func(n int64) interface{} {
+			return int32(n)
+		})
+	case t == "Int64":
+		return intConverter(t, math.MinInt64, math.MaxInt64, func(n int64) interface{} {
+			return n
+		})
+	case t == "UInt8":
+		return uintConverter(t, math.MaxUint8, func(n uint64) interface{} {
+			return uint8(n)
+		})
+	case t == "UInt16":
+		return uintConverter(t, math.MaxUint16, func(n uint64) interface{} {
+			return uint16(n)
+		})
+	case t == "UInt32":
+		return uintConverter(t, math.MaxUint32, func(n uint64) interface{} {
+			return uint32(n)
+		})
+	case t == "UInt64":
+		return uintConverter(t, math.MaxUint64, func(n uint64) interface{} {
+			return n
+		})
+	case t == "Float32":
+		return func(value interface{}) (interface{}, error) {
+			f, err := toFloat(value)
+			return float32(f), err
+		}
+	case t == "Float64":
+		return func(value interface{}) (interface{}, error) {
+			return toFloat(value)
+		}
+	case t == "Bool":
+		return toBool
+	case t == "Date", t == "Date32", strings.HasPrefix(t, "DateTime"):
+		return toTime
+	}
+	// Left to the driver, e.g. arrays.
+	return func(value interface{}) (interface{}, error) {
+		return value, nil
+	}
+}
+
+func toString(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case []byte:
+		return string(v), nil
+	case time.Time:
+		return v.Format(time.RFC3339Nano), nil
+	}
+	return fmt.Sprint(value), nil
+}
+
+func intConverter(t string, min, max int64, cast func(int64) interface{}) converter {
+	return func(value interface{}) (interface{}, error) {
+		var n int64
+		switch v := value.(type) {
+		case nil:
+		case int64:
+			n = v
+		case float64:
+			if v < float64(min) || v > float64(max) {
+				return nil, fmt.Errorf("%v is out of range for %s", v, t)
+			}
+			n = int64(v)
+		case bool:
+			if v {
+				n = 1
+			}
+		case time.Time:
+			n = v.Unix()
+		default:
+			s := strings.TrimSpace(fmt.Sprintf("%s", value))
+			var err error
+			if n, err = strconv.ParseInt(s, 10, 64); err != nil {
+				return nil, fmt.Errorf("can't convert '%s' to %s", s, t)
+			}
+		}
+		if n < min || n > max {
+			return nil, fmt.Errorf("%d is out of range for %s", n, t)
+		}
+		return cast(n), nil
+	}
+}
+
+func uintConverter(t string, max uint64, cast func(uint64) interface{}) converter {
+	return func(value interface{}) (interface{}, error) {
+		var n uint64
+		switch v := value.(type) {
+		case nil:
+		case int64:
+			if v < 0 {
+				return nil, fmt.Errorf("%d is out of range for %s", v, t)
+			}
+			n = uint64(v)
+		case float64:
+			if v < 0 || v > float64(max) {
+				return nil, fmt.Errorf("%v is out of range for %s", v, t)
+			}
+			n = uint64(v)
+		case bool:
+			if v {
+				n = 1
+			}
+		case time.Time:
+			n = uint64(v.Unix())
+		default:
+			s := strings.TrimSpace(fmt.Sprintf("%s", value))
+			var err error
+			if n, err = strconv.ParseUint(s, 10, 64); err != nil {
+				return nil, fmt.Errorf("can't convert '%s' to %s", s, t)
+			}
+		}
+		if n > max {
+			return nil, fmt.Errorf("%d is out of range for %s", n, t)
+		}
+		return cast(n), nil
+	}
+}
+
+func toFloat(value interface{}) (float64, error) {
+	switch v := value.(type) {
+	case nil:
+		return 0, nil
+	case float64:
+		return v, nil
+	case int64:
+		return float64(v), nil
+	case bool:
+		if v {
+			return 1, nil
+		}
+		return 0, nil
+	}
+	s := strings.TrimSpace(fmt.Sprintf("%s", value))
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, fmt.Errorf("can't convert '%s' to a float", s)
+	}
+	return f, nil
+}
+
+func toBool(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case nil:
+		return false, nil
+	case bool:
+		return v, nil
+	case int64:
+		return v != 0, nil
+	case float64:
+		return v != 0, nil
+	}
+	s := strings.TrimSpace(fmt.Sprintf("%s", value))
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		return nil, fmt.Errorf("can't convert '%s' to Bool", s)
+	}
+	return b, nil
+}
+
+// Converts times, integers taken as nanoseconds since the epoch like Heka's
+// timestamps, and RFC 3339 strings.
+func toTime(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case nil:
+		return time.Unix(0, 0).UTC(), nil
+	case time.Time:
+		return v, nil
+	case int64:
+		return time.Unix(0, v).UTC(), nil
+	case float64:
+		return time.Unix(0, int64(v)).UTC(), nil
+	}
+	s := strings.TrimSpace(fmt.Sprintf("%s", value))
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return nil, fmt.Errorf("can't convert '%s' to a time", s)
+	}
+	return t, nil
+}
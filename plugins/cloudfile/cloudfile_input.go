@@ -0,0 +1,449 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package cloudfile
+
+import (
+	"bufio"
+	"code.google.com/p/go-uuid/uuid"
+	"compress/bzip2"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+	"github.com/mozilla-services/heka/pipeline"
+	"github.com/mozilla-services/heka/plugins/aws"
+	"io"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Endpoint of Google Cloud Storage's S3 compatible XML API.
+const gcsEndpoint = "https://storage.googleapis.com"
+
+// The object store operations the input uses.
+type objectStore interface {
+	ListObjects(bucket, prefix, token string) ([]aws.S3Object, string, error)
+	OpenObject(bucket, key string) (io.ReadCloser, error)
+}
+
+type CloudFileInputConfig struct {
+	// "s3" (the default) or "gcs".
+	Provider string
+	Bucket   string
+	// Only objects whose keys start with the prefix are read.
+	Prefix string
+	// Defaults to "auto" for GCS.
+	Region string
+	// Base URL of the API, e.g. for an S3 compatible store. Defaults to the
+	// regional S3 endpoint, or to Google Cloud Storage's XML API for GCS.
+	Endpoint string
+	// Credentials, for GCS an HMAC key. For S3 they're taken from the
+	// environment or the instance's IAM role if not specified.
+	AccessKeyID     string `toml:"access_key_id"`
+	SecretAccessKey string `toml:"secret_access_key"`
+	SessionToken    string `toml:"session_token"`
+	// Seconds between listings of the prefix.
+	TickerInterval uint `toml:"ticker_interval"`
+	// File recording the objects read, relative to the base_dir. Defaults to
+	// "cloudfile/<plugin name>.json".
+	Manifest string
+	// "auto" (the default) to decompress objects by their extension, ".gz"
+	// or ".bz2", or "gzip", "bzip2", or "none" for all of them.
+	Compression string
+	// How the objects are split into records, "token" (the default),
+	// "regexp", "message.proto", or "json_array".
+	ParserType string `toml:"parser_type"`
+	Delimiter  string
+	// "start" or "end" (the default), only used by the regexp parser.
+	DelimiterLocation string `toml:"delimiter_location"`
+	// Field of the JSON object holding the array of records, only used by
+	// the json_array parser. Defaults to "Records", as in CloudTrail logs.
+	JSONArrayField string `toml:"json_array_field"`
+}
+
+// Polls an S3 or GCS prefix, reading each object not read before and
+// delivering its records, e.g. to replay archived logs. The objects read are
+// recorded in a manifest in the base_dir, so they're only read once, unless
+// they're overwritten.
+type CloudFileInput struct {
+	objectsRead      int64
+	objectFailures   int64
+	recordsDelivered int64
+
+	conf     *CloudFileInputConfig
+	store    objectStore
+	manifest *manifest
+	pConfig  *pipeline.PipelineConfig
+	name     string
+	stopChan chan struct{}
+	stopLock sync.Mutex
+	stopped  bool
+}
+
+func (c *CloudFileInput) ConfigStruct() interface{} {
+	return &CloudFileInputConfig{
+		Provider:       "s3",
+		TickerInterval: 60,
+		Compression:    "auto",
+		ParserType:     "token",
+		JSONArrayField: "Records",
+	}
+}
+
+func (c *CloudFileInput) SetPipelineConfig(pConfig *pipeline.PipelineConfig) {
+	c.pConfig = pConfig
+}
+
+func (c *CloudFileInput) SetName(name string) {
+	c.name = name
+}
+
+func (c *CloudFileInput) Init(config interface{}) (err error) {
+	c.conf = config.(*CloudFileInputConfig)
+	if c.conf.Bucket == "" {
+		return errors.New("bucket must be specified")
+	}
+	switch c.conf.Compression {
+	case "auto", "gzip", "bzip2", "none":
+	default:
+		return fmt.Errorf("invalid compression: %s", c.conf.Compression)
+	}
+	if _, err = c.newParser(); err != nil {
+		return
+	}
+
+	if c.store == nil {
+		region, endpoint := c.conf.Region, c.conf.Endpoint
+		switch c.conf.Provider {
+		case "s3":
+		case "gcs":
+			if c.conf.AccessKeyID == "" {
+				return errors.New("gcs requires an HMAC key, access_key_id and " +
+					"secret_access_key must be specified")
+			}
+			if region == "" {
+				region = "auto"
+			}
+			if endpoint == "" {
+				endpoint = gcsEndpoint
+			}
+		default:
+			return fmt.Errorf("invalid provider: %s", c.conf.Provider)
+		}
+		creds := aws.NewCredentialsProvider(c.conf.AccessKeyID, c.conf.SecretAccessKey,
+			c.conf.SessionToken)
+		client, err := aws.NewS3Client(region, endpoint, creds)
+		if err != nil {
+			return err
+		}
+		// Archives can take a while to download.
+		client.HTTP.Timeout = time.Hour
+		c.store = client
+	}
+
+	path := c.conf.Manifest
+	if path == "" {
+		path = filepath.Join("cloudfile", c.name+".json")
+	}
+	c.manifest, err = loadManifest(c.pConfig.Globals.PrependBaseDir(path))
+	return
+}
+
+// Returns a new parser, a parser holding on to the end of the last object it
+// parsed. Returns no parser for json_array, parsed by readJSONArray.
+func (c *CloudFileInput) newParser() (pipeline.StreamParser, error) {
+	switch c.conf.ParserType {
+	case "token":
+		tp := pipeline.NewTokenParser()
+		switch len(c.conf.Delimiter) {
+		case 0: // use default
+		case 1:
+			tp.SetDelimiter(c.conf.Delimiter[0])
+		default:
+			return nil, fmt.Errorf("invalid delimiter: %s", c.conf.Delimiter)
+		}
+		return tp, nil
+	case "regexp":
+		rp := pipeline.NewRegexpParser()
+		if len(c.conf.Delimiter) > 0 {
+			if err := rp.SetDelimiter(c.conf.Delimiter); err != nil {
+				return nil, err
+			}
+		}
+		if err := rp.SetDelimiterLocation(c.conf.DelimiterLocation); err != nil {
+			return nil, err
+		}
+		return rp, nil
+	case "message.proto":
+		return pipeline.NewMessageProtoParser(), nil
+	case "json_array":
+		return nil, nil
+	}
+	return nil, fmt.Errorf("unknown parser type: %s", c.conf.ParserType)
+}
+
+func (c *CloudFileInput) Run(ir pipeline.InputRunner, h pipeline.PluginHelper) error {
+	c.stopLock.Lock()
+	c.stopChan = make(chan struct{})
+	c.stopped = false
+	c.stopLock.Unlock()
+
+	ticker := ir.Ticker()
+	for {
+		if !c.poll(ir) {
+			return nil
+		}
+		select {
+		case <-ticker:
+		case <-c.stopChan:
+			return nil
+		}
+	}
+}
+
+// Lists the prefix and reads the objects not read yet, in key order,
+// returning false if the input is stopped in the meantime.
+func (c *CloudFileInput) poll(ir pipeline.InputRunner) bool {
+	listed := make(map[string]bool)
+	token := ""
+	for {
+		objects, next, err := c.store.ListObjects(c.conf.Bucket, c.conf.Prefix, token)
+		if err != nil {
+			ir.LogError(fmt.Errorf("can't list %s: %s", c.location(c.conf.Prefix), err))
+			return true
+		}
+		for _, obj := range objects {
+			listed[obj.Key] = true
+			// Skip directory placeholders, and objects already read.
+			if strings.HasSuffix(obj.Key, "/") || c.manifest.has(obj.Key, obj.ETag) {
+				continue
+			}
+			if err = c.read(ir, obj.Key); err == errStopped {
+				return false
+			} else if err != nil {
+				atomic.AddInt64(&c.objectFailures, 1)
+				ir.LogError(fmt.Errorf("can't read %s, will try again: %s",
+					c.location(obj.Key), err))
+				continue
+			}
+			atomic.AddInt64(&c.objectsRead, 1)
+			if err = c.manifest.add(obj.Key, obj.ETag); err != nil {
+				ir.LogError(fmt.Errorf("can't save the manifest: %s", err))
+			}
+		}
+		if token = next; token == "" {
+			break
+		}
+	}
+	// Only pruned after a complete listing.
+	if err := c.manifest.prune(listed); err != nil {
+		ir.LogError(fmt.Errorf("can't save the manifest: %s", err))
+	}
+	return true
+}
+
+func (c *CloudFileInput) location(key string) string {
+	scheme := "s3"
+	if c.conf.Provider == "gcs" {
+		scheme = "gs"
+	}
+	return fmt.Sprintf("%s://%s/%s", scheme, c.conf.Bucket, key)
+}
+
+var errStopped = errors.New("stopped")
+
+// Streams an object's records to the router.
+func (c *CloudFileInput) read(ir pipeline.InputRunner, key string) (err error) {
+	body, err := c.store.OpenObject(c.conf.Bucket, key)
+	if err != nil {
+		return
+	}
+	defer body.Close()
+	var reader io.Reader = body
+	compression := c.conf.Compression
+	if compression == "auto" {
+		switch {
+		case strings.HasSuffix(key, ".gz"):
+			compression = "gzip"
+		case strings.HasSuffix(key, ".bz2"):
+			compression = "bzip2"
+		}
+	}
+	switch compression {
+	case "gzip":
+		var gz *gzip.Reader
+		if gz, err = gzip.NewReader(body); err != nil {
+			return
+		}
+		defer gz.Close()
+		reader = gz
+	case "bzip2":
+		reader = bzip2.NewReader(body)
+	}
+	// Parsers drop the data returned along with io.EOF, buffered readers
+	// never return any.
+	reader = bufio.NewReader(reader)
+	if c.conf.ParserType == "json_array" {
+		return c.readJSONArray(ir, key, reader)
+	}
+
+	parser, _ := c.newParser()
+	truncated := false
+	for {
+		select {
+		case <-c.stopChan:
+			return errStopped
+		default:
+		}
+		var record []byte
+		_, record, err = parser.Parse(reader)
+		if err == io.ErrShortBuffer {
+			ir.LogError(fmt.Errorf("%s: record exceeded MAX_RECORD_SIZE %d and was dropped",
+				c.location(key), message.MAX_RECORD_SIZE))
+			truncated = true
+			continue
+		}
+		if err == io.EOF {
+			// What's left of a stream of framed messages is an incomplete
+			// message, while for the other parsers it's the last record.
+			if record = parser.GetRemainingData(); c.conf.ParserType == "message.proto" {
+				record = nil
+			}
+		} else if err != nil {
+			return
+		}
+		// The rest of a record that was too large is dropped as well.
+		if len(record) > 0 && !truncated {
+			if !c.deliver(ir, key, record) {
+				return errStopped
+			}
+		}
+		if len(record) > 0 {
+			truncated = false
+		}
+		if err == io.EOF {
+			return nil
+		}
+	}
+}
+
+// Streams the elements of a JSON array, either the whole document or the
+// `json_array_field` field of the top level object, as records, so large
+// files such as CloudTrail logs are never held in memory.
+func (c *CloudFileInput) readJSONArray(ir pipeline.InputRunner, key string,
+	reader io.Reader) error {
+
+	dec := json.NewDecoder(reader)
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if tok == json.Delim('{') {
+		for {
+			if !dec.More() {
+				// The field's missing, so there's no records.
+				return nil
+			}
+			if tok, err = dec.Token(); err != nil {
+				return err
+			}
+			if tok == c.conf.JSONArrayField {
+				break
+			}
+			var skipped json.RawMessage
+			if err = dec.Decode(&skipped); err != nil {
+				return err
+			}
+		}
+		if tok, err = dec.Token(); err != nil {
+			return err
+		}
+	}
+	if tok != json.Delim('[') {
+		return fmt.Errorf("%s: not a JSON array or an object with a '%s' array",
+			c.location(key), c.conf.JSONArrayField)
+	}
+	for dec.More() {
+		select {
+		case <-c.stopChan:
+			return errStopped
+		default:
+		}
+		var record json.RawMessage
+		if err = dec.Decode(&record); err != nil {
+			return err
+		}
+		if !c.deliver(ir, key, record) {
+			return errStopped
+		}
+	}
+	return nil
+}
+
+// Hands a record on, returning false if the input is stopped while waiting
+// for a pack.
+func (c *CloudFileInput) deliver(ir pipeline.InputRunner, key string,
+	record []byte) bool {
+
+	var pack *pipeline.PipelinePack
+	select {
+	case pack = <-ir.InChan():
+	case <-c.stopChan:
+		return false
+	}
+	if c.conf.ParserType == "message.proto" {
+		headerLen := int(record[1]) + 3 // recsep+len+header+unitsep
+		pack.MsgBytes = append(pack.MsgBytes[:0], record[headerLen:]...)
+	} else {
+		m := pack.Message
+		m.SetUuid(uuid.NewRandom())
+		m.SetTimestamp(time.Now().UnixNano())
+		m.SetType("heka.cloudfile")
+		m.SetLogger(c.name)
+		m.SetHostname(c.pConfig.Hostname())
+		m.SetPayload(string(record))
+		message.NewStringField(m, "Bucket", c.conf.Bucket)
+		message.NewStringField(m, "Key", key)
+	}
+	ir.Deliver(pack)
+	atomic.AddInt64(&c.recordsDelivered, 1)
+	return true
+}
+
+// Also called by Run when it fails, so may be called twice.
+func (c *CloudFileInput) Stop() {
+	c.stopLock.Lock()
+	defer c.stopLock.Unlock()
+	if !c.stopped && c.stopChan != nil {
+		c.stopped = true
+		close(c.stopChan)
+	}
+}
+
+func (c *CloudFileInput) ReportMsg(msg *message.Message) error {
+	message.NewInt64Field(msg, "ObjectsRead", atomic.LoadInt64(&c.objectsRead), "count")
+	message.NewInt64Field(msg, "ObjectFailures", atomic.LoadInt64(&c.objectFailures),
+		"count")
+	message.NewInt64Field(msg, "RecordsDelivered",
+		atomic.LoadInt64(&c.recordsDelivered), "count")
+	return nil
+}
+
+func init() {
+	pipeline.RegisterPlugin("CloudFileInput", func() interface{} {
+		return new(CloudFileInput)
+	})
+}
@@ -0,0 +1,217 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package cloudfile
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"github.com/mozilla-services/heka/pipeline"
+	"github.com/mozilla-services/heka/pipelinemock"
+	"github.com/mozilla-services/heka/plugins/aws"
+	"github.com/rafrombrc/gomock/gomock"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"testing"
+)
+
+// Object store fake, listing a page per object.
+type fakeStore struct {
+	objects map[string]string
+	etags   map[string]string
+}
+
+func (f *fakeStore) ListObjects(bucket, prefix, token string) ([]aws.S3Object,
+	string, error) {
+
+	keys := make([]string, 0, len(f.objects))
+	for key := range f.objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for i, key := range keys {
+		if key <= token {
+			continue
+		}
+		next := ""
+		if i < len(keys)-1 {
+			next = key
+		}
+		return []aws.S3Object{{Key: key, ETag: f.etags[key]}}, next, nil
+	}
+	return nil, "", nil
+}
+
+func (f *fakeStore) OpenObject(bucket, key string) (io.ReadCloser, error) {
+	contents, ok := f.objects[key]
+	if !ok {
+		return nil, errors.New("no such key")
+	}
+	return ioutil.NopCloser(bytes.NewBufferString(contents)), nil
+}
+
+func gzipped(s string) string {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	w.Write([]byte(s))
+	w.Close()
+	return buf.String()
+}
+
+func newTestInput(t *testing.T, store *fakeStore) (*CloudFileInput, func()) {
+	tmpDir, err := ioutil.TempDir("", "cloudfile-tests")
+	if err != nil {
+		t.Fatal(err)
+	}
+	globals := pipeline.DefaultGlobals()
+	globals.BaseDir = tmpDir
+	c := &CloudFileInput{store: store}
+	c.SetName("archive")
+	c.SetPipelineConfig(pipeline.NewPipelineConfig(globals))
+	config := c.ConfigStruct().(*CloudFileInputConfig)
+	config.Bucket = "logs"
+	if err = c.Init(config); err != nil {
+		t.Fatal(err)
+	}
+	return c, func() { os.RemoveAll(tmpDir) }
+}
+
+func TestInputConfig(t *testing.T) {
+	c := new(CloudFileInput)
+	c.SetPipelineConfig(pipeline.NewPipelineConfig(nil))
+	config := c.ConfigStruct().(*CloudFileInputConfig)
+	if err := c.Init(config); err == nil || err.Error() != "bucket must be specified" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	config.Bucket = "logs"
+	config.Provider = "gcs"
+	if err := c.Init(config); err == nil {
+		t.Error("gcs accepted without an HMAC key")
+	}
+	config.Provider = "s3"
+	config.Compression = "lz4"
+	if err := c.Init(config); err == nil || err.Error() != "invalid compression: lz4" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestInputReadsNewObjects(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	store := &fakeStore{
+		objects: map[string]string{
+			"2015/01.log.gz": gzipped("one\ntwo\n"),
+			"2015/02.log":    "three\nfour",
+			"2015/03.log.gz": "not gzipped",
+			"2015/":          "",
+		},
+		etags: map[string]string{"2015/02.log": "v1"},
+	}
+	c, cleanup := newTestInput(t, store)
+	defer cleanup()
+
+	packSupply := make(chan *pipeline.PipelinePack, 1)
+	packSupply <- pipeline.NewPipelinePack(packSupply)
+	ir := pipelinemock.NewMockInputRunner(ctrl)
+	ir.EXPECT().InChan().Return(packSupply).AnyTimes()
+	ir.EXPECT().LogError(gomock.Any()).AnyTimes()
+	var payloads []string
+	ir.EXPECT().Deliver(gomock.Any()).AnyTimes().Do(func(pack *pipeline.PipelinePack) {
+		key, _ := pack.Message.GetFieldValue("Key")
+		payloads = append(payloads, key.(string)+":"+pack.Message.GetPayload())
+		pack.Recycle()
+	})
+
+	c.poll(ir)
+	expected := []string{"2015/01.log.gz:one\n", "2015/01.log.gz:two\n",
+		"2015/02.log:three\n", "2015/02.log:four"}
+	if len(payloads) != len(expected) {
+		t.Fatalf("Unexpected records: %q", payloads)
+	}
+	for i, payload := range payloads {
+		if payload != expected[i] {
+			t.Errorf("Unexpected record %d: %q", i, payload)
+		}
+	}
+	if c.objectsRead != 2 || c.objectFailures != 1 {
+		t.Errorf("Unexpected counts: %d read, %d failures", c.objectsRead,
+			c.objectFailures)
+	}
+
+	// Only objects that are new or overwritten are read again, and deleted
+	// ones are forgotten.
+	payloads = nil
+	delete(store.objects, "2015/01.log.gz")
+	store.objects["2015/03.log.gz"] = gzipped("five\n")
+	store.etags["2015/02.log"] = "v2"
+	c.poll(ir)
+	if len(payloads) != 3 || payloads[2] != "2015/03.log.gz:five\n" {
+		t.Errorf("Unexpected records: %q", payloads)
+	}
+	manifest, err := loadManifest(c.manifest.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.objects) != 2 || !manifest.has("2015/02.log", "v2") ||
+		manifest.has("2015/01.log.gz", "") {
+
+		t.Errorf("Unexpected manifest: %v", manifest.objects)
+	}
+}
+
+func TestInputReadsJSONArrays(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	store := &fakeStore{
+		objects: map[string]string{
+			"a.json.gz": gzipped(`{"Other": {"Records": [1]}, "Records": [` +
+				`{"eventName": "GetObject"}, {"eventName": "PutObject", "x": [1, 2]}]}`),
+			"b.json": `[1, "two"]`,
+			"c.json": `{"Other": []}`,
+			"d.json": `"not an array"`,
+		},
+	}
+	c, cleanup := newTestInput(t, store)
+	defer cleanup()
+	c.conf.ParserType = "json_array"
+
+	packSupply := make(chan *pipeline.PipelinePack, 1)
+	packSupply <- pipeline.NewPipelinePack(packSupply)
+	ir := pipelinemock.NewMockInputRunner(ctrl)
+	ir.EXPECT().InChan().Return(packSupply).AnyTimes()
+	ir.EXPECT().LogError(gomock.Any()).AnyTimes()
+	var payloads []string
+	ir.EXPECT().Deliver(gomock.Any()).AnyTimes().Do(func(pack *pipeline.PipelinePack) {
+		payloads = append(payloads, pack.Message.GetPayload())
+		pack.Recycle()
+	})
+
+	c.poll(ir)
+	expected := []string{`{"eventName": "GetObject"}`,
+		`{"eventName": "PutObject", "x": [1, 2]}`, "1", `"two"`}
+	if len(payloads) != len(expected) {
+		t.Fatalf("Unexpected records: %q", payloads)
+	}
+	for i, payload := range payloads {
+		if payload != expected[i] {
+			t.Errorf("Unexpected record %d: %q", i, payload)
+		}
+	}
+	if c.objectsRead != 3 || c.objectFailures != 1 {
+		t.Errorf("Unexpected counts: %d read, %d failures", c.objectsRead,
+			c.objectFailures)
+	}
+}
@@ -0,0 +1,82 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package cloudfile
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Persisted record of the objects that have been read, mapping each key to
+// the ETag of the version read, so only new or overwritten objects are read.
+type manifest struct {
+	path    string
+	objects map[string]string
+}
+
+func loadManifest(path string) (*manifest, error) {
+	m := &manifest{path: path, objects: make(map[string]string)}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return m, os.MkdirAll(filepath.Dir(path), 0755)
+	} else if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(data, &m.objects); err != nil {
+		return nil, fmt.Errorf("corrupt manifest %s: %s", path, err)
+	}
+	return m, nil
+}
+
+// Whether the specified version of an object has been read.
+func (m *manifest) has(key, etag string) bool {
+	read, ok := m.objects[key]
+	return ok && read == etag
+}
+
+// Records that a version of an object has been read and saves the manifest.
+func (m *manifest) add(key, etag string) error {
+	m.objects[key] = etag
+	return m.save()
+}
+
+// Forgets the objects that are no longer listed, so the manifest doesn't grow
+// forever when old objects are deleted or expire.
+func (m *manifest) prune(listed map[string]bool) error {
+	pruned := false
+	for key := range m.objects {
+		if !listed[key] {
+			delete(m.objects, key)
+			pruned = true
+		}
+	}
+	if !pruned {
+		return nil
+	}
+	return m.save()
+}
+
+// Rewrites the whole file, replacing it atomically.
+func (m *manifest) save() error {
+	data, err := json.Marshal(m.objects)
+	if err != nil {
+		return err
+	}
+	tmpPath := m.path + ".tmp"
+	if err = ioutil.WriteFile(tmpPath, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, m.path)
+}
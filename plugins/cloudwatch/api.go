@@ -0,0 +1,73 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package cloudwatch
+
+import (
+	"github.com/mozilla-services/heka/plugins/aws"
+)
+
+// The CloudWatch Logs API calls the input uses, faked in tests.
+type logsAPI interface {
+	FilterLogEvents(in *FilterLogEventsInput) (*FilterLogEventsOutput, error)
+}
+
+type FilterLogEventsInput struct {
+	LogGroupName   string   `json:"logGroupName"`
+	LogStreamNames []string `json:"logStreamNames,omitempty"`
+	FilterPattern  string   `json:"filterPattern,omitempty"`
+	// Milliseconds since the epoch.
+	StartTime int64  `json:"startTime,omitempty"`
+	EndTime   int64  `json:"endTime,omitempty"`
+	NextToken string `json:"nextToken,omitempty"`
+	Limit     int    `json:"limit,omitempty"`
+}
+
+// A log event, as returned by FilterLogEvents and sent to subscriptions.
+type LogEvent struct {
+	EventId       string `json:"eventId"`
+	LogStreamName string `json:"logStreamName"`
+	// Milliseconds since the epoch.
+	Timestamp     int64  `json:"timestamp"`
+	IngestionTime int64  `json:"ingestionTime"`
+	Message       string `json:"message"`
+}
+
+type FilterLogEventsOutput struct {
+	Events    []LogEvent `json:"events"`
+	NextToken string     `json:"nextToken"`
+}
+
+// logsAPI implementation using the CloudWatch Logs JSON API.
+type logsClient struct {
+	client *aws.Client
+}
+
+func newLogsClient(region, endpoint string, creds aws.CredentialsProvider) (*logsClient,
+	error) {
+
+	client, err := aws.NewClient("logs", region, endpoint, "Logs_20140328",
+		"application/x-amz-json-1.1", creds)
+	if err != nil {
+		return nil, err
+	}
+	return &logsClient{client}, nil
+}
+
+func (l *logsClient) FilterLogEvents(in *FilterLogEventsInput) (*FilterLogEventsOutput,
+	error) {
+
+	out := new(FilterLogEventsOutput)
+	if err := l.client.Call("FilterLogEvents", in, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
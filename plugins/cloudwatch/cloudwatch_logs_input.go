@@ -0,0 +1,282 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package cloudwatch
+
+import (
+	"code.google.com/p/go-uuid/uuid"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+	"github.com/mozilla-services/heka/pipeline"
+	"github.com/mozilla-services/heka/plugins/aws"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Fills a message with a log event of a log group.
+func fillLogEvent(m *message.Message, logGroup string, ev *LogEvent) {
+	m.SetUuid(uuid.NewRandom())
+	m.SetTimestamp(ev.Timestamp * int64(time.Millisecond))
+	m.SetType("heka.cloudwatch.logs")
+	m.SetPayload(ev.Message)
+	message.NewStringField(m, "LogGroup", logGroup)
+	message.NewStringField(m, "LogStream", ev.LogStreamName)
+	message.NewStringField(m, "EventId", ev.EventId)
+	if ev.IngestionTime > 0 {
+		message.NewInt64Field(m, "IngestionTime", ev.IngestionTime*int64(time.Millisecond),
+			"ns")
+	}
+}
+
+type CloudWatchLogsInputConfig struct {
+	LogGroup string `toml:"log_group"`
+	// Only the events of these log streams are read, all of them if empty.
+	LogStreams []string `toml:"log_streams"`
+	// CloudWatch Logs filter pattern the events must match.
+	FilterPattern string `toml:"filter_pattern"`
+	Region        string
+	Endpoint      string
+	// Credentials, if not taken from the environment or the instance's IAM
+	// role.
+	AccessKeyID     string `toml:"access_key_id"`
+	SecretAccessKey string `toml:"secret_access_key"`
+	SessionToken    string `toml:"session_token"`
+	// Seconds between polls.
+	TickerInterval uint `toml:"ticker_interval"`
+	// How far back the first poll starts, e.g. "24h", when there's no
+	// checkpoint yet.
+	InitialLookback string `toml:"initial_lookback"`
+	// How far behind the newest event read each poll starts, so events
+	// ingested late are still read.
+	LateEventWindow string `toml:"late_event_window"`
+}
+
+// Position of the input in the log group, saved after each poll.
+type logsCheckpoint struct {
+	// Timestamp of the newest event read, in milliseconds.
+	Newest int64 `json:"newest"`
+	// Timestamps of the events read within the late event window, by event
+	// ID, so they're not read twice.
+	Seen map[string]int64 `json:"seen"`
+}
+
+// Polls a CloudWatch Logs log group with FilterLogEvents, delivering each log
+// event once. The events read are checkpointed in a file in the base_dir, so
+// the input resumes where it left off.
+type CloudWatchLogsInput struct {
+	eventsRead int64
+	pollErrors int64
+
+	conf           *CloudWatchLogsInputConfig
+	api            logsAPI
+	checkpoint     *logsCheckpoint
+	checkpointPath string
+	lookback       time.Duration
+	window         time.Duration
+	pConfig        *pipeline.PipelineConfig
+	name           string
+	stopChan       chan struct{}
+	stopLock       sync.Mutex
+	stopped        bool
+	// Swapped out in tests.
+	now func() time.Time
+}
+
+func (c *CloudWatchLogsInput) ConfigStruct() interface{} {
+	return &CloudWatchLogsInputConfig{
+		TickerInterval:  10,
+		InitialLookback: "0s",
+		LateEventWindow: "5m",
+	}
+}
+
+func (c *CloudWatchLogsInput) SetPipelineConfig(pConfig *pipeline.PipelineConfig) {
+	c.pConfig = pConfig
+}
+
+func (c *CloudWatchLogsInput) SetName(name string) {
+	c.name = name
+}
+
+func (c *CloudWatchLogsInput) Init(config interface{}) (err error) {
+	c.conf = config.(*CloudWatchLogsInputConfig)
+	if c.conf.LogGroup == "" {
+		return errors.New("log_group must be specified")
+	}
+	if c.lookback, err = time.ParseDuration(c.conf.InitialLookback); err != nil {
+		return fmt.Errorf("invalid initial_lookback: %s", err)
+	}
+	if c.window, err = time.ParseDuration(c.conf.LateEventWindow); err != nil {
+		return fmt.Errorf("invalid late_event_window: %s", err)
+	}
+	if c.api == nil {
+		creds := aws.NewCredentialsProvider(c.conf.AccessKeyID, c.conf.SecretAccessKey,
+			c.conf.SessionToken)
+		if c.api, err = newLogsClient(c.conf.Region, c.conf.Endpoint, creds); err != nil {
+			return
+		}
+	}
+	if c.now == nil {
+		c.now = time.Now
+	}
+	c.checkpointPath = c.pConfig.Globals.PrependBaseDir(filepath.Join("cloudwatch",
+		c.name+".json"))
+	return c.loadCheckpoint()
+}
+
+func (c *CloudWatchLogsInput) loadCheckpoint() error {
+	c.checkpoint = &logsCheckpoint{Seen: make(map[string]int64)}
+	data, err := ioutil.ReadFile(c.checkpointPath)
+	if os.IsNotExist(err) {
+		c.checkpoint.Newest = c.now().Add(-c.lookback).UnixNano() / int64(time.Millisecond)
+		return os.MkdirAll(filepath.Dir(c.checkpointPath), 0755)
+	} else if err != nil {
+		return err
+	}
+	if err = json.Unmarshal(data, c.checkpoint); err != nil {
+		return fmt.Errorf("corrupt checkpoint file %s: %s", c.checkpointPath, err)
+	}
+	if c.checkpoint.Seen == nil {
+		c.checkpoint.Seen = make(map[string]int64)
+	}
+	return nil
+}
+
+// Rewrites the whole file, replacing it atomically.
+func (c *CloudWatchLogsInput) saveCheckpoint() error {
+	data, err := json.Marshal(c.checkpoint)
+	if err != nil {
+		return err
+	}
+	tmpPath := c.checkpointPath + ".tmp"
+	if err = ioutil.WriteFile(tmpPath, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, c.checkpointPath)
+}
+
+func (c *CloudWatchLogsInput) Run(ir pipeline.InputRunner, h pipeline.PluginHelper) error {
+	c.stopLock.Lock()
+	c.stopChan = make(chan struct{})
+	c.stopped = false
+	c.stopLock.Unlock()
+
+	ticker := ir.Ticker()
+	for {
+		ok := c.poll(ir)
+		if err := c.saveCheckpoint(); err != nil {
+			ir.LogError(fmt.Errorf("can't save the checkpoint: %s", err))
+		}
+		if !ok {
+			return nil
+		}
+		select {
+		case <-ticker:
+		case <-c.stopChan:
+			return nil
+		}
+	}
+}
+
+// Reads the events since the newest one read, less the late event window,
+// skipping those already read. Returns false if the input is stopped in the
+// meantime.
+func (c *CloudWatchLogsInput) poll(ir pipeline.InputRunner) bool {
+	cp := c.checkpoint
+	windowMs := int64(c.window / time.Millisecond)
+	in := &FilterLogEventsInput{
+		LogGroupName:   c.conf.LogGroup,
+		LogStreamNames: c.conf.LogStreams,
+		FilterPattern:  c.conf.FilterPattern,
+		StartTime:      cp.Newest - windowMs,
+	}
+	if in.StartTime < 0 {
+		in.StartTime = 0
+	}
+	for {
+		out, err := c.api.FilterLogEvents(in)
+		if err != nil {
+			atomic.AddInt64(&c.pollErrors, 1)
+			ir.LogError(fmt.Errorf("can't read log group %s, will retry: %s",
+				c.conf.LogGroup, err))
+			break
+		}
+		for i := range out.Events {
+			ev := &out.Events[i]
+			if _, ok := cp.Seen[ev.EventId]; ok {
+				continue
+			}
+			if !c.deliver(ir, ev) {
+				return false
+			}
+			cp.Seen[ev.EventId] = ev.Timestamp
+			if ev.Timestamp > cp.Newest {
+				cp.Newest = ev.Timestamp
+			}
+		}
+		if out.NextToken == "" {
+			break
+		}
+		in.NextToken = out.NextToken
+	}
+	// Only the events that will be read again need to be remembered.
+	for id, ts := range cp.Seen {
+		if ts < cp.Newest-windowMs {
+			delete(cp.Seen, id)
+		}
+	}
+	return true
+}
+
+// Hands an event on, returning false if the input is stopped while waiting
+// for a pack.
+func (c *CloudWatchLogsInput) deliver(ir pipeline.InputRunner, ev *LogEvent) bool {
+	var pack *pipeline.PipelinePack
+	select {
+	case pack = <-ir.InChan():
+	case <-c.stopChan:
+		return false
+	}
+	fillLogEvent(pack.Message, c.conf.LogGroup, ev)
+	pack.Message.SetLogger(c.name)
+	pack.Message.SetHostname(c.pConfig.Hostname())
+	ir.Deliver(pack)
+	atomic.AddInt64(&c.eventsRead, 1)
+	return true
+}
+
+// Also called by Run when it fails, so may be called twice.
+func (c *CloudWatchLogsInput) Stop() {
+	c.stopLock.Lock()
+	defer c.stopLock.Unlock()
+	if !c.stopped && c.stopChan != nil {
+		c.stopped = true
+		close(c.stopChan)
+	}
+}
+
+func (c *CloudWatchLogsInput) ReportMsg(msg *message.Message) error {
+	message.NewInt64Field(msg, "EventsRead", atomic.LoadInt64(&c.eventsRead), "count")
+	message.NewInt64Field(msg, "PollErrors", atomic.LoadInt64(&c.pollErrors), "count")
+	return nil
+}
+
+func init() {
+	pipeline.RegisterPlugin("CloudWatchLogsInput", func() interface{} {
+		return new(CloudWatchLogsInput)
+	})
+}
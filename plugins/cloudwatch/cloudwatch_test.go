@@ -0,0 +1,259 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package cloudwatch
+
+import (
+	"bytes"
+	"compress/gzip"
+	"github.com/mozilla-services/heka/pipeline"
+	"github.com/mozilla-services/heka/pipelinemock"
+	"github.com/rafrombrc/gomock/gomock"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+// CloudWatch Logs API fake, returning the events after the start time, a
+// page per event.
+type fakeLogs struct {
+	events []LogEvent
+	starts []int64
+}
+
+func (f *fakeLogs) FilterLogEvents(in *FilterLogEventsInput) (*FilterLogEventsOutput,
+	error) {
+
+	if in.NextToken == "" {
+		f.starts = append(f.starts, in.StartTime)
+	}
+	out := new(FilterLogEventsOutput)
+	for i, ev := range f.events {
+		if ev.Timestamp < in.StartTime || ev.EventId <= in.NextToken {
+			continue
+		}
+		out.Events = []LogEvent{ev}
+		if i < len(f.events)-1 {
+			out.NextToken = ev.EventId
+		}
+		break
+	}
+	return out, nil
+}
+
+func newTestInput(t *testing.T, api logsAPI, baseDir string) *CloudWatchLogsInput {
+	globals := pipeline.DefaultGlobals()
+	globals.BaseDir = baseDir
+	c := &CloudWatchLogsInput{api: api}
+	c.now = func() time.Time { return time.Unix(1000, 0) }
+	c.SetName("cwlogs")
+	c.SetPipelineConfig(pipeline.NewPipelineConfig(globals))
+	config := c.ConfigStruct().(*CloudWatchLogsInputConfig)
+	config.LogGroup = "app"
+	config.InitialLookback = "10s"
+	config.LateEventWindow = "1s"
+	if err := c.Init(config); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestInputConfig(t *testing.T) {
+	c := &CloudWatchLogsInput{api: new(fakeLogs)}
+	c.SetPipelineConfig(pipeline.NewPipelineConfig(nil))
+	config := c.ConfigStruct().(*CloudWatchLogsInputConfig)
+	if err := c.Init(config); err == nil || err.Error() != "log_group must be specified" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	config.LogGroup = "app"
+	config.LateEventWindow = "5"
+	if err := c.Init(config); err == nil {
+		t.Error("Invalid late_event_window accepted")
+	}
+}
+
+func TestInputReadsEventsOnce(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	tmpDir, err := ioutil.TempDir("", "cloudwatch-tests")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	api := &fakeLogs{events: []LogEvent{
+		{EventId: "1", LogStreamName: "a", Timestamp: 994000, Message: "one"},
+		{EventId: "2", LogStreamName: "b", Timestamp: 996000, Message: "two",
+			IngestionTime: 996500},
+	}}
+	c := newTestInput(t, api, tmpDir)
+
+	packSupply := make(chan *pipeline.PipelinePack, 1)
+	packSupply <- pipeline.NewPipelinePack(packSupply)
+	ir := pipelinemock.NewMockInputRunner(ctrl)
+	ir.EXPECT().InChan().Return(packSupply).AnyTimes()
+	var payloads []string
+	ir.EXPECT().Deliver(gomock.Any()).AnyTimes().Do(func(pack *pipeline.PipelinePack) {
+		msg := pack.Message
+		payloads = append(payloads, msg.GetPayload())
+		if msg.GetPayload() == "two" {
+			stream, _ := msg.GetFieldValue("LogStream")
+			ingested, _ := msg.GetFieldValue("IngestionTime")
+			if msg.GetTimestamp() != 996*int64(time.Second) || stream != "b" ||
+				ingested != 996500*int64(time.Millisecond) ||
+				msg.GetType() != "heka.cloudwatch.logs" {
+
+				t.Errorf("Unexpected message: %v", msg)
+			}
+		}
+		pack.Recycle()
+	})
+
+	c.poll(ir)
+	if len(payloads) != 2 || api.starts[0] != 989000 {
+		t.Fatalf("Unexpected events: %q, starting at %v", payloads, api.starts)
+	}
+	if err = c.saveCheckpoint(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A late event within the window is read, the events already read aren't,
+	// and those out of the window are forgotten.
+	api.events = append(api.events, LogEvent{EventId: "3", Timestamp: 995500,
+		Message: "late"})
+	c = newTestInput(t, api, tmpDir)
+	payloads = nil
+	c.poll(ir)
+	if len(payloads) != 1 || payloads[0] != "late" || api.starts[1] != 995000 {
+		t.Errorf("Unexpected events: %q, starting at %v", payloads, api.starts)
+	}
+	if _, ok := c.checkpoint.Seen["1"]; ok || len(c.checkpoint.Seen) != 2 {
+		t.Errorf("Unexpected events remembered: %v", c.checkpoint.Seen)
+	}
+}
+
+func gzipped(s string) string {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	w.Write([]byte(s))
+	w.Close()
+	return buf.String()
+}
+
+func TestCloudWatchLogsDecoder(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	pConfig := pipeline.NewPipelineConfig(nil)
+	dRunner := pipelinemock.NewMockDecoderRunner(ctrl)
+	dRunner.EXPECT().NewPack().Return(pipeline.NewPipelinePack(nil))
+	d := new(CloudWatchLogsDecoder)
+	d.SetDecoderRunner(dRunner)
+	d.SetPipelineConfig(pConfig)
+
+	pack := pipeline.NewPipelinePack(nil)
+	pack.Message.SetHostname("kinesis-host")
+	pack.Message.SetPayload(gzipped(`{"messageType": "DATA_MESSAGE", ` +
+		`"owner": "123456789012", "logGroup": "app", "logStream": "web", ` +
+		`"subscriptionFilters": ["all"], "logEvents": [` +
+		`{"id": "e1", "timestamp": 1420070400000, "message": "first"}, ` +
+		`{"id": "e2", "timestamp": 1420070401000, "message": "second"}]}`))
+	packs, err := d.Decode(pack)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(packs) != 2 || packs[0] != pack {
+		t.Fatalf("Unexpected packs: %v", packs)
+	}
+	for i, expected := range []string{"first", "second"} {
+		msg := packs[i].Message
+		group, _ := msg.GetFieldValue("LogGroup")
+		owner, _ := msg.GetFieldValue("Owner")
+		if msg.GetPayload() != expected || group != "app" || owner != "123456789012" ||
+			msg.GetHostname() != "kinesis-host" ||
+			msg.GetTimestamp() != (1420070400+int64(i))*int64(time.Second) {
+
+			t.Errorf("Unexpected message %d: %v", i, msg)
+		}
+	}
+
+	pack = pipeline.NewPipelinePack(nil)
+	pack.Message.SetPayload(`{"messageType": "CONTROL_MESSAGE", "logEvents": [` +
+		`{"id": "", "timestamp": 1420070400000, "message": "CWL CONTROL MESSAGE"}]}`)
+	if packs, err = d.Decode(pack); err != nil || packs != nil {
+		t.Errorf("Control message decoded: %v, %v", packs, err)
+	}
+}
+
+func TestCloudTrailDecoder(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	dRunner := pipelinemock.NewMockDecoderRunner(ctrl)
+	dRunner.EXPECT().NewPack().Return(pipeline.NewPipelinePack(nil))
+	d := new(CloudTrailDecoder)
+	d.SetDecoderRunner(dRunner)
+	d.SetPipelineConfig(pipeline.NewPipelineConfig(nil))
+
+	record := `{"eventVersion": "1.05", "eventTime": "2015-01-01T00:00:00Z", ` +
+		`"eventSource": "s3.amazonaws.com", "eventName": "GetObject", ` +
+		`"awsRegion": "us-east-1", "sourceIPAddress": "10.0.0.1", ` +
+		`"userIdentity": {"type": "IAMUser", "arn": "arn:aws:iam::1:user/ops", ` +
+		`"accountId": "1", "userName": "ops"}, "readOnly": true, ` +
+		`"errorCode": "AccessDenied"}`
+	pack := pipeline.NewPipelinePack(nil)
+	pack.Message.SetPayload(`{"Records": [` + record + `, {"eventName": "PutObject", ` +
+		`"readOnly": "false"}]}`)
+	packs, err := d.Decode(pack)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(packs) != 2 {
+		t.Fatalf("Unexpected packs: %v", packs)
+	}
+	msg := packs[0].Message
+	fields := map[string]interface{}{
+		"EventName":        "GetObject",
+		"EventSource":      "s3.amazonaws.com",
+		"AwsRegion":        "us-east-1",
+		"SourceIPAddress":  "10.0.0.1",
+		"UserIdentityType": "IAMUser",
+		"UserIdentityArn":  "arn:aws:iam::1:user/ops",
+		"UserName":         "ops",
+		"ErrorCode":        "AccessDenied",
+		"ReadOnly":         true,
+	}
+	for name, expected := range fields {
+		if value, _ := msg.GetFieldValue(name); value != expected {
+			t.Errorf("Unexpected %s: %v", name, value)
+		}
+	}
+	if msg.GetTimestamp() != 1420070400*int64(time.Second) ||
+		msg.GetType() != "heka.cloudtrail" || msg.GetPayload() != record {
+
+		t.Errorf("Unexpected message: %v", msg)
+	}
+	if readOnly, _ := packs[1].Message.GetFieldValue("ReadOnly"); readOnly != false {
+		t.Errorf("Unexpected ReadOnly: %v", readOnly)
+	}
+
+	// Single records are decoded into the pack itself.
+	pack = pipeline.NewPipelinePack(nil)
+	pack.Message.SetPayload(record)
+	if packs, err = d.Decode(pack); err != nil || len(packs) != 1 || packs[0] != pack {
+		t.Errorf("Unexpected result: %v, %v", packs, err)
+	}
+	pack.Message.SetPayload(`{"eventVersion": "1.05"}`)
+	if _, err = d.Decode(pack); err == nil {
+		t.Error("Record without an eventName decoded")
+	}
+}
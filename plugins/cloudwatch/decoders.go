@@ -0,0 +1,256 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package cloudwatch
+
+import (
+	"bytes"
+	"code.google.com/p/go-uuid/uuid"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+	"github.com/mozilla-services/heka/pipeline"
+	"io/ioutil"
+	"time"
+)
+
+// Returns the packs for the messages decoded from a pack: the pack itself,
+// followed by new packs holding copies of its message. Fails rather than
+// waiting forever when the input pool couldn't possibly supply enough packs.
+func splitPack(pack *pipeline.PipelinePack, n int, dr pipeline.DecoderRunner,
+	pConfig *pipeline.PipelineConfig) ([]*pipeline.PipelinePack, error) {
+
+	if n == 1 {
+		return []*pipeline.PipelinePack{pack}, nil
+	}
+	if dr == nil || pConfig == nil {
+		return nil, fmt.Errorf("can't decode %d messages from a single one", n)
+	}
+	if n > cap(pConfig.InputRecycleChan())/2 {
+		return nil, fmt.Errorf("%d messages exceed half the pool size of %d", n,
+			cap(pConfig.InputRecycleChan()))
+	}
+	packs := make([]*pipeline.PipelinePack, n)
+	packs[0] = pack
+	for i := 1; i < n; i++ {
+		packs[i] = dr.NewPack()
+		packs[i].MsgLoopCount = pack.MsgLoopCount
+		pack.Message.Copy(packs[i].Message)
+	}
+	return packs, nil
+}
+
+// CloudWatch Logs subscription data, as delivered through Kinesis.
+type subscriptionData struct {
+	MessageType string `json:"messageType"`
+	Owner       string `json:"owner"`
+	LogGroup    string `json:"logGroup"`
+	LogStream   string `json:"logStream"`
+	LogEvents   []struct {
+		Id        string `json:"id"`
+		Timestamp int64  `json:"timestamp"`
+		Message   string `json:"message"`
+	} `json:"logEvents"`
+}
+
+// Decodes the CloudWatch Logs subscription data in the payload, gzipped or
+// not, into a message per log event, so log groups subscribed to a Kinesis
+// stream can be read with a KinesisInput. The fields of the original message
+// are kept.
+type CloudWatchLogsDecoder struct {
+	dRunner pipeline.DecoderRunner
+	pConfig *pipeline.PipelineConfig
+}
+
+func (d *CloudWatchLogsDecoder) Init(config interface{}) error {
+	return nil
+}
+
+func (d *CloudWatchLogsDecoder) SetDecoderRunner(dr pipeline.DecoderRunner) {
+	d.dRunner = dr
+}
+
+func (d *CloudWatchLogsDecoder) SetPipelineConfig(pConfig *pipeline.PipelineConfig) {
+	d.pConfig = pConfig
+}
+
+func (d *CloudWatchLogsDecoder) Decode(pack *pipeline.PipelinePack) (
+	packs []*pipeline.PipelinePack, err error) {
+
+	data := []byte(pack.Message.GetPayload())
+	if len(data) > 1 && data[0] == 0x1f && data[1] == 0x8b {
+		var gz *gzip.Reader
+		if gz, err = gzip.NewReader(bytes.NewReader(data)); err != nil {
+			return nil, err
+		}
+		if data, err = ioutil.ReadAll(gz); err != nil {
+			return nil, fmt.Errorf("can't gunzip the subscription data: %s", err)
+		}
+	}
+	sub := new(subscriptionData)
+	if err = json.Unmarshal(data, sub); err != nil {
+		return nil, fmt.Errorf("invalid subscription data: %s", err)
+	}
+	if sub.MessageType == "CONTROL_MESSAGE" || len(sub.LogEvents) == 0 {
+		// Sent by CloudWatch Logs to check the stream is writable.
+		pack.Recycle()
+		return nil, nil
+	}
+	if packs, err = splitPack(pack, len(sub.LogEvents), d.dRunner, d.pConfig); err != nil {
+		return nil, err
+	}
+	for i, e := range sub.LogEvents {
+		m := packs[i].Message
+		fillLogEvent(m, sub.LogGroup, &LogEvent{
+			EventId:       e.Id,
+			LogStreamName: sub.LogStream,
+			Timestamp:     e.Timestamp,
+			Message:       e.Message,
+		})
+		message.NewStringField(m, "Owner", sub.Owner)
+	}
+	return packs, nil
+}
+
+// A CloudTrail record, only holding the normalized values.
+type cloudTrailRecord struct {
+	EventTime    string `json:"eventTime"`
+	EventName    string `json:"eventName"`
+	EventSource  string `json:"eventSource"`
+	EventType    string `json:"eventType"`
+	EventID      string `json:"eventID"`
+	AwsRegion    string `json:"awsRegion"`
+	SourceIP     string `json:"sourceIPAddress"`
+	UserAgent    string `json:"userAgent"`
+	ErrorCode    string `json:"errorCode"`
+	ErrorMessage string `json:"errorMessage"`
+	// A boolean, or a string in older records.
+	ReadOnly     interface{} `json:"readOnly"`
+	Recipient    string      `json:"recipientAccountId"`
+	UserIdentity struct {
+		Type      string `json:"type"`
+		Arn       string `json:"arn"`
+		AccountId string `json:"accountId"`
+		UserName  string `json:"userName"`
+	} `json:"userIdentity"`
+}
+
+// Decodes CloudTrail records into messages with typed fields. The payload is
+// either a single record, as delivered by a CloudFileInput with the
+// `json_array` parser or a CloudWatch Logs subscription, or a whole CloudTrail
+// log file, decoded into a message per record.
+type CloudTrailDecoder struct {
+	dRunner pipeline.DecoderRunner
+	pConfig *pipeline.PipelineConfig
+}
+
+func (d *CloudTrailDecoder) Init(config interface{}) error {
+	return nil
+}
+
+func (d *CloudTrailDecoder) SetDecoderRunner(dr pipeline.DecoderRunner) {
+	d.dRunner = dr
+}
+
+func (d *CloudTrailDecoder) SetPipelineConfig(pConfig *pipeline.PipelineConfig) {
+	d.pConfig = pConfig
+}
+
+func (d *CloudTrailDecoder) Decode(pack *pipeline.PipelinePack) (
+	packs []*pipeline.PipelinePack, err error) {
+
+	payload := []byte(pack.Message.GetPayload())
+	var file struct {
+		Records []json.RawMessage
+	}
+	if err = json.Unmarshal(payload, &file); err != nil {
+		return nil, fmt.Errorf("invalid CloudTrail record: %s", err)
+	}
+	records := file.Records
+	if records == nil {
+		records = []json.RawMessage{payload}
+	} else if len(records) == 0 {
+		pack.Recycle()
+		return nil, nil
+	}
+	if packs, err = splitPack(pack, len(records), d.dRunner, d.pConfig); err != nil {
+		return nil, err
+	}
+	for i, raw := range records {
+		if err = fillCloudTrailRecord(packs[i].Message, raw); err != nil {
+			for _, p := range packs[1:] {
+				p.Recycle()
+			}
+			return nil, err
+		}
+	}
+	return packs, nil
+}
+
+func fillCloudTrailRecord(m *message.Message, raw []byte) error {
+	r := new(cloudTrailRecord)
+	if err := json.Unmarshal(raw, r); err != nil {
+		return fmt.Errorf("invalid CloudTrail record: %s", err)
+	}
+	if r.EventName == "" {
+		return fmt.Errorf("CloudTrail record has no eventName")
+	}
+	if t, err := time.Parse(time.RFC3339, r.EventTime); err == nil {
+		m.SetTimestamp(t.UnixNano())
+	}
+	m.SetUuid(uuid.NewRandom())
+	m.SetType("heka.cloudtrail")
+	m.SetPayload(string(raw))
+	strs := []struct{ name, value string }{
+		{"EventName", r.EventName},
+		{"EventSource", r.EventSource},
+		{"EventType", r.EventType},
+		{"EventID", r.EventID},
+		{"AwsRegion", r.AwsRegion},
+		{"SourceIPAddress", r.SourceIP},
+		{"UserAgent", r.UserAgent},
+		{"ErrorCode", r.ErrorCode},
+		{"ErrorMessage", r.ErrorMessage},
+		{"RecipientAccountId", r.Recipient},
+		{"UserIdentityType", r.UserIdentity.Type},
+		{"UserIdentityArn", r.UserIdentity.Arn},
+		{"UserIdentityAccountId", r.UserIdentity.AccountId},
+		{"UserName", r.UserIdentity.UserName},
+	}
+	for _, s := range strs {
+		if s.value != "" {
+			message.NewStringField(m, s.name, s.value)
+		}
+	}
+	var readOnly interface{}
+	switch v := r.ReadOnly.(type) {
+	case bool:
+		readOnly = v
+	case string:
+		readOnly = v == "true"
+	}
+	if readOnly != nil {
+		if f, err := message.NewField("ReadOnly", readOnly, ""); err == nil {
+			m.AddField(f)
+		}
+	}
+	return nil
+}
+
+func init() {
+	pipeline.RegisterPlugin("CloudWatchLogsDecoder", func() interface{} {
+		return new(CloudWatchLogsDecoder)
+	})
+	pipeline.RegisterPlugin("CloudTrailDecoder", func() interface{} {
+		return new(CloudTrailDecoder)
+	})
+}
@@ -0,0 +1,131 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package plugins
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Maps message values to the columns of a database table, for outputs
+// writing rows rather than encoded messages.
+type ColumnMapping struct {
+	// Column names, sorted, in the order of the values.
+	Names   []string
+	columns []mappedColumn
+}
+
+// Source of a column's values.
+type mappedColumn struct {
+	header string // Header name, "Fields", or "" for a single field.
+	field  string
+}
+
+var mappingHeaders = map[string]bool{"Uuid": true, "Timestamp": true, "Type": true,
+	"Logger": true, "Severity": true, "Payload": true, "EnvVersion": true,
+	"Pid": true, "Hostname": true, "Fields": true}
+
+// Returns the mapping of the message values written to each column, by
+// column name: a header name ("Uuid", "Timestamp", "Type", "Logger",
+// "Severity", "Payload", "EnvVersion", "Pid", or "Hostname"), "Fields[name]"
+// for the value of a dynamic field, or "Fields" for all of them as a JSON
+// object.
+func NewColumnMapping(sources map[string]string) (*ColumnMapping, error) {
+	cm := &ColumnMapping{Names: make([]string, 0, len(sources))}
+	for name := range sources {
+		cm.Names = append(cm.Names, name)
+	}
+	sort.Strings(cm.Names)
+	cm.columns = make([]mappedColumn, len(cm.Names))
+	for i, name := range cm.Names {
+		source := sources[name]
+		switch {
+		case mappingHeaders[source]:
+			cm.columns[i].header = source
+		case strings.HasPrefix(source, "Fields[") && strings.HasSuffix(source, "]"):
+			cm.columns[i].field = source[len("Fields[") : len(source)-1]
+		default:
+			return nil, fmt.Errorf("invalid source for column '%s': %s", name, source)
+		}
+	}
+	return cm, nil
+}
+
+// Returns a message's values for the columns: strings for the string
+// headers and "Fields", a UTC time.Time for Timestamp, int64s for Severity
+// and Pid, and the first value of dynamic fields, nil if the message doesn't
+// have the field.
+func (cm *ColumnMapping) Values(msg *message.Message) []interface{} {
+	values := make([]interface{}, len(cm.columns))
+	for i, col := range cm.columns {
+		switch col.header {
+		case "":
+			if value, ok := msg.GetFieldValue(col.field); ok {
+				values[i] = value
+			}
+		case "Uuid":
+			values[i] = msg.GetUuidString()
+		case "Timestamp":
+			values[i] = time.Unix(0, msg.GetTimestamp()).UTC()
+		case "Type":
+			values[i] = msg.GetType()
+		case "Logger":
+			values[i] = msg.GetLogger()
+		case "Severity":
+			values[i] = int64(msg.GetSeverity())
+		case "Payload":
+			values[i] = msg.GetPayload()
+		case "EnvVersion":
+			values[i] = msg.GetEnvVersion()
+		case "Pid":
+			values[i] = int64(msg.GetPid())
+		case "Hostname":
+			values[i] = msg.GetHostname()
+		case "Fields":
+			values[i] = fieldsJSON(msg)
+		}
+	}
+	return values
+}
+
+// Returns a message's dynamic fields as a JSON object, fields with several
+// values as arrays.
+func fieldsJSON(msg *message.Message) string {
+	fields := make(map[string]interface{}, len(msg.Fields))
+	for _, f := range msg.Fields {
+		var values interface{}
+		switch f.GetValueType() {
+		case message.Field_STRING:
+			values = f.ValueString
+		case message.Field_BYTES:
+			values = f.ValueBytes
+		case message.Field_INTEGER:
+			values = f.ValueInteger
+		case message.Field_DOUBLE:
+			values = f.ValueDouble
+		case message.Field_BOOL:
+			values = f.ValueBool
+		}
+		count := len(f.ValueString) + len(f.ValueBytes) + len(f.ValueInteger) +
+			len(f.ValueDouble) + len(f.ValueBool)
+		if count == 1 {
+			values = f.GetValue()
+		}
+		fields[f.GetName()] = values
+	}
+	data, _ := json.Marshal(fields)
+	return string(data)
+}
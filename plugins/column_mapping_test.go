@@ -0,0 +1,66 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package plugins
+
+import (
+	"github.com/mozilla-services/heka/message"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"time"
+)
+
+func ColumnMappingSpec(c gs.Context) {
+
+	c.Specify("A ColumnMapping", func() {
+		msg := new(message.Message)
+		msg.SetTimestamp(1420070400 * int64(time.Second))
+		msg.SetHostname("web1")
+		msg.SetSeverity(3)
+
+		c.Specify("rejects invalid sources", func() {
+			_, err := NewColumnMapping(map[string]string{"actor": "user"})
+			c.Expect(err.Error(), gs.Equals, "invalid source for column 'actor': user")
+		})
+
+		c.Specify("returns a message's values in column name order", func() {
+			cm, err := NewColumnMapping(map[string]string{
+				"event_time": "Timestamp",
+				"actor":      "Fields[user]",
+				"attrs":      "Fields",
+				"host":       "Hostname",
+				"level":      "Severity",
+			})
+			c.Assume(err, gs.IsNil)
+			c.Expect(len(cm.Names), gs.Equals, 5)
+			c.Expect(cm.Names[0], gs.Equals, "actor")
+
+			message.NewStringField(msg, "user", "alice")
+			field, _ := message.NewField("roles", "admin", "")
+			field.AddValue("ops")
+			msg.AddField(field)
+			values := cm.Values(msg)
+			c.Expect(values[0], gs.Equals, "alice")
+			c.Expect(values[1], gs.Equals, `{"roles":["admin","ops"],"user":"alice"}`)
+			c.Expect(values[2].(time.Time).Equal(time.Unix(1420070400, 0)), gs.IsTrue)
+			c.Expect(values[3], gs.Equals, "web1")
+			c.Expect(values[4], gs.Equals, int64(3))
+		})
+
+		c.Specify("returns nil for missing fields", func() {
+			cm, err := NewColumnMapping(map[string]string{"actor": "Fields[user]",
+				"attrs": "Fields"})
+			c.Assume(err, gs.IsNil)
+			values := cm.Values(msg)
+			c.Expect(values[0], gs.IsNil)
+			c.Expect(values[1], gs.Equals, "{}")
+		})
+	})
+}
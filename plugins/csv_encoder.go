@@ -0,0 +1,209 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package plugins
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/csv"
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+	"github.com/mozilla-services/heka/pipeline"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// CsvEncoder serializes each message to a CSV (or TSV) record, with a column
+// per configured header or field, for spreadsheet style exports.
+type CsvEncoder struct {
+	conf    *CsvEncoderConfig
+	columns []ndjsonColumn
+	comma   rune
+	header  []byte
+}
+
+type CsvEncoderConfig struct {
+	// Message data written, one column each, in order. Each entry is either a
+	// message header name ("Uuid", "Timestamp", "Type", "Logger", "Severity",
+	// "Payload", "EnvVersion", "Pid", or "Hostname") or "Fields[name]" for a
+	// dynamic field. Defaults to "Timestamp", "Type", "Logger", "Severity",
+	// "Hostname", and "Payload".
+	Fields []string
+	// Names of the columns in the header, defaulting to the header names and
+	// the names of the dynamic fields.
+	ColumnNames []string `toml:"column_names"`
+	// Column delimiter, a single character. Defaults to ",", use "\t" for
+	// TSV.
+	Delimiter string
+	// Whether the column names are written at the start of each output file,
+	// by outputs supporting it. Defaults to true.
+	Header bool
+	// Timestamp format, an empty string writes the timestamp as an integer
+	// number of nanoseconds since the epoch. Defaults to
+	// "2006-01-02T15:04:05.000Z".
+	TimestampFormat string `toml:"timestamp_format"`
+	// Whether records end with "\r\n" rather than "\n". Defaults to false.
+	UseCRLF bool `toml:"use_crlf"`
+}
+
+func (e *CsvEncoder) ConfigStruct() interface{} {
+	return &CsvEncoderConfig{
+		Fields: []string{"Timestamp", "Type", "Logger", "Severity", "Hostname",
+			"Payload"},
+		Delimiter:       ",",
+		Header:          true,
+		TimestampFormat: "2006-01-02T15:04:05.000Z",
+	}
+}
+
+func (e *CsvEncoder) Init(config interface{}) (err error) {
+	e.conf = config.(*CsvEncoderConfig)
+	if utf8.RuneCountInString(e.conf.Delimiter) != 1 {
+		return fmt.Errorf("delimiter must be a single character: '%s'", e.conf.Delimiter)
+	}
+	e.comma, _ = utf8.DecodeRuneInString(e.conf.Delimiter)
+	if e.comma == '"' || e.comma == '\r' || e.comma == '\n' {
+		return fmt.Errorf("invalid delimiter: %q", e.conf.Delimiter)
+	}
+	if len(e.conf.Fields) == 0 {
+		return fmt.Errorf("at least one field is required")
+	}
+	if e.conf.ColumnNames != nil && len(e.conf.ColumnNames) != len(e.conf.Fields) {
+		return fmt.Errorf("%d column names for %d fields", len(e.conf.ColumnNames),
+			len(e.conf.Fields))
+	}
+
+	e.columns = make([]ndjsonColumn, len(e.conf.Fields))
+	names := make([]string, len(e.conf.Fields))
+	for i, f := range e.conf.Fields {
+		if strings.HasPrefix(f, "Fields[") && strings.HasSuffix(f, "]") {
+			name := f[len("Fields[") : len(f)-1]
+			if name == "" {
+				return fmt.Errorf("empty field name: %s", f)
+			}
+			e.columns[i] = ndjsonColumn{kind: ndjsonField, name: name}
+			names[i] = name
+			continue
+		}
+		known := false
+		for _, header := range ndjsonHeaders {
+			if strings.ToLower(f) == header {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return fmt.Errorf("Unable to find field: %s", f)
+		}
+		e.columns[i] = ndjsonColumn{kind: ndjsonHeader, name: f}
+		names[i] = f
+	}
+	if e.conf.ColumnNames != nil {
+		names = e.conf.ColumnNames
+	}
+	e.header = nil
+	if e.conf.Header {
+		e.header = e.write(names)
+	}
+	return
+}
+
+// Returns the column names record, written by file outputs at the start of
+// each new file, or nil if the header is disabled.
+func (e *CsvEncoder) Header() []byte {
+	return e.header
+}
+
+func (e *CsvEncoder) Encode(pack *pipeline.PipelinePack) (output []byte, err error) {
+	m := pack.Message
+	record := make([]string, len(e.columns))
+	for i, col := range e.columns {
+		if col.kind == ndjsonHeader {
+			record[i] = e.headerValue(col.name, m)
+		} else if field := m.FindFirstField(col.name); field != nil {
+			record[i] = csvFieldValue(field)
+		}
+	}
+	return e.write(record), nil
+}
+
+func (e *CsvEncoder) write(record []string) []byte {
+	buf := new(bytes.Buffer)
+	w := csv.NewWriter(buf)
+	w.Comma = e.comma
+	w.UseCRLF = e.conf.UseCRLF
+	w.Write(record)
+	w.Flush()
+	return buf.Bytes()
+}
+
+func (e *CsvEncoder) headerValue(name string, m *message.Message) string {
+	switch strings.ToLower(name) {
+	case "uuid":
+		return m.GetUuidString()
+	case "timestamp":
+		if e.conf.TimestampFormat == "" {
+			return strconv.FormatInt(m.GetTimestamp(), 10)
+		}
+		return time.Unix(0, m.GetTimestamp()).UTC().Format(e.conf.TimestampFormat)
+	case "type":
+		return m.GetType()
+	case "logger":
+		return m.GetLogger()
+	case "severity":
+		return strconv.Itoa(int(m.GetSeverity()))
+	case "payload":
+		return m.GetPayload()
+	case "envversion":
+		return m.GetEnvVersion()
+	case "pid":
+		return strconv.Itoa(int(m.GetPid()))
+	case "hostname":
+		return m.GetHostname()
+	}
+	return ""
+}
+
+// Returns a dynamic field's first value as text, byte values base64 encoded.
+func csvFieldValue(field *message.Field) string {
+	switch field.GetValueType() {
+	case message.Field_STRING:
+		if len(field.ValueString) > 0 {
+			return field.ValueString[0]
+		}
+	case message.Field_BYTES:
+		if len(field.ValueBytes) > 0 {
+			return base64.StdEncoding.EncodeToString(field.ValueBytes[0])
+		}
+	case message.Field_INTEGER:
+		if len(field.ValueInteger) > 0 {
+			return strconv.FormatInt(field.ValueInteger[0], 10)
+		}
+	case message.Field_DOUBLE:
+		if len(field.ValueDouble) > 0 {
+			return strconv.FormatFloat(field.ValueDouble[0], 'g', -1, 64)
+		}
+	case message.Field_BOOL:
+		if len(field.ValueBool) > 0 {
+			return strconv.FormatBool(field.ValueBool[0])
+		}
+	}
+	return ""
+}
+
+func init() {
+	pipeline.RegisterPlugin("CsvEncoder", func() interface{} {
+		return new(CsvEncoder)
+	})
+}
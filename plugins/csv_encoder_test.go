@@ -0,0 +1,82 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package plugins
+
+import (
+	"github.com/mozilla-services/heka/message"
+	"github.com/mozilla-services/heka/pipeline"
+	pipeline_ts "github.com/mozilla-services/heka/pipeline/testsupport"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+)
+
+func CsvEncoderSpec(c gs.Context) {
+
+	c.Specify("A CsvEncoder", func() {
+		encoder := new(CsvEncoder)
+		config := encoder.ConfigStruct().(*CsvEncoderConfig)
+		supply := make(chan *pipeline.PipelinePack, 1)
+		pack := pipeline.NewPipelinePack(supply)
+		pack.Message = pipeline_ts.GetTestMessage()
+
+		encode := func() string {
+			err := encoder.Init(config)
+			c.Assume(err, gs.IsNil)
+			output, err := encoder.Encode(pack)
+			c.Assume(err, gs.IsNil)
+			return string(output)
+		}
+
+		c.Specify("serializes a message with the default settings", func() {
+			c.Expect(encode(), gs.Equals,
+				"2006-01-02T22:04:05.000Z,TEST,GoSpec,6,my.host.name,Test Payload\n")
+			c.Expect(string(encoder.Header()), gs.Equals,
+				"Timestamp,Type,Logger,Severity,Hostname,Payload\n")
+		})
+
+		c.Specify("writes the fields in order", func() {
+			message.NewInt64Field(pack.Message, "status", 200, "")
+			message.NewStringField(pack.Message, "agent", `Mozilla "5.0", X11`)
+			config.Fields = []string{"Fields[agent]", "Timestamp", "Fields[status]",
+				"Fields[missing]"}
+			config.TimestampFormat = ""
+			c.Expect(encode(), gs.Equals,
+				`"Mozilla ""5.0"", X11",1136239445000000000,200,`+"\n")
+			c.Expect(string(encoder.Header()), gs.Equals, "agent,Timestamp,status,missing\n")
+		})
+
+		c.Specify("writes TSV", func() {
+			config.Fields = []string{"Type", "Fields[foo]"}
+			config.ColumnNames = []string{"type", "foo value"}
+			config.Delimiter = "\t"
+			config.UseCRLF = true
+			c.Expect(encode(), gs.Equals, "TEST\tbar\r\n")
+			c.Expect(string(encoder.Header()), gs.Equals, "type\tfoo value\r\n")
+		})
+
+		c.Specify("doesn't write a header if asked not to", func() {
+			config.Header = false
+			encode()
+			c.Expect(encoder.Header(), gs.IsNil)
+		})
+
+		c.Specify("fails on invalid settings", func() {
+			config.Delimiter = ";;"
+			c.Expect(encoder.Init(config), gs.Not(gs.IsNil))
+			config.Delimiter = ","
+			config.ColumnNames = []string{"a"}
+			c.Expect(encoder.Init(config), gs.Not(gs.IsNil))
+			config.ColumnNames = nil
+			config.Fields = []string{"Fields"}
+			c.Expect(encoder.Init(config), gs.Not(gs.IsNil))
+		})
+	})
+}
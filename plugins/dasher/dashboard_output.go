@@ -27,7 +27,6 @@ import (
 	"path"
 	"path/filepath"
 	"regexp"
-	"sync"
 	"time"
 )
 
@@ -52,6 +51,10 @@ type DashboardOutputConfig struct {
 	MessageMatcher string
 	// Custom http headers
 	Headers http.Header
+	// Optional tenants, keyed by name. If any are specified the dashboard
+	// requires HTTP basic auth and each tenant only sees the plugins that
+	// match its plugin patterns.
+	Tenants map[string]DashboardTenantConfig `toml:"tenants"`
 }
 
 func (self *DashboardOutput) ConfigStruct() interface{} {
@@ -74,6 +77,9 @@ type DashboardOutput struct {
 	handler          http.Handler
 	pConfig          *PipelineConfig
 	starterFunc      func(output *DashboardOutput) error
+	// The unscoped view if no tenants are configured, otherwise one view per
+	// tenant.
+	views []*dashView
 }
 
 // Heka will call this before calling any other methods to give us access to
@@ -105,6 +111,21 @@ func (self *DashboardOutput) Init(config interface{}) (err error) {
 			os.Remove(fn)
 		}
 	}
+	tenantsDirectory := filepath.Join(self.workingDirectory, "tenants")
+	os.RemoveAll(tenantsDirectory)
+
+	if len(conf.Tenants) == 0 {
+		self.views = []*dashView{newDashView("", self.dataDirectory)}
+	} else {
+		if self.views, err = newTenantViews(tenantsDirectory, conf.Tenants); err != nil {
+			return fmt.Errorf("DashboardOutput: %s", err)
+		}
+		for _, view := range self.views {
+			if err = os.MkdirAll(view.dataDirectory, 0700); err != nil {
+				return fmt.Errorf("DashboardOutput: Can't create tenant directory: %s", err)
+			}
+		}
+	}
 
 	// Copy the static content from the static dir to the working directory.
 	// This function does the copying, will be passed in to filepath.Walk.
@@ -154,9 +175,13 @@ func (self *DashboardOutput) Init(config interface{}) (err error) {
 		}
 		self.handler = http.FileServer(http.Dir(self.workingDirectory))
 	}
+	handler := self.handler
+	if len(conf.Tenants) > 0 {
+		handler = newTenantHandler(handler, self.views)
+	}
 	self.server = &http.Server{
 		Addr:         conf.Address,
-		Handler:      httpPlugin.CustomHeadersHandler(self.handler, conf.Headers),
+		Handler:      httpPlugin.CustomHeadersHandler(handler, conf.Headers),
 		ReadTimeout:  10 * time.Second,
 		WriteTimeout: 10 * time.Second,
 	}
@@ -175,10 +200,6 @@ func (self *DashboardOutput) Run(or OutputRunner, h PluginHelper) (err error) {
 		msg  *message.Message
 	)
 
-	// Maps sandbox names to plugin list items used to generate the
-	// sandboxes.json file.
-	sandboxes := make(map[string]*DashPluginListItem)
-	sbxsLock := new(sync.Mutex)
 	reNotWord, _ := regexp.Compile("\\W")
 	for ok {
 		select {
@@ -189,14 +210,20 @@ func (self *DashboardOutput) Run(or OutputRunner, h PluginHelper) (err error) {
 			msg = pack.Message
 			switch msg.GetType() {
 			case "heka.all-report":
-				fn := filepath.Join(self.dataDirectory, "heka_report.json")
-				overwriteFile(fn, msg.GetPayload())
-				sbxsLock.Lock()
-				if err := overwritePluginListFile(self.dataDirectory, sandboxes); err != nil {
-					or.LogError(fmt.Errorf("Can't write plugin list file to '%s': %s",
-						self.dataDirectory, err))
+				for _, view := range self.views {
+					payload, err := view.filterReport(msg.GetPayload())
+					if err != nil {
+						or.LogError(fmt.Errorf("Can't filter report for tenant '%s': %s",
+							view.name, err))
+						continue
+					}
+					fn := filepath.Join(view.dataDirectory, "heka_report.json")
+					overwriteFile(fn, payload)
+					if err := view.writePluginList(); err != nil {
+						or.LogError(fmt.Errorf("Can't write plugin list file to '%s': %s",
+							view.dataDirectory, err))
+					}
 				}
-				sbxsLock.Unlock()
 			case "heka.sandbox-output":
 				tmp, _ := msg.GetFieldValue("payload_type")
 				if payloadType, ok := tmp.(string); ok {
@@ -213,38 +240,15 @@ func (self *DashboardOutput) Run(or OutputRunner, h PluginHelper) (err error) {
 					payloadType = reNotWord.ReplaceAllString(payloadType, "")
 					filterName := msg.GetLogger()
 					fn := filterName + nameExt + "." + payloadType
-					ofn := filepath.Join(self.dataDirectory, fn)
 					relPath := path.Join(self.relDataPath, fn) // Used for generating HTTP URLs.
-					overwriteFile(ofn, msg.GetPayload())
-					sbxsLock.Lock()
-					if listItem, ok := sandboxes[filterName]; !ok {
-						// First time we've seen this sandbox, add it to the set.
-						output := &DashPluginOutput{
-							Name:     payloadName,
-							Filename: relPath,
-						}
-						sandboxes[filterName] = &DashPluginListItem{
-							Name:    filterName,
-							Outputs: []*DashPluginOutput{output},
-						}
-					} else {
-						// We've seen the sandbox, see if we already have this output.
-						found := false
-						for _, output := range listItem.Outputs {
-							if output.Name == payloadName {
-								found = true
-								break
-							}
-						}
-						if !found {
-							output := &DashPluginOutput{
-								Name:     payloadName,
-								Filename: relPath,
-							}
-							listItem.Outputs = append(listItem.Outputs, output)
+					for _, view := range self.views {
+						if !view.canSee(filterName) {
+							continue
 						}
+						ofn := filepath.Join(view.dataDirectory, fn)
+						overwriteFile(ofn, msg.GetPayload())
+						view.addSandboxOutput(filterName, payloadName, relPath)
 					}
-					sbxsLock.Unlock()
 				}
 			case "heka.sandbox-terminated":
 				var filterName string
@@ -254,38 +258,41 @@ func (self *DashboardOutput) Run(or OutputRunner, h PluginHelper) (err error) {
 				} else {
 					break
 				}
-				fn := filepath.Join(self.dataDirectory, "heka_sandbox_termination.tsv")
-				if file, err := os.OpenFile(fn, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644); err == nil {
-					var line string
-					if _, ok := msg.GetFieldValue("ProcessMessageCount"); !ok {
-						line = fmt.Sprintf("%d\t%s\t%v\n", msg.GetTimestamp()/1e9,
-							filterName, msg.GetPayload())
-					} else {
-						pmc, _ := msg.GetFieldValue("ProcessMessageCount")
-						pms, _ := msg.GetFieldValue("ProcessMessageSamples")
-						pmd, _ := msg.GetFieldValue("ProcessMessageAvgDuration")
-						mad, _ := msg.GetFieldValue("MatchAvgDuration")
-						fcl, _ := msg.GetFieldValue("FilterChanLength")
-						mcl, _ := msg.GetFieldValue("MatchChanLength")
-						rcl, _ := msg.GetFieldValue("RouterChanLength")
-						line = fmt.Sprintf("%d\t%s\t%v"+
-							" ProcessMessageCount:%v"+
-							" ProcessMessageSamples:%v"+
-							" ProcessMessageAvgDuration:%v"+
-							" MatchAvgDuration:%v"+
-							" FilterChanLength:%v"+
-							" MatchChanLength:%v"+
-							" RouterChanLength:%v\n",
-							msg.GetTimestamp()/1e9,
-							filterName, msg.GetPayload(), pmc, pms, pmd,
-							mad, fcl, mcl, rcl)
+				var line string
+				if _, ok := msg.GetFieldValue("ProcessMessageCount"); !ok {
+					line = fmt.Sprintf("%d\t%s\t%v\n", msg.GetTimestamp()/1e9,
+						filterName, msg.GetPayload())
+				} else {
+					pmc, _ := msg.GetFieldValue("ProcessMessageCount")
+					pms, _ := msg.GetFieldValue("ProcessMessageSamples")
+					pmd, _ := msg.GetFieldValue("ProcessMessageAvgDuration")
+					mad, _ := msg.GetFieldValue("MatchAvgDuration")
+					fcl, _ := msg.GetFieldValue("FilterChanLength")
+					mcl, _ := msg.GetFieldValue("MatchChanLength")
+					rcl, _ := msg.GetFieldValue("RouterChanLength")
+					line = fmt.Sprintf("%d\t%s\t%v"+
+						" ProcessMessageCount:%v"+
+						" ProcessMessageSamples:%v"+
+						" ProcessMessageAvgDuration:%v"+
+						" MatchAvgDuration:%v"+
+						" FilterChanLength:%v"+
+						" MatchChanLength:%v"+
+						" RouterChanLength:%v\n",
+						msg.GetTimestamp()/1e9,
+						filterName, msg.GetPayload(), pmc, pms, pmd,
+						mad, fcl, mcl, rcl)
+				}
+				for _, view := range self.views {
+					if !view.canSee(filterName) {
+						continue
+					}
+					fn := filepath.Join(view.dataDirectory, "heka_sandbox_termination.tsv")
+					if file, err := os.OpenFile(fn, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644); err == nil {
+						file.WriteString(line)
+						file.Close()
 					}
-					file.WriteString(line)
-					file.Close()
+					view.removeSandbox(filterName)
 				}
-				sbxsLock.Lock()
-				delete(sandboxes, filterName)
-				sbxsLock.Unlock()
 			}
 			pack.Recycle()
 		case <-ticker:
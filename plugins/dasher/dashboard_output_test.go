@@ -15,6 +15,8 @@
 package dasher
 
 import (
+	"encoding/json"
+	"github.com/mozilla-services/heka/message"
 	"github.com/mozilla-services/heka/pipeline"
 	pipeline_ts "github.com/mozilla-services/heka/pipeline/testsupport"
 	"github.com/mozilla-services/heka/pipelinemock"
@@ -25,6 +27,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"reflect"
 	"runtime"
 	"testing"
@@ -130,6 +133,74 @@ func DashboardOutputSpec(c gs.Context) {
 					c.Expect(eq, gs.IsTrue)
 				})
 
+				c.Specify("scopes data to tenants", func() {
+					config.Tenants = map[string]DashboardTenantConfig{
+						"web": {Username: "web", Password: "webpass", Plugins: []string{"web-*"}},
+						"db":  {Username: "db", Password: "dbpass", Plugins: []string{"db-*"}},
+					}
+					err = dashboardOutput.Init(config)
+					c.Assume(err, gs.IsNil)
+					ts.Config = dashboardOutput.server
+
+					startOutput()
+					<-startedChan
+
+					packRecycleChan := make(chan *pipeline.PipelinePack, 4)
+					newPack := func(msgType, logger, payload string) *pipeline.PipelinePack {
+						p := pipeline.NewPipelinePack(packRecycleChan)
+						p.Message.SetType(msgType)
+						p.Message.SetLogger(logger)
+						p.Message.SetPayload(payload)
+						return p
+					}
+					reportPack := newPack("heka.all-report", "hekad",
+						`{"globals":[{"Name":"inputRecycleChan"}],`+
+							`"filters":[{"Name":"web-counter"},{"Name":"db-counter"}]}`)
+					outputPack := newPack("heka.sandbox-output", "db-counter", "stats")
+					f, _ := message.NewField("payload_type", "txt", "")
+					outputPack.Message.AddField(f)
+					f, _ = message.NewField("payload_name", "stats", "")
+					outputPack.Message.AddField(f)
+
+					inChan <- outputPack
+					inChan <- reportPack
+					// Once these are queued the others have been processed.
+					inChan <- newPack("test", "", "")
+					inChan <- newPack("test", "", "")
+
+					tenantFile := func(tenant, name string) string {
+						return filepath.Join(tmpdir, "tenants", tenant, "data", name)
+					}
+					report := make(map[string][]map[string]interface{})
+					contents, err := ioutil.ReadFile(tenantFile("web", "heka_report.json"))
+					c.Assume(err, gs.IsNil)
+					err = json.Unmarshal(contents, &report)
+					c.Assume(err, gs.IsNil)
+					c.Expect(len(report["globals"]), gs.Equals, 0)
+					c.Expect(len(report["filters"]), gs.Equals, 1)
+					c.Expect(report["filters"][0]["Name"], gs.Equals, "web-counter")
+
+					_, err = os.Stat(tenantFile("db", "db-counter.stats.txt"))
+					c.Expect(err, gs.IsNil)
+					_, err = os.Stat(tenantFile("web", "db-counter.stats.txt"))
+					c.Expect(os.IsNotExist(err), gs.IsTrue)
+
+					get := func(username, password string) int {
+						req, err := http.NewRequest("GET", ts.URL+"/data/heka_report.json", nil)
+						c.Assume(err, gs.IsNil)
+						if username != "" {
+							req.SetBasicAuth(username, password)
+						}
+						resp, err := http.DefaultClient.Do(req)
+						c.Assume(err, gs.IsNil)
+						resp.Body.Close()
+						return resp.StatusCode
+					}
+					c.Expect(get("", ""), gs.Equals, http.StatusUnauthorized)
+					c.Expect(get("web", "dbpass"), gs.Equals, http.StatusUnauthorized)
+					c.Expect(get("web", "webpass"), gs.Equals, http.StatusOK)
+				})
+
 				close(inChan)
 				c.Expect(<-errChan, gs.IsNil)
 
@@ -0,0 +1,232 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package dasher
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+type DashboardTenantConfig struct {
+	// Credentials the tenant uses to log in to the dashboard, via HTTP basic
+	// auth.
+	Username string `toml:"username"`
+	Password string `toml:"password"`
+	// Glob patterns (e.g. "web-*") matching the names of the plugins whose
+	// reports, sandbox output, and termination notices the tenant may see.
+	Plugins []string `toml:"plugins"`
+}
+
+// A scoped copy of the dashboard data. The DashboardOutput always maintains
+// an unscoped view, served when no tenants are configured, plus one view per
+// configured tenant.
+type dashView struct {
+	name          string
+	dataDirectory string
+	patterns      []string // Nil means everything is visible.
+	username      string
+	password      string
+	// Maps sandbox names to plugin list items used to generate the
+	// sandboxes.json file.
+	sandboxes map[string]*DashPluginListItem
+	sbxsLock  sync.Mutex
+}
+
+func newDashView(name, dataDirectory string) *dashView {
+	return &dashView{
+		name:          name,
+		dataDirectory: dataDirectory,
+		sandboxes:     make(map[string]*DashPluginListItem),
+	}
+}
+
+// Returns whether or not the view includes the named plugin.
+func (v *dashView) canSee(pluginName string) bool {
+	if v.patterns == nil {
+		return true
+	}
+	for _, pattern := range v.patterns {
+		if matched, _ := path.Match(pattern, pluginName); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// Removes all plugins the view doesn't include from the JSON `heka.all-report`
+// payload.
+func (v *dashView) filterReport(payload string) (string, error) {
+	if v.patterns == nil {
+		return payload, nil
+	}
+	var report map[string][]map[string]interface{}
+	if err := json.Unmarshal([]byte(payload), &report); err != nil {
+		return "", err
+	}
+	for category, plugins := range report {
+		visible := make([]map[string]interface{}, 0, len(plugins))
+		for _, plugin := range plugins {
+			if name, ok := plugin["Name"].(string); ok && v.canSee(name) {
+				visible = append(visible, plugin)
+			}
+		}
+		report[category] = visible
+	}
+	buffer := new(bytes.Buffer)
+	if err := json.NewEncoder(buffer).Encode(report); err != nil {
+		return "", err
+	}
+	return buffer.String(), nil
+}
+
+// Records that the named sandbox has generated the specified output.
+func (v *dashView) addSandboxOutput(filterName, payloadName, relPath string) {
+	v.sbxsLock.Lock()
+	defer v.sbxsLock.Unlock()
+	output := &DashPluginOutput{
+		Name:     payloadName,
+		Filename: relPath,
+	}
+	listItem, ok := v.sandboxes[filterName]
+	if !ok {
+		// First time we've seen this sandbox, add it to the set.
+		v.sandboxes[filterName] = &DashPluginListItem{
+			Name:    filterName,
+			Outputs: []*DashPluginOutput{output},
+		}
+		return
+	}
+	// We've seen the sandbox, see if we already have this output.
+	for _, existing := range listItem.Outputs {
+		if existing.Name == payloadName {
+			return
+		}
+	}
+	listItem.Outputs = append(listItem.Outputs, output)
+}
+
+func (v *dashView) removeSandbox(filterName string) {
+	v.sbxsLock.Lock()
+	delete(v.sandboxes, filterName)
+	v.sbxsLock.Unlock()
+}
+
+func (v *dashView) writePluginList() error {
+	v.sbxsLock.Lock()
+	defer v.sbxsLock.Unlock()
+	return overwritePluginListFile(v.dataDirectory, v.sandboxes)
+}
+
+// Creates the tenant views specified in the config, keeping the tenant data
+// in per-tenant subdirectories of `tenantsDirectory`.
+func newTenantViews(tenantsDirectory string,
+	configs map[string]DashboardTenantConfig) ([]*dashView, error) {
+
+	views := make([]*dashView, 0, len(configs))
+	usernames := make(map[string]bool)
+	for name, config := range configs {
+		if config.Username == "" || config.Password == "" {
+			return nil, fmt.Errorf("tenant '%s' requires a username and password", name)
+		}
+		if usernames[config.Username] {
+			return nil, fmt.Errorf("tenant '%s' username '%s' is already in use", name,
+				config.Username)
+		}
+		usernames[config.Username] = true
+		for _, pattern := range config.Plugins {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("tenant '%s' has invalid plugin pattern '%s'", name,
+					pattern)
+			}
+		}
+		view := newDashView(name, filepath.Join(tenantsDirectory, name, "data"))
+		view.username = config.Username
+		view.password = config.Password
+		view.patterns = config.Plugins
+		if view.patterns == nil {
+			view.patterns = []string{}
+		}
+		views = append(views, view)
+	}
+	return views, nil
+}
+
+// Extracts HTTP basic auth credentials from the request.
+func basicAuth(r *http.Request) (username, password string, ok bool) {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Basic ") {
+		return
+	}
+	decoded, err := base64.StdEncoding.DecodeString(auth[len("Basic "):])
+	if err != nil {
+		return
+	}
+	creds := strings.SplitN(string(decoded), ":", 2)
+	if len(creds) != 2 {
+		return
+	}
+	return creds[0], creds[1], true
+}
+
+// Requires every request to authenticate as one of the tenants, serving the
+// tenant's own data files and the shared static content.
+type tenantHandler struct {
+	static http.Handler
+	data   map[string]http.Handler
+	views  map[string]*dashView
+}
+
+func newTenantHandler(static http.Handler, views []*dashView) *tenantHandler {
+	th := &tenantHandler{
+		static: static,
+		data:   make(map[string]http.Handler),
+		views:  make(map[string]*dashView),
+	}
+	for _, view := range views {
+		th.views[view.username] = view
+		th.data[view.username] = http.StripPrefix("/data/",
+			http.FileServer(http.Dir(view.dataDirectory)))
+	}
+	return th
+}
+
+func (th *tenantHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	username, password, ok := basicAuth(r)
+	var view *dashView
+	if ok {
+		view = th.views[username]
+	}
+	if view == nil || subtle.ConstantTimeCompare([]byte(password),
+		[]byte(view.password)) != 1 {
+
+		w.Header().Set("WWW-Authenticate", `Basic realm="heka"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/data/"):
+		th.data[username].ServeHTTP(w, r)
+	case strings.HasPrefix(r.URL.Path, "/tenants/"):
+		http.NotFound(w, r)
+	default:
+		th.static.ServeHTTP(w, r)
+	}
+}
@@ -0,0 +1,534 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package datadog
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+	"github.com/mozilla-services/heka/pipeline"
+	"github.com/mozilla-services/heka/plugins"
+	"github.com/mozilla-services/heka/plugins/tcp"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Limits of the logs intake API.
+const (
+	maxLogsPerBatch  = 1000
+	maxLogBatchBytes = 5 * 1024 * 1024
+)
+
+type DatadogOutputConfig struct {
+	// API key sent with every request.
+	ApiKey string `toml:"api_key"`
+	// File holding the API key instead, read again whenever it changes or the
+	// key is rejected, so keys can be rotated without a restart.
+	ApiKeyFile string `toml:"api_key_file"`
+	// Datadog site, e.g. "datadoghq.com" or "datadoghq.eu".
+	Site string
+	// Override the intake URLs derived from the site, e.g. for a proxy.
+	LogsUrl    string `toml:"logs_url"`
+	MetricsUrl string `toml:"metrics_url"`
+	// Whether messages are shipped as logs.
+	SendLogs bool `toml:"send_logs"`
+	// Names of the numeric fields sent as gauges.
+	MetricFields []string `toml:"metric_fields"`
+	// Prepended to the names of the gauges.
+	MetricPrefix string `toml:"metric_prefix"`
+	// Values of the logs' `service` and `ddsource` attributes.
+	Service string
+	Source  string
+	// Tags added to every log and metric, as "key:value" strings.
+	StaticTags []string `toml:"static_tags"`
+	// Tags taken from message values, by tag name. Sources are message
+	// header names or "Fields[name]".
+	Tags map[string]string
+	// "gzip" or "none".
+	Compression string
+	// Milliseconds after which accumulated logs and metrics are sent even if
+	// the batch isn't full.
+	FlushInterval uint32 `toml:"flush_interval"`
+	// Number of logs that triggers a send, at most 1000.
+	FlushCount int `toml:"flush_count"`
+	// Milliseconds after which a request times out, 0 for no timeout.
+	HttpTimeout uint32 `toml:"http_timeout"`
+	Tls         tcp.TlsConfig
+	// Settings used to back off from failed requests.
+	Retries pipeline.RetryOptions
+}
+
+// Ships messages to Datadog's logs intake API, with `ddtags` built from
+// message values, and optionally sends numeric fields as gauges to the
+// metrics API. Logs and metrics are accumulated and sent in compressed
+// batches.
+type DatadogOutput struct {
+	logsSent       int64
+	logsDropped    int64
+	metricsSent    int64
+	metricsDropped int64
+	keyReloads     int64
+
+	conf        *DatadogOutputConfig
+	tags        *plugins.ColumnMapping
+	client      *http.Client
+	retryHelper *pipeline.RetryHelper
+	pConfig     *pipeline.PipelineConfig
+	key         apiKey
+	logs        []json.RawMessage
+	logBytes    int
+	series      []ddSeries
+}
+
+// A log in the intake API's format.
+type ddLog struct {
+	Message   string `json:"message"`
+	Source    string `json:"ddsource,omitempty"`
+	Tags      string `json:"ddtags,omitempty"`
+	Hostname  string `json:"hostname,omitempty"`
+	Service   string `json:"service,omitempty"`
+	Status    string `json:"status,omitempty"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+// A metric in the v2 series API's format.
+type ddSeries struct {
+	Metric    string       `json:"metric"`
+	Type      int          `json:"type"`
+	Points    []ddPoint    `json:"points"`
+	Resources []ddResource `json:"resources,omitempty"`
+	Tags      []string     `json:"tags,omitempty"`
+}
+
+type ddPoint struct {
+	Timestamp int64   `json:"timestamp"`
+	Value     float64 `json:"value"`
+}
+
+type ddResource struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+// Series type of gauges.
+const ddGauge = 3
+
+// Datadog log statuses, by syslog severity.
+var statuses = []string{"emergency", "alert", "critical", "error", "warning",
+	"notice", "info", "debug"}
+
+// The API key, either configured or read from a file.
+type apiKey struct {
+	lock    sync.Mutex
+	value   string
+	file    string
+	modTime time.Time
+}
+
+// Returns the current key, reading the key file again if it has changed.
+func (k *apiKey) get() (string, error) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	if k.file == "" {
+		return k.value, nil
+	}
+	info, err := os.Stat(k.file)
+	if err != nil {
+		return "", err
+	}
+	if k.value != "" && info.ModTime().Equal(k.modTime) {
+		return k.value, nil
+	}
+	data, err := ioutil.ReadFile(k.file)
+	if err != nil {
+		return "", err
+	}
+	value := strings.TrimSpace(string(data))
+	if value == "" {
+		return "", fmt.Errorf("%s is empty", k.file)
+	}
+	k.value = value
+	k.modTime = info.ModTime()
+	return k.value, nil
+}
+
+// Forces the key file to be read again, after the key was rejected. Returns
+// false if the key doesn't come from a file.
+func (k *apiKey) reload() bool {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	k.value = ""
+	return k.file != ""
+}
+
+func (o *DatadogOutput) ConfigStruct() interface{} {
+	return &DatadogOutputConfig{
+		Site:          "datadoghq.com",
+		SendLogs:      true,
+		Source:        "heka",
+		Compression:   "gzip",
+		FlushInterval: 1000,
+		FlushCount:    500,
+		HttpTimeout:   10000,
+		Retries: pipeline.RetryOptions{
+			MaxDelay:   "30s",
+			Delay:      "250ms",
+			MaxRetries: -1,
+		},
+	}
+}
+
+func (o *DatadogOutput) SetPipelineConfig(pConfig *pipeline.PipelineConfig) {
+	o.pConfig = pConfig
+}
+
+func (o *DatadogOutput) Init(config interface{}) (err error) {
+	o.conf = config.(*DatadogOutputConfig)
+	if (o.conf.ApiKey == "") == (o.conf.ApiKeyFile == "") {
+		return errors.New("exactly one of api_key and api_key_file must be specified")
+	}
+	o.key.value = o.conf.ApiKey
+	o.key.file = o.conf.ApiKeyFile
+	if o.key.file != "" {
+		if _, err = o.key.get(); err != nil {
+			return fmt.Errorf("can't read API key: %s", err)
+		}
+	}
+	if !o.conf.SendLogs && len(o.conf.MetricFields) == 0 {
+		return errors.New("send_logs is false and no metric_fields are specified")
+	}
+	if o.conf.Compression != "gzip" && o.conf.Compression != "none" {
+		return fmt.Errorf(`invalid compression "%s", must be "gzip" or "none"`,
+			o.conf.Compression)
+	}
+	if o.conf.FlushCount < 1 || o.conf.FlushCount > maxLogsPerBatch {
+		return fmt.Errorf("flush_count must be between 1 and %d", maxLogsPerBatch)
+	}
+	if o.conf.LogsUrl == "" {
+		o.conf.LogsUrl = fmt.Sprintf("https://http-intake.logs.%s/api/v2/logs",
+			o.conf.Site)
+	}
+	if o.conf.MetricsUrl == "" {
+		o.conf.MetricsUrl = fmt.Sprintf("https://api.%s/api/v2/series", o.conf.Site)
+	}
+	for _, u := range []string{o.conf.LogsUrl, o.conf.MetricsUrl} {
+		parsed, e := url.Parse(u)
+		if e != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+			return fmt.Errorf("invalid URL: %s", u)
+		}
+	}
+	if o.tags, err = plugins.NewColumnMapping(o.conf.Tags); err != nil {
+		return
+	}
+
+	o.client = new(http.Client)
+	if o.conf.HttpTimeout > 0 {
+		o.client.Timeout = time.Duration(o.conf.HttpTimeout) * time.Millisecond
+	}
+	transport := &http.Transport{}
+	if transport.TLSClientConfig, err = tcp.CreateGoTlsConfig(&o.conf.Tls); err != nil {
+		return fmt.Errorf("TLS init error: %s", err)
+	}
+	o.client.Transport = transport
+	if o.retryHelper, err = pipeline.NewRetryHelper(o.conf.Retries); err != nil {
+		return fmt.Errorf("invalid retries: %s", err)
+	}
+	return
+}
+
+func (o *DatadogOutput) Run(or pipeline.OutputRunner, h pipeline.PluginHelper) (err error) {
+	ticker := time.NewTicker(time.Duration(o.conf.FlushInterval) * time.Millisecond)
+	defer ticker.Stop()
+	inChan := or.InChan()
+	for {
+		select {
+		case pack, ok := <-inChan:
+			if !ok {
+				return o.flush(or)
+			}
+			log, e := o.prepare(or, pack)
+			pack.Recycle()
+			if e != nil {
+				or.LogError(e)
+				atomic.AddInt64(&o.logsDropped, 1)
+				continue
+			}
+			if log == nil {
+				continue
+			}
+			if o.logBytes+len(log)+1 > maxLogBatchBytes {
+				if err = o.flush(or); err != nil {
+					return
+				}
+			}
+			o.logs = append(o.logs, log)
+			o.logBytes += len(log) + 1
+			if len(o.logs) >= o.conf.FlushCount {
+				if err = o.flush(or); err != nil {
+					return
+				}
+			}
+		case <-ticker.C:
+			if err = o.flush(or); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// Adds a message's metrics to the batch, and returns its log, nil if logs
+// aren't sent.
+func (o *DatadogOutput) prepare(or pipeline.OutputRunner, pack *pipeline.PipelinePack) (
+	json.RawMessage, error) {
+
+	msg := pack.Message
+	tags := o.messageTags(msg)
+	o.addMetrics(msg, tags)
+	if !o.conf.SendLogs {
+		return nil, nil
+	}
+
+	var text string
+	if or.Encoder() != nil {
+		encoded, err := or.Encode(pack)
+		if err != nil {
+			return nil, fmt.Errorf("can't encode message: %s", err)
+		}
+		if encoded == nil {
+			return nil, nil
+		}
+		text = string(encoded)
+	} else {
+		text = msg.GetPayload()
+	}
+	log := ddLog{
+		Message:   text,
+		Source:    o.conf.Source,
+		Tags:      strings.Join(tags, ","),
+		Hostname:  msg.GetHostname(),
+		Service:   o.conf.Service,
+		Timestamp: msg.GetTimestamp() / int64(time.Millisecond),
+	}
+	if severity := msg.GetSeverity(); severity >= 0 && int(severity) < len(statuses) {
+		log.Status = statuses[severity]
+	}
+	data, err := json.Marshal(log)
+	if err != nil {
+		return nil, err
+	}
+	if len(data)+2 > maxLogBatchBytes {
+		return nil, fmt.Errorf("log of %d bytes over the intake's limit", len(data))
+	}
+	return data, nil
+}
+
+// Returns the static tags followed by the tags taken from the message, in
+// tag name order.
+func (o *DatadogOutput) messageTags(msg *message.Message) []string {
+	tags := make([]string, 0, len(o.conf.StaticTags)+len(o.tags.Names))
+	tags = append(tags, o.conf.StaticTags...)
+	for i, value := range o.tags.Values(msg) {
+		if value == nil {
+			continue
+		}
+		if t, ok := value.(time.Time); ok {
+			value = t.Format(time.RFC3339)
+		}
+		tags = append(tags, fmt.Sprintf("%s:%v", o.tags.Names[i], value))
+	}
+	return tags
+}
+
+// Adds a gauge for each of the message's numeric metric fields.
+func (o *DatadogOutput) addMetrics(msg *message.Message, tags []string) {
+	timestamp := msg.GetTimestamp() / int64(time.Second)
+	for _, name := range o.conf.MetricFields {
+		raw, ok := msg.GetFieldValue(name)
+		if !ok {
+			continue
+		}
+		var value float64
+		switch v := raw.(type) {
+		case int64:
+			value = float64(v)
+		case float64:
+			value = v
+		default:
+			continue
+		}
+		series := ddSeries{
+			Metric: o.conf.MetricPrefix + name,
+			Type:   ddGauge,
+			Points: []ddPoint{{timestamp, value}},
+			Tags:   tags,
+		}
+		if host := msg.GetHostname(); host != "" {
+			series.Resources = []ddResource{{host, "host"}}
+		}
+		o.series = append(o.series, series)
+	}
+}
+
+// Sends the accumulated logs and metrics. Returns an error if the output
+// must stop.
+func (o *DatadogOutput) flush(or pipeline.OutputRunner) error {
+	logs, series := o.logs, o.series
+	o.logs, o.series, o.logBytes = nil, nil, 0
+	if len(logs) > 0 {
+		var body bytes.Buffer
+		body.WriteByte('[')
+		for i, log := range logs {
+			if i > 0 {
+				body.WriteByte(',')
+			}
+			body.Write(log)
+		}
+		body.WriteByte(']')
+		err := o.send(or, o.conf.LogsUrl, body.Bytes(), len(logs), "logs",
+			&o.logsSent, &o.logsDropped)
+		if err != nil {
+			atomic.AddInt64(&o.metricsDropped, int64(len(series)))
+			return err
+		}
+	}
+	if len(series) > 0 {
+		body, err := json.Marshal(map[string][]ddSeries{"series": series})
+		if err != nil {
+			atomic.AddInt64(&o.metricsDropped, int64(len(series)))
+			return err
+		}
+		return o.send(or, o.conf.MetricsUrl, body, len(series), "metrics",
+			&o.metricsSent, &o.metricsDropped)
+	}
+	return nil
+}
+
+// Sends a batch, backing off and retrying while the failures are worth
+// retrying, and counts it as sent or dropped.
+func (o *DatadogOutput) send(or pipeline.OutputRunner, endpoint string, body []byte,
+	count int, what string, sent, dropped *int64) error {
+
+	if o.conf.Compression == "gzip" {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		gz.Write(body)
+		gz.Close()
+		body = buf.Bytes()
+	}
+	o.retryHelper.Reset()
+	for {
+		err := o.request(endpoint, body)
+		if err == nil {
+			atomic.AddInt64(sent, int64(count))
+			return nil
+		}
+		switch pipeline.ClassifyError(err) {
+		case pipeline.ErrKindMalformed:
+			or.LogError(fmt.Errorf("batch of %d %s rejected: %s", count, what, err))
+			atomic.AddInt64(dropped, int64(count))
+			return nil
+		case pipeline.ErrKindFatal:
+			atomic.AddInt64(dropped, int64(count))
+			return err
+		case pipeline.ErrKindThrottled:
+			if retryAfter := err.(*pipeline.OutputError).RetryAfter; retryAfter > 0 {
+				or.LogError(err)
+				time.Sleep(retryAfter)
+				continue
+			}
+		}
+		or.LogError(err)
+		if o.pConfig != nil && o.pConfig.Globals.IsShuttingDown() {
+			break
+		}
+		if o.retryHelper.Wait() != nil {
+			or.LogError(errors.New("retries exhausted"))
+			break
+		}
+	}
+	atomic.AddInt64(dropped, int64(count))
+	or.LogError(fmt.Errorf("dropping %d %s", count, what))
+	return nil
+}
+
+// Sends a request to an intake API, returning a classified error if it
+// wasn't accepted.
+func (o *DatadogOutput) request(endpoint string, body []byte) error {
+	key, err := o.key.get()
+	if err != nil {
+		return pipeline.NewRetryableError(fmt.Errorf("can't read API key: %s", err))
+	}
+	req, err := http.NewRequest("POST", endpoint, bytes.NewReader(body))
+	if err != nil {
+		return pipeline.NewFatalError(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if o.conf.Compression == "gzip" {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	req.Header.Set("DD-API-KEY", key)
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return pipeline.NewRetryableError(fmt.Errorf("request failed: %s", err))
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 300 {
+		return nil
+	}
+	respBody, _ := ioutil.ReadAll(resp.Body)
+	err = fmt.Errorf("request failed: %s - %s", resp.Status,
+		strings.TrimSpace(string(respBody)))
+	switch {
+	case resp.StatusCode == http.StatusForbidden || resp.StatusCode == http.StatusUnauthorized:
+		// The key may have been rotated, the file is read again.
+		if o.key.reload() {
+			atomic.AddInt64(&o.keyReloads, 1)
+			return pipeline.NewRetryableError(err)
+		}
+		return pipeline.NewFatalError(err)
+	case resp.StatusCode == 429 || resp.StatusCode == http.StatusServiceUnavailable:
+		var retryAfter time.Duration
+		if secs, e := strconv.Atoi(resp.Header.Get("Retry-After")); e == nil {
+			retryAfter = time.Duration(secs) * time.Second
+		}
+		return pipeline.NewThrottledError(err, retryAfter)
+	case resp.StatusCode == http.StatusRequestTimeout || resp.StatusCode >= 500:
+		return pipeline.NewRetryableError(err)
+	}
+	return pipeline.NewMalformedMessageError(err)
+}
+
+func (o *DatadogOutput) ReportMsg(msg *message.Message) error {
+	message.NewInt64Field(msg, "LogsSent", atomic.LoadInt64(&o.logsSent), "count")
+	message.NewInt64Field(msg, "LogsDropped", atomic.LoadInt64(&o.logsDropped), "count")
+	message.NewInt64Field(msg, "MetricsSent", atomic.LoadInt64(&o.metricsSent), "count")
+	message.NewInt64Field(msg, "MetricsDropped", atomic.LoadInt64(&o.metricsDropped),
+		"count")
+	message.NewInt64Field(msg, "ApiKeyReloads", atomic.LoadInt64(&o.keyReloads), "count")
+	return nil
+}
+
+func init() {
+	pipeline.RegisterPlugin("DatadogOutput", func() interface{} {
+		return new(DatadogOutput)
+	})
+}
@@ -0,0 +1,212 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package datadog
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"github.com/mozilla-services/heka/message"
+	"github.com/mozilla-services/heka/pipeline"
+	"github.com/mozilla-services/heka/pipelinemock"
+	"github.com/rafrombrc/gomock/gomock"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newPack() *pipeline.PipelinePack {
+	pack := pipeline.NewPipelinePack(nil)
+	msg := pack.Message
+	msg.SetTimestamp(1420070400123456789)
+	msg.SetHostname("web1")
+	msg.SetSeverity(3)
+	msg.SetPayload("upstream timed out")
+	message.NewStringField(msg, "env", "prod")
+	message.NewInt64Field(msg, "status", 504, "")
+	f, _ := message.NewField("request_time", 0.25, "s")
+	msg.AddField(f)
+	return pack
+}
+
+type request struct {
+	path, key string
+	body      []byte
+}
+
+// Returns a server recording the requests it receives, decompressed,
+// responding with the listed statuses and then with 202s.
+func newServer(t *testing.T, statuses ...int) (*httptest.Server, chan request) {
+	requests := make(chan request, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter,
+		r *http.Request) {
+
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		body, _ := ioutil.ReadAll(gz)
+		requests <- request{r.URL.Path, r.Header.Get("DD-API-KEY"), body}
+		status := http.StatusAccepted
+		if len(statuses) > 0 {
+			status, statuses = statuses[0], statuses[1:]
+		}
+		w.WriteHeader(status)
+	}))
+	return server, requests
+}
+
+func newOutput(t *testing.T, server *httptest.Server,
+	setup func(*DatadogOutputConfig)) *DatadogOutput {
+
+	o := new(DatadogOutput)
+	config := o.ConfigStruct().(*DatadogOutputConfig)
+	config.ApiKey = "key1"
+	config.LogsUrl = server.URL + "/api/v2/logs"
+	config.MetricsUrl = server.URL + "/api/v2/series"
+	config.Retries.Delay = "1ms"
+	setup(config)
+	if err := o.Init(config); err != nil {
+		t.Fatal(err)
+	}
+	return o
+}
+
+func TestSendsLogsAndMetrics(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	or := pipelinemock.NewMockOutputRunner(ctrl)
+	or.EXPECT().LogError(gomock.Any()).AnyTimes()
+	or.EXPECT().Encoder().Return(nil)
+
+	server, requests := newServer(t)
+	defer server.Close()
+	o := newOutput(t, server, func(config *DatadogOutputConfig) {
+		config.Service = "nginx"
+		config.StaticTags = []string{"team:web"}
+		config.Tags = map[string]string{"env": "Fields[env]", "missing": "Fields[x]"}
+		config.MetricFields = []string{"status", "request_time", "env"}
+		config.MetricPrefix = "nginx."
+	})
+
+	log, err := o.prepare(or, newPack())
+	if err != nil {
+		t.Fatal(err)
+	}
+	o.logs = append(o.logs, log)
+	if err = o.flush(or); err != nil {
+		t.Fatal(err)
+	}
+
+	req := <-requests
+	if req.path != "/api/v2/logs" || req.key != "key1" {
+		t.Errorf("Unexpected request: %s, %s", req.path, req.key)
+	}
+	var logs []ddLog
+	if err = json.Unmarshal(req.body, &logs); err != nil {
+		t.Fatal(err)
+	}
+	expected := ddLog{"upstream timed out", "heka", "team:web,env:prod", "web1",
+		"nginx", "error", 1420070400123}
+	if len(logs) != 1 || logs[0] != expected {
+		t.Errorf("Unexpected logs: %+v", logs)
+	}
+
+	req = <-requests
+	var series map[string][]ddSeries
+	if err = json.Unmarshal(req.body, &series); err != nil {
+		t.Fatal(err)
+	}
+	metrics := series["series"]
+	if req.path != "/api/v2/series" || len(metrics) != 2 {
+		t.Fatalf("Unexpected series: %s", req.body)
+	}
+	if metrics[0].Metric != "nginx.status" || metrics[0].Points[0] != (ddPoint{1420070400, 504}) ||
+		metrics[1].Metric != "nginx.request_time" || metrics[1].Resources[0].Name != "web1" ||
+		len(metrics[1].Tags) != 2 {
+
+		t.Errorf("Unexpected series: %s", req.body)
+	}
+	if o.logsSent != 1 || o.metricsSent != 2 {
+		t.Errorf("Unexpected counts: %d logs, %d metrics", o.logsSent, o.metricsSent)
+	}
+}
+
+func TestRetriesAndDrops(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	or := pipelinemock.NewMockOutputRunner(ctrl)
+	or.EXPECT().LogError(gomock.Any()).AnyTimes()
+
+	server, requests := newServer(t, http.StatusInternalServerError,
+		http.StatusAccepted, http.StatusBadRequest, http.StatusForbidden)
+	defer server.Close()
+	o := newOutput(t, server, func(config *DatadogOutputConfig) {})
+
+	// The failed request is retried.
+	o.logs = []json.RawMessage{json.RawMessage(`{"message":"a"}`)}
+	if err := o.flush(or); err != nil || o.logsSent != 1 || len(requests) != 2 {
+		t.Errorf("Unexpected result: %v, %d sent", err, o.logsSent)
+	}
+	// Rejected logs are dropped, a rejected key stops the output.
+	o.logs = []json.RawMessage{json.RawMessage(`{"message":"b"}`)}
+	if err := o.flush(or); err != nil || o.logsDropped != 1 {
+		t.Errorf("Unexpected result: %v, %d dropped", err, o.logsDropped)
+	}
+	o.logs = []json.RawMessage{json.RawMessage(`{"message":"c"}`)}
+	if err := o.flush(or); pipeline.ClassifyError(err) != pipeline.ErrKindFatal {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestRotatedApiKey(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	or := pipelinemock.NewMockOutputRunner(ctrl)
+	or.EXPECT().LogError(gomock.Any()).AnyTimes()
+
+	dir, err := ioutil.TempDir("", "datadog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	keyFile := filepath.Join(dir, "api_key")
+	if err = ioutil.WriteFile(keyFile, []byte("old\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	server, requests := newServer(t, http.StatusForbidden)
+	defer server.Close()
+	o := newOutput(t, server, func(config *DatadogOutputConfig) {
+		config.ApiKey = ""
+		config.ApiKeyFile = keyFile
+	})
+	// The key is rotated, keeping the file's modification time.
+	info, _ := os.Stat(keyFile)
+	ioutil.WriteFile(keyFile, []byte("new\n"), 0600)
+	os.Chtimes(keyFile, time.Now(), info.ModTime())
+
+	o.logs = []json.RawMessage{json.RawMessage(`{"message":"a"}`)}
+	if err = o.flush(or); err != nil {
+		t.Fatal(err)
+	}
+	if first, second := <-requests, <-requests; first.key != "old" || second.key != "new" {
+		t.Errorf("Unexpected keys: %s, %s", first.key, second.key)
+	}
+	if o.keyReloads != 1 || o.logsSent != 1 {
+		t.Errorf("Unexpected counts: %d reloads, %d sent", o.keyReloads, o.logsSent)
+	}
+}
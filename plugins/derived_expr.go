@@ -0,0 +1,424 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package plugins
+
+import (
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Arithmetic expressions over message fields, used by the DerivedFieldsFilter.
+//
+//	expr    = term { ("+" | "-") term }
+//	term    = unary { ("*" | "/" | "%") unary }
+//	unary   = "-" unary | power
+//	power   = primary [ "^" unary ]
+//	primary = number | "(" expr ")" | "Fields[" name "]" | name
+//	        | function "(" expr { "," expr } ")"
+//
+// A bare name refers to the message field of that name, except for
+// `Timestamp` (in seconds), `Severity`, and `Pid`, which refer to the
+// message headers, and `interval`, the seconds elapsed since the previous
+// message of the same group.
+
+// Evaluation state of one group of messages, for `delta`, `rate`, and
+// `interval`.
+type exprState struct {
+	lastTimestamp int64
+	hasTimestamp  bool
+	// Previous argument values of each `delta` or `rate` call.
+	last    []float64
+	hasLast []bool
+}
+
+type exprContext struct {
+	msg   *message.Message
+	state *exprState
+}
+
+// An expression node. Evaluation fails, returning false, if a referenced
+// field is missing or not numeric, or if there is no previous message for
+// `delta`, `rate`, or `interval`.
+type exprNode interface {
+	eval(ctx *exprContext) (float64, bool)
+}
+
+type numberNode float64
+
+func (n numberNode) eval(ctx *exprContext) (float64, bool) {
+	return float64(n), true
+}
+
+type fieldNode string
+
+func (n fieldNode) eval(ctx *exprContext) (float64, bool) {
+	value, ok := ctx.msg.GetFieldValue(string(n))
+	if !ok {
+		return 0, false
+	}
+	switch v := value.(type) {
+	case int64:
+		return float64(v), true
+	case float64:
+		return v, true
+	case bool:
+		if v {
+			return 1, true
+		}
+		return 0, true
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+type headerNode string
+
+func (n headerNode) eval(ctx *exprContext) (float64, bool) {
+	switch n {
+	case "Timestamp":
+		return float64(ctx.msg.GetTimestamp()) / 1e9, true
+	case "Severity":
+		return float64(ctx.msg.GetSeverity()), true
+	case "Pid":
+		return float64(ctx.msg.GetPid()), true
+	}
+	return 0, false
+}
+
+type intervalNode struct{}
+
+func (n intervalNode) eval(ctx *exprContext) (float64, bool) {
+	if !ctx.state.hasTimestamp {
+		return 0, false
+	}
+	return float64(ctx.msg.GetTimestamp()-ctx.state.lastTimestamp) / 1e9, true
+}
+
+type binaryNode struct {
+	op          byte
+	left, right exprNode
+}
+
+func (n *binaryNode) eval(ctx *exprContext) (float64, bool) {
+	l, ok := n.left.eval(ctx)
+	if !ok {
+		return 0, false
+	}
+	r, ok := n.right.eval(ctx)
+	if !ok {
+		return 0, false
+	}
+	switch n.op {
+	case '+':
+		return l + r, true
+	case '-':
+		return l - r, true
+	case '*':
+		return l * r, true
+	case '/':
+		return l / r, true
+	case '%':
+		return math.Mod(l, r), true
+	case '^':
+		return math.Pow(l, r), true
+	}
+	return 0, false
+}
+
+type negateNode struct {
+	operand exprNode
+}
+
+func (n *negateNode) eval(ctx *exprContext) (float64, bool) {
+	v, ok := n.operand.eval(ctx)
+	return -v, ok
+}
+
+type callNode struct {
+	fn   func(args []float64) float64
+	args []exprNode
+}
+
+func (n *callNode) eval(ctx *exprContext) (float64, bool) {
+	args := make([]float64, len(n.args))
+	for i, arg := range n.args {
+		v, ok := arg.eval(ctx)
+		if !ok {
+			return 0, false
+		}
+		args[i] = v
+	}
+	return n.fn(args), true
+}
+
+// `delta(x)`, the change in x since the previous message of the group, or
+// with `perSecond` set `rate(x)`, that change divided by the interval.
+type deltaNode struct {
+	arg       exprNode
+	slot      int
+	perSecond bool
+}
+
+func (n *deltaNode) eval(ctx *exprContext) (float64, bool) {
+	v, ok := n.arg.eval(ctx)
+	if !ok {
+		return 0, false
+	}
+	state := ctx.state
+	last, hasLast := state.last[n.slot], state.hasLast[n.slot]
+	state.last[n.slot], state.hasLast[n.slot] = v, true
+	if !hasLast {
+		return 0, false
+	}
+	if !n.perSecond {
+		return v - last, true
+	}
+	interval, ok := intervalNode{}.eval(ctx)
+	if !ok {
+		return 0, false
+	}
+	return (v - last) / interval, true
+}
+
+// Functions taking a fixed number of arguments.
+var exprFuncs = map[string]struct {
+	args int
+	fn   func(args []float64) float64
+}{
+	"abs":   {1, func(a []float64) float64 { return math.Abs(a[0]) }},
+	"ceil":  {1, func(a []float64) float64 { return math.Ceil(a[0]) }},
+	"floor": {1, func(a []float64) float64 { return math.Floor(a[0]) }},
+	"round": {1, func(a []float64) float64 { return math.Floor(a[0] + 0.5) }},
+	"sqrt":  {1, func(a []float64) float64 { return math.Sqrt(a[0]) }},
+	"log":   {1, func(a []float64) float64 { return math.Log(a[0]) }},
+	"log10": {1, func(a []float64) float64 { return math.Log10(a[0]) }},
+	"min":   {2, func(a []float64) float64 { return math.Min(a[0], a[1]) }},
+	"max":   {2, func(a []float64) float64 { return math.Max(a[0], a[1]) }},
+}
+
+type exprParser struct {
+	src string
+	pos int
+	// Number of `delta` and `rate` calls parsed so far, shared by all the
+	// expressions of a filter so each call gets its own state slot.
+	slots *int
+}
+
+// Parses an expression. `slots` counts the state slots used by `delta` and
+// `rate` calls.
+func parseExpr(src string, slots *int) (exprNode, error) {
+	p := &exprParser{src: src, slots: slots}
+	node, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	p.skipSpace()
+	if p.pos < len(p.src) {
+		return nil, p.errorf("unexpected '%c'", p.src[p.pos])
+	}
+	return node, nil
+}
+
+func (p *exprParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("at offset %d: %s", p.pos, fmt.Sprintf(format, args...))
+}
+
+func (p *exprParser) skipSpace() {
+	for p.pos < len(p.src) && unicode.IsSpace(rune(p.src[p.pos])) {
+		p.pos++
+	}
+}
+
+// Consumes the next character if it's one of `ops`.
+func (p *exprParser) accept(ops string) (byte, bool) {
+	p.skipSpace()
+	if p.pos < len(p.src) && strings.IndexByte(ops, p.src[p.pos]) != -1 {
+		p.pos++
+		return p.src[p.pos-1], true
+	}
+	return 0, false
+}
+
+func (p *exprParser) expr() (exprNode, error) {
+	left, err := p.term()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op, ok := p.accept("+-")
+		if !ok {
+			return left, nil
+		}
+		right, err := p.term()
+		if err != nil {
+			return nil, err
+		}
+		left = &binaryNode{op, left, right}
+	}
+}
+
+func (p *exprParser) term() (exprNode, error) {
+	left, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op, ok := p.accept("*/%")
+		if !ok {
+			return left, nil
+		}
+		right, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		left = &binaryNode{op, left, right}
+	}
+}
+
+func (p *exprParser) unary() (exprNode, error) {
+	if _, ok := p.accept("-"); ok {
+		operand, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return &negateNode{operand}, nil
+	}
+	base, err := p.primary()
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := p.accept("^"); ok {
+		exponent, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return &binaryNode{'^', base, exponent}, nil
+	}
+	return base, nil
+}
+
+func isNameChar(c byte, first bool) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') ||
+		(!first && (c == '.' || (c >= '0' && c <= '9')))
+}
+
+func (p *exprParser) primary() (exprNode, error) {
+	p.skipSpace()
+	if p.pos >= len(p.src) {
+		return nil, p.errorf("unexpected end of expression")
+	}
+	c := p.src[p.pos]
+	switch {
+	case c == '(':
+		p.pos++
+		node, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := p.accept(")"); !ok {
+			return nil, p.errorf("missing ')'")
+		}
+		return node, nil
+	case c == '.' || (c >= '0' && c <= '9'):
+		return p.number()
+	case isNameChar(c, true):
+		start := p.pos
+		for p.pos < len(p.src) && isNameChar(p.src[p.pos], false) {
+			p.pos++
+		}
+		return p.name(p.src[start:p.pos])
+	}
+	return nil, p.errorf("unexpected '%c'", c)
+}
+
+func (p *exprParser) number() (exprNode, error) {
+	start := p.pos
+	for p.pos < len(p.src) {
+		c := p.src[p.pos]
+		if (c >= '0' && c <= '9') || c == '.' {
+			p.pos++
+		} else if (c == 'e' || c == 'E') && p.pos+1 < len(p.src) {
+			p.pos++
+			if p.src[p.pos] == '+' || p.src[p.pos] == '-' {
+				p.pos++
+			}
+		} else {
+			break
+		}
+	}
+	v, err := strconv.ParseFloat(p.src[start:p.pos], 64)
+	if err != nil {
+		return nil, p.errorf("invalid number '%s'", p.src[start:p.pos])
+	}
+	return numberNode(v), nil
+}
+
+func (p *exprParser) name(name string) (exprNode, error) {
+	if name == "Fields" && p.pos < len(p.src) && p.src[p.pos] == '[' {
+		end := strings.IndexByte(p.src[p.pos:], ']')
+		if end == -1 {
+			return nil, p.errorf("missing ']'")
+		}
+		field := p.src[p.pos+1 : p.pos+end]
+		p.pos += end + 1
+		return fieldNode(field), nil
+	}
+	if _, ok := p.accept("("); !ok {
+		switch name {
+		case "interval":
+			return intervalNode{}, nil
+		case "Timestamp", "Severity", "Pid":
+			return headerNode(name), nil
+		}
+		return fieldNode(name), nil
+	}
+
+	var args []exprNode
+	if _, ok := p.accept(")"); !ok {
+		for {
+			arg, err := p.expr()
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, arg)
+			if _, ok := p.accept(")"); ok {
+				break
+			}
+			if _, ok := p.accept(","); !ok {
+				return nil, p.errorf("expected ',' or ')'")
+			}
+		}
+	}
+	switch name {
+	case "delta", "rate":
+		if len(args) != 1 {
+			return nil, p.errorf("%s takes 1 argument", name)
+		}
+		node := &deltaNode{arg: args[0], slot: *p.slots, perSecond: name == "rate"}
+		*p.slots++
+		return node, nil
+	}
+	f, ok := exprFuncs[name]
+	if !ok {
+		return nil, p.errorf("unknown function '%s'", name)
+	}
+	if len(args) != f.args {
+		return nil, p.errorf("%s takes %d argument(s)", name, f.args)
+	}
+	return &callNode{f.fn, args}, nil
+}
@@ -0,0 +1,187 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package plugins
+
+import (
+	"code.google.com/p/go-uuid/uuid"
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+	"github.com/mozilla-services/heka/pipeline"
+	"math"
+	"sort"
+	"strings"
+)
+
+// Filter computing new numeric fields from arithmetic expressions over the
+// fields of each message it receives, e.g. unit conversions or rates of
+// monotonic counters, and injecting the results as new messages.
+type DerivedFieldsFilter struct {
+	conf  *DerivedFieldsFilterConfig
+	names []string // Sorted, so fields are computed in a stable order.
+	exprs []exprNode
+	slots int // Number of `delta` and `rate` calls in the expressions.
+	// Evaluation state of each message group.
+	groups map[string]*exprState
+}
+
+// A derived field value.
+type derivedField struct {
+	name  string
+	value float64
+}
+
+type DerivedFieldsFilterConfig struct {
+	// Fields to compute, mapping each field name to its expression.
+	Fields map[string]string
+	// Representations of the computed fields, e.g. "ms", by field name.
+	Representations map[string]string
+	// Type of the injected messages. Defaults to "heka.derived".
+	MessageType string `toml:"message_type"`
+	// Whether the injected messages are copies of the original messages with
+	// the computed fields added, rather than new messages only containing
+	// the computed fields and the `group_by` fields. Defaults to true.
+	CopyMessage bool `toml:"copy_message"`
+	// Fields whose values separate messages into independent series for
+	// `delta`, `rate`, and `interval`, e.g. the host name of a counter.
+	GroupBy []string `toml:"group_by"`
+}
+
+func (f *DerivedFieldsFilter) ConfigStruct() interface{} {
+	return &DerivedFieldsFilterConfig{
+		MessageType: "heka.derived",
+		CopyMessage: true,
+	}
+}
+
+func (f *DerivedFieldsFilter) Init(config interface{}) error {
+	f.conf = config.(*DerivedFieldsFilterConfig)
+	if len(f.conf.Fields) == 0 {
+		return fmt.Errorf("no fields specified")
+	}
+	f.names = make([]string, 0, len(f.conf.Fields))
+	for name := range f.conf.Fields {
+		f.names = append(f.names, name)
+	}
+	sort.Strings(f.names)
+	f.exprs = make([]exprNode, len(f.names))
+	f.slots = 0
+	for i, name := range f.names {
+		expr, err := parseExpr(f.conf.Fields[name], &f.slots)
+		if err != nil {
+			return fmt.Errorf("invalid expression for field '%s': %s", name, err)
+		}
+		f.exprs[i] = expr
+	}
+	f.groups = make(map[string]*exprState)
+	return nil
+}
+
+func (f *DerivedFieldsFilter) Run(fr pipeline.FilterRunner,
+	h pipeline.PluginHelper) (err error) {
+
+	for pack := range fr.InChan() {
+		derived := f.derive(pack.Message)
+		if len(derived) == 0 {
+			pack.Recycle()
+			continue
+		}
+		newPack := h.PipelinePack(pack.MsgLoopCount)
+		if newPack == nil {
+			fr.LogError(fmt.Errorf("exceeded MaxMsgLoops = %d",
+				h.PipelineConfig().Globals.Tunables().MaxMsgLoops))
+			pack.Recycle()
+			continue
+		}
+		f.fillMessage(newPack.Message, pack.Message, fr.Name(), derived)
+		pack.Recycle()
+		fr.Inject(newPack)
+	}
+	return
+}
+
+// Computes the derived fields of a message, omitting those whose expressions
+// can't be evaluated or evaluate to NaN or infinity, and updates the state of
+// the message's group.
+func (f *DerivedFieldsFilter) derive(msg *message.Message) (derived []derivedField) {
+	key := f.groupKey(msg)
+	state, ok := f.groups[key]
+	if !ok {
+		state = &exprState{
+			last:    make([]float64, f.slots),
+			hasLast: make([]bool, f.slots),
+		}
+		f.groups[key] = state
+	}
+	ctx := &exprContext{msg: msg, state: state}
+	for i, expr := range f.exprs {
+		value, ok := expr.eval(ctx)
+		if !ok || math.IsNaN(value) || math.IsInf(value, 0) {
+			continue
+		}
+		derived = append(derived, derivedField{f.names[i], value})
+	}
+	state.lastTimestamp, state.hasTimestamp = msg.GetTimestamp(), true
+	return
+}
+
+func (f *DerivedFieldsFilter) groupKey(msg *message.Message) string {
+	if len(f.conf.GroupBy) == 0 {
+		return ""
+	}
+	values := make([]string, len(f.conf.GroupBy))
+	for i, name := range f.conf.GroupBy {
+		if value, ok := msg.GetFieldValue(name); ok {
+			values[i] = fmt.Sprint(value)
+		}
+	}
+	return strings.Join(values, "\x00")
+}
+
+// Fills in the injected message for a message and its derived fields.
+func (f *DerivedFieldsFilter) fillMessage(msg, orig *message.Message, logger string,
+	derived []derivedField) {
+
+	if f.conf.CopyMessage {
+		orig.Copy(msg)
+		msg.SetUuid(uuid.NewRandom())
+		// Replace any fields of the same names.
+		kept := msg.Fields[:0]
+		for _, field := range msg.Fields {
+			if _, ok := f.conf.Fields[field.GetName()]; !ok {
+				kept = append(kept, field)
+			}
+		}
+		msg.Fields = kept
+	} else {
+		msg.SetTimestamp(orig.GetTimestamp())
+		msg.SetHostname(orig.GetHostname())
+		msg.SetLogger(logger)
+		for _, name := range f.conf.GroupBy {
+			if field := orig.FindFirstField(name); field != nil {
+				msg.AddField(message.CopyField(field))
+			}
+		}
+	}
+	msg.SetType(f.conf.MessageType)
+	for _, d := range derived {
+		field, err := message.NewField(d.name, d.value, f.conf.Representations[d.name])
+		if err == nil {
+			msg.AddField(field)
+		}
+	}
+}
+
+func init() {
+	pipeline.RegisterPlugin("DerivedFieldsFilter", func() interface{} {
+		return new(DerivedFieldsFilter)
+	})
+}
@@ -0,0 +1,142 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package plugins
+
+import (
+	"github.com/mozilla-services/heka/message"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"time"
+)
+
+func DerivedFieldsFilterSpec(c gs.Context) {
+
+	c.Specify("A DerivedFieldsFilter", func() {
+		filter := new(DerivedFieldsFilter)
+		config := filter.ConfigStruct().(*DerivedFieldsFilterConfig)
+
+		newMsg := func(seconds int64, fields map[string]interface{}) *message.Message {
+			msg := new(message.Message)
+			msg.SetType("metric")
+			msg.SetTimestamp(seconds * int64(time.Second))
+			for name, value := range fields {
+				field, err := message.NewField(name, value, "")
+				c.Assume(err, gs.IsNil)
+				msg.AddField(field)
+			}
+			return msg
+		}
+
+		values := func(derived []derivedField) map[string]float64 {
+			result := make(map[string]float64)
+			for _, d := range derived {
+				result[d.name] = d.value
+			}
+			return result
+		}
+
+		c.Specify("computes fields", func() {
+			config.Fields = map[string]string{
+				"latency_ms": "duration_ns / 1e6",
+				"total":      "max(Fields[req.ok], 0) + errors",
+			}
+			c.Assume(filter.Init(config), gs.IsNil)
+			msg := newMsg(1, map[string]interface{}{
+				"duration_ns": int64(2500000),
+				"req.ok":      "40",
+				"errors":      2.0,
+			})
+			result := values(filter.derive(msg))
+			c.Expect(len(result), gs.Equals, 2)
+			c.Expect(result["latency_ms"], gs.Equals, 2.5)
+			c.Expect(result["total"], gs.Equals, float64(42))
+		})
+
+		c.Specify("skips fields that can't be computed", func() {
+			config.Fields = map[string]string{
+				"a": "missing * 2",
+				"b": "1 / zero",
+				"c": "zero + 1",
+			}
+			c.Assume(filter.Init(config), gs.IsNil)
+			result := values(filter.derive(newMsg(1, map[string]interface{}{"zero": int64(0)})))
+			c.Expect(len(result), gs.Equals, 1)
+			c.Expect(result["c"], gs.Equals, float64(1))
+		})
+
+		c.Specify("computes rates per group", func() {
+			config.Fields = map[string]string{
+				"rate":  "rate(requests)",
+				"delta": "delta(requests)",
+			}
+			config.GroupBy = []string{"host"}
+			c.Assume(filter.Init(config), gs.IsNil)
+			msg := func(seconds int64, host string, requests int64) *message.Message {
+				return newMsg(seconds, map[string]interface{}{
+					"host":     host,
+					"requests": requests,
+				})
+			}
+			c.Expect(len(filter.derive(msg(10, "a", 100))), gs.Equals, 0)
+			c.Expect(len(filter.derive(msg(12, "b", 500))), gs.Equals, 0)
+			result := values(filter.derive(msg(20, "a", 150)))
+			c.Expect(result["rate"], gs.Equals, float64(5))
+			c.Expect(result["delta"], gs.Equals, float64(50))
+			result = values(filter.derive(msg(14, "b", 520)))
+			c.Expect(result["rate"], gs.Equals, float64(10))
+		})
+
+		c.Specify("fails to initialize with an invalid expression", func() {
+			config.Fields = map[string]string{"x": "foo(1)"}
+			c.Expect(filter.Init(config), gs.Not(gs.IsNil))
+			config.Fields = map[string]string{"x": "(1 + 2"}
+			c.Expect(filter.Init(config), gs.Not(gs.IsNil))
+		})
+
+		c.Specify("builds output messages", func() {
+			config.Fields = map[string]string{"latency_ms": "duration_ns / 1e6"}
+			config.Representations = map[string]string{"latency_ms": "ms"}
+			orig := newMsg(1, map[string]interface{}{
+				"duration_ns": int64(2500000),
+				"host":        "web1",
+				"latency_ms":  "stale",
+			})
+			orig.SetHostname("box")
+
+			c.Specify("copying the original message", func() {
+				c.Assume(filter.Init(config), gs.IsNil)
+				msg := new(message.Message)
+				filter.fillMessage(msg, orig, "derived", filter.derive(orig))
+				c.Expect(msg.GetType(), gs.Equals, "heka.derived")
+				c.Expect(msg.GetHostname(), gs.Equals, "box")
+				c.Expect(len(msg.Fields), gs.Equals, 3)
+				field := msg.FindFirstField("latency_ms")
+				c.Expect(field.ValueDouble[0], gs.Equals, 2.5)
+				c.Expect(field.GetRepresentation(), gs.Equals, "ms")
+			})
+
+			c.Specify("with only the group fields", func() {
+				config.CopyMessage = false
+				config.GroupBy = []string{"host"}
+				config.MessageType = "latency"
+				c.Assume(filter.Init(config), gs.IsNil)
+				msg := new(message.Message)
+				filter.fillMessage(msg, orig, "derived", filter.derive(orig))
+				c.Expect(msg.GetType(), gs.Equals, "latency")
+				c.Expect(msg.GetLogger(), gs.Equals, "derived")
+				c.Expect(msg.GetTimestamp(), gs.Equals, orig.GetTimestamp())
+				c.Expect(len(msg.Fields), gs.Equals, 2)
+				host, _ := msg.GetFieldValue("host")
+				c.Expect(host, gs.Equals, "web1")
+			})
+		})
+	})
+}
@@ -0,0 +1,182 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package dns
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+	"github.com/mozilla-services/heka/pipeline"
+	"strings"
+	"time"
+)
+
+type DnsQueryLogDecoderConfig struct {
+	// Log format, "bind", "unbound", or "dnsmasq".
+	Format string
+	// Type of the decoded messages, left as it is if empty.
+	Type string
+	// Time zone of the timestamps, which have no zone in any of the formats.
+	// Defaults to "UTC".
+	TimestampLocation string `toml:"timestamp_location"`
+	// "none" (the default), "truncate" to strip the query names down to
+	// their last `keep_labels` labels, or "hash" to replace the labels
+	// before those with a keyed hash.
+	Anonymize string
+	// Labels of the query names kept by the anonymization, e.g. 2 to keep
+	// "example.com". Defaults to 2.
+	KeepLabels uint `toml:"keep_labels"`
+	// Key of the hash used by the "hash" anonymization.
+	AnonymizeKey string `toml:"anonymize_key"`
+	// Whether lines that aren't queries or replies, e.g. a server's startup
+	// messages, are dropped rather than failing to decode. Defaults to true.
+	DropOtherLines bool `toml:"drop_other_lines"`
+}
+
+// Decodes the query logs of BIND, unbound, and dnsmasq into typed fields,
+// without regular expressions, to keep up with busy resolvers.
+type DnsQueryLogDecoder struct {
+	conf  *DnsQueryLogDecoderConfig
+	parse func(line string, loc *time.Location, now time.Time) (*queryLogEntry,
+		error)
+	loc *time.Location
+	// Swapped out in tests.
+	now func() time.Time
+}
+
+func (d *DnsQueryLogDecoder) ConfigStruct() interface{} {
+	return &DnsQueryLogDecoderConfig{
+		TimestampLocation: "UTC",
+		Anonymize:         "none",
+		KeepLabels:        2,
+		DropOtherLines:    true,
+	}
+}
+
+func (d *DnsQueryLogDecoder) Init(config interface{}) (err error) {
+	d.conf = config.(*DnsQueryLogDecoderConfig)
+	switch d.conf.Format {
+	case "bind":
+		d.parse = parseBind
+	case "unbound":
+		d.parse = parseUnbound
+	case "dnsmasq":
+		d.parse = parseDnsmasq
+	case "":
+		return errors.New("format must be specified")
+	default:
+		return fmt.Errorf("unknown format: %s", d.conf.Format)
+	}
+	switch d.conf.Anonymize {
+	case "none", "truncate":
+	case "hash":
+		if d.conf.AnonymizeKey == "" {
+			return errors.New("the hash anonymization requires an anonymize_key")
+		}
+	default:
+		return fmt.Errorf("invalid anonymize: %s", d.conf.Anonymize)
+	}
+	if d.loc, err = time.LoadLocation(d.conf.TimestampLocation); err != nil {
+		return fmt.Errorf("unknown timestamp_location '%s': %s",
+			d.conf.TimestampLocation, err)
+	}
+	if d.now == nil {
+		d.now = time.Now
+	}
+	return nil
+}
+
+// Returns the query name, anonymized as configured.
+func (d *DnsQueryLogDecoder) anonymize(name string) string {
+	if d.conf.Anonymize == "none" {
+		return name
+	}
+	labels := strings.Split(name, ".")
+	keep := int(d.conf.KeepLabels)
+	if len(labels) <= keep {
+		return name
+	}
+	kept := strings.Join(labels[len(labels)-keep:], ".")
+	if d.conf.Anonymize == "truncate" {
+		return kept
+	}
+	mac := hmac.New(sha256.New, []byte(d.conf.AnonymizeKey))
+	mac.Write([]byte(strings.Join(labels[:len(labels)-keep], ".")))
+	hashed := hex.EncodeToString(mac.Sum(nil)[:8])
+	if kept == "" {
+		return hashed
+	}
+	return hashed + "." + kept
+}
+
+func (d *DnsQueryLogDecoder) Decode(pack *pipeline.PipelinePack) (
+	packs []*pipeline.PipelinePack, err error) {
+
+	line := strings.TrimRight(pack.Message.GetPayload(), "\r\n")
+	e, err := d.parse(line, d.loc, d.now())
+	if err == errNotQuery && d.conf.DropOtherLines {
+		pack.Recycle()
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	m := pack.Message
+	if !e.timestamp.IsZero() {
+		m.SetTimestamp(e.timestamp.UnixNano())
+	}
+	if d.conf.Type != "" {
+		m.SetType(d.conf.Type)
+	}
+	strs := []struct{ name, value string }{
+		{"action", e.action},
+		{"qname", d.anonymize(e.qname)},
+		{"qtype", e.qtype},
+		{"qclass", e.qclass},
+		{"rcode", e.rcode},
+		{"client_ip", e.clientIP},
+		{"server_ip", e.serverIP},
+		{"flags", e.flags},
+		{"answer", e.answer},
+	}
+	for _, s := range strs {
+		if s.value != "" {
+			message.NewStringField(m, s.name, s.value)
+		}
+	}
+	if e.clientPort > 0 {
+		message.NewIntField(m, "client_port", e.clientPort, "")
+	}
+	if e.action == "reply" {
+		if f, err := message.NewField("cached", e.cached, ""); err == nil {
+			m.AddField(f)
+		}
+	}
+	if e.duration > 0 {
+		if f, err := message.NewField("duration", e.duration, "s"); err == nil {
+			m.AddField(f)
+		}
+	}
+	if e.size > 0 {
+		message.NewIntField(m, "response_size", e.size, "B")
+	}
+	return []*pipeline.PipelinePack{pack}, nil
+}
+
+func init() {
+	pipeline.RegisterPlugin("DnsQueryLogDecoder", func() interface{} {
+		return new(DnsQueryLogDecoder)
+	})
+}
@@ -0,0 +1,204 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package dns
+
+import (
+	"github.com/mozilla-services/heka/pipeline"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var now = time.Date(2015, time.March, 15, 12, 0, 0, 0, time.UTC)
+
+func TestParseQueryLogs(t *testing.T) {
+	tests := []struct {
+		parse    func(string, *time.Location, time.Time) (*queryLogEntry, error)
+		line     string
+		expected *queryLogEntry
+	}{
+		{parseBind, "15-Mar-2015 10:20:30.123 client 192.168.1.10#53012 " +
+			"(WWW.Example.com): query: WWW.Example.com IN A +E (10.0.0.1)",
+			&queryLogEntry{
+				timestamp: time.Date(2015, time.March, 15, 10, 20, 30, 123000000,
+					time.UTC),
+				action: "query", qname: "www.example.com", qclass: "IN", qtype: "A",
+				clientIP: "192.168.1.10", clientPort: 53012, flags: "+E",
+				serverIP: "10.0.0.1"}},
+		{parseBind, "15-Mar-2015 10:20:30.123 queries: info: client @0x7f3c " +
+			"2001:db8::1#5353 (example.com): view internal: query: example.com " +
+			"IN AAAA +E(0)K (2001:db8::53)",
+			&queryLogEntry{
+				timestamp: time.Date(2015, time.March, 15, 10, 20, 30, 123000000,
+					time.UTC),
+				action: "query", qname: "example.com", qclass: "IN", qtype: "AAAA",
+				clientIP: "2001:db8::1", clientPort: 5353, flags: "+E(0)K",
+				serverIP: "2001:db8::53"}},
+		{parseBind, "15-Mar-2015 10:20:30.123 general: info: zone loaded", nil},
+		{parseUnbound, "[1426414830] unbound[1234:0] info: 192.168.1.10 " +
+			"www.example.com. A IN",
+			&queryLogEntry{timestamp: time.Unix(1426414830, 0), action: "query",
+				qname: "www.example.com", qtype: "A", qclass: "IN",
+				clientIP: "192.168.1.10"}},
+		{parseUnbound, "Mar 15 10:20:30 unbound[1234:0] reply: 192.168.1.10 " +
+			"nope.example.com. MX IN NXDOMAIN 0.000123 1 45",
+			&queryLogEntry{
+				timestamp: time.Date(2015, time.March, 15, 10, 20, 30, 0, time.UTC),
+				action:    "reply", qname: "nope.example.com", qtype: "MX",
+				qclass: "IN", clientIP: "192.168.1.10", rcode: "NXDOMAIN",
+				duration: 0.000123, cached: true, size: 45}},
+		{parseUnbound, "[1426414830] unbound[1234:0] info: start of service " +
+			"(unbound 1.5.1).", nil},
+		{parseDnsmasq, "Mar 15 10:20:30 dnsmasq[1234]: query[AAAA] example.com " +
+			"from 192.168.1.10",
+			&queryLogEntry{
+				timestamp: time.Date(2015, time.March, 15, 10, 20, 30, 0, time.UTC),
+				action:    "query", qname: "example.com", qtype: "AAAA",
+				clientIP: "192.168.1.10"}},
+		{parseDnsmasq, "Dec 31 23:59:59 dnsmasq[1234]: 14 192.168.1.10/53012 " +
+			"cached example.com is NXDOMAIN",
+			&queryLogEntry{
+				timestamp: time.Date(2014, time.December, 31, 23, 59, 59, 0, time.UTC),
+				action:    "reply", qname: "example.com", clientIP: "192.168.1.10",
+				clientPort: 53012, rcode: "NXDOMAIN", cached: true}},
+		{parseDnsmasq, "Mar 15 10:20:30 dnsmasq[1234]: reply example.com is " +
+			"93.184.216.34",
+			&queryLogEntry{
+				timestamp: time.Date(2015, time.March, 15, 10, 20, 30, 0, time.UTC),
+				action:    "reply", qname: "example.com", rcode: "NOERROR",
+				answer: "93.184.216.34"}},
+		{parseDnsmasq, "Mar 15 10:20:30 dnsmasq[1234]: forwarded example.com to " +
+			"8.8.8.8",
+			&queryLogEntry{
+				timestamp: time.Date(2015, time.March, 15, 10, 20, 30, 0, time.UTC),
+				action:    "forwarded", qname: "example.com", serverIP: "8.8.8.8"}},
+		{parseDnsmasq, "Mar 15 10:20:30 dnsmasq[1234]: read /etc/hosts - 2 addresses",
+			nil},
+	}
+	for _, test := range tests {
+		e, err := test.parse(test.line, time.UTC, now)
+		if test.expected == nil {
+			if err != errNotQuery {
+				t.Errorf("%s: unexpected result %+v, %v", test.line, e, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.line, err)
+			continue
+		}
+		if !e.timestamp.Equal(test.expected.timestamp) {
+			t.Errorf("%s: unexpected timestamp %s", test.line, e.timestamp)
+		}
+		e.timestamp = test.expected.timestamp
+		if !reflect.DeepEqual(e, test.expected) {
+			t.Errorf("%s: unexpected entry %+v", test.line, e)
+		}
+	}
+}
+
+func newTestDecoder(t *testing.T, config *DnsQueryLogDecoderConfig) *DnsQueryLogDecoder {
+	d := &DnsQueryLogDecoder{now: func() time.Time { return now }}
+	if err := d.Init(config); err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func TestDecoderConfig(t *testing.T) {
+	d := new(DnsQueryLogDecoder)
+	config := d.ConfigStruct().(*DnsQueryLogDecoderConfig)
+	if err := d.Init(config); err == nil || err.Error() != "format must be specified" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	config.Format = "unbound"
+	config.Anonymize = "hash"
+	if err := d.Init(config); err == nil {
+		t.Error("hash anonymization accepted without a key")
+	}
+}
+
+func TestDecoder(t *testing.T) {
+	d := new(DnsQueryLogDecoder)
+	config := d.ConfigStruct().(*DnsQueryLogDecoderConfig)
+	config.Format = "unbound"
+	config.Type = "dns.unbound"
+	d = newTestDecoder(t, config)
+
+	pack := pipeline.NewPipelinePack(nil)
+	pack.Message.SetPayload("[1426414830] unbound[1234:0] reply: 192.168.1.10 " +
+		"a.b.example.com. A IN NOERROR 0.25 0 61\n")
+	packs, err := d.Decode(pack)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := packs[0].Message
+	fields := map[string]interface{}{
+		"action":        "reply",
+		"qname":         "a.b.example.com",
+		"qtype":         "A",
+		"rcode":         "NOERROR",
+		"client_ip":     "192.168.1.10",
+		"cached":        false,
+		"duration":      0.25,
+		"response_size": int64(61),
+	}
+	for name, expected := range fields {
+		if value, _ := m.GetFieldValue(name); value != expected {
+			t.Errorf("Unexpected %s: %v", name, value)
+		}
+	}
+	if m.GetTimestamp() != 1426414830*int64(time.Second) || m.GetType() != "dns.unbound" {
+		t.Errorf("Unexpected message: %v", m)
+	}
+
+	pack = pipeline.NewPipelinePack(nil)
+	pack.Message.SetPayload("[1426414830] unbound[1234:0] notice: init module 0")
+	if packs, err = d.Decode(pack); packs != nil || err != nil {
+		t.Errorf("Other line not dropped: %v, %v", packs, err)
+	}
+	config.DropOtherLines = false
+	d = newTestDecoder(t, config)
+	if _, err = d.Decode(pack); err != errNotQuery {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestAnonymize(t *testing.T) {
+	d := new(DnsQueryLogDecoder)
+	config := d.ConfigStruct().(*DnsQueryLogDecoderConfig)
+	config.Format = "bind"
+	config.Anonymize = "truncate"
+	d = newTestDecoder(t, config)
+	if name := d.anonymize("a.b.example.com"); name != "example.com" {
+		t.Errorf("Unexpected truncated name: %s", name)
+	}
+	if name := d.anonymize("example.com"); name != "example.com" {
+		t.Errorf("Unexpected truncated name: %s", name)
+	}
+
+	config.Anonymize = "hash"
+	config.AnonymizeKey = "secret"
+	d = newTestDecoder(t, config)
+	hashed := d.anonymize("a.b.example.com")
+	if len(hashed) != 28 || hashed[16:] != ".example.com" ||
+		hashed != d.anonymize("a.b.example.com") ||
+		hashed == d.anonymize("c.b.example.com") {
+
+		t.Errorf("Unexpected hashed name: %s", hashed)
+	}
+	config.KeepLabels = 0
+	d = newTestDecoder(t, config)
+	if hashed = d.anonymize("example.com"); len(hashed) != 16 {
+		t.Errorf("Unexpected hashed name: %s", hashed)
+	}
+}
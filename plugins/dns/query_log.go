@@ -0,0 +1,230 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package dns
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A parsed DNS server log line. Values not in the line are left empty.
+type queryLogEntry struct {
+	timestamp  time.Time // Zero if the line has no usable timestamp.
+	action     string    // e.g. "query" or "reply".
+	qname      string
+	qtype      string
+	qclass     string
+	rcode      string
+	clientIP   string
+	clientPort int
+	serverIP   string
+	flags      string
+	answer     string
+	duration   float64 // Seconds.
+	cached     bool
+	size       int
+}
+
+var errNotQuery = errors.New("not a query log line")
+
+// Layout of BIND's default log timestamps.
+const bindLayout = "02-Jan-2006 15:04:05.000"
+
+// Layout of syslog timestamps, also used by unbound's log-time-ascii option.
+const syslogLayout = "Jan _2 15:04:05"
+
+// Parses a syslog style timestamp at the start of a line, which has no year,
+// in the year that puts it closest to `now`.
+func parseSyslogTime(line string, loc *time.Location, now time.Time) time.Time {
+	if len(line) < len(syslogLayout) {
+		return time.Time{}
+	}
+	ts, err := time.ParseInLocation(syslogLayout, line[:len(syslogLayout)], loc)
+	if err != nil {
+		return time.Time{}
+	}
+	now = now.In(loc)
+	ts = ts.AddDate(now.Year(), 0, 0)
+	// Lines logged just before new year are read in the next one.
+	if ts.After(now.Add(24 * time.Hour)) {
+		ts = ts.AddDate(-1, 0, 0)
+	}
+	return ts
+}
+
+// Splits an "address#port" or "address/port" client address.
+func splitClient(addr string, sep string) (ip string, port int) {
+	i := strings.LastIndex(addr, sep)
+	if i < 0 {
+		return addr, 0
+	}
+	port, _ = strconv.Atoi(addr[i+1:])
+	return addr[:i], port
+}
+
+// Lowercases a query name and strips its trailing dot.
+func normalizeName(name string) string {
+	if len(name) > 1 {
+		name = strings.TrimSuffix(name, ".")
+	}
+	return strings.ToLower(name)
+}
+
+// Whether a token is a DNS class, distinguishing unbound's query lines from
+// its other info messages.
+func isClass(token string) bool {
+	switch token {
+	case "IN", "CH", "HS", "NONE", "ANY":
+		return true
+	}
+	return strings.HasPrefix(token, "CLASS")
+}
+
+// Parses a BIND query log line, e.g.
+//
+//	15-Mar-2015 10:20:30.123 queries: info: client @0x7f3c 192.168.1.10#53012
+//	(www.example.com): query: www.example.com IN A +E(0)K (10.0.0.1)
+func parseBind(line string, loc *time.Location, now time.Time) (*queryLogEntry,
+	error) {
+
+	qi := strings.Index(line, " query: ")
+	if qi < 0 {
+		return nil, errNotQuery
+	}
+	ci := strings.LastIndex(line[:qi], "client ")
+	if ci < 0 {
+		return nil, errNotQuery
+	}
+	e := &queryLogEntry{action: "query"}
+	for _, token := range strings.Fields(line[ci+len("client ") : qi]) {
+		// Skipping the client object's address, logged by BIND 9.11+.
+		if !strings.HasPrefix(token, "@") {
+			e.clientIP, e.clientPort = splitClient(token, "#")
+			break
+		}
+	}
+	tokens := strings.Fields(line[qi+len(" query: "):])
+	if len(tokens) < 3 {
+		return nil, errNotQuery
+	}
+	e.qname, e.qclass, e.qtype = normalizeName(tokens[0]), tokens[1], tokens[2]
+	if len(tokens) > 3 {
+		e.flags = tokens[3]
+	}
+	if len(tokens) > 4 {
+		e.serverIP = strings.Trim(tokens[4], "()")
+	}
+	if len(line) >= len(bindLayout) {
+		if ts, err := time.ParseInLocation(bindLayout, line[:len(bindLayout)],
+			loc); err == nil {
+
+			e.timestamp = ts
+		}
+	}
+	return e, nil
+}
+
+// Parses an unbound log-queries or log-replies line, e.g.
+//
+//	[1426414830] unbound[1234:0] info: 192.168.1.10 www.example.com. A IN
+//	[1426414830] unbound[1234:0] reply: 192.168.1.10 www.example.com. A IN
+//	NOERROR 0.000123 0 45
+func parseUnbound(line string, loc *time.Location, now time.Time) (*queryLogEntry,
+	error) {
+
+	e := new(queryLogEntry)
+	var rest string
+	if i := strings.Index(line, " info: "); i >= 0 {
+		e.action, rest = "query", line[i+len(" info: "):]
+	} else if i = strings.Index(line, " reply: "); i >= 0 {
+		e.action, rest = "reply", line[i+len(" reply: "):]
+	} else {
+		return nil, errNotQuery
+	}
+	tokens := strings.Fields(rest)
+	if len(tokens) < 4 || !isClass(tokens[3]) {
+		return nil, errNotQuery
+	}
+	e.clientIP = tokens[0]
+	e.qname, e.qtype, e.qclass = normalizeName(tokens[1]), tokens[2], tokens[3]
+	if e.action == "reply" && len(tokens) >= 8 {
+		e.rcode = tokens[4]
+		e.duration, _ = strconv.ParseFloat(tokens[5], 64)
+		e.cached = tokens[6] == "1"
+		e.size, _ = strconv.Atoi(tokens[7])
+	}
+	if strings.HasPrefix(line, "[") {
+		if end := strings.IndexByte(line, ']'); end > 0 {
+			if secs, err := strconv.ParseInt(line[1:end], 10, 64); err == nil {
+				e.timestamp = time.Unix(secs, 0)
+			}
+		}
+	} else {
+		e.timestamp = parseSyslogTime(line, loc, now)
+	}
+	return e, nil
+}
+
+// Parses a dnsmasq log-queries line, with or without log-queries=extra, e.g.
+//
+//	Mar 15 10:20:30 dnsmasq[1234]: query[A] www.example.com from 192.168.1.10
+//	Mar 15 10:20:30 dnsmasq[1234]: 14 192.168.1.10/53012 reply
+//	www.example.com is 93.184.216.34
+func parseDnsmasq(line string, loc *time.Location, now time.Time) (*queryLogEntry,
+	error) {
+
+	i := strings.Index(line, "dnsmasq")
+	if i < 0 {
+		return nil, errNotQuery
+	}
+	colon := strings.Index(line[i:], ": ")
+	if colon < 0 {
+		return nil, errNotQuery
+	}
+	tokens := strings.Fields(line[i+colon+2:])
+	e := new(queryLogEntry)
+	if len(tokens) > 2 && strings.IndexByte(tokens[1], '/') > 0 {
+		if _, err := strconv.Atoi(tokens[0]); err == nil {
+			e.clientIP, e.clientPort = splitClient(tokens[1], "/")
+			tokens = tokens[2:]
+		}
+	}
+	if len(tokens) < 4 {
+		return nil, errNotQuery
+	}
+	e.qname = normalizeName(tokens[1])
+	switch action := tokens[0]; {
+	case strings.HasPrefix(action, "query[") && strings.HasSuffix(action, "]"):
+		e.action, e.qtype = "query", action[len("query["):len(action)-1]
+		if tokens[2] == "from" {
+			e.clientIP = tokens[3]
+		}
+	case action == "forwarded" && tokens[2] == "to":
+		e.action, e.serverIP = "forwarded", tokens[3]
+	case (action == "reply" || action == "cached") && tokens[2] == "is":
+		e.action, e.cached = "reply", action == "cached"
+		switch answer := tokens[3]; {
+		case answer == "NXDOMAIN", answer == "SERVFAIL", answer == "REFUSED":
+			e.rcode = answer
+		case strings.HasPrefix(answer, "NODATA"):
+			e.rcode = "NOERROR"
+		default:
+			e.rcode, e.answer = "NOERROR", answer
+		}
+	default:
+		return nil, errNotQuery
+	}
+	e.timestamp = parseSyslogTime(line, loc, now)
+	return e, nil
+}
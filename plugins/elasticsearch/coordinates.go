@@ -19,6 +19,7 @@ import (
 	"bytes"
 	"fmt"
 	"github.com/mozilla-services/heka/message"
+	"github.com/mozilla-services/heka/pipeline"
 	"strconv"
 	"strings"
 	"time"
@@ -31,6 +32,21 @@ type ElasticSearchCoordinates struct {
 	Type                 string
 	Id                   string
 	ESIndexFromTimestamp bool
+	// Optional guard against unbounded index names, see SetIndexLimit.
+	indexTemplate *pipeline.DestinationTemplate
+}
+
+// Caps the number of distinct indexes that the Index setting can render to
+// `max`, sending any messages that would exceed the cap (or that are missing
+// a referenced field) to the `fallback` index.
+func (e *ElasticSearchCoordinates) SetIndexLimit(max uint, fallback string) (err error) {
+	e.indexTemplate, err = pipeline.NewDestinationTemplate(pipeline.DestinationTemplateConfig{
+		Template:            e.Index,
+		MaxCardinality:      max,
+		Fallback:            fallback,
+		UseMessageTimestamp: e.ESIndexFromTimestamp,
+	})
+	return
 }
 
 // Renders the coordinates of the ElasticSearch document as JSON.
@@ -44,7 +60,12 @@ func (e *ElasticSearchCoordinates) PopulateBuffer(m *message.Message, buf *bytes
 		interpId    string
 	)
 
-	interpIndex, err = interpolateFlag(e, m, e.Index)
+	if e.indexTemplate != nil {
+		interpIndex, err = e.indexTemplate.Destination(m)
+	}
+	if e.indexTemplate == nil || err != nil {
+		interpIndex, err = interpolateFlag(e, m, e.Index)
+	}
 
 	buf.WriteString(strconv.Quote(interpIndex))
 	buf.WriteString(`,"_type":`)
@@ -64,6 +85,64 @@ func (e *ElasticSearchCoordinates) PopulateBuffer(m *message.Message, buf *bytes
 	buf.WriteString(`}}`)
 }
 
+// Go time layouts for the supported strftime date specifiers.
+var strftimeLayouts = map[byte]string{
+	'Y': "2006",
+	'y': "06",
+	'm': "01",
+	'b': "Jan",
+	'B': "January",
+	'd': "02",
+	'a': "Mon",
+	'A': "Monday",
+	'H': "15",
+	'M': "04",
+	'S': "05",
+	'z': "-0700",
+	'Z': "MST",
+}
+
+// Converts strftime style date specifiers in an index name to the
+// equivalent time layout pattern, e.g. "logs-%Y.%m.%d" becomes
+// "logs-%{2006.01.02}". Specifiers separated only by '.', '-', ':', or '/'
+// characters are combined into a single pattern.
+func strftimeToLayout(name string) string {
+	specifier := func(i int) (string, bool) {
+		if i+1 >= len(name) || name[i] != '%' {
+			return "", false
+		}
+		layout, ok := strftimeLayouts[name[i+1]]
+		return layout, ok
+	}
+
+	var out bytes.Buffer
+	for i := 0; i < len(name); {
+		layout, ok := specifier(i)
+		if !ok {
+			out.WriteByte(name[i])
+			i++
+			continue
+		}
+		out.WriteString("%{")
+		out.WriteString(layout)
+		i += 2
+		for {
+			j := i
+			for j < len(name) && strings.IndexByte(".-:/", name[j]) >= 0 {
+				j++
+			}
+			if layout, ok = specifier(j); !ok {
+				break
+			}
+			out.WriteString(name[i:j])
+			out.WriteString(layout)
+			i = j + 2
+		}
+		out.WriteString("}")
+	}
+	return out.String()
+}
+
 // Replaces a date pattern (ex: %{2012.09.19} in the index name
 func interpolateFlag(e *ElasticSearchCoordinates, m *message.Message, name string) (
 	interpolatedValue string, err error) {
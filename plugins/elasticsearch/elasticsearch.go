@@ -20,19 +20,26 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/mozilla-services/heka/message"
 	. "github.com/mozilla-services/heka/pipeline"
 	"io/ioutil"
 	"net"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // Output plugin that index messages to an elasticsearch cluster.
 // Largely based on FileOutput plugin.
 type ElasticSearchOutput struct {
+	bulkRetries   int64
+	bulkThrottles int64
+	bulkDrops     int64
+
 	flushInterval uint32
 	flushCount    int
 	batchChan     chan []byte
@@ -49,6 +56,11 @@ type ElasticSearchOutput struct {
 	// It's always included in overall request timeout (see 'http_timeout' option).
 	// Default is 0 (infinite)
 	connect_timeout uint32
+	// Used to build the bulk index requests when no encoder is specified.
+	encoder *ESJsonEncoder
+	// Backoff for failed and throttled bulk index requests.
+	retries *RetryHelper
+	pConfig *PipelineConfig
 }
 
 // ConfigStruct for ElasticSearchOutput plugin.
@@ -78,6 +90,26 @@ type ElasticSearchOutputConfig struct {
 	HTTPDisableKeepalives bool `toml:"http_disable_keepalives"`
 	// Resolve and connect timeout only
 	ConnectTimeout uint32 `toml:"connect_timeout"`
+	// Size of the accumulated bulk request data, in bytes, that triggers a
+	// bulk indexation to ElasticSearch over HTTP. Defaults to 0, i.e. only
+	// `flush_count` is used.
+	FlushBytes int `toml:"flush_bytes"`
+	// Name of the index in which the messages will be indexed when no encoder
+	// is specified. Supports the same interpolation as the ESJsonEncoder's
+	// Index setting, along with strftime style date specifiers. Defaults to
+	// "heka-%{2006.01.02}".
+	Index string
+	// Name of the document type when no encoder is specified. Defaults to
+	// "message".
+	TypeName string `toml:"type_name"`
+	// Document ID to use when no encoder is specified. Defaults to "".
+	Id string
+	// When formatting the Index use the Timestamp from the Message instead of
+	// time of processing. Defaults to false.
+	ESIndexFromTimestamp bool `toml:"es_index_from_timestamp"`
+	// The output's retry settings, also used to back off from failed and
+	// throttled bulk index requests.
+	Retries RetryOptions
 }
 
 func (o *ElasticSearchOutput) ConfigStruct() interface{} {
@@ -90,9 +122,20 @@ func (o *ElasticSearchOutput) ConfigStruct() interface{} {
 		HTTPTimeout:           0,
 		HTTPDisableKeepalives: false,
 		ConnectTimeout:        0,
+		Index:                 "heka-%{2006.01.02}",
+		TypeName:              "message",
+		Retries: RetryOptions{
+			MaxDelay:   "30s",
+			Delay:      "250ms",
+			MaxRetries: -1,
+		},
 	}
 }
 
+func (o *ElasticSearchOutput) SetPipelineConfig(pConfig *PipelineConfig) {
+	o.pConfig = pConfig
+}
+
 func (o *ElasticSearchOutput) Init(config interface{}) (err error) {
 	conf := config.(*ElasticSearchOutputConfig)
 	o.flushInterval = conf.FlushInterval
@@ -102,13 +145,29 @@ func (o *ElasticSearchOutput) Init(config interface{}) (err error) {
 	o.http_timeout = conf.HTTPTimeout
 	o.http_disable_keepalives = conf.HTTPDisableKeepalives
 	o.connect_timeout = conf.ConnectTimeout
+	if o.retries, err = NewRetryHelper(conf.Retries); err != nil {
+		return fmt.Errorf("invalid retries: %s", err)
+	}
+
+	o.encoder = new(ESJsonEncoder)
+	encoderConf := o.encoder.ConfigStruct().(*ESJsonEncoderConfig)
+	encoderConf.Index = conf.Index
+	encoderConf.TypeName = conf.TypeName
+	encoderConf.Id = conf.Id
+	encoderConf.ESIndexFromTimestamp = conf.ESIndexFromTimestamp
+	if err = o.encoder.Init(encoderConf); err != nil {
+		return
+	}
+
 	var serverUrl *url.URL
 	if serverUrl, err = url.Parse(conf.Server); err == nil {
 		switch strings.ToLower(serverUrl.Scheme) {
 		case "http", "https":
-			o.bulkIndexer = NewHttpBulkIndexer(strings.ToLower(serverUrl.Scheme),
+			indexer := NewHttpBulkIndexer(strings.ToLower(serverUrl.Scheme),
 				serverUrl.Host, o.flushCount, conf.Username, conf.Password,
 				o.http_timeout, o.http_disable_keepalives, o.connect_timeout)
+			indexer.MaxLength = conf.FlushBytes
+			o.bulkIndexer = indexer
 		case "udp":
 			o.bulkIndexer = NewUDPBulkIndexer(serverUrl.Host, o.flushCount)
 		default:
@@ -121,9 +180,6 @@ func (o *ElasticSearchOutput) Init(config interface{}) (err error) {
 }
 
 func (o *ElasticSearchOutput) Run(or OutputRunner, h PluginHelper) (err error) {
-	if or.Encoder() == nil {
-		return errors.New("Encoder must be specified.")
-	}
 	var wg sync.WaitGroup
 	wg.Add(2)
 	go o.receiver(or, &wg)
@@ -158,9 +214,25 @@ func (o *ElasticSearchOutput) receiver(or OutputRunner, wg *sync.WaitGroup) {
 				close(o.batchChan)
 				break
 			}
-			outBytes, e = or.Encode(pack)
+			if or.Encoder() != nil {
+				outBytes, e = or.Encode(pack)
+			} else {
+				outBytes, e = o.encoder.Encode(pack)
+			}
 			pack.Recycle()
-			if e != nil {
+			if oversized, isOversized := e.(*OversizedRecordError); isOversized &&
+				oversized.Record != nil {
+
+				// Index the oversized record on its own, so if it's rejected
+				// the other records of the batch still make it.
+				if len(outBatch) > 0 {
+					o.batchChan <- outBatch
+					outBatch = <-o.backChan
+					count = 0
+				}
+				o.batchChan <- append(outBatch, oversized.Record...)
+				outBatch = <-o.backChan
+			} else if e != nil {
 				or.LogError(e)
 			} else if outBytes != nil {
 				outBatch = append(outBatch, outBytes...)
@@ -196,15 +268,62 @@ func (o *ElasticSearchOutput) committer(or OutputRunner, wg *sync.WaitGroup) {
 	var outBatch []byte
 
 	for outBatch = range o.batchChan {
-		if err := o.bulkIndexer.Index(outBatch); err != nil {
-			or.LogError(err)
-		}
+		o.index(or, outBatch)
 		outBatch = outBatch[:0]
 		o.backChan <- outBatch
 	}
 	wg.Done()
 }
 
+// Indexes a batch, backing off and retrying while ElasticSearch is throttling
+// requests or failing in a way that's worth retrying. Documents that
+// ElasticSearch rejects because it's overloaded are retried on their own.
+// Batches that can't be indexed are dropped.
+func (o *ElasticSearchOutput) index(or OutputRunner, batch []byte) {
+	o.retries.Reset()
+	for {
+		err := o.bulkIndexer.Index(batch)
+		if err == nil {
+			return
+		}
+		or.LogError(err)
+		kind := ClassifyError(err)
+		if kind == ErrKindThrottled {
+			atomic.AddInt64(&o.bulkThrottles, 1)
+			outputErr := err.(*OutputError)
+			if rejected, ok := outputErr.Err.(*BulkRejectedError); ok {
+				batch = rejected.Retry
+			}
+			if outputErr.RetryAfter > 0 {
+				time.Sleep(outputErr.RetryAfter)
+				continue
+			}
+		}
+		if kind != ErrKindThrottled && kind != ErrKindRetryable {
+			break
+		}
+		if o.pConfig != nil && o.pConfig.Globals.IsShuttingDown() {
+			break
+		}
+		if o.retries.Wait() != nil {
+			or.LogError(errors.New("retries exhausted"))
+			break
+		}
+		atomic.AddInt64(&o.bulkRetries, 1)
+	}
+	atomic.AddInt64(&o.bulkDrops, 1)
+	or.LogError(errors.New("dropping bulk index request"))
+}
+
+func (o *ElasticSearchOutput) ReportMsg(msg *message.Message) error {
+	message.NewInt64Field(msg, "BulkRetries", atomic.LoadInt64(&o.bulkRetries),
+		"count")
+	message.NewInt64Field(msg, "BulkThrottles", atomic.LoadInt64(&o.bulkThrottles),
+		"count")
+	message.NewInt64Field(msg, "BulkDrops", atomic.LoadInt64(&o.bulkDrops), "count")
+	return nil
+}
+
 // A BulkIndexer is used to index documents in ElasticSearch
 type BulkIndexer interface {
 	// Index documents
@@ -222,6 +341,8 @@ type HttpBulkIndexer struct {
 	Domain string
 	// Maximum number of documents.
 	MaxCount int
+	// Maximum length of the request body, 0 for no limit.
+	MaxLength int
 	// Internal HTTP Client.
 	client *http.Client
 	// Optional username for HTTP authentication
@@ -258,20 +379,52 @@ func NewHttpBulkIndexer(protocol string, domain string, maxCount int,
 func (h *HttpBulkIndexer) CheckFlush(count int, length int) bool {
 	if count >= h.MaxCount {
 		return true
+	} else if h.MaxLength > 0 && length >= h.MaxLength {
+		return true
 	}
 	return false
 }
 
+// Returned, wrapped in a throttled *OutputError, when ElasticSearch rejected
+// some of the documents in a bulk request because it was overloaded, i.e.
+// with a 429 status.
+type BulkRejectedError struct {
+	// Number of rejected documents.
+	Rejected int
+	// Bulk request body containing only the rejected documents.
+	Retry []byte
+	// Description of any documents that failed for other reasons.
+	Failures string
+}
+
+func (e *BulkRejectedError) Error() string {
+	msg := fmt.Sprintf("ElasticSearch rejected %d documents", e.Rejected)
+	if e.Failures != "" {
+		msg = fmt.Sprintf("%s, other errors: %s", msg, e.Failures)
+	}
+	return msg
+}
+
+// The parts of a bulk API response we need.
+type bulkResponse struct {
+	Errors bool
+	Items  []map[string]struct {
+		Status int
+		Error  interface{}
+	}
+}
+
+// Sends a bulk request. Failures are returned as *OutputError values
+// indicating whether the request is worth retrying.
 func (h *HttpBulkIndexer) Index(body []byte) error {
 	var response_body []byte
-	var response_body_json map[string]interface{}
 
 	url := fmt.Sprintf("%s://%s%s", h.Protocol, h.Domain, "/_bulk")
 
 	// Creating ElasticSearch Bulk HTTP request
 	request, err := http.NewRequest("POST", url, bytes.NewReader(body))
 	if err != nil {
-		return fmt.Errorf("Can't create bulk request: %s", err.Error())
+		return NewFatalError(fmt.Errorf("Can't create bulk request: %s", err.Error()))
 	}
 	request.Header.Add("Accept", "application/json")
 	if h.username != "" && h.password != "" {
@@ -285,34 +438,86 @@ func (h *HttpBulkIndexer) Index(body []byte) error {
 		if (h.client.Timeout > 0) && (request_time >= h.client.Timeout) &&
 			(strings.Contains(err.Error(), "use of closed network connection")) {
 
-			return fmt.Errorf("HTTP request was interrupted after timeout. It lasted %s",
-				request_time.String())
+			return NewRetryableError(fmt.Errorf(
+				"HTTP request was interrupted after timeout. It lasted %s",
+				request_time.String()))
 		} else {
-			return fmt.Errorf("HTTP request failed: %s", err.Error())
+			return NewRetryableError(fmt.Errorf("HTTP request failed: %s", err.Error()))
 		}
 	}
 	if response != nil {
 		defer response.Body.Close()
 		if response.StatusCode > 304 {
-			return fmt.Errorf("HTTP response error status: %s", response.Status)
+			err = fmt.Errorf("HTTP response error status: %s", response.Status)
+			switch {
+			case response.StatusCode == 429 ||
+				response.StatusCode == http.StatusServiceUnavailable:
+				var retryAfter time.Duration
+				secs, e := strconv.Atoi(response.Header.Get("Retry-After"))
+				if e == nil {
+					retryAfter = time.Duration(secs) * time.Second
+				}
+				return NewThrottledError(err, retryAfter)
+			case response.StatusCode >= 500:
+				return NewRetryableError(err)
+			}
+			return NewMalformedMessageError(err)
 		}
 		if response_body, err = ioutil.ReadAll(response.Body); err != nil {
-			return fmt.Errorf("Can't read HTTP response body: %s", err.Error())
+			return NewRetryableError(fmt.Errorf("Can't read HTTP response body: %s",
+				err.Error()))
 		}
-		err = json.Unmarshal(response_body, &response_body_json)
+		var bulkResp bulkResponse
+		err = json.Unmarshal(response_body, &bulkResp)
 		if err != nil {
-			return fmt.Errorf("HTTP response didn't contain valid JSON. Body: %s",
-				string(response_body))
+			return NewMalformedMessageError(fmt.Errorf(
+				"HTTP response didn't contain valid JSON. Body: %s",
+				string(response_body)))
 		}
-		json_errors, ok := response_body_json["errors"].(bool)
-		if ok && json_errors {
-			return fmt.Errorf("ElasticSearch server reported error within JSON: %s",
-				string(response_body))
+		if bulkResp.Errors {
+			return itemErrors(body, response_body, &bulkResp)
 		}
 	}
 	return nil
 }
 
+// Works out what to do about the documents that failed within a bulk
+// request. If any were rejected with a 429 status, and the request body
+// consists of action and document line pairs, the rejected documents are
+// returned to be retried.
+func itemErrors(body, response_body []byte, bulkResp *bulkResponse) error {
+	lines := bytes.SplitAfter(body, []byte{NEWLINE})
+	if len(lines[len(lines)-1]) == 0 {
+		lines = lines[:len(lines)-1]
+	}
+	pairs := len(lines) == 2*len(bulkResp.Items)
+
+	rejected := new(BulkRejectedError)
+	var failures []string
+	for i, item := range bulkResp.Items {
+		for _, result := range item {
+			if result.Status < 300 {
+				continue
+			}
+			if result.Status == 429 && pairs {
+				rejected.Rejected++
+				rejected.Retry = append(rejected.Retry, lines[2*i]...)
+				rejected.Retry = append(rejected.Retry, lines[2*i+1]...)
+				continue
+			}
+			failures = append(failures, fmt.Sprintf("%d %v", result.Status,
+				result.Error))
+		}
+	}
+	if rejected.Rejected == 0 {
+		return NewMalformedMessageError(fmt.Errorf(
+			"ElasticSearch server reported error within JSON: %s",
+			string(response_body)))
+	}
+	rejected.Failures = strings.Join(failures, "; ")
+	return NewThrottledError(rejected, 0)
+}
+
 // A UDPBulkIndexer uses the Bulk UDP Api of ElasticSearch
 // in order to index documents
 type UDPBulkIndexer struct {
@@ -0,0 +1,165 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package elasticsearch
+
+import (
+	. "github.com/mozilla-services/heka/pipeline"
+	pipeline_ts "github.com/mozilla-services/heka/pipeline/testsupport"
+	plugins_ts "github.com/mozilla-services/heka/plugins/testsupport"
+	"github.com/rafrombrc/gomock/gomock"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"time"
+)
+
+// BulkIndexer that returns canned errors, recording the request bodies.
+type testBulkIndexer struct {
+	bodies [][]byte
+	errs   []error
+}
+
+func (t *testBulkIndexer) Index(body []byte) (err error) {
+	t.bodies = append(t.bodies, append([]byte{}, body...))
+	if len(t.errs) > 0 {
+		err, t.errs = t.errs[0], t.errs[1:]
+	}
+	return
+}
+
+func (t *testBulkIndexer) CheckFlush(count int, length int) bool {
+	return false
+}
+
+func ESOutputSpec(c gs.Context) {
+	t := new(pipeline_ts.SimpleT)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	body := []byte(`{"index":{"_index":"a"}}` + "\n" + `{"n":1}` + "\n" +
+		`{"index":{"_index":"a"}}` + "\n" + `{"n":2}` + "\n")
+
+	c.Specify("strftimeToLayout", func() {
+		c.Specify("converts date specifiers", func() {
+			c.Expect(strftimeToLayout("logs-%{Type}-%Y.%m.%d"), gs.Equals,
+				"logs-%{Type}-%{2006.01.02}")
+			c.Expect(strftimeToLayout("logs-%Y-%m-%{Type}-%H"), gs.Equals,
+				"logs-%{2006-01}-%{Type}-%{15}")
+		})
+
+		c.Specify("leaves other text alone", func() {
+			c.Expect(strftimeToLayout("heka-%{2006.01.02}"), gs.Equals,
+				"heka-%{2006.01.02}")
+			c.Expect(strftimeToLayout("100%q."), gs.Equals, "100%q.")
+		})
+	})
+
+	c.Specify("An HttpBulkIndexer", func() {
+		var (
+			status     int
+			retryAfter string
+			response   string
+		)
+		server := httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				if retryAfter != "" {
+					w.Header().Set("Retry-After", retryAfter)
+				}
+				w.WriteHeader(status)
+				w.Write([]byte(response))
+			}))
+		defer server.Close()
+		serverUrl, _ := url.Parse(server.URL)
+		indexer := NewHttpBulkIndexer("http", serverUrl.Host, 10, "", "", 0, false, 0)
+
+		c.Specify("reports throttling", func() {
+			status = 429
+			retryAfter = "2"
+			err := indexer.Index(body)
+			c.Assume(err, gs.Not(gs.IsNil))
+			c.Expect(ClassifyError(err), gs.Equals, ErrKindThrottled)
+			c.Expect(err.(*OutputError).RetryAfter, gs.Equals, 2*time.Second)
+		})
+
+		c.Specify("classifies error responses", func() {
+			status = 500
+			c.Expect(ClassifyError(indexer.Index(body)), gs.Equals, ErrKindRetryable)
+			status = 400
+			c.Expect(ClassifyError(indexer.Index(body)), gs.Equals, ErrKindMalformed)
+		})
+
+		c.Specify("returns the rejected documents to be retried", func() {
+			status = 200
+			response = `{"errors":true,"items":[{"index":{"status":201}},` +
+				`{"index":{"status":429,"error":"EsRejectedExecutionException"}}]}`
+			err := indexer.Index(body)
+			c.Assume(err, gs.Not(gs.IsNil))
+			c.Expect(ClassifyError(err), gs.Equals, ErrKindThrottled)
+			rejected, ok := err.(*OutputError).Err.(*BulkRejectedError)
+			c.Assume(ok, gs.IsTrue)
+			c.Expect(rejected.Rejected, gs.Equals, 1)
+			c.Expect(string(rejected.Retry), gs.Equals,
+				`{"index":{"_index":"a"}}`+"\n"+`{"n":2}`+"\n")
+		})
+
+		c.Specify("drops documents that failed for other reasons", func() {
+			status = 200
+			response = `{"errors":true,"items":[{"index":{"status":201}},` +
+				`{"index":{"status":400,"error":"MapperParsingException"}}]}`
+			c.Expect(ClassifyError(indexer.Index(body)), gs.Equals, ErrKindMalformed)
+		})
+	})
+
+	c.Specify("An ElasticSearchOutput", func() {
+		output := new(ElasticSearchOutput)
+		config := output.ConfigStruct().(*ElasticSearchOutputConfig)
+		config.Retries.Delay = "1ms"
+		config.Retries.MaxJitter = "1ms"
+		config.Retries.MaxRetries = 2
+		err := output.Init(config)
+		c.Assume(err, gs.IsNil)
+
+		indexer := new(testBulkIndexer)
+		output.bulkIndexer = indexer
+		oth := plugins_ts.NewOutputTestHelper(ctrl)
+		oth.MockOutputRunner.EXPECT().LogError(gomock.Any()).AnyTimes()
+
+		c.Specify("retries only the rejected documents", func() {
+			retry := []byte(`{"index":{"_index":"a"}}` + "\n" + `{"n":2}` + "\n")
+			indexer.errs = []error{
+				NewThrottledError(&BulkRejectedError{Rejected: 1, Retry: retry}, 0),
+			}
+			output.index(oth.MockOutputRunner, body)
+			c.Assume(len(indexer.bodies), gs.Equals, 2)
+			c.Expect(string(indexer.bodies[1]), gs.Equals, string(retry))
+			c.Expect(output.bulkThrottles, gs.Equals, int64(1))
+			c.Expect(output.bulkDrops, gs.Equals, int64(0))
+		})
+
+		c.Specify("drops a batch once retries are exhausted", func() {
+			failure := NewRetryableError(http.ErrHandlerTimeout)
+			indexer.errs = []error{failure, failure, failure}
+			output.index(oth.MockOutputRunner, body)
+			c.Expect(len(indexer.bodies), gs.Equals, 3)
+			c.Expect(output.bulkRetries, gs.Equals, int64(2))
+			c.Expect(output.bulkDrops, gs.Equals, int64(1))
+		})
+
+		c.Specify("drops malformed batches without retrying", func() {
+			indexer.errs = []error{NewMalformedMessageError(http.ErrBodyNotAllowed)}
+			output.index(oth.MockOutputRunner, body)
+			c.Expect(len(indexer.bodies), gs.Equals, 1)
+			c.Expect(output.bulkDrops, gs.Equals, int64(1))
+		})
+	})
+}
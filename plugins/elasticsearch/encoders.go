@@ -102,7 +102,7 @@ func writeField(first bool, b *bytes.Buffer, f *message.Field, raw bool) {
 				} else {
 					writeQuotedString(b, value)
 				}
-				if i < len(values) - 1 {
+				if i < len(values)-1 {
 					b.WriteString(`,`)
 				}
 			}
@@ -124,7 +124,7 @@ func writeField(first bool, b *bytes.Buffer, f *message.Field, raw bool) {
 				} else {
 					writeQuotedString(b, base64.StdEncoding.EncodeToString(value))
 				}
-				if i < len(values) - 1 {
+				if i < len(values)-1 {
 					b.WriteString(`,`)
 				}
 			}
@@ -142,7 +142,7 @@ func writeField(first bool, b *bytes.Buffer, f *message.Field, raw bool) {
 			b.WriteString(`[`)
 			for i, value := range values {
 				b.WriteString(strconv.FormatInt(value, 10))
-				if i < len(values) - 1 {
+				if i < len(values)-1 {
 					b.WriteString(`,`)
 				}
 			}
@@ -156,7 +156,7 @@ func writeField(first bool, b *bytes.Buffer, f *message.Field, raw bool) {
 			b.WriteString(`[`)
 			for i, value := range values {
 				b.WriteString(strconv.FormatFloat(value, 'g', -1, 64))
-				if i < len(values) - 1 {
+				if i < len(values)-1 {
 					b.WriteString(`,`)
 				}
 			}
@@ -170,7 +170,7 @@ func writeField(first bool, b *bytes.Buffer, f *message.Field, raw bool) {
 			b.WriteString(`[`)
 			for i, value := range values {
 				b.WriteString(strconv.FormatBool(value))
-				if i < len(values) - 1 {
+				if i < len(values)-1 {
 					b.WriteString(`,`)
 				}
 			}
@@ -210,8 +210,9 @@ type ESJsonEncoder struct {
 }
 
 type ESJsonEncoderConfig struct {
-	// Name of the index in which the messages will be indexed. Defaults
-	// to "heka-%{2006.01.02}".
+	// Name of the index in which the messages will be indexed, may include
+	// strftime style date specifiers such as "%Y.%m.%d". Defaults to
+	// "heka-%{2006.01.02}".
 	Index string
 	// Name of the document type of the messages. Defaults to "message".
 	TypeName string `toml:"type_name"`
@@ -226,6 +227,13 @@ type ESJsonEncoderConfig struct {
 	Id string
 	// Fields to which formatting will not be applied.
 	RawBytesFields []string `toml:"raw_bytes_fields"`
+	// Maximum number of distinct header and field value combinations that
+	// the Index setting may render. Defaults to 0, i.e. unlimited.
+	MaxIndexCardinality uint `toml:"max_index_cardinality"`
+	// Index used for messages that would exceed `max_index_cardinality` or
+	// that are missing a field referenced by the Index setting. Defaults to
+	// "heka-overflow".
+	FallbackIndex string `toml:"fallback_index"`
 }
 
 func (e *ESJsonEncoder) ConfigStruct() interface{} {
@@ -235,6 +243,7 @@ func (e *ESJsonEncoder) ConfigStruct() interface{} {
 		Timestamp:            "2006-01-02T15:04:05.000Z",
 		ESIndexFromTimestamp: false,
 		Id:                   "",
+		FallbackIndex:        "heka-overflow",
 	}
 
 	config.Fields = []string{
@@ -259,11 +268,14 @@ func (e *ESJsonEncoder) Init(config interface{}) (err error) {
 	e.timestampFormat = conf.Timestamp
 	e.rawBytesFields = conf.RawBytesFields
 	e.coord = &ElasticSearchCoordinates{
-		Index:                conf.Index,
+		Index:                strftimeToLayout(conf.Index),
 		Type:                 conf.TypeName,
 		ESIndexFromTimestamp: conf.ESIndexFromTimestamp,
 		Id:                   conf.Id,
 	}
+	if conf.MaxIndexCardinality > 0 {
+		err = e.coord.SetIndexLimit(conf.MaxIndexCardinality, conf.FallbackIndex)
+	}
 	return
 }
 
@@ -306,7 +318,7 @@ func (e *ESJsonEncoder) Encode(pack *PipelinePack) (output []byte, err error) {
 					}
 				}
 				writeField(first, &buf, field, raw)
-		 		first = false
+				first = false
 			}
 		default:
 			err = fmt.Errorf("Unable to find field: %s", f)
@@ -330,8 +342,9 @@ type ESLogstashV0Encoder struct {
 }
 
 type ESLogstashV0EncoderConfig struct {
-	// Name of the index in which the messages will be indexed. Defaults
-	// to "logstash-%{2006.01.02}".
+	// Name of the index in which the messages will be indexed, may include
+	// strftime style date specifiers such as "%Y.%m.%d". Defaults to
+	// "logstash-%{2006.01.02}".
 	Index string
 	// Name of the document type of the messages. Defaults to "message".
 	TypeName string `toml:"type_name"`
@@ -346,6 +359,13 @@ type ESLogstashV0EncoderConfig struct {
 	Id string
 	// Fields to which formatting will not be applied.
 	RawBytesFields []string `toml:"raw_bytes_fields"`
+	// Maximum number of distinct header and field value combinations that
+	// the Index setting may render. Defaults to 0, i.e. unlimited.
+	MaxIndexCardinality uint `toml:"max_index_cardinality"`
+	// Index used for messages that would exceed `max_index_cardinality` or
+	// that are missing a field referenced by the Index setting. Defaults to
+	// "logstash-overflow".
+	FallbackIndex string `toml:"fallback_index"`
 }
 
 func (e *ESLogstashV0Encoder) ConfigStruct() interface{} {
@@ -355,6 +375,7 @@ func (e *ESLogstashV0Encoder) ConfigStruct() interface{} {
 		UseMessageType:       false,
 		ESIndexFromTimestamp: false,
 		Id:                   "",
+		FallbackIndex:        "logstash-overflow",
 	}
 
 	config.Fields = []string{
@@ -379,11 +400,14 @@ func (e *ESLogstashV0Encoder) Init(config interface{}) (err error) {
 	e.fields = conf.Fields
 	e.useMessageType = conf.UseMessageType
 	e.coord = &ElasticSearchCoordinates{
-		Index:                conf.Index,
+		Index:                strftimeToLayout(conf.Index),
 		Type:                 conf.TypeName,
 		ESIndexFromTimestamp: conf.ESIndexFromTimestamp,
 		Id:                   conf.Id,
 	}
+	if conf.MaxIndexCardinality > 0 {
+		err = e.coord.SetIndexLimit(conf.MaxIndexCardinality, conf.FallbackIndex)
+	}
 	return
 }
 
@@ -33,6 +33,7 @@ func TestAllSpecs(t *testing.T) {
 	r.Parallel = false
 
 	r.AddSpec(ESEncodersSpec)
+	r.AddSpec(ESOutputSpec)
 
 	gs.MainGoTest(r, t)
 }
@@ -154,6 +155,30 @@ func ESEncodersSpec(c gs.Context) {
 		})
 	})
 
+	c.Specify("ElasticSearchCoordinates with an index limit", func() {
+		coord := &ElasticSearchCoordinates{Index: "heka-%{idField}", Type: "message"}
+		err := coord.SetIndexLimit(1, "heka-overflow")
+		c.Assume(err, gs.IsNil)
+		buf := bytes.Buffer{}
+
+		c.Specify("should use the rendered index within the limit", func() {
+			coord.PopulateBuffer(pack.Message, &buf)
+			c.Expect(buf.String(), gs.Equals,
+				`{"index":{"_index":"heka-1234","_type":"message"}}`)
+		})
+
+		c.Specify("should use the fallback index beyond the limit", func() {
+			coord.PopulateBuffer(pack.Message, &buf)
+			buf.Reset()
+			msg := message.CopyMessage(pack.Message)
+			field, _ := message.NewField("idField", "5678", "")
+			msg.Fields = []*message.Field{field}
+			coord.PopulateBuffer(msg, &buf)
+			c.Expect(buf.String(), gs.Equals,
+				`{"index":{"_index":"heka-overflow","_type":"message"}}`)
+		})
+	})
+
 	c.Specify("ESLogstashV0Encoder", func() {
 		encoder := new(ESLogstashV0Encoder)
 		config := encoder.ConfigStruct()
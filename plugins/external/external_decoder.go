@@ -0,0 +1,96 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package external
+
+import (
+	"code.google.com/p/gogoprotobuf/proto"
+	"fmt"
+	"github.com/mozilla-services/heka/pipeline"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+)
+
+// Decoder running as a separate process, see plugin.proto. Each message is
+// passed to the plugin, which returns the decoded messages.
+type ExternalDecoder struct {
+	name    string
+	conf    *ExternalConfig
+	process *pluginProcess
+	dRunner pipeline.DecoderRunner
+}
+
+func (ed *ExternalDecoder) SetName(name string) {
+	ed.name = name
+}
+
+func (ed *ExternalDecoder) ConfigStruct() interface{} {
+	return defaultExternalConfig()
+}
+
+func (ed *ExternalDecoder) Init(config interface{}) (err error) {
+	ed.conf = config.(*ExternalConfig)
+	ed.process, err = startPluginProcess(ed.name, "ExternalDecoder", ed.conf)
+	return
+}
+
+// Heka will call this to give us access to the runner, for new packs.
+func (ed *ExternalDecoder) SetDecoderRunner(dr pipeline.DecoderRunner) {
+	ed.dRunner = dr
+}
+
+func (ed *ExternalDecoder) Decode(pack *pipeline.PipelinePack) (
+	packs []*pipeline.PipelinePack, err error) {
+
+	msgBytes, err := proto.Marshal(pack.Message)
+	if err != nil {
+		return nil, err
+	}
+	decoded := new(encodedMessages)
+	err = grpc.Invoke(context.Background(), methodDecode, &encodedMessage{msgBytes},
+		decoded, ed.process.conn)
+	if err != nil {
+		return nil, fmt.Errorf("Decode call failed: %s", err)
+	}
+	if len(decoded.messages) == 0 {
+		// The plugin dropped the message.
+		pack.Recycle()
+		return nil, nil
+	}
+
+	packs = make([]*pipeline.PipelinePack, len(decoded.messages))
+	for i, msgBytes := range decoded.messages {
+		if i == 0 {
+			packs[i] = pack
+		} else {
+			packs[i] = ed.dRunner.NewPack()
+			packs[i].MsgLoopCount = pack.MsgLoopCount
+		}
+		if err = proto.Unmarshal(msgBytes, packs[i].Message); err != nil {
+			for _, p := range packs[1 : i+1] {
+				p.Recycle()
+			}
+			return nil, fmt.Errorf("invalid message from plugin: %s", err)
+		}
+	}
+	return packs, nil
+}
+
+// Stops the plugin's process.
+func (ed *ExternalDecoder) Shutdown() {
+	ed.process.stop()
+}
+
+func init() {
+	pipeline.RegisterPlugin("ExternalDecoder", func() interface{} {
+		return new(ExternalDecoder)
+	})
+}
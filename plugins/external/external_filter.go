@@ -0,0 +1,136 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package external
+
+import (
+	"code.google.com/p/gogoprotobuf/proto"
+	"fmt"
+	"github.com/mozilla-services/heka/pipeline"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"io"
+)
+
+// Filter running as a separate process, see plugin.proto. Matching messages
+// are streamed to the plugin, and the messages it returns are injected.
+type ExternalFilter struct {
+	name    string
+	conf    *ExternalConfig
+	process *pluginProcess
+}
+
+func (ef *ExternalFilter) SetName(name string) {
+	ef.name = name
+}
+
+func (ef *ExternalFilter) ConfigStruct() interface{} {
+	return defaultExternalConfig()
+}
+
+func (ef *ExternalFilter) Init(config interface{}) (err error) {
+	ef.conf = config.(*ExternalConfig)
+	ef.process, err = startPluginProcess(ef.name, "ExternalFilter", ef.conf)
+	return
+}
+
+func (ef *ExternalFilter) Run(fr pipeline.FilterRunner, h pipeline.PluginHelper) error {
+	// The process is started again by Init if the filter is restarted.
+	defer ef.process.stop()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream, err := openProcessStream(ctx, ef.process)
+	if err != nil {
+		return err
+	}
+
+	// Loop counts of the messages sent, awaiting their results.
+	pending := make(chan uint, h.PipelineConfig().Globals.Tunables().PluginChanSize)
+	done := make(chan error, 1)
+	go func() {
+		done <- ef.injectResults(fr, h, stream, pending)
+	}()
+
+	for pack := range fr.InChan() {
+		msgBytes, e := proto.Marshal(pack.Message)
+		loopCount := pack.MsgLoopCount
+		pack.Recycle()
+		if e != nil {
+			fr.LogError(fmt.Errorf("can't encode message: %s", e))
+			continue
+		}
+		pending <- loopCount
+		if err = stream.SendMsg(&encodedMessage{msgBytes}); err != nil {
+			err = fmt.Errorf("Process call failed: %s", err)
+			break
+		}
+	}
+	if err == nil {
+		stream.CloseSend()
+		err = <-done
+	}
+	return err
+}
+
+// Injects the messages returned by the plugin, until the stream ends.
+func (ef *ExternalFilter) injectResults(fr pipeline.FilterRunner, h pipeline.PluginHelper,
+	stream grpc.ClientStream, pending chan uint) error {
+
+	res := new(result)
+	for {
+		if err := stream.RecvMsg(res); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return fmt.Errorf("Process call failed: %s", err)
+		}
+		loopCount := <-pending
+		if err := res.error(); err != nil {
+			fr.LogError(err)
+		}
+		for _, msgBytes := range res.inject {
+			pack := h.PipelinePack(loopCount)
+			if pack == nil {
+				fr.LogError(fmt.Errorf("exceeded MaxMsgLoops = %d",
+					h.PipelineConfig().Globals.Tunables().MaxMsgLoops))
+				break
+			}
+			if err := proto.Unmarshal(msgBytes, pack.Message); err != nil {
+				fr.LogError(fmt.Errorf("invalid message from plugin: %s", err))
+				pack.Recycle()
+				continue
+			}
+			fr.Inject(pack)
+		}
+	}
+}
+
+// The plugin's process is stopped when Run returns, and started again by
+// Init.
+func (ef *ExternalFilter) CleanupForRestart() {
+}
+
+// Opens a bidirectional Process stream.
+func openProcessStream(ctx context.Context, process *pluginProcess) (grpc.ClientStream, error) {
+	stream, err := grpc.NewClientStream(ctx,
+		&grpc.StreamDesc{ServerStreams: true, ClientStreams: true},
+		process.conn, methodProcess)
+	if err != nil {
+		return nil, fmt.Errorf("Process call failed: %s", err)
+	}
+	return stream, nil
+}
+
+func init() {
+	pipeline.RegisterPlugin("ExternalFilter", func() interface{} {
+		return new(ExternalFilter)
+	})
+}
@@ -0,0 +1,99 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package external
+
+import (
+	"code.google.com/p/gogoprotobuf/proto"
+	"fmt"
+	"github.com/mozilla-services/heka/pipeline"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+)
+
+// Input running as a separate process, see plugin.proto. The messages the
+// plugin generates are delivered as is, or passed to the input's decoder.
+type ExternalInput struct {
+	name    string
+	conf    *ExternalConfig
+	process *pluginProcess
+	cancel  context.CancelFunc
+	stopped bool
+}
+
+func (ei *ExternalInput) SetName(name string) {
+	ei.name = name
+}
+
+func (ei *ExternalInput) ConfigStruct() interface{} {
+	return defaultExternalConfig()
+}
+
+func (ei *ExternalInput) Init(config interface{}) (err error) {
+	ei.conf = config.(*ExternalConfig)
+	ei.process, err = startPluginProcess(ei.name, "ExternalInput", ei.conf)
+	return
+}
+
+func (ei *ExternalInput) Run(ir pipeline.InputRunner, h pipeline.PluginHelper) error {
+	var ctx context.Context
+	ctx, ei.cancel = context.WithCancel(context.Background())
+	stream, err := grpc.NewClientStream(ctx, &grpc.StreamDesc{ServerStreams: true},
+		ei.process.conn, methodReceive)
+	if err == nil {
+		if err = stream.SendMsg(empty{}); err == nil {
+			err = stream.CloseSend()
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("Receive call failed: %s", err)
+	}
+
+	useMsgBytes := ir.UseMsgBytes()
+	msg := new(encodedMessage)
+	for {
+		if err = stream.RecvMsg(msg); err != nil {
+			break
+		}
+		pack := <-ir.InChan()
+		if useMsgBytes {
+			pack.MsgBytes = append(pack.MsgBytes[:0], msg.bytes...)
+		} else if err = proto.Unmarshal(msg.bytes, pack.Message); err != nil {
+			ir.LogError(fmt.Errorf("invalid message from plugin: %s", err))
+			pack.Recycle()
+			continue
+		}
+		ir.Deliver(pack)
+	}
+	if ei.stopped {
+		return nil
+	}
+	return fmt.Errorf("plugin stopped sending messages: %s", err)
+}
+
+func (ei *ExternalInput) Stop() {
+	ei.stopped = true
+	if ei.cancel != nil {
+		ei.cancel()
+	}
+	ei.process.stop()
+}
+
+// Stops the plugin's process, it's started again by Init.
+func (ei *ExternalInput) CleanupForRestart() {
+	ei.process.stop()
+}
+
+func init() {
+	pipeline.RegisterPlugin("ExternalInput", func() interface{} {
+		return new(ExternalInput)
+	})
+}
@@ -0,0 +1,97 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package external
+
+import (
+	"code.google.com/p/gogoprotobuf/proto"
+	"fmt"
+	"github.com/mozilla-services/heka/pipeline"
+	"golang.org/x/net/context"
+)
+
+// Output running as a separate process, see plugin.proto. Messages are
+// streamed to the plugin one at a time, and the delivery failures it reports
+// are handled like those of any other output, e.g. retried with the output's
+// `retries` settings.
+type ExternalOutput struct {
+	name    string
+	conf    *ExternalConfig
+	process *pluginProcess
+}
+
+func (eo *ExternalOutput) SetName(name string) {
+	eo.name = name
+}
+
+func (eo *ExternalOutput) ConfigStruct() interface{} {
+	return defaultExternalConfig()
+}
+
+func (eo *ExternalOutput) Init(config interface{}) (err error) {
+	eo.conf = config.(*ExternalConfig)
+	eo.process, err = startPluginProcess(eo.name, "ExternalOutput", eo.conf)
+	return
+}
+
+func (eo *ExternalOutput) Run(or pipeline.OutputRunner, h pipeline.PluginHelper) error {
+	// The process is started again by Init if the output is restarted.
+	defer eo.process.stop()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream, err := openProcessStream(ctx, eo.process)
+	if err != nil {
+		return err
+	}
+
+	res := new(result)
+	for pack := range or.InChan() {
+		msgBytes, e := proto.Marshal(pack.Message)
+		if e != nil {
+			or.HandleFailure(pack, pipeline.NewMalformedMessageError(e))
+			continue
+		}
+		for {
+			if err = stream.SendMsg(&encodedMessage{msgBytes}); err == nil {
+				err = stream.RecvMsg(res)
+			}
+			if err != nil {
+				// The stream is broken, the message is retried once the
+				// output has been restarted.
+				or.RetainPack(pack)
+				return fmt.Errorf("Process call failed: %s", err)
+			}
+			if e = res.error(); e == nil {
+				pack.Recycle()
+				break
+			}
+			if !or.HandleFailure(pack, e) {
+				if pipeline.ClassifyError(e) == pipeline.ErrKindFatal {
+					return e
+				}
+				break
+			}
+		}
+	}
+	stream.CloseSend()
+	return nil
+}
+
+// The plugin's process is stopped when Run returns, and started again by
+// Init.
+func (eo *ExternalOutput) CleanupForRestart() {
+}
+
+func init() {
+	pipeline.RegisterPlugin("ExternalOutput", func() interface{} {
+		return new(ExternalOutput)
+	})
+}
@@ -0,0 +1,183 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package external
+
+import (
+	"code.google.com/p/gogoprotobuf/proto"
+	"errors"
+	"github.com/mozilla-services/heka/message"
+	. "github.com/mozilla-services/heka/pipeline"
+	pipeline_ts "github.com/mozilla-services/heka/pipeline/testsupport"
+	"github.com/mozilla-services/heka/pipelinemock"
+	"github.com/rafrombrc/gomock/gomock"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"golang.org/x/net/context"
+	"net"
+	"strings"
+	"time"
+)
+
+func ProtocolSpec(c gs.Context) {
+	c.Specify("The external plugin protocol", func() {
+		c.Specify("parses handshakes", func() {
+			network, address, err := parseHandshake(
+				handshakeLine("tcp", "127.0.0.1:5565") + "\n")
+			c.Expect(err, gs.IsNil)
+			c.Expect(network, gs.Equals, "tcp")
+			c.Expect(address, gs.Equals, "127.0.0.1:5565")
+
+			_, _, err = parseHandshake("HEKA_PLUGIN|2|tcp|127.0.0.1:5565")
+			c.Expect(err, gs.Not(gs.IsNil))
+			_, _, err = parseHandshake("listening on 5565")
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+
+		c.Specify("encodes results", func() {
+			res := &result{err: "slow down", kind: ErrKindThrottled, retryAfterMs: 250,
+				inject: [][]byte{[]byte("one"), []byte("two")}}
+			decoded := new(result)
+			c.Expect(decoded.unmarshal(res.marshal()), gs.IsNil)
+			c.Expect(decoded.err, gs.Equals, "slow down")
+			c.Expect(decoded.kind, gs.Equals, ErrKindThrottled)
+			c.Expect(decoded.retryAfterMs, gs.Equals, uint64(250))
+			c.Assume(len(decoded.inject), gs.Equals, 2)
+			c.Expect(string(decoded.inject[1]), gs.Equals, "two")
+
+			err := decoded.error()
+			c.Expect(ClassifyError(err), gs.Equals, ErrKindThrottled)
+			c.Expect(err.(*OutputError).RetryAfter, gs.Equals, 250*time.Millisecond)
+			c.Expect((&result{}).error(), gs.IsNil)
+		})
+
+		c.Specify("skips unknown fields", func() {
+			data := appendVarintField(nil, 9, 42)
+			data = appendBytesField(data, 1, []byte("failed"))
+			data = append(data, byte(10<<3|wireFixed32), 1, 2, 3, 4)
+			resp := new(initResponse)
+			c.Expect(resp.unmarshal(data), gs.IsNil)
+			c.Expect(resp.err, gs.Equals, "failed")
+		})
+
+		c.Specify("rejects truncated messages", func() {
+			data := appendBytesField(nil, 1, []byte("failed"))
+			resp := new(initResponse)
+			c.Expect(resp.unmarshal(data[:len(data)-2]), gs.Equals, errTruncated)
+		})
+	})
+}
+
+// Test plugin splitting payloads into lines, and failing to deliver messages
+// of type "fail".
+type linesPlugin struct {
+	config map[string]interface{}
+}
+
+func (p *linesPlugin) Init(name string, config map[string]interface{}) error {
+	if config["fail"] == true {
+		return errors.New("bad config")
+	}
+	p.config = config
+	return nil
+}
+
+func (p *linesPlugin) Decode(msg *message.Message) (msgs []*message.Message, err error) {
+	for _, line := range strings.Split(msg.GetPayload(), "\n") {
+		if line == "" {
+			continue
+		}
+		m := new(message.Message)
+		m.SetType("line")
+		m.SetPayload(line)
+		msgs = append(msgs, m)
+	}
+	return
+}
+
+func (p *linesPlugin) Process(msg *message.Message) ([]*message.Message, error) {
+	if msg.GetType() == "fail" {
+		return nil, NewMalformedMessageError(errors.New("rejected"))
+	}
+	return p.Decode(msg)
+}
+
+func ExternalPluginSpec(c gs.Context) {
+	t := &pipeline_ts.SimpleT{}
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	c.Specify("An external plugin", func() {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		c.Assume(err, gs.IsNil)
+		go serveListener(new(linesPlugin), listener)
+		defer listener.Close()
+
+		conn, err := dialPlugin("tcp", listener.Addr().String(), time.Second)
+		c.Assume(err, gs.IsNil)
+		process := &pluginProcess{name: "lines", conn: conn}
+		defer process.stop()
+
+		c.Specify("is initialized with its config", func() {
+			c.Expect(process.init("lines", "ExternalDecoder", `{"fail": false}`), gs.IsNil)
+			err := process.init("lines", "ExternalDecoder", `{"fail": true}`)
+			c.Expect(err, gs.Not(gs.IsNil))
+			c.Expect(err.Error(), gs.Equals, "bad config")
+		})
+
+		c.Specify("decodes messages", func() {
+			decoder := &ExternalDecoder{process: process}
+			dRunner := pipelinemock.NewMockDecoderRunner(ctrl)
+			decoder.SetDecoderRunner(dRunner)
+			config := NewPipelineConfig(nil)
+			pack := NewPipelinePack(config.InputRecycleChan())
+			pack.Message.SetPayload("one\ntwo\n")
+			dRunner.EXPECT().NewPack().Return(NewPipelinePack(config.InputRecycleChan()))
+
+			packs, err := decoder.Decode(pack)
+			c.Expect(err, gs.IsNil)
+			c.Assume(len(packs), gs.Equals, 2)
+			c.Expect(packs[0], gs.Equals, pack)
+			c.Expect(packs[0].Message.GetPayload(), gs.Equals, "one")
+			c.Expect(packs[1].Message.GetPayload(), gs.Equals, "two")
+			c.Expect(packs[1].Message.GetType(), gs.Equals, "line")
+		})
+
+		c.Specify("processes messages in order", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			stream, err := openProcessStream(ctx, process)
+			c.Assume(err, gs.IsNil)
+
+			send := func(typ, payload string) *result {
+				msg := new(message.Message)
+				msg.SetType(typ)
+				msg.SetPayload(payload)
+				msgBytes, err := proto.Marshal(msg)
+				c.Assume(err, gs.IsNil)
+				c.Assume(stream.SendMsg(&encodedMessage{msgBytes}), gs.IsNil)
+				res := new(result)
+				c.Assume(stream.RecvMsg(res), gs.IsNil)
+				return res
+			}
+
+			res := send("data", "a\nb")
+			c.Expect(res.error(), gs.IsNil)
+			c.Assume(len(res.inject), gs.Equals, 2)
+			injected := new(message.Message)
+			c.Expect(proto.Unmarshal(res.inject[1], injected), gs.IsNil)
+			c.Expect(injected.GetPayload(), gs.Equals, "b")
+
+			res = send("fail", "")
+			c.Expect(ClassifyError(res.error()), gs.Equals, ErrKindMalformed)
+			c.Expect(res.error().Error(), gs.Equals, "rejected")
+		})
+	})
+}
@@ -0,0 +1,187 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package external
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"time"
+)
+
+// Config shared by all of the external plugin types.
+type ExternalConfig struct {
+	// Command running the plugin, and its arguments.
+	Command string
+	Args    []string
+	// Additional environment variables for the command, as "NAME=value".
+	Env []string
+	// How long to wait for the plugin to start and complete its handshake.
+	// Defaults to "10s".
+	StartTimeout string `toml:"start_timeout"`
+	// How long to wait for the plugin to exit once asked to stop, before
+	// killing it. Defaults to "5s".
+	StopTimeout string `toml:"stop_timeout"`
+	// Settings for the plugin itself, passed to its Init as JSON.
+	Config map[string]interface{}
+}
+
+func defaultExternalConfig() *ExternalConfig {
+	return &ExternalConfig{
+		StartTimeout: "10s",
+		StopTimeout:  "5s",
+	}
+}
+
+// A running external plugin.
+type pluginProcess struct {
+	name        string
+	cmd         *exec.Cmd
+	conn        *grpc.ClientConn
+	stopTimeout time.Duration
+	exited      chan struct{}
+}
+
+// Starts an external plugin's command, connects to it, and initializes it.
+func startPluginProcess(name, typ string, conf *ExternalConfig) (*pluginProcess, error) {
+	if conf.Command == "" {
+		return nil, errors.New("command must be specified")
+	}
+	startTimeout, err := time.ParseDuration(conf.StartTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("invalid start_timeout: %s", err)
+	}
+	stopTimeout, err := time.ParseDuration(conf.StopTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("invalid stop_timeout: %s", err)
+	}
+	// Encode the config before starting anything.
+	config, err := json.Marshal(conf.Config)
+	if err != nil {
+		return nil, fmt.Errorf("can't encode config: %s", err)
+	}
+
+	cmd := exec.Command(conf.Command, conf.Args...)
+	cmd.Env = append(os.Environ(), conf.Env...)
+	cmd.Env = append(cmd.Env, ProtocolEnv+"="+strconv.Itoa(ProtocolVersion))
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err = cmd.Start(); err != nil {
+		return nil, fmt.Errorf("can't start %s: %s", conf.Command, err)
+	}
+	p := &pluginProcess{
+		name:        name,
+		cmd:         cmd,
+		stopTimeout: stopTimeout,
+		exited:      make(chan struct{}),
+	}
+	go p.logOutput(stderr)
+
+	handshake := make(chan string, 1)
+	go func() {
+		reader := bufio.NewReader(stdout)
+		line, _ := reader.ReadString('\n')
+		handshake <- line
+		// Anything written to stdout after the handshake is logged too.
+		p.logOutput(reader)
+		p.cmd.Wait()
+		close(p.exited)
+	}()
+
+	var line string
+	select {
+	case line = <-handshake:
+	case <-time.After(startTimeout):
+		p.stop()
+		return nil, errors.New("timed out waiting for the plugin handshake")
+	}
+	network, address, err := parseHandshake(line)
+	if err == nil {
+		p.conn, err = dialPlugin(network, address, startTimeout)
+	}
+	if err == nil {
+		err = p.init(name, typ, string(config))
+	}
+	if err != nil {
+		p.stop()
+		return nil, err
+	}
+	return p, nil
+}
+
+// Connects to the plugin's gRPC server, which only listens on a local
+// socket, so the connection isn't encrypted.
+func dialPlugin(network, address string, timeout time.Duration) (*grpc.ClientConn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return grpc.DialContext(ctx, address,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithBlock(),
+		grpc.WithDefaultCallOptions(grpc.ForceCodec(codec{})),
+		grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, network, addr)
+		}))
+}
+
+func (p *pluginProcess) init(name, typ, config string) error {
+	req := &initRequest{name: name, typ: typ, config: config}
+	resp := new(initResponse)
+	if err := grpc.Invoke(context.Background(), methodInit, req, resp, p.conn); err != nil {
+		return fmt.Errorf("Init call failed: %s", err)
+	}
+	if resp.err != "" {
+		return errors.New(resp.err)
+	}
+	return nil
+}
+
+// Logs each line the plugin writes.
+func (p *pluginProcess) logOutput(r io.Reader) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		log.Printf("Plugin '%s' process: %s", p.name, scanner.Text())
+	}
+}
+
+// Closes the connection and stops the plugin's process, killing it if it
+// doesn't exit within the stop timeout.
+func (p *pluginProcess) stop() {
+	if p.conn != nil {
+		p.conn.Close()
+	}
+	if p.cmd == nil || p.cmd.Process == nil {
+		return
+	}
+	p.cmd.Process.Signal(os.Interrupt)
+	select {
+	case <-p.exited:
+	case <-time.After(p.stopTimeout):
+		p.cmd.Process.Kill()
+	}
+}
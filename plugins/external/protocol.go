@@ -0,0 +1,324 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package external
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/mozilla-services/heka/pipeline"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Implementation of the protocol defined in plugin.proto. The few protocol
+// messages are encoded by hand, and Heka messages are passed through in their
+// encoded form, so no generated code is needed.
+
+const (
+	// Version of the protocol spoken by this package.
+	ProtocolVersion = 1
+	// Environment variable set to the protocol version for plugin commands.
+	ProtocolEnv = "HEKA_PLUGIN_PROTOCOL"
+
+	handshakePrefix = "HEKA_PLUGIN"
+	serviceName     = "heka.plugin.Plugin"
+	methodInit      = "/" + serviceName + "/Init"
+	methodReceive   = "/" + serviceName + "/Receive"
+	methodDecode    = "/" + serviceName + "/Decode"
+	methodProcess   = "/" + serviceName + "/Process"
+)
+
+// Formats the handshake line a plugin writes to stdout once it's listening.
+func handshakeLine(network, address string) string {
+	return fmt.Sprintf("%s|%d|%s|%s", handshakePrefix, ProtocolVersion, network, address)
+}
+
+// Parses a plugin's handshake line, returning the address to connect to.
+func parseHandshake(line string) (network, address string, err error) {
+	parts := strings.SplitN(strings.TrimSpace(line), "|", 4)
+	if len(parts) != 4 || parts[0] != handshakePrefix {
+		return "", "", fmt.Errorf("invalid handshake: %q", line)
+	}
+	version, err := strconv.Atoi(parts[1])
+	if err != nil || version != ProtocolVersion {
+		return "", "", fmt.Errorf("unsupported protocol version: %s", parts[1])
+	}
+	if parts[2] != "tcp" && parts[2] != "unix" {
+		return "", "", fmt.Errorf("unsupported network: %s", parts[2])
+	}
+	return parts[2], parts[3], nil
+}
+
+// A protocol message.
+type wireMessage interface {
+	marshal() []byte
+	unmarshal(data []byte) error
+}
+
+// gRPC codec for the protocol messages.
+type codec struct{}
+
+func (codec) Marshal(v interface{}) ([]byte, error) {
+	msg, ok := v.(wireMessage)
+	if !ok {
+		return nil, fmt.Errorf("can't marshal %T", v)
+	}
+	return msg.marshal(), nil
+}
+
+func (codec) Unmarshal(data []byte, v interface{}) error {
+	msg, ok := v.(wireMessage)
+	if !ok {
+		return fmt.Errorf("can't unmarshal %T", v)
+	}
+	return msg.unmarshal(data)
+}
+
+func (codec) Name() string {
+	return "heka"
+}
+
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+func appendVarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], v)
+	return append(b, buf[:n]...)
+}
+
+func appendVarintField(b []byte, field int, v uint64) []byte {
+	b = appendVarint(b, uint64(field)<<3|wireVarint)
+	return appendVarint(b, v)
+}
+
+func appendBytesField(b []byte, field int, v []byte) []byte {
+	b = appendVarint(b, uint64(field)<<3|wireBytes)
+	b = appendVarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+var errTruncated = errors.New("truncated protocol message")
+
+// Calls `f` with each field of an encoded protocol message. Only varint and
+// length delimited values are passed to `f`, other fields are skipped.
+func readFields(data []byte, f func(field int, varint uint64, bytes []byte) error) error {
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return errTruncated
+		}
+		data = data[n:]
+		field := int(key >> 3)
+		var (
+			varint uint64
+			bytes  []byte
+		)
+		switch key & 7 {
+		case wireVarint:
+			if varint, n = binary.Uvarint(data); n <= 0 {
+				return errTruncated
+			}
+			data = data[n:]
+		case wireBytes:
+			length, n := binary.Uvarint(data)
+			if n <= 0 || uint64(len(data)-n) < length {
+				return errTruncated
+			}
+			bytes = data[n : n+int(length)]
+			data = data[n+int(length):]
+		case wireFixed64:
+			if len(data) < 8 {
+				return errTruncated
+			}
+			data = data[8:]
+			continue
+		case wireFixed32:
+			if len(data) < 4 {
+				return errTruncated
+			}
+			data = data[4:]
+			continue
+		default:
+			return fmt.Errorf("unsupported wire type %d", key&7)
+		}
+		if err := f(field, varint, bytes); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type initRequest struct {
+	name, typ, config string
+}
+
+func (r *initRequest) marshal() (b []byte) {
+	b = appendBytesField(b, 1, []byte(r.name))
+	b = appendBytesField(b, 2, []byte(r.typ))
+	return appendBytesField(b, 3, []byte(r.config))
+}
+
+func (r *initRequest) unmarshal(data []byte) error {
+	return readFields(data, func(field int, varint uint64, bytes []byte) error {
+		switch field {
+		case 1:
+			r.name = string(bytes)
+		case 2:
+			r.typ = string(bytes)
+		case 3:
+			r.config = string(bytes)
+		}
+		return nil
+	})
+}
+
+type initResponse struct {
+	err string
+}
+
+func (r *initResponse) marshal() (b []byte) {
+	if r.err != "" {
+		b = appendBytesField(b, 1, []byte(r.err))
+	}
+	return
+}
+
+func (r *initResponse) unmarshal(data []byte) error {
+	return readFields(data, func(field int, varint uint64, bytes []byte) error {
+		if field == 1 {
+			r.err = string(bytes)
+		}
+		return nil
+	})
+}
+
+type empty struct{}
+
+func (empty) marshal() []byte {
+	return nil
+}
+
+func (empty) unmarshal(data []byte) error {
+	return nil
+}
+
+// A single encoded Heka message.
+type encodedMessage struct {
+	bytes []byte
+}
+
+func (m *encodedMessage) marshal() []byte {
+	return m.bytes
+}
+
+func (m *encodedMessage) unmarshal(data []byte) error {
+	m.bytes = append(m.bytes[:0], data...)
+	return nil
+}
+
+// A list of encoded Heka messages, the Messages protocol message.
+type encodedMessages struct {
+	messages [][]byte
+}
+
+func (m *encodedMessages) marshal() (b []byte) {
+	for _, msg := range m.messages {
+		b = appendBytesField(b, 1, msg)
+	}
+	return
+}
+
+func (m *encodedMessages) unmarshal(data []byte) error {
+	m.messages = m.messages[:0]
+	return readFields(data, func(field int, varint uint64, bytes []byte) error {
+		if field == 1 {
+			m.messages = append(m.messages, append([]byte(nil), bytes...))
+		}
+		return nil
+	})
+}
+
+// Outcome of processing one message, the Result protocol message.
+type result struct {
+	err          string
+	kind         pipeline.OutputErrorKind
+	retryAfterMs uint64
+	inject       [][]byte
+}
+
+// Protocol values of the error kinds, in the ErrorKind enum's order.
+var errorKinds = []pipeline.OutputErrorKind{pipeline.ErrKindRetryable,
+	pipeline.ErrKindThrottled, pipeline.ErrKindMalformed, pipeline.ErrKindFatal}
+
+func (r *result) marshal() (b []byte) {
+	if r.err != "" {
+		b = appendBytesField(b, 1, []byte(r.err))
+		for i, kind := range errorKinds {
+			if kind == r.kind && i != 0 {
+				b = appendVarintField(b, 2, uint64(i))
+			}
+		}
+		if r.retryAfterMs != 0 {
+			b = appendVarintField(b, 3, r.retryAfterMs)
+		}
+	}
+	for _, msg := range r.inject {
+		b = appendBytesField(b, 4, msg)
+	}
+	return
+}
+
+func (r *result) unmarshal(data []byte) error {
+	*r = result{}
+	return readFields(data, func(field int, varint uint64, bytes []byte) error {
+		switch field {
+		case 1:
+			r.err = string(bytes)
+		case 2:
+			if varint >= uint64(len(errorKinds)) {
+				return fmt.Errorf("unknown error kind %d", varint)
+			}
+			r.kind = errorKinds[varint]
+		case 3:
+			r.retryAfterMs = varint
+		case 4:
+			r.inject = append(r.inject, append([]byte(nil), bytes...))
+		}
+		return nil
+	})
+}
+
+// Returns the error reported by a result, classified for
+// OutputRunner.HandleFailure, or nil.
+func (r *result) error() error {
+	if r.err == "" {
+		return nil
+	}
+	err := errors.New(r.err)
+	switch r.kind {
+	case pipeline.ErrKindThrottled:
+		return pipeline.NewThrottledError(err,
+			time.Duration(r.retryAfterMs)*time.Millisecond)
+	case pipeline.ErrKindMalformed:
+		return pipeline.NewMalformedMessageError(err)
+	case pipeline.ErrKindFatal:
+		return pipeline.NewFatalError(err)
+	}
+	return pipeline.NewRetryableError(err)
+}
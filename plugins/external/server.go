@@ -0,0 +1,224 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package external
+
+import (
+	"code.google.com/p/gogoprotobuf/proto"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+	"github.com/mozilla-services/heka/pipeline"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Support for writing external plugins in Go. A plugin program implements
+// ServedPlugin along with the interface for its plugin type, and calls Serve
+// from its main function.
+
+// Implemented by every external plugin served with Serve.
+type ServedPlugin interface {
+	// Configures the plugin, `config` holds the `config` settings of its
+	// section.
+	Init(name string, config map[string]interface{}) error
+}
+
+// Implemented by plugins used with ExternalInput.
+type InputPlugin interface {
+	ServedPlugin
+	// Sends messages to `out` until `stop` is closed. The messages are
+	// encoded before the next one is read, so they may be reused.
+	Receive(out chan<- *message.Message, stop <-chan struct{}) error
+}
+
+// Implemented by plugins used with ExternalDecoder.
+type DecoderPlugin interface {
+	ServedPlugin
+	// Returns the messages decoded from `msg`, none to drop it.
+	Decode(msg *message.Message) ([]*message.Message, error)
+}
+
+// Implemented by plugins used with ExternalFilter and ExternalOutput.
+type ProcessPlugin interface {
+	ServedPlugin
+	// Handles a message, returning any messages to inject (filters only).
+	// Outputs can classify delivery errors with pipeline.NewRetryableError,
+	// NewThrottledError, NewMalformedMessageError, and NewFatalError.
+	Process(msg *message.Message) (inject []*message.Message, err error)
+}
+
+var serviceDesc = grpc.ServiceDesc{
+	ServiceName: serviceName,
+	HandlerType: (*ServedPlugin)(nil),
+	Methods: []grpc.MethodDesc{
+		{MethodName: "Init", Handler: handleInit},
+		{MethodName: "Decode", Handler: handleDecode},
+	},
+	Streams: []grpc.StreamDesc{
+		{StreamName: "Receive", Handler: handleReceive, ServerStreams: true},
+		{StreamName: "Process", Handler: handleProcess, ServerStreams: true,
+			ClientStreams: true},
+	},
+}
+
+// Serves a plugin to hekad: listens on a local TCP port, writes the handshake
+// line to stdout, and handles hekad's calls until it disconnects. Must be
+// called from a program started by hekad.
+func Serve(plugin ServedPlugin) error {
+	version := os.Getenv(ProtocolEnv)
+	if version == "" {
+		return errors.New("not started by hekad, " + ProtocolEnv + " isn't set")
+	}
+	if version != strconv.Itoa(ProtocolVersion) {
+		return fmt.Errorf("unsupported protocol version: %s", version)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	fmt.Println(handshakeLine("tcp", listener.Addr().String()))
+	return serveListener(plugin, listener)
+}
+
+func serveListener(plugin ServedPlugin, listener net.Listener) error {
+	server := grpc.NewServer(grpc.ForceServerCodec(codec{}))
+	server.RegisterService(&serviceDesc, plugin)
+	return server.Serve(listener)
+}
+
+func handleInit(srv interface{}, ctx context.Context, dec func(interface{}) error,
+	interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+
+	req := new(initRequest)
+	if err := dec(req); err != nil {
+		return nil, err
+	}
+	var config map[string]interface{}
+	resp := new(initResponse)
+	if err := json.Unmarshal([]byte(req.config), &config); err != nil {
+		resp.err = fmt.Sprintf("invalid config: %s", err)
+	} else if err = srv.(ServedPlugin).Init(req.name, config); err != nil {
+		resp.err = err.Error()
+	}
+	return resp, nil
+}
+
+func handleDecode(srv interface{}, ctx context.Context, dec func(interface{}) error,
+	interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+
+	decoder, ok := srv.(DecoderPlugin)
+	if !ok {
+		return nil, errors.New("plugin isn't a decoder")
+	}
+	req := new(encodedMessage)
+	if err := dec(req); err != nil {
+		return nil, err
+	}
+	msg := new(message.Message)
+	if err := proto.Unmarshal(req.bytes, msg); err != nil {
+		return nil, err
+	}
+	msgs, err := decoder.Decode(msg)
+	if err != nil {
+		return nil, err
+	}
+	resp := new(encodedMessages)
+	if resp.messages, err = encodeMessages(msgs); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func handleReceive(srv interface{}, stream grpc.ServerStream) error {
+	input, ok := srv.(InputPlugin)
+	if !ok {
+		return errors.New("plugin isn't an input")
+	}
+	if err := stream.RecvMsg(new(empty)); err != nil {
+		return err
+	}
+	out := make(chan *message.Message)
+	stop := make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		done <- input.Receive(out, stop)
+	}()
+	defer close(stop)
+	for {
+		select {
+		case msg := <-out:
+			msgBytes, err := proto.Marshal(msg)
+			if err != nil {
+				return err
+			}
+			if err = stream.SendMsg(&encodedMessage{msgBytes}); err != nil {
+				return err
+			}
+		case err := <-done:
+			return err
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		}
+	}
+}
+
+func handleProcess(srv interface{}, stream grpc.ServerStream) error {
+	processor, ok := srv.(ProcessPlugin)
+	if !ok {
+		return errors.New("plugin isn't a filter or output")
+	}
+	req := new(encodedMessage)
+	msg := new(message.Message)
+	for {
+		if err := stream.RecvMsg(req); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if err := proto.Unmarshal(req.bytes, msg); err != nil {
+			return err
+		}
+		inject, err := processor.Process(msg)
+		res := new(result)
+		if err != nil {
+			res.err = err.Error()
+			res.kind = pipeline.ClassifyError(err)
+			if oErr, ok := err.(*pipeline.OutputError); ok {
+				res.retryAfterMs = uint64(oErr.RetryAfter / time.Millisecond)
+			}
+		}
+		if res.inject, err = encodeMessages(inject); err != nil {
+			return err
+		}
+		if err = stream.SendMsg(res); err != nil {
+			return err
+		}
+	}
+}
+
+func encodeMessages(msgs []*message.Message) ([][]byte, error) {
+	encoded := make([][]byte, len(msgs))
+	for i, msg := range msgs {
+		var err error
+		if encoded[i], err = proto.Marshal(msg); err != nil {
+			return nil, err
+		}
+	}
+	return encoded, nil
+}
@@ -0,0 +1,159 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package plugins
+
+import (
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+	"github.com/mozilla-services/heka/pipeline"
+	"sort"
+	"strconv"
+)
+
+// Processor that renames, converts, removes, and adds dynamic fields, in that
+// order.
+type FieldsProcessor struct {
+	conf *FieldsProcessorConfig
+	// Sorted names of the fields to add, so they're added in a stable order.
+	addNames []string
+}
+
+type FieldsProcessorConfig struct {
+	// Fields to rename, mapping the current name to the new one.
+	Rename map[string]string
+	// String fields to parse, mapping the field name to the value type:
+	// "int", "float", or "bool".
+	Convert map[string]string
+	// Names of the fields to remove.
+	Remove []string
+	// String fields to add, replacing any existing fields of the same name.
+	Add map[string]string
+	// Whether to drop messages with fields that can't be converted rather than
+	// treating them as processing errors. Defaults to false.
+	DropInvalid bool `toml:"drop_invalid"`
+}
+
+func (p *FieldsProcessor) ConfigStruct() interface{} {
+	return new(FieldsProcessorConfig)
+}
+
+func (p *FieldsProcessor) Init(config interface{}) error {
+	p.conf = config.(*FieldsProcessorConfig)
+	for name, typ := range p.conf.Convert {
+		switch typ {
+		case "int", "float", "bool":
+		default:
+			return fmt.Errorf("invalid convert type for field '%s': %s", name, typ)
+		}
+	}
+	p.addNames = make([]string, 0, len(p.conf.Add))
+	for name := range p.conf.Add {
+		p.addNames = append(p.addNames, name)
+	}
+	sort.Strings(p.addNames)
+	return nil
+}
+
+func (p *FieldsProcessor) Process(pack *pipeline.PipelinePack) (keep bool, err error) {
+	m := pack.Message
+	for _, field := range m.Fields {
+		if newName, ok := p.conf.Rename[field.GetName()]; ok {
+			field.Name = &newName
+		}
+	}
+
+	for i, field := range m.Fields {
+		typ, ok := p.conf.Convert[field.GetName()]
+		if !ok || field.GetValueType() != message.Field_STRING {
+			continue
+		}
+		var converted *message.Field
+		if converted, err = convertField(field, typ); err != nil {
+			if p.conf.DropInvalid {
+				return false, nil
+			}
+			return false, err
+		}
+		m.Fields[i] = converted
+	}
+
+	if len(p.conf.Remove) > 0 || len(p.addNames) > 0 {
+		kept := m.Fields[:0]
+		for _, field := range m.Fields {
+			if !p.removed(field.GetName()) {
+				kept = append(kept, field)
+			}
+		}
+		m.Fields = kept
+	}
+
+	for _, name := range p.addNames {
+		message.NewStringField(m, name, p.conf.Add[name])
+	}
+	return true, nil
+}
+
+// Whether the named field should be removed, either because it's configured
+// to be or because it's about to be replaced.
+func (p *FieldsProcessor) removed(name string) bool {
+	if _, ok := p.conf.Add[name]; ok {
+		return true
+	}
+	for _, removed := range p.conf.Remove {
+		if name == removed {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns a copy of a string field with its values parsed as the specified
+// type.
+func convertField(field *message.Field, typ string) (*message.Field, error) {
+	var valueType message.Field_ValueType
+	switch typ {
+	case "int":
+		valueType = message.Field_INTEGER
+	case "float":
+		valueType = message.Field_DOUBLE
+	case "bool":
+		valueType = message.Field_BOOL
+	}
+	converted := message.NewFieldInit(field.GetName(), valueType,
+		field.GetRepresentation())
+	for _, s := range field.ValueString {
+		var (
+			value interface{}
+			err   error
+		)
+		switch typ {
+		case "int":
+			value, err = strconv.ParseInt(s, 10, 64)
+		case "float":
+			value, err = strconv.ParseFloat(s, 64)
+		case "bool":
+			value, err = strconv.ParseBool(s)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("can't convert field '%s' to %s: %s",
+				field.GetName(), typ, err)
+		}
+		converted.AddValue(value)
+	}
+	return converted, nil
+}
+
+func init() {
+	pipeline.RegisterPlugin("FieldsProcessor", func() interface{} {
+		return new(FieldsProcessor)
+	})
+}
@@ -0,0 +1,108 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package plugins
+
+import (
+	"github.com/mozilla-services/heka/message"
+	"github.com/mozilla-services/heka/pipeline"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+)
+
+func FieldsProcessorSpec(c gs.Context) {
+
+	c.Specify("A FieldsProcessor", func() {
+		processor := new(FieldsProcessor)
+		config := processor.ConfigStruct().(*FieldsProcessorConfig)
+		supply := make(chan *pipeline.PipelinePack, 1)
+		pack := pipeline.NewPipelinePack(supply)
+		m := pack.Message
+		message.NewStringField(m, "status", "200")
+		message.NewStringField(m, "host", "web1")
+		message.NewStringField(m, "tmp", "x")
+
+		process := func() bool {
+			err := processor.Init(config)
+			c.Assume(err, gs.IsNil)
+			keep, err := processor.Process(pack)
+			c.Assume(err, gs.IsNil)
+			return keep
+		}
+
+		names := func() (names []string) {
+			for _, field := range m.Fields {
+				names = append(names, field.GetName())
+			}
+			return
+		}
+
+		c.Specify("renames fields", func() {
+			config.Rename = map[string]string{"host": "hostname"}
+			c.Expect(process(), gs.IsTrue)
+			c.Expect(names(), gs.ContainsExactly, []string{"status", "hostname", "tmp"})
+		})
+
+		c.Specify("converts fields", func() {
+			config.Convert = map[string]string{"status": "int"}
+			c.Expect(process(), gs.IsTrue)
+			field := m.FindFirstField("status")
+			c.Expect(field.GetValueType(), gs.Equals, message.Field_INTEGER)
+			c.Expect(field.ValueInteger[0], gs.Equals, int64(200))
+		})
+
+		c.Specify("converts renamed fields by their new name", func() {
+			config.Rename = map[string]string{"status": "code"}
+			config.Convert = map[string]string{"code": "float"}
+			c.Expect(process(), gs.IsTrue)
+			field := m.FindFirstField("code")
+			c.Expect(field.ValueDouble[0], gs.Equals, float64(200))
+		})
+
+		c.Specify("removes fields", func() {
+			config.Remove = []string{"tmp", "missing"}
+			c.Expect(process(), gs.IsTrue)
+			c.Expect(names(), gs.ContainsExactly, []string{"status", "host"})
+		})
+
+		c.Specify("adds fields, replacing existing ones", func() {
+			config.Add = map[string]string{"host": "web2", "env": "prod"}
+			c.Expect(process(), gs.IsTrue)
+			c.Expect(names(), gs.ContainsExactly, []string{"status", "tmp", "env", "host"})
+			value, _ := m.GetFieldValue("host")
+			c.Expect(value, gs.Equals, "web2")
+		})
+
+		c.Specify("with an unconvertible field", func() {
+			config.Convert = map[string]string{"host": "bool"}
+			err := processor.Init(config)
+			c.Assume(err, gs.IsNil)
+
+			c.Specify("returns an error", func() {
+				_, err := processor.Process(pack)
+				c.Expect(err.Error(), gs.Equals, "can't convert field 'host' to bool: "+
+					"strconv.ParseBool: parsing \"web1\": invalid syntax")
+			})
+
+			c.Specify("drops the message if asked", func() {
+				config.DropInvalid = true
+				keep, err := processor.Process(pack)
+				c.Expect(err, gs.IsNil)
+				c.Expect(keep, gs.IsFalse)
+			})
+		})
+
+		c.Specify("rejects unknown convert types", func() {
+			config.Convert = map[string]string{"status": "date"}
+			err := processor.Init(config)
+			c.Expect(err.Error(), gs.Equals, "invalid convert type for field 'status': date")
+		})
+	})
+}
@@ -25,6 +25,8 @@ func TestAllSpecs(t *testing.T) {
 
 	r.AddSpec(FileOutputSpec)
 	r.AddSpec(FilePollingInputSpec)
+	r.AddSpec(FileWatchInputSpec)
+	r.AddSpec(JsonLinesOutputSpec)
 
 	gospec.MainGoTest(r, t)
 }
@@ -21,9 +21,13 @@ import (
 	. "github.com/mozilla-services/heka/pipeline"
 	"github.com/mozilla-services/heka/plugins"
 	"github.com/rafrombrc/go-notify"
+	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"runtime"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
@@ -38,13 +42,45 @@ type FileOutput struct {
 	backChan   chan []byte
 	folderPerm os.FileMode
 	timerChan  <-chan time.Time
+	// Only set if Path references message values, see Init.
+	pathTemplate *DestinationTemplate
+	destChan     chan string
+	files        map[string]*os.File
+	path         string
+	// Only set in transactional mode, maps output paths to the staging files
+	// holding their unpublished data.
+	staged        map[string]*stagedFile
+	fsyncFile     bool
+	fsyncDir      bool
+	lastPublished int64
+	// Only set if GroupField is, see receiver.
+	grouper       *messageGrouper
+	groupTickChan <-chan time.Time
+	// Written at the start of each new file, if the encoder has one.
+	header []byte
+}
+
+// A temp file holding output that hasn't been published yet.
+type stagedFile struct {
+	name string
+	file *os.File // Nil if closed by a failed publish attempt.
 }
 
 // ConfigStruct for FileOutput plugin.
 type FileOutputConfig struct {
-	// Full output file path.
+	// Full output file path. May reference message headers, fields, and time
+	// formats (e.g. "/var/log/heka/%{Logger}-%{2006.01.02}.log") in which case
+	// messages are written to the file matching each message.
 	Path string
 
+	// Maximum number of distinct header and field value combinations that
+	// may be used to render the output path (default 0, i.e. unlimited).
+	MaxFiles uint `toml:"max_files"`
+
+	// Output file for messages that would exceed `max_files` or that are
+	// missing a field referenced by the output path.
+	FallbackPath string `toml:"fallback_path"`
+
 	// Output file permissions (default "644").
 	Perm string
 
@@ -70,15 +106,47 @@ type FileOutputConfig struct {
 	// output. We do some magic to default to true if ProtobufEncoder is used,
 	// false otherwise.
 	UseFraming *bool `toml:"use_framing"`
+
+	// If true, each flush is written to a temp file which is then atomically
+	// renamed to a new file named after the output path, so readers never see
+	// partially written output (default false).
+	Transactional bool `toml:"transactional"`
+
+	// When to fsync in transactional mode. "full" syncs each file before it's
+	// renamed and its directory after, "file" only syncs the file, "none"
+	// leaves it up to the OS (default "full").
+	FsyncPolicy string `toml:"fsync_policy"`
+
+	// Message field correlating related messages, e.g. "request_id". If set,
+	// the output of messages with the same field value arriving within the
+	// `group_window` is written as a single block, under a header line, with
+	// each line indented. Messages without the field are written as usual.
+	GroupField string `toml:"group_field"`
+
+	// How long to collect a group's messages after its first one arrives, in
+	// milliseconds (default 1000).
+	GroupWindow uint32 `toml:"group_window"`
+
+	// Number of messages after which a group is written right away (default
+	// 1000, 0 meaning unlimited).
+	GroupMaxMessages uint `toml:"group_max_messages"`
+
+	// Prefix of each line of a grouped message's output (default four
+	// spaces).
+	GroupIndent string `toml:"group_indent"`
 }
 
 func (o *FileOutput) ConfigStruct() interface{} {
 	return &FileOutputConfig{
-		Perm:          "644",
-		FlushInterval: 1000,
-		FlushCount:    1,
-		FlushOperator: "AND",
-		FolderPerm:    "700",
+		Perm:             "644",
+		FlushInterval:    1000,
+		FlushCount:       1,
+		FlushOperator:    "AND",
+		FolderPerm:       "700",
+		FsyncPolicy:      "full",
+		GroupWindow:      1000,
+		GroupMaxMessages: 1000,
+		GroupIndent:      "    ",
 	}
 }
 
@@ -100,10 +168,52 @@ func (o *FileOutput) Init(config interface{}) (err error) {
 		return
 	}
 	o.perm = os.FileMode(intPerm)
-	if err = o.openFile(); err != nil {
-		err = fmt.Errorf("FileOutput '%s' error opening file: %s", o.Path, err)
+
+	switch conf.FsyncPolicy {
+	case "full":
+		o.fsyncFile = true
+		// Directories can't be synced on Windows.
+		o.fsyncDir = runtime.GOOS != "windows"
+	case "file":
+		o.fsyncFile = true
+	case "none":
+	default:
+		err = fmt.Errorf("FileOutput '%s' `fsync_policy` must be 'full', 'file', or 'none'",
+			o.Path)
 		return
 	}
+	if conf.Transactional {
+		o.staged = make(map[string]*stagedFile)
+	}
+
+	o.pathTemplate, err = NewDestinationTemplate(DestinationTemplateConfig{
+		Template:       conf.Path,
+		MaxCardinality: conf.MaxFiles,
+		Fallback:       conf.FallbackPath,
+		Sanitize:       sanitizePathValue,
+	})
+	if err != nil {
+		err = fmt.Errorf("FileOutput '%s' invalid path: %s", o.Path, err)
+		return
+	}
+	if o.pathTemplate.IsDynamic() {
+		// Files are opened as messages for them arrive.
+		o.destChan = make(chan string)
+		o.files = make(map[string]*os.File)
+	} else {
+		o.pathTemplate = nil
+		o.path = o.Path
+		if o.staged != nil {
+			// Files are created as output is published.
+			if err = o.prepareDir(o.path); err != nil {
+				err = fmt.Errorf("FileOutput '%s' error preparing directory: %s", o.Path, err)
+				return
+			}
+		} else if o.file, err = o.openFile(o.path); err != nil {
+			err = fmt.Errorf("FileOutput '%s' error opening file: %s", o.Path, err)
+			return
+		}
+	}
 
 	if conf.FlushCount < 1 {
 		err = fmt.Errorf("Parameter 'flush_count' needs to be greater 1.")
@@ -120,21 +230,93 @@ func (o *FileOutput) Init(config interface{}) (err error) {
 		return
 	}
 
+	if conf.GroupField != "" {
+		if o.pathTemplate != nil {
+			err = fmt.Errorf("FileOutput '%s' `group_field` can't be used with a dynamic path",
+				o.Path)
+			return
+		}
+		if conf.UseFraming != nil && *conf.UseFraming {
+			err = fmt.Errorf("FileOutput '%s' `group_field` can't be used with framing",
+				o.Path)
+			return
+		}
+		if conf.GroupWindow == 0 {
+			err = fmt.Errorf("FileOutput '%s' `group_window` must be greater than 0",
+				o.Path)
+			return
+		}
+		o.grouper = newMessageGrouper(conf.GroupField,
+			time.Duration(conf.GroupWindow)*time.Millisecond, conf.GroupMaxMessages,
+			conf.GroupIndent)
+	}
+
 	o.batchChan = make(chan []byte)
 	o.backChan = make(chan []byte, 2) // Never block on the hand-back
 	return
 }
 
-func (o *FileOutput) openFile() (err error) {
-	basePath := filepath.Dir(o.Path)
-	if err = os.MkdirAll(basePath, o.folderPerm); err != nil {
+// Makes sure the directory for the provided path exists and is writable.
+func (o *FileOutput) prepareDir(path string) error {
+	basePath := filepath.Dir(path)
+	if err := os.MkdirAll(basePath, o.folderPerm); err != nil {
 		return fmt.Errorf("Can't create the basepath for the FileOutput plugin: %s", err.Error())
 	}
-	if err = plugins.CheckWritePermission(basePath); err != nil {
+	return plugins.CheckWritePermission(basePath)
+}
+
+func (o *FileOutput) openFile(path string) (file *os.File, err error) {
+	if err = o.prepareDir(path); err != nil {
 		return
 	}
-	o.file, err = os.OpenFile(o.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, o.perm)
-	return
+	return os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, o.perm)
+}
+
+// Writes the encoder's header to a file if it's empty, i.e. new, recreated
+// by log rotation, or truncated.
+func (o *FileOutput) writeHeader(file *os.File) error {
+	if o.header == nil {
+		return nil
+	}
+	info, err := file.Stat()
+	if err != nil || info.Size() > 0 {
+		return err
+	}
+	n, err := file.Write(o.header)
+	if err == nil && n != len(o.header) {
+		err = io.ErrShortWrite
+	}
+	return err
+}
+
+// Keeps message values used in the output path from escaping the directory
+// they're meant to end up in.
+func sanitizePathValue(val string) string {
+	val = strings.Replace(val, "/", "_", -1)
+	val = strings.Replace(val, string(os.PathSeparator), "_", -1)
+	if val == "." || val == ".." || val == "" {
+		return "_"
+	}
+	return val
+}
+
+// Switches the committer to the file for the provided path, opening it if
+// necessary.
+func (o *FileOutput) useFile(or OutputRunner, path string) {
+	o.path = path
+	if o.staged != nil {
+		return
+	}
+	var ok bool
+	if o.file, ok = o.files[path]; ok {
+		return
+	}
+	var err error
+	if o.file, err = o.openFile(path); err != nil {
+		or.LogError(fmt.Errorf("Can't open %s: %s", path, err))
+		return
+	}
+	o.files[path] = o.file
 }
 
 func (o *FileOutput) Run(or OutputRunner, h PluginHelper) (err error) {
@@ -146,9 +328,15 @@ func (o *FileOutput) Run(or OutputRunner, h PluginHelper) (err error) {
 		// Nothing was specified, we'll default to framing IFF ProtobufEncoder
 		// is being used.
 		if _, ok := enc.(*ProtobufEncoder); ok {
+			if o.grouper != nil {
+				return errors.New("`group_field` requires a text encoder.")
+			}
 			or.SetUseFraming(true)
 		}
 	}
+	if he, ok := enc.(HeaderEncoder); ok && (o.UseFraming == nil || !*o.UseFraming) {
+		o.header = he.Header()
+	}
 	var wg sync.WaitGroup
 	wg.Add(2)
 	go o.receiver(or, &wg)
@@ -169,6 +357,8 @@ func (o *FileOutput) receiver(or OutputRunner, wg *sync.WaitGroup) {
 		msgCounter      uint32
 		intervalElapsed bool
 		outBytes        []byte
+		dest            string
+		curDest         string
 	)
 	ok := true
 	outBatch := make([]byte, 0, 10000)
@@ -181,42 +371,95 @@ func (o *FileOutput) receiver(or OutputRunner, wg *sync.WaitGroup) {
 			o.timerChan = timer.C
 		}
 	}
+	if o.grouper != nil && o.groupTickChan == nil {
+		// Check for complete groups a few times per window.
+		ticker := time.NewTicker(o.grouper.window / 4)
+		defer ticker.Stop()
+		o.groupTickChan = ticker.C
+	}
+
+	// Trigger immediately when the message count threshold has been
+	// reached if a) the "OR" operator is in effect or b) the
+	// flushInterval is 0 or c) the flushInterval has already elapsed.
+	// at least once since the last flush.
+	checkFlushCount := func() {
+		if msgCounter >= o.FlushCount {
+			if !o.flushOpAnd || o.FlushInterval == 0 || intervalElapsed {
+				// This will block until the other side is ready to accept
+				// this batch, freeing us to start on the next one.
+				o.batchChan <- outBatch
+				outBatch = <-o.backChan
+				msgCounter = 0
+				intervalElapsed = false
+				if timer != nil {
+					timer.Reset(timerDuration)
+				}
+			}
+		}
+	}
 
 	for ok {
 		select {
 		case pack, ok = <-inChan:
 			if !ok {
 				// Closed inChan => we're shutting down, flush data
+				if o.grouper != nil {
+					rendered, _ := o.grouper.expired(true)
+					outBatch = append(outBatch, rendered...)
+				}
 				if len(outBatch) > 0 {
 					o.batchChan <- outBatch
 				}
 				close(o.batchChan)
 				break
 			}
+			if o.pathTemplate != nil {
+				if dest, e = o.pathTemplate.Destination(pack.Message); e != nil {
+					or.LogError(e)
+					pack.Recycle()
+					continue
+				}
+				if dest != curDest {
+					// Batches only ever go to a single file, so flush what
+					// we've got before switching.
+					if len(outBatch) > 0 {
+						o.batchChan <- outBatch
+						outBatch = <-o.backChan
+						msgCounter = 0
+						intervalElapsed = false
+						if timer != nil {
+							timer.Reset(timerDuration)
+						}
+					}
+					o.destChan <- dest
+					curDest = dest
+				}
+			}
 			if outBytes, e = or.Encode(pack); e != nil {
 				or.LogError(e)
 			} else if outBytes != nil {
-				outBatch = append(outBatch, outBytes...)
-				msgCounter++
+				var rendered []byte
+				grouped := false
+				if o.grouper != nil {
+					rendered, grouped = o.grouper.add(pack.Message, outBytes)
+				}
+				if !grouped {
+					outBatch = append(outBatch, outBytes...)
+					msgCounter++
+				} else if rendered != nil {
+					outBatch = append(outBatch, rendered...)
+					msgCounter++
+				}
 			}
 			pack.Recycle()
-
-			// Trigger immediately when the message count threshold has been
-			// reached if a) the "OR" operator is in effect or b) the
-			// flushInterval is 0 or c) the flushInterval has already elapsed.
-			// at least once since the last flush.
-			if msgCounter >= o.FlushCount {
-				if !o.flushOpAnd || o.FlushInterval == 0 || intervalElapsed {
-					// This will block until the other side is ready to accept
-					// this batch, freeing us to start on the next one.
-					o.batchChan <- outBatch
-					outBatch = <-o.backChan
-					msgCounter = 0
-					intervalElapsed = false
-					if timer != nil {
-						timer.Reset(timerDuration)
-					}
-				}
+			checkFlushCount()
+		case <-o.groupTickChan:
+			// Each complete group counts as a single message.
+			rendered, count := o.grouper.expired(false)
+			if count > 0 {
+				outBatch = append(outBatch, rendered...)
+				msgCounter += uint32(count)
+				checkFlushCount()
 			}
 		case <-o.timerChan:
 			if (o.flushOpAnd && msgCounter >= o.FlushCount) ||
@@ -257,19 +500,42 @@ func (o *FileOutput) committer(or OutputRunner, wg *sync.WaitGroup) {
 				// Channel is closed => we're shutting down, exit cleanly.
 				break
 			}
-			n, err := o.file.Write(outBatch)
-			if err != nil {
-				or.LogError(fmt.Errorf("Can't write to %s: %s", o.Path, err))
+			if o.staged != nil {
+				o.commitStaged(or, outBatch)
+			} else if o.file == nil {
+				or.LogError(fmt.Errorf("Dropping output for %s, file not open", o.path))
+			} else if err := o.writeHeader(o.file); err != nil {
+				or.LogError(fmt.Errorf("Can't write header to %s: %s", o.path, err))
+			} else if n, err := o.file.Write(outBatch); err != nil {
+				or.LogError(fmt.Errorf("Can't write to %s: %s", o.path, err))
 			} else if n != len(outBatch) {
-				or.LogError(fmt.Errorf("Truncated output for %s", o.Path))
+				or.LogError(fmt.Errorf("Truncated output for %s", o.path))
 			} else {
 				o.file.Sync()
 			}
 			outBatch = outBatch[:0]
 			o.backChan <- outBatch
+		case path := <-o.destChan:
+			o.useFile(or, path)
 		case <-hupChan:
+			if o.staged != nil {
+				// Nothing is held open between flushes.
+				break
+			}
+			if o.files != nil {
+				// Only the current file is reopened right away, the others
+				// will be as messages for them arrive.
+				for path, file := range o.files {
+					file.Close()
+					delete(o.files, path)
+				}
+				if o.path != "" {
+					o.useFile(or, o.path)
+				}
+				break
+			}
 			o.file.Close()
-			if err = o.openFile(); err != nil {
+			if o.file, err = o.openFile(o.path); err != nil {
 				// TODO: Need a way to handle this gracefully, see
 				// https://github.com/mozilla-services/heka/issues/38
 				panic(fmt.Sprintf("FileOutput unable to reopen file '%s': %s",
@@ -278,10 +544,138 @@ func (o *FileOutput) committer(or OutputRunner, wg *sync.WaitGroup) {
 		}
 	}
 
-	o.file.Close()
+	if o.staged != nil {
+		// Anything left over failed to publish earlier, try one last time.
+		for path, staged := range o.staged {
+			if err = o.publish(path, staged); err != nil {
+				or.LogError(fmt.Errorf("Can't publish %s, leaving it in place: %s",
+					staged.name, err))
+			}
+		}
+	} else if o.files != nil {
+		for _, file := range o.files {
+			file.Close()
+		}
+	} else {
+		o.file.Close()
+	}
 	wg.Done()
 }
 
+// Appends a batch to the current path's staging file and publishes it. If
+// publishing fails the staged data is kept, to be published with the next
+// batch.
+func (o *FileOutput) commitStaged(or OutputRunner, outBatch []byte) {
+	staged, err := o.stage(o.path, outBatch)
+	if err != nil {
+		or.LogError(fmt.Errorf("Can't stage output for %s: %s", o.path, err))
+		return
+	}
+	if err = o.publish(o.path, staged); err != nil {
+		or.LogError(fmt.Errorf("Can't publish %s, will retry on next flush: %s",
+			staged.name, err))
+	}
+}
+
+// Appends data to the staging file for the provided path, creating it in the
+// same directory, so it can be renamed into place, if necessary. Failed
+// writes are rolled back so partial batches are never published.
+func (o *FileOutput) stage(path string, data []byte) (staged *stagedFile, err error) {
+	var ok bool
+	if staged, ok = o.staged[path]; !ok {
+		if err = o.prepareDir(path); err != nil {
+			return nil, err
+		}
+		var file *os.File
+		prefix := "." + filepath.Base(path) + ".tmp"
+		if file, err = ioutil.TempFile(filepath.Dir(path), prefix); err != nil {
+			return nil, err
+		}
+		if err = file.Chmod(o.perm); err != nil {
+			file.Close()
+			os.Remove(file.Name())
+			return nil, err
+		}
+		if err = o.writeHeader(file); err != nil {
+			file.Close()
+			os.Remove(file.Name())
+			return nil, err
+		}
+		staged = &stagedFile{name: file.Name(), file: file}
+		o.staged[path] = staged
+	} else if staged.file == nil {
+		if staged.file, err = os.OpenFile(staged.name, os.O_WRONLY, o.perm); err != nil {
+			return nil, err
+		}
+	}
+
+	var size int64
+	if size, err = staged.file.Seek(0, os.SEEK_END); err != nil {
+		return nil, err
+	}
+	n, err := staged.file.Write(data)
+	if err == nil && n != len(data) {
+		err = io.ErrShortWrite
+	}
+	if err != nil {
+		if terr := staged.file.Truncate(size); terr != nil {
+			// We can't tell what's in there any more, throw it all away.
+			staged.file.Close()
+			os.Remove(staged.name)
+			delete(o.staged, path)
+			err = fmt.Errorf("%s, discarded unpublished output: %s", err, terr)
+		}
+		return nil, err
+	}
+	return staged, nil
+}
+
+// Atomically renames a staging file to a new file named after the output
+// path, syncing according to the fsync policy.
+func (o *FileOutput) publish(path string, staged *stagedFile) (err error) {
+	if staged.file != nil {
+		if o.fsyncFile {
+			if err = staged.file.Sync(); err != nil {
+				return
+			}
+		}
+		err = staged.file.Close()
+		staged.file = nil
+		if err != nil {
+			return
+		}
+	}
+	if err = os.Rename(staged.name, o.publishedName(path)); err != nil {
+		return
+	}
+	delete(o.staged, path)
+	if o.fsyncDir {
+		err = syncDir(filepath.Dir(path))
+	}
+	return
+}
+
+// Returns a new, unique name for published output, which sorts in the order
+// the output was published.
+func (o *FileOutput) publishedName(path string) string {
+	stamp := time.Now().UnixNano()
+	if stamp <= o.lastPublished {
+		stamp = o.lastPublished + 1
+	}
+	o.lastPublished = stamp
+	return fmt.Sprintf("%s.%d", path, stamp)
+}
+
+// Flushes a directory's entries to disk, so renames survive a crash.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
 func init() {
 	RegisterPlugin("FileOutput", func() interface{} {
 		return new(FileOutput)
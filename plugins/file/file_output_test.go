@@ -17,6 +17,7 @@ package file
 
 import (
 	"fmt"
+	"github.com/mozilla-services/heka/message"
 	. "github.com/mozilla-services/heka/pipeline"
 	pipeline_ts "github.com/mozilla-services/heka/pipeline/testsupport"
 	"github.com/mozilla-services/heka/plugins"
@@ -122,6 +123,98 @@ func FileOutputSpec(c gs.Context) {
 			c.Expect(string(outBatch), gs.Equals, payload)
 		})
 
+		c.Specify("groups related messages", func() {
+			config.GroupField = "request_id"
+			config.GroupIndent = "  "
+			config.FlushInterval = 0
+			err := fileOutput.Init(config)
+			c.Assume(err, gs.IsNil)
+			fileOutput.file.Close()
+			now := time.Unix(1000, 0)
+			fileOutput.grouper.now = func() time.Time { return now }
+			tickChan := make(chan time.Time)
+			fileOutput.groupTickChan = tickChan
+
+			newPack := func(requestId, payload string, ts int64) *PipelinePack {
+				pack := NewPipelinePack(pConfig.InputRecycleChan())
+				pack.Message = message.CopyMessage(msg)
+				pack.Message.Fields = nil
+				if requestId != "" {
+					message.NewStringField(pack.Message, "request_id", requestId)
+				}
+				pack.Message.SetPayload(payload)
+				pack.Message.SetTimestamp(ts)
+				oth.MockOutputRunner.EXPECT().Encode(pack).Return(encoder.Encode(pack))
+				return pack
+			}
+
+			inChan = make(chan *PipelinePack)
+			oth.MockOutputRunner.EXPECT().InChan().Return(inChan)
+			wg.Add(1)
+			go fileOutput.receiver(oth.MockOutputRunner, &wg)
+			inChan <- newPack("abc", "first\nsecond", 1e9)
+			inChan <- newPack("", "ungrouped", 2e9)
+			outBatch := <-fileOutput.batchChan
+			c.Expect(string(outBatch), gs.Equals, "ungrouped\n")
+			fileOutput.backChan <- outBatch[:0]
+			inChan <- newPack("abc", "third", 3e9)
+
+			// The window hasn't elapsed yet.
+			tickChan <- now
+			select {
+			case <-fileOutput.batchChan:
+				c.Expect("", gs.Equals, "fileOutput.batchChan should NOT have fired yet")
+			default:
+			}
+
+			now = now.Add(time.Second)
+			tickChan <- now
+			outBatch = <-fileOutput.batchChan
+			c.Expect(string(outBatch), gs.Equals, "--- request_id=abc (2 messages, "+
+				"1970-01-01T00:00:01.000Z .. 1970-01-01T00:00:03.000Z)\n"+
+				"  first\n  second\n  third\n\n")
+			fileOutput.backChan <- outBatch[:0]
+			close(inChan)
+			<-fileOutput.batchChan
+			wg.Wait()
+		})
+
+		c.Specify("routes messages to files by message values", func() {
+			tmpdir, err := ioutil.TempDir("", "fileoutput-dest-test")
+			c.Assume(err, gs.IsNil)
+			defer os.RemoveAll(tmpdir)
+			config.Path = filepath.Join(tmpdir, "%{Logger}.log")
+			config.MaxFiles = 1
+			config.FallbackPath = filepath.Join(tmpdir, "overflow.log")
+			err = fileOutput.Init(config)
+			c.Assume(err, gs.IsNil)
+			c.Expect(fileOutput.file, gs.IsNil)
+
+			pack2 := NewPipelinePack(pConfig.InputRecycleChan())
+			pack2.Message = message.CopyMessage(msg)
+			pack2.Message.SetLogger("../other")
+
+			inChan = make(chan *PipelinePack, 2)
+			oth.MockOutputRunner.EXPECT().InChan().Return(inChan)
+			oth.MockOutputRunner.EXPECT().Encode(pack).Return(encoder.Encode(pack))
+			oth.MockOutputRunner.EXPECT().Encode(pack2).Return(encoder.Encode(pack2))
+			wg.Add(2)
+			go fileOutput.receiver(oth.MockOutputRunner, &wg)
+			go fileOutput.committer(oth.MockOutputRunner, &wg)
+			inChan <- pack
+			inChan <- pack2
+			close(inChan)
+			wg.Wait()
+
+			payload := fmt.Sprintf("%s\n", msg.GetPayload())
+			contents, err := ioutil.ReadFile(filepath.Join(tmpdir, msg.GetLogger()+".log"))
+			c.Expect(err, gs.IsNil)
+			c.Expect(string(contents), gs.Equals, payload)
+			contents, err = ioutil.ReadFile(config.FallbackPath)
+			c.Expect(err, gs.IsNil)
+			c.Expect(string(contents), gs.Equals, payload)
+		})
+
 		c.Specify("commits to a file", func() {
 			outStr := "Write me out to the log file"
 			outBytes := []byte(outStr)
@@ -188,6 +281,66 @@ func FileOutputSpec(c gs.Context) {
 					c.Expect(fileMode.String(), pipeline_ts.StringContains, "-------")
 				}
 			})
+
+			c.Specify("starting with the encoder's header", func() {
+				err := fileOutput.Init(config)
+				c.Assume(err, gs.IsNil)
+				fileOutput.header = []byte("header\n")
+
+				wg.Add(1)
+				go fileOutput.committer(oth.MockOutputRunner, &wg)
+				go func() {
+					fileOutput.batchChan <- outBytes
+					outBatch := <-fileOutput.backChan
+					fileOutput.batchChan <- append(outBatch, []byte("second")...)
+					<-fileOutput.backChan
+					close(fileOutput.batchChan)
+				}()
+				wg.Wait()
+
+				// The header is only written to the empty file.
+				contents, err := ioutil.ReadFile(tmpFilePath)
+				c.Assume(err, gs.IsNil)
+				c.Expect(string(contents), gs.Equals, "header\n"+outStr+"second")
+			})
+
+			c.Specify("transactionally", func() {
+				tmpdir, err := ioutil.TempDir("", "fileoutput-tx-test")
+				c.Assume(err, gs.IsNil)
+				defer os.RemoveAll(tmpdir)
+				config.Path = filepath.Join(tmpdir, "out.log")
+				config.Transactional = true
+				err = fileOutput.Init(config)
+				c.Assume(err, gs.IsNil)
+				c.Expect(fileOutput.file, gs.IsNil)
+
+				wg.Add(1)
+				go fileOutput.committer(oth.MockOutputRunner, &wg)
+				go func() {
+					fileOutput.batchChan <- outBytes
+					outBatch := <-fileOutput.backChan
+					fileOutput.batchChan <- append(outBatch, []byte("second")...)
+					<-fileOutput.backChan
+					close(fileOutput.batchChan)
+				}()
+				wg.Wait()
+
+				// Each batch is published to its own file, in order.
+				published, err := filepath.Glob(config.Path + ".*")
+				c.Assume(err, gs.IsNil)
+				c.Assume(len(published), gs.Equals, 2)
+				contents, err := ioutil.ReadFile(published[0])
+				c.Expect(err, gs.IsNil)
+				c.Expect(string(contents), gs.Equals, outStr)
+				contents, err = ioutil.ReadFile(published[1])
+				c.Expect(err, gs.IsNil)
+				c.Expect(string(contents), gs.Equals, "second")
+
+				// Nothing's left in staging.
+				staging, err := filepath.Glob(filepath.Join(tmpdir, ".*"))
+				c.Expect(err, gs.IsNil)
+				c.Expect(len(staging), gs.Equals, 0)
+			})
 		})
 
 		if runtime.GOOS != "windows" {
@@ -0,0 +1,604 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package file
+
+import (
+	"code.google.com/p/go-uuid/uuid"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/fsnotify/fsnotify"
+	"github.com/mozilla-services/heka/message"
+	"github.com/mozilla-services/heka/pipeline"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+type FileWatchInputConfig struct {
+	// Shell glob patterns of the files to read, e.g. "/srv/*/logs/*.log".
+	Globs []string
+	// Where to start reading the files that exist when Heka starts and have
+	// no checkpoint, "end" or "beginning". Files appearing later are always
+	// read from the beginning.
+	StartPosition string `toml:"start_position"`
+	// How often the globs are expanded again, in case a change was missed,
+	// e.g. on network filesystems.
+	RescanInterval string `toml:"rescan_interval"`
+	// How long a rotated file keeps being read, for the writes made before
+	// its writer reopened the file.
+	RotateWait string `toml:"rotate_wait"`
+	// File the positions of the files are saved in, relative to the base_dir.
+	// Defaults to "file_watch/<input name>.json".
+	CheckpointFile string `toml:"checkpoint_file"`
+	// How often the positions are saved, if they changed.
+	CheckpointInterval string `toml:"checkpoint_interval"`
+	// Type of parser used to break the files up into records, "token",
+	// "regexp", "length_prefix", "varint", or "json".
+	ParserType string `toml:"parser_type"`
+	// Delimiter used to split the files into records
+	Delimiter string
+	// String indicating if the delimiter is at the start or end of the line,
+	// only used for regexp delimiters
+	DelimiterLocation string `toml:"delimiter_location"`
+	// Joins the records into multiline records, e.g. stack traces.
+	Multiline pipeline.MultilineOptions
+}
+
+// Reads the files matching globs as they're written to, watching their
+// directories for new and rotated files, e.g. with inotify on Linux, rather
+// than rescanning them. The position of each file is saved in a checkpoint
+// file, replaced atomically so it's never partially written.
+type FileWatchInput struct {
+	filesWatched int64
+	filesRotated int64
+	recordsRead  int64
+
+	conf           *FileWatchInputConfig
+	pConfig        *pipeline.PipelineConfig
+	name           string
+	hostname       string
+	rescanInterval time.Duration
+	rotateWait     time.Duration
+	checkpointTick time.Duration
+	checkpoints    map[string]*fileCheckpoint
+	dirty          bool
+	watcher        *fsnotify.Watcher
+	dirs           map[string]bool
+	// Files being read, by path.
+	files map[string]*watchedFile
+	// Rotated files read until their rotate_wait is over.
+	rotated  []*watchedFile
+	ir       pipeline.InputRunner
+	stopChan chan bool
+}
+
+// The saved position of a file. As files are replaced under the same path,
+// a hash of their start identifies them.
+type fileCheckpoint struct {
+	Offset     int64  `json:"offset"`
+	Hash       string `json:"hash"`
+	HashLength int64  `json:"hash_length"`
+}
+
+// Length of the start of a file its hash covers.
+const checkpointHashLength = 512
+
+type watchedFile struct {
+	path       string
+	fd         *os.File
+	info       os.FileInfo
+	parser     pipeline.StreamParser
+	checkpoint fileCheckpoint
+	rotatedAt  time.Time
+}
+
+func (input *FileWatchInput) SetPipelineConfig(pConfig *pipeline.PipelineConfig) {
+	input.pConfig = pConfig
+}
+
+func (input *FileWatchInput) SetName(name string) {
+	input.name = name
+}
+
+func (input *FileWatchInput) ConfigStruct() interface{} {
+	return &FileWatchInputConfig{
+		StartPosition:      "end",
+		RescanInterval:     "1m",
+		RotateWait:         "5s",
+		CheckpointInterval: "1s",
+		ParserType:         "token",
+		Multiline: pipeline.MultilineOptions{
+			MaxLines: 500,
+			Timeout:  "5s",
+		},
+	}
+}
+
+func (input *FileWatchInput) Init(config interface{}) (err error) {
+	input.conf = config.(*FileWatchInputConfig)
+	if len(input.conf.Globs) == 0 {
+		return errors.New("`globs` setting is required")
+	}
+	for _, glob := range input.conf.Globs {
+		if _, err = filepath.Match(glob, ""); err != nil {
+			return fmt.Errorf("invalid glob '%s': %s", glob, err)
+		}
+	}
+	if input.conf.StartPosition != "end" && input.conf.StartPosition != "beginning" {
+		return errors.New("start_position must be 'end' or 'beginning'")
+	}
+	if input.rescanInterval, err = time.ParseDuration(input.conf.RescanInterval); err != nil {
+		return fmt.Errorf("invalid rescan_interval: %s", err)
+	}
+	if input.rotateWait, err = time.ParseDuration(input.conf.RotateWait); err != nil {
+		return fmt.Errorf("invalid rotate_wait: %s", err)
+	}
+	if input.checkpointTick, err = time.ParseDuration(input.conf.CheckpointInterval); err != nil {
+		return fmt.Errorf("invalid checkpoint_interval: %s", err)
+	}
+	if input.rescanInterval <= 0 || input.checkpointTick <= 0 {
+		return errors.New("rescan_interval and checkpoint_interval must be positive")
+	}
+	if _, err = input.newParser(); err != nil {
+		return
+	}
+
+	if input.conf.CheckpointFile == "" {
+		input.conf.CheckpointFile = filepath.Join("file_watch", input.name+".json")
+	}
+	input.conf.CheckpointFile = input.pConfig.Globals.PrependBaseDir(input.conf.CheckpointFile)
+	if err = os.MkdirAll(filepath.Dir(input.conf.CheckpointFile), 0755); err != nil {
+		return
+	}
+	input.checkpoints = make(map[string]*fileCheckpoint)
+	if data, err := ioutil.ReadFile(input.conf.CheckpointFile); err == nil {
+		if err = json.Unmarshal(data, &input.checkpoints); err != nil {
+			return fmt.Errorf("invalid checkpoint file %s: %s",
+				input.conf.CheckpointFile, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	input.hostname = input.pConfig.Hostname()
+	input.dirs = make(map[string]bool)
+	input.files = make(map[string]*watchedFile)
+	input.rotated = nil
+	input.stopChan = make(chan bool)
+	return
+}
+
+func (input *FileWatchInput) newParser() (pipeline.StreamParser, error) {
+	parser, err := input.newRecordParser()
+	if err != nil || !input.conf.Multiline.Enabled() {
+		return parser, err
+	}
+	return pipeline.NewMultilineParser(parser, input.conf.Multiline)
+}
+
+func (input *FileWatchInput) newRecordParser() (pipeline.StreamParser, error) {
+	switch input.conf.ParserType {
+	case "", "token":
+		tp := pipeline.NewTokenParser()
+		switch len(input.conf.Delimiter) {
+		case 0:
+		case 1:
+			tp.SetDelimiter(input.conf.Delimiter[0])
+		default:
+			return nil, fmt.Errorf("invalid delimiter: %s", input.conf.Delimiter)
+		}
+		return tp, nil
+	case "regexp":
+		rp := pipeline.NewRegexpParser()
+		if len(input.conf.Delimiter) > 0 {
+			if err := rp.SetDelimiter(input.conf.Delimiter); err != nil {
+				return nil, err
+			}
+		}
+		if err := rp.SetDelimiterLocation(input.conf.DelimiterLocation); err != nil {
+			return nil, err
+		}
+		return rp, nil
+	case "length_prefix", "varint":
+		lp := pipeline.NewLengthPrefixParser()
+		lp.SetVarint(input.conf.ParserType == "varint")
+		return lp, nil
+	case "json":
+		return pipeline.NewJsonParser(), nil
+	}
+	return nil, fmt.Errorf("unknown parser type: %s", input.conf.ParserType)
+}
+
+func (input *FileWatchInput) Run(ir pipeline.InputRunner, h pipeline.PluginHelper) (err error) {
+	input.ir = ir
+	if input.watcher, err = fsnotify.NewWatcher(); err != nil {
+		return fmt.Errorf("can't watch files: %s", err)
+	}
+	defer func() {
+		input.watcher.Close()
+		input.saveCheckpoints()
+		for _, f := range input.files {
+			f.fd.Close()
+		}
+		for _, f := range input.rotated {
+			f.fd.Close()
+		}
+	}()
+
+	input.scan(true)
+	if !input.readAll() {
+		return nil
+	}
+	rescan := time.NewTicker(input.rescanInterval)
+	defer rescan.Stop()
+	checkpoint := time.NewTicker(input.checkpointTick)
+	defer checkpoint.Stop()
+
+	for {
+		select {
+		case <-input.stopChan:
+			return nil
+		case event := <-input.watcher.Events:
+			if !input.handle(event) {
+				return nil
+			}
+		case err := <-input.watcher.Errors:
+			// Events may have been lost, e.g. when the event queue overflowed.
+			ir.LogError(fmt.Errorf("watching files: %s", err))
+			input.scan(false)
+			if !input.readAll() {
+				return nil
+			}
+		case <-rescan.C:
+			input.scan(false)
+			if !input.readAll() {
+				return nil
+			}
+		case now := <-checkpoint.C:
+			// Returns the multiline records that timed out.
+			if input.conf.Multiline.Enabled() && !input.readAll() {
+				return nil
+			}
+			if !input.expireRotated(now) {
+				return nil
+			}
+			input.saveCheckpoints()
+		}
+	}
+}
+
+func (input *FileWatchInput) Stop() {
+	close(input.stopChan)
+}
+
+// Handles a change in a watched directory, returning false if the input is
+// stopping.
+func (input *FileWatchInput) handle(event fsnotify.Event) bool {
+	f, tracked := input.files[event.Name]
+	switch {
+	case tracked && event.Op&(fsnotify.Remove|fsnotify.Rename) != 0:
+		// The file was rotated away, what's left of it is read before its
+		// replacement, if it's there already.
+		delete(input.files, f.path)
+		delete(input.checkpoints, f.path)
+		input.dirty = true
+		f.rotatedAt = time.Now()
+		input.rotated = append(input.rotated, f)
+		atomic.AddInt64(&input.filesRotated, 1)
+		atomic.StoreInt64(&input.filesWatched, int64(len(input.files)))
+		if !input.read(f) {
+			return false
+		}
+		input.scan(false)
+		return input.readAll()
+	case tracked && event.Op&fsnotify.Write != 0:
+		return input.read(f)
+	case event.Op&(fsnotify.Create|fsnotify.Rename) != 0:
+		input.scan(false)
+		return input.readAll()
+	}
+	return true
+}
+
+// Expands the globs, watching the directories new matches could appear in
+// and opening the new matching files. `initial` is true for the files found
+// when starting.
+func (input *FileWatchInput) scan(initial bool) {
+	dirs := make(map[string]bool)
+	for _, glob := range input.conf.Globs {
+		for _, dir := range globDirs(glob) {
+			dirs[dir] = true
+		}
+	}
+	// Directories are watched before their files are listed, so no file is
+	// missed.
+	for dir := range dirs {
+		if !input.dirs[dir] {
+			if err := input.watcher.Add(dir); err != nil {
+				delete(dirs, dir)
+			}
+		}
+	}
+	for dir := range input.dirs {
+		if !dirs[dir] {
+			input.watcher.Remove(dir)
+		}
+	}
+	input.dirs = dirs
+
+	var paths []string
+	for _, glob := range input.conf.Globs {
+		matches, _ := filepath.Glob(glob)
+		paths = append(paths, matches...)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		if _, ok := input.files[path]; ok {
+			continue
+		}
+		if err := input.open(path, initial); err != nil {
+			input.ir.LogError(fmt.Errorf("can't open %s: %s", path, err))
+		}
+	}
+	atomic.StoreInt64(&input.filesWatched, int64(len(input.files)))
+}
+
+// Returns the directories to watch for new matches of a glob: those its
+// matches are in and, for the parts of the glob that are patterns, the
+// directories new matching directories would appear in.
+func globDirs(glob string) []string {
+	dir := filepath.Dir(glob)
+	if !strings.ContainsAny(dir, "*?[") || dir == glob {
+		return []string{dir}
+	}
+	dirs := globDirs(dir)
+	matches, _ := filepath.Glob(dir)
+	for _, match := range matches {
+		if info, err := os.Stat(match); err == nil && info.IsDir() {
+			dirs = append(dirs, match)
+		}
+	}
+	return dirs
+}
+
+// Opens a file, resuming from its checkpoint if it's the file the checkpoint
+// was saved for.
+func (input *FileWatchInput) open(path string, initial bool) error {
+	fd, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	info, err := fd.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		fd.Close()
+		return err
+	}
+	// A rotated file renamed to a matching name is still the same file.
+	for i, f := range input.rotated {
+		if os.SameFile(f.info, info) {
+			fd.Close()
+			input.rotated = append(input.rotated[:i], input.rotated[i+1:]...)
+			f.path = path
+			input.track(f)
+			return nil
+		}
+	}
+
+	f := &watchedFile{path: path, fd: fd, info: info}
+	if f.parser, err = input.newParser(); err != nil {
+		fd.Close()
+		return err
+	}
+	if cp, ok := input.checkpoints[path]; ok && cp.Offset <= info.Size() &&
+		fileHash(fd, cp.HashLength) == cp.Hash {
+
+		f.checkpoint = *cp
+	} else if initial && !ok && input.conf.StartPosition == "end" {
+		f.checkpoint.Offset = info.Size()
+	}
+	if _, err = fd.Seek(f.checkpoint.Offset, 0); err != nil {
+		fd.Close()
+		return err
+	}
+	input.track(f)
+	return nil
+}
+
+func (input *FileWatchInput) track(f *watchedFile) {
+	input.files[f.path] = f
+	input.updateCheckpoint(f)
+}
+
+// Returns the hash of the first `length` bytes of a file, or "" if it's
+// shorter.
+func fileHash(fd *os.File, length int64) string {
+	buf := make([]byte, length)
+	if _, err := fd.ReadAt(buf, 0); err != nil {
+		return ""
+	}
+	sum := sha1.Sum(buf)
+	return hex.EncodeToString(sum[:])
+}
+
+// Records a file's position to be saved with the next checkpoint.
+func (input *FileWatchInput) updateCheckpoint(f *watchedFile) {
+	cp := &f.checkpoint
+	if cp.HashLength < checkpointHashLength && cp.Offset > cp.HashLength {
+		cp.HashLength = cp.Offset
+		if cp.HashLength > checkpointHashLength {
+			cp.HashLength = checkpointHashLength
+		}
+		cp.Hash = fileHash(f.fd, cp.HashLength)
+	} else if cp.Hash == "" {
+		cp.Hash = fileHash(f.fd, cp.HashLength)
+	}
+	// Rotated files aren't resumed, their path may be a new file's.
+	if input.files[f.path] != f {
+		return
+	}
+	if saved, ok := input.checkpoints[f.path]; !ok || *saved != *cp {
+		saved := *cp
+		input.checkpoints[f.path] = &saved
+		input.dirty = true
+	}
+}
+
+// Reads the records appended to a file, returning false if the input is
+// stopping.
+func (input *FileWatchInput) read(f *watchedFile) bool {
+	if info, err := f.fd.Stat(); err == nil && info.Size() < f.checkpoint.Offset {
+		// Truncated, e.g. by copytruncate rotation.
+		f.fd.Seek(0, 0)
+		f.parser, _ = input.newParser()
+		f.checkpoint = fileCheckpoint{}
+		atomic.AddInt64(&input.filesRotated, 1)
+	}
+	defer input.updateCheckpoint(f)
+	for {
+		n, record, err := f.parser.Parse(f.fd)
+		if err == io.ErrShortBuffer {
+			input.ir.LogError(fmt.Errorf("record in %s exceeded MAX_RECORD_SIZE %d and "+
+				"was dropped", f.path, message.MAX_RECORD_SIZE))
+			record = nil
+			err = nil
+		}
+		f.checkpoint.Offset += int64(n)
+		if len(record) > 0 && !input.deliver(f, record) {
+			f.checkpoint.Offset -= int64(n)
+			return false
+		}
+		if err != nil {
+			if err != io.EOF {
+				input.ir.LogError(fmt.Errorf("reading %s: %s", f.path, err))
+			}
+			return true
+		}
+	}
+}
+
+// Delivers a record read from a file, returning false if the input is
+// stopping.
+func (input *FileWatchInput) deliver(f *watchedFile, record []byte) bool {
+	var pack *pipeline.PipelinePack
+	select {
+	case pack = <-input.ir.InChan():
+	case <-input.stopChan:
+		return false
+	}
+	pack.Message.SetUuid(uuid.NewRandom())
+	pack.Message.SetTimestamp(time.Now().UnixNano())
+	pack.Message.SetType("logfile")
+	pack.Message.SetHostname(input.hostname)
+	pack.Message.SetLogger(input.name)
+	pack.Message.SetPayload(string(record))
+	message.NewStringField(pack.Message, "FilePath", f.path)
+	input.ir.Deliver(pack)
+	atomic.AddInt64(&input.recordsRead, 1)
+	return true
+}
+
+// Reads every file, returning false if the input is stopping.
+func (input *FileWatchInput) readAll() bool {
+	for _, f := range input.files {
+		if !input.read(f) {
+			return false
+		}
+	}
+	return true
+}
+
+// Reads the rotated files, closing those rotated more than rotate_wait ago,
+// returning false if the input is stopping.
+func (input *FileWatchInput) expireRotated(now time.Time) bool {
+	rotated := input.rotated[:0]
+	for _, f := range input.rotated {
+		if !input.read(f) {
+			return false
+		}
+		if now.Sub(f.rotatedAt) >= input.rotateWait {
+			f.fd.Close()
+			// The multiline record being assembled won't get more lines.
+			if m, ok := f.parser.(*pipeline.MultilineParser); ok {
+				if record := m.GetRemainingData(); len(record) > 0 &&
+					!input.deliver(f, record) {
+
+					return false
+				}
+			}
+			continue
+		}
+		rotated = append(rotated, f)
+	}
+	input.rotated = rotated
+	return true
+}
+
+// Saves the positions of the files if they changed. The checkpoint file is
+// replaced by renaming a new one over it, so it's either fully updated or
+// not at all.
+func (input *FileWatchInput) saveCheckpoints() {
+	if !input.dirty {
+		return
+	}
+	if err := writeFileAtomic(input.conf.CheckpointFile, input.checkpoints); err != nil {
+		input.ir.LogError(fmt.Errorf("saving checkpoints: %s", err))
+		return
+	}
+	input.dirty = false
+}
+
+func writeFileAtomic(path string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(data); err == nil {
+		err = f.Sync()
+	}
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (input *FileWatchInput) ReportMsg(msg *message.Message) error {
+	message.NewInt64Field(msg, "FilesWatched",
+		atomic.LoadInt64(&input.filesWatched), "count")
+	message.NewInt64Field(msg, "FilesRotated",
+		atomic.LoadInt64(&input.filesRotated), "count")
+	message.NewInt64Field(msg, "RecordsRead",
+		atomic.LoadInt64(&input.recordsRead), "count")
+	return nil
+}
+
+func init() {
+	pipeline.RegisterPlugin("FileWatchInput", func() interface{} {
+		return new(FileWatchInput)
+	})
+}
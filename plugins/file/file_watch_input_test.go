@@ -0,0 +1,169 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package file
+
+import (
+	"encoding/json"
+	. "github.com/mozilla-services/heka/pipeline"
+	pipeline_ts "github.com/mozilla-services/heka/pipeline/testsupport"
+	"github.com/mozilla-services/heka/pipelinemock"
+	"github.com/rafrombrc/gomock/gomock"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+func FileWatchInputSpec(c gs.Context) {
+	t := new(pipeline_ts.SimpleT)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	dir, err := ioutil.TempDir("", "filewatchinput-test")
+	c.Assume(err, gs.IsNil)
+	defer os.RemoveAll(dir)
+	c.Assume(os.MkdirAll(filepath.Join(dir, "logs", "a"), 0755), gs.IsNil)
+	checkpointFile := filepath.Join(dir, "checkpoints.json")
+	pConfig := NewPipelineConfig(nil)
+
+	appendTo := func(path, data string) {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		c.Assume(err, gs.IsNil)
+		_, err = f.WriteString(data)
+		c.Assume(err, gs.IsNil)
+		f.Close()
+	}
+
+	type record struct {
+		payload, path string
+	}
+
+	// Starts an input, returning it, the records it delivers, and the
+	// result of its Run.
+	start := func(setup func(*FileWatchInputConfig)) (*FileWatchInput, chan record,
+		chan error) {
+
+		input := new(FileWatchInput)
+		input.SetName("FileWatchInput")
+		input.SetPipelineConfig(pConfig)
+		config := input.ConfigStruct().(*FileWatchInputConfig)
+		config.Globs = []string{filepath.Join(dir, "logs", "*", "*.log")}
+		config.CheckpointFile = checkpointFile
+		config.CheckpointInterval = "50ms"
+		config.RotateWait = "200ms"
+		setup(config)
+		c.Assume(input.Init(config), gs.IsNil)
+
+		ir := pipelinemock.NewMockInputRunner(ctrl)
+		packSupply := make(chan *PipelinePack, 1)
+		packSupply <- NewPipelinePack(packSupply)
+		records := make(chan record, 10)
+		ir.EXPECT().InChan().Return(packSupply).AnyTimes()
+		ir.EXPECT().LogError(gomock.Any()).AnyTimes()
+		ir.EXPECT().Deliver(gomock.Any()).Do(func(pack *PipelinePack) {
+			path, _ := pack.Message.GetFieldValue("FilePath")
+			records <- record{pack.Message.GetPayload(), path.(string)}
+			pack.Recycle()
+		}).AnyTimes()
+		errChan := make(chan error, 1)
+		go func() {
+			errChan <- input.Run(ir, nil)
+		}()
+		// Lets the input watch the directories.
+		time.Sleep(100 * time.Millisecond)
+		return input, records, errChan
+	}
+
+	next := func(records chan record) record {
+		select {
+		case r := <-records:
+			return r
+		case <-time.After(2 * time.Second):
+			return record{}
+		}
+	}
+
+	appLog := filepath.Join(dir, "logs", "a", "app.log")
+	newLog := filepath.Join(dir, "logs", "b", "new.log")
+	appendTo(appLog, "old\n")
+
+	c.Specify("A FileWatchInput", func() {
+		input, records, errChan := start(func(*FileWatchInputConfig) {})
+
+		c.Specify("reads appended, new, and rotated files", func() {
+			// Existing files are read from the end.
+			appendTo(appLog, "one\n")
+			c.Expect(next(records), gs.Equals, record{"one\n", appLog})
+
+			c.Assume(os.MkdirAll(filepath.Dir(newLog), 0755), gs.IsNil)
+			appendTo(newLog, "two\n")
+			c.Expect(next(records), gs.Equals, record{"two\n", newLog})
+
+			// The rotated file is read until rotate_wait is over.
+			c.Assume(os.Rename(appLog, appLog+".1"), gs.IsNil)
+			appendTo(appLog+".1", "late\n")
+			appendTo(appLog, "three\n")
+			read := map[record]bool{next(records): true, next(records): true}
+			c.Expect(read[record{"late\n", appLog}], gs.IsTrue)
+			c.Expect(read[record{"three\n", appLog}], gs.IsTrue)
+
+			// Partial records wait for their delimiter.
+			appendTo(newLog, "par")
+			time.Sleep(100 * time.Millisecond)
+			appendTo(newLog, "tial\n")
+			c.Expect(next(records), gs.Equals, record{"partial\n", newLog})
+
+			// Truncated files are read from the start.
+			c.Assume(os.Truncate(newLog, 0), gs.IsNil)
+			appendTo(newLog, "x\n")
+			c.Expect(next(records), gs.Equals, record{"x\n", newLog})
+
+			time.Sleep(300 * time.Millisecond)
+			input.Stop()
+			c.Expect(<-errChan, gs.IsNil)
+
+			var checkpoints map[string]*fileCheckpoint
+			data, err := ioutil.ReadFile(checkpointFile)
+			c.Assume(err, gs.IsNil)
+			c.Assume(json.Unmarshal(data, &checkpoints), gs.IsNil)
+			c.Expect(len(checkpoints), gs.Equals, 2)
+			c.Expect(checkpoints[appLog].Offset, gs.Equals, int64(6))
+			c.Expect(checkpoints[newLog].Offset, gs.Equals, int64(2))
+
+			c.Specify("and resumes from its checkpoints", func() {
+				appendTo(newLog, "four\n")
+				input, records, errChan = start(func(config *FileWatchInputConfig) {
+					config.StartPosition = "beginning"
+				})
+				c.Expect(next(records), gs.Equals, record{"four\n", newLog})
+				select {
+				case r := <-records:
+					c.Expect(r.payload, gs.Equals, "")
+				case <-time.After(300 * time.Millisecond):
+				}
+				input.Stop()
+				c.Expect(<-errChan, gs.IsNil)
+			})
+		})
+	})
+
+	c.Specify("Directories are watched for new matches", func() {
+		c.Assume(os.MkdirAll(filepath.Join(dir, "logs", "a", "x"), 0755), gs.IsNil)
+		dirs := globDirs(filepath.Join(dir, "logs", "*", "x", "*.log"))
+		c.Expect(len(dirs), gs.Equals, 3)
+		c.Expect(dirs[0], gs.Equals, filepath.Join(dir, "logs"))
+		c.Expect(dirs[1], gs.Equals, filepath.Join(dir, "logs", "a"))
+		c.Expect(dirs[2], gs.Equals, filepath.Join(dir, "logs", "a", "x"))
+		c.Expect(globDirs("/var/log/*.log")[0], gs.Equals, "/var/log")
+	})
+}
@@ -0,0 +1,447 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package file
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+	. "github.com/mozilla-services/heka/pipeline"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Name of the manifest file in each partition directory. Batch loaders such
+// as Hive, Spark, and Athena skip files starting with an underscore or a dot,
+// as they do the temp files parts are written to.
+const jsonlManifestName = "_manifest.json"
+
+// Output writing messages as JSON Lines to files in partition directories,
+// e.g. "dt=2015-03-15", and listing each file in the partition's manifest
+// once it's complete, so batch loaders only ever read complete files.
+type JsonLinesOutput struct {
+	recordsWritten int64
+	filesCommitted int64
+	writeErrors    int64
+
+	conf       *JsonLinesOutputConfig
+	partition  *DestinationTemplate
+	perm       os.FileMode
+	folderPerm os.FileMode
+	rollAfter  time.Duration
+	fsyncDir   bool
+	// Files being written, by partition.
+	parts         map[string]*jsonlPart
+	lastCommitted int64
+	// Swapped out in tests.
+	now func() time.Time
+}
+
+type JsonLinesOutputConfig struct {
+	// Root directory of the partitions.
+	Path string
+	// Partition directory of each message, relative to the path. May
+	// reference message headers, fields, and time formats, which are
+	// rendered with the message timestamp. Defaults to "dt=%{2006-01-02}".
+	Partition string
+	// Maximum number of distinct header and field value combinations used to
+	// render partitions (default 0, i.e. unlimited).
+	MaxPartitions uint `toml:"max_partitions"`
+	// Partition of the messages that would exceed `max_partitions` or that
+	// are missing a value the partition references.
+	FallbackPartition string `toml:"fallback_partition"`
+	// "gzip" (the default) or "none".
+	Compression string
+	// Records after which a file is committed (default 1000000).
+	MaxFileRecords int64 `toml:"max_file_records"`
+	// Uncompressed bytes after which a file is committed (default 128MiB).
+	MaxFileSize int64 `toml:"max_file_size"`
+	// Seconds after which a file is committed, however small (default 300).
+	RollInterval uint `toml:"roll_interval"`
+	// Seconds between checks for files to commit.
+	TickerInterval uint `toml:"ticker_interval"`
+	// File and directory permissions (default "644" and "700").
+	Perm       string
+	FolderPerm string `toml:"folder_perm"`
+}
+
+// A file being written to a partition.
+type jsonlPart struct {
+	dir     string
+	tmpName string
+	file    *os.File
+	gz      *gzip.Writer
+	w       io.Writer // Where records are written, gz or out.
+	out     *countingWriter
+	opened  time.Time
+	size    int64 // Uncompressed.
+	records int64
+	minTs   int64
+	maxTs   int64
+}
+
+// Writes to a file, hashing and counting what's written.
+type countingWriter struct {
+	w     io.Writer
+	hash  hash.Hash
+	count int64
+}
+
+func (c *countingWriter) Write(p []byte) (n int, err error) {
+	n, err = c.w.Write(p)
+	c.hash.Write(p[:n])
+	c.count += int64(n)
+	return
+}
+
+// A complete file listed in a partition's manifest.
+type jsonlManifestEntry struct {
+	File         string `json:"file"`
+	Records      int64  `json:"records"`
+	Bytes        int64  `json:"bytes"`
+	MinTimestamp string `json:"min_timestamp"`
+	MaxTimestamp string `json:"max_timestamp"`
+	SHA256       string `json:"sha256"`
+}
+
+type jsonlManifest struct {
+	Records int64                `json:"records"`
+	Files   []jsonlManifestEntry `json:"files"`
+}
+
+func (o *JsonLinesOutput) ConfigStruct() interface{} {
+	return &JsonLinesOutputConfig{
+		Partition:      "dt=%{2006-01-02}",
+		Compression:    "gzip",
+		MaxFileRecords: 1000000,
+		MaxFileSize:    128 * 1024 * 1024,
+		RollInterval:   300,
+		TickerInterval: 10,
+		Perm:           "644",
+		FolderPerm:     "700",
+	}
+}
+
+func (o *JsonLinesOutput) Init(config interface{}) (err error) {
+	o.conf = config.(*JsonLinesOutputConfig)
+	if o.conf.Path == "" {
+		return errors.New("path must be specified")
+	}
+	switch o.conf.Compression {
+	case "gzip", "none":
+	default:
+		return fmt.Errorf("invalid compression: %s", o.conf.Compression)
+	}
+	if o.conf.MaxFileRecords < 1 || o.conf.MaxFileSize < 1 {
+		return errors.New("max_file_records and max_file_size must be greater than 0")
+	}
+	var intPerm int64
+	if intPerm, err = strconv.ParseInt(o.conf.Perm, 8, 32); err != nil {
+		return fmt.Errorf("can't parse `perm`, is it an octal integer string?")
+	}
+	o.perm = os.FileMode(intPerm)
+	if intPerm, err = strconv.ParseInt(o.conf.FolderPerm, 8, 32); err != nil {
+		return fmt.Errorf("can't parse `folder_perm`, is it an octal integer string?")
+	}
+	o.folderPerm = os.FileMode(intPerm)
+	o.partition, err = NewDestinationTemplate(DestinationTemplateConfig{
+		Template:            o.conf.Partition,
+		MaxCardinality:      o.conf.MaxPartitions,
+		Fallback:            o.conf.FallbackPartition,
+		UseMessageTimestamp: true,
+		Sanitize:            sanitizePathValue,
+	})
+	if err != nil {
+		return fmt.Errorf("invalid partition: %s", err)
+	}
+	o.rollAfter = time.Duration(o.conf.RollInterval) * time.Second
+	// Directories can't be synced on Windows.
+	o.fsyncDir = runtime.GOOS != "windows"
+	o.parts = make(map[string]*jsonlPart)
+	if o.now == nil {
+		o.now = time.Now
+	}
+	return nil
+}
+
+func (o *JsonLinesOutput) Run(or OutputRunner, h PluginHelper) (err error) {
+	if or.Encoder() == nil {
+		return errors.New("Encoder required.")
+	}
+	inChan := or.InChan()
+	ticker := or.Ticker()
+	ok := true
+	var pack *PipelinePack
+	for ok {
+		select {
+		case pack, ok = <-inChan:
+			if !ok {
+				break
+			}
+			o.write(or, pack)
+			pack.Recycle()
+		case <-ticker:
+			o.commitOld(or)
+		}
+	}
+	for partition := range o.parts {
+		o.commit(or, partition)
+	}
+	return nil
+}
+
+// Appends a message's record to its partition's file.
+func (o *JsonLinesOutput) write(or OutputRunner, pack *PipelinePack) {
+	partition, err := o.partition.Destination(pack.Message)
+	if err != nil {
+		or.LogError(err)
+		return
+	}
+	record, err := or.Encode(pack)
+	if err != nil {
+		or.LogError(err)
+		return
+	}
+	if record == nil {
+		return
+	}
+	if len(record) == 0 || record[len(record)-1] != '\n' {
+		record = append(record, '\n')
+	}
+	if bytes.IndexByte(record, '\n') != len(record)-1 {
+		or.LogError(errors.New("dropping record spanning several lines, " +
+			"the encoder must write single line JSON"))
+		return
+	}
+
+	part, ok := o.parts[partition]
+	if !ok {
+		if part, err = o.open(partition); err != nil {
+			atomic.AddInt64(&o.writeErrors, 1)
+			or.LogError(fmt.Errorf("can't create a file in partition %s: %s",
+				partition, err))
+			return
+		}
+		o.parts[partition] = part
+	}
+	if _, err = part.w.Write(record); err != nil {
+		atomic.AddInt64(&o.writeErrors, 1)
+		or.LogError(fmt.Errorf("can't write to %s, discarding its %d records: %s",
+			part.tmpName, part.records, err))
+		o.discard(partition)
+		return
+	}
+	ts := pack.Message.GetTimestamp()
+	if part.records == 0 || ts < part.minTs {
+		part.minTs = ts
+	}
+	if part.records == 0 || ts > part.maxTs {
+		part.maxTs = ts
+	}
+	part.records++
+	part.size += int64(len(record))
+	atomic.AddInt64(&o.recordsWritten, 1)
+	if part.records >= o.conf.MaxFileRecords || part.size >= o.conf.MaxFileSize {
+		o.commit(or, partition)
+	}
+}
+
+// Creates a temp file to write a partition's records to.
+func (o *JsonLinesOutput) open(partition string) (part *jsonlPart, err error) {
+	dir := filepath.Join(o.conf.Path, partition)
+	if err = os.MkdirAll(dir, o.folderPerm); err != nil {
+		return
+	}
+	file, err := ioutil.TempFile(dir, ".part")
+	if err != nil {
+		return
+	}
+	if err = file.Chmod(o.perm); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return
+	}
+	part = &jsonlPart{
+		dir:     dir,
+		tmpName: file.Name(),
+		file:    file,
+		out:     &countingWriter{w: file, hash: sha256.New()},
+		opened:  o.now(),
+	}
+	part.w = part.out
+	if o.conf.Compression == "gzip" {
+		part.gz = gzip.NewWriter(part.out)
+		part.w = part.gz
+	}
+	return part, nil
+}
+
+// Gives up on a partition's file.
+func (o *JsonLinesOutput) discard(partition string) {
+	part := o.parts[partition]
+	part.file.Close()
+	os.Remove(part.tmpName)
+	delete(o.parts, partition)
+}
+
+// Commits the files that have been open for longer than the roll interval.
+func (o *JsonLinesOutput) commitOld(or OutputRunner) {
+	now := o.now()
+	for partition, part := range o.parts {
+		if now.Sub(part.opened) >= o.rollAfter {
+			o.commit(or, partition)
+		}
+	}
+}
+
+// Completes a partition's file, renames it into place, and adds it to the
+// partition's manifest, which is replaced atomically. A file is only
+// complete once it's in the manifest: if the manifest can't be written the
+// file is removed and its records are lost.
+func (o *JsonLinesOutput) commit(or OutputRunner, partition string) {
+	part := o.parts[partition]
+	delete(o.parts, partition)
+	err := o.completePart(part)
+	if err != nil {
+		os.Remove(part.tmpName)
+		atomic.AddInt64(&o.writeErrors, 1)
+		or.LogError(fmt.Errorf("can't complete %s, discarding its %d records: %s",
+			part.tmpName, part.records, err))
+		return
+	}
+	name := o.committedName()
+	path := filepath.Join(part.dir, name)
+	if err = os.Rename(part.tmpName, path); err == nil {
+		err = o.addToManifest(part, name)
+		if err != nil {
+			os.Remove(path)
+		}
+	}
+	if err != nil {
+		os.Remove(part.tmpName)
+		atomic.AddInt64(&o.writeErrors, 1)
+		or.LogError(fmt.Errorf("can't commit %s, discarding its %d records: %s", path,
+			part.records, err))
+		return
+	}
+	atomic.AddInt64(&o.filesCommitted, 1)
+}
+
+// Flushes and closes a file.
+func (o *JsonLinesOutput) completePart(part *jsonlPart) (err error) {
+	if part.gz != nil {
+		if err = part.gz.Close(); err != nil {
+			part.file.Close()
+			return
+		}
+	}
+	if err = part.file.Sync(); err != nil {
+		part.file.Close()
+		return
+	}
+	return part.file.Close()
+}
+
+// Returns a new, unique name for a committed file, which sorts in the order
+// the files were committed.
+func (o *JsonLinesOutput) committedName() string {
+	stamp := o.now().UnixNano()
+	if stamp <= o.lastCommitted {
+		stamp = o.lastCommitted + 1
+	}
+	o.lastCommitted = stamp
+	ext := ".jsonl"
+	if o.conf.Compression == "gzip" {
+		ext += ".gz"
+	}
+	return fmt.Sprintf("part-%d%s", stamp, ext)
+}
+
+func formatTimestamp(ts int64) string {
+	return time.Unix(0, ts).UTC().Format(time.RFC3339Nano)
+}
+
+// Rewrites a partition's manifest with a new file added.
+func (o *JsonLinesOutput) addToManifest(part *jsonlPart, name string) (err error) {
+	path := filepath.Join(part.dir, jsonlManifestName)
+	manifest := new(jsonlManifest)
+	data, err := ioutil.ReadFile(path)
+	if err == nil {
+		if err = json.Unmarshal(data, manifest); err != nil {
+			return fmt.Errorf("corrupt manifest %s: %s", path, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return
+	}
+	manifest.Files = append(manifest.Files, jsonlManifestEntry{
+		File:         name,
+		Records:      part.records,
+		Bytes:        part.out.count,
+		MinTimestamp: formatTimestamp(part.minTs),
+		MaxTimestamp: formatTimestamp(part.maxTs),
+		SHA256:       hex.EncodeToString(part.out.hash.Sum(nil)),
+	})
+	manifest.Records += part.records
+	if data, err = json.MarshalIndent(manifest, "", "  "); err != nil {
+		return
+	}
+	tmpPath := filepath.Join(part.dir, "."+jsonlManifestName+".tmp")
+	file, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, o.perm)
+	if err != nil {
+		return
+	}
+	if _, err = file.Write(data); err == nil {
+		err = file.Sync()
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return
+	}
+	if o.fsyncDir {
+		err = syncDir(part.dir)
+	}
+	return
+}
+
+func (o *JsonLinesOutput) ReportMsg(msg *message.Message) error {
+	message.NewInt64Field(msg, "RecordsWritten", atomic.LoadInt64(&o.recordsWritten),
+		"count")
+	message.NewInt64Field(msg, "FilesCommitted", atomic.LoadInt64(&o.filesCommitted),
+		"count")
+	message.NewInt64Field(msg, "WriteErrors", atomic.LoadInt64(&o.writeErrors), "count")
+	o.partition.ReportMsg(msg, "Partition")
+	return nil
+}
+
+func init() {
+	RegisterPlugin("JsonLinesOutput", func() interface{} {
+		return new(JsonLinesOutput)
+	})
+}
@@ -0,0 +1,152 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package file
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+	. "github.com/mozilla-services/heka/pipeline"
+	pipeline_ts "github.com/mozilla-services/heka/pipeline/testsupport"
+	plugins_ts "github.com/mozilla-services/heka/plugins/testsupport"
+	"github.com/rafrombrc/gomock/gomock"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+func JsonLinesOutputSpec(c gs.Context) {
+	t := new(pipeline_ts.SimpleT)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	tmpDir, err := ioutil.TempDir("", "jsonl-output-tests")
+	c.Assume(err, gs.IsNil)
+	defer os.RemoveAll(tmpDir)
+
+	oth := plugins_ts.NewOutputTestHelper(ctrl)
+	now := time.Date(2015, time.March, 15, 12, 0, 0, 0, time.UTC)
+
+	c.Specify("A JsonLinesOutput", func() {
+		output := &JsonLinesOutput{now: func() time.Time { return now }}
+		config := output.ConfigStruct().(*JsonLinesOutputConfig)
+		config.Path = tmpDir
+		config.Partition = "%{Type}/dt=%{2006-01-02}"
+		config.MaxFileRecords = 2
+
+		// Writes a message of the type and day, encoded as its payload.
+		write := func(msgType string, day int, payload string) {
+			pack := NewPipelinePack(nil)
+			pack.Message = message.CopyMessage(pipeline_ts.GetTestMessage())
+			pack.Message.SetType(msgType)
+			pack.Message.SetTimestamp(time.Date(2015, time.March, day, 1, 2, 3, 0,
+				time.UTC).UnixNano())
+			oth.MockOutputRunner.EXPECT().Encode(pack).Return([]byte(payload), nil)
+			output.write(oth.MockOutputRunner, pack)
+		}
+		readManifest := func(partition string) *jsonlManifest {
+			data, err := ioutil.ReadFile(filepath.Join(tmpDir, partition,
+				jsonlManifestName))
+			c.Assume(err, gs.IsNil)
+			manifest := new(jsonlManifest)
+			c.Assume(json.Unmarshal(data, manifest), gs.IsNil)
+			return manifest
+		}
+
+		c.Specify("commits full files to their partition's manifest", func() {
+			c.Assume(output.Init(config), gs.IsNil)
+			write("web", 14, `{"n":1}`)
+			write("web", 15, `{"n":2}`+"\n")
+			write("web", 14, `{"n":3}`)
+			write("web", 14, `{"n":4}`)
+			c.Expect(len(output.parts), gs.Equals, 1)
+
+			manifest := readManifest("web/dt=2015-03-14")
+			c.Expect(manifest.Records, gs.Equals, int64(2))
+			c.Expect(len(manifest.Files), gs.Equals, 1)
+			entry := manifest.Files[0]
+			c.Expect(entry.Records, gs.Equals, int64(2))
+			c.Expect(entry.MinTimestamp, gs.Equals, "2015-03-14T01:02:03Z")
+			c.Expect(strings.HasSuffix(entry.File, ".jsonl.gz"), gs.IsTrue)
+
+			path := filepath.Join(tmpDir, "web/dt=2015-03-14", entry.File)
+			data, err := ioutil.ReadFile(path)
+			c.Assume(err, gs.IsNil)
+			sum := sha256.Sum256(data)
+			c.Expect(entry.SHA256, gs.Equals, hex.EncodeToString(sum[:]))
+			c.Expect(entry.Bytes, gs.Equals, int64(len(data)))
+			file, err := os.Open(path)
+			c.Assume(err, gs.IsNil)
+			defer file.Close()
+			gz, err := gzip.NewReader(file)
+			c.Assume(err, gs.IsNil)
+			records, err := ioutil.ReadAll(gz)
+			c.Assume(err, gs.IsNil)
+			c.Expect(string(records), gs.Equals, "{\"n\":1}\n{\"n\":3}\n")
+
+			// The other partition's file is committed once it's old enough.
+			output.commitOld(oth.MockOutputRunner)
+			c.Expect(len(output.parts), gs.Equals, 1)
+			now = now.Add(time.Duration(config.RollInterval) * time.Second)
+			output.commitOld(oth.MockOutputRunner)
+			c.Expect(len(output.parts), gs.Equals, 0)
+			manifest = readManifest("web/dt=2015-03-15")
+			c.Expect(len(manifest.Files), gs.Equals, 1)
+			c.Expect(manifest.Files[0].MaxTimestamp, gs.Equals, "2015-03-15T01:02:03Z")
+
+			// Later files are added to the manifest.
+			write("web", 14, `{"n":5}`)
+			output.commit(oth.MockOutputRunner, "web/dt=2015-03-14")
+			manifest = readManifest("web/dt=2015-03-14")
+			c.Expect(manifest.Records, gs.Equals, int64(3))
+			c.Expect(len(manifest.Files), gs.Equals, 2)
+			c.Expect(manifest.Files[0].File < manifest.Files[1].File, gs.IsTrue)
+
+			// No temp files are left behind.
+			matches, _ := filepath.Glob(filepath.Join(tmpDir, "web", "*", ".part*"))
+			c.Expect(len(matches), gs.Equals, 0)
+		})
+
+		c.Specify("writes uncompressed files", func() {
+			config.Compression = "none"
+			config.Partition = "all"
+			c.Assume(output.Init(config), gs.IsNil)
+			write("web", 14, `{"n":1}`)
+			write("web", 14, `{"n":2}`)
+			manifest := readManifest("all")
+			data, err := ioutil.ReadFile(filepath.Join(tmpDir, "all",
+				manifest.Files[0].File))
+			c.Assume(err, gs.IsNil)
+			c.Expect(string(data), gs.Equals, "{\"n\":1}\n{\"n\":2}\n")
+		})
+
+		c.Specify("drops records spanning several lines", func() {
+			c.Assume(output.Init(config), gs.IsNil)
+			oth.MockOutputRunner.EXPECT().LogError(gomock.Any())
+			write("web", 14, "{\n\"n\":1}")
+			c.Expect(len(output.parts), gs.Equals, 0)
+		})
+
+		c.Specify("rejects invalid settings", func() {
+			config.Compression = "lz4"
+			err := output.Init(config)
+			c.Expect(err.Error(), gs.Equals, fmt.Sprintf("invalid compression: %s",
+				config.Compression))
+		})
+	})
+}
@@ -0,0 +1,146 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package file
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+	"time"
+)
+
+const groupTimeFormat = "2006-01-02T15:04:05.000Z"
+
+// Collects the encoded output of related messages, i.e. those with the same
+// value of a correlation field arriving within a time window, so FileOutput
+// can write them as a single indented block.
+type messageGrouper struct {
+	field       string
+	window      time.Duration
+	maxMessages uint
+	indent      []byte
+	groups      map[string]*messageGroup
+	// Group values in the order the groups were started.
+	order []string
+	// Swapped out in tests.
+	now func() time.Time
+}
+
+type messageGroup struct {
+	started time.Time
+	first   int64 // Earliest message timestamp.
+	last    int64 // Latest message timestamp.
+	count   uint
+	body    bytes.Buffer
+}
+
+func newMessageGrouper(field string, window time.Duration, maxMessages uint,
+	indent string) *messageGrouper {
+
+	return &messageGrouper{
+		field:       field,
+		window:      window,
+		maxMessages: maxMessages,
+		indent:      []byte(indent),
+		groups:      make(map[string]*messageGroup),
+		now:         time.Now,
+	}
+}
+
+// Adds a message's output to its group, returning false if the message
+// doesn't have the correlation field, in which case the output should be
+// written as is. Returns the rendered group if it's now full.
+func (g *messageGrouper) add(msg *message.Message, output []byte) (
+	rendered []byte, ok bool) {
+
+	value, ok := msg.GetFieldValue(g.field)
+	if !ok {
+		return nil, false
+	}
+	key := fmt.Sprint(value)
+	ts := msg.GetTimestamp()
+	group, exists := g.groups[key]
+	if !exists {
+		group = &messageGroup{started: g.now(), first: ts, last: ts}
+		g.groups[key] = group
+		g.order = append(g.order, key)
+	}
+	if ts < group.first {
+		group.first = ts
+	}
+	if ts > group.last {
+		group.last = ts
+	}
+	group.count++
+	g.writeIndented(&group.body, output)
+	if g.maxMessages > 0 && group.count >= g.maxMessages {
+		rendered = g.render(key, group)
+		delete(g.groups, key)
+		g.removeFromOrder(key)
+	}
+	return rendered, true
+}
+
+// Renders and removes the groups whose window has elapsed, or every group if
+// `all` is true, e.g. on shutdown. Groups are rendered in the order they were
+// started.
+func (g *messageGrouper) expired(all bool) (rendered []byte, count int) {
+	now := g.now()
+	kept := g.order[:0]
+	for _, key := range g.order {
+		group := g.groups[key]
+		if !all && now.Sub(group.started) < g.window {
+			kept = append(kept, key)
+			continue
+		}
+		rendered = append(rendered, g.render(key, group)...)
+		delete(g.groups, key)
+		count++
+	}
+	g.order = kept
+	return
+}
+
+func (g *messageGrouper) removeFromOrder(key string) {
+	for i, k := range g.order {
+		if k == key {
+			g.order = append(g.order[:i], g.order[i+1:]...)
+			return
+		}
+	}
+}
+
+// Renders a group as a header line naming the correlation value, the number
+// of messages, and their time span, followed by the indented output of each
+// message and a blank line.
+func (g *messageGrouper) render(key string, group *messageGroup) []byte {
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "--- %s=%s (%d messages, %s .. %s)\n", g.field, key, group.count,
+		time.Unix(0, group.first).UTC().Format(groupTimeFormat),
+		time.Unix(0, group.last).UTC().Format(groupTimeFormat))
+	buf.Write(group.body.Bytes())
+	buf.WriteByte('\n')
+	return buf.Bytes()
+}
+
+// Writes each line of a message's output prefixed with the indent, making
+// sure the last one ends with a newline.
+func (g *messageGrouper) writeIndented(buf *bytes.Buffer, output []byte) {
+	output = bytes.TrimRight(output, "\n")
+	for _, line := range bytes.Split(output, []byte("\n")) {
+		if len(line) > 0 {
+			buf.Write(g.indent)
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+}
@@ -26,6 +26,7 @@ func TestAllSpecs(t *testing.T) {
 	r.AddSpec(CarbonOutputSpec)
 	r.AddSpec(WhisperOutputSpec)
 	r.AddSpec(WhisperRunnerSpec)
+	r.AddSpec(GraphiteOutputSpec)
 
 	gospec.MainGoTest(r, t)
 }
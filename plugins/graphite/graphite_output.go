@@ -0,0 +1,361 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package graphite
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+	. "github.com/mozilla-services/heka/pipeline"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+type GraphiteOutputConfig struct {
+	// Addresses of the carbon relays, in order of preference.
+	Servers []string
+	// "pickle" or "plaintext".
+	Protocol string
+	// Milliseconds after which accumulated metrics are sent even if the batch
+	// isn't full.
+	FlushInterval uint32 `toml:"flush_interval"`
+	// Number of metrics that triggers a send.
+	FlushCount int `toml:"flush_count"`
+	// Milliseconds to wait for a connection to be established, or for a
+	// batch to be written, 0 for no timeout.
+	ConnectTimeout uint32 `toml:"connect_timeout"`
+	WriteTimeout   uint32 `toml:"write_timeout"`
+	// Seconds a relay is skipped for after failing, before it's tried again.
+	FailbackInterval uint32 `toml:"failback_interval"`
+	// Prepended to every metric name.
+	Prefix string
+	// Patterns of the names of counters that are summed over the aggregation
+	// interval rather than sent as they arrive.
+	AggregateCounters []string `toml:"aggregate_counters"`
+	// Seconds over which counters are aggregated.
+	AggregationInterval uint32 `toml:"aggregation_interval"`
+	// Settings used to back off from failed sends.
+	Retries RetryOptions
+}
+
+// Sends the "stat metric" lines carried by messages to carbon relays, in
+// batches using the pickle or plaintext protocol. Relays are used in order of
+// preference, failing over to the next one when a relay fails, and back once
+// a failed relay's failback interval has passed. Counters can be aggregated
+// before they're sent, so only their sum is sent once per interval.
+type GraphiteOutput struct {
+	metricsSent    int64
+	metricsDropped int64
+	malformedLines int64
+	relayFailures  int64
+	activeRelay    int64
+
+	conf        *GraphiteOutputConfig
+	relays      []*graphiteRelay
+	conn        net.Conn
+	connIdx     int
+	retryHelper *RetryHelper
+	pConfig     *PipelineConfig
+	batch       []metric
+	counters    map[string]float64
+	// Swapped out in tests.
+	now func() time.Time
+}
+
+type graphiteRelay struct {
+	address   string
+	downUntil time.Time
+}
+
+func (o *GraphiteOutput) ConfigStruct() interface{} {
+	return &GraphiteOutputConfig{
+		Servers:             []string{"localhost:2004"},
+		Protocol:            "pickle",
+		FlushInterval:       1000,
+		FlushCount:          500,
+		ConnectTimeout:      5000,
+		WriteTimeout:        10000,
+		FailbackInterval:    30,
+		AggregationInterval: 10,
+		Retries: RetryOptions{
+			MaxDelay:   "30s",
+			Delay:      "250ms",
+			MaxRetries: -1,
+		},
+	}
+}
+
+func (o *GraphiteOutput) SetPipelineConfig(pConfig *PipelineConfig) {
+	o.pConfig = pConfig
+}
+
+func (o *GraphiteOutput) Init(config interface{}) (err error) {
+	o.conf = config.(*GraphiteOutputConfig)
+	if len(o.conf.Servers) == 0 {
+		return errors.New("at least one server must be specified")
+	}
+	if o.conf.Protocol != "pickle" && o.conf.Protocol != "plaintext" {
+		return fmt.Errorf(`invalid protocol "%s", must be "pickle" or "plaintext"`,
+			o.conf.Protocol)
+	}
+	if o.conf.FlushCount < 1 {
+		return errors.New("flush_count must be greater than 0")
+	}
+	for _, pattern := range o.conf.AggregateCounters {
+		if _, err = path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid aggregate_counters pattern '%s': %s", pattern, err)
+		}
+	}
+	if len(o.conf.AggregateCounters) > 0 && o.conf.AggregationInterval == 0 {
+		return errors.New("aggregation_interval must be greater than 0")
+	}
+	o.relays = make([]*graphiteRelay, len(o.conf.Servers))
+	for i, address := range o.conf.Servers {
+		o.relays[i] = &graphiteRelay{address: address}
+	}
+	o.connIdx = -1
+	o.activeRelay = -1
+	o.counters = make(map[string]float64)
+	o.now = time.Now
+	if o.retryHelper, err = NewRetryHelper(o.conf.Retries); err != nil {
+		return fmt.Errorf("invalid retries: %s", err)
+	}
+	return
+}
+
+func (o *GraphiteOutput) Run(or OutputRunner, h PluginHelper) (err error) {
+	ticker := time.NewTicker(time.Duration(o.conf.FlushInterval) * time.Millisecond)
+	defer ticker.Stop()
+	var aggregate <-chan time.Time
+	if len(o.conf.AggregateCounters) > 0 {
+		aggTicker := time.NewTicker(time.Duration(o.conf.AggregationInterval) * time.Second)
+		defer aggTicker.Stop()
+		aggregate = aggTicker.C
+	}
+	defer o.disconnect()
+
+	inChan := or.InChan()
+	for {
+		select {
+		case pack, ok := <-inChan:
+			if !ok {
+				o.emitCounters()
+				return o.flush(or)
+			}
+			var payload string
+			if or.Encoder() != nil {
+				encoded, e := or.Encode(pack)
+				if e != nil {
+					or.LogError(fmt.Errorf("can't encode message: %s", e))
+					pack.Recycle()
+					continue
+				}
+				payload = string(encoded)
+			} else {
+				payload = pack.Message.GetPayload()
+			}
+			pack.Recycle()
+			o.addLines(or, payload)
+			if len(o.batch) >= o.conf.FlushCount {
+				if err = o.flush(or); err != nil {
+					return
+				}
+			}
+		case <-ticker.C:
+			if err = o.flush(or); err != nil {
+				return
+			}
+		case <-aggregate:
+			o.emitCounters()
+		}
+	}
+}
+
+// Parses the "<name> <value> <timestamp>" lines of a message, adding them to
+// the batch or to the aggregated counters.
+func (o *GraphiteOutput) addLines(or OutputRunner, payload string) {
+	for _, line := range strings.Split(strings.TrimSpace(payload), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 3 {
+			atomic.AddInt64(&o.malformedLines, 1)
+			or.LogError(fmt.Errorf("malformed statmetric line: '%s'", line))
+			continue
+		}
+		value, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			atomic.AddInt64(&o.malformedLines, 1)
+			or.LogError(fmt.Errorf("parsing value '%s': %s", fields[1], err))
+			continue
+		}
+		timestamp, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			atomic.AddInt64(&o.malformedLines, 1)
+			or.LogError(fmt.Errorf("parsing time: %s", err))
+			continue
+		}
+		name := o.conf.Prefix + fields[0]
+		if o.aggregated(fields[0]) {
+			o.counters[name] += value
+			continue
+		}
+		o.batch = append(o.batch, metric{name, value, timestamp})
+	}
+}
+
+func (o *GraphiteOutput) aggregated(name string) bool {
+	for _, pattern := range o.conf.AggregateCounters {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// Adds the sums of the aggregated counters to the batch, timestamped with the
+// end of the interval, and starts a new interval.
+func (o *GraphiteOutput) emitCounters() {
+	if len(o.counters) == 0 {
+		return
+	}
+	timestamp := o.now().Unix()
+	for name, sum := range o.counters {
+		o.batch = append(o.batch, metric{name, sum, timestamp})
+	}
+	o.counters = make(map[string]float64)
+}
+
+// Sends the accumulated metrics. Returns an error if the output must stop.
+func (o *GraphiteOutput) flush(or OutputRunner) error {
+	batch := o.batch
+	o.batch = nil
+	if len(batch) == 0 {
+		return nil
+	}
+	var data bytes.Buffer
+	if o.conf.Protocol == "pickle" {
+		appendPickle(&data, batch)
+	} else {
+		appendPlaintext(&data, batch)
+	}
+
+	o.retryHelper.Reset()
+	for {
+		err := o.send(or, data.Bytes())
+		if err == nil {
+			atomic.AddInt64(&o.metricsSent, int64(len(batch)))
+			return nil
+		}
+		or.LogError(err)
+		if o.pConfig != nil && o.pConfig.Globals.IsShuttingDown() {
+			break
+		}
+		if o.retryHelper.Wait() != nil {
+			or.LogError(errors.New("retries exhausted"))
+			break
+		}
+	}
+	atomic.AddInt64(&o.metricsDropped, int64(len(batch)))
+	or.LogError(fmt.Errorf("dropping %d metrics", len(batch)))
+	return nil
+}
+
+// Writes data to the most preferred relay available. Relays that failed
+// recently are only tried once all the others have failed too.
+func (o *GraphiteOutput) send(or OutputRunner, data []byte) error {
+	now := o.now()
+	tried := make([]bool, len(o.relays))
+	var lastErr error
+	for _, skipDown := range []bool{true, false} {
+		for i, relay := range o.relays {
+			if tried[i] || (skipDown && now.Before(relay.downUntil)) {
+				continue
+			}
+			tried[i] = true
+			err := o.write(i, data)
+			if err == nil {
+				return nil
+			}
+			lastErr = fmt.Errorf("relay %s failed: %s", relay.address, err)
+			atomic.AddInt64(&o.relayFailures, 1)
+			relay.downUntil = now.Add(time.Duration(o.conf.FailbackInterval) * time.Second)
+			if i < len(o.relays)-1 {
+				or.LogError(lastErr)
+			}
+		}
+	}
+	return lastErr
+}
+
+// Writes data to a relay, connecting first if needed. A connection to a less
+// preferred relay is dropped for it.
+func (o *GraphiteOutput) write(idx int, data []byte) (err error) {
+	if o.conn != nil && o.connIdx != idx {
+		o.disconnect()
+	}
+	if o.conn == nil {
+		timeout := time.Duration(o.conf.ConnectTimeout) * time.Millisecond
+		if o.conn, err = net.DialTimeout("tcp", o.relays[idx].address, timeout); err != nil {
+			o.conn = nil
+			return
+		}
+		o.connIdx = idx
+		atomic.StoreInt64(&o.activeRelay, int64(idx))
+	}
+	if o.conf.WriteTimeout > 0 {
+		o.conn.SetWriteDeadline(time.Now().Add(
+			time.Duration(o.conf.WriteTimeout) * time.Millisecond))
+	}
+	if _, err = o.conn.Write(data); err != nil {
+		o.disconnect()
+	}
+	return
+}
+
+func (o *GraphiteOutput) disconnect() {
+	if o.conn == nil {
+		return
+	}
+	o.conn.Close()
+	o.conn = nil
+	o.connIdx = -1
+	atomic.StoreInt64(&o.activeRelay, -1)
+}
+
+func (o *GraphiteOutput) ReportMsg(msg *message.Message) error {
+	message.NewInt64Field(msg, "MetricsSent", atomic.LoadInt64(&o.metricsSent), "count")
+	message.NewInt64Field(msg, "MetricsDropped", atomic.LoadInt64(&o.metricsDropped),
+		"count")
+	message.NewInt64Field(msg, "MalformedLines", atomic.LoadInt64(&o.malformedLines),
+		"count")
+	message.NewInt64Field(msg, "RelayFailures", atomic.LoadInt64(&o.relayFailures),
+		"count")
+	relay := ""
+	if idx := atomic.LoadInt64(&o.activeRelay); idx >= 0 {
+		relay = o.relays[idx].address
+	}
+	message.NewStringField(msg, "ActiveRelay", relay)
+	return nil
+}
+
+func init() {
+	RegisterPlugin("GraphiteOutput", func() interface{} {
+		return new(GraphiteOutput)
+	})
+}
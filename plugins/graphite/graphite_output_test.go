@@ -0,0 +1,107 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package graphite
+
+import (
+	"bytes"
+	pipeline_ts "github.com/mozilla-services/heka/pipeline/testsupport"
+	. "github.com/mozilla-services/heka/pipelinemock"
+	"github.com/rafrombrc/gomock/gomock"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"io/ioutil"
+	"net"
+	"time"
+)
+
+func GraphiteOutputSpec(c gs.Context) {
+	t := new(pipeline_ts.SimpleT)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	oRunner := NewMockOutputRunner(ctrl)
+	oRunner.EXPECT().LogError(gomock.Any()).AnyTimes()
+
+	output := new(GraphiteOutput)
+	config := output.ConfigStruct().(*GraphiteOutputConfig)
+
+	c.Specify("The pickle protocol", func() {
+		var buf bytes.Buffer
+		appendPickle(&buf, []metric{{"a.b", 1.5, 100}})
+		expected := []byte{0, 0, 0, 30, 0x80, 2, ']', '(',
+			'X', 3, 0, 0, 0, 'a', '.', 'b',
+			'J', 100, 0, 0, 0,
+			'G', 0x3f, 0xf8, 0, 0, 0, 0, 0, 0,
+			0x86, 0x86, 'e', '.'}
+		c.Expect(bytes.Equal(buf.Bytes(), expected), gs.IsTrue)
+
+		buf.Reset()
+		appendPlaintext(&buf, []metric{{"a.b", 1.5, 100}})
+		c.Expect(buf.String(), gs.Equals, "a.b 1.5 100\n")
+	})
+
+	c.Specify("A GraphiteOutput", func() {
+		c.Specify("aggregates counters", func() {
+			config.Prefix = "web."
+			config.AggregateCounters = []string{"stats.counters.*"}
+			c.Assume(output.Init(config), gs.IsNil)
+			output.now = func() time.Time { return time.Unix(200, 0) }
+
+			output.addLines(oRunner, "stats.counters.hits 2 100\n"+
+				"stats.gauges.load 0.5 100\nstats.counters.hits 3 101\nbogus\n")
+			c.Expect(len(output.batch), gs.Equals, 1)
+			c.Expect(output.batch[0].name, gs.Equals, "web.stats.gauges.load")
+			c.Expect(output.malformedLines, gs.Equals, int64(1))
+
+			output.emitCounters()
+			c.Assume(len(output.batch), gs.Equals, 2)
+			c.Expect(output.batch[1], gs.Equals, metric{"web.stats.counters.hits", 5, 200})
+			c.Expect(len(output.counters), gs.Equals, 0)
+		})
+
+		c.Specify("fails over to the next relay", func() {
+			down, err := net.Listen("tcp", "127.0.0.1:0")
+			c.Assume(err, gs.IsNil)
+			down.Close()
+			up, err := net.Listen("tcp", "127.0.0.1:0")
+			c.Assume(err, gs.IsNil)
+			defer up.Close()
+			received := make(chan []byte, 1)
+			go func() {
+				conn, err := up.Accept()
+				if err != nil {
+					return
+				}
+				data, _ := ioutil.ReadAll(conn)
+				received <- data
+			}()
+
+			config.Servers = []string{down.Addr().String(), up.Addr().String()}
+			config.Protocol = "plaintext"
+			c.Assume(output.Init(config), gs.IsNil)
+			c.Expect(output.send(oRunner, []byte("a 1 1\n")), gs.IsNil)
+			c.Expect(output.relayFailures, gs.Equals, int64(1))
+			c.Expect(output.activeRelay, gs.Equals, int64(1))
+
+			// The failed relay isn't tried again until its failback interval
+			// has passed.
+			c.Expect(output.send(oRunner, []byte("b 2 2\n")), gs.IsNil)
+			c.Expect(output.relayFailures, gs.Equals, int64(1))
+			output.disconnect()
+			c.Expect(string(<-received), gs.Equals, "a 1 1\nb 2 2\n")
+
+			up.Close()
+			output.now = func() time.Time { return time.Now().Add(time.Minute) }
+			c.Expect(output.send(oRunner, []byte("c 3 3\n")), gs.Not(gs.IsNil))
+			c.Expect(output.relayFailures, gs.Equals, int64(3))
+		})
+	})
+}
@@ -0,0 +1,87 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package graphite
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"strconv"
+)
+
+// A single data point.
+type metric struct {
+	name      string
+	value     float64
+	timestamp int64
+}
+
+// Pickle opcodes used by carbon's pickle protocol, see the Python pickletools
+// module.
+const (
+	pickleProto      = 0x80
+	pickleEmptyList  = ']'
+	pickleMark       = '('
+	pickleBinUnicode = 'X'
+	pickleBinInt     = 'J'
+	pickleLong1      = 0x8a
+	pickleBinFloat   = 'G'
+	pickleTuple2     = 0x86
+	pickleAppends    = 'e'
+	pickleStop       = '.'
+)
+
+// Appends a batch of metrics in carbon's pickle protocol, i.e. a pickled list
+// of `(name, (timestamp, value))` tuples preceded by its length as a 4 byte
+// big endian integer.
+func appendPickle(buf *bytes.Buffer, metrics []metric) {
+	var body bytes.Buffer
+	var scratch [8]byte
+	body.Write([]byte{pickleProto, 2, pickleEmptyList, pickleMark})
+	for _, m := range metrics {
+		body.WriteByte(pickleBinUnicode)
+		binary.LittleEndian.PutUint32(scratch[:4], uint32(len(m.name)))
+		body.Write(scratch[:4])
+		body.WriteString(m.name)
+		if m.timestamp >= math.MinInt32 && m.timestamp <= math.MaxInt32 {
+			body.WriteByte(pickleBinInt)
+			binary.LittleEndian.PutUint32(scratch[:4], uint32(int32(m.timestamp)))
+			body.Write(scratch[:4])
+		} else {
+			body.Write([]byte{pickleLong1, 8})
+			binary.LittleEndian.PutUint64(scratch[:], uint64(m.timestamp))
+			body.Write(scratch[:])
+		}
+		body.WriteByte(pickleBinFloat)
+		binary.BigEndian.PutUint64(scratch[:], math.Float64bits(m.value))
+		body.Write(scratch[:])
+		body.Write([]byte{pickleTuple2, pickleTuple2})
+	}
+	body.Write([]byte{pickleAppends, pickleStop})
+
+	binary.BigEndian.PutUint32(scratch[:4], uint32(body.Len()))
+	buf.Write(scratch[:4])
+	buf.Write(body.Bytes())
+}
+
+// Appends a batch of metrics in carbon's plaintext protocol, one
+// `<name> <value> <timestamp>` line per metric.
+func appendPlaintext(buf *bytes.Buffer, metrics []metric) {
+	for _, m := range metrics {
+		buf.WriteString(m.name)
+		buf.WriteByte(' ')
+		buf.WriteString(strconv.FormatFloat(m.value, 'f', -1, 64))
+		buf.WriteByte(' ')
+		buf.WriteString(strconv.FormatInt(m.timestamp, 10))
+		buf.WriteByte('\n')
+	}
+}
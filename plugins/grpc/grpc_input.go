@@ -0,0 +1,343 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package grpc
+
+import (
+	"code.google.com/p/gogoprotobuf/proto"
+	"crypto/subtle"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+	"github.com/mozilla-services/heka/pipeline"
+	"github.com/mozilla-services/heka/plugins/tcp"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type GrpcInputConfig struct {
+	// Address the gRPC server listens on.
+	Address string
+	// Maximum size in bytes of a batch of messages.
+	MaxBatchSize uint32 `toml:"max_batch_size"`
+	// Set to true to serve over TLS, requires the `tls` section. Setting its
+	// `client_auth` to "RequireAndVerifyClientCert" authenticates clients
+	// with certificates.
+	UseTls bool `toml:"use_tls"`
+	Tls    tcp.TlsConfig
+	// If set, only clients with a certificate issued to one of these common
+	// names are accepted.
+	ClientNames []string `toml:"client_names"`
+	// If set, clients must send one of these bearer tokens, keyed by client
+	// name.
+	Tokens map[string]string
+	// If set, batches are acknowledged once their messages have reached the
+	// specified point in the pipeline, "router" or "output".
+	DeliveryReport string `toml:"delivery_report"`
+	// Maximum time to wait for delivery reports, in milliseconds.
+	DeliveryTimeout uint32 `toml:"delivery_timeout"`
+}
+
+// Accepts batches of Heka protobuf messages over gRPC, see
+// message_service.proto. Each message's signer is set to the name of the
+// client that sent it, so `message_signer` matchers can select clients.
+type GrpcInput struct {
+	messagesReceived int64
+	invalidMessages  int64
+	batchesReceived  int64
+	callsRejected    int64
+
+	conf          *GrpcInputConfig
+	ir            pipeline.InputRunner
+	useMsgBytes   bool
+	tlsConfig     *tls.Config
+	clientNames   map[string]bool
+	deliveryPoint pipeline.DeliveryPoint
+	server        *grpc.Server
+	listener      net.Listener
+	stopChan      chan struct{}
+	stopOnce      sync.Once
+}
+
+var errStopping = errors.New("input is stopping")
+
+func (input *GrpcInput) ConfigStruct() interface{} {
+	return &GrpcInputConfig{
+		Address:         "127.0.0.1:5566",
+		MaxBatchSize:    4 * 1024 * 1024,
+		Tls:             tcp.TlsConfig{PreferServerCiphers: true},
+		DeliveryTimeout: 10000,
+	}
+}
+
+func (input *GrpcInput) Init(config interface{}) (err error) {
+	input.conf = config.(*GrpcInputConfig)
+	if input.conf.UseTls {
+		if input.tlsConfig, err = tcp.CreateGoTlsConfig(&input.conf.Tls); err != nil {
+			return fmt.Errorf("TLS init error: %s", err)
+		}
+	}
+	if len(input.conf.ClientNames) > 0 {
+		if input.tlsConfig == nil || input.tlsConfig.ClientAuth != tls.RequireAndVerifyClientCert {
+			return errors.New(
+				"client_names requires use_tls and a client_auth of RequireAndVerifyClientCert")
+		}
+		input.clientNames = make(map[string]bool, len(input.conf.ClientNames))
+		for _, name := range input.conf.ClientNames {
+			input.clientNames[name] = true
+		}
+	}
+	for name, token := range input.conf.Tokens {
+		if token == "" {
+			return fmt.Errorf("empty token for client '%s'", name)
+		}
+	}
+	input.deliveryPoint = 0
+	if input.conf.DeliveryReport != "" {
+		if input.deliveryPoint, err = pipeline.ParseDeliveryPoint(input.conf.DeliveryReport); err != nil {
+			return fmt.Errorf("invalid delivery_report: %s", input.conf.DeliveryReport)
+		}
+	}
+	input.stopChan = make(chan struct{})
+	return
+}
+
+func (input *GrpcInput) Run(ir pipeline.InputRunner, h pipeline.PluginHelper) error {
+	listener, err := net.Listen("tcp", input.conf.Address)
+	if err != nil {
+		return fmt.Errorf("can't listen on %s: %s", input.conf.Address, err)
+	}
+	input.ir = ir
+	input.useMsgBytes = ir.UseMsgBytes()
+	return input.serve(listener)
+}
+
+// Serves calls on the listener until the input is stopped.
+func (input *GrpcInput) serve(listener net.Listener) error {
+	input.listener = listener
+	options := []grpc.ServerOption{grpc.ForceServerCodec(codec{}),
+		grpc.MaxRecvMsgSize(int(input.conf.MaxBatchSize))}
+	if input.tlsConfig != nil {
+		options = append(options, grpc.Creds(credentials.NewTLS(input.tlsConfig)))
+	}
+	input.server = grpc.NewServer(options...)
+	input.server.RegisterService(&serviceDesc, input)
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- input.server.Serve(listener)
+	}()
+
+	select {
+	case err := <-errChan:
+		select {
+		case <-input.stopChan:
+			return nil
+		default:
+		}
+		input.Stop()
+		return fmt.Errorf("server failed: %s", err)
+	case <-input.stopChan:
+	}
+	return nil
+}
+
+func (input *GrpcInput) Stop() {
+	input.stopOnce.Do(func() {
+		close(input.stopChan)
+		if input.server != nil {
+			input.server.Stop()
+		} else if input.listener != nil {
+			input.listener.Close()
+		}
+	})
+}
+
+// Returns the name of the client making a call, the common name of its
+// certificate or the name of its token, or an error if it isn't allowed.
+func (input *GrpcInput) authenticate(ctx context.Context) (client string, err error) {
+	if p, ok := peer.FromContext(ctx); ok {
+		if info, ok := p.AuthInfo.(credentials.TLSInfo); ok &&
+			len(info.State.VerifiedChains) > 0 && len(info.State.VerifiedChains[0]) > 0 {
+
+			client = info.State.VerifiedChains[0][0].Subject.CommonName
+		}
+	}
+	if input.clientNames != nil && !input.clientNames[client] {
+		return "", status.Errorf(codes.PermissionDenied, "client '%s' isn't allowed", client)
+	}
+	if len(input.conf.Tokens) == 0 {
+		return client, nil
+	}
+
+	var token string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		for _, authz := range md["authorization"] {
+			if strings.HasPrefix(authz, "Bearer ") {
+				token = strings.TrimSpace(authz[len("Bearer "):])
+			}
+		}
+	}
+	if token == "" {
+		return "", status.Error(codes.Unauthenticated, "missing bearer token")
+	}
+	name := ""
+	// Every token is compared, so the time taken doesn't reveal which one
+	// matched.
+	for n, t := range input.conf.Tokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(t)) == 1 {
+			name = n
+		}
+	}
+	if name == "" {
+		return "", status.Error(codes.Unauthenticated, "invalid bearer token")
+	}
+	return name, nil
+}
+
+// Delivers the messages of a batch, returning its acknowledgement.
+func (input *GrpcInput) deliver(client string, b *batch) *ack {
+	atomic.AddInt64(&input.batchesReceived, 1)
+	a := &ack{id: b.id}
+	var (
+		reports []<-chan pipeline.DeliveryReport
+		invalid int
+	)
+	for _, msgBytes := range b.messages {
+		var pack *pipeline.PipelinePack
+		select {
+		case pack = <-input.ir.InChan():
+		case <-input.stopChan:
+			a.err = errStopping.Error()
+			return a
+		}
+		if input.useMsgBytes {
+			pack.MsgBytes = append(pack.MsgBytes[:0], msgBytes...)
+		} else if err := proto.Unmarshal(msgBytes, pack.Message); err != nil {
+			invalid++
+			pack.Recycle()
+			continue
+		}
+		pack.Signer = client
+		if input.deliveryPoint != 0 {
+			reports = append(reports, pack.TrackDelivery(input.deliveryPoint))
+		}
+		input.ir.Deliver(pack)
+		a.accepted++
+	}
+	atomic.AddInt64(&input.messagesReceived, int64(a.accepted))
+	if invalid > 0 {
+		atomic.AddInt64(&input.invalidMessages, int64(invalid))
+		a.err = fmt.Sprintf("%d invalid messages", invalid)
+	}
+	if input.deliveryPoint == 0 {
+		return a
+	}
+
+	// Only the messages that reached the delivery point are accepted.
+	a.accepted = 0
+	timeout := time.After(time.Duration(input.conf.DeliveryTimeout) * time.Millisecond)
+	for _, ch := range reports {
+		select {
+		case report := <-ch:
+			if report.Err == nil {
+				a.accepted++
+			} else if a.err == "" {
+				a.err = report.Err.Error()
+			}
+			continue
+		case <-timeout:
+			a.err = "timed out waiting for delivery report"
+		case <-input.stopChan:
+			a.err = errStopping.Error()
+		}
+		break
+	}
+	return a
+}
+
+func (input *GrpcInput) ReportMsg(msg *message.Message) error {
+	message.NewInt64Field(msg, "MessagesReceived",
+		atomic.LoadInt64(&input.messagesReceived), "count")
+	message.NewInt64Field(msg, "InvalidMessages",
+		atomic.LoadInt64(&input.invalidMessages), "count")
+	message.NewInt64Field(msg, "BatchesReceived",
+		atomic.LoadInt64(&input.batchesReceived), "count")
+	message.NewInt64Field(msg, "CallsRejected",
+		atomic.LoadInt64(&input.callsRejected), "count")
+	return nil
+}
+
+var serviceDesc = grpc.ServiceDesc{
+	ServiceName: serviceName,
+	HandlerType: (*interface{})(nil),
+	Methods: []grpc.MethodDesc{
+		{MethodName: "SendBatch", Handler: handleSendBatch},
+	},
+	Streams: []grpc.StreamDesc{
+		{StreamName: "Send", Handler: handleSend, ServerStreams: true,
+			ClientStreams: true},
+	},
+}
+
+func handleSendBatch(srv interface{}, ctx context.Context, dec func(interface{}) error,
+	interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+
+	input := srv.(*GrpcInput)
+	client, err := input.authenticate(ctx)
+	if err != nil {
+		atomic.AddInt64(&input.callsRejected, 1)
+		return nil, err
+	}
+	b := new(batch)
+	if err = dec(b); err != nil {
+		return nil, err
+	}
+	return input.deliver(client, b), nil
+}
+
+func handleSend(srv interface{}, stream grpc.ServerStream) error {
+	input := srv.(*GrpcInput)
+	client, err := input.authenticate(stream.Context())
+	if err != nil {
+		atomic.AddInt64(&input.callsRejected, 1)
+		return err
+	}
+	b := new(batch)
+	for {
+		if err = stream.RecvMsg(b); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if err = stream.SendMsg(input.deliver(client, b)); err != nil {
+			return err
+		}
+	}
+}
+
+func init() {
+	pipeline.RegisterPlugin("GrpcInput", func() interface{} {
+		return new(GrpcInput)
+	})
+}
@@ -0,0 +1,211 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package grpc
+
+import (
+	"code.google.com/p/gogoprotobuf/proto"
+	"github.com/mozilla-services/heka/message"
+	"github.com/mozilla-services/heka/pipeline"
+	"github.com/mozilla-services/heka/pipelinemock"
+	"github.com/rafrombrc/gomock/gomock"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+type delivery struct {
+	payload, signer string
+}
+
+// Starts an input with the provided settings, returning a connection to it
+// and the messages it delivers.
+func startInput(t *testing.T, ctrl *gomock.Controller,
+	setup func(*GrpcInputConfig)) (*GrpcInput, *grpc.ClientConn, func() []delivery) {
+
+	input := new(GrpcInput)
+	config := input.ConfigStruct().(*GrpcInputConfig)
+	setup(config)
+	if err := input.Init(config); err != nil {
+		t.Fatal(err)
+	}
+	ir := pipelinemock.NewMockInputRunner(ctrl)
+	packs := make(chan *pipeline.PipelinePack, 1)
+	packs <- pipeline.NewPipelinePack(packs)
+	var (
+		delivered []delivery
+		lock      sync.Mutex
+	)
+	ir.EXPECT().InChan().Return(packs).AnyTimes()
+	ir.EXPECT().Deliver(gomock.Any()).Do(func(pack *pipeline.PipelinePack) {
+		lock.Lock()
+		delivered = append(delivered, delivery{pack.Message.GetPayload(), pack.Signer})
+		lock.Unlock()
+		pack.Recycle()
+	}).AnyTimes()
+	input.ir = ir
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go input.serve(listener)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := grpc.DialContext(ctx, listener.Addr().String(),
+		grpc.WithTransportCredentials(insecure.NewCredentials()), grpc.WithBlock(),
+		grpc.WithDefaultCallOptions(grpc.ForceCodec(codec{})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return input, conn, func() []delivery {
+		lock.Lock()
+		defer lock.Unlock()
+		return delivered
+	}
+}
+
+func encode(t *testing.T, payloads ...string) [][]byte {
+	var encoded [][]byte
+	for _, payload := range payloads {
+		msg := new(message.Message)
+		msg.SetType("test")
+		msg.SetPayload(payload)
+		msgBytes, err := proto.Marshal(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		encoded = append(encoded, msgBytes)
+	}
+	return encoded
+}
+
+func TestSendStream(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	input, conn, delivered := startInput(t, ctrl, func(*GrpcInputConfig) {})
+	defer input.Stop()
+	defer conn.Close()
+
+	stream, err := grpc.NewClientStream(context.Background(),
+		&grpc.StreamDesc{ServerStreams: true, ClientStreams: true}, conn, methodSend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	batches := []*batch{
+		{id: 1, messages: encode(t, "a", "b")},
+		{id: 2, messages: append(encode(t, "c"), []byte{0xff})},
+	}
+	for _, b := range batches {
+		if err = stream.SendMsg(b); err != nil {
+			t.Fatal(err)
+		}
+		a := new(ack)
+		if err = stream.RecvMsg(a); err != nil {
+			t.Fatal(err)
+		}
+		if a.id != b.id {
+			t.Errorf("Unexpected ack: %+v", a)
+		}
+	}
+	stream.CloseSend()
+
+	a := new(ack)
+	err = grpc.Invoke(context.Background(), methodSendOne,
+		&batch{id: 3, messages: [][]byte{{0xff}}}, a, conn)
+	if err != nil || a.id != 3 || a.accepted != 0 || a.err != "1 invalid messages" {
+		t.Errorf("Unexpected ack: %+v, %v", a, err)
+	}
+	msgs := delivered()
+	if len(msgs) != 3 || msgs[0].payload != "a" || msgs[2].payload != "c" {
+		t.Errorf("Unexpected messages: %+v", msgs)
+	}
+	if input.messagesReceived != 3 || input.invalidMessages != 2 || input.batchesReceived != 3 {
+		t.Errorf("Unexpected counts: %d received, %d invalid", input.messagesReceived,
+			input.invalidMessages)
+	}
+}
+
+func TestTokenAuthentication(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	input, conn, delivered := startInput(t, ctrl, func(config *GrpcInputConfig) {
+		config.Tokens = map[string]string{"web": "t1", "db": "t2"}
+	})
+	defer input.Stop()
+	defer conn.Close()
+
+	send := func(ctx context.Context) (*ack, error) {
+		a := new(ack)
+		err := grpc.Invoke(ctx, methodSendOne, &batch{messages: encode(t, "x")}, a, conn)
+		return a, err
+	}
+	if _, err := send(context.Background()); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	ctx := metadata.NewOutgoingContext(context.Background(),
+		metadata.Pairs("authorization", "Bearer nope"))
+	if _, err := send(ctx); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	ctx = metadata.NewOutgoingContext(context.Background(),
+		metadata.Pairs("authorization", "Bearer t2"))
+	if a, err := send(ctx); err != nil || a.accepted != 1 {
+		t.Errorf("Unexpected result: %+v, %v", a, err)
+	}
+	msgs := delivered()
+	if len(msgs) != 1 || msgs[0].signer != "db" {
+		t.Errorf("Unexpected messages: %+v", msgs)
+	}
+	if input.callsRejected != 2 {
+		t.Errorf("Unexpected rejected calls: %d", input.callsRejected)
+	}
+}
+
+func TestInvalidConfig(t *testing.T) {
+	input := new(GrpcInput)
+	config := input.ConfigStruct().(*GrpcInputConfig)
+	config.ClientNames = []string{"web"}
+	if err := input.Init(config); err == nil {
+		t.Error("client_names without client certificates accepted")
+	}
+	config.ClientNames = nil
+	config.DeliveryReport = "disk"
+	if err := input.Init(config); err == nil {
+		t.Error("Invalid delivery_report accepted")
+	}
+}
+
+func TestProtocolMessages(t *testing.T) {
+	b := &batch{id: 300, messages: [][]byte{[]byte("one"), {}}}
+	decoded := new(batch)
+	if err := decoded.unmarshal(b.marshal()); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.id != 300 || len(decoded.messages) != 2 || string(decoded.messages[0]) != "one" {
+		t.Errorf("Unexpected batch: %+v", decoded)
+	}
+	a := &ack{id: 7, accepted: 2, err: "failed"}
+	decodedAck := new(ack)
+	if err := decodedAck.unmarshal(a.marshal()); err != nil || *decodedAck != *a {
+		t.Errorf("Unexpected ack: %+v, %v", decodedAck, err)
+	}
+	if err := decoded.unmarshal([]byte{0x12, 0x05, 'a'}); err != errTruncated {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,199 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package grpc
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Implementation of the protocol defined in message_service.proto. The
+// protocol messages are encoded by hand and Heka messages are passed through
+// in their encoded form, so no generated code is needed.
+
+const (
+	serviceName   = "heka.input.MessageService"
+	methodSend    = "/" + serviceName + "/Send"
+	methodSendOne = "/" + serviceName + "/SendBatch"
+)
+
+// A protocol message.
+type wireMessage interface {
+	marshal() []byte
+	unmarshal(data []byte) error
+}
+
+// gRPC codec for the protocol messages.
+type codec struct{}
+
+func (codec) Marshal(v interface{}) ([]byte, error) {
+	msg, ok := v.(wireMessage)
+	if !ok {
+		return nil, fmt.Errorf("can't marshal %T", v)
+	}
+	return msg.marshal(), nil
+}
+
+func (codec) Unmarshal(data []byte, v interface{}) error {
+	msg, ok := v.(wireMessage)
+	if !ok {
+		return fmt.Errorf("can't unmarshal %T", v)
+	}
+	return msg.unmarshal(data)
+}
+
+func (codec) Name() string {
+	return "proto"
+}
+
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+func appendVarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], v)
+	return append(b, buf[:n]...)
+}
+
+func appendVarintField(b []byte, field int, v uint64) []byte {
+	b = appendVarint(b, uint64(field)<<3|wireVarint)
+	return appendVarint(b, v)
+}
+
+func appendBytesField(b []byte, field int, v []byte) []byte {
+	b = appendVarint(b, uint64(field)<<3|wireBytes)
+	b = appendVarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+var errTruncated = errors.New("truncated protocol message")
+
+// Calls `f` with each field of an encoded protocol message. Only varint and
+// length delimited values are passed to `f`, other fields are skipped.
+func readFields(data []byte, f func(field int, varint uint64, bytes []byte) error) error {
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return errTruncated
+		}
+		data = data[n:]
+		field := int(key >> 3)
+		var (
+			varint uint64
+			bytes  []byte
+		)
+		switch key & 7 {
+		case wireVarint:
+			if varint, n = binary.Uvarint(data); n <= 0 {
+				return errTruncated
+			}
+			data = data[n:]
+		case wireBytes:
+			length, n := binary.Uvarint(data)
+			if n <= 0 || uint64(len(data)-n) < length {
+				return errTruncated
+			}
+			bytes = data[n : n+int(length)]
+			data = data[n+int(length):]
+		case wireFixed64:
+			if len(data) < 8 {
+				return errTruncated
+			}
+			data = data[8:]
+			continue
+		case wireFixed32:
+			if len(data) < 4 {
+				return errTruncated
+			}
+			data = data[4:]
+			continue
+		default:
+			return fmt.Errorf("unsupported wire type %d", key&7)
+		}
+		if err := f(field, varint, bytes); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// A batch of encoded Heka messages, the Batch protocol message.
+type batch struct {
+	id       uint64
+	messages [][]byte
+}
+
+func (b *batch) marshal() (data []byte) {
+	if b.id != 0 {
+		data = appendVarintField(data, 1, b.id)
+	}
+	for _, msg := range b.messages {
+		data = appendBytesField(data, 2, msg)
+	}
+	return
+}
+
+func (b *batch) unmarshal(data []byte) error {
+	// The messages reference the data, which gRPC may reuse.
+	data = append([]byte(nil), data...)
+	b.id = 0
+	b.messages = b.messages[:0]
+	return readFields(data, func(field int, varint uint64, bytes []byte) error {
+		switch field {
+		case 1:
+			b.id = varint
+		case 2:
+			b.messages = append(b.messages, bytes)
+		}
+		return nil
+	})
+}
+
+// Acknowledgement of a batch, the Ack protocol message.
+type ack struct {
+	id       uint64
+	accepted uint32
+	err      string
+}
+
+func (a *ack) marshal() (data []byte) {
+	if a.id != 0 {
+		data = appendVarintField(data, 1, a.id)
+	}
+	if a.accepted != 0 {
+		data = appendVarintField(data, 2, uint64(a.accepted))
+	}
+	if a.err != "" {
+		data = appendBytesField(data, 3, []byte(a.err))
+	}
+	return
+}
+
+func (a *ack) unmarshal(data []byte) error {
+	*a = ack{}
+	return readFields(data, func(field int, varint uint64, bytes []byte) error {
+		switch field {
+		case 1:
+			a.id = varint
+		case 2:
+			a.accepted = uint32(varint)
+		case 3:
+			a.err = string(bytes)
+		}
+		return nil
+	})
+}
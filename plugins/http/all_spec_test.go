@@ -26,6 +26,8 @@ func TestAllSpecs(t *testing.T) {
 	r.AddSpec(HttpInputSpec)
 	r.AddSpec(HttpListenInputSpec)
 	r.AddSpec(HttpOutputSpec)
+	r.AddSpec(ChatWebhookOutputSpec)
+	r.AddSpec(WebSocketSpec)
 
 	gospec.MainGoTest(r, t)
 }
@@ -0,0 +1,334 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package http
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+	"github.com/mozilla-services/heka/pipeline"
+	"github.com/mozilla-services/heka/plugins/tcp"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"time"
+)
+
+type ChatWebhookOutputConfig struct {
+	// "slack" or "teams".
+	Service string
+	// Incoming webhook URL of the default channel.
+	WebhookUrl string `toml:"webhook_url"`
+	// Incoming webhook URLs of other channels, by channel name.
+	Channels map[string]string
+	// Template rendering the name of the channel a message is posted to.
+	// Messages rendering a name not in `channels` go to the default channel.
+	Channel string
+	// Templates rendering the text and the title of the posts, see
+	// pipeline.DestinationTemplateConfig. The payload is posted if the text
+	// references a value the message doesn't have.
+	Template string
+	Title    string
+	// Longer texts are shortened, and posted in full as an attachment.
+	MaxTextLength int `toml:"max_text_length"`
+	// Maximum length of the attachment, longer texts are truncated.
+	MaxAttachmentLength int `toml:"max_attachment_length"`
+	// Maximum number of posts per minute to each channel, 0 for no limit.
+	MaxPerMinute int `toml:"max_per_minute"`
+	// Milliseconds after which a request times out, 0 for no timeout.
+	HttpTimeout uint32 `toml:"http_timeout"`
+	Tls         tcp.TlsConfig
+}
+
+// Posts messages, formatted with templates, to Slack or Microsoft Teams
+// incoming webhooks. Meant for low volume operational alerts generated by
+// filters, so each channel is rate limited and messages over the limit are
+// dropped, the next post to the channel saying how many were.
+type ChatWebhookOutput struct {
+	posted     int64
+	suppressed int64
+	failed     int64
+
+	conf     *ChatWebhookOutputConfig
+	text     *pipeline.DestinationTemplate
+	title    *pipeline.DestinationTemplate
+	channel  *pipeline.DestinationTemplate
+	limits   map[string]*channelLimit
+	client   *http.Client
+	hasTitle bool
+	// Swapped out in tests.
+	now func() time.Time
+}
+
+// Posts made to a channel during the current minute.
+type channelLimit struct {
+	windowStart time.Time
+	count       int
+	// Posts dropped since the last one made.
+	suppressed int
+}
+
+// Default channel name.
+const defaultChannel = "default"
+
+// Attachment colors, by severity.
+const (
+	colorDanger  = "danger"
+	colorWarning = "warning"
+	colorGood    = "good"
+)
+
+// Teams theme colors matching Slack's attachment colors.
+var teamsColors = map[string]string{
+	colorDanger:  "D00000",
+	colorWarning: "DAA038",
+	colorGood:    "2EB886",
+}
+
+func (o *ChatWebhookOutput) ConfigStruct() interface{} {
+	return &ChatWebhookOutputConfig{
+		Service:             "slack",
+		Template:            "%{Payload}",
+		MaxTextLength:       500,
+		MaxAttachmentLength: 7000,
+		MaxPerMinute:        10,
+		HttpTimeout:         10000,
+	}
+}
+
+func (o *ChatWebhookOutput) Init(config interface{}) (err error) {
+	o.conf = config.(*ChatWebhookOutputConfig)
+	if o.conf.Service != "slack" && o.conf.Service != "teams" {
+		return fmt.Errorf(`invalid service "%s", must be "slack" or "teams"`,
+			o.conf.Service)
+	}
+	if o.conf.WebhookUrl == "" {
+		return errors.New("webhook_url must be specified")
+	}
+	urls := map[string]string{defaultChannel: o.conf.WebhookUrl}
+	for name, u := range o.conf.Channels {
+		urls[name] = u
+	}
+	for name, u := range urls {
+		parsed, e := url.Parse(u)
+		if e != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+			return fmt.Errorf("invalid webhook URL for channel '%s': %s", name, u)
+		}
+	}
+	if o.conf.MaxTextLength < 1 || o.conf.MaxAttachmentLength < 1 {
+		return errors.New("max_text_length and max_attachment_length must be greater than 0")
+	}
+	if o.text, err = pipeline.NewDestinationTemplate(pipeline.DestinationTemplateConfig{
+		Template: o.conf.Template,
+	}); err != nil {
+		return
+	}
+	if o.title, err = pipeline.NewDestinationTemplate(pipeline.DestinationTemplateConfig{
+		Template: o.conf.Title,
+	}); err != nil {
+		return
+	}
+	o.hasTitle = o.conf.Title != ""
+	if o.channel, err = pipeline.NewDestinationTemplate(pipeline.DestinationTemplateConfig{
+		Template: o.conf.Channel,
+		Fallback: defaultChannel,
+	}); err != nil {
+		return
+	}
+	o.limits = make(map[string]*channelLimit)
+	o.now = time.Now
+
+	o.client = new(http.Client)
+	if o.conf.HttpTimeout > 0 {
+		o.client.Timeout = time.Duration(o.conf.HttpTimeout) * time.Millisecond
+	}
+	transport := &http.Transport{}
+	if transport.TLSClientConfig, err = tcp.CreateGoTlsConfig(&o.conf.Tls); err != nil {
+		return fmt.Errorf("TLS init error: %s", err)
+	}
+	o.client.Transport = transport
+	return
+}
+
+func (o *ChatWebhookOutput) Run(or pipeline.OutputRunner, h pipeline.PluginHelper) (err error) {
+	for pack := range or.InChan() {
+		channel, webhook := o.destination(pack.Message)
+		limit := o.limit(channel)
+		if limit == nil {
+			atomic.AddInt64(&o.suppressed, 1)
+			pack.Recycle()
+			continue
+		}
+		body, e := o.post(pack.Message, limit.suppressed)
+		if e != nil {
+			or.HandleFailure(pack, pipeline.NewMalformedMessageError(e))
+			continue
+		}
+		for {
+			if e = o.request(webhook, body); e == nil {
+				atomic.AddInt64(&o.posted, 1)
+				limit.suppressed = 0
+				pack.Recycle()
+				break
+			}
+			if !or.HandleFailure(pack, e) {
+				atomic.AddInt64(&o.failed, 1)
+				if pipeline.ClassifyError(e) == pipeline.ErrKindFatal {
+					return e
+				}
+				break
+			}
+		}
+	}
+	return
+}
+
+// Returns the name and webhook URL of the channel a message is posted to.
+func (o *ChatWebhookOutput) destination(msg *message.Message) (string, string) {
+	name, _ := o.channel.Destination(msg)
+	if u, ok := o.conf.Channels[name]; ok {
+		return name, u
+	}
+	return defaultChannel, o.conf.WebhookUrl
+}
+
+// Counts a post to a channel, returning the channel's limit, or nil if the
+// post is over the limit.
+func (o *ChatWebhookOutput) limit(channel string) *channelLimit {
+	limit, ok := o.limits[channel]
+	if !ok {
+		limit = new(channelLimit)
+		o.limits[channel] = limit
+	}
+	now := o.now()
+	if now.Sub(limit.windowStart) >= time.Minute {
+		limit.windowStart = now
+		limit.count = 0
+	}
+	if o.conf.MaxPerMinute > 0 && limit.count >= o.conf.MaxPerMinute {
+		limit.suppressed++
+		return nil
+	}
+	limit.count++
+	return limit
+}
+
+// Returns the webhook payload posting a message.
+func (o *ChatWebhookOutput) post(msg *message.Message, suppressed int) ([]byte, error) {
+	// An alert is still posted when it's missing a value the templates
+	// reference.
+	text, err := o.text.Destination(msg)
+	if err != nil {
+		text = msg.GetPayload()
+	}
+	var title string
+	if o.hasTitle {
+		title, _ = o.title.Destination(msg)
+	}
+	var attachment string
+	if len(text) > o.conf.MaxTextLength {
+		attachment = truncate(text, o.conf.MaxAttachmentLength)
+		text = truncate(text, o.conf.MaxTextLength)
+	}
+	if suppressed > 0 {
+		text += fmt.Sprintf("\n(%d more messages suppressed by rate limiting)", suppressed)
+	}
+
+	color := colorGood
+	switch severity := msg.GetSeverity(); {
+	case severity <= 3:
+		color = colorDanger
+	case severity == 4:
+		color = colorWarning
+	}
+
+	var payload interface{}
+	if o.conf.Service == "slack" {
+		slack := map[string]interface{}{"text": text}
+		if title != "" || attachment != "" {
+			slack["attachments"] = []map[string]string{{
+				"fallback": text,
+				"color":    color,
+				"title":    title,
+				"text":     attachment,
+			}}
+		}
+		payload = slack
+	} else {
+		summary := title
+		if summary == "" {
+			summary = truncate(text, 80)
+		}
+		card := map[string]interface{}{
+			"@type":      "MessageCard",
+			"@context":   "https://schema.org/extensions",
+			"summary":    summary,
+			"themeColor": teamsColors[color],
+			"text":       text,
+		}
+		if title != "" {
+			card["title"] = title
+		}
+		if attachment != "" {
+			card["sections"] = []map[string]string{{"text": attachment}}
+		}
+		payload = card
+	}
+	return json.Marshal(payload)
+}
+
+// Shortens text to at most max bytes, marking it as truncated, without
+// splitting a UTF-8 character.
+func truncate(text string, max int) string {
+	if len(text) <= max {
+		return text
+	}
+	const ellipsis = "…"
+	cut := max - len(ellipsis)
+	if cut < 0 {
+		cut = 0
+	}
+	for cut > 0 && cut < len(text) && text[cut]&0xC0 == 0x80 {
+		cut--
+	}
+	return text[:cut] + ellipsis
+}
+
+func (o *ChatWebhookOutput) request(webhook string, body []byte) error {
+	resp, err := o.client.Post(webhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return pipeline.NewRetryableError(fmt.Errorf("webhook request failed: %s", err))
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 300 {
+		return nil
+	}
+	respBody, _ := ioutil.ReadAll(resp.Body)
+	return classifyResponse(resp, fmt.Errorf("webhook request failed: %s - %s",
+		resp.Status, respBody))
+}
+
+func (o *ChatWebhookOutput) ReportMsg(msg *message.Message) error {
+	message.NewInt64Field(msg, "Posted", atomic.LoadInt64(&o.posted), "count")
+	message.NewInt64Field(msg, "Suppressed", atomic.LoadInt64(&o.suppressed), "count")
+	message.NewInt64Field(msg, "Failed", atomic.LoadInt64(&o.failed), "count")
+	return nil
+}
+
+func init() {
+	pipeline.RegisterPlugin("ChatWebhookOutput", func() interface{} {
+		return new(ChatWebhookOutput)
+	})
+}
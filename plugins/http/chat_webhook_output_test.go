@@ -0,0 +1,147 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package http
+
+import (
+	"encoding/json"
+	"github.com/mozilla-services/heka/message"
+	"github.com/mozilla-services/heka/pipeline"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+)
+
+func ChatWebhookOutputSpec(c gs.Context) {
+	output := new(ChatWebhookOutput)
+	config := output.ConfigStruct().(*ChatWebhookOutputConfig)
+	config.WebhookUrl = "https://hooks.example.com/default"
+	config.Channels = map[string]string{"ops": "https://hooks.example.com/ops"}
+	config.Channel = "%{team}"
+	config.Template = "%{Hostname}: %{Payload}"
+	config.Title = "Alert from %{Logger}"
+
+	msg := new(message.Message)
+	msg.SetHostname("web1")
+	msg.SetLogger("DiskFilter")
+	msg.SetSeverity(3)
+	msg.SetPayload("disk full")
+	message.NewStringField(msg, "team", "ops")
+
+	decode := func(body []byte) map[string]interface{} {
+		var payload map[string]interface{}
+		c.Assume(json.Unmarshal(body, &payload), gs.IsNil)
+		return payload
+	}
+
+	c.Specify("A ChatWebhookOutput", func() {
+		c.Specify("formats Slack posts", func() {
+			c.Assume(output.Init(config), gs.IsNil)
+			body, err := output.post(msg, 0)
+			c.Assume(err, gs.IsNil)
+			payload := decode(body)
+			c.Expect(payload["text"], gs.Equals, "web1: disk full")
+			attachment := payload["attachments"].([]interface{})[0].(map[string]interface{})
+			c.Expect(attachment["title"], gs.Equals, "Alert from DiskFilter")
+			c.Expect(attachment["color"], gs.Equals, "danger")
+			c.Expect(attachment["text"], gs.Equals, "")
+		})
+
+		c.Specify("posts long texts as attachments", func() {
+			config.Title = ""
+			config.MaxTextLength = 20
+			c.Assume(output.Init(config), gs.IsNil)
+			msg.SetPayload(strings.Repeat("x", 30))
+			body, err := output.post(msg, 2)
+			c.Assume(err, gs.IsNil)
+			payload := decode(body)
+			text := payload["text"].(string)
+			c.Expect(strings.HasPrefix(text, "web1: "+strings.Repeat("x", 11)+"…\n"), gs.IsTrue)
+			c.Expect(strings.HasSuffix(text, "(2 more messages suppressed by rate limiting)"),
+				gs.IsTrue)
+			attachment := payload["attachments"].([]interface{})[0].(map[string]interface{})
+			c.Expect(attachment["text"], gs.Equals, "web1: "+strings.Repeat("x", 30))
+		})
+
+		c.Specify("formats Teams cards", func() {
+			config.Service = "teams"
+			c.Assume(output.Init(config), gs.IsNil)
+			msg.SetSeverity(4)
+			body, err := output.post(msg, 0)
+			c.Assume(err, gs.IsNil)
+			payload := decode(body)
+			c.Expect(payload["@type"], gs.Equals, "MessageCard")
+			c.Expect(payload["title"], gs.Equals, "Alert from DiskFilter")
+			c.Expect(payload["summary"], gs.Equals, "Alert from DiskFilter")
+			c.Expect(payload["themeColor"], gs.Equals, "DAA038")
+			c.Expect(payload["text"], gs.Equals, "web1: disk full")
+		})
+
+		c.Specify("routes messages to channels", func() {
+			c.Assume(output.Init(config), gs.IsNil)
+			name, webhook := output.destination(msg)
+			c.Expect(name, gs.Equals, "ops")
+			c.Expect(webhook, gs.Equals, "https://hooks.example.com/ops")
+
+			other := new(message.Message)
+			message.NewStringField(other, "team", "dev")
+			name, webhook = output.destination(other)
+			c.Expect(name, gs.Equals, "default")
+			c.Expect(webhook, gs.Equals, config.WebhookUrl)
+			name, _ = output.destination(new(message.Message))
+			c.Expect(name, gs.Equals, "default")
+		})
+
+		c.Specify("rate limits each channel", func() {
+			config.MaxPerMinute = 2
+			c.Assume(output.Init(config), gs.IsNil)
+			now := time.Unix(1000, 0)
+			output.now = func() time.Time { return now }
+
+			c.Expect(output.limit("ops") != nil, gs.IsTrue)
+			c.Expect(output.limit("ops") != nil, gs.IsTrue)
+			c.Expect(output.limit("ops") == nil, gs.IsTrue)
+			c.Expect(output.limit("ops") == nil, gs.IsTrue)
+			c.Expect(output.limit("default") != nil, gs.IsTrue)
+
+			now = now.Add(time.Minute)
+			limit := output.limit("ops")
+			c.Assume(limit != nil, gs.IsTrue)
+			c.Expect(limit.suppressed, gs.Equals, 2)
+		})
+
+		c.Specify("classifies webhook failures", func() {
+			status := http.StatusOK
+			var received []byte
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter,
+				r *http.Request) {
+
+				received, _ = ioutil.ReadAll(r.Body)
+				w.WriteHeader(status)
+			}))
+			defer server.Close()
+			config.WebhookUrl = server.URL
+			c.Assume(output.Init(config), gs.IsNil)
+
+			c.Expect(output.request(server.URL, []byte(`{"text":"hi"}`)), gs.IsNil)
+			c.Expect(string(received), gs.Equals, `{"text":"hi"}`)
+			status = http.StatusInternalServerError
+			err := output.request(server.URL, []byte(`{}`))
+			c.Expect(pipeline.ClassifyError(err), gs.Equals, pipeline.ErrKindRetryable)
+			status = http.StatusForbidden
+			err = output.request(server.URL, []byte(`{}`))
+			c.Expect(pipeline.ClassifyError(err), gs.Equals, pipeline.ErrKindFatal)
+		})
+	})
+}
@@ -16,15 +16,29 @@
 package http
 
 import (
+	"bytes"
 	"code.google.com/p/go-uuid/uuid"
+	"compress/gzip"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/mozilla-services/heka/message"
 	. "github.com/mozilla-services/heka/pipeline"
+	"hash"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -37,6 +51,14 @@ type HttpListenInput struct {
 	pConfig     *PipelineConfig
 	server      *http.Server
 	starterFunc func(hli *HttpListenInput) error
+	// Zero if responses don't wait for delivery reports.
+	deliveryPoint DeliveryPoint
+	hmacHash      func() hash.Hash
+	limiter       *sourceLimiter
+
+	rejectedAuth int64
+	rejectedRate int64
+	badRequests  int64
 }
 
 // HTTP Listen Input config struct
@@ -46,13 +68,64 @@ type HttpListenInputConfig struct {
 	Address      string
 	Headers      http.Header
 	UnescapeBody bool `toml:"unescape_body"`
+	// If set, each response is deferred until the request's message has
+	// reached the specified point in the pipeline, "router" or "output".
+	DeliveryReport string `toml:"delivery_report"`
+	// Maximum time to wait for a delivery report, in milliseconds. Defaults
+	// to 10000.
+	DeliveryTimeout uint32 `toml:"delivery_timeout"`
+	// How request bodies are split into messages: "none" (one message per
+	// request), "newline", "json_array", or "protobuf" (framed Heka
+	// messages).
+	Split string
+	// Maximum size of a request body in bytes, after decompression. 0 for no
+	// limit.
+	MaxBodySize int64 `toml:"max_body_size"`
+	// Authentication required of requests: "none", "basic", "bearer", or
+	// "hmac".
+	Auth string
+	// Credentials of basic authentication.
+	User     string
+	Password string
+	// Accepted bearer tokens.
+	Tokens []string
+	// HMAC authentication key, header carrying the signature of the body,
+	// and hash function, "sha256" or "sha1".
+	HmacKey         string `toml:"hmac_key"`
+	SignatureHeader string `toml:"signature_header"`
+	HmacHash        string `toml:"hmac_hash"`
+	// Maximum number of requests per second accepted from a single source
+	// IP, 0 for no limit, and the number of requests allowed in a burst.
+	MaxRequestsPerSec uint `toml:"max_requests_per_sec"`
+	Burst             uint
+}
+
+// Body of the responses sent when using delivery reports.
+type deliveryResponse struct {
+	Delivered bool   `json:"delivered"`
+	Error     string `json:"error,omitempty"`
+}
+
+// Request failure, reported with an HTTP status.
+type requestError struct {
+	status int
+	msg    string
+}
+
+func (e *requestError) Error() string {
+	return e.msg
 }
 
 func (hli *HttpListenInput) ConfigStruct() interface{} {
 	return &HttpListenInputConfig{
-		Address:      "127.0.0.1:8325",
-		Headers:      make(http.Header),
-		UnescapeBody: true,
+		Address:         "127.0.0.1:8325",
+		Headers:         make(http.Header),
+		UnescapeBody:    true,
+		DeliveryTimeout: 10000,
+		Split:           "none",
+		Auth:            "none",
+		SignatureHeader: "X-Signature",
+		HmacHash:        "sha256",
 	}
 }
 
@@ -75,13 +148,221 @@ func defaultStarter(hli *HttpListenInput) (err error) {
 }
 
 func (hli *HttpListenInput) RequestHandler(w http.ResponseWriter, req *http.Request) {
-	body, err := ioutil.ReadAll(req.Body)
+	if hli.limiter != nil && !hli.limiter.allow(sourceIP(req)) {
+		atomic.AddInt64(&hli.rejectedRate, 1)
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "too many requests", 429)
+		return
+	}
+	if err := hli.authenticate(req); err != nil {
+		atomic.AddInt64(&hli.rejectedAuth, 1)
+		if hli.conf.Auth == "basic" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="heka"`)
+		} else if hli.conf.Auth == "bearer" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="heka"`)
+		}
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	records, err := hli.readRecords(req)
 	if err != nil {
-		fmt.Errorf("[HttpListenInput] Read HTTP request body fail: %s\n", err.Error())
+		status := http.StatusBadRequest
+		if reqErr, ok := err.(*requestError); ok {
+			status = reqErr.status
+		}
+		if status == http.StatusUnauthorized {
+			atomic.AddInt64(&hli.rejectedAuth, 1)
+		} else {
+			atomic.AddInt64(&hli.badRequests, 1)
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	var reports []<-chan DeliveryReport
+	for _, record := range records {
+		pack := <-hli.ir.InChan()
+		hli.populate(pack, req, record)
+		if hli.deliveryPoint != 0 {
+			reports = append(reports, pack.TrackDelivery(hli.deliveryPoint))
+		}
+		hli.ir.Deliver(pack)
+	}
+	if hli.deliveryPoint == 0 {
+		return
+	}
+
+	timeout := time.After(time.Duration(hli.conf.DeliveryTimeout) * time.Millisecond)
+	status := http.StatusOK
+	resp := deliveryResponse{Delivered: true}
+	for _, ch := range reports {
+		select {
+		case report := <-ch:
+			if report.Err != nil && resp.Delivered {
+				status = http.StatusServiceUnavailable
+				resp = deliveryResponse{Error: report.Err.Error()}
+			}
+			continue
+		case <-timeout:
+			status = http.StatusGatewayTimeout
+			resp = deliveryResponse{Error: "timed out waiting for delivery report"}
+		case <-hli.stopChan:
+			status = http.StatusServiceUnavailable
+			resp = deliveryResponse{Error: "shutting down"}
+		}
+		break
+	}
+	body, _ := json.Marshal(resp)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+// Checks the basic or bearer credentials of a request. HMAC signatures are
+// checked once the body has been read.
+func (hli *HttpListenInput) authenticate(req *http.Request) error {
+	switch hli.conf.Auth {
+	case "basic":
+		user, password, ok := req.BasicAuth()
+		if !ok || !secureEqual(user, hli.conf.User) ||
+			!secureEqual(password, hli.conf.Password) {
+
+			return errors.New("invalid credentials")
+		}
+	case "bearer":
+		authz := req.Header.Get("Authorization")
+		if !strings.HasPrefix(authz, "Bearer ") {
+			return errors.New("missing bearer token")
+		}
+		token := strings.TrimSpace(authz[len("Bearer "):])
+		valid := false
+		for _, t := range hli.conf.Tokens {
+			// Every token is compared, so the time taken doesn't reveal
+			// which one matched.
+			if secureEqual(token, t) {
+				valid = true
+			}
+		}
+		if !valid {
+			return errors.New("invalid bearer token")
+		}
+	}
+	return nil
+}
+
+// Compares strings in constant time.
+func secureEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// Checks the HMAC signature of a request's body. The signature is hex
+// encoded, optionally prefixed with the hash name, e.g. "sha256=<hex>".
+func (hli *HttpListenInput) verifySignature(req *http.Request, body []byte) error {
+	signature := req.Header.Get(hli.conf.SignatureHeader)
+	signature = strings.TrimPrefix(signature, hli.conf.HmacHash+"=")
+	digest, err := hex.DecodeString(signature)
+	if err != nil || len(digest) == 0 {
+		return &requestError{http.StatusUnauthorized, "missing or malformed signature"}
+	}
+	mac := hmac.New(hli.hmacHash, []byte(hli.conf.HmacKey))
+	mac.Write(body)
+	if !hmac.Equal(digest, mac.Sum(nil)) {
+		return &requestError{http.StatusUnauthorized, "invalid signature"}
+	}
+	return nil
+}
+
+// Reads a request's body, verifying its signature and decompressing it, and
+// splits it into records.
+func (hli *HttpListenInput) readRecords(req *http.Request) ([][]byte, error) {
+	defer req.Body.Close()
+	var reader io.Reader = req.Body
+	if hli.conf.MaxBodySize > 0 {
+		reader = io.LimitReader(reader, hli.conf.MaxBodySize+1)
+	}
+	body, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("can't read request body: %s", err)
+	}
+	if hli.conf.Auth == "hmac" {
+		if err = hli.verifySignature(req, body); err != nil {
+			return nil, err
+		}
+	}
+	if strings.EqualFold(req.Header.Get("Content-Encoding"), "gzip") {
+		gz, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, fmt.Errorf("invalid gzip body: %s", err)
+		}
+		reader = gz
+		if hli.conf.MaxBodySize > 0 {
+			reader = io.LimitReader(gz, hli.conf.MaxBodySize+1)
+		}
+		if body, err = ioutil.ReadAll(reader); err != nil {
+			return nil, fmt.Errorf("invalid gzip body: %s", err)
+		}
+	}
+	if hli.conf.MaxBodySize > 0 && int64(len(body)) > hli.conf.MaxBodySize {
+		return nil, &requestError{http.StatusRequestEntityTooLarge,
+			fmt.Sprintf("request body exceeds %d bytes", hli.conf.MaxBodySize)}
+	}
+	return splitBody(hli.conf.Split, body)
+}
+
+// Splits a request body into the records sent as separate messages.
+func splitBody(split string, body []byte) (records [][]byte, err error) {
+	switch split {
+	case "newline":
+		for _, line := range bytes.Split(body, []byte("\n")) {
+			if line = bytes.TrimRight(line, "\r"); len(line) > 0 {
+				records = append(records, line)
+			}
+		}
+	case "json_array":
+		var elements []json.RawMessage
+		if err = json.Unmarshal(body, &elements); err != nil {
+			return nil, fmt.Errorf("body isn't a JSON array: %s", err)
+		}
+		for _, element := range elements {
+			records = append(records, []byte(element))
+		}
+	case "protobuf":
+		parser := NewMessageProtoParser()
+		reader := bytes.NewReader(body)
+		for {
+			_, record, e := parser.Parse(reader)
+			if len(record) == 0 {
+				if e != nil && e != io.EOF {
+					err = fmt.Errorf("invalid framed message: %s", e)
+				}
+				break
+			}
+			// Only the message is kept, the record is only valid until the
+			// next call to Parse.
+			headerLen := int(record[1]) + message.HEADER_FRAMING_SIZE
+			records = append(records, append([]byte(nil), record[headerLen:]...))
+		}
+		if err == nil && len(records) == 0 && len(body) > 0 {
+			err = errors.New("no framed messages in body")
+		}
+	default:
+		records = [][]byte{body}
+	}
+	return
+}
+
+// Fills in a pack with a record of a request. Framed Heka messages are left
+// to the input's decoder.
+func (hli *HttpListenInput) populate(pack *PipelinePack, req *http.Request, record []byte) {
+	if hli.conf.Split == "protobuf" {
+		if len(record) > cap(pack.MsgBytes) {
+			pack.MsgBytes = make([]byte, len(record))
+		}
+		pack.MsgBytes = pack.MsgBytes[:len(record)]
+		copy(pack.MsgBytes, record)
+		return
 	}
-	req.Body.Close()
 
-	pack := <-hli.ir.InChan()
 	pack.Message.SetUuid(uuid.NewRandom())
 	pack.Message.SetTimestamp(time.Now().UnixNano())
 	pack.Message.SetType("heka.httpdata.request")
@@ -90,10 +371,10 @@ func (hli *HttpListenInput) RequestHandler(w http.ResponseWriter, req *http.Requ
 	pack.Message.SetPid(int32(os.Getpid()))
 	pack.Message.SetSeverity(int32(6))
 	if hli.conf.UnescapeBody {
-		unEscapedBody, _ := url.QueryUnescape(string(body))
+		unEscapedBody, _ := url.QueryUnescape(string(record))
 		pack.Message.SetPayload(unEscapedBody)
 	} else {
-		pack.Message.SetPayload(string(body))
+		pack.Message.SetPayload(string(record))
 	}
 	if field, err := message.NewField("Protocol", req.Proto, ""); err == nil {
 		pack.Message.AddField(field)
@@ -121,8 +402,6 @@ func (hli *HttpListenInput) RequestHandler(w http.ResponseWriter, req *http.Requ
 			}
 		}
 	}
-
-	hli.ir.Deliver(pack)
 }
 
 func (hli *HttpListenInput) Init(config interface{}) (err error) {
@@ -131,6 +410,44 @@ func (hli *HttpListenInput) Init(config interface{}) (err error) {
 		hli.starterFunc = defaultStarter
 	}
 	hli.stopChan = make(chan bool, 1)
+	hli.deliveryPoint = 0
+	if hli.conf.DeliveryReport != "" {
+		if hli.deliveryPoint, err = ParseDeliveryPoint(hli.conf.DeliveryReport); err != nil {
+			return fmt.Errorf("invalid delivery_report: %s", hli.conf.DeliveryReport)
+		}
+	}
+
+	switch hli.conf.Split {
+	case "none", "newline", "json_array", "protobuf":
+	default:
+		return fmt.Errorf("invalid split: %s", hli.conf.Split)
+	}
+	switch hli.conf.Auth {
+	case "none":
+	case "basic":
+		if hli.conf.User == "" {
+			return errors.New("basic auth requires a user")
+		}
+	case "bearer":
+		if len(hli.conf.Tokens) == 0 {
+			return errors.New("bearer auth requires at least one token")
+		}
+	case "hmac":
+		if hli.conf.HmacKey == "" {
+			return errors.New("hmac auth requires an hmac_key")
+		}
+		switch hli.conf.HmacHash {
+		case "sha256":
+			hli.hmacHash = sha256.New
+		case "sha1":
+			hli.hmacHash = sha1.New
+		default:
+			return fmt.Errorf("invalid hmac_hash: %s", hli.conf.HmacHash)
+		}
+	default:
+		return fmt.Errorf("invalid auth: %s", hli.conf.Auth)
+	}
+	hli.limiter = newSourceLimiter(hli.conf.MaxRequestsPerSec, hli.conf.Burst)
 
 	handler := http.HandlerFunc(hli.RequestHandler)
 	hli.server = &http.Server{
@@ -160,6 +477,88 @@ func (hli *HttpListenInput) Stop() {
 	close(hli.stopChan)
 }
 
+func (hli *HttpListenInput) ReportMsg(msg *message.Message) error {
+	message.NewInt64Field(msg, "RejectedAuth", atomic.LoadInt64(&hli.rejectedAuth), "count")
+	message.NewInt64Field(msg, "RejectedRate", atomic.LoadInt64(&hli.rejectedRate), "count")
+	message.NewInt64Field(msg, "BadRequests", atomic.LoadInt64(&hli.badRequests), "count")
+	return nil
+}
+
+// Returns the IP address a request was sent from.
+func sourceIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// Token buckets limiting the rate of requests from each source IP. Requests
+// over the limit are rejected.
+type sourceLimiter struct {
+	rate      float64
+	burst     float64
+	buckets   map[string]*tokenBucket
+	lastPrune time.Time
+	lock      sync.Mutex
+	// Swapped out in tests.
+	now func() time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Returns a limiter for the specified rate, or nil if the rate is zero. The
+// burst defaults to one second's worth of requests.
+func newSourceLimiter(perSec, burst uint) *sourceLimiter {
+	if perSec == 0 {
+		return nil
+	}
+	if burst == 0 {
+		burst = perSec
+	}
+	return &sourceLimiter{
+		rate:    float64(perSec),
+		burst:   float64(burst),
+		buckets: make(map[string]*tokenBucket),
+		now:     time.Now,
+	}
+}
+
+// Takes a token from the source's bucket if one is available, returning
+// whether it was.
+func (l *sourceLimiter) allow(source string) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	now := l.now()
+	// Full buckets are forgotten, so the map only holds recent sources.
+	if now.Sub(l.lastPrune) > time.Minute {
+		for s, b := range l.buckets {
+			if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+				delete(l.buckets, s)
+			}
+		}
+		l.lastPrune = now
+	}
+	b, ok := l.buckets[source]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[source] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * l.rate
+	if b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
 func init() {
 	RegisterPlugin("HttpListenInput", func() interface{} {
 		return new(HttpListenInput)
@@ -12,6 +12,15 @@
 package http
 
 import (
+	"bytes"
+	"code.google.com/p/gogoprotobuf/proto"
+	"compress/gzip"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/mozilla-services/heka/client"
+	"github.com/mozilla-services/heka/message"
 	. "github.com/mozilla-services/heka/pipeline"
 	pipeline_ts "github.com/mozilla-services/heka/pipeline/testsupport"
 	"github.com/mozilla-services/heka/pipelinemock"
@@ -23,6 +32,7 @@ import (
 	"reflect"
 	"strings"
 	"sync"
+	"time"
 )
 
 func HttpListenInputSpec(c gs.Context) {
@@ -52,8 +62,12 @@ func HttpListenInputSpec(c gs.Context) {
 		ith.MockInputRunner.EXPECT().Name().Return("HttpListenInput")
 		var deliverWg sync.WaitGroup
 		deliverWg.Add(1)
+		var onDeliver func(pack *PipelinePack)
 		deliverCall := ith.MockInputRunner.EXPECT().Deliver(ith.Pack)
 		deliverCall.Do(func(pack *PipelinePack) {
+			if onDeliver != nil {
+				onDeliver(pack)
+			}
 			deliverWg.Done()
 		})
 		ith.MockHelper.EXPECT().PipelineConfig().Return(pConfig)
@@ -150,7 +164,204 @@ func HttpListenInputSpec(c gs.Context) {
 			c.Expect(payload, gs.Equals, "1+2")
 		})
 
+		c.Specify("Responds with the delivery report", func() {
+			config.DeliveryReport = "router"
+			// Dropping the pack without routing it fails the delivery.
+			onDeliver = func(pack *PipelinePack) {
+				pack.Recycle()
+			}
+			err := httpListenInput.Init(config)
+			ts.Config = httpListenInput.server
+			c.Assume(err, gs.IsNil)
+
+			startInput()
+			ith.PackSupply <- ith.Pack
+			<-startedChan
+			resp, err := http.Post(ts.URL, "text/plain", strings.NewReader("data"))
+			c.Assume(err, gs.IsNil)
+			var body map[string]interface{}
+			err = json.NewDecoder(resp.Body).Decode(&body)
+			resp.Body.Close()
+			c.Expect(err, gs.IsNil)
+			c.Expect(resp.StatusCode, gs.Equals, http.StatusServiceUnavailable)
+			c.Expect(body["delivered"], gs.Equals, false)
+			c.Expect(body["error"], gs.Equals, ErrDroppedBeforeRouter.Error())
+			deliverWg.Wait()
+		})
+
 		ts.Close()
 		httpListenInput.Stop()
 	})
+
+	c.Specify("A HttpListenInput handling requests", func() {
+		var delivered []*PipelinePack
+		ith.MockInputRunner.EXPECT().InChan().Return(ith.PackSupply).AnyTimes()
+		ith.MockInputRunner.EXPECT().Name().Return("HttpListenInput").AnyTimes()
+		ith.MockInputRunner.EXPECT().Deliver(gomock.Any()).Do(func(pack *PipelinePack) {
+			delivered = append(delivered, pack)
+		}).AnyTimes()
+		httpListenInput.ir = ith.MockInputRunner
+
+		handle := func(req *http.Request) *httptest.ResponseRecorder {
+			go func() {
+				for i := 0; i < 3; i++ {
+					ith.PackSupply <- NewPipelinePack(pConfig.InputRecycleChan())
+				}
+			}()
+			w := httptest.NewRecorder()
+			httpListenInput.RequestHandler(w, req)
+			// Drain the packs that weren't used.
+			for {
+				select {
+				case <-ith.PackSupply:
+					continue
+				case <-time.After(10 * time.Millisecond):
+				}
+				break
+			}
+			return w
+		}
+		post := func(body string) *http.Request {
+			req, _ := http.NewRequest("POST", "/", strings.NewReader(body))
+			req.RemoteAddr = "10.0.0.1:1234"
+			return req
+		}
+
+		c.Specify("splits newline delimited bodies", func() {
+			config.Split = "newline"
+			c.Assume(httpListenInput.Init(config), gs.IsNil)
+			w := handle(post("one\r\n\ntwo\n"))
+			c.Expect(w.Code, gs.Equals, 200)
+			c.Assume(len(delivered), gs.Equals, 2)
+			c.Expect(delivered[0].Message.GetPayload(), gs.Equals, "one")
+			c.Expect(delivered[1].Message.GetPayload(), gs.Equals, "two")
+		})
+
+		c.Specify("splits JSON arrays", func() {
+			config.Split = "json_array"
+			config.UnescapeBody = false
+			c.Assume(httpListenInput.Init(config), gs.IsNil)
+			w := handle(post(`[{"a":1}, "b"]`))
+			c.Expect(w.Code, gs.Equals, 200)
+			c.Assume(len(delivered), gs.Equals, 2)
+			c.Expect(delivered[0].Message.GetPayload(), gs.Equals, `{"a":1}`)
+			c.Expect(delivered[1].Message.GetPayload(), gs.Equals, `"b"`)
+
+			w = handle(post(`{"a":1}`))
+			c.Expect(w.Code, gs.Equals, http.StatusBadRequest)
+		})
+
+		c.Specify("splits framed protobuf messages", func() {
+			config.Split = "protobuf"
+			c.Assume(httpListenInput.Init(config), gs.IsNil)
+			var body []byte
+			for _, payload := range []string{"first", "second"} {
+				msg := pipeline_ts.GetTestMessage()
+				msg.SetPayload(payload)
+				msgBytes, _ := proto.Marshal(msg)
+				var framed []byte
+				c.Assume(client.CreateHekaStream(msgBytes, &framed, nil), gs.IsNil)
+				body = append(body, framed...)
+			}
+			w := handle(post(string(body)))
+			c.Expect(w.Code, gs.Equals, 200)
+			c.Assume(len(delivered), gs.Equals, 2)
+			msg := new(message.Message)
+			c.Assume(proto.Unmarshal(delivered[1].MsgBytes, msg), gs.IsNil)
+			c.Expect(msg.GetPayload(), gs.Equals, "second")
+		})
+
+		c.Specify("decodes gzipped bodies", func() {
+			c.Assume(httpListenInput.Init(config), gs.IsNil)
+			var buf bytes.Buffer
+			gz := gzip.NewWriter(&buf)
+			gz.Write([]byte("compressed"))
+			gz.Close()
+			req := post(buf.String())
+			req.Header.Set("Content-Encoding", "gzip")
+			w := handle(req)
+			c.Expect(w.Code, gs.Equals, 200)
+			c.Assume(len(delivered), gs.Equals, 1)
+			c.Expect(delivered[0].Message.GetPayload(), gs.Equals, "compressed")
+		})
+
+		c.Specify("rejects bodies over the maximum size", func() {
+			config.MaxBodySize = 4
+			c.Assume(httpListenInput.Init(config), gs.IsNil)
+			w := handle(post("12345"))
+			c.Expect(w.Code, gs.Equals, http.StatusRequestEntityTooLarge)
+			c.Expect(len(delivered), gs.Equals, 0)
+		})
+
+		c.Specify("checks basic credentials", func() {
+			config.Auth = "basic"
+			config.User = "heka"
+			config.Password = "secret"
+			c.Assume(httpListenInput.Init(config), gs.IsNil)
+			req := post("data")
+			req.SetBasicAuth("heka", "wrong")
+			w := handle(req)
+			c.Expect(w.Code, gs.Equals, http.StatusUnauthorized)
+			c.Expect(w.Header().Get("WWW-Authenticate"), gs.Equals, `Basic realm="heka"`)
+			req = post("data")
+			req.SetBasicAuth("heka", "secret")
+			c.Expect(handle(req).Code, gs.Equals, 200)
+			c.Expect(len(delivered), gs.Equals, 1)
+		})
+
+		c.Specify("checks bearer tokens", func() {
+			config.Auth = "bearer"
+			config.Tokens = []string{"t1", "t2"}
+			c.Assume(httpListenInput.Init(config), gs.IsNil)
+			c.Expect(handle(post("data")).Code, gs.Equals, http.StatusUnauthorized)
+			req := post("data")
+			req.Header.Set("Authorization", "Bearer t2")
+			c.Expect(handle(req).Code, gs.Equals, 200)
+		})
+
+		c.Specify("checks HMAC signatures", func() {
+			config.Auth = "hmac"
+			config.HmacKey = "key"
+			c.Assume(httpListenInput.Init(config), gs.IsNil)
+			mac := hmac.New(sha256.New, []byte("key"))
+			mac.Write([]byte("data"))
+			signature := hex.EncodeToString(mac.Sum(nil))
+
+			req := post("data")
+			req.Header.Set("X-Signature", "sha256="+signature)
+			c.Expect(handle(req).Code, gs.Equals, 200)
+			req = post("tampered")
+			req.Header.Set("X-Signature", signature)
+			c.Expect(handle(req).Code, gs.Equals, http.StatusUnauthorized)
+			c.Expect(len(delivered), gs.Equals, 1)
+		})
+
+		c.Specify("limits requests per source IP", func() {
+			config.MaxRequestsPerSec = 1
+			config.Burst = 2
+			c.Assume(httpListenInput.Init(config), gs.IsNil)
+			now := time.Unix(1000, 0)
+			httpListenInput.limiter.now = func() time.Time { return now }
+
+			c.Expect(handle(post("1")).Code, gs.Equals, 200)
+			c.Expect(handle(post("2")).Code, gs.Equals, 200)
+			w := handle(post("3"))
+			c.Expect(w.Code, gs.Equals, 429)
+			c.Expect(w.Header().Get("Retry-After"), gs.Equals, "1")
+			other := post("4")
+			other.RemoteAddr = "10.0.0.2:1234"
+			c.Expect(handle(other).Code, gs.Equals, 200)
+			now = now.Add(time.Second)
+			c.Expect(handle(post("5")).Code, gs.Equals, 200)
+			c.Expect(len(delivered), gs.Equals, 4)
+		})
+
+		c.Specify("rejects invalid settings", func() {
+			config.Split = "xml"
+			c.Expect(httpListenInput.Init(config), gs.Not(gs.IsNil))
+			config.Split = "none"
+			config.Auth = "hmac"
+			c.Expect(httpListenInput.Init(config), gs.Not(gs.IsNil))
+		})
+	})
 }
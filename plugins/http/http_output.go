@@ -24,6 +24,7 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -99,16 +100,25 @@ func (o *HttpOutput) Run(or pipeline.OutputRunner, h pipeline.PluginHelper) (err
 
 	for pack := range inChan {
 		outBytes, e = or.Encode(pack)
-		pack.Recycle()
 		if e != nil {
-			or.LogError(e)
+			or.HandleFailure(pack, pipeline.NewMalformedMessageError(e))
 			continue
 		}
 		if outBytes == nil {
+			pack.Recycle()
 			continue
 		}
-		if e = o.request(or, outBytes); e != nil {
-			or.LogError(e)
+		for {
+			if e = o.request(or, outBytes); e == nil {
+				pack.Recycle()
+				break
+			}
+			if !or.HandleFailure(pack, e) {
+				if pipeline.ClassifyError(e) == pipeline.ErrKindFatal {
+					return e
+				}
+				break
+			}
 		}
 	}
 
@@ -138,7 +148,8 @@ func (o *HttpOutput) request(or pipeline.OutputRunner, outBytes []byte) (err err
 		req.Body = readCloser
 	}
 	if resp, err = o.client.Do(req); err != nil {
-		return fmt.Errorf("Error making HTTP request: %s", err.Error())
+		return pipeline.NewRetryableError(
+			fmt.Errorf("Error making HTTP request: %s", err.Error()))
 	}
 	defer resp.Body.Close()
 
@@ -148,12 +159,33 @@ func (o *HttpOutput) request(or pipeline.OutputRunner, outBytes []byte) (err err
 			body = make([]byte, resp.ContentLength)
 			resp.Body.Read(body)
 		}
-		return fmt.Errorf("HTTP Error code returned: %d %s - %s",
+		err = fmt.Errorf("HTTP Error code returned: %d %s - %s",
 			resp.StatusCode, resp.Status, string(body))
+		return classifyResponse(resp, err)
 	}
 	return
 }
 
+// Classifies an HTTP error response so the OutputRunner knows whether the
+// request is worth retrying.
+func classifyResponse(resp *http.Response, err error) error {
+	switch {
+	case resp.StatusCode == 429 ||
+		resp.StatusCode == http.StatusServiceUnavailable:
+		var retryAfter time.Duration
+		if secs, e := strconv.Atoi(resp.Header.Get("Retry-After")); e == nil {
+			retryAfter = time.Duration(secs) * time.Second
+		}
+		return pipeline.NewThrottledError(err, retryAfter)
+	case resp.StatusCode == http.StatusUnauthorized ||
+		resp.StatusCode == http.StatusForbidden:
+		return pipeline.NewFatalError(err)
+	case resp.StatusCode >= 500:
+		return pipeline.NewRetryableError(err)
+	}
+	return pipeline.NewMalformedMessageError(err)
+}
+
 func init() {
 	pipeline.RegisterPlugin("HttpOutput", func() interface{} {
 		return new(HttpOutput)
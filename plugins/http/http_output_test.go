@@ -204,10 +204,11 @@ func HttpOutputSpec(c gs.Context) {
 				c.Expect(err, gs.IsNil)
 
 				var errMsg string
-				oth.MockOutputRunner.EXPECT().LogError(gomock.Any()).Do(
-					func(err error) {
+				oth.MockOutputRunner.EXPECT().HandleFailure(pack, gomock.Any()).Do(
+					func(pack *pipeline.PipelinePack, err error) {
 						errMsg = err.Error()
-					})
+						c.Expect(pipeline.ClassifyError(err), gs.Equals, pipeline.ErrKindRetryable)
+					}).Return(false)
 				runWg.Add(1)
 				go runOutput()
 				handleWg.Add(1)
@@ -219,16 +220,33 @@ func HttpOutputSpec(c gs.Context) {
 					"HTTP Error code returned: 500"), gs.IsTrue)
 			})
 
+			c.Specify("retries error responses until the runner gives up", func() {
+				handler.respBody = ""
+				handler.respCode = 500
+				err := httpOutput.Init(config)
+				c.Expect(err, gs.IsNil)
+
+				oth.MockOutputRunner.EXPECT().HandleFailure(pack, gomock.Any()).Return(true)
+				oth.MockOutputRunner.EXPECT().HandleFailure(pack, gomock.Any()).Return(false)
+				runWg.Add(1)
+				go runOutput()
+				handleWg.Add(2)
+				inChan <- pack
+				close(inChan)
+				handleWg.Wait()
+				runWg.Wait()
+			})
+
 			c.Specify("honors http timeout interval", func() {
 				config.HttpTimeout = 1 // 1 millisecond
 				err := httpOutput.Init(config)
 				c.Expect(err, gs.IsNil)
 
 				var errMsg string
-				oth.MockOutputRunner.EXPECT().LogError(gomock.Any()).Do(
-					func(err error) {
+				oth.MockOutputRunner.EXPECT().HandleFailure(pack, gomock.Any()).Do(
+					func(pack *pipeline.PipelinePack, err error) {
 						errMsg = err.Error()
-					})
+					}).Return(false)
 				delay = true
 				runWg.Add(1)
 				go runOutput()
@@ -0,0 +1,56 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package http
+
+import (
+	"crypto/tls"
+	"fmt"
+	"golang.org/x/net/websocket"
+	"net"
+	"net/http"
+)
+
+// Returns a WebSocket server calling `handler` for each connection to
+// `path`. Connections are only accepted from the listed origins, from any
+// origin if there are none.
+func newWebSocketServer(path string, origins []string,
+	handler func(*websocket.Conn)) *http.Server {
+
+	allowed := make(map[string]bool, len(origins))
+	for _, origin := range origins {
+		allowed[origin] = true
+	}
+	ws := websocket.Server{
+		Handler: handler,
+		Handshake: func(config *websocket.Config, req *http.Request) error {
+			if len(allowed) > 0 && !allowed[req.Header.Get("Origin")] {
+				return fmt.Errorf("origin '%s' isn't allowed", req.Header.Get("Origin"))
+			}
+			return nil
+		},
+	}
+	mux := http.NewServeMux()
+	mux.Handle(path, ws)
+	return &http.Server{Handler: mux}
+}
+
+// Listens on an address, with TLS if a config is provided.
+func listenWebSocket(address string, tlsConfig *tls.Config) (net.Listener, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, fmt.Errorf("can't listen on %s: %s", address, err)
+	}
+	if tlsConfig != nil {
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+	return listener, nil
+}
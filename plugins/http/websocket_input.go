@@ -0,0 +1,202 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package http
+
+import (
+	"code.google.com/p/go-uuid/uuid"
+	"crypto/tls"
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+	"github.com/mozilla-services/heka/pipeline"
+	"github.com/mozilla-services/heka/plugins/tcp"
+	"golang.org/x/net/websocket"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type WebSocketInputConfig struct {
+	// Address to listen on.
+	Address string
+	// Path of the WebSocket endpoint.
+	Path string
+	// Origins clients may connect from, any if empty.
+	Origins []string
+	// "text", each WebSocket message becomes the payload of a message, or
+	// "protobuf", each WebSocket message holds framed Heka messages.
+	Format string
+	// Maximum size in bytes of a WebSocket message.
+	MaxMessageSize int  `toml:"max_message_size"`
+	UseTls         bool `toml:"use_tls"`
+	Tls            tcp.TlsConfig
+}
+
+// Accepts WebSocket connections from clients pushing messages, e.g. JSON
+// documents to be parsed by a decoder, or framed Heka protobuf messages.
+type WebSocketInput struct {
+	messagesReceived int64
+	clientsConnected int64
+
+	conf      *WebSocketInputConfig
+	ir        pipeline.InputRunner
+	tlsConfig *tls.Config
+	server    *http.Server
+	listener  net.Listener
+	conns     map[*websocket.Conn]bool
+	connsLock sync.Mutex
+	stopChan  chan struct{}
+	stopOnce  sync.Once
+}
+
+func (wi *WebSocketInput) ConfigStruct() interface{} {
+	return &WebSocketInputConfig{
+		Address:        "127.0.0.1:8327",
+		Path:           "/",
+		Format:         "text",
+		MaxMessageSize: 1024 * 1024,
+		Tls:            tcp.TlsConfig{PreferServerCiphers: true},
+	}
+}
+
+func (wi *WebSocketInput) Init(config interface{}) (err error) {
+	wi.conf = config.(*WebSocketInputConfig)
+	if wi.conf.Format != "text" && wi.conf.Format != "protobuf" {
+		return fmt.Errorf(`invalid format "%s", must be "text" or "protobuf"`,
+			wi.conf.Format)
+	}
+	if wi.conf.UseTls {
+		if wi.tlsConfig, err = tcp.CreateGoTlsConfig(&wi.conf.Tls); err != nil {
+			return fmt.Errorf("TLS init error: %s", err)
+		}
+	}
+	wi.conns = make(map[*websocket.Conn]bool)
+	wi.stopChan = make(chan struct{})
+	wi.server = newWebSocketServer(wi.conf.Path, wi.conf.Origins, wi.handle)
+	return
+}
+
+func (wi *WebSocketInput) Run(ir pipeline.InputRunner, h pipeline.PluginHelper) (err error) {
+	wi.ir = ir
+	if wi.listener, err = listenWebSocket(wi.conf.Address, wi.tlsConfig); err != nil {
+		return
+	}
+	ir.LogMessage(fmt.Sprintf("Listening on %s", wi.conf.Address))
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- wi.server.Serve(wi.listener)
+	}()
+	select {
+	case err = <-errChan:
+		select {
+		case <-wi.stopChan:
+			return nil
+		default:
+		}
+		wi.Stop()
+		return fmt.Errorf("server failed: %s", err)
+	case <-wi.stopChan:
+	}
+	return nil
+}
+
+func (wi *WebSocketInput) Stop() {
+	wi.stopOnce.Do(func() {
+		close(wi.stopChan)
+		if wi.listener != nil {
+			wi.listener.Close()
+		}
+		wi.connsLock.Lock()
+		for ws := range wi.conns {
+			ws.Close()
+		}
+		wi.connsLock.Unlock()
+	})
+}
+
+// Delivers the messages pushed by a client until it disconnects.
+func (wi *WebSocketInput) handle(ws *websocket.Conn) {
+	wi.connsLock.Lock()
+	wi.conns[ws] = true
+	wi.connsLock.Unlock()
+	atomic.AddInt64(&wi.clientsConnected, 1)
+	defer func() {
+		wi.connsLock.Lock()
+		delete(wi.conns, ws)
+		wi.connsLock.Unlock()
+		atomic.AddInt64(&wi.clientsConnected, -1)
+		ws.Close()
+	}()
+	ws.MaxPayloadBytes = wi.conf.MaxMessageSize
+	remoteAddr := ws.Request().RemoteAddr
+
+	for {
+		var data []byte
+		if err := websocket.Message.Receive(ws, &data); err != nil {
+			select {
+			case <-wi.stopChan:
+			default:
+				if err != io.EOF {
+					wi.ir.LogError(fmt.Errorf("client %s: %s", remoteAddr, err))
+				}
+			}
+			return
+		}
+		records := [][]byte{data}
+		if wi.conf.Format == "protobuf" {
+			var err error
+			if records, err = splitBody("protobuf", data); err != nil {
+				wi.ir.LogError(fmt.Errorf("client %s: %s", remoteAddr, err))
+				continue
+			}
+		}
+		for _, record := range records {
+			var pack *pipeline.PipelinePack
+			select {
+			case pack = <-wi.ir.InChan():
+			case <-wi.stopChan:
+				return
+			}
+			if wi.conf.Format == "protobuf" {
+				pack.MsgBytes = append(pack.MsgBytes[:0], record...)
+			} else {
+				pack.Message.SetUuid(uuid.NewRandom())
+				pack.Message.SetTimestamp(time.Now().UnixNano())
+				pack.Message.SetType("heka.websocket")
+				pack.Message.SetLogger(wi.ir.Name())
+				pack.Message.SetHostname(remoteAddr)
+				pack.Message.SetPid(int32(os.Getpid()))
+				pack.Message.SetSeverity(int32(6))
+				pack.Message.SetPayload(string(record))
+			}
+			wi.ir.Deliver(pack)
+			atomic.AddInt64(&wi.messagesReceived, 1)
+		}
+	}
+}
+
+func (wi *WebSocketInput) ReportMsg(msg *message.Message) error {
+	message.NewInt64Field(msg, "MessagesReceived",
+		atomic.LoadInt64(&wi.messagesReceived), "count")
+	message.NewInt64Field(msg, "ClientsConnected",
+		atomic.LoadInt64(&wi.clientsConnected), "count")
+	return nil
+}
+
+func init() {
+	pipeline.RegisterPlugin("WebSocketInput", func() interface{} {
+		return new(WebSocketInput)
+	})
+}
@@ -0,0 +1,242 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package http
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+	"github.com/mozilla-services/heka/pipeline"
+	"github.com/mozilla-services/heka/plugins/tcp"
+	"golang.org/x/net/websocket"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type WebSocketOutputConfig struct {
+	// Address to listen on.
+	Address string
+	// Path of the WebSocket endpoint.
+	Path string
+	// Origins clients may connect from, any if empty.
+	Origins []string
+	// Set to true to send the encoded messages as binary WebSocket messages,
+	// e.g. with the ProtobufEncoder, rather than as text.
+	Binary bool
+	// Maximum number of connected clients, 0 for no limit.
+	MaxClients int `toml:"max_clients"`
+	// Number of messages queued for each client. Messages are dropped for
+	// clients that fall further behind.
+	ClientBuffer int `toml:"client_buffer"`
+	// Milliseconds after which a client that doesn't accept a message is
+	// disconnected.
+	WriteTimeout uint32 `toml:"write_timeout"`
+	UseTls       bool   `toml:"use_tls"`
+	Tls          tcp.TlsConfig
+}
+
+// Streams the messages it's sent to every connected WebSocket client, e.g.
+// for live tailing UIs. Clients can select messages with a message matcher
+// passed as the `match` query parameter. The output never waits for slow
+// clients, messages are dropped for clients whose queue is full.
+type WebSocketOutput struct {
+	messagesSent     int64
+	messagesDropped  int64
+	clientsConnected int64
+
+	conf        *WebSocketOutputConfig
+	tlsConfig   *tls.Config
+	server      *http.Server
+	listener    net.Listener
+	clients     map[*webSocketClient]bool
+	clientsLock sync.RWMutex
+	stopChan    chan struct{}
+}
+
+// A connected client of the output.
+type webSocketClient struct {
+	ws *websocket.Conn
+	// Nil if the client receives every message.
+	matcher *message.MatcherSpecification
+	queue   chan []byte
+}
+
+func (wo *WebSocketOutput) ConfigStruct() interface{} {
+	return &WebSocketOutputConfig{
+		Address:      "127.0.0.1:8328",
+		Path:         "/",
+		MaxClients:   100,
+		ClientBuffer: 100,
+		WriteTimeout: 10000,
+		Tls:          tcp.TlsConfig{PreferServerCiphers: true},
+	}
+}
+
+func (wo *WebSocketOutput) Init(config interface{}) (err error) {
+	wo.conf = config.(*WebSocketOutputConfig)
+	if wo.conf.ClientBuffer < 1 {
+		return errors.New("client_buffer must be greater than 0")
+	}
+	if wo.conf.UseTls {
+		if wo.tlsConfig, err = tcp.CreateGoTlsConfig(&wo.conf.Tls); err != nil {
+			return fmt.Errorf("TLS init error: %s", err)
+		}
+	}
+	wo.clients = make(map[*webSocketClient]bool)
+	wo.stopChan = make(chan struct{})
+	wo.server = newWebSocketServer(wo.conf.Path, wo.conf.Origins, wo.handle)
+	return
+}
+
+func (wo *WebSocketOutput) Run(or pipeline.OutputRunner, h pipeline.PluginHelper) (err error) {
+	if or.Encoder() == nil {
+		return errors.New("encoder required")
+	}
+	if wo.listener, err = listenWebSocket(wo.conf.Address, wo.tlsConfig); err != nil {
+		return
+	}
+	go wo.server.Serve(wo.listener)
+	defer wo.stop()
+
+	for pack := range or.InChan() {
+		data, e := or.Encode(pack)
+		if e != nil {
+			or.LogError(e)
+		} else if data != nil {
+			wo.broadcast(pack.Message, data)
+		}
+		pack.Recycle()
+	}
+	return
+}
+
+// Closes the listener and disconnects every client.
+func (wo *WebSocketOutput) stop() {
+	close(wo.stopChan)
+	wo.listener.Close()
+	wo.clientsLock.RLock()
+	for client := range wo.clients {
+		client.ws.Close()
+	}
+	wo.clientsLock.RUnlock()
+}
+
+// Queues an encoded message for each client it matches.
+func (wo *WebSocketOutput) broadcast(msg *message.Message, data []byte) {
+	// The encoder may reuse its buffer.
+	data = append([]byte(nil), data...)
+	wo.clientsLock.RLock()
+	defer wo.clientsLock.RUnlock()
+	for client := range wo.clients {
+		if client.matcher != nil && !client.matcher.Match(msg) {
+			continue
+		}
+		select {
+		case client.queue <- data:
+		default:
+			atomic.AddInt64(&wo.messagesDropped, 1)
+		}
+	}
+}
+
+// Sends the queued messages to a client until it disconnects.
+func (wo *WebSocketOutput) handle(ws *websocket.Conn) {
+	defer ws.Close()
+	client := &webSocketClient{
+		ws:    ws,
+		queue: make(chan []byte, wo.conf.ClientBuffer),
+	}
+	if spec := ws.Request().URL.Query().Get("match"); spec != "" {
+		var err error
+		if client.matcher, err = message.CreateMatcherSpecification(spec); err != nil {
+			websocket.Message.Send(ws, fmt.Sprintf("invalid match: %s", err))
+			return
+		}
+	}
+	if !wo.addClient(client) {
+		websocket.Message.Send(ws, "too many clients")
+		return
+	}
+	defer wo.removeClient(client)
+
+	// Clients aren't expected to send anything, reading only detects
+	// disconnections.
+	closed := make(chan struct{})
+	go func() {
+		io.Copy(ioutil.Discard, ws)
+		close(closed)
+	}()
+	timeout := time.Duration(wo.conf.WriteTimeout) * time.Millisecond
+	for {
+		select {
+		case data := <-client.queue:
+			if timeout > 0 {
+				ws.SetWriteDeadline(time.Now().Add(timeout))
+			}
+			var err error
+			if wo.conf.Binary {
+				err = websocket.Message.Send(ws, data)
+			} else {
+				err = websocket.Message.Send(ws, string(data))
+			}
+			if err != nil {
+				return
+			}
+			atomic.AddInt64(&wo.messagesSent, 1)
+		case <-closed:
+			return
+		case <-wo.stopChan:
+			return
+		}
+	}
+}
+
+// Registers a client, returning false if the maximum number of clients is
+// already connected.
+func (wo *WebSocketOutput) addClient(client *webSocketClient) bool {
+	wo.clientsLock.Lock()
+	defer wo.clientsLock.Unlock()
+	if wo.conf.MaxClients > 0 && len(wo.clients) >= wo.conf.MaxClients {
+		return false
+	}
+	wo.clients[client] = true
+	atomic.AddInt64(&wo.clientsConnected, 1)
+	return true
+}
+
+func (wo *WebSocketOutput) removeClient(client *webSocketClient) {
+	wo.clientsLock.Lock()
+	delete(wo.clients, client)
+	wo.clientsLock.Unlock()
+	atomic.AddInt64(&wo.clientsConnected, -1)
+}
+
+func (wo *WebSocketOutput) ReportMsg(msg *message.Message) error {
+	message.NewInt64Field(msg, "MessagesSent", atomic.LoadInt64(&wo.messagesSent), "count")
+	message.NewInt64Field(msg, "MessagesDropped",
+		atomic.LoadInt64(&wo.messagesDropped), "count")
+	message.NewInt64Field(msg, "ClientsConnected",
+		atomic.LoadInt64(&wo.clientsConnected), "count")
+	return nil
+}
+
+func init() {
+	pipeline.RegisterPlugin("WebSocketOutput", func() interface{} {
+		return new(WebSocketOutput)
+	})
+}
@@ -0,0 +1,203 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package http
+
+import (
+	"code.google.com/p/gogoprotobuf/proto"
+	"github.com/mozilla-services/heka/client"
+	"github.com/mozilla-services/heka/message"
+	. "github.com/mozilla-services/heka/pipeline"
+	pipeline_ts "github.com/mozilla-services/heka/pipeline/testsupport"
+	"github.com/mozilla-services/heka/pipelinemock"
+	"github.com/rafrombrc/gomock/gomock"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"golang.org/x/net/websocket"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+func WebSocketSpec(c gs.Context) {
+	t := &pipeline_ts.SimpleT{}
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	dial := func(server *httptest.Server, query string) *websocket.Conn {
+		u := "ws" + strings.TrimPrefix(server.URL, "http") + "/" + query
+		ws, err := websocket.Dial(u, "", "http://localhost/")
+		c.Assume(err, gs.IsNil)
+		return ws
+	}
+
+	c.Specify("A WebSocketInput", func() {
+		input := new(WebSocketInput)
+		config := input.ConfigStruct().(*WebSocketInputConfig)
+		ir := pipelinemock.NewMockInputRunner(ctrl)
+		packs := make(chan *PipelinePack, 1)
+		packs <- NewPipelinePack(packs)
+		delivered := make(chan *PipelinePack, 10)
+		ir.EXPECT().InChan().Return(packs).AnyTimes()
+		ir.EXPECT().Name().Return("WebSocketInput").AnyTimes()
+		ir.EXPECT().LogError(gomock.Any()).AnyTimes()
+		ir.EXPECT().Deliver(gomock.Any()).Do(func(pack *PipelinePack) {
+			copied := NewPipelinePack(nil)
+			copied.Message = message.CopyMessage(pack.Message)
+			copied.MsgBytes = append(copied.MsgBytes[:0], pack.MsgBytes...)
+			delivered <- copied
+			pack.Recycle()
+		}).AnyTimes()
+
+		start := func() *httptest.Server {
+			c.Assume(input.Init(config), gs.IsNil)
+			input.ir = ir
+			return httptest.NewServer(input.server.Handler)
+		}
+
+		c.Specify("delivers text messages", func() {
+			server := start()
+			defer server.Close()
+			defer input.Stop()
+			ws := dial(server, "")
+			defer ws.Close()
+			c.Assume(websocket.Message.Send(ws, `{"level":"info"}`), gs.IsNil)
+			pack := <-delivered
+			c.Expect(pack.Message.GetPayload(), gs.Equals, `{"level":"info"}`)
+			c.Expect(pack.Message.GetType(), gs.Equals, "heka.websocket")
+			c.Expect(pack.Message.GetLogger(), gs.Equals, "WebSocketInput")
+			c.Expect(atomic.LoadInt64(&input.messagesReceived), gs.Equals, int64(1))
+		})
+
+		c.Specify("delivers framed protobuf messages", func() {
+			config.Format = "protobuf"
+			server := start()
+			defer server.Close()
+			defer input.Stop()
+			ws := dial(server, "")
+			defer ws.Close()
+
+			var data []byte
+			for _, payload := range []string{"one", "two"} {
+				msg := pipeline_ts.GetTestMessage()
+				msg.SetPayload(payload)
+				msgBytes, _ := proto.Marshal(msg)
+				var framed []byte
+				c.Assume(client.CreateHekaStream(msgBytes, &framed, nil), gs.IsNil)
+				data = append(data, framed...)
+			}
+			c.Assume(websocket.Message.Send(ws, data), gs.IsNil)
+			for _, payload := range []string{"one", "two"} {
+				pack := <-delivered
+				msg := new(message.Message)
+				c.Assume(proto.Unmarshal(pack.MsgBytes, msg), gs.IsNil)
+				c.Expect(msg.GetPayload(), gs.Equals, payload)
+			}
+		})
+
+		c.Specify("rejects other origins", func() {
+			config.Origins = []string{"https://logs.example.com"}
+			server := start()
+			defer server.Close()
+			defer input.Stop()
+			u := "ws" + strings.TrimPrefix(server.URL, "http") + "/"
+			_, err := websocket.Dial(u, "", "http://localhost/")
+			c.Expect(err, gs.Not(gs.IsNil))
+			ws, err := websocket.Dial(u, "", "https://logs.example.com")
+			c.Assume(err, gs.IsNil)
+			ws.Close()
+		})
+
+		c.Specify("rejects invalid formats", func() {
+			config.Format = "xml"
+			c.Expect(input.Init(config), gs.Not(gs.IsNil))
+		})
+	})
+
+	c.Specify("A WebSocketOutput", func() {
+		output := new(WebSocketOutput)
+		config := output.ConfigStruct().(*WebSocketOutputConfig)
+		config.ClientBuffer = 2
+
+		newMessage := func(typ, payload string) *message.Message {
+			msg := new(message.Message)
+			msg.SetType(typ)
+			msg.SetPayload(payload)
+			return msg
+		}
+		start := func() *httptest.Server {
+			c.Assume(output.Init(config), gs.IsNil)
+			return httptest.NewServer(output.server.Handler)
+		}
+		// Waits for the expected number of clients to be registered.
+		waitClients := func(n int64) {
+			for i := 0; i < 100 && atomic.LoadInt64(&output.clientsConnected) != n; i++ {
+				time.Sleep(10 * time.Millisecond)
+			}
+			c.Assume(atomic.LoadInt64(&output.clientsConnected), gs.Equals, n)
+		}
+		receive := func(ws *websocket.Conn) string {
+			var data string
+			ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+			c.Assume(websocket.Message.Receive(ws, &data), gs.IsNil)
+			return data
+		}
+
+		c.Specify("streams matching messages to clients", func() {
+			server := start()
+			defer server.Close()
+			all := dial(server, "")
+			defer all.Close()
+			errors := dial(server, "?match="+url.QueryEscape("Type == 'error'"))
+			defer errors.Close()
+			waitClients(2)
+
+			output.broadcast(newMessage("info", ""), []byte("first"))
+			output.broadcast(newMessage("error", ""), []byte("second"))
+			c.Expect(receive(all), gs.Equals, "first")
+			c.Expect(receive(all), gs.Equals, "second")
+			c.Expect(receive(errors), gs.Equals, "second")
+		})
+
+		c.Specify("drops messages for slow clients", func() {
+			c.Assume(output.Init(config), gs.IsNil)
+			slow := &webSocketClient{queue: make(chan []byte, config.ClientBuffer)}
+			output.clients[slow] = true
+			for _, data := range []string{"a", "b", "c"} {
+				output.broadcast(newMessage("info", ""), []byte(data))
+			}
+			c.Expect(len(slow.queue), gs.Equals, 2)
+			c.Expect(string(<-slow.queue), gs.Equals, "a")
+			c.Expect(atomic.LoadInt64(&output.messagesDropped), gs.Equals, int64(1))
+		})
+
+		c.Specify("refuses clients over the limit", func() {
+			config.MaxClients = 1
+			server := start()
+			defer server.Close()
+			first := dial(server, "")
+			defer first.Close()
+			waitClients(1)
+			second := dial(server, "")
+			defer second.Close()
+			c.Expect(receive(second), gs.Equals, "too many clients")
+		})
+
+		c.Specify("rejects invalid matchers", func() {
+			server := start()
+			defer server.Close()
+			ws := dial(server, "?match="+url.QueryEscape("Type ==="))
+			defer ws.Close()
+			c.Expect(strings.HasPrefix(receive(ws), "invalid match"), gs.IsTrue)
+		})
+	})
+}
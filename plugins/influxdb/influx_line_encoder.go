@@ -0,0 +1,229 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package influxdb
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/mozilla-services/heka/pipeline"
+	"github.com/mozilla-services/heka/plugins"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// InfluxLineEncoder serializes each message to a single point in the
+// InfluxDB line protocol, mapping message values to the point's measurement,
+// tags, and fields.
+type InfluxLineEncoder struct {
+	conf        *InfluxLineEncoderConfig
+	measurement *plugins.ColumnMapping
+	tags        *plugins.ColumnMapping
+	fields      *plugins.ColumnMapping // nil to write all the dynamic fields.
+	tagFields   map[string]bool        // Dynamic fields used as tags.
+	divisor     int64
+}
+
+type InfluxLineEncoderConfig struct {
+	// Measurement of the points.
+	Measurement string
+	// Message value used as the measurement instead, when the message has
+	// it, see plugins.NewColumnMapping.
+	MeasurementSource string `toml:"measurement_source"`
+	// Message values written as tags, by tag key. Tags without a value are
+	// left out.
+	Tags map[string]string
+	// Message values written as fields, by field key. Defaults to all of the
+	// dynamic fields not written as tags.
+	Fields map[string]string
+	// Precision of the timestamps, "ns", "us", "ms", or "s".
+	Precision string
+}
+
+// Timestamp divisors of the supported precisions.
+var precisions = map[string]int64{
+	"ns": 1,
+	"us": int64(time.Microsecond),
+	"ms": int64(time.Millisecond),
+	"s":  int64(time.Second),
+}
+
+var (
+	measurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `)
+	keyEscaper         = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+	stringEscaper      = strings.NewReplacer(`"`, `\"`, `\`, `\\`)
+)
+
+func (e *InfluxLineEncoder) ConfigStruct() interface{} {
+	return &InfluxLineEncoderConfig{
+		Measurement: "heka",
+		Precision:   "ns",
+	}
+}
+
+func (e *InfluxLineEncoder) Init(config interface{}) (err error) {
+	e.conf = config.(*InfluxLineEncoderConfig)
+	if e.conf.Measurement == "" && e.conf.MeasurementSource == "" {
+		return errors.New("measurement or measurement_source must be specified")
+	}
+	var ok bool
+	if e.divisor, ok = precisions[e.conf.Precision]; !ok {
+		return fmt.Errorf("invalid precision: %s", e.conf.Precision)
+	}
+	if e.conf.MeasurementSource != "" {
+		e.measurement, err = plugins.NewColumnMapping(map[string]string{
+			"measurement": e.conf.MeasurementSource})
+		if err != nil {
+			return
+		}
+	}
+	if e.tags, err = plugins.NewColumnMapping(e.conf.Tags); err != nil {
+		return
+	}
+	e.tagFields = make(map[string]bool)
+	for _, source := range e.conf.Tags {
+		if strings.HasPrefix(source, "Fields[") {
+			e.tagFields[source[len("Fields["):len(source)-1]] = true
+		}
+	}
+	if len(e.conf.Fields) > 0 {
+		e.fields, err = plugins.NewColumnMapping(e.conf.Fields)
+	}
+	return
+}
+
+func (e *InfluxLineEncoder) Encode(pack *pipeline.PipelinePack) (output []byte,
+	err error) {
+
+	msg := pack.Message
+	buf := new(bytes.Buffer)
+	measurement := e.conf.Measurement
+	if e.measurement != nil {
+		if value := e.measurement.Values(msg)[0]; value != nil {
+			if s := formatTag(value); s != "" {
+				measurement = s
+			}
+		}
+	}
+	if measurement == "" {
+		return nil, errors.New("message has no measurement")
+	}
+	buf.WriteString(measurementEscaper.Replace(measurement))
+
+	for i, value := range e.tags.Values(msg) {
+		if s := formatTag(value); s != "" {
+			buf.WriteByte(',')
+			buf.WriteString(keyEscaper.Replace(e.tags.Names[i]))
+			buf.WriteByte('=')
+			buf.WriteString(keyEscaper.Replace(s))
+		}
+	}
+
+	sep := byte(' ')
+	writeField := func(key string, value interface{}) {
+		s, ok := formatField(value)
+		if !ok {
+			return
+		}
+		buf.WriteByte(sep)
+		sep = ','
+		buf.WriteString(keyEscaper.Replace(key))
+		buf.WriteByte('=')
+		buf.WriteString(s)
+	}
+	if e.fields != nil {
+		for i, value := range e.fields.Values(msg) {
+			writeField(e.fields.Names[i], value)
+		}
+	} else {
+		names := make([]string, 0, len(msg.Fields))
+		values := make(map[string]interface{}, len(msg.Fields))
+		for _, f := range msg.Fields {
+			name := f.GetName()
+			if _, dup := values[name]; dup || e.tagFields[name] {
+				continue
+			}
+			names = append(names, name)
+			values[name] = f.GetValue()
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			writeField(name, values[name])
+		}
+	}
+	if sep == ' ' {
+		return nil, errors.New("message has no field values")
+	}
+
+	buf.WriteByte(' ')
+	buf.WriteString(strconv.FormatInt(floorDiv(msg.GetTimestamp(), e.divisor), 10))
+	buf.WriteByte('\n')
+	return buf.Bytes(), nil
+}
+
+// Divides a timestamp, rounding down so timestamps before the epoch aren't
+// moved forward.
+func floorDiv(ts, divisor int64) int64 {
+	q := ts / divisor
+	if ts%divisor < 0 {
+		q--
+	}
+	return q
+}
+
+// Returns a value as a tag value, "" if the tag should be left out.
+func formatTag(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	}
+	s, _ := formatField(value)
+	return strings.TrimSuffix(s, "i")
+}
+
+// Returns a value in the line protocol's field value syntax, false if it
+// can't be written: missing values and non-finite floats.
+func formatField(value interface{}) (string, bool) {
+	switch v := value.(type) {
+	case string:
+		return `"` + stringEscaper.Replace(v) + `"`, true
+	case []byte:
+		return `"` + stringEscaper.Replace(string(v)) + `"`, true
+	case int64:
+		return strconv.FormatInt(v, 10) + "i", true
+	case float64:
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return "", false
+		}
+		return strconv.FormatFloat(v, 'g', -1, 64), true
+	case bool:
+		return strconv.FormatBool(v), true
+	case time.Time:
+		return strconv.FormatInt(v.UnixNano(), 10) + "i", true
+	}
+	return "", false
+}
+
+func init() {
+	pipeline.RegisterPlugin("InfluxLineEncoder", func() interface{} {
+		return new(InfluxLineEncoder)
+	})
+}
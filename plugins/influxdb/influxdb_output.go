@@ -0,0 +1,310 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package influxdb
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+	"github.com/mozilla-services/heka/pipeline"
+	"github.com/mozilla-services/heka/plugins/tcp"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+type InfluxDBOutputConfig struct {
+	// Base URL of the server's HTTP API.
+	Address string
+	// Database written to.
+	Database string
+	// Retention policy written to. Defaults to the database's default one.
+	RetentionPolicy string `toml:"retention_policy"`
+	// Credentials sent with HTTP basic authentication.
+	Username string
+	Password string
+	// Token sent in the Authorization header instead of the credentials,
+	// e.g. for InfluxDB 2's v1 compatible write API.
+	Token string
+	// Write consistency for clustered servers, "any", "one", "quorum", or
+	// "all". Defaults to the server's setting.
+	Consistency string
+	// Precision of the points' timestamps, "ns", "us", "ms", or "s". Also
+	// used by the default encoder.
+	Precision string
+	// Measurement, measurement source, tags, and fields of the points when
+	// the output has no encoder, see InfluxLineEncoderConfig.
+	Measurement       string
+	MeasurementSource string `toml:"measurement_source"`
+	Tags              map[string]string
+	Fields            map[string]string
+	// Milliseconds after which accumulated points are written even if the
+	// batch isn't full.
+	FlushInterval uint32 `toml:"flush_interval"`
+	// Number of points that triggers a write.
+	FlushCount int `toml:"flush_count"`
+	// Milliseconds after which a write request times out, 0 for no timeout.
+	HttpTimeout uint32 `toml:"http_timeout"`
+	Tls         tcp.TlsConfig
+	// The output's retry settings, also used to back off from failed writes.
+	Retries pipeline.RetryOptions
+}
+
+// Writes messages to InfluxDB as points in the line protocol, accumulating
+// them into batches written with a single request to the HTTP write API.
+type InfluxDBOutput struct {
+	pointsWritten int64
+	pointsDropped int64
+	retries       int64
+
+	conf        *InfluxDBOutputConfig
+	writeUrl    string
+	client      *http.Client
+	encoder     *InfluxLineEncoder // Used when the output has no encoder.
+	retryHelper *pipeline.RetryHelper
+	pConfig     *pipeline.PipelineConfig
+	batch       []byte
+	count       int
+}
+
+func (o *InfluxDBOutput) ConfigStruct() interface{} {
+	return &InfluxDBOutputConfig{
+		Address:       "http://localhost:8086",
+		Precision:     "ns",
+		Measurement:   "heka",
+		FlushInterval: 1000,
+		FlushCount:    5000,
+		HttpTimeout:   10000,
+		Retries: pipeline.RetryOptions{
+			MaxDelay:   "30s",
+			Delay:      "250ms",
+			MaxRetries: -1,
+		},
+	}
+}
+
+func (o *InfluxDBOutput) SetPipelineConfig(pConfig *pipeline.PipelineConfig) {
+	o.pConfig = pConfig
+}
+
+func (o *InfluxDBOutput) Init(config interface{}) (err error) {
+	o.conf = config.(*InfluxDBOutputConfig)
+	if o.conf.Database == "" {
+		return errors.New("database must be specified")
+	}
+	if o.conf.FlushCount < 1 {
+		return errors.New("flush_count must be greater than 0")
+	}
+	switch o.conf.Consistency {
+	case "", "any", "one", "quorum", "all":
+	default:
+		return fmt.Errorf("invalid consistency: %s", o.conf.Consistency)
+	}
+	serverUrl, err := url.Parse(o.conf.Address)
+	if err != nil {
+		return fmt.Errorf("can't parse address '%s': %s", o.conf.Address, err)
+	}
+	if serverUrl.Scheme != "http" && serverUrl.Scheme != "https" {
+		return errors.New("address must contain an absolute http or https URL")
+	}
+
+	o.encoder = new(InfluxLineEncoder)
+	encoderConf := o.encoder.ConfigStruct().(*InfluxLineEncoderConfig)
+	encoderConf.Measurement = o.conf.Measurement
+	encoderConf.MeasurementSource = o.conf.MeasurementSource
+	encoderConf.Tags = o.conf.Tags
+	encoderConf.Fields = o.conf.Fields
+	encoderConf.Precision = o.conf.Precision
+	if err = o.encoder.Init(encoderConf); err != nil {
+		return
+	}
+
+	params := url.Values{}
+	params.Set("db", o.conf.Database)
+	if o.conf.RetentionPolicy != "" {
+		params.Set("rp", o.conf.RetentionPolicy)
+	}
+	if o.conf.Consistency != "" {
+		params.Set("consistency", o.conf.Consistency)
+	}
+	params.Set("precision", o.conf.Precision)
+	o.writeUrl = fmt.Sprintf("%s/write?%s", strings.TrimSuffix(o.conf.Address, "/"),
+		params.Encode())
+
+	o.client = new(http.Client)
+	if o.conf.HttpTimeout > 0 {
+		o.client.Timeout = time.Duration(o.conf.HttpTimeout) * time.Millisecond
+	}
+	if serverUrl.Scheme == "https" {
+		transport := &http.Transport{}
+		if transport.TLSClientConfig, err = tcp.CreateGoTlsConfig(&o.conf.Tls); err != nil {
+			return fmt.Errorf("TLS init error: %s", err)
+		}
+		o.client.Transport = transport
+	}
+	if o.retryHelper, err = pipeline.NewRetryHelper(o.conf.Retries); err != nil {
+		return fmt.Errorf("invalid retries: %s", err)
+	}
+	return
+}
+
+func (o *InfluxDBOutput) Run(or pipeline.OutputRunner, h pipeline.PluginHelper) (err error) {
+	ticker := time.NewTicker(time.Duration(o.conf.FlushInterval) * time.Millisecond)
+	defer ticker.Stop()
+	inChan := or.InChan()
+	for {
+		select {
+		case pack, ok := <-inChan:
+			if !ok {
+				return o.flush(or)
+			}
+			var point []byte
+			var e error
+			if or.Encoder() != nil {
+				point, e = or.Encode(pack)
+			} else {
+				point, e = o.encoder.Encode(pack)
+			}
+			pack.Recycle()
+			if e != nil {
+				or.LogError(fmt.Errorf("dropping point: %s", e))
+				atomic.AddInt64(&o.pointsDropped, 1)
+				continue
+			}
+			if point == nil {
+				continue
+			}
+			o.batch = append(o.batch, point...)
+			if o.count++; o.count >= o.conf.FlushCount {
+				if err = o.flush(or); err != nil {
+					return
+				}
+			}
+		case <-ticker.C:
+			if err = o.flush(or); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// Writes the accumulated points. Returns an error if the output must stop.
+func (o *InfluxDBOutput) flush(or pipeline.OutputRunner) error {
+	batch, count := o.batch, o.count
+	o.batch, o.count = nil, 0
+	if count == 0 {
+		return nil
+	}
+	return o.write(or, batch, count)
+}
+
+// Writes a batch of points, backing off and retrying while the failures are
+// worth retrying.
+func (o *InfluxDBOutput) write(or pipeline.OutputRunner, batch []byte, count int) error {
+	o.retryHelper.Reset()
+	for {
+		err := o.request(batch)
+		if err == nil {
+			atomic.AddInt64(&o.pointsWritten, int64(count))
+			return nil
+		}
+		switch pipeline.ClassifyError(err) {
+		case pipeline.ErrKindMalformed:
+			// InfluxDB writes the valid points of a batch and rejects the
+			// others, without saying how many it wrote.
+			or.LogError(fmt.Errorf("batch of %d points partially rejected: %s",
+				count, err))
+			atomic.AddInt64(&o.pointsDropped, int64(count))
+			return nil
+		case pipeline.ErrKindFatal:
+			atomic.AddInt64(&o.pointsDropped, int64(count))
+			return err
+		case pipeline.ErrKindThrottled:
+			if retryAfter := err.(*pipeline.OutputError).RetryAfter; retryAfter > 0 {
+				or.LogError(err)
+				time.Sleep(retryAfter)
+				continue
+			}
+		}
+		or.LogError(err)
+		if o.pConfig != nil && o.pConfig.Globals.IsShuttingDown() {
+			break
+		}
+		if o.retryHelper.Wait() != nil {
+			or.LogError(errors.New("retries exhausted"))
+			break
+		}
+		atomic.AddInt64(&o.retries, 1)
+	}
+	atomic.AddInt64(&o.pointsDropped, int64(count))
+	or.LogError(fmt.Errorf("dropping %d points", count))
+	return nil
+}
+
+// Sends a batch to the write API, returning a classified error if it wasn't
+// written.
+func (o *InfluxDBOutput) request(batch []byte) error {
+	req, err := http.NewRequest("POST", o.writeUrl, bytes.NewReader(batch))
+	if err != nil {
+		return pipeline.NewFatalError(err)
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if o.conf.Token != "" {
+		req.Header.Set("Authorization", "Token "+o.conf.Token)
+	} else if o.conf.Username != "" || o.conf.Password != "" {
+		req.SetBasicAuth(o.conf.Username, o.conf.Password)
+	}
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return pipeline.NewRetryableError(fmt.Errorf("write request failed: %s", err))
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 300 {
+		return nil
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	err = fmt.Errorf("write failed: %s - %s", resp.Status, strings.TrimSpace(string(body)))
+	switch {
+	case resp.StatusCode == 429 || resp.StatusCode == http.StatusServiceUnavailable:
+		var retryAfter time.Duration
+		if secs, e := strconv.Atoi(resp.Header.Get("Retry-After")); e == nil {
+			retryAfter = time.Duration(secs) * time.Second
+		}
+		return pipeline.NewThrottledError(err, retryAfter)
+	case resp.StatusCode == http.StatusUnauthorized ||
+		resp.StatusCode == http.StatusForbidden ||
+		resp.StatusCode == http.StatusNotFound:
+		// 404 means the database or retention policy doesn't exist.
+		return pipeline.NewFatalError(err)
+	case resp.StatusCode >= 500:
+		return pipeline.NewRetryableError(err)
+	}
+	return pipeline.NewMalformedMessageError(err)
+}
+
+func (o *InfluxDBOutput) ReportMsg(msg *message.Message) error {
+	message.NewInt64Field(msg, "PointsWritten", atomic.LoadInt64(&o.pointsWritten), "count")
+	message.NewInt64Field(msg, "PointsDropped", atomic.LoadInt64(&o.pointsDropped), "count")
+	message.NewInt64Field(msg, "WriteRetries", atomic.LoadInt64(&o.retries), "count")
+	return nil
+}
+
+func init() {
+	pipeline.RegisterPlugin("InfluxDBOutput", func() interface{} {
+		return new(InfluxDBOutput)
+	})
+}
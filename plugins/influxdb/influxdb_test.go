@@ -0,0 +1,164 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package influxdb
+
+import (
+	"github.com/mozilla-services/heka/message"
+	"github.com/mozilla-services/heka/pipeline"
+	"github.com/mozilla-services/heka/pipelinemock"
+	"github.com/rafrombrc/gomock/gomock"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func newPack() *pipeline.PipelinePack {
+	pack := pipeline.NewPipelinePack(nil)
+	msg := pack.Message
+	msg.SetTimestamp(1420070400123456789)
+	msg.SetType("nginx.access")
+	msg.SetHostname("web 1")
+	message.NewStringField(msg, "path", `/a "b"`)
+	message.NewInt64Field(msg, "status", 200, "")
+	f, _ := message.NewField("request_time", 0.25, "s")
+	msg.AddField(f)
+	f, _ = message.NewField("ratio", math.NaN(), "")
+	msg.AddField(f)
+	return pack
+}
+
+func newEncoder(t *testing.T, setup func(*InfluxLineEncoderConfig)) *InfluxLineEncoder {
+	e := new(InfluxLineEncoder)
+	config := e.ConfigStruct().(*InfluxLineEncoderConfig)
+	setup(config)
+	if err := e.Init(config); err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+func TestEncodeAllFields(t *testing.T) {
+	e := newEncoder(t, func(config *InfluxLineEncoderConfig) {
+		config.MeasurementSource = "Type"
+		config.Tags = map[string]string{"host": "Hostname", "status": "Fields[status]"}
+	})
+	output, err := e.Encode(newPack())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `nginx.access,host=web\ 1,status=200 path="/a \"b\"",request_time=0.25` +
+		" 1420070400123456789\n"
+	if string(output) != expected {
+		t.Errorf("Unexpected point: %q", output)
+	}
+}
+
+func TestEncodeMappedFields(t *testing.T) {
+	e := newEncoder(t, func(config *InfluxLineEncoderConfig) {
+		config.Measurement = "requests"
+		config.MeasurementSource = "Fields[missing]"
+		config.Fields = map[string]string{"code": "Fields[status]", "sev": "Severity"}
+		config.Precision = "ms"
+	})
+	output, err := e.Encode(newPack())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(output) != "requests code=200i,sev=7i 1420070400123\n" {
+		t.Errorf("Unexpected point: %q", output)
+	}
+
+	e = newEncoder(t, func(config *InfluxLineEncoderConfig) {
+		config.Fields = map[string]string{"ratio": "Fields[ratio]"}
+	})
+	if _, err = e.Encode(newPack()); err == nil {
+		t.Error("Expected an error for a point without fields")
+	}
+}
+
+func TestEncoderConfig(t *testing.T) {
+	e := new(InfluxLineEncoder)
+	config := e.ConfigStruct().(*InfluxLineEncoderConfig)
+	config.Precision = "m"
+	if err := e.Init(config); err == nil {
+		t.Error("Expected an error for an invalid precision")
+	}
+	config.Precision = "s"
+	config.Tags = map[string]string{"host": "Host"}
+	if err := e.Init(config); err == nil {
+		t.Error("Expected an error for an invalid tag source")
+	}
+}
+
+func TestOutputWritesBatches(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	or := pipelinemock.NewMockOutputRunner(ctrl)
+	or.EXPECT().LogError(gomock.Any()).AnyTimes()
+
+	var bodies []string
+	var query, auth string
+	statuses := []int{http.StatusInternalServerError, http.StatusNoContent,
+		http.StatusBadRequest, http.StatusNotFound}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter,
+		r *http.Request) {
+
+		body, _ := ioutil.ReadAll(r.Body)
+		bodies = append(bodies, string(body))
+		query = r.URL.RawQuery
+		auth = r.Header.Get("Authorization")
+		w.WriteHeader(statuses[0])
+		statuses = statuses[1:]
+	}))
+	defer server.Close()
+
+	o := new(InfluxDBOutput)
+	config := o.ConfigStruct().(*InfluxDBOutputConfig)
+	config.Address = server.URL + "/"
+	config.Database = "web"
+	config.RetentionPolicy = "week"
+	config.Token = "secret"
+	config.Precision = "s"
+	config.Retries.Delay = "1ms"
+	if err := o.Init(config); err != nil {
+		t.Fatal(err)
+	}
+	o.batch = []byte("cpu value=1 1\ncpu value=2 2\n")
+	o.count = 2
+
+	// The failed write is retried.
+	if err := o.flush(or); err != nil {
+		t.Fatal(err)
+	}
+	if len(bodies) != 2 || bodies[1] != "cpu value=1 1\ncpu value=2 2\n" {
+		t.Errorf("Unexpected requests: %q", bodies)
+	}
+	if query != "db=web&precision=s&rp=week" || auth != "Token secret" {
+		t.Errorf("Unexpected request: %s, %s", query, auth)
+	}
+	if o.pointsWritten != 2 || o.retries != 1 || o.batch != nil {
+		t.Errorf("Unexpected counts: %d written, %d retries", o.pointsWritten,
+			o.retries)
+	}
+
+	// Rejected points are dropped, a missing database stops the output.
+	o.batch, o.count = []byte("cpu value=x 3\n"), 1
+	if err := o.flush(or); err != nil || o.pointsDropped != 1 {
+		t.Errorf("Unexpected result: %v, %d dropped", err, o.pointsDropped)
+	}
+	o.batch, o.count = []byte("cpu value=4 4\n"), 1
+	if err := o.flush(or); pipeline.ClassifyError(err) != pipeline.ErrKindFatal {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,292 @@
+// +build linux
+
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package journald
+
+import (
+	"code.google.com/p/go-uuid/uuid"
+	"fmt"
+	"github.com/coreos/go-systemd/sdjournal"
+	"github.com/mozilla-services/heka/message"
+	"github.com/mozilla-services/heka/pipeline"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+type JournaldInputConfig struct {
+	// Directory of the journal files to read, defaults to the system journal.
+	Path string `toml:"path"`
+	// Only read the entries of these systemd units, e.g. "nginx.service".
+	Units []string `toml:"units"`
+	// Only read entries with at most this syslog priority, e.g. 4 for
+	// warnings and more severe. Defaults to 7 (debug), i.e. all entries.
+	MaxPriority int `toml:"max_priority"`
+	// Additional "FIELD=value" matches. Matches of the same field are ORed,
+	// those of different fields ANDed.
+	Matches []string `toml:"matches"`
+	// Where to start reading when there's no saved cursor, "tail" (only new
+	// entries) or "head" (the whole journal).
+	SeekPosition string `toml:"seek_position"`
+	// Whether to save the cursor of the last delivered entry, to resume
+	// reading from there after a restart.
+	SaveCursor bool `toml:"save_cursor"`
+}
+
+// Input reading the systemd journal, delivering each entry as a
+// `heka.journald` message with the journal fields as message fields.
+type JournaldInput struct {
+	processMessageCount int64
+
+	conf           *JournaldInputConfig
+	journal        *sdjournal.Journal
+	pConfig        *pipeline.PipelineConfig
+	name           string
+	cursorFilename string
+	cursorFile     *os.File
+	stopChan       chan bool
+}
+
+// Journal fields mapped to message headers rather than fields.
+var headerFields = map[string]bool{
+	"MESSAGE":   true,
+	"PRIORITY":  true,
+	"_PID":      true,
+	"_HOSTNAME": true,
+}
+
+func (j *JournaldInput) ConfigStruct() interface{} {
+	return &JournaldInputConfig{
+		MaxPriority:  7,
+		SeekPosition: "tail",
+		SaveCursor:   true,
+	}
+}
+
+func (j *JournaldInput) SetPipelineConfig(pConfig *pipeline.PipelineConfig) {
+	j.pConfig = pConfig
+}
+
+func (j *JournaldInput) SetName(name string) {
+	j.name = name
+}
+
+// Returns the journal matches for a config.
+func journalMatches(conf *JournaldInputConfig) (matches []string, err error) {
+	for _, unit := range conf.Units {
+		matches = append(matches, "_SYSTEMD_UNIT="+unit)
+	}
+	if conf.MaxPriority < 0 || conf.MaxPriority > 7 {
+		return nil, fmt.Errorf("max_priority must be between 0 and 7")
+	}
+	if conf.MaxPriority < 7 {
+		for p := 0; p <= conf.MaxPriority; p++ {
+			matches = append(matches, "PRIORITY="+strconv.Itoa(p))
+		}
+	}
+	for _, match := range conf.Matches {
+		if strings.Index(match, "=") < 1 {
+			return nil, fmt.Errorf("invalid match '%s', expected FIELD=value", match)
+		}
+		matches = append(matches, match)
+	}
+	return
+}
+
+func (j *JournaldInput) Init(config interface{}) (err error) {
+	j.conf = config.(*JournaldInputConfig)
+	if j.conf.SeekPosition != "tail" && j.conf.SeekPosition != "head" {
+		return fmt.Errorf("seek_position must be 'tail' or 'head'")
+	}
+	matches, err := journalMatches(j.conf)
+	if err != nil {
+		return
+	}
+	if j.conf.Path == "" {
+		j.journal, err = sdjournal.NewJournal()
+	} else {
+		j.journal, err = sdjournal.NewJournalFromDir(j.conf.Path)
+	}
+	if err != nil {
+		return fmt.Errorf("can't open the journal: %s", err)
+	}
+	for _, match := range matches {
+		if err = j.journal.AddMatch(match); err != nil {
+			j.journal.Close()
+			return fmt.Errorf("invalid match '%s': %s", match, err)
+		}
+	}
+
+	j.cursorFilename = j.pConfig.Globals.PrependBaseDir(filepath.Join("journald",
+		j.name+".cursor"))
+	cursor := ""
+	if j.conf.SaveCursor {
+		if err = os.MkdirAll(filepath.Dir(j.cursorFilename), 0766); err != nil {
+			j.journal.Close()
+			return
+		}
+		if data, err := ioutil.ReadFile(j.cursorFilename); err == nil {
+			cursor = strings.TrimSpace(string(data))
+		}
+	}
+	if err = j.seek(cursor); err != nil {
+		j.journal.Close()
+		return fmt.Errorf("can't seek the journal: %s", err)
+	}
+	return nil
+}
+
+// Positions the journal so the next entry read is the first one to deliver.
+func (j *JournaldInput) seek(cursor string) (err error) {
+	if cursor != "" {
+		if err = j.journal.SeekCursor(cursor); err == nil {
+			// The cursor's entry was already delivered, skip it.
+			if _, err = j.journal.Next(); err == nil {
+				if j.journal.TestCursor(cursor) == nil {
+					return nil
+				}
+				// The entry is gone, e.g. rotated away, so we're already
+				// past it.
+				_, err = j.journal.Previous()
+			}
+			return
+		}
+	}
+	if j.conf.SeekPosition == "head" {
+		return j.journal.SeekHead()
+	}
+	if err = j.journal.SeekTail(); err == nil {
+		_, err = j.journal.Previous()
+	}
+	return
+}
+
+func (j *JournaldInput) writeCursor(cursor string) (err error) {
+	if j.cursorFile == nil {
+		if j.cursorFile, err = os.OpenFile(j.cursorFilename,
+			os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644); err != nil {
+			return
+		}
+	}
+	if err = j.cursorFile.Truncate(0); err != nil {
+		return
+	}
+	_, err = j.cursorFile.WriteAt([]byte(cursor), 0)
+	return
+}
+
+func (j *JournaldInput) Run(ir pipeline.InputRunner, h pipeline.PluginHelper) (err error) {
+	defer func() {
+		j.journal.Close()
+		if j.cursorFile != nil {
+			j.cursorFile.Close()
+		}
+	}()
+	j.stopChan = make(chan bool)
+
+	var (
+		n          uint64
+		entry      *sdjournal.JournalEntry
+		hostname   = j.pConfig.Hostname()
+		packSupply = ir.InChan()
+	)
+
+	for {
+		select {
+		case <-j.stopChan:
+			return nil
+		default:
+		}
+		if n, err = j.journal.Next(); err != nil {
+			return fmt.Errorf("reading the journal: %s", err)
+		}
+		if n == 0 {
+			// At the end of the journal, wait up to a second for new entries
+			// so a stop request isn't held up.
+			j.journal.Wait(time.Second)
+			continue
+		}
+		if entry, err = j.journal.GetEntry(); err != nil {
+			return fmt.Errorf("reading a journal entry: %s", err)
+		}
+		atomic.AddInt64(&j.processMessageCount, 1)
+		pack := <-packSupply
+		populatePack(pack, entry.Fields, int64(entry.RealtimeTimestamp)*1000,
+			j.name, hostname)
+		ir.Deliver(pack)
+		if j.conf.SaveCursor {
+			if err = j.writeCursor(entry.Cursor); err != nil {
+				return fmt.Errorf("saving the journal cursor: %s", err)
+			}
+		}
+	}
+}
+
+// Fills a pack with a journal entry's fields. `MESSAGE` becomes the payload,
+// `PRIORITY`, `_PID`, and `_HOSTNAME` the corresponding headers, and the
+// other fields message fields of the same names, in name order.
+func populatePack(pack *pipeline.PipelinePack, fields map[string]string,
+	timestamp int64, logger, hostname string) {
+
+	msg := pack.Message
+	msg.SetUuid(uuid.NewRandom())
+	msg.SetTimestamp(timestamp)
+	msg.SetType("heka.journald")
+	msg.SetLogger(logger)
+	msg.SetHostname(hostname)
+	msg.SetPayload(fields["MESSAGE"])
+	if host, ok := fields["_HOSTNAME"]; ok {
+		msg.SetHostname(host)
+	}
+	if priority, err := strconv.Atoi(fields["PRIORITY"]); err == nil {
+		msg.SetSeverity(int32(priority))
+	}
+	if pid, err := strconv.Atoi(fields["_PID"]); err == nil {
+		msg.SetPid(int32(pid))
+	}
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		if !headerFields[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		message.NewStringField(msg, name, fields[name])
+	}
+}
+
+func (j *JournaldInput) Stop() {
+	close(j.stopChan)
+}
+
+func (j *JournaldInput) ReportMsg(msg *message.Message) error {
+	message.NewInt64Field(msg, "ProcessMessageCount",
+		atomic.LoadInt64(&j.processMessageCount), "count")
+	return nil
+}
+
+func (j *JournaldInput) CleanupForRestart() {
+	return
+}
+
+func init() {
+	pipeline.RegisterPlugin("JournaldInput", func() interface{} {
+		return new(JournaldInput)
+	})
+}
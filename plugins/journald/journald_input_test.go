@@ -0,0 +1,83 @@
+// +build linux
+
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package journald
+
+import (
+	"github.com/mozilla-services/heka/pipeline"
+	"reflect"
+	"testing"
+)
+
+func TestJournalMatches(t *testing.T) {
+	conf := new(JournaldInput).ConfigStruct().(*JournaldInputConfig)
+	matches, err := journalMatches(conf)
+	if err != nil || len(matches) != 0 {
+		t.Errorf("the defaults shouldn't filter entries, got %v, %v", matches, err)
+	}
+
+	conf.Units = []string{"nginx.service", "sshd.service"}
+	conf.MaxPriority = 1
+	conf.Matches = []string{"_TRANSPORT=syslog"}
+	matches, err = journalMatches(conf)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	expected := []string{"_SYSTEMD_UNIT=nginx.service", "_SYSTEMD_UNIT=sshd.service",
+		"PRIORITY=0", "PRIORITY=1", "_TRANSPORT=syslog"}
+	if !reflect.DeepEqual(matches, expected) {
+		t.Errorf("expected %v, got %v", expected, matches)
+	}
+
+	conf.Matches = []string{"=syslog"}
+	if _, err = journalMatches(conf); err == nil {
+		t.Errorf("a match without a field name should be invalid")
+	}
+	conf.Matches = nil
+	conf.MaxPriority = 8
+	if _, err = journalMatches(conf); err == nil {
+		t.Errorf("a priority above 7 should be invalid")
+	}
+}
+
+func TestPopulatePack(t *testing.T) {
+	pack := pipeline.NewPipelinePack(nil)
+	fields := map[string]string{
+		"MESSAGE":       "Started Session 1 of user root.",
+		"PRIORITY":      "6",
+		"_PID":          "1",
+		"_HOSTNAME":     "web1",
+		"_SYSTEMD_UNIT": "systemd-logind.service",
+		"_COMM":         "systemd",
+	}
+	populatePack(pack, fields, 1428000000000000000, "JournaldInput", "localhost")
+	msg := pack.Message
+	if msg.GetType() != "heka.journald" || msg.GetLogger() != "JournaldInput" {
+		t.Errorf("unexpected type '%s' or logger '%s'", msg.GetType(), msg.GetLogger())
+	}
+	if msg.GetPayload() != fields["MESSAGE"] {
+		t.Errorf("unexpected payload '%s'", msg.GetPayload())
+	}
+	if msg.GetSeverity() != 6 || msg.GetPid() != 1 || msg.GetHostname() != "web1" {
+		t.Errorf("unexpected headers %v", msg)
+	}
+	if msg.GetTimestamp() != 1428000000000000000 {
+		t.Errorf("unexpected timestamp %d", msg.GetTimestamp())
+	}
+	if len(msg.Fields) != 2 || msg.Fields[0].GetName() != "_COMM" {
+		t.Errorf("expected the _COMM and _SYSTEMD_UNIT fields, got %v", msg.Fields)
+	}
+	if unit, _ := msg.GetFieldValue("_SYSTEMD_UNIT"); unit != "systemd-logind.service" {
+		t.Errorf("unexpected unit %v", unit)
+	}
+}
@@ -0,0 +1,693 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package kafka
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Shopify/sarama"
+	"github.com/mozilla-services/heka/message"
+	"github.com/mozilla-services/heka/pipeline"
+	"github.com/mozilla-services/heka/plugins/tcp"
+	"github.com/samuel/go-zookeeper/zk"
+	"path"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type KafkaGroupInputConfig struct {
+	// Client Config
+	Id    string
+	Addrs []string
+	// Set to true to connect to the brokers over TLS, requires the `tls`
+	// section.
+	UseTls bool `toml:"use_tls"`
+	Tls    tcp.TlsConfig
+	// Credentials for SASL PLAIN authentication with the brokers, which is
+	// used if the user is set.
+	SaslUser     string `toml:"sasl_user"`
+	SaslPassword string `toml:"sasl_password"`
+
+	// Consumer group config
+	Topics           []string
+	Group            string
+	ZookeeperAddrs   []string `toml:"zookeeper_addrs"`
+	ZookeeperChroot  string   `toml:"zookeeper_chroot"`
+	ZookeeperTimeout uint32   `toml:"zookeeper_timeout"`
+	ClaimTimeout     uint32   `toml:"claim_timeout"`
+	RefreshInterval  uint32   `toml:"refresh_interval"`
+	OffsetMethod     string   `toml:"offset_method"`   // Newest, Oldest
+	CommitStrategy   string   `toml:"commit_strategy"` // periodic, on_ack
+	CommitInterval   uint32   `toml:"commit_interval"`
+	// Point the on_ack commit strategy waits for the messages to reach,
+	// "router" or "output".
+	CommitAfter string `toml:"commit_after"`
+
+	// Consumer Config
+	DefaultFetchSize int32  `toml:"default_fetch_size"`
+	MinFetchSize     int32  `toml:"min_fetch_size"`
+	MaxMessageSize   int32  `toml:"max_message_size"`
+	MaxWaitTime      uint32 `toml:"max_wait_time"`
+	EventBufferSize  int    `toml:"event_buffer_size"`
+}
+
+type topicPartition struct {
+	topic     string
+	partition int32
+}
+
+func (tp topicPartition) String() string {
+	return fmt.Sprintf("%s/%d", tp.topic, tp.partition)
+}
+
+// A message or error from a partition's consumer.
+type partitionEvent struct {
+	tp  topicPartition
+	msg *sarama.ConsumerMessage
+	err error
+}
+
+// A delivered message whose delivery hasn't been acknowledged yet.
+type pendingAck struct {
+	offset int64 // Next offset once the message is acknowledged.
+	report <-chan pipeline.DeliveryReport
+}
+
+type partitionConsumer struct {
+	consumer sarama.PartitionConsumer
+	done     chan struct{}
+}
+
+// Consumes one or more topics as a member of a consumer group, sharing the
+// topics' partitions with the other members of the group. Group membership,
+// partition ownership, and committed offsets are kept in ZooKeeper using the
+// same layout as Kafka's own high level consumer, so Heka can share a group
+// with other consumers.
+type KafkaGroupInput struct {
+	processMessageCount    int64
+	processMessageFailures int64
+	rebalanceCount         int64
+
+	config       *KafkaGroupInputConfig
+	saramaConfig *sarama.Config
+	pConfig      *pipeline.PipelineConfig
+	name         string
+	consumerId   string
+	stopChan     chan bool
+	// Delivery point of the on_ack commit strategy, 0 for periodic commits.
+	commitPoint pipeline.DeliveryPoint
+	// Offset partitions without a committed offset are consumed from.
+	initialOffset int64
+
+	client        sarama.Client
+	consumer      sarama.Consumer
+	zkConn        *zk.Conn
+	consumers     map[topicPartition]*partitionConsumer
+	consumersWg   sync.WaitGroup
+	events        chan partitionEvent
+	partitionCnts map[string]int
+	offsets       map[topicPartition]int64 // Next offset to consume.
+	acked         map[topicPartition]int64 // Next offset that may be committed.
+	pending       map[topicPartition][]pendingAck
+	committed     map[topicPartition]int64
+	lagLock       sync.Mutex
+	lag           map[topicPartition]int64
+}
+
+func (k *KafkaGroupInput) ConfigStruct() interface{} {
+	hn := k.pConfig.Hostname()
+	return &KafkaGroupInputConfig{
+		Id:               hn,
+		ZookeeperTimeout: 6000,
+		ClaimTimeout:     30 * 1000,
+		RefreshInterval:  10 * 1000,
+		OffsetMethod:     "Newest",
+		CommitStrategy:   "periodic",
+		CommitInterval:   1000,
+		CommitAfter:      "output",
+		DefaultFetchSize: 1024 * 32,
+		MinFetchSize:     1,
+		MaxWaitTime:      250,
+		EventBufferSize:  16,
+	}
+}
+
+func (k *KafkaGroupInput) SetPipelineConfig(pConfig *pipeline.PipelineConfig) {
+	k.pConfig = pConfig
+}
+
+func (k *KafkaGroupInput) SetName(name string) {
+	k.name = name
+}
+
+func (k *KafkaGroupInput) Init(config interface{}) (err error) {
+	k.config = config.(*KafkaGroupInputConfig)
+	if len(k.config.Addrs) == 0 {
+		return errors.New("addrs must have at least one entry")
+	}
+	if len(k.config.Topics) == 0 {
+		return errors.New("topics must have at least one entry")
+	}
+	if k.config.Group == "" {
+		return errors.New("group must be set")
+	}
+	if len(k.config.ZookeeperAddrs) == 0 {
+		return errors.New("zookeeper_addrs must have at least one entry")
+	}
+	switch k.config.CommitStrategy {
+	case "periodic":
+		k.commitPoint = 0
+	case "on_ack":
+		if k.commitPoint, err = pipeline.ParseDeliveryPoint(k.config.CommitAfter); err != nil {
+			return fmt.Errorf("invalid commit_after: %s", k.config.CommitAfter)
+		}
+	default:
+		return fmt.Errorf("invalid commit_strategy: %s", k.config.CommitStrategy)
+	}
+	if k.config.CommitInterval == 0 {
+		return errors.New("commit_interval must be greater than 0")
+	}
+	if k.config.RefreshInterval == 0 {
+		return errors.New("refresh_interval must be greater than 0")
+	}
+
+	switch k.config.OffsetMethod {
+	case "Newest":
+		k.initialOffset = sarama.OffsetNewest
+	case "Oldest":
+		k.initialOffset = sarama.OffsetOldest
+	default:
+		return fmt.Errorf("invalid offset_method: %s", k.config.OffsetMethod)
+	}
+	k.saramaConfig = sarama.NewConfig()
+	k.saramaConfig.ClientID = k.config.Id
+	if k.config.UseTls {
+		if k.saramaConfig.Net.TLS.Config, err = tcp.CreateGoTlsConfig(&k.config.Tls); err != nil {
+			return fmt.Errorf("TLS init error: %s", err)
+		}
+		k.saramaConfig.Net.TLS.Enable = true
+	}
+	if k.config.SaslUser != "" {
+		if k.config.SaslPassword == "" {
+			return errors.New("sasl_password must be set with sasl_user")
+		}
+		k.saramaConfig.Net.SASL.Enable = true
+		k.saramaConfig.Net.SASL.User = k.config.SaslUser
+		k.saramaConfig.Net.SASL.Password = k.config.SaslPassword
+	} else if k.config.SaslPassword != "" {
+		return errors.New("sasl_password requires sasl_user")
+	}
+	k.saramaConfig.Consumer.Fetch.Default = k.config.DefaultFetchSize
+	k.saramaConfig.Consumer.Fetch.Min = k.config.MinFetchSize
+	k.saramaConfig.Consumer.Fetch.Max = k.config.MaxMessageSize
+	k.saramaConfig.Consumer.MaxWaitTime = time.Duration(k.config.MaxWaitTime) * time.Millisecond
+	k.saramaConfig.Consumer.Return.Errors = true
+	k.saramaConfig.ChannelBufferSize = k.config.EventBufferSize
+
+	// Unique within the group, even for several inputs in one hekad.
+	k.consumerId = fmt.Sprintf("%s-%s-%d", k.config.Id, k.name, time.Now().UnixNano())
+	k.stopChan = make(chan bool)
+	return
+}
+
+func (k *KafkaGroupInput) groupPath(parts ...string) string {
+	return path.Join(append([]string{"/", k.config.ZookeeperChroot, "consumers",
+		k.config.Group}, parts...)...)
+}
+
+func (k *KafkaGroupInput) Run(ir pipeline.InputRunner, h pipeline.PluginHelper) (err error) {
+	if k.client, err = sarama.NewClient(k.config.Addrs, k.saramaConfig); err != nil {
+		return
+	}
+	defer k.client.Close()
+	if k.consumer, err = sarama.NewConsumerFromClient(k.client); err != nil {
+		return
+	}
+	defer k.consumer.Close()
+
+	zkTimeout := time.Duration(k.config.ZookeeperTimeout) * time.Millisecond
+	if k.zkConn, _, err = zk.Connect(k.config.ZookeeperAddrs, zkTimeout); err != nil {
+		return
+	}
+	defer k.zkConn.Close()
+
+	if err = k.register(); err != nil {
+		return fmt.Errorf("can't join consumer group: %s", err)
+	}
+	defer k.zkConn.Delete(k.groupPath("ids", k.consumerId), -1)
+
+	k.consumers = make(map[topicPartition]*partitionConsumer)
+	k.events = make(chan partitionEvent, k.config.EventBufferSize)
+	k.offsets = make(map[topicPartition]int64)
+	k.acked = make(map[topicPartition]int64)
+	k.pending = make(map[topicPartition][]pendingAck)
+	k.committed = make(map[topicPartition]int64)
+	defer k.releaseAll(ir)
+
+	commitTicker := time.NewTicker(time.Duration(k.config.CommitInterval) *
+		time.Millisecond)
+	defer commitTicker.Stop()
+	refreshTicker := time.NewTicker(time.Duration(k.config.RefreshInterval) *
+		time.Millisecond)
+	defer refreshTicker.Stop()
+
+	var (
+		hostname    = k.pConfig.Hostname()
+		packSupply  = ir.InChan()
+		useMsgBytes = ir.UseMsgBytes()
+		membersChan <-chan zk.Event
+	)
+	for {
+		if membersChan, err = k.rebalance(ir); err != nil {
+			return
+		}
+
+	consume:
+		for {
+			select {
+			case pe := <-k.events:
+				atomic.AddInt64(&k.processMessageCount, 1)
+				if pe.err != nil {
+					atomic.AddInt64(&k.processMessageFailures, 1)
+					ir.LogError(fmt.Errorf("%s: %s", pe.tp, pe.err))
+					if pe.err == sarama.ErrOffsetOutOfRange {
+						// Forget the bad offset, the partition will be
+						// consumed from the offset_method position.
+						ir.LogError(fmt.Errorf("%s: removing the out of range offset",
+							pe.tp))
+						k.zkConn.Delete(k.groupPath("offsets", pe.tp.topic,
+							strconv.Itoa(int(pe.tp.partition))), -1)
+						k.forget(pe.tp)
+						break consume
+					}
+					break
+				}
+				pack := <-packSupply
+				populatePack(ir, pack, pe.msg, k.name, hostname, useMsgBytes)
+				offset := pe.msg.Offset + 1
+				if k.commitPoint == 0 {
+					k.acked[pe.tp] = offset
+				} else {
+					k.pending[pe.tp] = append(k.pending[pe.tp],
+						pendingAck{offset, pack.TrackDelivery(k.commitPoint)})
+				}
+				ir.Deliver(pack)
+				k.offsets[pe.tp] = offset
+			case <-commitTicker.C:
+				k.commitAll(ir)
+			case <-refreshTicker.C:
+				k.updateLag(ir)
+				if k.partitionsChanged() {
+					ir.LogMessage("topic partitions changed, rebalancing")
+					break consume
+				}
+			case <-membersChan:
+				ir.LogMessage("consumer group membership changed, rebalancing")
+				break consume
+			case <-k.stopChan:
+				return nil
+			}
+		}
+	}
+}
+
+// Registers this input as a member of the consumer group.
+func (k *KafkaGroupInput) register() error {
+	subscription := make(map[string]int, len(k.config.Topics))
+	for _, topic := range k.config.Topics {
+		subscription[topic] = 1
+	}
+	data, err := json.Marshal(map[string]interface{}{
+		"version":      1,
+		"subscription": subscription,
+		"pattern":      "static",
+		"timestamp":    strconv.FormatInt(time.Now().UnixNano()/1e6, 10),
+	})
+	if err != nil {
+		return err
+	}
+	if err = k.ensurePath(k.groupPath("ids")); err != nil {
+		return err
+	}
+	_, err = k.zkConn.Create(k.groupPath("ids", k.consumerId), data,
+		zk.FlagEphemeral, zk.WorldACL(zk.PermAll))
+	return err
+}
+
+// Creates the specified ZooKeeper node and any missing parents.
+func (k *KafkaGroupInput) ensurePath(p string) error {
+	if p == "/" {
+		return nil
+	}
+	exists, _, err := k.zkConn.Exists(p)
+	if err != nil || exists {
+		return err
+	}
+	if err = k.ensurePath(path.Dir(p)); err != nil {
+		return err
+	}
+	_, err = k.zkConn.Create(p, nil, 0, zk.WorldACL(zk.PermAll))
+	if err == zk.ErrNodeExists {
+		err = nil
+	}
+	return err
+}
+
+// Releases any partitions this member owns, then claims and starts
+// consuming the partitions assigned to it under the group's current
+// membership. Returns a channel that will receive an event when the
+// membership changes.
+func (k *KafkaGroupInput) rebalance(ir pipeline.InputRunner) (<-chan zk.Event, error) {
+	k.releaseAll(ir)
+
+	members, _, membersChan, err := k.zkConn.ChildrenW(k.groupPath("ids"))
+	if err != nil {
+		return nil, fmt.Errorf("can't list group members: %s", err)
+	}
+	partitions := make(map[string][]int32, len(k.config.Topics))
+	k.partitionCnts = make(map[string]int, len(k.config.Topics))
+	for _, topic := range k.config.Topics {
+		if partitions[topic], err = k.client.Partitions(topic); err != nil {
+			return nil, fmt.Errorf("can't get partitions for %s: %s", topic, err)
+		}
+		k.partitionCnts[topic] = len(partitions[topic])
+	}
+
+	assigned := assignPartitions(members, k.consumerId, k.config.Topics, partitions)
+	for _, tp := range assigned {
+		if err = k.claim(tp); err != nil {
+			return nil, err
+		}
+		if err = k.startConsumer(ir, tp); err != nil {
+			return nil, fmt.Errorf("can't consume %s: %s", tp, err)
+		}
+	}
+	atomic.AddInt64(&k.rebalanceCount, 1)
+	ir.LogMessage(fmt.Sprintf("consuming %d partitions, %d group members",
+		len(assigned), len(members)))
+	return membersChan, nil
+}
+
+// Assigns each member of the group a contiguous range of each topic's
+// partitions, the same way Kafka's high level consumer does. Returns the
+// partitions assigned to the specified member.
+func assignPartitions(members []string, memberId string, topics []string,
+	partitions map[string][]int32) (assigned []topicPartition) {
+
+	members = append([]string{}, members...)
+	sort.Strings(members)
+	index := sort.SearchStrings(members, memberId)
+	if index == len(members) || members[index] != memberId {
+		return
+	}
+	for _, topic := range topics {
+		ps := append([]int32{}, partitions[topic]...)
+		sort.Sort(int32Slice(ps))
+		perMember := len(ps) / len(members)
+		extra := len(ps) % len(members)
+		start := index*perMember + min(index, extra)
+		count := perMember
+		if index < extra {
+			count++
+		}
+		for _, partition := range ps[start : start+count] {
+			assigned = append(assigned, topicPartition{topic, partition})
+		}
+	}
+	return
+}
+
+type int32Slice []int32
+
+func (s int32Slice) Len() int           { return len(s) }
+func (s int32Slice) Less(i, j int) bool { return s[i] < s[j] }
+func (s int32Slice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// Registers this member as a partition's owner, waiting for the previous
+// owner (if any) to release it.
+func (k *KafkaGroupInput) claim(tp topicPartition) error {
+	ownerPath := k.groupPath("owners", tp.topic, strconv.Itoa(int(tp.partition)))
+	if err := k.ensurePath(path.Dir(ownerPath)); err != nil {
+		return err
+	}
+	deadline := time.Now().Add(time.Duration(k.config.ClaimTimeout) * time.Millisecond)
+	for {
+		_, err := k.zkConn.Create(ownerPath, []byte(k.consumerId), zk.FlagEphemeral,
+			zk.WorldACL(zk.PermAll))
+		if err != zk.ErrNodeExists {
+			return err
+		}
+		owner, _, err := k.zkConn.Get(ownerPath)
+		if err == nil && string(owner) == k.consumerId {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%s is still owned by %s", tp, owner)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// Starts consuming a partition from the group's committed offset, or from
+// the offset_method position if there isn't one or it's out of range.
+func (k *KafkaGroupInput) startConsumer(ir pipeline.InputRunner, tp topicPartition) error {
+	offset := k.initialOffset
+	offsetPath := k.groupPath("offsets", tp.topic, strconv.Itoa(int(tp.partition)))
+	data, _, err := k.zkConn.Get(offsetPath)
+	if err == nil {
+		if offset, err = strconv.ParseInt(string(data), 10, 64); err != nil {
+			return fmt.Errorf("invalid committed offset: %s", err)
+		}
+		k.offsets[tp] = offset
+		k.acked[tp] = offset
+		k.committed[tp] = offset
+	} else if err != zk.ErrNoNode {
+		return err
+	}
+
+	consumer, err := k.consumer.ConsumePartition(tp.topic, tp.partition, offset)
+	if err == sarama.ErrOffsetOutOfRange && offset != k.initialOffset {
+		ir.LogError(fmt.Errorf("%s: removing the out of range offset", tp))
+		k.zkConn.Delete(offsetPath, -1)
+		k.forget(tp)
+		consumer, err = k.consumer.ConsumePartition(tp.topic, tp.partition,
+			k.initialOffset)
+	}
+	if err != nil {
+		return err
+	}
+	pc := &partitionConsumer{consumer: consumer, done: make(chan struct{})}
+	k.consumers[tp] = pc
+	k.consumersWg.Add(1)
+	go func() {
+		defer k.consumersWg.Done()
+		for {
+			var event partitionEvent
+			select {
+			case msg, ok := <-consumer.Messages():
+				if !ok {
+					return
+				}
+				event = partitionEvent{tp: tp, msg: msg}
+			case cErr, ok := <-consumer.Errors():
+				if !ok {
+					return
+				}
+				event = partitionEvent{tp: tp, err: cErr.Err}
+			case <-pc.done:
+				return
+			}
+			select {
+			case k.events <- event:
+			case <-pc.done:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// Commits the offset following the partition's messages that have been
+// delivered or, with the on_ack strategy, acknowledged.
+func (k *KafkaGroupInput) commit(tp topicPartition) error {
+	offset, ok := k.acked[tp]
+	if !ok || offset == k.committed[tp] {
+		return nil
+	}
+	offsetPath := k.groupPath("offsets", tp.topic, strconv.Itoa(int(tp.partition)))
+	data := []byte(strconv.FormatInt(offset, 10))
+	_, err := k.zkConn.Set(offsetPath, data, -1)
+	if err == zk.ErrNoNode {
+		if err = k.ensurePath(path.Dir(offsetPath)); err == nil {
+			_, err = k.zkConn.Create(offsetPath, data, 0, zk.WorldACL(zk.PermAll))
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("can't commit offset for %s: %s", tp, err)
+	}
+	k.committed[tp] = offset
+	return nil
+}
+
+func (k *KafkaGroupInput) commitAll(ir pipeline.InputRunner) {
+	k.collectAcks(ir)
+	for tp := range k.consumers {
+		if err := k.commit(tp); err != nil {
+			ir.LogError(err)
+		}
+	}
+}
+
+// Moves each partition's committable offset past the messages whose delivery
+// has been reported, in order, up to the first one still outstanding. Failed
+// deliveries are logged and counted, but moved past too, as Kafka can't hand
+// out a single message again.
+func (k *KafkaGroupInput) collectAcks(ir pipeline.InputRunner) {
+	for tp, pending := range k.pending {
+		n := 0
+	acks:
+		for ; n < len(pending); n++ {
+			select {
+			case report := <-pending[n].report:
+				if report.Err != nil {
+					atomic.AddInt64(&k.processMessageFailures, 1)
+					ir.LogError(fmt.Errorf("%s: message at offset %d wasn't delivered: %s",
+						tp, pending[n].offset-1, report.Err))
+				}
+				k.acked[tp] = pending[n].offset
+			default:
+				break acks
+			}
+		}
+		k.pending[tp] = pending[n:]
+	}
+}
+
+// Drops everything known about a partition's offsets.
+func (k *KafkaGroupInput) forget(tp topicPartition) {
+	delete(k.offsets, tp)
+	delete(k.acked, tp)
+	delete(k.pending, tp)
+	delete(k.committed, tp)
+}
+
+// Commits the offsets of, stops consuming, and gives up ownership of all of
+// the partitions this member owns. Messages that were fetched but not yet
+// delivered or acknowledged are dropped, the next owner will fetch them
+// again.
+func (k *KafkaGroupInput) releaseAll(ir pipeline.InputRunner) {
+	k.commitAll(ir)
+	for _, pc := range k.consumers {
+		close(pc.done)
+	}
+	k.consumersWg.Wait()
+	for tp, pc := range k.consumers {
+		pc.consumer.Close()
+		k.zkConn.Delete(k.groupPath("owners", tp.topic,
+			strconv.Itoa(int(tp.partition))), -1)
+		delete(k.consumers, tp)
+		k.forget(tp)
+	}
+	for drained := false; !drained; {
+		select {
+		case <-k.events:
+		default:
+			drained = true
+		}
+	}
+	k.lagLock.Lock()
+	k.lag = make(map[topicPartition]int64)
+	k.lagLock.Unlock()
+}
+
+// Returns whether any of the topics' partition counts have changed since the
+// last rebalance.
+func (k *KafkaGroupInput) partitionsChanged() bool {
+	for topic, cnt := range k.partitionCnts {
+		partitions, err := k.client.Partitions(topic)
+		if err == nil && len(partitions) != cnt {
+			return true
+		}
+	}
+	return false
+}
+
+// Records how far behind the newest message each owned partition is.
+func (k *KafkaGroupInput) updateLag(ir pipeline.InputRunner) {
+	lag := make(map[topicPartition]int64, len(k.consumers))
+	for tp := range k.consumers {
+		offset, ok := k.offsets[tp]
+		if !ok {
+			continue
+		}
+		newest, err := k.newestOffset(tp)
+		if err != nil {
+			ir.LogError(fmt.Errorf("can't get newest offset for %s: %s", tp, err))
+			continue
+		}
+		lag[tp] = newest - offset
+	}
+	k.lagLock.Lock()
+	k.lag = lag
+	k.lagLock.Unlock()
+}
+
+// Returns the offset that will be assigned to the next message produced to
+// the partition.
+func (k *KafkaGroupInput) newestOffset(tp topicPartition) (int64, error) {
+	return k.client.GetOffset(tp.topic, tp.partition, sarama.OffsetNewest)
+}
+
+func (k *KafkaGroupInput) Stop() {
+	close(k.stopChan)
+}
+
+func (k *KafkaGroupInput) ReportMsg(msg *message.Message) error {
+	message.NewInt64Field(msg, "ProcessMessageCount",
+		atomic.LoadInt64(&k.processMessageCount), "count")
+	message.NewInt64Field(msg, "ProcessMessageFailures",
+		atomic.LoadInt64(&k.processMessageFailures), "count")
+	message.NewInt64Field(msg, "RebalanceCount",
+		atomic.LoadInt64(&k.rebalanceCount), "count")
+
+	k.lagLock.Lock()
+	defer k.lagLock.Unlock()
+	var total int64
+	for tp, lag := range k.lag {
+		message.NewInt64Field(msg, fmt.Sprintf("PartitionLag-%s-%d", tp.topic,
+			tp.partition), lag, "count")
+		total += lag
+	}
+	message.NewInt64Field(msg, "TotalLag", total, "count")
+	return nil
+}
+
+func (k *KafkaGroupInput) CleanupForRestart() {
+	return
+}
+
+func init() {
+	pipeline.RegisterPlugin("KafkaGroupInput", func() interface{} {
+		return new(KafkaGroupInput)
+	})
+}
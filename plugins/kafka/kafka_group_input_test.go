@@ -0,0 +1,161 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package kafka
+
+import (
+	"crypto/tls"
+	. "github.com/mozilla-services/heka/pipeline"
+	"reflect"
+	"testing"
+)
+
+func newTestGroupInput() (*KafkaGroupInput, *KafkaGroupInputConfig) {
+	pConfig := NewPipelineConfig(nil)
+	ki := new(KafkaGroupInput)
+	ki.SetName("test")
+	ki.SetPipelineConfig(pConfig)
+	config := ki.ConfigStruct().(*KafkaGroupInputConfig)
+	config.Addrs = []string{"localhost:9092"}
+	config.Topics = []string{"test"}
+	config.Group = "heka"
+	config.ZookeeperAddrs = []string{"localhost:2181"}
+	return ki, config
+}
+
+func TestGroupInputConfig(t *testing.T) {
+	ki, config := newTestGroupInput()
+	if err := ki.Init(config); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+
+	tests := []struct {
+		modify func(config *KafkaGroupInputConfig)
+		errmsg string
+	}{
+		{func(config *KafkaGroupInputConfig) { config.Topics = nil },
+			"topics must have at least one entry"},
+		{func(config *KafkaGroupInputConfig) { config.Group = "" },
+			"group must be set"},
+		{func(config *KafkaGroupInputConfig) { config.ZookeeperAddrs = nil },
+			"zookeeper_addrs must have at least one entry"},
+		{func(config *KafkaGroupInputConfig) { config.CommitStrategy = "never" },
+			"invalid commit_strategy: never"},
+		{func(config *KafkaGroupInputConfig) { config.OffsetMethod = "Manual" },
+			"invalid offset_method: Manual"},
+		{func(config *KafkaGroupInputConfig) {
+			config.CommitStrategy = "on_ack"
+			config.CommitAfter = "decoder"
+		}, "invalid commit_after: decoder"},
+		{func(config *KafkaGroupInputConfig) { config.CommitInterval = 0 },
+			"commit_interval must be greater than 0"},
+		{func(config *KafkaGroupInputConfig) {
+			config.UseTls = true
+			config.Tls.MinVersion = "TLS99"
+		}, "TLS init error: Invalid MinVersion: TLS99"},
+		{func(config *KafkaGroupInputConfig) { config.SaslUser = "heka" },
+			"sasl_password must be set with sasl_user"},
+		{func(config *KafkaGroupInputConfig) { config.SaslPassword = "secret" },
+			"sasl_password requires sasl_user"},
+	}
+	for _, test := range tests {
+		ki, config = newTestGroupInput()
+		test.modify(config)
+		err := ki.Init(config)
+		if err == nil || err.Error() != test.errmsg {
+			t.Errorf("Expected: %s, received: %v", test.errmsg, err)
+		}
+	}
+}
+
+func TestGroupInputTlsAndSasl(t *testing.T) {
+	ki, config := newTestGroupInput()
+	if err := ki.Init(config); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if ki.saramaConfig.Net.TLS.Enable || ki.saramaConfig.Net.SASL.Enable {
+		t.Errorf("TLS and SASL should be off by default")
+	}
+
+	ki, config = newTestGroupInput()
+	config.UseTls = true
+	config.Tls.ServerName = "kafka.example.com"
+	config.Tls.MinVersion = "TLS12"
+	config.SaslUser = "heka"
+	config.SaslPassword = "secret"
+	if err := ki.Init(config); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	net := ki.saramaConfig.Net
+	if !net.TLS.Enable || net.TLS.Config == nil {
+		t.Fatalf("TLS isn't enabled")
+	}
+	if net.TLS.Config.ServerName != "kafka.example.com" ||
+		net.TLS.Config.MinVersion != tls.VersionTLS12 {
+
+		t.Errorf("Unexpected TLS config: %+v", net.TLS.Config)
+	}
+	if !net.SASL.Enable || net.SASL.User != "heka" || net.SASL.Password != "secret" {
+		t.Errorf("Unexpected SASL config: %+v", net.SASL)
+	}
+	if err := ki.saramaConfig.Validate(); err != nil {
+		t.Errorf("Invalid client config: %s", err)
+	}
+}
+
+func TestCollectAcks(t *testing.T) {
+	ki, _ := newTestGroupInput()
+	tp := topicPartition{"test", 0}
+	reports := make([]chan DeliveryReport, 3)
+	for i := range reports {
+		reports[i] = make(chan DeliveryReport, 1)
+	}
+	ki.acked = map[topicPartition]int64{tp: 10}
+	ki.pending = map[topicPartition][]pendingAck{
+		tp: {{11, reports[0]}, {12, reports[1]}, {13, reports[2]}},
+	}
+
+	// Acknowledgements are only taken in order.
+	reports[1] <- DeliveryReport{}
+	ki.collectAcks(nil)
+	if ki.acked[tp] != 10 || len(ki.pending[tp]) != 3 {
+		t.Errorf("Expected offset 10 and 3 pending, received %d and %d",
+			ki.acked[tp], len(ki.pending[tp]))
+	}
+	reports[0] <- DeliveryReport{}
+	ki.collectAcks(nil)
+	if ki.acked[tp] != 12 || len(ki.pending[tp]) != 1 {
+		t.Errorf("Expected offset 12 and 1 pending, received %d and %d",
+			ki.acked[tp], len(ki.pending[tp]))
+	}
+}
+
+func TestAssignPartitions(t *testing.T) {
+	members := []string{"c", "a", "b"}
+	topics := []string{"one", "two"}
+	partitions := map[string][]int32{
+		"one": {4, 3, 2, 1, 0},
+		"two": {0},
+	}
+
+	expected := map[string][]topicPartition{
+		"a": {{"one", 0}, {"one", 1}, {"two", 0}},
+		"b": {{"one", 2}, {"one", 3}},
+		"c": {{"one", 4}},
+		"d": nil,
+	}
+	for member, want := range expected {
+		got := assignPartitions(members, member, topics, partitions)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: expected %v, received %v", member, want, got)
+		}
+	}
+}
@@ -60,10 +60,9 @@ type KafkaInput struct {
 	processMessageFailures int64
 
 	config             *KafkaInputConfig
-	clientConfig       *sarama.ClientConfig
-	consumerConfig     *sarama.ConsumerConfig
-	client             *sarama.Client
-	consumer           *sarama.Consumer
+	saramaConfig       *sarama.Config
+	consumer           sarama.Consumer
+	partitionConsumer  sarama.PartitionConsumer
 	pConfig            *pipeline.PipelineConfig
 	checkpointFile     *os.File
 	stopChan           chan bool
@@ -137,30 +136,31 @@ func (k *KafkaInput) Init(config interface{}) (err error) {
 		k.config.Group = k.config.Id
 	}
 
-	k.clientConfig = sarama.NewClientConfig()
-	k.clientConfig.MetadataRetries = k.config.MetadataRetries
-	k.clientConfig.WaitForElection = time.Duration(k.config.WaitForElection) * time.Millisecond
-	k.clientConfig.BackgroundRefreshFrequency = time.Duration(k.config.BackgroundRefreshFrequency) * time.Millisecond
-
-	k.clientConfig.DefaultBrokerConf = sarama.NewBrokerConfig()
-	k.clientConfig.DefaultBrokerConf.MaxOpenRequests = k.config.MaxOpenRequests
-	k.clientConfig.DefaultBrokerConf.DialTimeout = time.Duration(k.config.DialTimeout) * time.Millisecond
-	k.clientConfig.DefaultBrokerConf.ReadTimeout = time.Duration(k.config.ReadTimeout) * time.Millisecond
-	k.clientConfig.DefaultBrokerConf.WriteTimeout = time.Duration(k.config.WriteTimeout) * time.Millisecond
-
-	k.consumerConfig = sarama.NewConsumerConfig()
-	k.consumerConfig.DefaultFetchSize = k.config.DefaultFetchSize
-	k.consumerConfig.MinFetchSize = k.config.MinFetchSize
-	k.consumerConfig.MaxMessageSize = k.config.MaxMessageSize
-	k.consumerConfig.MaxWaitTime = time.Duration(k.config.MaxWaitTime) * time.Millisecond
+	k.saramaConfig = sarama.NewConfig()
+	k.saramaConfig.ClientID = k.config.Id
+	k.saramaConfig.Metadata.Retry.Max = k.config.MetadataRetries
+	k.saramaConfig.Metadata.Retry.Backoff = time.Duration(k.config.WaitForElection) * time.Millisecond
+	k.saramaConfig.Metadata.RefreshFrequency = time.Duration(k.config.BackgroundRefreshFrequency) * time.Millisecond
+
+	k.saramaConfig.Net.MaxOpenRequests = k.config.MaxOpenRequests
+	k.saramaConfig.Net.DialTimeout = time.Duration(k.config.DialTimeout) * time.Millisecond
+	k.saramaConfig.Net.ReadTimeout = time.Duration(k.config.ReadTimeout) * time.Millisecond
+	k.saramaConfig.Net.WriteTimeout = time.Duration(k.config.WriteTimeout) * time.Millisecond
+
+	k.saramaConfig.Consumer.Fetch.Default = k.config.DefaultFetchSize
+	k.saramaConfig.Consumer.Fetch.Min = k.config.MinFetchSize
+	k.saramaConfig.Consumer.Fetch.Max = k.config.MaxMessageSize
+	k.saramaConfig.Consumer.MaxWaitTime = time.Duration(k.config.MaxWaitTime) * time.Millisecond
+	k.saramaConfig.Consumer.Return.Errors = true
+	k.saramaConfig.ChannelBufferSize = k.config.EventBufferSize
 	k.checkpointFilename = k.pConfig.Globals.PrependBaseDir(filepath.Join("kafka",
 		fmt.Sprintf("%s.%s.%d.offset.bin", k.name, k.config.Topic, k.config.Partition)))
 
+	var offset int64
 	switch k.config.OffsetMethod {
 	case "Manual":
-		k.consumerConfig.OffsetMethod = sarama.OffsetMethodManual
 		if fileExists(k.checkpointFilename) {
-			if k.consumerConfig.OffsetValue, err = readCheckpoint(k.checkpointFilename); err != nil {
+			if offset, err = readCheckpoint(k.checkpointFilename); err != nil {
 				return fmt.Errorf("readCheckpoint %s", err)
 			}
 		} else {
@@ -172,14 +172,14 @@ func (k *KafkaInput) Init(config interface{}) (err error) {
 			}
 		}
 	case "Newest":
-		k.consumerConfig.OffsetMethod = sarama.OffsetMethodNewest
+		offset = sarama.OffsetNewest
 		if fileExists(k.checkpointFilename) {
 			if err = os.Remove(k.checkpointFilename); err != nil {
 				return
 			}
 		}
 	case "Oldest":
-		k.consumerConfig.OffsetMethod = sarama.OffsetMethodOldest
+		offset = sarama.OffsetOldest
 		if fileExists(k.checkpointFilename) {
 			if err = os.Remove(k.checkpointFilename); err != nil {
 				return
@@ -189,20 +189,28 @@ func (k *KafkaInput) Init(config interface{}) (err error) {
 		return fmt.Errorf("invalid offset_method: %s", k.config.OffsetMethod)
 	}
 
-	k.consumerConfig.EventBufferSize = k.config.EventBufferSize
-
-	k.client, err = sarama.NewClient(k.config.Id, k.config.Addrs, k.clientConfig)
-	if err != nil {
+	if k.consumer, err = sarama.NewConsumer(k.config.Addrs, k.saramaConfig); err != nil {
 		return
 	}
-	k.consumer, err = sarama.NewConsumer(k.client, k.config.Topic, k.config.Partition, k.config.Group, k.consumerConfig)
+	k.partitionConsumer, err = k.consumer.ConsumePartition(k.config.Topic,
+		k.config.Partition, offset)
+	if err == sarama.ErrOffsetOutOfRange && k.config.OffsetMethod == "Manual" {
+		if e := os.Remove(k.checkpointFilename); e != nil {
+			err = fmt.Errorf("%s, can't remove the checkpoint file: %s", err, e)
+		} else {
+			err = fmt.Errorf("%s, removed the checkpoint file", err)
+		}
+	}
+	if err != nil {
+		k.consumer.Close()
+	}
 	return
 }
 
 func (k *KafkaInput) Run(ir pipeline.InputRunner, h pipeline.PluginHelper) (err error) {
 	defer func() {
+		k.partitionConsumer.Close()
 		k.consumer.Close()
-		k.client.Close()
 		if k.checkpointFile != nil {
 			k.checkpointFile.Close()
 		}
@@ -218,71 +226,36 @@ func (k *KafkaInput) Run(ir pipeline.InputRunner, h pipeline.PluginHelper) (err
 
 	for {
 		select {
-		case event, ok := <-k.consumer.Events():
+		case event, ok := <-k.partitionConsumer.Messages():
 			if !ok {
 				return
 			}
 			atomic.AddInt64(&k.processMessageCount, 1)
-			if event.Err != nil {
-				if event.Err == sarama.OffsetOutOfRange {
-					ir.LogError(fmt.Errorf("removing the out of range checkpoint file and stopping"))
-					if err := os.Remove(k.checkpointFilename); err != nil {
-						ir.LogError(err)
-					}
-					return
-				}
-				atomic.AddInt64(&k.processMessageFailures, 1)
-				ir.LogError(event.Err)
-				break
-			}
 			pack = <-packSupply
-			if useMsgBytes {
-				messageLen := len(event.Value)
-				if messageLen > cap(pack.MsgBytes) {
-					pack.MsgBytes = make([]byte, messageLen)
-				}
-				pack.MsgBytes = pack.MsgBytes[:messageLen]
-				copy(pack.MsgBytes, event.Value)
-			} else {
-				pack.Message.SetUuid(uuid.NewRandom())
-				pack.Message.SetTimestamp(time.Now().UnixNano())
-				pack.Message.SetType("heka.kafka")
-				pack.Message.SetLogger(k.name)
-				pack.Message.SetHostname(hostname)
-				pack.Message.SetPayload(string(event.Value))
-				if field, err := message.NewField("Key", event.Key, ""); err == nil {
-					pack.Message.AddField(field)
-				} else {
-					ir.LogError(fmt.Errorf("can't add field: %s", err))
-				}
-
-				if field, err := message.NewField("Topic", event.Topic, ""); err == nil {
-					pack.Message.AddField(field)
-				} else {
-					ir.LogError(fmt.Errorf("can't add field: %s", err))
-				}
-
-				if field, err := message.NewField("Partition", event.Partition, ""); err == nil {
-					pack.Message.AddField(field)
-				} else {
-					ir.LogError(fmt.Errorf("can't add field: %s", err))
-				}
-
-				if field, err := message.NewField("Offset", event.Offset, ""); err == nil {
-					pack.Message.AddField(field)
-				} else {
-					ir.LogError(fmt.Errorf("can't add field: %s", err))
-				}
-			}
-
+			populatePack(ir, pack, event, k.name, hostname, useMsgBytes)
 			ir.Deliver(pack)
 
-			if k.consumerConfig.OffsetMethod == sarama.OffsetMethodManual {
+			if k.config.OffsetMethod == "Manual" {
 				if err = k.writeCheckpoint(event.Offset + 1); err != nil {
 					return
 				}
 			}
 
+		case e, ok := <-k.partitionConsumer.Errors():
+			if !ok {
+				return
+			}
+			atomic.AddInt64(&k.processMessageCount, 1)
+			if e.Err == sarama.ErrOffsetOutOfRange {
+				ir.LogError(fmt.Errorf("removing the out of range checkpoint file and stopping"))
+				if err := os.Remove(k.checkpointFilename); err != nil {
+					ir.LogError(err)
+				}
+				return
+			}
+			atomic.AddInt64(&k.processMessageFailures, 1)
+			ir.LogError(e)
+
 		case <-k.stopChan:
 			return
 		}
@@ -290,6 +263,53 @@ func (k *KafkaInput) Run(ir pipeline.InputRunner, h pipeline.PluginHelper) (err
 	return
 }
 
+// Fills a pack with the contents of a Kafka message, either as the raw message
+// bytes (for use with a decoder) or as a "heka.kafka" message with the Kafka
+// message value as the payload.
+func populatePack(ir pipeline.InputRunner, pack *pipeline.PipelinePack,
+	event *sarama.ConsumerMessage, logger, hostname string, useMsgBytes bool) {
+
+	if useMsgBytes {
+		messageLen := len(event.Value)
+		if messageLen > cap(pack.MsgBytes) {
+			pack.MsgBytes = make([]byte, messageLen)
+		}
+		pack.MsgBytes = pack.MsgBytes[:messageLen]
+		copy(pack.MsgBytes, event.Value)
+		return
+	}
+
+	pack.Message.SetUuid(uuid.NewRandom())
+	pack.Message.SetTimestamp(time.Now().UnixNano())
+	pack.Message.SetType("heka.kafka")
+	pack.Message.SetLogger(logger)
+	pack.Message.SetHostname(hostname)
+	pack.Message.SetPayload(string(event.Value))
+	if field, err := message.NewField("Key", event.Key, ""); err == nil {
+		pack.Message.AddField(field)
+	} else {
+		ir.LogError(fmt.Errorf("can't add field: %s", err))
+	}
+
+	if field, err := message.NewField("Topic", event.Topic, ""); err == nil {
+		pack.Message.AddField(field)
+	} else {
+		ir.LogError(fmt.Errorf("can't add field: %s", err))
+	}
+
+	if field, err := message.NewField("Partition", event.Partition, ""); err == nil {
+		pack.Message.AddField(field)
+	} else {
+		ir.LogError(fmt.Errorf("can't add field: %s", err))
+	}
+
+	if field, err := message.NewField("Offset", event.Offset, ""); err == nil {
+		pack.Message.AddField(field)
+	} else {
+		ir.LogError(fmt.Errorf("can't add field: %s", err))
+	}
+}
+
 func (k *KafkaInput) Stop() {
 	close(k.stopChan)
 }
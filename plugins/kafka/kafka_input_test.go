@@ -75,14 +75,19 @@ func TestReceivePayloadMessage(t *testing.T) {
 	}()
 
 	topic := "test"
-	mdr := new(sarama.MetadataResponse)
-	mdr.AddBroker(b2.Addr(), b2.BrokerID())
-	mdr.AddTopicPartition(topic, 0, 2)
-	b1.Returns(mdr)
-
-	fr := new(sarama.FetchResponse)
-	fr.AddMessage(topic, 0, nil, sarama.ByteEncoder([]byte{0x41, 0x42}), 0)
-	b2.Returns(fr)
+	b1.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(b1.Addr(), b1.BrokerID()).
+			SetBroker(b2.Addr(), b2.BrokerID()).
+			SetLeader(topic, 0, b2.BrokerID()),
+	})
+	b2.SetHandlerByMap(map[string]sarama.MockResponse{
+		"OffsetRequest": sarama.NewMockOffsetResponse(t).
+			SetOffset(topic, 0, sarama.OffsetOldest, 0).
+			SetOffset(topic, 0, sarama.OffsetNewest, 1),
+		"FetchRequest": sarama.NewMockFetchResponse(t, 1).
+			SetMessage(topic, 0, 0, sarama.ByteEncoder([]byte{0x41, 0x42})),
+	})
 
 	pConfig := NewPipelineConfig(nil)
 	pConfig.Globals.BaseDir = tmpDir
@@ -168,14 +173,19 @@ func TestReceiveProtobufMessage(t *testing.T) {
 	}()
 
 	topic := "test"
-	mdr := new(sarama.MetadataResponse)
-	mdr.AddBroker(b2.Addr(), b2.BrokerID())
-	mdr.AddTopicPartition(topic, 0, 2)
-	b1.Returns(mdr)
-
-	fr := new(sarama.FetchResponse)
-	fr.AddMessage(topic, 0, nil, sarama.ByteEncoder([]byte{0x41, 0x42}), 0)
-	b2.Returns(fr)
+	b1.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(b1.Addr(), b1.BrokerID()).
+			SetBroker(b2.Addr(), b2.BrokerID()).
+			SetLeader(topic, 0, b2.BrokerID()),
+	})
+	b2.SetHandlerByMap(map[string]sarama.MockResponse{
+		"OffsetRequest": sarama.NewMockOffsetResponse(t).
+			SetOffset(topic, 0, sarama.OffsetOldest, 0).
+			SetOffset(topic, 0, sarama.OffsetNewest, 1),
+		"FetchRequest": sarama.NewMockFetchResponse(t, 1).
+			SetMessage(topic, 0, 0, sarama.ByteEncoder([]byte{0x41, 0x42})),
+	})
 
 	pConfig := NewPipelineConfig(nil)
 	pConfig.Globals.BaseDir = tmpDir
@@ -22,6 +22,7 @@ import (
 	"github.com/mozilla-services/heka/pipeline"
 	"regexp"
 	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -48,16 +49,20 @@ type KafkaOutputConfig struct {
 	HashVariable  string `toml:"hash_variable"`  // HashPartitioner key is extracted from a message variable
 	TopicVariable string `toml:"topic_variable"` // Topic extracted from a message variable
 	Topic         string // Static topic
-
-	RequiredAcks               string `toml:"required_acks"` // NoResponse, WaitForLocal, WaitForAll
-	Timeout                    uint32
-	CompressionCodec           string `toml:"compression_codec"` // None, GZIP, Snappy
-	MaxBufferTime              uint32 `toml:"max_buffer_time"`
-	MaxBufferedBytes           uint32 `toml:"max_buffered_bytes"`
+	// Topic rendered from message headers and fields, e.g. "logs-%{Logger}".
+	TopicTemplate string `toml:"topic_template"`
+	MaxTopics     uint   `toml:"max_topics"`     // Cardinality limit for topic_template
+	FallbackTopic string `toml:"fallback_topic"` // Used beyond max_topics
+
+	RequiredAcks     string `toml:"required_acks"` // NoResponse, WaitForLocal, WaitForAll
+	Timeout          uint32
+	CompressionCodec string `toml:"compression_codec"` // None, GZIP, Snappy, LZ4
+	MaxBufferTime    uint32 `toml:"max_buffer_time"`
+	MaxBufferedBytes uint32 `toml:"max_buffered_bytes"`
+	// No longer used, the producer limits the size of its requests itself.
 	BackPressureThresholdBytes uint32 `toml:"back_pressure_threshold_bytes"`
 }
 
-var Shutdown = errors.New("Shutdown Kafka error processing")
 var fieldRegex = regexp.MustCompile("^Fields\\[([^\\]]*)\\](?:\\[(\\d+)\\])?(?:\\[(\\d+)\\])?$")
 
 type messageVariable struct {
@@ -71,17 +76,19 @@ type KafkaOutput struct {
 	processMessageCount    int64
 	processMessageFailures int64
 	processMessageDiscards int64
-	kafkaDroppedMessages   int64
 	kafkaEncodingErrors    int64
 
 	hashVariable   *messageVariable
 	topicVariable  *messageVariable
+	topicTemplate  *pipeline.DestinationTemplate
 	config         *KafkaOutputConfig
-	cconfig        *sarama.ClientConfig
-	pconfig        *sarama.ProducerConfig
-	client         *sarama.Client
-	producer       *sarama.Producer
+	saramaConfig   *sarama.Config
+	producer       sarama.AsyncProducer
 	pipelineConfig *pipeline.PipelineConfig
+	// Messages handed to the producer whose delivery hasn't succeeded or
+	// been given up on yet.
+	inFlight       sync.WaitGroup
+	encodeFailures chan *sarama.ProducerError
 }
 
 func (k *KafkaOutput) ConfigStruct() interface{} {
@@ -97,10 +104,10 @@ func (k *KafkaOutput) ConfigStruct() interface{} {
 		WriteTimeout:               60 * 1000,
 		Partitioner:                "Random",
 		RequiredAcks:               "WaitForLocal",
+		Timeout:                    10 * 1000,
 		CompressionCodec:           "None",
 		MaxBufferTime:              1,
 		MaxBufferedBytes:           1,
-		BackPressureThresholdBytes: 50 * 1024 * 1024,
 	}
 }
 
@@ -204,32 +211,35 @@ func (k *KafkaOutput) Init(config interface{}) (err error) {
 		return errors.New("addrs must have at least one entry")
 	}
 
-	k.cconfig = sarama.NewClientConfig()
-	k.cconfig.MetadataRetries = k.config.MetadataRetries
-	k.cconfig.WaitForElection = time.Duration(k.config.WaitForElection) * time.Millisecond
-	k.cconfig.BackgroundRefreshFrequency = time.Duration(k.config.BackgroundRefreshFrequency) * time.Millisecond
+	k.saramaConfig = sarama.NewConfig()
+	k.saramaConfig.ClientID = k.config.Id
+	k.saramaConfig.Metadata.Retry.Max = k.config.MetadataRetries
+	k.saramaConfig.Metadata.Retry.Backoff = time.Duration(k.config.WaitForElection) * time.Millisecond
+	k.saramaConfig.Metadata.RefreshFrequency = time.Duration(k.config.BackgroundRefreshFrequency) * time.Millisecond
 
-	k.cconfig.DefaultBrokerConf = sarama.NewBrokerConfig()
-	k.cconfig.DefaultBrokerConf.MaxOpenRequests = k.config.MaxOpenRequests
-	k.cconfig.DefaultBrokerConf.DialTimeout = time.Duration(k.config.DialTimeout) * time.Millisecond
-	k.cconfig.DefaultBrokerConf.ReadTimeout = time.Duration(k.config.ReadTimeout) * time.Millisecond
-	k.cconfig.DefaultBrokerConf.WriteTimeout = time.Duration(k.config.WriteTimeout) * time.Millisecond
+	k.saramaConfig.Net.MaxOpenRequests = k.config.MaxOpenRequests
+	k.saramaConfig.Net.DialTimeout = time.Duration(k.config.DialTimeout) * time.Millisecond
+	k.saramaConfig.Net.ReadTimeout = time.Duration(k.config.ReadTimeout) * time.Millisecond
+	k.saramaConfig.Net.WriteTimeout = time.Duration(k.config.WriteTimeout) * time.Millisecond
 
-	k.pconfig = sarama.NewProducerConfig()
+	// The results are needed to recycle delivered packs and to retry the
+	// failed ones.
+	k.saramaConfig.Producer.Return.Successes = true
+	k.saramaConfig.Producer.Return.Errors = true
 
 	switch k.config.Partitioner {
 	case "Random":
-		k.pconfig.Partitioner = sarama.NewRandomPartitioner()
+		k.saramaConfig.Producer.Partitioner = sarama.NewRandomPartitioner
 		if len(k.config.HashVariable) > 0 {
 			return fmt.Errorf("hash_variable should not be set for the %s partitioner", k.config.Partitioner)
 		}
 	case "RoundRobin":
-		k.pconfig.Partitioner = new(sarama.RoundRobinPartitioner)
+		k.saramaConfig.Producer.Partitioner = sarama.NewRoundRobinPartitioner
 		if len(k.config.HashVariable) > 0 {
 			return fmt.Errorf("hash_variable should not be set for the %s partitioner", k.config.Partitioner)
 		}
 	case "Hash":
-		k.pconfig.Partitioner = sarama.NewHashPartitioner()
+		k.saramaConfig.Producer.Partitioner = sarama.NewHashPartitioner
 		if k.hashVariable = verifyMessageVariable(k.config.HashVariable); k.hashVariable == nil {
 			return fmt.Errorf("invalid hash_variable: %s", k.config.HashVariable)
 		}
@@ -237,7 +247,19 @@ func (k *KafkaOutput) Init(config interface{}) (err error) {
 		return fmt.Errorf("invalid partitioner: %s", k.config.Partitioner)
 	}
 
-	if len(k.config.Topic) == 0 {
+	if len(k.config.TopicTemplate) > 0 {
+		if len(k.config.Topic) > 0 || len(k.config.TopicVariable) > 0 {
+			return errors.New("topic_template cannot be combined with topic or topic_variable")
+		}
+		k.topicTemplate, err = pipeline.NewDestinationTemplate(pipeline.DestinationTemplateConfig{
+			Template:       k.config.TopicTemplate,
+			MaxCardinality: k.config.MaxTopics,
+			Fallback:       k.config.FallbackTopic,
+		})
+		if err != nil {
+			return fmt.Errorf("invalid topic_template: %s", err)
+		}
+	} else if len(k.config.Topic) == 0 {
 		if k.topicVariable = verifyMessageVariable(k.config.TopicVariable); k.topicVariable == nil {
 			return fmt.Errorf("invalid topic_variable: %s", k.config.TopicVariable)
 		}
@@ -247,74 +269,138 @@ func (k *KafkaOutput) Init(config interface{}) (err error) {
 
 	switch k.config.RequiredAcks {
 	case "NoResponse":
-		k.pconfig.RequiredAcks = sarama.NoResponse
+		k.saramaConfig.Producer.RequiredAcks = sarama.NoResponse
 	case "WaitForLocal":
-		k.pconfig.RequiredAcks = sarama.WaitForLocal
+		k.saramaConfig.Producer.RequiredAcks = sarama.WaitForLocal
 	case "WaitForAll":
-		k.pconfig.RequiredAcks = sarama.WaitForAll
+		k.saramaConfig.Producer.RequiredAcks = sarama.WaitForAll
 	default:
 		return fmt.Errorf("invalid required_acks: %s", k.config.RequiredAcks)
 	}
 
-	k.pconfig.Timeout = time.Duration(k.config.Timeout) * time.Millisecond
-
-	switch k.config.CompressionCodec {
-	case "None":
-		k.pconfig.Compression = sarama.CompressionNone
-	case "GZIP":
-		k.pconfig.Compression = sarama.CompressionGZIP
-	case "Snappy":
-		k.pconfig.Compression = sarama.CompressionSnappy
+	k.saramaConfig.Producer.Timeout = time.Duration(k.config.Timeout) * time.Millisecond
+
+	switch strings.ToLower(k.config.CompressionCodec) {
+	case "none":
+		k.saramaConfig.Producer.Compression = sarama.CompressionNone
+	case "gzip":
+		k.saramaConfig.Producer.Compression = sarama.CompressionGZIP
+	case "snappy":
+		k.saramaConfig.Producer.Compression = sarama.CompressionSnappy
+	case "lz4":
+		// Kafka only decodes LZ4 messages correctly from 0.10 on.
+		k.saramaConfig.Producer.Compression = sarama.CompressionLZ4
+		k.saramaConfig.Version = sarama.V0_10_0_0
 	default:
 		return fmt.Errorf("invalid compression_codec: %s", k.config.CompressionCodec)
 	}
 
-	k.pconfig.MaxBufferedBytes = k.config.MaxBufferedBytes
-	k.pconfig.MaxBufferTime = time.Duration(k.config.MaxBufferTime) * time.Millisecond
-	k.pconfig.BackPressureThresholdBytes = k.config.BackPressureThresholdBytes
+	k.saramaConfig.Producer.Flush.Bytes = int(k.config.MaxBufferedBytes)
+	k.saramaConfig.Producer.Flush.Frequency = time.Duration(k.config.MaxBufferTime) * time.Millisecond
 
-	k.client, err = sarama.NewClient(k.config.Id, k.config.Addrs, k.cconfig)
-	if err != nil {
-		return
-	}
-	k.producer, err = sarama.NewProducer(k.client, k.pconfig)
+	k.producer, err = sarama.NewAsyncProducer(k.config.Addrs, k.saramaConfig)
 	return
 }
 
-func (k *KafkaOutput) processKafkaErrors(or pipeline.OutputRunner, errChan chan error, wg *sync.WaitGroup) {
-shutdown:
-	for err := range errChan {
-		switch err {
-		case nil:
-		case Shutdown:
-			break shutdown
-		case sarama.EncodingError:
-			atomic.AddInt64(&k.kafkaEncodingErrors, 1)
-		default:
-			if e, ok := err.(sarama.DroppedMessagesError); ok {
-				atomic.AddInt64(&k.kafkaDroppedMessages, int64(e.DroppedMessages))
+// Reads the producer's results, recycling the packs of the delivered
+// messages and handing the failed ones, and those that couldn't be encoded,
+// to the runner's HandleFailure, which decides whether they're retried.
+// Failures are handled one message at a time, those of other messages wait
+// until the message being retried is either delivered or given up on, so
+// that each message's attempts are counted separately.
+func (k *KafkaOutput) processResults(or pipeline.OutputRunner, wg *sync.WaitGroup) {
+	defer wg.Done()
+	var (
+		successes = k.producer.Successes()
+		errs      = k.producer.Errors()
+		retrying  *pipeline.PipelinePack
+		failed    []*sarama.ProducerError
+	)
+	for successes != nil || errs != nil {
+		select {
+		case msg, ok := <-successes:
+			if !ok {
+				successes = nil
+				continue
+			}
+			pack := msg.Metadata.(*pipeline.PipelinePack)
+			if pack == retrying {
+				retrying = nil
+			}
+			pack.Recycle()
+			k.inFlight.Done()
+		case pErr := <-k.encodeFailures:
+			failed = append(failed, pErr)
+		case pErr, ok := <-errs:
+			if !ok {
+				errs = nil
+				continue
+			}
+			if pErr.Msg.Metadata.(*pipeline.PipelinePack) == retrying {
+				retrying = nil
+				failed = append([]*sarama.ProducerError{pErr}, failed...)
+			} else {
+				failed = append(failed, pErr)
+			}
+		}
+		for retrying == nil && len(failed) > 0 {
+			pErr := failed[0]
+			failed = failed[1:]
+			if k.handleFailure(or, pErr) {
+				retrying = pErr.Msg.Metadata.(*pipeline.PipelinePack)
 			}
-			or.LogError(err)
 		}
 	}
-	wg.Done()
 }
 
-func (k *KafkaOutput) Run(or pipeline.OutputRunner, h pipeline.PluginHelper) (err error) {
-	defer func() {
-		k.producer.Close()
-		k.client.Close()
+// Passes a failed message to the runner's HandleFailure, sending it again if
+// it's to be retried. Returns whether it was.
+func (k *KafkaOutput) handleFailure(or pipeline.OutputRunner, pErr *sarama.ProducerError) bool {
+	var (
+		pack = pErr.Msg.Metadata.(*pipeline.PipelinePack)
+		err  = pErr.Err
+	)
+	switch err.(type) {
+	case sarama.PacketEncodingError:
+		atomic.AddInt64(&k.kafkaEncodingErrors, 1)
+		err = pipeline.NewMalformedMessageError(err)
+	default:
+		if err == sarama.ErrMessageSizeTooLarge || err == sarama.ErrInvalidMessage {
+			atomic.AddInt64(&k.kafkaEncodingErrors, 1)
+			err = pipeline.NewMalformedMessageError(err)
+		}
+	}
+	if !or.HandleFailure(pack, err) {
+		atomic.AddInt64(&k.processMessageFailures, 1)
+		k.inFlight.Done()
+		return false
+	}
+	// The producer keeps its own state in the messages it returns, so the
+	// retry is sent as a new one. It's sent from a separate goroutine as the
+	// producer may be blocked handing us its results.
+	msg := &sarama.ProducerMessage{
+		Topic:    pErr.Msg.Topic,
+		Key:      pErr.Msg.Key,
+		Value:    pErr.Msg.Value,
+		Metadata: pack,
+	}
+	go func() {
+		k.producer.Input() <- msg
 	}()
+	return true
+}
 
+func (k *KafkaOutput) Run(or pipeline.OutputRunner, h pipeline.PluginHelper) (err error) {
 	if or.Encoder() == nil {
+		k.producer.Close()
 		return errors.New("Encoder required.")
 	}
 
 	inChan := or.InChan()
-	errChan := k.producer.Errors()
+	k.encodeFailures = make(chan *sarama.ProducerError)
 	var wg sync.WaitGroup
 	wg.Add(1)
-	go k.processKafkaErrors(or, errChan, &wg)
+	go k.processResults(or, &wg)
 
 	var (
 		pack  *pipeline.PipelinePack
@@ -327,28 +413,46 @@ func (k *KafkaOutput) Run(or pipeline.OutputRunner, h pipeline.PluginHelper) (er
 
 		if k.topicVariable != nil {
 			topic = getMessageVariable(pack.Message, k.topicVariable)
+		} else if k.topicTemplate != nil {
+			var e error
+			if topic, e = k.topicTemplate.Destination(pack.Message); e != nil {
+				atomic.AddInt64(&k.processMessageFailures, 1)
+				or.LogError(fmt.Errorf("can't resolve topic: %s", e))
+				pack.Recycle()
+				continue
+			}
 		}
 		if k.hashVariable != nil {
 			key = sarama.StringEncoder(getMessageVariable(pack.Message, k.hashVariable))
 		}
 
-		if msgBytes, err := or.Encode(pack); err == nil {
-			if msgBytes != nil {
-				err = k.producer.QueueMessage(topic, key, sarama.ByteEncoder(msgBytes))
-				if err != nil {
-					atomic.AddInt64(&k.processMessageFailures, 1)
-					or.LogError(err)
-				}
-			} else {
-				atomic.AddInt64(&k.processMessageDiscards, 1)
+		msgBytes, e := or.Encode(pack)
+		if e != nil {
+			// Handled with the producer's failures, HandleFailure isn't
+			// safe for concurrent use.
+			k.inFlight.Add(1)
+			k.encodeFailures <- &sarama.ProducerError{
+				Msg: &sarama.ProducerMessage{Metadata: pack},
+				Err: pipeline.NewMalformedMessageError(e),
 			}
-		} else {
-			atomic.AddInt64(&k.processMessageFailures, 1)
-			or.LogError(err)
+			continue
+		}
+		if msgBytes == nil {
+			atomic.AddInt64(&k.processMessageDiscards, 1)
+			pack.Recycle()
+			continue
+		}
+		k.inFlight.Add(1)
+		k.producer.Input() <- &sarama.ProducerMessage{
+			Topic:    topic,
+			Key:      key,
+			Value:    sarama.ByteEncoder(msgBytes),
+			Metadata: pack,
 		}
-		pack.Recycle()
 	}
-	errChan <- Shutdown
+	// Let the retries finish before shutting the producer down.
+	k.inFlight.Wait()
+	k.producer.AsyncClose()
 	wg.Wait()
 	return
 }
@@ -360,10 +464,11 @@ func (k *KafkaOutput) ReportMsg(msg *message.Message) error {
 		atomic.LoadInt64(&k.processMessageFailures), "count")
 	message.NewInt64Field(msg, "ProcessMessageDiscards",
 		atomic.LoadInt64(&k.processMessageDiscards), "count")
-	message.NewInt64Field(msg, "KafkaDroppedMessages",
-		atomic.LoadInt64(&k.kafkaDroppedMessages), "count")
 	message.NewInt64Field(msg, "KafkaEncodingErrors",
 		atomic.LoadInt64(&k.kafkaEncodingErrors), "count")
+	if k.topicTemplate != nil {
+		k.topicTemplate.ReportMsg(msg, "Topic")
+	}
 	return nil
 }
 
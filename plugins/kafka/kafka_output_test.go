@@ -233,6 +233,37 @@ func TestConflictingTopic(t *testing.T) {
 	}
 }
 
+func TestConflictingTopicTemplate(t *testing.T) {
+	pConfig := NewPipelineConfig(nil)
+	ko := new(KafkaOutput)
+	ko.SetPipelineConfig(pConfig)
+	config := ko.ConfigStruct().(*KafkaOutputConfig)
+	config.Addrs = append(config.Addrs, "localhost:5432")
+	config.TopicTemplate = "logs-%{Logger}"
+	config.TopicVariable = "Type"
+	err := ko.Init(config)
+
+	errmsg := "topic_template cannot be combined with topic or topic_variable"
+	if err.Error() != errmsg {
+		t.Errorf("Expected: %s, received: %s", errmsg, err)
+	}
+}
+
+func TestInvalidTopicTemplate(t *testing.T) {
+	pConfig := NewPipelineConfig(nil)
+	ko := new(KafkaOutput)
+	ko.SetPipelineConfig(pConfig)
+	config := ko.ConfigStruct().(*KafkaOutputConfig)
+	config.Addrs = append(config.Addrs, "localhost:5432")
+	config.TopicTemplate = "logs-%{Logger"
+	err := ko.Init(config)
+
+	errmsg := "invalid topic_template: unterminated reference in destination template: logs-%{Logger"
+	if err.Error() != errmsg {
+		t.Errorf("Expected: %s, received: %s", errmsg, err)
+	}
+}
+
 func TestInvalidRequiredAcks(t *testing.T) {
 	pConfig := NewPipelineConfig(nil)
 	ko := new(KafkaOutput)
@@ -265,10 +296,61 @@ func TestInvalidCompressionCodec(t *testing.T) {
 	}
 }
 
+func TestLZ4CompressionCodec(t *testing.T) {
+	b1 := sarama.NewMockBroker(t, 1)
+	defer b1.Close()
+	b1.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(b1.Addr(), b1.BrokerID()).
+			SetLeader("test", 0, b1.BrokerID()),
+	})
+
+	pConfig := NewPipelineConfig(nil)
+	ko := new(KafkaOutput)
+	ko.SetPipelineConfig(pConfig)
+	config := ko.ConfigStruct().(*KafkaOutputConfig)
+	config.Addrs = append(config.Addrs, b1.Addr())
+	config.Topic = "test"
+	config.CompressionCodec = "lz4"
+	if err := ko.Init(config); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer ko.producer.Close()
+
+	if ko.saramaConfig.Producer.Compression != sarama.CompressionLZ4 {
+		t.Errorf("Expected LZ4 compression, received: %d",
+			ko.saramaConfig.Producer.Compression)
+	}
+	if !ko.saramaConfig.Version.IsAtLeast(sarama.V0_10_0_0) {
+		t.Errorf("Expected Kafka version 0.10 or later, received: %s",
+			ko.saramaConfig.Version)
+	}
+}
+
+// Returns mock brokers for the "test" topic whose partition leader replies
+// to produce requests with the specified error.
+func newTestProducerBrokers(t *testing.T, topic string, kerr sarama.KError) (b1,
+	b2 *sarama.MockBroker) {
+
+	b1 = sarama.NewMockBroker(t, 1)
+	b2 = sarama.NewMockBroker(t, 2)
+	b1.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(b1.Addr(), b1.BrokerID()).
+			SetBroker(b2.Addr(), b2.BrokerID()).
+			SetLeader(topic, 0, b2.BrokerID()),
+	})
+	b2.SetHandlerByMap(map[string]sarama.MockResponse{
+		"ProduceRequest": sarama.NewMockProduceResponse(t).
+			SetError(topic, 0, kerr),
+	})
+	return
+}
+
 func TestSendMessage(t *testing.T) {
 	ctrl := gomock.NewController(t)
-	b1 := sarama.NewMockBroker(t, 1)
-	b2 := sarama.NewMockBroker(t, 2)
+	topic := "test"
+	b1, b2 := newTestProducerBrokers(t, topic, sarama.ErrNoError)
 
 	defer func() {
 		b1.Close()
@@ -276,19 +358,9 @@ func TestSendMessage(t *testing.T) {
 		ctrl.Finish()
 	}()
 
-	topic := "test"
 	globals := DefaultGlobals()
 	pConfig := NewPipelineConfig(globals)
 
-	mdr := new(sarama.MetadataResponse)
-	mdr.AddBroker(b2.Addr(), b2.BrokerID())
-	mdr.AddTopicPartition(topic, 0, 2)
-	b1.Returns(mdr)
-
-	pr := new(sarama.ProduceResponse)
-	pr.AddTopicPartition(topic, 0, sarama.NoError)
-	b2.Returns(pr)
-
 	ko := new(KafkaOutput)
 	ko.SetPipelineConfig(pConfig)
 	config := ko.ConfigStruct().(*KafkaOutputConfig)
@@ -355,3 +427,57 @@ func TestSendMessage(t *testing.T) {
 		t.Errorf("Invalid ending processMessageFailures %d", msgcount)
 	}
 }
+
+func TestRetryFailedMessage(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	topic := "test"
+	b1, b2 := newTestProducerBrokers(t, topic, sarama.ErrBrokerNotAvailable)
+
+	defer func() {
+		b1.Close()
+		b2.Close()
+		ctrl.Finish()
+	}()
+
+	pConfig := NewPipelineConfig(nil)
+	ko := new(KafkaOutput)
+	ko.SetPipelineConfig(pConfig)
+	config := ko.ConfigStruct().(*KafkaOutputConfig)
+	config.Addrs = append(config.Addrs, b1.Addr())
+	config.Topic = topic
+	if err := ko.Init(config); err != nil {
+		t.Fatal(err)
+	}
+	oth := plugins_ts.NewOutputTestHelper(ctrl)
+	encoder := new(plugins.PayloadEncoder)
+	encoder.Init(encoder.ConfigStruct().(*plugins.PayloadEncoderConfig))
+
+	inChan := make(chan *PipelinePack, 1)
+	pack := NewPipelinePack(pConfig.InputRecycleChan())
+	pack.Message = pipeline_ts.GetTestMessage()
+	pack.Message.SetPayload("Write me out to the network")
+
+	oth.MockOutputRunner.EXPECT().InChan().Return(inChan)
+	oth.MockOutputRunner.EXPECT().Encoder().Return(encoder)
+	oth.MockOutputRunner.EXPECT().Encode(pack).Return(encoder.Encode(pack))
+	// The failed message is sent again until HandleFailure gives up on it.
+	oth.MockOutputRunner.EXPECT().HandleFailure(pack,
+		sarama.ErrBrokerNotAvailable).Return(true)
+	oth.MockOutputRunner.EXPECT().HandleFailure(pack,
+		sarama.ErrBrokerNotAvailable).Return(false)
+
+	inChan <- pack
+	close(inChan)
+	if err := ko.Run(oth.MockOutputRunner, oth.MockHelper); err != nil {
+		t.Errorf("Error running output %s", err)
+	}
+
+	msgcount := atomic.LoadInt64(&ko.processMessageCount)
+	if msgcount != 1 {
+		t.Errorf("Invalid ending processMessageCount %d", msgcount)
+	}
+	msgcount = atomic.LoadInt64(&ko.processMessageFailures)
+	if msgcount != 1 {
+		t.Errorf("Invalid ending processMessageFailures %d", msgcount)
+	}
+}
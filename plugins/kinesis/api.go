@@ -0,0 +1,323 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package kinesis
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/mozilla-services/heka/pipeline"
+	"github.com/mozilla-services/heka/plugins/aws"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// The Kinesis API calls the plugins use, faked in tests.
+type kinesisAPI interface {
+	// Lists all shards of a stream, including closed ones still within the
+	// retention period.
+	ListShards(stream string) ([]Shard, error)
+	GetShardIterator(stream, shardId, iteratorType, sequenceNumber string) (string, error)
+	GetRecords(iterator string, limit int) (*GetRecordsOutput, error)
+	PutRecords(stream string, records []PutRecordsEntry) (*PutRecordsOutput, error)
+}
+
+type SequenceNumberRange struct {
+	StartingSequenceNumber string
+	EndingSequenceNumber   string `json:",omitempty"`
+}
+
+// A shard of a stream. A shard closed by resharding has an ending sequence
+// number, and the shards it was split into or merged into have it as their
+// parent.
+type Shard struct {
+	ShardId               string
+	ParentShardId         string `json:",omitempty"`
+	AdjacentParentShardId string `json:",omitempty"`
+	SequenceNumberRange   SequenceNumberRange
+}
+
+// Returns the IDs of the shard's parents.
+func (s *Shard) parents() (ids []string) {
+	for _, id := range []string{s.ParentShardId, s.AdjacentParentShardId} {
+		if id != "" {
+			ids = append(ids, id)
+		}
+	}
+	return
+}
+
+type Record struct {
+	Data           []byte
+	PartitionKey   string
+	SequenceNumber string
+	// Seconds since the epoch.
+	ApproximateArrivalTimestamp float64 `json:",omitempty"`
+}
+
+type GetRecordsOutput struct {
+	Records []Record
+	// Nil once a closed shard has been read to its end.
+	NextShardIterator  *string
+	MillisBehindLatest int64
+}
+
+type PutRecordsEntry struct {
+	Data         []byte
+	PartitionKey string
+}
+
+type PutRecordsResult struct {
+	SequenceNumber string `json:",omitempty"`
+	ShardId        string `json:",omitempty"`
+	ErrorCode      string `json:",omitempty"`
+	ErrorMessage   string `json:",omitempty"`
+}
+
+type PutRecordsOutput struct {
+	FailedRecordCount int
+	// In the order of the records put.
+	Records []PutRecordsResult
+}
+
+// kinesisAPI implementation using the Kinesis JSON API.
+type kinesisClient struct {
+	client *aws.Client
+}
+
+func newKinesisClient(region, endpoint string,
+	creds aws.CredentialsProvider) (*kinesisClient, error) {
+
+	client, err := aws.NewClient("kinesis", region, endpoint, "Kinesis_20131202",
+		"application/x-amz-json-1.1", creds)
+	if err != nil {
+		return nil, err
+	}
+	return &kinesisClient{client}, nil
+}
+
+func (k *kinesisClient) ListShards(stream string) (shards []Shard, err error) {
+	type describeStreamInput struct {
+		StreamName            string
+		ExclusiveStartShardId string `json:",omitempty"`
+	}
+	in := &describeStreamInput{StreamName: stream}
+	for {
+		var out struct {
+			StreamDescription struct {
+				Shards        []Shard
+				HasMoreShards bool
+			}
+		}
+		if err = k.client.Call("DescribeStream", in, &out); err != nil {
+			return nil, err
+		}
+		page := out.StreamDescription.Shards
+		shards = append(shards, page...)
+		if !out.StreamDescription.HasMoreShards || len(page) == 0 {
+			return shards, nil
+		}
+		in.ExclusiveStartShardId = page[len(page)-1].ShardId
+	}
+}
+
+func (k *kinesisClient) GetShardIterator(stream, shardId, iteratorType,
+	sequenceNumber string) (string, error) {
+
+	in := struct {
+		StreamName             string
+		ShardId                string
+		ShardIteratorType      string
+		StartingSequenceNumber string `json:",omitempty"`
+	}{stream, shardId, iteratorType, sequenceNumber}
+	var out struct {
+		ShardIterator string
+	}
+	err := k.client.Call("GetShardIterator", &in, &out)
+	return out.ShardIterator, err
+}
+
+func (k *kinesisClient) GetRecords(iterator string, limit int) (*GetRecordsOutput, error) {
+	in := struct {
+		ShardIterator string
+		Limit         int
+	}{iterator, limit}
+	out := new(GetRecordsOutput)
+	if err := k.client.Call("GetRecords", &in, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (k *kinesisClient) PutRecords(stream string,
+	records []PutRecordsEntry) (*PutRecordsOutput, error) {
+
+	in := struct {
+		StreamName string
+		Records    []PutRecordsEntry
+	}{stream, records}
+	out := new(PutRecordsOutput)
+	if err := k.client.Call("PutRecords", &in, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// Classifies a Kinesis error the way outputs report failures.
+func classifyError(err error) error {
+	if awsErr, ok := err.(*aws.Error); ok {
+		switch {
+		case awsErr.Throttled():
+			return pipeline.NewThrottledError(err, 0)
+		case awsErr.Retryable():
+			return pipeline.NewRetryableError(err)
+		case awsErr.Code == "ResourceNotFoundException":
+			// The stream may be being created.
+			return pipeline.NewRetryableError(err)
+		}
+		return pipeline.NewFatalError(err)
+	}
+	// Network errors.
+	return pipeline.NewRetryableError(err)
+}
+
+// A shard's position, i.e. the last record handed on, and whether the shard
+// was read to its end after being closed by resharding.
+type checkpoint struct {
+	SequenceNumber string
+	Finished       bool
+}
+
+// Where KinesisInput keeps the position of each shard.
+type checkpointStore interface {
+	Get(shardId string) (checkpoint, error)
+	Set(shardId string, cp checkpoint) error
+}
+
+// Checkpoints kept in a DynamoDB table, so they survive the loss of the host
+// and can be shared with a replacement. The table's hash key must be a string
+// attribute named "ShardKey".
+type dynamoCheckpoints struct {
+	client *aws.Client
+	table  string
+	// Prefixed to shard IDs to build the ShardKey, so several applications
+	// and streams can share a table.
+	prefix string
+	owner  string
+}
+
+func newDynamoCheckpoints(region, endpoint, table, prefix, owner string,
+	creds aws.CredentialsProvider) (*dynamoCheckpoints, error) {
+
+	client, err := aws.NewClient("dynamodb", region, endpoint, "DynamoDB_20120810",
+		"application/x-amz-json-1.0", creds)
+	if err != nil {
+		return nil, err
+	}
+	return &dynamoCheckpoints{client, table, prefix, owner}, nil
+}
+
+// A DynamoDB attribute value.
+type attributeValue struct {
+	S    *string `json:",omitempty"`
+	BOOL *bool   `json:",omitempty"`
+}
+
+func stringValue(s string) attributeValue {
+	return attributeValue{S: &s}
+}
+
+func (d *dynamoCheckpoints) Get(shardId string) (cp checkpoint, err error) {
+	in := struct {
+		TableName      string
+		Key            map[string]attributeValue
+		ConsistentRead bool
+	}{
+		TableName:      d.table,
+		Key:            map[string]attributeValue{"ShardKey": stringValue(d.prefix + shardId)},
+		ConsistentRead: true,
+	}
+	var out struct {
+		Item map[string]attributeValue
+	}
+	if err = d.client.Call("GetItem", &in, &out); err != nil {
+		return
+	}
+	if v := out.Item["SequenceNumber"].S; v != nil {
+		cp.SequenceNumber = *v
+	}
+	if v := out.Item["Finished"].BOOL; v != nil {
+		cp.Finished = *v
+	}
+	return
+}
+
+func (d *dynamoCheckpoints) Set(shardId string, cp checkpoint) error {
+	item := map[string]attributeValue{
+		"ShardKey": stringValue(d.prefix + shardId),
+		"Owner":    stringValue(d.owner),
+		"Finished": {BOOL: &cp.Finished},
+	}
+	if cp.SequenceNumber != "" {
+		item["SequenceNumber"] = stringValue(cp.SequenceNumber)
+	}
+	in := struct {
+		TableName string
+		Item      map[string]attributeValue
+	}{d.table, item}
+	return d.client.Call("PutItem", &in, nil)
+}
+
+// Checkpoints kept in a JSON file in the base_dir, when no DynamoDB table is
+// configured.
+type fileCheckpoints struct {
+	path        string
+	lock        sync.Mutex
+	checkpoints map[string]checkpoint
+}
+
+func newFileCheckpoints(path string) (*fileCheckpoints, error) {
+	f := &fileCheckpoints{path: path, checkpoints: make(map[string]checkpoint)}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return f, os.MkdirAll(filepath.Dir(path), 0755)
+	} else if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(data, &f.checkpoints); err != nil {
+		return nil, fmt.Errorf("corrupt checkpoint file %s: %s", path, err)
+	}
+	return f, nil
+}
+
+func (f *fileCheckpoints) Get(shardId string) (checkpoint, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.checkpoints[shardId], nil
+}
+
+// Rewrites the whole file, replacing it atomically.
+func (f *fileCheckpoints) Set(shardId string, cp checkpoint) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.checkpoints[shardId] = cp
+	data, err := json.Marshal(f.checkpoints)
+	if err != nil {
+		return err
+	}
+	tmpPath := f.path + ".tmp"
+	if err = ioutil.WriteFile(tmpPath, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, f.path)
+}
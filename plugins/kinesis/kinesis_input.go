@@ -0,0 +1,411 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package kinesis
+
+import (
+	"code.google.com/p/go-uuid/uuid"
+	"errors"
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+	"github.com/mozilla-services/heka/pipeline"
+	"github.com/mozilla-services/heka/plugins/aws"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type KinesisInputConfig struct {
+	// Name of the stream to read.
+	Stream   string
+	Region   string
+	Endpoint string
+	// Credentials, if not taken from the environment or the instance's IAM
+	// role.
+	AccessKeyID     string `toml:"access_key_id"`
+	SecretAccessKey string `toml:"secret_access_key"`
+	SessionToken    string `toml:"session_token"`
+	// DynamoDB table in which the position of each shard is checkpointed. If
+	// empty, the checkpoints are kept in a file in the base_dir.
+	CheckpointTable  string `toml:"checkpoint_table"`
+	DynamoDBEndpoint string `toml:"dynamodb_endpoint"`
+	// Distinguishes the checkpoints of several consumers of a stream sharing
+	// a table. Defaults to the plugin name.
+	ApplicationName string `toml:"application_name"`
+	// Where shards without a checkpoint are read from, "TRIM_HORIZON" (the
+	// oldest record) or "LATEST". Shards created by resharding while
+	// running are always read from the oldest record.
+	InitialPosition string `toml:"initial_position"`
+	// Milliseconds to wait before polling a shard that had no new records.
+	PollInterval uint32 `toml:"poll_interval"`
+	// Maximum number of records fetched per request.
+	MaxRecords int `toml:"max_records"`
+	// Seconds between checks for shards created by resharding.
+	ShardRefreshInterval uint32 `toml:"shard_refresh_interval"`
+}
+
+// Reads the records of every shard of a Kinesis stream, checkpointing each
+// shard's position after handing its records on. Closed shards are read to
+// their end before the shards they were split or merged into, so records
+// with the same partition key stay in order across resharding.
+type KinesisInput struct {
+	recordsReceived int64
+	throttles       int64
+	activeShards    int64
+
+	conf        *KinesisInputConfig
+	api         kinesisAPI
+	checkpoints checkpointStore
+	pConfig     *pipeline.PipelineConfig
+	name        string
+	stopChan    chan struct{}
+	stopLock    sync.Mutex
+	stopped     bool
+	// Receives the IDs of the shards read to their end.
+	finishedChan chan string
+	wg           sync.WaitGroup
+	// Shards being read, and those read to their end.
+	reading  map[string]bool
+	finished map[string]bool
+	// Whether the shards have been listed since the input started.
+	started bool
+}
+
+func (k *KinesisInput) ConfigStruct() interface{} {
+	return &KinesisInputConfig{
+		InitialPosition:      "LATEST",
+		PollInterval:         1000,
+		MaxRecords:           1000,
+		ShardRefreshInterval: 60,
+	}
+}
+
+func (k *KinesisInput) SetPipelineConfig(pConfig *pipeline.PipelineConfig) {
+	k.pConfig = pConfig
+}
+
+func (k *KinesisInput) SetName(name string) {
+	k.name = name
+}
+
+func (k *KinesisInput) Init(config interface{}) (err error) {
+	k.conf = config.(*KinesisInputConfig)
+	if k.conf.Stream == "" {
+		return errors.New("stream must be specified")
+	}
+	switch k.conf.InitialPosition {
+	case "TRIM_HORIZON", "LATEST":
+	default:
+		return fmt.Errorf("invalid initial_position: %s", k.conf.InitialPosition)
+	}
+	if k.conf.MaxRecords < 1 || k.conf.MaxRecords > 10000 {
+		return errors.New("max_records must be between 1 and 10000")
+	}
+	if k.conf.ApplicationName == "" {
+		k.conf.ApplicationName = k.name
+	}
+	creds := aws.NewCredentialsProvider(k.conf.AccessKeyID, k.conf.SecretAccessKey,
+		k.conf.SessionToken)
+	if k.api == nil {
+		if k.api, err = newKinesisClient(k.conf.Region, k.conf.Endpoint, creds); err != nil {
+			return
+		}
+	}
+	if k.checkpoints == nil {
+		if k.conf.CheckpointTable != "" {
+			k.checkpoints, err = newDynamoCheckpoints(k.conf.Region,
+				k.conf.DynamoDBEndpoint, k.conf.CheckpointTable,
+				k.conf.ApplicationName+"/"+k.conf.Stream+"/", k.pConfig.Hostname(), creds)
+		} else {
+			k.checkpoints, err = newFileCheckpoints(k.pConfig.Globals.PrependBaseDir(
+				filepath.Join("kinesis", k.conf.ApplicationName+"."+k.conf.Stream+".json")))
+		}
+	}
+	return
+}
+
+func (k *KinesisInput) Run(ir pipeline.InputRunner, h pipeline.PluginHelper) (err error) {
+	k.stopLock.Lock()
+	k.stopChan = make(chan struct{})
+	k.stopped = false
+	k.stopLock.Unlock()
+	k.finishedChan = make(chan string)
+	k.reading = make(map[string]bool)
+	k.finished = make(map[string]bool)
+	k.started = false
+	packSupply := ir.InChan()
+	defer k.wg.Wait()
+
+	// Fail early, so a misconfigured stream is retried and reported.
+	if err = k.refreshShards(ir, packSupply); err != nil {
+		k.Stop()
+		return fmt.Errorf("can't list the shards of %s: %s", k.conf.Stream, err)
+	}
+	ticker := time.NewTicker(time.Duration(k.conf.ShardRefreshInterval) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-k.stopChan:
+			return nil
+		case shardId := <-k.finishedChan:
+			delete(k.reading, shardId)
+			k.finished[shardId] = true
+			atomic.AddInt64(&k.activeShards, -1)
+			// Start reading the shards it was split or merged into.
+			if e := k.refreshShards(ir, packSupply); e != nil {
+				ir.LogError(fmt.Errorf("can't list shards: %s", e))
+			}
+		case <-ticker.C:
+			if e := k.refreshShards(ir, packSupply); e != nil {
+				ir.LogError(fmt.Errorf("can't list shards: %s", e))
+			}
+		}
+	}
+}
+
+// Starts reading the shards that aren't being read yet, unless they were
+// read to their end already or their parents are still being read.
+func (k *KinesisInput) refreshShards(ir pipeline.InputRunner,
+	packSupply chan *pipeline.PipelinePack) error {
+
+	shards, err := k.api.ListShards(k.conf.Stream)
+	if err != nil {
+		return err
+	}
+	listed := make(map[string]bool, len(shards))
+	for _, shard := range shards {
+		listed[shard.ShardId] = true
+	}
+	for _, shard := range shards {
+		id := shard.ShardId
+		if k.reading[id] || k.finished[id] {
+			continue
+		}
+		cp, err := k.checkpoints.Get(id)
+		if err != nil {
+			return fmt.Errorf("can't read the checkpoint of shard %s: %s", id, err)
+		}
+		if cp.Finished {
+			k.finished[id] = true
+			continue
+		}
+		ready := true
+		for _, parent := range shard.parents() {
+			// Parents past the retention period are no longer listed.
+			if listed[parent] && !k.isFinished(parent) {
+				ready = false
+			}
+		}
+		if !ready {
+			continue
+		}
+		// Shards created by resharding since the input started, or whose
+		// parents were read to their end, are read from their start.
+		position := k.conf.InitialPosition
+		for _, parent := range shard.parents() {
+			if k.finished[parent] {
+				position = "TRIM_HORIZON"
+			}
+		}
+		if k.started {
+			position = "TRIM_HORIZON"
+		}
+		k.reading[id] = true
+		atomic.AddInt64(&k.activeShards, 1)
+		k.wg.Add(1)
+		go k.readShard(ir, packSupply, id, position, cp.SequenceNumber)
+	}
+	k.started = true
+	return nil
+}
+
+// Whether a shard has been read to its end, checking its checkpoint if it
+// isn't known to be.
+func (k *KinesisInput) isFinished(shardId string) bool {
+	if k.finished[shardId] {
+		return true
+	}
+	if k.reading[shardId] {
+		return false
+	}
+	cp, err := k.checkpoints.Get(shardId)
+	if err == nil && cp.Finished {
+		k.finished[shardId] = true
+	}
+	return k.finished[shardId]
+}
+
+// Waits for the specified duration, returning false if the input is stopped
+// in the meantime.
+func (k *KinesisInput) sleep(d time.Duration) bool {
+	select {
+	case <-k.stopChan:
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
+
+// Reads a shard from its checkpoint, or the specified position if it has
+// none, until it's read to its end or the input is stopped.
+func (k *KinesisInput) readShard(ir pipeline.InputRunner,
+	packSupply chan *pipeline.PipelinePack, shardId, position, last string) {
+
+	defer k.wg.Done()
+	var (
+		iterator    string
+		err         error
+		pollDelay   = time.Duration(k.conf.PollInterval) * time.Millisecond
+		backoff     = pollDelay
+		hostname    = k.pConfig.Hostname()
+		useMsgBytes = ir.UseMsgBytes()
+	)
+	for {
+		if iterator == "" {
+			if last != "" {
+				iterator, err = k.api.GetShardIterator(k.conf.Stream, shardId,
+					"AFTER_SEQUENCE_NUMBER", last)
+			} else {
+				iterator, err = k.api.GetShardIterator(k.conf.Stream, shardId, position, "")
+			}
+			if err != nil {
+				ir.LogError(fmt.Errorf("shard %s: can't get an iterator: %s", shardId, err))
+				if !k.sleep(backoff) {
+					return
+				}
+				continue
+			}
+		}
+
+		out, err := k.api.GetRecords(iterator, k.conf.MaxRecords)
+		if err != nil {
+			if awsErr, ok := err.(*aws.Error); ok && awsErr.Throttled() {
+				atomic.AddInt64(&k.throttles, 1)
+				// Back off up to a minute while the shard's throughput is
+				// exceeded.
+				if backoff *= 2; backoff > time.Minute {
+					backoff = time.Minute
+				}
+			} else {
+				ir.LogError(fmt.Errorf("shard %s: %s", shardId, err))
+				// Iterators expire after a few minutes, and may be
+				// invalidated by errors, so start over from the checkpoint.
+				iterator = ""
+			}
+			if !k.sleep(backoff) {
+				return
+			}
+			continue
+		}
+		backoff = pollDelay
+
+		for _, record := range out.Records {
+			var pack *pipeline.PipelinePack
+			select {
+			case pack = <-packSupply:
+			case <-k.stopChan:
+				k.saveCheckpoint(ir, shardId, checkpoint{SequenceNumber: last})
+				return
+			}
+			k.populatePack(pack, &record, shardId, hostname, useMsgBytes)
+			ir.Deliver(pack)
+			last = record.SequenceNumber
+			atomic.AddInt64(&k.recordsReceived, 1)
+		}
+		if out.NextShardIterator == nil {
+			// The shard was closed by resharding and has been read to its
+			// end.
+			if k.saveCheckpoint(ir, shardId, checkpoint{last, true}) {
+				select {
+				case k.finishedChan <- shardId:
+				case <-k.stopChan:
+				}
+			}
+			return
+		}
+		if len(out.Records) > 0 {
+			k.saveCheckpoint(ir, shardId, checkpoint{SequenceNumber: last})
+		}
+		iterator = *out.NextShardIterator
+		if len(out.Records) < k.conf.MaxRecords && !k.sleep(pollDelay) {
+			return
+		}
+	}
+}
+
+func (k *KinesisInput) saveCheckpoint(ir pipeline.InputRunner, shardId string,
+	cp checkpoint) bool {
+
+	if cp.SequenceNumber == "" && !cp.Finished {
+		return true
+	}
+	if err := k.checkpoints.Set(shardId, cp); err != nil {
+		ir.LogError(fmt.Errorf("shard %s: can't save checkpoint: %s", shardId, err))
+		return false
+	}
+	return true
+}
+
+// Fills a pack with a record, either as the raw record data (for use with a
+// decoder) or as a "heka.kinesis" message with the data as the payload.
+func (k *KinesisInput) populatePack(pack *pipeline.PipelinePack, record *Record,
+	shardId, hostname string, useMsgBytes bool) {
+
+	if useMsgBytes {
+		pack.MsgBytes = append(pack.MsgBytes[:0], record.Data...)
+		return
+	}
+	msg := pack.Message
+	msg.SetUuid(uuid.NewRandom())
+	if record.ApproximateArrivalTimestamp > 0 {
+		msg.SetTimestamp(int64(record.ApproximateArrivalTimestamp * 1e9))
+	} else {
+		msg.SetTimestamp(time.Now().UnixNano())
+	}
+	msg.SetType("heka.kinesis")
+	msg.SetLogger(k.name)
+	msg.SetHostname(hostname)
+	msg.SetPayload(string(record.Data))
+	message.NewStringField(msg, "Stream", k.conf.Stream)
+	message.NewStringField(msg, "ShardId", shardId)
+	message.NewStringField(msg, "SequenceNumber", record.SequenceNumber)
+	message.NewStringField(msg, "PartitionKey", record.PartitionKey)
+}
+
+// Also called by Run when it fails, so may be called twice.
+func (k *KinesisInput) Stop() {
+	k.stopLock.Lock()
+	defer k.stopLock.Unlock()
+	if !k.stopped && k.stopChan != nil {
+		k.stopped = true
+		close(k.stopChan)
+	}
+}
+
+func (k *KinesisInput) ReportMsg(msg *message.Message) error {
+	message.NewInt64Field(msg, "RecordsReceived",
+		atomic.LoadInt64(&k.recordsReceived), "count")
+	message.NewInt64Field(msg, "Throttles", atomic.LoadInt64(&k.throttles), "count")
+	message.NewInt64Field(msg, "ActiveShards", atomic.LoadInt64(&k.activeShards),
+		"count")
+	return nil
+}
+
+func (k *KinesisInput) CleanupForRestart() {
+	atomic.StoreInt64(&k.activeShards, 0)
+}
+
+func init() {
+	pipeline.RegisterPlugin("KinesisInput", func() interface{} {
+		return new(KinesisInput)
+	})
+}
@@ -0,0 +1,273 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package kinesis
+
+import (
+	"code.google.com/p/go-uuid/uuid"
+	"errors"
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+	"github.com/mozilla-services/heka/pipeline"
+	"github.com/mozilla-services/heka/plugins/aws"
+	"sync/atomic"
+	"time"
+)
+
+// Limits of the PutRecords API.
+const (
+	maxBatchRecords    = 500
+	maxBatchBytes      = 5 << 20
+	maxRecordBytes     = 1 << 20
+	maxPartitionKeyLen = 256
+)
+
+type KinesisOutputConfig struct {
+	// Name of the stream to write to.
+	Stream   string
+	Region   string
+	Endpoint string
+	// Credentials, if not taken from the environment or the instance's IAM
+	// role.
+	AccessKeyID     string `toml:"access_key_id"`
+	SecretAccessKey string `toml:"secret_access_key"`
+	SessionToken    string `toml:"session_token"`
+	// Partition key rendered from message headers and fields, e.g.
+	// "%{Hostname}", which decides the shard of each record. If empty, or if
+	// a message is missing a referenced value and there's no fallback, a
+	// random key is used, spreading the records over all shards.
+	PartitionKey         string `toml:"partition_key"`
+	FallbackPartitionKey string `toml:"fallback_partition_key"`
+	// Milliseconds after which accumulated records are put even if the batch
+	// isn't full.
+	FlushInterval uint32 `toml:"flush_interval"`
+	// Number of records that triggers a put, at most 500.
+	FlushCount int `toml:"flush_count"`
+	// Size of the accumulated records, in bytes, that triggers a put, at
+	// most 5MiB.
+	FlushBytes int `toml:"flush_bytes"`
+	// The output's retry settings, also used to back off from throttled and
+	// failed puts.
+	Retries pipeline.RetryOptions
+}
+
+// Writes encoded messages to a Kinesis stream, batching them into PutRecords
+// requests. Records rejected individually, e.g. because their shard's
+// throughput is exceeded, are retried on their own.
+type KinesisOutput struct {
+	recordsSent    int64
+	recordsDropped int64
+	putRetries     int64
+	throttles      int64
+
+	conf         *KinesisOutputConfig
+	api          kinesisAPI
+	partitionKey *pipeline.DestinationTemplate
+	retries      *pipeline.RetryHelper
+	pConfig      *pipeline.PipelineConfig
+	// Accumulated records and their total size.
+	batch      []PutRecordsEntry
+	batchBytes int
+}
+
+func (k *KinesisOutput) ConfigStruct() interface{} {
+	return &KinesisOutputConfig{
+		FlushInterval: 1000,
+		FlushCount:    maxBatchRecords,
+		FlushBytes:    maxBatchBytes,
+		Retries: pipeline.RetryOptions{
+			MaxDelay:   "30s",
+			Delay:      "250ms",
+			MaxRetries: -1,
+		},
+	}
+}
+
+func (k *KinesisOutput) SetPipelineConfig(pConfig *pipeline.PipelineConfig) {
+	k.pConfig = pConfig
+}
+
+func (k *KinesisOutput) Init(config interface{}) (err error) {
+	k.conf = config.(*KinesisOutputConfig)
+	if k.conf.Stream == "" {
+		return errors.New("stream must be specified")
+	}
+	if k.conf.FlushCount < 1 || k.conf.FlushCount > maxBatchRecords {
+		return fmt.Errorf("flush_count must be between 1 and %d", maxBatchRecords)
+	}
+	if k.conf.FlushBytes < 1 || k.conf.FlushBytes > maxBatchBytes {
+		return fmt.Errorf("flush_bytes must be between 1 and %d", maxBatchBytes)
+	}
+	if k.conf.PartitionKey != "" {
+		k.partitionKey, err = pipeline.NewDestinationTemplate(pipeline.DestinationTemplateConfig{
+			Template: k.conf.PartitionKey,
+			Fallback: k.conf.FallbackPartitionKey,
+		})
+		if err != nil {
+			return fmt.Errorf("invalid partition_key: %s", err)
+		}
+	}
+	if k.retries, err = pipeline.NewRetryHelper(k.conf.Retries); err != nil {
+		return fmt.Errorf("invalid retries: %s", err)
+	}
+	if k.api == nil {
+		creds := aws.NewCredentialsProvider(k.conf.AccessKeyID, k.conf.SecretAccessKey,
+			k.conf.SessionToken)
+		k.api, err = newKinesisClient(k.conf.Region, k.conf.Endpoint, creds)
+	}
+	return
+}
+
+func (k *KinesisOutput) Run(or pipeline.OutputRunner, h pipeline.PluginHelper) (err error) {
+	if or.Encoder() == nil {
+		return errors.New("Encoder required.")
+	}
+	ticker := time.NewTicker(time.Duration(k.conf.FlushInterval) * time.Millisecond)
+	defer ticker.Stop()
+	inChan := or.InChan()
+	for {
+		select {
+		case pack, ok := <-inChan:
+			if !ok {
+				k.flush(or)
+				return nil
+			}
+			k.add(or, pack)
+		case <-ticker.C:
+			k.flush(or)
+		}
+	}
+}
+
+// Encodes a message and adds it to the batch, putting the batch first if the
+// record wouldn't fit.
+func (k *KinesisOutput) add(or pipeline.OutputRunner, pack *pipeline.PipelinePack) {
+	data, err := or.Encode(pack)
+	if err != nil {
+		atomic.AddInt64(&k.recordsDropped, 1)
+		or.HandleFailure(pack, pipeline.NewMalformedMessageError(err))
+		return
+	}
+	if data == nil {
+		pack.Recycle()
+		return
+	}
+	key := k.resolvePartitionKey(or, pack.Message)
+	size := len(data) + len(key)
+	if size > maxRecordBytes {
+		atomic.AddInt64(&k.recordsDropped, 1)
+		or.HandleFailure(pack, pipeline.NewMalformedMessageError(fmt.Errorf(
+			"record of %d bytes exceeds the limit of %d", size, maxRecordBytes)))
+		return
+	}
+	// The encoded data may be reused once the pack is recycled.
+	entry := PutRecordsEntry{Data: append([]byte(nil), data...), PartitionKey: key}
+	pack.Recycle()
+
+	if k.batchBytes+size > k.conf.FlushBytes {
+		k.flush(or)
+	}
+	k.batch = append(k.batch, entry)
+	k.batchBytes += size
+	if len(k.batch) >= k.conf.FlushCount || k.batchBytes >= k.conf.FlushBytes {
+		k.flush(or)
+	}
+}
+
+func (k *KinesisOutput) resolvePartitionKey(or pipeline.OutputRunner,
+	msg *message.Message) (key string) {
+
+	if k.partitionKey != nil {
+		var err error
+		if key, err = k.partitionKey.Destination(msg); err != nil {
+			key = ""
+		}
+	}
+	if key == "" {
+		return uuid.NewRandom().String()
+	}
+	if len(key) > maxPartitionKeyLen {
+		key = key[:maxPartitionKeyLen]
+	}
+	return key
+}
+
+// Puts the accumulated records, backing off and retrying the records that
+// failed while the failures are worth retrying. Records that can't be put are
+// dropped.
+func (k *KinesisOutput) flush(or pipeline.OutputRunner) {
+	records := k.batch
+	if len(records) == 0 {
+		return
+	}
+	k.batch = nil
+	k.batchBytes = 0
+	k.retries.Reset()
+	for {
+		out, err := k.api.PutRecords(k.conf.Stream, records)
+		if err == nil {
+			records = failedRecords(records, out)
+			if len(records) == 0 {
+				atomic.AddInt64(&k.recordsSent, int64(len(out.Records)))
+				return
+			}
+			atomic.AddInt64(&k.recordsSent, int64(len(out.Records)-len(records)))
+			atomic.AddInt64(&k.throttles, 1)
+		} else {
+			or.LogError(err)
+			kind := pipeline.ClassifyError(classifyError(err))
+			if kind == pipeline.ErrKindThrottled {
+				atomic.AddInt64(&k.throttles, 1)
+			} else if kind != pipeline.ErrKindRetryable {
+				break
+			}
+		}
+		if k.pConfig != nil && k.pConfig.Globals.IsShuttingDown() {
+			break
+		}
+		if k.retries.Wait() != nil {
+			or.LogError(errors.New("retries exhausted"))
+			break
+		}
+		atomic.AddInt64(&k.putRetries, 1)
+	}
+	atomic.AddInt64(&k.recordsDropped, int64(len(records)))
+	or.LogError(fmt.Errorf("dropping %d records", len(records)))
+}
+
+// Returns the records a PutRecords call failed to put.
+func failedRecords(records []PutRecordsEntry, out *PutRecordsOutput) []PutRecordsEntry {
+	if out.FailedRecordCount == 0 {
+		return nil
+	}
+	failed := make([]PutRecordsEntry, 0, out.FailedRecordCount)
+	for i, result := range out.Records {
+		if result.ErrorCode != "" && i < len(records) {
+			failed = append(failed, records[i])
+		}
+	}
+	return failed
+}
+
+func (k *KinesisOutput) ReportMsg(msg *message.Message) error {
+	message.NewInt64Field(msg, "RecordsSent", atomic.LoadInt64(&k.recordsSent), "count")
+	message.NewInt64Field(msg, "RecordsDropped", atomic.LoadInt64(&k.recordsDropped),
+		"count")
+	message.NewInt64Field(msg, "PutRetries", atomic.LoadInt64(&k.putRetries), "count")
+	message.NewInt64Field(msg, "Throttles", atomic.LoadInt64(&k.throttles), "count")
+	return nil
+}
+
+func init() {
+	pipeline.RegisterPlugin("KinesisOutput", func() interface{} {
+		return new(KinesisOutput)
+	})
+}
@@ -0,0 +1,296 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package kinesis
+
+import (
+	"github.com/mozilla-services/heka/message"
+	. "github.com/mozilla-services/heka/pipeline"
+	"github.com/mozilla-services/heka/pipelinemock"
+	"github.com/rafrombrc/gomock/gomock"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Kinesis API fake, serving a stream whose shard s0 was split into s1.
+type fakeKinesis struct {
+	lock      sync.Mutex
+	shards    []Shard
+	records   map[string][]Record
+	iterators map[string]string // Iterator types requested, by shard.
+	puts      [][]PutRecordsEntry
+	putErrors [][]string // Error codes returned by successive puts.
+}
+
+func (f *fakeKinesis) ListShards(stream string) ([]Shard, error) {
+	return f.shards, nil
+}
+
+func (f *fakeKinesis) GetShardIterator(stream, shardId, iteratorType,
+	sequenceNumber string) (string, error) {
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.iterators[shardId] = iteratorType
+	return shardId, nil
+}
+
+func (f *fakeKinesis) GetRecords(iterator string, limit int) (*GetRecordsOutput, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	out := &GetRecordsOutput{Records: f.records[iterator]}
+	f.records[iterator] = nil
+	for _, shard := range f.shards {
+		if shard.ShardId == iterator && shard.SequenceNumberRange.EndingSequenceNumber == "" {
+			// Still open.
+			out.NextShardIterator = &iterator
+		}
+	}
+	return out, nil
+}
+
+func (f *fakeKinesis) PutRecords(stream string,
+	records []PutRecordsEntry) (*PutRecordsOutput, error) {
+
+	f.puts = append(f.puts, records)
+	out := &PutRecordsOutput{Records: make([]PutRecordsResult, len(records))}
+	if len(f.putErrors) > 0 {
+		for i, code := range f.putErrors[0] {
+			if code != "" {
+				out.Records[i].ErrorCode = code
+				out.FailedRecordCount++
+			}
+		}
+		f.putErrors = f.putErrors[1:]
+	}
+	return out, nil
+}
+
+type memCheckpoints struct {
+	lock        sync.Mutex
+	checkpoints map[string]checkpoint
+}
+
+func (m *memCheckpoints) Get(shardId string) (checkpoint, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.checkpoints[shardId], nil
+}
+
+func (m *memCheckpoints) Set(shardId string, cp checkpoint) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.checkpoints[shardId] = cp
+	return nil
+}
+
+func TestInputConfig(t *testing.T) {
+	ki := new(KinesisInput)
+	ki.SetPipelineConfig(NewPipelineConfig(nil))
+	config := ki.ConfigStruct().(*KinesisInputConfig)
+	if err := ki.Init(config); err == nil || err.Error() != "stream must be specified" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	config.Stream = "logs"
+	config.InitialPosition = "EARLIEST"
+	if err := ki.Init(config); err == nil ||
+		err.Error() != "invalid initial_position: EARLIEST" {
+
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestInputReadsParentShardsFirst(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	api := &fakeKinesis{
+		shards: []Shard{
+			{ShardId: "s1", ParentShardId: "s0"},
+			{ShardId: "s0", SequenceNumberRange: SequenceNumberRange{"1", "2"}},
+		},
+		records: map[string][]Record{
+			"s0": {{Data: []byte("a"), SequenceNumber: "1"},
+				{Data: []byte("b"), SequenceNumber: "2"}},
+			"s1": {{Data: []byte("c"), SequenceNumber: "3", PartitionKey: "k"}},
+		},
+		iterators: make(map[string]string),
+	}
+	checkpoints := &memCheckpoints{checkpoints: make(map[string]checkpoint)}
+	ki := &KinesisInput{api: api, checkpoints: checkpoints}
+	ki.SetName("kinesis")
+	ki.SetPipelineConfig(NewPipelineConfig(nil))
+	config := ki.ConfigStruct().(*KinesisInputConfig)
+	config.Stream = "logs"
+	config.PollInterval = 10
+	if err := ki.Init(config); err != nil {
+		t.Fatal(err)
+	}
+
+	packSupply := make(chan *PipelinePack, 1)
+	packSupply <- NewPipelinePack(packSupply)
+	ir := pipelinemock.NewMockInputRunner(ctrl)
+	ir.EXPECT().InChan().Return(packSupply)
+	ir.EXPECT().UseMsgBytes().Return(false).AnyTimes()
+	ir.EXPECT().LogError(gomock.Any()).AnyTimes()
+	var (
+		payloads []string
+		fields   []string
+		done     = make(chan bool)
+	)
+	ir.EXPECT().Deliver(gomock.Any()).Times(3).Do(func(pack *PipelinePack) {
+		payloads = append(payloads, pack.Message.GetPayload())
+		shard, _ := pack.Message.GetFieldValue("ShardId")
+		fields = append(fields, shard.(string))
+		pack.Recycle()
+		if len(payloads) == 3 {
+			close(done)
+		}
+	})
+
+	errChan := make(chan error)
+	go func() {
+		errChan <- ki.Run(ir, pipelinemock.NewMockPluginHelper(ctrl))
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out, received %v", payloads)
+	}
+	// Let the last checkpoint be saved.
+	time.Sleep(50 * time.Millisecond)
+	ki.Stop()
+	if err := <-errChan; err != nil {
+		t.Fatal(err)
+	}
+
+	if len(payloads) != 3 || payloads[0] != "a" || payloads[1] != "b" || payloads[2] != "c" {
+		t.Errorf("Records out of order: %v", payloads)
+	}
+	if fields[0] != "s0" || fields[2] != "s1" {
+		t.Errorf("Unexpected shards: %v", fields)
+	}
+	// The child shard was created by resharding, so it's read from its start
+	// even though new shards are read from the latest record.
+	if api.iterators["s0"] != "LATEST" || api.iterators["s1"] != "TRIM_HORIZON" {
+		t.Errorf("Unexpected iterator types: %v", api.iterators)
+	}
+	if cp := checkpoints.checkpoints["s0"]; cp.SequenceNumber != "2" || !cp.Finished {
+		t.Errorf("Unexpected checkpoint for s0: %+v", cp)
+	}
+	if cp := checkpoints.checkpoints["s1"]; cp.SequenceNumber != "3" || cp.Finished {
+		t.Errorf("Unexpected checkpoint for s1: %+v", cp)
+	}
+}
+
+func TestFileCheckpoints(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "kinesis-tests")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	path := filepath.Join(tmpDir, "kinesis", "app.logs.json")
+
+	store, err := newFileCheckpoints(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = store.Set("s0", checkpoint{"42", true}); err != nil {
+		t.Fatal(err)
+	}
+	if store, err = newFileCheckpoints(path); err != nil {
+		t.Fatal(err)
+	}
+	if cp, _ := store.Get("s0"); cp.SequenceNumber != "42" || !cp.Finished {
+		t.Errorf("Checkpoint not restored: %+v", cp)
+	}
+	if cp, _ := store.Get("s1"); cp.SequenceNumber != "" {
+		t.Errorf("Unexpected checkpoint: %+v", cp)
+	}
+}
+
+type testEncoder struct{}
+
+func (e *testEncoder) Encode(pack *PipelinePack) ([]byte, error) {
+	return []byte(pack.Message.GetPayload()), nil
+}
+
+func TestOutputRetriesFailedRecords(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	api := &fakeKinesis{putErrors: [][]string{
+		{"", "ProvisionedThroughputExceededException", ""},
+	}}
+	ko := &KinesisOutput{api: api}
+	config := ko.ConfigStruct().(*KinesisOutputConfig)
+	config.Stream = "logs"
+	config.FlushCount = 3
+	config.Retries.Delay = "1ms"
+	if err := ko.Init(config); err != nil {
+		t.Fatal(err)
+	}
+
+	recycleChan := make(chan *PipelinePack, 3)
+	inChan := make(chan *PipelinePack, 3)
+	for _, payload := range []string{"a", "b", "c"} {
+		pack := NewPipelinePack(recycleChan)
+		pack.Message.SetPayload(payload)
+		inChan <- pack
+	}
+	close(inChan)
+	or := pipelinemock.NewMockOutputRunner(ctrl)
+	or.EXPECT().Encoder().Return(&testEncoder{})
+	or.EXPECT().InChan().Return(inChan)
+	or.EXPECT().LogError(gomock.Any()).AnyTimes()
+	for _, payload := range []string{"a", "b", "c"} {
+		or.EXPECT().Encode(gomock.Any()).Return([]byte(payload), nil)
+	}
+
+	if err := ko.Run(or, pipelinemock.NewMockPluginHelper(ctrl)); err != nil {
+		t.Fatal(err)
+	}
+	if len(api.puts) != 2 || len(api.puts[0]) != 3 || len(api.puts[1]) != 1 ||
+		string(api.puts[1][0].Data) != "b" {
+
+		t.Fatalf("Unexpected puts: %v", api.puts)
+	}
+	if ko.recordsSent != 3 || ko.recordsDropped != 0 {
+		t.Errorf("%d records sent, %d dropped", ko.recordsSent, ko.recordsDropped)
+	}
+}
+
+func TestPartitionKey(t *testing.T) {
+	ko := &KinesisOutput{api: new(fakeKinesis)}
+	config := ko.ConfigStruct().(*KinesisOutputConfig)
+	config.Stream = "logs"
+	config.PartitionKey = "%{Hostname}-%{app}"
+	if err := ko.Init(config); err != nil {
+		t.Fatal(err)
+	}
+	msg := new(message.Message)
+	msg.SetHostname("web1")
+	message.NewStringField(msg, "app", "nginx")
+	if key := ko.resolvePartitionKey(nil, msg); key != "web1-nginx" {
+		t.Errorf("Unexpected partition key: %s", key)
+	}
+	// Random keys for messages missing a value.
+	msg = new(message.Message)
+	key1 := ko.resolvePartitionKey(nil, msg)
+	key2 := ko.resolvePartitionKey(nil, msg)
+	if len(key1) != 36 || key1 == key2 {
+		t.Errorf("Unexpected partition keys: %s, %s", key1, key2)
+	}
+}
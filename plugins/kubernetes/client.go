@@ -0,0 +1,122 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package kubernetes
+
+import (
+	"errors"
+	"fmt"
+	"github.com/mozilla-services/heka/plugins/tcp"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Where pods find the credentials of their service account.
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// Minimal Kubernetes API server client, just enough to list, watch, and read
+// the logs of pods.
+type apiClient struct {
+	server    string
+	tokenFile string
+	client    *http.Client
+}
+
+// Creates a client for the specified API server. If `server` is empty the
+// in-cluster API server is used, authenticating with the pod's service
+// account unless another token file or CA file is specified.
+func newAPIClient(server, tokenFile string, tlsConf *tcp.TlsConfig) (*apiClient, error) {
+	if server == "" {
+		host := os.Getenv("KUBERNETES_SERVICE_HOST")
+		if host == "" {
+			return nil, errors.New("`api_server` must be set when not running in a cluster")
+		}
+		server = "https://" + net.JoinHostPort(host, os.Getenv("KUBERNETES_SERVICE_PORT"))
+		if tokenFile == "" {
+			tokenFile = filepath.Join(serviceAccountDir, "token")
+		}
+		if tlsConf.RootCAs == "" {
+			tlsConf.RootCAs = filepath.Join(serviceAccountDir, "ca.crt")
+		}
+	}
+	transport := &http.Transport{Proxy: http.ProxyFromEnvironment}
+	if strings.HasPrefix(server, "https:") {
+		var err error
+		if transport.TLSClientConfig, err = tcp.CreateGoTlsConfig(tlsConf); err != nil {
+			return nil, fmt.Errorf("TLS init error: %s", err)
+		}
+	}
+	return &apiClient{
+		server:    strings.TrimRight(server, "/"),
+		tokenFile: tokenFile,
+		client:    &http.Client{Transport: transport},
+	}, nil
+}
+
+// An error response from the API server.
+type apiError struct {
+	status int
+	body   string
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("API server returned %d: %s", e.status, e.body)
+}
+
+// Sends a GET request for an API path, returning the response if its status
+// is 200 OK. Closing `cancel` aborts the request, including reading the
+// response body.
+func (c *apiClient) get(path string, query url.Values, cancel <-chan struct{}) (
+	*http.Response, error) {
+
+	u := c.server + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Cancel = cancel
+	if c.tokenFile != "" {
+		// Read every time, service account tokens are rotated.
+		token, err := ioutil.ReadFile(c.tokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("can't read token: %s", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		resp.Body.Close()
+		return nil, &apiError{resp.StatusCode, strings.TrimSpace(string(body))}
+	}
+	return resp, nil
+}
+
+// Returns the API path of the pods in a namespace, or in all namespaces if
+// `namespace` is empty.
+func podsPath(namespace string) string {
+	if namespace == "" {
+		return "/api/v1/pods"
+	}
+	return "/api/v1/namespaces/" + url.QueryEscape(namespace) + "/pods"
+}
@@ -0,0 +1,344 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package kubernetes
+
+import (
+	"bufio"
+	"code.google.com/p/go-uuid/uuid"
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+	"github.com/mozilla-services/heka/pipeline"
+	"github.com/mozilla-services/heka/plugins/tcp"
+	"io"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Input tailing the logs of the containers of the pods matching a namespace
+// and selectors through the Kubernetes API server, enriching each line with
+// the metadata of its pod.
+type KubernetesInput struct {
+	conf     *KubernetesInputConfig
+	client   *apiClient
+	cache    *podCache
+	ir       pipeline.InputRunner
+	hostname string
+	lines    chan *logLine
+	stopChan chan struct{}
+	// Tailers by podKey and container name.
+	tailers   map[string]map[string]*logTailer
+	tailersWg sync.WaitGroup
+	// When tailing started, no earlier lines are read unless FromBeginning is
+	// set.
+	started time.Time
+}
+
+type KubernetesInputConfig struct {
+	// API server URL. Defaults to the in-cluster API server.
+	ApiServer string `toml:"api_server"`
+	// File holding the bearer token to authenticate with. Defaults to the
+	// service account token when running in a cluster.
+	TokenFile string `toml:"token_file"`
+	Tls       tcp.TlsConfig
+	// Namespace of the pods to tail. Defaults to all namespaces.
+	Namespace string `toml:"namespace"`
+	// Label selector of the pods to tail, e.g. "app=nginx,tier!=cache".
+	LabelSelector string `toml:"label_selector"`
+	// Only tail the pods on this node, e.g. that of a DaemonSet pod running
+	// Heka. Defaults to all nodes.
+	NodeName string `toml:"node_name"`
+	// Names of the containers to tail. Defaults to all of them.
+	Containers []string `toml:"containers"`
+	// Prefix of the field names of pod labels (default "label.").
+	LabelPrefix string `toml:"label_prefix"`
+	// Whether to add pod annotations as fields prefixed with "annotation.".
+	IncludeAnnotations bool `toml:"include_annotations"`
+	// Whether to read the logs of the containers running when Heka starts
+	// from their beginning, rather than only the lines written since.
+	FromBeginning bool `toml:"from_beginning"`
+}
+
+// A line of a container's log.
+type logLine struct {
+	namespace string
+	pod       string
+	container string
+	timestamp time.Time
+	text      string
+}
+
+func (k *KubernetesInput) ConfigStruct() interface{} {
+	return &KubernetesInputConfig{
+		LabelPrefix: "label.",
+	}
+}
+
+func (k *KubernetesInput) Init(config interface{}) (err error) {
+	k.conf = config.(*KubernetesInputConfig)
+	if k.client, err = newAPIClient(k.conf.ApiServer, k.conf.TokenFile,
+		&k.conf.Tls); err != nil {
+		return
+	}
+	var fieldSelector string
+	if k.conf.NodeName != "" {
+		fieldSelector = "spec.nodeName=" + k.conf.NodeName
+	}
+	k.cache = newPodCache(k.client, k.conf.Namespace, k.conf.LabelSelector,
+		fieldSelector, func(err error) { k.ir.LogError(err) })
+	k.cache.events = make(chan podEvent)
+	k.lines = make(chan *logLine)
+	k.stopChan = make(chan struct{})
+	k.tailers = make(map[string]map[string]*logTailer)
+	return nil
+}
+
+func (k *KubernetesInput) Run(ir pipeline.InputRunner, h pipeline.PluginHelper) error {
+	k.ir = ir
+	k.hostname = h.Hostname()
+	k.started = time.Now()
+	go k.cache.run()
+
+	for {
+		select {
+		case event := <-k.cache.events:
+			k.updateTailers(event)
+		case line := <-k.lines:
+			k.deliver(line)
+		case <-k.stopChan:
+			k.cache.stop()
+			for _, containers := range k.tailers {
+				for _, t := range containers {
+					t.stop()
+				}
+			}
+			k.tailersWg.Wait()
+			return nil
+		}
+	}
+}
+
+// Starts tailing the containers of new pods and stops tailing those of
+// deleted pods.
+func (k *KubernetesInput) updateTailers(event podEvent) {
+	p := event.pod
+	key := p.key()
+	if event.typ == "DELETED" {
+		for _, t := range k.tailers[key] {
+			t.stop()
+		}
+		delete(k.tailers, key)
+		return
+	}
+	if p.Status.Phase == "Pending" {
+		// The logs aren't available yet.
+		return
+	}
+	containers, ok := k.tailers[key]
+	if !ok {
+		containers = make(map[string]*logTailer)
+		k.tailers[key] = containers
+	}
+	for _, c := range p.Spec.Containers {
+		if _, ok := containers[c.Name]; ok || !k.wantContainer(c.Name) {
+			continue
+		}
+		t := &logTailer{
+			input:     k,
+			namespace: p.Metadata.Namespace,
+			pod:       p.Metadata.Name,
+			container: c.Name,
+			stopChan:  make(chan struct{}),
+		}
+		if !k.conf.FromBeginning {
+			t.since = k.started
+		}
+		containers[c.Name] = t
+		k.tailersWg.Add(1)
+		go t.run()
+	}
+}
+
+func (k *KubernetesInput) wantContainer(name string) bool {
+	if len(k.conf.Containers) == 0 {
+		return true
+	}
+	for _, c := range k.conf.Containers {
+		if c == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (k *KubernetesInput) deliver(line *logLine) {
+	pack := <-k.ir.InChan()
+	msg := pack.Message
+	msg.SetUuid(uuid.NewRandom())
+	msg.SetTimestamp(line.timestamp.UnixNano())
+	msg.SetType("heka.kubernetes")
+	msg.SetLogger(k.ir.Name())
+	msg.SetHostname(k.hostname)
+	msg.SetPayload(line.text)
+	message.NewStringField(msg, "namespace", line.namespace)
+	message.NewStringField(msg, "pod", line.pod)
+	message.NewStringField(msg, "container", line.container)
+	if p, ok := k.cache.get(line.namespace, line.pod); ok {
+		if image := p.image(line.container); image != "" {
+			message.NewStringField(msg, "image", image)
+		}
+		addPodFields(msg, p, k.conf.LabelPrefix, k.conf.IncludeAnnotations)
+	}
+	k.ir.Deliver(pack)
+}
+
+// Adds the pod's node, UID, labels, and optionally annotations to a message,
+// in a stable order.
+func addPodFields(msg *message.Message, p *pod, labelPrefix string, annotations bool) {
+	if p.Spec.NodeName != "" {
+		message.NewStringField(msg, "node", p.Spec.NodeName)
+	}
+	message.NewStringField(msg, "pod_uid", p.Metadata.Uid)
+	addMapFields(msg, labelPrefix, p.Metadata.Labels)
+	if annotations {
+		addMapFields(msg, "annotation.", p.Metadata.Annotations)
+	}
+}
+
+func addMapFields(msg *message.Message, prefix string, values map[string]string) {
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		message.NewStringField(msg, prefix+name, values[name])
+	}
+}
+
+func (k *KubernetesInput) Stop() {
+	close(k.stopChan)
+}
+
+func (k *KubernetesInput) CleanupForRestart() {
+	// Intentionally left empty. Cleanup happens in Run()
+}
+
+// Streams the log of a container to the input, reconnecting when the stream
+// ends, e.g. because the container restarted, until the pod finishes.
+type logTailer struct {
+	input     *KubernetesInput
+	namespace string
+	pod       string
+	container string
+	// Timestamp of the last line read, only later lines are read when
+	// reconnecting. Zero to read the whole log.
+	since    time.Time
+	stopChan chan struct{}
+	stopOnce sync.Once
+}
+
+func (t *logTailer) stop() {
+	t.stopOnce.Do(func() { close(t.stopChan) })
+}
+
+func (t *logTailer) run() {
+	defer t.input.tailersWg.Done()
+	for {
+		err := t.stream()
+		select {
+		case <-t.stopChan:
+			return
+		default:
+		}
+		if err != nil {
+			t.input.ir.LogError(fmt.Errorf("can't read log of %s/%s/%s: %s", t.namespace,
+				t.pod, t.container, err))
+		} else if p, ok := t.input.cache.get(t.namespace, t.pod); !ok || p.finished() {
+			// No more lines will be written, wait for the pod to be deleted.
+			<-t.stopChan
+			return
+		}
+		select {
+		case <-time.After(t.input.cache.retryDelay):
+		case <-t.stopChan:
+			return
+		}
+	}
+}
+
+// Reads the container's log, following it, until the stream ends.
+func (t *logTailer) stream() error {
+	query := url.Values{
+		"container":  {t.container},
+		"follow":     {"true"},
+		"timestamps": {"true"},
+	}
+	if !t.since.IsZero() {
+		query.Set("sinceTime", t.since.UTC().Format(time.RFC3339))
+	}
+	path := fmt.Sprintf("/api/v1/namespaces/%s/pods/%s/log", url.QueryEscape(t.namespace),
+		url.QueryEscape(t.pod))
+	resp, err := t.input.client.get(path, query, t.stopChan)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// sinceTime only has a resolution of seconds, skip the lines we've
+	// already read.
+	after := t.since
+	reader := bufio.NewReader(resp.Body)
+	for {
+		text, err := reader.ReadString('\n')
+		if text != "" {
+			timestamp, text, ok := parseLogLine(text)
+			if ok && timestamp.After(after) {
+				t.since = timestamp
+				line := &logLine{t.namespace, t.pod, t.container, timestamp, text}
+				select {
+				case t.input.lines <- line:
+				case <-t.stopChan:
+					return nil
+				}
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Splits a log line read with timestamps into the timestamp and the text.
+func parseLogLine(line string) (timestamp time.Time, text string, ok bool) {
+	line = strings.TrimRight(line, "\r\n")
+	space := strings.IndexByte(line, ' ')
+	if space == -1 {
+		return
+	}
+	var err error
+	if timestamp, err = time.Parse(time.RFC3339Nano, line[:space]); err != nil {
+		return
+	}
+	return timestamp, line[space+1:], true
+}
+
+func init() {
+	pipeline.RegisterPlugin("KubernetesInput", func() interface{} {
+		return new(KubernetesInput)
+	})
+}
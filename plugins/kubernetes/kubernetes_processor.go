@@ -0,0 +1,120 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package kubernetes
+
+import (
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+	"github.com/mozilla-services/heka/pipeline"
+	"github.com/mozilla-services/heka/plugins/tcp"
+	"log"
+)
+
+// Processor adding the metadata of the Kubernetes pod a message came from,
+// e.g. a line of a container log read by another input, to the message. The
+// pods are looked up in a local cache kept up to date by watching the API
+// server, which is shared by all the processors configured alike.
+type KubernetesProcessor struct {
+	conf  *KubernetesProcessorConfig
+	cache *podCache
+}
+
+type KubernetesProcessorConfig struct {
+	// API server URL. Defaults to the in-cluster API server.
+	ApiServer string `toml:"api_server"`
+	// File holding the bearer token to authenticate with. Defaults to the
+	// service account token when running in a cluster.
+	TokenFile string `toml:"token_file"`
+	Tls       tcp.TlsConfig
+	// Namespace of the pods to cache. Defaults to all namespaces.
+	Namespace string `toml:"namespace"`
+	// Label selector of the pods to cache.
+	LabelSelector string `toml:"label_selector"`
+	// Only cache the pods on this node. Defaults to all nodes.
+	NodeName string `toml:"node_name"`
+	// Fields holding the namespace and name of a message's pod (defaults
+	// "namespace" and "pod").
+	NamespaceField string `toml:"namespace_field"`
+	PodField       string `toml:"pod_field"`
+	// Field holding the ID of the container a message came from, e.g.
+	// "ContainerID" for DockerLogInput. If set, and the message has the
+	// field, the pod is looked up by container ID instead.
+	ContainerIdField string `toml:"container_id_field"`
+	// Prefix of the field names of pod labels (default "label.").
+	LabelPrefix string `toml:"label_prefix"`
+	// Whether to add pod annotations as fields prefixed with "annotation.".
+	IncludeAnnotations bool `toml:"include_annotations"`
+}
+
+func (p *KubernetesProcessor) ConfigStruct() interface{} {
+	return &KubernetesProcessorConfig{
+		NamespaceField: "namespace",
+		PodField:       "pod",
+		LabelPrefix:    "label.",
+	}
+}
+
+func (p *KubernetesProcessor) Init(config interface{}) error {
+	p.conf = config.(*KubernetesProcessorConfig)
+	client, err := newAPIClient(p.conf.ApiServer, p.conf.TokenFile, &p.conf.Tls)
+	if err != nil {
+		return err
+	}
+	var fieldSelector string
+	if p.conf.NodeName != "" {
+		fieldSelector = "spec.nodeName=" + p.conf.NodeName
+	}
+	p.cache = sharedPodCache(client, p.conf.Namespace, p.conf.LabelSelector,
+		fieldSelector, func(err error) {
+			log.Printf("KubernetesProcessor: %s", err)
+		})
+	return nil
+}
+
+// Adds the metadata of the message's pod, if it's known. Messages whose pod
+// isn't known are passed on unchanged.
+func (p *KubernetesProcessor) Process(pack *pipeline.PipelinePack) (keep bool, err error) {
+	msg := pack.Message
+	var (
+		po *pod
+		ok bool
+	)
+	if p.conf.ContainerIdField != "" {
+		if id, found := msg.GetFieldValue(p.conf.ContainerIdField); found {
+			po, ok = p.cache.getByContainerID(fmt.Sprint(id))
+		}
+	}
+	if !ok {
+		namespace, _ := msg.GetFieldValue(p.conf.NamespaceField)
+		name, _ := msg.GetFieldValue(p.conf.PodField)
+		if namespace == nil || name == nil {
+			return true, nil
+		}
+		if po, ok = p.cache.get(fmt.Sprint(namespace), fmt.Sprint(name)); !ok {
+			return true, nil
+		}
+	}
+	if msg.FindFirstField(p.conf.NamespaceField) == nil {
+		message.NewStringField(msg, p.conf.NamespaceField, po.Metadata.Namespace)
+	}
+	if msg.FindFirstField(p.conf.PodField) == nil {
+		message.NewStringField(msg, p.conf.PodField, po.Metadata.Name)
+	}
+	addPodFields(msg, po, p.conf.LabelPrefix, p.conf.IncludeAnnotations)
+	return true, nil
+}
+
+func init() {
+	pipeline.RegisterPlugin("KubernetesProcessor", func() interface{} {
+		return new(KubernetesProcessor)
+	})
+}
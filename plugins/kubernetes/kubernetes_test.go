@@ -0,0 +1,189 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package kubernetes
+
+import (
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+	"github.com/mozilla-services/heka/pipeline"
+	"github.com/mozilla-services/heka/plugins/tcp"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+const podTemplate = `{"metadata": {"name": "%s", "namespace": "default", "uid": "uid-%s",
+	"resourceVersion": "%d", "labels": {"app": "%s"}},
+	"spec": {"nodeName": "node-1", "containers": [{"name": "web", "image": "nginx"}]},
+	"status": {"phase": "Running", "containerStatuses": [{"name": "web",
+	"containerID": "docker://%s-id"}]}}`
+
+func podJSON(name, app string, version int) string {
+	return fmt.Sprintf(podTemplate, name, name, version, app, name)
+}
+
+func newTestClient(t *testing.T, handler http.HandlerFunc) (*apiClient, func()) {
+	server := httptest.NewServer(handler)
+	tokenFile, err := ioutil.TempFile("", "kubernetes-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokenFile.WriteString("secret\n")
+	tokenFile.Close()
+	client, err := newAPIClient(server.URL, tokenFile.Name(), new(tcp.TlsConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, func() {
+		server.Close()
+		os.Remove(tokenFile.Name())
+	}
+}
+
+func TestPodCache(t *testing.T) {
+	var watchVersion string
+	client, cleanup := newTestClient(t, func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") != "Bearer secret" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if req.URL.Path != "/api/v1/namespaces/default/pods" ||
+			req.URL.Query().Get("labelSelector") != "tier=web" {
+			http.NotFound(w, req)
+			return
+		}
+		if req.URL.Query().Get("watch") == "" {
+			fmt.Fprintf(w, `{"metadata": {"resourceVersion": "10"}, "items": [%s, %s]}`,
+				podJSON("a", "shop", 5), podJSON("b", "shop", 6))
+			return
+		}
+		watchVersion = req.URL.Query().Get("resourceVersion")
+		fmt.Fprintf(w, `{"type": "MODIFIED", "object": %s}`, podJSON("a", "cart", 11))
+		fmt.Fprintf(w, `{"type": "DELETED", "object": %s}`, podJSON("b", "shop", 12))
+	})
+	defer cleanup()
+
+	cache := newPodCache(client, "default", "tier=web", "", func(error) {})
+	version, err := cache.list()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != "10" {
+		t.Errorf("expected version 10, got %s", version)
+	}
+	if _, ok := cache.get("default", "b"); !ok {
+		t.Error("pod b wasn't cached")
+	}
+
+	if version, err = cache.watch(version); err != nil {
+		t.Fatal(err)
+	}
+	if watchVersion != "10" || version != "12" {
+		t.Errorf("expected to watch from 10 to 12, watched from %s to %s", watchVersion,
+			version)
+	}
+	p, ok := cache.get("default", "a")
+	if !ok || p.Metadata.Labels["app"] != "cart" {
+		t.Errorf("pod a wasn't updated: %v", p)
+	}
+	if _, ok = cache.get("default", "b"); ok {
+		t.Error("pod b wasn't removed")
+	}
+	if p, ok = cache.getByContainerID("docker://a-id"); !ok || p.Metadata.Name != "a" {
+		t.Error("pod a wasn't found by container ID")
+	}
+	if _, ok = cache.getByContainerID("b-id"); ok {
+		t.Error("pod b was found by container ID")
+	}
+}
+
+func TestPodCacheRelistsWhenTooOld(t *testing.T) {
+	client, cleanup := newTestClient(t, func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprint(w, `{"type": "ERROR", "object": {"code": 410, "message": "too old"}}`)
+	})
+	defer cleanup()
+
+	cache := newPodCache(client, "", "", "", func(error) {})
+	version, err := cache.watch("3")
+	if err != nil || version != "" {
+		t.Errorf("expected to start over, got %q, %v", version, err)
+	}
+}
+
+func TestParseLogLine(t *testing.T) {
+	timestamp, text, ok := parseLogLine("2015-06-01T12:00:00.123456789Z GET / 200\n")
+	if !ok {
+		t.Fatal("line wasn't parsed")
+	}
+	if text != "GET / 200" {
+		t.Errorf("unexpected text: %q", text)
+	}
+	expected := time.Date(2015, 6, 1, 12, 0, 0, 123456789, time.UTC)
+	if !timestamp.Equal(expected) {
+		t.Errorf("expected %s, got %s", expected, timestamp)
+	}
+	if _, _, ok = parseLogLine("no timestamp"); ok {
+		t.Error("line without a timestamp was parsed")
+	}
+}
+
+func TestKubernetesProcessor(t *testing.T) {
+	proc := new(KubernetesProcessor)
+	proc.conf = proc.ConfigStruct().(*KubernetesProcessorConfig)
+	proc.conf.ContainerIdField = "ContainerID"
+	proc.cache = newPodCache(nil, "", "", "", func(error) {})
+	p := new(pod)
+	p.Metadata.Name = "a"
+	p.Metadata.Namespace = "default"
+	p.Metadata.Uid = "uid-a"
+	p.Metadata.Labels = map[string]string{"app": "shop", "tier": "web"}
+	p.Status.ContainerStatuses = append(p.Status.ContainerStatuses, struct {
+		Name        string `json:"name"`
+		ContainerID string `json:"containerID"`
+	}{"web", "docker://a-id"})
+	proc.cache.apply("ADDED", p)
+
+	newPack := func(fields map[string]string) *pipeline.PipelinePack {
+		pack := pipeline.NewPipelinePack(nil)
+		for name, value := range fields {
+			message.NewStringField(pack.Message, name, value)
+		}
+		return pack
+	}
+
+	pack := newPack(map[string]string{"namespace": "default", "pod": "a"})
+	if keep, err := proc.Process(pack); !keep || err != nil {
+		t.Fatalf("message wasn't kept: %v", err)
+	}
+	for name, expected := range map[string]string{"pod_uid": "uid-a", "label.app": "shop",
+		"label.tier": "web"} {
+
+		if value, _ := pack.Message.GetFieldValue(name); value != expected {
+			t.Errorf("expected %s to be %s, got %v", name, expected, value)
+		}
+	}
+
+	pack = newPack(map[string]string{"ContainerID": "a-id"})
+	proc.Process(pack)
+	if value, _ := pack.Message.GetFieldValue("pod"); value != "a" {
+		t.Errorf("pod wasn't found by container ID, got %v", value)
+	}
+
+	pack = newPack(map[string]string{"namespace": "default", "pod": "unknown"})
+	proc.Process(pack)
+	if len(pack.Message.Fields) != 2 {
+		t.Errorf("message of an unknown pod was changed: %v", pack.Message.Fields)
+	}
+}
@@ -0,0 +1,358 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package kubernetes
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The parts of a pod resource the plugins use.
+type pod struct {
+	Metadata struct {
+		Name            string            `json:"name"`
+		Namespace       string            `json:"namespace"`
+		Uid             string            `json:"uid"`
+		ResourceVersion string            `json:"resourceVersion"`
+		Labels          map[string]string `json:"labels"`
+		Annotations     map[string]string `json:"annotations"`
+	} `json:"metadata"`
+	Spec struct {
+		NodeName   string `json:"nodeName"`
+		Containers []struct {
+			Name  string `json:"name"`
+			Image string `json:"image"`
+		} `json:"containers"`
+	} `json:"spec"`
+	Status struct {
+		Phase             string `json:"phase"`
+		ContainerStatuses []struct {
+			Name        string `json:"name"`
+			ContainerID string `json:"containerID"`
+		} `json:"containerStatuses"`
+	} `json:"status"`
+}
+
+func podKey(namespace, name string) string {
+	return namespace + "/" + name
+}
+
+func (p *pod) key() string {
+	return podKey(p.Metadata.Namespace, p.Metadata.Name)
+}
+
+// Returns the image of the named container, if known.
+func (p *pod) image(container string) string {
+	for _, c := range p.Spec.Containers {
+		if c.Name == container {
+			return c.Image
+		}
+	}
+	return ""
+}
+
+// Whether the pod's containers have all terminated for good.
+func (p *pod) finished() bool {
+	return p.Status.Phase == "Succeeded" || p.Status.Phase == "Failed"
+}
+
+// Returns the pod's container IDs without the runtime prefix, e.g.
+// "docker://", by container name.
+func (p *pod) containerIDs() map[string]string {
+	ids := make(map[string]string)
+	for _, status := range p.Status.ContainerStatuses {
+		if id := stripRuntime(status.ContainerID); id != "" {
+			ids[status.Name] = id
+		}
+	}
+	return ids
+}
+
+func stripRuntime(containerID string) string {
+	if i := strings.Index(containerID, "://"); i != -1 {
+		return containerID[i+3:]
+	}
+	return containerID
+}
+
+type podList struct {
+	Metadata struct {
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Items []*pod `json:"items"`
+}
+
+type watchEvent struct {
+	Type   string          `json:"type"`
+	Object json.RawMessage `json:"object"`
+}
+
+// A change to the cached pods.
+type podEvent struct {
+	typ string // "ADDED", "MODIFIED", or "DELETED".
+	pod *pod
+}
+
+// Local cache of the pods in a namespace (or all namespaces) matching a set
+// of selectors. Like a client-go informer it lists the pods once and then
+// watches them for changes, only listing them again if the watch falls too
+// far behind, so looking up a pod never calls the API server. The cached pods
+// are replaced rather than modified when they change, so they can be used
+// without holding the lock.
+type podCache struct {
+	client     *apiClient
+	namespace  string
+	query      url.Values
+	lock       sync.RWMutex
+	pods       map[string]*pod // By podKey.
+	containers map[string]*pod // By container ID.
+	// If set, receives every change to the cached pods.
+	events   chan podEvent
+	logError func(error)
+	stopChan chan struct{}
+	stopOnce sync.Once
+	// Swapped out in tests.
+	retryDelay   time.Duration
+	watchTimeout time.Duration
+}
+
+func newPodCache(client *apiClient, namespace, labelSelector, fieldSelector string,
+	logError func(error)) *podCache {
+
+	query := make(url.Values)
+	if labelSelector != "" {
+		query.Set("labelSelector", labelSelector)
+	}
+	if fieldSelector != "" {
+		query.Set("fieldSelector", fieldSelector)
+	}
+	return &podCache{
+		client:       client,
+		namespace:    namespace,
+		query:        query,
+		pods:         make(map[string]*pod),
+		containers:   make(map[string]*pod),
+		logError:     logError,
+		stopChan:     make(chan struct{}),
+		retryDelay:   5 * time.Second,
+		watchTimeout: 5 * time.Minute,
+	}
+}
+
+// Keeps the cache in sync with the API server until stop is called.
+func (c *podCache) run() {
+	var (
+		version string
+		err     error
+	)
+	for {
+		if version == "" {
+			version, err = c.list()
+		} else {
+			version, err = c.watch(version)
+		}
+		if c.stopped() {
+			return
+		}
+		if err != nil {
+			c.logError(err)
+			select {
+			case <-time.After(c.retryDelay):
+			case <-c.stopChan:
+				return
+			}
+		}
+	}
+}
+
+func (c *podCache) stop() {
+	c.stopOnce.Do(func() { close(c.stopChan) })
+}
+
+func (c *podCache) stopped() bool {
+	select {
+	case <-c.stopChan:
+		return true
+	default:
+		return false
+	}
+}
+
+// Replaces the cached pods with the current ones, returning the resource
+// version to start watching from.
+func (c *podCache) list() (string, error) {
+	resp, err := c.client.get(podsPath(c.namespace), c.query, c.stopChan)
+	if err != nil {
+		return "", fmt.Errorf("can't list pods: %s", err)
+	}
+	defer resp.Body.Close()
+	var list podList
+	if err = json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return "", fmt.Errorf("can't decode pod list: %s", err)
+	}
+
+	pods := make(map[string]*pod, len(list.Items))
+	containers := make(map[string]*pod)
+	for _, p := range list.Items {
+		pods[p.key()] = p
+		for _, id := range p.containerIDs() {
+			containers[id] = p
+		}
+	}
+	c.lock.Lock()
+	old := c.pods
+	c.pods, c.containers = pods, containers
+	c.lock.Unlock()
+
+	for key, p := range old {
+		if _, ok := pods[key]; !ok {
+			c.notify("DELETED", p)
+		}
+	}
+	for key, p := range pods {
+		if _, ok := old[key]; ok {
+			c.notify("MODIFIED", p)
+		} else {
+			c.notify("ADDED", p)
+		}
+	}
+	return list.Metadata.ResourceVersion, nil
+}
+
+// Applies the changes to the pods since the specified resource version until
+// the watch times out, returning the version to continue from, or an empty
+// version if the pods must be listed again.
+func (c *podCache) watch(version string) (string, error) {
+	query := make(url.Values)
+	for k, v := range c.query {
+		query[k] = v
+	}
+	query.Set("watch", "true")
+	query.Set("resourceVersion", version)
+	query.Set("timeoutSeconds", fmt.Sprint(int(c.watchTimeout.Seconds())))
+	resp, err := c.client.get(podsPath(c.namespace), query, c.stopChan)
+	if err != nil {
+		if apiErr, ok := err.(*apiError); ok && apiErr.status == http.StatusGone {
+			return "", nil
+		}
+		return version, fmt.Errorf("can't watch pods: %s", err)
+	}
+	defer resp.Body.Close()
+
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var event watchEvent
+		if err = dec.Decode(&event); err != nil {
+			if err == io.EOF {
+				return version, nil
+			}
+			return version, fmt.Errorf("pod watch failed: %s", err)
+		}
+		if event.Type == "ERROR" {
+			var status struct {
+				Code    int    `json:"code"`
+				Message string `json:"message"`
+			}
+			json.Unmarshal(event.Object, &status)
+			if status.Code == http.StatusGone {
+				// Our version is too old, start over.
+				return "", nil
+			}
+			return version, fmt.Errorf("pod watch error: %s", status.Message)
+		}
+		p := new(pod)
+		if err = json.Unmarshal(event.Object, p); err != nil {
+			return version, fmt.Errorf("can't decode pod: %s", err)
+		}
+		version = p.Metadata.ResourceVersion
+		switch event.Type {
+		case "ADDED", "MODIFIED", "DELETED":
+			c.apply(event.Type, p)
+		}
+	}
+}
+
+func (c *podCache) apply(typ string, p *pod) {
+	key := p.key()
+	c.lock.Lock()
+	if old, ok := c.pods[key]; ok {
+		for _, id := range old.containerIDs() {
+			delete(c.containers, id)
+		}
+	}
+	if typ == "DELETED" {
+		delete(c.pods, key)
+	} else {
+		c.pods[key] = p
+		for _, id := range p.containerIDs() {
+			c.containers[id] = p
+		}
+	}
+	c.lock.Unlock()
+	c.notify(typ, p)
+}
+
+func (c *podCache) notify(typ string, p *pod) {
+	if c.events == nil {
+		return
+	}
+	select {
+	case c.events <- podEvent{typ, p}:
+	case <-c.stopChan:
+	}
+}
+
+func (c *podCache) get(namespace, name string) (p *pod, ok bool) {
+	c.lock.RLock()
+	p, ok = c.pods[podKey(namespace, name)]
+	c.lock.RUnlock()
+	return
+}
+
+// Looks up a pod by the ID of one of its containers, with or without the
+// runtime prefix.
+func (c *podCache) getByContainerID(id string) (p *pod, ok bool) {
+	c.lock.RLock()
+	p, ok = c.containers[stripRuntime(id)]
+	c.lock.RUnlock()
+	return
+}
+
+var (
+	sharedCaches     = make(map[string]*podCache)
+	sharedCachesLock sync.Mutex
+)
+
+// Returns the running cache for the API server, namespace, and selectors,
+// starting it if necessary, so all the plugins configured alike share a
+// single watch. Shared caches run for the lifetime of the process.
+func sharedPodCache(client *apiClient, namespace, labelSelector, fieldSelector string,
+	logError func(error)) *podCache {
+
+	key := strings.Join([]string{client.server, namespace, labelSelector, fieldSelector},
+		"\x00")
+	sharedCachesLock.Lock()
+	defer sharedCachesLock.Unlock()
+	cache, ok := sharedCaches[key]
+	if !ok {
+		cache = newPodCache(client, namespace, labelSelector, fieldSelector, logError)
+		sharedCaches[key] = cache
+		go cache.run()
+	}
+	return cache
+}
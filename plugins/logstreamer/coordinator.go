@@ -0,0 +1,156 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package logstreamer
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Shares the logstreams of a log directory among the hekad instances reading
+// it, e.g. from an NFS mount, through lock files in a shared coordination
+// directory. Each instance holds a lock on its own file in `members`, so the
+// instances can be counted, and a lock on a file in `claims` for each
+// logstream it reads. Locks are released by the OS when an instance dies, so
+// the survivors take its logstreams over.
+type streamCoordinator struct {
+	dir    string
+	member *os.File
+	// Lock files of the claimed logstreams, by name.
+	claims map[string]*os.File
+}
+
+func newStreamCoordinator(dir, memberName string) (*streamCoordinator, error) {
+	for _, sub := range []string{"members", "claims", "journals"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0755); err != nil {
+			return nil, err
+		}
+	}
+	c := &streamCoordinator{
+		dir:    dir,
+		claims: make(map[string]*os.File),
+	}
+	var (
+		locked bool
+		err    error
+	)
+	path := filepath.Join(dir, "members", memberName)
+	if c.member, locked, err = openLocked(path); err != nil {
+		return nil, err
+	}
+	if !locked {
+		return nil, fmt.Errorf("%s is locked by another instance", path)
+	}
+	return c, nil
+}
+
+// Where the journals of the logstreams are kept, so an instance taking a
+// logstream over resumes where the previous one left off.
+func (c *streamCoordinator) journalDir() string {
+	return filepath.Join(c.dir, "journals")
+}
+
+// Opens a lock file, creating it if needed, and tries to lock it. The file
+// is closed if it can't be locked.
+func openLocked(path string) (f *os.File, locked bool, err error) {
+	if f, err = os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644); err != nil {
+		return nil, false, err
+	}
+	if locked, err = tryLock(f); err != nil || !locked {
+		f.Close()
+		return nil, locked, err
+	}
+	return f, true, nil
+}
+
+// Counts the live instances, including this one, removing the member files
+// of dead ones.
+func (c *streamCoordinator) members() (n int, err error) {
+	dir := filepath.Join(c.dir, "members")
+	d, err := os.Open(dir)
+	if err != nil {
+		return 0, err
+	}
+	names, err := d.Readdirnames(-1)
+	d.Close()
+	if err != nil {
+		return 0, err
+	}
+	self := filepath.Base(c.member.Name())
+	n = 1
+	for _, name := range names {
+		if name == self {
+			continue
+		}
+		path := filepath.Join(dir, name)
+		f, locked, err := openLocked(path)
+		if err != nil {
+			continue
+		}
+		if !locked {
+			n++
+			continue
+		}
+		// Nobody holds it, so its instance is gone.
+		os.Remove(path)
+		f.Close()
+	}
+	return n, nil
+}
+
+// Number of logstreams each instance should read.
+func (c *streamCoordinator) share(logstreams, members int) int {
+	return (logstreams + members - 1) / members
+}
+
+// Claims a logstream, returning false if another instance has claimed it.
+func (c *streamCoordinator) claim(name string) (bool, error) {
+	if _, ok := c.claims[name]; ok {
+		return true, nil
+	}
+	path := filepath.Join(c.dir, "claims", claimFileName(name))
+	f, locked, err := openLocked(path)
+	if err != nil || !locked {
+		return false, err
+	}
+	c.claims[name] = f
+	return true, nil
+}
+
+func (c *streamCoordinator) claimed(name string) bool {
+	_, ok := c.claims[name]
+	return ok
+}
+
+// Releases a claimed logstream. Its position must have been saved already.
+func (c *streamCoordinator) release(name string) {
+	if f, ok := c.claims[name]; ok {
+		f.Close()
+		delete(c.claims, name)
+	}
+}
+
+// Releases every claim and leaves the group.
+func (c *streamCoordinator) Close() {
+	for name := range c.claims {
+		c.release(name)
+	}
+	os.Remove(c.member.Name())
+	c.member.Close()
+}
+
+// Logstream names may contain path separators.
+func claimFileName(name string) string {
+	return strings.Replace(name, string(os.PathSeparator), "_", -1) + ".lock"
+}
@@ -0,0 +1,82 @@
+// +build !windows
+
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package logstreamer
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStreamCoordinator(t *testing.T) {
+	dir, err := ioutil.TempDir("", "coordinator-tests")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	a, err := newStreamCoordinator(dir, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = newStreamCoordinator(dir, "a"); err == nil {
+		t.Error("Joined twice under the same name")
+	}
+	b, err := newStreamCoordinator(dir, "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	if n, err := b.members(); err != nil || n != 2 {
+		t.Errorf("Expected 2 members, got %d (%v)", n, err)
+	}
+	if share := b.share(5, 2); share != 3 {
+		t.Errorf("Expected a share of 3, got %d", share)
+	}
+
+	if ok, err := a.claim("web/access"); !ok || err != nil {
+		t.Fatalf("Claim failed: %v", err)
+	}
+	if ok, err := b.claim("web/access"); ok || err != nil {
+		t.Errorf("Claimed a logstream claimed by another member: %v", err)
+	}
+	if _, err = os.Stat(filepath.Join(dir, "claims", "web_access.lock")); err != nil {
+		t.Error(err)
+	}
+
+	// Leaving releases the claims.
+	a.Close()
+	if ok, err := b.claim("web/access"); !ok || err != nil {
+		t.Errorf("Couldn't claim a released logstream: %v", err)
+	}
+	if !b.claimed("web/access") {
+		t.Error("Claim not recorded")
+	}
+	if n, _ := b.members(); n != 1 {
+		t.Errorf("Expected 1 member, got %d", n)
+	}
+
+	// The member files of instances that died are removed.
+	stale := filepath.Join(dir, "members", "c")
+	if err = ioutil.WriteFile(stale, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := b.members(); n != 1 {
+		t.Errorf("Expected 1 member, got %d", n)
+	}
+	if _, err = os.Stat(stale); !os.IsNotExist(err) {
+		t.Error("Stale member file wasn't removed")
+	}
+}
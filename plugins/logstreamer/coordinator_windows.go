@@ -0,0 +1,23 @@
+// +build windows
+
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package logstreamer
+
+import (
+	"errors"
+	"os"
+)
+
+func tryLock(f *os.File) (bool, error) {
+	return false, errors.New("coordination_directory isn't supported on Windows")
+}
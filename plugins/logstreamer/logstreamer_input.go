@@ -24,7 +24,9 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -57,19 +59,30 @@ type LogstreamerInputConfig struct {
 	DelimiterLocation string `toml:"delimiter_location"`
 	// Whether truncate message exceeding buffer size instead of dropping it
 	KeepTruncatedMessages bool `toml:"keep_truncated_messages"`
+	// Joins the records into multiline records, e.g. stack traces
+	Multiline p.MultilineOptions
+	// Shared directory through which the hekad instances reading the same
+	// log directory share out its logstreams, journals being kept there too
+	CoordinationDirectory string `toml:"coordination_directory"`
+	// Where a logstream resumes when its journaled position no longer
+	// matches the file, "start" or "end"
+	PositionLostPolicy string `toml:"position_lost_policy"`
 }
 
 type LogstreamerInput struct {
+	claimedLogstreams     int64
 	pConfig               *p.PipelineConfig
 	logstreamSet          *ls.LogstreamSet
 	logstreamSetLock      sync.RWMutex
 	rescanInterval        time.Duration
 	plugins               map[string]*LogstreamInput
-	stopLogstreamChans    []chan chan bool
+	stopLogstreamChans    map[string]chan chan bool
+	coordinator           *streamCoordinator
 	stopChan              chan bool
 	parser                string
 	delimiter             string
 	delimiterLocation     string
+	multiline             p.MultilineOptions
 	hostName              string
 	pluginName            string
 	keepTruncatedMessages bool
@@ -86,9 +99,14 @@ func (li *LogstreamerInput) ConfigStruct() interface{} {
 	return &LogstreamerInputConfig{
 		RescanInterval:   "1m",
 		ParserType:       "token",
-		OldestDuration:   "720h",
-		LogDirectory:     "/var/log",
-		JournalDirectory: filepath.Join(baseDir, "logstreamer"),
+		OldestDuration:     "720h",
+		LogDirectory:       "/var/log",
+		JournalDirectory:   filepath.Join(baseDir, "logstreamer"),
+		PositionLostPolicy: ls.PositionLostStart,
+		Multiline: p.MultilineOptions{
+			MaxLines: 500,
+			Timeout:  "5s",
+		},
 	}
 }
 
@@ -120,6 +138,7 @@ func (li *LogstreamerInput) Init(config interface{}) (err error) {
 	li.parser = conf.ParserType
 	li.delimiter = conf.Delimiter
 	li.delimiterLocation = conf.DelimiterLocation
+	li.multiline = conf.Multiline
 	li.plugins = make(map[string]*LogstreamInput)
 
 	// Setup the rescan interval
@@ -155,6 +174,17 @@ func (li *LogstreamerInput) Init(config interface{}) (err error) {
 		Differentiator: conf.Differentiator,
 	}
 
+	// Journals are shared when sharing logstreams with other instances
+	li.coordinator = nil
+	if conf.CoordinationDirectory != "" {
+		member := fmt.Sprintf("%s.%d", li.pConfig.Hostname(), os.Getpid())
+		li.coordinator, err = newStreamCoordinator(conf.CoordinationDirectory, member)
+		if err != nil {
+			return fmt.Errorf("can't join coordination directory: %s", err)
+		}
+		conf.JournalDirectory = li.coordinator.journalDir()
+	}
+
 	// Create the main logstream set
 	li.logstreamSetLock.Lock()
 	defer li.logstreamSetLock.Unlock()
@@ -163,6 +193,9 @@ func (li *LogstreamerInput) Init(config interface{}) (err error) {
 	if err != nil {
 		return
 	}
+	if err = li.logstreamSet.SetPositionLostPolicy(conf.PositionLostPolicy); err != nil {
+		return
+	}
 
 	// Initial scan for logstreams
 	plugins, errs = li.logstreamSet.ScanForLogstreams()
@@ -171,8 +204,7 @@ func (li *LogstreamerInput) Init(config interface{}) (err error) {
 	}
 
 	// Verify we can make a parser
-	_, _, err = CreateParser(li.parser, li.delimiter, li.delimiterLocation)
-	if err != nil {
+	if _, _, err = li.createParser(); err != nil {
 		return
 	}
 
@@ -191,16 +223,110 @@ func (li *LogstreamerInput) Init(config interface{}) (err error) {
 		if !ok {
 			continue
 		}
-		stParser, parserFunc, _ := CreateParser(li.parser, li.delimiter,
-			li.delimiterLocation)
-		li.plugins[name] = NewLogstreamInput(stream, stParser, parserFunc,
-			name, li.hostName, li.keepTruncatedMessages)
+		li.plugins[name] = li.newLogstreamInput(stream, name)
 	}
-	li.stopLogstreamChans = make([]chan chan bool, 0, len(plugins))
+	li.stopLogstreamChans = make(map[string]chan chan bool, len(plugins))
 	li.stopChan = make(chan bool)
 	return
 }
 
+func (li *LogstreamerInput) newLogstreamInput(stream *ls.Logstream,
+	name string) *LogstreamInput {
+
+	stParser, parserFunc, _ := li.createParser()
+	return NewLogstreamInput(stream, stParser, parserFunc, name, li.hostName,
+		li.keepTruncatedMessages)
+}
+
+// Creates the parser splitting a logstream into records, joining them into
+// multiline records if configured to.
+func (li *LogstreamerInput) createParser() (parser p.StreamParser,
+	parseFunction string, err error) {
+
+	parser, parseFunction, err = CreateParser(li.parser, li.delimiter,
+		li.delimiterLocation)
+	if err != nil || !li.multiline.Enabled() {
+		return
+	}
+	if parseFunction != "payload" {
+		return nil, "", errors.New("multiline records require a `token` or " +
+			"`regexp` parser_type")
+	}
+	parser, err = p.NewMultilineParser(parser, li.multiline)
+	return
+}
+
+// Starts reading a logstream
+func (li *LogstreamerInput) startLogstream(ir p.InputRunner, h p.PluginHelper,
+	name string) {
+
+	stop := make(chan chan bool, 1)
+	go li.plugins[name].Run(ir, h, stop)
+	li.stopLogstreamChans[name] = stop
+	atomic.AddInt64(&li.claimedLogstreams, 1)
+}
+
+// Stops reading a logstream, saving its position
+func (li *LogstreamerInput) stopLogstream(name string) {
+	ret := make(chan bool)
+	li.stopLogstreamChans[name] <- ret
+	<-ret
+	li.plugins[name].stream.SavePosition()
+	delete(li.stopLogstreamChans, name)
+	atomic.AddInt64(&li.claimedLogstreams, -1)
+}
+
+// Claims or releases logstreams so each of the instances sharing the log
+// directory reads its share of them. Excess logstreams are released when
+// another instance joins, and those of an instance that died are claimed by
+// the others.
+func (li *LogstreamerInput) rebalance(ir p.InputRunner, h p.PluginHelper) {
+	members, err := li.coordinator.members()
+	if err != nil {
+		ir.LogError(fmt.Errorf("can't count coordinating instances: %s", err))
+		return
+	}
+	names := make([]string, 0, len(li.plugins))
+	for name := range li.plugins {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	share := li.coordinator.share(len(names), members)
+
+	// Release from the end and claim from the start, so the logstreams an
+	// instance keeps are those it would claim again.
+	for i := len(names) - 1; i >= 0 && len(li.stopLogstreamChans) > share; i-- {
+		if _, ok := li.stopLogstreamChans[names[i]]; ok {
+			li.stopLogstream(names[i])
+			li.coordinator.release(names[i])
+		}
+	}
+	for _, name := range names {
+		if len(li.stopLogstreamChans) >= share {
+			break
+		}
+		if _, ok := li.stopLogstreamChans[name]; ok {
+			continue
+		}
+		claimed, err := li.coordinator.claim(name)
+		if err != nil {
+			ir.LogError(fmt.Errorf("can't claim logstream %s: %s", name, err))
+			continue
+		}
+		if !claimed {
+			continue
+		}
+		// Another instance may have read it since we last did.
+		stream := li.plugins[name].stream
+		if err = stream.ReloadPosition(); err != nil {
+			ir.LogError(fmt.Errorf("can't load the journal of logstream %s, reading "+
+				"it from the start: %s", name, err))
+		}
+		li.plugins[name] = li.newLogstreamInput(stream, name)
+		li.startLogstream(ir, h, name)
+	}
+}
+
 // Main Logstreamer Input runner
 // This runner kicks off all the other logstream inputs, and handles rescanning for
 // updates to the filesystem that might affect file visibility for the logstream
@@ -219,14 +345,19 @@ func (li *LogstreamerInput) Run(ir p.InputRunner, h p.PluginHelper) (err error)
 			<-li.stopChan
 			close(li.stopChan)
 		}()
+		if li.coordinator != nil {
+			li.coordinator.Close()
+		}
 		return errors.New("`message.proto` parser_type requires ProtobufDecoder")
 	}
 
-	// Kick off all the current logstreams we know of
-	for _, logstream := range li.plugins {
-		stop := make(chan chan bool, 1)
-		go logstream.Run(ir, h, stop)
-		li.stopLogstreamChans = append(li.stopLogstreamChans, stop)
+	// Kick off all the current logstreams we know of, or our share of them
+	if li.coordinator != nil {
+		li.rebalance(ir, h)
+	} else {
+		for name := range li.plugins {
+			li.startLogstream(ir, h, name)
+		}
 	}
 
 	ok = true
@@ -236,12 +367,12 @@ func (li *LogstreamerInput) Run(ir p.InputRunner, h p.PluginHelper) (err error)
 		select {
 		case <-li.stopChan:
 			ok = false
-			returnChans := make([]chan bool, len(li.stopLogstreamChans))
+			returnChans := make([]chan bool, 0, len(li.stopLogstreamChans))
 			// Send out all the stop signals
-			for i, ch := range li.stopLogstreamChans {
+			for _, ch := range li.stopLogstreamChans {
 				ret := make(chan bool)
 				ch <- ret
-				returnChans[i] = ret
+				returnChans = append(returnChans, ret)
 			}
 
 			// Wait for all the stops
@@ -249,6 +380,14 @@ func (li *LogstreamerInput) Run(ir p.InputRunner, h p.PluginHelper) (err error)
 				<-ch
 			}
 
+			// Hand our logstreams over to the other instances
+			if li.coordinator != nil {
+				for name := range li.stopLogstreamChans {
+					li.plugins[name].stream.SavePosition()
+				}
+				li.coordinator.Close()
+			}
+
 			// Close our own stopChan to indicate we shut down
 			close(li.stopChan)
 		case <-rescan:
@@ -264,16 +403,15 @@ func (li *LogstreamerInput) Run(ir p.InputRunner, h p.PluginHelper) (err error)
 					continue
 				}
 
-				// Setup a new logstream input for this logstream and start it running
-				stParser, parserFunc, _ := CreateParser(li.parser, li.delimiter,
-					li.delimiterLocation)
-
-				lsi := NewLogstreamInput(stream, stParser, parserFunc, name,
-					li.hostName, li.keepTruncatedMessages)
-				li.plugins[name] = lsi
-				stop := make(chan chan bool, 1)
-				go lsi.Run(ir, h, stop)
-				li.stopLogstreamChans = append(li.stopLogstreamChans, stop)
+				// Setup a new logstream input for this logstream and start it
+				// running, unless it's up for sharing
+				li.plugins[name] = li.newLogstreamInput(stream, name)
+				if li.coordinator == nil {
+					li.startLogstream(ir, h, name)
+				}
+			}
+			if li.coordinator != nil {
+				li.rebalance(ir, h)
 			}
 			li.logstreamSetLock.Unlock()
 		}
@@ -298,6 +436,8 @@ type LogstreamInput struct {
 	stopped               chan bool
 	keepTruncatedMessages bool
 	prevMsgWasTruncated   bool
+	// Times the position was lost, as of the last check.
+	positionsLost int64
 }
 
 func NewLogstreamInput(stream *ls.Logstream, parser p.StreamParser, parserFunction,
@@ -347,6 +487,12 @@ func (lsi *LogstreamInput) Run(ir p.InputRunner, h p.PluginHelper, stopChan chan
 		if err != nil && err != io.EOF {
 			ir.LogError(err)
 		}
+		if lost := lsi.stream.PositionsLost(); lost > lsi.positionsLost {
+			lsi.positionsLost = lost
+			ir.LogError(fmt.Errorf("logstream '%s' changed underneath us, its "+
+				"journaled position couldn't be found, resumed according to "+
+				"position_lost_policy", lsi.loggerIdent))
+		}
 
 		// Did our parser func get stopped?
 		if lsi.stopped != nil {
@@ -481,6 +627,12 @@ func CreateParser(parserType, delimiter, delimiterLocation string) (parser p.Str
 		}
 		err = rp.SetDelimiterLocation(delimiterLocation)
 		parser = rp
+	case "length_prefix", "varint":
+		lp := p.NewLengthPrefixParser()
+		lp.SetVarint(parserType == "varint")
+		parser = lp
+	case "json":
+		parser = p.NewJsonParser()
 	case "message.proto":
 		parser = p.NewMessageProtoParser()
 		parseFunction = "messageProto"
@@ -507,7 +659,13 @@ func (li *LogstreamerInput) ReportMsg(msg *message.Message) error {
 			fname, bytes := logstream.ReportPosition()
 			message.NewStringField(msg, fmt.Sprintf("%s-filename", name), fname)
 			message.NewInt64Field(msg, fmt.Sprintf("%s-bytes", name), bytes, "count")
+			message.NewInt64Field(msg, fmt.Sprintf("%s-positions-lost", name),
+				logstream.PositionsLost(), "count")
 		}
 	}
+	if li.coordinator != nil {
+		message.NewInt64Field(msg, "ClaimedLogstreams",
+			atomic.LoadInt64(&li.claimedLogstreams), "count")
+	}
 	return nil
 }
@@ -0,0 +1,326 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package plugins
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+	"github.com/mozilla-services/heka/pipeline"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// NdjsonEncoder serializes each message to a single line of JSON, with the
+// keys in a deterministic order.
+type NdjsonEncoder struct {
+	conf    *NdjsonEncoderConfig
+	columns []ndjsonColumn
+}
+
+type NdjsonEncoderConfig struct {
+	// Message data to include, in order. Each entry is either a message
+	// header name ("Uuid", "Timestamp", "Type", "Logger", "Severity",
+	// "Payload", "EnvVersion", "Pid", or "Hostname"), "Fields" for all of
+	// the dynamic fields, or "Fields[name]" for a single dynamic field.
+	// Defaults to all of the headers followed by all of the fields.
+	Fields []string
+	// Timestamp format, an empty string writes the timestamp as an integer
+	// number of nanoseconds since the epoch. Defaults to
+	// "2006-01-02T15:04:05.000Z".
+	TimestampFormat string `toml:"timestamp_format"`
+	// Whether the dynamic fields included by "Fields" are sorted by name
+	// (true), or written in the order they appear in the message (false).
+	// Defaults to true.
+	SortFields bool `toml:"sort_fields"`
+	// Whether dynamic fields with dotted names (e.g. "http.status") are
+	// written as nested objects. Defaults to false.
+	NestDottedFields bool `toml:"nest_dotted_fields"`
+	// How empty values (empty strings, empty byte fields, fields without any
+	// values, and fields named with "Fields[name]" that the message doesn't
+	// have) are written, "keep" (written as they are, missing fields are
+	// skipped), "omit", or "null". Defaults to "keep".
+	EmptyValues string `toml:"empty_values"`
+}
+
+const (
+	ndjsonHeader = iota
+	ndjsonAllFields
+	ndjsonField
+)
+
+type ndjsonColumn struct {
+	kind int
+	name string // Header name as configured, or the dynamic field name.
+}
+
+var ndjsonHeaders = []string{"uuid", "timestamp", "type", "logger", "severity",
+	"payload", "envversion", "pid", "hostname"}
+
+func (e *NdjsonEncoder) ConfigStruct() interface{} {
+	return &NdjsonEncoderConfig{
+		Fields: []string{"Uuid", "Timestamp", "Type", "Logger", "Severity",
+			"Payload", "EnvVersion", "Pid", "Hostname", "Fields"},
+		TimestampFormat: "2006-01-02T15:04:05.000Z",
+		SortFields:      true,
+		EmptyValues:     "keep",
+	}
+}
+
+func (e *NdjsonEncoder) Init(config interface{}) (err error) {
+	e.conf = config.(*NdjsonEncoderConfig)
+	switch e.conf.EmptyValues {
+	case "keep", "omit", "null":
+	default:
+		return fmt.Errorf("invalid empty_values: %s", e.conf.EmptyValues)
+	}
+
+	e.columns = make([]ndjsonColumn, 0, len(e.conf.Fields))
+	for _, f := range e.conf.Fields {
+		switch {
+		case strings.ToLower(f) == "fields":
+			e.columns = append(e.columns, ndjsonColumn{kind: ndjsonAllFields})
+		case strings.HasPrefix(f, "Fields[") && strings.HasSuffix(f, "]"):
+			name := f[len("Fields[") : len(f)-1]
+			if name == "" {
+				return fmt.Errorf("empty field name: %s", f)
+			}
+			e.columns = append(e.columns, ndjsonColumn{kind: ndjsonField, name: name})
+		default:
+			known := false
+			for _, header := range ndjsonHeaders {
+				if strings.ToLower(f) == header {
+					known = true
+					break
+				}
+			}
+			if !known {
+				return fmt.Errorf("Unable to find field: %s", f)
+			}
+			e.columns = append(e.columns, ndjsonColumn{kind: ndjsonHeader, name: f})
+		}
+	}
+	return
+}
+
+func (e *NdjsonEncoder) Encode(pack *pipeline.PipelinePack) (output []byte, err error) {
+	m := pack.Message
+	obj := newNdjsonObject()
+	for _, col := range e.columns {
+		switch col.kind {
+		case ndjsonHeader:
+			e.addHeader(obj, col.name, m)
+		case ndjsonAllFields:
+			fields := m.Fields
+			if e.conf.SortFields {
+				fields = make([]*message.Field, len(m.Fields))
+				copy(fields, m.Fields)
+				sort.Stable(fieldsByName(fields))
+			}
+			for _, field := range fields {
+				value, empty := ndjsonFieldValue(field)
+				e.add(obj, field.GetName(), value, empty, e.conf.NestDottedFields)
+			}
+		case ndjsonField:
+			if field := m.FindFirstField(col.name); field != nil {
+				value, empty := ndjsonFieldValue(field)
+				e.add(obj, col.name, value, empty, e.conf.NestDottedFields)
+			} else if e.conf.EmptyValues == "null" {
+				e.add(obj, col.name, nil, true, e.conf.NestDottedFields)
+			}
+		}
+	}
+
+	buf := new(bytes.Buffer)
+	obj.write(buf)
+	buf.WriteByte('\n')
+	return buf.Bytes(), nil
+}
+
+func (e *NdjsonEncoder) addHeader(obj *ndjsonObject, name string, m *message.Message) {
+	var value string
+	switch strings.ToLower(name) {
+	case "uuid":
+		value = m.GetUuidString()
+	case "timestamp":
+		if e.conf.TimestampFormat == "" {
+			e.add(obj, name, []byte(strconv.FormatInt(m.GetTimestamp(), 10)), false,
+				false)
+			return
+		}
+		value = time.Unix(0, m.GetTimestamp()).UTC().Format(e.conf.TimestampFormat)
+	case "type":
+		value = m.GetType()
+	case "logger":
+		value = m.GetLogger()
+	case "severity":
+		e.add(obj, name, []byte(strconv.Itoa(int(m.GetSeverity()))), false, false)
+		return
+	case "payload":
+		value = m.GetPayload()
+	case "envversion":
+		value = m.GetEnvVersion()
+	case "pid":
+		e.add(obj, name, []byte(strconv.Itoa(int(m.GetPid()))), false, false)
+		return
+	case "hostname":
+		value = m.GetHostname()
+	}
+	e.add(obj, name, ndjsonString(value), value == "", false)
+}
+
+// Adds an encoded value to the object according to the empty value policy,
+// nesting it under its dotted name's parts if `nest` is true. A value whose
+// dotted name clashes with an existing value is added under its full name
+// instead. Only the first value for a given key is kept.
+func (e *NdjsonEncoder) add(obj *ndjsonObject, key string, value []byte, empty,
+	nest bool) {
+
+	if empty {
+		switch e.conf.EmptyValues {
+		case "omit":
+			return
+		case "null":
+			value = []byte("null")
+		}
+	}
+	if nest && strings.Contains(key, ".") {
+		parts := strings.Split(key, ".")
+		parent := obj
+		for _, part := range parts[:len(parts)-1] {
+			if parent = parent.child(part); parent == nil {
+				break
+			}
+		}
+		if parent != nil && parent.set(parts[len(parts)-1], value) {
+			return
+		}
+	}
+	obj.set(key, value)
+}
+
+// Returns the JSON encoding of a dynamic field's value(s), i.e. a scalar if
+// it has a single value and an array otherwise, and whether it's empty.
+func ndjsonFieldValue(field *message.Field) (value []byte, empty bool) {
+	var items [][]byte
+	switch field.GetValueType() {
+	case message.Field_STRING:
+		for _, v := range field.ValueString {
+			items = append(items, ndjsonString(v))
+		}
+		empty = len(field.ValueString) == 1 && field.ValueString[0] == ""
+	case message.Field_BYTES:
+		for _, v := range field.ValueBytes {
+			// encoding/json writes byte slices base64 encoded.
+			b, _ := json.Marshal(v)
+			items = append(items, b)
+		}
+		empty = len(field.ValueBytes) == 1 && len(field.ValueBytes[0]) == 0
+	case message.Field_INTEGER:
+		for _, v := range field.ValueInteger {
+			items = append(items, []byte(strconv.FormatInt(v, 10)))
+		}
+	case message.Field_DOUBLE:
+		for _, v := range field.ValueDouble {
+			if math.IsNaN(v) || math.IsInf(v, 0) {
+				// Not representable in JSON.
+				items = append(items, []byte("null"))
+			} else {
+				items = append(items, []byte(strconv.FormatFloat(v, 'g', -1, 64)))
+			}
+		}
+	case message.Field_BOOL:
+		for _, v := range field.ValueBool {
+			items = append(items, []byte(strconv.FormatBool(v)))
+		}
+	}
+	switch len(items) {
+	case 0:
+		return []byte("[]"), true
+	case 1:
+		return items[0], empty
+	}
+	return append(append([]byte("["), bytes.Join(items, []byte(","))...), ']'), false
+}
+
+// Invalid UTF-8 is encoded as U+FFFD.
+func ndjsonString(s string) []byte {
+	b, _ := json.Marshal(s)
+	return b
+}
+
+type fieldsByName []*message.Field
+
+func (f fieldsByName) Len() int           { return len(f) }
+func (f fieldsByName) Less(i, j int) bool { return f[i].GetName() < f[j].GetName() }
+func (f fieldsByName) Swap(i, j int)      { f[i], f[j] = f[j], f[i] }
+
+// A JSON object that remembers the order in which its keys were added.
+type ndjsonObject struct {
+	keys   []string
+	values map[string]interface{} // Encoded []byte values or *ndjsonObjects.
+}
+
+func newNdjsonObject() *ndjsonObject {
+	return &ndjsonObject{values: make(map[string]interface{})}
+}
+
+// Adds a value if the key isn't already in use, returns false if it is.
+func (o *ndjsonObject) set(key string, value []byte) bool {
+	if _, ok := o.values[key]; ok {
+		return false
+	}
+	o.keys = append(o.keys, key)
+	o.values[key] = value
+	return true
+}
+
+// Returns the nested object stored under the key, adding it if necessary, or
+// nil if the key holds a value.
+func (o *ndjsonObject) child(key string) *ndjsonObject {
+	if existing, ok := o.values[key]; ok {
+		child, _ := existing.(*ndjsonObject)
+		return child
+	}
+	child := newNdjsonObject()
+	o.keys = append(o.keys, key)
+	o.values[key] = child
+	return child
+}
+
+func (o *ndjsonObject) write(buf *bytes.Buffer) {
+	buf.WriteByte('{')
+	for i, key := range o.keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		buf.Write(ndjsonString(key))
+		buf.WriteByte(':')
+		switch v := o.values[key].(type) {
+		case []byte:
+			buf.Write(v)
+		case *ndjsonObject:
+			v.write(buf)
+		}
+	}
+	buf.WriteByte('}')
+}
+
+func init() {
+	pipeline.RegisterPlugin("NdjsonEncoder", func() interface{} {
+		return new(NdjsonEncoder)
+	})
+}
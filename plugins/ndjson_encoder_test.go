@@ -0,0 +1,108 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package plugins
+
+import (
+	"github.com/mozilla-services/heka/message"
+	"github.com/mozilla-services/heka/pipeline"
+	pipeline_ts "github.com/mozilla-services/heka/pipeline/testsupport"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+)
+
+func NdjsonEncoderSpec(c gs.Context) {
+
+	c.Specify("An NdjsonEncoder", func() {
+		encoder := new(NdjsonEncoder)
+		config := encoder.ConfigStruct().(*NdjsonEncoderConfig)
+		supply := make(chan *pipeline.PipelinePack, 1)
+		pack := pipeline.NewPipelinePack(supply)
+
+		encode := func() string {
+			err := encoder.Init(config)
+			c.Assume(err, gs.IsNil)
+			output, err := encoder.Encode(pack)
+			c.Assume(err, gs.IsNil)
+			return string(output)
+		}
+
+		c.Specify("serializes a message with the default settings", func() {
+			pack.Message = pipeline_ts.GetTestMessage()
+			expected := `{"Uuid":"8e414f01-9d7f-4a48-a5e1-ae92e5954df5",` +
+				`"Timestamp":"2006-01-02T22:04:05.000Z","Type":"TEST",` +
+				`"Logger":"GoSpec","Severity":6,"Payload":"Test Payload",` +
+				`"EnvVersion":"0.8","Pid":43,"Hostname":"my.host.name","foo":"bar"}` +
+				"\n"
+			c.Expect(encode(), gs.Equals, expected)
+		})
+
+		c.Specify("with dynamic fields", func() {
+			m := pack.Message
+			message.NewInt64Field(m, "z", 1, "")
+			message.NewInt64Field(m, "http.status", 200, "")
+			message.NewStringField(m, "http.method", "GET")
+			field, _ := message.NewField("a", "x", "")
+			field.AddValue("y")
+			m.AddField(field)
+			config.Fields = []string{"Fields"}
+
+			c.Specify("sorts them by name", func() {
+				c.Expect(encode(), gs.Equals,
+					`{"a":["x","y"],"http.method":"GET","http.status":200,"z":1}`+"\n")
+			})
+
+			c.Specify("keeps the message order if asked", func() {
+				config.SortFields = false
+				c.Expect(encode(), gs.Equals,
+					`{"z":1,"http.status":200,"http.method":"GET","a":["x","y"]}`+"\n")
+			})
+
+			c.Specify("nests dotted names", func() {
+				config.NestDottedFields = true
+				c.Expect(encode(), gs.Equals,
+					`{"a":["x","y"],"http":{"method":"GET","status":200},"z":1}`+"\n")
+			})
+
+			c.Specify("projects individual fields", func() {
+				config.Fields = []string{"Fields[z]", "Type", "Fields[http.status]"}
+				config.NestDottedFields = true
+				c.Expect(encode(), gs.Equals,
+					`{"z":1,"Type":"","http":{"status":200}}`+"\n")
+			})
+		})
+
+		c.Specify("with empty values", func() {
+			message.NewStringField(pack.Message, "empty", "")
+			config.Fields = []string{"Payload", "Fields[missing]", "Fields[empty]"}
+
+			c.Specify("keeps them by default", func() {
+				c.Expect(encode(), gs.Equals, `{"Payload":"","empty":""}`+"\n")
+			})
+
+			c.Specify("omits them", func() {
+				config.EmptyValues = "omit"
+				c.Expect(encode(), gs.Equals, "{}\n")
+			})
+
+			c.Specify("writes them as null", func() {
+				config.EmptyValues = "null"
+				c.Expect(encode(), gs.Equals,
+					`{"Payload":null,"missing":null,"empty":null}`+"\n")
+			})
+		})
+
+		c.Specify("rejects unknown fields", func() {
+			config.Fields = []string{"Uuid", "Bogus"}
+			err := encoder.Init(config)
+			c.Expect(err.Error(), gs.Equals, "Unable to find field: Bogus")
+		})
+	})
+}
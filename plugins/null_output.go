@@ -0,0 +1,229 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package plugins
+
+import (
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+	. "github.com/mozilla-services/heka/pipeline"
+	"log"
+	"sync"
+	"time"
+)
+
+// Message, byte, and latency bookkeeping for the NullOutput and EchoOutput.
+type outputAccounting struct {
+	lock         sync.Mutex
+	start        time.Time
+	count        int64
+	bytes        int64
+	latencyTotal int64 // Sum of the latencies of the counted messages, in ns.
+	latencyMax   int64
+	tickStart    time.Time
+	tickCount    int64
+	tickLatency  int64
+}
+
+func newOutputAccounting(now time.Time) *outputAccounting {
+	return &outputAccounting{start: now, tickStart: now}
+}
+
+// Counts a message that has reached the output. Latency is measured from the
+// message's timestamp, so for messages whose timestamp was set at the source
+// it includes the time spent before the message reached hekad.
+func (a *outputAccounting) record(msg *message.Message, size int, now time.Time) {
+	latency := now.UnixNano() - msg.GetTimestamp()
+	if latency < 0 {
+		latency = 0
+	}
+	a.lock.Lock()
+	a.count++
+	a.bytes += int64(size)
+	a.latencyTotal += latency
+	if latency > a.latencyMax {
+		a.latencyMax = latency
+	}
+	a.tickCount++
+	a.tickLatency += latency
+	a.lock.Unlock()
+}
+
+func (a *outputAccounting) reportMsg(msg *message.Message, now time.Time) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	var rate, avgLatency int64
+	if elapsed := now.Sub(a.start).Seconds(); elapsed > 0 {
+		rate = int64(float64(a.count) / elapsed)
+	}
+	if a.count > 0 {
+		avgLatency = a.latencyTotal / a.count
+	}
+	message.NewInt64Field(msg, "ProcessMessageCount", a.count, "count")
+	message.NewInt64Field(msg, "ProcessMessageBytes", a.bytes, "B")
+	message.NewInt64Field(msg, "ProcessMessageRate", rate, "count/s")
+	message.NewInt64Field(msg, "LatencyAvg", avgLatency, "ns")
+	message.NewInt64Field(msg, "LatencyMax", a.latencyMax, "ns")
+}
+
+// Returns a summary of the messages counted since the previous tick.
+func (a *outputAccounting) tick(now time.Time) string {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	elapsed := now.Sub(a.tickStart)
+	var rate float64
+	if elapsed > 0 {
+		rate = float64(a.tickCount) / elapsed.Seconds()
+	}
+	var avgLatency time.Duration
+	if a.tickCount > 0 {
+		avgLatency = time.Duration(a.tickLatency / a.tickCount)
+	}
+	summary := fmt.Sprintf("%d messages in %s (%.1f/sec), average latency %s",
+		a.tickCount, elapsed, rate, avgLatency)
+	a.tickStart = now
+	a.tickCount = 0
+	a.tickLatency = 0
+	return summary
+}
+
+// Output plugin that discards every message it receives, while keeping track
+// of how many arrived and how long they took to get there. Useful for
+// benchmarking and as a placeholder for a decommissioned output. If an
+// encoder is specified each message is encoded before being discarded, and
+// the encoded bytes are counted.
+type NullOutput struct {
+	acct *outputAccounting
+}
+
+func (n *NullOutput) Init(config interface{}) (err error) {
+	n.acct = newOutputAccounting(time.Now())
+	return
+}
+
+func (n *NullOutput) Run(or OutputRunner, h PluginHelper) (err error) {
+	return n.run(or, nil, nil)
+}
+
+// Counts every message from the runner's input channel, passing each one and
+// its encoded bytes (if any) to `handle` before recycling it. Logs a summary
+// and calls `tick` every ticker_interval.
+func (n *NullOutput) run(or OutputRunner, handle func(pack *PipelinePack,
+	outBytes []byte), tick func()) (err error) {
+
+	var (
+		pack     *PipelinePack
+		outBytes []byte
+		e        error
+		ok       = true
+		encode   = or.Encoder() != nil
+		inChan   = or.InChan()
+		ticker   = or.Ticker()
+	)
+	for ok {
+		select {
+		case pack, ok = <-inChan:
+			if !ok {
+				break
+			}
+			outBytes = nil
+			if encode {
+				if outBytes, e = or.Encode(pack); e != nil {
+					or.LogError(fmt.Errorf("Error encoding message: %s", e))
+				}
+			}
+			n.acct.record(pack.Message, len(outBytes), time.Now())
+			// Messages the encoder dropped are counted but not handled.
+			if handle != nil && (!encode || outBytes != nil) {
+				handle(pack, outBytes)
+			}
+			pack.Recycle()
+		case <-ticker:
+			or.LogMessage(n.acct.tick(time.Now()))
+			if tick != nil {
+				tick()
+			}
+		}
+	}
+	return
+}
+
+// Satisfies the `pipeline.ReportingPlugin` interface to provide plugin state
+// information to the Heka report and dashboard.
+func (n *NullOutput) ReportMsg(msg *message.Message) error {
+	n.acct.reportMsg(msg, time.Now())
+	return nil
+}
+
+type EchoOutputConfig struct {
+	// Maximum number of messages to log per ticker_interval, or in total if
+	// there's no ticker_interval. Defaults to 10.
+	EchoCount uint `toml:"echo_count"`
+	// Only one in every `sample_denominator` messages is considered for
+	// logging. Defaults to 1, i.e. every message.
+	SampleDenominator uint `toml:"sample_denominator"`
+}
+
+// Output plugin that logs a sample of the messages it receives, and counts
+// and discards the rest, in the same way as the NullOutput. Messages are
+// logged in their encoded form if an encoder is specified, or as a text
+// representation of the whole message otherwise.
+type EchoOutput struct {
+	NullOutput
+	conf   *EchoOutputConfig
+	seen   uint64
+	echoed uint
+}
+
+func (e *EchoOutput) ConfigStruct() interface{} {
+	return &EchoOutputConfig{
+		EchoCount:         10,
+		SampleDenominator: 1,
+	}
+}
+
+func (e *EchoOutput) Init(config interface{}) (err error) {
+	e.conf = config.(*EchoOutputConfig)
+	if e.conf.SampleDenominator == 0 {
+		e.conf.SampleDenominator = 1
+	}
+	return e.NullOutput.Init(nil)
+}
+
+func (e *EchoOutput) Run(or OutputRunner, h PluginHelper) (err error) {
+	// With a ticker_interval the echo budget applies to each interval.
+	return e.run(or, e.echo, func() { e.echoed = 0 })
+}
+
+func (e *EchoOutput) echo(pack *PipelinePack, outBytes []byte) {
+	e.seen++
+	if (e.seen-1)%uint64(e.conf.SampleDenominator) != 0 ||
+		e.echoed >= e.conf.EchoCount {
+		return
+	}
+	e.echoed++
+	if outBytes != nil {
+		log.Print(string(outBytes))
+	} else {
+		log.Print(pack.Message.String())
+	}
+}
+
+func init() {
+	RegisterPlugin("NullOutput", func() interface{} {
+		return new(NullOutput)
+	})
+	RegisterPlugin("EchoOutput", func() interface{} {
+		return new(EchoOutput)
+	})
+}
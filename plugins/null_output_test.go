@@ -0,0 +1,139 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package plugins
+
+import (
+	"github.com/mozilla-services/heka/message"
+	"github.com/mozilla-services/heka/pipeline"
+	pipeline_ts "github.com/mozilla-services/heka/pipeline/testsupport"
+	plugins_ts "github.com/mozilla-services/heka/plugins/testsupport"
+	"github.com/rafrombrc/gomock/gomock"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"strings"
+	"time"
+)
+
+func NullOutputSpec(c gs.Context) {
+	t := new(pipeline_ts.SimpleT)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	oth := plugins_ts.NewOutputTestHelper(ctrl)
+	pConfig := pipeline.NewPipelineConfig(nil)
+	inChan := make(chan *pipeline.PipelinePack, 5)
+
+	newPack := func(age time.Duration) *pipeline.PipelinePack {
+		pack := pipeline.NewPipelinePack(pConfig.InputRecycleChan())
+		pack.Message.SetTimestamp(time.Now().Add(-age).UnixNano())
+		pack.Message.SetPayload("payload")
+		pack.Decoded = true
+		return pack
+	}
+
+	getField := func(msg *message.Message, name string) int64 {
+		val, ok := msg.GetFieldValue(name)
+		c.Assume(ok, gs.IsTrue)
+		return val.(int64)
+	}
+
+	c.Specify("An outputAccounting", func() {
+		start := time.Now()
+		acct := newOutputAccounting(start)
+		msg := new(message.Message)
+
+		c.Specify("tracks counts, throughput, and latency", func() {
+			msg.SetTimestamp(start.UnixNano())
+			acct.record(msg, 10, start.Add(time.Second))
+			acct.record(msg, 20, start.Add(3*time.Second))
+
+			report := new(message.Message)
+			acct.reportMsg(report, start.Add(2*time.Second))
+			c.Expect(getField(report, "ProcessMessageCount"), gs.Equals, int64(2))
+			c.Expect(getField(report, "ProcessMessageBytes"), gs.Equals, int64(30))
+			c.Expect(getField(report, "ProcessMessageRate"), gs.Equals, int64(1))
+			c.Expect(getField(report, "LatencyAvg"), gs.Equals,
+				int64(2*time.Second))
+			c.Expect(getField(report, "LatencyMax"), gs.Equals,
+				int64(3*time.Second))
+		})
+
+		c.Specify("resets the interval counts on each tick", func() {
+			msg.SetTimestamp(start.UnixNano())
+			acct.record(msg, 0, start.Add(time.Second))
+			summary := acct.tick(start.Add(2 * time.Second))
+			c.Expect(summary, gs.Equals,
+				"1 messages in 2s (0.5/sec), average latency 1s")
+			summary = acct.tick(start.Add(3 * time.Second))
+			c.Expect(strings.HasPrefix(summary, "0 messages in 1s (0.0/sec)"),
+				gs.IsTrue)
+
+			report := new(message.Message)
+			acct.reportMsg(report, start.Add(4*time.Second))
+			c.Expect(getField(report, "ProcessMessageCount"), gs.Equals, int64(1))
+		})
+	})
+
+	c.Specify("A NullOutput", func() {
+		output := new(NullOutput)
+		err := output.Init(nil)
+		c.Assume(err, gs.IsNil)
+
+		oth.MockOutputRunner.EXPECT().Encoder().Return(nil)
+		oth.MockOutputRunner.EXPECT().InChan().Return(inChan)
+		oth.MockOutputRunner.EXPECT().Ticker().Return(nil)
+
+		c.Specify("counts and recycles every message", func() {
+			for i := 0; i < 3; i++ {
+				inChan <- newPack(time.Millisecond)
+			}
+			close(inChan)
+			err = output.Run(oth.MockOutputRunner, oth.MockHelper)
+			c.Expect(err, gs.IsNil)
+			c.Expect(len(pConfig.InputRecycleChan()), gs.Equals, 3)
+
+			report := new(message.Message)
+			c.Expect(output.ReportMsg(report), gs.IsNil)
+			c.Expect(getField(report, "ProcessMessageCount"), gs.Equals, int64(3))
+			c.Expect(getField(report, "LatencyMax") >= int64(time.Millisecond),
+				gs.IsTrue)
+		})
+	})
+
+	c.Specify("An EchoOutput", func() {
+		output := new(EchoOutput)
+		config := output.ConfigStruct().(*EchoOutputConfig)
+		var echoed []*pipeline.PipelinePack
+
+		c.Specify("echoes a sample of the messages and counts the rest", func() {
+			config.EchoCount = 2
+			config.SampleDenominator = 2
+			err := output.Init(config)
+			c.Assume(err, gs.IsNil)
+
+			for i := 0; i < 6; i++ {
+				pack := newPack(0)
+				output.acct.record(pack.Message, 0, time.Now())
+				before := output.echoed
+				output.echo(pack, nil)
+				if output.echoed > before {
+					echoed = append(echoed, pack)
+				}
+			}
+			c.Expect(len(echoed), gs.Equals, 2)
+			c.Expect(output.seen, gs.Equals, uint64(6))
+
+			report := new(message.Message)
+			c.Expect(output.ReportMsg(report), gs.IsNil)
+			c.Expect(getField(report, "ProcessMessageCount"), gs.Equals, int64(6))
+		})
+	})
+}
@@ -0,0 +1,492 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package otlp
+
+import (
+	"code.google.com/p/go-uuid/uuid"
+	"compress/gzip"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+	"github.com/mozilla-services/heka/pipeline"
+	"github.com/mozilla-services/heka/plugins/tcp"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	serviceName = "opentelemetry.proto.collector.logs.v1.LogsService"
+	logsPath    = "/v1/logs"
+)
+
+type OTLPInputConfig struct {
+	// Address the OTLP/gRPC server listens on, empty to disable it.
+	GrpcAddress string `toml:"grpc_address"`
+	// Address the OTLP/HTTP server listens on, empty to disable it.
+	HttpAddress string `toml:"http_address"`
+	// Maximum size in bytes of an export request, after decompression.
+	MaxRequestSize uint32 `toml:"max_request_size"`
+	// Prefixes of the names of the fields holding the records' attributes,
+	// their resource's attributes, and their instrumentation scope's
+	// attributes.
+	AttributePrefix string `toml:"attribute_prefix"`
+	ResourcePrefix  string `toml:"resource_prefix"`
+	ScopePrefix     string `toml:"scope_prefix"`
+	// Set to true to serve both protocols over TLS, requires the `tls`
+	// section.
+	UseTls bool `toml:"use_tls"`
+	Tls    tcp.TlsConfig
+}
+
+// Receives log records from OpenTelemetry SDKs and collectors over OTLP,
+// both OTLP/gRPC and OTLP/HTTP with protobuf or JSON payloads, delivering
+// each record as a message.
+type OTLPInput struct {
+	recordsReceived  int64
+	requestsRejected int64
+
+	conf       *OTLPInputConfig
+	ir         pipeline.InputRunner
+	hostname   string
+	tlsConfig  *tls.Config
+	grpcServer *grpc.Server
+	httpServer *http.Server
+	listeners  []net.Listener
+	stopChan   chan struct{}
+	stopOnce   sync.Once
+}
+
+var errStopping = errors.New("input is stopping")
+
+func (input *OTLPInput) ConfigStruct() interface{} {
+	return &OTLPInputConfig{
+		GrpcAddress:    "127.0.0.1:4317",
+		HttpAddress:    "127.0.0.1:4318",
+		MaxRequestSize: 4 * 1024 * 1024,
+		ResourcePrefix: "resource.",
+		ScopePrefix:    "scope.",
+		Tls:            tcp.TlsConfig{PreferServerCiphers: true},
+	}
+}
+
+func (input *OTLPInput) Init(config interface{}) (err error) {
+	input.conf = config.(*OTLPInputConfig)
+	if input.conf.GrpcAddress == "" && input.conf.HttpAddress == "" {
+		return errors.New("grpc_address or http_address must be specified")
+	}
+	if input.conf.UseTls {
+		if input.tlsConfig, err = tcp.CreateGoTlsConfig(&input.conf.Tls); err != nil {
+			return fmt.Errorf("TLS init error: %s", err)
+		}
+	}
+	input.stopChan = make(chan struct{})
+	return
+}
+
+func (input *OTLPInput) Run(ir pipeline.InputRunner, h pipeline.PluginHelper) error {
+	input.ir = ir
+	input.hostname = h.PipelineConfig().Hostname()
+	errChan := make(chan error, 2)
+
+	if input.conf.GrpcAddress != "" {
+		listener, err := net.Listen("tcp", input.conf.GrpcAddress)
+		if err != nil {
+			return fmt.Errorf("can't listen on %s: %s", input.conf.GrpcAddress, err)
+		}
+		input.listeners = append(input.listeners, listener)
+		options := []grpc.ServerOption{grpc.ForceServerCodec(codec{}),
+			grpc.MaxRecvMsgSize(int(input.conf.MaxRequestSize))}
+		if input.tlsConfig != nil {
+			options = append(options, grpc.Creds(credentials.NewTLS(input.tlsConfig)))
+		}
+		input.grpcServer = grpc.NewServer(options...)
+		input.grpcServer.RegisterService(&serviceDesc, input)
+		go func() {
+			errChan <- input.grpcServer.Serve(listener)
+		}()
+	}
+
+	if input.conf.HttpAddress != "" {
+		listener, err := net.Listen("tcp", input.conf.HttpAddress)
+		if err != nil {
+			input.Stop()
+			return fmt.Errorf("can't listen on %s: %s", input.conf.HttpAddress, err)
+		}
+		if input.tlsConfig != nil {
+			listener = tls.NewListener(listener, input.tlsConfig)
+		}
+		input.listeners = append(input.listeners, listener)
+		mux := http.NewServeMux()
+		mux.HandleFunc(logsPath, input.handleHttp)
+		input.httpServer = &http.Server{Handler: mux}
+		go func() {
+			errChan <- input.httpServer.Serve(listener)
+		}()
+	}
+
+	select {
+	case err := <-errChan:
+		select {
+		case <-input.stopChan:
+			return nil
+		default:
+		}
+		input.Stop()
+		return fmt.Errorf("server failed: %s", err)
+	case <-input.stopChan:
+	}
+	return nil
+}
+
+func (input *OTLPInput) Stop() {
+	input.stopOnce.Do(func() {
+		close(input.stopChan)
+		for _, listener := range input.listeners {
+			listener.Close()
+		}
+		if input.grpcServer != nil {
+			input.grpcServer.Stop()
+		}
+	})
+}
+
+// Delivers the records of an export request. Returns errStopping if the
+// input stopped before they were all delivered.
+func (input *OTLPInput) export(logs []resourceLogs) error {
+	for i := range logs {
+		rl := &logs[i]
+		for j := range rl.scopes {
+			sl := &rl.scopes[j]
+			for k := range sl.records {
+				var pack *pipeline.PipelinePack
+				select {
+				case pack = <-input.ir.InChan():
+				case <-input.stopChan:
+					return errStopping
+				}
+				input.populate(pack.Message, rl, sl, &sl.records[k])
+				input.ir.Deliver(pack)
+				atomic.AddInt64(&input.recordsReceived, 1)
+			}
+		}
+	}
+	return nil
+}
+
+// Syslog severities of the OpenTelemetry severity number ranges, TRACE,
+// DEBUG, INFO, WARN, ERROR, and FATAL, four numbers each.
+var severities = []int32{7, 7, 6, 4, 3, 2}
+
+// Fills in a message from a log record.
+func (input *OTLPInput) populate(msg *message.Message, rl *resourceLogs,
+	sl *scopeLogs, rec *logRecord) {
+
+	msg.SetUuid(uuid.NewRandom())
+	switch {
+	case rec.timeUnixNano != 0:
+		msg.SetTimestamp(int64(rec.timeUnixNano))
+	case rec.observedTimeUnixNano != 0:
+		msg.SetTimestamp(int64(rec.observedTimeUnixNano))
+	default:
+		msg.SetTimestamp(time.Now().UnixNano())
+	}
+	msg.SetType("otlp.log")
+	if sl.name != "" {
+		msg.SetLogger(sl.name)
+	} else {
+		msg.SetLogger(input.ir.Name())
+	}
+	msg.SetHostname(input.hostname)
+	if rec.severityNumber >= 1 && rec.severityNumber <= 24 {
+		msg.SetSeverity(severities[(rec.severityNumber-1)/4])
+	}
+	msg.SetPayload(rec.body.String())
+
+	for _, kv := range rl.attributes {
+		switch kv.key {
+		case "host.name":
+			if kv.value != nil && kv.value.kind == kindString {
+				msg.SetHostname(kv.value.str)
+			}
+		case "process.pid":
+			if kv.value != nil && kv.value.kind == kindInt {
+				msg.SetPid(int32(kv.value.int))
+			}
+		}
+	}
+
+	if rec.severityText != "" {
+		message.NewStringField(msg, "SeverityText", rec.severityText)
+	}
+	if rec.eventName != "" {
+		message.NewStringField(msg, "EventName", rec.eventName)
+	}
+	if len(rec.traceId) > 0 {
+		message.NewStringField(msg, "TraceId", hex.EncodeToString(rec.traceId))
+	}
+	if len(rec.spanId) > 0 {
+		message.NewStringField(msg, "SpanId", hex.EncodeToString(rec.spanId))
+	}
+	if sl.version != "" {
+		message.NewStringField(msg, "ScopeVersion", sl.version)
+	}
+	addAttributes(msg, input.conf.AttributePrefix, rec.attributes)
+	addAttributes(msg, input.conf.ResourcePrefix, rl.attributes)
+	addAttributes(msg, input.conf.ScopePrefix, sl.attributes)
+}
+
+// Adds attributes to a message as fields. Arrays of strings, booleans,
+// integers, or doubles become fields with multiple values, other arrays and
+// key/value lists are JSON encoded.
+func addAttributes(msg *message.Message, prefix string, attributes []keyValue) {
+	for _, kv := range attributes {
+		if kv.value == nil || kv.value.kind == kindEmpty {
+			continue
+		}
+		name := prefix + kv.key
+		var field *message.Field
+		if kv.value.kind == kindArray {
+			field = arrayField(name, kv.value.array)
+		} else {
+			field, _ = message.NewField(name, scalarValue(kv.value), "")
+		}
+		if field == nil {
+			field, _ = message.NewField(name, kv.value.String(), "")
+		}
+		if field != nil {
+			msg.AddField(field)
+		}
+	}
+}
+
+// Returns the Go value of a scalar value, or a JSON string.
+func scalarValue(v *anyValue) interface{} {
+	switch v.kind {
+	case kindBool:
+		return v.bool
+	case kindInt:
+		return v.int
+	case kindDouble:
+		return v.double
+	case kindBytes:
+		return v.bytes
+	}
+	return v.String()
+}
+
+// Returns a multi-valued field for an array of scalar values of the same
+// kind, or nil.
+func arrayField(name string, values []*anyValue) (field *message.Field) {
+	if len(values) == 0 {
+		return nil
+	}
+	for _, v := range values {
+		if v == nil || v.kind != values[0].kind || v.kind == kindEmpty ||
+			v.kind == kindArray || v.kind == kindKvlist {
+			return nil
+		}
+		if field == nil {
+			field, _ = message.NewField(name, scalarValue(v), "")
+		} else if field.AddValue(scalarValue(v)) != nil {
+			return nil
+		}
+	}
+	return
+}
+
+func (input *OTLPInput) ReportMsg(msg *message.Message) error {
+	message.NewInt64Field(msg, "RecordsReceived",
+		atomic.LoadInt64(&input.recordsReceived), "count")
+	message.NewInt64Field(msg, "RequestsRejected",
+		atomic.LoadInt64(&input.requestsRejected), "count")
+	return nil
+}
+
+// OTLP/HTTP
+
+func (input *OTLPInput) handleHttp(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	contentType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	var unmarshal func([]byte) ([]resourceLogs, error)
+	switch contentType {
+	case "application/x-protobuf":
+		unmarshal = unmarshalLogsRequest
+	case "application/json":
+		unmarshal = unmarshalJSONLogsRequest
+	default:
+		http.Error(w, "unsupported content type", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	var body io.Reader = http.MaxBytesReader(w, req.Body, int64(input.conf.MaxRequestSize))
+	if req.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			input.rejectHttp(w, contentType, http.StatusBadRequest, err)
+			return
+		}
+		defer gz.Close()
+		body = io.LimitReader(gz, int64(input.conf.MaxRequestSize)+1)
+	}
+	data, err := ioutil.ReadAll(body)
+	if err == nil && len(data) > int(input.conf.MaxRequestSize) {
+		err = errors.New("request too large")
+	}
+	if err != nil {
+		input.rejectHttp(w, contentType, http.StatusRequestEntityTooLarge, err)
+		return
+	}
+	logs, err := unmarshal(data)
+	if err != nil {
+		input.rejectHttp(w, contentType, http.StatusBadRequest, err)
+		return
+	}
+	if err = input.export(logs); err != nil {
+		input.rejectHttp(w, contentType, http.StatusServiceUnavailable, err)
+		return
+	}
+	// An empty ExportLogsServiceResponse, all the records were accepted.
+	w.Header().Set("Content-Type", contentType)
+	if contentType == "application/json" {
+		w.Write([]byte("{}"))
+	}
+}
+
+// Responds with an error, as a google.rpc.Status message in the request's
+// encoding.
+func (input *OTLPInput) rejectHttp(w http.ResponseWriter, contentType string,
+	statusCode int, err error) {
+
+	atomic.AddInt64(&input.requestsRejected, 1)
+	code := codes.InvalidArgument
+	if statusCode == http.StatusServiceUnavailable {
+		code = codes.Unavailable
+	}
+	var body []byte
+	if contentType == "application/json" {
+		body, _ = json.Marshal(map[string]interface{}{"code": uint32(code),
+			"message": err.Error()})
+	} else {
+		body = appendVarintField(nil, 1, uint64(code))
+		body = appendBytesField(body, 2, []byte(err.Error()))
+	}
+	if statusCode == http.StatusServiceUnavailable {
+		w.Header().Set("Retry-After", "1")
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(statusCode)
+	w.Write(body)
+}
+
+func appendVarintField(b []byte, field int, v uint64) []byte {
+	b = appendVarint(b, uint64(field)<<3|wireVarint)
+	return appendVarint(b, v)
+}
+
+func appendBytesField(b []byte, field int, v []byte) []byte {
+	b = appendVarint(b, uint64(field)<<3|wireBytes)
+	b = appendVarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+func appendVarint(b []byte, v uint64) []byte {
+	for v >= 0x80 {
+		b = append(b, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(b, byte(v))
+}
+
+// OTLP/gRPC
+
+var serviceDesc = grpc.ServiceDesc{
+	ServiceName: serviceName,
+	HandlerType: (*interface{})(nil),
+	Methods: []grpc.MethodDesc{
+		{MethodName: "Export", Handler: handleExport},
+	},
+	Streams: []grpc.StreamDesc{},
+}
+
+// An encoded protobuf message, requests are decoded by the handler.
+type rawMessage struct {
+	bytes []byte
+}
+
+// gRPC codec passing the encoded messages through.
+type codec struct{}
+
+func (codec) Marshal(v interface{}) ([]byte, error) {
+	msg, ok := v.(*rawMessage)
+	if !ok {
+		return nil, fmt.Errorf("can't marshal %T", v)
+	}
+	return msg.bytes, nil
+}
+
+func (codec) Unmarshal(data []byte, v interface{}) error {
+	msg, ok := v.(*rawMessage)
+	if !ok {
+		return fmt.Errorf("can't unmarshal %T", v)
+	}
+	msg.bytes = data
+	return nil
+}
+
+func (codec) Name() string {
+	return "proto"
+}
+
+func handleExport(srv interface{}, ctx context.Context, dec func(interface{}) error,
+	interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+
+	input := srv.(*OTLPInput)
+	req := new(rawMessage)
+	if err := dec(req); err != nil {
+		return nil, err
+	}
+	logs, err := unmarshalLogsRequest(req.bytes)
+	if err != nil {
+		atomic.AddInt64(&input.requestsRejected, 1)
+		return nil, status.Errorf(codes.InvalidArgument, "invalid request: %s", err)
+	}
+	if err = input.export(logs); err != nil {
+		atomic.AddInt64(&input.requestsRejected, 1)
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+	// An empty ExportLogsServiceResponse.
+	return new(rawMessage), nil
+}
+
+func init() {
+	pipeline.RegisterPlugin("OTLPInput", func() interface{} {
+		return new(OTLPInput)
+	})
+}
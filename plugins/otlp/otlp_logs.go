@@ -0,0 +1,513 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package otlp
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Decoding of the OTLP logs export requests, the ExportLogsServiceRequest
+// message of OpenTelemetry's `collector/logs/v1/logs_service.proto`, from
+// their protobuf and JSON encodings. Only the parts of the protocol Heka uses
+// are decoded, by hand, so no generated code is needed.
+
+// Resource and the log records it produced, grouped by instrumentation
+// scope.
+type resourceLogs struct {
+	attributes []keyValue
+	scopes     []scopeLogs
+}
+
+type scopeLogs struct {
+	name, version string
+	attributes    []keyValue
+	records       []logRecord
+}
+
+type logRecord struct {
+	timeUnixNano         uint64
+	observedTimeUnixNano uint64
+	severityNumber       int32
+	severityText         string
+	body                 *anyValue
+	attributes           []keyValue
+	traceId, spanId      []byte
+	eventName            string
+}
+
+type keyValue struct {
+	key   string
+	value *anyValue
+}
+
+type valueKind int
+
+const (
+	kindEmpty valueKind = iota
+	kindString
+	kindBool
+	kindInt
+	kindDouble
+	kindArray
+	kindKvlist
+	kindBytes
+)
+
+// An AnyValue, the value of a record's body or of an attribute.
+type anyValue struct {
+	kind   valueKind
+	str    string
+	bool   bool
+	int    int64
+	double float64
+	bytes  []byte
+	array  []*anyValue
+	kvlist []keyValue
+}
+
+// Returns the value as a plain Go value, e.g. for JSON encoding.
+func (v *anyValue) interfaceValue() interface{} {
+	if v == nil {
+		return nil
+	}
+	switch v.kind {
+	case kindString:
+		return v.str
+	case kindBool:
+		return v.bool
+	case kindInt:
+		return v.int
+	case kindDouble:
+		if math.IsNaN(v.double) || math.IsInf(v.double, 0) {
+			return strconv.FormatFloat(v.double, 'g', -1, 64)
+		}
+		return v.double
+	case kindBytes:
+		return v.bytes
+	case kindArray:
+		values := make([]interface{}, len(v.array))
+		for i, value := range v.array {
+			values[i] = value.interfaceValue()
+		}
+		return values
+	case kindKvlist:
+		values := make(map[string]interface{}, len(v.kvlist))
+		for _, kv := range v.kvlist {
+			values[kv.key] = kv.value.interfaceValue()
+		}
+		return values
+	}
+	return nil
+}
+
+// Returns the value as a string: strings as is, other values JSON encoded.
+func (v *anyValue) String() string {
+	if v == nil {
+		return ""
+	}
+	if v.kind == kindString {
+		return v.str
+	}
+	b, _ := json.Marshal(v.interfaceValue())
+	return string(b)
+}
+
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+var errTruncated = errors.New("truncated protobuf message")
+
+// Calls `f` with each field of an encoded protobuf message. Varint and fixed
+// width values are passed as `num`, length delimited ones as `bytes`.
+func readFields(data []byte, f func(field int, num uint64, bytes []byte) error) error {
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return errTruncated
+		}
+		data = data[n:]
+		var (
+			num   uint64
+			bytes []byte
+		)
+		switch key & 7 {
+		case wireVarint:
+			if num, n = binary.Uvarint(data); n <= 0 {
+				return errTruncated
+			}
+			data = data[n:]
+		case wireFixed64:
+			if len(data) < 8 {
+				return errTruncated
+			}
+			num = binary.LittleEndian.Uint64(data)
+			data = data[8:]
+		case wireBytes:
+			length, n := binary.Uvarint(data)
+			if n <= 0 || uint64(len(data)-n) < length {
+				return errTruncated
+			}
+			bytes = data[n : n+int(length)]
+			data = data[n+int(length):]
+		case wireFixed32:
+			if len(data) < 4 {
+				return errTruncated
+			}
+			num = uint64(binary.LittleEndian.Uint32(data))
+			data = data[4:]
+		default:
+			return fmt.Errorf("unsupported wire type %d", key&7)
+		}
+		if err := f(int(key>>3), num, bytes); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Decodes a protobuf encoded ExportLogsServiceRequest.
+func unmarshalLogsRequest(data []byte) (logs []resourceLogs, err error) {
+	err = readFields(data, func(field int, num uint64, bytes []byte) error {
+		if field != 1 {
+			return nil
+		}
+		var rl resourceLogs
+		if err := rl.unmarshal(bytes); err != nil {
+			return err
+		}
+		logs = append(logs, rl)
+		return nil
+	})
+	return
+}
+
+func (rl *resourceLogs) unmarshal(data []byte) error {
+	return readFields(data, func(field int, num uint64, bytes []byte) error {
+		switch field {
+		case 1: // Resource
+			return readFields(bytes, func(field int, num uint64, bytes []byte) error {
+				if field != 1 {
+					return nil
+				}
+				kv, err := unmarshalKeyValue(bytes)
+				rl.attributes = append(rl.attributes, kv)
+				return err
+			})
+		case 2:
+			var sl scopeLogs
+			if err := sl.unmarshal(bytes); err != nil {
+				return err
+			}
+			rl.scopes = append(rl.scopes, sl)
+		}
+		return nil
+	})
+}
+
+func (sl *scopeLogs) unmarshal(data []byte) error {
+	return readFields(data, func(field int, num uint64, bytes []byte) error {
+		switch field {
+		case 1: // InstrumentationScope
+			return readFields(bytes, func(field int, num uint64, bytes []byte) error {
+				switch field {
+				case 1:
+					sl.name = string(bytes)
+				case 2:
+					sl.version = string(bytes)
+				case 3:
+					kv, err := unmarshalKeyValue(bytes)
+					sl.attributes = append(sl.attributes, kv)
+					return err
+				}
+				return nil
+			})
+		case 2:
+			var rec logRecord
+			if err := rec.unmarshal(bytes); err != nil {
+				return err
+			}
+			sl.records = append(sl.records, rec)
+		}
+		return nil
+	})
+}
+
+func (rec *logRecord) unmarshal(data []byte) error {
+	return readFields(data, func(field int, num uint64, bytes []byte) (err error) {
+		switch field {
+		case 1:
+			rec.timeUnixNano = num
+		case 2:
+			rec.severityNumber = int32(num)
+		case 3:
+			rec.severityText = string(bytes)
+		case 5:
+			rec.body, err = unmarshalAnyValue(bytes)
+		case 6:
+			var kv keyValue
+			kv, err = unmarshalKeyValue(bytes)
+			rec.attributes = append(rec.attributes, kv)
+		case 9:
+			rec.traceId = append([]byte(nil), bytes...)
+		case 10:
+			rec.spanId = append([]byte(nil), bytes...)
+		case 11:
+			rec.observedTimeUnixNano = num
+		case 12:
+			rec.eventName = string(bytes)
+		}
+		return
+	})
+}
+
+func unmarshalKeyValue(data []byte) (kv keyValue, err error) {
+	err = readFields(data, func(field int, num uint64, bytes []byte) (err error) {
+		switch field {
+		case 1:
+			kv.key = string(bytes)
+		case 2:
+			kv.value, err = unmarshalAnyValue(bytes)
+		}
+		return
+	})
+	return
+}
+
+func unmarshalAnyValue(data []byte) (v *anyValue, err error) {
+	v = new(anyValue)
+	err = readFields(data, func(field int, num uint64, bytes []byte) error {
+		switch field {
+		case 1:
+			v.kind, v.str = kindString, string(bytes)
+		case 2:
+			v.kind, v.bool = kindBool, num != 0
+		case 3:
+			v.kind, v.int = kindInt, int64(num)
+		case 4:
+			v.kind, v.double = kindDouble, math.Float64frombits(num)
+		case 5:
+			v.kind = kindArray
+			return readFields(bytes, func(field int, num uint64, bytes []byte) error {
+				if field != 1 {
+					return nil
+				}
+				value, err := unmarshalAnyValue(bytes)
+				v.array = append(v.array, value)
+				return err
+			})
+		case 6:
+			v.kind = kindKvlist
+			return readFields(bytes, func(field int, num uint64, bytes []byte) error {
+				if field != 1 {
+					return nil
+				}
+				kv, err := unmarshalKeyValue(bytes)
+				v.kvlist = append(v.kvlist, kv)
+				return err
+			})
+		case 7:
+			v.kind, v.bytes = kindBytes, append([]byte(nil), bytes...)
+		}
+		return nil
+	})
+	return
+}
+
+// The JSON encoding of the request, as specified by OTLP: protobuf's JSON
+// mapping with lowerCamelCase keys, 64 bit integers that may be strings, and
+// trace and span IDs as hex strings.
+
+type jsonLogsRequest struct {
+	ResourceLogs []struct {
+		Resource struct {
+			Attributes []jsonKeyValue `json:"attributes"`
+		} `json:"resource"`
+		ScopeLogs []struct {
+			Scope struct {
+				Name       string         `json:"name"`
+				Version    string         `json:"version"`
+				Attributes []jsonKeyValue `json:"attributes"`
+			} `json:"scope"`
+			LogRecords []jsonLogRecord `json:"logRecords"`
+		} `json:"scopeLogs"`
+	} `json:"resourceLogs"`
+}
+
+type jsonLogRecord struct {
+	TimeUnixNano         jsonNumber     `json:"timeUnixNano"`
+	ObservedTimeUnixNano jsonNumber     `json:"observedTimeUnixNano"`
+	SeverityNumber       jsonNumber     `json:"severityNumber"`
+	SeverityText         string         `json:"severityText"`
+	Body                 *jsonAnyValue  `json:"body"`
+	Attributes           []jsonKeyValue `json:"attributes"`
+	TraceId              string         `json:"traceId"`
+	SpanId               string         `json:"spanId"`
+	EventName            string         `json:"eventName"`
+}
+
+type jsonKeyValue struct {
+	Key   string        `json:"key"`
+	Value *jsonAnyValue `json:"value"`
+}
+
+type jsonAnyValue struct {
+	StringValue *string    `json:"stringValue"`
+	BoolValue   *bool      `json:"boolValue"`
+	IntValue    jsonNumber `json:"intValue"`
+	DoubleValue jsonNumber `json:"doubleValue"`
+	BytesValue  []byte     `json:"bytesValue"`
+	ArrayValue  *struct {
+		Values []*jsonAnyValue `json:"values"`
+	} `json:"arrayValue"`
+	KvlistValue *struct {
+		Values []jsonKeyValue `json:"values"`
+	} `json:"kvlistValue"`
+}
+
+// A JSON number, or a string holding one.
+type jsonNumber string
+
+func (n *jsonNumber) UnmarshalJSON(data []byte) error {
+	if s := string(data); s != "null" {
+		*n = jsonNumber(strings.Trim(s, `"`))
+	}
+	return nil
+}
+
+func (n jsonNumber) uint64() (uint64, error) {
+	if n == "" {
+		return 0, nil
+	}
+	return strconv.ParseUint(string(n), 10, 64)
+}
+
+func (n jsonNumber) int64() (int64, error) {
+	if n == "" {
+		return 0, nil
+	}
+	return strconv.ParseInt(string(n), 10, 64)
+}
+
+// Decodes a JSON encoded ExportLogsServiceRequest.
+func unmarshalJSONLogsRequest(data []byte) (logs []resourceLogs, err error) {
+	var req jsonLogsRequest
+	if err = json.Unmarshal(data, &req); err != nil {
+		return nil, err
+	}
+	for _, jrl := range req.ResourceLogs {
+		var rl resourceLogs
+		if rl.attributes, err = convertJSONKeyValues(jrl.Resource.Attributes); err != nil {
+			return nil, err
+		}
+		for _, jsl := range jrl.ScopeLogs {
+			sl := scopeLogs{name: jsl.Scope.Name, version: jsl.Scope.Version}
+			if sl.attributes, err = convertJSONKeyValues(jsl.Scope.Attributes); err != nil {
+				return nil, err
+			}
+			for _, jrec := range jsl.LogRecords {
+				rec, err := jrec.convert()
+				if err != nil {
+					return nil, err
+				}
+				sl.records = append(sl.records, rec)
+			}
+			rl.scopes = append(rl.scopes, sl)
+		}
+		logs = append(logs, rl)
+	}
+	return
+}
+
+func (jrec *jsonLogRecord) convert() (rec logRecord, err error) {
+	if rec.timeUnixNano, err = jrec.TimeUnixNano.uint64(); err != nil {
+		return rec, fmt.Errorf("invalid timeUnixNano: %s", err)
+	}
+	if rec.observedTimeUnixNano, err = jrec.ObservedTimeUnixNano.uint64(); err != nil {
+		return rec, fmt.Errorf("invalid observedTimeUnixNano: %s", err)
+	}
+	severity, err := jrec.SeverityNumber.int64()
+	if err != nil {
+		return rec, fmt.Errorf("invalid severityNumber: %s", err)
+	}
+	rec.severityNumber = int32(severity)
+	rec.severityText = jrec.SeverityText
+	rec.eventName = jrec.EventName
+	if rec.body, err = jrec.Body.convert(); err != nil {
+		return
+	}
+	if rec.attributes, err = convertJSONKeyValues(jrec.Attributes); err != nil {
+		return
+	}
+	if rec.traceId, err = hex.DecodeString(jrec.TraceId); err != nil {
+		return rec, fmt.Errorf("invalid traceId: %s", err)
+	}
+	if rec.spanId, err = hex.DecodeString(jrec.SpanId); err != nil {
+		return rec, fmt.Errorf("invalid spanId: %s", err)
+	}
+	return
+}
+
+func convertJSONKeyValues(jkvs []jsonKeyValue) (kvs []keyValue, err error) {
+	for _, jkv := range jkvs {
+		kv := keyValue{key: jkv.Key}
+		if kv.value, err = jkv.Value.convert(); err != nil {
+			return nil, fmt.Errorf("invalid value of '%s': %s", jkv.Key, err)
+		}
+		kvs = append(kvs, kv)
+	}
+	return
+}
+
+func (jv *jsonAnyValue) convert() (v *anyValue, err error) {
+	if jv == nil {
+		return nil, nil
+	}
+	v = new(anyValue)
+	switch {
+	case jv.StringValue != nil:
+		v.kind, v.str = kindString, *jv.StringValue
+	case jv.BoolValue != nil:
+		v.kind, v.bool = kindBool, *jv.BoolValue
+	case jv.IntValue != "":
+		v.kind = kindInt
+		v.int, err = jv.IntValue.int64()
+	case jv.DoubleValue != "":
+		v.kind = kindDouble
+		v.double, err = strconv.ParseFloat(string(jv.DoubleValue), 64)
+	case jv.BytesValue != nil:
+		v.kind, v.bytes = kindBytes, jv.BytesValue
+	case jv.ArrayValue != nil:
+		v.kind = kindArray
+		for _, jvalue := range jv.ArrayValue.Values {
+			value, err := jvalue.convert()
+			if err != nil {
+				return nil, err
+			}
+			v.array = append(v.array, value)
+		}
+	case jv.KvlistValue != nil:
+		v.kind = kindKvlist
+		v.kvlist, err = convertJSONKeyValues(jv.KvlistValue.Values)
+	}
+	return
+}
@@ -0,0 +1,196 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package otlp
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"github.com/mozilla-services/heka/message"
+	"github.com/mozilla-services/heka/pipeline"
+	"github.com/mozilla-services/heka/pipelinemock"
+	"github.com/rafrombrc/gomock/gomock"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func appendFixed64Field(b []byte, field int, v uint64) []byte {
+	b = appendVarint(b, uint64(field)<<3|wireFixed64)
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], v)
+	return append(b, buf[:]...)
+}
+
+func stringValue(s string) []byte {
+	return appendBytesField(nil, 1, []byte(s))
+}
+
+func keyValueBytes(key string, value []byte) []byte {
+	return appendBytesField(appendBytesField(nil, 1, []byte(key)), 2, value)
+}
+
+// Encodes an export request holding a single record.
+func encodedRequest() []byte {
+	resource := appendBytesField(nil, 1, keyValueBytes("host.name", stringValue("web1")))
+	resource = appendBytesField(resource, 1, keyValueBytes("process.pid",
+		appendVarintField(nil, 3, 42)))
+	scope := appendBytesField(nil, 1, []byte("checkout"))
+	scope = appendBytesField(scope, 2, []byte("1.2.0"))
+
+	array := appendBytesField(nil, 1, appendVarintField(nil, 3, 1))
+	array = appendBytesField(array, 1, appendVarintField(nil, 3, 2))
+	record := appendFixed64Field(nil, 1, 1420070400123456789)
+	record = appendVarintField(record, 2, 17) // ERROR
+	record = appendBytesField(record, 3, []byte("Error"))
+	record = appendBytesField(record, 5, stringValue("payment failed"))
+	record = appendBytesField(record, 6, keyValueBytes("amount",
+		appendFixed64Field(nil, 4, math.Float64bits(9.5))))
+	record = appendBytesField(record, 6, keyValueBytes("items",
+		appendBytesField(nil, 5, array)))
+	record = appendBytesField(record, 9, []byte{0xab, 0xcd})
+
+	scopeLogs := appendBytesField(nil, 1, scope)
+	scopeLogs = appendBytesField(scopeLogs, 2, record)
+	resourceLogs := appendBytesField(nil, 1, resource)
+	resourceLogs = appendBytesField(resourceLogs, 2, scopeLogs)
+	return appendBytesField(nil, 1, resourceLogs)
+}
+
+const jsonRequest = `{"resourceLogs": [{
+	"resource": {"attributes": [{"key": "host.name", "value": {"stringValue": "web1"}}]},
+	"scopeLogs": [{
+		"scope": {"name": "checkout"},
+		"logRecords": [{
+			"observedTimeUnixNano": "1420070400000000000",
+			"severityNumber": 9,
+			"body": {"kvlistValue": {"values": [{"key": "order", "value": {"intValue": "7"}}]}},
+			"attributes": [{"key": "user", "value": {"stringValue": "bob"}}],
+			"traceId": "abcd"
+		}]
+	}]
+}]}`
+
+func newInput(t *testing.T, ctrl *gomock.Controller) (*OTLPInput, *[]*message.Message) {
+	input := new(OTLPInput)
+	if err := input.Init(input.ConfigStruct()); err != nil {
+		t.Fatal(err)
+	}
+	input.hostname = "collector"
+	ir := pipelinemock.NewMockInputRunner(ctrl)
+	packs := make(chan *pipeline.PipelinePack, 1)
+	packs <- pipeline.NewPipelinePack(packs)
+	var delivered []*message.Message
+	ir.EXPECT().InChan().Return(packs).AnyTimes()
+	ir.EXPECT().Name().Return("otlp").AnyTimes()
+	ir.EXPECT().Deliver(gomock.Any()).Do(func(pack *pipeline.PipelinePack) {
+		delivered = append(delivered, message.CopyMessage(pack.Message))
+		pack.Recycle()
+	}).AnyTimes()
+	input.ir = ir
+	return input, &delivered
+}
+
+func TestUnmarshalProtobuf(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	input, delivered := newInput(t, ctrl)
+
+	logs, err := unmarshalLogsRequest(encodedRequest())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = input.export(logs); err != nil {
+		t.Fatal(err)
+	}
+	if len(*delivered) != 1 {
+		t.Fatalf("Unexpected messages: %v", *delivered)
+	}
+	msg := (*delivered)[0]
+	if msg.GetTimestamp() != 1420070400123456789 || msg.GetSeverity() != 3 ||
+		msg.GetPayload() != "payment failed" || msg.GetLogger() != "checkout" ||
+		msg.GetHostname() != "web1" || msg.GetPid() != 42 {
+		t.Errorf("Unexpected message: %v", msg)
+	}
+	expected := map[string]interface{}{
+		"SeverityText":       "Error",
+		"TraceId":            "abcd",
+		"ScopeVersion":       "1.2.0",
+		"amount":             9.5,
+		"items":              int64(1),
+		"resource.host.name": "web1",
+	}
+	for name, value := range expected {
+		if v, _ := msg.GetFieldValue(name); v != value {
+			t.Errorf("Unexpected %s: %v", name, v)
+		}
+	}
+	if len(msg.FindFirstField("items").GetValueInteger()) != 2 {
+		t.Error("Expected both array items")
+	}
+
+	if _, err = unmarshalLogsRequest(encodedRequest()[:20]); err == nil {
+		t.Error("Expected an error for a truncated request")
+	}
+}
+
+func TestHttpExport(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	input, delivered := newInput(t, ctrl)
+	server := httptest.NewServer(http.HandlerFunc(input.handleHttp))
+	defer server.Close()
+
+	var gzipped bytes.Buffer
+	gz := gzip.NewWriter(&gzipped)
+	gz.Write([]byte(jsonRequest))
+	gz.Close()
+	req, _ := http.NewRequest("POST", server.URL+logsPath, &gzipped)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Encoding", "gzip")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || len(*delivered) != 1 {
+		t.Fatalf("Unexpected response: %s, %d messages", resp.Status, len(*delivered))
+	}
+	msg := (*delivered)[0]
+	if msg.GetTimestamp() != 1420070400000000000 || msg.GetSeverity() != 6 ||
+		msg.GetPayload() != `{"order":7}` || msg.GetHostname() != "web1" {
+		t.Errorf("Unexpected message: %v", msg)
+	}
+	if v, _ := msg.GetFieldValue("user"); v != "bob" {
+		t.Errorf("Unexpected user: %v", v)
+	}
+
+	resp, err = http.Post(server.URL+logsPath, "application/json",
+		strings.NewReader(`{"resourceLogs": {}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest || input.requestsRejected != 1 {
+		t.Errorf("Unexpected response: %s", resp.Status)
+	}
+	resp, err = http.Post(server.URL+logsPath, "text/plain", strings.NewReader("hi"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnsupportedMediaType {
+		t.Errorf("Unexpected response: %s", resp.Status)
+	}
+}
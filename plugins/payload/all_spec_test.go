@@ -23,8 +23,12 @@ func TestAllSpecs(t *testing.T) {
 	r := gospec.NewRunner()
 	r.Parallel = false
 
+	r.AddSpec(CsvDecoderSpec)
+	r.AddSpec(GrokDecoderSpec)
+	r.AddSpec(JsonDecoderSpec)
 	r.AddSpec(MultiDecoderSpec)
 	r.AddSpec(PayloadDecodersSpec)
+	r.AddSpec(RegexDecoderSpec)
 
 	gospec.MainGoTest(r, t)
 }
@@ -0,0 +1,204 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package payload
+
+import (
+	"encoding/csv"
+	"fmt"
+	. "github.com/mozilla-services/heka/pipeline"
+	"io"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+type CsvDecoderConfig struct {
+	// Names of the fields set by the record's columns, in order. Columns
+	// named "" aren't decoded. Required unless `header_row` is set.
+	Columns []string
+
+	// Whether the first record is a header, naming the columns unless
+	// `columns` is set. It, and any later record identical to it, e.g. the
+	// header of the next file read, aren't decoded into messages.
+	HeaderRow bool `toml:"header_row"`
+
+	// Column delimiter, a single character. Defaults to ",", use "\t" for
+	// TSV.
+	Delimiter string
+
+	// Character starting comment lines, which are skipped. Defaults to none.
+	Comment string
+
+	// Whether quotes may appear in unquoted values, and unescaped quotes in
+	// quoted ones. Defaults to false.
+	LazyQuotes bool `toml:"lazy_quotes"`
+
+	// Whether the leading white space of values is trimmed. Defaults to
+	// false.
+	TrimLeadingSpace bool `toml:"trim_leading_space"`
+
+	// Types the values of columns are converted to, keyed by column name, as
+	// for the RegexDecoder's `field_types`. Defaults to "string".
+	FieldTypes map[string]string `toml:"field_types"`
+
+	// Layout the Timestamp column and the columns of the "timestamp" type
+	// are parsed with.
+	TimestampLayout string `toml:"timestamp_layout"`
+
+	// Time zone in which the timestamps in the text are presumed to be in.
+	// Defaults to "UTC".
+	TimestampLocation string `toml:"timestamp_location"`
+
+	// Maps severity strings to their int version
+	SeverityMap map[string]int32 `toml:"severity_map"`
+
+	// Keyed to the message field that should be filled in, the value will be
+	// interpolated so it can use the record's values.
+	MessageFields MessageTemplate `toml:"message_fields"`
+}
+
+// Decodes payloads holding a CSV (or TSV) record, setting the message's
+// headers and fields from the values of its columns.
+type CsvDecoder struct {
+	conf *CsvDecoderConfig
+	// Sets the headers and fields from the values, like a RegexDecoder
+	// pattern does from its captures.
+	decoder *RegexDecoder
+	mapping *regexPattern
+	comma   rune
+	comment rune
+	header  []string
+}
+
+func (cd *CsvDecoder) ConfigStruct() interface{} {
+	return &CsvDecoderConfig{
+		Delimiter: ",",
+	}
+}
+
+func (cd *CsvDecoder) Init(config interface{}) (err error) {
+	conf := config.(*CsvDecoderConfig)
+	if cd.comma, err = csvRune("delimiter", conf.Delimiter); err != nil {
+		return
+	}
+	if cd.comma == 0 || cd.comma == '"' || cd.comma == '\r' || cd.comma == '\n' {
+		return fmt.Errorf("CsvDecoder invalid delimiter: %q", conf.Delimiter)
+	}
+	if cd.comment, err = csvRune("comment", conf.Comment); err != nil {
+		return
+	}
+	if len(conf.Columns) == 0 && !conf.HeaderRow {
+		return fmt.Errorf("CsvDecoder requires `columns` or `header_row`")
+	}
+
+	cd.conf = conf
+	cd.header = nil
+	cd.decoder = &RegexDecoder{severityMap: conf.SeverityMap}
+	if cd.decoder.tzLocation, err = time.LoadLocation(conf.TimestampLocation); err != nil {
+		return fmt.Errorf("CsvDecoder unknown timestamp_location '%s': %s",
+			conf.TimestampLocation, err)
+	}
+	cd.mapping = &regexPattern{
+		types:           make(map[string]captureType),
+		timestampLayout: conf.TimestampLayout,
+		messageFields:   conf.MessageFields,
+	}
+	for name, typ := range conf.FieldTypes {
+		if cd.mapping.types[name], err = parseCaptureType(typ, conf.TimestampLayout); err != nil {
+			return fmt.Errorf("CsvDecoder column '%s': %s", name, err)
+		}
+	}
+	if len(conf.Columns) > 0 {
+		cd.mapping.names = conf.Columns
+	}
+	return
+}
+
+// Returns the single character of a setting, or 0 if it's empty.
+func csvRune(setting, value string) (r rune, err error) {
+	if value == "" {
+		return 0, nil
+	}
+	if utf8.RuneCountInString(value) != 1 {
+		return 0, fmt.Errorf("CsvDecoder %s must be a single character: '%s'",
+			setting, value)
+	}
+	r, _ = utf8.DecodeRuneInString(value)
+	return
+}
+
+// Heka will call this to give us access to the runner.
+func (cd *CsvDecoder) SetDecoderRunner(dr DecoderRunner) {
+	cd.decoder.SetDecoderRunner(dr)
+}
+
+func (cd *CsvDecoder) Decode(pack *PipelinePack) (packs []*PipelinePack, err error) {
+	reader := csv.NewReader(strings.NewReader(pack.Message.GetPayload()))
+	reader.Comma = cd.comma
+	reader.Comment = cd.comment
+	reader.LazyQuotes = cd.conf.LazyQuotes
+	reader.TrimLeadingSpace = cd.conf.TrimLeadingSpace
+	reader.FieldsPerRecord = -1
+	record, err := reader.Read()
+	if err == io.EOF {
+		// Blank or comment line.
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid CSV record: %s", err)
+	}
+	if _, err = reader.Read(); err != io.EOF {
+		return nil, fmt.Errorf("payload holds more than one CSV record")
+	}
+
+	if cd.conf.HeaderRow {
+		if cd.header == nil {
+			cd.header = record
+			if cd.mapping.names == nil {
+				cd.mapping.names = record
+			}
+			return nil, nil
+		}
+		if csvRecordsEqual(record, cd.header) {
+			return nil, nil
+		}
+	}
+	if len(record) > len(cd.mapping.names) {
+		return nil, fmt.Errorf("record has %d values, more than the %d columns",
+			len(record), len(cd.mapping.names))
+	}
+	// Missing trailing values are empty, i.e. not set.
+	values := make([]string, len(cd.mapping.names))
+	copy(values, record)
+	if err = cd.decoder.apply(cd.mapping, pack, values); err != nil {
+		return
+	}
+	return []*PipelinePack{pack}, nil
+}
+
+func csvRecordsEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func init() {
+	RegisterPlugin("CsvDecoder", func() interface{} {
+		return new(CsvDecoder)
+	})
+}
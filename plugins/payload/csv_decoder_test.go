@@ -0,0 +1,129 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package payload
+
+import (
+	. "github.com/mozilla-services/heka/pipeline"
+	pipeline_ts "github.com/mozilla-services/heka/pipeline/testsupport"
+	"github.com/mozilla-services/heka/pipelinemock"
+	"github.com/rafrombrc/gomock/gomock"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+)
+
+func CsvDecoderSpec(c gs.Context) {
+	t := &pipeline_ts.SimpleT{}
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	c.Specify("A CsvDecoder", func() {
+		decoder := new(CsvDecoder)
+		conf := decoder.ConfigStruct().(*CsvDecoderConfig)
+		dRunner := pipelinemock.NewMockDecoderRunner(ctrl)
+		supply := make(chan *PipelinePack, 1)
+		pack := NewPipelinePack(supply)
+
+		decode := func(payload string) ([]*PipelinePack, error) {
+			pack.Message.SetPayload(payload)
+			return decoder.Decode(pack)
+		}
+
+		c.Specify("sets headers and typed fields from the columns", func() {
+			conf.Columns = []string{"Timestamp", "Severity", "", "status", "duration", "agent"}
+			conf.TimestampLayout = "2006-01-02 15:04:05"
+			conf.SeverityMap = map[string]int32{"warn": 4}
+			conf.FieldTypes = map[string]string{"status": "int", "duration": "float"}
+			conf.MessageFields = MessageTemplate{"Type": "access.%status%"}
+			c.Assume(decoder.Init(conf), gs.IsNil)
+			decoder.SetDecoderRunner(dRunner)
+			packs, err := decode(`2013-04-18 21:00:28,warn,skipped,503,0.25,"Mozilla ""5.0"", X11"`)
+			c.Expect(err, gs.IsNil)
+			c.Expect(len(packs), gs.Equals, 1)
+
+			msg := pack.Message
+			c.Expect(msg.GetTimestamp(), gs.Equals, int64(1366318828000000000))
+			c.Expect(msg.GetSeverity(), gs.Equals, int32(4))
+			c.Expect(msg.GetType(), gs.Equals, "access.503")
+			status, _ := msg.GetFieldValue("status")
+			c.Expect(status, gs.Equals, int64(503))
+			duration, _ := msg.GetFieldValue("duration")
+			c.Expect(duration, gs.Equals, 0.25)
+			agent, _ := msg.GetFieldValue("agent")
+			c.Expect(agent, gs.Equals, `Mozilla "5.0", X11`)
+			c.Expect(len(msg.Fields), gs.Equals, 3)
+		})
+
+		c.Specify("leaves missing values unset", func() {
+			conf.Columns = []string{"a", "b", "c"}
+			c.Assume(decoder.Init(conf), gs.IsNil)
+			decoder.SetDecoderRunner(dRunner)
+			_, err := decode("1,,")
+			c.Expect(err, gs.IsNil)
+			c.Expect(len(pack.Message.Fields), gs.Equals, 1)
+			pack.Message.Fields = nil
+			_, err = decode("1")
+			c.Expect(err, gs.IsNil)
+			c.Expect(len(pack.Message.Fields), gs.Equals, 1)
+
+			_, err = decode("1,2,3,4")
+			c.Expect(err.Error(), gs.Equals, "record has 4 values, more than the 3 columns")
+		})
+
+		c.Specify("names the columns after the header row", func() {
+			conf.HeaderRow = true
+			conf.Delimiter = "\t"
+			conf.Comment = "#"
+			c.Assume(decoder.Init(conf), gs.IsNil)
+			decoder.SetDecoderRunner(dRunner)
+			packs, err := decode("# exported\n")
+			c.Expect(err, gs.IsNil)
+			c.Expect(packs, gs.IsNil)
+			packs, err = decode("host\tpath")
+			c.Expect(err, gs.IsNil)
+			c.Expect(packs, gs.IsNil)
+
+			packs, err = decode("web1\t/index.html")
+			c.Expect(err, gs.IsNil)
+			c.Expect(len(packs), gs.Equals, 1)
+			host, _ := pack.Message.GetFieldValue("host")
+			c.Expect(host, gs.Equals, "web1")
+			path, _ := pack.Message.GetFieldValue("path")
+			c.Expect(path, gs.Equals, "/index.html")
+
+			packs, err = decode("host\tpath")
+			c.Expect(err, gs.IsNil)
+			c.Expect(packs, gs.IsNil)
+		})
+
+		c.Specify("fails on invalid records", func() {
+			conf.Columns = []string{"a", "b"}
+			conf.FieldTypes = map[string]string{"b": "int"}
+			c.Assume(decoder.Init(conf), gs.IsNil)
+			decoder.SetDecoderRunner(dRunner)
+			_, err := decode(`1,"2`)
+			c.Expect(err, gs.Not(gs.IsNil))
+			_, err = decode("1,2\n3,4")
+			c.Expect(err.Error(), gs.Equals, "payload holds more than one CSV record")
+			_, err = decode("1,two")
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+
+		c.Specify("fails on invalid settings", func() {
+			c.Expect(decoder.Init(conf), gs.Not(gs.IsNil))
+			conf.Columns = []string{"a"}
+			conf.Delimiter = ";;"
+			c.Expect(decoder.Init(conf), gs.Not(gs.IsNil))
+			conf.Delimiter = ","
+			conf.FieldTypes = map[string]string{"a": "duration"}
+			c.Expect(decoder.Init(conf), gs.Not(gs.IsNil))
+		})
+	})
+}
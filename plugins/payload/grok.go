@@ -0,0 +1,259 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package payload
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// A reference to a grok pattern, e.g. %{NUMBER:bytes:int}, with the name of
+// the field its match sets and the field's type being optional.
+var grokReference = regexp.MustCompile(`%\{(\w+)(?::([^:}]+))?(?::(\w+))?\}`)
+
+var grokPatternName = regexp.MustCompile(`^\w+$`)
+
+// Grok pattern definitions, keyed by name.
+type grokLibrary map[string]grokDefinition
+
+type grokDefinition struct {
+	expr     string
+	standard bool
+	// Why RE2 can't compile the definition, if it can't.
+	err error
+}
+
+func newGrokLibrary() grokLibrary {
+	lib := make(grokLibrary)
+	lib.load(strings.NewReader(grokStandardPatterns), true)
+	return lib
+}
+
+// Adds a pattern definition. Definitions RE2 can't compile don't replace
+// the standard ones, so that Logstash's own pattern files can be loaded as
+// is, and only fail expressions that use them.
+func (lib grokLibrary) add(name, expr string, standard bool) error {
+	if !grokPatternName.MatchString(name) {
+		return fmt.Errorf("invalid grok pattern name '%s'", name)
+	}
+	translated, err := grokToRE2(expr)
+	if err != nil {
+		if lib[name].standard {
+			return nil
+		}
+		translated = expr
+	}
+	lib[name] = grokDefinition{expr: translated, standard: standard, err: err}
+	return nil
+}
+
+// Loads pattern definitions, one "NAME expression" per line, ignoring blank
+// lines and those starting with '#'. Lines can be of any length, as some
+// patterns are longer than bufio.Scanner's default limit.
+func (lib grokLibrary) load(r io.Reader, standard bool) (err error) {
+	reader := bufio.NewReader(r)
+	for line := 1; err != io.EOF; line++ {
+		var text string
+		if text, err = reader.ReadString('\n'); err != nil && err != io.EOF {
+			return
+		}
+		text = strings.TrimSpace(text)
+		if text == "" || text[0] == '#' {
+			continue
+		}
+		fields := strings.SplitN(text, " ", 2)
+		if len(fields) != 2 {
+			return fmt.Errorf("line %d: missing grok pattern expression", line)
+		}
+		if err := lib.add(fields[0], strings.TrimSpace(fields[1]), standard); err != nil {
+			return fmt.Errorf("line %d: %s", line, err)
+		}
+	}
+	return nil
+}
+
+// Loads a pattern file, or every file in a pattern directory.
+func (lib grokLibrary) loadPath(path string) (err error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return
+	}
+	paths := []string{path}
+	if info.IsDir() {
+		var infos []os.FileInfo
+		if infos, err = ioutil.ReadDir(path); err != nil {
+			return
+		}
+		paths = paths[:0]
+		for _, info := range infos {
+			if !info.IsDir() {
+				paths = append(paths, filepath.Join(path, info.Name()))
+			}
+		}
+	}
+	for _, path := range paths {
+		var file *os.File
+		if file, err = os.Open(path); err != nil {
+			return
+		}
+		err = lib.load(file, false)
+		file.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %s", path, err)
+		}
+	}
+	return
+}
+
+// A grok expression compiled to an RE2 regular expression.
+type grokExpression struct {
+	regex string
+	// Field names and types keyed by the names of the capture groups.
+	fields map[string]grokField
+}
+
+type grokField struct {
+	name string
+	typ  string
+}
+
+// Compiles a grok expression to an RE2 regular expression, expanding its
+// pattern references recursively. References naming a field, and named
+// groups, are capture groups, the others aren't.
+func (lib grokLibrary) compile(expr string) (compiled *grokExpression, err error) {
+	compiled = &grokExpression{fields: make(map[string]grokField)}
+	if expr, err = grokToRE2(expr); err != nil {
+		return nil, err
+	}
+	if compiled.regex, err = lib.expand(compiled, expr, nil); err != nil {
+		return nil, err
+	}
+	return
+}
+
+func (lib grokLibrary) expand(compiled *grokExpression, expr string,
+	stack []string) (expanded string, err error) {
+
+	expanded = grokReference.ReplaceAllStringFunc(expr, func(ref string) string {
+		if err != nil {
+			return ""
+		}
+		parts := grokReference.FindStringSubmatch(ref)
+		name, field, typ := parts[1], parts[2], parts[3]
+		def, ok := lib[name]
+		if !ok {
+			err = fmt.Errorf("unknown grok pattern '%s'", name)
+			return ""
+		}
+		if def.err != nil {
+			err = fmt.Errorf("grok pattern '%s': %s", name, def.err)
+			return ""
+		}
+		for _, outer := range stack {
+			if outer == name {
+				err = fmt.Errorf("grok pattern '%s' references itself", name)
+				return ""
+			}
+		}
+		var sub string
+		if sub, err = lib.expand(compiled, def.expr, append(stack, name)); err != nil {
+			return ""
+		}
+		if field == "" {
+			return "(?:" + sub + ")"
+		}
+		group := fmt.Sprintf("grok%d", len(compiled.fields))
+		compiled.fields[group] = grokField{name: grokFieldName(field), typ: typ}
+		return "(?P<" + group + ">" + sub + ")"
+	})
+	return
+}
+
+// Returns the name of a field in Logstash's nested field syntax, e.g.
+// "[http][status]", as a dotted name, e.g. "http.status".
+func grokFieldName(field string) string {
+	if !strings.HasPrefix(field, "[") || !strings.HasSuffix(field, "]") {
+		return field
+	}
+	return strings.Replace(field[1:len(field)-1], "][", ".", -1)
+}
+
+// Rewrites the Oniguruma constructs Logstash patterns use into their RE2
+// equivalents: named groups written (?<name>...) become (?P<name>...), and
+// atomic groups and possessive quantifiers become their plain counterparts.
+// Lookaround assertions, which RE2 doesn't support, are errors.
+func grokToRE2(expr string) (string, error) {
+	var b bytes.Buffer
+	inClass, quantified := false, false
+	for i := 0; i < len(expr); i++ {
+		ch := expr[i]
+		rest := expr[i:]
+		switch {
+		case ch == '\\':
+			b.WriteByte(ch)
+			if i+1 < len(expr) {
+				i++
+				b.WriteByte(expr[i])
+			}
+			quantified = false
+			continue
+		case inClass:
+			inClass = ch != ']'
+		case ch == '[':
+			inClass = true
+			b.WriteByte(ch)
+			// A ']' first in a class is a literal.
+			if strings.HasPrefix(expr[i+1:], "^") {
+				i++
+				b.WriteByte('^')
+			}
+			if strings.HasPrefix(expr[i+1:], "]") {
+				i++
+				b.WriteByte(']')
+			}
+			quantified = false
+			continue
+		case strings.HasPrefix(rest, "(?="), strings.HasPrefix(rest, "(?!"),
+			strings.HasPrefix(rest, "(?<="), strings.HasPrefix(rest, "(?<!"):
+			return "", fmt.Errorf("lookaround assertion at offset %d isn't supported by RE2", i)
+		case strings.HasPrefix(rest, "(?<"):
+			b.WriteString("(?P<")
+			i += 2
+			quantified = false
+			continue
+		case strings.HasPrefix(rest, "(?>"):
+			b.WriteString("(?:")
+			i += 2
+			quantified = false
+			continue
+		case strings.HasPrefix(rest, "(?"):
+			b.WriteString("(?")
+			i++
+			quantified = false
+			continue
+		case ch == '+' && quantified:
+			// Possessive quantifier.
+			quantified = false
+			continue
+		}
+		b.WriteByte(ch)
+		quantified = !inClass && (ch == '*' || ch == '+' || ch == '?') && !quantified
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,190 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package payload
+
+import (
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+	. "github.com/mozilla-services/heka/pipeline"
+	"sort"
+	"time"
+)
+
+type GrokDecoderConfig struct {
+	// Grok expressions the payload is matched against, tried in turn, e.g.
+	// "%{COMBINEDAPACHELOG}".
+	Match []string
+
+	// Whether decoding stops at the first expression that matches. Defaults
+	// to true.
+	BreakOnMatch bool `toml:"break_on_match"`
+
+	// Pattern files, or directories of pattern files, loaded in addition to
+	// the standard patterns. Relative paths are relative to the share_dir.
+	PatternFiles []string `toml:"pattern_files"`
+
+	// Additional patterns keyed by name.
+	PatternDefinitions map[string]string `toml:"pattern_definitions"`
+
+	// Layout the Timestamp field is parsed with.
+	TimestampLayout string `toml:"timestamp_layout"`
+
+	// Time zone in which the timestamps in the text are presumed to be in.
+	// Defaults to "UTC".
+	TimestampLocation string `toml:"timestamp_location"`
+
+	// Maps severity strings to their int version
+	SeverityMap map[string]int32 `toml:"severity_map"`
+
+	// Keyed to the message field that should be filled in, the value will be
+	// interpolated so it can use the fields the expressions set.
+	MessageFields MessageTemplate `toml:"message_fields"`
+
+	// Whether payloads that match no expression should be logged.
+	LogErrors bool `toml:"log_errors"`
+
+	// Maximum payload length in bytes to match, longer payloads fail to
+	// decode. Defaults to 0, i.e. no limit.
+	MaxMatchLength int `toml:"max_match_length"`
+
+	// Milliseconds each match may take before the payload fails to decode.
+	// Defaults to 0, i.e. no limit.
+	MatchTimeBudget uint `toml:"match_time_budget"`
+
+	// Maximum number of instructions each expression may compile to,
+	// bounding the memory each match uses. Defaults to 0, i.e. no limit.
+	MaxRegexSize int `toml:"max_regex_size"`
+}
+
+// Decodes payloads with grok expressions, compiled to RE2 regexes, so that
+// Logstash grok configurations can be used as is.
+type GrokDecoder struct {
+	decoder *RegexDecoder
+	pConfig *PipelineConfig
+}
+
+// Heka will call this before calling any other methods to give us access to
+// the pipeline configuration.
+func (gd *GrokDecoder) SetPipelineConfig(pConfig *PipelineConfig) {
+	gd.pConfig = pConfig
+}
+
+func (gd *GrokDecoder) ConfigStruct() interface{} {
+	return &GrokDecoderConfig{
+		BreakOnMatch: true,
+		LogErrors:    true,
+	}
+}
+
+func (gd *GrokDecoder) Init(config interface{}) (err error) {
+	conf := config.(*GrokDecoderConfig)
+	if len(conf.Match) == 0 {
+		return fmt.Errorf("GrokDecoder requires at least one `match` expression")
+	}
+
+	lib := newGrokLibrary()
+	for _, path := range conf.PatternFiles {
+		if err = lib.loadPath(gd.pConfig.Globals.PrependShareDir(path)); err != nil {
+			return fmt.Errorf("GrokDecoder can't load patterns: %s", err)
+		}
+	}
+	names := make([]string, 0, len(conf.PatternDefinitions))
+	for name := range conf.PatternDefinitions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err = lib.add(name, conf.PatternDefinitions[name], false); err != nil {
+			return fmt.Errorf("GrokDecoder: %s", err)
+		}
+	}
+
+	limits := RegexpLimits{
+		MaxMatchLength:  conf.MaxMatchLength,
+		MatchTimeBudget: time.Duration(conf.MatchTimeBudget) * time.Millisecond,
+		MaxProgramSize:  conf.MaxRegexSize,
+	}
+	decoder := &RegexDecoder{
+		patterns:    make([]*regexPattern, len(conf.Match)),
+		severityMap: conf.SeverityMap,
+		logErrors:   conf.LogErrors,
+	}
+	for i, expr := range conf.Match {
+		if decoder.patterns[i], err = newGrokPattern(lib, expr, limits, conf); err != nil {
+			return fmt.Errorf("GrokDecoder expression '%s': %s", expr, err)
+		}
+	}
+	if decoder.tzLocation, err = time.LoadLocation(conf.TimestampLocation); err != nil {
+		return fmt.Errorf("GrokDecoder unknown timestamp_location '%s': %s",
+			conf.TimestampLocation, err)
+	}
+	gd.decoder = decoder
+	return
+}
+
+// Compiles a grok expression to a RegexDecoder pattern, its capture groups
+// setting the fields the expression names.
+func newGrokPattern(lib grokLibrary, expr string, limits RegexpLimits,
+	conf *GrokDecoderConfig) (pattern *regexPattern, err error) {
+
+	compiled, err := lib.compile(expr)
+	if err != nil {
+		return
+	}
+	pattern = &regexPattern{
+		types:           make(map[string]captureType),
+		timestampLayout: conf.TimestampLayout,
+		messageFields:   conf.MessageFields,
+		fallsThrough:    !conf.BreakOnMatch,
+	}
+	if pattern.bounded, err = CompileBoundedRegexp(compiled.regex, limits); err != nil {
+		return nil, err
+	}
+	pattern.names = append([]string(nil), pattern.bounded.SubexpNames()...)
+	for i, group := range pattern.names {
+		field, ok := compiled.fields[group]
+		if !ok {
+			// Groups named in the expression itself set the field they're
+			// named after.
+			continue
+		}
+		pattern.names[i] = field.name
+		if field.typ == "" {
+			continue
+		}
+		ct, err := parseCaptureType(field.typ, conf.TimestampLayout)
+		if err != nil {
+			return nil, fmt.Errorf("field '%s': %s", field.name, err)
+		}
+		pattern.types[field.name] = ct
+	}
+	return
+}
+
+// Heka will call this to give us access to the runner.
+func (gd *GrokDecoder) SetDecoderRunner(dr DecoderRunner) {
+	gd.decoder.SetDecoderRunner(dr)
+}
+
+func (gd *GrokDecoder) Decode(pack *PipelinePack) (packs []*PipelinePack, err error) {
+	return gd.decoder.Decode(pack)
+}
+
+func (gd *GrokDecoder) ReportMsg(msg *message.Message) error {
+	return gd.decoder.ReportMsg(msg)
+}
+
+func init() {
+	RegisterPlugin("GrokDecoder", func() interface{} {
+		return new(GrokDecoder)
+	})
+}
@@ -0,0 +1,178 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package payload
+
+import (
+	. "github.com/mozilla-services/heka/pipeline"
+	pipeline_ts "github.com/mozilla-services/heka/pipeline/testsupport"
+	"github.com/mozilla-services/heka/pipelinemock"
+	"github.com/rafrombrc/gomock/gomock"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+func GrokDecoderSpec(c gs.Context) {
+	t := &pipeline_ts.SimpleT{}
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	c.Specify("A grok expression", func() {
+		lib := newGrokLibrary()
+
+		c.Specify("translates Oniguruma constructs", func() {
+			re, err := grokToRE2(`(?<name>a++)(?>b*+)[+(?<]c?+`)
+			c.Expect(err, gs.IsNil)
+			c.Expect(re, gs.Equals, `(?P<name>a+)(?:b*)[+(?<]c?`)
+			re, err = grokToRE2(`\++a+?`)
+			c.Expect(err, gs.IsNil)
+			c.Expect(re, gs.Equals, `\++a+?`)
+			_, err = grokToRE2(`(?<![0-9])\d+`)
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+
+		c.Specify("captures the named references only", func() {
+			compiled, err := lib.compile(`%{IP:[client][ip]} %{WORD} %{NUMBER:bytes:int}`)
+			c.Expect(err, gs.IsNil)
+			c.Expect(len(compiled.fields), gs.Equals, 2)
+			fields := make(map[string]string)
+			for _, field := range compiled.fields {
+				fields[field.name] = field.typ
+			}
+			c.Expect(fields["client.ip"], gs.Equals, "")
+			c.Expect(fields["bytes"], gs.Equals, "int")
+		})
+
+		c.Specify("fails on unknown and recursive patterns", func() {
+			_, err := lib.compile(`%{NOPE:x}`)
+			c.Expect(err, gs.Not(gs.IsNil))
+			lib.add("LOOP", "a%{LOOP}", false)
+			_, err = lib.compile(`%{LOOP}`)
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+
+		c.Specify("keeps standard patterns RE2 can't compile", func() {
+			c.Expect(lib.add("INT", `(?<![0-9])\d+`, false), gs.IsNil)
+			c.Expect(lib["INT"].standard, gs.IsTrue)
+			c.Expect(lib.add("MYINT", `(?<![0-9])\d+`, false), gs.IsNil)
+			_, err := lib.compile(`%{MYINT:n}`)
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+	})
+
+	c.Specify("A GrokDecoder", func() {
+		decoder := new(GrokDecoder)
+		decoder.SetPipelineConfig(NewPipelineConfig(nil))
+		conf := decoder.ConfigStruct().(*GrokDecoderConfig)
+		dRunner := pipelinemock.NewMockDecoderRunner(ctrl)
+		supply := make(chan *PipelinePack, 1)
+		pack := NewPipelinePack(supply)
+
+		c.Specify("decodes with the standard patterns", func() {
+			conf.Match = []string{`%{COMBINEDAPACHELOG}`}
+			c.Assume(decoder.Init(conf), gs.IsNil)
+			decoder.SetDecoderRunner(dRunner)
+			pack.Message.SetPayload(`127.0.0.1 - frank [10/Oct/2000:13:55:36 -0700] ` +
+				`"GET /apache_pb.gif HTTP/1.0" 200 2326 "http://www.example.com/start.html" ` +
+				`"Mozilla/4.08 [en] (Win98; I ;Nav)"`)
+			_, err := decoder.Decode(pack)
+			c.Expect(err, gs.IsNil)
+
+			msg := pack.Message
+			clientip, _ := msg.GetFieldValue("clientip")
+			c.Expect(clientip, gs.Equals, "127.0.0.1")
+			auth, _ := msg.GetFieldValue("auth")
+			c.Expect(auth, gs.Equals, "frank")
+			timestamp, _ := msg.GetFieldValue("timestamp")
+			c.Expect(timestamp, gs.Equals, "10/Oct/2000:13:55:36 -0700")
+			request, _ := msg.GetFieldValue("request")
+			c.Expect(request, gs.Equals, "/apache_pb.gif")
+			response, _ := msg.GetFieldValue("response")
+			c.Expect(response, gs.Equals, "200")
+			agent, _ := msg.GetFieldValue("agent")
+			c.Expect(agent, gs.Equals, `"Mozilla/4.08 [en] (Win98; I ;Nav)"`)
+			c.Expect(msg.FindFirstField("rawrequest"), gs.IsNil)
+		})
+
+		c.Specify("sets headers and typed fields", func() {
+			conf.Match = []string{`\[%{HTTPDATE:Timestamp}\] %{LOGLEVEL:Severity} ` +
+				`%{NUMBER:duration:float} %{INT:status:int} %{GREEDYDATA:Payload}`}
+			conf.TimestampLayout = "02/Jan/2006:15:04:05 -0700"
+			conf.SeverityMap = map[string]int32{"WARN": 4}
+			c.Assume(decoder.Init(conf), gs.IsNil)
+			decoder.SetDecoderRunner(dRunner)
+			pack.Message.SetPayload("[18/Apr/2013:14:00:28 -0700] WARN 0.25 503 upstream timed out")
+			_, err := decoder.Decode(pack)
+			c.Expect(err, gs.IsNil)
+
+			msg := pack.Message
+			c.Expect(msg.GetTimestamp(), gs.Equals, int64(1366318828000000000))
+			c.Expect(msg.GetSeverity(), gs.Equals, int32(4))
+			c.Expect(msg.GetPayload(), gs.Equals, "upstream timed out")
+			duration, _ := msg.GetFieldValue("duration")
+			c.Expect(duration, gs.Equals, 0.25)
+			status, _ := msg.GetFieldValue("status")
+			c.Expect(status, gs.Equals, int64(503))
+		})
+
+		c.Specify("loads custom patterns", func() {
+			dir, err := ioutil.TempDir("", "grokdecoder-test")
+			c.Assume(err, gs.IsNil)
+			defer os.RemoveAll(dir)
+			err = ioutil.WriteFile(filepath.Join(dir, "app"), []byte(
+				"# Application patterns\n"+
+					"REQID (?<![0-9a-f])[0-9a-f]{8}\n"+
+					"APPREQ req=%{REQID:req_id} user=%{USER:user}\n"), 0644)
+			c.Assume(err, gs.IsNil)
+			conf.PatternFiles = []string{dir}
+			conf.PatternDefinitions = map[string]string{"REQID": "[0-9a-f]{8}"}
+			conf.Match = []string{`%{APPREQ} (?<action>\w+)`}
+			c.Assume(decoder.Init(conf), gs.IsNil)
+			decoder.SetDecoderRunner(dRunner)
+			pack.Message.SetPayload("req=0a1b2c3d user=bob login")
+			_, err = decoder.Decode(pack)
+			c.Expect(err, gs.IsNil)
+
+			reqId, _ := pack.Message.GetFieldValue("req_id")
+			c.Expect(reqId, gs.Equals, "0a1b2c3d")
+			user, _ := pack.Message.GetFieldValue("user")
+			c.Expect(user, gs.Equals, "bob")
+			action, _ := pack.Message.GetFieldValue("action")
+			c.Expect(action, gs.Equals, "login")
+		})
+
+		c.Specify("tries the expressions in turn", func() {
+			conf.Match = []string{`^%{INT:code:int}$`, `^%{WORD:word}$`}
+			c.Assume(decoder.Init(conf), gs.IsNil)
+			decoder.SetDecoderRunner(dRunner)
+			pack.Message.SetPayload("hello")
+			_, err := decoder.Decode(pack)
+			c.Expect(err, gs.IsNil)
+			word, _ := pack.Message.GetFieldValue("word")
+			c.Expect(word, gs.Equals, "hello")
+
+			pack.Message.SetPayload("nothing matches this")
+			_, err = decoder.Decode(pack)
+			c.Expect(err.Error(), gs.Equals, "No match: nothing matches this")
+		})
+
+		c.Specify("fails on invalid expressions", func() {
+			conf.Match = []string{`%{NOTAPATTERN:x}`}
+			c.Expect(decoder.Init(conf), gs.Not(gs.IsNil))
+			conf.Match = []string{`%{INT:x:duration}`}
+			c.Expect(decoder.Init(conf), gs.Not(gs.IsNil))
+			conf.Match = nil
+			c.Expect(decoder.Init(conf), gs.Not(gs.IsNil))
+		})
+	})
+}
@@ -0,0 +1,360 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package payload
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+	. "github.com/mozilla-services/heka/pipeline"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type JsonDecoderConfig struct {
+	// JSONPath expressions selecting the values of the message's fields,
+	// keyed by field. Timestamp, Severity, Hostname, Logger, Type, Payload,
+	// Pid, and Uuid set the message's headers, other names set fields, and
+	// can be followed by "|" and the field's representation, e.g.
+	// "bytes|B". An expression selecting several values, with a wildcard,
+	// sets a field with several values.
+	FieldMap map[string]string `toml:"field_map"`
+
+	// Types the values of fields are converted to, "string", "int", "float",
+	// or "bool", keyed by field name. Strings and booleans are otherwise
+	// kept as is, numbers are floats, and objects and arrays are JSON text.
+	FieldTypes map[string]string `toml:"field_types"`
+
+	// Whether every value in the document is added as a field named after
+	// its path, e.g. Fields[a.b.c] for {"a": {"b": {"c": 1}}}.
+	Flatten bool
+
+	// Separator of the names of flattened fields. Defaults to ".".
+	FlattenSeparator string `toml:"flatten_separator"`
+
+	// Layouts the Timestamp is parsed with, tried in order, as accepted by
+	// the PayloadRegexDecoder's `timestamp_layout`. Numbers no layout
+	// matches are seconds since the epoch.
+	TimestampLayouts []string `toml:"timestamp_layouts"`
+
+	// Time zone the timestamps without one are in. Defaults to "UTC".
+	TimestampLocation string `toml:"timestamp_location"`
+
+	// Maps severity strings to their int version
+	SeverityMap map[string]int32 `toml:"severity_map"`
+}
+
+// Decodes JSON payloads natively, rather than in a sandbox, setting the
+// message's headers and fields from the values JSONPath expressions select,
+// and optionally from every value in the document.
+type JsonDecoder struct {
+	fields      []jsonField
+	types       map[string]string
+	flatten     bool
+	separator   string
+	layouts     []string
+	tzLocation  *time.Location
+	severityMap map[string]int32
+	dRunner     DecoderRunner
+}
+
+type jsonField struct {
+	name           string
+	representation string
+	path           jsonPath
+}
+
+// Message headers the field map can set, other names setting fields.
+var messageHeaders = map[string]bool{
+	"Timestamp": true,
+	"Severity":  true,
+	"Hostname":  true,
+	"Logger":    true,
+	"Type":      true,
+	"Payload":   true,
+	"Pid":       true,
+	"Uuid":      true,
+}
+
+func (jd *JsonDecoder) ConfigStruct() interface{} {
+	return &JsonDecoderConfig{
+		FlattenSeparator: ".",
+		TimestampLayouts: []string{time.RFC3339Nano},
+	}
+}
+
+func (jd *JsonDecoder) Init(config interface{}) (err error) {
+	conf := config.(*JsonDecoderConfig)
+
+	jd.fields = make([]jsonField, 0, len(conf.FieldMap))
+	for name, expr := range conf.FieldMap {
+		field := jsonField{name: name}
+		if i := strings.Index(name, "|"); i != -1 && !messageHeaders[name[:i]] {
+			field.name, field.representation = name[:i], name[i+1:]
+		}
+		if field.path, err = compileJsonPath(expr); err != nil {
+			return
+		}
+		jd.fields = append(jd.fields, field)
+	}
+	// Fields are added in the same order for every message.
+	sort.Sort(jsonFieldsByName(jd.fields))
+
+	jd.types = make(map[string]string)
+	for name, typ := range conf.FieldTypes {
+		switch typ {
+		case "string", "int", "float", "bool":
+		default:
+			return fmt.Errorf("invalid type '%s' for field '%s'", typ, name)
+		}
+		jd.types[name] = typ
+	}
+	jd.flatten = conf.Flatten
+	jd.separator = conf.FlattenSeparator
+	jd.layouts = conf.TimestampLayouts
+	if jd.tzLocation, err = time.LoadLocation(conf.TimestampLocation); err != nil {
+		return fmt.Errorf("JsonDecoder unknown timestamp_location '%s': %s",
+			conf.TimestampLocation, err)
+	}
+	jd.severityMap = conf.SeverityMap
+	return
+}
+
+// Heka will call this to give us access to the runner.
+func (jd *JsonDecoder) SetDecoderRunner(dr DecoderRunner) {
+	jd.dRunner = dr
+}
+
+func (jd *JsonDecoder) Decode(pack *PipelinePack) (packs []*PipelinePack, err error) {
+	decoder := json.NewDecoder(strings.NewReader(pack.Message.GetPayload()))
+	decoder.UseNumber()
+	var doc interface{}
+	if err = decoder.Decode(&doc); err != nil {
+		return nil, fmt.Errorf("invalid JSON payload: %s", err)
+	}
+
+	msg := pack.Message
+	if obj, ok := doc.(map[string]interface{}); ok && jd.flatten {
+		if err = jd.flattenObject(msg, "", obj); err != nil {
+			return
+		}
+	}
+	for _, field := range jd.fields {
+		values := field.path.find(doc)
+		if len(values) == 0 || values[0] == nil {
+			continue
+		}
+		switch field.name {
+		case "Timestamp":
+			jd.decodeTimestamp(msg, values[0])
+		case "Severity":
+			jd.decodeSeverity(msg, jsonString(values[0]))
+		default:
+			if messageHeaders[field.name] {
+				template := MessageTemplate{field.name: jsonString(values[0])}
+				err = template.PopulateMessage(msg, nil)
+			} else {
+				err = jd.addField(msg, field.name, field.representation, values)
+			}
+			if err != nil {
+				return
+			}
+		}
+	}
+	return []*PipelinePack{pack}, nil
+}
+
+// Adds the members of an object as fields, those of nested objects being
+// named after their path.
+func (jd *JsonDecoder) flattenObject(msg *message.Message, prefix string,
+	obj map[string]interface{}) (err error) {
+
+	for _, key := range sortedKeys(obj) {
+		name := prefix + key
+		switch v := obj[key].(type) {
+		case map[string]interface{}:
+			err = jd.flattenObject(msg, name+jd.separator, v)
+		case []interface{}:
+			if len(v) == 0 {
+				continue
+			}
+			// Arrays of strings, numbers, or booleans are fields with
+			// several values, other arrays are JSON text.
+			if isScalarArray(v) {
+				err = jd.addField(msg, name, "", v)
+			} else {
+				err = jd.addField(msg, name, "", []interface{}{v})
+			}
+		default:
+			err = jd.addField(msg, name, "", []interface{}{v})
+		}
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (jd *JsonDecoder) addField(msg *message.Message, name, representation string,
+	values []interface{}) (err error) {
+
+	var field *message.Field
+	for _, value := range values {
+		if value == nil {
+			continue
+		}
+		if value, err = convertJsonValue(value, jd.types[name]); err != nil {
+			return fmt.Errorf("field '%s': %s", name, err)
+		}
+		if field == nil {
+			if field, err = message.NewField(name, value, representation); err != nil {
+				return
+			}
+			msg.AddField(field)
+		} else if err = field.AddValue(value); err != nil {
+			return fmt.Errorf("field '%s': %s", name, err)
+		}
+	}
+	return
+}
+
+// Parses the timestamp with each layout in turn, numbers no layout matches
+// being seconds since the epoch.
+func (jd *JsonDecoder) decodeTimestamp(msg *message.Message, value interface{}) {
+	s := jsonString(value)
+	layouts := jd.layouts
+	if _, ok := value.(json.Number); ok {
+		layouts = append(layouts[:len(layouts):len(layouts)], "Epoch")
+	}
+	for _, layout := range layouts {
+		if t, err := message.ForgivingTimeParse(layout, s, jd.tzLocation); err == nil {
+			msg.SetTimestamp(t.UnixNano())
+			return
+		}
+	}
+	jd.dRunner.LogError(fmt.Errorf("Don't recognize Timestamp: '%s'", s))
+}
+
+func (jd *JsonDecoder) decodeSeverity(msg *message.Message, s string) {
+	if severity, ok := jd.severityMap[s]; ok {
+		msg.SetSeverity(severity)
+	} else if severity, err := strconv.ParseInt(s, 10, 32); err == nil {
+		msg.SetSeverity(int32(severity))
+	} else {
+		jd.dRunner.LogError(fmt.Errorf("Don't recognize severity: '%s'", s))
+	}
+}
+
+// Converts a decoded JSON value to a field value of the given type, or of
+// the value's own type if none is given.
+func convertJsonValue(value interface{}, typ string) (interface{}, error) {
+	switch typ {
+	case "":
+		switch v := value.(type) {
+		case string, bool:
+			return v, nil
+		case json.Number:
+			return v.Float64()
+		}
+		return jsonString(value), nil
+	case "string":
+		return jsonString(value), nil
+	case "bool":
+		switch v := value.(type) {
+		case bool:
+			return v, nil
+		case string:
+			return strconv.ParseBool(v)
+		case json.Number:
+			f, err := v.Float64()
+			return f != 0, err
+		}
+	case "int", "float":
+		var s string
+		switch v := value.(type) {
+		case bool:
+			s = "0"
+			if v {
+				s = "1"
+			}
+		case string:
+			s = strings.TrimSpace(v)
+		case json.Number:
+			s = v.String()
+		default:
+			return nil, fmt.Errorf("can't convert %s to %s", jsonString(value), typ)
+		}
+		if typ == "float" {
+			return strconv.ParseFloat(s, 64)
+		}
+		if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return i, nil
+		}
+		f, err := strconv.ParseFloat(s, 64)
+		return int64(f), err
+	}
+	return nil, fmt.Errorf("can't convert %s to %s", jsonString(value), typ)
+}
+
+// Returns a decoded JSON value as a string, objects and arrays as JSON text.
+func jsonString(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case bool:
+		return strconv.FormatBool(v)
+	case nil:
+		return ""
+	}
+	text, _ := json.Marshal(value)
+	return string(text)
+}
+
+// Whether the values are all strings, all numbers, or all booleans.
+func isScalarArray(values []interface{}) bool {
+	for _, value := range values {
+		switch value.(type) {
+		case string, json.Number, bool:
+		default:
+			return false
+		}
+		if fmt.Sprintf("%T", value) != fmt.Sprintf("%T", values[0]) {
+			return false
+		}
+	}
+	return true
+}
+
+func sortedKeys(obj map[string]interface{}) []string {
+	keys := make([]string, 0, len(obj))
+	for key := range obj {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+type jsonFieldsByName []jsonField
+
+func (f jsonFieldsByName) Len() int           { return len(f) }
+func (f jsonFieldsByName) Less(i, j int) bool { return f[i].name < f[j].name }
+func (f jsonFieldsByName) Swap(i, j int)      { f[i], f[j] = f[j], f[i] }
+
+func init() {
+	RegisterPlugin("JsonDecoder", func() interface{} {
+		return new(JsonDecoder)
+	})
+}
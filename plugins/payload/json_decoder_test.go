@@ -0,0 +1,154 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package payload
+
+import (
+	. "github.com/mozilla-services/heka/pipeline"
+	pipeline_ts "github.com/mozilla-services/heka/pipeline/testsupport"
+	"github.com/mozilla-services/heka/pipelinemock"
+	"github.com/rafrombrc/gomock/gomock"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"time"
+)
+
+func JsonDecoderSpec(c gs.Context) {
+	t := &pipeline_ts.SimpleT{}
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	c.Specify("A JsonDecoder", func() {
+		decoder := new(JsonDecoder)
+		conf := decoder.ConfigStruct().(*JsonDecoderConfig)
+		dRunner := pipelinemock.NewMockDecoderRunner(ctrl)
+		supply := make(chan *PipelinePack, 1)
+		pack := NewPipelinePack(supply)
+		pack.Message.SetPayload(`{
+			"time": "2015-03-01T12:34:56.789Z",
+			"level": "warn",
+			"host": "web1",
+			"pid": 1234,
+			"request": {"status": "504", "bytes": 2048, "secure": true,
+				"headers": {"User-Agent": "curl", "X.Id": "a1"}},
+			"tags": ["a", "b"],
+			"upstreams": [{"addr": "10.0.0.1", "time": 0.25},
+				{"addr": "10.0.0.2", "time": 0.5}],
+			"note": null
+		}`)
+
+		decode := func() {
+			c.Assume(decoder.Init(conf), gs.IsNil)
+			decoder.SetDecoderRunner(dRunner)
+			_, err := decoder.Decode(pack)
+			c.Assume(err, gs.IsNil)
+		}
+
+		c.Specify("maps values with JSONPath expressions", func() {
+			conf.FieldMap = map[string]string{
+				"Timestamp":     "$.time",
+				"Severity":      "$.level",
+				"Hostname":      "$.host",
+				"Pid":           "$.pid",
+				"status":        "$.request.status",
+				"bytes|B":       "$['request'].bytes",
+				"agent":         "$.request.headers['User-Agent']",
+				"upstream_time": "$.upstreams[*].time",
+				"last_addr":     "$.upstreams[-1].addr",
+				"missing":       "$.request.missing",
+				"note":          "$.note",
+			}
+			conf.FieldTypes = map[string]string{"status": "int"}
+			conf.SeverityMap = map[string]int32{"warn": 4}
+			decode()
+
+			msg := pack.Message
+			expected := time.Date(2015, 3, 1, 12, 34, 56, 789000000, time.UTC)
+			c.Expect(msg.GetTimestamp(), gs.Equals, expected.UnixNano())
+			c.Expect(msg.GetSeverity(), gs.Equals, int32(4))
+			c.Expect(msg.GetHostname(), gs.Equals, "web1")
+			c.Expect(msg.GetPid(), gs.Equals, int32(1234))
+			status, _ := msg.GetFieldValue("status")
+			c.Expect(status, gs.Equals, int64(504))
+			bytes := msg.FindFirstField("bytes")
+			c.Expect(bytes.GetValueDouble()[0], gs.Equals, float64(2048))
+			c.Expect(bytes.GetRepresentation(), gs.Equals, "B")
+			agent, _ := msg.GetFieldValue("agent")
+			c.Expect(agent, gs.Equals, "curl")
+			times := msg.FindFirstField("upstream_time").GetValueDouble()
+			c.Expect(len(times), gs.Equals, 2)
+			c.Expect(times[1], gs.Equals, 0.5)
+			addr, _ := msg.GetFieldValue("last_addr")
+			c.Expect(addr, gs.Equals, "10.0.0.2")
+			c.Expect(len(msg.Fields), gs.Equals, 5)
+		})
+
+		c.Specify("flattens nested objects", func() {
+			conf.Flatten = true
+			conf.FieldTypes = map[string]string{"request.bytes": "int"}
+			decode()
+
+			msg := pack.Message
+			status, _ := msg.GetFieldValue("request.status")
+			c.Expect(status, gs.Equals, "504")
+			bytes, _ := msg.GetFieldValue("request.bytes")
+			c.Expect(bytes, gs.Equals, int64(2048))
+			secure, _ := msg.GetFieldValue("request.secure")
+			c.Expect(secure, gs.Equals, true)
+			id, _ := msg.GetFieldValue("request.headers.X.Id")
+			c.Expect(id, gs.Equals, "a1")
+			tags := msg.FindFirstField("tags").GetValueString()
+			c.Expect(len(tags), gs.Equals, 2)
+			upstreams, _ := msg.GetFieldValue("upstreams")
+			c.Expect(upstreams, gs.Equals,
+				`[{"addr":"10.0.0.1","time":0.25},{"addr":"10.0.0.2","time":0.5}]`)
+			c.Expect(msg.FindFirstField("note"), gs.IsNil)
+		})
+
+		c.Specify("parses epoch timestamps", func() {
+			pack.Message.SetPayload(`{"ts": 1425213296.5, "ms": "1425213296789"}`)
+			conf.FieldMap = map[string]string{"Timestamp": "$.ts"}
+			decode()
+			c.Expect(pack.Message.GetTimestamp(), gs.Equals, int64(1425213296500000000))
+
+			conf.FieldMap = map[string]string{"Timestamp": "$.ms"}
+			conf.TimestampLayouts = []string{"EpochMilli"}
+			decode()
+			c.Expect(pack.Message.GetTimestamp(), gs.Equals, int64(1425213296789000000))
+		})
+
+		c.Specify("fails", func() {
+			c.Specify("on invalid JSON", func() {
+				c.Assume(decoder.Init(conf), gs.IsNil)
+				pack.Message.SetPayload(`{"a": `)
+				_, err := decoder.Decode(pack)
+				c.Expect(err, gs.Not(gs.IsNil))
+			})
+
+			c.Specify("on values that can't be converted", func() {
+				conf.FieldMap = map[string]string{"host": "$.host"}
+				conf.FieldTypes = map[string]string{"host": "int"}
+				c.Assume(decoder.Init(conf), gs.IsNil)
+				_, err := decoder.Decode(pack)
+				c.Expect(err, gs.Not(gs.IsNil))
+			})
+
+			c.Specify("on invalid config", func() {
+				conf.FieldMap = map[string]string{"host": "host"}
+				c.Expect(decoder.Init(conf), gs.Not(gs.IsNil))
+				conf.FieldMap = map[string]string{"host": "$.a[x]"}
+				c.Expect(decoder.Init(conf), gs.Not(gs.IsNil))
+				conf.FieldMap = nil
+				conf.FieldTypes = map[string]string{"host": "date"}
+				c.Expect(decoder.Init(conf), gs.Not(gs.IsNil))
+			})
+		})
+	})
+}
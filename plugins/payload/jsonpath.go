@@ -0,0 +1,120 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package payload
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Compiled JSONPath expression. The child (`.name` or `['name']`), array
+// index (`[0]`, `[-1]` for the last element), and wildcard (`.*` or `[*]`)
+// selectors are supported, e.g. `$.requests[*].headers['User-Agent']`.
+type jsonPath []jsonPathStep
+
+type jsonPathStep struct {
+	name     string
+	index    int
+	isIndex  bool
+	wildcard bool
+}
+
+func compileJsonPath(expr string) (path jsonPath, err error) {
+	if !strings.HasPrefix(expr, "$") {
+		return nil, fmt.Errorf("JSONPath '%s' doesn't start with '$'", expr)
+	}
+	rest := expr[1:]
+	for len(rest) > 0 {
+		var step jsonPathStep
+		switch rest[0] {
+		case '.':
+			rest = rest[1:]
+			end := strings.IndexAny(rest, ".[")
+			if end == -1 {
+				end = len(rest)
+			}
+			if end == 0 {
+				return nil, fmt.Errorf("JSONPath '%s' has an empty name", expr)
+			}
+			if step.name = rest[:end]; step.name == "*" {
+				step.wildcard = true
+			}
+			rest = rest[end:]
+		case '[':
+			if len(rest) > 1 && (rest[1] == '\'' || rest[1] == '"') {
+				// A quoted name, which can contain anything but its quote.
+				closing := strings.IndexByte(rest[2:], rest[1]) + 2
+				if closing < 2 || closing+1 >= len(rest) || rest[closing+1] != ']' {
+					return nil, fmt.Errorf("JSONPath '%s' has an unclosed name", expr)
+				}
+				step.name = rest[2:closing]
+				rest = rest[closing+2:]
+				break
+			}
+			end := strings.IndexByte(rest, ']')
+			if end == -1 {
+				return nil, fmt.Errorf("JSONPath '%s' has an unclosed '['", expr)
+			}
+			if selector := rest[1:end]; selector == "*" {
+				step.wildcard = true
+			} else if step.index, err = strconv.Atoi(selector); err == nil {
+				step.isIndex = true
+			} else {
+				return nil, fmt.Errorf("JSONPath '%s' has an invalid selector '[%s]'",
+					expr, selector)
+			}
+			rest = rest[end+1:]
+		default:
+			return nil, fmt.Errorf("JSONPath '%s' has an unexpected '%c'", expr, rest[0])
+		}
+		path = append(path, step)
+	}
+	return path, nil
+}
+
+// Returns the values the path selects in a decoded JSON document, in
+// document order for the wildcards, object members being sorted by name.
+func (path jsonPath) find(doc interface{}) (values []interface{}) {
+	values = []interface{}{doc}
+	for _, step := range path {
+		var next []interface{}
+		for _, value := range values {
+			switch v := value.(type) {
+			case map[string]interface{}:
+				if step.wildcard {
+					for _, key := range sortedKeys(v) {
+						next = append(next, v[key])
+					}
+				} else if member, ok := v[step.name]; ok && !step.isIndex {
+					next = append(next, member)
+				}
+			case []interface{}:
+				if step.wildcard {
+					next = append(next, v...)
+				} else if step.isIndex {
+					i := step.index
+					if i < 0 {
+						i += len(v)
+					}
+					if i >= 0 && i < len(v) {
+						next = append(next, v[i])
+					}
+				}
+			}
+		}
+		if values = next; len(values) == 0 {
+			break
+		}
+	}
+	return values
+}
@@ -175,6 +175,28 @@ func PayloadDecodersSpec(c gospec.Context) {
 			pack.Zero()
 		})
 
+		c.Specify("fails payloads longer than max_match_length", func() {
+			conf.MatchRegex = `\[(?P<Timestamp>[^\]]+)\]`
+			conf.MaxMatchLength = 10
+			err := decoder.Init(conf)
+			c.Assume(err, gs.IsNil)
+			dRunner := pipelinemock.NewMockDecoderRunner(ctrl)
+			decoder.SetDecoderRunner(dRunner)
+			pack.Message.SetPayload("[18/Apr/2013:14:00:28 -0700]")
+			_, err = decoder.Decode(pack)
+			c.Expect(err, gs.Equals, ErrRegexpInputTooLong)
+			tooLong, _ := decoder.bounded.LimitCounts()
+			c.Expect(tooLong, gs.Equals, int64(1))
+			pack.Zero()
+		})
+
+		c.Specify("rejects regexes over max_regex_size", func() {
+			conf.MatchRegex = `(?P<Word>\w{100})`
+			conf.MaxRegexSize = 50
+			err := decoder.Init(conf)
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+
 		c.Specify("uses kitchen timestamp", func() {
 			conf.MatchRegex = `\[(?P<Timestamp>[^\]]+)\]`
 			err := decoder.Init(conf)
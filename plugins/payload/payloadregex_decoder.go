@@ -17,6 +17,7 @@ package payload
 
 import (
 	"fmt"
+	"github.com/mozilla-services/heka/message"
 	. "github.com/mozilla-services/heka/pipeline"
 	"regexp"
 	"time"
@@ -51,10 +52,23 @@ type PayloadRegexDecoderConfig struct {
 
 	// Whether payloads that do not match the regex should be logged.
 	LogErrors bool `toml:"log_errors"`
+
+	// Maximum payload length in bytes to match, longer payloads fail to
+	// decode. Defaults to 0, i.e. no limit.
+	MaxMatchLength int `toml:"max_match_length"`
+
+	// Milliseconds a match may take before the payload fails to decode.
+	// Defaults to 0, i.e. no limit.
+	MatchTimeBudget uint `toml:"match_time_budget"`
+
+	// Maximum number of instructions the regex may compile to, bounding the
+	// memory each match uses. Defaults to 0, i.e. no limit.
+	MaxRegexSize int `toml:"max_regex_size"`
 }
 
 type PayloadRegexDecoder struct {
 	Match           *regexp.Regexp
+	bounded         *BoundedRegexp
 	SeverityMap     map[string]int32
 	MessageFields   MessageTemplate
 	TimestampLayout string
@@ -71,10 +85,16 @@ func (ld *PayloadRegexDecoder) ConfigStruct() interface{} {
 
 func (ld *PayloadRegexDecoder) Init(config interface{}) (err error) {
 	conf := config.(*PayloadRegexDecoderConfig)
-	if ld.Match, err = regexp.Compile(conf.MatchRegex); err != nil {
+	limits := RegexpLimits{
+		MaxMatchLength:  conf.MaxMatchLength,
+		MatchTimeBudget: time.Duration(conf.MatchTimeBudget) * time.Millisecond,
+		MaxProgramSize:  conf.MaxRegexSize,
+	}
+	if ld.bounded, err = CompileBoundedRegexp(conf.MatchRegex, limits); err != nil {
 		err = fmt.Errorf("PayloadRegexDecoder: %s", err)
 		return
 	}
+	ld.Match = ld.bounded.Regexp
 	if ld.Match.NumSubexp() == 0 {
 		err = fmt.Errorf("PayloadRegexDecoder regex must contain capture groups")
 		return
@@ -107,9 +127,11 @@ func (ld *PayloadRegexDecoder) SetDecoderRunner(dr DecoderRunner) {
 }
 
 // Matches the given string against the regex and returns the match result
-// and captures
-func tryMatch(re *regexp.Regexp, s string) (match bool, captures map[string]string) {
-	findResults := re.FindStringSubmatch(s)
+// and captures, or an error if the regex's limits were exceeded.
+func tryMatch(re *BoundedRegexp, s string) (match bool, captures map[string]string,
+	err error) {
+
+	findResults, err := re.BoundedFindStringSubmatch(s)
 	if findResults == nil {
 		return
 	}
@@ -132,7 +154,10 @@ func tryMatch(re *regexp.Regexp, s string) (match bool, captures map[string]stri
 // capture values interpolated into the message template values.
 func (ld *PayloadRegexDecoder) Decode(pack *PipelinePack) (packs []*PipelinePack, err error) {
 	// First try to match the regex.
-	match, captures := tryMatch(ld.Match, pack.Message.GetPayload())
+	match, captures, err := tryMatch(ld.bounded, pack.Message.GetPayload())
+	if err != nil {
+		return
+	}
 	if !match {
 		if ld.logErrors {
 			err = fmt.Errorf("No match: %s", pack.Message.GetPayload())
@@ -159,6 +184,13 @@ func (ld *PayloadRegexDecoder) Decode(pack *PipelinePack) (packs []*PipelinePack
 	return
 }
 
+func (ld *PayloadRegexDecoder) ReportMsg(msg *message.Message) error {
+	tooLong, overBudget := ld.bounded.LimitCounts()
+	message.NewInt64Field(msg, "MatchTooLong", tooLong, "count")
+	message.NewInt64Field(msg, "MatchOverBudget", overBudget, "count")
+	return nil
+}
+
 func init() {
 	RegisterPlugin("PayloadRegexDecoder", func() interface{} {
 		return new(PayloadRegexDecoder)
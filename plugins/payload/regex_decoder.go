@@ -0,0 +1,320 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package payload
+
+import (
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+	. "github.com/mozilla-services/heka/pipeline"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type RegexPatternConfig struct {
+	// Regular expression the payload is matched against, its named capture
+	// groups setting the message's headers and fields.
+	MatchRegex string `toml:"match_regex"`
+
+	// Types the captures are converted to, "string", "int", "float", "bool",
+	// or "timestamp", keyed by capture name. Timestamps are parsed with the
+	// pattern's `timestamp_layout`, or with the layout following the type,
+	// e.g. "timestamp:02/Jan/2006:15:04:05 -0700". Defaults to "string".
+	FieldTypes map[string]string `toml:"field_types"`
+
+	// Layout the Timestamp capture and the captures of the "timestamp" type
+	// are parsed with.
+	TimestampLayout string `toml:"timestamp_layout"`
+
+	// Keyed to the message field that should be filled in, the value will be
+	// interpolated so it can use the pattern's captures.
+	MessageFields MessageTemplate `toml:"message_fields"`
+
+	// Whether the following patterns are tried once this one matches.
+	Fallthrough bool
+}
+
+type RegexDecoderConfig struct {
+	// Patterns tried in turn, until one matches that doesn't fall through.
+	Patterns []RegexPatternConfig
+
+	// Maps severity strings to their int version
+	SeverityMap map[string]int32 `toml:"severity_map"`
+
+	// Time zone in which the timestamps in the text are presumed to be in.
+	// Defaults to "UTC".
+	TimestampLocation string `toml:"timestamp_location"`
+
+	// Whether payloads that match no pattern should be logged.
+	LogErrors bool `toml:"log_errors"`
+
+	// Maximum payload length in bytes to match, longer payloads fail to
+	// decode. Defaults to 0, i.e. no limit.
+	MaxMatchLength int `toml:"max_match_length"`
+
+	// Milliseconds each match may take before the payload fails to decode.
+	// Defaults to 0, i.e. no limit.
+	MatchTimeBudget uint `toml:"match_time_budget"`
+
+	// Maximum number of instructions each regex may compile to, bounding the
+	// memory each match uses. Defaults to 0, i.e. no limit.
+	MaxRegexSize int `toml:"max_regex_size"`
+}
+
+// Decodes payloads natively with one or more regular expressions, setting
+// the message's headers and fields from their named captures, converted to
+// the declared types.
+type RegexDecoder struct {
+	patterns    []*regexPattern
+	severityMap map[string]int32
+	tzLocation  *time.Location
+	dRunner     DecoderRunner
+	logErrors   bool
+}
+
+type regexPattern struct {
+	bounded *BoundedRegexp
+	// Names of the fields the capture groups set, by group index, unnamed
+	// groups setting none.
+	names           []string
+	types           map[string]captureType
+	timestampLayout string
+	messageFields   MessageTemplate
+	fallsThrough    bool
+}
+
+type captureType struct {
+	name   string
+	layout string
+}
+
+func (rd *RegexDecoder) ConfigStruct() interface{} {
+	return &RegexDecoderConfig{
+		LogErrors: true,
+	}
+}
+
+func (rd *RegexDecoder) Init(config interface{}) (err error) {
+	conf := config.(*RegexDecoderConfig)
+	if len(conf.Patterns) == 0 {
+		return fmt.Errorf("RegexDecoder requires at least one pattern")
+	}
+	limits := RegexpLimits{
+		MaxMatchLength:  conf.MaxMatchLength,
+		MatchTimeBudget: time.Duration(conf.MatchTimeBudget) * time.Millisecond,
+		MaxProgramSize:  conf.MaxRegexSize,
+	}
+	rd.patterns = make([]*regexPattern, len(conf.Patterns))
+	for i, patternConf := range conf.Patterns {
+		if rd.patterns[i], err = newRegexPattern(patternConf, limits); err != nil {
+			return fmt.Errorf("RegexDecoder pattern %d: %s", i, err)
+		}
+	}
+
+	rd.severityMap = make(map[string]int32)
+	for codeString, codeInt := range conf.SeverityMap {
+		rd.severityMap[codeString] = codeInt
+	}
+	if rd.tzLocation, err = time.LoadLocation(conf.TimestampLocation); err != nil {
+		return fmt.Errorf("RegexDecoder unknown timestamp_location '%s': %s",
+			conf.TimestampLocation, err)
+	}
+	rd.logErrors = conf.LogErrors
+	return
+}
+
+func newRegexPattern(conf RegexPatternConfig, limits RegexpLimits) (
+	pattern *regexPattern, err error) {
+
+	pattern = &regexPattern{
+		timestampLayout: conf.TimestampLayout,
+		messageFields:   conf.MessageFields,
+		fallsThrough:    conf.Fallthrough,
+	}
+	if pattern.bounded, err = CompileBoundedRegexp(conf.MatchRegex, limits); err != nil {
+		return nil, err
+	}
+	pattern.names = pattern.bounded.SubexpNames()
+	named := make(map[string]bool)
+	for _, name := range pattern.names {
+		if name != "" {
+			named[name] = true
+		}
+	}
+	if len(named) == 0 && len(conf.MessageFields) == 0 {
+		return nil, fmt.Errorf("regex must contain named capture groups")
+	}
+
+	pattern.types = make(map[string]captureType)
+	for name, typ := range conf.FieldTypes {
+		if !named[name] {
+			return nil, fmt.Errorf("no capture group named '%s'", name)
+		}
+		if pattern.types[name], err = parseCaptureType(typ, conf.TimestampLayout); err != nil {
+			return nil, fmt.Errorf("capture '%s': %s", name, err)
+		}
+	}
+	return
+}
+
+// Parses a capture's type, "string", "int", "float", "bool", or "timestamp",
+// optionally followed by the timestamp's layout, e.g. "timestamp:Epoch".
+func parseCaptureType(typ, timestampLayout string) (ct captureType, err error) {
+	ct.name = typ
+	if strings.HasPrefix(typ, "timestamp:") {
+		ct.name, ct.layout = "timestamp", typ[len("timestamp:"):]
+	}
+	switch ct.name {
+	case "string", "int", "float", "bool":
+	case "timestamp":
+		if ct.layout == "" {
+			ct.layout = timestampLayout
+		}
+	default:
+		err = fmt.Errorf("invalid type '%s'", typ)
+	}
+	return
+}
+
+// Heka will call this to give us access to the runner.
+func (rd *RegexDecoder) SetDecoderRunner(dr DecoderRunner) {
+	rd.dRunner = dr
+}
+
+// Tries the patterns in turn against the message payload. The captures of
+// every pattern that matches, up to the first one that doesn't fall
+// through, are applied to the message.
+func (rd *RegexDecoder) Decode(pack *PipelinePack) (packs []*PipelinePack, err error) {
+	payload := pack.Message.GetPayload()
+	matched := false
+	for _, pattern := range rd.patterns {
+		var values []string
+		if values, err = pattern.bounded.BoundedFindStringSubmatch(payload); err != nil {
+			return
+		}
+		if values == nil {
+			continue
+		}
+		matched = true
+		if err = rd.apply(pattern, pack, values); err != nil {
+			return
+		}
+		if !pattern.fallsThrough {
+			break
+		}
+	}
+	if !matched {
+		if rd.logErrors {
+			err = fmt.Errorf("No match: %s", payload)
+		}
+		return
+	}
+	return []*PipelinePack{pack}, nil
+}
+
+// Sets the message's headers and fields from a matching pattern's captures.
+func (rd *RegexDecoder) apply(pattern *regexPattern, pack *PipelinePack,
+	values []string) (err error) {
+
+	// Captures of optional groups that didn't participate in the match
+	// aren't set, and the first group setting a field wins.
+	captures := make(map[string]string, len(values))
+	order := make([]string, 0, len(values))
+	for i, name := range pattern.names {
+		if name == "" || values[i] == "" {
+			continue
+		}
+		if _, ok := captures[name]; !ok {
+			captures[name] = values[i]
+			order = append(order, name)
+		}
+	}
+	pdh := &PayloadDecoderHelper{
+		Captures:        map[string]string{},
+		dRunner:         rd.dRunner,
+		TimestampLayout: pattern.timestampLayout,
+		TzLocation:      rd.tzLocation,
+		SeverityMap:     rd.severityMap,
+	}
+	for _, name := range []string{"Timestamp", "Severity"} {
+		if value, ok := captures[name]; ok {
+			pdh.Captures[name] = value
+		}
+	}
+	pdh.DecodeTimestamp(pack)
+	pdh.DecodeSeverity(pack)
+
+	msg := pack.Message
+	for _, name := range order {
+		value := captures[name]
+		if name == "Timestamp" || name == "Severity" {
+			continue
+		}
+		if messageHeaders[name] {
+			if err = (MessageTemplate{name: value}).PopulateMessage(msg, nil); err != nil {
+				return
+			}
+			continue
+		}
+		var converted interface{}
+		if converted, err = rd.convertCapture(value, pattern.types[name]); err != nil {
+			return fmt.Errorf("capture '%s': %s", name, err)
+		}
+		var field *message.Field
+		if field, err = message.NewField(name, converted, ""); err != nil {
+			return
+		}
+		msg.AddField(field)
+	}
+	if pattern.messageFields != nil {
+		err = pattern.messageFields.PopulateMessage(msg, captures)
+	}
+	return
+}
+
+// Converts a captured string to a field value of the given type, timestamps
+// being nanoseconds since the epoch.
+func (rd *RegexDecoder) convertCapture(value string, typ captureType) (interface{}, error) {
+	switch typ.name {
+	case "int":
+		return strconv.ParseInt(value, 10, 64)
+	case "float":
+		return strconv.ParseFloat(value, 64)
+	case "bool":
+		return strconv.ParseBool(value)
+	case "timestamp":
+		t, err := message.ForgivingTimeParse(typ.layout, value, rd.tzLocation)
+		if err != nil {
+			return nil, err
+		}
+		return t.UnixNano(), nil
+	}
+	return value, nil
+}
+
+func (rd *RegexDecoder) ReportMsg(msg *message.Message) error {
+	var tooLong, overBudget int64
+	for _, pattern := range rd.patterns {
+		patternTooLong, patternOverBudget := pattern.bounded.LimitCounts()
+		tooLong += patternTooLong
+		overBudget += patternOverBudget
+	}
+	message.NewInt64Field(msg, "MatchTooLong", tooLong, "count")
+	message.NewInt64Field(msg, "MatchOverBudget", overBudget, "count")
+	return nil
+}
+
+func init() {
+	RegisterPlugin("RegexDecoder", func() interface{} {
+		return new(RegexDecoder)
+	})
+}
@@ -0,0 +1,165 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package payload
+
+import (
+	. "github.com/mozilla-services/heka/pipeline"
+	pipeline_ts "github.com/mozilla-services/heka/pipeline/testsupport"
+	"github.com/mozilla-services/heka/pipelinemock"
+	"github.com/rafrombrc/gomock/gomock"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+)
+
+func RegexDecoderSpec(c gs.Context) {
+	t := &pipeline_ts.SimpleT{}
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	c.Specify("A RegexDecoder", func() {
+		decoder := new(RegexDecoder)
+		conf := decoder.ConfigStruct().(*RegexDecoderConfig)
+		dRunner := pipelinemock.NewMockDecoderRunner(ctrl)
+		supply := make(chan *PipelinePack, 1)
+		pack := NewPipelinePack(supply)
+
+		access := RegexPatternConfig{
+			MatchRegex: `^(?P<Hostname>\S+) \[(?P<Timestamp>[^\]]+)\] "(?P<Method>[A-Z]+) ` +
+				`(?P<Url>\S+)" (?P<Status>\d+) (?P<Bytes>\d+) (?P<Duration>[\d.]+)` +
+				`(?: (?P<Cached>true|false))?`,
+			TimestampLayout: "02/Jan/2006:15:04:05 -0700",
+			FieldTypes: map[string]string{
+				"Status":   "int",
+				"Bytes":    "int",
+				"Duration": "float",
+				"Cached":   "bool",
+			},
+			MessageFields: MessageTemplate{"Type": "access"},
+		}
+		errorLog := RegexPatternConfig{
+			MatchRegex:      `^(?P<Time>\S+ \S+) \[(?P<Severity>\w+)\] (?P<Message>.*)`,
+			TimestampLayout: "2006/01/02 15:04:05",
+			FieldTypes:      map[string]string{"Time": "timestamp"},
+			MessageFields:   MessageTemplate{"Type": "error"},
+		}
+		conf.Patterns = []RegexPatternConfig{access, errorLog}
+		conf.SeverityMap = map[string]int32{"error": 3}
+
+		c.Specify("sets headers and typed fields from the captures", func() {
+			c.Assume(decoder.Init(conf), gs.IsNil)
+			decoder.SetDecoderRunner(dRunner)
+			pack.Message.SetPayload(`web1 [18/Apr/2013:14:00:28 -0700] "GET /index.html" ` +
+				`200 2326 0.053 true`)
+			packs, err := decoder.Decode(pack)
+			c.Expect(err, gs.IsNil)
+			c.Expect(len(packs), gs.Equals, 1)
+
+			msg := pack.Message
+			c.Expect(msg.GetTimestamp(), gs.Equals, int64(1366318828000000000))
+			c.Expect(msg.GetHostname(), gs.Equals, "web1")
+			c.Expect(msg.GetType(), gs.Equals, "access")
+			method, _ := msg.GetFieldValue("Method")
+			c.Expect(method, gs.Equals, "GET")
+			status, _ := msg.GetFieldValue("Status")
+			c.Expect(status, gs.Equals, int64(200))
+			bytes, _ := msg.GetFieldValue("Bytes")
+			c.Expect(bytes, gs.Equals, int64(2326))
+			duration, _ := msg.GetFieldValue("Duration")
+			c.Expect(duration, gs.Equals, 0.053)
+			cached, _ := msg.GetFieldValue("Cached")
+			c.Expect(cached, gs.Equals, true)
+		})
+
+		c.Specify("doesn't set the captures of groups that didn't match", func() {
+			c.Assume(decoder.Init(conf), gs.IsNil)
+			decoder.SetDecoderRunner(dRunner)
+			pack.Message.SetPayload(`web1 [18/Apr/2013:14:00:28 -0700] "GET /" 200 0 0.1`)
+			_, err := decoder.Decode(pack)
+			c.Expect(err, gs.IsNil)
+			c.Expect(pack.Message.FindFirstField("Cached"), gs.IsNil)
+		})
+
+		c.Specify("tries the following patterns", func() {
+			c.Assume(decoder.Init(conf), gs.IsNil)
+			decoder.SetDecoderRunner(dRunner)
+			pack.Message.SetPayload(`2015/03/01 12:34:56 [error] upstream timed out`)
+			_, err := decoder.Decode(pack)
+			c.Expect(err, gs.IsNil)
+
+			msg := pack.Message
+			c.Expect(msg.GetType(), gs.Equals, "error")
+			c.Expect(msg.GetSeverity(), gs.Equals, int32(3))
+			t, _ := msg.GetFieldValue("Time")
+			c.Expect(t, gs.Equals, int64(1425213296000000000))
+			text, _ := msg.GetFieldValue("Message")
+			c.Expect(text, gs.Equals, "upstream timed out")
+		})
+
+		c.Specify("applies the patterns following one falling through", func() {
+			conf.Patterns = []RegexPatternConfig{
+				{MatchRegex: `user=(?P<User>\w+)`, Fallthrough: true},
+				{MatchRegex: `status=(?P<Status>\d+)`},
+				{MatchRegex: `(?P<Other>.+)`},
+			}
+			c.Assume(decoder.Init(conf), gs.IsNil)
+			decoder.SetDecoderRunner(dRunner)
+			pack.Message.SetPayload("user=bob status=404")
+			_, err := decoder.Decode(pack)
+			c.Expect(err, gs.IsNil)
+
+			user, _ := pack.Message.GetFieldValue("User")
+			c.Expect(user, gs.Equals, "bob")
+			status, _ := pack.Message.GetFieldValue("Status")
+			c.Expect(status, gs.Equals, "404")
+			c.Expect(pack.Message.FindFirstField("Other"), gs.IsNil)
+		})
+
+		c.Specify("fails", func() {
+			c.Specify("payloads no pattern matches", func() {
+				c.Assume(decoder.Init(conf), gs.IsNil)
+				pack.Message.SetPayload("invalid payload")
+				_, err := decoder.Decode(pack)
+				c.Expect(err.Error(), gs.Equals, "No match: invalid payload")
+
+				conf.LogErrors = false
+				c.Assume(decoder.Init(conf), gs.IsNil)
+				packs, err := decoder.Decode(pack)
+				c.Expect(err, gs.IsNil)
+				c.Expect(len(packs), gs.Equals, 0)
+			})
+
+			c.Specify("captures that can't be converted", func() {
+				conf.Patterns = []RegexPatternConfig{{
+					MatchRegex: `n=(?P<N>\w+)`,
+					FieldTypes: map[string]string{"N": "int"},
+				}}
+				c.Assume(decoder.Init(conf), gs.IsNil)
+				pack.Message.SetPayload("n=abc")
+				_, err := decoder.Decode(pack)
+				c.Expect(err, gs.Not(gs.IsNil))
+			})
+
+			c.Specify("invalid configs", func() {
+				conf.Patterns = nil
+				c.Expect(decoder.Init(conf), gs.Not(gs.IsNil))
+				conf.Patterns = []RegexPatternConfig{{MatchRegex: `(\d+)`}}
+				c.Expect(decoder.Init(conf), gs.Not(gs.IsNil))
+				conf.Patterns = []RegexPatternConfig{{
+					MatchRegex: `(?P<N>\d+)`,
+					FieldTypes: map[string]string{"M": "int"},
+				}}
+				c.Expect(decoder.Init(conf), gs.Not(gs.IsNil))
+				conf.Patterns[0].FieldTypes = map[string]string{"N": "duration"}
+				c.Expect(decoder.Init(conf), gs.Not(gs.IsNil))
+			})
+		})
+	})
+}
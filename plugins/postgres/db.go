@@ -0,0 +1,106 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package postgres
+
+import (
+	"database/sql"
+	"github.com/lib/pq"
+	"github.com/mozilla-services/heka/pipeline"
+)
+
+// Writes rows to a table.
+type rowWriter interface {
+	CopyRows(columns []string, rows [][]interface{}) error
+	Close() error
+}
+
+// Writes rows with COPY, in a transaction per batch, so a batch is either
+// written whole or not at all.
+type pqWriter struct {
+	db     *sql.DB
+	schema string
+	table  string
+}
+
+func newPqWriter(connection, schema, table string) (*pqWriter, error) {
+	// Connections are only opened, and reopened after they're lost, as
+	// they're used.
+	db, err := sql.Open("postgres", connection)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+	return &pqWriter{db: db, schema: schema, table: table}, nil
+}
+
+func (w *pqWriter) CopyRows(columns []string, rows [][]interface{}) (err error) {
+	tx, err := w.db.Begin()
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+	var query string
+	if w.schema != "" {
+		query = pq.CopyInSchema(w.schema, w.table, columns...)
+	} else {
+		query = pq.CopyIn(w.table, columns...)
+	}
+	stmt, err := tx.Prepare(query)
+	if err != nil {
+		return
+	}
+	for _, row := range rows {
+		if _, err = stmt.Exec(row...); err != nil {
+			stmt.Close()
+			return
+		}
+	}
+	// Rows are buffered until COPY is ended by an Exec without arguments.
+	if _, err = stmt.Exec(); err != nil {
+		stmt.Close()
+		return
+	}
+	if err = stmt.Close(); err != nil {
+		return
+	}
+	return tx.Commit()
+}
+
+func (w *pqWriter) Close() error {
+	return w.db.Close()
+}
+
+// Wraps an error with its kind for pipeline.ClassifyError, from the class of
+// PostgreSQL's error code.
+func classifyError(err error) error {
+	if pqErr, ok := err.(*pq.Error); ok {
+		switch pqErr.Code.Class() {
+		case "08", // Connection exception.
+			"40", // Transaction rollback, e.g. a deadlock.
+			"53", // Insufficient resources, e.g. a full disk.
+			"57", // Operator intervention, e.g. a server shutdown.
+			"58": // System error.
+			return pipeline.NewRetryableError(err)
+		case "22", // Data exception, e.g. an invalid value.
+			"23": // Integrity constraint violation.
+			return pipeline.NewMalformedMessageError(err)
+		}
+		// e.g. a missing table or column, or invalid credentials.
+		return pipeline.NewFatalError(err)
+	}
+	// Network errors and lost connections.
+	return pipeline.NewRetryableError(err)
+}
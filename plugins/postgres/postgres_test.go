@@ -0,0 +1,133 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package postgres
+
+import (
+	"github.com/lib/pq"
+	"github.com/mozilla-services/heka/message"
+	"github.com/mozilla-services/heka/pipeline"
+	"github.com/mozilla-services/heka/pipelinemock"
+	"github.com/rafrombrc/gomock/gomock"
+	"testing"
+	"time"
+)
+
+// Table fake, rejecting rows holding "bad" and failing the calls listed in
+// errs.
+type fakeTable struct {
+	rows  [][]interface{}
+	calls int
+	errs  []error
+}
+
+func (f *fakeTable) CopyRows(columns []string, rows [][]interface{}) error {
+	f.calls++
+	if len(f.errs) > 0 {
+		err := f.errs[0]
+		f.errs = f.errs[1:]
+		return err
+	}
+	for _, row := range rows {
+		for _, value := range row {
+			if value == "bad" {
+				return &pq.Error{Code: "22P02", Message: "invalid input syntax"}
+			}
+		}
+	}
+	f.rows = append(f.rows, rows...)
+	return nil
+}
+
+func (f *fakeTable) Close() error {
+	return nil
+}
+
+func newTestOutput(t *testing.T, table *fakeTable) *PostgresOutput {
+	p := &PostgresOutput{writer: table}
+	config := p.ConfigStruct().(*PostgresOutputConfig)
+	config.Connection = "postgres://localhost/audit"
+	config.Table = "audit.events"
+	config.Columns = map[string]string{
+		"event_time": "Timestamp",
+		"actor":      "Fields[user]",
+		"attrs":      "Fields",
+		"host":       "Hostname",
+	}
+	config.Retries.Delay = "1ms"
+	if err := p.Init(config); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func newMessage(user string) *message.Message {
+	msg := new(message.Message)
+	msg.SetTimestamp(1420070400 * int64(time.Second))
+	msg.SetHostname("web1")
+	if user != "" {
+		message.NewStringField(msg, "user", user)
+		field, _ := message.NewField("roles", "admin", "")
+		field.AddValue("ops")
+		msg.AddField(field)
+	}
+	return msg
+}
+
+func TestOutputConfig(t *testing.T) {
+	p := &PostgresOutput{writer: new(fakeTable)}
+	config := p.ConfigStruct().(*PostgresOutputConfig)
+	config.Connection = "postgres://localhost/audit"
+	config.Table = "events"
+	if err := p.Init(config); err == nil || err.Error() != "columns must be specified" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	config.Columns = map[string]string{"actor": "user"}
+	if err := p.Init(config); err == nil ||
+		err.Error() != "invalid source for column 'actor': user" {
+
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestWriteRetriesAndIsolatesRejectedRows(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	or := pipelinemock.NewMockOutputRunner(ctrl)
+	or.EXPECT().LogError(gomock.Any()).AnyTimes()
+
+	table := &fakeTable{errs: []error{&pq.Error{Code: "08006"}}}
+	p := newTestOutput(t, table)
+	p.batch = [][]interface{}{
+		p.columns.Values(newMessage("alice")),
+		p.columns.Values(newMessage("bad")),
+		p.columns.Values(newMessage("bob")),
+	}
+	if err := p.flush(or); err != nil {
+		t.Fatal(err)
+	}
+	// The lost connection is retried, then the batch is rejected and written
+	// row by row.
+	if table.calls != 5 || len(table.rows) != 2 || table.rows[1][0] != "bob" {
+		t.Errorf("Unexpected writes: %d calls, %v", table.calls, table.rows)
+	}
+	if p.rowsWritten != 2 || p.rowsDropped != 1 || p.retries != 1 {
+		t.Errorf("Unexpected counts: %d written, %d dropped, %d retries",
+			p.rowsWritten, p.rowsDropped, p.retries)
+	}
+
+	// A missing table stops the output.
+	table.errs = []error{&pq.Error{Code: "42P01", Message: "undefined table"}}
+	p.batch = [][]interface{}{p.columns.Values(newMessage("carol"))}
+	if err := p.flush(or); pipeline.ClassifyError(err) != pipeline.ErrKindFatal {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,185 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package siem
+
+import (
+	"fmt"
+	"github.com/mozilla-services/heka/pipeline"
+	"strings"
+)
+
+type CefDecoderConfig struct {
+	// Types the values of header fields and extensions are converted to,
+	// keyed by field name: "string", "int", "float", or "bool". Defaults to
+	// "string".
+	FieldTypes map[string]string `toml:"field_types"`
+
+	// Whether the custom extensions with a label, e.g. "cs1" with
+	// "cs1Label", are named after their label. The label extensions are then
+	// left out. Defaults to true.
+	UseCustomLabels bool `toml:"use_custom_labels"`
+
+	// Extension setting the message's Timestamp. Defaults to "rt", the time
+	// the device received the event.
+	TimestampField string `toml:"timestamp_field"`
+
+	// Layouts the timestamp is parsed with, in turn. Defaults to
+	// milliseconds since the epoch ("EpochMilli") and the "MMM dd yyyy
+	// HH:mm:ss" dates of the CEF specification.
+	TimestampLayouts []string `toml:"timestamp_layouts"`
+
+	// Time zone in which the timestamps in the text are presumed to be in.
+	// Defaults to "UTC".
+	TimestampLocation string `toml:"timestamp_location"`
+
+	// Keyed to the message field that should be filled in, the value will be
+	// interpolated so it can use the event's header fields and extensions.
+	MessageFields pipeline.MessageTemplate `toml:"message_fields"`
+}
+
+// Names of the fields set by the fields of a CEF event's header.
+var cefHeaderFields = []string{"cefVersion", "deviceVendor", "deviceProduct",
+	"deviceVersion", "deviceEventClassId", "name", "severity"}
+
+// Decodes ArcSight Common Event Format (CEF) events, setting a message field
+// for each of their header fields and extensions. Text before the "CEF:"
+// prefix, e.g. a syslog header, is ignored.
+type CefDecoder struct {
+	eventDecoder
+	conf *CefDecoderConfig
+}
+
+func (cd *CefDecoder) ConfigStruct() interface{} {
+	return &CefDecoderConfig{
+		UseCustomLabels:  true,
+		TimestampField:   "rt",
+		TimestampLayouts: defaultTimestampLayouts,
+	}
+}
+
+func (cd *CefDecoder) Init(config interface{}) (err error) {
+	conf := config.(*CefDecoderConfig)
+	if err = cd.init("CefDecoder", conf.FieldTypes, conf.TimestampLayouts,
+		conf.TimestampLocation, conf.MessageFields); err != nil {
+		return
+	}
+	cd.conf = conf
+	return
+}
+
+// Heka will call this to give us access to the runner, so that we can log
+// the timestamps and severities we don't recognize.
+func (cd *CefDecoder) SetDecoderRunner(dr pipeline.DecoderRunner) {
+	cd.dRunner = dr
+}
+
+func (cd *CefDecoder) Decode(pack *pipeline.PipelinePack) (
+	packs []*pipeline.PipelinePack, err error) {
+
+	payload := pack.Message.GetPayload()
+	start := strings.Index(payload, "CEF:")
+	if start == -1 {
+		return nil, fmt.Errorf("payload isn't a CEF event")
+	}
+	header, extension, err := splitHeader(payload[start+len("CEF:"):], len(cefHeaderFields))
+	if err != nil {
+		return nil, fmt.Errorf("invalid CEF event: %s", err)
+	}
+	values := make([]keyValue, 0, len(cefHeaderFields)+8)
+	for i, name := range cefHeaderFields {
+		values = append(values, keyValue{name, header[i]})
+	}
+	extensions := parseExtension(extension)
+	if cd.conf.UseCustomLabels {
+		extensions = applyLabels(extensions)
+	}
+	values = append(values, extensions...)
+
+	msg := pack.Message
+	cd.setSeverity(msg, header[6])
+	for _, kv := range extensions {
+		if kv.key == cd.conf.TimestampField {
+			cd.setTimestamp(msg, kv.value, cd.layouts)
+			break
+		}
+	}
+	if err = cd.addFields(msg, values); err != nil {
+		return
+	}
+	return []*pipeline.PipelinePack{pack}, nil
+}
+
+// Parses the extension of a CEF event, space separated key=value pairs whose
+// values may hold spaces, and escaped equal signs. An equal sign that doesn't
+// follow a valid key is part of the value.
+func parseExtension(s string) (values []keyValue) {
+	key := ""
+	start := 0 // Start of the current value.
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' {
+			i++
+			continue
+		}
+		if s[i] != '=' {
+			continue
+		}
+		keyStart := strings.LastIndex(s[:i], " ") + 1
+		if key != "" && keyStart <= start || !validKey(s[keyStart:i]) {
+			continue
+		}
+		if key != "" {
+			values = append(values, keyValue{key,
+				unescapeValue(strings.TrimRight(s[start:keyStart], " "))})
+		}
+		key = s[keyStart:i]
+		start = i + 1
+	}
+	if key != "" {
+		values = append(values, keyValue{key,
+			unescapeValue(strings.TrimRight(s[start:], " \r\n"))})
+	}
+	return
+}
+
+// Names the custom extensions with a label, e.g. "cs1" with "cs1Label",
+// after it, leaving out the label extensions.
+func applyLabels(extensions []keyValue) []keyValue {
+	keys := make(map[string]bool, len(extensions))
+	for _, kv := range extensions {
+		keys[kv.key] = true
+	}
+	labels := make(map[string]string)
+	for _, kv := range extensions {
+		base := strings.TrimSuffix(kv.key, "Label")
+		if base != kv.key && kv.value != "" && keys[base] {
+			labels[base] = kv.value
+		}
+	}
+	if len(labels) == 0 {
+		return extensions
+	}
+	labeled := make([]keyValue, 0, len(extensions)-len(labels))
+	for _, kv := range extensions {
+		if label, ok := labels[kv.key]; ok {
+			labeled = append(labeled, keyValue{label, kv.value})
+		} else if _, ok = labels[strings.TrimSuffix(kv.key, "Label")]; !ok {
+			labeled = append(labeled, kv)
+		}
+	}
+	return labeled
+}
+
+func init() {
+	pipeline.RegisterPlugin("CefDecoder", func() interface{} {
+		return new(CefDecoder)
+	})
+}
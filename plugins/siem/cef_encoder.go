@@ -0,0 +1,127 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package siem
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/mozilla-services/heka/pipeline"
+	"github.com/mozilla-services/heka/plugins"
+	"strings"
+)
+
+type CefEncoderConfig struct {
+	// Device vendor, product, and version written in the header. Default to
+	// "Mozilla", "Heka", and Heka's version.
+	DeviceVendor  string `toml:"device_vendor"`
+	DeviceProduct string `toml:"device_product"`
+	DeviceVersion string `toml:"device_version"`
+
+	// Message values written as the event's signature id (its
+	// "deviceEventClassId") and name, see plugins.NewColumnMapping. Default
+	// to "Type" and "Payload".
+	SignatureId string `toml:"signature_id"`
+	Name        string
+
+	// Message values written as extensions, by extension key. Extensions
+	// without a value are left out. Defaults to the Timestamp as "rt", in
+	// milliseconds since the epoch, and the Hostname as "dvchost".
+	Extensions map[string]string
+
+	// Whether the message's dynamic fields are written as extensions too,
+	// keyed by their name with the characters keys can't hold replaced by
+	// underscores. Fields written by or named after a configured extension, or
+	// after a field of the header as set by the CefDecoder, are left out.
+	// Defaults to false.
+	IncludeFields bool `toml:"include_fields"`
+
+	// Whether a newline is appended to each event. Defaults to true.
+	AppendNewlines bool `toml:"append_newlines"`
+}
+
+// Serializes messages to ArcSight Common Event Format (CEF) events, e.g. for
+// a TcpOutput or UdpOutput sending them to a SIEM's syslog listener. The
+// header's severity is mapped from the message's syslog severity.
+type CefEncoder struct {
+	eventEncoder
+	conf   *CefEncoderConfig
+	header *plugins.ColumnMapping
+	prefix string // The header's constant fields.
+}
+
+func (ce *CefEncoder) ConfigStruct() interface{} {
+	return &CefEncoderConfig{
+		DeviceVendor:  "Mozilla",
+		DeviceProduct: "Heka",
+		DeviceVersion: pipeline.VERSION,
+		SignatureId:   "Type",
+		Name:          "Payload",
+		Extensions: map[string]string{
+			"rt":      "Timestamp",
+			"dvchost": "Hostname",
+		},
+		AppendNewlines: true,
+	}
+}
+
+func (ce *CefEncoder) Init(config interface{}) (err error) {
+	conf := config.(*CefEncoderConfig)
+	if err = ce.init("CefEncoder", conf.Extensions, conf.IncludeFields,
+		cefHeaderFields); err != nil {
+		return
+	}
+	// Names are sorted, "name" first.
+	ce.header, err = plugins.NewColumnMapping(map[string]string{
+		"name":        conf.Name,
+		"signatureId": conf.SignatureId,
+	})
+	if err != nil {
+		return fmt.Errorf("CefEncoder %s", err)
+	}
+	ce.prefix = fmt.Sprintf("CEF:0|%s|%s|%s|", escapeHeader(conf.DeviceVendor),
+		escapeHeader(conf.DeviceProduct), escapeHeader(conf.DeviceVersion))
+	ce.conf = conf
+	return
+}
+
+func (ce *CefEncoder) Encode(pack *pipeline.PipelinePack) (output []byte, err error) {
+	msg := pack.Message
+	header := ce.header.Values(msg)
+	name, _ := formatValue(header[0])
+	signatureId, _ := formatValue(header[1])
+
+	buf := new(bytes.Buffer)
+	buf.WriteString(ce.prefix)
+	fmt.Fprintf(buf, "%s|%s|%d|", escapeHeader(signatureId), escapeHeader(name),
+		encodeSeverity(msg.GetSeverity()))
+	for i, kv := range ce.keyValues(msg) {
+		if i > 0 {
+			buf.WriteByte(' ')
+		}
+		buf.WriteString(kv.key)
+		buf.WriteByte('=')
+		buf.WriteString(extensionEscaper.Replace(kv.value))
+	}
+	if ce.conf.AppendNewlines {
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes(), nil
+}
+
+var extensionEscaper = strings.NewReplacer(`\`, `\\`, `=`, `\=`, "\n", `\n`,
+	"\r", `\r`)
+
+func init() {
+	pipeline.RegisterPlugin("CefEncoder", func() interface{} {
+		return new(CefEncoder)
+	})
+}
@@ -0,0 +1,169 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package siem
+
+import (
+	"github.com/mozilla-services/heka/message"
+	"github.com/mozilla-services/heka/pipeline"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func decodeCef(t *testing.T, conf *CefDecoderConfig, payload string) (
+	*message.Message, error) {
+
+	decoder := new(CefDecoder)
+	if conf == nil {
+		conf = decoder.ConfigStruct().(*CefDecoderConfig)
+	}
+	if err := decoder.Init(conf); err != nil {
+		t.Fatal(err)
+	}
+	pack := pipeline.NewPipelinePack(nil)
+	pack.Message.SetPayload(payload)
+	_, err := decoder.Decode(pack)
+	return pack.Message, err
+}
+
+func TestParseExtension(t *testing.T) {
+	tests := map[string][]keyValue{
+		"src=10.0.0.1 act=blocked a \\= b msg=x=y  suser=": {
+			{"src", "10.0.0.1"}, {"act", "blocked a = b"}, {"msg", "x=y"},
+			{"suser", ""}},
+		`request=http://x/?a=b&c=d cs1=C:\\temp\nnext`: {
+			{"request", "http://x/?a=b&c=d"}, {"cs1", "C:\\temp\nnext"}},
+		"": nil,
+	}
+	for extension, expected := range tests {
+		if values := parseExtension(extension); !reflect.DeepEqual(values, expected) {
+			t.Errorf("Unexpected values of '%s': %v", extension, values)
+		}
+	}
+}
+
+func TestCefDecoder(t *testing.T) {
+	payload := `Sep 19 08:26:10 host CEF:0|Security|threat\|manager|1.0|100|` +
+		`worm successfully stopped|10|src=10.0.0.1 dst=2.1.2.2 spt=1232 ` +
+		`cs1Label=Rule Name cs1=Block all rt=1420070400123 msg=a\=b c\\d` + "\n"
+	conf := new(CefDecoder).ConfigStruct().(*CefDecoderConfig)
+	conf.FieldTypes = map[string]string{"spt": "int", "cefVersion": "int"}
+	conf.MessageFields = pipeline.MessageTemplate{"Type": "cef.%deviceEventClassId%"}
+	msg, err := decodeCef(t, conf, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.GetTimestamp() != 1420070400123000000 || msg.GetSeverity() != 2 ||
+		msg.GetType() != "cef.100" {
+
+		t.Errorf("Unexpected headers: %s", msg)
+	}
+	expected := map[string]interface{}{
+		"cefVersion":    int64(0),
+		"deviceProduct": "threat|manager",
+		"name":          "worm successfully stopped",
+		"spt":           int64(1232),
+		"Rule Name":     "Block all",
+		"msg":           `a=b c\d`,
+	}
+	for name, value := range expected {
+		if v, _ := msg.GetFieldValue(name); v != value {
+			t.Errorf("Unexpected field '%s': %#v", name, v)
+		}
+	}
+	if msg.FindFirstField("cs1") != nil || msg.FindFirstField("cs1Label") != nil {
+		t.Errorf("Unexpected label fields: %s", msg)
+	}
+
+	conf.UseCustomLabels = false
+	if msg, err = decodeCef(t, conf, payload); err != nil {
+		t.Fatal(err)
+	}
+	if label, _ := msg.GetFieldValue("cs1Label"); label != "Rule Name" {
+		t.Errorf("Unexpected label: %#v", label)
+	}
+	if _, err = decodeCef(t, conf, strings.Replace(payload, "1232", "x", 1)); err == nil ||
+		!strings.Contains(err.Error(), "field 'spt'") {
+
+		t.Errorf("Unexpected error: %v", err)
+	}
+	for _, invalid := range []string{"not CEF", "CEF:0|Security|threat|1.0|100|10"} {
+		if _, err = decodeCef(t, nil, invalid); err == nil {
+			t.Errorf("Expected an error decoding '%s'", invalid)
+		}
+	}
+
+	// Dates are parsed in the configured time zone.
+	conf = new(CefDecoder).ConfigStruct().(*CefDecoderConfig)
+	conf.TimestampLocation = "America/New_York"
+	msg, err = decodeCef(t, conf, "CEF:0|a|b|1|2|n|Low|rt=Jan 01 2015 00:00:00")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.GetTimestamp() != 1420088400000000000 || msg.GetSeverity() != 6 {
+		t.Errorf("Unexpected headers: %s", msg)
+	}
+}
+
+func TestCefEncoder(t *testing.T) {
+	encoder := new(CefEncoder)
+	conf := encoder.ConfigStruct().(*CefEncoderConfig)
+	conf.DeviceVersion = "0.9"
+	conf.Extensions["suser"] = "Fields[user]"
+	conf.IncludeFields = true
+	if err := encoder.Init(conf); err != nil {
+		t.Fatal(err)
+	}
+	pack := pipeline.NewPipelinePack(nil)
+	msg := pack.Message
+	msg.SetTimestamp(1420070400123000000)
+	msg.SetType("auth|failure")
+	msg.SetPayload("Login failed\nfor root")
+	msg.SetHostname("web1")
+	msg.SetSeverity(3)
+	message.NewStringField(msg, "user", "root")
+	message.NewStringField(msg, "request path", "/login?next=/")
+	message.NewStringField(msg, "name", "left out")
+	message.NewInt64Field(msg, "attempts", 3, "")
+
+	output, err := encoder.Encode(pack)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `CEF:0|Mozilla|Heka|0.9|auth\|failure|Login failed for root|7|` +
+		`dvchost=web1 rt=1420070400123 suser=root request_path=/login?next\=/ ` +
+		"attempts=3\n"
+	if string(output) != expected {
+		t.Errorf("Unexpected output: %s", output)
+	}
+
+	// The decoder reads what the encoder writes.
+	decoded, err := decodeCef(t, nil, string(output))
+	if err != nil {
+		t.Fatal(err)
+	}
+	path, _ := decoded.GetFieldValue("request_path")
+	if decoded.GetTimestamp() != msg.GetTimestamp() || decoded.GetSeverity() != 3 ||
+		path != "/login?next=/" {
+
+		t.Errorf("Unexpected message: %s", decoded)
+	}
+
+	conf.Extensions = map[string]string{"bad key": "Type"}
+	if err = encoder.Init(conf); err == nil {
+		t.Error("Expected an error with an invalid extension key")
+	}
+	conf.Extensions = map[string]string{"msg": "Fields[]x"}
+	if err = encoder.Init(conf); err == nil {
+		t.Error("Expected an error with an invalid extension source")
+	}
+}
@@ -0,0 +1,108 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package siem
+
+import (
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+	"github.com/mozilla-services/heka/pipeline"
+	"time"
+)
+
+// What the CEF and LEEF decoders share: adding the event's header fields and
+// key/value pairs to the message, and setting its headers from them.
+type eventDecoder struct {
+	types         map[string]string
+	layouts       []string
+	tzLocation    *time.Location
+	messageFields pipeline.MessageTemplate
+	dRunner       pipeline.DecoderRunner
+}
+
+func (ed *eventDecoder) init(name string, types map[string]string, layouts []string,
+	location string, messageFields pipeline.MessageTemplate) (err error) {
+
+	for field, typ := range types {
+		switch typ {
+		case "string", "int", "float", "bool":
+		default:
+			return fmt.Errorf("%s invalid type '%s' for field '%s'", name, typ, field)
+		}
+	}
+	if ed.tzLocation, err = time.LoadLocation(location); err != nil {
+		return fmt.Errorf("%s unknown timestamp_location '%s': %s", name, location, err)
+	}
+	ed.types = types
+	ed.layouts = layouts
+	ed.messageFields = messageFields
+	return nil
+}
+
+// Parses a timestamp with each layout in turn, logging it if none matches.
+func (ed *eventDecoder) setTimestamp(msg *message.Message, value string,
+	layouts []string) {
+
+	for _, layout := range layouts {
+		if t, err := message.ForgivingTimeParse(layout, value, ed.tzLocation); err == nil {
+			msg.SetTimestamp(t.UnixNano())
+			return
+		}
+	}
+	ed.logError(fmt.Errorf("Don't recognize Timestamp: '%s'", value))
+}
+
+func (ed *eventDecoder) logError(err error) {
+	if ed.dRunner != nil {
+		ed.dRunner.LogError(err)
+	}
+}
+
+func (ed *eventDecoder) setSeverity(msg *message.Message, value string) {
+	if severity, ok := decodeSeverity(value); ok {
+		msg.SetSeverity(severity)
+	} else if value != "" && value != "Unknown" {
+		ed.logError(fmt.Errorf("Don't recognize severity: '%s'", value))
+	}
+}
+
+// Adds the values as fields, converted to their configured types, and
+// populates the message fields template with them.
+func (ed *eventDecoder) addFields(msg *message.Message, values []keyValue) error {
+	subs := make(map[string]string, len(values))
+	for _, kv := range values {
+		value, err := convertValue(kv.value, ed.types[kv.key])
+		if err != nil {
+			return fmt.Errorf("field '%s': %s", kv.key, err)
+		}
+		field, err := message.NewField(kv.key, value, "")
+		if err != nil {
+			return fmt.Errorf("field '%s': %s", kv.key, err)
+		}
+		msg.AddField(field)
+		subs[kv.key] = kv.value
+	}
+	if ed.messageFields != nil {
+		return ed.messageFields.PopulateMessage(msg, subs)
+	}
+	return nil
+}
+
+// Layouts timestamps are parsed with by default: milliseconds since the
+// epoch, and the "MMM dd yyyy HH:mm:ss" dates CEF and LEEF devices write,
+// with optional milliseconds and time zone.
+var defaultTimestampLayouts = []string{
+	"EpochMilli",
+	"Jan 02 2006 15:04:05.000 MST",
+	"Jan 02 2006 15:04:05 MST",
+	"Jan 02 2006 15:04:05.000",
+	"Jan 02 2006 15:04:05",
+}
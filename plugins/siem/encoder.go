@@ -0,0 +1,83 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package siem
+
+import (
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+	"github.com/mozilla-services/heka/plugins"
+	"strings"
+)
+
+// What the CEF and LEEF encoders share: the message values written as an
+// event's key/value pairs.
+type eventEncoder struct {
+	values        *plugins.ColumnMapping
+	includeFields bool
+	reserved      map[string]bool // Keys the dynamic fields aren't written as.
+	mapped        map[string]bool // Dynamic fields written by the mapping.
+}
+
+// Maps the message values to the keys they're written as, see
+// plugins.NewColumnMapping. The dynamic fields are written too if
+// includeFields is set, keyed by their name, unless it's reserved or they're
+// already mapped to a key.
+func (ee *eventEncoder) init(name string, values map[string]string,
+	includeFields bool, reserved []string) (err error) {
+
+	ee.reserved = make(map[string]bool, len(values)+len(reserved))
+	for _, key := range reserved {
+		ee.reserved[key] = true
+	}
+	ee.mapped = make(map[string]bool)
+	for key, source := range values {
+		if !validKey(key) {
+			return fmt.Errorf("%s invalid key '%s'", name, key)
+		}
+		ee.reserved[key] = true
+		if strings.HasPrefix(source, "Fields[") && strings.HasSuffix(source, "]") {
+			ee.mapped[source[len("Fields["):len(source)-1]] = true
+		}
+	}
+	if ee.values, err = plugins.NewColumnMapping(values); err != nil {
+		return fmt.Errorf("%s %s", name, err)
+	}
+	ee.includeFields = includeFields
+	return
+}
+
+// Returns the key/value pairs of a message, leaving out the values it
+// doesn't have. Dynamic fields with several values are written with their
+// first one.
+func (ee *eventEncoder) keyValues(msg *message.Message) []keyValue {
+	values := make([]keyValue, 0, len(ee.values.Names)+len(msg.Fields))
+	for i, value := range ee.values.Values(msg) {
+		if text, ok := formatValue(value); ok {
+			values = append(values, keyValue{ee.values.Names[i], text})
+		}
+	}
+	if !ee.includeFields {
+		return values
+	}
+	written := make(map[string]bool, len(msg.Fields))
+	for _, field := range msg.Fields {
+		key := sanitizeKey(field.GetName())
+		if key == "" || ee.mapped[field.GetName()] || ee.reserved[key] || written[key] {
+			continue
+		}
+		if text, ok := formatValue(field.GetValue()); ok {
+			values = append(values, keyValue{key, text})
+			written[key] = true
+		}
+	}
+	return values
+}
@@ -0,0 +1,263 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+// Package siem holds the decoders and encoders of the ArcSight Common Event
+// Format (CEF) and IBM QRadar's Log Event Extended Format (LEEF), the line
+// formats security devices use to send events to SIEMs.
+package siem
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A key and value of a CEF extension or a LEEF event's attributes.
+type keyValue struct {
+	key, value string
+}
+
+// Splits the pipe delimited header of a CEF or LEEF event into n fields,
+// returning the rest of the event after the n-th pipe. Escaped pipes and
+// backslashes in the fields are unescaped.
+func splitHeader(s string, n int) (fields []string, rest string, err error) {
+	fields = make([]string, 0, n)
+	var field bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '\\' && i+1 < len(s) && (s[i+1] == '|' || s[i+1] == '\\'):
+			i++
+			field.WriteByte(s[i])
+		case c == '|':
+			fields = append(fields, field.String())
+			field.Reset()
+			if len(fields) == n {
+				return fields, s[i+1:], nil
+			}
+		default:
+			field.WriteByte(c)
+		}
+	}
+	return nil, "", fmt.Errorf("header has %d fields rather than %d", len(fields), n)
+}
+
+// Escapes pipes and backslashes in a header field, and replaces line breaks
+// with spaces.
+func escapeHeader(s string) string {
+	return headerEscaper.Replace(s)
+}
+
+var headerEscaper = strings.NewReplacer(`\`, `\\`, `|`, `\|`, "\r\n", " ",
+	"\n", " ", "\r", " ")
+
+// Whether a string is a valid extension or attribute key.
+func validKey(key string) bool {
+	if key == "" {
+		return false
+	}
+	for i := 0; i < len(key); i++ {
+		if !isKeyChar(key[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func isKeyChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+		c == '_' || c == '.' || c == '-' || c == '[' || c == ']'
+}
+
+// Replaces the characters keys can't hold with underscores.
+func sanitizeKey(name string) string {
+	key := []byte(name)
+	for i := range key {
+		if !isKeyChar(key[i]) {
+			key[i] = '_'
+		}
+	}
+	return string(key)
+}
+
+// Unescapes a value, "\n" and "\r" being line breaks, and any other escaped
+// character standing for itself.
+func unescapeValue(s string) string {
+	if strings.IndexByte(s, '\\') == -1 {
+		return s
+	}
+	var value bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 == len(s) {
+			value.WriteByte(s[i])
+			continue
+		}
+		i++
+		switch s[i] {
+		case 'n':
+			value.WriteByte('\n')
+		case 'r':
+			value.WriteByte('\r')
+		default:
+			value.WriteByte(s[i])
+		}
+	}
+	return value.String()
+}
+
+// Returns the text of a message value written to an extension or attribute,
+// and whether there's one. Timestamps are milliseconds since the epoch,
+// bytes are base64 encoded.
+func formatValue(value interface{}) (string, bool) {
+	switch v := value.(type) {
+	case nil:
+		return "", false
+	case string:
+		return v, true
+	case int64:
+		return strconv.FormatInt(v, 10), true
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	case bool:
+		return strconv.FormatBool(v), true
+	case []byte:
+		return base64.StdEncoding.EncodeToString(v), true
+	case time.Time:
+		return strconv.FormatInt(v.UnixNano()/int64(time.Millisecond), 10), true
+	}
+	return fmt.Sprint(value), true
+}
+
+// Maps a CEF (0-10) or LEEF (1-10) severity to a syslog severity: 9-10 to
+// critical, 7-8 to error, 4-6 to warning, and 0-3 to informational. CEF's
+// Low, Medium, High, and Very-High severities are mapped likewise.
+func decodeSeverity(s string) (severity int32, ok bool) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "low":
+		return 6, true
+	case "medium":
+		return 4, true
+	case "high":
+		return 3, true
+	case "very-high":
+		return 2, true
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(s))
+	switch {
+	case err != nil || n < 0 || n > 10:
+		return 0, false
+	case n >= 9:
+		return 2, true
+	case n >= 7:
+		return 3, true
+	case n >= 4:
+		return 4, true
+	}
+	return 6, true
+}
+
+// Syslog severities as CEF and LEEF severities, the reverse of
+// decodeSeverity.
+var encodedSeverities = []int{10, 9, 9, 7, 5, 3, 1, 0}
+
+func encodeSeverity(severity int32) int {
+	if severity < 0 {
+		return encodedSeverities[0]
+	}
+	if int(severity) >= len(encodedSeverities) {
+		return 0
+	}
+	return encodedSeverities[severity]
+}
+
+// Converts a value to the given field type, "string", "int", "float", or
+// "bool".
+func convertValue(value, typ string) (interface{}, error) {
+	switch typ {
+	case "", "string":
+		return value, nil
+	case "int":
+		return strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+	case "float":
+		return strconv.ParseFloat(strings.TrimSpace(value), 64)
+	case "bool":
+		return strconv.ParseBool(strings.TrimSpace(value))
+	}
+	return nil, fmt.Errorf("unknown type '%s'", typ)
+}
+
+// Go layouts of the letters of Java's SimpleDateFormat patterns, keyed by
+// the letter and the number of times it's repeated, 0 for any other count.
+var javaLayouts = map[byte]map[int]string{
+	'y': {2: "06", 0: "2006"},
+	'M': {1: "1", 2: "01", 3: "Jan", 0: "January"},
+	'd': {1: "2", 0: "02"},
+	'E': {1: "Mon", 2: "Mon", 3: "Mon", 0: "Monday"},
+	'H': {0: "15"},
+	'h': {1: "3", 0: "03"},
+	'm': {1: "4", 0: "04"},
+	's': {1: "5", 0: "05"},
+	'S': {1: "0", 2: "00", 0: "000"},
+	'a': {0: "PM"},
+	'z': {0: "MST"},
+	'Z': {0: "-0700"},
+	'X': {1: "-07", 2: "-0700", 0: "-07:00"},
+}
+
+// Converts a Java SimpleDateFormat pattern, as used by LEEF's devTimeFormat,
+// to a Go time layout.
+func javaLayout(pattern string) (string, error) {
+	var layout bytes.Buffer
+	for i := 0; i < len(pattern); {
+		c := pattern[i]
+		if c == '\'' && i+1 < len(pattern) && pattern[i+1] == '\'' {
+			layout.WriteByte('\'')
+			i += 2
+			continue
+		}
+		if c == '\'' {
+			// Quoted text, '' being a quote.
+			for i++; ; i++ {
+				if i == len(pattern) {
+					return "", fmt.Errorf("unterminated quote in '%s'", pattern)
+				}
+				if pattern[i] == '\'' {
+					if i+1 == len(pattern) || pattern[i+1] != '\'' {
+						break
+					}
+					i++
+				}
+				layout.WriteByte(pattern[i])
+			}
+			i++
+			continue
+		}
+		n := 1
+		for i+n < len(pattern) && pattern[i+n] == c {
+			n++
+		}
+		if layouts, ok := javaLayouts[c]; ok {
+			l, ok := layouts[n]
+			if !ok {
+				l = layouts[0]
+			}
+			layout.WriteString(l)
+		} else if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' {
+			return "", fmt.Errorf("unsupported letter '%c' in '%s'", c, pattern)
+		} else {
+			layout.WriteString(pattern[i : i+n])
+		}
+		i += n
+	}
+	return layout.String(), nil
+}
@@ -0,0 +1,182 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package siem
+
+import (
+	"fmt"
+	"github.com/mozilla-services/heka/pipeline"
+	"strconv"
+	"strings"
+)
+
+type LeefDecoderConfig struct {
+	// Types the values of header fields and attributes are converted to,
+	// keyed by field name: "string", "int", "float", or "bool". Defaults to
+	// "string".
+	FieldTypes map[string]string `toml:"field_types"`
+
+	// Layouts the "devTime" attribute is parsed with, in turn, when the
+	// event has no "devTimeFormat" attribute or it doesn't match. Defaults
+	// to milliseconds since the epoch ("EpochMilli") and the "MMM dd yyyy
+	// HH:mm:ss" dates of the LEEF specification.
+	TimestampLayouts []string `toml:"timestamp_layouts"`
+
+	// Time zone in which the timestamps in the text are presumed to be in.
+	// Defaults to "UTC".
+	TimestampLocation string `toml:"timestamp_location"`
+
+	// Keyed to the message field that should be filled in, the value will be
+	// interpolated so it can use the event's header fields and attributes.
+	MessageFields pipeline.MessageTemplate `toml:"message_fields"`
+}
+
+// Names of the fields set by the fields of a LEEF event's header.
+var leefHeaderFields = []string{"leefVersion", "vendor", "product",
+	"productVersion", "eventId"}
+
+// Decodes IBM QRadar's Log Event Extended Format (LEEF) 1.0 and 2.0 events,
+// setting a message field for each of their header fields and attributes.
+// Text before the "LEEF:" prefix, e.g. a syslog header, is ignored.
+type LeefDecoder struct {
+	eventDecoder
+}
+
+func (ld *LeefDecoder) ConfigStruct() interface{} {
+	return &LeefDecoderConfig{
+		TimestampLayouts: defaultTimestampLayouts,
+	}
+}
+
+func (ld *LeefDecoder) Init(config interface{}) error {
+	conf := config.(*LeefDecoderConfig)
+	return ld.init("LeefDecoder", conf.FieldTypes, conf.TimestampLayouts,
+		conf.TimestampLocation, conf.MessageFields)
+}
+
+// Heka will call this to give us access to the runner, so that we can log
+// the timestamps, severities, and attributes we don't recognize.
+func (ld *LeefDecoder) SetDecoderRunner(dr pipeline.DecoderRunner) {
+	ld.dRunner = dr
+}
+
+func (ld *LeefDecoder) Decode(pack *pipeline.PipelinePack) (
+	packs []*pipeline.PipelinePack, err error) {
+
+	payload := pack.Message.GetPayload()
+	start := strings.Index(payload, "LEEF:")
+	if start == -1 {
+		return nil, fmt.Errorf("payload isn't a LEEF event")
+	}
+	header, rest, err := splitHeader(payload[start+len("LEEF:"):], len(leefHeaderFields))
+	if err != nil {
+		return nil, fmt.Errorf("invalid LEEF event: %s", err)
+	}
+	delimiter := byte('\t')
+	if header[0] != "1.0" {
+		// LEEF 2.0 events may name their attribute delimiter after the
+		// header.
+		if end := strings.IndexByte(rest, '|'); end != -1 {
+			if d, ok := parseDelimiter(rest[:end]); ok {
+				delimiter = d
+				rest = rest[end+1:]
+			}
+		}
+	}
+	values := make([]keyValue, 0, len(leefHeaderFields)+8)
+	for i, name := range leefHeaderFields {
+		values = append(values, keyValue{name, header[i]})
+	}
+	attributes := ld.parseAttributes(strings.TrimRight(rest, "\r\n"), delimiter)
+	values = append(values, attributes...)
+
+	msg := pack.Message
+	var devTime, devTimeFormat string
+	for _, kv := range attributes {
+		switch kv.key {
+		case "devTime":
+			devTime = kv.value
+		case "devTimeFormat":
+			devTimeFormat = kv.value
+		case "sev":
+			ld.setSeverity(msg, kv.value)
+		}
+	}
+	if devTime != "" {
+		layouts := ld.layouts
+		if devTimeFormat != "" {
+			if layout, err := javaLayout(devTimeFormat); err == nil {
+				layouts = append([]string{layout}, layouts...)
+			} else {
+				ld.logError(fmt.Errorf("invalid devTimeFormat: %s", err))
+			}
+		}
+		ld.setTimestamp(msg, devTime, layouts)
+	}
+	if err = ld.addFields(msg, values); err != nil {
+		return
+	}
+	return []*pipeline.PipelinePack{pack}, nil
+}
+
+// Parses a LEEF 2.0 delimiter: a single character, or its code in hex, e.g.
+// "x09" or "0x09". Empty ones are tabs, backslashes can't be delimiters.
+func parseDelimiter(s string) (delimiter byte, ok bool) {
+	switch {
+	case s == "":
+		return '\t', true
+	case len(s) == 1:
+		return s[0], s[0] != '\\'
+	case strings.HasPrefix(s, "0x") || strings.HasPrefix(s, "x"):
+		code, err := strconv.ParseUint(s[strings.IndexByte(s, 'x')+1:], 16, 8)
+		if err != nil || code == 0 || code == '\\' {
+			return 0, false
+		}
+		return byte(code), true
+	}
+	return 0, false
+}
+
+// Parses the key=value attributes of a LEEF event, separated by the
+// delimiter, which is escaped in values by a backslash.
+func (ld *LeefDecoder) parseAttributes(s string, delimiter byte) (values []keyValue) {
+	var attributes []string
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case delimiter:
+			attributes = append(attributes, s[start:i])
+			start = i + 1
+		}
+	}
+	attributes = append(attributes, s[start:])
+	for _, attribute := range attributes {
+		if strings.TrimSpace(attribute) == "" {
+			continue
+		}
+		eq := strings.IndexByte(attribute, '=')
+		if eq == -1 || !validKey(strings.TrimSpace(attribute[:eq])) {
+			ld.logError(fmt.Errorf("invalid LEEF attribute: '%s'", attribute))
+			continue
+		}
+		values = append(values, keyValue{strings.TrimSpace(attribute[:eq]),
+			unescapeValue(attribute[eq+1:])})
+	}
+	return
+}
+
+func init() {
+	pipeline.RegisterPlugin("LeefDecoder", func() interface{} {
+		return new(LeefDecoder)
+	})
+}
@@ -0,0 +1,158 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package siem
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/mozilla-services/heka/pipeline"
+	"github.com/mozilla-services/heka/plugins"
+	"strconv"
+	"strings"
+)
+
+type LeefEncoderConfig struct {
+	// LEEF version written, "1.0" or "2.0". Defaults to "2.0".
+	Version string
+
+	// Attribute delimiter, a single character or its code in hex, e.g.
+	// "x5E". LEEF 1.0 events are always tab delimited. Defaults to a tab.
+	Delimiter string
+
+	// Vendor, product, and product version written in the header. Default
+	// to "Mozilla", "Heka", and Heka's version.
+	Vendor         string
+	Product        string
+	ProductVersion string `toml:"product_version"`
+
+	// Message value written as the event id, see plugins.NewColumnMapping.
+	// Defaults to "Type".
+	EventId string `toml:"event_id"`
+
+	// Message values written as attributes, by attribute key. Attributes
+	// without a value are left out. Defaults to the Timestamp as "devTime",
+	// in milliseconds since the epoch.
+	Attributes map[string]string
+
+	// Whether the message's dynamic fields are written as attributes too,
+	// keyed by their name with the characters keys can't hold replaced by
+	// underscores. Fields written by or named after a configured attribute, or
+	// after a field of the header as set by the LeefDecoder, are left out.
+	// Defaults to false.
+	IncludeFields bool `toml:"include_fields"`
+
+	// Whether a newline is appended to each event. Defaults to true.
+	AppendNewlines bool `toml:"append_newlines"`
+}
+
+// Serializes messages to IBM QRadar's Log Event Extended Format (LEEF)
+// events. The "sev" attribute is mapped from the message's syslog severity.
+type LeefEncoder struct {
+	eventEncoder
+	conf      *LeefEncoderConfig
+	eventId   *plugins.ColumnMapping
+	delimiter byte
+	prefix    string // The header's constant fields.
+	escaper   *strings.Replacer
+}
+
+func (le *LeefEncoder) ConfigStruct() interface{} {
+	return &LeefEncoderConfig{
+		Version:        "2.0",
+		Delimiter:      "\t",
+		Vendor:         "Mozilla",
+		Product:        "Heka",
+		ProductVersion: pipeline.VERSION,
+		EventId:        "Type",
+		Attributes: map[string]string{
+			"devTime": "Timestamp",
+		},
+		AppendNewlines: true,
+	}
+}
+
+func (le *LeefEncoder) Init(config interface{}) (err error) {
+	conf := config.(*LeefEncoderConfig)
+	var ok bool
+	if le.delimiter, ok = parseDelimiter(conf.Delimiter); !ok || le.delimiter == '=' ||
+		le.delimiter == '|' || le.delimiter == '\n' || le.delimiter == '\r' {
+
+		return fmt.Errorf("LeefEncoder invalid delimiter: %q", conf.Delimiter)
+	}
+	if conf.Version == "1.0" && le.delimiter != '\t' {
+		return fmt.Errorf("LeefEncoder LEEF 1.0 events are tab delimited")
+	} else if conf.Version != "1.0" && conf.Version != "2.0" {
+		return fmt.Errorf("LeefEncoder unknown LEEF version '%s'", conf.Version)
+	}
+	if _, ok = conf.Attributes["sev"]; ok {
+		return fmt.Errorf("LeefEncoder writes the `sev` attribute itself")
+	}
+	reserved := append([]string{"sev"}, leefHeaderFields...)
+	if err = le.init("LeefEncoder", conf.Attributes, conf.IncludeFields,
+		reserved); err != nil {
+		return
+	}
+	if le.eventId, err = plugins.NewColumnMapping(map[string]string{
+		"eventId": conf.EventId}); err != nil {
+
+		return fmt.Errorf("LeefEncoder %s", err)
+	}
+
+	le.prefix = fmt.Sprintf("LEEF:%s|%s|%s|%s|", conf.Version, escapeHeader(conf.Vendor),
+		escapeHeader(conf.Product), escapeHeader(conf.ProductVersion))
+	delimiter := string(le.delimiter)
+	le.escaper = strings.NewReplacer(`\`, `\\`, delimiter, `\`+delimiter, "\n", `\n`,
+		"\r", `\r`)
+	le.conf = conf
+	return
+}
+
+func (le *LeefEncoder) Encode(pack *pipeline.PipelinePack) (output []byte, err error) {
+	msg := pack.Message
+	eventId, _ := formatValue(le.eventId.Values(msg)[0])
+
+	buf := new(bytes.Buffer)
+	buf.WriteString(le.prefix)
+	buf.WriteString(escapeHeader(eventId))
+	buf.WriteByte('|')
+	if le.conf.Version != "1.0" {
+		if le.delimiter > ' ' && le.delimiter < 0x7f {
+			buf.WriteByte(le.delimiter)
+		} else {
+			fmt.Fprintf(buf, "x%02X", le.delimiter)
+		}
+		buf.WriteByte('|')
+	}
+	// LEEF severities go from 1 to 10.
+	severity := encodeSeverity(msg.GetSeverity())
+	if severity < 1 {
+		severity = 1
+	}
+	buf.WriteString("sev=")
+	buf.WriteString(strconv.Itoa(severity))
+	for _, kv := range le.keyValues(msg) {
+		buf.WriteByte(le.delimiter)
+		buf.WriteString(kv.key)
+		buf.WriteByte('=')
+		buf.WriteString(le.escaper.Replace(kv.value))
+	}
+	if le.conf.AppendNewlines {
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes(), nil
+}
+
+func init() {
+	pipeline.RegisterPlugin("LeefEncoder", func() interface{} {
+		return new(LeefEncoder)
+	})
+}
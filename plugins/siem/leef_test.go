@@ -0,0 +1,160 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package siem
+
+import (
+	"github.com/mozilla-services/heka/message"
+	"github.com/mozilla-services/heka/pipeline"
+	"testing"
+)
+
+func decodeLeef(t *testing.T, conf *LeefDecoderConfig, payload string) (
+	*message.Message, error) {
+
+	decoder := new(LeefDecoder)
+	if conf == nil {
+		conf = decoder.ConfigStruct().(*LeefDecoderConfig)
+	}
+	if err := decoder.Init(conf); err != nil {
+		t.Fatal(err)
+	}
+	pack := pipeline.NewPipelinePack(nil)
+	pack.Message.SetPayload(payload)
+	_, err := decoder.Decode(pack)
+	return pack.Message, err
+}
+
+func TestJavaLayout(t *testing.T) {
+	tests := map[string]string{
+		"MMM dd yyyy HH:mm:ss.SSS z":      "Jan 02 2006 15:04:05.000 MST",
+		"yyyy-MM-dd'T'HH:mm:ssXXX":        "2006-01-02T15:04:05-07:00",
+		"EEE, d MMM yy h:mm a 'o''clock'": "Mon, 2 Jan 06 3:04 PM o'clock",
+	}
+	for pattern, expected := range tests {
+		if layout, err := javaLayout(pattern); err != nil || layout != expected {
+			t.Errorf("Unexpected layout of '%s': %v, '%s'", pattern, err, layout)
+		}
+	}
+	if _, err := javaLayout("yyyy 'Q"); err == nil {
+		t.Error("Expected an error with an unterminated quote")
+	}
+}
+
+func TestLeefDecoder(t *testing.T) {
+	// LEEF 1.0 events are tab delimited.
+	conf := new(LeefDecoder).ConfigStruct().(*LeefDecoderConfig)
+	conf.FieldTypes = map[string]string{"srcPort": "int"}
+	conf.MessageFields = pipeline.MessageTemplate{"Hostname": "%src%"}
+	msg, err := decodeLeef(t, conf, "<13>Jan 18 11:07:53 host LEEF:1.0|Microsoft|"+
+		"MSExchange|4.0 SP1|15345|src=192.0.2.0\tsrcPort=1024\tsev=8\t"+
+		"devTime=Jan 18 2015 11:07:53.250 UTC\tmsg=a\\\tb\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.GetTimestamp() != 1421579273250000000 || msg.GetSeverity() != 3 ||
+		msg.GetHostname() != "192.0.2.0" {
+
+		t.Errorf("Unexpected headers: %s", msg)
+	}
+	expected := map[string]interface{}{
+		"leefVersion":    "1.0",
+		"productVersion": "4.0 SP1",
+		"eventId":        "15345",
+		"srcPort":        int64(1024),
+		"msg":            "a\tb",
+	}
+	for name, value := range expected {
+		if v, _ := msg.GetFieldValue(name); v != value {
+			t.Errorf("Unexpected field '%s': %#v", name, v)
+		}
+	}
+
+	// LEEF 2.0 events may name their delimiter, and the devTime format.
+	msg, err = decodeLeef(t, nil, "LEEF:2.0|Lancope|StealthWatch|1.0|41|x5E|"+
+		"src=10.0.1.8^dst=10.0.0.5^devTimeFormat=yyyy-MM-dd HH:mm:ss^"+
+		"devTime=2015-01-01 00:00:01^ignored")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst, _ := msg.GetFieldValue("dst")
+	if msg.GetTimestamp() != 1420070401000000000 || dst != "10.0.0.5" {
+		t.Errorf("Unexpected message: %s", msg)
+	}
+	msg, err = decodeLeef(t, nil, "LEEF:2.0|Lancope|StealthWatch|1.0|41|src=a|b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if src, _ := msg.GetFieldValue("src"); src != "a|b" {
+		t.Errorf("Unexpected src: %#v", src)
+	}
+	if _, err = decodeLeef(t, nil, "LEEF:1.0|Microsoft|MSExchange"); err == nil {
+		t.Error("Expected an error decoding a truncated header")
+	}
+}
+
+func TestLeefEncoder(t *testing.T) {
+	encoder := new(LeefEncoder)
+	conf := encoder.ConfigStruct().(*LeefEncoderConfig)
+	conf.Delimiter = "^"
+	conf.ProductVersion = "0.9"
+	conf.IncludeFields = true
+	if err := encoder.Init(conf); err != nil {
+		t.Fatal(err)
+	}
+	pack := pipeline.NewPipelinePack(nil)
+	msg := pack.Message
+	msg.SetTimestamp(1420070400123000000)
+	msg.SetType("login")
+	msg.SetSeverity(7)
+	message.NewStringField(msg, "usrName", "a^b\\c")
+	message.NewStringField(msg, "sev", "left out")
+
+	output, err := encoder.Encode(pack)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "LEEF:2.0|Mozilla|Heka|0.9|login|^|sev=1^devTime=1420070400123^" +
+		"usrName=a\\^b\\\\c\n"
+	if string(output) != expected {
+		t.Errorf("Unexpected output: %q", output)
+	}
+	decoded, err := decodeLeef(t, nil, string(output))
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, _ := decoded.GetFieldValue("usrName")
+	if decoded.GetTimestamp() != msg.GetTimestamp() || user != "a^b\\c" {
+		t.Errorf("Unexpected message: %s", decoded)
+	}
+
+	// LEEF 1.0 events are tab delimited, and don't name their delimiter.
+	conf.Version = "1.0"
+	if err = encoder.Init(conf); err == nil {
+		t.Error("Expected an error with a LEEF 1.0 delimiter")
+	}
+	conf.Delimiter = "x09"
+	if err = encoder.Init(conf); err != nil {
+		t.Fatal(err)
+	}
+	if output, err = encoder.Encode(pack); err != nil {
+		t.Fatal(err)
+	}
+	expected = "LEEF:1.0|Mozilla|Heka|0.9|login|sev=1\tdevTime=1420070400123\t" +
+		"usrName=a^b\\\\c\n"
+	if string(output) != expected {
+		t.Errorf("Unexpected output: %q", output)
+	}
+	conf.Attributes = map[string]string{"sev": "Severity"}
+	if err = encoder.Init(conf); err == nil {
+		t.Error("Expected an error with a `sev` attribute")
+	}
+}
@@ -17,13 +17,19 @@
 package smtp
 
 import (
+	"bytes"
+	"crypto/tls"
 	"encoding/base64"
 	"errors"
 	"fmt"
+	"github.com/mozilla-services/heka/message"
 	. "github.com/mozilla-services/heka/pipeline"
+	"github.com/mozilla-services/heka/plugins/tcp"
 	"net"
 	"net/smtp"
+	"sort"
 	"strings"
+	"text/template"
 	"time"
 )
 
@@ -31,10 +37,14 @@ type SmtpOutput struct {
 	conf         *SmtpOutputConfig
 	auth         smtp.Auth
 	sendFunction func(addr string, a smtp.Auth, from string, to []string, msg []byte) error
-	inMessage    chan []byte
 	or           OutputRunner
-	fullMsg      []byte
-	headerLen    int
+	tlsConfig    *tls.Config
+	subject      *template.Template
+	body         *template.Template
+	// Messages waiting to be sent, by recipient list.
+	batches map[string]*mailBatch
+	// Swapped out in tests.
+	now func() time.Time
 }
 
 type SmtpOutputConfig struct {
@@ -42,8 +52,12 @@ type SmtpOutputConfig struct {
 	SendFrom string `toml:"send_from"`
 	// email addresses to send the output to
 	SendTo []string `toml:"send_to"`
-	// User defined email subject line
+	// User defined email subject line, a Go text/template rendered with the
+	// first message of the email.
 	Subject string
+	// Go text/template rendering the body of each message, instead of the
+	// output's encoder.
+	Template string
 	// SMTP Host
 	Host string
 	// SMTP Authentication type
@@ -57,19 +71,77 @@ type SmtpOutputConfig struct {
 	// is received in the period, the mail text is concatenated. Default is 0,
 	// meaning no limit.
 	SendInterval uint `toml:"send_interval"`
+	// Digest mode: messages are batched into one email until there are
+	// `digest_count` of them or `digest_interval` seconds have passed since
+	// the first one. 0 disables either trigger.
+	DigestCount    int  `toml:"digest_count"`
+	DigestInterval uint `toml:"digest_interval"`
+	// Name of the message field whose value selects the recipients in
+	// `recipients`. Messages without a listed value are sent to `send_to`.
+	RecipientField string `toml:"recipient_field"`
+	Recipients     map[string][]string
+	// "opportunistic" (STARTTLS when the server offers it), "starttls"
+	// (STARTTLS required), "tls" (implicit TLS), or "none".
+	TlsMode string `toml:"tls_mode"`
+	// TLS settings, e.g. a client certificate.
+	Tls tcp.TlsConfig
+	// Seconds to wait for the connection to the server.
+	ConnectTimeout uint `toml:"connect_timeout"`
 }
 
-type smtpHeader struct {
-	name  string
-	value string
+// Bodies of the messages to be sent in the next email to a recipient list.
+type mailBatch struct {
+	to       []string
+	subject  string
+	bodies   [][]byte
+	first    time.Time
+	lastSent time.Time
+}
+
+// The message values available to templates.
+type templateMessage struct {
+	Uuid       string
+	Timestamp  time.Time
+	Type       string
+	Logger     string
+	Severity   int32
+	Payload    string
+	EnvVersion string
+	Pid        int32
+	Hostname   string
+	// First value of each field, by name.
+	Fields map[string]interface{}
+}
+
+func newTemplateMessage(msg *message.Message) *templateMessage {
+	tm := &templateMessage{
+		Uuid:       msg.GetUuidString(),
+		Timestamp:  time.Unix(0, msg.GetTimestamp()).UTC(),
+		Type:       msg.GetType(),
+		Logger:     msg.GetLogger(),
+		Severity:   msg.GetSeverity(),
+		Payload:    msg.GetPayload(),
+		EnvVersion: msg.GetEnvVersion(),
+		Pid:        msg.GetPid(),
+		Hostname:   msg.GetHostname(),
+		Fields:     make(map[string]interface{}, len(msg.Fields)),
+	}
+	for _, f := range msg.Fields {
+		if _, ok := tm.Fields[f.GetName()]; !ok {
+			tm.Fields[f.GetName()] = f.GetValue()
+		}
+	}
+	return tm
 }
 
 func (s *SmtpOutput) ConfigStruct() interface{} {
 	return &SmtpOutputConfig{
-		SendFrom:     "heka@localhost.localdomain",
-		Host:         "127.0.0.1:25",
-		Auth:         "none",
-		SendInterval: 0,
+		SendFrom:       "heka@localhost.localdomain",
+		Host:           "127.0.0.1:25",
+		Auth:           "none",
+		SendInterval:   0,
+		TlsMode:        "opportunistic",
+		ConnectTimeout: 30,
 	}
 }
 
@@ -85,7 +157,7 @@ func (s *SmtpOutput) Init(config interface{}) (err error) {
 		return fmt.Errorf("Host must contain a port specifier")
 	}
 
-	s.sendFunction = smtp.SendMail
+	s.sendFunction = s.sendMail
 
 	if s.conf.Auth == "Plain" {
 		s.auth = smtp.PlainAuth("", s.conf.User, s.conf.Password, host)
@@ -96,130 +168,255 @@ func (s *SmtpOutput) Init(config interface{}) (err error) {
 	} else {
 		return fmt.Errorf("Invalid auth type: %s", s.conf.Auth)
 	}
+
+	switch s.conf.TlsMode {
+	case "opportunistic", "starttls", "tls", "none":
+	default:
+		return fmt.Errorf("Invalid tls_mode: %s", s.conf.TlsMode)
+	}
+	if s.tlsConfig, err = tcp.CreateGoTlsConfig(&s.conf.Tls); err != nil {
+		return fmt.Errorf("TLS init error: %s", err)
+	}
+	if s.tlsConfig.ServerName == "" {
+		s.tlsConfig.ServerName = host
+	}
+
+	if s.conf.Subject != "" {
+		if s.subject, err = template.New("subject").Parse(s.conf.Subject); err != nil {
+			return fmt.Errorf("Invalid subject template: %s", err)
+		}
+	}
+	if s.conf.Template != "" {
+		if s.body, err = template.New("body").Parse(s.conf.Template); err != nil {
+			return fmt.Errorf("Invalid template: %s", err)
+		}
+	}
+	if s.conf.DigestCount < 0 {
+		return errors.New("digest_count must not be negative")
+	}
+	if len(s.conf.Recipients) > 0 && s.conf.RecipientField == "" {
+		return errors.New("recipients requires a recipient_field")
+	}
+	s.batches = make(map[string]*mailBatch)
+	s.now = time.Now
 	return
 }
 
 func (s *SmtpOutput) Run(or OutputRunner, h PluginHelper) (err error) {
-	var (
-		pack     *PipelinePack
-		contents []byte
-	)
 	s.or = or
-	if or.Encoder() == nil {
-		return errors.New("encoder required")
+	if s.body == nil && or.Encoder() == nil {
+		return errors.New("encoder or template required")
 	}
 
-	inChan := or.InChan()
-	s.fullMsg = s.getHeader()
-	s.headerLen = len(s.fullMsg)
-
-	if s.conf.SendInterval != 0 {
-		// Start sender. This will receive messages on the s.inMessage channel.
-		s.inMessage = make(chan []byte, 1)
-		go s.sendLoop()
+	// Batches are only needed when emails can't be sent right away.
+	var tick <-chan time.Time
+	if s.batching() {
+		ticker := time.NewTicker(250 * time.Millisecond)
+		defer ticker.Stop()
+		tick = ticker.C
 	}
 
-	for pack = range inChan {
-		contents, err = or.Encode(pack)
-		if contents == nil || err != nil {
-			if err != nil {
-				or.LogError(fmt.Errorf("encoding error: %s", err.Error()))
+	inChan := or.InChan()
+	for {
+		select {
+		case pack, ok := <-inChan:
+			if !ok {
+				s.flush(true)
+				return nil
 			}
+			s.add(pack)
 			pack.Recycle()
-			continue
+			s.flush(false)
+		case <-tick:
+			s.flush(false)
+		}
+	}
+}
+
+func (s *SmtpOutput) batching() bool {
+	return s.conf.SendInterval > 0 || s.conf.DigestCount > 0 || s.conf.DigestInterval > 0
+}
+
+// Renders a message and adds it to the batch of its recipients.
+func (s *SmtpOutput) add(pack *PipelinePack) {
+	var (
+		contents []byte
+		err      error
+		tm       *templateMessage
+	)
+	if s.body != nil || s.subject != nil {
+		tm = newTemplateMessage(pack.Message)
+	}
+	if s.body != nil {
+		var buf bytes.Buffer
+		if err = s.body.Execute(&buf, tm); err == nil {
+			contents = buf.Bytes()
+		}
+	} else {
+		contents, err = s.or.Encode(pack)
+	}
+	if contents == nil || err != nil {
+		if err != nil {
+			s.or.LogError(fmt.Errorf("encoding error: %s", err.Error()))
 		}
+		return
+	}
+
+	to := s.recipients(pack.Message)
+	key := strings.Join(to, ",")
+	batch, ok := s.batches[key]
+	if !ok {
+		batch = &mailBatch{to: to}
+		s.batches[key] = batch
+	}
+	if len(batch.bodies) == 0 {
+		batch.first = s.now()
+		batch.subject = s.renderSubject(tm)
+	}
+	batch.bodies = append(batch.bodies, contents)
+}
 
-		// We run this direct output if no minimum interval has been requested.
-		if s.conf.SendInterval == 0 {
-			err = s.sendMail(contents)
-			if err != nil {
-				or.LogError(fmt.Errorf("sending error: %s", err.Error()))
+// Returns the recipients of a message, sorted.
+func (s *SmtpOutput) recipients(msg *message.Message) []string {
+	to := s.conf.SendTo
+	if s.conf.RecipientField != "" {
+		if value, ok := msg.GetFieldValue(s.conf.RecipientField); ok {
+			if routed, ok := s.conf.Recipients[fmt.Sprint(value)]; ok {
+				to = routed
 			}
-		} else {
-			s.inMessage <- contents
 		}
-		pack.Recycle()
 	}
-	return nil
+	sorted := make([]string, len(to))
+	copy(sorted, to)
+	sort.Strings(sorted)
+	return sorted
 }
 
-func (s SmtpOutput) sendMail(contents []byte) error {
-	encodedLen := base64.StdEncoding.EncodedLen(len(contents))
-	if cap(s.fullMsg) < s.headerLen+encodedLen {
-		newFullMsg := make([]byte, s.headerLen+encodedLen)
-		copy(newFullMsg, s.fullMsg[:s.headerLen])
-		s.fullMsg = newFullMsg
+func (s *SmtpOutput) renderSubject(tm *templateMessage) string {
+	if s.subject == nil {
+		return fmt.Sprintf("Heka [%s]", s.or.Name())
+	}
+	var buf bytes.Buffer
+	if err := s.subject.Execute(&buf, tm); err != nil {
+		s.or.LogError(fmt.Errorf("subject template error: %s", err))
+		return s.conf.Subject
 	}
-	s.fullMsg = s.fullMsg[:s.headerLen+encodedLen]
-	base64.StdEncoding.Encode(s.fullMsg[s.headerLen:], contents)
-	return s.sendFunction(s.conf.Host, s.auth, s.conf.SendFrom, s.conf.SendTo, s.fullMsg)
+	// Header values must stay on a single line.
+	return strings.Join(strings.Fields(buf.String()), " ")
 }
 
-func (s SmtpOutput) getHeader() []byte {
-	var subject string
-	if s.conf.Subject != "" {
-		subject = s.conf.Subject
-	} else {
-		subject = fmt.Sprintf("Heka [%s]", s.or.Name())
+// Sends the batches that are due, or all of them when the output stops.
+func (s *SmtpOutput) flush(all bool) {
+	now := s.now()
+	for _, batch := range s.batches {
+		if len(batch.bodies) == 0 || (!all && !s.due(batch, now)) {
+			continue
+		}
+		contents := bytes.Join(batch.bodies, []byte("\r\n\r\n"))
+		err := s.sendFunction(s.conf.Host, s.auth, s.conf.SendFrom, batch.to,
+			s.compose(batch.subject, contents))
+		if err != nil {
+			s.or.LogError(fmt.Errorf("sending error: %s", err.Error()))
+		}
+		batch.bodies = batch.bodies[:0]
+		batch.lastSent = now
 	}
-	headers := make([]string, 5)
-	headers[0] = "From: " + s.conf.SendFrom
-	headers[1] = "Subject: " + subject
-	headers[2] = "MIME-Version: 1.0"
-	headers[3] = "Content-Type: text/plain; charset=\"utf-8\""
-	headers[4] = "Content-Transfer-Encoding: base64"
-	return []byte(strings.Join(headers, "\r\n") + "\r\n\r\n")
 }
 
-func (s *SmtpOutput) sendLoop() {
-	var err error
+// Returns whether a batch is complete and its send interval has passed.
+func (s *SmtpOutput) due(batch *mailBatch, now time.Time) bool {
+	interval := time.Duration(s.conf.SendInterval) * time.Second
+	if now.Before(batch.lastSent.Add(interval)) {
+		return false
+	}
+	if s.conf.DigestCount == 0 && s.conf.DigestInterval == 0 {
+		return true
+	}
+	if s.conf.DigestCount > 0 && len(batch.bodies) >= s.conf.DigestCount {
+		return true
+	}
+	digestInterval := time.Duration(s.conf.DigestInterval) * time.Second
+	return s.conf.DigestInterval > 0 && !now.Before(batch.first.Add(digestInterval))
+}
 
-	// Bodies of all currently queued messages that will be sent in the next mail
-	var queue []byte
-	// Channel to indicate that timeout has been reached
-	timeOut := make(chan bool, 1)
-	// Minimum duration between each email
-	tickerDur := time.Second * time.Duration(s.conf.SendInterval)
-	// Time indicating when the last message was sent.
-	lastSent := time.Now().Add(-tickerDur)
+// Returns an email with the provided subject and base64 encoded contents.
+func (s *SmtpOutput) compose(subject string, contents []byte) []byte {
+	headers := []string{
+		"From: " + s.conf.SendFrom,
+		"Subject: " + subject,
+		"MIME-Version: 1.0",
+		"Content-Type: text/plain; charset=\"utf-8\"",
+		"Content-Transfer-Encoding: base64",
+	}
+	header := strings.Join(headers, "\r\n") + "\r\n\r\n"
+	mail := make([]byte, len(header)+base64.StdEncoding.EncodedLen(len(contents)))
+	copy(mail, header)
+	base64.StdEncoding.Encode(mail[len(header):], contents)
+	return mail
+}
 
-	for {
-		select {
-		case msg := <-s.inMessage:
-			// If none are queued, and we are after the ticker duration, just
-			// send it right away.
-			if len(queue) == 0 && time.Now().After(lastSent.Add(tickerDur)) {
-				err = s.sendMail(msg)
-				lastSent = time.Now()
-				if err != nil {
-					s.or.LogError(err)
-				}
-				continue
-			}
-			if len(queue) == 0 {
-				// The ticker duration has not expired yet, but no messages
-				// are queued, so we start a timeout function that will fire
-				// when the duration has passed.
-				go func() {
-					dur := lastSent.Sub(time.Now()) + tickerDur
-					time.Sleep(dur)
-					timeOut <- true
-				}()
-			}
-			queue = append(queue, msg...)
-			queue = append(queue, []byte("\r\n\r\n")...)
-		case <-timeOut:
-			// When the timeout has expired, send the messages that are
-			// queued.
-			contents := queue[:len(queue)-4]
-			queue = queue[:0]
-			err = s.sendMail(contents)
-			lastSent = time.Now()
-			if err != nil {
-				s.or.LogError(err)
+// Sends an email like smtp.SendMail, according to the output's TLS mode and
+// settings.
+func (s *SmtpOutput) sendMail(addr string, a smtp.Auth, from string, to []string,
+	msg []byte) error {
+
+	host, _, _ := net.SplitHostPort(addr)
+	dialer := &net.Dialer{Timeout: time.Duration(s.conf.ConnectTimeout) * time.Second}
+	var (
+		conn net.Conn
+		err  error
+	)
+	if s.conf.TlsMode == "tls" {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, s.tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return err
+	}
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if s.conf.TlsMode == "opportunistic" || s.conf.TlsMode == "starttls" {
+		if ok, _ := c.Extension("STARTTLS"); ok {
+			if err = c.StartTLS(s.tlsConfig); err != nil {
+				return err
 			}
+		} else if s.conf.TlsMode == "starttls" {
+			return errors.New("server doesn't support STARTTLS")
 		}
 	}
+	if a != nil {
+		if ok, _ := c.Extension("AUTH"); !ok {
+			return errors.New("server doesn't support AUTH")
+		}
+		if err = c.Auth(a); err != nil {
+			return err
+		}
+	}
+	if err = c.Mail(from); err != nil {
+		return err
+	}
+	for _, addr := range to {
+		if err = c.Rcpt(addr); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(msg); err != nil {
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
 }
 
 func init() {
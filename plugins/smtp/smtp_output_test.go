@@ -17,7 +17,9 @@ package smtp
 
 import (
 	"bytes"
+	"encoding/base64"
 	"fmt"
+	"github.com/mozilla-services/heka/message"
 	. "github.com/mozilla-services/heka/pipeline"
 	pipeline_ts "github.com/mozilla-services/heka/pipeline/testsupport"
 	"github.com/mozilla-services/heka/plugins"
@@ -25,9 +27,10 @@ import (
 	"github.com/rafrombrc/gomock/gomock"
 	gs "github.com/rafrombrc/gospec/src/gospec"
 	"net/smtp"
+	"strings"
 	"sync"
 	"testing"
-	//"time"
+	"time"
 )
 
 var sendCount int
@@ -109,6 +112,113 @@ func SmtpOutputSpec(c gs.Context) {
 		})
 	})
 
+	c.Specify("A templated SmtpOutput", func() {
+		smtpOutput := new(SmtpOutput)
+		config := smtpOutput.ConfigStruct().(*SmtpOutputConfig)
+		config.SendTo = []string{"root"}
+		config.Subject = "{{.Severity}} from {{.Hostname}}"
+		config.Template = "{{.Logger}}: {{.Payload}} ({{index .Fields \"team\"}})"
+		config.RecipientField = "team"
+		config.Recipients = map[string][]string{"db": {"dba@example.com", "alice@example.com"}}
+
+		type sent struct {
+			to   []string
+			mail string
+		}
+		var mails []sent
+		now := time.Unix(1000, 0)
+
+		newPack := func(payload, team string) *PipelinePack {
+			pack := NewPipelinePack(pConfig.InputRecycleChan())
+			pack.Message.SetHostname("db1")
+			pack.Message.SetLogger("Alerts")
+			pack.Message.SetSeverity(2)
+			pack.Message.SetPayload(payload)
+			message.NewStringField(pack.Message, "team", team)
+			return pack
+		}
+		setup := func() {
+			c.Assume(smtpOutput.Init(config), gs.IsNil)
+			smtpOutput.or = oth.MockOutputRunner
+			smtpOutput.now = func() time.Time { return now }
+			smtpOutput.sendFunction = func(addr string, a smtp.Auth, from string,
+				to []string, msg []byte) error {
+
+				mails = append(mails, sent{to, string(msg)})
+				return nil
+			}
+		}
+		body := func(mail string) string {
+			parts := strings.SplitN(mail, "\r\n\r\n", 2)
+			decoded, _ := base64.StdEncoding.DecodeString(parts[1])
+			return string(decoded)
+		}
+
+		c.Specify("renders templates and routes by field", func() {
+			setup()
+			smtpOutput.add(newPack("disk full", "db"))
+			smtpOutput.add(newPack("cpu hot", "web"))
+			smtpOutput.flush(false)
+			c.Assume(len(mails), gs.Equals, 2)
+			for _, m := range mails {
+				c.Expect(strings.Contains(m.mail, "\r\nSubject: 2 from db1\r\n"), gs.IsTrue)
+				if m.to[0] == "root" {
+					c.Expect(body(m.mail), gs.Equals, "Alerts: cpu hot (web)")
+				} else {
+					c.Expect(m.to[0], gs.Equals, "alice@example.com")
+					c.Expect(m.to[1], gs.Equals, "dba@example.com")
+					c.Expect(body(m.mail), gs.Equals, "Alerts: disk full (db)")
+				}
+			}
+		})
+
+		c.Specify("batches digests by count and interval", func() {
+			config.DigestCount = 3
+			config.DigestInterval = 60
+			setup()
+			smtpOutput.add(newPack("one", "web"))
+			smtpOutput.add(newPack("two", "web"))
+			smtpOutput.flush(false)
+			c.Expect(len(mails), gs.Equals, 0)
+			smtpOutput.add(newPack("three", "web"))
+			smtpOutput.flush(false)
+			c.Assume(len(mails), gs.Equals, 1)
+			c.Expect(body(mails[0].mail), gs.Equals,
+				"Alerts: one (web)\r\n\r\nAlerts: two (web)\r\n\r\nAlerts: three (web)")
+
+			smtpOutput.add(newPack("four", "web"))
+			now = now.Add(59 * time.Second)
+			smtpOutput.flush(false)
+			c.Expect(len(mails), gs.Equals, 1)
+			now = now.Add(time.Second)
+			smtpOutput.flush(false)
+			c.Assume(len(mails), gs.Equals, 2)
+			c.Expect(body(mails[1].mail), gs.Equals, "Alerts: four (web)")
+		})
+
+		c.Specify("waits for the send interval", func() {
+			config.SendInterval = 10
+			setup()
+			smtpOutput.add(newPack("one", "web"))
+			smtpOutput.flush(false)
+			smtpOutput.add(newPack("two", "web"))
+			smtpOutput.flush(false)
+			c.Expect(len(mails), gs.Equals, 1)
+			now = now.Add(10 * time.Second)
+			smtpOutput.flush(false)
+			c.Assume(len(mails), gs.Equals, 2)
+			c.Expect(body(mails[1].mail), gs.Equals, "Alerts: two (web)")
+		})
+
+		c.Specify("rejects invalid settings", func() {
+			config.TlsMode = "sometimes"
+			c.Expect(smtpOutput.Init(config), gs.Not(gs.IsNil))
+			config.TlsMode = "starttls"
+			config.Template = "{{.Payload"
+			c.Expect(smtpOutput.Init(config), gs.Not(gs.IsNil))
+		})
+	})
+
 	// // Use this test with a real server
 	// c.Specify("Real SmtpOutput output", func() {
 	// 	smtpOutput := new(SmtpOutput)
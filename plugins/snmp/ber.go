@@ -0,0 +1,204 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package snmp
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Decoding of the subset of ASN.1 BER used by SNMP.
+
+// BER tags of the SNMP types and PDUs.
+const (
+	tagInteger     = 0x02
+	tagOctetString = 0x04
+	tagNull        = 0x05
+	tagOID         = 0x06
+	tagSequence    = 0x30
+
+	tagIpAddress = 0x40
+	tagCounter32 = 0x41
+	tagGauge32   = 0x42
+	tagTimeTicks = 0x43
+	tagOpaque    = 0x44
+	tagCounter64 = 0x46
+
+	tagNoSuchObject   = 0x80
+	tagNoSuchInstance = 0x81
+	tagEndOfMibView   = 0x82
+
+	tagResponse = 0xa2
+	tagTrapV1   = 0xa4
+	tagInform   = 0xa6
+	tagTrapV2   = 0xa7
+)
+
+var errTruncated = errors.New("truncated BER value")
+
+// Reads the tag-length-value element at the start of data, returning its
+// tag, its contents, and the data following it.
+func readTLV(data []byte) (tag byte, content, rest []byte, err error) {
+	if len(data) < 2 {
+		return 0, nil, nil, errTruncated
+	}
+	tag = data[0]
+	length := int(data[1])
+	data = data[2:]
+	if length&0x80 != 0 {
+		n := length & 0x7f
+		if n == 0 || n > 4 || len(data) < n {
+			return 0, nil, nil, fmt.Errorf("invalid BER length of tag 0x%x", tag)
+		}
+		length = 0
+		for _, b := range data[:n] {
+			length = length<<8 | int(b)
+		}
+		data = data[n:]
+	}
+	if length < 0 || length > len(data) {
+		return 0, nil, nil, errTruncated
+	}
+	return tag, data[:length], data[length:], nil
+}
+
+// Reads an element that must have the specified tag.
+func expectTLV(data []byte, want byte, what string) (content, rest []byte, err error) {
+	tag, content, rest, err := readTLV(data)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %s", what, err)
+	}
+	if tag != want {
+		return nil, nil, fmt.Errorf("%s: unexpected tag 0x%x", what, tag)
+	}
+	return content, rest, nil
+}
+
+// Reads an INTEGER element.
+func readInt(data []byte, what string) (int64, []byte, error) {
+	content, rest, err := expectTLV(data, tagInteger, what)
+	if err != nil {
+		return 0, nil, err
+	}
+	v, err := decodeInt(content)
+	if err != nil {
+		return 0, nil, fmt.Errorf("%s: %s", what, err)
+	}
+	return v, rest, nil
+}
+
+// Decodes the contents of a signed integer.
+func decodeInt(content []byte) (int64, error) {
+	if len(content) == 0 || len(content) > 8 {
+		return 0, fmt.Errorf("invalid integer length %d", len(content))
+	}
+	v := int64(int8(content[0]))
+	for _, b := range content[1:] {
+		v = v<<8 | int64(b)
+	}
+	return v, nil
+}
+
+// Decodes the contents of an unsigned integer, e.g. a Counter64. The sign
+// byte BER adds to values with the high bit set is allowed.
+func decodeUint(content []byte) (uint64, error) {
+	if len(content) > 0 && content[0] == 0 {
+		content = content[1:]
+	}
+	if len(content) > 8 {
+		return 0, fmt.Errorf("invalid unsigned integer length %d", len(content))
+	}
+	var v uint64
+	for _, b := range content {
+		v = v<<8 | uint64(b)
+	}
+	return v, nil
+}
+
+// An object identifier, e.g. 1.3.6.1.2.1.1.3.0.
+type oid []uint32
+
+func (o oid) String() string {
+	parts := make([]string, len(o))
+	for i, n := range o {
+		parts[i] = strconv.FormatUint(uint64(n), 10)
+	}
+	return strings.Join(parts, ".")
+}
+
+func (o oid) equal(other oid) bool {
+	return len(o) == len(other) && o.hasPrefix(other)
+}
+
+func (o oid) hasPrefix(prefix oid) bool {
+	if len(prefix) > len(o) {
+		return false
+	}
+	for i, n := range prefix {
+		if o[i] != n {
+			return false
+		}
+	}
+	return true
+}
+
+// Parses the dotted form of an object identifier.
+func parseOID(s string) (oid, error) {
+	s = strings.TrimPrefix(s, ".")
+	parts := strings.Split(s, ".")
+	o := make(oid, len(parts))
+	for i, part := range parts {
+		n, err := strconv.ParseUint(part, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid OID '%s'", s)
+		}
+		o[i] = uint32(n)
+	}
+	return o, nil
+}
+
+// Decodes the contents of an OBJECT IDENTIFIER.
+func decodeOID(content []byte) (oid, error) {
+	if len(content) == 0 {
+		return nil, errors.New("empty OID")
+	}
+	var (
+		o oid
+		n uint64
+	)
+	for i, b := range content {
+		n = n<<7 | uint64(b&0x7f)
+		if n > 0xffffffff {
+			return nil, errors.New("OID component overflow")
+		}
+		if b&0x80 != 0 {
+			if i == len(content)-1 {
+				return nil, errTruncated
+			}
+			continue
+		}
+		if len(o) == 0 {
+			// The first component encodes the first two arcs.
+			first := n / 40
+			if first > 2 {
+				first = 2
+			}
+			o = append(o, uint32(first), uint32(n-first*40))
+		} else {
+			o = append(o, uint32(n))
+		}
+		n = 0
+	}
+	return o, nil
+}
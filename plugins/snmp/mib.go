@@ -0,0 +1,267 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package snmp
+
+import (
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Names of the objects in the standard MIBs most traps refer to, so traps
+// are readable without loading any MIB file.
+const builtinMIB = `
+iso OBJECT IDENTIFIER ::= { 1 }
+org OBJECT IDENTIFIER ::= { iso 3 }
+dod OBJECT IDENTIFIER ::= { org 6 }
+internet OBJECT IDENTIFIER ::= { dod 1 }
+mgmt OBJECT IDENTIFIER ::= { internet 2 }
+mib-2 OBJECT IDENTIFIER ::= { mgmt 1 }
+system OBJECT IDENTIFIER ::= { mib-2 1 }
+sysDescr OBJECT IDENTIFIER ::= { system 1 }
+sysObjectID OBJECT IDENTIFIER ::= { system 2 }
+sysUpTime OBJECT IDENTIFIER ::= { system 3 }
+sysContact OBJECT IDENTIFIER ::= { system 4 }
+sysName OBJECT IDENTIFIER ::= { system 5 }
+sysLocation OBJECT IDENTIFIER ::= { system 6 }
+interfaces OBJECT IDENTIFIER ::= { mib-2 2 }
+ifTable OBJECT IDENTIFIER ::= { interfaces 2 }
+ifEntry OBJECT IDENTIFIER ::= { ifTable 1 }
+ifIndex OBJECT IDENTIFIER ::= { ifEntry 1 }
+ifDescr OBJECT IDENTIFIER ::= { ifEntry 2 }
+ifType OBJECT IDENTIFIER ::= { ifEntry 3 }
+ifAdminStatus OBJECT IDENTIFIER ::= { ifEntry 7 }
+ifOperStatus OBJECT IDENTIFIER ::= { ifEntry 8 }
+private OBJECT IDENTIFIER ::= { internet 4 }
+enterprises OBJECT IDENTIFIER ::= { private 1 }
+snmpV2 OBJECT IDENTIFIER ::= { internet 6 }
+snmpModules OBJECT IDENTIFIER ::= { snmpV2 3 }
+snmpMIB OBJECT IDENTIFIER ::= { snmpModules 1 }
+snmpMIBObjects OBJECT IDENTIFIER ::= { snmpMIB 1 }
+snmpTrap OBJECT IDENTIFIER ::= { snmpMIBObjects 4 }
+snmpTrapOID OBJECT IDENTIFIER ::= { snmpTrap 1 }
+snmpTrapEnterprise OBJECT IDENTIFIER ::= { snmpTrap 3 }
+snmpTraps OBJECT IDENTIFIER ::= { snmpMIBObjects 5 }
+coldStart OBJECT IDENTIFIER ::= { snmpTraps 1 }
+warmStart OBJECT IDENTIFIER ::= { snmpTraps 2 }
+linkDown OBJECT IDENTIFIER ::= { snmpTraps 3 }
+linkUp OBJECT IDENTIFIER ::= { snmpTraps 4 }
+authenticationFailure OBJECT IDENTIFIER ::= { snmpTraps 5 }
+egpNeighborLoss OBJECT IDENTIFIER ::= { snmpTraps 6 }
+`
+
+// Macros defining an object, the name preceding them is the object's.
+var definingMacros = map[string]bool{
+	"OBJECT-TYPE":        true,
+	"MODULE-IDENTITY":    true,
+	"OBJECT-IDENTITY":    true,
+	"NOTIFICATION-TYPE":  true,
+	"OBJECT-GROUP":       true,
+	"NOTIFICATION-GROUP": true,
+	"MODULE-COMPLIANCE":  true,
+	"AGENT-CAPABILITIES": true,
+	"TRAP-TYPE":          true,
+}
+
+// An object definition, whose OID is its parent's followed by the path.
+type definition struct {
+	name   string
+	parent string
+	path   oid
+}
+
+// Object names, from the built-in definitions and the loaded MIB files.
+type mib struct {
+	oids    map[string]oid
+	names   map[string]string
+	pending []definition
+}
+
+func newMIB() *mib {
+	m := &mib{
+		oids:  make(map[string]oid),
+		names: make(map[string]string),
+	}
+	m.load(builtinMIB)
+	return m
+}
+
+// Loads the object definitions of a MIB module. Definitions whose parents
+// aren't known yet are kept until a module defining them is loaded.
+func (m *mib) load(text string) {
+	m.pending = append(m.pending, parseMIB(text)...)
+	for progress := true; progress; {
+		progress = false
+		pending := m.pending[:0]
+		for _, def := range m.pending {
+			parent, ok := m.oids[def.parent]
+			if def.parent != "" && !ok {
+				pending = append(pending, def)
+				continue
+			}
+			o := append(append(oid{}, parent...), def.path...)
+			m.oids[def.name] = o
+			m.names[o.String()] = def.name
+			progress = true
+		}
+		m.pending = pending
+	}
+}
+
+// Returns the name of the object an OID belongs to, followed by the OID's
+// instance suffix, e.g. "ifIndex.2", or the dotted OID if it's unknown.
+func (m *mib) resolve(o oid) string {
+	for n := len(o); n > 0; n-- {
+		if name, ok := m.names[o[:n].String()]; ok {
+			if n == len(o) {
+				return name
+			}
+			return name + "." + o[n:].String()
+		}
+	}
+	return o.String()
+}
+
+// Splits the text of a MIB module into tokens, dropping comments and
+// quoted strings.
+func tokenizeMIB(text string) []string {
+	var tokens []string
+	for i := 0; i < len(text); {
+		c := text[i]
+		switch {
+		case c == '-' && i+1 < len(text) && text[i+1] == '-':
+			end := strings.IndexByte(text[i:], '\n')
+			if end < 0 {
+				return tokens
+			}
+			i += end + 1
+		case c == '"':
+			end := strings.IndexByte(text[i+1:], '"')
+			if end < 0 {
+				return tokens
+			}
+			i += end + 2
+		case strings.HasPrefix(text[i:], "::="):
+			tokens = append(tokens, "::=")
+			i += 3
+		case isIdentChar(c):
+			start := i
+			for i < len(text) && isIdentChar(text[i]) && !strings.HasPrefix(text[i:], "--") {
+				i++
+			}
+			tokens = append(tokens, text[start:i])
+		case unicode.IsSpace(rune(c)):
+			i++
+		default:
+			tokens = append(tokens, text[i:i+1])
+			i++
+		}
+	}
+	return tokens
+}
+
+func isIdentChar(c byte) bool {
+	return c == '-' || c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' ||
+		c >= '0' && c <= '9'
+}
+
+// Returns the object definitions of a MIB module.
+func parseMIB(text string) []definition {
+	tokens := tokenizeMIB(text)
+	var defs []definition
+	for i := 0; i+2 < len(tokens); i++ {
+		name := tokens[i]
+		if !unicode.IsLower(rune(name[0])) {
+			continue
+		}
+		var end int
+		switch {
+		case tokens[i+1] == "OBJECT" && tokens[i+2] == "IDENTIFIER":
+			// Elsewhere, e.g. in SEQUENCEs, this is the type of a column.
+			if i+3 >= len(tokens) || tokens[i+3] != "::=" {
+				continue
+			}
+			end = i + 3
+		case definingMacros[tokens[i+1]]:
+			for end = i + 2; end < len(tokens) && tokens[end] != "::="; end++ {
+			}
+			if end == len(tokens) {
+				return defs
+			}
+		default:
+			continue
+		}
+
+		if tokens[i+1] == "TRAP-TYPE" {
+			// SNMPv1 traps are numbered within their enterprise, see RFC 3584.
+			var enterprise string
+			for j := i + 2; j+1 < end; j++ {
+				if tokens[j] == "ENTERPRISE" {
+					enterprise = tokens[j+1]
+				}
+			}
+			if end+1 < len(tokens) && enterprise != "" {
+				if n, err := strconv.ParseUint(tokens[end+1], 10, 32); err == nil {
+					defs = append(defs, definition{name, enterprise, oid{0, uint32(n)}})
+				}
+			}
+		} else if parsed, ok := parseOIDValue(name, tokens[end+1:]); ok {
+			defs = append(defs, parsed...)
+		}
+		i = end
+	}
+	return defs
+}
+
+// Parses an OID value, e.g. "{ iso org(3) dod(6) 1 }", returning the
+// definition of the object it's assigned to, preceded by the definitions of
+// the named components.
+func parseOIDValue(name string, tokens []string) ([]definition, bool) {
+	if len(tokens) == 0 || tokens[0] != "{" {
+		return nil, false
+	}
+	var (
+		defs   []definition
+		parent string
+		path   oid
+	)
+	for i := 1; i < len(tokens); i++ {
+		token := tokens[i]
+		if token == "}" {
+			if len(path) == 0 {
+				return nil, false
+			}
+			return append(defs, definition{name, parent, path}), true
+		}
+		if n, err := strconv.ParseUint(token, 10, 32); err == nil {
+			path = append(path, uint32(n))
+			continue
+		}
+		// A named component, with its number in parentheses.
+		if i+3 < len(tokens) && tokens[i+1] == "(" && tokens[i+3] == ")" {
+			n, err := strconv.ParseUint(tokens[i+2], 10, 32)
+			if err != nil {
+				return nil, false
+			}
+			path = append(path, uint32(n))
+			defs = append(defs, definition{token, parent, append(oid{}, path...)})
+			i += 3
+			continue
+		}
+		// Only the first component may be a parent's name.
+		if i != 1 {
+			return nil, false
+		}
+		parent = token
+	}
+	return nil, false
+}
@@ -0,0 +1,240 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package snmp
+
+import (
+	"errors"
+	"fmt"
+	"net"
+)
+
+var (
+	// sysUpTime.0 and snmpTrapOID.0, the first two varbinds of v2 traps.
+	sysUpTimeOID   = oid{1, 3, 6, 1, 2, 1, 1, 3, 0}
+	snmpTrapOIDOID = oid{1, 3, 6, 1, 6, 3, 1, 1, 4, 1, 0}
+	// Prefix of the standard traps, e.g. coldStart is snmpTrapsOID.1.
+	snmpTrapsOID = oid{1, 3, 6, 1, 6, 3, 1, 1, 5}
+)
+
+// A variable binding, the value is still BER encoded.
+type varbind struct {
+	name  oid
+	tag   byte
+	value []byte
+}
+
+// A received trap or inform.
+type trap struct {
+	version   string // "1", "2c", or "3"
+	community string
+	// SNMPv3 user and context.
+	user        string
+	contextName string
+	inform      bool
+	// SNMPv1 trap fields.
+	enterprise   oid
+	agentAddress string
+	// Uptime of the sender when the trap was sent, in hundredths of a
+	// second, -1 if unknown.
+	uptime   int64
+	trapOID  oid
+	varbinds []varbind
+	// Offset of the PDU in the packet, so informs can be acknowledged.
+	pduOffset int
+}
+
+var errUnsupportedPDU = errors.New("unsupported PDU")
+
+// Decodes a trap or inform, authenticating and decrypting SNMPv3 messages
+// with the users of `sec`.
+func parsePacket(packet []byte, sec *usm) (*trap, error) {
+	msg, _, err := expectTLV(packet, tagSequence, "message")
+	if err != nil {
+		return nil, err
+	}
+	version, rest, err := readInt(msg, "version")
+	if err != nil {
+		return nil, err
+	}
+	t := &trap{uptime: -1}
+	switch version {
+	case 0, 1:
+		t.version = "1"
+		if version == 1 {
+			t.version = "2c"
+		}
+		community, pdu, err := expectTLV(rest, tagOctetString, "community")
+		if err != nil {
+			return nil, err
+		}
+		t.community = string(community)
+		t.pduOffset = cap(packet) - cap(pdu)
+		if err = t.parsePDU(pdu); err != nil {
+			return nil, err
+		}
+	case 3:
+		t.version = "3"
+		scopedPDU, err := sec.process(t, packet, rest)
+		if err != nil {
+			return nil, err
+		}
+		content, _, err := expectTLV(scopedPDU, tagSequence, "scoped PDU")
+		if err != nil {
+			return nil, err
+		}
+		_, rest, err = expectTLV(content, tagOctetString, "context engine ID")
+		if err != nil {
+			return nil, err
+		}
+		contextName, pdu, err := expectTLV(rest, tagOctetString, "context name")
+		if err != nil {
+			return nil, err
+		}
+		t.contextName = string(contextName)
+		if err = t.parsePDU(pdu); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported SNMP version %d", version)
+	}
+	return t, nil
+}
+
+func (t *trap) parsePDU(data []byte) error {
+	tag, pdu, _, err := readTLV(data)
+	if err != nil {
+		return fmt.Errorf("PDU: %s", err)
+	}
+	switch tag {
+	case tagTrapV1:
+		if t.version != "1" {
+			return errUnsupportedPDU
+		}
+		return t.parseV1(pdu)
+	case tagTrapV2, tagInform:
+		if t.version == "1" {
+			return errUnsupportedPDU
+		}
+		t.inform = tag == tagInform
+		return t.parseV2(pdu)
+	}
+	return errUnsupportedPDU
+}
+
+func (t *trap) parseV1(pdu []byte) (err error) {
+	content, rest, err := expectTLV(pdu, tagOID, "enterprise")
+	if err != nil {
+		return
+	}
+	if t.enterprise, err = decodeOID(content); err != nil {
+		return fmt.Errorf("enterprise: %s", err)
+	}
+	content, rest, err = expectTLV(rest, tagIpAddress, "agent address")
+	if err != nil {
+		return
+	}
+	if len(content) == 4 {
+		t.agentAddress = net.IP(content).String()
+	}
+	generic, rest, err := readInt(rest, "generic trap")
+	if err != nil {
+		return
+	}
+	specific, rest, err := readInt(rest, "specific trap")
+	if err != nil {
+		return
+	}
+	content, rest, err = expectTLV(rest, tagTimeTicks, "time stamp")
+	if err != nil {
+		return
+	}
+	uptime, err := decodeUint(content)
+	if err != nil {
+		return fmt.Errorf("time stamp: %s", err)
+	}
+	t.uptime = int64(uptime)
+	// The SNMPv2 equivalent of the trap, see RFC 3584.
+	if generic >= 0 && generic < 6 {
+		t.trapOID = append(append(oid{}, snmpTrapsOID...), uint32(generic+1))
+	} else {
+		t.trapOID = append(append(oid{}, t.enterprise...), 0, uint32(specific))
+	}
+	t.varbinds, err = parseVarbinds(rest)
+	return
+}
+
+func (t *trap) parseV2(pdu []byte) (err error) {
+	rest := pdu
+	for _, what := range []string{"request ID", "error status", "error index"} {
+		if _, rest, err = readInt(rest, what); err != nil {
+			return
+		}
+	}
+	varbinds, err := parseVarbinds(rest)
+	if err != nil {
+		return
+	}
+	// sysUpTime.0 and snmpTrapOID.0 describe the trap itself.
+	for _, vb := range varbinds {
+		switch {
+		case vb.name.equal(sysUpTimeOID) && vb.tag == tagTimeTicks:
+			if uptime, e := decodeUint(vb.value); e == nil {
+				t.uptime = int64(uptime)
+			}
+		case vb.name.equal(snmpTrapOIDOID) && vb.tag == tagOID:
+			if t.trapOID, err = decodeOID(vb.value); err != nil {
+				return fmt.Errorf("snmpTrapOID: %s", err)
+			}
+		default:
+			t.varbinds = append(t.varbinds, vb)
+		}
+	}
+	if t.trapOID == nil {
+		return errors.New("trap has no snmpTrapOID")
+	}
+	return
+}
+
+func parseVarbinds(data []byte) ([]varbind, error) {
+	list, _, err := expectTLV(data, tagSequence, "varbinds")
+	if err != nil {
+		return nil, err
+	}
+	var varbinds []varbind
+	for len(list) > 0 {
+		var content []byte
+		if content, list, err = expectTLV(list, tagSequence, "varbind"); err != nil {
+			return nil, err
+		}
+		name, rest, err := expectTLV(content, tagOID, "varbind name")
+		if err != nil {
+			return nil, err
+		}
+		vb := varbind{}
+		if vb.name, err = decodeOID(name); err != nil {
+			return nil, fmt.Errorf("varbind name: %s", err)
+		}
+		if vb.tag, vb.value, _, err = readTLV(rest); err != nil {
+			return nil, fmt.Errorf("varbind value: %s", err)
+		}
+		varbinds = append(varbinds, vb)
+	}
+	return varbinds, nil
+}
+
+// Returns the response acknowledging an SNMPv2c inform, which is the inform
+// itself with a Response PDU tag.
+func informResponse(packet []byte, t *trap) []byte {
+	response := append([]byte(nil), packet...)
+	response[t.pduOffset] = tagResponse
+	return response
+}
@@ -0,0 +1,425 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package snmp
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/hex"
+	"github.com/mozilla-services/heka/message"
+	"github.com/mozilla-services/heka/pipeline"
+	"github.com/mozilla-services/heka/pipelinemock"
+	"github.com/rafrombrc/gomock/gomock"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// BER encoding of test packets.
+
+func tlv(tag byte, parts ...[]byte) []byte {
+	content := bytes.Join(parts, nil)
+	out := []byte{tag}
+	if len(content) < 0x80 {
+		out = append(out, byte(len(content)))
+	} else {
+		out = append(out, 0x82, byte(len(content)>>8), byte(len(content)))
+	}
+	return append(out, content...)
+}
+
+func integer(v int64) []byte {
+	content := []byte{byte(v)}
+	for v >>= 8; v != 0 && v != -1 || content[0]&0x80 != byte(v)&0x80; v >>= 8 {
+		content = append([]byte{byte(v)}, content...)
+	}
+	return tlv(tagInteger, content)
+}
+
+func octets(s string) []byte {
+	return tlv(tagOctetString, []byte(s))
+}
+
+func objectID(s string) []byte {
+	o, _ := parseOID(s)
+	content := []byte{byte(o[0]*40 + o[1])}
+	for _, n := range o[2:] {
+		var enc []byte
+		for enc = []byte{byte(n & 0x7f)}; n > 0x7f; {
+			n >>= 7
+			enc = append([]byte{byte(n&0x7f | 0x80)}, enc...)
+		}
+		content = append(content, enc...)
+	}
+	return tlv(tagOID, content)
+}
+
+func varbinds(pairs ...[]byte) []byte {
+	var list [][]byte
+	for i := 0; i < len(pairs); i += 2 {
+		list = append(list, tlv(tagSequence, pairs[i], pairs[i+1]))
+	}
+	return tlv(tagSequence, list...)
+}
+
+func v2Trap(version int64, community string, pduTag byte) []byte {
+	return tlv(tagSequence, integer(version), octets(community), tlv(pduTag,
+		integer(1234), integer(0), integer(0), varbinds(
+			objectID("1.3.6.1.2.1.1.3.0"), tlv(tagTimeTicks, []byte{0x01, 0x00}),
+			objectID("1.3.6.1.6.3.1.1.4.1.0"), objectID("1.3.6.1.4.1.9999.0.1"),
+			objectID("1.3.6.1.4.1.9999.1.1.0"), octets("disk full\x00"),
+			objectID("1.3.6.1.4.1.9999.1.2.0"), tlv(tagGauge32, []byte{0x00, 0xfa}),
+			objectID("1.3.6.1.4.1.9999.1.3"), tlv(tagIpAddress, []byte{10, 0, 0, 1}),
+			objectID("1.3.6.1.4.1.9999.1.4.0"), octets("\x00\x1b\x21\x3a\x4f\x5e"),
+			objectID("1.3.6.1.4.1.9999.1.5.0"), tlv(tagNoSuchInstance),
+		)))
+}
+
+const testMIB = `
+ACME-MIB DEFINITIONS ::= BEGIN
+IMPORTS
+    MODULE-IDENTITY, OBJECT-TYPE, NOTIFICATION-TYPE, enterprises
+        FROM SNMPv2-SMI;
+
+acme MODULE-IDENTITY
+    LAST-UPDATED "201501010000Z"
+    ORGANIZATION "Acme -- not a comment"
+    DESCRIPTION  "Acme ::= { enterprises 1 }"
+    ::= { enterprises 9999 }
+
+acmeObjects OBJECT IDENTIFIER ::= { acme 1 }
+acmeNotifications OBJECT IDENTIFIER ::= { acme 0 }
+
+AcmeEntry ::= SEQUENCE {
+    acmeIndex OBJECT IDENTIFIER,
+    acmeLoad  Gauge32
+}
+
+-- acmeFake OBJECT IDENTIFIER ::= { acme 42 }
+acmeMessage OBJECT-TYPE
+    SYNTAX      DisplayString
+    MAX-ACCESS  accessible-for-notify
+    STATUS      current
+    DESCRIPTION "Text of the alert."
+    ::= { acmeObjects 1 }
+
+acmeLoad OBJECT-TYPE
+    SYNTAX      Gauge32 (0..1000)
+    MAX-ACCESS  read-only
+    STATUS      current
+    DEFVAL      { 0 }
+    ::= { acmeObjects 2 }
+
+acmeAlert NOTIFICATION-TYPE
+    OBJECTS     { acmeMessage, acmeLoad }
+    STATUS      current
+    ::= { acmeNotifications 1 }
+
+acmeOldAlert TRAP-TYPE
+    ENTERPRISE  acme
+    VARIABLES   { acmeMessage }
+    ::= 7
+
+acmeLab OBJECT IDENTIFIER ::= { iso org(3) dod(6) internet(1) acmeLabs(7) 2 }
+END
+`
+
+func TestMIB(t *testing.T) {
+	m := newMIB()
+	m.load(testMIB)
+	tests := map[string]string{
+		"1.3.6.1.4.1.9999":         "acme",
+		"1.3.6.1.4.1.9999.1.1.0":   "acmeMessage.0",
+		"1.3.6.1.4.1.9999.1.2.5.3": "acmeLoad.5.3",
+		"1.3.6.1.4.1.9999.0.1":     "acmeAlert",
+		"1.3.6.1.4.1.9999.0.7":     "acmeOldAlert",
+		"1.3.6.1.4.1.9999.42":      "acme.42",
+		"1.3.6.1.7.2":              "acmeLab",
+		"1.3.6.1.7.3":              "acmeLabs.3",
+		"1.3.6.1.6.3.1.1.5.3":      "linkDown",
+		"1.3.6.1.2.1.2.2.1.1.12":   "ifIndex.12",
+		"2.5.4":                    "2.5.4",
+	}
+	for dotted, expected := range tests {
+		o, _ := parseOID(dotted)
+		if name := m.resolve(o); name != expected {
+			t.Errorf("%s resolved to %s, expected %s", dotted, name, expected)
+		}
+	}
+
+	// Definitions are resolved once their parents are loaded.
+	m = newMIB()
+	m.load(`acmeChild OBJECT IDENTIFIER ::= { acmeParent 3 }`)
+	if len(m.pending) != 1 {
+		t.Fatalf("Unexpected pending definitions: %v", m.pending)
+	}
+	m.load(`acmeParent OBJECT IDENTIFIER ::= { enterprises 1 }`)
+	if name := m.resolve(oid{1, 3, 6, 1, 4, 1, 1, 3}); name != "acmeChild" || len(m.pending) != 0 {
+		t.Errorf("Unexpected name %s", name)
+	}
+}
+
+func TestParseV1(t *testing.T) {
+	packet := tlv(tagSequence, integer(0), octets("public"), tlv(tagTrapV1,
+		objectID("1.3.6.1.4.1.9999"), tlv(tagIpAddress, []byte{192, 168, 1, 2}),
+		integer(2), integer(0), tlv(tagTimeTicks, []byte{0x00, 0x80}), varbinds(
+			objectID("1.3.6.1.2.1.2.2.1.1.3"), integer(3),
+		)))
+	tr, err := parsePacket(packet, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tr.version != "1" || tr.community != "public" || tr.agentAddress != "192.168.1.2" ||
+		tr.uptime != 128 || tr.trapOID.String() != "1.3.6.1.6.3.1.1.5.3" ||
+		len(tr.varbinds) != 1 {
+
+		t.Errorf("Unexpected trap: %+v", tr)
+	}
+
+	// Enterprise specific traps.
+	packet = tlv(tagSequence, integer(0), octets("public"), tlv(tagTrapV1,
+		objectID("1.3.6.1.4.1.9999"), tlv(tagIpAddress, []byte{192, 168, 1, 2}),
+		integer(6), integer(7), tlv(tagTimeTicks, []byte{0x00}), varbinds()))
+	if tr, err = parsePacket(packet, nil); err != nil {
+		t.Fatal(err)
+	}
+	if tr.trapOID.String() != "1.3.6.1.4.1.9999.0.7" {
+		t.Errorf("Unexpected trap OID %s", tr.trapOID)
+	}
+
+	if _, err = parsePacket(packet[:len(packet)-3], nil); err == nil {
+		t.Error("Truncated packet accepted")
+	}
+}
+
+func TestParseV2cInform(t *testing.T) {
+	packet := v2Trap(1, "private", tagInform)
+	tr, err := parsePacket(packet, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tr.version != "2c" || tr.community != "private" || !tr.inform || tr.uptime != 256 ||
+		tr.trapOID.String() != "1.3.6.1.4.1.9999.0.1" || len(tr.varbinds) != 5 {
+
+		t.Errorf("Unexpected trap: %+v", tr)
+	}
+	response := informResponse(packet, tr)
+	if !bytes.Equal(response, v2Trap(1, "private", tagResponse)) {
+		t.Errorf("Unexpected response: %x", response)
+	}
+	if packet[tr.pduOffset] != tagInform {
+		t.Error("Inform modified")
+	}
+}
+
+func TestPasswordToKey(t *testing.T) {
+	// RFC 3414 A.3.
+	engineID, _ := hex.DecodeString("000000000000000000000002")
+	key := localizeKey(authProtocols["md5"].hash,
+		passwordToKey(authProtocols["md5"].hash, "maplesyrup"), engineID)
+	if hex.EncodeToString(key) != "526f5eed9fcce26f8964c2930787d82b" {
+		t.Errorf("Unexpected MD5 key %x", key)
+	}
+	key = localizeKey(sha1.New, passwordToKey(sha1.New, "maplesyrup"), engineID)
+	if hex.EncodeToString(key) != "6695febc9288e36282235fc7151f128497b38f3f" {
+		t.Errorf("Unexpected SHA key %x", key)
+	}
+}
+
+var testEngineID = []byte("\x80\x00\x1f\x88\x04acme")
+
+// Returns an SNMPv3 trap, sent by "alice" with SHA authentication and AES
+// privacy using the specified passwords.
+func v3Trap(authPassword, privPassword string) []byte {
+	salt := []byte("saltsalt")
+	scopedPDU := tlv(tagSequence, octets(string(testEngineID)), octets("edge"),
+		tlv(tagTrapV2, integer(1), integer(0), integer(0), varbinds(
+			objectID("1.3.6.1.6.3.1.1.4.1.0"), objectID("1.3.6.1.6.3.1.1.5.1"),
+		)))
+	privKey := localizeKey(sha1.New, passwordToKey(sha1.New, privPassword), testEngineID)
+	block, _ := aes.NewCipher(privKey[:16])
+	iv := append([]byte{0, 0, 0, 3, 0, 0, 0x01, 0x00}, salt...)
+	encrypted := make([]byte, len(scopedPDU))
+	cipher.NewCFBEncrypter(block, iv).XORKeyStream(encrypted, scopedPDU)
+
+	build := func(mac []byte) []byte {
+		return tlv(tagSequence, integer(3),
+			tlv(tagSequence, integer(42), integer(65507), octets("\x07"), integer(3)),
+			octets(string(tlv(tagSequence, octets(string(testEngineID)), integer(3),
+				integer(256), octets("alice"), octets(string(mac)), octets(string(salt))))),
+			octets(string(encrypted)))
+	}
+	authKey := localizeKey(sha1.New, passwordToKey(sha1.New, authPassword), testEngineID)
+	h := hmac.New(sha1.New, authKey)
+	h.Write(build(make([]byte, 12)))
+	return build(h.Sum(nil)[:12])
+}
+
+func TestParseV3(t *testing.T) {
+	sec, err := newUSM(map[string]SNMPUserConfig{
+		"alice": {"sha", "authpassword", "aes", "privpassword"},
+		"bob":   {"sha", "authpassword", "", ""},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr, err := parsePacket(v3Trap("authpassword", "privpassword"), sec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tr.version != "3" || tr.user != "alice" || tr.contextName != "edge" ||
+		tr.trapOID.String() != "1.3.6.1.6.3.1.1.5.1" {
+
+		t.Errorf("Unexpected trap: %+v", tr)
+	}
+
+	if _, err = parsePacket(v3Trap("wrongpassword", "privpassword"), sec); err != errAuthentication {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if _, err = parsePacket(v3Trap("authpassword", "wrongpassword"), sec); err == nil {
+		t.Error("Trap with wrong privacy key accepted")
+	}
+	delete(sec.users, "alice")
+	if _, err = parsePacket(v3Trap("authpassword", "privpassword"), sec); err != errUnknownUser {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	// Bob doesn't use privacy.
+	sec.users["alice"] = sec.users["bob"]
+	if _, err = parsePacket(v3Trap("authpassword", "privpassword"), sec); err != errAuthentication {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	if _, err = newUSM(map[string]SNMPUserConfig{"carol": {"sha", "short", "", ""}}); err == nil {
+		t.Error("Short password accepted")
+	}
+	if _, err = newUSM(map[string]SNMPUserConfig{"carol": {"", "", "aes", "privpassword"}}); err == nil {
+		t.Error("Privacy without authentication accepted")
+	}
+}
+
+func TestPopulate(t *testing.T) {
+	input := new(SNMPTrapInput)
+	input.conf = &SNMPTrapInputConfig{FieldPrefix: "vb."}
+	input.mib = newMIB()
+	input.mib.load(testMIB)
+	tr, err := parsePacket(v2Trap(1, "public", tagTrapV2), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := new(message.Message)
+	input.populate(msg, tr, "10.1.1.1")
+
+	if msg.GetType() != "snmp.trap" || msg.GetHostname() != "10.1.1.1" ||
+		msg.GetPayload() != "acmeAlert" {
+
+		t.Errorf("Unexpected message: %s", msg)
+	}
+	expected := map[string]interface{}{
+		"Version":            "2c",
+		"TrapOID":            "1.3.6.1.4.1.9999.0.1",
+		"Uptime":             int64(256),
+		"vb.acmeMessage.0":   "disk full",
+		"vb.acmeLoad.0":      int64(250),
+		"vb.acmeObjects.3":   "10.0.0.1",
+		"vb.acmeObjects.4.0": "001b213a4f5e",
+	}
+	for name, value := range expected {
+		if v, ok := msg.GetFieldValue(name); !ok || v != value {
+			t.Errorf("Field %s is %v, expected %v", name, v, value)
+		}
+	}
+	if _, ok := msg.GetFieldValue("vb.acmeObjects.5.0"); ok {
+		t.Error("Field without value added")
+	}
+}
+
+func TestReceivesTraps(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	dir, err := ioutil.TempDir("", "snmp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err = ioutil.WriteFile(filepath.Join(dir, "ACME-MIB.txt"), []byte(testMIB), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	input := new(SNMPTrapInput)
+	input.SetPipelineConfig(pipeline.NewPipelineConfig(nil))
+	config := input.ConfigStruct().(*SNMPTrapInputConfig)
+	config.Address = "127.0.0.1:0"
+	config.Communities = []string{"public"}
+	config.MibFiles = []string{filepath.Join(dir, "*.txt")}
+	if err = input.Init(config); err != nil {
+		t.Fatal(err)
+	}
+
+	ir := pipelinemock.NewMockInputRunner(ctrl)
+	packs := make(chan *pipeline.PipelinePack, 1)
+	packs <- pipeline.NewPipelinePack(packs)
+	delivered := make(chan string, 1)
+	ir.EXPECT().InChan().Return(packs).AnyTimes()
+	ir.EXPECT().Name().Return("SNMPTrapInput").AnyTimes()
+	ir.EXPECT().LogError(gomock.Any()).AnyTimes()
+	ir.EXPECT().Deliver(gomock.Any()).Do(func(pack *pipeline.PipelinePack) {
+		delivered <- pack.Message.GetPayload()
+		pack.Recycle()
+	}).AnyTimes()
+	done := make(chan error)
+	go func() {
+		done <- input.Run(ir, nil)
+	}()
+
+	conn, err := net.Dial("udp", input.conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// Traps from unknown communities are dropped, informs are acknowledged.
+	conn.Write(v2Trap(1, "private", tagTrapV2))
+	conn.Write(v2Trap(1, "public", tagInform))
+	response := make([]byte, 1024)
+	n, err := conn.Read(response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(response[:n], v2Trap(1, "public", tagResponse)) {
+		t.Errorf("Unexpected response: %x", response[:n])
+	}
+	select {
+	case payload := <-delivered:
+		if payload != "acmeAlert" {
+			t.Errorf("Unexpected payload %s", payload)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("No message delivered")
+	}
+
+	input.Stop()
+	if err = <-done; err != nil {
+		t.Error(err)
+	}
+	if input.trapsReceived != 1 || input.authFailures != 1 {
+		t.Errorf("Unexpected counts: %d received, %d rejected", input.trapsReceived,
+			input.authFailures)
+	}
+}
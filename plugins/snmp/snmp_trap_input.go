@@ -0,0 +1,281 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package snmp
+
+import (
+	"code.google.com/p/go-uuid/uuid"
+	"encoding/hex"
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+	"github.com/mozilla-services/heka/pipeline"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+type SNMPUserConfig struct {
+	// "md5", "sha", "sha256", "sha512", or "none".
+	AuthProtocol string `toml:"auth_protocol"`
+	AuthPassword string `toml:"auth_password"`
+	// "des", "aes", or "none".
+	PrivProtocol string `toml:"priv_protocol"`
+	PrivPassword string `toml:"priv_password"`
+}
+
+type SNMPTrapInputConfig struct {
+	// UDP address traps are received on.
+	Address string
+	// Communities accepted from SNMPv1 and SNMPv2c senders, any if empty.
+	Communities []string
+	// SNMPv3 users, by name.
+	Users map[string]SNMPUserConfig
+	// Glob patterns of the MIB files OIDs are resolved with, relative to the
+	// share_dir.
+	MibFiles []string `toml:"mib_files"`
+	// Prefix of the names of the fields varbinds are stored in.
+	FieldPrefix string `toml:"field_prefix"`
+}
+
+// Receives SNMP traps and informs, generating a message for each with the
+// trap's name as payload and a field for each variable binding, named after
+// the variable's MIB object.
+type SNMPTrapInput struct {
+	trapsReceived  int64
+	invalidPackets int64
+	authFailures   int64
+
+	conf        *SNMPTrapInputConfig
+	pConfig     *pipeline.PipelineConfig
+	communities map[string]bool
+	sec         *usm
+	mib         *mib
+	conn        net.PacketConn
+	stopChan    chan struct{}
+}
+
+func (input *SNMPTrapInput) SetPipelineConfig(pConfig *pipeline.PipelineConfig) {
+	input.pConfig = pConfig
+}
+
+func (input *SNMPTrapInput) ConfigStruct() interface{} {
+	return &SNMPTrapInputConfig{
+		Address: "0.0.0.0:162",
+	}
+}
+
+func (input *SNMPTrapInput) Init(config interface{}) (err error) {
+	input.conf = config.(*SNMPTrapInputConfig)
+	input.communities = nil
+	if len(input.conf.Communities) > 0 {
+		input.communities = make(map[string]bool, len(input.conf.Communities))
+		for _, community := range input.conf.Communities {
+			input.communities[community] = true
+		}
+	}
+	if input.sec, err = newUSM(input.conf.Users); err != nil {
+		return
+	}
+	input.mib = newMIB()
+	for _, pattern := range input.conf.MibFiles {
+		pattern = input.pConfig.Globals.PrependShareDir(pattern)
+		paths, err := filepath.Glob(pattern)
+		if err != nil {
+			return fmt.Errorf("invalid mib_files pattern '%s': %s", pattern, err)
+		}
+		if len(paths) == 0 {
+			return fmt.Errorf("no MIB files match '%s'", pattern)
+		}
+		for _, path := range paths {
+			text, err := ioutil.ReadFile(path)
+			if err != nil {
+				return fmt.Errorf("can't read MIB file: %s", err)
+			}
+			input.mib.load(string(text))
+		}
+	}
+
+	if input.conn, err = net.ListenPacket("udp", input.conf.Address); err != nil {
+		return fmt.Errorf("can't listen on %s: %s", input.conf.Address, err)
+	}
+	input.stopChan = make(chan struct{})
+	return
+}
+
+func (input *SNMPTrapInput) Run(ir pipeline.InputRunner, h pipeline.PluginHelper) error {
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := input.conn.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-input.stopChan:
+				return nil
+			default:
+			}
+			return fmt.Errorf("read error: %s", err)
+		}
+		packet := buf[:n]
+		t, err := input.accept(packet)
+		if err != nil {
+			ir.LogError(fmt.Errorf("trap from %s rejected: %s", addr, err))
+			continue
+		}
+		if t.inform && t.version == "2c" {
+			if _, err = input.conn.WriteTo(informResponse(packet, t), addr); err != nil {
+				ir.LogError(fmt.Errorf("can't acknowledge inform from %s: %s", addr, err))
+			}
+		}
+
+		var pack *pipeline.PipelinePack
+		select {
+		case pack = <-ir.InChan():
+		case <-input.stopChan:
+			return nil
+		}
+		host := addr.String()
+		if udpAddr, ok := addr.(*net.UDPAddr); ok {
+			host = udpAddr.IP.String()
+		}
+		pack.Message.SetUuid(uuid.NewRandom())
+		pack.Message.SetTimestamp(time.Now().UnixNano())
+		pack.Message.SetLogger(ir.Name())
+		pack.Message.SetPid(int32(os.Getpid()))
+		input.populate(pack.Message, t, host)
+		ir.Deliver(pack)
+	}
+}
+
+func (input *SNMPTrapInput) Stop() {
+	close(input.stopChan)
+	input.conn.Close()
+}
+
+// Decodes and authenticates a packet, counting it.
+func (input *SNMPTrapInput) accept(packet []byte) (*trap, error) {
+	t, err := parsePacket(packet, input.sec)
+	if err == errUnknownUser || err == errAuthentication {
+		atomic.AddInt64(&input.authFailures, 1)
+		return nil, err
+	}
+	if err != nil {
+		atomic.AddInt64(&input.invalidPackets, 1)
+		return nil, err
+	}
+	if t.version != "3" && input.communities != nil && !input.communities[t.community] {
+		atomic.AddInt64(&input.authFailures, 1)
+		return nil, fmt.Errorf("unknown community '%s'", t.community)
+	}
+	atomic.AddInt64(&input.trapsReceived, 1)
+	return t, nil
+}
+
+// Sets the type, hostname, payload, and fields of a trap's message.
+func (input *SNMPTrapInput) populate(msg *message.Message, t *trap, host string) {
+	msg.SetType("snmp.trap")
+	msg.SetHostname(host)
+	msg.SetSeverity(6)
+	msg.SetPayload(input.mib.resolve(t.trapOID))
+	message.NewStringField(msg, "Version", t.version)
+	message.NewStringField(msg, "TrapOID", t.trapOID.String())
+	if t.uptime >= 0 {
+		message.NewInt64Field(msg, "Uptime", t.uptime, "centiseconds")
+	}
+	if t.version == "3" {
+		message.NewStringField(msg, "User", t.user)
+		if t.contextName != "" {
+			message.NewStringField(msg, "ContextName", t.contextName)
+		}
+	}
+	if t.enterprise != nil {
+		message.NewStringField(msg, "Enterprise", input.mib.resolve(t.enterprise))
+		message.NewStringField(msg, "AgentAddress", t.agentAddress)
+	}
+	if t.inform {
+		f, _ := message.NewField("Inform", true, "")
+		msg.AddField(f)
+	}
+	for _, vb := range t.varbinds {
+		value := input.value(vb)
+		if value == nil {
+			continue
+		}
+		f, err := message.NewField(input.conf.FieldPrefix+input.mib.resolve(vb.name), value, "")
+		if err == nil {
+			msg.AddField(f)
+		}
+	}
+}
+
+// Returns the value of a varbind as an int64 or a string, or nil if the
+// varbind has no value.
+func (input *SNMPTrapInput) value(vb varbind) interface{} {
+	switch vb.tag {
+	case tagInteger:
+		if v, err := decodeInt(vb.value); err == nil {
+			return v
+		}
+	case tagCounter32, tagGauge32, tagTimeTicks, tagCounter64:
+		if v, err := decodeUint(vb.value); err == nil {
+			return int64(v)
+		}
+	case tagOctetString, tagOpaque:
+		s := strings.TrimRight(string(vb.value), "\x00")
+		if printable(s) {
+			return s
+		}
+		return hex.EncodeToString(vb.value)
+	case tagOID:
+		if o, err := decodeOID(vb.value); err == nil {
+			return input.mib.resolve(o)
+		}
+	case tagIpAddress:
+		if len(vb.value) == 4 {
+			return net.IP(vb.value).String()
+		}
+	}
+	return nil
+}
+
+// Reports whether an octet string is text, rather than binary, e.g. a MAC
+// address.
+func printable(s string) bool {
+	if !utf8.ValidString(s) {
+		return false
+	}
+	for _, r := range s {
+		if !unicode.IsPrint(r) && r != '\t' && r != '\n' && r != '\r' {
+			return false
+		}
+	}
+	return true
+}
+
+func (input *SNMPTrapInput) ReportMsg(msg *message.Message) error {
+	message.NewInt64Field(msg, "TrapsReceived",
+		atomic.LoadInt64(&input.trapsReceived), "count")
+	message.NewInt64Field(msg, "InvalidPackets",
+		atomic.LoadInt64(&input.invalidPackets), "count")
+	message.NewInt64Field(msg, "AuthFailures",
+		atomic.LoadInt64(&input.authFailures), "count")
+	return nil
+}
+
+func init() {
+	pipeline.RegisterPlugin("SNMPTrapInput", func() interface{} {
+		return new(SNMPTrapInput)
+	})
+}
@@ -0,0 +1,264 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package snmp
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+)
+
+// The SNMPv3 user-based security model (RFC 3414), for received traps: the
+// sender is the authoritative engine, so keys are localized with the engine
+// ID of each message.
+
+// Authentication protocols, by config name.
+var authProtocols = map[string]struct {
+	hash func() hash.Hash
+	// Length of the truncated HMAC carried in messages.
+	macLen int
+}{
+	"md5":    {md5.New, 12},
+	"sha":    {sha1.New, 12},
+	"sha256": {sha256.New, 24},
+	"sha512": {sha512.New, 48},
+}
+
+var (
+	errUnknownUser    = errors.New("unknown user")
+	errAuthentication = errors.New("authentication failed")
+)
+
+type usmUser struct {
+	hash     func() hash.Hash
+	macLen   int
+	privName string
+	// Keys derived from the passwords, not localized yet.
+	authKey []byte
+	privKey []byte
+}
+
+// The configured SNMPv3 users.
+type usm struct {
+	users map[string]*usmUser
+}
+
+// Returns the security model for the configured users, deriving their keys.
+func newUSM(users map[string]SNMPUserConfig) (*usm, error) {
+	sec := &usm{users: make(map[string]*usmUser, len(users))}
+	for name, conf := range users {
+		user := new(usmUser)
+		if conf.AuthProtocol != "" && conf.AuthProtocol != "none" {
+			proto, ok := authProtocols[conf.AuthProtocol]
+			if !ok {
+				return nil, fmt.Errorf("user '%s': invalid auth_protocol '%s'", name,
+					conf.AuthProtocol)
+			}
+			if len(conf.AuthPassword) < 8 {
+				return nil, fmt.Errorf("user '%s': auth_password must be at least 8 characters",
+					name)
+			}
+			user.hash, user.macLen = proto.hash, proto.macLen
+			user.authKey = passwordToKey(user.hash, conf.AuthPassword)
+		}
+		switch conf.PrivProtocol {
+		case "", "none":
+		case "des", "aes":
+			if user.hash == nil {
+				return nil, fmt.Errorf("user '%s': priv_protocol requires an auth_protocol",
+					name)
+			}
+			if len(conf.PrivPassword) < 8 {
+				return nil, fmt.Errorf("user '%s': priv_password must be at least 8 characters",
+					name)
+			}
+			user.privName = conf.PrivProtocol
+			user.privKey = passwordToKey(user.hash, conf.PrivPassword)
+		default:
+			return nil, fmt.Errorf("user '%s': invalid priv_protocol '%s'", name,
+				conf.PrivProtocol)
+		}
+		sec.users[name] = user
+	}
+	return sec, nil
+}
+
+// Derives a key from a password, see RFC 3414 A.2.
+func passwordToKey(h func() hash.Hash, password string) []byte {
+	hasher := h()
+	buf := make([]byte, 64)
+	pw := []byte(password)
+	index := 0
+	for count := 0; count < 1048576; count += len(buf) {
+		for i := range buf {
+			buf[i] = pw[index%len(pw)]
+			index++
+		}
+		hasher.Write(buf)
+	}
+	return hasher.Sum(nil)
+}
+
+// Localizes a key for an engine.
+func localizeKey(h func() hash.Hash, key, engineID []byte) []byte {
+	hasher := h()
+	hasher.Write(key)
+	hasher.Write(engineID)
+	hasher.Write(key)
+	return hasher.Sum(nil)
+}
+
+// Message flags.
+const (
+	flagAuth = 0x01
+	flagPriv = 0x02
+)
+
+// Checks the security of an SNMPv3 message, `packet`, whose version has been
+// read, returning its scoped PDU. `rest` holds the rest of the message.
+func (sec *usm) process(t *trap, packet, rest []byte) ([]byte, error) {
+	global, rest, err := expectTLV(rest, tagSequence, "global data")
+	if err != nil {
+		return nil, err
+	}
+	for _, what := range []string{"message ID", "maximum size"} {
+		if _, global, err = readInt(global, what); err != nil {
+			return nil, err
+		}
+	}
+	flags, global, err := expectTLV(global, tagOctetString, "flags")
+	if err != nil {
+		return nil, err
+	}
+	if len(flags) != 1 {
+		return nil, errors.New("invalid flags")
+	}
+	model, _, err := readInt(global, "security model")
+	if err != nil {
+		return nil, err
+	}
+	if model != 3 {
+		return nil, fmt.Errorf("unsupported security model %d", model)
+	}
+
+	params, msgData, err := expectTLV(rest, tagOctetString, "security parameters")
+	if err != nil {
+		return nil, err
+	}
+	params, _, err = expectTLV(params, tagSequence, "security parameters")
+	if err != nil {
+		return nil, err
+	}
+	engineID, params, err := expectTLV(params, tagOctetString, "engine ID")
+	if err != nil {
+		return nil, err
+	}
+	boots, params, err := readInt(params, "engine boots")
+	if err != nil {
+		return nil, err
+	}
+	engineTime, params, err := readInt(params, "engine time")
+	if err != nil {
+		return nil, err
+	}
+	userName, params, err := expectTLV(params, tagOctetString, "user name")
+	if err != nil {
+		return nil, err
+	}
+	authParams, params, err := expectTLV(params, tagOctetString, "authentication parameters")
+	if err != nil {
+		return nil, err
+	}
+	privParams, _, err := expectTLV(params, tagOctetString, "privacy parameters")
+	if err != nil {
+		return nil, err
+	}
+
+	t.user = string(userName)
+	user, ok := sec.users[t.user]
+	if !ok {
+		return nil, errUnknownUser
+	}
+	// Messages must be as secure as their user requires.
+	if (user.authKey != nil) != (flags[0]&flagAuth != 0) ||
+		(user.privKey != nil) != (flags[0]&flagPriv != 0) {
+
+		return nil, errAuthentication
+	}
+	if user.authKey != nil {
+		key := localizeKey(user.hash, user.authKey, engineID)
+		if len(authParams) != user.macLen {
+			return nil, errAuthentication
+		}
+		// The MAC is computed with the authentication parameters zeroed.
+		offset := cap(packet) - cap(authParams)
+		whole := append([]byte(nil), packet...)
+		for i := offset; i < offset+len(authParams); i++ {
+			whole[i] = 0
+		}
+		mac := hmac.New(user.hash, key)
+		mac.Write(whole)
+		if !hmac.Equal(mac.Sum(nil)[:user.macLen], authParams) {
+			return nil, errAuthentication
+		}
+	}
+	if user.privKey == nil {
+		return msgData, nil
+	}
+
+	encrypted, _, err := expectTLV(msgData, tagOctetString, "encrypted PDU")
+	if err != nil {
+		return nil, err
+	}
+	key := localizeKey(user.hash, user.privKey, engineID)
+	if len(privParams) != 8 {
+		return nil, errors.New("invalid privacy parameters")
+	}
+	plain := make([]byte, len(encrypted))
+	switch user.privName {
+	case "des":
+		// DES-CBC, see RFC 3414 8.1.1.
+		if len(encrypted)%des.BlockSize != 0 {
+			return nil, errors.New("invalid encrypted PDU length")
+		}
+		block, err := des.NewCipher(key[:8])
+		if err != nil {
+			return nil, err
+		}
+		iv := make([]byte, 8)
+		for i := range iv {
+			iv[i] = key[8+i] ^ privParams[i]
+		}
+		cipher.NewCBCDecrypter(block, iv).CryptBlocks(plain, encrypted)
+	case "aes":
+		// AES-128-CFB, see RFC 3826 3.1.
+		block, err := aes.NewCipher(key[:16])
+		if err != nil {
+			return nil, err
+		}
+		iv := make([]byte, 16)
+		binary.BigEndian.PutUint32(iv, uint32(boots))
+		binary.BigEndian.PutUint32(iv[4:], uint32(engineTime))
+		copy(iv[8:], privParams)
+		cipher.NewCFBDecrypter(block, iv).XORKeyStream(plain, encrypted)
+	}
+	return plain, nil
+}
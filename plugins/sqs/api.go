@@ -0,0 +1,103 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package sqs
+
+import (
+	"github.com/mozilla-services/heka/plugins/aws"
+	"time"
+)
+
+// The SQS API calls the input uses, faked in tests.
+type sqsAPI interface {
+	ReceiveMessage(in *ReceiveMessageInput) ([]Message, error)
+	DeleteMessage(queueURL, receiptHandle string) error
+	// Sets the time left before a received message becomes visible again.
+	ChangeMessageVisibility(queueURL, receiptHandle string, timeout uint32) error
+}
+
+// The S3 calls needed to fetch the payloads offloaded to S3, faked in tests.
+type s3API interface {
+	GetObject(bucket, key string) ([]byte, error)
+	DeleteObject(bucket, key string) error
+}
+
+type ReceiveMessageInput struct {
+	QueueUrl                    string
+	MaxNumberOfMessages         int
+	WaitTimeSeconds             uint32
+	VisibilityTimeout           uint32
+	AttributeNames              []string
+	MessageAttributeNames       []string
+	MessageSystemAttributeNames []string
+}
+
+type MessageAttribute struct {
+	DataType    string
+	StringValue string `json:",omitempty"`
+	BinaryValue []byte `json:",omitempty"`
+}
+
+type Message struct {
+	MessageId     string
+	ReceiptHandle string
+	Body          string
+	// System attributes, e.g. SentTimestamp and ApproximateReceiveCount.
+	Attributes        map[string]string
+	MessageAttributes map[string]MessageAttribute
+}
+
+// sqsAPI implementation using the SQS JSON API.
+type sqsClient struct {
+	client *aws.Client
+}
+
+func newSQSClient(region, endpoint string, creds aws.CredentialsProvider) (*sqsClient,
+	error) {
+
+	client, err := aws.NewClient("sqs", region, endpoint, "AmazonSQS",
+		"application/x-amz-json-1.0", creds)
+	if err != nil {
+		return nil, err
+	}
+	// Long polls last up to 20 seconds.
+	client.HTTP.Timeout = 30 * time.Second
+	return &sqsClient{client}, nil
+}
+
+func (s *sqsClient) ReceiveMessage(in *ReceiveMessageInput) ([]Message, error) {
+	var out struct {
+		Messages []Message
+	}
+	if err := s.client.Call("ReceiveMessage", in, &out); err != nil {
+		return nil, err
+	}
+	return out.Messages, nil
+}
+
+func (s *sqsClient) DeleteMessage(queueURL, receiptHandle string) error {
+	in := struct {
+		QueueUrl      string
+		ReceiptHandle string
+	}{queueURL, receiptHandle}
+	return s.client.Call("DeleteMessage", &in, nil)
+}
+
+func (s *sqsClient) ChangeMessageVisibility(queueURL, receiptHandle string,
+	timeout uint32) error {
+
+	in := struct {
+		QueueUrl          string
+		ReceiptHandle     string
+		VisibilityTimeout uint32
+	}{queueURL, receiptHandle, timeout}
+	return s.client.Call("ChangeMessageVisibility", &in, nil)
+}
@@ -0,0 +1,412 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package sqs
+
+import (
+	"code.google.com/p/go-uuid/uuid"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+	"github.com/mozilla-services/heka/pipeline"
+	"github.com/mozilla-services/heka/plugins/aws"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Classes of the pointers the SQS Extended Client Library sends in place of
+// payloads offloaded to S3.
+var s3PointerClasses = map[string]bool{
+	"software.amazon.payloadoffloading.PayloadS3Pointer": true,
+	"com.amazon.sqs.javamessaging.MessageS3Pointer":      true,
+}
+
+// Location of a payload offloaded to S3.
+type s3Pointer struct {
+	Bucket string `json:"s3BucketName"`
+	Key    string `json:"s3Key"`
+}
+
+// Parses a message body that points to a payload offloaded to S3, returning
+// nil if it doesn't.
+func parseS3Pointer(body string) *s3Pointer {
+	if !strings.HasPrefix(body, `["`) {
+		return nil
+	}
+	var parts []json.RawMessage
+	if json.Unmarshal([]byte(body), &parts) != nil || len(parts) != 2 {
+		return nil
+	}
+	var class string
+	if json.Unmarshal(parts[0], &class) != nil || !s3PointerClasses[class] {
+		return nil
+	}
+	pointer := new(s3Pointer)
+	if json.Unmarshal(parts[1], pointer) != nil || pointer.Bucket == "" ||
+		pointer.Key == "" {
+
+		return nil
+	}
+	return pointer
+}
+
+type SQSInputConfig struct {
+	// URL of the queue to read.
+	QueueURL string `toml:"queue_url"`
+	Region   string
+	Endpoint string
+	// Credentials, if not taken from the environment or the instance's IAM
+	// role.
+	AccessKeyID     string `toml:"access_key_id"`
+	SecretAccessKey string `toml:"secret_access_key"`
+	SessionToken    string `toml:"session_token"`
+	// Seconds each receive request waits for messages to arrive, up to 20.
+	WaitTime uint32 `toml:"wait_time"`
+	// Maximum number of messages received per request, up to 10.
+	MaxMessages int `toml:"max_messages"`
+	// Seconds received messages stay invisible to other consumers. The
+	// timeout is extended while a message is being delivered.
+	VisibilityTimeout uint32 `toml:"visibility_timeout"`
+	// Seconds after which the visibility timeout of a message that still
+	// hasn't been delivered is no longer extended, so it's received again.
+	MaxVisibilityExtension uint32 `toml:"max_visibility_extension"`
+	// When messages are deleted from the queue: once they've been accepted
+	// by the router ("router"), or once every matching output has finished
+	// with them ("output").
+	DeleteAfter string `toml:"delete_after"`
+	// Maximum number of received messages not yet delivered.
+	MaxInFlight int `toml:"max_in_flight"`
+	// Whether payloads offloaded to S3 by the SQS Extended Client Library
+	// are fetched, rather than handing on the pointers.
+	S3Payloads bool   `toml:"s3_payloads"`
+	S3Endpoint string `toml:"s3_endpoint"`
+	// Whether offloaded payloads are deleted from S3 along with their
+	// messages.
+	DeleteS3Payloads bool `toml:"delete_s3_payloads"`
+}
+
+// Long-polls an SQS queue, deleting each message only once it has been
+// delivered. The visibility timeout of each message is extended while it's
+// being delivered, and messages that fail to be delivered are left to be
+// received again once their visibility timeout runs out, so delivery is at
+// least once.
+type SQSInput struct {
+	messagesReceived int64
+	messagesDeleted  int64
+	deliveryFailures int64
+	extensions       int64
+	s3Fetches        int64
+	inFlightCount    int64
+
+	conf          *SQSInputConfig
+	api           sqsAPI
+	s3            s3API
+	deliveryPoint pipeline.DeliveryPoint
+	pConfig       *pipeline.PipelineConfig
+	name          string
+	stopChan      chan struct{}
+	stopLock      sync.Mutex
+	stopped       bool
+	wg            sync.WaitGroup
+}
+
+func (s *SQSInput) ConfigStruct() interface{} {
+	return &SQSInputConfig{
+		WaitTime:               20,
+		MaxMessages:            10,
+		VisibilityTimeout:      30,
+		MaxVisibilityExtension: 3600,
+		DeleteAfter:            "output",
+		MaxInFlight:            100,
+		S3Payloads:             true,
+	}
+}
+
+func (s *SQSInput) SetPipelineConfig(pConfig *pipeline.PipelineConfig) {
+	s.pConfig = pConfig
+}
+
+func (s *SQSInput) SetName(name string) {
+	s.name = name
+}
+
+func (s *SQSInput) Init(config interface{}) (err error) {
+	s.conf = config.(*SQSInputConfig)
+	if s.conf.QueueURL == "" {
+		return errors.New("queue_url must be specified")
+	}
+	if s.conf.WaitTime > 20 {
+		return errors.New("wait_time must be 20 or less")
+	}
+	if s.conf.MaxMessages < 1 || s.conf.MaxMessages > 10 {
+		return errors.New("max_messages must be between 1 and 10")
+	}
+	if s.conf.VisibilityTimeout < 2 {
+		return errors.New("visibility_timeout must be at least 2")
+	}
+	if s.conf.MaxInFlight < 1 {
+		return errors.New("max_in_flight must be at least 1")
+	}
+	if s.deliveryPoint, err = pipeline.ParseDeliveryPoint(s.conf.DeleteAfter); err != nil {
+		return fmt.Errorf("invalid delete_after: %s", s.conf.DeleteAfter)
+	}
+	creds := aws.NewCredentialsProvider(s.conf.AccessKeyID, s.conf.SecretAccessKey,
+		s.conf.SessionToken)
+	if s.api == nil {
+		if s.api, err = newSQSClient(s.conf.Region, s.conf.Endpoint, creds); err != nil {
+			return
+		}
+	}
+	if s.s3 == nil && s.conf.S3Payloads {
+		if s.s3, err = aws.NewS3Client(s.conf.Region, s.conf.S3Endpoint, creds); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Waits for the specified duration, returning false if the input is stopped
+// in the meantime.
+func (s *SQSInput) sleep(d time.Duration) bool {
+	select {
+	case <-s.stopChan:
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
+
+func (s *SQSInput) Run(ir pipeline.InputRunner, h pipeline.PluginHelper) (err error) {
+	s.stopLock.Lock()
+	s.stopChan = make(chan struct{})
+	s.stopped = false
+	s.stopLock.Unlock()
+	defer s.wg.Wait()
+
+	var (
+		packSupply = ir.InChan()
+		// Holds a token per message in flight.
+		inFlight = make(chan struct{}, s.conf.MaxInFlight)
+		backoff  = time.Second
+		in       = &ReceiveMessageInput{
+			QueueUrl:                    s.conf.QueueURL,
+			WaitTimeSeconds:             s.conf.WaitTime,
+			VisibilityTimeout:           s.conf.VisibilityTimeout,
+			AttributeNames:              []string{"All"},
+			MessageAttributeNames:       []string{"All"},
+			MessageSystemAttributeNames: []string{"All"},
+		}
+	)
+	for {
+		// Only receive as many messages as there's room for, waiting for
+		// room if there's none.
+		free := cap(inFlight) - len(inFlight)
+		if free == 0 {
+			select {
+			case inFlight <- struct{}{}:
+				<-inFlight
+				continue
+			case <-s.stopChan:
+				return nil
+			}
+		}
+		if in.MaxNumberOfMessages = s.conf.MaxMessages; free < in.MaxNumberOfMessages {
+			in.MaxNumberOfMessages = free
+		}
+
+		msgs, err := s.api.ReceiveMessage(in)
+		select {
+		case <-s.stopChan:
+			// The messages will be received again once their visibility
+			// timeout runs out.
+			return nil
+		default:
+		}
+		if err != nil {
+			ir.LogError(fmt.Errorf("can't receive messages: %s", err))
+			if !s.sleep(backoff) {
+				return nil
+			}
+			if backoff *= 2; backoff > time.Minute {
+				backoff = time.Minute
+			}
+			continue
+		}
+		backoff = time.Second
+
+		for i := range msgs {
+			if !s.deliver(ir, packSupply, inFlight, &msgs[i]) {
+				return nil
+			}
+		}
+	}
+}
+
+// Hands a message on and starts waiting for its delivery, returning false if
+// the input is stopped in the meantime.
+func (s *SQSInput) deliver(ir pipeline.InputRunner, packSupply chan *pipeline.PipelinePack,
+	inFlight chan struct{}, msg *Message) bool {
+
+	atomic.AddInt64(&s.messagesReceived, 1)
+	payload := []byte(msg.Body)
+	var pointer *s3Pointer
+	if s.conf.S3Payloads {
+		if pointer = parseS3Pointer(msg.Body); pointer != nil {
+			var err error
+			if payload, err = s.s3.GetObject(pointer.Bucket, pointer.Key); err != nil {
+				// Left to be received again.
+				ir.LogError(fmt.Errorf("message %s: can't fetch payload s3://%s/%s: %s",
+					msg.MessageId, pointer.Bucket, pointer.Key, err))
+				return true
+			}
+			atomic.AddInt64(&s.s3Fetches, 1)
+		}
+	}
+
+	var pack *pipeline.PipelinePack
+	select {
+	case pack = <-packSupply:
+	case <-s.stopChan:
+		return false
+	}
+	s.populatePack(pack, msg, payload, ir.UseMsgBytes())
+	reports := pack.TrackDelivery(s.deliveryPoint)
+	inFlight <- struct{}{}
+	atomic.AddInt64(&s.inFlightCount, 1)
+	s.wg.Add(1)
+	go s.awaitDelivery(ir, inFlight, msg, pointer, reports)
+	ir.Deliver(pack)
+	return true
+}
+
+// Extends the visibility timeout of a message until it's delivered, then
+// deletes it.
+func (s *SQSInput) awaitDelivery(ir pipeline.InputRunner, inFlight chan struct{},
+	msg *Message, pointer *s3Pointer, reports <-chan pipeline.DeliveryReport) {
+
+	defer func() {
+		atomic.AddInt64(&s.inFlightCount, -1)
+		<-inFlight
+		s.wg.Done()
+	}()
+	timeout := time.Duration(s.conf.VisibilityTimeout) * time.Second
+	// Only extend until the maximum extension is reached.
+	deadline := time.Now().Add(time.Duration(s.conf.MaxVisibilityExtension) * time.Second)
+	extend := time.NewTicker(timeout / 2)
+	defer extend.Stop()
+	for {
+		select {
+		case report := <-reports:
+			if report.Err != nil {
+				atomic.AddInt64(&s.deliveryFailures, 1)
+				ir.LogError(fmt.Errorf("message %s wasn't delivered, leaving it to be "+
+					"received again: %s", msg.MessageId, report.Err))
+				return
+			}
+			if err := s.api.DeleteMessage(s.conf.QueueURL, msg.ReceiptHandle); err != nil {
+				ir.LogError(fmt.Errorf("can't delete message %s: %s", msg.MessageId, err))
+				return
+			}
+			atomic.AddInt64(&s.messagesDeleted, 1)
+			if pointer != nil && s.conf.DeleteS3Payloads {
+				if err := s.s3.DeleteObject(pointer.Bucket, pointer.Key); err != nil {
+					ir.LogError(fmt.Errorf("message %s: can't delete payload s3://%s/%s: %s",
+						msg.MessageId, pointer.Bucket, pointer.Key, err))
+				}
+			}
+			return
+		case <-extend.C:
+			if time.Now().Add(timeout).After(deadline) {
+				continue
+			}
+			err := s.api.ChangeMessageVisibility(s.conf.QueueURL, msg.ReceiptHandle,
+				s.conf.VisibilityTimeout)
+			if err != nil {
+				ir.LogError(fmt.Errorf("can't extend the visibility timeout of message "+
+					"%s: %s", msg.MessageId, err))
+				continue
+			}
+			atomic.AddInt64(&s.extensions, 1)
+		case <-s.stopChan:
+			// Not deleted, so it will be received again.
+			return
+		}
+	}
+}
+
+// Fills a pack with a message, either as the raw payload (for use with a
+// decoder) or as a "heka.sqs" message with the payload as the payload.
+func (s *SQSInput) populatePack(pack *pipeline.PipelinePack, msg *Message,
+	payload []byte, useMsgBytes bool) {
+
+	if useMsgBytes {
+		pack.MsgBytes = append(pack.MsgBytes[:0], payload...)
+		return
+	}
+	m := pack.Message
+	m.SetUuid(uuid.NewRandom())
+	if sent, err := strconv.ParseInt(msg.Attributes["SentTimestamp"], 10, 64); err == nil {
+		m.SetTimestamp(sent * int64(time.Millisecond))
+	} else {
+		m.SetTimestamp(time.Now().UnixNano())
+	}
+	m.SetType("heka.sqs")
+	m.SetLogger(s.name)
+	m.SetHostname(s.pConfig.Hostname())
+	m.SetPayload(string(payload))
+	message.NewStringField(m, "MessageId", msg.MessageId)
+	if count, err := strconv.Atoi(msg.Attributes["ApproximateReceiveCount"]); err == nil {
+		message.NewIntField(m, "ReceiveCount", count, "count")
+	}
+	for name, attr := range msg.MessageAttributes {
+		var value interface{} = attr.StringValue
+		if strings.HasPrefix(attr.DataType, "Binary") {
+			value = attr.BinaryValue
+		}
+		if field, err := message.NewField(name, value, ""); err == nil {
+			m.AddField(field)
+		}
+	}
+}
+
+// Also called by Run when it fails, so may be called twice.
+func (s *SQSInput) Stop() {
+	s.stopLock.Lock()
+	defer s.stopLock.Unlock()
+	if !s.stopped && s.stopChan != nil {
+		s.stopped = true
+		close(s.stopChan)
+	}
+}
+
+func (s *SQSInput) ReportMsg(msg *message.Message) error {
+	message.NewInt64Field(msg, "MessagesReceived",
+		atomic.LoadInt64(&s.messagesReceived), "count")
+	message.NewInt64Field(msg, "MessagesDeleted",
+		atomic.LoadInt64(&s.messagesDeleted), "count")
+	message.NewInt64Field(msg, "DeliveryFailures",
+		atomic.LoadInt64(&s.deliveryFailures), "count")
+	message.NewInt64Field(msg, "VisibilityExtensions",
+		atomic.LoadInt64(&s.extensions), "count")
+	message.NewInt64Field(msg, "S3Fetches", atomic.LoadInt64(&s.s3Fetches), "count")
+	message.NewInt64Field(msg, "InFlight", atomic.LoadInt64(&s.inFlightCount), "count")
+	return nil
+}
+
+func init() {
+	pipeline.RegisterPlugin("SQSInput", func() interface{} {
+		return new(SQSInput)
+	})
+}
@@ -0,0 +1,206 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package sqs
+
+import (
+	"errors"
+	. "github.com/mozilla-services/heka/pipeline"
+	"github.com/mozilla-services/heka/pipelinemock"
+	"github.com/rafrombrc/gomock/gomock"
+	"sync"
+	"testing"
+	"time"
+)
+
+// SQS API fake, serving its messages on the first receive.
+type fakeSQS struct {
+	lock       sync.Mutex
+	messages   []Message
+	deleted    []string
+	extensions []string
+}
+
+func (f *fakeSQS) ReceiveMessage(in *ReceiveMessageInput) ([]Message, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	n := in.MaxNumberOfMessages
+	if n > len(f.messages) {
+		n = len(f.messages)
+	}
+	msgs := f.messages[:n]
+	f.messages = f.messages[n:]
+	if len(msgs) == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	return msgs, nil
+}
+
+func (f *fakeSQS) DeleteMessage(queueURL, receiptHandle string) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.deleted = append(f.deleted, receiptHandle)
+	return nil
+}
+
+func (f *fakeSQS) ChangeMessageVisibility(queueURL, receiptHandle string,
+	timeout uint32) error {
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.extensions = append(f.extensions, receiptHandle)
+	return nil
+}
+
+func (f *fakeSQS) deletedHandles() []string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return append([]string(nil), f.deleted...)
+}
+
+type fakeS3 map[string]string
+
+func (f fakeS3) GetObject(bucket, key string) ([]byte, error) {
+	if body, ok := f[bucket+"/"+key]; ok {
+		return []byte(body), nil
+	}
+	return nil, errors.New("NoSuchKey")
+}
+
+func (f fakeS3) DeleteObject(bucket, key string) error {
+	delete(f, bucket+"/"+key)
+	return nil
+}
+
+func TestParseS3Pointer(t *testing.T) {
+	pointer := parseS3Pointer(`["software.amazon.payloadoffloading.PayloadS3Pointer",` +
+		`{"s3BucketName":"large","s3Key":"a/b"}]`)
+	if pointer == nil || pointer.Bucket != "large" || pointer.Key != "a/b" {
+		t.Errorf("Unexpected pointer: %+v", pointer)
+	}
+	for _, body := range []string{`["a","b"]`, `{"s3BucketName":"x"}`, "plain text",
+		`["com.amazon.sqs.javamessaging.MessageS3Pointer",{}]`} {
+
+		if pointer = parseS3Pointer(body); pointer != nil {
+			t.Errorf("Unexpected pointer for %s: %+v", body, pointer)
+		}
+	}
+}
+
+func TestInputConfig(t *testing.T) {
+	si := new(SQSInput)
+	si.SetPipelineConfig(NewPipelineConfig(nil))
+	config := si.ConfigStruct().(*SQSInputConfig)
+	if err := si.Init(config); err == nil || err.Error() != "queue_url must be specified" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	config.QueueURL = "https://sqs.us-east-1.amazonaws.com/123456789012/logs"
+	config.DeleteAfter = "receive"
+	if err := si.Init(config); err == nil || err.Error() != "invalid delete_after: receive" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestInputDeletesDeliveredMessages(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	api := &fakeSQS{messages: []Message{
+		{MessageId: "1", ReceiptHandle: "h1", Body: "first",
+			Attributes: map[string]string{"SentTimestamp": "1420070400000",
+				"ApproximateReceiveCount": "2"},
+			MessageAttributes: map[string]MessageAttribute{
+				"env": {DataType: "String", StringValue: "prod"}}},
+		{MessageId: "2", ReceiptHandle: "h2", Body: "fails"},
+		{MessageId: "3", ReceiptHandle: "h3",
+			Body: `["software.amazon.payloadoffloading.PayloadS3Pointer",` +
+				`{"s3BucketName":"large","s3Key":"k"}]`},
+		{MessageId: "4", ReceiptHandle: "h4",
+			Body: `["software.amazon.payloadoffloading.PayloadS3Pointer",` +
+				`{"s3BucketName":"large","s3Key":"missing"}]`},
+	}}
+	objects := fakeS3{"large/k": "offloaded"}
+	si := &SQSInput{api: api, s3: objects}
+	si.SetName("sqs")
+	si.SetPipelineConfig(NewPipelineConfig(nil))
+	config := si.ConfigStruct().(*SQSInputConfig)
+	config.QueueURL = "https://sqs.us-east-1.amazonaws.com/123456789012/logs"
+	config.DeleteAfter = "router"
+	config.DeleteS3Payloads = true
+	if err := si.Init(config); err != nil {
+		t.Fatal(err)
+	}
+
+	router := NewMessageRouter(10)
+	router.Start()
+	defer close(router.InChan())
+	packSupply := make(chan *PipelinePack, 1)
+	packSupply <- NewPipelinePack(packSupply)
+	ir := pipelinemock.NewMockInputRunner(ctrl)
+	ir.EXPECT().InChan().Return(packSupply)
+	ir.EXPECT().UseMsgBytes().Return(false).AnyTimes()
+	ir.EXPECT().LogError(gomock.Any()).AnyTimes()
+	var (
+		payloads []string
+		done     = make(chan bool)
+	)
+	ir.EXPECT().Deliver(gomock.Any()).Times(3).Do(func(pack *PipelinePack) {
+		msg := pack.Message
+		payloads = append(payloads, msg.GetPayload())
+		if len(payloads) == 1 {
+			env, _ := msg.GetFieldValue("env")
+			count, _ := msg.GetFieldValue("ReceiveCount")
+			if msg.GetTimestamp() != 1420070400*int64(time.Second) || env != "prod" ||
+				count != int64(2) {
+
+				t.Errorf("Unexpected message: %v", msg)
+			}
+		}
+		if msg.GetPayload() == "fails" {
+			// Never reaches the router.
+			pack.Recycle()
+		} else {
+			router.InChan() <- pack
+		}
+		if len(payloads) == 3 {
+			close(done)
+		}
+	})
+
+	errChan := make(chan error)
+	go func() {
+		errChan <- si.Run(ir, pipelinemock.NewMockPluginHelper(ctrl))
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out, received %v", payloads)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(api.deletedHandles()) < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	si.Stop()
+	if err := <-errChan; err != nil {
+		t.Fatal(err)
+	}
+
+	if len(payloads) != 3 || payloads[0] != "first" || payloads[2] != "offloaded" {
+		t.Errorf("Unexpected payloads: %v", payloads)
+	}
+	deleted := api.deletedHandles()
+	if len(deleted) != 2 || deleted[0] == "h2" || deleted[1] == "h2" {
+		t.Errorf("Unexpected deletions: %v", deleted)
+	}
+	if _, ok := objects["large/k"]; ok {
+		t.Error("Offloaded payload wasn't deleted")
+	}
+}
@@ -25,6 +25,7 @@ func TestAllSpecs(t *testing.T) {
 
 	r.AddSpec(StatsdInputSpec)
 	r.AddSpec(StatsToFieldsDecoderSpec)
+	r.AddSpec(StatsdOutputSpec)
 
 	gospec.MainGoTest(r, t)
 }
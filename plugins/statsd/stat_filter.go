@@ -80,30 +80,11 @@ func (s *StatFilter) Run(fr FilterRunner, h PluginHelper) (err error) {
 		pack   *PipelinePack
 		values = make(map[string]string)
 		stat   Stat
-		val    string
 	)
 
 	inChan := fr.InChan()
 	for pack = range inChan {
-		// Load existing values into the set for replacement
-		values["Logger"] = pack.Message.GetLogger()
-		values["Hostname"] = pack.Message.GetHostname()
-		values["Type"] = pack.Message.GetType()
-		values["Payload"] = pack.Message.GetPayload()
-
-		for _, field := range pack.Message.Fields {
-			// It's painful to be converting these numeric values to strings,
-			// but for now it's the only way to get numeric data into the stat
-			// accumulator.
-			if field.GetValueType() == message.Field_STRING && len(field.ValueString) > 0 {
-				val = field.ValueString[0]
-			} else if field.GetValueType() == message.Field_DOUBLE {
-				val = strconv.FormatFloat(field.ValueDouble[0], 'f', -1, 64)
-			} else if field.GetValueType() == message.Field_INTEGER {
-				val = strconv.FormatInt(field.ValueInteger[0], 10)
-			}
-			values[field.GetName()] = val
-		}
+		messageValues(pack.Message, values)
 
 		// We matched, generate appropriate metrics
 		for _, met := range s.metrics {
@@ -128,6 +109,31 @@ func (s *StatFilter) Run(fr FilterRunner, h PluginHelper) (err error) {
 	return
 }
 
+// Loads the "Logger", "Hostname", "Type", and "Payload" values of a message,
+// and the first value of each of its string and numeric fields, into the set
+// of values used for interpolation.
+func messageValues(msg *message.Message, values map[string]string) {
+	values["Logger"] = msg.GetLogger()
+	values["Hostname"] = msg.GetHostname()
+	values["Type"] = msg.GetType()
+	values["Payload"] = msg.GetPayload()
+
+	var val string
+	for _, field := range msg.Fields {
+		// It's painful to be converting these numeric values to strings,
+		// but for now it's the only way to get numeric data into the stat
+		// accumulator.
+		if field.GetValueType() == message.Field_STRING && len(field.ValueString) > 0 {
+			val = field.ValueString[0]
+		} else if field.GetValueType() == message.Field_DOUBLE {
+			val = strconv.FormatFloat(field.ValueDouble[0], 'f', -1, 64)
+		} else if field.GetValueType() == message.Field_INTEGER {
+			val = strconv.FormatInt(field.ValueInteger[0], 10)
+		}
+		values[field.GetName()] = val
+	}
+}
+
 func init() {
 	RegisterPlugin("StatFilter", func() interface{} {
 		return new(StatFilter)
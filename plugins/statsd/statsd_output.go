@@ -0,0 +1,269 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package statsd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+	. "github.com/mozilla-services/heka/pipeline"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// A statsd metric generated from each message, see StatFilter's metrics.
+type outputMetric struct {
+	// Supports "Counter", "Timer", or "Gauge"
+	Type_ string `toml:"type"`
+	Name  string
+	Value string
+	// Fraction of the messages a counter or timer is sent for, the server
+	// scales the values accordingly. Defaults to 1.
+	SampleRate float64 `toml:"sample_rate"`
+}
+
+type StatsdOutputConfig struct {
+	// Address of the statsd server. Defaults to "127.0.0.1:8125".
+	Address string
+	// Network type, "udp" or "tcp". Defaults to "udp".
+	Net string
+	// Prepended to every metric name.
+	Prefix string
+	// Set of metric templates, keyed by arbitrary metric id.
+	Metric map[string]outputMetric
+	// Maximum size of a UDP packet, several metrics are sent in a packet
+	// when they fit. Defaults to 512.
+	MaxPacketSize int `toml:"max_packet_size"`
+	// Milliseconds to wait for a TCP connection to be established. Defaults
+	// to 5000.
+	ConnectTimeout uint32 `toml:"connect_timeout"`
+}
+
+// Heka Output plugin generating statsd metrics from the messages it receives,
+// as StatFilter does, and sending them to an external statsd server, e.g. a
+// Datadog agent, over UDP or TCP.
+type StatsdOutput struct {
+	metricsSent    int64
+	metricsSkipped int64
+	metricsDropped int64
+	sendFailures   int64
+
+	conf    *StatsdOutputConfig
+	names   []string
+	conn    net.Conn
+	packet  bytes.Buffer
+	skipped map[string]bool
+	// Swapped out in tests.
+	random func() float64
+}
+
+func (o *StatsdOutput) ConfigStruct() interface{} {
+	return &StatsdOutputConfig{
+		Address:        "127.0.0.1:8125",
+		Net:            "udp",
+		MaxPacketSize:  512,
+		ConnectTimeout: 5000,
+	}
+}
+
+func (o *StatsdOutput) Init(config interface{}) error {
+	o.conf = config.(*StatsdOutputConfig)
+	if o.conf.Net != "udp" && o.conf.Net != "tcp" {
+		return fmt.Errorf(`invalid net "%s", must be "udp" or "tcp"`, o.conf.Net)
+	}
+	if len(o.conf.Metric) == 0 {
+		return errors.New("at least one metric must be specified")
+	}
+	if o.conf.MaxPacketSize < 1 {
+		return errors.New("max_packet_size must be greater than 0")
+	}
+	for id, met := range o.conf.Metric {
+		switch met.Type_ {
+		case "Counter", "Timer", "Gauge":
+		default:
+			return fmt.Errorf("metric %s: unsupported type '%s'", id, met.Type_)
+		}
+		if met.SampleRate < 0 || met.SampleRate > 1 {
+			return fmt.Errorf("metric %s: sample_rate must be between 0 and 1", id)
+		}
+		if met.SampleRate == 0 {
+			met.SampleRate = 1
+			o.conf.Metric[id] = met
+		}
+		o.names = append(o.names, id)
+	}
+	// Metrics are sent in a stable order.
+	sort.Strings(o.names)
+	o.skipped = make(map[string]bool)
+	o.random = rand.Float64
+	return nil
+}
+
+func (o *StatsdOutput) Run(or OutputRunner, h PluginHelper) (err error) {
+	defer o.disconnect()
+	var lines []string
+	for pack := range or.InChan() {
+		values := make(map[string]string)
+		messageValues(pack.Message, values)
+		pack.Recycle()
+
+		lines = lines[:0]
+		for _, id := range o.names {
+			lines = o.appendLines(or, lines, id, values)
+		}
+		if len(lines) > 0 {
+			o.send(or, lines)
+		}
+	}
+	return
+}
+
+// Appends the statsd lines of a metric, if its value is numeric and it's
+// sampled.
+func (o *StatsdOutput) appendLines(or OutputRunner, lines []string, id string,
+	values map[string]string) []string {
+
+	met := o.conf.Metric[id]
+	raw := InterpolateString(met.Value, values)
+	value, err := strconv.ParseFloat(raw, 64)
+	if err != nil {
+		atomic.AddInt64(&o.metricsSkipped, 1)
+		// The same fields are usually missing from every message.
+		if !o.skipped[id] {
+			o.skipped[id] = true
+			or.LogError(fmt.Errorf("metric %s: non numeric value '%s'", id, raw))
+		}
+		return lines
+	}
+	name := statsdName(o.conf.Prefix + InterpolateString(met.Name, values))
+	formatted := strconv.FormatFloat(value, 'f', -1, 64)
+
+	switch met.Type_ {
+	case "Gauge":
+		// A signed value changes a gauge rather than setting it.
+		if value < 0 {
+			lines = append(lines, name+":0|g")
+		}
+		return append(lines, fmt.Sprintf("%s:%s|g", name, formatted))
+	case "Timer":
+		formatted += "|ms"
+	default:
+		formatted += "|c"
+	}
+	if met.SampleRate < 1 {
+		if o.random() >= met.SampleRate {
+			return lines
+		}
+		formatted += "|@" + strconv.FormatFloat(met.SampleRate, 'f', -1, 64)
+	}
+	return append(lines, name+":"+formatted)
+}
+
+// Replaces the characters statsd uses as separators in metric names.
+var nameReplacer = strings.NewReplacer(":", "_", "|", "_", "@", "_", " ", "_",
+	"\t", "_", "\n", "_")
+
+func statsdName(name string) string {
+	return nameReplacer.Replace(name)
+}
+
+// Sends a message's metrics, in as few UDP packets as they fit in, or in a
+// single TCP write.
+func (o *StatsdOutput) send(or OutputRunner, lines []string) {
+	if o.conn == nil {
+		if err := o.connect(); err != nil {
+			o.failed(or, len(lines), err)
+			return
+		}
+	}
+	udp := o.conf.Net == "udp"
+	o.packet.Reset()
+	count := 0
+	for i, line := range lines {
+		if udp && o.packet.Len() > 0 {
+			if o.packet.Len()+1+len(line) > o.conf.MaxPacketSize {
+				if !o.write(or, count) {
+					atomic.AddInt64(&o.metricsDropped, int64(len(lines)-i))
+					return
+				}
+				o.packet.Reset()
+				count = 0
+			} else {
+				o.packet.WriteByte('\n')
+			}
+		}
+		o.packet.WriteString(line)
+		if !udp {
+			o.packet.WriteByte('\n')
+		}
+		count++
+	}
+	o.write(or, count)
+}
+
+// Writes the pending packet of `count` metrics. A TCP connection is dropped
+// after a failure, to be established again for the next message.
+func (o *StatsdOutput) write(or OutputRunner, count int) bool {
+	if _, err := o.conn.Write(o.packet.Bytes()); err != nil {
+		if o.conf.Net == "tcp" {
+			o.disconnect()
+		}
+		o.failed(or, count, err)
+		return false
+	}
+	atomic.AddInt64(&o.metricsSent, int64(count))
+	return true
+}
+
+func (o *StatsdOutput) failed(or OutputRunner, count int, err error) {
+	atomic.AddInt64(&o.sendFailures, 1)
+	atomic.AddInt64(&o.metricsDropped, int64(count))
+	or.LogError(fmt.Errorf("can't send to %s: %s", o.conf.Address, err))
+}
+
+func (o *StatsdOutput) connect() (err error) {
+	timeout := time.Duration(o.conf.ConnectTimeout) * time.Millisecond
+	if o.conn, err = net.DialTimeout(o.conf.Net, o.conf.Address, timeout); err != nil {
+		o.conn = nil
+	}
+	return
+}
+
+func (o *StatsdOutput) disconnect() {
+	if o.conn != nil {
+		o.conn.Close()
+		o.conn = nil
+	}
+}
+
+func (o *StatsdOutput) ReportMsg(msg *message.Message) error {
+	message.NewInt64Field(msg, "MetricsSent", atomic.LoadInt64(&o.metricsSent), "count")
+	message.NewInt64Field(msg, "MetricsSkipped", atomic.LoadInt64(&o.metricsSkipped),
+		"count")
+	message.NewInt64Field(msg, "MetricsDropped", atomic.LoadInt64(&o.metricsDropped),
+		"count")
+	message.NewInt64Field(msg, "SendFailures", atomic.LoadInt64(&o.sendFailures),
+		"count")
+	return nil
+}
+
+func init() {
+	RegisterPlugin("StatsdOutput", func() interface{} {
+		return new(StatsdOutput)
+	})
+}
@@ -0,0 +1,150 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package statsd
+
+import (
+	"github.com/mozilla-services/heka/message"
+	. "github.com/mozilla-services/heka/pipeline"
+	pipeline_ts "github.com/mozilla-services/heka/pipeline/testsupport"
+	. "github.com/mozilla-services/heka/pipelinemock"
+	"github.com/rafrombrc/gomock/gomock"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"net"
+	"time"
+)
+
+func StatsdOutputSpec(c gs.Context) {
+	t := new(pipeline_ts.SimpleT)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	oRunner := NewMockOutputRunner(ctrl)
+	oRunner.EXPECT().LogError(gomock.Any()).AnyTimes()
+
+	output := new(StatsdOutput)
+	config := output.ConfigStruct().(*StatsdOutputConfig)
+	config.Prefix = "heka."
+	config.Metric = map[string]outputMetric{
+		"bytes": {Type_: "Counter", Name: "bytes.%Hostname%", Value: "%Bytes%"},
+		"load":  {Type_: "Gauge", Name: "load", Value: "%Load%"},
+		"time":  {Type_: "Timer", Name: "time:%Method%", Value: "%Time%", SampleRate: 0.5},
+	}
+
+	pConfig := NewPipelineConfig(nil)
+	pack := NewPipelinePack(pConfig.InputRecycleChan())
+	pack.Message.SetHostname("web1")
+	message.NewInt64Field(pack.Message, "Bytes", 512, "B")
+	field, _ := message.NewField("Load", -0.5, "")
+	pack.Message.AddField(field)
+	message.NewStringField(pack.Message, "Method", "GET")
+	message.NewInt64Field(pack.Message, "Time", 12, "ms")
+
+	values := make(map[string]string)
+	messageValues(pack.Message, values)
+
+	c.Specify("A StatsdOutput", func() {
+		c.Specify("generates statsd lines", func() {
+			c.Assume(output.Init(config), gs.IsNil)
+			output.random = func() float64 { return 0.25 }
+			var lines []string
+			for _, id := range output.names {
+				lines = output.appendLines(oRunner, lines, id, values)
+			}
+			c.Expect(len(lines), gs.Equals, 4)
+			c.Expect(lines[0], gs.Equals, "heka.bytes.web1:512|c")
+			c.Expect(lines[1], gs.Equals, "heka.load:0|g")
+			c.Expect(lines[2], gs.Equals, "heka.load:-0.5|g")
+			c.Expect(lines[3], gs.Equals, "heka.time_GET:12|ms|@0.5")
+
+			output.random = func() float64 { return 0.75 }
+			lines = output.appendLines(oRunner, nil, "time", values)
+			c.Expect(len(lines), gs.Equals, 0)
+
+			delete(values, "Bytes")
+			lines = output.appendLines(oRunner, nil, "bytes", values)
+			c.Expect(len(lines), gs.Equals, 0)
+			c.Expect(output.metricsSkipped, gs.Equals, int64(1))
+		})
+
+		c.Specify("rejects unknown metric types", func() {
+			config.Metric = map[string]outputMetric{
+				"sets": {Type_: "Set", Name: "users", Value: "%User%"},
+			}
+			c.Expect(output.Init(config), gs.Not(gs.IsNil))
+		})
+
+		c.Specify("splits metrics into UDP packets", func() {
+			server, err := net.ListenPacket("udp", "127.0.0.1:0")
+			c.Assume(err, gs.IsNil)
+			defer server.Close()
+			config.Address = server.LocalAddr().String()
+			config.MaxPacketSize = 30
+			c.Assume(output.Init(config), gs.IsNil)
+
+			output.send(oRunner, []string{"heka.a:1|c", "heka.b:2|c", "heka.c:3|c"})
+			buf := make([]byte, 100)
+			server.SetReadDeadline(time.Now().Add(time.Second))
+			n, _, err := server.ReadFrom(buf)
+			c.Assume(err, gs.IsNil)
+			c.Expect(string(buf[:n]), gs.Equals, "heka.a:1|c\nheka.b:2|c")
+			n, _, err = server.ReadFrom(buf)
+			c.Assume(err, gs.IsNil)
+			c.Expect(string(buf[:n]), gs.Equals, "heka.c:3|c")
+			c.Expect(output.metricsSent, gs.Equals, int64(3))
+			output.disconnect()
+		})
+
+		c.Specify("sends newline terminated metrics over TCP", func() {
+			server, err := net.Listen("tcp", "127.0.0.1:0")
+			c.Assume(err, gs.IsNil)
+			defer server.Close()
+			received := make(chan string, 1)
+			go func() {
+				conn, err := server.Accept()
+				if err != nil {
+					return
+				}
+				buf := make([]byte, 100)
+				n, _ := conn.Read(buf)
+				received <- string(buf[:n])
+				conn.Close()
+			}()
+			config.Net = "tcp"
+			config.Address = server.Addr().String()
+			c.Assume(output.Init(config), gs.IsNil)
+
+			output.send(oRunner, []string{"heka.a:1|c", "heka.b:2|g"})
+			select {
+			case data := <-received:
+				c.Expect(data, gs.Equals, "heka.a:1|c\nheka.b:2|g\n")
+			case <-time.After(time.Second):
+				c.Expect("nothing received", gs.Equals, "")
+			}
+			output.disconnect()
+		})
+
+		c.Specify("drops metrics when the server is unreachable", func() {
+			server, err := net.Listen("tcp", "127.0.0.1:0")
+			c.Assume(err, gs.IsNil)
+			config.Address = server.Addr().String()
+			server.Close()
+			config.Net = "tcp"
+			config.ConnectTimeout = 100
+			c.Assume(output.Init(config), gs.IsNil)
+
+			output.send(oRunner, []string{"heka.a:1|c", "heka.b:2|c"})
+			c.Expect(output.metricsDropped, gs.Equals, int64(2))
+			c.Expect(output.sendFailures, gs.Equals, int64(1))
+			c.Expect(output.conn, gs.IsNil)
+		})
+	})
+}
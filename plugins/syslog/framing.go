@@ -0,0 +1,121 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package syslog
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// Reads syslog messages from a stream transport, framed either with octet
+// counting (RFC 6587 section 3.4.1, as used by RFC 5425 TLS transport), i.e.
+// prefixed with their length, or non-transparently, i.e. terminated by a line
+// feed. Buffered data survives read errors, so reads can time out and be
+// retried without losing partial messages.
+type frameReader struct {
+	r       io.Reader
+	framing string // "octet_counting", "non_transparent", or "auto".
+	maxSize int
+	buf     []byte
+	start   int // Offset of the unread data in buf.
+	end     int
+}
+
+func newFrameReader(r io.Reader, framing string, maxSize int) *frameReader {
+	return &frameReader{
+		r:       r,
+		framing: framing,
+		maxSize: maxSize,
+		// Room for the largest message and its length prefix.
+		buf: make([]byte, maxSize+16),
+	}
+}
+
+// Returns the next message, which is only valid until the following call.
+// Framing errors are fatal, as the stream can't be resynchronized.
+func (f *frameReader) next() ([]byte, error) {
+	for {
+		frame, err := f.frame()
+		if frame != nil || err != nil {
+			return frame, err
+		}
+		if f.start > 0 {
+			copy(f.buf, f.buf[f.start:f.end])
+			f.end -= f.start
+			f.start = 0
+		}
+		n, err := f.r.Read(f.buf[f.end:])
+		f.end += n
+		if err != nil {
+			if err == io.EOF && f.end > f.start && !f.counted(f.buf[f.start:f.end]) {
+				// The last message of a connection may lack its line feed.
+				frame = f.buf[f.start:f.end]
+				f.start = f.end
+				return frame, nil
+			}
+			return nil, err
+		}
+	}
+}
+
+// Extracts a complete message from the buffered data, returning nil if more
+// data is needed.
+func (f *frameReader) frame() ([]byte, error) {
+	data := f.buf[f.start:f.end]
+	if len(data) == 0 {
+		return nil, nil
+	}
+	if f.counted(data) {
+		return f.countedFrame(data)
+	}
+	if i := bytes.IndexByte(data, '\n'); i >= 0 {
+		f.start += i + 1
+		return bytes.TrimSuffix(data[:i], []byte("\r")), nil
+	}
+	if len(data) > f.maxSize {
+		return nil, fmt.Errorf("message exceeds the maximum size of %d bytes", f.maxSize)
+	}
+	return nil, nil
+}
+
+// Returns whether the message at the start of the data uses octet counting.
+// When detecting the framing, that's the case if it starts with a length
+// rather than a PRI part.
+func (f *frameReader) counted(data []byte) bool {
+	return f.framing == "octet_counting" ||
+		(f.framing == "auto" && data[0] >= '1' && data[0] <= '9')
+}
+
+func (f *frameReader) countedFrame(data []byte) ([]byte, error) {
+	sp := bytes.IndexByte(data, ' ')
+	if sp < 0 {
+		if len(data) > 10 {
+			return nil, fmt.Errorf("invalid message length: %.10q", data)
+		}
+		return nil, nil
+	}
+	size, err := strconv.Atoi(string(data[:sp]))
+	if err != nil || size < 1 {
+		return nil, fmt.Errorf("invalid message length: %q", data[:sp])
+	}
+	if size > f.maxSize {
+		return nil, fmt.Errorf("message length %d exceeds the maximum size of %d bytes",
+			size, f.maxSize)
+	}
+	if len(data) < sp+1+size {
+		return nil, nil
+	}
+	f.start += sp + 1 + size
+	return data[sp+1 : sp+1+size], nil
+}
@@ -0,0 +1,303 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package syslog
+
+import (
+	"code.google.com/p/go-uuid/uuid"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+	"github.com/mozilla-services/heka/pipeline"
+	"github.com/mozilla-services/heka/plugins/tcp"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type SyslogInputConfig struct {
+	// Transport, "udp", "tcp", or a variant restricted to IPv4 or IPv6 such
+	// as "tcp4". TLS is used over "tcp" if `use_tls` is set.
+	Net string
+	// Address to listen on, e.g. "0.0.0.0:514".
+	Address string
+	// Whether TCP connections are tunneled through TLS (RFC 5425). Requires
+	// the `tls` section.
+	UseTls bool `toml:"use_tls"`
+	// Subsection for TLS configuration.
+	Tls tcp.TlsConfig
+	// Framing of stream transports, "octet_counting", "non_transparent"
+	// (line feed terminated), or "auto" to detect it for each message.
+	Framing string
+	// Message format, "rfc3164", "rfc5424", or "auto" to detect it for each
+	// message.
+	Format string
+	// Largest message accepted, in bytes. Defaults to 64KiB.
+	MaxMessageSize uint32 `toml:"max_message_size"`
+	// Time zone of RFC 3164 timestamps, which carry no zone. Defaults to UTC.
+	Tz string `toml:"tz"`
+	// Type of the delivered messages. Defaults to "syslog".
+	MessageType string `toml:"message_type"`
+}
+
+// Input listening for syslog messages over UDP, TCP, or TLS, parsing them
+// into message headers and fields without the need for a decoder.
+type SyslogInput struct {
+	conf     *SyslogInputConfig
+	loc      *time.Location
+	listener net.Listener
+	packet   net.PacketConn
+	ir       pipeline.InputRunner
+	wg       sync.WaitGroup
+	stopChan chan bool
+}
+
+func (s *SyslogInput) ConfigStruct() interface{} {
+	return &SyslogInputConfig{
+		Net:            "udp",
+		Framing:        "auto",
+		Format:         "auto",
+		MaxMessageSize: 64 * 1024,
+		Tz:             "UTC",
+		MessageType:    "syslog",
+		Tls:            tcp.TlsConfig{PreferServerCiphers: true},
+	}
+}
+
+func (s *SyslogInput) Init(config interface{}) (err error) {
+	s.conf = config.(*SyslogInputConfig)
+	if s.conf.Address == "" {
+		return errors.New("`address` must be specified")
+	}
+	switch s.conf.Framing {
+	case "auto", "octet_counting", "non_transparent":
+	default:
+		return fmt.Errorf("`framing` must be 'auto', 'octet_counting', or "+
+			"'non_transparent', got %s", s.conf.Framing)
+	}
+	switch s.conf.Format {
+	case "auto", "rfc3164", "rfc5424":
+	default:
+		return fmt.Errorf("`format` must be 'auto', 'rfc3164', or 'rfc5424', got %s",
+			s.conf.Format)
+	}
+	if s.conf.MaxMessageSize == 0 {
+		return errors.New("`max_message_size` must be greater than zero")
+	}
+	if s.loc, err = time.LoadLocation(s.conf.Tz); err != nil {
+		return err
+	}
+
+	if strings.HasPrefix(s.conf.Net, "udp") {
+		if s.conf.UseTls {
+			return errors.New("TLS requires a TCP transport")
+		}
+		if s.packet, err = net.ListenPacket(s.conf.Net, s.conf.Address); err != nil {
+			return fmt.Errorf("ListenPacket failed: %s", err)
+		}
+	} else if strings.HasPrefix(s.conf.Net, "tcp") {
+		if s.listener, err = net.Listen(s.conf.Net, s.conf.Address); err != nil {
+			return fmt.Errorf("Listen failed: %s", err)
+		}
+		if s.conf.UseTls {
+			if err = s.setupTls(); err != nil {
+				s.listener.Close()
+				return err
+			}
+		}
+	} else {
+		return fmt.Errorf("unsupported net: %s", s.conf.Net)
+	}
+	s.stopChan = make(chan bool)
+	return nil
+}
+
+func (s *SyslogInput) setupTls() (err error) {
+	if s.conf.Tls.CertFile == "" || s.conf.Tls.KeyFile == "" {
+		return errors.New("TLS config requires both cert_file and key_file value.")
+	}
+	var goConf *tls.Config
+	if goConf, err = tcp.CreateGoTlsConfig(&s.conf.Tls); err == nil {
+		s.listener = tls.NewListener(s.listener, goConf)
+	}
+	return
+}
+
+func (s *SyslogInput) Run(ir pipeline.InputRunner, h pipeline.PluginHelper) error {
+	s.ir = ir
+	if s.packet != nil {
+		s.readPackets()
+		return nil
+	}
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+				ir.LogError(fmt.Errorf("accept failed: %s", err))
+				continue
+			}
+			break
+		}
+		s.wg.Add(1)
+		go s.handleConnection(conn)
+	}
+	s.wg.Wait()
+	return nil
+}
+
+// Delivers each datagram as a message until the socket is closed.
+func (s *SyslogInput) readPackets() {
+	buf := make([]byte, s.conf.MaxMessageSize)
+	for {
+		n, addr, err := s.packet.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-s.stopChan:
+				return
+			default:
+			}
+			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+				s.ir.LogError(fmt.Errorf("read failed: %s", err))
+				continue
+			}
+			s.ir.LogError(fmt.Errorf("read failed: %s", err))
+			return
+		}
+		if data := trimMessage(buf[:n]); len(data) > 0 {
+			s.deliver(data, addr)
+		}
+	}
+}
+
+// Delivers the messages of a stream connection until it's closed or the
+// input is stopped.
+func (s *SyslogInput) handleConnection(conn net.Conn) {
+	defer func() {
+		conn.Close()
+		s.wg.Done()
+	}()
+	reader := newFrameReader(conn, s.conf.Framing, int(s.conf.MaxMessageSize))
+	for {
+		select {
+		case <-s.stopChan:
+			return
+		default:
+		}
+		// Time out regularly to check whether we're stopping.
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		data, err := reader.next()
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				continue
+			}
+			if err != io.EOF {
+				s.ir.LogError(fmt.Errorf("connection from %s: %s", conn.RemoteAddr(), err))
+			}
+			return
+		}
+		if data = trimMessage(data); len(data) > 0 {
+			s.deliver(data, conn.RemoteAddr())
+		}
+	}
+}
+
+// Strips the trailing line feeds and NUL bytes some senders add.
+func trimMessage(data []byte) []byte {
+	for len(data) > 0 {
+		switch data[len(data)-1] {
+		case '\n', '\r', 0:
+			data = data[:len(data)-1]
+		default:
+			return data
+		}
+	}
+	return data
+}
+
+// Parses a syslog message and delivers it. Messages that can't be parsed are
+// delivered with the raw message as the payload and the decode failure fields
+// set.
+func (s *SyslogInput) deliver(data []byte, addr net.Addr) {
+	now := time.Now()
+	sender := addr.String()
+	if host, _, err := net.SplitHostPort(sender); err == nil {
+		sender = host
+	}
+	pack := <-s.ir.InChan()
+	msg := pack.Message
+	msg.SetUuid(uuid.NewRandom())
+	msg.SetType(s.conf.MessageType)
+	msg.SetLogger(s.ir.Name())
+	msg.SetTimestamp(now.UnixNano())
+	msg.SetHostname(sender)
+	message.NewStringField(msg, "sender", sender)
+
+	m, err := parseSyslog(data, s.conf.Format, s.loc, now)
+	if err != nil {
+		msg.SetPayload(string(data))
+		if err = pipeline.AddDecodeFailureFields(msg, err.Error()); err != nil {
+			s.ir.LogError(err)
+		}
+	} else {
+		populateMessage(msg, m)
+	}
+	s.ir.Deliver(pack)
+}
+
+// Copies a parsed syslog message into a Heka message. The timestamp and
+// hostname are only replaced if the syslog message has them.
+func populateMessage(msg *message.Message, m *syslogMessage) {
+	if !m.timestamp.IsZero() {
+		msg.SetTimestamp(m.timestamp.UnixNano())
+	}
+	if m.hostname != "" {
+		msg.SetHostname(m.hostname)
+	}
+	msg.SetSeverity(int32(m.severity))
+	msg.SetPayload(m.msg)
+	message.NewIntField(msg, "syslogfacility", m.facility, "")
+	if m.appName != "" {
+		message.NewStringField(msg, "programname", m.appName)
+	}
+	if m.procID != "" {
+		if pid, err := strconv.ParseInt(m.procID, 10, 32); err == nil {
+			msg.SetPid(int32(pid))
+		} else {
+			message.NewStringField(msg, "procid", m.procID)
+		}
+	}
+	if m.msgID != "" {
+		message.NewStringField(msg, "msgid", m.msgID)
+	}
+	for _, p := range m.sd {
+		message.NewStringField(msg, p.id+"."+p.name, p.value)
+	}
+}
+
+func (s *SyslogInput) Stop() {
+	close(s.stopChan)
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	if s.packet != nil {
+		s.packet.Close()
+	}
+}
+
+func init() {
+	pipeline.RegisterPlugin("SyslogInput", func() interface{} {
+		return new(SyslogInput)
+	})
+}
@@ -0,0 +1,291 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package syslog
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// A parsed syslog message. Absent (or nil, "-") values are left empty.
+type syslogMessage struct {
+	facility  int
+	severity  int
+	timestamp time.Time // Zero if the message has no usable timestamp.
+	hostname  string
+	appName   string
+	procID    string
+	msgID     string
+	sd        []sdParam
+	msg       string
+}
+
+// A parameter of an RFC 5424 structured data element.
+type sdParam struct {
+	id    string
+	name  string
+	value string
+}
+
+// Priority of RFC 3164 messages without a PRI part: user.notice.
+const defaultPriority = 13
+
+// UTF-8 byte order mark allowed at the start of an RFC 5424 message.
+var bom = []byte{0xEF, 0xBB, 0xBF}
+
+var errNoPriority = errors.New("missing PRI part")
+
+// Parses a syslog message in `format`, "rfc3164", "rfc5424", or "auto" to
+// detect the format from the version following the PRI part. RFC 3164
+// timestamps, which have no year or zone, are interpreted in `loc`, in the
+// year that puts them closest to `now`.
+func parseSyslog(data []byte, format string, loc *time.Location,
+	now time.Time) (m *syslogMessage, err error) {
+
+	m = new(syslogMessage)
+	pri, rest, err := parsePriority(data)
+	if err != nil {
+		if err != errNoPriority || format == "rfc5424" {
+			return nil, err
+		}
+		// RFC 3164 section 4.3.3: a relay treats a message without PRI as
+		// user.notice with the entire message as its content.
+		pri, rest, err = defaultPriority, data, nil
+	}
+	m.facility, m.severity = pri/8, pri%8
+	isRFC5424 := len(rest) > 1 && rest[0] == '1' && rest[1] == ' '
+	switch {
+	case format == "rfc5424" || (format == "auto" && isRFC5424):
+		if !isRFC5424 {
+			return nil, errors.New("unsupported RFC 5424 version")
+		}
+		err = m.parseRFC5424(rest[2:])
+	default:
+		m.parseRFC3164(rest, loc, now)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Parses the `<PRI>` part, returning the priority and the remaining data.
+func parsePriority(data []byte) (pri int, rest []byte, err error) {
+	if len(data) == 0 || data[0] != '<' {
+		return 0, nil, errNoPriority
+	}
+	end := bytes.IndexByte(data, '>')
+	if end < 2 || end > 4 {
+		return 0, nil, errors.New("invalid PRI part")
+	}
+	if pri, err = strconv.Atoi(string(data[1:end])); err != nil || pri > 191 {
+		return 0, nil, fmt.Errorf("invalid priority: %s", data[1:end])
+	}
+	return pri, data[end+1:], nil
+}
+
+// Splits off the next space separated token.
+func nextToken(data []byte) (token, rest []byte) {
+	if i := bytes.IndexByte(data, ' '); i >= 0 {
+		return data[:i], data[i+1:]
+	}
+	return data, nil
+}
+
+// Returns the value of an RFC 5424 header field, mapping the nil value to "".
+func headerValue(token []byte) string {
+	if len(token) == 1 && token[0] == '-' {
+		return ""
+	}
+	return string(token)
+}
+
+// Parses an RFC 5424 message following the version.
+func (m *syslogMessage) parseRFC5424(data []byte) (err error) {
+	var token []byte
+	token, data = nextToken(data)
+	if ts := headerValue(token); ts != "" {
+		if m.timestamp, err = time.Parse(time.RFC3339Nano, ts); err != nil {
+			return fmt.Errorf("invalid timestamp: %s", ts)
+		}
+	}
+	fields := []*string{&m.hostname, &m.appName, &m.procID, &m.msgID}
+	for _, field := range fields {
+		if data == nil {
+			return errors.New("truncated header")
+		}
+		token, data = nextToken(data)
+		*field = headerValue(token)
+	}
+	if len(data) == 0 {
+		return errors.New("missing structured data")
+	}
+	if data[0] == '-' {
+		data = data[1:]
+	} else if data, err = m.parseStructuredData(data); err != nil {
+		return err
+	}
+	if len(data) > 0 {
+		if data[0] != ' ' {
+			return errors.New("invalid structured data")
+		}
+		data = bytes.TrimPrefix(data[1:], bom)
+	}
+	m.msg = string(data)
+	return nil
+}
+
+// Parses the structured data elements, returning the data following them.
+func (m *syslogMessage) parseStructuredData(data []byte) ([]byte, error) {
+	for len(data) > 0 && data[0] == '[' {
+		end := bytes.IndexAny(data, " ]")
+		if end < 2 {
+			return nil, errors.New("invalid structured data element ID")
+		}
+		id := string(data[1:end])
+		data = data[end:]
+		for len(data) > 0 && data[0] == ' ' {
+			eq := bytes.IndexByte(data, '=')
+			if eq < 2 || len(data) < eq+2 || data[eq+1] != '"' {
+				return nil, fmt.Errorf("invalid parameter in structured data element %s", id)
+			}
+			name := string(data[1:eq])
+			value, rest, err := parseParamValue(data[eq+2:])
+			if err != nil {
+				return nil, fmt.Errorf("%s in structured data element %s", err, id)
+			}
+			m.sd = append(m.sd, sdParam{id, name, value})
+			data = rest
+		}
+		if len(data) == 0 || data[0] != ']' {
+			return nil, fmt.Errorf("unterminated structured data element %s", id)
+		}
+		data = data[1:]
+	}
+	return data, nil
+}
+
+// Parses a quoted parameter value following the opening quote, resolving the
+// `\"`, `\\`, and `\]` escapes.
+func parseParamValue(data []byte) (value string, rest []byte, err error) {
+	var buf bytes.Buffer
+	for i := 0; i < len(data); i++ {
+		switch c := data[i]; c {
+		case '"':
+			return buf.String(), data[i+1:], nil
+		case '\\':
+			if i+1 < len(data) {
+				switch data[i+1] {
+				case '"', '\\', ']':
+					i++
+					c = data[i]
+				}
+			}
+			buf.WriteByte(c)
+		default:
+			buf.WriteByte(c)
+		}
+	}
+	return "", nil, errors.New("unterminated parameter value")
+}
+
+// Layouts of the timestamps found in RFC 3164 messages, the first is the one
+// the RFC specifies, the others are common deviations.
+var rfc3164Layouts = []string{
+	time.Stamp,
+	time.StampMicro,
+	time.StampMilli,
+}
+
+// Parses an RFC 3164 message following the PRI part. The format is loosely
+// followed in practice, so anything that can't be recognized becomes part of
+// the message content.
+func (m *syslogMessage) parseRFC3164(data []byte, loc *time.Location, now time.Time) {
+	data = m.parse3164Timestamp(data, loc, now)
+	if !m.timestamp.IsZero() {
+		// The hostname is only reliably present after a timestamp.
+		token, rest := nextToken(data)
+		if len(token) > 0 && rest != nil && !isTag(token) {
+			m.hostname = string(token)
+			data = rest
+		}
+	}
+	data = m.parseTag(data)
+	m.msg = string(data)
+}
+
+// Parses the timestamp at the start of an RFC 3164 message, returning the
+// data following it.
+func (m *syslogMessage) parse3164Timestamp(data []byte, loc *time.Location,
+	now time.Time) []byte {
+
+	// Some senders, e.g. rsyslog with RSYSLOG_ForwardFormat, use RFC 3339.
+	if token, rest := nextToken(data); len(token) > 19 && token[4] == '-' {
+		if ts, err := time.Parse(time.RFC3339Nano, string(token)); err == nil {
+			m.timestamp = ts
+			return rest
+		}
+	}
+	for _, layout := range rfc3164Layouts {
+		if len(data) < len(layout) {
+			continue
+		}
+		ts, err := time.ParseInLocation(layout, string(data[:len(layout)]), loc)
+		if err != nil {
+			continue
+		}
+		rest := data[len(layout):]
+		if len(rest) > 0 && rest[0] != ' ' {
+			continue
+		}
+		now = now.In(loc)
+		ts = ts.AddDate(now.Year(), 0, 0)
+		// Messages sent just before new year are received in the next one.
+		if ts.After(now.Add(24 * time.Hour)) {
+			ts = ts.AddDate(-1, 0, 0)
+		}
+		m.timestamp = ts
+		if len(rest) > 0 {
+			rest = rest[1:]
+		}
+		return rest
+	}
+	return data
+}
+
+// Returns whether a token is a tag, i.e. ends in ':' or includes a PID,
+// rather than a hostname.
+func isTag(token []byte) bool {
+	return token[len(token)-1] == ':' || bytes.IndexByte(token, '[') > 0
+}
+
+// Parses the `TAG[PID]: ` prefix of the message content, if there is one,
+// returning the content following it.
+func (m *syslogMessage) parseTag(data []byte) []byte {
+	token, rest := nextToken(data)
+	if len(token) < 2 || !isTag(token) {
+		return data
+	}
+	tag := bytes.TrimSuffix(token, []byte(":"))
+	if open := bytes.IndexByte(tag, '['); open > 0 {
+		if tag[len(tag)-1] != ']' {
+			return data
+		}
+		m.procID = string(tag[open+1 : len(tag)-1])
+		tag = tag[:open]
+	}
+	m.appName = string(tag)
+	return rest
+}
@@ -0,0 +1,248 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package syslog
+
+import (
+	"github.com/mozilla-services/heka/message"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+var now = time.Date(2015, time.March, 3, 12, 0, 0, 0, time.UTC)
+
+func TestParseRFC5424(t *testing.T) {
+	data := `<165>1 2003-10-11T22:14:15.003Z mymachine.example.com evntslog - ID47 ` +
+		`[exampleSDID@32473 iut="3" eventSource="Application" eventID="1011"]` +
+		`[examplePriority@32473 class="high \"x\\y\]"] ` + "\xEF\xBB\xBFAn application event"
+	m, err := parseSyslog([]byte(data), "auto", time.UTC, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.facility != 20 || m.severity != 5 {
+		t.Errorf("facility %d severity %d, expected 20 and 5", m.facility, m.severity)
+	}
+	expectedTs := time.Date(2003, time.October, 11, 22, 14, 15, 3e6, time.UTC)
+	if !m.timestamp.Equal(expectedTs) {
+		t.Errorf("timestamp %s, expected %s", m.timestamp, expectedTs)
+	}
+	if m.hostname != "mymachine.example.com" || m.appName != "evntslog" ||
+		m.procID != "" || m.msgID != "ID47" {
+		t.Errorf("unexpected header: %+v", m)
+	}
+	if len(m.sd) != 4 {
+		t.Fatalf("expected 4 structured data parameters, got %d", len(m.sd))
+	}
+	if p := m.sd[3]; p.id != "examplePriority@32473" || p.name != "class" ||
+		p.value != `high "x\y]` {
+		t.Errorf("unexpected parameter: %+v", p)
+	}
+	if m.msg != "An application event" {
+		t.Errorf("unexpected message: %q", m.msg)
+	}
+
+	m, err = parseSyslog([]byte("<34>1 - - - - - -"), "rfc5424", time.UTC, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !m.timestamp.IsZero() || m.hostname != "" || m.msg != "" {
+		t.Errorf("expected nil values: %+v", m)
+	}
+
+	for _, bad := range []string{
+		"<34>1 2003-10-11T22:14:15Z host",
+		"<34>1 bogus host app - - -",
+		"<34>1 - host app - - [id a=\"1\"",
+		"<34>1 - host app - - [id a=1]",
+		"<34>2 - host app - - -",
+		"<34 no priority",
+	} {
+		if _, err = parseSyslog([]byte(bad), "rfc5424", time.UTC, now); err == nil {
+			t.Errorf("expected an error parsing %q", bad)
+		}
+	}
+}
+
+func TestParseRFC3164(t *testing.T) {
+	tests := []struct {
+		data     string
+		ts       time.Time
+		hostname string
+		appName  string
+		procID   string
+		msg      string
+	}{
+		{"<34>Oct 11 22:14:15 mymachine su: 'su root' failed for lonvick on /dev/pts/8",
+			time.Date(2014, time.October, 11, 22, 14, 15, 0, time.UTC),
+			"mymachine", "su", "", "'su root' failed for lonvick on /dev/pts/8"},
+		{"<13>Mar  3 11:59:00 host sshd[1234]: Accepted publickey",
+			time.Date(2015, time.March, 3, 11, 59, 0, 0, time.UTC),
+			"host", "sshd", "1234", "Accepted publickey"},
+		{"<13>Mar  3 11:59:00 sshd[1234]: no hostname",
+			time.Date(2015, time.March, 3, 11, 59, 0, 0, time.UTC),
+			"", "sshd", "1234", "no hostname"},
+		{"<13>2015-03-03T11:59:00.5+01:00 host app: rsyslog forward format",
+			time.Date(2015, time.March, 3, 10, 59, 0, 5e8, time.UTC),
+			"host", "app", "", "rsyslog forward format"},
+		{"<13>just some text", time.Time{}, "", "", "", "just some text"},
+		{"no priority at all", time.Time{}, "", "", "", "no priority at all"},
+	}
+	for _, test := range tests {
+		m, err := parseSyslog([]byte(test.data), "auto", time.UTC, now)
+		if err != nil {
+			t.Errorf("%q: %s", test.data, err)
+			continue
+		}
+		if !m.timestamp.Equal(test.ts) {
+			t.Errorf("%q: timestamp %s, expected %s", test.data, m.timestamp, test.ts)
+		}
+		if m.hostname != test.hostname || m.appName != test.appName ||
+			m.procID != test.procID || m.msg != test.msg {
+			t.Errorf("%q: unexpected parse %+v", test.data, m)
+		}
+	}
+
+	m, _ := parseSyslog([]byte("<34>Oct 11 22:14:15 mymachine su: x"), "rfc3164",
+		time.UTC, now)
+	if m.facility != 4 || m.severity != 2 {
+		t.Errorf("facility %d severity %d, expected 4 and 2", m.facility, m.severity)
+	}
+	m, _ = parseSyslog([]byte("x"), "rfc3164", time.UTC, now)
+	if m.facility != 1 || m.severity != 5 {
+		t.Errorf("expected user.notice without a PRI part, got %d.%d", m.facility,
+			m.severity)
+	}
+}
+
+// Reader returning its chunks one per read, then timing out once, then EOF.
+type chunkReader struct {
+	chunks   []string
+	timedOut bool
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	if len(r.chunks) == 0 {
+		if !r.timedOut {
+			r.timedOut = true
+			return 0, timeoutError{}
+		}
+		return 0, io.EOF
+	}
+	n := copy(p, r.chunks[0])
+	r.chunks = r.chunks[1:]
+	return n, nil
+}
+
+func readFrames(reader *frameReader) (frames []string, err error) {
+	for {
+		frame, err := reader.next()
+		if err != nil {
+			if _, ok := err.(net.Error); ok {
+				continue
+			}
+			return frames, err
+		}
+		frames = append(frames, string(frame))
+	}
+}
+
+func TestFrameReader(t *testing.T) {
+	tests := []struct {
+		framing string
+		chunks  []string
+		frames  []string
+	}{
+		{"non_transparent", []string{"<1>one\r\n<1>tw", "o\n<1>three"},
+			[]string{"<1>one", "<1>two", "<1>three"}},
+		{"octet_counting", []string{"6 <1>one7 <1>t", "wo\n"},
+			[]string{"<1>one", "<1>two\n"}},
+		{"auto", []string{"6 <1>one<1>two\n", "8 <1>three"},
+			[]string{"<1>one", "<1>two", "<1>three"}},
+	}
+	for _, test := range tests {
+		reader := newFrameReader(&chunkReader{chunks: test.chunks}, test.framing, 64)
+		frames, err := readFrames(reader)
+		if err != io.EOF {
+			t.Errorf("%s: unexpected error: %v", test.framing, err)
+		}
+		if len(frames) != len(test.frames) {
+			t.Errorf("%s: frames %q, expected %q", test.framing, frames, test.frames)
+			continue
+		}
+		for i := range frames {
+			if frames[i] != test.frames[i] {
+				t.Errorf("%s: frames %q, expected %q", test.framing, frames, test.frames)
+				break
+			}
+		}
+	}
+
+	reader := newFrameReader(&chunkReader{chunks: []string{"65 <1>"}}, "auto", 64)
+	if _, err := readFrames(reader); err == nil || err == io.EOF {
+		t.Errorf("expected an error for an oversized message, got %v", err)
+	}
+	reader = newFrameReader(&chunkReader{chunks: []string{"x6 <1>one"}},
+		"octet_counting", 64)
+	if _, err := readFrames(reader); err == nil || err == io.EOF {
+		t.Errorf("expected an error for an invalid length, got %v", err)
+	}
+}
+
+func TestPopulateMessage(t *testing.T) {
+	m, err := parseSyslog([]byte(`<165>1 2003-10-11T22:14:15Z host app 42 ID47 `+
+		`[origin ip="192.0.2.1"][meta x="y"] event`), "auto", time.UTC, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := new(message.Message)
+	msg.SetHostname("sender")
+	populateMessage(msg, m)
+	if msg.GetHostname() != "host" || msg.GetSeverity() != 5 || msg.GetPid() != 42 ||
+		msg.GetPayload() != "event" {
+		t.Errorf("unexpected headers: %s", msg)
+	}
+	expected := map[string]interface{}{
+		"syslogfacility": int64(20),
+		"programname":    "app",
+		"msgid":          "ID47",
+		"origin.ip":      "192.0.2.1",
+		"meta.x":         "y",
+	}
+	for name, value := range expected {
+		if v, ok := msg.GetFieldValue(name); !ok || v != value {
+			t.Errorf("field %s is %v, expected %v", name, v, value)
+		}
+	}
+
+	m, _ = parseSyslog([]byte("<13>1 - - app worker-1 - - text"), "auto", time.UTC, now)
+	msg = new(message.Message)
+	populateMessage(msg, m)
+	if v, _ := msg.GetFieldValue("procid"); v != "worker-1" {
+		t.Errorf("non-numeric procid should be a field, got %v", v)
+	}
+}
+
+func TestTrimMessage(t *testing.T) {
+	if s := string(trimMessage([]byte("msg\r\n\x00"))); s != "msg" {
+		t.Errorf("trimmed to %q", s)
+	}
+	if len(trimMessage([]byte("\n"))) != 0 {
+		t.Error("expected an empty message")
+	}
+}
@@ -27,6 +27,7 @@ func TestAllSpecs(t *testing.T) {
 	r.AddSpec(TcpOutputSpec)
 	r.AddSpec(TlsSpec)
 	r.AddSpec(TcpInputSpecFailure)
+	r.AddSpec(HandshakeSpec)
 
 	gospec.MainGoTest(r, t)
 }
@@ -0,0 +1,255 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package tcp
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	. "github.com/mozilla-services/heka/pipeline"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// The handshake is a single line in each direction, the magic prefix followed
+// by a JSON object. A TcpOutput sends its hello as soon as it connects and
+// waits for the TcpInput's reply before sending any messages.
+const (
+	handshakeMagic   = "HEKA-HANDSHAKE "
+	handshakeMaxSize = 4096
+	// Version of the message schema, i.e. of message.proto, that this Heka
+	// produces. Increment when fields are added or their meaning changes.
+	handshakeSchemaVersion = 1
+)
+
+var errNoHandshake = errors.New("peer didn't send a handshake")
+
+// What one end of a connection supports.
+type handshakeHello struct {
+	// Heka version.
+	Version string `json:"version"`
+	// Message schema version.
+	Schema int `json:"schema"`
+	// Whether the stream uses Heka's message framing.
+	Framing bool `json:"framing"`
+	// Supported compression methods, in order of preference.
+	Compression []string `json:"compression"`
+	// Identifier of the schema of the messages the client produces, if
+	// configured, stamped on them by the server.
+	ProducerSchema string `json:"producer_schema,omitempty"`
+}
+
+// TcpInput's answer to a hello.
+type handshakeReply struct {
+	handshakeHello
+	Accepted bool   `json:"accepted"`
+	Error    string `json:"error,omitempty"`
+}
+
+func newHandshakeHello(framing bool) handshakeHello {
+	return handshakeHello{
+		Version:     VERSION,
+		Schema:      handshakeSchemaVersion,
+		Framing:     framing,
+		Compression: []string{"none"},
+	}
+}
+
+// Returns the major and minor parts of a version string.
+func majorMinor(version string) string {
+	parts := strings.SplitN(version, ".", 3)
+	if len(parts) > 2 {
+		parts = parts[:2]
+	}
+	return strings.Join(parts, ".")
+}
+
+// Compares the two ends of a connection, returning a description of each
+// incompatibility.
+func (h handshakeHello) mismatches(peer handshakeHello) []string {
+	var problems []string
+	if majorMinor(h.Version) != majorMinor(peer.Version) {
+		problems = append(problems, fmt.Sprintf("Heka version %s, peer has %s",
+			h.Version, peer.Version))
+	}
+	if h.Schema != peer.Schema {
+		problems = append(problems, fmt.Sprintf("message schema version %d, peer has %d",
+			h.Schema, peer.Schema))
+	}
+	if h.Framing != peer.Framing {
+		problems = append(problems, fmt.Sprintf("framing %t, peer has %t", h.Framing,
+			peer.Framing))
+	}
+	common := false
+	for _, c := range peer.Compression {
+		if c == "none" {
+			common = true
+			break
+		}
+	}
+	if !common {
+		problems = append(problems, fmt.Sprintf("no common compression method, peer supports %s",
+			strings.Join(peer.Compression, ", ")))
+	}
+	return problems
+}
+
+// Checks a `handshake_mismatch` setting.
+func validateMismatchPolicy(policy string) error {
+	switch policy {
+	case "ignore", "warn", "reject":
+		return nil
+	}
+	return fmt.Errorf("`handshake_mismatch` must be 'ignore', 'warn', or 'reject', got %s",
+		policy)
+}
+
+// Applies a mismatch policy, returning an error if the connection should be
+// refused and logging the mismatches if they should be reported.
+func applyMismatchPolicy(policy string, problems []string,
+	logError func(error)) error {
+
+	if len(problems) == 0 || policy == "ignore" {
+		return nil
+	}
+	err := fmt.Errorf("incompatible peer: %s", strings.Join(problems, "; "))
+	if policy == "reject" {
+		return err
+	}
+	logError(err)
+	return nil
+}
+
+func writeHandshakeLine(w io.Writer, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	line := make([]byte, 0, len(handshakeMagic)+len(data)+1)
+	line = append(line, handshakeMagic...)
+	line = append(line, data...)
+	line = append(line, '\n')
+	_, err = w.Write(line)
+	return err
+}
+
+// Reads a handshake line into `v`. The connection is read a byte at a time so
+// nothing beyond the handshake is consumed. If the stream doesn't start with
+// the handshake magic, errNoHandshake is returned along with the bytes read
+// so far, which belong to the message stream.
+func readHandshakeLine(r io.Reader, v interface{}) (read []byte, err error) {
+	b := make([]byte, 1)
+	for len(read) < handshakeMaxSize {
+		if _, err = io.ReadFull(r, b); err != nil {
+			return read, err
+		}
+		read = append(read, b[0])
+		if len(read) <= len(handshakeMagic) {
+			if read[len(read)-1] != handshakeMagic[len(read)-1] {
+				return read, errNoHandshake
+			}
+			continue
+		}
+		if b[0] == '\n' {
+			data := bytes.TrimSpace(read[len(handshakeMagic):])
+			if err = json.Unmarshal(data, v); err != nil {
+				return nil, fmt.Errorf("invalid handshake: %s", err)
+			}
+			return nil, nil
+		}
+	}
+	return nil, errors.New("handshake too long")
+}
+
+// A connection whose first reads return bytes that were already read from it.
+type prefixConn struct {
+	net.Conn
+	prefix []byte
+}
+
+func (c *prefixConn) Read(b []byte) (int, error) {
+	if len(c.prefix) > 0 {
+		n := copy(b, c.prefix)
+		c.prefix = c.prefix[n:]
+		return n, nil
+	}
+	return c.Conn.Read(b)
+}
+
+// Client side of the handshake, used by TcpOutput. Returns an error if the
+// connection should be closed.
+func clientHandshake(conn net.Conn, framing bool, schema string, timeout time.Duration,
+	policy string, logError func(error)) error {
+
+	hello := newHandshakeHello(framing)
+	hello.ProducerSchema = schema
+	conn.SetDeadline(time.Now().Add(timeout))
+	defer conn.SetDeadline(time.Time{})
+	if err := writeHandshakeLine(conn, hello); err != nil {
+		return fmt.Errorf("sending handshake: %s", err)
+	}
+	reply := new(handshakeReply)
+	if _, err := readHandshakeLine(conn, reply); err != nil {
+		return fmt.Errorf("reading handshake reply: %s", err)
+	}
+	if !reply.Accepted {
+		return fmt.Errorf("connection refused by peer: %s", reply.Error)
+	}
+	return applyMismatchPolicy(policy, hello.mismatches(reply.handshakeHello),
+		logError)
+}
+
+// Server side of the handshake, used by TcpInput. `mode` is "optional" or
+// "required". Returns the connection to read the message stream from, which
+// replays any bytes consumed while looking for a handshake, and the client's
+// producer schema, if any, or an error if the connection should be closed.
+func serverHandshake(conn net.Conn, mode string, framing bool, timeout time.Duration,
+	policy string, logError func(error)) (net.Conn, string, error) {
+
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	peer := new(handshakeHello)
+	read, err := readHandshakeLine(conn, peer)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		noHandshake := err == errNoHandshake
+		if neterr, ok := err.(net.Error); ok && neterr.Timeout() && len(read) == 0 {
+			// An idle peer, most likely an older Heka.
+			noHandshake = true
+		}
+		if noHandshake && mode == "optional" {
+			return &prefixConn{Conn: conn, prefix: read}, "", nil
+		}
+		if noHandshake {
+			return nil, "", errNoHandshake
+		}
+		return nil, "", err
+	}
+
+	reply := handshakeReply{handshakeHello: newHandshakeHello(framing)}
+	err = applyMismatchPolicy(policy, reply.mismatches(*peer), logError)
+	reply.Accepted = err == nil
+	if err != nil {
+		reply.Error = err.Error()
+	}
+	conn.SetWriteDeadline(time.Now().Add(timeout))
+	if e := writeHandshakeLine(conn, reply); e != nil && err == nil {
+		err = fmt.Errorf("sending handshake reply: %s", e)
+	}
+	conn.SetWriteDeadline(time.Time{})
+	if err != nil {
+		return nil, "", err
+	}
+	return conn, peer.ProducerSchema, nil
+}
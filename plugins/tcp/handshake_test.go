@@ -0,0 +1,114 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package tcp
+
+import (
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"io/ioutil"
+	"net"
+	"strings"
+	"time"
+)
+
+func HandshakeSpec(c gs.Context) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	timeout := time.Second
+	var logged []error
+	logError := func(err error) {
+		logged = append(logged, err)
+	}
+
+	// Runs the server side of the handshake in the background.
+	var producerSchema string
+	serve := func(mode string, framing bool, policy string) chan error {
+		result := make(chan error, 1)
+		go func() {
+			_, schema, err := serverHandshake(server, mode, framing, timeout, policy,
+				logError)
+			producerSchema = schema
+			result <- err
+		}()
+		return result
+	}
+
+	c.Specify("A handshake", func() {
+		c.Specify("succeeds between compatible peers", func() {
+			result := serve("required", true, "reject")
+			err := clientHandshake(client, true, "", timeout, "reject", logError)
+			c.Expect(err, gs.IsNil)
+			c.Expect(<-result, gs.IsNil)
+			c.Expect(len(logged), gs.Equals, 0)
+			c.Expect(producerSchema, gs.Equals, "")
+		})
+
+		c.Specify("passes the producer schema to the input", func() {
+			result := serve("required", true, "reject")
+			err := clientHandshake(client, true, "web-v2", timeout, "reject", logError)
+			c.Expect(err, gs.IsNil)
+			c.Expect(<-result, gs.IsNil)
+			c.Expect(producerSchema, gs.Equals, "web-v2")
+		})
+
+		c.Specify("reports mismatches", func() {
+			result := serve("required", false, "warn")
+			err := clientHandshake(client, true, "", timeout, "warn", logError)
+			c.Expect(err, gs.IsNil)
+			c.Expect(<-result, gs.IsNil)
+			c.Expect(len(logged), gs.Equals, 2)
+			c.Expect(strings.Contains(logged[0].Error(), "framing"), gs.IsTrue)
+		})
+
+		c.Specify("is refused on mismatch if the input's policy says so", func() {
+			result := serve("optional", false, "reject")
+			err := clientHandshake(client, true, "", timeout, "ignore", logError)
+			c.Expect(err, gs.Not(gs.IsNil))
+			c.Expect(strings.Contains(err.Error(), "refused by peer"), gs.IsTrue)
+			c.Expect(<-result, gs.Not(gs.IsNil))
+		})
+
+		c.Specify("is optional for older peers", func() {
+			result := make(chan string, 1)
+			go func() {
+				stream, _, err := serverHandshake(server, "optional", true, timeout,
+					"reject", logError)
+				if err != nil {
+					result <- err.Error()
+					return
+				}
+				data, _ := ioutil.ReadAll(stream)
+				result <- string(data)
+			}()
+			client.Write([]byte("\x1e\x02legacy stream"))
+			client.Close()
+			c.Expect(<-result, gs.Equals, "\x1e\x02legacy stream")
+		})
+
+		c.Specify("can be required", func() {
+			result := serve("required", true, "reject")
+			go client.Write([]byte("\x1e\x02legacy stream"))
+			c.Expect(<-result, gs.Equals, errNoHandshake)
+		})
+	})
+
+	c.Specify("Version compatibility ignores the patch level", func() {
+		c.Expect(majorMinor("0.9.2"), gs.Equals, "0.9")
+		hello := newHandshakeHello(true)
+		peer := newHandshakeHello(true)
+		peer.Version = "0.9.99"
+		c.Expect(len(hello.mismatches(peer)), gs.Equals, 0)
+		peer.Version = "0.10.0"
+		c.Expect(len(hello.mismatches(peer)), gs.Equals, 1)
+	})
+}
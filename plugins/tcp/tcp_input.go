@@ -64,10 +64,23 @@ type TcpInputConfig struct {
 	KeepAlive bool `toml:"keep_alive"`
 	// Integer indicating seconds between keep alives.
 	KeepAlivePeriod int `toml:"keep_alive_period"`
+	// Whether TcpOutputs must exchange versions and capabilities when they
+	// connect, "off", "optional", or "required". Defaults to "off".
+	Handshake string
+	// Milliseconds to wait for a connection's handshake. Defaults to 5000.
+	HandshakeTimeout uint `toml:"handshake_timeout"`
+	// What to do when a TcpOutput is incompatible, "ignore", "warn", or
+	// "reject". Defaults to "warn".
+	HandshakeMismatch string `toml:"handshake_mismatch"`
 }
 
 func (t *TcpInput) ConfigStruct() interface{} {
-	config := &TcpInputConfig{Net: "tcp"}
+	config := &TcpInputConfig{
+		Net:               "tcp",
+		Handshake:         "off",
+		HandshakeTimeout:  5000,
+		HandshakeMismatch: "warn",
+	}
 	config.Tls = TlsConfig{PreferServerCiphers: true}
 	return config
 }
@@ -109,12 +122,23 @@ func (t *TcpInput) Init(config interface{}) error {
 		if len(t.config.Delimiter) > 1 {
 			return fmt.Errorf("invalid delimiter: %s", t.config.Delimiter)
 		}
-	} else if t.config.ParserType != "message.proto" {
+	} else if t.config.ParserType != "message.proto" && t.config.ParserType != "json" &&
+		t.config.ParserType != "length_prefix" && t.config.ParserType != "varint" {
+
 		return fmt.Errorf("unknown parser type: %s", t.config.ParserType)
 	}
 	if t.config.KeepAlivePeriod != 0 {
 		t.keepAliveDuration = time.Duration(t.config.KeepAlivePeriod) * time.Second
 	}
+	switch t.config.Handshake {
+	case "off", "optional", "required":
+	default:
+		return fmt.Errorf("`handshake` must be 'off', 'optional', or 'required', got %s",
+			t.config.Handshake)
+	}
+	if err = validateMismatchPolicy(t.config.HandshakeMismatch); err != nil {
+		return err
+	}
 	t.stopChan = make(chan bool)
 	closeIt = false
 	return nil
@@ -143,6 +167,20 @@ func (t *TcpInput) handleConnection(conn net.Conn) {
 		t.wg.Done()
 	}()
 
+	var schema string
+	if t.config.Handshake != "off" {
+		timeout := time.Duration(t.config.HandshakeTimeout) * time.Millisecond
+		framing := t.config.ParserType == "message.proto"
+		stream, producerSchema, err := serverHandshake(conn, t.config.Handshake, framing,
+			timeout, t.config.HandshakeMismatch, t.ir.LogError)
+		if err != nil {
+			t.ir.LogError(fmt.Errorf("handshake with %s failed: %s", conn.RemoteAddr(),
+				err))
+			return
+		}
+		conn, schema = stream, producerSchema
+	}
+
 	var (
 		dr      DecoderRunner
 		decoder Decoder
@@ -177,10 +215,12 @@ func (t *TcpInput) handleConnection(conn net.Conn) {
 
 	if dr != nil {
 		deliver = func(pack *PipelinePack) {
+			pack.Schema = schema
 			dr.InChan() <- pack
 		}
 	} else if decoder != nil {
 		deliver = func(pack *PipelinePack) {
+			pack.Schema = schema
 			packs, err := decoder.Decode(pack)
 			if err != nil {
 				errMsg := err.Error()
@@ -195,12 +235,14 @@ func (t *TcpInput) handleConnection(conn net.Conn) {
 				t.ir.Inject(pack)
 			}
 			for _, p := range packs {
+				p.Schema = schema
 				t.ir.Inject(p)
 			}
 			return
 		}
 	} else {
 		deliver = func(pack *PipelinePack) {
+			pack.Schema = schema
 			t.ir.Inject(pack)
 		}
 	}
@@ -230,6 +272,14 @@ func (t *TcpInput) handleConnection(conn net.Conn) {
 		if len(t.config.Delimiter) == 1 {
 			tp.SetDelimiter(t.config.Delimiter[0])
 		}
+	case "length_prefix", "varint":
+		lp := NewLengthPrefixParser()
+		lp.SetVarint(t.config.ParserType == "varint")
+		parser = lp
+		parseFunction = NetworkPayloadParser
+	case "json":
+		parser = NewJsonParser()
+		parseFunction = NetworkPayloadParser
 	}
 
 	var err error
@@ -73,6 +73,18 @@ type TcpOutputConfig struct {
 	// Specifies action which should be executed if queue is full. Possible
 	// values are "shutdown", "drop", or "block".
 	QueueFullAction string `toml:"queue_full_action"`
+	// Whether to exchange versions and capabilities with the TcpInput when
+	// connecting. Requires the TcpInput to have its `handshake` option set.
+	Handshake bool
+	// Milliseconds to wait for the TcpInput's handshake reply. Defaults to
+	// 5000.
+	HandshakeTimeout uint `toml:"handshake_timeout"`
+	// What to do when the TcpInput is incompatible, "ignore", "warn", or
+	// "reject". Defaults to "warn".
+	HandshakeMismatch string `toml:"handshake_mismatch"`
+	// Schema identifier of the messages sent, passed to the TcpInput in the
+	// handshake so it can stamp them with it.
+	Schema string
 }
 
 func (t *TcpOutput) ConfigStruct() interface{} {
@@ -82,6 +94,8 @@ func (t *TcpOutput) ConfigStruct() interface{} {
 		Encoder:            "ProtobufEncoder",
 		QueueMaxBufferSize: 0,
 		QueueFullAction:    "shutdown",
+		HandshakeTimeout:   5000,
+		HandshakeMismatch:  "warn",
 	}
 }
 
@@ -113,7 +127,7 @@ func (t *TcpOutput) Init(config interface{}) (err error) {
 		return fmt.Errorf("`queue_full_action` must be 'shutdown', 'drop', or 'block', got %s",
 			t.conf.QueueFullAction)
 	}
-	return
+	return validateMismatchPolicy(t.conf.HandshakeMismatch)
 }
 
 func (t *TcpOutput) connect() (err error) {
@@ -142,6 +156,15 @@ func (t *TcpOutput) connect() (err error) {
 			}
 		}
 	}
+	if err == nil && t.conf.Handshake {
+		timeout := time.Duration(t.conf.HandshakeTimeout) * time.Millisecond
+		if err = clientHandshake(t.connection, t.or.UsesFraming(), t.conf.Schema,
+			timeout, t.conf.HandshakeMismatch, t.or.LogError); err != nil {
+
+			t.connection.Close()
+			err = fmt.Errorf("handshake with %s failed: %s", t.address, err)
+		}
+	}
 	return
 }
 
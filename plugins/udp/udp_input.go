@@ -131,6 +131,14 @@ func (u *UdpInput) Init(config interface{}) (err error) {
 		default:
 			return fmt.Errorf("invalid delimiter: %s", u.config.Delimiter)
 		}
+	} else if u.config.ParserType == "length_prefix" || u.config.ParserType == "varint" {
+		lp := NewLengthPrefixParser()
+		lp.SetVarint(u.config.ParserType == "varint")
+		u.parser = lp
+		u.parseFunction = NetworkPayloadParser
+	} else if u.config.ParserType == "json" {
+		u.parser = NewJsonParser()
+		u.parseFunction = NetworkPayloadParser
 	} else {
 		return fmt.Errorf("unknown parser type: %s", u.config.ParserType)
 	}
@@ -0,0 +1,571 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+// Package js runs sandboxed filters written in JavaScript, using the otto
+// interpreter, with the same API as the Lua sandbox.
+package js
+
+import (
+	"errors"
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+	"github.com/mozilla-services/heka/pipeline"
+	"github.com/mozilla-services/heka/sandbox"
+	"github.com/robertkrimen/otto"
+	"io/ioutil"
+	"log"
+	"regexp"
+	"time"
+)
+
+// The interpreter can't count instructions, so the instruction limit is
+// enforced as an execution time budget per call, allowing this long for each
+// instruction.
+const nsPerInstruction = 10
+
+var fieldNameRe = regexp.MustCompile(`^Fields\[(.+)\]$`)
+
+// Stops a call that exceeded a limit. Unlike JavaScript exceptions, it can't
+// be caught by the script.
+type termination struct {
+	msg string
+}
+
+// Script run before the filter to copy the global variables to preserve into
+// an object, and to restore them. Functions aren't preserved, and the
+// restoration is skipped if the `_PRESERVATION_VERSION` global doesn't match
+// the preserved one.
+const preservationScript = `({
+	save: function(g) {
+		var data = {};
+		for (var k in g) {
+			if (typeof g[k] !== "function") {
+				data[k] = g[k];
+			}
+		}
+		return JSON.stringify(data);
+	},
+	restore: function(g, json) {
+		var data = JSON.parse(json);
+		if (data._PRESERVATION_VERSION !== g._PRESERVATION_VERSION) {
+			return;
+		}
+		for (var k in data) {
+			g[k] = data[k];
+		}
+	}
+})`
+
+// A sandbox running a JavaScript filter.
+type JSSandbox struct {
+	vm           *otto.Otto
+	global       *otto.Object
+	script       *otto.Script
+	preservation *otto.Object
+	conf         *sandbox.SandboxConfig
+
+	injectMessage func(payload, payload_type, payload_name string) int
+	readReport    func(plugin, field string) (interface{}, bool)
+	pack          *pipeline.PipelinePack // Message being processed.
+	payload       []byte                 // Output of add_to_payload.
+	status        int
+	lastError     string
+	usage         [3][3]uint
+}
+
+// Compiles a script, which is run by Init.
+func CreateJSSandbox(conf *sandbox.SandboxConfig) (sandbox.Sandbox, error) {
+	src, err := ioutil.ReadFile(conf.ScriptFilename)
+	if err != nil {
+		return nil, err
+	}
+	sb := &JSSandbox{
+		vm:   otto.New(),
+		conf: conf,
+		injectMessage: func(p, pt, pn string) int {
+			log.Printf("payload_type: %s\npayload_name: %s\npayload: %s\n", pt, pn, p)
+			return 0
+		},
+	}
+	if sb.script, err = sb.vm.Compile(conf.ScriptFilename, src); err != nil {
+		return nil, err
+	}
+	if sb.global, err = sb.vm.Object("this"); err != nil {
+		return nil, err
+	}
+	if sb.preservation, err = sb.vm.Object(preservationScript); err != nil {
+		return nil, err
+	}
+	sb.usage[sandbox.TYPE_MEMORY][sandbox.STAT_LIMIT] = conf.MemoryLimit
+	sb.usage[sandbox.TYPE_INSTRUCTIONS][sandbox.STAT_LIMIT] = conf.InstructionLimit
+	sb.usage[sandbox.TYPE_OUTPUT][sandbox.STAT_LIMIT] = conf.OutputLimit
+
+	api := map[string]interface{}{
+		"read_message":   sb.readMessage,
+		"read_config":    sb.readConfig,
+		"read_report":    sb.readReportValue,
+		"add_to_payload": sb.addToPayload,
+		"inject_payload": sb.injectPayload,
+		"inject_message": sb.injectMessageTable,
+	}
+	for name, fn := range api {
+		if err = sb.vm.Set(name, fn); err != nil {
+			return nil, err
+		}
+	}
+	return sb, nil
+}
+
+// Throws a JavaScript exception from an API function.
+func (sb *JSSandbox) throw(format string, args ...interface{}) {
+	panic(sb.vm.MakeCustomError("Error", fmt.Sprintf(format, args...)))
+}
+
+func (sb *JSSandbox) toValue(value interface{}) otto.Value {
+	v, err := sb.vm.ToValue(value)
+	if err != nil {
+		sb.throw("%s", err)
+	}
+	return v
+}
+
+func (sb *JSSandbox) readMessage(call otto.FunctionCall) otto.Value {
+	if sb.pack == nil {
+		return otto.NullValue()
+	}
+	name, _ := call.Argument(0).ToString()
+	msg := sb.pack.Message
+	switch name {
+	case "raw":
+		return sb.toValue(string(sb.pack.MsgBytes))
+	case "Uuid":
+		return sb.toValue(msg.GetUuidString())
+	case "Type":
+		return sb.toValue(msg.GetType())
+	case "Logger":
+		return sb.toValue(msg.GetLogger())
+	case "Payload":
+		return sb.toValue(msg.GetPayload())
+	case "EnvVersion":
+		return sb.toValue(msg.GetEnvVersion())
+	case "Hostname":
+		return sb.toValue(msg.GetHostname())
+	case "Timestamp":
+		return sb.toValue(msg.GetTimestamp())
+	case "Severity":
+		return sb.toValue(msg.GetSeverity())
+	case "Pid":
+		return sb.toValue(msg.GetPid())
+	}
+	m := fieldNameRe.FindStringSubmatch(name)
+	if m == nil {
+		return otto.NullValue()
+	}
+	fi, _ := call.Argument(1).ToInteger()
+	ai, _ := call.Argument(2).ToInteger()
+	fields := msg.FindAllFields(m[1])
+	if fi < 0 || fi >= int64(len(fields)) {
+		return otto.NullValue()
+	}
+	field := fields[fi]
+	var values []interface{}
+	switch field.GetValueType() {
+	case message.Field_STRING:
+		for _, v := range field.ValueString {
+			values = append(values, v)
+		}
+	case message.Field_BYTES:
+		for _, v := range field.ValueBytes {
+			values = append(values, string(v))
+		}
+	case message.Field_INTEGER:
+		for _, v := range field.ValueInteger {
+			values = append(values, v)
+		}
+	case message.Field_DOUBLE:
+		for _, v := range field.ValueDouble {
+			values = append(values, v)
+		}
+	case message.Field_BOOL:
+		for _, v := range field.ValueBool {
+			values = append(values, v)
+		}
+	}
+	if ai < 0 || ai >= int64(len(values)) {
+		return otto.NullValue()
+	}
+	return sb.toValue(values[ai])
+}
+
+func (sb *JSSandbox) readConfig(call otto.FunctionCall) otto.Value {
+	name, _ := call.Argument(0).ToString()
+	value, ok := sb.conf.Config[name]
+	if !ok {
+		return otto.NullValue()
+	}
+	return sb.toValue(value)
+}
+
+func (sb *JSSandbox) readReportValue(call otto.FunctionCall) otto.Value {
+	plugin, _ := call.Argument(0).ToString()
+	field, _ := call.Argument(1).ToString()
+	if sb.readReport == nil {
+		return otto.NullValue()
+	}
+	value, ok := sb.readReport(plugin, field)
+	if !ok {
+		return otto.NullValue()
+	}
+	return sb.toValue(value)
+}
+
+func (sb *JSSandbox) addToPayload(call otto.FunctionCall) otto.Value {
+	sb.appendPayload(call.ArgumentList)
+	return otto.UndefinedValue()
+}
+
+// Appends values to the payload buffer, enforcing the output limit.
+func (sb *JSSandbox) appendPayload(args []otto.Value) {
+	for _, arg := range args {
+		if !arg.IsPrimitive() {
+			sb.throw("add_to_payload() only accepts primitive values")
+		}
+		s, _ := arg.ToString()
+		sb.payload = append(sb.payload, s...)
+		if uint(len(sb.payload)) > sb.conf.OutputLimit {
+			panic(termination{fmt.Sprintf("output_limit exceeded: %d", len(sb.payload))})
+		}
+	}
+}
+
+func (sb *JSSandbox) injectPayload(call otto.FunctionCall) otto.Value {
+	payloadType, payloadName := "txt", ""
+	if arg := call.Argument(0); arg.IsDefined() {
+		payloadType, _ = arg.ToString()
+	}
+	if arg := call.Argument(1); arg.IsDefined() {
+		payloadName, _ = arg.ToString()
+	}
+	if len(call.ArgumentList) > 2 {
+		sb.appendPayload(call.ArgumentList[2:])
+	}
+	payload := string(sb.payload)
+	sb.payload = sb.payload[:0]
+	sb.inject("inject_payload", payload, payloadType, payloadName)
+	return otto.UndefinedValue()
+}
+
+func (sb *JSSandbox) injectMessageTable(call otto.FunctionCall) otto.Value {
+	arg := call.Argument(0)
+	if !arg.IsObject() {
+		sb.throw("inject_message() takes a message object")
+	}
+	msg, err := sb.newMessage(arg.Object())
+	if err != nil {
+		sb.throw("inject_message() %s", err)
+	}
+	data, err := msg.Marshal()
+	if err != nil {
+		sb.throw("inject_message() %s", err)
+	}
+	sb.inject("inject_message", string(data), "", "")
+	return otto.UndefinedValue()
+}
+
+// Passes an injected message on, terminating the sandbox if it exceeds the
+// output limit or can't be injected.
+func (sb *JSSandbox) inject(fn, payload, payloadType, payloadName string) {
+	size := uint(len(payload))
+	output := &sb.usage[sandbox.TYPE_OUTPUT]
+	output[sandbox.STAT_CURRENT] = size
+	if size > output[sandbox.STAT_MAXIMUM] {
+		output[sandbox.STAT_MAXIMUM] = size
+	}
+	if size > sb.conf.OutputLimit {
+		panic(termination{fmt.Sprintf("output_limit exceeded: %d", size)})
+	}
+	if r := sb.injectMessage(payload, payloadType, payloadName); r != 0 {
+		panic(termination{fmt.Sprintf("%s() failed: %d", fn, r)})
+	}
+}
+
+// Builds a message from a JavaScript object with the structure described in
+// the Lua sandbox's inject_message documentation.
+func (sb *JSSandbox) newMessage(obj *otto.Object) (*message.Message, error) {
+	msg := new(message.Message)
+	msg.SetTimestamp(time.Now().UnixNano())
+	for _, key := range obj.Keys() {
+		value, _ := obj.Get(key)
+		var err error
+		switch key {
+		case "Type", "Logger", "Payload", "EnvVersion", "Hostname":
+			s, _ := value.ToString()
+			switch key {
+			case "Type":
+				msg.SetType(s)
+			case "Logger":
+				msg.SetLogger(s)
+			case "Payload":
+				msg.SetPayload(s)
+			case "EnvVersion":
+				msg.SetEnvVersion(s)
+			case "Hostname":
+				msg.SetHostname(s)
+			}
+		case "Timestamp", "Severity", "Pid":
+			var n int64
+			if n, err = value.ToInteger(); err != nil {
+				return nil, fmt.Errorf("invalid %s: %s", key, err)
+			}
+			switch key {
+			case "Timestamp":
+				msg.SetTimestamp(n)
+			case "Severity":
+				msg.SetSeverity(int32(n))
+			case "Pid":
+				msg.SetPid(int32(n))
+			}
+		case "Fields":
+			if !value.IsObject() {
+				return nil, errors.New("Fields must be an object")
+			}
+			if err = addFields(msg, value.Object()); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return msg, nil
+}
+
+func addFields(msg *message.Message, fields *otto.Object) error {
+	for _, name := range fields.Keys() {
+		value, _ := fields.Get(name)
+		representation := ""
+		if value.IsObject() && value.Class() != "Array" {
+			obj := value.Object()
+			if rep, _ := obj.Get("representation"); rep.IsDefined() {
+				representation, _ = rep.ToString()
+			}
+			value, _ = obj.Get("value")
+		}
+		values := []otto.Value{value}
+		if value.Class() == "Array" {
+			obj := value.Object()
+			length, _ := obj.Get("length")
+			n, _ := length.ToInteger()
+			values = make([]otto.Value, n)
+			for i := range values {
+				values[i], _ = obj.Get(fmt.Sprint(i))
+			}
+		}
+		var field *message.Field
+		for _, v := range values {
+			var gv interface{}
+			switch {
+			case v.IsString():
+				gv, _ = v.ToString()
+			case v.IsNumber():
+				gv, _ = v.ToFloat()
+			case v.IsBoolean():
+				gv, _ = v.ToBoolean()
+			default:
+				return fmt.Errorf("unsupported value for field '%s'", name)
+			}
+			var err error
+			if field == nil {
+				field, err = message.NewField(name, gv, representation)
+			} else {
+				err = field.AddValue(gv)
+			}
+			if err != nil {
+				return fmt.Errorf("field '%s': %s", name, err)
+			}
+		}
+		if field != nil {
+			msg.AddField(field)
+		}
+	}
+	return nil
+}
+
+// Calls a global function, enforcing the instruction limit as a time budget.
+// Returns the function's status, or 0 if it isn't defined and `optional` is
+// set. The function can return a status, or an array of the status and an
+// error message. Exceptions and exceeded limits terminate the sandbox and
+// return 1.
+func (sb *JSSandbox) call(name string, optional bool, args ...interface{}) (status int) {
+	if sb.status != sandbox.STATUS_RUNNING {
+		return 1
+	}
+	fn, _ := sb.global.Get(name)
+	if !fn.IsFunction() {
+		if optional {
+			return 0
+		}
+		sb.terminate(fmt.Sprintf("%s() function was not found", name))
+		return 1
+	}
+
+	var result otto.Value
+	var err error
+	start := time.Now()
+	sb.run(func() {
+		result, err = fn.Call(otto.UndefinedValue(), args...)
+	}, &err)
+	used := uint(time.Since(start) / nsPerInstruction)
+	if used > sb.conf.InstructionLimit {
+		used = sb.conf.InstructionLimit
+	}
+	instructions := &sb.usage[sandbox.TYPE_INSTRUCTIONS]
+	instructions[sandbox.STAT_CURRENT] = used
+	if used > instructions[sandbox.STAT_MAXIMUM] {
+		instructions[sandbox.STAT_MAXIMUM] = used
+	}
+	if err != nil {
+		sb.terminate(fmt.Sprintf("%s() %s", name, err))
+		return 1
+	}
+
+	msg := ""
+	if result.Class() == "Array" {
+		obj := result.Object()
+		result, _ = obj.Get("0")
+		if v, _ := obj.Get("1"); v.IsDefined() {
+			msg, _ = v.ToString()
+		}
+	}
+	if !result.IsDefined() {
+		return 0
+	}
+	r, _ := result.ToInteger()
+	if r != 0 {
+		sb.lastError = msg
+	}
+	return int(r)
+}
+
+// Runs a function in the interpreter, interrupting it once it exceeds the
+// instruction limit. Exceeded limits are reported in `err`.
+func (sb *JSSandbox) run(f func(), err *error) {
+	// A new channel for each call, so an interruption arriving after the call
+	// completed can't affect the next one.
+	interrupt := make(chan func(), 1)
+	sb.vm.Interrupt = interrupt
+	budget := time.Duration(sb.conf.InstructionLimit) * nsPerInstruction
+	timer := time.AfterFunc(budget, func() {
+		interrupt <- func() {
+			panic(termination{"instruction_limit exceeded"})
+		}
+	})
+	defer func() {
+		timer.Stop()
+		sb.payload = sb.payload[:0]
+		if r := recover(); r != nil {
+			t, ok := r.(termination)
+			if !ok {
+				panic(r)
+			}
+			*err = errors.New(t.msg)
+		}
+	}()
+	f()
+}
+
+func (sb *JSSandbox) terminate(msg string) {
+	sb.status = sandbox.STATUS_TERMINATED
+	sb.lastError = msg
+}
+
+func (sb *JSSandbox) Init(dataFile, pluginType string) (err error) {
+	if pluginType != "filter" {
+		return fmt.Errorf("Init() JavaScript sandboxes only support filters")
+	}
+	sb.status = sandbox.STATUS_RUNNING
+	sb.run(func() { _, err = sb.vm.Run(sb.script) }, &err)
+	if err == nil && dataFile != "" {
+		err = sb.restore(dataFile)
+	}
+	if err != nil {
+		sb.terminate(err.Error())
+		return fmt.Errorf("Init() %s", err)
+	}
+	return nil
+}
+
+func (sb *JSSandbox) restore(dataFile string) (err error) {
+	data, err := ioutil.ReadFile(dataFile)
+	if err != nil {
+		return fmt.Errorf("can't read preserved data: %s", err)
+	}
+	sb.run(func() {
+		_, err = sb.preservation.Call("restore", sb.global, string(data))
+	}, &err)
+	if err != nil {
+		return fmt.Errorf("restoring preserved data: %s", err)
+	}
+	return nil
+}
+
+func (sb *JSSandbox) Destroy(dataFile string) (err error) {
+	if dataFile != "" && sb.status == sandbox.STATUS_RUNNING {
+		var data otto.Value
+		sb.run(func() { data, err = sb.preservation.Call("save", sb.global) }, &err)
+		if err != nil {
+			err = fmt.Errorf("Destroy() %s", err)
+		} else {
+			s, _ := data.ToString()
+			if err = ioutil.WriteFile(dataFile, []byte(s), 0644); err != nil {
+				err = fmt.Errorf("Destroy() %s", err)
+			}
+		}
+	}
+	sb.status = sandbox.STATUS_TERMINATED
+	return
+}
+
+func (sb *JSSandbox) Status() int {
+	return sb.status
+}
+
+func (sb *JSSandbox) LastError() string {
+	return sb.lastError
+}
+
+func (sb *JSSandbox) Usage(utype, ustat int) uint {
+	if utype < 0 || utype >= len(sb.usage) || ustat < 0 || ustat >= len(sb.usage[0]) {
+		return 0
+	}
+	return sb.usage[utype][ustat]
+}
+
+func (sb *JSSandbox) ProcessMessage(pack *pipeline.PipelinePack) int {
+	sb.pack = pack
+	defer func() { sb.pack = nil }()
+	return sb.call("process_message", false)
+}
+
+func (sb *JSSandbox) TimerEvent(ns int64) int {
+	return sb.call("timer_event", true, ns)
+}
+
+func (sb *JSSandbox) WindowEvent(start, end int64) int {
+	return sb.call("window_event", true, start, end)
+}
+
+func (sb *JSSandbox) InjectMessage(f func(payload, payload_type,
+	payload_name string) int) {
+
+	sb.injectMessage = f
+}
+
+func (sb *JSSandbox) ReadReport(f func(plugin, field string) (interface{}, bool)) {
+	sb.readReport = f
+}
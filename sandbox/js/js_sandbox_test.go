@@ -0,0 +1,222 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package js_test
+
+import (
+	"code.google.com/p/go-uuid/uuid"
+	"github.com/mozilla-services/heka/message"
+	"github.com/mozilla-services/heka/pipeline"
+	. "github.com/mozilla-services/heka/sandbox"
+	"github.com/mozilla-services/heka/sandbox/js"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func getTestConfig() *SandboxConfig {
+	return &SandboxConfig{
+		ScriptType:       "js",
+		ScriptFilename:   "./testsupport/counter.js",
+		MemoryLimit:      1024 * 1024,
+		InstructionLimit: 1e6,
+		OutputLimit:      1024,
+		Config:           map[string]interface{}{"title": "Totals"},
+	}
+}
+
+func getTestPack(typ string) *pipeline.PipelinePack {
+	pack := pipeline.NewPipelinePack(nil)
+	pack.Message.SetUuid(uuid.NewRandom())
+	pack.Message.SetTimestamp(5123456789)
+	pack.Message.SetType(typ)
+	field, _ := message.NewField("reason", "testing", "")
+	pack.Message.AddField(field)
+	return pack
+}
+
+func createSandbox(t *testing.T, sbc *SandboxConfig, dataFile string) Sandbox {
+	sb, err := js.CreateJSSandbox(sbc)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if err = sb.Init(dataFile, "filter"); err != nil {
+		t.Fatalf("%s", err)
+	}
+	return sb
+}
+
+type injected struct {
+	payload, payloadType, payloadName string
+}
+
+func TestProcessMessage(t *testing.T) {
+	sb := createSandbox(t, getTestConfig(), "")
+	defer sb.Destroy("")
+	for _, typ := range []string{"a", "b", "a"} {
+		if r := sb.ProcessMessage(getTestPack(typ)); r != 0 {
+			t.Fatalf("ProcessMessage should return 0, received %d: %s", r, sb.LastError())
+		}
+	}
+	if r := sb.ProcessMessage(getTestPack("fail")); r != -1 {
+		t.Errorf("ProcessMessage should return -1, received %d", r)
+	}
+	if sb.LastError() != "failed testing" {
+		t.Errorf("expected 'failed testing', got '%s'", sb.LastError())
+	}
+	if sb.Status() != STATUS_RUNNING {
+		t.Errorf("a failed message shouldn't terminate the sandbox")
+	}
+
+	var out []injected
+	sb.InjectMessage(func(p, pt, pn string) int {
+		out = append(out, injected{p, pt, pn})
+		return 0
+	})
+	if r := sb.TimerEvent(42); r != 0 {
+		t.Fatalf("TimerEvent should return 0, received %d: %s", r, sb.LastError())
+	}
+	if len(out) != 2 {
+		t.Fatalf("expected 2 injected messages, got %d", len(out))
+	}
+	if out[0] != (injected{"Totals: 3\n", "txt", "totals"}) {
+		t.Errorf("unexpected payload %v", out[0])
+	}
+	if out[1].payloadType != "" {
+		t.Errorf("inject_message should inject a protobuf message")
+	}
+	msg := new(message.Message)
+	if err := msg.Unmarshal([]byte(out[1].payload)); err != nil {
+		t.Fatalf("%s", err)
+	}
+	if msg.GetType() != "counts" || msg.GetPayload() != `{"a":2,"b":1}` {
+		t.Errorf("unexpected message %v", msg)
+	}
+	if v, _ := msg.GetFieldValue("total"); v != float64(3) {
+		t.Errorf("expected a total of 3, got %v", v)
+	}
+	if f := msg.FindFirstField("ns"); f == nil || f.GetRepresentation() != "ns" ||
+		f.GetValue() != float64(42) {
+		t.Errorf("unexpected ns field %v", f)
+	}
+	if f := msg.FindFirstField("names"); f == nil || len(f.ValueString) != 2 {
+		t.Errorf("unexpected names field %v", f)
+	}
+	if sb.Usage(TYPE_OUTPUT, STAT_MAXIMUM) == 0 {
+		t.Errorf("maximum output should be >0")
+	}
+}
+
+func TestTermination(t *testing.T) {
+	sb := createSandbox(t, getTestConfig(), "")
+	defer sb.Destroy("")
+	if r := sb.ProcessMessage(getTestPack("throw")); r != 1 {
+		t.Errorf("ProcessMessage should return 1, received %d", r)
+	}
+	if sb.Status() != STATUS_TERMINATED {
+		t.Errorf("an exception should terminate the sandbox")
+	}
+	if !strings.Contains(sb.LastError(), "bad message") {
+		t.Errorf("unexpected error '%s'", sb.LastError())
+	}
+}
+
+func TestReadReport(t *testing.T) {
+	sb := createSandbox(t, getTestConfig(), "")
+	defer sb.Destroy("")
+	sb.(ReportReader).ReadReport(func(plugin, field string) (interface{}, bool) {
+		if plugin == "out" && field == "BufferSize" {
+			return int64(1024), true
+		}
+		return nil, false
+	})
+	if r := sb.ProcessMessage(getTestPack("report")); r != 0 {
+		t.Errorf("ProcessMessage should return 0, received %d", r)
+	}
+}
+
+func TestInstructionLimit(t *testing.T) {
+	sbc := getTestConfig()
+	sbc.InstructionLimit = 1000
+	sb := createSandbox(t, sbc, "")
+	defer sb.Destroy("")
+	if r := sb.ProcessMessage(getTestPack("loop")); r != 1 {
+		t.Errorf("ProcessMessage should return 1, received %d", r)
+	}
+	if sb.LastError() != "process_message() instruction_limit exceeded" {
+		t.Errorf("unexpected error '%s'", sb.LastError())
+	}
+	if b := sb.Usage(TYPE_INSTRUCTIONS, STAT_CURRENT); b != sbc.InstructionLimit {
+		t.Errorf("instructions used should be %d, using %d", sbc.InstructionLimit, b)
+	}
+}
+
+func TestOutputLimit(t *testing.T) {
+	sbc := getTestConfig()
+	sbc.OutputLimit = 8
+	sb := createSandbox(t, sbc, "")
+	defer sb.Destroy("")
+	sb.InjectMessage(func(p, pt, pn string) int { return 0 })
+	if r := sb.TimerEvent(0); r != 1 {
+		t.Errorf("TimerEvent should return 1, received %d", r)
+	}
+	if !strings.HasPrefix(sb.LastError(), "timer_event() output_limit exceeded") {
+		t.Errorf("unexpected error '%s'", sb.LastError())
+	}
+}
+
+func TestFailedInjection(t *testing.T) {
+	sb := createSandbox(t, getTestConfig(), "")
+	defer sb.Destroy("")
+	sb.InjectMessage(func(p, pt, pn string) int { return 3 })
+	if r := sb.TimerEvent(0); r != 1 {
+		t.Errorf("TimerEvent should return 1, received %d", r)
+	}
+	if sb.LastError() != "timer_event() inject_payload() failed: 3" {
+		t.Errorf("unexpected error '%s'", sb.LastError())
+	}
+}
+
+func TestPreserveData(t *testing.T) {
+	output := filepath.Join(os.TempDir(), "counter.js.data")
+	defer os.Remove(output)
+	sb := createSandbox(t, getTestConfig(), "")
+	sb.ProcessMessage(getTestPack("a"))
+	sb.ProcessMessage(getTestPack("b"))
+	if err := sb.Destroy(output); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	sb = createSandbox(t, getTestConfig(), output)
+	defer sb.Destroy("")
+	var payload string
+	sb.InjectMessage(func(p, pt, pn string) int {
+		if pt == "txt" {
+			payload = p
+		}
+		return 0
+	})
+	sb.TimerEvent(0)
+	if payload != "Totals: 2\n" {
+		t.Errorf("the totals should be restored, got %q", payload)
+	}
+}
+
+func TestDecodersUnsupported(t *testing.T) {
+	sb, err := js.CreateJSSandbox(getTestConfig())
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if err = sb.Init("", "decoder"); err == nil {
+		t.Errorf("decoders should be unsupported")
+	}
+}
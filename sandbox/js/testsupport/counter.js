@@ -0,0 +1,38 @@
+// Counts the messages it receives, by type, and reports the totals.
+var _PRESERVATION_VERSION = 1;
+var total = 0;
+var types = {};
+
+function process_message() {
+    var type = read_message("Type");
+    if (type === "fail") {
+        return [-1, "failed " + read_message("Fields[reason]")];
+    }
+    if (type === "loop") {
+        while (true) {}
+    }
+    if (type === "throw") {
+        throw new Error("bad message");
+    }
+    if (type === "report") {
+        return read_report("out", "BufferSize") === 1024 &&
+            read_report("out", "missing") === null ? 0 : -1;
+    }
+    total += 1;
+    types[type] = (types[type] || 0) + 1;
+    return 0;
+}
+
+function timer_event(ns) {
+    add_to_payload(read_config("title"), ": ", total, "\n");
+    inject_payload("txt", "totals");
+    inject_message({
+        Type: "counts",
+        Payload: JSON.stringify(types),
+        Fields: {
+            total: total,
+            ns: {value: ns, representation: "ns"},
+            names: Object.keys(types)
+        }
+    });
+}
@@ -13,6 +13,9 @@
 #include <lauxlib.h>
 #include <lualib.h>
 #include <time.h>
+#ifdef LUA_JITLIBNAME
+#include <luajit.h>
+#endif
 #include <lua_sandbox.h>
 #include "_cgo_export.h"
 
@@ -114,6 +117,37 @@ int timer_event(lua_sandbox* lsb, long long ns)
     return 0;
 }
 
+////////////////////////////////////////////////////////////////////////////////
+int window_event(lua_sandbox* lsb, long long start, long long end)
+{
+    static const char* func_name = "window_event";
+    lua_State* lua = lsb_get_lua(lsb);
+    if (!lua) return 1;
+
+    if (lsb_pcall_setup(lsb, func_name)) {
+        char err[LSB_ERROR_SIZE];
+        snprintf(err, LSB_ERROR_SIZE, "%s() function was not found", func_name);
+        lsb_terminate(lsb, err);
+        return 1;
+    }
+
+    lua_pushnumber(lua, start);
+    lua_pushnumber(lua, end);
+    if (lua_pcall(lua, 2, 0, 0) != 0) {
+        char err[LSB_ERROR_SIZE];
+        size_t len = snprintf(err, LSB_ERROR_SIZE, "%s() %s", func_name,
+                              lua_tostring(lua, -1));
+        if (len >= LSB_ERROR_SIZE) {
+          err[LSB_ERROR_SIZE - 1] = 0;
+        }
+        lsb_terminate(lsb, err);
+        return 1;
+    }
+    lsb_pcall_teardown(lsb);
+    lua_gc(lua, LUA_GCCOLLECT, 0);
+    return 0;
+}
+
 ////////////////////////////////////////////////////////////////////////////////
 /// Calls from Lua
 ////////////////////////////////////////////////////////////////////////////////
@@ -156,6 +190,45 @@ int read_config(lua_State* lua)
     return 1;
 }
 
+////////////////////////////////////////////////////////////////////////////////
+int read_report(lua_State* lua)
+{
+    void* luserdata = lua_touserdata(lua, lua_upvalueindex(1));
+    if (NULL == luserdata) {
+        luaL_error(lua, "read_report() invalid lightuserdata");
+    }
+    lua_sandbox* lsb = (lua_sandbox*)luserdata;
+
+    if (lua_gettop(lua) != 2) {
+        luaL_error(lua, "read_report() incorrect number of arguments");
+    }
+    const char* plugin = luaL_checkstring(lua, 1);
+    const char* field = luaL_checkstring(lua, 2);
+
+    struct go_lua_read_report_return gr;
+    gr = go_lua_read_report(lsb_get_parent(lsb), (char*)plugin, (char*)field);
+    if (gr.r1 == NULL) {
+        lua_pushnil(lua);
+    } else {
+        switch (gr.r0) {
+        case 0:
+            lua_pushlstring(lua, gr.r1, gr.r2);
+            free(gr.r1);
+            break;
+        case 3:
+            lua_pushnumber(lua, *((GoFloat64*)gr.r1));
+            break;
+        case 4:
+            lua_pushboolean(lua, *((GoInt8*)gr.r1));
+            break;
+        default:
+            lua_pushnil(lua);
+            break;
+        }
+    }
+    return 1;
+}
+
 ////////////////////////////////////////////////////////////////////////////////
 int read_message(lua_State* lua)
 {
@@ -425,7 +498,61 @@ int inject_payload(lua_State* lua)
 }
 
 ////////////////////////////////////////////////////////////////////////////////
-int sandbox_init(lua_sandbox* lsb, const char* data_file, const char* plugin_type)
+/// LuaJIT support
+////////////////////////////////////////////////////////////////////////////////
+int sandbox_luajit()
+{
+#ifdef LUA_JITLIBNAME
+    return 1;
+#else
+    return 0;
+#endif
+}
+
+#ifdef LUA_JITLIBNAME
+static void remove_module(lua_State* lua, const char* name)
+{
+    static const char* tables[] = { "loaded", "preload", NULL };
+    lua_pushnil(lua);
+    lua_setglobal(lua, name);
+    lua_getglobal(lua, LUA_LOADLIBNAME);
+    if (lua_istable(lua, -1)) {
+        for (int i = 0; tables[i]; ++i) {
+            lua_getfield(lua, -1, tables[i]);
+            if (lua_istable(lua, -1)) {
+                lua_pushnil(lua);
+                lua_setfield(lua, -2, name);
+            }
+            lua_pop(lua, 1);
+        }
+    }
+    lua_pop(lua, 1);
+}
+#endif
+
+////////////////////////////////////////////////////////////////////////////////
+int sandbox_check_memory(lua_sandbox* lsb, unsigned memory_limit)
+{
+#ifdef LUA_JITLIBNAME
+    lua_State* lua = lsb_get_lua(lsb);
+    if (!lua || memory_limit == 0) return 0;
+
+    size_t used = (size_t)lua_gc(lua, LUA_GCCOUNT, 0) * 1024
+      + lua_gc(lua, LUA_GCCOUNTB, 0);
+    if (used > memory_limit) {
+        char err[LSB_ERROR_SIZE];
+        snprintf(err, LSB_ERROR_SIZE, "memory limit exceeded (%u bytes)",
+                 memory_limit);
+        lsb_terminate(lsb, err);
+        return 1;
+    }
+#endif
+    return 0;
+}
+
+////////////////////////////////////////////////////////////////////////////////
+int sandbox_init(lua_sandbox* lsb, const char* data_file, const char* plugin_type,
+                 int jit)
 {
     static const char *output = "output";
     if (!lsb) return 1;
@@ -440,6 +567,9 @@ int sandbox_init(lua_sandbox* lsb, const char* data_file, const char* plugin_typ
         strcmp(plugin_type, "encoder") == 0) {
         lsb_add_function(lsb, &write_message, "write_message");
     }
+    if (strcmp(plugin_type, "filter") == 0) {
+        lsb_add_function(lsb, &read_report, "read_report");
+    }
 
     int result = lsb_init(lsb, data_file);
     if (result) return result;
@@ -451,5 +581,20 @@ int sandbox_init(lua_sandbox* lsb, const char* data_file, const char* plugin_typ
     lua_pushnil(lua);
     lua_setglobal(lua, output);
 
+#ifdef LUA_JITLIBNAME
+    // The FFI and the JIT controls would let a script escape the sandbox.
+    remove_module(lua, LUA_FFILIBNAME);
+    remove_module(lua, LUA_JITLIBNAME);
+    if (!jit) {
+        // Interpreted code runs the instruction count hook, keeping the
+        // instruction limit exact. Drop anything the script's main chunk
+        // already compiled.
+        luaJIT_setmode(lua, 0, LUAJIT_MODE_ENGINE | LUAJIT_MODE_OFF);
+        luaJIT_setmode(lua, 0, LUAJIT_MODE_ENGINE | LUAJIT_MODE_FLUSH);
+    }
+#else
+    (void)jit;
+#endif
+
     return 0;
 }
@@ -40,6 +40,19 @@ int process_message(lua_sandbox* lsb);
 */
 int timer_event(lua_sandbox* lsb, long long ns);
 
+/**
+* Called when an event time window has been completed by the pipeline
+* watermark. The instruction count limits are active during this call.
+*
+* @param lsb Pointer to the sandbox.
+* @param start Window start in nanoseconds since the UNIX epoch (inclusive).
+* @param end Window end in nanoseconds since the UNIX epoch (exclusive).
+*
+* @return int Zero on success, non-zero on failure.
+*
+*/
+int window_event(lua_sandbox* lsb, long long start, long long end);
+
 /**
 * Reads a configuration variable provided in the Heka toml and returns the
 * value.
@@ -59,6 +72,15 @@ int read_config(lua_State* lua);
 */
 int read_message(lua_State* lua);
 
+/**
+* Read a field of another plugin's report (filters only).
+*
+* @param lua Pointer to the Lua state.
+*
+* @return int Returns one value on the stack.
+*/
+int read_report(lua_State* lua);
+
 /**
  * Iterates through the message fields returning the type, name, value,
  * representation, and count for each field.
@@ -86,9 +108,33 @@ int inject_message(lua_State* lua);
  * @param data_file File used for the data restoration (empty or NULL for no
  *                  restoration)
  *
+ * @param plugin_type Type of the plugin running the sandbox.
+ * @param jit Non-zero to keep the LuaJIT trace compiler enabled (ignored when
+ *            not built against LuaJIT).
+ *
  * @return int 0 on success
  */
-int sandbox_init(lua_sandbox* lsb, const char* data_file, const char* plugin_type);
+int sandbox_init(lua_sandbox* lsb, const char* data_file, const char* plugin_type,
+                 int jit);
+
+/**
+ * Reports whether the sandbox was built against LuaJIT.
+ *
+ * @return int 1 for LuaJIT, 0 for the standard Lua interpreter
+ */
+int sandbox_luajit();
+
+/**
+ * Terminates the sandbox if the Lua heap exceeds the memory limit. LuaJIT
+ * doesn't use the sandbox's allocator on all platforms, so the limit is
+ * checked after each call instead (a no-op when not built against LuaJIT).
+ *
+ * @param lsb Pointer to the sandbox.
+ * @param memory_limit Maximum heap size in bytes.
+ *
+ * @return int 0 when within the limit, 1 when the sandbox was terminated
+ */
+int sandbox_check_memory(lua_sandbox* lsb, unsigned memory_limit);
 
 #endif
 
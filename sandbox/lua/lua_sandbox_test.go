@@ -23,6 +23,7 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"strings"
 	"testing"
 	"time"
 )
@@ -919,6 +920,42 @@ func TestCJson(t *testing.T) {
 	sb.Destroy("")
 }
 
+func TestReadReport(t *testing.T) {
+	var sbc SandboxConfig
+	sbc.ScriptFilename = "./testsupport/read_report.lua"
+	sbc.MemoryLimit = 32767
+	sbc.InstructionLimit = 1000
+	sb, err := lua.CreateLuaSandbox(&sbc)
+	if err != nil {
+		t.Errorf("%s", err)
+	}
+	reader, ok := sb.(ReportReader)
+	if !ok {
+		t.Fatalf("the Lua sandbox should implement ReportReader")
+	}
+	reader.ReadReport(func(plugin, field string) (interface{}, bool) {
+		if plugin != "ElasticSearchOutput" {
+			return nil, false
+		}
+		switch field {
+		case "BufferSize":
+			return int64(1024), true
+		case "name":
+			return plugin, true
+		}
+		return nil, false
+	})
+	err = sb.Init("", "filter")
+	if err != nil {
+		t.Errorf("%s", err)
+	}
+	r := sb.ProcessMessage(getTestPack())
+	if r != 0 {
+		t.Errorf("ProcessMessage should return 0, received %d %s", r, sb.LastError())
+	}
+	sb.Destroy("")
+}
+
 func TestReadNilConfig(t *testing.T) {
 	var sbc SandboxConfig
 	sbc.ScriptFilename = "./testsupport/read_config_nil.lua"
@@ -1096,6 +1133,69 @@ func TestAnomaly(t *testing.T) {
 	sb.Destroy("")
 }
 
+func TestLuaJITUnavailable(t *testing.T) {
+	if lua.LuaJITAvailable() {
+		t.Skip("built with LuaJIT")
+	}
+	var sbc SandboxConfig
+	sbc.ScriptFilename = "./testsupport/hello_world.lua"
+	sbc.MemoryLimit = 32767
+	sbc.InstructionLimit = 1000
+	sbc.LuaJIT = true
+	_, err := lua.CreateLuaSandbox(&sbc)
+	if err == nil {
+		t.Errorf("creating a JIT sandbox without LuaJIT support should fail")
+	}
+}
+
+func TestFFIUnavailable(t *testing.T) {
+	for _, jit := range []bool{false, lua.LuaJITAvailable()} {
+		var sbc SandboxConfig
+		sbc.ScriptFilename = "./testsupport/ffi.lua"
+		sbc.MemoryLimit = 1024 * 1024
+		sbc.InstructionLimit = 1000
+		sbc.LuaJIT = jit
+		sb, err := lua.CreateLuaSandbox(&sbc)
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+		if err = sb.Init("", ""); err == nil {
+			t.Errorf("Init() should fail to load the ffi module (jit %t)", jit)
+		}
+		sb.Destroy("")
+	}
+}
+
+func TestLuaJITInstructionBudget(t *testing.T) {
+	if !lua.LuaJITAvailable() {
+		t.Skip("not built with LuaJIT")
+	}
+	var sbc SandboxConfig
+	sbc.ScriptFilename = "./testsupport/busy.lua"
+	sbc.MemoryLimit = 1024 * 1024
+	sbc.InstructionLimit = 1000
+	sbc.LuaJIT = true
+	pack := getTestPack()
+	sb, err := lua.CreateLuaSandbox(&sbc)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if err = sb.Init("", ""); err != nil {
+		t.Fatalf("%s", err)
+	}
+	if r := sb.ProcessMessage(pack); r != 1 {
+		t.Errorf("ProcessMessage should return 1, received %d", r)
+	}
+	if STATUS_TERMINATED != sb.Status() {
+		t.Errorf("status should be %d, received %d",
+			STATUS_TERMINATED, sb.Status())
+	}
+	if !strings.HasPrefix(sb.LastError(), "instruction_limit exceeded") {
+		t.Errorf("unexpected error: %s", sb.LastError())
+	}
+	sb.Destroy("")
+}
+
 func TestElasticSearch(t *testing.T) {
 	var sbc SandboxConfig
 	sbc.ScriptFilename = "./testsupport/elasticsearch.lua"
@@ -1170,6 +1270,26 @@ func BenchmarkSandboxProcessMessageCounter(b *testing.B) {
 	sb.Destroy("")
 }
 
+func BenchmarkSandboxProcessMessageCounterJIT(b *testing.B) {
+	if !lua.LuaJITAvailable() {
+		b.Skip("not built with LuaJIT")
+	}
+	b.StopTimer()
+	var sbc SandboxConfig
+	sbc.ScriptFilename = "./testsupport/counter.lua"
+	sbc.MemoryLimit = 32767
+	sbc.InstructionLimit = 1000
+	sbc.LuaJIT = true
+	pack := getTestPack()
+	sb, _ := lua.CreateLuaSandbox(&sbc)
+	sb.Init("", "")
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		sb.ProcessMessage(pack)
+	}
+	sb.Destroy("")
+}
+
 func BenchmarkSandboxReadMessageString(b *testing.B) {
 	b.StopTimer()
 	var sbc SandboxConfig
@@ -1318,12 +1438,26 @@ func BenchmarkSandboxOutputMessageAsJSON(b *testing.B) {
 }
 
 func BenchmarkSandboxLpegDecoder(b *testing.B) {
+	benchmarkLpegDecoder(b, false)
+}
+
+// Compare with BenchmarkSandboxLpegDecoder for the per message cost of a
+// decoder with and without the JIT.
+func BenchmarkSandboxLpegDecoderJIT(b *testing.B) {
+	if !lua.LuaJITAvailable() {
+		b.Skip("not built with LuaJIT")
+	}
+	benchmarkLpegDecoder(b, true)
+}
+
+func benchmarkLpegDecoder(b *testing.B, jit bool) {
 	b.StopTimer()
 	var sbc SandboxConfig
 	sbc.ScriptFilename = "./testsupport/decoder.lua"
 	sbc.MemoryLimit = 1024 * 1024 * 8
 	sbc.InstructionLimit = 1e6
 	sbc.OutputLimit = 1024 * 63
+	sbc.LuaJIT = jit
 	pack := getTestPack()
 	sb, _ := lua.CreateLuaSandbox(&sbc)
 	sb.Init("", "")
@@ -0,0 +1,13 @@
+-- This Source Code Form is subject to the terms of the Mozilla Public
+-- License, v. 2.0. If a copy of the MPL was not distributed with this
+-- file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+-- A tight loop, compiled to a trace under LuaJIT so it never runs the
+-- instruction count hook.
+function process_message()
+    local sum = 0
+    for i = 1, 1e8 do
+        sum = sum + i
+    end
+    return 0
+end
@@ -0,0 +1,21 @@
+-- This Source Code Form is subject to the terms of the Mozilla Public
+-- License, v. 2.0. If a copy of the MPL was not distributed with this
+-- file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+function process_message ()
+    local size = read_report("ElasticSearchOutput", "BufferSize")
+    if size ~= 1024 then return 1, "size" end
+
+    local name = read_report("ElasticSearchOutput", "name")
+    if name ~= "ElasticSearchOutput" then return 1, "name" end
+
+    if read_report("ElasticSearchOutput", "missing") ~= nil then return 1, "field" end
+    if read_report("missing", "BufferSize") ~= nil then return 1, "plugin" end
+
+    local ok = pcall(read_report, "ElasticSearchOutput")
+    if ok then return 1, "arguments" end
+    return 0
+end
+
+function timer_event()
+end
@@ -0,0 +1,388 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package sandbox
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"regexp"
+	"strings"
+)
+
+// A pattern literal in a sandbox script that may backtrack excessively on
+// some inputs, consuming the sandbox's instruction budget or stalling the
+// plugin.
+type PatternWarning struct {
+	Line    int
+	Pattern string
+	Reason  string
+}
+
+func (w PatternWarning) String() string {
+	return fmt.Sprintf("line %d: pattern %q %s", w.Line, w.Pattern, w.Reason)
+}
+
+// Calls taking a pattern: Lua string library functions, called as functions
+// or methods, and lrexlib PCRE functions.
+var patternCallRe = regexp.MustCompile(
+	`\bstring\s*\.\s*(match|find|gmatch|gsub)\s*\(|` +
+		`:\s*(match|find|gmatch|gsub)\s*\(|` +
+		`\brex(?:_pcre)?\s*\.\s*(new|match|find|gmatch|gsub|split|count)\s*\(`)
+
+// Reads a sandbox script and checks the literal patterns it uses, see
+// CheckPatterns.
+func CheckScriptPatterns(filename string) ([]PatternWarning, error) {
+	source, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return CheckPatterns(string(source)), nil
+}
+
+// Logs the CheckScriptPatterns warnings for a sandbox plugin's script at
+// startup. Unreadable scripts are left for the sandbox itself to report.
+func LogPatternWarnings(pluginName, filename string) {
+	warnings, err := CheckScriptPatterns(filename)
+	if err != nil {
+		return
+	}
+	for _, w := range warnings {
+		log.Printf("Plugin '%s' warning: %s %s", pluginName, filename, w)
+	}
+}
+
+// Checks the literal patterns passed to the Lua string library and to PCRE
+// (lrexlib) functions in a sandbox script. Lua patterns with several
+// unbounded wildcards backtrack in polynomial time, PCRE patterns with nested
+// unbounded quantifiers in exponential time. Patterns built at runtime aren't
+// checked.
+func CheckPatterns(source string) (warnings []PatternWarning) {
+	for _, loc := range patternCallRe.FindAllStringSubmatchIndex(source, -1) {
+		// Which argument is the pattern.
+		arg, pcre := 0, false
+		switch {
+		case loc[2] != -1:
+			arg = 1
+		case loc[6] != -1:
+			pcre = true
+			if source[loc[6]:loc[7]] != "new" {
+				arg = 1
+			}
+		}
+		pattern, ok := literalArg(source, loc[1], arg)
+		if !ok {
+			continue
+		}
+		var reason string
+		if pcre {
+			reason = pcreProblem(pattern)
+		} else {
+			reason = luaPatternProblem(pattern)
+		}
+		if reason != "" {
+			line := strings.Count(source[:loc[0]], "\n") + 1
+			warnings = append(warnings, PatternWarning{line, pattern, reason})
+		}
+	}
+	return
+}
+
+// Returns the value of the specified call argument, starting at `pos` just
+// after the opening parenthesis, if it's a string literal.
+func literalArg(source string, pos, arg int) (string, bool) {
+	depth, index, argStart := 0, 0, true
+	for pos < len(source) {
+		c := source[pos]
+		switch {
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+			pos++
+			continue
+		case strings.HasPrefix(source[pos:], "--"):
+			if end := strings.IndexByte(source[pos:], '\n'); end != -1 {
+				pos += end
+			} else {
+				pos = len(source)
+			}
+			continue
+		case c == '"' || c == '\'' || c == '[':
+			value, end, ok := luaString(source, pos)
+			if ok {
+				if depth == 0 && index == arg && argStart {
+					return value, true
+				}
+				pos, argStart = end, false
+				continue
+			}
+		case c == '(' || c == '{':
+			depth++
+		case c == ')' || c == '}':
+			if depth == 0 {
+				return "", false
+			}
+			depth--
+		case c == ',' && depth == 0:
+			index++
+			if index > arg {
+				return "", false
+			}
+			pos++
+			argStart = true
+			continue
+		}
+		pos++
+		argStart = false
+	}
+	return "", false
+}
+
+var longBracketRe = regexp.MustCompile(`^\[(=*)\[`)
+
+// Parses the Lua string literal starting at `pos`, returning its value and
+// the position just after it.
+func luaString(source string, pos int) (value string, end int, ok bool) {
+	if m := longBracketRe.FindStringSubmatch(source[pos:]); m != nil {
+		start := pos + len(m[0])
+		close := "]" + m[1] + "]"
+		i := strings.Index(source[start:], close)
+		if i == -1 {
+			return "", 0, false
+		}
+		value = source[start : start+i]
+		if strings.HasPrefix(value, "\n") {
+			value = value[1:]
+		}
+		return value, start + i + len(close), true
+	}
+	quote := source[pos]
+	if quote != '"' && quote != '\'' {
+		return "", 0, false
+	}
+	buf := make([]byte, 0, 32)
+	for i := pos + 1; i < len(source); i++ {
+		c := source[i]
+		switch {
+		case c == quote:
+			return string(buf), i + 1, true
+		case c == '\n':
+			return "", 0, false
+		case c == '\\' && i+1 < len(source):
+			i++
+			switch e := source[i]; e {
+			case 'n':
+				buf = append(buf, '\n')
+			case 't':
+				buf = append(buf, '\t')
+			case 'r':
+				buf = append(buf, '\r')
+			default:
+				if e >= '0' && e <= '9' {
+					n := 0
+					for j := 0; j < 3 && i < len(source) && source[i] >= '0' &&
+						source[i] <= '9'; j++ {
+						n = n*10 + int(source[i]-'0')
+						i++
+					}
+					i--
+					buf = append(buf, byte(n))
+				} else {
+					buf = append(buf, e)
+				}
+			}
+		default:
+			buf = append(buf, c)
+		}
+	}
+	return "", 0, false
+}
+
+// Returns the index just after the Lua pattern set starting at `i`.
+func skipLuaSet(p string, i int) int {
+	i++
+	if i < len(p) && p[i] == '^' {
+		i++
+	}
+	if i < len(p) && p[i] == ']' {
+		i++
+	}
+	for i < len(p) && p[i] != ']' {
+		if p[i] == '%' {
+			i++
+		}
+		i++
+	}
+	return i + 1
+}
+
+// Lua patterns can't quantify groups, so they never backtrack exponentially,
+// but each unbounded wildcard (`.*`, `.+`, or `.-`) can multiply the work by
+// the input length when the match fails, as can an unanchored search.
+func luaPatternProblem(p string) string {
+	anchored := strings.HasPrefix(p, "^")
+	i, wildcards := 0, 0
+	if anchored {
+		i = 1
+	}
+	for i < len(p) {
+		var class string
+		switch p[i] {
+		case '(', ')':
+			i++
+			continue
+		case '%':
+			if i+1 >= len(p) {
+				return ""
+			}
+			switch p[i+1] {
+			case 'b':
+				i += 4
+				continue
+			case 'f':
+				i = skipLuaSet(p, i+2)
+				continue
+			}
+			class = p[i : i+2]
+			i += 2
+		case '[':
+			end := skipLuaSet(p, i)
+			if end > len(p) {
+				end = len(p)
+			}
+			class = p[i:end]
+			i = end
+		default:
+			class = p[i : i+1]
+			i++
+		}
+		if i < len(p) {
+			switch p[i] {
+			case '*', '+', '-':
+				if class == "." {
+					wildcards++
+				}
+				i++
+			case '?':
+				i++
+			}
+		}
+	}
+	degree := wildcards
+	if !anchored {
+		degree++
+	}
+	if wildcards < 2 || degree < 3 {
+		return ""
+	}
+	return fmt.Sprintf("has %d unbounded wildcards and may backtrack in O(n^%d) time",
+		wildcards, degree)
+}
+
+// Looks for a group containing an unbounded quantifier that is itself
+// quantified without bound, e.g. `(a+)+` or `(\w+\s?)*`, which PCRE can take
+// exponential time to fail to match.
+func pcreProblem(p string) string {
+	// For each open group, whether it contains an unbounded quantifier.
+	var groups []bool
+	var starts []int
+	// Whether the last atom was a group containing an unbounded quantifier,
+	// and where it started.
+	lastNested, lastStart := false, 0
+	unboundedAt := func(i int) (bool, int) {
+		if i >= len(p) {
+			return false, i
+		}
+		switch p[i] {
+		case '*', '+':
+			return true, i + 1
+		case '?':
+			return false, i + 1
+		case '{':
+			end := strings.IndexByte(p[i:], '}')
+			if end == -1 {
+				return false, i
+			}
+			bounds := p[i+1 : i+end]
+			return strings.HasSuffix(bounds, ","), i + end + 1
+		}
+		return false, i
+	}
+	markUnbounded := func() {
+		if len(groups) > 0 {
+			groups[len(groups)-1] = true
+		}
+	}
+	for i := 0; i < len(p); {
+		atom := true
+		nested := false
+		start := i
+		switch p[i] {
+		case '\\':
+			i += 2
+		case '[':
+			i++
+			if i < len(p) && p[i] == '^' {
+				i++
+			}
+			if i < len(p) && p[i] == ']' {
+				i++
+			}
+			for i < len(p) && p[i] != ']' {
+				if p[i] == '\\' {
+					i++
+				}
+				i++
+			}
+			i++
+		case '(':
+			groups = append(groups, false)
+			starts = append(starts, i)
+			i++
+			atom = false
+		case ')':
+			i++
+			if len(groups) == 0 {
+				break
+			}
+			nested = groups[len(groups)-1]
+			start = starts[len(starts)-1]
+			groups, starts = groups[:len(groups)-1], starts[:len(starts)-1]
+			if nested {
+				markUnbounded()
+			}
+		default:
+			i++
+		}
+		if !atom {
+			continue
+		}
+		lastNested, lastStart = nested, start
+		unbounded, next := unboundedAt(i)
+		if next == i {
+			continue
+		}
+		i = next
+		// A possessive quantifier never backtracks.
+		possessive := i < len(p) && p[i] == '+'
+		if i < len(p) && (p[i] == '?' || p[i] == '+') {
+			i++
+		}
+		if !unbounded || possessive {
+			continue
+		}
+		if lastNested && !strings.HasPrefix(p[lastStart:], "(?>") {
+			return fmt.Sprintf("has nested unbounded quantifiers in `%s` and may backtrack in exponential time",
+				p[lastStart:i])
+		}
+		markUnbounded()
+	}
+	return ""
+}
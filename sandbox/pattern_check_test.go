@@ -0,0 +1,64 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package sandbox
+
+import (
+	"testing"
+)
+
+func TestCheckPatterns(t *testing.T) {
+	source := `
+local a = string.match(line, "^(.-) (.-) (.-)$")
+local b = line:match("^(%S+) (%S+)")
+for k, v in string.gmatch(s, '(.-)=(.-)') do end
+local c = rex.match(s, "^(a+)+$")
+local d = rex.new([[(\w+\s?)*x]])
+local e = rex.new("(?>a+)+")
+local f = rex.match(s, "a++b")
+local g = string.find(s, "%d+") -- "(.-)(.-)(.-)"
+local h = string.gsub(fmt("x", "(.-)(.-)(.-)"), "%s", "")
+`
+	expected := []struct {
+		line    int
+		pattern string
+	}{
+		{2, "^(.-) (.-) (.-)$"},
+		{4, "(.-)=(.-)"},
+		{5, "^(a+)+$"},
+		{6, `(\w+\s?)*x`},
+	}
+	warnings := CheckPatterns(source)
+	if len(warnings) != len(expected) {
+		t.Fatalf("expected %d warnings, got %d: %v", len(expected), len(warnings), warnings)
+	}
+	for i, e := range expected {
+		if warnings[i].Line != e.line || warnings[i].Pattern != e.pattern {
+			t.Errorf("warning %d: expected line %d pattern %q, got %s", i, e.line,
+				e.pattern, warnings[i])
+		}
+	}
+}
+
+func TestCheckPatternsLiterals(t *testing.T) {
+	source := `local a = string.match(s, "^(.*)\t(.*)\t(.*)$")` + "\n" +
+		`local b = string.match(s, [==[^(.-)]](.-)]](.-)$]==])`
+	warnings := CheckPatterns(source)
+	if len(warnings) != 2 {
+		t.Fatalf("expected 2 warnings, got %v", warnings)
+	}
+	if warnings[0].Pattern != "^(.*)\t(.*)\t(.*)$" {
+		t.Errorf("escapes not decoded: %q", warnings[0].Pattern)
+	}
+	if warnings[1].Pattern != "^(.-)]](.-)]](.-)$" {
+		t.Errorf("long string not parsed: %q", warnings[1].Pattern)
+	}
+}
@@ -23,6 +23,7 @@ import (
 	"github.com/mozilla-services/heka/pipeline"
 	. "github.com/mozilla-services/heka/sandbox"
 	"github.com/mozilla-services/heka/sandbox/lua"
+	"github.com/mozilla-services/heka/sandbox/wasm"
 	"math/rand"
 	"os"
 	"path/filepath"
@@ -72,7 +73,10 @@ func (s *SandboxDecoder) Init(config interface{}) (err error) {
 	s.sbc = config.(*SandboxConfig)
 	globals := s.pConfig.Globals
 	s.sbc.ScriptFilename = globals.PrependShareDir(s.sbc.ScriptFilename)
-	s.sampleDenominator = globals.SampleDenominator
+	if s.sbc.ScriptType == "lua" {
+		LogPatternWarnings(s.name, s.sbc.ScriptFilename)
+	}
+	s.sampleDenominator = globals.Tunables().SampleDenominator
 
 	s.tz = time.UTC
 	if tz, ok := s.sbc.Config["tz"]; ok {
@@ -91,7 +95,7 @@ func (s *SandboxDecoder) Init(config interface{}) (err error) {
 	}
 
 	switch s.sbc.ScriptType {
-	case "lua":
+	case "lua", "wasm":
 	default:
 		return fmt.Errorf("unsupported script type: %s", s.sbc.ScriptType)
 	}
@@ -148,6 +152,8 @@ func (s *SandboxDecoder) SetDecoderRunner(dr pipeline.DecoderRunner) {
 	switch s.sbc.ScriptType {
 	case "lua":
 		s.sb, s.err = lua.CreateLuaSandbox(s.sbc)
+	case "wasm":
+		s.sb, s.err = wasm.CreateWasmSandbox(s.sbc)
 	default:
 		s.err = fmt.Errorf("unsupported script type: %s", s.sbc.ScriptType)
 	}
@@ -338,6 +344,9 @@ func init() {
 	pipeline.RegisterPlugin("SandboxFilter", func() interface{} {
 		return new(SandboxFilter)
 	})
+	pipeline.RegisterPlugin("SandboxJSFilter", func() interface{} {
+		return new(SandboxJSFilter)
+	})
 	pipeline.RegisterPlugin("SandboxManagerFilter", func() interface{} {
 		return new(SandboxManagerFilter)
 	})
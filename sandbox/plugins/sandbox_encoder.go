@@ -60,6 +60,7 @@ type SandboxEncoderConfig struct {
 	MemoryLimit      uint   `toml:"memory_limit"`
 	InstructionLimit uint   `toml:"instruction_limit"`
 	OutputLimit      uint   `toml:"output_limit"`
+	LuaJIT           bool   `toml:"lua_jit"`
 	Profile          bool
 	Config           map[string]interface{}
 }
@@ -96,12 +97,14 @@ func (s *SandboxEncoder) Init(config interface{}) (err error) {
 		MemoryLimit:      conf.MemoryLimit,
 		InstructionLimit: conf.InstructionLimit,
 		OutputLimit:      conf.OutputLimit,
+		LuaJIT:           conf.LuaJIT,
 		Profile:          conf.Profile,
 		Config:           conf.Config,
 	}
 	globals := s.pConfig.Globals
 	s.sbc.ScriptFilename = globals.PrependShareDir(s.sbc.ScriptFilename)
-	s.sampleDenominator = globals.SampleDenominator
+	sandbox.LogPatternWarnings(s.name, s.sbc.ScriptFilename)
+	s.sampleDenominator = globals.Tunables().SampleDenominator
 
 	s.tz = time.UTC
 	if tz, ok := s.sbc.Config["tz"]; ok {
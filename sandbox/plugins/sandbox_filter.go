@@ -22,7 +22,9 @@ import (
 	"github.com/mozilla-services/heka/message"
 	"github.com/mozilla-services/heka/pipeline"
 	. "github.com/mozilla-services/heka/sandbox"
+	"github.com/mozilla-services/heka/sandbox/js"
 	"github.com/mozilla-services/heka/sandbox/lua"
+	"github.com/mozilla-services/heka/sandbox/wasm"
 	"math/rand"
 	"os"
 	"path/filepath"
@@ -64,6 +66,18 @@ type SandboxFilter struct {
 	pConfig                *pipeline.PipelineConfig
 }
 
+// SandboxFilter running a JavaScript filter, i.e. with the `script_type`
+// defaulting to "js".
+type SandboxJSFilter struct {
+	SandboxFilter
+}
+
+func (this *SandboxJSFilter) ConfigStruct() interface{} {
+	conf := NewSandboxConfig(this.pConfig.Globals).(*SandboxConfig)
+	conf.ScriptType = "js"
+	return conf
+}
+
 // Heka will call this before calling any other methods to give us access to
 // the pipeline configuration.
 func (this *SandboxFilter) SetPipelineConfig(pConfig *pipeline.PipelineConfig) {
@@ -87,7 +101,10 @@ func (this *SandboxFilter) Init(config interface{}) (err error) {
 	this.sbc = config.(*SandboxConfig)
 	globals := this.pConfig.Globals
 	this.sbc.ScriptFilename = globals.PrependShareDir(this.sbc.ScriptFilename)
-	this.sampleDenominator = globals.SampleDenominator
+	if this.sbc.ScriptType == "lua" {
+		LogPatternWarnings(this.name, this.sbc.ScriptFilename)
+	}
+	this.sampleDenominator = globals.Tunables().SampleDenominator
 
 	data_dir := globals.PrependBaseDir(DATA_DIR)
 	if !fileExists(data_dir) {
@@ -103,9 +120,22 @@ func (this *SandboxFilter) Init(config interface{}) (err error) {
 		if err != nil {
 			return
 		}
+	case "wasm":
+		this.sb, err = wasm.CreateWasmSandbox(this.sbc)
+		if err != nil {
+			return
+		}
+	case "js":
+		this.sb, err = js.CreateJSSandbox(this.sbc)
+		if err != nil {
+			return
+		}
 	default:
 		return fmt.Errorf("unsupported script type: %s", this.sbc.ScriptType)
 	}
+	if reader, ok := this.sb.(ReportReader); ok {
+		reader.ReadReport(this.readReport)
+	}
 
 	this.preservationFile = filepath.Join(data_dir, this.name+DATA_EXT)
 	if this.sbc.PreserveData && fileExists(this.preservationFile) {
@@ -117,6 +147,15 @@ func (this *SandboxFilter) Init(config interface{}) (err error) {
 	return
 }
 
+// Returns a field of another plugin's report for the sandbox's `read_report`.
+func (this *SandboxFilter) readReport(plugin, field string) (interface{}, bool) {
+	msg, ok := this.pConfig.PluginReport(plugin)
+	if !ok {
+		return nil, false
+	}
+	return msg.GetFieldValue(field)
+}
+
 // Satisfies the `pipeline.ReportingPlugin` interface to provide sandbox state
 // information to the Heka report and dashboard.
 func (this *SandboxFilter) ReportMsg(msg *message.Message) error {
@@ -165,6 +204,11 @@ func (this *SandboxFilter) ReportMsg(msg *message.Message) error {
 func (this *SandboxFilter) Run(fr pipeline.FilterRunner, h pipeline.PluginHelper) (err error) {
 	inChan := fr.InChan()
 	ticker := fr.Ticker()
+	var windows <-chan pipeline.Window
+	windowHandler, _ := this.sb.(WindowHandler)
+	if wr, ok := fr.(pipeline.WindowRunner); ok && windowHandler != nil {
+		windows = wr.Windows()
+	}
 
 	var (
 		ok             = true
@@ -177,7 +221,7 @@ func (this *SandboxFilter) Run(fr pipeline.FilterRunner, h pipeline.PluginHelper
 		msgLoopCount   uint
 		injectionCount uint
 		startTime      time.Time
-		slowDuration   int64 = int64(this.pConfig.Globals.MaxMsgProcessDuration)
+		slowDuration   int64 = int64(this.pConfig.Globals.Tunables().MaxMsgProcessDuration)
 		duration       int64
 		capacity       = cap(inChan) - 1
 	)
@@ -193,7 +237,7 @@ func (this *SandboxFilter) Run(fr pipeline.FilterRunner, h pipeline.PluginHelper
 		pack := h.PipelinePack(msgLoopCount)
 		if pack == nil {
 			err = pipeline.TerminatedError(fmt.Sprintf("exceeded MaxMsgLoops = %d",
-				this.pConfig.Globals.MaxMsgLoops))
+				this.pConfig.Globals.Tunables().MaxMsgLoops))
 			return 3
 		}
 		if len(payload_type) == 0 { // heka protobuf message
@@ -230,7 +274,7 @@ func (this *SandboxFilter) Run(fr pipeline.FilterRunner, h pipeline.PluginHelper
 				break
 			}
 			atomic.AddInt64(&this.processMessageCount, 1)
-			injectionCount = this.pConfig.Globals.MaxMsgProcessInject
+			injectionCount = this.pConfig.Globals.Tunables().MaxMsgProcessInject
 			msgLoopCount = pack.MsgLoopCount
 
 			if this.manager != nil { // only check for backpressure on dynamic plugins
@@ -283,15 +327,19 @@ func (this *SandboxFilter) Run(fr pipeline.FilterRunner, h pipeline.PluginHelper
 					if len(em) > 0 {
 						fr.LogError(errors.New(em))
 					}
+					this.pConfig.DeadLetter(pack, pipeline.DeadLetterFilter, fr.Name(),
+						errors.New(em))
 				}
 				sample = 0 == rand.Intn(this.sampleDenominator)
 			} else {
 				terminated = true
+				this.pConfig.DeadLetter(pack, pipeline.DeadLetterFilter, fr.Name(),
+					errors.New(this.sb.LastError()))
 			}
 			pack.Recycle()
 
 		case t := <-ticker:
-			injectionCount = this.pConfig.Globals.MaxMsgTimerInject
+			injectionCount = this.pConfig.Globals.Tunables().MaxMsgTimerInject
 			startTime = time.Now()
 			if retval = this.sb.TimerEvent(t.UnixNano()); retval != 0 {
 				terminated = true
@@ -301,6 +349,12 @@ func (this *SandboxFilter) Run(fr pipeline.FilterRunner, h pipeline.PluginHelper
 			this.timerEventDuration += duration
 			this.timerEventSamples++
 			this.reportLock.Unlock()
+
+		case w := <-windows:
+			injectionCount = this.pConfig.Globals.Tunables().MaxMsgTimerInject
+			if retval = windowHandler.WindowEvent(w.Start, w.End); retval != 0 {
+				terminated = true
+			}
 		}
 
 		if terminated {
@@ -128,6 +128,33 @@ func FilterSpec(c gs.Context) {
 		})
 	})
 
+	c.Specify("A SandboxJSFilter", func() {
+		sbFilter := new(SandboxJSFilter)
+		sbFilter.SetPipelineConfig(pConfig)
+		config := sbFilter.ConfigStruct().(*sandbox.SandboxConfig)
+		c.Expect(config.ScriptType, gs.Equals, "js")
+		config.ScriptFilename = "../js/testsupport/counter.js"
+
+		pack := pipeline.NewPipelinePack(pConfig.InjectRecycleChan())
+		pack.Message = getTestMessage()
+		pack.Decoded = true
+
+		c.Specify("processes messages", func() {
+			var timer <-chan time.Time
+			fth.MockFilterRunner.EXPECT().Ticker().Return(timer)
+			fth.MockFilterRunner.EXPECT().InChan().Return(inChan)
+
+			err := sbFilter.Init(config)
+			c.Assume(err, gs.IsNil)
+			inChan <- pack
+			close(inChan)
+			err = sbFilter.Run(fth.MockFilterRunner, fth.MockHelper)
+			c.Expect(err, gs.IsNil)
+			c.Expect(sbFilter.processMessageCount, gs.Equals, int64(1))
+			c.Expect(sbFilter.processMessageFailures, gs.Equals, int64(0))
+		})
+	})
+
 	c.Specify("A SandboxManagerFilter", func() {
 		pConfig.Globals.BaseDir = os.TempDir()
 		sbxMgrsDir := filepath.Join(pConfig.Globals.BaseDir, "sbxmgrs")
@@ -51,6 +51,19 @@ type Sandbox interface {
 	InjectMessage(f func(payload, payload_type, payload_name string) int)
 }
 
+// Implemented by sandboxes whose scripts can handle completed event time
+// windows, see the filters' `window_interval` setting.
+type WindowHandler interface {
+	WindowEvent(start, end int64) int
+}
+
+// Implemented by sandboxes giving filters read only access to the reports of
+// other plugins through the `read_report` function. The reader returns the
+// named field of the named plugin's report.
+type ReportReader interface {
+	ReadReport(f func(plugin, field string) (value interface{}, ok bool))
+}
+
 type SandboxConfig struct {
 	ScriptType       string `toml:"script_type"`
 	ScriptFilename   string `toml:"filename"`
@@ -60,6 +73,7 @@ type SandboxConfig struct {
 	InstructionLimit uint   `toml:"instruction_limit"`
 	OutputLimit      uint   `toml:"output_limit"`
 	CanExit          bool   `toml:"can_exit"`
+	LuaJIT           bool   `toml:"lua_jit"`
 	Profile          bool
 	Config           map[string]interface{}
 	Globals          *pipeline.GlobalConfigStruct
@@ -0,0 +1,41 @@
+;; Test module counting and echoing the messages it receives.
+(module
+  (import "heka" "inject_message" (func $inject_message (param i32 i32) (result i32)))
+  (import "heka" "inject_payload"
+    (func $inject_payload (param i32 i32 i32 i32 i32 i32) (result i32)))
+  (import "heka" "set_error" (func $set_error (param i32 i32)))
+  (memory (export "memory") 1)
+  (data (i32.const 0) "txtcountmessage too large")
+  (global $count (mut i32) (i32.const 0))
+
+  (func (export "heka_alloc") (param $size i32) (result i32)
+    (i32.const 1024))
+
+  (func (export "process_message") (param $ptr i32) (param $len i32) (result i32)
+    (if (i32.gt_u (local.get $len) (i32.const 256))
+      (then
+        (call $set_error (i32.const 8) (i32.const 17))
+        (return (i32.const -1))))
+    (global.set $count (i32.add (global.get $count) (i32.const 1)))
+    (if (call $inject_message (local.get $ptr) (local.get $len))
+      (then (return (i32.const -1))))
+    (i32.const 0))
+
+  ;; Injects the count as a single byte payload.
+  (func (export "timer_event") (param $ns i64) (result i32)
+    (i32.store8 (i32.const 512) (global.get $count))
+    (call $inject_payload (i32.const 0) (i32.const 3) (i32.const 3) (i32.const 5)
+      (i32.const 512) (i32.const 1)))
+
+  ;; Loops forever, to exceed the instruction limit.
+  (func (export "window_event") (param $start i64) (param $end i64) (result i32)
+    (loop $forever (br $forever))
+    (i32.const 0))
+
+  (func (export "heka_save") (result i64)
+    (i32.store (i32.const 512) (global.get $count))
+    (i64.const 0x0000020000000004))
+
+  (func (export "heka_restore") (param $ptr i32) (param $len i32) (result i32)
+    (global.set $count (i32.load (local.get $ptr)))
+    (i32.const 0)))
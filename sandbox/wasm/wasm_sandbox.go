@@ -0,0 +1,411 @@
+// +build wasm
+
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+// Package wasm runs filters and decoders compiled to WebAssembly, as an
+// alternative to the Lua sandbox, using the Wasmtime runtime. It's only
+// included in builds with the `wasm` build tag.
+//
+// A module must export its `memory` and the following functions:
+//
+//	heka_alloc(size i32) i32
+//		Returns the address of a buffer of at least `size` bytes, which
+//		Heka fills in before calling process_message or heka_init. The
+//		buffer is only used for the duration of that call, so the same one
+//		may be returned each time.
+//	process_message(ptr i32, len i32) i32
+//		Processes a message, passed protobuf encoded. Returns 0 on success,
+//		a negative value if the message couldn't be processed, and a
+//		positive value to terminate the sandbox.
+//
+// and may export:
+//
+//	heka_init(ptr i32, len i32) i32
+//		Called once at startup with the plugin's `config` settings as a
+//		JSON object. A non-zero return value fails the initialization.
+//	timer_event(ns i64) i32
+//		Called on each ticker interval (filters only).
+//	window_event(start i64, end i64) i32
+//		Called when an event time window closes (filters only).
+//	heka_save() i64
+//		Returns the state to preserve across restarts with `preserve_data`,
+//		as a buffer address in the upper 32 bits and its length in the
+//		lower ones.
+//	heka_restore(ptr i32, len i32) i32
+//		Restores the state saved by heka_save.
+//
+// Modules can import the following functions from the "heka" module, as well
+// as WASI, without any access to the file system or network:
+//
+//	inject_message(ptr i32, len i32) i32
+//		Injects a protobuf encoded message. For decoders, the injected
+//		messages replace the decoded one. Returns non-zero on failure.
+//	inject_payload(type_ptr, type_len, name_ptr, name_len, ptr, len i32) i32
+//		Injects a message with the specified payload, `payload_type`, and
+//		`payload_name`, like the Lua sandbox's inject_payload.
+//	set_error(ptr i32, len i32)
+//		Sets the error message reported when process_message fails.
+package wasm
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/bytecodealliance/wasmtime-go"
+	"github.com/mozilla-services/heka/pipeline"
+	"github.com/mozilla-services/heka/sandbox"
+	"io/ioutil"
+	"log"
+	"strings"
+)
+
+// A sandbox running a WebAssembly module. The instruction limit is enforced
+// with Wasmtime's fuel, which is consumed roughly one unit per instruction,
+// and the memory limit caps the size of the module's linear memory.
+type WasmSandbox struct {
+	store    *wasmtime.Store
+	instance *wasmtime.Instance
+	memory   *wasmtime.Memory
+	alloc    *wasmtime.Func
+	conf     *sandbox.SandboxConfig
+
+	injectMessage func(payload, payload_type, payload_name string) int
+	status        int
+	lastError     string
+	// Error message set by the module with set_error.
+	moduleError string
+	// Fuel consumed before the current call.
+	fuelConsumed uint64
+	usage        [3][3]uint
+}
+
+// Compiles and instantiates a module, read from a `.wasm` file, or from a
+// `.wat` file in the WebAssembly text format.
+func CreateWasmSandbox(conf *sandbox.SandboxConfig) (sandbox.Sandbox, error) {
+	code, err := ioutil.ReadFile(conf.ScriptFilename)
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasSuffix(conf.ScriptFilename, ".wat") {
+		if code, err = wasmtime.Wat2Wasm(string(code)); err != nil {
+			return nil, err
+		}
+	}
+
+	config := wasmtime.NewConfig()
+	config.SetConsumeFuel(true)
+	engine := wasmtime.NewEngineWithConfig(config)
+	module, err := wasmtime.NewModule(engine, code)
+	if err != nil {
+		return nil, fmt.Errorf("can't compile module: %s", err)
+	}
+
+	sb := &WasmSandbox{
+		store: wasmtime.NewStore(engine),
+		conf:  conf,
+		injectMessage: func(p, pt, pn string) int {
+			log.Printf("payload_type: %s\npayload_name: %s\npayload: %s\n", pt, pn, p)
+			return 0
+		},
+	}
+	sb.usage[sandbox.TYPE_MEMORY][sandbox.STAT_LIMIT] = conf.MemoryLimit
+	sb.usage[sandbox.TYPE_INSTRUCTIONS][sandbox.STAT_LIMIT] = conf.InstructionLimit
+	sb.usage[sandbox.TYPE_OUTPUT][sandbox.STAT_LIMIT] = conf.OutputLimit
+	sb.store.Limiter(int64(conf.MemoryLimit), -1, -1, -1, -1)
+	sb.store.SetWasi(wasmtime.NewWasiConfig())
+	if err = sb.store.AddFuel(uint64(conf.InstructionLimit)); err != nil {
+		return nil, err
+	}
+
+	linker := wasmtime.NewLinker(engine)
+	if err = linker.DefineWasi(); err != nil {
+		return nil, err
+	}
+	if err = sb.defineImports(linker); err != nil {
+		return nil, err
+	}
+	if sb.instance, err = linker.Instantiate(sb.store, module); err != nil {
+		return nil, fmt.Errorf("can't instantiate module: %s", err)
+	}
+	if export := sb.instance.GetExport(sb.store, "memory"); export != nil {
+		sb.memory = export.Memory()
+	}
+	if sb.memory == nil {
+		return nil, errors.New("module doesn't export its memory")
+	}
+	if sb.alloc = sb.instance.GetFunc(sb.store, "heka_alloc"); sb.alloc == nil {
+		return nil, errors.New("module doesn't export heka_alloc")
+	}
+	if sb.instance.GetFunc(sb.store, "process_message") == nil {
+		return nil, errors.New("module doesn't export process_message")
+	}
+	sb.updateMemoryUsage()
+	return sb, nil
+}
+
+// Returns a slice of the module's memory, or nil if it's out of bounds.
+func (sb *WasmSandbox) bytes(data []byte, ptr, length int32) []byte {
+	if data == nil || ptr < 0 || length < 0 ||
+		int64(ptr)+int64(length) > int64(len(data)) {
+		return nil
+	}
+	return data[ptr : ptr+length]
+}
+
+func (sb *WasmSandbox) defineImports(linker *wasmtime.Linker) error {
+	memoryOf := func(caller *wasmtime.Caller) []byte {
+		export := caller.GetExport("memory")
+		if export == nil || export.Memory() == nil {
+			return nil
+		}
+		return export.Memory().UnsafeData(caller)
+	}
+	err := linker.FuncWrap("heka", "inject_message",
+		func(caller *wasmtime.Caller, ptr, length int32) (int32, *wasmtime.Trap) {
+			msg := sb.bytes(memoryOf(caller), ptr, length)
+			if msg == nil {
+				return 0, wasmtime.NewTrap("inject_message: out of bounds")
+			}
+			return sb.inject(string(msg), "", "")
+		})
+	if err != nil {
+		return err
+	}
+	err = linker.FuncWrap("heka", "inject_payload",
+		func(caller *wasmtime.Caller, typePtr, typeLen, namePtr, nameLen, ptr,
+			length int32) (int32, *wasmtime.Trap) {
+
+			data := memoryOf(caller)
+			typ := sb.bytes(data, typePtr, typeLen)
+			name := sb.bytes(data, namePtr, nameLen)
+			payload := sb.bytes(data, ptr, length)
+			if typ == nil || name == nil || payload == nil {
+				return 0, wasmtime.NewTrap("inject_payload: out of bounds")
+			}
+			payloadType := string(typ)
+			if payloadType == "" {
+				payloadType = "txt"
+			}
+			return sb.inject(string(payload), payloadType, string(name))
+		})
+	if err != nil {
+		return err
+	}
+	return linker.FuncWrap("heka", "set_error",
+		func(caller *wasmtime.Caller, ptr, length int32) {
+			if msg := sb.bytes(memoryOf(caller), ptr, length); msg != nil {
+				sb.moduleError = string(msg)
+			}
+		})
+}
+
+// Passes an injected message on, enforcing the output limit.
+func (sb *WasmSandbox) inject(payload, payloadType, payloadName string) (
+	int32, *wasmtime.Trap) {
+
+	size := uint(len(payload))
+	output := &sb.usage[sandbox.TYPE_OUTPUT]
+	output[sandbox.STAT_CURRENT] = size
+	if size > output[sandbox.STAT_MAXIMUM] {
+		output[sandbox.STAT_MAXIMUM] = size
+	}
+	if size > sb.conf.OutputLimit {
+		return 0, wasmtime.NewTrap(fmt.Sprintf("output_limit exceeded: %d", size))
+	}
+	if sb.injectMessage(payload, payloadType, payloadName) != 0 {
+		return 1, nil
+	}
+	return 0, nil
+}
+
+// Copies data into a buffer allocated by the module, returning its address.
+func (sb *WasmSandbox) copyIn(data []byte) (int32, error) {
+	result, err := sb.alloc.Call(sb.store, int32(len(data)))
+	if err != nil {
+		return 0, err
+	}
+	ptr := result.(int32)
+	buf := sb.bytes(sb.memory.UnsafeData(sb.store), ptr, int32(len(data)))
+	if buf == nil {
+		return 0, errors.New("heka_alloc returned an invalid buffer")
+	}
+	copy(buf, data)
+	return ptr, nil
+}
+
+// Calls an exported function, refilling the fuel used by the previous call
+// first. Returns the function's result, or 0 if it isn't exported and
+// `optional` is set. A trap, e.g. running out of fuel, terminates the
+// sandbox and returns 1.
+func (sb *WasmSandbox) call(name string, optional bool, args ...interface{}) int {
+	if sb.status != sandbox.STATUS_RUNNING {
+		return 1
+	}
+	fn := sb.instance.GetFunc(sb.store, name)
+	if fn == nil {
+		if optional {
+			return 0
+		}
+		sb.terminate(fmt.Sprintf("%s() function was not found", name))
+		return 1
+	}
+	sb.moduleError = ""
+	result, err := fn.Call(sb.store, args...)
+	consumed, _ := sb.store.FuelConsumed()
+	used := consumed - sb.fuelConsumed
+	sb.fuelConsumed = consumed
+	instructions := &sb.usage[sandbox.TYPE_INSTRUCTIONS]
+	instructions[sandbox.STAT_CURRENT] = uint(used)
+	if uint(used) > instructions[sandbox.STAT_MAXIMUM] {
+		instructions[sandbox.STAT_MAXIMUM] = uint(used)
+	}
+	sb.updateMemoryUsage()
+	if err != nil {
+		sb.terminate(fmt.Sprintf("%s() %s", name, err))
+		return 1
+	}
+	if fuelErr := sb.store.AddFuel(used); fuelErr != nil {
+		sb.terminate(fuelErr.Error())
+		return 1
+	}
+	r, _ := result.(int32)
+	if r != 0 {
+		sb.lastError = sb.moduleError
+	}
+	return int(r)
+}
+
+func (sb *WasmSandbox) terminate(msg string) {
+	sb.status = sandbox.STATUS_TERMINATED
+	sb.lastError = msg
+}
+
+func (sb *WasmSandbox) updateMemoryUsage() {
+	size := uint(sb.memory.DataSize(sb.store))
+	memory := &sb.usage[sandbox.TYPE_MEMORY]
+	memory[sandbox.STAT_CURRENT] = size
+	if size > memory[sandbox.STAT_MAXIMUM] {
+		memory[sandbox.STAT_MAXIMUM] = size
+	}
+}
+
+// Calls a function taking a buffer, which is copied into the module first.
+func (sb *WasmSandbox) callWithData(name string, optional bool, data []byte) int {
+	if optional && sb.instance.GetFunc(sb.store, name) == nil {
+		return 0
+	}
+	ptr, err := sb.copyIn(data)
+	if err != nil {
+		sb.terminate(fmt.Sprintf("%s() %s", name, err))
+		return 1
+	}
+	return sb.call(name, optional, ptr, int32(len(data)))
+}
+
+func (sb *WasmSandbox) Init(dataFile, pluginType string) error {
+	sb.status = sandbox.STATUS_RUNNING
+	// Reactor modules built for WASI initialize their runtime here.
+	if sb.call("_initialize", true) != 0 {
+		return fmt.Errorf("Init() %s", sb.lastError)
+	}
+	settings := sb.conf.Config
+	if settings == nil {
+		settings = map[string]interface{}{}
+	}
+	config, err := json.Marshal(settings)
+	if err != nil {
+		return fmt.Errorf("Init() can't encode config: %s", err)
+	}
+	if sb.callWithData("heka_init", true, config) != 0 {
+		sb.status = sandbox.STATUS_TERMINATED
+		return fmt.Errorf("Init() %s", sb.lastError)
+	}
+	if dataFile == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(dataFile)
+	if err != nil {
+		return fmt.Errorf("Init() can't read preserved data: %s", err)
+	}
+	if sb.callWithData("heka_restore", true, data) != 0 {
+		sb.status = sandbox.STATUS_TERMINATED
+		return fmt.Errorf("Init() restoring preserved data: %s", sb.lastError)
+	}
+	return nil
+}
+
+func (sb *WasmSandbox) Destroy(dataFile string) (err error) {
+	if dataFile != "" && sb.status == sandbox.STATUS_RUNNING &&
+		sb.instance.GetFunc(sb.store, "heka_save") != nil {
+
+		err = sb.save(dataFile)
+	}
+	sb.status = sandbox.STATUS_TERMINATED
+	sb.instance, sb.memory, sb.alloc, sb.store = nil, nil, nil, nil
+	return
+}
+
+// Writes the state returned by heka_save to the data file.
+func (sb *WasmSandbox) save(dataFile string) error {
+	result, err := sb.instance.GetFunc(sb.store, "heka_save").Call(sb.store)
+	if err != nil {
+		return fmt.Errorf("Destroy() heka_save() %s", err)
+	}
+	packed, _ := result.(int64)
+	data := sb.bytes(sb.memory.UnsafeData(sb.store), int32(packed>>32),
+		int32(packed&0xffffffff))
+	if data == nil {
+		return errors.New("Destroy() heka_save() returned an invalid buffer")
+	}
+	if err = ioutil.WriteFile(dataFile, data, 0644); err != nil {
+		return fmt.Errorf("Destroy() %s", err)
+	}
+	return nil
+}
+
+func (sb *WasmSandbox) Status() int {
+	return sb.status
+}
+
+func (sb *WasmSandbox) LastError() string {
+	return sb.lastError
+}
+
+func (sb *WasmSandbox) Usage(utype, ustat int) uint {
+	if utype < 0 || utype >= len(sb.usage) || ustat < 0 || ustat >= len(sb.usage[0]) {
+		return 0
+	}
+	return sb.usage[utype][ustat]
+}
+
+func (sb *WasmSandbox) ProcessMessage(pack *pipeline.PipelinePack) int {
+	msg, err := pack.Message.Marshal()
+	if err != nil {
+		sb.lastError = fmt.Sprintf("can't encode message: %s", err)
+		return -1
+	}
+	return sb.callWithData("process_message", false, msg)
+}
+
+func (sb *WasmSandbox) TimerEvent(ns int64) int {
+	return sb.call("timer_event", true, ns)
+}
+
+func (sb *WasmSandbox) WindowEvent(start, end int64) int {
+	return sb.call("window_event", true, start, end)
+}
+
+func (sb *WasmSandbox) InjectMessage(f func(payload, payload_type,
+	payload_name string) int) {
+
+	sb.injectMessage = f
+}
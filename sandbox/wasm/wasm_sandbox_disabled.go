@@ -0,0 +1,24 @@
+// +build !wasm
+
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package wasm
+
+import (
+	"errors"
+	"github.com/mozilla-services/heka/sandbox"
+)
+
+// Fails, this build of Heka doesn't include the Wasm runtime.
+func CreateWasmSandbox(conf *sandbox.SandboxConfig) (sandbox.Sandbox, error) {
+	return nil, errors.New("this build doesn't support wasm sandboxes, rebuild with the wasm tag")
+}
@@ -0,0 +1,211 @@
+// +build wasm
+
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# ***** END LICENSE BLOCK *****/
+
+package wasm_test
+
+import (
+	"bytes"
+	"code.google.com/p/go-uuid/uuid"
+	"github.com/mozilla-services/heka/message"
+	"github.com/mozilla-services/heka/pipeline"
+	. "github.com/mozilla-services/heka/sandbox"
+	"github.com/mozilla-services/heka/sandbox/wasm"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func getTestConfig() *SandboxConfig {
+	return &SandboxConfig{
+		ScriptType:       "wasm",
+		ScriptFilename:   "./testsupport/counter.wat",
+		MemoryLimit:      1024 * 1024,
+		InstructionLimit: 1000,
+		OutputLimit:      1024,
+	}
+}
+
+func getTestPack(payload string) *pipeline.PipelinePack {
+	pack := pipeline.NewPipelinePack(nil)
+	pack.Message.SetUuid(uuid.NewRandom())
+	pack.Message.SetTimestamp(5123456789)
+	pack.Message.SetType("TEST")
+	pack.Message.SetPayload(payload)
+	return pack
+}
+
+func createSandbox(t *testing.T, sbc *SandboxConfig) Sandbox {
+	sb, err := wasm.CreateWasmSandbox(sbc)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if err = sb.Init("", "filter"); err != nil {
+		t.Fatalf("%s", err)
+	}
+	return sb
+}
+
+func TestCreationErrors(t *testing.T) {
+	sbc := getTestConfig()
+	sbc.ScriptFilename = "./testsupport/missing.wat"
+	if _, err := wasm.CreateWasmSandbox(sbc); err == nil {
+		t.Errorf("a missing module should fail")
+	}
+
+	sbc.ScriptFilename = filepath.Join(os.TempDir(), "no_process_message.wat")
+	src := `(module (memory (export "memory") 1)
+		(func (export "heka_alloc") (param i32) (result i32) (i32.const 0)))`
+	if err := ioutil.WriteFile(sbc.ScriptFilename, []byte(src), 0644); err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer os.Remove(sbc.ScriptFilename)
+	_, err := wasm.CreateWasmSandbox(sbc)
+	if err == nil || err.Error() != "module doesn't export process_message" {
+		t.Errorf("expected a missing process_message error, got '%v'", err)
+	}
+}
+
+func TestProcessMessage(t *testing.T) {
+	sb := createSandbox(t, getTestConfig())
+	defer sb.Destroy("")
+	if sb.Usage(TYPE_MEMORY, STAT_CURRENT) != 65536 {
+		t.Errorf("memory should be one page, using %d",
+			sb.Usage(TYPE_MEMORY, STAT_CURRENT))
+	}
+
+	pack := getTestPack("hello")
+	var injected string
+	sb.InjectMessage(func(p, pt, pn string) int {
+		injected = p
+		return 0
+	})
+	if r := sb.ProcessMessage(pack); r != 0 {
+		t.Fatalf("ProcessMessage should return 0, received %d: %s", r, sb.LastError())
+	}
+	msg := new(message.Message)
+	if err := msg.Unmarshal([]byte(injected)); err != nil {
+		t.Fatalf("injected message should decode: %s", err)
+	}
+	if msg.GetPayload() != "hello" || msg.GetType() != "TEST" {
+		t.Errorf("injected message should match the original, got %v", msg)
+	}
+	if sb.Usage(TYPE_INSTRUCTIONS, STAT_CURRENT) == 0 {
+		t.Errorf("instructions used should be >0")
+	}
+	if sb.Usage(TYPE_OUTPUT, STAT_CURRENT) != uint(len(injected)) {
+		t.Errorf("output should be %d, using %d", len(injected),
+			sb.Usage(TYPE_OUTPUT, STAT_CURRENT))
+	}
+
+	pack = getTestPack(strings.Repeat("x", 300))
+	if r := sb.ProcessMessage(pack); r != -1 {
+		t.Errorf("ProcessMessage should return -1, received %d", r)
+	}
+	if sb.LastError() != "message too large" {
+		t.Errorf("expected 'message too large', got '%s'", sb.LastError())
+	}
+	if sb.Status() != STATUS_RUNNING {
+		t.Errorf("a failed message shouldn't terminate the sandbox")
+	}
+}
+
+func TestTimerEvent(t *testing.T) {
+	sb := createSandbox(t, getTestConfig())
+	defer sb.Destroy("")
+	var payload, payloadType, payloadName string
+	sb.InjectMessage(func(p, pt, pn string) int {
+		payload, payloadType, payloadName = p, pt, pn
+		return 0
+	})
+	sb.ProcessMessage(getTestPack("one"))
+	sb.ProcessMessage(getTestPack("two"))
+	if r := sb.TimerEvent(0); r != 0 {
+		t.Fatalf("TimerEvent should return 0, received %d: %s", r, sb.LastError())
+	}
+	if payload != "\x02" || payloadType != "txt" || payloadName != "count" {
+		t.Errorf("unexpected payload %q type '%s' name '%s'", payload, payloadType,
+			payloadName)
+	}
+}
+
+func TestInstructionLimit(t *testing.T) {
+	sb := createSandbox(t, getTestConfig())
+	defer sb.Destroy("")
+	if r := sb.WindowEvent(0, 1); r != 1 {
+		t.Errorf("WindowEvent should return 1, received %d", r)
+	}
+	if sb.Status() != STATUS_TERMINATED {
+		t.Errorf("the sandbox should be terminated")
+	}
+	if !strings.HasPrefix(sb.LastError(), "window_event()") {
+		t.Errorf("unexpected error '%s'", sb.LastError())
+	}
+	if r := sb.ProcessMessage(getTestPack("late")); r != 1 {
+		t.Errorf("a terminated sandbox should return 1, received %d", r)
+	}
+}
+
+func TestOutputLimit(t *testing.T) {
+	sbc := getTestConfig()
+	sbc.OutputLimit = 16
+	sb := createSandbox(t, sbc)
+	defer sb.Destroy("")
+	sb.InjectMessage(func(p, pt, pn string) int { return 0 })
+	if r := sb.ProcessMessage(getTestPack("too long for the output limit")); r != 1 {
+		t.Errorf("ProcessMessage should return 1, received %d", r)
+	}
+	if !strings.Contains(sb.LastError(), "output_limit exceeded") {
+		t.Errorf("unexpected error '%s'", sb.LastError())
+	}
+}
+
+func TestPreserveData(t *testing.T) {
+	sbc := getTestConfig()
+	output := filepath.Join(os.TempDir(), "counter.wat.data")
+	defer os.Remove(output)
+	sb := createSandbox(t, sbc)
+	sb.InjectMessage(func(p, pt, pn string) int { return 0 })
+	for i := 0; i < 3; i++ {
+		sb.ProcessMessage(getTestPack("msg"))
+	}
+	if err := sb.Destroy(output); err != nil {
+		t.Fatalf("%s", err)
+	}
+	data, err := ioutil.ReadFile(output)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if !bytes.Equal(data, []byte{3, 0, 0, 0}) {
+		t.Errorf("unexpected preserved data %v", data)
+	}
+
+	sb, err = wasm.CreateWasmSandbox(sbc)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer sb.Destroy("")
+	if err = sb.Init(output, "filter"); err != nil {
+		t.Fatalf("%s", err)
+	}
+	var payload string
+	sb.InjectMessage(func(p, pt, pn string) int {
+		payload = p
+		return 0
+	})
+	sb.TimerEvent(0)
+	if payload != "\x03" {
+		t.Errorf("the count should be restored, got %q", payload)
+	}
+}